@@ -0,0 +1,295 @@
+package access
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when changing state before Configure is called
+	ErrNotConfigured = errors.New("access: not configured")
+
+	// ErrNotAllowed is returned when a request comes from an address that is not in the
+	// allowlist for the panel or the caller's role
+	ErrNotAllowed = errors.New("access: the panel cannot be reached from your address")
+
+	// ErrBreakGlassDisabled is returned when using break glass without a token configured
+	ErrBreakGlassDisabled = errors.New("access: break glass is not enabled")
+
+	// ErrInvalidToken is returned when the break glass token is incorrect
+	ErrInvalidToken = errors.New("access: invalid break glass token")
+)
+
+// state is persisted so that maintenance windows, maintenance mode and break glass
+// grants survive a restart
+type state struct {
+	Windows []Window             `json:"windows"`
+	Mode    *Mode                `json:"mode,omitempty"`
+	Grants  map[string]time.Time `json:"grants"`
+}
+
+// Controller decides whether a request may reach the panel based on the address it came
+// from, the role of the caller and any scheduled maintenance
+type Controller struct {
+	mu     sync.Mutex
+	path   string
+	config *config.AccessConfiguration
+	allow  []*net.IPNet
+	roles  map[string][]*net.IPNet
+	state  state
+}
+
+var std *Controller
+
+// Configure parses the allowlists and loads the maintenance windows and break glass
+// grants from the data directory
+func Configure(dataDir string, c *config.AccessConfiguration) error {
+	dir := filepath.Join(dataDir, "access")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	allow, err := parseNetworks(c.Allow)
+	if err != nil {
+		return err
+	}
+
+	roles := make(map[string][]*net.IPNet)
+	for role, list := range c.Roles {
+		if roles[role], err = parseNetworks(list); err != nil {
+			return err
+		}
+	}
+
+	ctl := &Controller{
+		path:   filepath.Join(dir, "state.json"),
+		config: c,
+		allow:  allow,
+		roles:  roles,
+		state:  state{Grants: make(map[string]time.Time)},
+	}
+
+	if b, err := os.ReadFile(ctl.path); err == nil {
+		if err := json.Unmarshal(b, &ctl.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if ctl.state.Grants == nil {
+		ctl.state.Grants = make(map[string]time.Time)
+	}
+
+	std = ctl
+
+	return nil
+}
+
+// Check returns an error if a request from the address as the role should be refused.
+// An empty role only checks the global allowlist, which is used before the caller is
+// known. Administrators are let in during maintenance windows and maintenance mode,
+// everyone else receives a *MaintenanceError
+func Check(ip string, role string) error {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+
+	if !std.allowed(ip, role, now) {
+		return ErrNotAllowed
+	}
+
+	if role != "" && role != auth.RoleAdmin {
+		if m := std.state.Mode; m != nil {
+			return &MaintenanceError{Message: m.Reason, Until: m.ETA}
+		}
+
+		if w := std.active(now); w != nil {
+			return &MaintenanceError{Message: w.Message, Until: w.End}
+		}
+	}
+
+	return nil
+}
+
+// allowed returns true if the address is in the allowlists for the role. The controller
+// must be locked
+func (ctl *Controller) allowed(ip string, role string, now time.Time) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	if addr.IsLoopback() {
+		return true
+	}
+
+	if until, ok := ctl.state.Grants[addr.String()]; ok && now.Before(until) {
+		return true
+	}
+
+	if len(ctl.allow) > 0 && !contains(ctl.allow, addr) {
+		return false
+	}
+
+	if nets, ok := ctl.roles[role]; ok && role != "" && !contains(nets, addr) {
+		return false
+	}
+
+	return true
+}
+
+// BreakGlass allows the address past every allowlist for the configured duration if the
+// token matches. Every use is published as an event so that it shows up in the audit log
+func BreakGlass(token string, ip string) (time.Time, error) {
+	if std == nil {
+		return time.Time{}, ErrNotConfigured
+	}
+
+	if std.config.BreakGlassToken == "" {
+		return time.Time{}, ErrBreakGlassDisabled
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(std.config.BreakGlassToken)) != 1 {
+		return time.Time{}, ErrInvalidToken
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return time.Time{}, fmt.Errorf("access: %q is not a valid address", ip)
+	}
+
+	now := time.Now().UTC()
+	until := now.Add(time.Duration(std.config.BreakGlassDuration) * time.Second)
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for a, t := range std.state.Grants {
+		if now.After(t) {
+			delete(std.state.Grants, a)
+		}
+	}
+	std.state.Grants[addr.String()] = until
+
+	if err := std.save(); err != nil {
+		return time.Time{}, err
+	}
+
+	zap.S().Named("access").Warnw("break glass used to bypass the panel allowlist", "ip", ip, "until", until)
+
+	events.Publish(events.Event{
+		Type:     "security.access.break_glass",
+		Actor:    "break-glass",
+		SourceIP: ip,
+		Resource: addr.String(),
+		Data:     map[string]interface{}{"until": until},
+	})
+
+	return until, nil
+}
+
+// Grants returns the addresses allowed through break glass and when each grant ends
+func Grants() map[string]time.Time {
+	grants := make(map[string]time.Time)
+	if std == nil {
+		return grants
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+	for a, t := range std.state.Grants {
+		if now.Before(t) {
+			grants[a] = t
+		}
+	}
+
+	return grants
+}
+
+// RevokeGrant ends a break glass grant before it expires
+func RevokeGrant(ip string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if addr := net.ParseIP(ip); addr != nil {
+		ip = addr.String()
+	}
+
+	delete(std.state.Grants, ip)
+
+	return std.save()
+}
+
+// save writes the maintenance windows, maintenance mode and grants to disk
+func (ctl *Controller) save() error {
+	b, err := json.MarshalIndent(ctl.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ctl.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ctl.path)
+}
+
+// parseNetworks parses a list of addresses and CIDR ranges
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("access: %q is not a valid address or CIDR range", entry)
+		}
+
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return nets, nil
+}
+
+// contains returns true if any of the networks contain the address
+func contains(nets []*net.IPNet, addr net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
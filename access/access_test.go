@@ -0,0 +1,194 @@
+package access
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestAllowed(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		allow []string
+		roles map[string][]string
+		ip    string
+		role  string
+		want  bool
+	}{
+		{"no allowlist", nil, nil, "203.0.113.7", auth.RoleUser, true},
+		{"in the allowlist", []string{"203.0.113.0/24"}, nil, "203.0.113.7", "", true},
+		{"outside the allowlist", []string{"203.0.113.0/24"}, nil, "198.51.100.7", "", false},
+		{"single address", []string{"198.51.100.7"}, nil, "198.51.100.7", "", true},
+		{"next to a single address", []string{"198.51.100.7"}, nil, "198.51.100.8", "", false},
+		{"IPv4-mapped address", []string{"203.0.113.0/24"}, nil, "::ffff:203.0.113.7", "", true},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::7", "", true},
+		{"IPv6 outside", []string{"2001:db8::/32"}, nil, "2001:db9::7", "", false},
+		{"loopback outside the allowlist", []string{"203.0.113.0/24"}, nil, "127.0.0.1", "", true},
+		{"IPv6 loopback outside the allowlist", []string{"203.0.113.0/24"}, nil, "::1", "", true},
+		{"not an address", nil, nil, "example.com", "", false},
+		{"empty address", nil, nil, "", "", false},
+
+		{"role allowlist", nil, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "192.0.2.7", auth.RoleAdmin, true},
+		{"outside the role allowlist", nil, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "203.0.113.7", auth.RoleAdmin, false},
+		{"other role", nil, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "203.0.113.7", auth.RoleUser, true},
+		{"role unknown yet", nil, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "203.0.113.7", "", true},
+		{"role allowlist and outside the global one", []string{"203.0.113.0/24"}, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "192.0.2.7", auth.RoleAdmin, false},
+		{"empty role allowlist", nil, map[string][]string{auth.RoleReseller: {}}, "203.0.113.7", auth.RoleReseller, false},
+
+		{"break glass", []string{"203.0.113.0/24"}, nil, "198.51.100.9", "", true},
+		{"break glass as an admin", nil, map[string][]string{auth.RoleAdmin: {"192.0.2.0/24"}}, "198.51.100.9", auth.RoleAdmin, true},
+		{"break glass in another form", []string{"203.0.113.0/24"}, nil, "::ffff:198.51.100.9", "", true},
+		{"expired break glass", []string{"203.0.113.0/24"}, nil, "198.51.100.10", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, err := parseNetworks(tt.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			roles := make(map[string][]*net.IPNet)
+			for role, list := range tt.roles {
+				if roles[role], err = parseNetworks(list); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctl := &Controller{allow: allow, roles: roles, state: state{Grants: map[string]time.Time{
+				"198.51.100.9":  now.Add(time.Minute),
+				"198.51.100.10": now.Add(-time.Minute),
+			}}}
+
+			if got := ctl.allowed(tt.ip, tt.role, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+		ok    bool
+	}{
+		{"203.0.113.0/24", "203.0.113.0/24", true},
+		{"203.0.113.7/24", "203.0.113.0/24", true},
+		{"203.0.113.7", "203.0.113.7/32", true},
+		{"::ffff:203.0.113.7", "203.0.113.7/32", true},
+		{"2001:db8::7", "2001:db8::7/128", true},
+		{"example.com", "", false},
+		{"203.0.113.0/33", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		nets, err := parseNetworks([]string{tt.entry})
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.entry, err)
+			continue
+		}
+		if tt.ok && nets[0].String() != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.entry, nets[0], tt.want)
+		}
+	}
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		mode    *Mode
+		windows []Window
+		role    string
+		err     bool
+	}{
+		{"no maintenance", nil, nil, auth.RoleUser, false},
+		{"mode as a user", &Mode{Reason: "Upgrading"}, nil, auth.RoleUser, true},
+		{"mode as a reseller", &Mode{Reason: "Upgrading"}, nil, auth.RoleReseller, true},
+		{"mode as an admin", &Mode{Reason: "Upgrading"}, nil, auth.RoleAdmin, false},
+		{"mode before the caller is known", &Mode{Reason: "Upgrading"}, nil, "", false},
+		{"window as a user", nil, []Window{{Start: now.Add(-time.Minute), End: now.Add(time.Hour)}}, auth.RoleUser, true},
+		{"window as an admin", nil, []Window{{Start: now.Add(-time.Minute), End: now.Add(time.Hour)}}, auth.RoleAdmin, false},
+		{"window not started", nil, []Window{{Start: now.Add(time.Minute), End: now.Add(time.Hour)}}, auth.RoleUser, false},
+		{"window over", nil, []Window{{Start: now.Add(-time.Hour), End: now.Add(-time.Minute)}}, auth.RoleUser, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			std = &Controller{state: state{Mode: tt.mode, Windows: tt.windows, Grants: map[string]time.Time{}}}
+			defer func() { std = nil }()
+
+			err := Check("203.0.113.7", tt.role)
+			var m *MaintenanceError
+			if errors.As(err, &m) != tt.err {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	start := time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC)
+	w := Window{Start: start, End: start.Add(2 * time.Hour)}
+
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{start.Add(-time.Second), false},
+		{start, true},
+		{start.Add(time.Hour), true},
+		{start.Add(2*time.Hour - time.Second), true},
+		{start.Add(2 * time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		if got := w.Active(tt.at); got != tt.want {
+			t.Errorf("Active(%s) = %v, want %v", tt.at.Format(time.TimeOnly), got, tt.want)
+		}
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		token  string
+		ip     string
+		err    error
+	}{
+		{"right token", "s3cr3t-break-glass", "s3cr3t-break-glass", "198.51.100.7", nil},
+		{"wrong token", "s3cr3t-break-glass", "guess", "198.51.100.7", ErrInvalidToken},
+		{"prefix of the token", "s3cr3t-break-glass", "s3cr3t", "198.51.100.7", ErrInvalidToken},
+		{"empty token", "s3cr3t-break-glass", "", "198.51.100.7", ErrInvalidToken},
+		{"disabled", "", "", "198.51.100.7", ErrBreakGlassDisabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.AccessConfiguration{Allow: []string{"203.0.113.0/24"}, BreakGlassToken: tt.config, BreakGlassDuration: 900}
+			if err := Configure(t.TempDir(), c); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { std = nil }()
+
+			if _, err := BreakGlass(tt.token, tt.ip); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			err := Check(tt.ip, "")
+			if allowed := err == nil; allowed != (tt.err == nil) {
+				t.Errorf("the address is allowed: %v", allowed)
+			}
+		})
+	}
+}
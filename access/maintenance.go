@@ -0,0 +1,209 @@
+package access
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// ErrWindowNotFound is returned when a maintenance window with the ID does not exist
+var ErrWindowNotFound = errors.New("access: maintenance window not found")
+
+// Window is a scheduled period during which only administrators can use the panel
+type Window struct {
+	ID      string    `json:"id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Message string    `json:"message"`
+	Created time.Time `json:"created"`
+}
+
+// Active returns true if the window covers the time
+func (w *Window) Active(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+// Mode is maintenance mode, switched on by an administrator for as long as an upgrade
+// or migration takes rather than for a scheduled window
+type Mode struct {
+	Reason  string    `json:"reason"`
+	Started time.Time `json:"started"`
+	By      string    `json:"by,omitempty"`
+
+	// When the maintenance is expected to be over, zero if unknown
+	ETA time.Time `json:"eta,omitempty"`
+}
+
+// MaintenanceError is returned by Check when a non-admin request is made during a
+// maintenance window or while maintenance mode is on
+type MaintenanceError struct {
+	Message string
+
+	// When the maintenance ends or is expected to, zero if unknown
+	Until time.Time
+}
+
+func (e *MaintenanceError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+
+	if e.Until.IsZero() {
+		return "the panel is down for maintenance"
+	}
+
+	return "the panel is down for maintenance until " + e.Until.Format(time.RFC1123)
+}
+
+// Windows returns every maintenance window that has not yet ended
+func Windows() []Window {
+	if std == nil {
+		return []Window{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+	windows := []Window{}
+	for _, w := range std.state.Windows {
+		if now.Before(w.End) {
+			windows = append(windows, w)
+		}
+	}
+
+	return windows
+}
+
+// Active returns the maintenance window in effect now, or nil if there is none
+func Active() *Window {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.active(time.Now())
+}
+
+// active returns the window covering the time. The controller must be locked
+func (ctl *Controller) active(now time.Time) *Window {
+	for i := range ctl.state.Windows {
+		if ctl.state.Windows[i].Active(now) {
+			w := ctl.state.Windows[i]
+			return &w
+		}
+	}
+
+	return nil
+}
+
+// Maintenance returns maintenance mode if it is on, or nil if it is off
+func Maintenance() *Mode {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if std.state.Mode == nil {
+		return nil
+	}
+
+	m := *std.state.Mode
+	return &m
+}
+
+// EnableMaintenance turns maintenance mode on, or updates its reason and ETA if it is
+// already on. Only administrators can use the panel until it is turned off
+func EnableMaintenance(reason string, eta time.Time, by string) (Mode, error) {
+	if std == nil {
+		return Mode{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	m := Mode{Reason: reason, Started: time.Now().UTC(), By: by}
+	if !eta.IsZero() {
+		m.ETA = eta.UTC()
+	}
+
+	if std.state.Mode != nil {
+		m.Started = std.state.Mode.Started
+	}
+
+	std.state.Mode = &m
+
+	return m, std.save()
+}
+
+// DisableMaintenance turns maintenance mode off
+func DisableMaintenance() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.state.Mode = nil
+
+	return std.save()
+}
+
+// Schedule adds a maintenance window, dropping any windows that have already ended
+func Schedule(w Window) (Window, error) {
+	if std == nil {
+		return w, ErrNotConfigured
+	}
+
+	if w.Start.IsZero() {
+		w.Start = time.Now()
+	}
+
+	if !w.End.After(w.Start) {
+		return w, errors.New("access: a maintenance window must end after it starts")
+	}
+
+	w.ID = ids.New()
+	w.Start = w.Start.UTC()
+	w.End = w.End.UTC()
+	w.Created = time.Now().UTC()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+	kept := []Window{}
+	for _, existing := range std.state.Windows {
+		if now.Before(existing.End) {
+			kept = append(kept, existing)
+		}
+	}
+	std.state.Windows = append(kept, w)
+
+	return w, std.save()
+}
+
+// Cancel removes a maintenance window, ending it early if it is in effect
+func Cancel(id string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for i, w := range std.state.Windows {
+		if w.ID == id {
+			std.state.Windows = append(append([]Window{}, std.state.Windows[:i]...), std.state.Windows[i+1:]...)
+			return std.save()
+		}
+	}
+
+	return ErrWindowNotFound
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// account manages panel users from the shell, which is how the first admin is created and
+// how an admin who has locked themselves out gets back in
+func account(args []string) error {
+	var o options
+	fs := o.flags("account", "list|create|delete|unlock|password [username]")
+	email := fs.String("email", "", "The email address of a created user")
+	role := fs.String("role", auth.RoleUser, "The role of a created user, one of admin, reseller or user")
+	owner := fs.String("owner", "", "The username of the reseller a created user belongs to")
+	password := fs.String("password", "", "The password to set, read from stdin if not set")
+	force := fs.Bool("force", false, "Change users even though the daemon appears to be running")
+	dry := fs.Bool("dry-run", false, "Report what deleting a user would remove without removing it")
+	args = parse(fs, args)
+
+	action, username := arg(args, 0), strings.ToLower(arg(args, 1))
+	switch {
+	case action == "list":
+	case action == "create" || action == "delete" || action == "unlock" || action == "password":
+		if username == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Configure(c.System.Data, c.Store); err != nil {
+		return err
+	}
+
+	if err := auth.Configure(c.System.Data, c.Auth); err != nil {
+		return err
+	}
+
+	if action == "list" {
+		return listUsers(&o)
+	}
+
+	// The daemon keeps the users in memory and would overwrite changes made here the
+	// next time it saves them
+	if !*force && !*dry && daemonRunning(c) {
+		return errors.New("the daemon is running, stop it first or pass -force")
+	}
+
+	if action == "create" {
+		var ownerID string
+		if *owner != "" {
+			r, err := findUser(*owner)
+			if err != nil {
+				return err
+			}
+			ownerID = r.ID
+		}
+
+		pw, err := readPassword(*password)
+		if err != nil {
+			return err
+		}
+
+		u, err := auth.CreateUser(auth.User{Username: username, Email: *email, Role: *role, Owner: ownerID}, pw)
+		if err != nil {
+			return err
+		}
+
+		return o.print(u.Public(), func() error {
+			fmt.Printf("Created %s %s with ID %s\n", u.Role, u.Username, u.ID)
+			return nil
+		})
+	}
+
+	u, err := findUser(username)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "delete":
+		if *dry {
+			plan, err := auth.PlanDelete(u.ID)
+			if err != nil {
+				return err
+			}
+
+			return o.print(plan, func() error {
+				printPlan(plan)
+				return nil
+			})
+		}
+
+		if err := auth.DeleteUser(u.ID); err != nil {
+			return err
+		}
+
+		return o.print(u.Public(), func() error {
+			fmt.Printf("Deleted %s\n", u.Username)
+			return nil
+		})
+	case "unlock":
+		unlocked, err := auth.Unlock(u.ID)
+		if err != nil {
+			return err
+		}
+
+		return o.print(unlocked.Public(), func() error {
+			fmt.Printf("Unlocked %s\n", u.Username)
+			return nil
+		})
+	case "password":
+		pw, err := readPassword(*password)
+		if err != nil {
+			return err
+		}
+
+		updated, err := auth.UpdateUser(u.ID, func(u *auth.User) error {
+			if len(pw) < 8 {
+				return errors.New("auth: password must be at least 8 characters")
+			}
+
+			u.FailedLogins = 0
+			u.LockedUntil = time.Time{}
+
+			return u.SetPassword(pw)
+		})
+		if err != nil {
+			return err
+		}
+
+		return o.print(updated.Public(), func() error {
+			fmt.Printf("Changed the password of %s\n", u.Username)
+			return nil
+		})
+	}
+
+	return nil
+}
+
+// listUsers prints every panel user
+func listUsers(o *options) error {
+	users := auth.Users()
+
+	public := make([]auth.User, 0, len(users))
+	for _, u := range users {
+		public = append(public, u.Public())
+	}
+
+	if o.output != "table" {
+		return o.print(public, nil)
+	}
+
+	owners := make(map[string]string)
+	for _, u := range users {
+		owners[u.ID] = u.Username
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tROLE\tEMAIL\tOWNER\tSECOND FACTOR\tLOCKED")
+
+	now := time.Now()
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%t\n", u.ID, u.Username, u.Role, u.Email, owners[u.Owner], u.HasSecondFactor(), u.Locked(now))
+	}
+
+	return w.Flush()
+}
+
+// findUser returns the user with the username
+func findUser(username string) (auth.User, error) {
+	for _, u := range auth.Users() {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+
+	return auth.User{}, fmt.Errorf("%w: %s", auth.ErrUserNotFound, username)
+}
+
+// readPassword returns the password from the flag, or reads it from the first line of
+// stdin so that it does not end up in the shell history
+func readPassword(flagged string) (string, error) {
+	if flagged != "" {
+		return flagged, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// daemonRunning returns true if something is listening on the panel's address
+func daemonRunning(c *config.Configuration) bool {
+	conn, err := net.DialTimeout("tcp", dialAddress(c.Panel.Host, c.Panel.Port), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
@@ -0,0 +1,253 @@
+package addresses
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("addresses: not configured")
+
+	// ErrNoPrefixes is returned when assigning an IPv6 prefix without any configured
+	ErrNoPrefixes = errors.New("addresses: no IPv6 prefixes are configured")
+
+	// ErrExhausted is returned when every configured IPv6 prefix is fully assigned
+	ErrExhausted = errors.New("addresses: every IPv6 prefix is fully assigned")
+
+	// ErrNotFound is returned for an account that has not been assigned an IPv6 prefix
+	ErrNotFound = errors.New("addresses: the account has no IPv6 prefix")
+)
+
+// Assignment is the IPv6 prefix assigned to an account, which is a single address when
+// its length is 128
+type Assignment struct {
+	Account  string       `json:"account"`
+	Prefix   netip.Prefix `json:"prefix"`
+	Assigned time.Time    `json:"assigned"`
+}
+
+// ipv6Kind is the kind the IPv6 prefixes assigned to accounts are kept under in the
+// state store, keyed by account
+const ipv6Kind = "address.ipv6"
+
+// manager hands out subnets of the configured prefixes and the dedicated addresses to
+// accounts
+type manager struct {
+	mu        sync.Mutex
+	config    *config.NetworkConfiguration
+	shared    func() (string, string)
+	prefixes  []netip.Prefix
+	assigned  map[string]*Assignment
+	pool      []netip.Addr
+	dedicated map[string]*Dedicated
+}
+
+var std *manager
+
+// Configure parses the IPv6 prefixes and the pool of dedicated addresses and loads what
+// is assigned to accounts from the state store, which must be configured first. Domains
+// are pointed back at the shared IPv4 and IPv6 addresses of the server that shared
+// returns once their dedicated address is released
+func Configure(dataDir string, c *config.NetworkConfiguration, shared func() (string, string)) error {
+	if c.IPv6PrefixLength < 1 || c.IPv6PrefixLength > 128 {
+		return fmt.Errorf("addresses: invalid IPv6 prefix length %d, must be between 1 and 128", c.IPv6PrefixLength)
+	}
+
+	m := &manager{
+		config:    c,
+		shared:    shared,
+		assigned:  make(map[string]*Assignment),
+		dedicated: make(map[string]*Dedicated),
+	}
+
+	for _, s := range c.IPv6Prefixes {
+		p, err := netip.ParsePrefix(s)
+		if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+			return fmt.Errorf("addresses: invalid IPv6 prefix %q", s)
+		}
+
+		// Accounts are assigned the subnets after the first, so a prefix must hold two
+		if p.Bits() >= c.IPv6PrefixLength {
+			return fmt.Errorf("addresses: the IPv6 prefix %s is too small to assign /%d prefixes from", s, c.IPv6PrefixLength)
+		}
+
+		m.prefixes = append(m.prefixes, p.Masked())
+	}
+
+	pool, err := parsePool(c.Dedicated)
+	if err != nil {
+		return err
+	}
+	m.pool = pool
+
+	// Earlier releases kept the IPv6 assignments in the data directory
+	if err := store.Import(ipv6Kind, filepath.Join(dataDir, "addresses", "ipv6.json")); err != nil {
+		return err
+	}
+
+	if err := store.Load(ipv6Kind, &m.assigned); err != nil {
+		return fmt.Errorf("addresses: failed to read IPv6 assignments: %w", err)
+	}
+
+	if err := store.Load(dedicatedKind, &m.dedicated); err != nil {
+		return fmt.Errorf("addresses: failed to read dedicated addresses: %w", err)
+	}
+
+	std = m
+
+	return nil
+}
+
+// AutoAssign returns true if accounts are assigned an IPv6 prefix when they are created
+func AutoAssign() bool {
+	return std != nil && std.config.AssignIPv6 && len(std.prefixes) > 0
+}
+
+// AssignIPv6 assigns the account the first free subnet of the configured prefixes. An
+// account that already has one keeps it
+func AssignIPv6(account string) (Assignment, error) {
+	if std == nil {
+		return Assignment{}, ErrNotConfigured
+	}
+
+	if len(std.prefixes) == 0 {
+		return Assignment{}, ErrNoPrefixes
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if a, ok := std.assigned[account]; ok {
+		return *a, nil
+	}
+
+	for _, p := range std.prefixes {
+		for i := uint64(1); ; i++ {
+			s, ok := subnet(p, std.config.IPv6PrefixLength, i)
+			if !ok {
+				break
+			}
+
+			if std.overlaps(s) {
+				continue
+			}
+
+			a := &Assignment{Account: account, Prefix: s, Assigned: time.Now().UTC()}
+			std.assigned[account] = a
+
+			if err := std.save(); err != nil {
+				delete(std.assigned, account)
+				return Assignment{}, err
+			}
+
+			return *a, nil
+		}
+	}
+
+	return Assignment{}, ErrExhausted
+}
+
+// ReleaseIPv6 returns the prefix assigned to the account, which can then be assigned to
+// another account
+func ReleaseIPv6(account string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	a, ok := std.assigned[account]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(std.assigned, account)
+
+	if err := std.save(); err != nil {
+		std.assigned[account] = a
+		return err
+	}
+
+	return nil
+}
+
+// IPv6 returns the prefix assigned to the account
+func IPv6(account string) (Assignment, error) {
+	if std == nil {
+		return Assignment{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	a, ok := std.assigned[account]
+	if !ok {
+		return Assignment{}, ErrNotFound
+	}
+
+	return *a, nil
+}
+
+// IPv6Assignments returns the prefix assigned to every account, sorted by account
+func IPv6Assignments() []Assignment {
+	if std == nil {
+		return []Assignment{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := make([]Assignment, 0, len(std.assigned))
+	for _, a := range std.assigned {
+		list = append(list, *a)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+
+	return list
+}
+
+// overlaps returns true if the prefix holds an address of a prefix already assigned,
+// which ones assigned before the prefix length was changed may. The manager must be
+// locked
+func (m *manager) overlaps(p netip.Prefix) bool {
+	for _, a := range m.assigned {
+		if a.Prefix.Overlaps(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// save writes the IPv6 assignments to the state store. The manager must be locked
+func (m *manager) save() error {
+	return store.Save(ipv6Kind, m.assigned)
+}
+
+// subnet returns the i-th subnet of the length within the prefix, or false if the prefix
+// has fewer subnets
+func subnet(p netip.Prefix, length int, i uint64) (netip.Prefix, bool) {
+	if bits := length - p.Bits(); bits < 64 && i >= 1<<bits {
+		return netip.Prefix{}, false
+	}
+
+	a := p.Addr().As16()
+
+	n := new(big.Int).SetBytes(a[:])
+	n.Add(n, new(big.Int).Lsh(new(big.Int).SetUint64(i), uint(128-length)))
+	n.FillBytes(a[:])
+
+	return netip.PrefixFrom(netip.AddrFrom16(a), length), true
+}
@@ -0,0 +1,212 @@
+package addresses
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the manager with the network configuration and a state store of its
+// own, returning the data directory
+func configure(t *testing.T, c config.NetworkConfiguration) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(dir, &c, func() (string, string) { return "192.0.2.1", "2001:db8::1" }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { std = nil })
+
+	return dir
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		length   int
+		ok       bool
+	}{
+		{"subnets", []string{"2001:db8:1::/48"}, 64, true},
+		{"single addresses", []string{"2001:db8:1::/64"}, 128, true},
+		{"host bits are masked", []string{"2001:db8:1::5/48"}, 64, true},
+		{"no prefixes", nil, 64, true},
+		{"no length", []string{"2001:db8:1::/48"}, 0, false},
+		{"too long", []string{"2001:db8:1::/48"}, 129, false},
+		{"IPv4", []string{"192.0.2.0/24"}, 28, false},
+		{"IPv4 mapped", []string{"::ffff:192.0.2.0/120"}, 124, false},
+		{"not a prefix", []string{"2001:db8:1::"}, 64, false},
+		{"as long as the length", []string{"2001:db8:1::/64"}, 64, false},
+		{"longer than the length", []string{"2001:db8:1::/80"}, 64, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { std = nil }()
+
+			err := Configure(dir, &config.NetworkConfiguration{IPv6Prefixes: tt.prefixes, IPv6PrefixLength: tt.length}, nil)
+			if (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	tests := []struct {
+		prefix string
+		length int
+		i      uint64
+		want   string
+	}{
+		{"2001:db8:1::/48", 64, 0, "2001:db8:1::/64"},
+		{"2001:db8:1::/48", 64, 1, "2001:db8:1:1::/64"},
+		{"2001:db8:1::/48", 64, 0xffff, "2001:db8:1:ffff::/64"},
+		{"2001:db8:1::/48", 64, 0x10000, ""},
+		{"2001:db8:1::/64", 128, 1, "2001:db8:1::1/128"},
+		{"2001:db8:1::/126", 128, 3, "2001:db8:1::3/128"},
+		{"2001:db8:1::/126", 128, 4, ""},
+		{"2001:db8::/32", 128, 1 << 63, "2001:db8::8000:0:0:0/128"},
+		{"::/0", 128, 1<<64 - 1, "::ffff:ffff:ffff:ffff/128"},
+	}
+
+	for _, tt := range tests {
+		got, ok := subnet(netip.MustParsePrefix(tt.prefix), tt.length, tt.i)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("subnet %d of %s at /%d is %s, want none", tt.i, tt.prefix, tt.length, got)
+			}
+			continue
+		}
+
+		if !ok || got != netip.MustParsePrefix(tt.want) {
+			t.Errorf("subnet %d of %s at /%d is %s, want %s", tt.i, tt.prefix, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestAssignIPv6(t *testing.T) {
+	if _, err := AssignIPv6("alice"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("assigning before Configure: %v", err)
+	}
+
+	configure(t, config.NetworkConfiguration{IPv6Prefixes: []string{"2001:db8:1::/126", "2001:db8:2::/127"}, IPv6PrefixLength: 128})
+
+	steps := []struct {
+		name    string
+		release string
+		assign  string
+		want    string
+		err     error
+	}{
+		{"first account", "", "alice", "2001:db8:1::1/128", nil},
+		{"second account", "", "bob", "2001:db8:1::2/128", nil},
+		{"again", "", "alice", "2001:db8:1::1/128", nil},
+		{"next prefix", "", "carol", "2001:db8:1::3/128", nil},
+		{"after the first prefix", "", "dave", "2001:db8:2::1/128", nil},
+		{"exhausted", "", "erin", "", ErrExhausted},
+		{"released", "bob", "erin", "2001:db8:1::2/128", nil},
+		{"released again", "bob", "", "", ErrNotFound},
+	}
+
+	for _, s := range steps {
+		if s.release != "" {
+			err := ReleaseIPv6(s.release)
+			if s.assign == "" {
+				if !errors.Is(err, s.err) {
+					t.Errorf("%s: error %v, want %v", s.name, err, s.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+		}
+
+		a, err := AssignIPv6(s.assign)
+		if !errors.Is(err, s.err) {
+			t.Errorf("%s: error %v, want %v", s.name, err, s.err)
+			continue
+		}
+		if err == nil && a.Prefix != netip.MustParsePrefix(s.want) {
+			t.Errorf("%s: assigned %s, want %s", s.name, a.Prefix, s.want)
+		}
+	}
+
+	if _, err := IPv6("bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the released account still has %v", err)
+	}
+
+	list := IPv6Assignments()
+	if len(list) != 4 || list[0].Account != "alice" || list[3].Account != "erin" {
+		t.Errorf("assignments %+v", list)
+	}
+}
+
+func TestAssignIPv6Reload(t *testing.T) {
+	dir := configure(t, config.NetworkConfiguration{IPv6Prefixes: []string{"2001:db8:1::/48"}, IPv6PrefixLength: 64})
+
+	for _, account := range []string{"alice", "bob"} {
+		if _, err := AssignIPv6(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		prefixes []string
+		length   int
+		want     string
+	}{
+		{"longer subnets", []string{"2001:db8:1::/48"}, 56, "2001:db8:1:100::/56"},
+
+		// Subnet 1 at /63 holds the subnet of bob
+		{"subnets holding assigned ones", []string{"2001:db8:1::/48"}, 63, "2001:db8:1:4::/63"},
+
+		{"another prefix", []string{"2001:db8:2::/48"}, 64, "2001:db8:2:1::/64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.NetworkConfiguration{IPv6Prefixes: tt.prefixes, IPv6PrefixLength: tt.length}
+			if err := Configure(dir, c, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, account := range []string{"alice", "bob"} {
+				if _, err := IPv6(account); err != nil {
+					t.Errorf("%s lost the prefix: %v", account, err)
+				}
+			}
+
+			a, err := AssignIPv6("carol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Prefix != netip.MustParsePrefix(tt.want) {
+				t.Errorf("assigned %s, want %s", a.Prefix, tt.want)
+			}
+
+			for _, other := range IPv6Assignments() {
+				if other.Account != "carol" && other.Prefix.Overlaps(a.Prefix) {
+					t.Errorf("%s overlaps %s of %s", a.Prefix, other.Prefix, other.Account)
+				}
+			}
+
+			if err := ReleaseIPv6("carol"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package addresses
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrPoolExhausted is returned when every dedicated address is assigned
+	ErrPoolExhausted = errors.New("addresses: every dedicated address is assigned")
+
+	// ErrNotInPool is returned for an address that is not a dedicated one
+	ErrNotInPool = errors.New("addresses: the address is not in the pool of dedicated addresses")
+
+	// ErrInUse is returned when assigning an address another account has
+	ErrInUse = errors.New("addresses: the address is assigned to another account")
+
+	// ErrDomainInUse is returned when serving a domain on a second dedicated address of
+	// the same family, whose records would point at only one of them
+	ErrDomainInUse = errors.New("addresses: the domain is served on another dedicated address")
+
+	// ErrNotAssigned is returned for a dedicated address no account has
+	ErrNotAssigned = errors.New("addresses: the address is not assigned")
+
+	// ErrInvalid is returned for an address or domain that cannot be parsed
+	ErrInvalid = errors.New("addresses: invalid")
+)
+
+// Dedicated is an address of the pool, along with the account and domain it is assigned
+// to
+type Dedicated struct {
+	Address netip.Addr `json:"address"`
+	Account string     `json:"account,omitempty"`
+
+	// The domain served on the address, whose A or AAAA record points at it and which
+	// the address resolves back to
+	Domain string `json:"domain,omitempty"`
+
+	// Whether the records of the domain and the reverse DNS of the address are published
+	// through a DNS provider. Those served elsewhere are changed by hand
+	DNS        bool `json:"dns"`
+	ReverseDNS bool `json:"reverse_dns"`
+
+	// Why publishing a record failed
+	Error string `json:"error,omitempty"`
+
+	Assigned time.Time `json:"assigned"`
+}
+
+// dedicatedKind is the kind the assigned dedicated addresses are kept under in the state
+// store, keyed by address
+const dedicatedKind = "address.dedicated"
+
+// The shortest networks the pool may list, so that a routed IPv6 prefix is not mistaken
+// for a list of addresses
+const (
+	maxPool4 = 22
+	maxPool6 = 118
+)
+
+// Pool returns every dedicated address, those that are free without an account, sorted
+// by address. Addresses still assigned after they were removed from the pool are
+// included
+func Pool() []Dedicated {
+	if std == nil {
+		return []Dedicated{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := make([]Dedicated, 0, len(std.pool))
+	for _, a := range std.pool {
+		if d, ok := std.dedicated[a.String()]; ok {
+			list = append(list, *d)
+		} else {
+			list = append(list, Dedicated{Address: a})
+		}
+	}
+
+	for _, d := range std.dedicated {
+		if !std.inPool(d.Address) {
+			list = append(list, *d)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Address.Less(list[j].Address) })
+
+	return list
+}
+
+// DedicatedOf returns the dedicated addresses assigned to the account, sorted by address
+func DedicatedOf(account string) []Dedicated {
+	list := []Dedicated{}
+	for _, d := range Pool() {
+		if d.Account == account {
+			list = append(list, d)
+		}
+	}
+
+	return list
+}
+
+// GetDedicated returns the dedicated address
+func GetDedicated(address string) (Dedicated, error) {
+	if std == nil {
+		return Dedicated{}, ErrNotConfigured
+	}
+
+	a, err := parseAddr(address)
+	if err != nil {
+		return Dedicated{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if d, ok := std.dedicated[a.String()]; ok {
+		return *d, nil
+	}
+
+	if !std.inPool(a) {
+		return Dedicated{}, ErrNotInPool
+	}
+
+	return Dedicated{Address: a}, nil
+}
+
+// AssignDedicated assigns the account the address, or the first free one when it is
+// empty, preferring IPv4. The domain, if any, is pointed at the address and the address
+// back at the domain. Assigning an address the account already has moves it to the
+// domain
+func AssignDedicated(account string, address string, domain string) (Dedicated, error) {
+	if std == nil {
+		return Dedicated{}, ErrNotConfigured
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if domain != "" && !hostname.Valid(domain) {
+		return Dedicated{}, fmt.Errorf("%w domain %q", ErrInvalid, domain)
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var a netip.Addr
+	if address == "" {
+		free, ok := std.free()
+		if !ok {
+			return Dedicated{}, ErrPoolExhausted
+		}
+		a = free
+	} else {
+		var err error
+		if a, err = parseAddr(address); err != nil {
+			return Dedicated{}, err
+		}
+	}
+
+	before, assigned := std.dedicated[a.String()]
+	switch {
+	case assigned && before.Account != account:
+		return Dedicated{}, ErrInUse
+	case !assigned && !std.inPool(a):
+		return Dedicated{}, ErrNotInPool
+	}
+
+	if domain != "" {
+		for _, other := range std.dedicated {
+			if other.Domain == domain && other.Address != a && other.Address.Is4() == a.Is4() {
+				return Dedicated{}, fmt.Errorf("%w %s", ErrDomainInUse, other.Address)
+			}
+		}
+	}
+
+	d := Dedicated{Address: a, Account: account, Domain: domain, Assigned: time.Now().UTC()}
+	if assigned {
+		d.Assigned = before.Assigned
+
+		if before.Domain != domain {
+			std.unpublish(before)
+		} else {
+			d.DNS, d.ReverseDNS, d.Error = before.DNS, before.ReverseDNS, before.Error
+		}
+	}
+
+	// Records that failed to publish are tried again
+	if domain != "" && (!assigned || before.Domain != domain || before.Error != "") {
+		std.publish(&d)
+	}
+
+	if err := std.put(d); err != nil {
+		return Dedicated{}, err
+	}
+
+	return d, nil
+}
+
+// ReleaseDedicated returns the address to the pool, pointing its domain back at the
+// shared address of the server
+func ReleaseDedicated(address string) (Dedicated, error) {
+	if std == nil {
+		return Dedicated{}, ErrNotConfigured
+	}
+
+	a, err := parseAddr(address)
+	if err != nil {
+		return Dedicated{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, ok := std.dedicated[a.String()]
+	if !ok {
+		return Dedicated{}, ErrNotAssigned
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(dedicatedKind, a.String())
+	})
+	if err != nil {
+		return Dedicated{}, err
+	}
+
+	delete(std.dedicated, a.String())
+	std.unpublish(d)
+
+	return *d, nil
+}
+
+// ReleaseAccount returns every dedicated address of the account to the pool
+func ReleaseAccount(account string) ([]Dedicated, error) {
+	var released []Dedicated
+	for _, d := range DedicatedOf(account) {
+		if _, err := ReleaseDedicated(d.Address.String()); err != nil {
+			return released, err
+		}
+		released = append(released, d)
+	}
+
+	return released, nil
+}
+
+// publish points the domain of the address at it and the address back at the domain,
+// recording what was published. Names served by no DNS provider are left alone
+func (m *manager) publish(d *Dedicated) {
+	var errs []error
+
+	_, err := externaldns.Set(externaldns.RecordSet{Name: d.Domain, Type: recordType(d.Address), Values: []string{d.Address.String()}})
+	d.DNS = err == nil
+	if err != nil && !errors.Is(err, externaldns.ErrNoProvider) {
+		errs = append(errs, err)
+	}
+
+	_, err = externaldns.Set(externaldns.RecordSet{Name: reverseName(d.Address), Type: externaldns.PTR, Values: []string{d.Domain}})
+	d.ReverseDNS = err == nil
+	if err != nil && !errors.Is(err, externaldns.ErrNoProvider) {
+		errs = append(errs, err)
+	}
+
+	d.Error = ""
+	if err := errors.Join(errs...); err != nil {
+		d.Error = err.Error()
+	}
+}
+
+// unpublish points the domain of the address back at the shared address of the server
+// and removes the reverse DNS of the address, for the records that were published
+func (m *manager) unpublish(d *Dedicated) {
+	if d.DNS {
+		typ := recordType(d.Address)
+
+		v4, v6 := m.shared()
+		shared := v4
+		if typ == externaldns.AAAA {
+			shared = v6
+		}
+
+		var err error
+		if shared != "" {
+			_, err = externaldns.Set(externaldns.RecordSet{Name: d.Domain, Type: typ, Values: []string{shared}})
+		} else {
+			err = externaldns.Delete(d.Domain, typ)
+		}
+		if err != nil {
+			zap.S().Named("addresses").Warnw("failed to point the domain back at the shared address", "address", d.Address, "domain", d.Domain, zap.Error(err))
+		}
+	}
+
+	if d.ReverseDNS {
+		if err := externaldns.Delete(reverseName(d.Address), externaldns.PTR); err != nil {
+			zap.S().Named("addresses").Warnw("failed to remove the reverse DNS of the address", "address", d.Address, zap.Error(err))
+		}
+	}
+}
+
+// put stores the assigned address. The manager must be locked
+func (m *manager) put(d Dedicated) error {
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(dedicatedKind, d.Address.String(), d)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.dedicated[d.Address.String()] = &d
+
+	return nil
+}
+
+// free returns the first address of the pool no account has, preferring IPv4. The
+// manager must be locked
+func (m *manager) free() (netip.Addr, bool) {
+	for _, v4 := range []bool{true, false} {
+		for _, a := range m.pool {
+			if _, ok := m.dedicated[a.String()]; !ok && a.Is4() == v4 {
+				return a, true
+			}
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+// inPool returns true if the address is one of the dedicated addresses
+func (m *manager) inPool(a netip.Addr) bool {
+	i := sort.Search(len(m.pool), func(i int) bool { return !m.pool[i].Less(a) })
+
+	return i < len(m.pool) && m.pool[i] == a
+}
+
+// parsePool returns the addresses of the pool in order. The network and broadcast
+// addresses of IPv4 networks are left out
+func parsePool(entries []string) ([]netip.Addr, error) {
+	seen := make(map[netip.Addr]bool)
+	var pool []netip.Addr
+
+	add := func(a netip.Addr) {
+		if !seen[a] {
+			seen[a] = true
+			pool = append(pool, a)
+		}
+	}
+
+	for _, e := range entries {
+		if a, err := netip.ParseAddr(e); err == nil {
+			add(a.Unmap())
+			continue
+		}
+
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("addresses: %q in dedicated is not an address or network", e)
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		if !p.IsValid() {
+			return nil, fmt.Errorf("addresses: %q in dedicated is not an address or network", e)
+		}
+		p = p.Masked()
+
+		if (p.Addr().Is4() && p.Bits() < maxPool4) || (p.Addr().Is6() && p.Bits() < maxPool6) {
+			return nil, fmt.Errorf("addresses: the network %s in dedicated holds too many addresses, list smaller ones", e)
+		}
+
+		first, last := p.Addr(), lastAddr(p)
+		if p.Addr().Is4() && p.Bits() < 31 {
+			first, last = first.Next(), last.Prev()
+		}
+		for a := first; a.IsValid() && !last.Less(a); a = a.Next() {
+			add(a)
+		}
+	}
+
+	sort.Slice(pool, func(i, j int) bool { return pool[i].Less(pool[j]) })
+
+	return pool, nil
+}
+
+// lastAddr returns the last address of the prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+
+	a, _ := netip.AddrFromSlice(b)
+
+	return a
+}
+
+// parseAddr parses the address, with IPv4 addresses mapped into IPv6 as plain IPv4
+func parseAddr(address string) (netip.Addr, error) {
+	a, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w address %q", ErrInvalid, address)
+	}
+
+	return a.Unmap(), nil
+}
+
+// recordType returns the type of the records pointing at the address
+func recordType(a netip.Addr) string {
+	if a.Is4() {
+		return externaldns.A
+	}
+
+	return externaldns.AAAA
+}
+
+// reverseName returns the name the reverse DNS of the address is published at, such as
+// 10.113.0.203.in-addr.arpa
+func reverseName(a netip.Addr) string {
+	b := a.AsSlice()
+
+	var labels []string
+	if a.Is4() {
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+	}
+
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
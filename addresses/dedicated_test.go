@@ -0,0 +1,184 @@
+package addresses
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestParsePool(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		ok      bool
+	}{
+		{"addresses", []string{"203.0.113.9", "2001:db8::5", "203.0.113.2"}, []string{"203.0.113.2", "203.0.113.9", "2001:db8::5"}, true},
+		{"duplicates", []string{"203.0.113.2", "203.0.113.2/32", "::ffff:203.0.113.2"}, []string{"203.0.113.2"}, true},
+		{"network without network and broadcast", []string{"203.0.113.16/29"}, []string{"203.0.113.17", "203.0.113.18", "203.0.113.19", "203.0.113.20", "203.0.113.21", "203.0.113.22"}, true},
+		{"point to point", []string{"203.0.113.16/31"}, []string{"203.0.113.16", "203.0.113.17"}, true},
+		{"host bits", []string{"203.0.113.17/30"}, []string{"203.0.113.17", "203.0.113.18"}, true},
+		{"IPv6 network", []string{"2001:db8::/126"}, []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"}, true},
+		{"IPv4 mapped network", []string{"::ffff:203.0.113.16/126"}, []string{"203.0.113.17", "203.0.113.18"}, true},
+		{"largest IPv4 network", []string{"10.0.0.0/22"}, nil, true},
+		{"IPv4 network too large", []string{"10.0.0.0/21"}, nil, false},
+		{"IPv6 network too large", []string{"2001:db8::/64"}, nil, false},
+		{"IPv4 mapped network too large", []string{"::ffff:10.0.0.0/96"}, nil, false},
+		{"not an address", []string{"example.com"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := parsePool(tt.entries)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+
+			if tt.want == nil {
+				if len(pool) != 1022 {
+					t.Errorf("%d addresses, want 1022", len(pool))
+				}
+				return
+			}
+
+			var got []string
+			for _, a := range pool {
+				got = append(got, a.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pool %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"203.0.113.10", "10.113.0.203.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, tt := range tests {
+		if got := reverseName(netip.MustParseAddr(tt.address)); got != tt.want {
+			t.Errorf("reverse name of %s is %s, want %s", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestAssignDedicated(t *testing.T) {
+	configure(t, config.NetworkConfiguration{IPv6PrefixLength: 64, Dedicated: []string{"2001:db8::10", "203.0.113.10", "203.0.113.11"}})
+
+	steps := []struct {
+		name    string
+		account string
+		address string
+		domain  string
+		want    string
+		err     error
+	}{
+		{"first free prefers IPv4", "alice", "", "Example.com.", "203.0.113.10", nil},
+		{"named address", "bob", "2001:db8::10", "", "2001:db8::10", nil},
+		{"mapped address", "bob", "::ffff:203.0.113.11", "example.net", "203.0.113.11", nil},
+		{"exhausted", "carol", "", "", "", ErrPoolExhausted},
+		{"address of another account", "carol", "203.0.113.10", "", "", ErrInUse},
+		{"outside the pool", "carol", "203.0.113.12", "", "", ErrNotInPool},
+		{"invalid address", "carol", "203.0.113", "", "", ErrInvalid},
+		{"invalid domain", "alice", "203.0.113.10", "-example.com", "", ErrInvalid},
+		{"domain on another address of the family", "bob", "203.0.113.11", "example.com", "", ErrDomainInUse},
+		{"domain on an address of the other family", "bob", "2001:db8::10", "example.com", "2001:db8::10", nil},
+		{"moving the domain", "alice", "203.0.113.10", "www.example.com", "203.0.113.10", nil},
+		{"domain moved away", "bob", "203.0.113.11", "example.com", "203.0.113.11", nil},
+	}
+
+	for _, s := range steps {
+		d, err := AssignDedicated(s.account, s.address, s.domain)
+		if !errors.Is(err, s.err) {
+			t.Errorf("%s: error %v, want %v", s.name, err, s.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if d.Address.String() != s.want || d.Account != s.account {
+			t.Errorf("%s: assigned %s to %s, want %s to %s", s.name, d.Address, d.Account, s.want, s.account)
+		}
+
+		// Without a DNS provider nothing is published, which is not an error
+		if d.DNS || d.ReverseDNS || d.Error != "" {
+			t.Errorf("%s: published %+v", s.name, d)
+		}
+	}
+
+	if d, _ := GetDedicated("203.0.113.10"); d.Domain != "www.example.com" {
+		t.Errorf("the domain of 203.0.113.10 is %q", d.Domain)
+	}
+
+	if got := DedicatedOf("bob"); len(got) != 2 || got[0].Address.String() != "203.0.113.11" {
+		t.Errorf("addresses of bob %+v", got)
+	}
+
+	released, err := ReleaseAccount("bob")
+	if err != nil || len(released) != 2 {
+		t.Fatalf("released %+v, %v", released, err)
+	}
+	if _, err := ReleaseDedicated("203.0.113.11"); !errors.Is(err, ErrNotAssigned) {
+		t.Errorf("releasing again: %v", err)
+	}
+
+	d, err := AssignDedicated("carol", "", "")
+	if err != nil || d.Address.String() != "203.0.113.11" {
+		t.Errorf("assigned %s, %v, want the released address", d.Address, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	dir := configure(t, config.NetworkConfiguration{IPv6PrefixLength: 64, Dedicated: []string{"203.0.113.10", "203.0.113.11"}})
+
+	if _, err := AssignDedicated("alice", "203.0.113.11", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// An address removed from the pool stays with its account until it is released
+	c := &config.NetworkConfiguration{IPv6PrefixLength: 64, Dedicated: []string{"203.0.113.10"}}
+	if err := Configure(dir, c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		account string
+		err     error
+	}{
+		{"203.0.113.10", "", nil},
+		{"203.0.113.11", "alice", nil},
+		{"203.0.113.12", "", ErrNotInPool},
+	}
+
+	for _, tt := range tests {
+		d, err := GetDedicated(tt.address)
+		if !errors.Is(err, tt.err) || d.Account != tt.account {
+			t.Errorf("%s is %+v, %v, want %q and %v", tt.address, d, err, tt.account, tt.err)
+		}
+	}
+
+	if pool := Pool(); len(pool) != 2 || pool[1].Account != "alice" {
+		t.Errorf("pool %+v", pool)
+	}
+
+	if _, err := ReleaseDedicated("203.0.113.11"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AssignDedicated("alice", "203.0.113.11", ""); !errors.Is(err, ErrNotInPool) {
+		t.Errorf("assigning an address removed from the pool: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package advisor
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+// Severities of a finding, each deducting a different number of points from the score
+const (
+	Critical = "critical"
+	Warning  = "warning"
+	Info     = "info"
+)
+
+var penalties = map[string]int{
+	Critical: 20,
+	Warning:  5,
+	Info:     0,
+}
+
+var (
+	// ErrNotConfigured is returned when scanning before Configure is called
+	ErrNotConfigured = errors.New("advisor: not configured")
+
+	// ErrScanRunning is returned when starting a scan while another is in progress
+	ErrScanRunning = errors.New("advisor: a scan is already running")
+)
+
+// Finding is a single insecure setting found by a check
+type Finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Detail   string `json:"detail,omitempty"`
+
+	// The path, user, port or certificate the finding is about
+	Resource string `json:"resource,omitempty"`
+
+	// What the administrator should do to resolve the finding
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// Report is the result of running every check. The score starts at 100 and each
+// finding deducts points according to its severity
+type Report struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Score    int       `json:"score"`
+	Findings []Finding `json:"findings"`
+
+	// Checks that could not run, such as when a file they read is missing
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// check inspects one aspect of the server and returns what it found
+type check struct {
+	name string
+	run  func(c *config.AdvisorConfiguration) ([]Finding, error)
+}
+
+// checks are run in order for every scan
+var checks = []check{
+	{"docroots", checkDocroots},
+	{"shells", checkShells},
+	{"certificates", checkCertificates},
+	{"tls", checkTLS},
+	{"runtimes", checkRuntimes},
+	{"ports", checkPorts},
+}
+
+// Advisor runs the checks and keeps the latest report
+type Advisor struct {
+	mu      sync.Mutex
+	path    string
+	config  *config.AdvisorConfiguration
+	latest  *Report
+	running bool
+}
+
+var std *Advisor
+
+// Configure loads the latest report from the data directory
+func Configure(dataDir string, c *config.AdvisorConfiguration) error {
+	dir := filepath.Join(dataDir, "advisor")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	a := &Advisor{path: filepath.Join(dir, "report.json"), config: c}
+
+	if b, err := os.ReadFile(a.path); err == nil {
+		var r Report
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		a.latest = &r
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	std = a
+
+	return nil
+}
+
+// Latest returns the report from the most recent scan, or nil if there has not been one
+func Latest() *Report {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.latest
+}
+
+// Due returns true if the scheduled interval has passed since the last scan
+func Due() bool {
+	if std == nil || std.config.Interval <= 0 {
+		return false
+	}
+
+	latest := Latest()
+
+	return latest == nil || time.Since(latest.Finished) >= time.Duration(std.config.Interval)*time.Hour
+}
+
+// Scan runs every check, stores the report as the latest one and publishes an event
+// with the score
+func Scan() (*Report, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	if std.running {
+		std.mu.Unlock()
+		return nil, ErrScanRunning
+	}
+	std.running = true
+	std.mu.Unlock()
+
+	defer func() {
+		std.mu.Lock()
+		std.running = false
+		std.mu.Unlock()
+	}()
+
+	r := &Report{ID: ids.New(), Started: time.Now().UTC(), Score: 100, Findings: []Finding{}}
+
+	for _, c := range checks {
+		findings, err := c.run(std.config)
+		if err != nil {
+			if r.Errors == nil {
+				r.Errors = make(map[string]string)
+			}
+			r.Errors[c.name] = err.Error()
+			zap.S().Named("advisor").Warnw("security check failed", "check", c.name, zap.Error(err))
+		}
+
+		for _, f := range findings {
+			f.Check = c.name
+			r.Findings = append(r.Findings, f)
+			r.Score -= penalties[f.Severity]
+		}
+	}
+
+	if r.Score < 0 {
+		r.Score = 0
+	}
+
+	// Critical findings are listed first
+	rank := map[string]int{Critical: 0, Warning: 1, Info: 2}
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		return rank[r.Findings[i].Severity] < rank[r.Findings[j].Severity]
+	})
+
+	r.Finished = time.Now().UTC()
+
+	std.mu.Lock()
+	std.latest = r
+	err := std.save()
+	std.mu.Unlock()
+
+	if err != nil {
+		return r, err
+	}
+
+	counts := make(map[string]int)
+	for _, f := range r.Findings {
+		counts[f.Severity]++
+	}
+
+	zap.S().Named("advisor").Infow("security scan finished", "score", r.Score, "findings", len(r.Findings))
+
+	events.Publish(events.Event{
+		Type:     "security.advisor.scan",
+		Resource: r.ID,
+		Data:     map[string]interface{}{"score": r.Score, "findings": counts},
+	})
+
+	return r, nil
+}
+
+// Running returns true while a scan is in progress
+func Running() bool {
+	if std == nil {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.running
+}
+
+// save writes the latest report to disk. The advisor must be locked
+func (a *Advisor) save() error {
+	b, err := json.MarshalIndent(a.latest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.path)
+}
@@ -0,0 +1,245 @@
+package advisor
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// maxPaths is the number of world writable paths listed for each document root, the
+// rest are only counted
+const maxPaths = 10
+
+// checkDocroots finds files and directories in document roots that any user on the
+// server can write to, which lets one compromised account deface or infect another
+func checkDocroots(c *config.AdvisorConfiguration) ([]Finding, error) {
+	roots, err := glob(c.Docroots)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, root := range roots {
+		var paths []string
+		count := 0
+
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil || info.Mode().Perm()&0002 == 0 {
+				return nil
+			}
+
+			count++
+			if len(paths) < maxPaths {
+				paths = append(paths, path)
+			}
+
+			return nil
+		})
+
+		if count == 0 {
+			continue
+		}
+
+		detail := strings.Join(paths, ", ")
+		if count > len(paths) {
+			detail += fmt.Sprintf(" and %d more", count-len(paths))
+		}
+
+		findings = append(findings, Finding{
+			Severity:    Critical,
+			Title:       fmt.Sprintf("%d world writable paths in a document root", count),
+			Detail:      detail,
+			Resource:    root,
+			Remediation: "Remove write access for other users with chmod o-w, PHP runs as the account owner so 755 and 644 are sufficient",
+		})
+	}
+
+	return findings, nil
+}
+
+// noShells are the shells that do not allow logging in
+var noShells = []string{"/sbin/nologin", "/usr/sbin/nologin", "/bin/false", "/usr/bin/false", ""}
+
+// checkShells finds users that can log in over SSH with an unrestricted shell
+func checkShells(c *config.AdvisorConfiguration) ([]Finding, error) {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var findings []Finding
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) < 7 {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || uid < c.MinUID || uid == 65534 {
+			continue
+		}
+
+		shell := fields[6]
+		if slices.Contains(noShells, shell) || slices.Contains(c.JailShells, shell) {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Severity:    Warning,
+			Title:       "User has an unrestricted shell",
+			Detail:      fmt.Sprintf("%s logs in with %s", fields[0], shell),
+			Resource:    fields[0],
+			Remediation: "Give the user a jailed shell, or disable shell access if they do not need it",
+		})
+	}
+
+	return findings, s.Err()
+}
+
+// checkCertificates finds certificates in use that have expired or expire within two
+// weeks
+func checkCertificates(c *config.AdvisorConfiguration) ([]Finding, error) {
+	paths, err := glob(c.Certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	var findings []Finding
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		block, _ := pem.Decode(b)
+		if block == nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case now.After(cert.NotAfter):
+			findings = append(findings, Finding{
+				Severity:    Critical,
+				Title:       "Certificate has expired",
+				Detail:      fmt.Sprintf("%s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02")),
+				Resource:    path,
+				Remediation: "Renew the certificate, or remove it if the domain is no longer served",
+			})
+		case cert.NotAfter.Sub(now) < 14*24*time.Hour:
+			findings = append(findings, Finding{
+				Severity:    Warning,
+				Title:       "Certificate expires soon",
+				Detail:      fmt.Sprintf("%s expires on %s", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02")),
+				Resource:    path,
+				Remediation: "Check why the certificate has not been renewed automatically",
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// phpEndOfLife is the date security support ends for each PHP release
+var phpEndOfLife = map[string]time.Time{
+	"5.6": time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC),
+	"7.0": time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC),
+	"7.1": time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC),
+	"7.2": time.Date(2020, 11, 30, 0, 0, 0, 0, time.UTC),
+	"7.3": time.Date(2021, 12, 6, 0, 0, 0, 0, time.UTC),
+	"7.4": time.Date(2022, 11, 28, 0, 0, 0, 0, time.UTC),
+	"8.0": time.Date(2023, 11, 26, 0, 0, 0, 0, time.UTC),
+	"8.1": time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC),
+	"8.2": time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC),
+	"8.3": time.Date(2027, 12, 31, 0, 0, 0, 0, time.UTC),
+	"8.4": time.Date(2028, 12, 31, 0, 0, 0, 0, time.UTC),
+}
+
+var phpVersion = regexp.MustCompile(`^(\d+\.\d+)\.\d+`)
+
+// checkRuntimes finds installed PHP versions that no longer receive security fixes
+func checkRuntimes(c *config.AdvisorConfiguration) ([]Finding, error) {
+	paths, err := glob(c.Runtimes)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	now := time.Now()
+
+	var findings []Finding
+	for _, path := range paths {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+
+		out, err := exec.Command(resolved, "-r", "echo PHP_VERSION;").Output()
+		if err != nil {
+			continue
+		}
+
+		m := phpVersion.FindStringSubmatch(strings.TrimSpace(string(out)))
+		if m == nil {
+			continue
+		}
+
+		// Releases older than the table have long been unsupported
+		eol, ok := phpEndOfLife[m[1]]
+		if major, _ := strconv.Atoi(strings.Split(m[1], ".")[0]); !ok && major < 7 {
+			eol, ok = phpEndOfLife["5.6"], true
+		}
+
+		if ok && now.After(eol) {
+			findings = append(findings, Finding{
+				Severity:    Warning,
+				Title:       "PHP version no longer receives security fixes",
+				Detail:      fmt.Sprintf("PHP %s reached end of life on %s", strings.TrimSpace(string(out)), eol.Format("2006-01-02")),
+				Resource:    resolved,
+				Remediation: "Move the sites using this version to a supported release and remove it",
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// glob returns every path matching any of the patterns
+func glob(patterns []string) ([]string, error) {
+	var paths []string
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,125 @@
+package advisor
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+)
+
+// checkPorts finds services listening on public addresses on ports the firewall was
+// not told to open. If the firewall drops unopened ports they cannot be reached, but are
+// still reported so that a change of policy does not expose them
+func checkPorts(c *config.AdvisorConfiguration) ([]Finding, error) {
+	listening, err := listeningPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[int]bool)
+	for _, p := range c.AllowedPorts {
+		expected[p] = true
+	}
+	for _, r := range firewall.Rules() {
+		if r.Type == firewall.AllowPort && r.Protocol == "tcp" {
+			expected[r.Port] = true
+		}
+	}
+
+	severity, detail := Warning, "Port %d is listening on every interface but was not opened by the panel"
+	if firewall.DefaultDrop() {
+		severity, detail = Info, "Port %d is listening on every interface, the firewall currently drops traffic to it"
+	}
+
+	var findings []Finding
+	for _, port := range listening {
+		if expected[port] {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Severity:    severity,
+			Title:       "Unexpected port listening publicly",
+			Detail:      fmt.Sprintf(detail, port),
+			Resource:    strconv.Itoa(port),
+			Remediation: "Bind the service to 127.0.0.1 if it is only used locally, or stop it if it is not needed",
+		})
+	}
+
+	return findings, nil
+}
+
+// listeningPorts returns the TCP ports with a socket listening on a non-loopback address,
+// read from /proc/net/tcp and /proc/net/tcp6
+func listeningPorts() ([]int, error) {
+	ports := make(map[int]bool)
+
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		s := bufio.NewScanner(f)
+		s.Scan()
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+
+			// The fourth field is the socket state, 0A being LISTEN
+			if len(fields) < 4 || fields[3] != "0A" {
+				continue
+			}
+
+			ip, port, err := parseProcAddress(fields[1])
+			if err != nil || ip.IsLoopback() {
+				continue
+			}
+
+			ports[port] = true
+		}
+		f.Close()
+	}
+
+	list := make([]int, 0, len(ports))
+	for p := range ports {
+		list = append(list, p)
+	}
+	sort.Ints(list)
+
+	return list, nil
+}
+
+// parseProcAddress parses an address from /proc/net/tcp, written as hex in host byte
+// order in groups of four bytes followed by the port
+func parseProcAddress(s string) (net.IP, int, error) {
+	host, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("advisor: invalid address %q", s)
+	}
+
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, fmt.Errorf("advisor: invalid address %q", s)
+	}
+
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+
+	port, err := strconv.ParseInt(portHex, 16, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return net.IP(b), int(port), nil
+}
@@ -0,0 +1,68 @@
+package advisor
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// checkTLS connects to each TLS port on the server and reports those that still accept
+// protocol versions or ciphers with known weaknesses
+func checkTLS(c *config.AdvisorConfiguration) ([]Finding, error) {
+	var weak []uint16
+	for _, s := range tls.InsecureCipherSuites() {
+		weak = append(weak, s.ID)
+	}
+
+	var findings []Finding
+	for _, port := range c.TLSPorts {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+		// Skip ports nothing is listening on
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		if accepts(addr, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}) {
+			findings = append(findings, Finding{
+				Severity:    Warning,
+				Title:       "TLS 1.0 or 1.1 is accepted",
+				Detail:      fmt.Sprintf("Port %d completes handshakes using deprecated protocol versions", port),
+				Resource:    strconv.Itoa(port),
+				Remediation: "Only allow TLS 1.2 and newer in the service's configuration",
+			})
+		}
+
+		if accepts(addr, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: weak}) {
+			findings = append(findings, Finding{
+				Severity:    Warning,
+				Title:       "Insecure cipher suites are accepted",
+				Detail:      fmt.Sprintf("Port %d completes handshakes using RC4, 3DES or CBC with SHA-256 ciphers", port),
+				Resource:    strconv.Itoa(port),
+				Remediation: "Restrict the service to AEAD cipher suites such as AES-GCM and ChaCha20-Poly1305",
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// accepts returns true if a handshake with the configuration succeeds. Certificates are
+// not verified since only the protocol is being tested
+func accepts(addr string, cfg *tls.Config) bool {
+	cfg.InsecureSkipVerify = true
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
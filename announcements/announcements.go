@@ -0,0 +1,413 @@
+package announcements
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// Severities of an announcement, which the UI shows its banner in
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+var (
+	// ErrNotFound is returned for an announcement that does not exist, or that the
+	// caller did not publish
+	ErrNotFound = errors.New("announcements: announcement not found")
+)
+
+// Announcement is a message from the admins, or from a reseller to their accounts, shown
+// in the panel while it is active
+type Announcement struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Severity string `json:"severity"`
+
+	// When the announcement is shown from, immediately when zero, and until, until it is
+	// deleted when zero
+	Starts time.Time `json:"starts,omitempty"`
+	Ends   time.Time `json:"ends,omitempty"`
+
+	Audience Audience `json:"audience"`
+
+	// Whether the announcement is emailed to its audience once it starts, and when it was
+	Email   bool      `json:"email"`
+	Emailed time.Time `json:"emailed,omitempty"`
+
+	// The ID of the reseller who published the announcement, only to their accounts, or
+	// empty for an announcement by the admins
+	Reseller string `json:"reseller,omitempty"`
+
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+
+	// The IDs of the users who have dismissed the announcement
+	Dismissed []string `json:"dismissed,omitempty"`
+}
+
+// Audience is who an announcement is for. Fields left empty match every user
+type Audience struct {
+	Roles    []string `json:"roles,omitempty"`
+	Packages []string `json:"packages,omitempty"`
+	Users    []string `json:"users,omitempty"`
+}
+
+// announcementKind is what announcements are kept under in the state store, keyed by ID
+const announcementKind = "announcement"
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "announcement",
+		Description: "Sent to the audience of an announcement that is emailed, once it starts",
+		Fields:      []string{"Username", "Title", "Body", "Severity", "Starts", "Ends"},
+		Template: notify.Template{
+			Subject: "{{.Title}}",
+			SMS:     "{{if eq .Severity \"critical\"}}{{.Product}}: {{.Title}}{{end}}",
+			Body: "{{.Body}}\n\n" +
+				"{{if .Ends}}This applies until {{.Ends}}.\n\n{{end}}" +
+				"{{if .URL}}You can read the announcements of your account at {{.URL}}\n{{end}}",
+		},
+	})
+}
+
+// List returns the announcements the reseller published, or every announcement for an
+// empty reseller, newest first
+func List(reseller string) ([]Announcement, error) {
+	list := []Announcement{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(announcementKind, func(id string, data []byte) error {
+			var a Announcement
+			if err := json.Unmarshal(data, &a); err != nil {
+				return fmt.Errorf("announcements: malformed announcement %s: %w", id, err)
+			}
+
+			if reseller == "" || a.Reseller == reseller {
+				list = append(list, a)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, nil
+}
+
+// Get returns the announcement with the ID the reseller published, or any announcement
+// for an empty reseller
+func Get(reseller string, id string) (Announcement, error) {
+	var a Announcement
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(announcementKind, id, &a)
+	})
+	if errors.Is(err, store.ErrNotFound) || (err == nil && reseller != "" && a.Reseller != reseller) {
+		return Announcement{}, ErrNotFound
+	}
+
+	return a, err
+}
+
+// Create checks and publishes the announcement
+func Create(a Announcement, actor string) (Announcement, error) {
+	if err := validate(&a); err != nil {
+		return Announcement{}, err
+	}
+
+	a.ID = ids.New()
+	a.Created = time.Now().UTC()
+	a.CreatedBy = actor
+	a.Emailed = time.Time{}
+	a.Dismissed = nil
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(announcementKind, a.ID, a)
+	})
+	if err != nil {
+		return Announcement{}, err
+	}
+
+	return a, nil
+}
+
+// Update replaces the announcement with the ID the reseller published, or any for an
+// empty reseller. Who it was published by and for, when it was emailed and who has
+// dismissed it are kept
+func Update(reseller string, id string, a Announcement) (Announcement, error) {
+	var updated Announcement
+
+	err := store.Update(func(tx *store.Tx) error {
+		var existing Announcement
+		if err := tx.Get(announcementKind, id, &existing); err != nil {
+			return err
+		}
+
+		if reseller != "" && existing.Reseller != reseller {
+			return ErrNotFound
+		}
+
+		a.ID = existing.ID
+		a.Reseller = existing.Reseller
+		a.Created = existing.Created
+		a.CreatedBy = existing.CreatedBy
+		a.Emailed = existing.Emailed
+		a.Dismissed = existing.Dismissed
+
+		if err := validate(&a); err != nil {
+			return err
+		}
+
+		updated = a
+
+		return tx.Put(announcementKind, id, a)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Announcement{}, ErrNotFound
+	}
+
+	return updated, err
+}
+
+// Delete removes the announcement with the ID the reseller published, or any for an
+// empty reseller
+func Delete(reseller string, id string) error {
+	err := store.Update(func(tx *store.Tx) error {
+		var a Announcement
+		if err := tx.Get(announcementKind, id, &a); err != nil {
+			return err
+		}
+
+		if reseller != "" && a.Reseller != reseller {
+			return ErrNotFound
+		}
+
+		return tx.Delete(announcementKind, id)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// DeleteReseller removes every announcement the reseller published, such as once they
+// are deleted
+func DeleteReseller(reseller string) error {
+	if reseller == "" {
+		return nil
+	}
+
+	list, err := List(reseller)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		for _, a := range list {
+			if err := tx.Delete(announcementKind, a.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// For returns the active announcements for the user that they have not dismissed,
+// critical ones first and then the newest
+func For(u auth.User) ([]Announcement, error) {
+	all, err := List("")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	list := []Announcement{}
+	for _, a := range all {
+		if a.Active(now) && a.For(u) && !slices.Contains(a.Dismissed, u.ID) {
+			a.Dismissed = nil
+			list = append(list, a)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Severity == Critical && list[j].Severity != Critical
+	})
+
+	return list, nil
+}
+
+// Dismiss hides the announcement from the user
+func Dismiss(u auth.User, id string) error {
+	err := store.Update(func(tx *store.Tx) error {
+		var a Announcement
+		if err := tx.Get(announcementKind, id, &a); err != nil {
+			return err
+		}
+
+		if !a.For(u) {
+			return ErrNotFound
+		}
+
+		if slices.Contains(a.Dismissed, u.ID) {
+			return nil
+		}
+		a.Dismissed = append(a.Dismissed, u.ID)
+
+		return tx.Put(announcementKind, id, a)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Active returns true if the announcement is shown at the time
+func (a Announcement) Active(t time.Time) bool {
+	return !t.Before(a.Starts) && (a.Ends.IsZero() || t.Before(a.Ends))
+}
+
+// For returns true if the user is in the audience of the announcement. Resellers'
+// announcements are only for their own accounts
+func (a Announcement) For(u auth.User) bool {
+	if a.Reseller != "" && (u.Role != auth.RoleUser || u.Owner != a.Reseller) {
+		return false
+	}
+
+	return (len(a.Audience.Roles) == 0 || slices.Contains(a.Audience.Roles, u.Role)) &&
+		(len(a.Audience.Packages) == 0 || slices.Contains(a.Audience.Packages, u.Package)) &&
+		(len(a.Audience.Users) == 0 || slices.Contains(a.Audience.Users, u.Username))
+}
+
+// Deliver emails the announcements that have started and are still active to their
+// audience, once each. It is run by the scheduler
+func Deliver() error {
+	now := time.Now()
+
+	var due []Announcement
+	err := store.Update(func(tx *store.Tx) error {
+		var list []Announcement
+		err := tx.Each(announcementKind, func(id string, data []byte) error {
+			var a Announcement
+			if err := json.Unmarshal(data, &a); err == nil && a.Email && a.Emailed.IsZero() && a.Active(now) {
+				list = append(list, a)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Announcements are marked before they are sent so that a slow send is not
+		// repeated by the next run
+		for _, a := range list {
+			a.Emailed = now.UTC()
+			if err := tx.Put(announcementKind, a.ID, a); err != nil {
+				return err
+			}
+			due = append(due, a)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, a := range due {
+		var sent, failed int
+		for _, u := range auth.Users() {
+			if !a.For(u) {
+				continue
+			}
+
+			err := auth.Notify(u, "announcement", map[string]interface{}{
+				"Username": u.Username,
+				"Title":    a.Title,
+				"Body":     a.Body,
+				"Severity": a.Severity,
+				"Starts":   formatTime(a.Starts),
+				"Ends":     formatTime(a.Ends),
+			})
+			if err != nil {
+				failed++
+				continue
+			}
+			sent++
+		}
+
+		zap.S().Named("announcements").Infow("emailed announcement", "id", a.ID, "title", a.Title, "sent", sent, "failed", failed)
+		if failed > 0 {
+			errs = append(errs, fmt.Errorf("announcements: %d of %d notifications of %s failed", failed, sent+failed, a.ID))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the announcement and fills in its defaults
+func validate(a *Announcement) error {
+	a.Title = strings.TrimSpace(a.Title)
+	if a.Title == "" || len(a.Title) > 200 || strings.ContainsAny(a.Title, "\r\n") {
+		return errors.New("announcements: the title must be a single line of at most 200 characters")
+	}
+
+	if strings.TrimSpace(a.Body) == "" || len(a.Body) > 10000 {
+		return errors.New("announcements: the body must be between 1 and 10000 characters")
+	}
+
+	switch a.Severity {
+	case "":
+		a.Severity = Info
+	case Info, Warning, Critical:
+	default:
+		return fmt.Errorf("announcements: severity must be one of %s, %s or %s", Info, Warning, Critical)
+	}
+
+	if !a.Ends.IsZero() && !a.Ends.After(a.Starts) {
+		return errors.New("announcements: an announcement must end after it starts")
+	}
+
+	for _, role := range a.Audience.Roles {
+		switch role {
+		case auth.RoleAdmin, auth.RoleReseller, auth.RoleUser:
+		default:
+			return fmt.Errorf("announcements: unknown role %q", role)
+		}
+
+		if a.Reseller != "" && role != auth.RoleUser {
+			return errors.New("announcements: resellers can only announce to their accounts")
+		}
+	}
+
+	return nil
+}
+
+// formatTime returns the time as shown in notifications, or nothing for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC1123)
+}
@@ -0,0 +1,390 @@
+package archives
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when archiving an account before Configure is called
+	ErrNotConfigured = errors.New("archives: not configured")
+
+	// ErrNotFound is returned for an archive that does not exist
+	ErrNotFound = errors.New("archives: archive not found")
+)
+
+// Archive is a terminated account, kept in the format accounts are transferred in until
+// it expires
+type Archive struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Package  string `json:"package,omitempty"`
+
+	// The ID of the reseller the account belonged to
+	Owner string `json:"owner,omitempty"`
+
+	// Who terminated the account, and the job that did when it was terminated through
+	// provisioning
+	Actor string `json:"actor"`
+	Job   string `json:"job,omitempty"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path"`
+}
+
+// archiveKind is what archives are kept under in the state store
+const archiveKind = "archive"
+
+type archiver struct {
+	// Serializes restoring and purging, so that an archive is not purged while it is
+	// being restored
+	mu     sync.Mutex
+	config *config.ArchivesConfiguration
+}
+
+var std *archiver
+
+// Configure sets where archives are written and how long they are kept
+func Configure(c *config.ArchivesConfiguration) error {
+	if c.Days < 0 {
+		return errors.New("archives: days must not be negative")
+	}
+
+	if c.Days > 0 && c.Dir == "" {
+		return errors.New("archives: the directory archives are written to is required")
+	}
+
+	std = &archiver{config: c}
+
+	return nil
+}
+
+// Enabled returns true if terminated accounts are archived rather than deleted
+func Enabled() bool {
+	return std != nil && std.config.Days > 0
+}
+
+// Create archives the account before it is terminated. An archive the job already made
+// is returned rather than made again, so that a terminate job can be retried. Archiving
+// is limited like the rest of the backups class, and stops once the context is done
+func Create(ctx context.Context, u auth.User, job string, actor string) (Archive, error) {
+	if !Enabled() {
+		return Archive{}, ErrNotConfigured
+	}
+
+	if job != "" {
+		list, err := List()
+		if err != nil {
+			return Archive{}, err
+		}
+
+		for _, a := range list {
+			if a.Job == job && a.Username == u.Username {
+				return a, nil
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	a := Archive{
+		ID:       ids.New(),
+		Username: u.Username,
+		Email:    u.Email,
+		Package:  u.Package,
+		Owner:    u.Owner,
+		Actor:    actor,
+		Job:      job,
+		Created:  now,
+		Expires:  now.AddDate(0, 0, std.config.Days),
+	}
+	a.Path = filepath.Join(std.config.Dir, u.Username+"-"+now.Format("20060102-150405")+"-"+a.ID+".tar.gz")
+
+	err := throttle.Run(ctx, throttle.Backups, func(ctx context.Context) error {
+		return write(ctx, &a)
+	})
+	if err != nil {
+		return Archive{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(archiveKind, a.ID, a)
+	})
+	if err != nil {
+		os.Remove(a.Path)
+		return Archive{}, err
+	}
+
+	events.Publish(events.Event{
+		Type:     "archive.create",
+		Actor:    actor,
+		Resource: a.ID,
+		Data:     map[string]interface{}{"username": a.Username, "size": a.Size, "expires": a.Expires},
+	})
+
+	return a, nil
+}
+
+// write exports the account into the file of the archive
+func write(ctx context.Context, a *Archive) error {
+	if err := os.MkdirAll(filepath.Dir(a.Path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.Path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{ctx: ctx, w: io.MultiWriter(f, h)}
+
+	err = transfer.Export(a.Username, counter)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(a.Path+".tmp", a.Path)
+	}
+	if err != nil {
+		os.Remove(a.Path + ".tmp")
+		return err
+	}
+
+	a.Size = counter.n
+	a.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return nil
+}
+
+// List returns every archive, newest first
+func List() ([]Archive, error) {
+	list := []Archive{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(archiveKind, func(id string, data []byte) error {
+			var a Archive
+			if err := json.Unmarshal(data, &a); err != nil {
+				return fmt.Errorf("archives: malformed archive %s: %w", id, err)
+			}
+
+			list = append(list, a)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, nil
+}
+
+// Get returns the archive with the ID
+func Get(id string) (Archive, error) {
+	var a Archive
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(archiveKind, id, &a)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Archive{}, ErrNotFound
+	}
+
+	return a, err
+}
+
+// Extend keeps the archive until the time, such as while the termination is disputed
+func Extend(id string, until time.Time) (Archive, error) {
+	if std == nil {
+		return Archive{}, ErrNotConfigured
+	}
+
+	if !until.After(time.Now()) {
+		return Archive{}, errors.New("archives: an archive can only be kept until a time in the future")
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	a, err := Get(id)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	a.Expires = until.UTC()
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(archiveKind, a.ID, a)
+	})
+
+	return a, err
+}
+
+// Restore recreates the terminated account from its archive, which is removed once the
+// account is back. The username must not have been taken since
+func Restore(id string) (auth.User, error) {
+	if std == nil {
+		return auth.User{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	a, err := Get(id)
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	f, err := open(a)
+	if err != nil {
+		return auth.User{}, err
+	}
+	defer f.Close()
+
+	u, err := transfer.Restore(f)
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	if err := remove(a); err != nil {
+		zap.S().Named("archives").Warnw("failed to remove restored archive", "archive", a.ID, "username", a.Username, zap.Error(err))
+	}
+
+	return u, nil
+}
+
+// Purge removes the archive for good
+func Purge(id string) (Archive, error) {
+	if std == nil {
+		return Archive{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	a, err := Get(id)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	return a, remove(a)
+}
+
+// Expire purges the archives that have expired. It is run by the scheduler
+func Expire() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	list, err := List()
+	if err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+
+	var errs []error
+	for _, a := range list {
+		if a.Expires.After(now) {
+			continue
+		}
+
+		if err := remove(a); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Username, err))
+			continue
+		}
+
+		events.Publish(events.Event{
+			Type:     "archive.expire",
+			Resource: a.ID,
+			Data:     map[string]interface{}{"username": a.Username, "created": a.Created},
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+// remove removes the file and the catalog entry of the archive. The archiver must be
+// locked
+func remove(a Archive) error {
+	if err := os.Remove(a.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Delete(archiveKind, a.ID)
+	})
+}
+
+// open opens the file of the archive, checking that it has not changed since it was
+// written
+func open(a Archive) (*os.File, error) {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != a.SHA256 {
+		f.Close()
+		return nil, fmt.Errorf("archives: %s is corrupt, its checksum is %s instead of %s", a.Path, sum, a.SHA256)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// countingWriter counts the bytes written through it, failing once the context is done
+type countingWriter struct {
+	ctx context.Context
+	w   io.Writer
+	n   int64
+}
+
+// Write writes to the underlying writer, counting the bytes written
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
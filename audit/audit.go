@@ -0,0 +1,310 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// ErrNotConfigured is returned when recording or querying before Configure is called
+var ErrNotConfigured = errors.New("audit: log has not been configured")
+
+// Entry is a single state-changing operation recorded in the audit log. Each entry
+// includes the hash of the entry before it, so removing or modifying an entry breaks
+// the chain for every entry that follows
+type Entry struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+
+	// The admin or reseller who made the change while acting as the actor
+	Impersonator string `json:"impersonator,omitempty"`
+
+	Action   string          `json:"action"`
+	Resource string          `json:"resource,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	SourceIP string          `json:"source_ip,omitempty"`
+
+	// A fingerprint of the API token used to make the change. The token itself is never
+	// written to the audit log
+	Token string `json:"token,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// name is the log in the state store audit entries are appended to
+const name = "audit"
+
+// Log is an append-only, hash-chained audit log kept in the state store
+type Log struct {
+	mu       sync.Mutex
+	sequence uint64
+	lastHash string
+}
+
+var std *Log
+
+// Configure opens the audit log in the state store, which must be configured first, and
+// makes it the log used by the package level functions. Entries in the file earlier
+// releases kept in the directory are moved into the store
+func Configure(dir string) error {
+	if err := importFile(filepath.Join(dir, "audit.log")); err != nil {
+		return err
+	}
+
+	l, err := Open()
+	if err != nil {
+		return err
+	}
+
+	std = l
+
+	return nil
+}
+
+// Open opens the audit log, reading its last entry so that new entries continue the
+// chain
+func Open() (*Log, error) {
+	l := &Log{}
+
+	var last Entry
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Last(name, &last)
+	})
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	l.sequence = last.Sequence
+	l.lastHash = last.Hash
+
+	return l, nil
+}
+
+// Record appends the entry to the log, assigning its sequence number and hash. The
+// entry is synced to disk before returning so a recorded entry survives a crash
+func (l *Log) Record(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Sequence = l.sequence + 1
+	e.PrevHash = l.lastHash
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Append(name, e.Sequence, e)
+	})
+	if err != nil {
+		return err
+	}
+
+	l.sequence = e.Sequence
+	l.lastHash = e.Hash
+
+	return nil
+}
+
+// Verify walks the entire log and checks that every entry's hash is correct and that
+// it links to the entry before it, returning an error describing the first break
+func (l *Log) Verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var prev string
+	var seq uint64
+	err := l.each(func(e Entry) error {
+		seq++
+		if e.Sequence != seq {
+			return fmt.Errorf("audit: expected sequence %d but found %d", seq, e.Sequence)
+		}
+
+		if e.PrevHash != prev {
+			return fmt.Errorf("audit: entry %d does not link to the previous entry", e.Sequence)
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+
+		if hash != e.Hash {
+			return fmt.Errorf("audit: entry %d has been modified", e.Sequence)
+		}
+
+		prev = e.Hash
+		return nil
+	})
+
+	return err
+}
+
+// Query returns the entries matching the filter, oldest first
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []Entry{}
+	err := l.each(func(e Entry) error {
+		if f.Matches(e) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+
+	return entries, nil
+}
+
+// each calls fn for every entry in the log in the order they were written
+func (l *Log) each(fn func(e Entry) error) error {
+	return store.View(func(tx *store.Tx) error {
+		return tx.Entries(name, 1, func(data []byte) error {
+			var e Entry
+			if err := json.Unmarshal(data, &e); err != nil {
+				return fmt.Errorf("audit: malformed entry after sequence %d: %w", l.sequence, err)
+			}
+
+			return fn(e)
+		})
+	})
+}
+
+// importFile moves the entries of the file earlier releases kept the log in into the
+// state store as they are, so that their hashes still verify
+func importFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = store.Update(func(tx *store.Tx) error {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				return fmt.Errorf("audit: malformed entry in %s: %w", path, err)
+			}
+
+			if err := tx.Append(name, e.Sequence, e); err != nil {
+				return err
+			}
+		}
+
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, path+".imported")
+}
+
+// computeHash returns the hash of the entry with its own hash field cleared
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Record appends the entry to the configured audit log
+func Record(e Entry) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.Record(e)
+}
+
+// Query returns the entries in the configured audit log matching the filter
+func Query(f Filter) ([]Entry, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	return std.Query(f)
+}
+
+// Verify checks the hash chain of the configured audit log
+func Verify() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.Verify()
+}
+
+// Fingerprint returns a short, non-reversible identifier for an API token so that the
+// token used for a change can be identified without storing it
+func Fingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// Attach records every event published on the default event bus that was caused by an
+// actor, which covers every state-changing operation made through the API. Events
+// generated by the panel itself are left to the activity feed
+func Attach() {
+	events.Handle(func(e events.Event) {
+		if e.Actor == "" {
+			return
+		}
+
+		err := Record(Entry{
+			Time:         e.Time,
+			Actor:        e.Actor,
+			Impersonator: e.Impersonator,
+			Action:       e.Type,
+			Resource:     e.Resource,
+			Before:       e.Before,
+			After:        e.After,
+			SourceIP:     e.SourceIP,
+			Token:        e.Token,
+		})
+		if err != nil {
+			zap.S().Named("audit").Errorw("failed to record audit log entry", "action", e.Type, zap.Error(err))
+		}
+	})
+}
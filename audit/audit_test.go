@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// openStore configures a new state store for the test
+func openStore(t *testing.T) {
+	t.Helper()
+
+	if err := store.Configure(t.TempDir(), &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chain returns entries linked as Record links them
+func chain(t *testing.T, n int) []Entry {
+	t.Helper()
+
+	var entries []Entry
+	prev := ""
+	for i := 1; i <= n; i++ {
+		e := Entry{
+			Sequence: uint64(i),
+			Time:     time.Date(2026, 10, 15, 12, i, 0, 0, time.UTC),
+			Actor:    "admin",
+			Action:   "domain.create",
+			Resource: "example.com",
+			PrevHash: prev,
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Hash = hash
+		prev = hash
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// rehash recomputes the hash of the entry, as someone rewriting it would
+func rehash(e *Entry) {
+	e.Hash, _ = e.computeHash()
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]Entry) []Entry
+		err    string
+	}{
+		{"intact", func(e []Entry) []Entry { return e }, ""},
+		{"empty", func(e []Entry) []Entry { return nil }, ""},
+
+		// The chain cannot tell a log cut short from one nothing was recorded to since
+		{"last entry removed", func(e []Entry) []Entry { return e[:len(e)-1] }, ""},
+
+		{"actor changed", func(e []Entry) []Entry {
+			e[1].Actor = "someone else"
+			return e
+		}, "entry 2 has been modified"},
+		{"time changed", func(e []Entry) []Entry {
+			e[2].Time = e[2].Time.Add(-time.Hour)
+			return e
+		}, "entry 3 has been modified"},
+		{"change undone", func(e []Entry) []Entry {
+			e[0].Before = json.RawMessage(`{"quota":100}`)
+			return e
+		}, "entry 1 has been modified"},
+		{"impersonator hidden", func(e []Entry) []Entry {
+			e[1].Impersonator = "reseller"
+			rehash(&e[1])
+			e[2].Impersonator = ""
+			return e
+		}, "entry 3 does not link"},
+		{"entry rewritten with a new hash", func(e []Entry) []Entry {
+			e[1].Action = "domain.delete"
+			rehash(&e[1])
+			return e
+		}, "entry 3 does not link"},
+		{"first entry removed", func(e []Entry) []Entry { return e[1:] }, "expected sequence 1 but found 2"},
+		{"entry removed", func(e []Entry) []Entry { return append(e[:1], e[2:]...) }, "expected sequence 2 but found 3"},
+		{"entry removed and renumbered", func(e []Entry) []Entry {
+			e = append(e[:1], e[2:]...)
+			for i := range e {
+				e[i].Sequence = uint64(i + 1)
+			}
+			return e
+		}, "entry 2 does not link"},
+		{"entries swapped", func(e []Entry) []Entry {
+			e[1], e[2] = e[2], e[1]
+			e[1].Sequence, e[2].Sequence = 2, 3
+			return e
+		}, "entry 2 does not link"},
+		{"entry inserted", func(e []Entry) []Entry {
+			forged := Entry{Sequence: 2, Actor: "admin", Action: "user.create", PrevHash: e[0].Hash}
+			rehash(&forged)
+			for i := 1; i < len(e); i++ {
+				e[i].Sequence++
+			}
+			return append(e[:1], append([]Entry{forged}, e[1:]...)...)
+		}, "entry 3 does not link"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openStore(t)
+
+			err := store.Update(func(tx *store.Tx) error {
+				for _, e := range tt.tamper(chain(t, 4)) {
+					if err := tx.Append(name, e.Sequence, e); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = l.Verify()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("the tampered log verified")
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRecordContinuesChain(t *testing.T) {
+	openStore(t)
+
+	entries := []Entry{
+		{Actor: "admin", Action: "user.create", Resource: "u1"},
+		{Actor: "admin", Action: "user.update", Before: json.RawMessage(`{ "note": "<b>&" }`), After: json.RawMessage(`{"note":"x"}`)},
+		{Actor: "alice", Impersonator: "admin", Action: "domain.create", Time: time.Date(2026, 10, 15, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))},
+		{Actor: "admin", Action: "user.delete", Resource: "u1", Token: Fingerprint("secret token")},
+	}
+
+	for i, e := range entries {
+		// The log is opened again before each entry, as it is when the panel restarts
+		l, err := Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+
+		if l.sequence != uint64(i+1) {
+			t.Fatalf("sequence %d after %d entries", l.sequence, i+1)
+		}
+	}
+
+	l, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != len(entries) || recorded[0].PrevHash != "" || recorded[0].Time.IsZero() {
+		t.Errorf("got %+v", recorded)
+	}
+	if strings.Contains(recorded[3].Token, "secret") || len(recorded[3].Token) != 16 {
+		t.Errorf("recorded the token as %q", recorded[3].Token)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"token", "token", true},
+		{"token", "Token", false},
+		{"token", "token ", false},
+	}
+
+	for _, tt := range tests {
+		if same := Fingerprint(tt.a) == Fingerprint(tt.b); same != tt.same {
+			t.Errorf("Fingerprint(%q) == Fingerprint(%q) is %v", tt.a, tt.b, same)
+		}
+	}
+
+	if Fingerprint("") != "" {
+		t.Errorf("an empty token has the fingerprint %q", Fingerprint(""))
+	}
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Filter limits the entries returned when querying the audit log. Empty fields match
+// every entry
+type Filter struct {
+	Actor    string
+	Action   string
+	Resource string
+	Since    time.Time
+	Until    time.Time
+
+	// The maximum number of entries to return, keeping the most recent ones
+	Limit int
+}
+
+// Matches returns true if the entry satisfies every condition in the filter
+func (f Filter) Matches(e Entry) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+
+	if f.Resource != "" && e.Resource != f.Resource {
+		return false
+	}
+
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// ExportJSONLines writes the entries in the same format they are stored in, allowing
+// the export to be verified independently of the panel
+func ExportJSONLines(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportCSV writes the entries as CSV with a header row
+func ExportCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"sequence", "time", "actor", "action", "resource", "source_ip", "token", "before", "after", "prev_hash", "hash", "impersonator"})
+	for _, e := range entries {
+		cw.Write([]string{
+			strconv.FormatUint(e.Sequence, 10),
+			e.Time.Format(time.RFC3339Nano),
+			e.Actor,
+			e.Action,
+			e.Resource,
+			e.SourceIP,
+			e.Token,
+			string(e.Before),
+			string(e.After),
+			e.PrevHash,
+			e.Hash,
+			e.Impersonator,
+		})
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
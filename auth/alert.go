@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"go.uber.org/zap"
+)
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "login_alert",
+		Description: "Sent when a user logs in from a device or network they have not used before",
+		Fields:      []string{"Username", "Reasons", "Time", "IP", "Browser"},
+		Template: notify.Template{
+			Subject: "New login to your {{.Product}} account",
+			SMS:     "{{.Product}}: new login to {{.Username}} from {{.IP}}. If this was not you, change your password.",
+			Body: "Your account {{.Username}} was just used to log in from {{.Reasons}}.\n\n" +
+				"Time: {{.Time}}\nAddress: {{.IP}}\nBrowser: {{.Browser}}\n\n" +
+				"If this was not you, change your password immediately and contact your administrator.\n",
+		},
+	})
+}
+
+// sendLoginAlert notifies the user of a login from a device or network they have not
+// used before
+func sendLoginAlert(c *config.AuthConfiguration, u User, ip string, userAgent string, newDevice bool, newNetwork bool) {
+	if u.Email == "" && u.Phone == "" {
+		return
+	}
+
+	var reasons []string
+	if newDevice {
+		reasons = append(reasons, "a device you have not used before")
+	}
+	if newNetwork {
+		reasons = append(reasons, "a network you have not logged in from before")
+	}
+
+	err := notify.Send(notify.Notification{
+		Kind:     "login_alert",
+		Username: u.Username,
+		Email:    u.Email,
+		Phone:    u.Phone,
+		Reseller: u.Reseller(),
+		Language: u.Language,
+		From:     c.AlertFrom,
+		Data: map[string]interface{}{
+			"Username": u.Username,
+			"Reasons":  strings.Join(reasons, " and "),
+			"Time":     time.Now().UTC().Format(time.RFC1123),
+			"IP":       ip,
+			"Browser":  userAgent,
+		},
+	})
+	if err != nil {
+		zap.S().Named("auth").Warnw("failed to send login alert", "user", u.Username, zap.Error(err))
+	}
+}
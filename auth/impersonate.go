@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// ErrImpersonationDenied is returned when acting as a user the caller does not manage
+var ErrImpersonationDenied = errors.New("auth: you may only act as the accounts you manage")
+
+// Impersonator is the admin or reseller acting as a user. The admin token from the
+// configuration has a name but no user ID
+type Impersonator struct {
+	UserID   string `json:"user_id,omitempty"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// CanImpersonate returns true if the impersonator may act as the user. Admins may act as
+// any reseller or user and resellers as the users they own. Nobody may act as an admin,
+// which would let a reseller or a stolen admin session escalate or hide behind another
+// admin's name
+func CanImpersonate(by Impersonator, u User) bool {
+	if u.Role == RoleAdmin || u.ID == by.UserID {
+		return false
+	}
+
+	switch by.Role {
+	case RoleAdmin:
+		return true
+	case RoleReseller:
+		return by.UserID != "" && u.Role == RoleUser && u.Owner == by.UserID
+	default:
+		return false
+	}
+}
+
+// Impersonate starts a session as the user on behalf of the impersonator, without their
+// password or second factor. The session lasts at most the impersonation lifetime and
+// its start, every change made with it and its end are published with the impersonator
+// recorded
+func Impersonate(id string, by Impersonator, ip string, userAgent string) (LoginResult, error) {
+	if std == nil {
+		return LoginResult{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return LoginResult{}, ErrUserNotFound
+	}
+
+	if !CanImpersonate(by, *u) {
+		return LoginResult{}, ErrImpersonationDenied
+	}
+
+	now := time.Now().UTC()
+	token, sess := std.newSession(u, "", ip, userAgent, false, now)
+	sess.Impersonator = &by
+
+	if lifetime := time.Duration(std.config.ImpersonationLifetime) * time.Second; sess.Expires.After(now.Add(lifetime)) {
+		sess.Expires = now.Add(lifetime)
+	}
+
+	if err := std.saveSessions(); err != nil {
+		delete(std.sessions, hashToken(token))
+		return LoginResult{}, err
+	}
+
+	zap.S().Named("auth").Infow("impersonation started", "user", u.Username, "impersonator", by.Username, "reason", by.Reason)
+
+	events.Publish(events.Event{
+		Type:     "auth.impersonation.start",
+		Actor:    by.Username,
+		SourceIP: ip,
+		Account:  u.Username,
+		Resource: u.ID,
+		Data:     map[string]interface{}{"reason": by.Reason, "expires": sess.Expires},
+	})
+
+	return LoginResult{Token: token, Expires: sess.Expires, User: u.Public()}, nil
+}
+
+// endImpersonation publishes the end of an impersonation session. The store must be
+// locked
+func (s *store) endImpersonation(sess *Session, reason string) {
+	username := sess.UserID
+	if u, ok := s.users[sess.UserID]; ok {
+		username = u.Username
+	}
+
+	events.Publish(events.Event{
+		Type:     "auth.impersonation.end",
+		Actor:    sess.Impersonator.Username,
+		SourceIP: sess.IP,
+		Account:  username,
+		Resource: sess.UserID,
+		Data:     map[string]interface{}{"reason": reason, "started": sess.Created},
+	})
+}
@@ -0,0 +1,47 @@
+package auth
+
+import "testing"
+
+func TestCanImpersonate(t *testing.T) {
+	admin := Impersonator{UserID: "a1", Username: "root", Role: RoleAdmin}
+	token := Impersonator{Username: "admin", Role: RoleAdmin}
+	reseller := Impersonator{UserID: "r1", Username: "hosting", Role: RoleReseller}
+	user := Impersonator{UserID: "u1", Username: "alice", Role: RoleUser}
+
+	tests := []struct {
+		name string
+		by   Impersonator
+		u    User
+		want bool
+	}{
+		{"admin as a user", admin, User{ID: "u1", Role: RoleUser}, true},
+		{"admin as a reseller", admin, User{ID: "r1", Role: RoleReseller}, true},
+		{"admin as another reseller's user", admin, User{ID: "u2", Role: RoleUser, Owner: "r1"}, true},
+		{"admin token as a user", token, User{ID: "u1", Role: RoleUser}, true},
+		{"admin as another admin", admin, User{ID: "a2", Role: RoleAdmin}, false},
+		{"admin token as an admin", token, User{ID: "a1", Role: RoleAdmin}, false},
+		{"admin as themselves", admin, User{ID: "a1", Role: RoleAdmin}, false},
+
+		{"reseller as their user", reseller, User{ID: "u1", Role: RoleUser, Owner: "r1"}, true},
+		{"reseller as another reseller's user", reseller, User{ID: "u2", Role: RoleUser, Owner: "r2"}, false},
+		{"reseller as a user without an owner", reseller, User{ID: "u3", Role: RoleUser}, false},
+		{"reseller as another reseller", reseller, User{ID: "r2", Role: RoleReseller}, false},
+		{"reseller as a reseller they own", reseller, User{ID: "r2", Role: RoleReseller, Owner: "r1"}, false},
+		{"reseller as themselves", reseller, User{ID: "r1", Role: RoleReseller}, false},
+		{"reseller as an admin", reseller, User{ID: "a1", Role: RoleAdmin}, false},
+		{"reseller without an ID as a user without an owner", Impersonator{Role: RoleReseller}, User{ID: "u3", Role: RoleUser}, false},
+
+		{"user as another user", user, User{ID: "u2", Role: RoleUser}, false},
+		{"user as a user they own", user, User{ID: "u2", Role: RoleUser, Owner: "u1"}, false},
+		{"unknown role", Impersonator{UserID: "x1", Role: "superuser"}, User{ID: "u1", Role: RoleUser}, false},
+		{"no role", Impersonator{UserID: "x1"}, User{ID: "u1", Role: RoleUser}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanImpersonate(tt.by, tt.u); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrInvalidCredentials is returned when the username or password is incorrect
+	ErrInvalidCredentials = errors.New("auth: invalid username or password")
+
+	// ErrLocked is returned when logging in to an account that has been locked after
+	// too many failed logins
+	ErrLocked = errors.New("auth: account is temporarily locked after too many failed logins")
+
+	// ErrSuspended is returned when logging in to a suspended account
+	ErrSuspended = errors.New("auth: account is suspended")
+)
+
+// dummyHash is compared against when a username does not exist, so that logging in as
+// an unknown user takes as long as getting the password wrong
+var dummyHash = func() User {
+	u := User{}
+	u.SetPassword(ids.Hex(16))
+	return u
+}()
+
+// LoginResult is returned from a successful login
+type LoginResult struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+
+	// The ID the client should send with future logins to identify this device
+	DeviceID string `json:"device_id"`
+
+	User       User `json:"user"`
+	NewDevice  bool `json:"new_device"`
+	NewNetwork bool `json:"new_network"`
+
+	// Set when the session may only be used to enroll the second factor the user's role
+	// requires
+	EnrollmentRequired bool `json:"enrollment_required,omitempty"`
+
+	// Set instead of a token when the user has a second factor. The login is completed by
+	// passing the challenge to one of the methods within five minutes
+	Challenge string   `json:"challenge,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+}
+
+// Login checks the credentials and creates a session, or a challenge if the user has a
+// second factor. Accounts are locked for a period after too many consecutive failures,
+// and logins from a device or network the user has not used before are reported through
+// an event and an email alert
+func Login(username string, password string, ip string, userAgent string, deviceID string) (LoginResult, error) {
+	if std == nil {
+		return LoginResult{}, ErrNotConfigured
+	}
+
+	now := time.Now().UTC()
+
+	std.mu.Lock()
+	u := std.byUsername(username)
+	var candidate User
+	if u != nil {
+		candidate = *u
+	}
+	std.mu.Unlock()
+
+	if u == nil {
+		dummyHash.CheckPassword(password)
+		return LoginResult{}, ErrInvalidCredentials
+	}
+
+	if candidate.Locked(now) {
+		return LoginResult{}, ErrLocked
+	}
+
+	// The password is checked without holding the lock since bcrypt is deliberately slow
+	if !candidate.CheckPassword(password) {
+		return LoginResult{}, std.failed(candidate.ID, ip, now)
+	}
+
+	// Only refused once the password is known to be right, so that the role of a user
+	// cannot be found out without it
+	if std.enforced(candidate.Role) {
+		return LoginResult{}, ErrSSORequired
+	}
+
+	if candidate.Suspended {
+		return LoginResult{}, ErrSuspended
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[candidate.ID]
+	if !ok {
+		return LoginResult{}, ErrInvalidCredentials
+	}
+
+	// Users with a second factor are given a challenge to complete instead of a session
+	if m := methods(u); len(m) > 0 {
+		token := std.newChallenge(&challenge{UserID: u.ID, DeviceID: deviceID, IP: ip, UserAgent: userAgent}, now)
+		return LoginResult{Challenge: token, Methods: m}, nil
+	}
+
+	return std.complete(u, deviceID, ip, userAgent, MethodPassword, now)
+}
+
+// complete creates the session for a user who has proven who they are with the method,
+// tracking the device and network they logged in from. If the method does not meet the
+// policy for the user's role the session may only be used to enroll a second factor.
+// The store must be locked
+func (s *store) complete(u *User, deviceID string, ip string, userAgent string, method string, now time.Time) (LoginResult, error) {
+	if method != MethodSSO && s.enforced(u.Role) {
+		return LoginResult{}, ErrSSORequired
+	}
+
+	if u.Suspended {
+		return LoginResult{}, ErrSuspended
+	}
+
+	firstLogin := u.LastLogin.IsZero()
+	res := LoginResult{}
+
+	u.FailedLogins = 0
+	u.LastLogin = now
+
+	d := u.device(deviceID)
+	if d == nil {
+		res.NewDevice = true
+		u.Devices = append(append([]Device{}, u.Devices...), Device{ID: ids.Hex(16), UserAgent: userAgent, FirstSeen: now})
+		d = &u.Devices[len(u.Devices)-1]
+	}
+	d.LastIP = ip
+	d.LastSeen = now
+
+	if network := networkOf(ip); !u.knowsNetwork(network) {
+		res.NewNetwork = true
+		u.Networks = append(u.Networks, network)
+	}
+
+	enrollment := !s.satisfies(u, method)
+	token, sess := s.newSession(u, d.ID, ip, userAgent, enrollment, now)
+
+	res.Token = token
+	res.Expires = sess.Expires
+	res.DeviceID = d.ID
+	res.User = u.Public()
+	res.EnrollmentRequired = enrollment
+
+	if err := s.saveAll(); err != nil {
+		return LoginResult{}, err
+	}
+
+	events.Publish(events.Event{
+		Type:     "auth.login",
+		Actor:    u.Username,
+		SourceIP: ip,
+		Resource: u.ID,
+		Data:     map[string]interface{}{"method": method, "new_device": res.NewDevice, "new_network": res.NewNetwork, "enrollment": enrollment},
+	})
+
+	if !firstLogin && (res.NewDevice || res.NewNetwork) && s.alerts(u.Role) {
+		go sendLoginAlert(s.config, *u, ip, userAgent, res.NewDevice, res.NewNetwork)
+	}
+
+	return res, nil
+}
+
+// failed records a failed login for the user, locking the account once the number of
+// consecutive failures reaches the lockout threshold
+func (s *store) failed(id string, ip string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return ErrInvalidCredentials
+	}
+
+	u.FailedLogins++
+	if s.config.LockoutThreshold <= 0 || u.FailedLogins < s.config.LockoutThreshold {
+		if err := s.saveUsers(); err != nil {
+			zap.S().Named("auth").Errorw("failed to save users", zap.Error(err))
+		}
+		return ErrInvalidCredentials
+	}
+
+	u.FailedLogins = 0
+	u.LockedUntil = now.Add(time.Duration(s.config.LockoutDuration) * time.Second)
+
+	if err := s.saveUsers(); err != nil {
+		zap.S().Named("auth").Errorw("failed to save users", zap.Error(err))
+	}
+
+	events.Publish(events.Event{
+		Type:     "auth.user.locked",
+		Resource: u.ID,
+		SourceIP: ip,
+		Data:     map[string]interface{}{"username": u.Username, "until": u.LockedUntil},
+	})
+
+	return ErrLocked
+}
+
+// Unlock clears the lockout and failed login count for the user
+func Unlock(id string) (User, error) {
+	return UpdateUser(id, func(u *User) error {
+		u.FailedLogins = 0
+		u.LockedUntil = time.Time{}
+		return nil
+	})
+}
+
+// Suspend stops the user logging in and ends their sessions, apart from those of admins
+// or resellers acting as them
+func Suspend(id string, reason string) (User, error) {
+	if std == nil {
+		return User{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	updated := *u
+	updated.Suspended = true
+	updated.SuspendReason = reason
+	std.users[id] = &updated
+
+	for k, s := range std.sessions {
+		if s.UserID == id && s.Impersonator == nil {
+			delete(std.sessions, k)
+		}
+	}
+
+	return updated, std.saveAll()
+}
+
+// Unsuspend lets a suspended user log in again
+func Unsuspend(id string) (User, error) {
+	return UpdateUser(id, func(u *User) error {
+		u.Suspended = false
+		u.SuspendReason = ""
+		return nil
+	})
+}
+
+// alerts returns true if users with the role are alerted about logins from new
+// devices or networks
+func (s *store) alerts(role string) bool {
+	for _, r := range s.config.AlertRoles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networkOf returns the network an address belongs to, which is used as an approximate
+// location. IPv4 addresses are grouped by /24 and IPv6 addresses by /48
+func networkOf(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	storepkg "github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the store with the user alice, whose password is correct horse
+func configure(t *testing.T) (*config.AuthConfiguration, User) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := storepkg.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.NewConfiguration("").Auth
+	c.LockoutThreshold = 3
+	c.AlertRoles = nil
+	if err := Configure(dir, c); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := CreateUser(User{Username: "alice"}, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, u
+}
+
+func TestLogin(t *testing.T) {
+	type attempt struct {
+		username string
+		password string
+		err      error
+	}
+
+	wrong := attempt{"alice", "battery staple", ErrInvalidCredentials}
+	right := attempt{"alice", "correct horse", nil}
+
+	tests := []struct {
+		name     string
+		suspend  bool
+		attempts []attempt
+	}{
+		{"right password", false, []attempt{right}},
+		{"username in another case", false, []attempt{{"Alice", "correct horse", nil}}},
+		{"wrong password", false, []attempt{wrong}},
+		{"unknown user", false, []attempt{{"bob", "correct horse", ErrInvalidCredentials}}},
+		{"no password", false, []attempt{{"alice", "", ErrInvalidCredentials}}},
+		{"failures below the threshold", false, []attempt{wrong, wrong, right, wrong, wrong, right}},
+		{"locked at the threshold", false, []attempt{wrong, wrong, {"alice", "battery staple", ErrLocked}, {"alice", "correct horse", ErrLocked}}},
+		{"locked account refuses wrong passwords too", false, []attempt{wrong, wrong, {"alice", "battery staple", ErrLocked}, {"alice", "battery staple", ErrLocked}}},
+		{"unknown users are never locked", false, []attempt{
+			{"bob", "x", ErrInvalidCredentials}, {"bob", "x", ErrInvalidCredentials}, {"bob", "x", ErrInvalidCredentials}, right,
+		}},
+		{"suspended", true, []attempt{{"alice", "correct horse", ErrSuspended}}},
+		{"suspended with a wrong password", true, []attempt{wrong}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, u := configure(t)
+			if tt.suspend {
+				if _, err := Suspend(u.ID, "unpaid"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, a := range tt.attempts {
+				res, err := Login(a.username, a.password, "203.0.113.7", "curl/8.5.0", "")
+				if !errors.Is(err, a.err) {
+					t.Fatalf("attempt %d: got %v, want %v", i+1, err, a.err)
+				}
+
+				if err != nil {
+					if res.Token != "" {
+						t.Errorf("attempt %d: a failed login returned a token", i+1)
+					}
+					continue
+				}
+
+				session, _, err := Authenticate(res.Token)
+				if err != nil || session.ID != u.ID {
+					t.Errorf("attempt %d: the session is for %q: %v", i+1, session.ID, err)
+				}
+				if res.User.PasswordHash != "" {
+					t.Errorf("attempt %d: the password hash was returned", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginDevices(t *testing.T) {
+	_, _ = configure(t)
+
+	first, err := Login("alice", "correct horse", "203.0.113.7", "curl/8.5.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ip         string
+		device     string
+		newDevice  bool
+		newNetwork bool
+	}{
+		{"same device and address", "203.0.113.7", first.DeviceID, false, false},
+		{"same network", "203.0.113.200", first.DeviceID, false, false},
+		{"another network", "198.51.100.7", first.DeviceID, false, true},
+		{"unknown device", "203.0.113.7", "made-up", true, false},
+		{"no device", "203.0.113.7", "", true, false},
+		{"IPv6 network", "2001:db8:1:2::7", first.DeviceID, false, true},
+		{"same IPv6 /48", "2001:db8:1:ffff::9", first.DeviceID, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Login("alice", "correct horse", tt.ip, "curl/8.5.0", tt.device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.NewDevice != tt.newDevice || res.NewNetwork != tt.newNetwork {
+				t.Errorf("new device %v and network %v, want %v and %v", res.NewDevice, res.NewNetwork, tt.newDevice, tt.newNetwork)
+			}
+			if tt.newDevice && res.DeviceID == tt.device {
+				t.Errorf("the device ID %q the client made up was kept", tt.device)
+			}
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		threshold int
+		failures  int
+		locked    bool
+	}{
+		{"below the threshold", 3, 2, false},
+		{"at the threshold", 3, 3, true},
+		{"lockout disabled", 0, 50, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, u := configure(t)
+			c.LockoutThreshold = tt.threshold
+			c.LockoutDuration = 900
+
+			for i := 0; i < tt.failures; i++ {
+				std.failed(u.ID, "203.0.113.7", now)
+			}
+
+			got := std.users[u.ID]
+			if got.Locked(now) != tt.locked {
+				t.Errorf("locked %v, want %v", got.Locked(now), tt.locked)
+			}
+			if got.Locked(now.Add(15*time.Minute + time.Second)) {
+				t.Errorf("still locked once the lockout is over")
+			}
+		})
+	}
+}
+
+func TestNetworkOf(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.0/24"},
+		{"::ffff:203.0.113.7", "203.0.113.0/24"},
+		{"2001:db8:1:2::7", "2001:db8:1::/48"},
+		{"unknown", "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := networkOf(tt.ip); got != tt.want {
+			t.Errorf("networkOf(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
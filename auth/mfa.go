@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// Second factor policies that can be set for each role
+const (
+	PolicyOptional = "optional"
+	PolicyRequired = "required"
+	PolicyWebAuthn = "webauthn"
+)
+
+// Methods a login can be completed with
+const (
+	MethodPassword = "password"
+	MethodTOTP     = "totp"
+	MethodWebAuthn = "webauthn"
+	MethodRecovery = "recovery"
+)
+
+// challengeLifetime is how long a user has to complete the second factor after entering
+// their password, and challengeAttempts how many wrong codes they may enter in that time
+const (
+	challengeLifetime = 5 * time.Minute
+	challengeAttempts = 5
+)
+
+var (
+	// ErrInvalidChallenge is returned when a login challenge is unknown or has expired
+	ErrInvalidChallenge = errors.New("auth: login challenge is invalid or has expired, log in again")
+
+	// ErrInvalidCode is returned when a TOTP or recovery code is incorrect
+	ErrInvalidCode = errors.New("auth: invalid code")
+
+	// ErrSecondFactorRequired is returned when removing the last second factor that
+	// satisfies the policy for the user's role
+	ErrSecondFactorRequired = errors.New("auth: your role requires a second factor, enroll another one before removing this one")
+)
+
+// challenge is a login waiting for its second factor. Passkey logins start with a
+// challenge that has no user, since the user is identified by the key
+type challenge struct {
+	UserID    string
+	DeviceID  string
+	IP        string
+	UserAgent string
+	Expires   time.Time
+	Attempts  int
+
+	// The WebAuthn ceremony started for the challenge, if any
+	ceremony *webauthn.SessionData
+}
+
+// policy returns the second factor policy for the role
+func (s *store) policy(role string) string {
+	if p, ok := s.config.SecondFactor[role]; ok && p != "" {
+		return p
+	}
+
+	return PolicyOptional
+}
+
+// satisfies returns true if completing a login with the method meets the policy for the
+// user's role. Logins that do not are given an enrollment session
+func (s *store) satisfies(u *User, method string) bool {
+	switch s.policy(u.Role) {
+	case PolicyWebAuthn:
+		return method == MethodWebAuthn
+	case PolicyRequired:
+		return method != MethodPassword
+	default:
+		return true
+	}
+}
+
+// satisfiable returns true if the user has enrolled a second factor that meets the
+// policy for their role
+func (s *store) satisfiable(u *User) bool {
+	switch s.policy(u.Role) {
+	case PolicyWebAuthn:
+		return len(u.SecurityKeys) > 0
+	case PolicyRequired:
+		return u.HasSecondFactor()
+	default:
+		return true
+	}
+}
+
+// methods returns the ways the user can complete a login challenge
+func methods(u *User) []string {
+	m := []string{}
+	if u.TOTPEnabled {
+		m = append(m, MethodTOTP)
+	}
+	if len(u.SecurityKeys) > 0 {
+		m = append(m, MethodWebAuthn)
+	}
+	if len(u.RecoveryCodes) > 0 {
+		m = append(m, MethodRecovery)
+	}
+
+	return m
+}
+
+// newChallenge stores the challenge and returns its token. The store must be locked
+func (s *store) newChallenge(c *challenge, now time.Time) string {
+	token := ids.Hex(32)
+	c.Expires = now.Add(challengeLifetime)
+	s.challenges[hashToken(token)] = c
+
+	return token
+}
+
+// challenge returns the unexpired challenge for the token. The store must be locked
+func (s *store) challenge(token string, now time.Time) (*challenge, error) {
+	c, ok := s.challenges[hashToken(token)]
+	if !ok || now.After(c.Expires) {
+		return nil, ErrInvalidChallenge
+	}
+
+	return c, nil
+}
+
+// failChallenge records a wrong code against the challenge and the user, discarding the
+// challenge after too many attempts. The store must not be locked
+func (s *store) failChallenge(token string, c *challenge, now time.Time) error {
+	s.mu.Lock()
+	c.Attempts++
+	if c.Attempts >= challengeAttempts {
+		delete(s.challenges, hashToken(token))
+	}
+	s.mu.Unlock()
+
+	if c.UserID == "" {
+		return ErrInvalidCode
+	}
+
+	if err := s.failed(c.UserID, c.IP, now); errors.Is(err, ErrLocked) {
+		return err
+	}
+
+	return ErrInvalidCode
+}
+
+// completeChallenge finishes the login for the challenge with the method it was
+// completed with. The store must be locked
+func (s *store) completeChallenge(token string, c *challenge, method string, now time.Time) (LoginResult, error) {
+	delete(s.challenges, hashToken(token))
+
+	u, ok := s.users[c.UserID]
+	if !ok {
+		return LoginResult{}, ErrInvalidChallenge
+	}
+
+	if u.Locked(now) {
+		return LoginResult{}, ErrLocked
+	}
+
+	return s.complete(u, c.DeviceID, c.IP, c.UserAgent, method, now)
+}
+
+// VerifyTOTP completes a login challenge with a code from the user's authenticator app
+func VerifyTOTP(token string, code string) (LoginResult, error) {
+	if std == nil {
+		return LoginResult{}, ErrNotConfigured
+	}
+
+	now := time.Now().UTC()
+
+	std.mu.Lock()
+	c, err := std.challenge(token, now)
+	if err != nil {
+		std.mu.Unlock()
+		return LoginResult{}, err
+	}
+
+	u, ok := std.users[c.UserID]
+	if ok && u.TOTPEnabled {
+		if counter, valid := validateTOTP(u.TOTPSecret, code, u.TOTPCounter, now); valid {
+			u.TOTPCounter = counter
+			defer std.mu.Unlock()
+			return std.completeChallenge(token, c, MethodTOTP, now)
+		}
+	}
+	std.mu.Unlock()
+
+	return LoginResult{}, std.failChallenge(token, c, now)
+}
+
+// VerifyRecoveryCode completes a login challenge with one of the user's recovery codes.
+// Each code can only be used once
+func VerifyRecoveryCode(token string, code string) (LoginResult, error) {
+	if std == nil {
+		return LoginResult{}, ErrNotConfigured
+	}
+
+	now := time.Now().UTC()
+	hash := hashToken(normalizeRecoveryCode(code))
+
+	std.mu.Lock()
+	c, err := std.challenge(token, now)
+	if err != nil {
+		std.mu.Unlock()
+		return LoginResult{}, err
+	}
+
+	if u, ok := std.users[c.UserID]; ok && !u.Locked(now) {
+		for i, h := range u.RecoveryCodes {
+			if h != hash {
+				continue
+			}
+
+			u.RecoveryCodes = append(append([]string{}, u.RecoveryCodes[:i]...), u.RecoveryCodes[i+1:]...)
+			defer std.mu.Unlock()
+			return std.completeChallenge(token, c, MethodRecovery, now)
+		}
+	}
+	std.mu.Unlock()
+
+	return LoginResult{}, std.failChallenge(token, c, now)
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with a new set, returning
+// the codes. Only their hashes are stored so they cannot be shown again
+func GenerateRecoveryCodes(id string) ([]string, error) {
+	var codes []string
+	_, err := UpdateUser(id, func(u *User) error {
+		codes = newRecoveryCodes(u)
+		return nil
+	})
+
+	return codes, err
+}
+
+// ResetSecondFactors removes every second factor from the user, used when they have lost
+// their keys and recovery codes. If their role requires a second factor their next login
+// gives them an enrollment session to set up a new one
+func ResetSecondFactors(id string) (User, error) {
+	return UpdateUser(id, func(u *User) error {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPPending = ""
+		u.TOTPCounter = 0
+		u.SecurityKeys = nil
+		u.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// newRecoveryCodes sets ten new recovery codes on the user and returns them
+func newRecoveryCodes(u *User) []string {
+	codes := make([]string, 10)
+	u.RecoveryCodes = make([]string, len(codes))
+	for i := range codes {
+		code := ids.Hex(5)
+		codes[i] = code[:5] + "-" + code[5:]
+		u.RecoveryCodes[i] = hashToken(code)
+	}
+
+	return codes
+}
+
+// normalizeRecoveryCode strips the formatting users may type along with a code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// enrolled is called with the store locked after the user enrolls a second factor. It
+// returns new recovery codes if the user has none yet, and lifts the restriction on any
+// enrollment sessions now that the user meets their role's policy
+func (s *store) enrolled(u *User) ([]string, error) {
+	var codes []string
+	if len(u.RecoveryCodes) == 0 {
+		codes = newRecoveryCodes(u)
+	}
+
+	if err := s.saveUsers(); err != nil {
+		return nil, err
+	}
+
+	return codes, s.liftEnrollment(u)
+}
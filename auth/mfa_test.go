@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestSecondFactorPolicy(t *testing.T) {
+	key := []SecurityKey{{Name: "YubiKey"}}
+
+	tests := []struct {
+		name        string
+		policy      string
+		user        User
+		satisfies   map[string]bool
+		satisfiable bool
+	}{
+		{"optional", "", User{Role: RoleUser},
+			map[string]bool{MethodPassword: true, MethodTOTP: true, MethodRecovery: true, MethodWebAuthn: true}, true},
+		{"required without a factor", PolicyRequired, User{Role: RoleUser},
+			map[string]bool{MethodPassword: false, MethodTOTP: true, MethodRecovery: true, MethodWebAuthn: true}, false},
+		{"required with an app", PolicyRequired, User{Role: RoleUser, TOTPEnabled: true},
+			map[string]bool{MethodPassword: false}, true},
+		{"required with a key", PolicyRequired, User{Role: RoleUser, SecurityKeys: key},
+			map[string]bool{MethodPassword: false}, true},
+		{"required with only recovery codes", PolicyRequired, User{Role: RoleUser, RecoveryCodes: []string{"x"}},
+			map[string]bool{MethodPassword: false}, false},
+		{"keys only with an app", PolicyWebAuthn, User{Role: RoleUser, TOTPEnabled: true},
+			map[string]bool{MethodPassword: false, MethodTOTP: false, MethodRecovery: false, MethodWebAuthn: true}, false},
+		{"keys only with a key", PolicyWebAuthn, User{Role: RoleUser, SecurityKeys: key},
+			map[string]bool{MethodWebAuthn: true, MethodSSO: false}, true},
+		{"single sign on under a required policy", PolicyRequired, User{Role: RoleUser},
+			map[string]bool{MethodSSO: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &store{config: &config.AuthConfiguration{SecondFactor: map[string]string{RoleUser: tt.policy}}}
+
+			for method, want := range tt.satisfies {
+				if got := s.satisfies(&tt.user, method); got != want {
+					t.Errorf("satisfies(%s) = %v, want %v", method, got, want)
+				}
+			}
+			if got := s.satisfiable(&tt.user); got != tt.satisfiable {
+				t.Errorf("satisfiable = %v, want %v", got, tt.satisfiable)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	u := &User{}
+	codes := newRecoveryCodes(u)
+
+	if len(codes) != 10 || len(u.RecoveryCodes) != 10 {
+		t.Fatalf("%d codes and %d hashes", len(codes), len(u.RecoveryCodes))
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"as shown", codes[0], true},
+		{"upper case with space around", "  " + strings.ToUpper(codes[1]) + "\t", true},
+		{"without the dash", codes[2][:5] + codes[2][6:], true},
+		{"with spaces", codes[3][:5] + " " + codes[3][6:], true},
+		{"the stored hash", u.RecoveryCodes[4], false},
+		{"made up", "00000-00000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := hashToken(normalizeRecoveryCode(tt.code))
+
+			found := false
+			for _, h := range u.RecoveryCodes {
+				found = found || h == hash
+			}
+			if found != tt.ok {
+				t.Errorf("found %v, want %v", found, tt.ok)
+			}
+		})
+	}
+
+	for _, h := range u.RecoveryCodes {
+		for _, c := range codes {
+			if h == c || h == normalizeRecoveryCode(c) {
+				t.Fatalf("code %s is stored in the clear", c)
+			}
+		}
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	type step struct {
+		method string
+		code   func(u *User, codes []string) string
+		err    error
+	}
+
+	totp := func(offset int64) func(*User, []string) string {
+		return func(u *User, _ []string) string {
+			c, _ := totpCode(u.TOTPSecret, time.Now().Unix()/totpPeriod+offset)
+			return c
+		}
+	}
+	recovery := func(i int) func(*User, []string) string {
+		return func(_ *User, codes []string) string { return codes[i] }
+	}
+	wrong := func(*User, []string) string { return "000000" }
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"app code", []step{{MethodTOTP, totp(0), nil}}},
+		{"recovery code", []step{{MethodRecovery, recovery(0), nil}}},
+		{"wrong app code then the right one", []step{{MethodTOTP, wrong, ErrInvalidCode}, {MethodTOTP, totp(0), nil}}},
+		{"recovery code after a wrong one", []step{{MethodRecovery, wrong, ErrInvalidCode}, {MethodRecovery, recovery(3), nil}}},
+		{"challenge used up", []step{
+			{MethodTOTP, wrong, ErrInvalidCode}, {MethodTOTP, wrong, ErrInvalidCode}, {MethodTOTP, wrong, ErrInvalidCode},
+			{MethodTOTP, wrong, ErrInvalidCode}, {MethodTOTP, wrong, ErrInvalidCode}, {MethodTOTP, totp(0), ErrInvalidChallenge},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, u := configure(t)
+			c.LockoutThreshold = 10
+
+			codes := enrollTOTP(t, u.ID)
+			user := std.users[u.ID]
+
+			res, err := Login("alice", "correct horse", "203.0.113.7", "curl/8.5.0", "")
+			if err != nil || res.Token != "" || res.Challenge == "" {
+				t.Fatalf("a login with a second factor returned %+v, %v", res, err)
+			}
+
+			for i, s := range tt.steps {
+				verify := VerifyTOTP
+				if s.method == MethodRecovery {
+					verify = VerifyRecoveryCode
+				}
+
+				res, err := verify(res.Challenge, s.code(user, codes))
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d: got %v, want %v", i+1, err, s.err)
+				}
+				if err == nil && res.Token == "" {
+					t.Fatalf("step %d: no session", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestSecondFactorNotReusable(t *testing.T) {
+	_, u := configure(t)
+	codes := enrollTOTP(t, u.ID)
+	user := std.users[u.ID]
+
+	tests := []struct {
+		name   string
+		verify func(string, string) (LoginResult, error)
+		code   func() string
+	}{
+		{"app code", VerifyTOTP, func() string {
+			c, _ := totpCode(user.TOTPSecret, time.Now().Unix()/totpPeriod+1)
+			return c
+		}},
+		{"recovery code", VerifyRecoveryCode, func() string { return codes[5] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := tt.code()
+			for i, want := range []error{nil, ErrInvalidCode} {
+				res, err := Login("alice", "correct horse", "203.0.113.7", "curl/8.5.0", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := tt.verify(res.Challenge, code); !errors.Is(err, want) {
+					t.Fatalf("use %d: got %v, want %v", i+1, err, want)
+				}
+			}
+		})
+	}
+
+	// The challenge of a completed login cannot complete another
+	res, err := Login("alice", "correct horse", "203.0.113.7", "curl/8.5.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyRecoveryCode(res.Challenge, codes[6]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyRecoveryCode(res.Challenge, codes[7]); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("got %v, want %v", err, ErrInvalidChallenge)
+	}
+}
+
+// enrollTOTP enrolls an authenticator app for the user, returning their recovery codes
+func enrollTOTP(t *testing.T, id string) []string {
+	t.Helper()
+
+	e, err := BeginTOTP(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The code of the last period is used to confirm, leaving the current and next for
+	// the login
+	code, err := totpCode(e.Secret, time.Now().Unix()/totpPeriod-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := ConfirmTOTP(id, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return codes
+}
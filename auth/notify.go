@@ -0,0 +1,48 @@
+package auth
+
+import "github.com/cosmicpanel/CosmicPanel/notify"
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "welcome",
+		Description: "Sent to a new account once it is created",
+		Fields:      []string{"Username", "Password"},
+		Template: notify.Template{
+			Subject: "Welcome to {{.Product}}",
+			Body: "Your account {{.Username}} is ready.\n\n" +
+				"{{if .URL}}Log in at {{.URL}}\n{{end}}Username: {{.Username}}\n{{if .Password}}Password: {{.Password}}\n{{end}}\n" +
+				"{{if .Password}}Change your password once you have logged in. {{end}}Enable two-factor authentication to keep your account safe.\n",
+		},
+	})
+
+	notify.Register(notify.Kind{
+		Name:        "account_suspended",
+		Description: "Sent when an account is suspended, such as while an invoice is unpaid",
+		Fields:      []string{"Username", "Reason"},
+		Template: notify.Template{
+			Subject: "Your {{.Product}} account has been suspended",
+			SMS:     "{{.Product}}: your account {{.Username}} has been suspended.{{if .Reason}} Reason: {{.Reason}}{{end}}",
+			Body: "Your account {{.Username}} has been suspended and can no longer log in. Your websites, email and files are kept.\n\n" +
+				"{{if .Reason}}Reason: {{.Reason}}\n\n{{end}}" +
+				"Contact your provider to have the account unsuspended.\n",
+		},
+	})
+}
+
+// Notify sends the user a notification of the kind, in the brand of their reseller. It
+// does nothing for users with neither an email address nor a phone number
+func Notify(u User, kind string, data map[string]interface{}) error {
+	if u.Email == "" && u.Phone == "" {
+		return nil
+	}
+
+	return notify.Send(notify.Notification{
+		Kind:     kind,
+		Username: u.Username,
+		Email:    u.Email,
+		Phone:    u.Phone,
+		Reseller: u.Reseller(),
+		Language: u.Language,
+		Data:     data,
+	})
+}
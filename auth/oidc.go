@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// ErrInvalidToken is returned when an ID token from the identity provider cannot be
+// verified
+var ErrInvalidToken = errors.New("auth: invalid ID token from the identity provider")
+
+// clockSkew is how far the clocks of the panel and the identity provider may differ
+const clockSkew = 2 * time.Minute
+
+// oidcClient is used for every request to the identity provider
+var oidcClient = httpx.Client(15 * time.Second)
+
+// provider is an OpenID Connect identity provider, discovered from its issuer URL
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var (
+	pmu       sync.Mutex
+	providers = make(map[string]*provider)
+)
+
+// discover returns the provider with the issuer, fetching its configuration the first
+// time it is used
+func discover(issuer string) (*provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	pmu.Lock()
+	defer pmu.Unlock()
+
+	if p, ok := providers[issuer]; ok {
+		return p, nil
+	}
+
+	p := &provider{}
+	if err := getJSON(issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("auth: failed to discover identity provider %s: %w", issuer, err)
+	}
+
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("auth: identity provider reports issuer %s instead of %s", p.Issuer, issuer)
+	}
+
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("auth: identity provider %s is missing required endpoints", issuer)
+	}
+
+	providers[issuer] = p
+
+	return p, nil
+}
+
+// authorizeURL returns the URL users are sent to in order to log in at the provider
+func (p *provider) authorizeURL(clientID string, redirect string, scopes []string, state string, nonce string, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirect},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return p.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// exchange trades the authorization code for the ID token of the user
+func (p *provider) exchange(clientID string, secret string, redirect string, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirect},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("auth: invalid token response from the identity provider: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("auth: the identity provider refused the login: %s %s", body.Error, body.Description)
+	}
+
+	if body.IDToken == "" {
+		return "", errors.New("auth: the identity provider did not return an ID token")
+	}
+
+	return body.IDToken, nil
+}
+
+// verify checks the signature and claims of the ID token, returning its claims
+func (p *provider) verify(token string, clientID string, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := p.key(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("%w: issued by %s", ErrInvalidToken, iss)
+	}
+
+	if !slices.Contains(stringsClaim(claims, "aud"), clientID) {
+		return nil, fmt.Errorf("%w: not issued for this panel", ErrInvalidToken)
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidToken)
+	}
+
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// key returns the signing key with the ID. The keys are fetched again when the ID is
+// unknown, since providers rotate their keys, but at most once a minute
+func (p *provider) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+
+	if now.Sub(p.fetched) < time.Minute {
+		return nil, fmt.Errorf("%w: unknown signing key %s", ErrInvalidToken, kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("auth: failed to fetch the keys of the identity provider: %w", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.fetched = now
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if pub, err := k.public(); err == nil {
+			p.keys[k.Kid] = pub
+		}
+	}
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown signing key %s", ErrInvalidToken, kid)
+}
+
+// lookup returns the key with the ID, or the only key if tokens do not name theirs. The
+// provider must be locked
+func (p *provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+
+	k, ok := p.keys[kid]
+
+	return k, ok
+}
+
+// jwk is a public key published by the identity provider
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Elliptic curve keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// public returns the key as a crypto key
+func (k jwk) public() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("auth: unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("auth: unsupported key type %s", k.Kty)
+}
+
+// verifySignature checks the signature of a token signed with the algorithm
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		default:
+			err = fmt.Errorf("unsupported algorithm %s for an RSA key", alg)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+	case *ecdsa.PublicKey:
+		// Each algorithm is defined for one curve, so ES256 is refused with a P-384 key
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg != "ES"+strconv.Itoa(k.Curve.Params().BitSize) || len(sig) != 2*size {
+			return fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+		}
+
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// decodeSegment decodes a base64 encoded JSON segment of a token
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// stringsClaim returns a claim that can be either a string or a list of strings
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+
+	return nil
+}
+
+// getJSON fetches the URL and decodes its JSON response into v
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://login.example.com/realms/hosting"
+
+// sign returns a token with the header and claims signed by the key with the algorithm
+func sign(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if strings.HasSuffix(alg, "384") {
+			d := sha512.Sum384([]byte(signed))
+			digest = d[:]
+		} else {
+			d := sha256.Sum256([]byte(signed))
+			digest = d[:]
+		}
+
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &provider{
+		Issuer:  testIssuer,
+		keys:    map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "p384": &p384Key.PublicKey},
+		fetched: now,
+	}
+
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   testIssuer,
+			"aud":   "panel",
+			"sub":   "248289761001",
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"nonce": "n-0S6_WzA2Mj",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", sign(t, "RS256", "rsa", rsaKey, claims(nil)), true},
+		{"PS256", sign(t, "PS256", "rsa", rsaKey, claims(nil)), true},
+		{"ES256", sign(t, "ES256", "ec", ecKey, claims(nil)), true},
+		{"ES384", sign(t, "ES384", "p384", p384Key, claims(nil)), true},
+		{"issuer with a trailing slash", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["iss"] = testIssuer + "/" })), true},
+		{"audience in a list", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "panel"} })), true},
+		{"expired within the clock skew", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), true},
+
+		// Signatures
+		{"signed by another key", sign(t, "ES256", "ec", otherKey, claims(nil)), false},
+		{"unknown key", sign(t, "ES256", "other", otherKey, claims(nil)), false},
+		{"no key ID with several keys", sign(t, "ES256", "", ecKey, claims(nil)), false},
+		{"RSA key named as the EC key", sign(t, "RS256", "ec", rsaKey, claims(nil)), false},
+		{"ES256 with a P-384 key", sign(t, "ES256", "p384", p384Key, claims(nil)), false},
+		{"ES384 with a P-256 key", sign(t, "ES384", "ec", ecKey, claims(nil)), false},
+		{"HS256 with the RSA key", hmacWithPublicKey(t, rsaKey, claims(nil)), false},
+		{"no algorithm", unsigned(t, "none", claims(nil)), false},
+		{"claims changed", tamper(t, sign(t, "ES256", "ec", ecKey, claims(nil)), claims(func(c map[string]interface{}) { c["sub"] = "admin" })), false},
+		{"two segments", "eyJhbGciOiJub25lIn0.e30", false},
+		{"four segments", sign(t, "ES256", "ec", ecKey, claims(nil)) + ".x", false},
+		{"not base64", "!!.!!.!!", false},
+
+		// Claims
+		{"another issuer", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), false},
+		{"no issuer", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { delete(c, "iss") })), false},
+		{"another audience", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"audience list without the panel", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["aud"] = []string{"other"} })), false},
+		{"no audience", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { delete(c, "aud") })), false},
+		{"expired", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-3 * time.Minute).Unix() })), false},
+		{"no expiry", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"expiry as text", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["exp"] = "2099-01-01" })), false},
+		{"another nonce", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["nonce"] = "replayed" })), false},
+		{"no nonce", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { delete(c, "nonce") })), false},
+		{"no subject", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { delete(c, "sub") })), false},
+		{"empty subject", sign(t, "ES256", "ec", ecKey, claims(func(c map[string]interface{}) { c["sub"] = "" })), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.verify(tt.token, "panel", "n-0S6_WzA2Mj", now)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want %v", err, ErrInvalidToken)
+			}
+			if err == nil && claims["sub"] != "248289761001" {
+				t.Errorf("got the subject %v", claims["sub"])
+			}
+		})
+	}
+}
+
+// hmacWithPublicKey returns a token signed with HS256 using the public RSA key as the
+// secret, which verifiers that trust the algorithm of the header accept
+func hmacWithPublicKey(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+
+	token := unsigned(t, "HS256", claims)
+	mac := sha256.Sum256(append(key.PublicKey.N.Bytes(), token...))
+
+	return strings.TrimSuffix(token, ".") + "." + base64.RawURLEncoding.EncodeToString(mac[:])
+}
+
+// unsigned returns a token with the algorithm and no signature
+func unsigned(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa"})
+	payload, _ := json.Marshal(claims)
+
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+// tamper replaces the claims of a signed token and keeps its signature
+func tamper(t *testing.T, token string, claims map[string]interface{}) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
+
+func TestProviderKeys(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	sig, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jwk{ecJWK("sig", "sig", &sig.PublicKey), ecJWK("enc", "enc", &enc.PublicKey)}})
+	}))
+	defer srv.Close()
+
+	p := &provider{Issuer: testIssuer, JWKSURI: srv.URL}
+
+	tests := []struct {
+		name    string
+		kid     string
+		now     time.Time
+		ok      bool
+		fetches int32
+	}{
+		{"fetched the first time", "sig", now, true, 1},
+		{"known key", "sig", now.Add(time.Hour), true, 1},
+		{"encryption key", "enc", now, false, 1},
+		{"unknown key within a minute", "rotated", now.Add(30 * time.Second), false, 1},
+		{"unknown key after a minute", "rotated", now.Add(2 * time.Minute), false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.key(tt.kid, tt.now)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v", err)
+			}
+			if got := fetches.Load(); got != tt.fetches {
+				t.Errorf("keys fetched %d times, want %d", got, tt.fetches)
+			}
+		})
+	}
+}
+
+func ecJWK(kid string, use string, k *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Use: use,
+		Crv: k.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func TestJWKPublic(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  jwk
+		ok   bool
+	}{
+		{"P-256", ecJWK("a", "sig", &ec.PublicKey), true},
+		{"RSA", jwk{Kty: "RSA", N: base64.RawURLEncoding.EncodeToString(big.NewInt(0).Lsh(big.NewInt(1), 2047).Bytes()), E: "AQAB"}, true},
+		{"unsupported curve", jwk{Kty: "EC", Crv: "P-521", X: "AA", Y: "AA"}, false},
+		{"symmetric key", jwk{Kty: "oct"}, false},
+		{"OKP key", jwk{Kty: "OKP", Crv: "Ed25519", X: "AA"}, false},
+		{"modulus not base64", jwk{Kty: "RSA", N: "!!", E: "AQAB"}, false},
+		{"coordinate not base64", jwk{Kty: "EC", Crv: "P-256", X: "!!", Y: "AA"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.key.public(); (err == nil) != tt.ok {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestStringsClaim(t *testing.T) {
+	claims := map[string]interface{}{
+		"one":    "admins",
+		"list":   []interface{}{"admins", "resellers"},
+		"mixed":  []interface{}{"admins", 7, nil, "resellers"},
+		"number": 7.0,
+		"empty":  []interface{}{},
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"one", []string{"admins"}},
+		{"list", []string{"admins", "resellers"}},
+		{"mixed", []string{"admins", "resellers"}},
+		{"number", nil},
+		{"empty", []string{}},
+		{"missing", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringsClaim(claims, tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
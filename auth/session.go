@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/cache"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	storepkg "github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidSession is returned when a session token is unknown or has expired
+var ErrInvalidSession = errors.New("auth: session is invalid or has expired")
+
+// Session is a logged in user. Sessions are stored by the hash of their token so that a
+// copy of the sessions file cannot be used to log in
+type Session struct {
+	UserID    string    `json:"user_id"`
+	DeviceID  string    `json:"device_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+
+	// Enrollment sessions may only be used to enroll the second factor the user's role
+	// requires, and last at most enrollmentLifetime
+	Enrollment bool `json:"enrollment,omitempty"`
+
+	// Set when an admin or reseller is acting as the user, see Impersonate
+	Impersonator *Impersonator `json:"impersonator,omitempty"`
+}
+
+// heldBy returns true if the session is the user's or the user is impersonating someone
+// in it
+func (s *Session) heldBy(id string) bool {
+	return s.UserID == id || (s.Impersonator != nil && s.Impersonator.UserID == id)
+}
+
+// enrollmentLifetime is how long a user has to enroll a second factor after logging in
+// without one
+const enrollmentLifetime = 15 * time.Minute
+
+// newSession creates a session for the user and returns its token. The store must be
+// locked
+func (s *store) newSession(u *User, deviceID string, ip string, userAgent string, enrollment bool, now time.Time) (string, *Session) {
+	token := ids.Hex(32)
+	sess := &Session{
+		UserID:     u.ID,
+		DeviceID:   deviceID,
+		IP:         ip,
+		UserAgent:  userAgent,
+		Created:    now,
+		Expires:    now.Add(time.Duration(s.config.SessionLifetime) * time.Second),
+		Enrollment: enrollment,
+	}
+
+	if enrollment && sess.Expires.After(now.Add(enrollmentLifetime)) {
+		sess.Expires = now.Add(enrollmentLifetime)
+	}
+
+	s.sessions[hashToken(token)] = sess
+
+	return token, sess
+}
+
+// shared caches the sessions found in a state store shared with other controllers,
+// which were created after this daemon loaded the sessions. Changes to users purge it
+var shared = cache.New("auth.sessions", 30*time.Second, 10000)
+
+func init() {
+	shared.PurgeOn("user.*", "auth.user.*", "auth.impersonation.*")
+}
+
+// sharedLogin is a session found in the shared store along with its user
+type sharedLogin struct {
+	User    User
+	Session Session
+}
+
+// Authenticate returns the user and session for a session token
+func Authenticate(token string) (User, Session, error) {
+	if std == nil {
+		return User{}, Session{}, ErrNotConfigured
+	}
+
+	key := hashToken(token)
+
+	std.mu.Lock()
+	sess, ok := std.sessions[key]
+	if !ok {
+		std.mu.Unlock()
+		return sharedSession(key)
+	}
+	defer std.mu.Unlock()
+
+	if time.Now().After(sess.Expires) {
+		return User{}, Session{}, ErrInvalidSession
+	}
+
+	u, ok := std.users[sess.UserID]
+	if !ok || (u.Suspended && sess.Impersonator == nil) {
+		return User{}, Session{}, ErrInvalidSession
+	}
+
+	return *u, *sess, nil
+}
+
+// sharedSession looks up a session this daemon does not hold in a store on a database
+// server, where another controller may have created it. Lookups are cached, so that
+// requests with an unknown token do not each query the server
+func sharedSession(key string) (User, Session, error) {
+	if storepkg.Embedded() {
+		return User{}, Session{}, ErrInvalidSession
+	}
+
+	v, err := shared.Get(key, func() (interface{}, error) {
+		var l sharedLogin
+		err := storepkg.View(func(tx *storepkg.Tx) error {
+			if err := tx.Get(sessionKind, key, &l.Session); err != nil {
+				return err
+			}
+
+			return tx.Get(userKind, l.Session.UserID, &l.User)
+		})
+		if errors.Is(err, storepkg.ErrNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &l, nil
+	})
+	if err != nil {
+		zap.S().Named("auth").Warnw("failed to look up a session in the store", zap.Error(err))
+		return User{}, Session{}, ErrInvalidSession
+	}
+
+	l, ok := v.(*sharedLogin)
+	if !ok || time.Now().After(l.Session.Expires) || (l.User.Suspended && l.Session.Impersonator == nil) {
+		return User{}, Session{}, ErrInvalidSession
+	}
+
+	return l.User, l.Session, nil
+}
+
+// Logout ends the session for the token
+func Logout(token string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	key := hashToken(token)
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	sess, ok := std.sessions[key]
+	if !ok {
+		// The session may have been created by another controller sharing the store
+		if storepkg.Embedded() {
+			return nil
+		}
+
+		shared.Invalidate(key)
+		return storepkg.Update(func(tx *storepkg.Tx) error {
+			return tx.Delete(sessionKind, key)
+		})
+	}
+
+	delete(std.sessions, key)
+
+	if sess.Impersonator != nil {
+		std.endImpersonation(sess, "logout")
+	}
+
+	return std.saveSessions()
+}
+
+// ExpireSessions removes every session and login challenge that has expired
+func ExpireSessions() error {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+	for k, s := range std.sessions {
+		if now.After(s.Expires) {
+			delete(std.sessions, k)
+
+			if s.Impersonator != nil {
+				std.endImpersonation(s, "expired")
+			}
+		}
+	}
+
+	for k, c := range std.challenges {
+		if now.After(c.Expires) {
+			delete(std.challenges, k)
+		}
+	}
+
+	for k, c := range std.registrations {
+		if now.After(c.Expires) {
+			delete(std.registrations, k)
+		}
+	}
+
+	for k, l := range std.logins {
+		if now.After(l.Expires) {
+			delete(std.logins, k)
+		}
+	}
+
+	return std.saveSessions()
+}
+
+// liftEnrollment turns the user's enrollment sessions into full sessions once they have
+// enrolled the second factor their role requires. The store must be locked
+func (s *store) liftEnrollment(u *User) error {
+	if !s.satisfiable(u) {
+		return nil
+	}
+
+	lifted := false
+	for _, sess := range s.sessions {
+		if sess.UserID == u.ID && sess.Enrollment {
+			sess.Enrollment = false
+			sess.Expires = sess.Created.Add(time.Duration(s.config.SessionLifetime) * time.Second)
+			lifted = true
+		}
+	}
+
+	if !lifted {
+		return nil
+	}
+
+	return s.saveSessions()
+}
+
+// hashToken returns the key a session token is stored under
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
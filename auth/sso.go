@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// MethodSSO is the method of logins completed at the identity provider. The provider
+// enforces its own second factor, so these logins meet the required policy
+const MethodSSO = "sso"
+
+// ssoLifetime is how long a user has to log in at the identity provider
+const ssoLifetime = 10 * time.Minute
+
+var (
+	// ErrSSODisabled is returned when logging in through an identity provider while none
+	// is configured
+	ErrSSODisabled = errors.New("auth: single sign on is not configured")
+
+	// ErrSSORequired is returned when logging in with a local password as a role that may
+	// only log in through the identity provider
+	ErrSSORequired = errors.New("auth: your role must log in through single sign on")
+
+	// ErrSSONoRole is returned when the groups of a user at the identity provider do not
+	// give them a role on the panel
+	ErrSSONoRole = errors.New("auth: your groups do not give you access to the panel")
+)
+
+// ssoLogin is a login waiting for the user to come back from the identity provider
+type ssoLogin struct {
+	Nonce     string
+	Verifier  string
+	DeviceID  string
+	IP        string
+	UserAgent string
+	Expires   time.Time
+}
+
+// roleRank orders the roles by their privileges
+var roleRank = map[string]int{RoleUser: 1, RoleReseller: 2, RoleAdmin: 3}
+
+// SSOEnabled returns true if users can log in through an identity provider
+func SSOEnabled() bool {
+	return std != nil && std.config.SSO.Issuer != ""
+}
+
+// BeginSSO starts a login at the identity provider, returning the URL to send the user
+// to. The provider sends them back to the callback route with a state and code that are
+// passed to FinishSSO
+func BeginSSO(ip string, userAgent string, deviceID string) (string, error) {
+	if !SSOEnabled() {
+		return "", ErrSSODisabled
+	}
+
+	c := std.config.SSO
+
+	p, err := discover(c.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	state := ids.Hex(32)
+	login := &ssoLogin{
+		Nonce:     ids.Hex(16),
+		Verifier:  ids.Hex(32),
+		DeviceID:  deviceID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Expires:   time.Now().Add(ssoLifetime),
+	}
+
+	std.mu.Lock()
+	std.logins[hashToken(state)] = login
+	std.mu.Unlock()
+
+	scopes := append([]string{"openid", "profile", "email"}, c.Scopes...)
+
+	return p.authorizeURL(c.ClientID, c.RedirectURL, scopes, state, login.Nonce, login.Verifier), nil
+}
+
+// FinishSSO completes a login once the user has come back from the identity provider.
+// Users are matched by their subject at the provider and created the first time they
+// log in, and their role is set from their groups on every login
+func FinishSSO(state string, code string) (LoginResult, error) {
+	if !SSOEnabled() {
+		return LoginResult{}, ErrSSODisabled
+	}
+
+	now := time.Now()
+
+	std.mu.Lock()
+	login, ok := std.logins[hashToken(state)]
+	delete(std.logins, hashToken(state))
+	std.mu.Unlock()
+
+	if !ok || now.After(login.Expires) {
+		return LoginResult{}, ErrInvalidChallenge
+	}
+
+	c := std.config.SSO
+
+	p, err := discover(c.Issuer)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	token, err := p.exchange(c.ClientID, c.ClientSecret, c.RedirectURL, code, login.Verifier)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	claims, err := p.verify(token, c.ClientID, login.Nonce, now)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	subject := strings.TrimSuffix(c.Issuer, "/") + "#" + claims["sub"].(string)
+
+	role := std.mapRole(stringsClaim(claims, c.GroupsClaim))
+	if role == "" {
+		events.Publish(events.Event{
+			Type:     "auth.sso.denied",
+			SourceIP: login.IP,
+			Data:     map[string]interface{}{"subject": subject, "groups": stringsClaim(claims, c.GroupsClaim)},
+		})
+		return LoginResult{}, ErrSSONoRole
+	}
+
+	email, _ := claims["email"].(string)
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u := std.bySubject(subject)
+	if u == nil {
+		if u, err = std.provision(subject, ssoUsername(claims, c.UsernameClaim), email, role, now); err != nil {
+			return LoginResult{}, err
+		}
+	}
+
+	if u.Locked(now) {
+		return LoginResult{}, ErrLocked
+	}
+
+	if u.Role != role {
+		events.Publish(events.Event{
+			Type:     "auth.sso.role",
+			Resource: u.ID,
+			Data:     map[string]interface{}{"username": u.Username, "from": u.Role, "to": role},
+		})
+	}
+
+	u.Role = role
+	if role != RoleUser {
+		u.Owner = ""
+	}
+	if email != "" {
+		u.Email = email
+	}
+
+	return std.complete(u, login.DeviceID, login.IP, login.UserAgent, MethodSSO, now.UTC())
+}
+
+// mapRole returns the role the groups give a user, or the default role if none of them
+// do
+func (s *store) mapRole(groups []string) string {
+	role := ""
+	for _, g := range groups {
+		if r := s.config.SSO.Roles[g]; roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+
+	if role == "" && roleRank[s.config.SSO.DefaultRole] > 0 {
+		role = s.config.SSO.DefaultRole
+	}
+
+	return role
+}
+
+// provision creates the user logging in through the identity provider for the first
+// time. Local users are never linked to the provider by their username, since whoever
+// controls the username at the provider could then take over the account. The store
+// must be locked
+func (s *store) provision(subject string, username string, email string, role string, now time.Time) (*User, error) {
+	if username == "" {
+		return nil, fmt.Errorf("%w: no username", ErrInvalidToken)
+	}
+
+	if s.byUsername(username) != nil {
+		return nil, fmt.Errorf("%w: %s belongs to a local user", ErrUserExists, username)
+	}
+
+	u := &User{
+		ID:         ids.Hex(8),
+		Username:   username,
+		Email:      email,
+		Role:       role,
+		SSOSubject: subject,
+		Created:    now.UTC(),
+	}
+
+	// Users from the provider have no password, so they are given one nobody knows
+	if err := u.SetPassword(ids.Hex(32)); err != nil {
+		return nil, err
+	}
+
+	s.users[u.ID] = u
+
+	events.Publish(events.Event{
+		Type:     "auth.sso.provision",
+		Resource: u.ID,
+		Data:     map[string]interface{}{"username": u.Username, "role": u.Role, "subject": subject},
+	})
+
+	return u, nil
+}
+
+// bySubject returns the user linked to the subject at the identity provider. The store
+// must be locked
+func (s *store) bySubject(subject string) *User {
+	for _, u := range s.users {
+		if u.SSOSubject == subject {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// enforced returns true if users with the role may only log in through the identity
+// provider
+func (s *store) enforced(role string) bool {
+	return s.config.SSO.Issuer != "" && slices.Contains(s.config.SSO.Enforce, role)
+}
+
+// ssoUsername returns the username for a new user from the claims, falling back to
+// their email address when the provider does not send the username claim
+func ssoUsername(claims map[string]interface{}, claim string) string {
+	username, _ := claims[claim].(string)
+	if username == "" {
+		username, _ = claims["email"].(string)
+	}
+
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "." || username == ".." || strings.ContainsAny(username, "/\\ ") {
+		return ""
+	}
+
+	return username
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestMapRole(t *testing.T) {
+	tests := []struct {
+		name        string
+		roles       map[string]string
+		defaultRole string
+		groups      []string
+		want        string
+	}{
+		{"mapped group", map[string]string{"hosting-admins": RoleAdmin}, "", []string{"hosting-admins"}, RoleAdmin},
+		{"highest of several groups", map[string]string{"staff": RoleUser, "partners": RoleReseller, "ops": RoleAdmin}, "", []string{"staff", "ops", "partners"}, RoleAdmin},
+		{"unmapped groups are ignored", map[string]string{"partners": RoleReseller}, "", []string{"everyone", "partners"}, RoleReseller},
+		{"no mapped group", map[string]string{"ops": RoleAdmin}, "", []string{"everyone"}, ""},
+		{"no groups", map[string]string{"ops": RoleAdmin}, "", nil, ""},
+		{"default role", map[string]string{"ops": RoleAdmin}, RoleUser, []string{"everyone"}, RoleUser},
+		{"mapped group over the default", map[string]string{"ops": RoleAdmin}, RoleUser, []string{"ops"}, RoleAdmin},
+		{"lower mapped group over the default", map[string]string{"staff": RoleUser}, RoleReseller, []string{"staff"}, RoleUser},
+		{"unknown mapped role", map[string]string{"ops": "root"}, "", []string{"ops"}, ""},
+		{"unknown default role", nil, "root", []string{"ops"}, ""},
+		{"group names are exact", map[string]string{"ops": RoleAdmin}, "", []string{"OPS", "ops-readonly"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &store{config: &config.AuthConfiguration{SSO: config.SSOConfiguration{Roles: tt.roles, DefaultRole: tt.defaultRole}}}
+			if got := s.mapRole(tt.groups); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSOUsername(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"username claim", map[string]interface{}{"preferred_username": "Alice", "email": "alice@example.com"}, "alice"},
+		{"email when there is no username", map[string]interface{}{"email": "Bob@Example.com"}, "bob@example.com"},
+		{"email when the username is empty", map[string]interface{}{"preferred_username": "", "email": "bob@example.com"}, "bob@example.com"},
+		{"surrounding spaces", map[string]interface{}{"preferred_username": " carol "}, "carol"},
+		{"username not a string", map[string]interface{}{"preferred_username": 7.0, "email": "dave@example.com"}, "dave@example.com"},
+		{"nothing", map[string]interface{}{}, ""},
+		{"slash", map[string]interface{}{"preferred_username": "../root"}, ""},
+		{"backslash", map[string]interface{}{"preferred_username": `corp\alice`}, ""},
+		{"space inside", map[string]interface{}{"preferred_username": "alice smith"}, ""},
+		{"dot", map[string]interface{}{"preferred_username": "."}, ""},
+		{"dot dot", map[string]interface{}{"preferred_username": ".."}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ssoUsername(tt.claims, "preferred_username"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvision(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		username string
+		err      error
+	}{
+		{"new user", "carol", nil},
+		{"username of a local user", "alice", ErrUserExists},
+		{"username of a local user in another case", "ALICE", ErrUserExists},
+		{"no username", "", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := &User{ID: "u1", Username: "alice", Role: RoleAdmin}
+			s := &store{users: map[string]*User{local.ID: local}}
+
+			u, err := s.provision(testIssuer+"#248289761001", tt.username, "", RoleUser, now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			if local.SSOSubject != "" {
+				t.Errorf("the local user was linked to %s", local.SSOSubject)
+			}
+
+			if err != nil {
+				if len(s.users) != 1 {
+					t.Errorf("%d users, want only the local one", len(s.users))
+				}
+				return
+			}
+
+			if s.bySubject(testIssuer+"#248289761001") != u || u.Role != RoleUser {
+				t.Errorf("got %+v", u)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	storepkg "github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("auth: not configured")
+
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("auth: user not found")
+
+	// ErrUserExists is returned when creating a user with a username already in use
+	ErrUserExists = errors.New("auth: a user with that username already exists")
+)
+
+// The kinds users and sessions are kept under in the state store
+const (
+	userKind    = "user"
+	sessionKind = "session"
+)
+
+// store holds every user and session, persisting them in the panel's state store. Login
+// challenges and security key registrations only live for a few minutes so they are
+// kept in memory
+type store struct {
+	mu       sync.Mutex
+	config   *config.AuthConfiguration
+	webauthn *webauthn.WebAuthn
+	users    map[string]*User
+	sessions map[string]*Session
+
+	challenges    map[string]*challenge
+	registrations map[string]*challenge
+	logins        map[string]*ssoLogin
+}
+
+var std *store
+
+// Configure loads the users and sessions from the state store, which must be configured
+// first. Users and sessions kept in the data directory by earlier releases are moved
+// into it
+func Configure(dataDir string, c *config.AuthConfiguration) error {
+	wa, err := newWebAuthn(c.WebAuthn.ID, c.WebAuthn.Name, c.WebAuthn.Origins)
+	if err != nil {
+		return err
+	}
+
+	s := &store{
+		config:        c,
+		webauthn:      wa,
+		users:         make(map[string]*User),
+		sessions:      make(map[string]*Session),
+		challenges:    make(map[string]*challenge),
+		registrations: make(map[string]*challenge),
+		logins:        make(map[string]*ssoLogin),
+	}
+
+	dir := filepath.Join(dataDir, "auth")
+	if err := storepkg.Import(userKind, filepath.Join(dir, "users.json")); err != nil {
+		return err
+	}
+
+	if err := storepkg.Import(sessionKind, filepath.Join(dir, "sessions.json")); err != nil {
+		return err
+	}
+
+	if err := storepkg.Load(userKind, &s.users); err != nil {
+		return err
+	}
+
+	if err := storepkg.Load(sessionKind, &s.sessions); err != nil {
+		return err
+	}
+
+	std = s
+
+	return nil
+}
+
+// Users returns every user
+func Users() []User {
+	if std == nil {
+		return []User{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	users := make([]User, 0, len(std.users))
+	for _, u := range std.users {
+		users = append(users, *u)
+	}
+
+	return users
+}
+
+// GetUser returns the user with the ID
+func GetUser(id string) (User, error) {
+	if std == nil {
+		return User{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return *u, nil
+}
+
+// CreateUser adds a new user with the password
+func CreateUser(u User, password string) (User, error) {
+	if std == nil {
+		return u, ErrNotConfigured
+	}
+
+	u.Username = strings.ToLower(strings.TrimSpace(u.Username))
+	if u.Username == "" {
+		return u, errors.New("auth: username is required")
+	}
+
+	switch u.Role {
+	case RoleAdmin, RoleReseller, RoleUser:
+	case "":
+		u.Role = RoleUser
+	default:
+		return u, errors.New("auth: role must be one of admin, reseller or user")
+	}
+
+	if u.Owner != "" && u.Role != RoleUser {
+		return u, errors.New("auth: only users can belong to a reseller")
+	}
+
+	if !ValidPhone(u.Phone) {
+		return u, errors.New("auth: phone must be a number in international format, such as +447700900123")
+	}
+
+	u.Language = locale.Canonical(u.Language)
+	if err := checkLanguage(u.Language); err != nil {
+		return u, err
+	}
+
+	if len(password) < 8 {
+		return u, errors.New("auth: password must be at least 8 characters")
+	}
+
+	if err := u.SetPassword(password); err != nil {
+		return u, err
+	}
+
+	u.ID = ids.Hex(8)
+	u.Created = time.Now().UTC()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if std.byUsername(u.Username) != nil {
+		return u, ErrUserExists
+	}
+
+	if owner, ok := std.users[u.Owner]; u.Owner != "" && (!ok || owner.Role != RoleReseller) {
+		return u, errors.New("auth: owner must be the ID of a reseller")
+	}
+
+	std.users[u.ID] = &u
+
+	return u, std.saveUsers()
+}
+
+// ImportUser adds a user exported from another server, keeping its password and second
+// factors so that it can log in as before. The user keeps its ID unless the ID is taken,
+// and loses its owner if the owner is not a reseller on this server
+func ImportUser(u User) (User, error) {
+	if std == nil {
+		return u, ErrNotConfigured
+	}
+
+	if u.Username == "" || u.PasswordHash == "" {
+		return u, errors.New("auth: imported users must have a username and password")
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if std.byUsername(u.Username) != nil {
+		return u, ErrUserExists
+	}
+
+	if _, ok := std.users[u.ID]; ok || u.ID == "" {
+		u.ID = ids.Hex(8)
+	}
+
+	if owner, ok := std.users[u.Owner]; u.Owner != "" && (!ok || owner.Role != RoleReseller) {
+		u.Owner = ""
+	}
+
+	u.FailedLogins = 0
+	u.LockedUntil = time.Time{}
+
+	std.users[u.ID] = &u
+
+	return u, std.saveUsers()
+}
+
+// UpdateUser applies the function to the user with the ID and persists the result
+func UpdateUser(id string, fn func(u *User) error) (User, error) {
+	if std == nil {
+		return User{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	updated := *u
+	if err := fn(&updated); err != nil {
+		return *u, err
+	}
+
+	std.users[id] = &updated
+
+	return updated, std.saveUsers()
+}
+
+// SetLanguage sets the language the user reads the panel in, or clears it when empty
+func SetLanguage(id string, language string) (User, error) {
+	language = locale.Canonical(language)
+	if err := checkLanguage(language); err != nil {
+		return User{}, err
+	}
+
+	return UpdateUser(id, func(u *User) error {
+		u.Language = language
+		return nil
+	})
+}
+
+// checkLanguage returns an error unless the language is empty or one the panel speaks
+func checkLanguage(language string) error {
+	if language != "" && !locale.Supported(language) {
+		return fmt.Errorf("auth: the panel has no translation into %s", language)
+	}
+
+	return nil
+}
+
+// DeleteUser removes the user and every session they hold, including those they are
+// impersonating someone in. Users the user owned are kept without an owner
+func DeleteUser(id string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if _, ok := std.users[id]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(std.users, id)
+	for k, s := range std.sessions {
+		if s.heldBy(id) {
+			delete(std.sessions, k)
+		}
+	}
+
+	// A reseller imported later with the same ID would otherwise own them
+	for _, u := range std.users {
+		if u.Owner == id {
+			u.Owner = ""
+		}
+	}
+
+	return std.saveAll()
+}
+
+// PlanDelete reports what DeleteUser would remove without removing anything
+func PlanDelete(id string) (*dryrun.Plan, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	plan := dryrun.New("user.delete")
+	plan.Add(dryrun.User, dryrun.Delete, u.Username, u.Role)
+
+	// Sessions are keyed by their token, so they are identified by where they are from
+	for _, s := range std.sessions {
+		if s.heldBy(id) {
+			plan.Add(dryrun.Session, dryrun.Delete, s.IP, s.UserAgent)
+		}
+	}
+
+	for _, owned := range std.users {
+		if owned.Owner == id {
+			plan.Note(owned.Username + " is owned by " + u.Username + " and is kept without an owner")
+		}
+	}
+
+	return plan, nil
+}
+
+// byUsername returns the user with the username. The store must be locked
+func (s *store) byUsername(username string) *User {
+	username = strings.ToLower(username)
+	for _, u := range s.users {
+		if u.Username == username {
+			return u
+		}
+	}
+
+	return nil
+}
+
+func (s *store) saveUsers() error {
+	return storepkg.Save(userKind, s.users)
+}
+
+func (s *store) saveSessions() error {
+	return storepkg.Save(sessionKind, s.sessions)
+}
+
+// saveAll saves the users and sessions in one transaction
+func (s *store) saveAll() error {
+	return storepkg.Update(func(tx *storepkg.Tx) error {
+		if err := tx.Save(userKind, s.users); err != nil {
+			return err
+		}
+
+		return tx.Save(sessionKind, s.sessions)
+	})
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+)
+
+func TestDeleteUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		delete   string
+		removed  []string // sorted
+		disowned []string
+	}{
+		{"user", "una", []string{"una", "una as rita"}, nil},
+		{"reseller", "rita", []string{"rita", "una as rita"}, []string{"una", "uli"}},
+		{"admin", "root", []string{"ada as root", "root"}, nil},
+		{"user without sessions", "ada", []string{"ada as root"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t)
+
+			users := map[string]User{}
+			for _, u := range []User{
+				{Username: "root", Role: RoleAdmin},
+				{Username: "rita", Role: RoleReseller},
+				{Username: "una", Owner: "rita"},
+				{Username: "uli", Owner: "rita"},
+				{Username: "ada"},
+			} {
+				if u.Owner != "" {
+					u.Owner = users[u.Owner].ID
+				}
+
+				created, err := CreateUser(u, "correct horse")
+				if err != nil {
+					t.Fatal(err)
+				}
+				users[created.Username] = created
+			}
+
+			// Sessions are told apart by their user agent
+			std.mu.Lock()
+			for _, s := range []struct{ user, by string }{
+				{"root", ""}, {"rita", ""}, {"una", ""}, {"uli", ""}, {"una", "rita"}, {"ada", "root"},
+			} {
+				u := users[s.user]
+				_, sess := std.newSession(&u, "", "192.0.2.1", s.user, false, time.Now())
+				if s.by != "" {
+					by := users[s.by]
+					sess.Impersonator = &Impersonator{UserID: by.ID, Username: by.Username, Role: by.Role}
+					sess.UserAgent += " as " + s.by
+				}
+			}
+			std.mu.Unlock()
+
+			id := users[tt.delete].ID
+
+			plan, err := PlanDelete(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var planned []string
+			for _, c := range plan.Changes {
+				if c.Kind == dryrun.Session {
+					planned = append(planned, c.Detail)
+				}
+			}
+			slices.Sort(planned)
+			if !slices.Equal(planned, tt.removed) {
+				t.Errorf("the plan removes sessions %q, want %q", planned, tt.removed)
+			}
+			if len(plan.Notes) != len(tt.disowned) {
+				t.Errorf("the plan notes %q, want a note for each of %q", plan.Notes, tt.disowned)
+			}
+
+			if err := DeleteUser(id); err != nil {
+				t.Fatal(err)
+			}
+
+			std.mu.Lock()
+			var removed []string
+			for _, agent := range []string{"root", "rita", "una", "uli", "una as rita", "ada as root"} {
+				kept := false
+				for _, s := range std.sessions {
+					kept = kept || s.UserAgent == agent
+				}
+				if !kept {
+					removed = append(removed, agent)
+				}
+			}
+			std.mu.Unlock()
+
+			slices.Sort(removed)
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed sessions %q, want %q", removed, tt.removed)
+			}
+
+			for _, name := range []string{"una", "uli"} {
+				if name == tt.delete {
+					continue
+				}
+
+				u, err := GetUser(users[name].ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := users["rita"].ID
+				if slices.Contains(tt.disowned, name) {
+					want = ""
+				}
+				if u.Owner != want {
+					t.Errorf("%s is owned by %q, want %q", name, u.Owner, want)
+				}
+			}
+
+			if _, err := GetUser(id); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("the user is still there: %v", err)
+			}
+			if _, err := PlanDelete(id); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("planning to delete the user again: %v", err)
+			}
+		})
+	}
+}
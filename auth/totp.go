@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// totpPeriod is the number of seconds each TOTP code is valid for, as used by every
+// common authenticator app
+const totpPeriod = 30
+
+// totpEncoding is the base32 encoding authenticator apps expect secrets in
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is returned when a user starts enrolling an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+
+	// An otpauth URI for the secret, which the client shows as a QR code
+	URI string `json:"uri"`
+}
+
+// BeginTOTP generates a new TOTP secret for the user. It is not used for logins until
+// the user proves their app has it by calling ConfirmTOTP with a code
+func BeginTOTP(id string) (TOTPEnrollment, error) {
+	b := make([]byte, 20)
+	rand.Read(b)
+	secret := totpEncoding.EncodeToString(b)
+
+	u, err := UpdateUser(id, func(u *User) error {
+		u.TOTPPending = secret
+		return nil
+	})
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	label := url.PathEscape("CosmicPanel:" + u.Username)
+	query := url.Values{"secret": {secret}, "issuer": {"CosmicPanel"}}
+
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode()),
+	}, nil
+}
+
+// ConfirmTOTP enables the pending TOTP secret once the user enters a valid code from it.
+// If this is the user's first second factor, their recovery codes are returned
+func ConfirmTOTP(id string, code string) ([]string, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	now := time.Now().UTC()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	if u.TOTPPending == "" {
+		return nil, errors.New("auth: no authenticator app is being enrolled")
+	}
+
+	counter, valid := validateTOTP(u.TOTPPending, code, 0, now)
+	if !valid {
+		return nil, ErrInvalidCode
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPSecret = u.TOTPPending
+	u.TOTPPending = ""
+	u.TOTPCounter = counter
+
+	return std.enrolled(u)
+}
+
+// DisableTOTP removes the user's authenticator app
+func DisableTOTP(id string) (User, error) {
+	return UpdateUser(id, func(u *User) error {
+		removed := *u
+		removed.TOTPEnabled = false
+		if std.satisfiable(u) && !std.satisfiable(&removed) {
+			return ErrSecondFactorRequired
+		}
+
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPPending = ""
+		u.TOTPCounter = 0
+		return nil
+	})
+}
+
+// validateTOTP checks the code against the secret, allowing for one period of clock
+// drift either side. Codes at or before the last accepted counter are rejected so that
+// a code cannot be replayed, and the counter of the matching code is returned
+func validateTOTP(secret string, code string, last int64, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != 6 {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for counter := current - 1; counter <= current+1; counter++ {
+		if counter <= last {
+			continue
+		}
+
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpCode returns the six digit code for the counter as defined by RFC 6238
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the test vectors in RFC 6238, 12345678901234567890
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// The last six digits of the eight digit codes in appendix B of RFC 6238
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfcSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("a secret that is not base32 was accepted")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	code := func(counter int64) string {
+		c, err := totpCode(rfcSecret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		code    string
+		last    int64
+		counter int64
+		ok      bool
+	}{
+		{"current code", rfcSecret, code(current), 0, current, true},
+		{"previous period", rfcSecret, code(current - 1), 0, current - 1, true},
+		{"next period", rfcSecret, code(current + 1), 0, current + 1, true},
+		{"with spaces", rfcSecret, " " + code(current)[:3] + " " + code(current)[3:] + " ", 0, current, true},
+		{"lower case secret", strings.ToLower(rfcSecret), code(current), 0, current, true},
+
+		{"two periods old", rfcSecret, code(current - 2), 0, 0, false},
+		{"two periods ahead", rfcSecret, code(current + 2), 0, 0, false},
+		{"replayed", rfcSecret, code(current), current, 0, false},
+		{"older than the last accepted", rfcSecret, code(current - 1), current, 0, false},
+		{"newer than the last accepted", rfcSecret, code(current + 1), current, current + 1, true},
+		{"wrong code", rfcSecret, "000000", 0, 0, false},
+		{"five digits", rfcSecret, code(current)[:5], 0, 0, false},
+		{"seven digits", rfcSecret, code(current) + "0", 0, 0, false},
+		{"empty", rfcSecret, "", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := validateTOTP(tt.secret, tt.code, tt.last, now)
+			if ok != tt.ok || counter != tt.counter {
+				t.Errorf("got %d, %v, want %d, %v", counter, ok, tt.counter, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a panel user can have
+const (
+	RoleAdmin    = "admin"
+	RoleReseller = "reseller"
+	RoleUser     = "user"
+)
+
+// User is a person who can log in to the panel
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+
+	// The mobile number notifications are sent to by SMS, in international format
+	Phone string `json:"phone,omitempty"`
+
+	// The language the user reads the panel and their notifications in, as a tag such as
+	// de or pt-BR. Users without one get that of their browser or their reseller
+	Language string `json:"language,omitempty"`
+
+	// The ID of the reseller the user belongs to, who may act as the user. Users without
+	// an owner belong to the administrators
+	Owner string `json:"owner,omitempty"`
+
+	PasswordHash string `json:"password_hash"`
+
+	// The issuer and subject of the user at the identity provider they log in through
+	SSOSubject string `json:"sso_subject,omitempty"`
+
+	// The number of consecutive failed logins, and the time the account is locked until
+	// once that number exceeds the lockout threshold
+	FailedLogins int       `json:"failed_logins"`
+	LockedUntil  time.Time `json:"locked_until,omitempty"`
+
+	// Devices and networks the user has successfully logged in from
+	Devices   []Device  `json:"devices"`
+	Networks  []string  `json:"networks"`
+	Created   time.Time `json:"created"`
+	LastLogin time.Time `json:"last_login,omitempty"`
+
+	// The hosting package of the account, set by the billing system that provisioned it
+	Package string `json:"package,omitempty"`
+
+	// Suspended users cannot log in, such as while an invoice is unpaid, and keep
+	// everything else
+	Suspended     bool   `json:"suspended,omitempty"`
+	SuspendReason string `json:"suspend_reason,omitempty"`
+
+	// Second factors. A TOTP secret is kept pending until the user confirms it with a
+	// code, and the counter of the last accepted code stops a code being used twice
+	TOTPEnabled   bool          `json:"totp_enabled"`
+	TOTPSecret    string        `json:"totp_secret,omitempty"`
+	TOTPPending   string        `json:"totp_pending,omitempty"`
+	TOTPCounter   int64         `json:"totp_counter,omitempty"`
+	SecurityKeys  []SecurityKey `json:"security_keys"`
+	RecoveryCodes []string      `json:"recovery_codes,omitempty"`
+}
+
+// SecurityKey is a FIDO2 authenticator registered by the user, either a hardware key or
+// a passkey stored by their device
+type SecurityKey struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+
+	Credential webauthn.Credential `json:"credential"`
+}
+
+// Device is a browser or client the user has logged in from. Clients identify a device
+// by sending back the device ID issued on their first login
+type Device struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	LastIP    string    `json:"last_ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// phoneNumber matches mobile numbers in E.164 format, such as +447700900123
+var phoneNumber = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// ValidPhone returns true if the phone number is empty or in international format
+func ValidPhone(phone string) bool {
+	return phone == "" || phoneNumber.MatchString(phone)
+}
+
+// SetPassword hashes the password and stores it on the user
+func (u *User) SetPassword(password string) error {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = string(b)
+
+	return nil
+}
+
+// CheckPassword returns true if the password matches the user's password
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// Locked returns true if the account is locked out at the given time
+func (u *User) Locked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// Public returns a copy of the user safe to return from the API
+func (u User) Public() User {
+	u.PasswordHash = ""
+	u.TOTPSecret = ""
+	u.TOTPPending = ""
+	u.RecoveryCodes = nil
+
+	keys := make([]SecurityKey, len(u.SecurityKeys))
+	for i, k := range u.SecurityKeys {
+		keys[i] = k.Public()
+	}
+	u.SecurityKeys = keys
+
+	return u
+}
+
+// Public returns a copy of the key without its credential
+func (k SecurityKey) Public() SecurityKey {
+	k.Credential = webauthn.Credential{}
+
+	return k
+}
+
+// Reseller returns the ID of the reseller whose brand the user sees, which is their own
+// for a reseller and empty for users who belong to the administrators
+func (u User) Reseller() string {
+	if u.Role == RoleReseller {
+		return u.ID
+	}
+
+	return u.Owner
+}
+
+// HasSecondFactor returns true if the user has enrolled an authenticator app or a
+// security key
+func (u *User) HasSecondFactor() bool {
+	return u.TOTPEnabled || len(u.SecurityKeys) > 0
+}
+
+// WebAuthnID returns the user handle security keys are registered with
+func (u *User) WebAuthnID() []byte {
+	return []byte(u.ID)
+}
+
+// WebAuthnName returns the name shown when choosing a key
+func (u *User) WebAuthnName() string {
+	return u.Username
+}
+
+// WebAuthnDisplayName returns the name shown when choosing a key
+func (u *User) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+// WebAuthnCredentials returns the credentials of every registered security key
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.SecurityKeys))
+	for i, k := range u.SecurityKeys {
+		creds[i] = k.Credential
+	}
+
+	return creds
+}
+
+// ForgetDevice removes a device so the next login from it is treated as new
+func (u *User) ForgetDevice(id string) bool {
+	for i := range u.Devices {
+		if u.Devices[i].ID == id {
+			u.Devices = append(append([]Device{}, u.Devices[:i]...), u.Devices[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// device returns the device with the ID, or nil if the user has never used it
+func (u *User) device(id string) *Device {
+	for i := range u.Devices {
+		if u.Devices[i].ID == id {
+			return &u.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// knowsNetwork returns true if the user has logged in from the network before
+func (u *User) knowsNetwork(network string) bool {
+	for _, n := range u.Networks {
+		if n == network {
+			return true
+		}
+	}
+
+	return false
+}
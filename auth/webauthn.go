@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.uber.org/zap"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+var (
+	// ErrWebAuthnDisabled is returned when using security keys without a relying party
+	// configured
+	ErrWebAuthnDisabled = errors.New("auth: security keys are not configured, set auth.webauthn.id")
+
+	// ErrKeyNotFound is returned when a security key does not exist
+	ErrKeyNotFound = errors.New("auth: security key not found")
+)
+
+// newWebAuthn returns the relying party for the configuration, or nil if security keys
+// are not configured
+func newWebAuthn(id string, name string, origins []string) (*webauthn.WebAuthn, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          id,
+		RPDisplayName: name,
+		RPOrigins:     origins,
+	})
+}
+
+// BeginKeyRegistration starts registering a security key for the user, returning the
+// options the client passes to navigator.credentials.create
+func BeginKeyRegistration(id string) (*protocol.CredentialCreation, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	if std.webauthn == nil {
+		return nil, ErrWebAuthnDisabled
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	u, ok := std.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, len(u.SecurityKeys))
+	for i, k := range u.SecurityKeys {
+		exclude[i] = k.Credential.Descriptor()
+	}
+
+	// Keys are registered as discoverable credentials when the authenticator supports it,
+	// so that they can also be used to log in without a password
+	creation, session, err := std.webauthn.BeginRegistration(u,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	std.registrations[id] = &challenge{UserID: id, Expires: time.Now().Add(challengeLifetime), ceremony: session}
+
+	return creation, nil
+}
+
+// FinishKeyRegistration verifies the client's response to BeginKeyRegistration and adds
+// the key to the user. If this is the user's first second factor, their recovery codes
+// are returned
+func FinishKeyRegistration(id string, name string, response []byte) (SecurityKey, []string, error) {
+	if std == nil {
+		return SecurityKey{}, nil, ErrNotConfigured
+	}
+
+	if std.webauthn == nil {
+		return SecurityKey{}, nil, ErrWebAuthnDisabled
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return SecurityKey{}, nil, err
+	}
+
+	now := time.Now().UTC()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	reg, ok := std.registrations[id]
+	delete(std.registrations, id)
+	if !ok || now.After(reg.Expires) {
+		return SecurityKey{}, nil, errors.New("auth: no security key is being registered, start again")
+	}
+
+	u, ok := std.users[id]
+	if !ok {
+		return SecurityKey{}, nil, ErrUserNotFound
+	}
+
+	cred, err := std.webauthn.CreateCredential(u, *reg.ceremony, parsed)
+	if err != nil {
+		return SecurityKey{}, nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Security key " + now.Format("2006-01-02")
+	}
+
+	key := SecurityKey{ID: ids.Hex(8), Name: name, Created: now, Credential: *cred}
+	u.SecurityKeys = append(append([]SecurityKey{}, u.SecurityKeys...), key)
+
+	codes, err := std.enrolled(u)
+	if err != nil {
+		return SecurityKey{}, nil, err
+	}
+
+	return key, codes, nil
+}
+
+// RemoveSecurityKey removes one of the user's security keys
+func RemoveSecurityKey(id string, keyID string) (User, error) {
+	return UpdateUser(id, func(u *User) error {
+		for i, k := range u.SecurityKeys {
+			if k.ID != keyID {
+				continue
+			}
+
+			removed := *u
+			removed.SecurityKeys = append(append([]SecurityKey{}, u.SecurityKeys[:i]...), u.SecurityKeys[i+1:]...)
+			if std.satisfiable(u) && !std.satisfiable(&removed) {
+				return ErrSecondFactorRequired
+			}
+
+			u.SecurityKeys = removed.SecurityKeys
+			return nil
+		}
+
+		return ErrKeyNotFound
+	})
+}
+
+// BeginKeyLogin starts completing a login challenge with one of the user's security
+// keys, returning the options the client passes to navigator.credentials.get
+func BeginKeyLogin(token string) (*protocol.CredentialAssertion, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	if std.webauthn == nil {
+		return nil, ErrWebAuthnDisabled
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	c, err := std.challenge(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := std.users[c.UserID]
+	if !ok || len(u.SecurityKeys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	assertion, session, err := std.webauthn.BeginLogin(u)
+	if err != nil {
+		return nil, err
+	}
+	c.ceremony = session
+
+	return assertion, nil
+}
+
+// BeginPasskeyLogin starts a login without a username or password, where the user is
+// identified by the discoverable credential on their key. It returns a challenge token
+// to pass to FinishKeyLogin along with the options for navigator.credentials.get
+func BeginPasskeyLogin(ip string, userAgent string, deviceID string) (string, *protocol.CredentialAssertion, error) {
+	if std == nil {
+		return "", nil, ErrNotConfigured
+	}
+
+	if std.webauthn == nil {
+		return "", nil, ErrWebAuthnDisabled
+	}
+
+	// User verification is required since the key replaces the password as well as
+	// being the second factor
+	assertion, session, err := std.webauthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return "", nil, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	token := std.newChallenge(&challenge{DeviceID: deviceID, IP: ip, UserAgent: userAgent, ceremony: session}, time.Now().UTC())
+
+	return token, assertion, nil
+}
+
+// FinishKeyLogin verifies the client's assertion for a challenge started by BeginKeyLogin
+// or BeginPasskeyLogin and completes the login
+func FinishKeyLogin(token string, response []byte) (LoginResult, error) {
+	if std == nil {
+		return LoginResult{}, ErrNotConfigured
+	}
+
+	if std.webauthn == nil {
+		return LoginResult{}, ErrWebAuthnDisabled
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	now := time.Now().UTC()
+
+	std.mu.Lock()
+	c, err := std.challenge(token, now)
+	if err != nil {
+		std.mu.Unlock()
+		return LoginResult{}, err
+	}
+
+	if c.ceremony == nil {
+		std.mu.Unlock()
+		return LoginResult{}, errors.New("auth: no security key login has been started for this challenge")
+	}
+
+	var u *User
+	var cred *webauthn.Credential
+	if c.UserID != "" {
+		u = std.users[c.UserID]
+		if u != nil {
+			cred, err = std.webauthn.ValidateLogin(u, *c.ceremony, parsed)
+		}
+	} else {
+		cred, err = std.webauthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			u = std.users[string(userHandle)]
+			if u == nil {
+				return nil, ErrKeyNotFound
+			}
+			return u, nil
+		}, *c.ceremony, parsed)
+	}
+
+	if u == nil || err != nil {
+		std.mu.Unlock()
+		if err != nil {
+			zap.S().Named("auth").Debugw("security key login failed", zap.Error(err))
+		}
+		return LoginResult{}, std.failChallenge(token, c, now)
+	}
+
+	// A signature counter that goes backwards means the key may have been cloned
+	if cred.Authenticator.CloneWarning {
+		std.mu.Unlock()
+		zap.S().Named("auth").Warnw("security key signature counter went backwards, the key may have been cloned", "user", u.Username)
+		return LoginResult{}, std.failChallenge(token, c, now)
+	}
+
+	keys := append([]SecurityKey{}, u.SecurityKeys...)
+	for i := range keys {
+		if bytes.Equal(keys[i].Credential.ID, cred.ID) {
+			keys[i].Credential.Authenticator = cred.Authenticator
+			keys[i].LastUsed = now
+		}
+	}
+	u.SecurityKeys = keys
+
+	defer std.mu.Unlock()
+
+	c.UserID = u.ID
+
+	return std.completeChallenge(token, c, MethodWebAuthn, now)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// backup archives the configuration file and the data directory, which together are
+// everything needed to move the panel to another server or roll it back
+func backup(args []string) error {
+	var o options
+	flags := o.flags("backup", "create")
+	file := flags.String("file", "", "The file the archive is written to, defaults to cosmicpanel-<time>.tar.gz")
+	args = parse(flags, args)
+
+	if arg(args, 0) != "create" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	if *file == "" {
+		*file = fmt.Sprintf("cosmicpanel-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+
+	out, err := filepath.Abs(*file)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// An SQLite store is archived from a snapshot, as its files may be written to
+	// meanwhile. A database server is backed up with its own tools
+	if err := store.Configure(c.System.Data, c.Store); err != nil {
+		return err
+	}
+
+	var snapshot string
+	if store.Embedded() {
+		tmp, err := os.MkdirTemp("", "cosmicpanel-backup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		snapshot = filepath.Join(tmp, "panel.db")
+		if err := store.Snapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	if err := archiveFile(tw, o.config, filepath.Base(o.config)); err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(c.System.Data, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// The archive may be written into the data directory
+		if path == out {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.System.Data, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(filepath.Join("data", rel))
+		if snapshot != "" && path == filepath.Dir(store.Path(c.System.Data)) {
+			if err := archiveFile(tw, path, name); err != nil {
+				return err
+			}
+
+			if err := archiveFile(tw, snapshot, name+"/"+filepath.Base(store.Path(c.System.Data))); err != nil {
+				return err
+			}
+
+			return filepath.SkipDir
+		}
+
+		return archiveFile(tw, path, name)
+	})
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return o.print(map[string]string{"archive": out}, func() error {
+		fmt.Printf("Wrote backup to %s\n", out)
+		return nil
+	})
+}
+
+// archiveFile writes a file or directory to the archive under the name. Anything other
+// than regular files and directories, such as sockets, is skipped
+func archiveFile(tw *tar.Writer, path string, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+
+	return err
+}
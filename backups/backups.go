@@ -0,0 +1,500 @@
+package backups
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+	"go.uber.org/zap"
+)
+
+// The job backups of this server run as
+const createJob = "backup.create"
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("backups: not configured")
+
+	// ErrNotFound is returned when a backup does not exist
+	ErrNotFound = errors.New("backups: backup not found")
+)
+
+// Backup is an archive of an account in the format accounts are transferred in
+type Backup struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+
+	// Where the archive is kept on the node that made it
+	Path string `json:"path"`
+}
+
+// The kinds the catalogs are kept under in the state store
+const (
+	backupKind = "backup"
+	nodeKind   = "backup.node"
+)
+
+// manager keeps the catalog of the backups made by this server
+type manager struct {
+	mu      sync.Mutex
+	config  *config.BackupsConfiguration
+	backups []Backup
+
+	// The catalogs of every node on a controller
+	nodes *catalog
+}
+
+var std *manager
+
+// Configure loads the catalog from the state store, which must be configured first, and
+// registers the commands and jobs backups are made and restored with
+func Configure(dataDir string, c *config.BackupsConfiguration) error {
+	m := &manager{
+		config:  c,
+		backups: []Backup{},
+	}
+
+	if err := importCatalog(filepath.Join(dataDir, "backups", "catalog.json")); err != nil {
+		return err
+	}
+
+	var backups map[string]Backup
+	if err := store.Load(backupKind, &backups); err != nil {
+		return fmt.Errorf("backups: failed to read catalog: %w", err)
+	}
+
+	for _, b := range backups {
+		m.backups = append(m.backups, b)
+	}
+	sort.Slice(m.backups, func(i, j int) bool { return m.backups[i].Created.Before(m.backups[j].Created) })
+
+	if cluster.Role() == cluster.Controller {
+		var err error
+		if m.nodes, err = loadCatalog(filepath.Join(dataDir, "backups", "cluster.json")); err != nil {
+			return err
+		}
+	}
+
+	std = m
+
+	jobs.Register(createJob, func(ctx context.Context, j *jobs.Job) error {
+		var p createRequest
+		if err := j.Decode(&p); err != nil {
+			return err
+		}
+
+		if p.Username != "" {
+			_, err := Create(ctx, p.Username)
+			return err
+		}
+
+		_, err := CreateAll(ctx)
+		return err
+	})
+
+	registerCluster()
+	registerBulk()
+
+	return nil
+}
+
+// createRequest is the payload of the job creating backups
+type createRequest struct {
+	// The account to back up, every account when empty
+	Username string `json:"username,omitempty"`
+}
+
+// Queue backs up the account, or every account if the username is empty, in the
+// background
+func Queue(username string, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	return jobs.Enqueue(createJob, createRequest{Username: username}, jobs.Options{Actor: actor})
+}
+
+// Scheduled runs the backups task. Standalone servers back up their accounts, and a
+// controller spreads the backups of its nodes across the window. Agents are backed up
+// when their controller tells them to
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	switch cluster.Role() {
+	case cluster.Agent, cluster.Standby:
+		return nil
+	case cluster.Controller:
+		// A standby that has taken over backs up its nodes once restarted as controller
+		if std.nodes != nil {
+			return coordinate()
+		}
+	}
+
+	_, err := CreateAll(context.Background())
+
+	return err
+}
+
+// CreateAll backs up every account except administrators, who are kept the same across
+// a cluster rather than restored
+func CreateAll(ctx context.Context) ([]Backup, error) {
+	list := []Backup{}
+
+	var errs []error
+	for _, u := range auth.Users() {
+		if u.Role == auth.RoleAdmin {
+			continue
+		}
+
+		b, err := Create(ctx, u.Username)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u.Username, err))
+			continue
+		}
+		list = append(list, b)
+	}
+
+	return list, errors.Join(errs...)
+}
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "backup_failed",
+		Description: "Sent to an account when backing it up fails",
+		Fields:      []string{"Username", "Error"},
+		Template: notify.Template{
+			Subject: "The backup of your {{.Product}} account failed",
+			Body: "Backing up your account {{.Username}} failed:\n\n  {{.Error}}\n\n" +
+				"Your earlier backups are kept. The backup is tried again on the next schedule.\n",
+		},
+	})
+}
+
+// Create backs up the account, removing its oldest backups beyond the number retained.
+// The account is notified when it fails. Backups are limited like the rest of the
+// backups class, and stop once the context is done
+func Create(ctx context.Context, username string) (Backup, error) {
+	if std == nil {
+		return Backup{}, ErrNotConfigured
+	}
+
+	var b Backup
+	err := throttle.Run(ctx, throttle.Backups, func(ctx context.Context) error {
+		var err error
+		b, err = create(ctx, username)
+		return err
+	})
+	if err != nil {
+		for _, u := range auth.Users() {
+			if u.Username != username {
+				continue
+			}
+
+			if nerr := auth.Notify(u, "backup_failed", map[string]interface{}{"Username": username, "Error": err.Error()}); nerr != nil {
+				zap.S().Named("backups").Warnw("failed to notify account of failed backup", "account", username, zap.Error(nerr))
+			}
+		}
+	}
+
+	return b, err
+}
+
+// create backs up the account
+func create(ctx context.Context, username string) (Backup, error) {
+	now := time.Now().UTC()
+	b := Backup{ID: ids.New(), Username: username, Created: now}
+	b.Path = filepath.Join(std.config.Dir, username, now.Format("20060102-150405")+"-"+b.ID+".tar.gz")
+
+	if err := os.MkdirAll(filepath.Dir(b.Path), 0700); err != nil {
+		return Backup{}, err
+	}
+
+	f, err := os.OpenFile(b.Path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{ctx: ctx, w: io.MultiWriter(f, h)}
+
+	err = transfer.Export(username, counter)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(b.Path+".tmp", b.Path)
+	}
+	if err != nil {
+		os.Remove(b.Path + ".tmp")
+		return Backup{}, err
+	}
+
+	b.Size = counter.n
+	b.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	std.mu.Lock()
+	std.backups = append(std.backups, b)
+	expired := std.prune(username)
+	err = std.save()
+	std.mu.Unlock()
+
+	for _, old := range expired {
+		if rerr := os.Remove(old.Path); rerr != nil && !os.IsNotExist(rerr) {
+			zap.S().Named("backups").Warnw("failed to remove expired backup", "path", old.Path, zap.Error(rerr))
+		}
+	}
+
+	if err != nil {
+		return b, err
+	}
+
+	events.Publish(events.Event{
+		Type:     "backup.create",
+		Resource: b.ID,
+		Data:     map[string]interface{}{"username": username, "size": b.Size},
+	})
+
+	return b, nil
+}
+
+// List returns the backups of this server, newest first, optionally only those of the
+// account
+func List(username string) []Backup {
+	if std == nil {
+		return []Backup{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := []Backup{}
+	for _, b := range std.backups {
+		if username == "" || b.Username == username {
+			list = append(list, b)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list
+}
+
+// Get returns the backup of this server with the ID
+func Get(id string) (Backup, error) {
+	if std == nil {
+		return Backup{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, b := range std.backups {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+
+	return Backup{}, ErrNotFound
+}
+
+// Delete removes every backup of the account made by this server, returning those that
+// were removed. Backups whose archive cannot be removed stay in the catalog
+func Delete(username string) ([]Backup, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var (
+		removed []Backup
+		errs    []error
+	)
+	kept := make([]Backup, 0, len(std.backups))
+	for _, b := range std.backups {
+		if b.Username != username {
+			kept = append(kept, b)
+			continue
+		}
+
+		if err := os.Remove(b.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			kept = append(kept, b)
+			continue
+		}
+		removed = append(removed, b)
+	}
+
+	if len(removed) > 0 {
+		std.backups = kept
+		if err := std.save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// Restore recreates the account from a backup of this server. The account must not
+// exist, so it is deleted first to roll it back
+func Restore(id string) (auth.User, error) {
+	b, err := Get(id)
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	f, err := open(b)
+	if err != nil {
+		return auth.User{}, err
+	}
+	defer f.Close()
+
+	return transfer.Restore(f)
+}
+
+// open opens the archive of the backup, checking that it has not changed since it was
+// written
+func open(b Backup) (*os.File, error) {
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != b.SHA256 {
+		f.Close()
+		return nil, fmt.Errorf("backups: archive %s is corrupt, its checksum is %s instead of %s", b.Path, sum, b.SHA256)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// prune removes the oldest backups of the account beyond the number retained from the
+// catalog, returning them so that their archives can be removed. The manager must be
+// locked
+func (m *manager) prune(username string) []Backup {
+	var own []int
+	for i, b := range m.backups {
+		if b.Username == username {
+			own = append(own, i)
+		}
+	}
+
+	if m.config.Retain <= 0 || len(own) <= m.config.Retain {
+		return nil
+	}
+
+	sort.Slice(own, func(i, j int) bool { return m.backups[own[i]].Created.Before(m.backups[own[j]].Created) })
+
+	drop := make(map[int]bool)
+	var expired []Backup
+	for _, i := range own[:len(own)-m.config.Retain] {
+		drop[i] = true
+		expired = append(expired, m.backups[i])
+	}
+
+	kept := make([]Backup, 0, len(m.backups)-len(drop))
+	for i, b := range m.backups {
+		if !drop[i] {
+			kept = append(kept, b)
+		}
+	}
+	m.backups = kept
+
+	return expired
+}
+
+// save writes the catalog to the state store. The manager must be locked
+func (m *manager) save() error {
+	backups := make(map[string]Backup, len(m.backups))
+	for _, b := range m.backups {
+		backups[b.ID] = b
+	}
+
+	return store.Save(backupKind, backups)
+}
+
+// importCatalog moves the catalog kept in the data directory by earlier releases, which
+// is a list rather than keyed by ID, into the state store
+func importCatalog(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var list []Backup
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return fmt.Errorf("backups: failed to read catalog: %w", err)
+		}
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		for _, backup := range list {
+			if err := tx.Put(backupKind, backup.ID, backup); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, path+".imported")
+}
+
+// countingWriter counts the bytes written through it, failing once the context is done
+type countingWriter struct {
+	ctx context.Context
+	w   io.Writer
+	n   int64
+}
+
+// Write writes to the underlying writer, counting the bytes written
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
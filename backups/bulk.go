@@ -0,0 +1,68 @@
+package backups
+
+import (
+	"context"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/events"
+)
+
+// registerBulk registers the operations that back up and restore many accounts at once
+func registerBulk() {
+	bulk.Register(bulk.Type{
+		Name: "backup.create",
+		Run: func(ctx context.Context, actor string, it bulk.Item) error {
+			_, err := Create(ctx, it.Key)
+			return err
+		},
+		All: accounts,
+	})
+
+	bulk.Register(bulk.Type{Name: "backup.restore", Run: restoreItem})
+}
+
+// accounts returns an item for every account CreateAll backs up
+func accounts() ([]bulk.Item, error) {
+	items := []bulk.Item{}
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleAdmin {
+			items = append(items, bulk.Item{Key: u.Username})
+		}
+	}
+
+	return items, nil
+}
+
+// restoreItem restores the backup the item is keyed by. Backups of this server are
+// restored here, and items with a node in their payload, such as {"node": "..."}, are
+// restored from the catalog onto their destination the way StartRestore does
+func restoreItem(ctx context.Context, actor string, it bulk.Item) error {
+	var r RestoreRequest
+	if err := it.Decode(&r); err != nil {
+		return err
+	}
+	r.Backup = it.Key
+
+	if r.Node != "" {
+		if err := checkRestore(&r); err != nil {
+			return err
+		}
+
+		return restore(ctx, r, actor)
+	}
+
+	u, err := Restore(r.Backup)
+	if err != nil {
+		return err
+	}
+
+	events.Publish(events.Event{
+		Type:     "backup.restore",
+		Actor:    actor,
+		Resource: u.ID,
+		Data:     map[string]interface{}{"username": u.Username, "backup": r.Backup},
+	})
+
+	return nil
+}
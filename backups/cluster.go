@@ -0,0 +1,421 @@
+package backups
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+	"go.uber.org/zap"
+)
+
+// The jobs a controller backs up its nodes and restores their backups with
+const (
+	nodeJob    = "backup.node"
+	restoreJob = "backup.restore"
+)
+
+// refreshTimeout is how long a refresh of the catalog waits for the nodes to answer
+const refreshTimeout = 30 * time.Second
+
+// NodeBackup is a backup in the catalog of the cluster, along with the node holding it
+type NodeBackup struct {
+	Backup
+	Node     string `json:"node"`
+	NodeName string `json:"node_name"`
+}
+
+// RestoreRequest restores a backup made by one node of the cluster onto another, or onto
+// the same node
+type RestoreRequest struct {
+	Backup      string `json:"backup"`
+	Node        string `json:"node"`
+	Destination string `json:"destination"`
+}
+
+// exportRequest is the payload of the backup.export command
+type exportRequest struct {
+	ID   string `json:"id"`
+	File string `json:"file"`
+}
+
+// exportResult is what a node reports once it has uploaded a backup
+type exportResult struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// nodeCatalog is the last catalog a node reported
+type nodeCatalog struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+	Backups []Backup  `json:"backups"`
+}
+
+// catalog holds the catalogs of every node on a controller
+type catalog struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeCatalog
+}
+
+// loadCatalog reads the catalogs of the nodes from the state store, moving the file
+// earlier releases kept them in into it
+func loadCatalog(path string) (*catalog, error) {
+	c := &catalog{nodes: make(map[string]*nodeCatalog)}
+
+	if err := store.Import(nodeKind, path); err != nil {
+		return nil, err
+	}
+
+	if err := store.Load(nodeKind, &c.nodes); err != nil {
+		return nil, fmt.Errorf("backups: failed to read cluster catalog: %w", err)
+	}
+
+	return c, nil
+}
+
+// update replaces the catalog of the node
+func (c *catalog) update(node cluster.Node, list []Backup) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodes[node.ID] = &nodeCatalog{Name: node.Name, Updated: time.Now().UTC(), Backups: list}
+
+	return store.Save(nodeKind, c.nodes)
+}
+
+// registerCluster registers the commands nodes carry out backups with, and on a
+// controller the jobs it backs up and restores its nodes with
+func registerCluster() {
+	cluster.Register("backup.run", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		if _, err := CreateAll(ctx); err != nil {
+			zap.S().Named("backups").Errorw("failed to back up some accounts", zap.Error(err))
+		}
+
+		return List(""), nil
+	})
+
+	cluster.Register("backup.catalog", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		return List(""), nil
+	})
+
+	cluster.Register("backup.export", exportBackup)
+
+	if std.nodes == nil {
+		return
+	}
+
+	jobs.Register(nodeJob, runNode)
+	jobs.Register(restoreJob, runRestore)
+}
+
+// coordinate queues the backups of the controller and every node, spread evenly across
+// the window
+func coordinate() error {
+	nodes, err := cluster.Nodes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	// The controller takes the first slot for the accounts it hosts itself
+	if _, err := jobs.Enqueue(createJob, createRequest{}, jobs.Options{RunAt: now}); err != nil {
+		return err
+	}
+
+	nodes = slices.DeleteFunc(nodes, func(n cluster.Node) bool { return n.Standby })
+	step := time.Duration(std.config.Window) * time.Minute / time.Duration(len(nodes)+1)
+
+	for i, n := range nodes {
+		at := now.Add(time.Duration(i+1) * step)
+
+		if _, err := jobs.Enqueue(nodeJob, byNode{Node: n.ID}, jobs.Options{RunAt: at, MaxAttempts: 1}); err != nil {
+			return err
+		}
+
+		zap.S().Named("backups").Infow("scheduled node backup", "node", n.ID, "name", n.Name, "at", at)
+	}
+
+	return nil
+}
+
+// byNode is the payload of the job backing up a node
+type byNode struct {
+	Node string `json:"node"`
+}
+
+// runNode has a node back up its accounts and records the catalog it reports back
+func runNode(ctx context.Context, j *jobs.Job) error {
+	var p byNode
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	list, err := command(ctx, p.Node, "backup.run", nil, j.Actor)
+	if err != nil {
+		return err
+	}
+
+	return record(p.Node, list)
+}
+
+// record replaces the catalog of the node with the backups it reported
+func record(id string, result json.RawMessage) error {
+	n, err := cluster.GetNode(id)
+	if err != nil {
+		return err
+	}
+
+	var list []Backup
+	if err := json.Unmarshal(result, &list); err != nil {
+		return err
+	}
+
+	return std.nodes.update(n, list)
+}
+
+// Catalog returns the backups of every node of the cluster, newest first, optionally
+// only those of the account or the node
+func Catalog(username string, node string) ([]NodeBackup, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	if std.nodes == nil {
+		return nil, cluster.ErrNotController
+	}
+
+	std.nodes.mu.Lock()
+	defer std.nodes.mu.Unlock()
+
+	list := []NodeBackup{}
+	for id, c := range std.nodes.nodes {
+		if node != "" && node != id {
+			continue
+		}
+
+		for _, b := range c.Backups {
+			if username == "" || strings.Contains(b.Username, username) {
+				list = append(list, NodeBackup{Backup: b, Node: id, NodeName: c.Name})
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, nil
+}
+
+// Refresh asks every node for its catalog, returning the nodes that could not be reached
+// in time. Nodes that do not answer keep the catalog they last reported
+func Refresh(ctx context.Context, actor string) ([]string, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	if std.nodes == nil {
+		return nil, cluster.ErrNotController
+	}
+
+	nodes, err := cluster.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = []string{}
+	)
+
+	for _, n := range nodes {
+		if n.Standby {
+			continue
+		}
+
+		wg.Add(1)
+		go func(n cluster.Node) {
+			defer wg.Done()
+
+			list, err := command(ctx, n.ID, "backup.catalog", nil, actor)
+			if err == nil {
+				err = record(n.ID, list)
+			}
+
+			if err != nil {
+				zap.S().Named("backups").Warnw("failed to refresh node catalog", "node", n.ID, zap.Error(err))
+
+				mu.Lock()
+				failed = append(failed, n.ID)
+				mu.Unlock()
+			}
+		}(n)
+	}
+
+	wg.Wait()
+
+	return failed, nil
+}
+
+// StartRestore queues the restore of a backup from the catalog onto a node. The backup
+// is moved through the controller the way transfers are, so it can be restored onto any
+// node
+func StartRestore(r RestoreRequest, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	if err := checkRestore(&r); err != nil {
+		return jobs.Job{}, err
+	}
+
+	// A restore that failed half way is not safe to repeat, so it is only attempted once
+	return jobs.Enqueue(restoreJob, r, jobs.Options{Actor: actor, MaxAttempts: 1})
+}
+
+// checkRestore returns an error unless the backup is in the catalog and the destination,
+// which defaults to the node holding the backup, is a node of the cluster
+func checkRestore(r *RestoreRequest) error {
+	if r.Destination == "" {
+		r.Destination = r.Node
+	}
+
+	list, err := Catalog("", r.Node)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, b := range list {
+		found = found || b.ID == r.Backup
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	if _, err := cluster.GetNode(r.Destination); err != nil {
+		return fmt.Errorf("%w: %s", err, r.Destination)
+	}
+
+	return nil
+}
+
+// runRestore runs the job restoring a backup of a node
+func runRestore(ctx context.Context, j *jobs.Job) error {
+	var r RestoreRequest
+	if err := j.Decode(&r); err != nil {
+		return err
+	}
+
+	return restore(ctx, r, j.Actor)
+}
+
+// restore has the node holding the backup upload it to the controller and the
+// destination import it from there
+func restore(ctx context.Context, r RestoreRequest, actor string) error {
+	file, err := cluster.NewFile()
+	if err != nil {
+		return err
+	}
+	defer cluster.RemoveFile(file)
+
+	result, err := command(ctx, r.Node, "backup.export", exportRequest{ID: r.Backup, File: file}, actor)
+	if err != nil {
+		return fmt.Errorf("failed to export backup %s from %s: %w", r.Backup, r.Node, err)
+	}
+
+	var exported exportResult
+	if err := json.Unmarshal(result, &exported); err != nil {
+		return err
+	}
+
+	u, err := transfer.Import(ctx, r.Destination, file, exported.SHA256, actor)
+	if err != nil {
+		return fmt.Errorf("failed to restore backup %s on %s: %w", r.Backup, r.Destination, err)
+	}
+
+	events.Publish(events.Event{
+		Type:     "backup.restore",
+		Actor:    actor,
+		Resource: u.ID,
+		Data: map[string]interface{}{
+			"username":    u.Username,
+			"backup":      r.Backup,
+			"node":        r.Node,
+			"destination": r.Destination,
+		},
+	})
+
+	return nil
+}
+
+// exportBackup streams a backup of this node to the controller
+func exportBackup(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var p exportRequest
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	b, err := Get(p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := open(b)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if err := cluster.Upload(ctx, p.File, io.TeeReader(f, h)); err != nil {
+		return nil, err
+	}
+
+	return exportResult{Size: b.Size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// command sends the command to the node and waits for its result
+func command(ctx context.Context, node string, typ string, payload interface{}, actor string) (json.RawMessage, error) {
+	var b json.RawMessage
+	if payload != nil {
+		var err error
+		if b, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd, err := cluster.Send(node, typ, b, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err = cluster.Wait(ctx, cmd.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.State == cluster.Failed {
+		return nil, errors.New(cmd.Error)
+	}
+
+	return cmd.Result, nil
+}
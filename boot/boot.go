@@ -0,0 +1,395 @@
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// States of a module
+const (
+	Pending  = "pending"
+	Starting = "starting"
+	Started  = "started"
+	Failed   = "failed"
+
+	// Skipped modules were not started since one of their prerequisites failed
+	Skipped = "skipped"
+)
+
+var (
+	// ErrUnknown is returned when a module requires one that has not been registered
+	ErrUnknown = errors.New("boot: unknown prerequisite")
+
+	// ErrCycle is returned when modules require each other
+	ErrCycle = errors.New("boot: modules require each other")
+)
+
+// Module is a part of the daemon started at boot
+type Module struct {
+	Name string
+
+	// The modules that must have started before this one can
+	Requires []string
+
+	// Critical modules stop the daemon from starting when they fail. Every other module
+	// failing only leaves the daemon degraded
+	Critical bool
+
+	// Background modules start alongside the modules after them rather than before, so
+	// that one waiting on the network, such as checking the license, does not hold up the
+	// API. Only the modules requiring one wait for it. They cannot be critical
+	Background bool
+
+	Start func() error
+}
+
+// Status is the outcome of starting a module
+type Status struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Requires   []string  `json:"requires,omitempty"`
+	Critical   bool      `json:"critical,omitempty"`
+	Background bool      `json:"background,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Started    time.Time `json:"started,omitempty"`
+	Duration   string    `json:"duration,omitempty"`
+}
+
+// Profile is how long booting took and how long each module took to start, which is
+// where to look when the daemon is slow to come up
+type Profile struct {
+	Started time.Time `json:"started"`
+
+	// Empty while modules are still starting
+	Duration string `json:"duration,omitempty"`
+
+	// In the order they started in
+	Modules []Status `json:"modules"`
+}
+
+// slow is how long a module starts for before it is logged as still starting, every
+// time it passes again
+const slow = 10 * time.Second
+
+var (
+	mu      sync.Mutex
+	modules []Module
+	status  = make(map[string]*Status)
+
+	// When Run was called, and how long until every module had started
+	began time.Time
+	took  time.Duration
+)
+
+// Register adds a module to start at boot. Modules are started in the order they are
+// registered in unless they require a module registered after them
+func Register(m Module) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	modules = append(modules, m)
+	status[m.Name] = &Status{Name: m.Name, State: Pending, Requires: m.Requires, Critical: m.Critical, Background: m.Background}
+}
+
+// Run starts the registered modules once their prerequisites have started. A module
+// that fails or panics does not stop the others, except for the modules requiring it
+// which are skipped. An error is only returned if a critical module did not start.
+// Background modules may still be starting when it returns
+func Run() error {
+	order, err := sorted()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	began = time.Now()
+	mu.Unlock()
+
+	// Closed once a module has started, failed or been skipped
+	done := make(map[string]chan struct{}, len(order))
+	for _, m := range order {
+		done[m.Name] = make(chan struct{})
+	}
+
+	wait := func(m Module) {
+		for _, req := range m.Requires {
+			<-done[req]
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range order {
+		if m.Background {
+			m := m
+			wg.Add(1)
+			crash.Go("boot", func() {
+				defer wg.Done()
+				defer close(done[m.Name])
+
+				wait(m)
+				start(m)
+			})
+			continue
+		}
+
+		wait(m)
+		err := start(m)
+		close(done[m.Name])
+
+		if err != nil && m.Critical {
+			return fmt.Errorf("boot: %s failed to start: %w", m.Name, err)
+		}
+	}
+
+	crash.Go("boot", func() {
+		wg.Wait()
+		finish()
+	})
+
+	return nil
+}
+
+// finish logs how long booting took once every module has started, and the modules
+// that did not
+func finish() {
+	mu.Lock()
+	took = time.Since(began)
+	mu.Unlock()
+
+	p := Report()
+
+	durations := make(map[string]string, len(p.Modules))
+	for _, s := range p.Modules {
+		durations[s.Name] = s.Duration
+	}
+
+	zap.S().Named("boot").Infow("booted", "duration", p.Duration, "modules", durations)
+
+	if degraded := Degraded(); len(degraded) > 0 {
+		names := make([]string, 0, len(degraded))
+		for _, s := range degraded {
+			names = append(names, s.Name)
+		}
+
+		zap.S().Named("boot").Warnw("started in degraded mode", "modules", names)
+	}
+}
+
+// sorted returns the modules in the order to start them in
+func sorted() ([]Module, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, m := range modules {
+		for _, req := range m.Requires {
+			if _, ok := status[req]; !ok {
+				return nil, fmt.Errorf("%w %s of %s", ErrUnknown, req, m.Name)
+			}
+		}
+	}
+
+	order := make([]Module, 0, len(modules))
+	placed := make(map[string]bool)
+
+	for len(order) < len(modules) {
+		progress := false
+
+		for _, m := range modules {
+			if placed[m.Name] {
+				continue
+			}
+
+			ready := true
+			for _, req := range m.Requires {
+				ready = ready && placed[req]
+			}
+
+			if ready {
+				order = append(order, m)
+				placed[m.Name] = true
+				progress = true
+			}
+		}
+
+		if !progress {
+			var left []string
+			for _, m := range modules {
+				if !placed[m.Name] {
+					left = append(left, m.Name)
+				}
+			}
+
+			return nil, fmt.Errorf("%w: %s", ErrCycle, strings.Join(left, ", "))
+		}
+	}
+
+	return order, nil
+}
+
+// start starts the module unless one of its prerequisites did not start, and records
+// the outcome
+func start(m Module) error {
+	mu.Lock()
+	var err error
+	for _, req := range m.Requires {
+		if status[req].State != Started {
+			err = fmt.Errorf("requires %s which did not start", req)
+			break
+		}
+	}
+	mu.Unlock()
+
+	state := Skipped
+	started := time.Now()
+
+	mu.Lock()
+	status[m.Name].Started = started
+	if err == nil {
+		status[m.Name].State = Starting
+	}
+	mu.Unlock()
+
+	if err == nil {
+		state = Started
+
+		stop := watch(m.Name, started)
+		err = call(m)
+		close(stop)
+
+		if err != nil {
+			state = Failed
+		}
+	}
+
+	mu.Lock()
+	s := status[m.Name]
+	s.State = state
+	s.Duration = time.Since(started).Round(time.Millisecond).String()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	mu.Unlock()
+
+	log := zap.S().Named("boot")
+
+	switch state {
+	case Started:
+		log.Infow("started module", "module", m.Name, "duration", s.Duration)
+	case Skipped:
+		log.Warnw("skipped module", "module", m.Name, zap.Error(err))
+	default:
+		log.Errorw("module failed to start", "module", m.Name, "critical", m.Critical, zap.Error(err))
+	}
+
+	if err != nil {
+		events.Publish(events.Event{
+			Type:     "boot.module." + state,
+			Resource: m.Name,
+			Data:     map[string]interface{}{"error": err.Error()},
+		})
+	}
+
+	return err
+}
+
+// watch logs the module as still starting each time it has been starting for another
+// while, so that a boot hanging on it can be told apart from a slow one. The returned
+// channel is closed once it has started
+func watch(name string, started time.Time) chan struct{} {
+	stop := make(chan struct{})
+
+	crash.Go("boot", func() {
+		t := time.NewTicker(slow)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				zap.S().Named("boot").Warnw("module is still starting", "module", name, "waited", time.Since(started).Round(time.Second).String())
+			}
+		}
+	})
+
+	return stop
+}
+
+// call starts the module, turning a panic into an error so that it only takes down the
+// module rather than the daemon
+func call(m Module) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rep := crash.Capture("boot", r, map[string]string{"module": m.Name})
+			err = fmt.Errorf("module panicked, see crash report %s: %v", rep.ID, r)
+		}
+	}()
+
+	return m.Start()
+}
+
+// Modules returns the status of every module, sorted by name
+func Modules() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Status, 0, len(status))
+	for _, s := range status {
+		list = append(list, *s)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Report returns how long booting took and how long each module took to start
+func Report() Profile {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := Profile{Started: began, Modules: []Status{}}
+	if took > 0 {
+		p.Duration = took.Round(time.Millisecond).String()
+	}
+
+	for _, s := range status {
+		if !s.Started.IsZero() {
+			p.Modules = append(p.Modules, *s)
+		}
+	}
+
+	sort.Slice(p.Modules, func(i, j int) bool { return p.Modules[i].Started.Before(p.Modules[j].Started) })
+
+	return p
+}
+
+// Degraded returns the status of the modules that failed or were skipped
+func Degraded() []Status {
+	var list []Status
+	for _, s := range Modules() {
+		if s.State == Failed || s.State == Skipped {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// Running returns true if the module has started
+func Running(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := status[name]
+
+	return ok && s.State == Started
+}
@@ -0,0 +1,304 @@
+package branding
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("branding: not configured")
+
+	// ErrNotFound is returned for a reseller that has not set a brand
+	ErrNotFound = errors.New("branding: the reseller has no brand")
+
+	// ErrHostnameTaken is returned when setting a panel hostname another reseller uses
+	ErrHostnameTaken = errors.New("branding: the hostname is used by another reseller")
+)
+
+// Brand is how the panel presents itself to a reseller's accounts, in the UI and in the
+// emails they are sent. Fields left empty fall back to the configured brand
+type Brand struct {
+	ProductName string `json:"product_name"`
+
+	// An https URL or data URI of the logo
+	Logo string `json:"logo,omitempty"`
+
+	// Colors of the UI as #rrggbb
+	PrimaryColor string `json:"primary_color,omitempty"`
+	AccentColor  string `json:"accent_color,omitempty"`
+
+	// The hostname the reseller's accounts reach the panel at, which must resolve to
+	// this server. The login page shown there carries the brand
+	Hostname string `json:"hostname,omitempty"`
+
+	// The address notifications to the reseller's accounts are emailed from
+	From string `json:"from,omitempty"`
+
+	// The language of the reseller's accounts that have not chosen one, as a tag such as
+	// de or pt-BR
+	Language string `json:"language,omitempty"`
+}
+
+// Public returns a copy of the brand safe to show before logging in, without the
+// reseller's email address
+func (b Brand) Public() Brand {
+	b.From = ""
+
+	return b
+}
+
+// brandKind is what brands are kept under in the state store, keyed by reseller ID
+const brandKind = "branding"
+
+var (
+	hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	dataLogo = regexp.MustCompile(`^data:image/(png|jpeg|gif|webp|svg\+xml);base64,`)
+)
+
+// maxLogo is the largest logo kept as a data URI, in bytes
+const maxLogo = 256 * 1024
+
+// manager keeps the brands of the resellers in memory, since one is looked up for every
+// notification and page
+type manager struct {
+	mu     sync.Mutex
+	config *config.BrandingConfiguration
+	brands map[string]Brand
+}
+
+var std *manager
+
+// Configure loads the brands of the resellers from the state store, which must be
+// configured first
+func Configure(c *config.BrandingConfiguration) error {
+	m := &manager{config: c, brands: make(map[string]Brand)}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(brandKind, func(id string, data []byte) error {
+			var b Brand
+			if err := json.Unmarshal(data, &b); err != nil {
+				return fmt.Errorf("branding: malformed brand of %s: %w", id, err)
+			}
+			m.brands[id] = b
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	std = m
+
+	return nil
+}
+
+// Default returns the configured brand
+func Default() Brand {
+	if std == nil {
+		return Brand{ProductName: "CosmicPanel"}
+	}
+
+	return Brand{
+		ProductName:  std.config.ProductName,
+		Logo:         std.config.Logo,
+		PrimaryColor: std.config.PrimaryColor,
+		AccentColor:  std.config.AccentColor,
+	}
+}
+
+// Resolve returns the brand the accounts of the reseller see, which is the configured
+// brand for an empty reseller or one without a brand of their own
+func Resolve(reseller string) Brand {
+	b := Default()
+	if std == nil || reseller == "" {
+		return b
+	}
+
+	std.mu.Lock()
+	own, ok := std.brands[reseller]
+	std.mu.Unlock()
+
+	if !ok {
+		return b
+	}
+
+	return merge(b, own)
+}
+
+// ForHost returns the brand of the reseller whose panel hostname the host is, with or
+// without a port, or the configured brand
+func ForHost(host string) Brand {
+	if std == nil {
+		return Default()
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	std.mu.Lock()
+	var reseller string
+	for id, b := range std.brands {
+		if b.Hostname != "" && b.Hostname == host {
+			reseller = id
+			break
+		}
+	}
+	std.mu.Unlock()
+
+	return Resolve(reseller)
+}
+
+// Get returns the brand the reseller has set, without the configured brand filled in
+func Get(reseller string) (Brand, error) {
+	if std == nil {
+		return Brand{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	b, ok := std.brands[reseller]
+	if !ok {
+		return Brand{}, ErrNotFound
+	}
+
+	return b, nil
+}
+
+// Set checks and saves the brand of the reseller, replacing the one they had
+func Set(reseller string, b Brand) (Brand, error) {
+	if std == nil {
+		return Brand{}, ErrNotConfigured
+	}
+
+	b.Hostname = strings.ToLower(strings.TrimSuffix(b.Hostname, "."))
+	b.Language = locale.Canonical(b.Language)
+	if err := validate(b); err != nil {
+		return Brand{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if b.Hostname != "" {
+		for id, other := range std.brands {
+			if id != reseller && other.Hostname == b.Hostname {
+				return Brand{}, ErrHostnameTaken
+			}
+		}
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(brandKind, reseller, b)
+	})
+	if err != nil {
+		return Brand{}, err
+	}
+
+	std.brands[reseller] = b
+
+	return b, nil
+}
+
+// Delete removes the brand of the reseller, whose accounts then see the configured brand
+func Delete(reseller string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if _, ok := std.brands[reseller]; !ok {
+		return ErrNotFound
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Delete(brandKind, reseller)
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(std.brands, reseller)
+
+	return nil
+}
+
+// merge fills the fields the brand leaves empty from the base brand
+func merge(base Brand, b Brand) Brand {
+	if b.ProductName != "" {
+		base.ProductName = b.ProductName
+	}
+	if b.Logo != "" {
+		base.Logo = b.Logo
+	}
+	if b.PrimaryColor != "" {
+		base.PrimaryColor = b.PrimaryColor
+	}
+	if b.AccentColor != "" {
+		base.AccentColor = b.AccentColor
+	}
+	if b.Language != "" {
+		base.Language = b.Language
+	}
+
+	base.Hostname = b.Hostname
+	base.From = b.From
+
+	return base
+}
+
+// validate checks every field of the brand that is set
+func validate(b Brand) error {
+	if len(b.ProductName) > 64 || strings.ContainsAny(b.ProductName, "\r\n\t") {
+		return errors.New("branding: the product name must be a single line of at most 64 characters")
+	}
+
+	if b.Logo != "" {
+		if dataLogo.MatchString(b.Logo) {
+			if len(b.Logo) > maxLogo {
+				return fmt.Errorf("branding: a logo data URI can be at most %d KiB", maxLogo/1024)
+			}
+		} else if u, err := url.Parse(b.Logo); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("branding: the logo must be an https URL or a base64 data URI of an image")
+		}
+	}
+
+	for _, c := range []string{b.PrimaryColor, b.AccentColor} {
+		if c != "" && !hexColor.MatchString(c) {
+			return fmt.Errorf("branding: invalid color %q, colors are written as #rrggbb", c)
+		}
+	}
+
+	if b.Hostname != "" && !hostname.Valid(b.Hostname) {
+		return fmt.Errorf("branding: invalid hostname %q", b.Hostname)
+	}
+
+	if b.From != "" {
+		if _, err := mail.ParseAddress(b.From); err != nil {
+			return fmt.Errorf("branding: invalid from address %q: %v", b.From, err)
+		}
+	}
+
+	if b.Language != "" && !locale.Supported(b.Language) {
+		return fmt.Errorf("branding: the panel has no translation into %s", b.Language)
+	}
+
+	return nil
+}
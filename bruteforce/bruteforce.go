@@ -0,0 +1,294 @@
+package bruteforce
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+	"go.uber.org/zap"
+)
+
+// offender tracks how many times an address has been banned so that repeat offenders
+// receive longer bans
+type offender struct {
+	Bans    int       `json:"bans"`
+	LastBan time.Time `json:"last_ban"`
+}
+
+// state is persisted to disk so that escalation and the whitelist survive a restart
+type state struct {
+	Offenders map[string]*offender `json:"offenders"`
+	Whitelist []string             `json:"whitelist"`
+}
+
+// Protector counts authentication failures per address across every service and bans
+// addresses through the firewall once they exceed the configured threshold
+type Protector struct {
+	mu       sync.Mutex
+	path     string
+	config   *config.BruteForceConfiguration
+	failures map[string][]time.Time
+	state    state
+}
+
+var std *Protector
+
+// Configure loads the persisted state and starts watching the configured log files for
+// authentication failures
+func Configure(dataDir string, c *config.BruteForceConfiguration) error {
+	dir := filepath.Join(dataDir, "bruteforce")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	p := &Protector{
+		path:     filepath.Join(dir, "state.json"),
+		config:   c,
+		failures: make(map[string][]time.Time),
+		state:    state{Offenders: make(map[string]*offender)},
+	}
+
+	if b, err := os.ReadFile(p.path); err == nil {
+		if err := json.Unmarshal(b, &p.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if p.state.Offenders == nil {
+		p.state.Offenders = make(map[string]*offender)
+	}
+
+	std = p
+
+	for _, src := range c.Sources {
+		if _, err := os.Stat(src.Path); err != nil {
+			continue
+		}
+
+		if err := watch(src); err != nil {
+			zap.S().Named("bruteforce").Warnw("failed to watch log file", "service", src.Service, "path", src.Path, zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// Failure records a failed authentication attempt from the address against the
+// service, banning the address if it has now failed too many times within the window
+func Failure(service string, ip string) {
+	if std == nil || !std.config.Enabled {
+		return
+	}
+
+	std.failure(service, ip, time.Now())
+}
+
+func (p *Protector) failure(service string, ip string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.whitelisted(ip) {
+		return
+	}
+
+	window := time.Duration(p.config.Window) * time.Second
+
+	recent := p.failures[ip][:0]
+	for _, t := range p.failures[ip] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	p.failures[ip] = recent
+
+	if len(recent) < p.config.Threshold {
+		return
+	}
+
+	delete(p.failures, ip)
+	p.ban(service, ip, now)
+}
+
+// ban blocks the address, doubling the ban duration for every previous ban within the
+// last 30 days up to the configured maximum
+func (p *Protector) ban(service string, ip string, now time.Time) {
+	o, ok := p.state.Offenders[ip]
+	if !ok || now.Sub(o.LastBan) > 30*24*time.Hour {
+		o = &offender{}
+		p.state.Offenders[ip] = o
+	}
+	o.Bans++
+	o.LastBan = now
+
+	ttl := time.Duration(float64(p.config.BanDuration)*math.Pow(p.config.Escalation, float64(o.Bans-1))) * time.Second
+	if max := time.Duration(p.config.MaxBanDuration) * time.Second; max > 0 && ttl > max {
+		ttl = max
+	}
+
+	reason := fmt.Sprintf("%d failed %s logins", p.config.Threshold, service)
+	rule, err := firewall.Ban("bruteforce", ip, ttl, reason)
+	if err != nil {
+		zap.S().Named("bruteforce").Errorw("failed to ban address", "ip", ip, zap.Error(err))
+		return
+	}
+
+	if err := p.save(); err != nil {
+		zap.S().Named("bruteforce").Errorw("failed to save brute force state", zap.Error(err))
+	}
+
+	zap.S().Named("bruteforce").Infow("banned address", "ip", ip, "service", service, "duration", ttl.String(), "bans", o.Bans)
+
+	events.Publish(events.Event{
+		Type:     "security.bruteforce.ban",
+		Resource: rule.ID,
+		Data: map[string]interface{}{
+			"ip":       ip,
+			"service":  service,
+			"duration": ttl.String(),
+			"bans":     o.Bans,
+		},
+	})
+}
+
+// whitelisted returns true if the address is in a configured or API managed whitelist
+func (p *Protector) whitelisted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return true
+	}
+
+	if addr.IsLoopback() {
+		return true
+	}
+
+	for _, list := range [][]string{p.config.Whitelist, p.state.Whitelist} {
+		for _, w := range list {
+			if _, n, err := net.ParseCIDR(w); err == nil && n.Contains(addr) {
+				return true
+			}
+
+			if w == ip {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// save writes the offenders and whitelist to disk
+func (p *Protector) save() error {
+	b, err := json.MarshalIndent(p.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.path)
+}
+
+// Bans returns the firewall rules created by brute force protection
+func Bans() []firewall.Rule {
+	bans := []firewall.Rule{}
+	for _, r := range firewall.Rules() {
+		if r.Owner == "bruteforce" {
+			bans = append(bans, r)
+		}
+	}
+
+	return bans
+}
+
+// Unban lifts the ban on the address and resets its ban history so that the next ban
+// starts at the base duration again
+func Unban(ip string) error {
+	if err := firewall.Unban(ip); err != nil {
+		return err
+	}
+
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	delete(std.state.Offenders, ip)
+	delete(std.failures, ip)
+
+	return std.save()
+}
+
+// Whitelist returns the addresses that are never banned, including those set in the
+// configuration file
+func Whitelist() []string {
+	if std == nil {
+		return []string{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return append(append([]string{}, std.config.Whitelist...), std.state.Whitelist...)
+}
+
+// AddWhitelist adds an address or CIDR range to the whitelist
+func AddWhitelist(entry string) error {
+	if std == nil {
+		return firewall.ErrNotConfigured
+	}
+
+	if net.ParseIP(entry) == nil {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("bruteforce: %q is not a valid address or CIDR range", entry)
+		}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, w := range std.state.Whitelist {
+		if w == entry {
+			return nil
+		}
+	}
+
+	std.state.Whitelist = append(std.state.Whitelist, entry)
+
+	return std.save()
+}
+
+// RemoveWhitelist removes an address or CIDR range added through AddWhitelist. Entries
+// from the configuration file can only be removed by editing it
+func RemoveWhitelist(entry string) error {
+	if std == nil {
+		return firewall.ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for i, w := range std.state.Whitelist {
+		if w == entry {
+			std.state.Whitelist = append(std.state.Whitelist[:i], std.state.Whitelist[i+1:]...)
+			return std.save()
+		}
+	}
+
+	return nil
+}
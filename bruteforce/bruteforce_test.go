@@ -0,0 +1,121 @@
+package bruteforce
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+)
+
+func newProtector(t *testing.T) *Protector {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := firewall.Configure(dir, &config.FirewallConfiguration{Backend: "none"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Protector{
+		path: filepath.Join(dir, "state.json"),
+		config: &config.BruteForceConfiguration{
+			Enabled:        true,
+			Threshold:      3,
+			Window:         600,
+			BanDuration:    600,
+			Escalation:     2,
+			MaxBanDuration: 3600,
+			Whitelist:      []string{"192.0.2.0/24", "2001:db8:ffff::1"},
+		},
+		failures: make(map[string][]time.Time),
+		state:    state{Offenders: make(map[string]*offender), Whitelist: []string{"198.51.100.9"}},
+	}
+}
+
+func TestFailure(t *testing.T) {
+	start := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		ip       string
+		failures []time.Duration
+		bans     int
+	}{
+		{"below the threshold", "203.0.113.7", []time.Duration{0, time.Minute}, 0},
+		{"at the threshold", "203.0.113.7", []time.Duration{0, time.Minute, 2 * time.Minute}, 1},
+		{"IPv6", "2001:db8::7", []time.Duration{0, time.Minute, 2 * time.Minute}, 1},
+		{"spread beyond the window", "203.0.113.7", []time.Duration{0, 6 * time.Minute, 12 * time.Minute, 18 * time.Minute}, 0},
+		{"counting starts again after a ban", "203.0.113.7", []time.Duration{0, 1, 2, 3, 4}, 1},
+		{"twice the threshold", "203.0.113.7", []time.Duration{0, 1, 2, 3, 4, 5}, 2},
+		{"configured range", "192.0.2.77", []time.Duration{0, 1, 2}, 0},
+		{"configured address", "2001:db8:ffff::1", []time.Duration{0, 1, 2}, 0},
+		{"added address", "198.51.100.9", []time.Duration{0, 1, 2}, 0},
+		{"loopback", "127.0.0.1", []time.Duration{0, 1, 2}, 0},
+		{"IPv6 loopback", "::1", []time.Duration{0, 1, 2}, 0},
+		{"not an address", "client.example.net", []time.Duration{0, 1, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newProtector(t)
+			for _, d := range tt.failures {
+				p.failure("ssh", tt.ip, start.Add(d))
+			}
+
+			bans := 0
+			if o, ok := p.state.Offenders[tt.ip]; ok {
+				bans = o.Bans
+			}
+			if bans != tt.bans {
+				t.Errorf("banned %d times, want %d", bans, tt.bans)
+			}
+
+			if banned := len(Bans()) > 0; banned != (tt.bans > 0) {
+				t.Errorf("firewall rules %+v", Bans())
+			}
+		})
+	}
+}
+
+func TestBanEscalation(t *testing.T) {
+	start := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		bans  int
+		ttl   time.Duration
+	}{
+		{"first ban", 0, 1, 10 * time.Minute},
+		{"second ban", time.Hour, 2, 20 * time.Minute},
+		{"third ban", 2 * time.Hour, 3, 40 * time.Minute},
+		{"capped at the maximum", 3 * time.Hour, 4, time.Hour},
+		{"forgotten after 30 days", 40 * 24 * time.Hour, 1, 10 * time.Minute},
+	}
+
+	p := newProtector(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range Bans() {
+				if err := firewall.Remove(r.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p.ban("ssh", "203.0.113.7", start.Add(tt.after))
+
+			if o := p.state.Offenders["203.0.113.7"]; o.Bans != tt.bans {
+				t.Errorf("%d bans, want %d", o.Bans, tt.bans)
+			}
+
+			bans := Bans()
+			if len(bans) != 1 || bans[0].Expires == nil {
+				t.Fatalf("got %+v", bans)
+			}
+			if ttl := time.Until(*bans[0].Expires); ttl > tt.ttl || ttl < tt.ttl-time.Minute {
+				t.Errorf("banned for %s, want %s", ttl.Round(time.Minute), tt.ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package bruteforce
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+)
+
+var (
+	// lfdMessage matches every line lfd logs, capturing the message
+	lfdMessage = regexp.MustCompile(`lfd\[\d+\]: (.+)$`)
+
+	// lfdAlert matches alerts such as *Port Scan* or *Suspicious Process*
+	lfdAlert = regexp.MustCompile(`^\*([A-Za-z ]+)\*`)
+
+	// lfdTrigger matches the setting that caused a block, such as [LF_SSHD]
+	lfdTrigger = regexp.MustCompile(`\[(LF_[A-Z_]+|CT_[A-Z_]+|PS_[A-Z_]+)\]`)
+
+	// lfdProcess matches the executable and command line at the end of the reports of
+	// processes, which whoever started the process chooses
+	lfdProcess = regexp.MustCompile(` (EXE|CMD):.*$`)
+)
+
+// WatchLFD follows the log of the ConfigServer login failure daemon, publishing its
+// blocks and alerts to the activity feed. Hosts using CSF leave brute force detection
+// for the services to lfd, and this makes its decisions visible in the panel
+func WatchLFD(path string) error {
+	t, err := newTail(path)
+	if err != nil {
+		return err
+	}
+
+	crash.Go("bruteforce", func() {
+		t.follow(func(line string) {
+			if e, ok := parseLFD(line); ok {
+				events.Publish(e)
+			}
+		})
+	})
+
+	return nil
+}
+
+// parseLFD returns the event for a line logged by lfd, if it is a block or an alert
+func parseLFD(line string) (events.Event, bool) {
+	m := lfdMessage.FindStringSubmatch(line)
+	if m == nil {
+		return events.Event{}, false
+	}
+	message := m[1]
+
+	data := map[string]interface{}{"source": "lfd", "message": message}
+
+	// The message is classified without the command line, so that a process cannot
+	// pass for a block of an address it names
+	fixed := lfdProcess.ReplaceAllString(message, "")
+	if t := lfdTrigger.FindStringSubmatch(fixed); t != nil {
+		data["trigger"] = t[1]
+	}
+
+	switch {
+	case strings.Contains(fixed, "*Blocked in csf*"):
+		return events.Event{Type: "security.lfd.block", Resource: firstIP(fixed), Data: data}, true
+	case strings.Contains(strings.ToLower(fixed), "unblock"):
+		return events.Event{Type: "security.lfd.unblock", Resource: firstIP(fixed), Data: data}, true
+	}
+
+	if a := lfdAlert.FindStringSubmatch(fixed); a != nil {
+		data["alert"] = a[1]
+		return events.Event{Type: "security.lfd.alert", Resource: firstIP(fixed), Data: data}, true
+	}
+
+	return events.Event{}, false
+}
+
+// firstIP returns the first address in the message, or an empty string if there is none
+func firstIP(message string) string {
+	for _, field := range strings.Fields(message) {
+		// A colon after the address is only removed when the field does not parse with
+		// it, as IPv6 addresses can start and end with one
+		field = strings.Trim(field, "()[],;.")
+		for _, s := range []string{field, strings.TrimSuffix(field, ":")} {
+			if ip := net.ParseIP(s); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,63 @@
+package bruteforce
+
+import "testing"
+
+func TestParseLFD(t *testing.T) {
+	const prefix = "Oct 15 08:06:08 web1 lfd[2417]: "
+
+	tests := []struct {
+		name     string
+		line     string
+		typ      string
+		resource string
+		trigger  string
+		alert    string
+	}{
+		{"ssh block", "(sshd) Failed SSH login from 203.0.113.7 (CN/China/-): 5 in the last 3600 secs - *Blocked in csf* [LF_SSHD]", "security.lfd.block", "203.0.113.7", "LF_SSHD", ""},
+		{"temporary block", "(imapd) Failed IMAP login from 203.0.113.7 (US/United States/-): 10 in the last 3600 secs - *Blocked in csf* for 3600 secs [LF_IMAPD]", "security.lfd.block", "203.0.113.7", "LF_IMAPD", ""},
+		{"port scan", "*Port Scan* detected from 203.0.113.7 (US/United States/-). 11 hits in the last 46 seconds - *Blocked in csf* for 3600 secs [PS_LIMIT]", "security.lfd.block", "203.0.113.7", "PS_LIMIT", ""},
+		{"IPv6 block", "(sshd) Failed SSH login from 2001:db8::7 (DE/Germany/-): 5 in the last 3600 secs - *Blocked in csf* [LF_SSHD]", "security.lfd.block", "2001:db8::7", "LF_SSHD", ""},
+		{"IPv6 ending in a colon", "(sshd) Failed SSH login from 2001:db8:: (DE/Germany/-): 5 in the last 3600 secs - *Blocked in csf* [LF_SSHD]", "security.lfd.block", "2001:db8::", "LF_SSHD", ""},
+		{"IPv6 before a colon", "*Blocked in csf* 2001:db8:::", "security.lfd.block", "2001:db8::", "", ""},
+		{"connection tracking", "203.0.113.7 (NL/Netherlands/-), 300 connections - *Blocked in csf* for 1800 secs [CT_LIMIT]", "security.lfd.block", "203.0.113.7", "CT_LIMIT", ""},
+		{"unblock", "UNBLOCK: 203.0.113.7 temporary block removed", "security.lfd.unblock", "203.0.113.7", "", ""},
+		{"suspicious process", "*Suspicious Process* PID:4411 PPID:1 User:alice Uptime:120 secs EXE:/tmp/.x/miner CMD:./miner --pool 198.51.100.2", "security.lfd.alert", "", "", "Suspicious Process"},
+		{"user processing", "*User Processing* PID:4411 Kill:1 User:alice VM:512(MB) EXE:/usr/bin/php CMD:php run.php", "security.lfd.alert", "", "", "User Processing"},
+
+		// The command line is chosen by whoever runs the process
+		{"command line naming a block", "*Suspicious Process* PID:4411 PPID:1 User:alice Uptime:120 secs EXE:/tmp/x CMD:x 192.0.2.1 - *Blocked in csf* [LF_SSHD]", "security.lfd.alert", "", "", "Suspicious Process"},
+		{"command line naming an unblock", "*Suspicious Process* PID:4411 PPID:1 User:alice Uptime:120 secs EXE:/tmp/unblock CMD:unblock 192.0.2.1", "security.lfd.alert", "", "", "Suspicious Process"},
+
+		{"startup", "daemon started on web1 - csf v14.20 (generic) - lfd v14.20 (generic)", "", "", "", ""},
+		{"watching", "Watching /var/log/secure...", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := parseLFD(prefix + tt.line)
+			if ok != (tt.typ != "") {
+				t.Fatalf("parsed %v, want %v", ok, tt.typ != "")
+			}
+			if !ok {
+				return
+			}
+
+			if e.Type != tt.typ || e.Resource != tt.resource {
+				t.Errorf("got %s of %q, want %s of %q", e.Type, e.Resource, tt.typ, tt.resource)
+			}
+			if e.Data["message"] != tt.line {
+				t.Errorf("message %q", e.Data["message"])
+			}
+
+			trigger, _ := e.Data["trigger"].(string)
+			alert, _ := e.Data["alert"].(string)
+			if trigger != tt.trigger || alert != tt.alert {
+				t.Errorf("trigger %q and alert %q, want %q and %q", trigger, alert, tt.trigger, tt.alert)
+			}
+		})
+	}
+
+	if _, ok := parseLFD("Oct 15 08:06:08 web1 sshd[4121]: *Blocked in csf* 203.0.113.7"); ok {
+		t.Error("a line of another program was parsed")
+	}
+}
@@ -0,0 +1,154 @@
+package bruteforce
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"go.uber.org/zap"
+)
+
+// patterns match authentication failures in the logs written by each service. The
+// first capture group of every pattern is the remote address. User names are chosen by
+// the client and may contain text that looks like an address, so the address is taken
+// from the end of the line when the user comes before it and from the start when it
+// comes after
+var patterns = map[string][]*regexp.Regexp{
+	"ssh": {
+		regexp.MustCompile(`sshd\[\d+\]: Failed \S+ for .* from (\S+)(?: port \d+)?(?: ssh2)?$`),
+		regexp.MustCompile(`sshd\[\d+\]: Invalid user .* from (\S+)(?: port \d+)?$`),
+		regexp.MustCompile(`sshd\[\d+\]: .*authentication failure;.*? rhost=(\S+)`),
+	},
+	"mail": {
+		regexp.MustCompile(`dovecot: \S+-login: .*auth failed.*rip=([0-9a-fA-F.:]+)`),
+		regexp.MustCompile(`postfix/\S+\[\d+\]: warning: \S+\[([0-9a-fA-F.:]+)\]: SASL \S+ authentication failed`),
+	},
+	"ftp": {
+		regexp.MustCompile(`pure-ftpd: \(\?@([0-9a-fA-F.:]+)\) \[WARNING\] Authentication failed`),
+		regexp.MustCompile(`FAIL LOGIN: Client "(?:::ffff:)?([0-9a-fA-F.:]+)"`),
+		regexp.MustCompile(`proftpd\[\d+\]: .*?\(\S*\[([0-9a-fA-F.:]+)\]\).*(?:Login failed|no such user)`),
+	},
+}
+
+// watch follows the log file in the background, recording a failure for every line
+// matching one of the service's patterns
+func watch(src config.BruteForceSource) error {
+	res, ok := patterns[src.Service]
+	if !ok {
+		return fmt.Errorf("bruteforce: no patterns for service %q", src.Service)
+	}
+
+	t, err := newTail(src.Path)
+	if err != nil {
+		return err
+	}
+
+	crash.Go("bruteforce", func() {
+		t.follow(func(line string) {
+			for _, re := range res {
+				if m := re.FindStringSubmatch(line); m != nil {
+					Failure(src.Service, strings.TrimPrefix(m[1], "::ffff:"))
+					return
+				}
+			}
+		})
+	})
+
+	return nil
+}
+
+// tail follows a log file from its current end, reopening it when it is rotated
+type tail struct {
+	path  string
+	file  *os.File
+	inode uint64
+}
+
+func newTail(path string) (*tail, error) {
+	t := &tail{path: path}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.file.Seek(0, io.SeekEnd); err != nil {
+		t.file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *tail) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		t.inode = sys.Ino
+	}
+	t.file = f
+
+	return nil
+}
+
+// rotated returns true if the file at the path has been replaced or truncated
+func (t *tail) rotated() bool {
+	st, err := os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && sys.Ino != t.inode {
+		return true
+	}
+
+	pos, err := t.file.Seek(0, io.SeekCurrent)
+
+	return err == nil && st.Size() < pos
+}
+
+// follow calls fn for every line appended to the file, polling for new lines once a
+// second
+func (t *tail) follow(fn func(line string)) {
+	r := bufio.NewReader(t.file)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			fn(partial + strings.TrimRight(line, "\r\n"))
+			partial = ""
+			continue
+		}
+
+		// Hold on to a partially written line until the rest of it arrives
+		partial += line
+
+		if t.rotated() {
+			t.file.Close()
+			if err := t.open(); err != nil {
+				zap.S().Named("bruteforce").Warnw("failed to reopen rotated log file", "path", t.path, zap.Error(err))
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			r.Reset(t.file)
+			partial = ""
+			continue
+		}
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,51 @@
+package bruteforce
+
+import "testing"
+
+func TestPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		line    string
+		ip      string
+	}{
+		{"ssh password", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Failed password for root from 203.0.113.7 port 51234 ssh2", "203.0.113.7"},
+		{"ssh invalid user", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Failed password for invalid user admin from 203.0.113.7 port 51234 ssh2", "203.0.113.7"},
+		{"ssh public key", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Failed publickey for git from 2001:db8::7 port 51234 ssh2", "2001:db8::7"},
+		{"ssh unknown user", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Invalid user oracle from 203.0.113.7 port 51234", "203.0.113.7"},
+		{"ssh empty user", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Invalid user  from 203.0.113.7 port 51234", "203.0.113.7"},
+		{"ssh PAM", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: pam_unix(sshd:auth): authentication failure; logname= uid=0 euid=0 tty=ssh ruser= rhost=203.0.113.7  user=root", "203.0.113.7"},
+		{"dovecot", "mail", "Oct 15 08:06:08 web1 dovecot: imap-login: Disconnected (auth failed, 1 attempts in 2 secs): user=<alice@example.com>, method=PLAIN, rip=203.0.113.7, lip=192.0.2.1, TLS", "203.0.113.7"},
+		{"postfix", "mail", "Oct 15 08:06:08 web1 postfix/smtpd[812]: warning: unknown[203.0.113.7]: SASL LOGIN authentication failed: UGFzc3dvcmQ6", "203.0.113.7"},
+		{"pure-ftpd", "ftp", "Oct 15 08:06:08 web1 pure-ftpd: (?@203.0.113.7) [WARNING] Authentication failed for user [alice]", "203.0.113.7"},
+		{"vsftpd", "ftp", `Thu Oct 15 08:06:08 2026 [pid 2] [alice] FAIL LOGIN: Client "::ffff:203.0.113.7"`, "203.0.113.7"},
+		{"proftpd", "ftp", "Oct 15 08:06:08 web1 proftpd[3110]: web1 (client.example.net[203.0.113.7]) - USER alice (Login failed): Incorrect password", "203.0.113.7"},
+
+		// The user name is chosen by the client, which must not get another address banned
+		{"ssh user naming an address", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Invalid user x from 192.0.2.1 from 203.0.113.7 port 51234", "203.0.113.7"},
+		{"ssh failed user naming an address", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Failed password for invalid user x from 192.0.2.1 port 22 from 203.0.113.7 port 51234 ssh2", "203.0.113.7"},
+		{"PAM user naming an address", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: pam_unix(sshd:auth): authentication failure; logname= uid=0 euid=0 tty=ssh ruser= rhost=203.0.113.7  user=x rhost=192.0.2.1", "203.0.113.7"},
+		{"dovecot user naming an address", "mail", "Oct 15 08:06:08 web1 dovecot: imap-login: Disconnected (auth failed, 1 attempts in 2 secs): user=<x, rip=192.0.2.1>, method=PLAIN, rip=203.0.113.7, lip=192.0.2.1, TLS", "203.0.113.7"},
+		{"proftpd user naming an address", "ftp", "Oct 15 08:06:08 web1 proftpd[3110]: web1 (client.example.net[203.0.113.7]) - USER (x[192.0.2.1]) (Login failed): no such user found", "203.0.113.7"},
+
+		{"ssh success", "ssh", "Oct 15 08:06:08 web1 sshd[4121]: Accepted publickey for git from 203.0.113.7 port 51234 ssh2", ""},
+		{"dovecot login", "mail", "Oct 15 08:06:08 web1 dovecot: imap-login: Login: user=<alice@example.com>, method=PLAIN, rip=203.0.113.7, lip=192.0.2.1", ""},
+		{"line of another service", "mail", "Oct 15 08:06:08 web1 sshd[4121]: Failed password for root from 203.0.113.7 port 51234 ssh2", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := ""
+			for _, re := range patterns[tt.service] {
+				if m := re.FindStringSubmatch(tt.line); m != nil {
+					ip = m[1]
+					break
+				}
+			}
+
+			if ip != tt.ip {
+				t.Errorf("got %q, want %q", ip, tt.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version, Commit and Date describe the build. Releases set them when linking:
+//
+//	go build -ldflags "-X github.com/cosmicpanel/CosmicPanel/buildinfo.Version=1.4.0
+//	  -X github.com/cosmicpanel/CosmicPanel/buildinfo.Commit=$(git rev-parse HEAD)
+//	  -X github.com/cosmicpanel/CosmicPanel/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds that do not set them fall back to what the Go toolchain embeds
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// Info describes the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+
+	return info
+}
+
+// String returns the information on a single line, as printed by cosmicpanel version
+func (i Info) String() string {
+	commit := i.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if i.Modified {
+		commit += "-dirty"
+	}
+
+	date := i.Date
+	if date == "" {
+		date = "unknown"
+	}
+
+	return fmt.Sprintf("CosmicPanel %s (commit %s, built %s, %s, %s)", i.Version, commit, date, i.GoVersion, i.Platform)
+}
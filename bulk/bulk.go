@@ -0,0 +1,807 @@
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// States of an operation and of its items
+const (
+	Pending   = "pending"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+
+	// Halted is an operation rolled out in stages that stopped because too many of its
+	// items failed, leaving the rest pending
+	Halted = "halted"
+)
+
+var (
+	// ErrNotConfigured is returned when starting an operation before Configure is called
+	ErrNotConfigured = errors.New("bulk: not configured")
+
+	// ErrNotFound is returned for an operation that does not exist
+	ErrNotFound = errors.New("bulk: operation not found")
+
+	// ErrUnknownType is returned for an operation of a type no package registered
+	ErrUnknownType = errors.New("bulk: unknown operation type")
+
+	// ErrNoItems is returned when starting an operation with nothing to process, or
+	// retrying one without failed items
+	ErrNoItems = errors.New("bulk: no items to process")
+
+	// ErrRunning is returned when retrying an operation that has not finished
+	ErrRunning = errors.New("bulk: operation is still running")
+
+	// ErrFinished is returned when cancelling an operation that has already finished
+	ErrFinished = errors.New("bulk: operation has already finished")
+
+	// ErrNoCanary is returned when rolling out an operation in stages without an item
+	// of a canary account to start with
+	ErrNoCanary = errors.New("bulk: none of the items belong to a canary account")
+)
+
+// Handler processes an item of an operation of the type it is registered for. The
+// context is cancelled when the operation is, and the actor is the user who started it
+type Handler func(ctx context.Context, actor string, it Item) error
+
+// Type is an operation packages can run on many items at once, such as restoring
+// backups
+type Type struct {
+	Name string
+	Run  Handler
+
+	// All returns an item for everything the operation can be run on, such as every
+	// account, which is what operations started without items process. Optional
+	All func() ([]Item, error)
+
+	// Check verifies an item still works a while after it was processed, such as a site
+	// still answering after its settings changed. Only operations rolled out in stages
+	// are checked, and an item failing it counts as failed. Optional
+	Check Handler
+
+	// Account returns the account the item belongs to, which canaries are picked by. The
+	// key is the account when this is not set
+	Account func(it Item) string
+}
+
+var (
+	tmu   sync.RWMutex
+	types = make(map[string]Type)
+)
+
+// Register makes the type of operation available. Packages register their types when
+// they are configured
+func Register(t Type) {
+	tmu.Lock()
+	defer tmu.Unlock()
+
+	types[t.Name] = t
+}
+
+// lookup returns the type with the name
+func lookup(name string) (Type, bool) {
+	tmu.RLock()
+	defer tmu.RUnlock()
+
+	t, ok := types[name]
+
+	return t, ok
+}
+
+// Item is something an operation is run on, such as a backup to restore, identified by
+// its key
+type Item struct {
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	// The wave of a rollout the item is processed in, the first being the canaries
+	Wave int `json:"wave,omitempty"`
+}
+
+// Decode unmarshals the payload of the item
+func (it Item) Decode(v interface{}) error {
+	if len(it.Payload) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(it.Payload, v)
+}
+
+// Operation runs a type of operation on many items, a bounded number at a time. Its
+// progress is kept after every item, so that it resumes where it stopped after a restart
+type Operation struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Actor       string `json:"actor,omitempty"`
+	State       string `json:"state"`
+	Concurrency int    `json:"concurrency"`
+
+	// The job processing the items, which is queued again when the operation is retried
+	Job string `json:"job"`
+
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+
+	// How the operation is rolled out in stages, the wave it reached and why it halted
+	Rollout *Rollout `json:"rollout,omitempty"`
+	Wave    int      `json:"wave,omitempty"`
+	Halted  string   `json:"halted,omitempty"`
+
+	// Left out of lists, which only summarise operations
+	Items []Item `json:"items,omitempty"`
+}
+
+// count updates the progress of the operation from its items
+func (op *Operation) count() {
+	op.Total, op.Pending, op.Succeeded, op.Failed = len(op.Items), 0, 0, 0
+
+	for _, it := range op.Items {
+		switch it.State {
+		case Succeeded:
+			op.Succeeded++
+		case Failed:
+			op.Failed++
+		default:
+			op.Pending++
+		}
+	}
+}
+
+// Rollout rolls an operation out in stages, so that a change breaking sites stops at
+// the few accounts it reached first. The items of canary accounts are processed first,
+// then the rest in waves that double in size. After every wave the items are checked,
+// and the operation halts when a canary or more of the items than the threshold failed.
+// Settings left at zero take the configured defaults
+type Rollout struct {
+	// Canary accounts on top of the configured ones, or the keys of items such as a
+	// domain to process first
+	Canary []string `json:"canary,omitempty"`
+
+	// The items in the first wave after the canaries
+	Wave int `json:"wave"`
+
+	// Seconds waited after a wave before its items are checked
+	Pause int `json:"pause"`
+
+	// The percentage of the items processed so far that may fail
+	Threshold int `json:"threshold"`
+}
+
+// Options change how an operation is run
+type Options struct {
+	// The number of items processed at the same time, up to the configured limit
+	Concurrency int
+
+	// Rolls the operation out in stages rather than processing every item at once
+	Rollout *Rollout
+
+	// The payload of the items without their own, such as a change made to every account
+	Payload json.RawMessage
+
+	Actor string
+}
+
+// kind is what operations are kept under in the state store
+const kind = "bulk.operation"
+
+// jobType is the job that processes the items of an operation
+const jobType = "bulk"
+
+// payload is what the job of an operation is queued with
+type payload struct {
+	Operation string `json:"operation"`
+}
+
+var (
+	std *config.BulkConfiguration
+
+	// mu is held while an operation is read and written back, so that the progress of
+	// items finishing at the same time is not lost
+	mu sync.Mutex
+)
+
+func init() {
+	// Jobs are resumed as soon as the queue starts, so the job must be registered before
+	jobs.Register(jobType, run)
+}
+
+// Configure sets how operations are run
+func Configure(c *config.BulkConfiguration) {
+	std = c
+}
+
+// Start queues an operation of the type on the items, or on everything the type can be
+// run on if there are none. Items are processed in the background, and the operation is
+// followed through Get
+func Start(typ string, items []Item, o Options) (Operation, error) {
+	if std == nil {
+		return Operation{}, ErrNotConfigured
+	}
+
+	t, ok := lookup(typ)
+	if !ok {
+		return Operation{}, fmt.Errorf("%w %s", ErrUnknownType, typ)
+	}
+
+	if len(items) == 0 && t.All != nil {
+		var err error
+		if items, err = t.All(); err != nil {
+			return Operation{}, err
+		}
+	}
+
+	if len(items) == 0 {
+		return Operation{}, ErrNoItems
+	}
+
+	list := make([]Item, 0, len(items))
+	seen := make(map[string]bool, len(items))
+	for i, it := range items {
+		key := strings.TrimSpace(it.Key)
+		if key == "" {
+			return Operation{}, fmt.Errorf("bulk: item %d has no key", i)
+		}
+		if seen[key] {
+			return Operation{}, fmt.Errorf("bulk: item %s is listed more than once", key)
+		}
+		seen[key] = true
+
+		payload := it.Payload
+		if len(payload) == 0 {
+			payload = o.Payload
+		}
+
+		list = append(list, Item{Key: key, Payload: payload, State: Pending})
+	}
+
+	concurrency := o.Concurrency
+	if concurrency <= 0 {
+		concurrency = std.Concurrency
+	}
+	if std.Limit > 0 {
+		concurrency = min(concurrency, std.Limit)
+	}
+
+	op := Operation{
+		ID:          ids.New(),
+		Type:        typ,
+		Actor:       o.Actor,
+		State:       Running,
+		Concurrency: max(concurrency, 1),
+		Created:     time.Now().UTC(),
+		Items:       list,
+	}
+
+	if o.Rollout != nil {
+		r, err := plan(t, op.Items, *o.Rollout)
+		if err != nil {
+			return Operation{}, err
+		}
+		op.Rollout = &r
+	}
+	op.count()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	prune()
+
+	// The job waits for the lock before reading the operation, so it sees its own ID
+	j, err := jobs.Enqueue(jobType, payload{Operation: op.ID}, jobs.Options{Actor: o.Actor})
+	if err != nil {
+		return Operation{}, err
+	}
+
+	op.Job = j.ID
+
+	if err := put(&op); err != nil {
+		jobs.Cancel(j.ID)
+		return Operation{}, err
+	}
+
+	return op, nil
+}
+
+// List returns the operations, newest first, without their items
+func List() ([]Operation, error) {
+	list := []Operation{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(kind, func(id string, data []byte) error {
+			var op Operation
+			if err := json.Unmarshal(data, &op); err != nil {
+				return err
+			}
+
+			op.Items = nil
+			list = append(list, op)
+			return nil
+		})
+	})
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, err
+}
+
+// Get returns the operation with the ID along with the state of each of its items
+func Get(id string) (Operation, error) {
+	var op Operation
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(kind, id, &op)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return op, ErrNotFound
+	}
+
+	return op, err
+}
+
+// Cancel stops an operation. Items being processed are cancelled and left pending along
+// with those that had not started, so that Retry processes them
+func Cancel(id string) (Operation, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	op, err := Get(id)
+	if err != nil {
+		return op, err
+	}
+
+	if op.State != Running {
+		return op, ErrFinished
+	}
+
+	j, err := jobs.Get(op.Job)
+	if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+		return op, err
+	}
+
+	// A running job records that it was cancelled once its items have stopped
+	running := err == nil && j.State == jobs.Running
+
+	if _, err := jobs.Cancel(op.Job); err != nil && !errors.Is(err, jobs.ErrFinished) && !errors.Is(err, jobs.ErrNotFound) {
+		return op, err
+	}
+
+	if !running {
+		op.State = Cancelled
+		op.Finished = time.Now().UTC()
+		if err := put(&op); err != nil {
+			return op, err
+		}
+	}
+
+	return op, nil
+}
+
+// Retry processes the items of a finished operation that failed or were left pending
+// again, keeping those that succeeded. A halted rollout carries on from the wave it
+// halted at
+func Retry(id string, actor string) (Operation, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	op, err := Get(id)
+	if err != nil {
+		return op, err
+	}
+
+	if op.State == Running {
+		return op, ErrRunning
+	}
+
+	if op.Failed+op.Pending == 0 {
+		return op, ErrNoItems
+	}
+
+	for i := range op.Items {
+		if op.Items[i].State == Failed {
+			op.Items[i].State, op.Items[i].Error, op.Items[i].Finished = Pending, "", time.Time{}
+		}
+	}
+
+	j, err := jobs.Enqueue(jobType, payload{Operation: op.ID}, jobs.Options{Actor: actor})
+	if err != nil {
+		return op, err
+	}
+
+	op.Job = j.ID
+	op.State = Running
+	op.Halted = ""
+	op.Finished = time.Time{}
+
+	return op, put(&op)
+}
+
+// run processes the pending items of the operation of the job. Failed items are
+// recorded on the operation rather than failing the job, which only fails when the
+// items could not be processed at all and is then retried
+func run(ctx context.Context, j *jobs.Job) error {
+	var p payload
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	op, err := Get(p.Operation)
+	if err == nil && op.State == Running {
+		if op.Started.IsZero() {
+			op.Started = time.Now().UTC()
+		}
+		err = put(&op)
+	}
+	mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Operations cancelled before their job started have nothing left to do
+	if op.State != Running {
+		return nil
+	}
+
+	t, ok := lookup(op.Type)
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownType, op.Type)
+	}
+
+	log := zap.S().Named("bulk").With("operation", op.ID, "type", op.Type)
+	log.Infow("processing items", "pending", op.Pending, "total", op.Total, "concurrency", op.Concurrency)
+
+	// Operations processed at once are a single wave
+	halted := ""
+	for _, wave := range op.waves() {
+		mu.Lock()
+		op.Wave = wave
+		if err := put(&op); err != nil {
+			log.Errorw("failed to save progress", zap.Error(err))
+		}
+		mu.Unlock()
+
+		processed := process(ctx, &op, wave, log, func(ctx context.Context, it Item) error {
+			return call(ctx, t.Run, op.Actor, it)
+		})
+		if ctx.Err() != nil || op.Rollout == nil {
+			break
+		}
+
+		if halted = verify(ctx, &op, t, wave, processed, log); halted != "" || ctx.Err() != nil {
+			break
+		}
+	}
+
+	mu.Lock()
+	switch {
+	case ctx.Err() != nil:
+		op.State = Cancelled
+	case halted != "":
+		op.State, op.Halted = Halted, halted
+	default:
+		op.count()
+		if op.Failed > 0 {
+			op.State = Failed
+		} else {
+			op.State = Succeeded
+		}
+	}
+	op.Finished = time.Now().UTC()
+	err = put(&op)
+	mu.Unlock()
+
+	log.Infow("finished processing items", "state", op.State, "succeeded", op.Succeeded, "failed", op.Failed, "pending", op.Pending)
+
+	data := map[string]interface{}{
+		"type":      op.Type,
+		"state":     op.State,
+		"total":     op.Total,
+		"succeeded": op.Succeeded,
+		"failed":    op.Failed,
+		"pending":   op.Pending,
+	}
+
+	typ := "bulk.finish"
+	if op.State == Halted {
+		typ = "bulk.halt"
+		data["wave"], data["reason"] = op.Wave, op.Halted
+		log.Warnw("halted rollout", "wave", op.Wave, "reason", op.Halted)
+	}
+
+	events.Publish(events.Event{
+		Type:     typ,
+		Actor:    op.Actor,
+		Resource: op.ID,
+		Data:     data,
+	})
+
+	return err
+}
+
+// process runs fn on the pending items of the wave, the concurrency of the operation at a
+// time, recording how each went. It returns the indexes of the items it finished
+func process(ctx context.Context, op *Operation, wave int, log *zap.SugaredLogger, fn func(ctx context.Context, it Item) error) []int {
+	sem := make(chan struct{}, op.Concurrency)
+	var wg sync.WaitGroup
+	var processed []int
+
+dispatch:
+	for i, it := range op.Items {
+		if it.State != Pending || it.Wave != wave {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int, it Item) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := fn(ctx, it)
+
+			// Items interrupted by cancelling the operation stay pending
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			processed = append(processed, i)
+			op.Items[i].Finished = time.Now().UTC()
+			if err != nil {
+				op.Items[i].State, op.Items[i].Error = Failed, err.Error()
+				log.Warnw("item failed", "item", it.Key, zap.Error(err))
+			} else {
+				op.Items[i].State, op.Items[i].Error = Succeeded, ""
+			}
+
+			if err := put(op); err != nil {
+				log.Errorw("failed to save progress", zap.Error(err))
+			}
+		}(i, it)
+	}
+
+	wg.Wait()
+
+	return processed
+}
+
+// verify checks the items of the wave that were processed once the pause of the rollout
+// has passed, and returns why the rollout halts, if it does
+func verify(ctx context.Context, op *Operation, t Type, wave int, processed []int, log *zap.SugaredLogger) string {
+	if t.Check != nil && len(processed) > 0 {
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-time.After(time.Duration(op.Rollout.Pause) * time.Second):
+		}
+
+		sem := make(chan struct{}, op.Concurrency)
+		var wg sync.WaitGroup
+		for _, i := range processed {
+			mu.Lock()
+			it := op.Items[i]
+			mu.Unlock()
+
+			if it.State != Succeeded {
+				continue
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int, it Item) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				err := call(ctx, t.Check, op.Actor, it)
+				if err == nil || ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				op.Items[i].State, op.Items[i].Error = Failed, "check failed: "+err.Error()
+				log.Warnw("item failed its check", "item", it.Key, zap.Error(err))
+
+				if err := put(op); err != nil {
+					log.Errorw("failed to save progress", zap.Error(err))
+				}
+			}(i, it)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return ""
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Items of earlier runs count as well, so that retrying a few failed items does not
+	// start the count over
+	var done, failed, canaries int
+	for _, it := range op.Items {
+		switch {
+		case it.State == Failed && it.Wave == 1:
+			canaries++
+			fallthrough
+		case it.State == Failed:
+			failed++
+			done++
+		case it.State == Succeeded:
+			done++
+		}
+	}
+
+	switch {
+	case canaries > 0:
+		return fmt.Sprintf("%d of the canaries failed", canaries)
+	case done > 0 && failed*100 > op.Rollout.Threshold*done:
+		return fmt.Sprintf("%d of the %d items processed failed, more than %d%%", failed, done, op.Rollout.Threshold)
+	}
+
+	return ""
+}
+
+// plan fills in the defaults of the rollout and assigns the items to its waves: the
+// items of canary accounts first, then waves of the rest doubling in size
+func plan(t Type, items []Item, r Rollout) (Rollout, error) {
+	r.Canary = append(append([]string{}, std.Canary...), r.Canary...)
+	if r.Wave <= 0 {
+		r.Wave = max(std.Wave, 1)
+	}
+	if r.Pause <= 0 {
+		r.Pause = std.Pause
+	}
+	if r.Threshold <= 0 {
+		r.Threshold = std.Threshold
+	}
+	if r.Threshold > 100 {
+		return r, errors.New("bulk: the threshold of a rollout is a percentage up to 100")
+	}
+
+	canary := make(map[string]bool, len(r.Canary))
+	for _, a := range r.Canary {
+		canary[strings.ToLower(strings.TrimSpace(a))] = true
+	}
+
+	var rest []int
+	for i, it := range items {
+		account := it.Key
+		if t.Account != nil {
+			account = t.Account(it)
+		}
+
+		if canary[strings.ToLower(it.Key)] || canary[strings.ToLower(account)] {
+			items[i].Wave = 1
+		} else {
+			rest = append(rest, i)
+		}
+	}
+
+	if len(rest) == len(items) {
+		return r, ErrNoCanary
+	}
+
+	wave, size := 2, r.Wave
+	for len(rest) > 0 {
+		n := min(size, len(rest))
+		for _, i := range rest[:n] {
+			items[i].Wave = wave
+		}
+		rest = rest[n:]
+		wave, size = wave+1, size*2
+	}
+
+	return r, nil
+}
+
+// waves returns the waves with pending items in the order they are processed
+func (op *Operation) waves() []int {
+	seen := make(map[int]bool)
+	var list []int
+	for _, it := range op.Items {
+		if it.State == Pending && !seen[it.Wave] {
+			seen[it.Wave] = true
+			list = append(list, it.Wave)
+		}
+	}
+
+	sort.Ints(list)
+
+	return list
+}
+
+// call processes the item, turning a panic into an error so that it fails the item
+// rather than the daemon
+func call(ctx context.Context, h Handler, actor string, it Item) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rep := crash.Capture("bulk", r, map[string]string{"item": it.Key})
+			err = fmt.Errorf("item panicked, see crash report %s: %v", rep.ID, r)
+		}
+	}()
+
+	return h(ctx, actor, it)
+}
+
+// put counts the progress of the operation and writes it to the state store. The lock
+// must be held
+func put(op *Operation) error {
+	op.count()
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(kind, op.ID, op)
+	})
+}
+
+// prune removes finished operations older than those kept. The lock must be held, and
+// operations that cannot be removed are left for the next time
+func prune() {
+	if std.Retention <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-time.Duration(std.Retention) * time.Hour)
+
+	err := store.Update(func(tx *store.Tx) error {
+		var expired []string
+		err := tx.Each(kind, func(id string, data []byte) error {
+			var op Operation
+			if err := json.Unmarshal(data, &op); err == nil && op.State != Running && !op.Finished.IsZero() && op.Finished.Before(cutoff) {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			if err := tx.Delete(kind, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		zap.S().Named("bulk").Warnw("failed to remove finished operations", zap.Error(err))
+	}
+}
@@ -0,0 +1,486 @@
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up operations on a new state store and job queue, whose dispatcher is
+// not started so that tests run the jobs themselves
+func configure(t *testing.T, c *config.BulkConfiguration) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Configure(dir, &config.JobsConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	Configure(c)
+
+	t.Cleanup(func() {
+		std = nil
+		tmu.Lock()
+		types = make(map[string]Type)
+		tmu.Unlock()
+	})
+}
+
+// handler returns a handler recording the items it processed, failing those listed
+func handler(fail ...string) (Handler, func() []string) {
+	var mu sync.Mutex
+	var seen []string
+
+	h := func(ctx context.Context, actor string, it Item) error {
+		mu.Lock()
+		seen = append(seen, it.Key)
+		mu.Unlock()
+
+		if slices.Contains(fail, it.Key) {
+			return fmt.Errorf("%s broke", it.Key)
+		}
+		return nil
+	}
+
+	return h, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		list := slices.Clone(seen)
+		slices.Sort(list)
+		return list
+	}
+}
+
+// runJob runs the job of the operation as the queue would and returns the operation
+func runJob(t *testing.T, ctx context.Context, id string) Operation {
+	t.Helper()
+
+	op, err := Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := jobs.Get(op.Job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(ctx, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	if op, err = Get(id); err != nil {
+		t.Fatal(err)
+	}
+
+	return op
+}
+
+// states returns the items of the operation by state
+func states(op Operation) map[string][]string {
+	m := make(map[string][]string)
+	for _, it := range op.Items {
+		m[it.State] = append(m[it.State], it.Key)
+	}
+	for _, list := range m {
+		slices.Sort(list)
+	}
+
+	return m
+}
+
+func items(keys ...string) []Item {
+	list := make([]Item, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, Item{Key: k})
+	}
+
+	return list
+}
+
+func TestStart(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Concurrency: 4, Limit: 8, Canary: []string{"test"}, Wave: 2, Threshold: 5})
+
+	h, _ := handler()
+	Register(Type{Name: "some", Run: h})
+	Register(Type{Name: "every", Run: h, All: func() ([]Item, error) { return items("alice", "bob"), nil }})
+
+	tests := []struct {
+		name        string
+		typ         string
+		items       []Item
+		options     Options
+		keys        []string
+		concurrency int
+		err         error
+	}{
+		{"items", "some", items("alice", " bob "), Options{}, []string{"alice", "bob"}, 4, nil},
+		{"everything", "every", nil, Options{}, []string{"alice", "bob"}, 4, nil},
+		{"concurrency", "some", items("alice"), Options{Concurrency: 2}, []string{"alice"}, 2, nil},
+		{"concurrency over the limit", "some", items("alice"), Options{Concurrency: 100}, []string{"alice"}, 8, nil},
+		{"rolled out", "some", items("alice", "test"), Options{Rollout: &Rollout{}}, []string{"alice", "test"}, 4, nil},
+
+		{"unknown type", "other", items("alice"), Options{}, nil, 0, ErrUnknownType},
+		{"no items", "some", nil, Options{}, nil, 0, ErrNoItems},
+		{"no key", "some", items("alice", " "), Options{}, nil, 0, errors.New("")},
+		{"listed twice", "some", items("alice", "bob", "alice "), Options{}, nil, 0, errors.New("")},
+		{"no canary", "some", items("alice", "bob"), Options{Rollout: &Rollout{}}, nil, 0, ErrNoCanary},
+		{"threshold over 100", "some", items("test"), Options{Rollout: &Rollout{Threshold: 101}}, nil, 0, errors.New("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(jobs.List("", jobType))
+
+			op, err := Start(tt.typ, tt.items, tt.options)
+			if (err == nil) != (tt.err == nil) || (tt.err != nil && tt.err.Error() != "" && !errors.Is(err, tt.err)) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if after := len(jobs.List("", jobType)); after != before {
+					t.Errorf("a job was queued for an operation that did not start")
+				}
+				return
+			}
+
+			var keys []string
+			for _, it := range op.Items {
+				keys = append(keys, it.Key)
+				if it.State != Pending {
+					t.Errorf("%s is %s", it.Key, it.State)
+				}
+			}
+			if !slices.Equal(keys, tt.keys) || op.Concurrency != tt.concurrency || op.State != Running {
+				t.Errorf("started %+v", op)
+			}
+			if op.Total != len(tt.keys) || op.Pending != len(tt.keys) {
+				t.Errorf("counted %d items with %d pending", op.Total, op.Pending)
+			}
+
+			stored, err := Get(op.ID)
+			if err != nil || stored.Job != op.Job || len(stored.Items) != len(tt.keys) {
+				t.Errorf("stored %+v, %v", stored, err)
+			}
+			if _, err := jobs.Get(op.Job); err != nil {
+				t.Errorf("job of the operation: %v", err)
+			}
+		})
+	}
+}
+
+func TestPayload(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Concurrency: 1})
+
+	var mu sync.Mutex
+	got := make(map[string]string)
+	Register(Type{Name: "ini", Run: func(ctx context.Context, actor string, it Item) error {
+		var p struct {
+			Limit string `json:"limit"`
+		}
+		if err := it.Decode(&p); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		got[it.Key] = actor + " " + p.Limit
+		mu.Unlock()
+		return nil
+	}})
+
+	list := []Item{{Key: "alice"}, {Key: "bob", Payload: json.RawMessage(`{"limit": "512M"}`)}}
+	op, err := Start("ini", list, Options{Payload: json.RawMessage(`{"limit": "256M"}`), Actor: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op = runJob(t, context.Background(), op.ID); op.State != Succeeded {
+		t.Fatalf("operation %+v", op)
+	}
+	if want := map[string]string{"alice": "admin 256M", "bob": "admin 512M"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Concurrency: 3})
+
+	h, seen := handler("carol", "erin")
+	Register(Type{Name: "backup", Run: h})
+
+	panicked := false
+	Register(Type{Name: "panics", Run: func(ctx context.Context, actor string, it Item) error {
+		if it.Key == "bob" {
+			panicked = true
+			panic("nil map")
+		}
+		return nil
+	}})
+
+	op, err := Start("backup", items("alice", "bob", "carol", "dave", "erin"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op = runJob(t, context.Background(), op.ID)
+	if op.State != Failed || op.Succeeded != 3 || op.Failed != 2 || op.Pending != 0 || op.Started.IsZero() || op.Finished.IsZero() {
+		t.Errorf("operation %+v", op)
+	}
+	if got := states(op); !slices.Equal(got[Failed], []string{"carol", "erin"}) {
+		t.Errorf("failed %q", got[Failed])
+	}
+	for _, it := range op.Items {
+		if (it.State == Failed) != (it.Error != "") || it.Finished.IsZero() {
+			t.Errorf("item %+v", it)
+		}
+	}
+
+	// Retrying processes the failed items alone
+	if _, err := Retry(op.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	h, seen = handler()
+	Register(Type{Name: "backup", Run: h})
+
+	op = runJob(t, context.Background(), op.ID)
+	if op.State != Succeeded || op.Succeeded != 5 {
+		t.Errorf("retried %+v", op)
+	}
+	if got := seen(); !slices.Equal(got, []string{"carol", "erin"}) {
+		t.Errorf("retried %q", got)
+	}
+
+	if _, err := Retry(op.ID, "admin"); !errors.Is(err, ErrNoItems) {
+		t.Errorf("retrying a succeeded operation: %v", err)
+	}
+
+	// An item panicking fails alone
+	op, err = Start("panics", items("alice", "bob", "carol"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op = runJob(t, context.Background(), op.ID)
+	if got := states(op); !panicked || !slices.Equal(got[Failed], []string{"bob"}) || !slices.Equal(got[Succeeded], []string{"alice", "carol"}) {
+		t.Errorf("items %v", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Concurrency: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	Register(Type{Name: "slow", Run: func(ctx context.Context, actor string, it Item) error {
+		if it.Key == "bob" {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}})
+
+	op, err := Start("slow", items("alice", "bob", "carol"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelled while its job runs, the items being processed and those not started are
+	// left pending
+	op = runJob(t, ctx, op.ID)
+	if got := states(op); op.State != Cancelled || !slices.Equal(got[Succeeded], []string{"alice"}) || !slices.Equal(got[Pending], []string{"bob", "carol"}) {
+		t.Errorf("cancelled %s with %v", op.State, got)
+	}
+
+	if _, err := Cancel(op.ID); !errors.Is(err, ErrFinished) {
+		t.Errorf("cancelling a cancelled operation: %v", err)
+	}
+
+	// Cancelled before its job started, nothing is processed
+	op, err = Start("slow", items("dave"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op, err = Cancel(op.ID); err != nil || op.State != Cancelled {
+		t.Fatalf("cancelled %+v, %v", op, err)
+	}
+	if op = runJob(t, context.Background(), op.ID); op.State != Cancelled || op.Pending != 1 {
+		t.Errorf("ran a cancelled operation %+v", op)
+	}
+
+	if _, err := Cancel("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cancelling a missing operation: %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Canary: []string{"Test"}, Wave: 2, Pause: 30, Threshold: 5})
+
+	tests := []struct {
+		name    string
+		keys    []string
+		rollout Rollout
+		account func(it Item) string
+		waves   []int
+		want    Rollout
+	}{
+		{"defaults", []string{"a", "test", "b", "c", "d", "e", "f", "g", "h"}, Rollout{}, nil, []int{2, 1, 2, 3, 3, 3, 3, 4, 4}, Rollout{Canary: []string{"Test"}, Wave: 2, Pause: 30, Threshold: 5}},
+		{"own canaries", []string{"a", "b", "c", "d"}, Rollout{Canary: []string{" B "}, Wave: 1, Pause: 1, Threshold: 50}, nil, []int{2, 1, 3, 3}, Rollout{Canary: []string{"Test", " B "}, Wave: 1, Pause: 1, Threshold: 50}},
+		{"canary by account", []string{"a.example.com", "test.example.com", "b.example.com"}, Rollout{}, func(it Item) string { return strings.TrimSuffix(it.Key, ".example.com") }, []int{2, 1, 2}, Rollout{Canary: []string{"Test"}, Wave: 2, Pause: 30, Threshold: 5}},
+		{"canary by key", []string{"a.example.com", "test.example.com"}, Rollout{Canary: []string{"a.example.com"}}, func(it Item) string { return "someone" }, []int{1, 2}, Rollout{Canary: []string{"Test", "a.example.com"}, Wave: 2, Pause: 30, Threshold: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := items(tt.keys...)
+
+			r, err := plan(Type{Account: tt.account}, list, tt.rollout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var waves []int
+			for _, it := range list {
+				waves = append(waves, it.Wave)
+			}
+			if !slices.Equal(waves, tt.waves) {
+				t.Errorf("waves %v, want %v", waves, tt.waves)
+			}
+			if fmt.Sprint(r) != fmt.Sprint(tt.want) {
+				t.Errorf("rollout %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollout(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      []string
+		checkFail []string
+		threshold int
+		state     string
+		succeeded []string
+	}{
+		{"every wave", nil, nil, 5, Succeeded, []string{"a", "b", "c", "d", "e", "f", "test"}},
+		{"canary fails", []string{"test"}, nil, 50, Halted, nil},
+		{"canary fails its check", nil, []string{"test"}, 50, Halted, nil},
+		{"over the threshold", []string{"b"}, nil, 25, Halted, []string{"a", "test"}},
+		{"under the threshold", []string{"b"}, nil, 50, Failed, []string{"a", "c", "d", "e", "f", "test"}},
+		{"check over the threshold", nil, []string{"a", "b"}, 50, Halted, []string{"test"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, &config.BulkConfiguration{Concurrency: 2, Wave: 2})
+
+			h, _ := handler(tt.fail...)
+			check, _ := handler(tt.checkFail...)
+			Register(Type{Name: "php", Run: h, Check: check})
+
+			op, err := Start("php", items("test", "a", "b", "c", "d", "e", "f"), Options{Rollout: &Rollout{Canary: []string{"test"}, Threshold: tt.threshold}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			op = runJob(t, context.Background(), op.ID)
+			if got := states(op); op.State != tt.state || !slices.Equal(got[Succeeded], tt.succeeded) {
+				t.Errorf("%s with %v, want %s with %q succeeded", op.State, got, tt.state, tt.succeeded)
+			}
+			if (op.State == Halted) != (op.Halted != "") {
+				t.Errorf("halted %q", op.Halted)
+			}
+		})
+	}
+
+	// A halted rollout carries on from where it stopped once retried
+	configure(t, &config.BulkConfiguration{Concurrency: 2, Wave: 2})
+
+	broken := true
+	var mu sync.Mutex
+	var seen []string
+	Register(Type{Name: "php", Run: func(ctx context.Context, actor string, it Item) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		seen = append(seen, it.Key)
+		if broken && it.Key == "b" {
+			return errors.New("broke")
+		}
+		return nil
+	}})
+
+	op, err := Start("php", items("test", "a", "b", "c", "d"), Options{Rollout: &Rollout{Canary: []string{"test"}, Threshold: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op = runJob(t, context.Background(), op.ID); op.State != Halted || op.Wave != 2 {
+		t.Fatalf("rollout %s at wave %d", op.State, op.Wave)
+	}
+
+	broken = false
+	seen = nil
+	if _, err := Retry(op.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if op = runJob(t, context.Background(), op.ID); op.State != Succeeded || op.Halted != "" {
+		t.Errorf("retried rollout %+v", op)
+	}
+	slices.Sort(seen)
+	if !slices.Equal(seen, []string{"b", "c", "d"}) {
+		t.Errorf("retried %q", seen)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	configure(t, &config.BulkConfiguration{Concurrency: 1, Retention: 1})
+
+	h, _ := handler()
+	Register(Type{Name: "some", Run: h})
+
+	old, err := Start("some", items("alice"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := Start("some", items("bob"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Finished two hours ago, and one that is still running from as long ago
+	old = runJob(t, context.Background(), old.ID)
+	for _, op := range []Operation{old, running} {
+		op, _ = Get(op.ID)
+		op.Finished = op.Created.Add(-2 * 60 * 60 * 1e9)
+		op.Created = op.Finished
+		if err := put(&op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Start("some", items("carol"), Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get(old.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("an expired operation was kept: %v", err)
+	}
+	if _, err := Get(running.ID); err != nil {
+		t.Errorf("a running operation was removed: %v", err)
+	}
+
+	list, err := List()
+	if err != nil || len(list) != 2 || list[0].Items != nil {
+		t.Errorf("listed %+v, %v", list, err)
+	}
+}
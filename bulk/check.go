@@ -0,0 +1,62 @@
+package bulk
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultSite is the web server sites are requested from when a type does not name one
+const defaultSite = "http://127.0.0.1"
+
+// SiteCheck returns a check requesting the site of the domain the item is keyed by from
+// the web server at base, such as http://127.0.0.1, with the domain as the Host header.
+// It fails when the site cannot be reached or answers with a server error. An empty base
+// requests the local web server over HTTP
+func SiteCheck(base string) Handler {
+	if base == "" {
+		base = defaultSite
+	}
+	base = strings.TrimSuffix(base, "/") + "/"
+
+	return func(ctx context.Context, actor string, it Item) error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = it.Key
+
+		client := &http.Client{
+			// A redirect, such as to HTTPS, is an answer of the site all the same
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+
+			// Over HTTPS the handshake is made for the domain, which is what a change to
+			// its TLS settings breaks. The certificate is not what is being checked, and
+			// may not have been issued yet
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: it.Key, InsecureSkipVerify: true},
+			},
+		}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%s answered with %s", it.Key, resp.Status)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package bulk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "ok.example.com":
+		case "redirect.example.com":
+			http.Redirect(w, r, "https://redirect.example.com/", http.StatusMovedPermanently)
+		case "missing.example.com":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	tls := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || r.TLS.ServerName != r.Host {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer tls.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		base string
+		key  string
+		ok   bool
+	}{
+		{srv.URL, "ok.example.com", true},
+		{srv.URL + "/", "redirect.example.com", true},
+		{srv.URL, "missing.example.com", true},
+		{tls.URL, "secure.example.com", true},
+
+		{srv.URL, "broken.example.com", false},
+		{closed.URL, "ok.example.com", false},
+	}
+
+	for _, tt := range tests {
+		err := SiteCheck(tt.base)(context.Background(), "admin", Item{Key: tt.key})
+		if (err == nil) != tt.ok {
+			t.Errorf("checking %s at %s: %v", tt.key, tt.base, err)
+		}
+	}
+}
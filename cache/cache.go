@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+)
+
+// Cache keeps the results of lookups in memory for a while, so that hot paths such as
+// authenticating a request do not query the state store every time. Results are loaded
+// on a miss and kept until they expire, the cache is full or an event invalidates them
+type Cache struct {
+	name string
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]entry
+
+	// Counts the purges and invalidations, so that a lookup that was loading while one
+	// happened does not store what it found from before it
+	generation uint64
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// entry is a cached result, which is nil when the lookup found nothing
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Stats are the counters of a cache
+type Stats struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+var (
+	mu     sync.Mutex
+	caches = make(map[string]*Cache)
+)
+
+// New returns a cache keeping results for the duration and at most size of them,
+// registering it under the name so that its counters are reported
+func New(name string, ttl time.Duration, size int) *Cache {
+	c := &Cache{name: name, ttl: ttl, size: size, entries: make(map[string]entry)}
+
+	mu.Lock()
+	caches[name] = c
+	mu.Unlock()
+
+	return c
+}
+
+// Get returns the result for the key, calling load on a miss. A nil result is cached as
+// well, so lookups of something that does not exist are not repeated either. Errors are
+// not cached, and neither is a result loaded while the cache was purged or invalidated
+func (c *Cache) Get(key string, load func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		c.hits.Add(1)
+		return e.value, nil
+	}
+	c.misses.Add(1)
+
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return v, nil
+	}
+
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = entry{value: v, expires: now.Add(c.ttl)}
+
+	return v, nil
+}
+
+// evict removes expired results, or every result if none have expired so that a full
+// cache never grows. The cache must be locked
+func (c *Cache) evict(now time.Time) {
+	before := len(c.entries)
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string]entry)
+	}
+
+	c.evictions.Add(uint64(before - len(c.entries)))
+}
+
+// Invalidate removes the result for the key
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+	c.generation++
+}
+
+// Purge removes every result
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]entry)
+	c.generation++
+}
+
+// PurgeOn purges the cache whenever an event matching one of the patterns is published.
+// The handler runs before Publish returns, so a lookup made after a change never sees
+// the result from before it
+func (c *Cache) PurgeOn(patterns ...string) {
+	events.Handle(func(e events.Event) {
+		for _, p := range patterns {
+			if e.Matches(p) {
+				c.Purge()
+				return
+			}
+		}
+	})
+}
+
+// Stats returns the counters of the cache
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return Stats{
+		Name:      c.name,
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// All returns the counters of every cache, ordered by name
+func All() []Stats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Stats, 0, len(caches))
+	for _, c := range caches {
+		list = append(list, c.Stats())
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
@@ -0,0 +1,505 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// CDNs a host can be fronted by
+const (
+	// Cloudflare proxies the records of the host in a zone served by a Cloudflare
+	// provider of externaldns
+	Cloudflare = "cloudflare"
+
+	// Pull is any CDN pulling from the server, which the host is pointed at by hand
+	Pull = "pull"
+)
+
+var (
+	// ErrNotConfigured is returned when using a CDN before Configure is called
+	ErrNotConfigured = errors.New("cdn: not configured")
+
+	// ErrNotFound is returned for a host that is not fronted by a CDN
+	ErrNotFound = errors.New("cdn: the host is not fronted by a CDN")
+
+	// ErrNoPurge is returned when purging a host whose CDN has no purge URL
+	ErrNoPurge = errors.New("cdn: the host has no purge URL")
+
+	// ErrFailed is returned when a CDN refused a purge or could not be reached
+	ErrFailed = errors.New("cdn: the CDN failed")
+
+	// ErrPrivatePurge is returned for a purge URL pointing at the server or its network
+	ErrPrivatePurge = errors.New("cdn: the purge URL must point at a public address")
+)
+
+// allowed returns true if purge URLs may point at the address. Sending the purge to the
+// loopback, private or link-local addresses would let an account reach services of the
+// server and its network that are not exposed to it
+var allowed = func(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// Site is a host fronted by a CDN
+type Site struct {
+	Host     string `json:"host"`
+	Provider string `json:"provider"`
+
+	// The hostname the pull CDN serves the host at, such as example.b-cdn.net
+	Hostname string `json:"hostname,omitempty"`
+
+	// The URL POSTed to with the host to purge the cache of a pull CDN, holding whatever
+	// credentials the CDN requires
+	PurgeURL string `json:"purge_url,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Purged  time.Time `json:"purged"`
+}
+
+// Redacted returns the site with only the scheme and host of its purge URL, so that the
+// credentials it holds are not reported
+func (s Site) Redacted() Site {
+	if u, err := url.Parse(s.PurgeURL); err == nil && s.PurgeURL != "" {
+		s.PurgeURL = u.Scheme + "://" + u.Host + "/..."
+	}
+
+	return s
+}
+
+const (
+	siteKind  = "cdn.site"
+	edgesKind = "cdn.edges"
+)
+
+// cloudflareIPs lists the networks the edges of Cloudflare connect from
+const cloudflareIPs = "https://api.cloudflare.com/client/v4/ips"
+
+// timeout is how long a call to a CDN may take
+const timeout = 30 * time.Second
+
+type manager struct {
+	// Serializes the changes to sites, which each call the CDN before they are stored
+	mu     sync.Mutex
+	config *config.CDNConfiguration
+	client *http.Client
+}
+
+var std *manager
+
+// Configure checks the trusted networks and registers the real visitor address
+// configuration of the web servers with the reconciler
+func Configure(c *config.CDNConfiguration) error {
+	for _, n := range c.Trusted {
+		if _, _, err := net.ParseCIDR(n); err != nil && net.ParseIP(n) == nil {
+			return fmt.Errorf("cdn: %q in trusted is not an address or network", n)
+		}
+	}
+
+	if c.Header == "" {
+		return errors.New("cdn: the header passing the address of visitors is required")
+	}
+
+	std = &manager{config: c, client: httpx.Client(timeout)}
+
+	reconcile.Register("cdn.nginx", source(&nginx{path: c.Nginx}))
+	reconcile.Register("cdn.apache", source(&apache{path: reconcile.FirstInstalled(c.Apache)}))
+
+	return nil
+}
+
+// Watch purges the cache of the host in the resource of the events the configuration
+// lists
+func Watch() {
+	if std == nil || len(std.config.PurgeOn) == 0 {
+		return
+	}
+
+	sub := events.Subscribe(64, std.config.PurgeOn...)
+	crash.Go("cdn", func() {
+		for e := range sub.C {
+			s, err := Get(e.Resource)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			if err == nil {
+				s, err = Purge(s.Host)
+			}
+			if err != nil {
+				zap.S().Named("cdn").Errorw("failed to purge after an event", "host", e.Resource, "event", e.Type, zap.Error(err))
+				continue
+			}
+
+			events.Publish(events.Event{Type: "cdn.purge", Resource: s.Host, Data: map[string]interface{}{"event": e.Type}})
+		}
+	})
+}
+
+// List returns the sites within the domains, or every site when no domains are given,
+// sorted by host
+func List(domains ...string) ([]Site, error) {
+	list := []Site{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(siteKind, func(id string, data []byte) error {
+			var s Site
+			if err := json.Unmarshal(data, &s); err != nil {
+				return fmt.Errorf("cdn: malformed site %s: %w", id, err)
+			}
+
+			if len(domains) == 0 || slices.ContainsFunc(domains, func(d string) bool { return Within(s.Host, d) }) {
+				list = append(list, s)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	return list, nil
+}
+
+// Get returns the site of the host
+func Get(host string) (Site, error) {
+	var s Site
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(siteKind, normalize(host), &s)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Site{}, ErrNotFound
+	}
+
+	return s, err
+}
+
+// Enable fronts the host of the site by its CDN, or moves it to another
+func Enable(s Site) (Site, error) {
+	if std == nil {
+		return Site{}, ErrNotConfigured
+	}
+
+	if err := validate(&s); err != nil {
+		return Site{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	before, err := Get(s.Host)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		s.Created = time.Now().UTC()
+	case err != nil:
+		return Site{}, err
+	default:
+		s.Created, s.Purged = before.Created, before.Purged
+
+		// The purge URL is kept when the site is sent back as it was reported
+		if s.PurgeURL != "" && s.PurgeURL == before.Redacted().PurgeURL {
+			s.PurgeURL = before.PurgeURL
+		}
+	}
+
+	switch s.Provider {
+	case Cloudflare:
+		// The web servers must trust the edges before visitors arrive through them
+		if _, err := cloudflareEdges(); err != nil {
+			return Site{}, err
+		}
+
+		if err := externaldns.SetProxied(s.Host, true); err != nil {
+			return Site{}, err
+		}
+	case Pull:
+		if before.Provider == Cloudflare {
+			if err := externaldns.SetProxied(s.Host, false); err != nil {
+				return Site{}, err
+			}
+		}
+	}
+
+	s.Updated = time.Now().UTC()
+
+	return s, put(s)
+}
+
+// Disable stops fronting the host by its CDN. Hosts of pull CDNs need to be pointed back
+// at the server by hand
+func Disable(host string) (Site, error) {
+	if std == nil {
+		return Site{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	s, err := Get(host)
+	if err != nil {
+		return Site{}, err
+	}
+
+	if s.Provider == Cloudflare {
+		if err := externaldns.SetProxied(s.Host, false); err != nil {
+			return Site{}, err
+		}
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(siteKind, s.Host)
+	})
+
+	return s, err
+}
+
+// Purge drops what the CDN cached for the host
+func Purge(host string) (Site, error) {
+	if std == nil {
+		return Site{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	s, err := Get(host)
+	if err != nil {
+		return Site{}, err
+	}
+
+	switch {
+	case s.Provider == Cloudflare:
+		err = externaldns.Purge(s.Host)
+	case s.PurgeURL == "":
+		err = ErrNoPurge
+	default:
+		err = std.purge(s)
+	}
+	if err != nil {
+		return Site{}, err
+	}
+
+	s.Purged = time.Now().UTC()
+
+	return s, put(s)
+}
+
+// Refresh fetches the networks the edges of Cloudflare connect from while a host is
+// fronted by it, which the web servers are reconciled with when they change. It is run
+// by the scheduler
+func Refresh() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	list, err := List()
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(list, func(s Site) bool { return s.Provider == Cloudflare }) {
+		return nil
+	}
+
+	var before []string
+	if err := store.View(func(tx *store.Tx) error { return tx.Get(edgesKind, Cloudflare, &before) }); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	after, err := fetchCloudflareEdges()
+	if err != nil || slices.Equal(before, after) {
+		return err
+	}
+
+	events.Publish(events.Event{Type: "cdn.edges", Resource: Cloudflare, Data: map[string]interface{}{"networks": after}})
+
+	return nil
+}
+
+// Within returns true if the host is the domain or one of its subdomains
+func Within(host string, domain string) bool {
+	host, domain = normalize(host), normalize(domain)
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// cloudflareEdges returns the networks the edges of Cloudflare connect from, fetching
+// them the first time
+func cloudflareEdges() ([]string, error) {
+	var edges []string
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(edgesKind, Cloudflare, &edges)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return fetchCloudflareEdges()
+	}
+
+	return edges, err
+}
+
+// fetchCloudflareEdges fetches and stores the networks the edges of Cloudflare connect
+// from
+func fetchCloudflareEdges() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cloudflareIPs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := std.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetching the networks of Cloudflare: %v", ErrFailed, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Success bool `json:"success"`
+		Result  struct {
+			IPv4 []string `json:"ipv4_cidrs"`
+			IPv6 []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || !body.Success {
+		return nil, fmt.Errorf("%w: fetching the networks of Cloudflare: %s", ErrFailed, resp.Status)
+	}
+
+	edges := append(body.Result.IPv4, body.Result.IPv6...)
+	for _, n := range edges {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return nil, fmt.Errorf("%w: Cloudflare listed %q as a network", ErrFailed, n)
+		}
+	}
+	if len(edges) == 0 {
+		return nil, fmt.Errorf("%w: Cloudflare listed no networks", ErrFailed)
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(edgesKind, Cloudflare, edges)
+	})
+
+	return edges, err
+}
+
+// purge POSTs the host to the purge URL of the site
+func (m *manager) purge(s Site) error {
+	b, err := json.Marshal(map[string]string{"host": s.Host})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.PurgeURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	// The URL is the account's to choose, so what its host resolves to is checked before
+	// anything is sent, rather than only when it was set
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", req.URL.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: purging %s: %v", ErrFailed, s.Host, err)
+	}
+	for _, addr := range addrs {
+		if !allowed(addr) {
+			return ErrPrivatePurge
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// The error holds the URL, which carries the credentials of the CDN
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("%w: purging %s: %v", ErrFailed, s.Host, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: purging %s: the CDN answered %s", ErrFailed, s.Host, resp.Status)
+	}
+
+	return nil
+}
+
+// validate checks the site and normalizes its host
+func validate(s *Site) error {
+	s.Host = normalize(s.Host)
+	if !hostname.Valid(s.Host) {
+		return fmt.Errorf("cdn: invalid host %q", s.Host)
+	}
+
+	switch s.Provider {
+	case Cloudflare:
+		s.Hostname, s.PurgeURL = "", ""
+	case Pull:
+		if len(std.config.Trusted) == 0 {
+			return errors.New("cdn: pull CDNs can only be used once cdn.trusted lists the networks of their edges")
+		}
+
+		s.Hostname = normalize(s.Hostname)
+		if !hostname.Valid(s.Hostname) {
+			return fmt.Errorf("cdn: invalid hostname %q of the pull CDN", s.Hostname)
+		}
+
+		if s.PurgeURL != "" {
+			u, err := url.Parse(s.PurgeURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return errors.New("cdn: the purge URL must be an HTTP or HTTPS URL")
+			}
+
+			if addr, err := netip.ParseAddr(u.Hostname()); (err == nil && !allowed(addr)) || strings.EqualFold(u.Hostname(), "localhost") {
+				return ErrPrivatePurge
+			}
+		}
+	default:
+		return fmt.Errorf("cdn: unknown provider %q, expected cloudflare or pull", s.Provider)
+	}
+
+	return nil
+}
+
+// put stores the site
+func put(s Site) error {
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(siteKind, s.Host, s)
+	})
+}
+
+// normalize returns the host lower case without a trailing dot
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
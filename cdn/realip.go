@@ -0,0 +1,137 @@
+package cdn
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// header starts every file the trusted edges are rendered into
+const header = "# Managed by CosmicPanel, changes are overwritten when hosts are fronted by a CDN\n"
+
+// server is a web server the trusted edges are rendered into, so that it logs and limits
+// visitors by their own address rather than that of the edge
+type server interface {
+	file() string
+	installed() bool
+	render(edges []string, field string) string
+	test() error
+	reload() error
+}
+
+// source generates the file of the server while it is installed and a host is fronted
+// by a CDN
+func source(s server) reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			if std == nil || !s.installed() {
+				return nil, nil
+			}
+
+			edges, err := trusted()
+			if err != nil || len(edges) == 0 {
+				return nil, err
+			}
+
+			return []reconcile.Artifact{{Path: s.file(), Content: s.render(edges, std.config.Header)}}, nil
+		},
+		Test:   s.test,
+		Reload: s.reload,
+		Events: []string{"cdn.enable", "cdn.disable", "cdn.edges"},
+	}
+}
+
+// trusted returns the networks of the edges of the CDNs hosts are fronted by
+func trusted() ([]string, error) {
+	list, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	var edges []string
+	if slices.ContainsFunc(list, func(s Site) bool { return s.Provider == Pull }) {
+		edges = append(edges, std.config.Trusted...)
+	}
+
+	if slices.ContainsFunc(list, func(s Site) bool { return s.Provider == Cloudflare }) {
+		cf, err := cloudflareEdges()
+		if err != nil {
+			return nil, err
+		}
+		edges = append(edges, cf...)
+	}
+
+	slices.Sort(edges)
+
+	return slices.Compact(edges), nil
+}
+
+// nginx renders the edges into a file included in the http block
+type nginx struct {
+	path string
+}
+
+func (t *nginx) file() string {
+	return t.path
+}
+
+func (t *nginx) installed() bool {
+	return reconcile.Installed(t.path)
+}
+
+func (t *nginx) render(edges []string, field string) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, n := range edges {
+		fmt.Fprintf(&b, "set_real_ip_from %s;\n", n)
+	}
+	fmt.Fprintf(&b, "real_ip_header %s;\n", field)
+	b.WriteString("real_ip_recursive on;\n")
+
+	return b.String()
+}
+
+func (t *nginx) test() error {
+	return privsep.Run("nginx", "-t")
+}
+
+func (t *nginx) reload() error {
+	return privsep.Run("nginx", "-s", "reload")
+}
+
+// apache renders the edges into a server wide configuration file for mod_remoteip
+type apache struct {
+	path string
+}
+
+func (t *apache) file() string {
+	return t.path
+}
+
+func (t *apache) installed() bool {
+	return reconcile.Installed(t.path)
+}
+
+func (t *apache) render(edges []string, field string) string {
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteString("<IfModule mod_remoteip.c>\n")
+	fmt.Fprintf(&b, "    RemoteIPHeader %s\n", field)
+	for _, n := range edges {
+		fmt.Fprintf(&b, "    RemoteIPTrustedProxy %s\n", n)
+	}
+	b.WriteString("</IfModule>\n")
+
+	return b.String()
+}
+
+func (t *apache) test() error {
+	return privsep.Run("apachectl", "configtest")
+}
+
+func (t *apache) reload() error {
+	return privsep.Run("apachectl", "graceful")
+}
@@ -0,0 +1,88 @@
+package cdn
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+func TestRender(t *testing.T) {
+	edges := []string{"192.0.2.0/24", "2001:db8::/32"}
+
+	tests := []struct {
+		name   string
+		server server
+		want   string
+	}{
+		{"nginx", &nginx{}, header + "set_real_ip_from 192.0.2.0/24;\nset_real_ip_from 2001:db8::/32;\nreal_ip_header CF-Connecting-IP;\nreal_ip_recursive on;\n"},
+		{"apache", &apache{}, header + "<IfModule mod_remoteip.c>\n    RemoteIPHeader CF-Connecting-IP\n    RemoteIPTrustedProxy 192.0.2.0/24\n    RemoteIPTrustedProxy 2001:db8::/32\n</IfModule>\n"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.server.render(edges, "CF-Connecting-IP"); got != tt.want {
+			t.Errorf("%s rendered\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	dir := configure(t, "192.0.2.0/24", "198.51.100.0/24")
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(edgesKind, Cloudflare, []string{"203.0.113.0/24", "198.51.100.0/24"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		sites []Site
+		want  []string
+	}{
+		{"no sites", nil, nil},
+		{"pull", []Site{{Host: "a.example.com", Provider: Pull}}, []string{"192.0.2.0/24", "198.51.100.0/24"}},
+		{"cloudflare", []Site{{Host: "a.example.com", Provider: Cloudflare}}, []string{"198.51.100.0/24", "203.0.113.0/24"}},
+		{"both", []Site{{Host: "a.example.com", Provider: Pull}, {Host: "b.example.com", Provider: Cloudflare}}, []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.Update(func(tx *store.Tx) error {
+				for _, id := range []string{"a.example.com", "b.example.com"} {
+					if err := tx.Delete(siteKind, id); err != nil {
+						return err
+					}
+				}
+				for _, s := range tt.sites {
+					if err := tx.Put(siteKind, s.Host, s); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := trusted()
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("trusted %q, %v, want %q", got, err, tt.want)
+			}
+
+			// Only the servers whose directory exists get a file
+			os.MkdirAll(filepath.Join(dir, "nginx"), 0755)
+			artifacts, err := source(&nginx{path: std.config.Nginx}).Desired()
+			if err != nil || len(artifacts) != map[bool]int{true: 1}[tt.want != nil] {
+				t.Errorf("nginx artifacts %+v, %v", artifacts, err)
+			}
+			artifacts, err = source(&apache{path: std.config.Apache[0]}).Desired()
+			if err != nil || len(artifacts) != 0 {
+				t.Errorf("apache artifacts %+v, %v", artifacts, err)
+			}
+		})
+	}
+}
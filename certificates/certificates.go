@@ -0,0 +1,372 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when scanning before Configure is called
+	ErrNotConfigured = errors.New("certificates: not configured")
+
+	// ErrScanning is returned when scanning while a scan is in progress
+	ErrScanning = errors.New("certificates: a scan is already running")
+)
+
+// certificateKind is what the certificates found by the last scan are kept under in the
+// state store, keyed by fingerprint, so that each stage of their expiry is only alerted
+// about once
+const certificateKind = "certificates.certificate"
+
+// Certificate is a certificate the server presents or keeps in a file, whether the panel
+// had anything to do with it or not
+type Certificate struct {
+	// The SHA-256 fingerprint of the certificate, in hex
+	Fingerprint string `json:"fingerprint"`
+
+	Subject    string    `json:"subject"`
+	Names      []string  `json:"names"`
+	Issuer     string    `json:"issuer"`
+	SelfSigned bool      `json:"self_signed"`
+	NotBefore  time.Time `json:"not_before"`
+	Expires    time.Time `json:"expires"`
+
+	// Where the certificate was found
+	Endpoints []Endpoint `json:"endpoints"`
+	Files     []string   `json:"files"`
+
+	// The IDs of the users owning the domains the certificate is presented for and covers
+	Owners []string `json:"owners"`
+
+	Checked time.Time `json:"checked"`
+
+	// When the expiry of the certificate was last alerted about
+	Alerted time.Time `json:"alerted,omitempty"`
+}
+
+// Endpoint is a name and port the server presents a certificate for
+type Endpoint struct {
+	Name    string `json:"name"`
+	Port    int    `json:"port"`
+	Address string `json:"address"`
+
+	// Whether the certificate covers the name, which it does not when the server presents
+	// its default certificate for a name it has none for
+	Matches bool `json:"matches"`
+}
+
+type checker struct {
+	mu      sync.Mutex
+	config  *config.CertificatesConfiguration
+	running bool
+}
+
+var std *checker
+
+// Configure checks the days certificates are alerted about before they expire
+func Configure(c *config.CertificatesConfiguration) error {
+	for _, d := range c.Days {
+		if d <= 0 {
+			return errors.New("certificates: the days before expiry must be more than zero")
+		}
+	}
+
+	for _, p := range c.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("certificates: %d is not a port", p)
+		}
+	}
+
+	for _, pattern := range c.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("certificates: %s: %w", pattern, err)
+		}
+	}
+
+	std = &checker{config: c}
+
+	return nil
+}
+
+// Scheduled runs the certificates task
+func Scheduled() error {
+	_, err := Scan()
+	return err
+}
+
+// Scan reads every certificate the server presents on the configured ports and keeps in
+// the configured files, and alerts about those that expire within the next of the
+// configured days or have expired since they were last alerted about
+func Scan() ([]Certificate, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	if std.running {
+		std.mu.Unlock()
+		return nil, ErrScanning
+	}
+	std.running = true
+	std.mu.Unlock()
+
+	defer func() {
+		std.mu.Lock()
+		std.running = false
+		std.mu.Unlock()
+	}()
+
+	domains, err := registrar.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	found := make(map[string]*Certificate)
+
+	add := func(cert *x509.Certificate) *Certificate {
+		sum := sha256.Sum256(cert.Raw)
+		fp := hex.EncodeToString(sum[:])
+
+		if c, ok := found[fp]; ok {
+			return c
+		}
+
+		c := &Certificate{
+			Fingerprint: fp,
+			Subject:     cert.Subject.CommonName,
+			Names:       cert.DNSNames,
+			Issuer:      issuer(cert),
+			SelfSigned:  selfSigned(cert),
+			NotBefore:   cert.NotBefore.UTC(),
+			Expires:     cert.NotAfter.UTC(),
+			Endpoints:   []Endpoint{},
+			Files:       []string{},
+			Owners:      []string{},
+			Checked:     now,
+		}
+		if c.Names == nil {
+			c.Names = []string{}
+		}
+		if c.Subject == "" && len(c.Names) > 0 {
+			c.Subject = c.Names[0]
+		}
+		found[fp] = c
+
+		return c
+	}
+
+	owners := make(map[string]string, len(domains))
+	for _, d := range domains {
+		owners[strings.ToLower(d.Name)] = d.Owner
+	}
+
+	for _, p := range std.presented(domains) {
+		c := add(p.cert)
+		c.Endpoints = append(c.Endpoints, p.Endpoint)
+
+		if owner := owners[p.Name]; owner != "" && p.Matches && !slices.Contains(c.Owners, owner) {
+			c.Owners = append(c.Owners, owner)
+		}
+	}
+
+	for path, cert := range readFiles(std.config.Files) {
+		c := add(cert)
+		c.Files = append(c.Files, path)
+	}
+
+	var alerts []Certificate
+	err = store.Update(func(tx *store.Tx) error {
+		var before map[string]Certificate
+		if err := tx.Load(certificateKind, &before); err != nil {
+			return err
+		}
+
+		after := make(map[string]Certificate, len(found))
+		for fp, c := range found {
+			slices.Sort(c.Files)
+
+			c.Alerted = before[fp].Alerted
+			if std.stage(*c, now) > std.stage(*c, c.Alerted) {
+				c.Alerted = now
+				alerts = append(alerts, *c)
+			}
+			after[fp] = *c
+		}
+
+		// Certificates no longer found, such as those that were renewed, are forgotten
+		return tx.Save(certificateKind, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range alerts {
+		std.alert(c, now)
+	}
+
+	zap.S().Named("certificates").Infow("scanned certificates", "certificates", len(found), "alerts", len(alerts))
+
+	list := make([]Certificate, 0, len(found))
+	for _, c := range found {
+		list = append(list, *c)
+	}
+	sortByExpiry(list)
+
+	return list, nil
+}
+
+// stage returns how many of the configured days before the certificate expires have
+// been reached at the time, plus one once it has expired
+func (c *checker) stage(cert Certificate, at time.Time) int {
+	if at.IsZero() {
+		return 0
+	}
+
+	n := 0
+	for _, d := range c.config.Days {
+		if !at.Before(cert.Expires.AddDate(0, 0, -d)) {
+			n++
+		}
+	}
+	if !at.Before(cert.Expires) {
+		n++
+	}
+
+	return n
+}
+
+// List returns the certificates found by the last scan that are presented for domains
+// of the owners, or every certificate when no owners are given, soonest to expire first
+func List(owners ...string) ([]Certificate, error) {
+	var found map[string]Certificate
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Load(certificateKind, &found)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Certificate{}
+	for _, c := range found {
+		if len(owners) == 0 || slices.ContainsFunc(c.Owners, func(id string) bool { return slices.Contains(owners, id) }) {
+			list = append(list, c)
+		}
+	}
+	sortByExpiry(list)
+
+	return list, nil
+}
+
+// Day is the certificates expiring on one day
+type Day struct {
+	Date         string        `json:"date"`
+	Certificates []Certificate `json:"certificates"`
+}
+
+// Calendar returns the certificates of List that have expired or expire within the
+// days, or ever when days is zero, grouped by the day they expire on
+func Calendar(days int, owners ...string) ([]Day, error) {
+	list, err := List(owners...)
+	if err != nil {
+		return nil, err
+	}
+
+	until := time.Now().UTC().AddDate(0, 0, days)
+
+	calendar := []Day{}
+	for _, c := range list {
+		if days > 0 && c.Expires.After(until) {
+			break
+		}
+
+		date := c.Expires.Format("2006-01-02")
+		if n := len(calendar); n > 0 && calendar[n-1].Date == date {
+			calendar[n-1].Certificates = append(calendar[n-1].Certificates, c)
+		} else {
+			calendar = append(calendar, Day{Date: date, Certificates: []Certificate{c}})
+		}
+	}
+
+	return calendar, nil
+}
+
+// daysLeft returns the whole days until the certificate expires at the time, negative
+// once it has
+func (c Certificate) daysLeft(at time.Time) int {
+	return int(math.Floor(c.Expires.Sub(at).Hours() / 24))
+}
+
+// sortByExpiry sorts the certificates soonest to expire first
+func sortByExpiry(list []Certificate) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Expires.Equal(list[j].Expires) {
+			return list[i].Expires.Before(list[j].Expires)
+		}
+		return list[i].Fingerprint < list[j].Fingerprint
+	})
+}
+
+// issuer returns the name of the issuer of the certificate, its organization when the
+// common name is missing
+func issuer(cert *x509.Certificate) string {
+	if cert.Issuer.CommonName != "" {
+		return cert.Issuer.CommonName
+	}
+	if len(cert.Issuer.Organization) > 0 {
+		return cert.Issuer.Organization[0]
+	}
+
+	return cert.Issuer.String()
+}
+
+// selfSigned returns true if the certificate is signed by its own key rather than by an
+// authority, whether or not it says it may sign others
+func selfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// hostname returns the name of the server, which clients not asking for a domain get the
+// default certificate of
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || !strings.Contains(name, ".") {
+		return ""
+	}
+
+	return strings.ToLower(name)
+}
+
+// admins returns the administrators, who are alerted about every certificate
+func admins() []auth.User {
+	var list []auth.User
+	for _, u := range auth.Users() {
+		if u.Role == auth.RoleAdmin {
+			list = append(list, u)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,64 @@
+package certificates
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// icalEscaper escapes text values in iCalendar
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// ExportICS writes the calendar as iCalendar, with an all-day event on the day each
+// certificate expires, so that it can be subscribed to from a calendar application
+func ExportICS(w io.Writer, calendar []Day) error {
+	bw := bufio.NewWriter(w)
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	line := func(format string, args ...interface{}) {
+		s := fmt.Sprintf(format, args...)
+
+		// Lines longer than 75 octets are folded onto lines starting with a space
+		for len(s) > 75 {
+			cut := 75
+			for cut > 1 && s[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			bw.WriteString(s[:cut] + "\r\n")
+			s = " " + s[cut:]
+		}
+		bw.WriteString(s + "\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//CosmicPanel//Certificates//EN")
+	line("X-WR-CALNAME:Certificate expiry")
+
+	for _, d := range calendar {
+		for _, c := range d.Certificates {
+			var where []string
+			for _, e := range c.Endpoints {
+				where = append(where, fmt.Sprintf("%s port %d", e.Name, e.Port))
+			}
+			where = append(where, c.Files...)
+
+			description := fmt.Sprintf("Issued by %s\nCovers %s\nUsed by %s", c.Issuer, strings.Join(c.Names, ", "), strings.Join(where, ", "))
+
+			line("BEGIN:VEVENT")
+			line("UID:%s@certificates.cosmicpanel", c.Fingerprint)
+			line("DTSTAMP:%s", stamp)
+			line("DTSTART;VALUE=DATE:%s", c.Expires.Format("20060102"))
+			line("DTEND;VALUE=DATE:%s", c.Expires.AddDate(0, 0, 1).Format("20060102"))
+			line("SUMMARY:%s", icalEscaper.Replace("Certificate for "+c.Subject+" expires"))
+			line("DESCRIPTION:%s", icalEscaper.Replace(description))
+			line("END:VEVENT")
+		}
+	}
+
+	line("END:VCALENDAR")
+
+	return bw.Flush()
+}
@@ -0,0 +1,83 @@
+package certificates
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"go.uber.org/zap"
+)
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "certificate_expiry",
+		Description: "Sent to the administrators, and the owners of the domains it is presented for, when a certificate is about to expire or has expired",
+		Fields:      []string{"Subject", "Names", "Issuer", "Expires", "Days", "Expired", "Where"},
+		Template: notify.Template{
+			Subject: "{{if .Expired}}The certificate for {{.Subject}} has expired{{else}}The certificate for {{.Subject}} expires in {{.Days}} days{{end}}",
+			SMS:     "{{.Product}}: the certificate for {{.Subject}} {{if .Expired}}expired on{{else}}expires on{{end}} {{.Expires}}.",
+			Body: "The certificate for {{.Subject}} issued by {{.Issuer}} {{if .Expired}}expired on {{.Expires}}. Visitors and mail clients now get security warnings or cannot connect at all.{{else}}expires on {{.Expires}}, in {{.Days}} days.{{end}}\n\n" +
+				"It covers: {{.Names}}\n\nIt is used by:\n\n" +
+				"{{range .Where}}  {{.}}\n{{end}}\n" +
+				"The panel did not necessarily issue the certificate. Renew it wherever it came from, such as the certificate authority it was bought from or the service that renews it automatically, and install the renewed certificate.\n",
+		},
+	})
+}
+
+// alert publishes the expiry of the certificate and notifies the administrators, and the
+// owners of the domains it is presented for if the configuration says so
+func (c *checker) alert(cert Certificate, now time.Time) {
+	days := cert.daysLeft(now)
+
+	typ := "certificates.expiring"
+	if days < 0 {
+		typ = "certificates.expired"
+	}
+
+	events.Publish(events.Event{
+		Type:     typ,
+		Resource: cert.Fingerprint,
+		Data: map[string]interface{}{
+			"subject": cert.Subject,
+			"names":   cert.Names,
+			"issuer":  cert.Issuer,
+			"expires": cert.Expires,
+			"days":    days,
+		},
+	})
+
+	where := []string{}
+	for _, e := range cert.Endpoints {
+		where = append(where, net.JoinHostPort(e.Name, strconv.Itoa(e.Port)))
+	}
+	where = append(where, cert.Files...)
+
+	data := map[string]interface{}{
+		"Subject": cert.Subject,
+		"Names":   strings.Join(cert.Names, ", "),
+		"Issuer":  cert.Issuer,
+		"Expires": cert.Expires.Format("2006-01-02 15:04 MST"),
+		"Days":    days,
+		"Expired": days < 0,
+		"Where":   where,
+	}
+
+	recipients := admins()
+	if c.config.Owners {
+		for _, id := range cert.Owners {
+			if u, err := auth.GetUser(id); err == nil && u.Role != auth.RoleAdmin {
+				recipients = append(recipients, u)
+			}
+		}
+	}
+
+	for _, u := range recipients {
+		if err := auth.Notify(u, "certificate_expiry", data); err != nil {
+			zap.S().Named("certificates").Warnw("failed to notify of an expiring certificate", "user", u.Username, "subject", cert.Subject, zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package certificates
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// timeout bounds connecting to a port and the handshake on it
+const timeout = 5 * time.Second
+
+// concurrency is how many handshakes are made at once
+const concurrency = 8
+
+// presentation is a certificate the server presented for a name on a port
+type presentation struct {
+	Endpoint
+	cert *x509.Certificate
+}
+
+// presented connects to the configured ports with the name of every domain, on its
+// dedicated address if it has one, and with the name of the server, returning the
+// certificates presented
+func (c *checker) presented(domains []registrar.Domain) []presentation {
+	type target struct {
+		name    string
+		address string
+	}
+
+	dedicated := make(map[string]string)
+	for _, d := range addresses.Pool() {
+		if d.Domain != "" {
+			dedicated[strings.ToLower(d.Domain)] = d.Address.String()
+		}
+	}
+
+	var targets []target
+	for _, d := range domains {
+		name := strings.ToLower(d.Name)
+		address, ok := dedicated[name]
+		if !ok {
+			address = "127.0.0.1"
+		}
+		targets = append(targets, target{name, address})
+	}
+	if name := hostname(); name != "" && !slices.ContainsFunc(targets, func(t target) bool { return t.name == name }) {
+		targets = append(targets, target{name, "127.0.0.1"})
+	}
+
+	// Ports nothing listens on are only tried once for every address
+	listening := make(map[string]bool)
+	for _, t := range targets {
+		for _, port := range c.config.Ports {
+			addr := net.JoinHostPort(t.address, strconv.Itoa(port))
+			if _, tried := listening[addr]; tried {
+				continue
+			}
+
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if listening[addr] = err == nil; err == nil {
+				conn.Close()
+			}
+		}
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		list []presentation
+	)
+
+	sem := make(chan struct{}, concurrency)
+	for _, t := range targets {
+		for _, port := range c.config.Ports {
+			addr := net.JoinHostPort(t.address, strconv.Itoa(port))
+			if !listening[addr] {
+				continue
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				cert, err := handshake(addr, t.name)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				list = append(list, presentation{
+					Endpoint: Endpoint{Name: t.name, Port: port, Address: t.address, Matches: cert.VerifyHostname(t.name) == nil},
+					cert:     cert,
+				})
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Port < list[j].Port
+	})
+
+	return list
+}
+
+// handshake connects to the address asking for the name and returns the certificate it
+// presents. The certificate is not verified, since those that would fail are the ones
+// worth knowing about
+func handshake(addr string, name string) (*x509.Certificate, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+
+	return certs[0], nil
+}
+
+// readFiles returns the first certificate in every file matching the patterns, by path.
+// Files that are not certificates are skipped
+func readFiles(patterns []string) map[string]*x509.Certificate {
+	found := make(map[string]*x509.Certificate)
+
+	for _, p := range patterns {
+		// The patterns were checked by Configure
+		matches, _ := filepath.Glob(p)
+
+		for _, path := range matches {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+
+			for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type != "CERTIFICATE" {
+					continue
+				}
+
+				if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+					found[path] = cert
+				}
+				break
+			}
+		}
+	}
+
+	return found
+}
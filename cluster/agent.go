@@ -0,0 +1,371 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"go.uber.org/zap"
+)
+
+// agentState is the identity of an agent and its connection to the controller
+type agentState struct {
+	dir     string
+	dataDir string
+	config  *config.ClusterConfiguration
+
+	// The ID the controller issued the agent, empty until it has joined
+	id     string
+	client *http.Client
+
+	// The controller or standby the agent is talking to, and the number of times in a
+	// row it could not be reached
+	mu       sync.Mutex
+	current  string
+	failures int
+}
+
+// failoverAttempts is the number of times in a row an agent fails to reach the
+// controller before it tries the standby
+const failoverAttempts = 3
+
+// agentIdentity is what an agent keeps about itself besides its certificate
+type agentIdentity struct {
+	ID         string `json:"id"`
+	Controller string `json:"controller"`
+}
+
+// newAgent loads the certificate the agent was issued when it joined the controller
+func newAgent(dataDir string, c *config.ClusterConfiguration) (*agentState, error) {
+	a := &agentState{
+		dir:     filepath.Join(dataDir, "cluster"),
+		dataDir: dataDir,
+		config:  c,
+	}
+
+	if err := os.MkdirAll(a.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(a.dir, "node.json"))
+	if os.IsNotExist(err) {
+		if c.JoinToken == "" {
+			return nil, errors.New("cluster: agents must set a join token until they have joined the controller")
+		}
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var id agentIdentity
+	if err := json.Unmarshal(b, &id); err != nil {
+		return nil, fmt.Errorf("cluster: failed to read node identity: %w", err)
+	}
+
+	if err := a.load(id.ID); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// load sets up the client authenticating the agent to the controller with its
+// certificate
+func (a *agentState) load(id string) error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(a.dir, "node.pem"), filepath.Join(a.dir, "node.key"))
+	if err != nil {
+		return fmt.Errorf("cluster: failed to load node certificate: %w", err)
+	}
+
+	ca, err := readCertificate(filepath.Join(a.dir, "ca.pem"))
+	if err != nil {
+		return err
+	}
+
+	a.id = id
+	a.client = newClient(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+
+		// The controller certificate is checked against the cluster authority instead of
+		// the address it is reached on, since agents may use an IP or any name
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyController(ca, ""),
+	})
+
+	return nil
+}
+
+// newClient returns a client for the controller, allowing for the time commands are
+// waited for
+func newClient(tc *tls.Config) *http.Client {
+	tc.MinVersion = tls.VersionTLS12
+
+	return &http.Client{
+		Timeout:   pollTimeout + 30*time.Second,
+		Transport: &http.Transport{TLSClientConfig: tc},
+	}
+}
+
+// start joins the controller if the agent has not yet, then reports the status of the
+// agent and carries out the commands sent to it in the background
+func (a *agentState) start() {
+	crash.Go("cluster", func() {
+		for a.id == "" {
+			if err := a.join(); err != nil {
+				zap.S().Named("cluster").Errorw("failed to join the cluster, retrying in a minute", "controller", a.config.Controller, zap.Error(err))
+				time.Sleep(time.Minute)
+			}
+		}
+
+		crash.Go("cluster", a.report)
+		a.poll()
+	})
+}
+
+// join requests a certificate from the controller with the join token
+func (a *agentState) join() error {
+	_, pin, ok := strings.Cut(a.config.JoinToken, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	key, csr, err := newRequest(nodeName(a.config))
+	if err != nil {
+		return err
+	}
+
+	// Until the agent has joined it only trusts a controller whose authority matches the
+	// fingerprint in the token
+	client := newClient(&tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyController(nil, pin),
+	})
+
+	var resp joinResponse
+	err = request(client, a.config.Controller, http.MethodPost, "/cluster/v1/join", joinRequest{
+		Token:   a.config.JoinToken,
+		Name:    nodeName(a.config),
+		Request: string(csr),
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKey(filepath.Join(a.dir, "node.key"), key); err != nil {
+		return err
+	}
+
+	for name, data := range map[string]string{"node.pem": resp.Certificate, "ca.pem": resp.CA} {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			return errors.New("cluster: the controller sent an invalid certificate")
+		}
+
+		if err := writePEM(filepath.Join(a.dir, name), block.Type, block.Bytes); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(agentIdentity{ID: resp.ID, Controller: a.config.Controller}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(a.dir, "node.json"), b, 0600); err != nil {
+		return err
+	}
+
+	if err := a.load(resp.ID); err != nil {
+		return err
+	}
+
+	zap.S().Named("cluster").Infow("joined the cluster", "controller", a.config.Controller, "node", resp.ID)
+
+	return nil
+}
+
+// report sends the status of the agent to the controller on the configured interval
+func (a *agentState) report() {
+	for ; ; time.Sleep(time.Duration(a.config.Interval) * time.Second) {
+		if err := request(a.client, a.address(), http.MethodPost, "/cluster/v1/status", collect(a.dataDir), nil); err != nil {
+			zap.S().Named("cluster").Warnw("failed to report status to the controller", zap.Error(err))
+		}
+	}
+}
+
+// poll waits for commands from the controller and carries them out
+func (a *agentState) poll() {
+	for {
+		var list []Command
+		if err := request(a.client, a.address(), http.MethodGet, "/cluster/v1/commands", nil, &list); err != nil {
+			zap.S().Named("cluster").Warnw("failed to fetch commands from the controller, retrying in 30s", zap.Error(err))
+			a.unreachable()
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		a.reachable()
+
+		for _, cmd := range list {
+			go a.run(cmd)
+		}
+	}
+}
+
+// run carries out the command and sends the outcome back to the controller
+func (a *agentState) run(cmd Command) {
+	log := zap.S().Named("cluster")
+	log.Infow("running command from the controller", "command", cmd.ID, "type", cmd.Type, "actor", cmd.Actor)
+
+	var res commandResult
+
+	result, err := call(cmd)
+	if err == nil && result != nil {
+		res.Result, err = json.Marshal(result)
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		log.Errorw("command failed", "command", cmd.ID, "type", cmd.Type, zap.Error(err))
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := request(a.client, a.address(), http.MethodPost, "/cluster/v1/commands/"+cmd.ID+"/result", res, nil)
+		if err == nil {
+			return
+		}
+
+		if attempt == 4 {
+			log.Errorw("failed to send command result to the controller", "command", cmd.ID, zap.Error(err))
+			return
+		}
+
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Second)
+	}
+}
+
+// address returns the address of the controller the agent is talking to
+func (a *agentState) address() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.current == "" {
+		return a.config.Controller
+	}
+
+	return a.current
+}
+
+// unreachable records that the controller could not be reached. After a few failures
+// in a row the agent switches between the controller and its standby, which accepts the
+// agent once it has taken over since it holds a copy of the cluster
+func (a *agentState) unreachable() {
+	if a.config.Standby == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.failures++; a.failures < failoverAttempts {
+		return
+	}
+
+	a.failures = 0
+	if a.current == a.config.Standby {
+		a.current = a.config.Controller
+	} else {
+		a.current = a.config.Standby
+	}
+
+	zap.S().Named("cluster").Warnw("switching controller", "controller", a.current)
+}
+
+// reachable records that the controller was reached
+func (a *agentState) reachable() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures = 0
+}
+
+// call runs the handler for the command, turning a panic into an error
+func call(cmd Command) (result interface{}, err error) {
+	h, ok := handler(cmd.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownCommand, cmd.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			rep := crash.Capture("cluster", r, map[string]string{"command": cmd.Type})
+			err = fmt.Errorf("command panicked, see crash report %s: %v", rep.ID, r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	return h(ctx, cmd.Payload)
+}
+
+// request calls the controller, decoding the response into out if it is not nil
+func request(client *http.Client, controller string, method string, path string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, "https://"+controller+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+
+		return fmt.Errorf("cluster: the controller returned %s: %s", resp.Status, e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Identity returns the ID this agent was issued by the controller, empty if it has not
+// joined yet or is not an agent
+func Identity() string {
+	if agent == nil {
+		return ""
+	}
+
+	return agent.id
+}
@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// controllerName is the common name of the certificate the controller serves, which
+// agents check so that a node certificate cannot be used to pose as the controller
+const controllerName = "cosmicpanel-controller"
+
+// authority is the certificate authority of the cluster, kept by the controller. It
+// signs the certificate the controller serves and the client certificates of agents
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// loadAuthority reads the certificate authority from the directory, creating it the
+// first time the controller starts
+func loadAuthority(dir string) (*authority, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber:          serial(),
+			Subject:               pkix.Name{CommonName: "CosmicPanel cluster CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(20, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeKey(keyPath, key); err != nil {
+			return nil, err
+		}
+
+		if err := writePEM(certPath, "CERTIFICATE", der); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := readKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authority{cert: cert, key: key}, nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate authority, which join
+// tokens carry so that agents can trust the controller before they have its certificate
+func (a *authority) fingerprint() string {
+	return fingerprint(a.cert)
+}
+
+// serverCertificate issues the certificate the controller serves agents with
+func (a *authority) serverCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: controllerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{controllerName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// The authority is sent along with the certificate so that joining agents can check
+	// it against the fingerprint in their token
+	return tls.Certificate{Certificate: [][]byte{der, a.cert.Raw}, PrivateKey: key}, nil
+}
+
+// sign issues a client certificate for the node from its certificate request, returning
+// the certificate and its serial number
+func (a *authority) sign(csrPEM []byte, node string) ([]byte, string, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, "", errors.New("cluster: invalid certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, "", fmt.Errorf("cluster: invalid certificate request: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: node},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, csr.PublicKey, a.key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), tmpl.SerialNumber.Text(16), nil
+}
+
+// verifyController returns a function checking that the controller serves a certificate
+// for the controller issued by the authority. A nil authority is taken from the chain the
+// controller sends and must match the fingerprint, which is how agents join
+func verifyController(ca *x509.Certificate, pin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("cluster: the controller sent no certificate")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(raw))
+		for _, b := range raw {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		root := ca
+		if root == nil {
+			for _, cert := range certs[1:] {
+				if fingerprint(cert) == pin {
+					root = cert
+				}
+			}
+
+			if root == nil {
+				return errors.New("cluster: the controller certificate does not match the join token")
+			}
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:   controllerName,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+
+		return err
+	}
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// pemCertificate returns the certificate PEM encoded
+func pemCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// serial returns a random certificate serial number
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+
+	return n
+}
+
+// newRequest generates a key and a certificate request for it
+func newRequest(node string) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: node}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// readCertificate reads a PEM encoded certificate
+func readCertificate(path string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("cluster: %s is not a certificate", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// readKey reads a PEM encoded EC private key
+func readKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("cluster: %s is not a private key", path)
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// writeKey writes the private key PEM encoded
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return writePEM(path, "EC PRIVATE KEY", der)
+}
+
+// writePEM writes the block to the file, readable only by the panel
+func writePEM(path string, typ string, der []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
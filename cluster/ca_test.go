@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+
+	ca, err := loadAuthority(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+// issue signs a certificate for the node and returns it parsed
+func issue(t *testing.T, ca *authority, node string) *x509.Certificate {
+	t.Helper()
+
+	_, csr, err := newRequest(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, serial, err := ca.sign(csr, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Text(16) != serial {
+		t.Fatalf("serial %s, certificate has %s", serial, cert.SerialNumber.Text(16))
+	}
+
+	return cert
+}
+
+func TestLoadAuthority(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := loadAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := loadAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.fingerprint() != again.fingerprint() {
+		t.Error("the authority changed when loaded again")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the key is readable with mode %v", info.Mode().Perm())
+	}
+}
+
+func TestSign(t *testing.T) {
+	ca := newAuthority(t)
+
+	// The certificate names the node the controller chose, not the one requested
+	_, csr, err := newRequest("cosmicpanel-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := ca.sign(csr, "a1b2c3d4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Subject.CommonName != "a1b2c3d4" || len(cert.DNSNames) != 0 {
+		t.Errorf("issued for %q and %q", cert.Subject.CommonName, cert.DNSNames)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("extended key usage %v, want client authentication only", cert.ExtKeyUsage)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("the certificate does not chain to the authority: %v", err)
+	}
+
+	der, _ := pem.Decode(csr)
+	tampered := append([]byte{}, der.Bytes...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	for name, request := range map[string][]byte{
+		"not PEM":           []byte("hello"),
+		"empty":             nil,
+		"a certificate":     pemCertificate(ca.cert),
+		"bad signature":     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: tampered}),
+		"malformed request": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte("junk")}),
+	} {
+		if _, _, err := ca.sign(request, "a1b2c3d4"); err == nil {
+			t.Errorf("%s: a certificate was issued", name)
+		}
+	}
+}
+
+func TestVerifyController(t *testing.T) {
+	ca := newAuthority(t)
+	other := newAuthority(t)
+
+	server, err := ca.serverCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := other.serverCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A node presenting its client certificate along with the authority
+	node := [][]byte{issue(t, ca, "a1b2c3d4").Raw, ca.cert.Raw}
+
+	tests := []struct {
+		name  string
+		ca    *x509.Certificate
+		pin   string
+		chain [][]byte
+		ok    bool
+	}{
+		{"pinned authority", nil, ca.fingerprint(), server.Certificate, true},
+		{"trusted authority", ca.cert, "", server.Certificate, true},
+
+		{"other authority", nil, ca.fingerprint(), impostor.Certificate, false},
+		{"other authority with its own pin", ca.cert, other.fingerprint(), impostor.Certificate, false},
+		{"controller of another cluster", other.cert, "", server.Certificate, false},
+		{"wrong pin", nil, other.fingerprint(), server.Certificate, false},
+		{"no pin", nil, "", server.Certificate, false},
+		{"leaf pinned", nil, fingerprint(mustParse(t, server.Certificate[0])), server.Certificate, false},
+		{"node certificate", nil, ca.fingerprint(), node, false},
+		{"node certificate with a trusted authority", ca.cert, "", node, false},
+		{"authority alone", nil, ca.fingerprint(), [][]byte{ca.cert.Raw, ca.cert.Raw}, false},
+		{"no chain", nil, ca.fingerprint(), server.Certificate[:1], false},
+		{"no certificate", ca.cert, "", nil, false},
+		{"garbage", ca.cert, "", [][]byte{[]byte("junk")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyController(tt.ca, tt.pin)(tt.chain, nil)
+			if (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
@@ -0,0 +1,261 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+)
+
+// Roles a server can have in a cluster
+const (
+	Standalone = "standalone"
+	Controller = "controller"
+	Standby    = "standby"
+	Agent      = "agent"
+)
+
+// States of a command
+const (
+	Queued    = "queued"
+	Sent      = "sent"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+var (
+	// ErrNotController is returned when managing nodes on a server that is not the
+	// controller of a cluster
+	ErrNotController = errors.New("cluster: this server is not a cluster controller")
+
+	// ErrNodeNotFound is returned when a node has not joined the cluster
+	ErrNodeNotFound = errors.New("cluster: node not found")
+
+	// ErrCommandNotFound is returned when a command does not exist
+	ErrCommandNotFound = errors.New("cluster: command not found")
+
+	// ErrInvalidToken is returned when an agent joins with a token that is unknown or has
+	// expired
+	ErrInvalidToken = errors.New("cluster: invalid or expired join token")
+
+	// ErrUnknownCommand is returned by agents for commands no handler is registered for
+	ErrUnknownCommand = errors.New("cluster: unknown command")
+
+	// ErrNotStandby is returned when promoting a server that is not a standby controller
+	ErrNotStandby = errors.New("cluster: this server is not a standby controller")
+)
+
+// Handler carries out a command on an agent, returning a result that is sent back to
+// the controller
+type Handler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+var (
+	hmu      sync.RWMutex
+	handlers = make(map[string]Handler)
+)
+
+// Register sets the handler that carries out commands of the type on agents. Packages
+// managing accounts, web servers and DNS register the commands they provision with
+func Register(typ string, h Handler) {
+	hmu.Lock()
+	defer hmu.Unlock()
+
+	handlers[typ] = h
+}
+
+// handler returns the handler for the type
+func handler(typ string) (Handler, bool) {
+	hmu.RLock()
+	defer hmu.RUnlock()
+
+	h, ok := handlers[typ]
+
+	return h, ok
+}
+
+// Node is a server that has joined the cluster
+type Node struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+	Joined  time.Time `json:"joined"`
+
+	// When the node last contacted the controller, and whether that was recently enough
+	// for the node to be considered online
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	Online   bool      `json:"online"`
+
+	// The serial number of the certificate issued to the node. Other certificates for the
+	// node are refused, such as one issued before it was removed and joined again
+	Serial string `json:"serial"`
+
+	// The last status report of the node
+	Status *Status `json:"status,omitempty"`
+
+	// The shared settings of the node that differ from the controller's
+	Drift []string `json:"drift,omitempty"`
+
+	// Labels new accounts can be placed by, such as ssd or eu-west
+	Tags []string `json:"tags,omitempty"`
+
+	// The number of accounts the node can hold, unlimited when zero, and whether it is
+	// being emptied so that no new accounts are placed on it
+	MaxAccounts int  `json:"max_accounts,omitempty"`
+	Draining    bool `json:"draining,omitempty"`
+
+	// Whether the node is the standby controller, which is sent a copy of the cluster and
+	// never has accounts placed on it
+	Standby bool `json:"standby,omitempty"`
+}
+
+// Status is what an agent reports about itself
+type Status struct {
+	Hostname string    `json:"hostname"`
+	Version  string    `json:"version"`
+	Uptime   string    `json:"uptime"`
+	Time     time.Time `json:"time"`
+
+	// The load averages over 1, 5 and 15 minutes, and the number of CPUs they are shared by
+	Load [3]float64 `json:"load"`
+	CPUs int        `json:"cpus"`
+
+	// Bytes of memory and of disk in the data directory
+	MemoryTotal     uint64 `json:"memory_total"`
+	MemoryAvailable uint64 `json:"memory_available"`
+	DiskTotal       uint64 `json:"disk_total"`
+	DiskFree        uint64 `json:"disk_free"`
+
+	Users int `json:"users"`
+
+	// The modules of the agent that did not start
+	Degraded []string `json:"degraded,omitempty"`
+
+	// Hashes of the settings the agent shares with the rest of the cluster, by name
+	Shared map[string]string `json:"shared,omitempty"`
+}
+
+// Command is a provisioning command sent from the controller to a node
+type Command struct {
+	ID      string          `json:"id"`
+	Node    string          `json:"node"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	State   string          `json:"state"`
+
+	// The user who sent the command
+	Actor string `json:"actor,omitempty"`
+
+	Created  time.Time `json:"created"`
+	Sent     time.Time `json:"sent,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	// What the handler on the node returned
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+var (
+	role       = Standalone
+	controller *controllerState
+	agent      *agentState
+	standby    *standbyState
+)
+
+// Configure prepares the server for its role in the cluster. Controllers load their
+// certificate authority and the nodes that have joined, agents load the certificate
+// they were issued if they have joined before
+func Configure(dataDir string, c *config.ClusterConfiguration) error {
+	switch c.Role {
+	case "", Standalone:
+		role = Standalone
+		return nil
+	case Controller:
+		ctl, err := newController(dataDir, c)
+		if err != nil {
+			return err
+		}
+		controller = ctl
+	case Agent:
+		if c.Controller == "" {
+			return errors.New("cluster: agents must set the address of the controller")
+		}
+
+		a, err := newAgent(dataDir, c)
+		if err != nil {
+			return err
+		}
+		agent = a
+
+		registerBuiltin()
+	case Standby:
+		if c.Controller == "" {
+			return errors.New("cluster: standbys must set the address of the controller")
+		}
+
+		s, err := newStandby(dataDir, c)
+		if err != nil {
+			return err
+		}
+
+		// A standby that has taken over stays the controller when it restarts
+		if s.hasTakenOver() {
+			if controller, err = newController(dataDir, c); err != nil {
+				return err
+			}
+			role = Controller
+
+			zap.S().Named("cluster").Warnw("this standby has taken over as controller, set its role to controller")
+
+			shareBuiltin()
+			return nil
+		}
+		standby = s
+	default:
+		return fmt.Errorf("cluster: unknown role %q, must be standalone, controller, standby or agent", c.Role)
+	}
+
+	shareBuiltin()
+	role = c.Role
+
+	return nil
+}
+
+// Start listens for agents on a controller, or joins the controller and starts taking
+// commands from it on an agent
+func Start() error {
+	switch {
+	case controller != nil:
+		if err := controller.fence(); err != nil {
+			return err
+		}
+		return controller.listen()
+	case standby != nil:
+		standby.start()
+	case agent != nil:
+		agent.start()
+	}
+
+	return nil
+}
+
+// Role returns the role of this server in the cluster
+func Role() string {
+	return role
+}
+
+// nodeName returns the name of the server in the cluster
+func nodeName(c *config.ClusterConfiguration) string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	hostname, _ := os.Hostname()
+
+	return hostname
+}
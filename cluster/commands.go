@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+)
+
+// createUser is the payload of the user.create command
+type createUser struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Owner    string `json:"owner"`
+	Password string `json:"password"`
+}
+
+// byID is the payload of commands acting on a single resource
+type byID struct {
+	ID string `json:"id"`
+}
+
+// registerBuiltin registers the commands for the parts of the panel every agent has.
+// Commands for hosting accounts, web servers and DNS zones are registered by the
+// modules managing them
+func registerBuiltin() {
+	Register("ping", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		return collect(agent.dataDir), nil
+	})
+
+	Register("user.create", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var p createUser
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, err
+		}
+
+		u, err := auth.CreateUser(auth.User{Username: p.Username, Email: p.Email, Role: p.Role, Owner: p.Owner}, p.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		return u.Public(), nil
+	})
+
+	Register("user.delete", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var p byID
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, err
+		}
+
+		return nil, auth.DeleteUser(p.ID)
+	})
+
+	Register("firewall.rule.add", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var r firewall.Rule
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return nil, err
+		}
+
+		return firewall.Add(r)
+	})
+
+	Register("firewall.rule.remove", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var p byID
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, err
+		}
+
+		return nil, firewall.Remove(p.ID)
+	})
+
+	Register("sync.apply", applySync)
+}
@@ -0,0 +1,618 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+const (
+	// How long an agent waits for commands before polling again
+	pollTimeout = 25 * time.Second
+
+	// How long a command can be out on a node without a result before it fails
+	commandTimeout = time.Hour
+
+	// How long finished commands are kept for
+	commandRetention = 7 * 24 * time.Hour
+)
+
+// controllerState is the nodes that have joined the controller and the commands sent to
+// them
+type controllerState struct {
+	mu     sync.Mutex
+	path   string
+	config *config.ClusterConfiguration
+	ca     *authority
+	state  struct {
+		Nodes    map[string]*Node     `json:"nodes"`
+		Tokens   map[string]time.Time `json:"tokens"`
+		Commands map[string]*Command  `json:"commands"`
+	}
+
+	// Signalled when commands are queued for a node waiting for them
+	wake map[string]chan struct{}
+}
+
+// newController loads the certificate authority and the state of the cluster
+func newController(dataDir string, c *config.ClusterConfiguration) (*controllerState, error) {
+	dir := filepath.Join(dataDir, "cluster")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ca, err := loadAuthority(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: failed to load certificate authority: %w", err)
+	}
+
+	ctl := &controllerState{
+		path:   filepath.Join(dir, "controller.json"),
+		config: c,
+		ca:     ca,
+		wake:   make(map[string]chan struct{}),
+	}
+
+	b, err := os.ReadFile(ctl.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &ctl.state); err != nil {
+			return nil, fmt.Errorf("cluster: failed to read cluster state: %w", err)
+		}
+	}
+
+	if ctl.state.Nodes == nil {
+		ctl.state.Nodes = make(map[string]*Node)
+	}
+	if ctl.state.Tokens == nil {
+		ctl.state.Tokens = make(map[string]time.Time)
+	}
+	if ctl.state.Commands == nil {
+		ctl.state.Commands = make(map[string]*Command)
+	}
+
+	return ctl, nil
+}
+
+// listen serves the agents of the cluster over mutual TLS. Agents without a certificate
+// can only join
+func (ctl *controllerState) listen() error {
+	cert, err := ctl.ca.serverCertificate()
+	if err != nil {
+		return err
+	}
+
+	clients := x509.NewCertPool()
+	clients.AddCert(ctl.ca.cert)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/v1/join", ctl.handleJoin)
+	mux.HandleFunc("GET /cluster/v1/role", ctl.handleRole)
+	mux.HandleFunc("GET /cluster/v1/replica", ctl.authenticated(ctl.handleReplica))
+	mux.HandleFunc("POST /cluster/v1/status", ctl.authenticated(ctl.handleStatus))
+	mux.HandleFunc("GET /cluster/v1/commands", ctl.authenticated(ctl.handleCommands))
+	mux.HandleFunc("POST /cluster/v1/commands/{id}/result", ctl.authenticated(ctl.handleResult))
+	mux.HandleFunc("PUT /cluster/v1/files/{id}", ctl.authenticated(ctl.handleFileUpload))
+	mux.HandleFunc("GET /cluster/v1/files/{id}", ctl.authenticated(ctl.handleFileDownload))
+
+	srv := &http.Server{
+		Addr:    config.ListenAddress(ctl.config.Host, ctl.config.Port),
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    clients,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	crash.Go("cluster", func() {
+		zap.S().Named("cluster").Infow("cluster controller listening", "address", srv.Addr)
+
+		if err := srv.ServeTLS(l, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.S().Named("cluster").Errorw("cluster controller stopped unexpectedly", zap.Error(err))
+		}
+	})
+
+	return nil
+}
+
+// authenticated only passes on requests from agents presenting the certificate most
+// recently issued to a node that is still part of the cluster
+func (ctl *controllerState) authenticated(next func(http.ResponseWriter, *http.Request, *Node)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeError(w, http.StatusUnauthorized, "a node certificate is required")
+			return
+		}
+
+		cert := r.TLS.VerifiedChains[0][0]
+
+		ctl.mu.Lock()
+		n, ok := ctl.state.Nodes[cert.Subject.CommonName]
+		valid := ok && n.Serial == cert.SerialNumber.Text(16)
+		if valid {
+			n.LastSeen = time.Now().UTC()
+			n.Address, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		ctl.mu.Unlock()
+
+		if !valid {
+			writeError(w, http.StatusForbidden, "the node has been removed from the cluster")
+			return
+		}
+
+		next(w, r, n)
+	}
+}
+
+// joinRequest is what an agent sends to join the cluster
+type joinRequest struct {
+	Token   string `json:"token"`
+	Name    string `json:"name"`
+	Request string `json:"request"`
+}
+
+// joinResponse is the certificate issued to an agent that joined the cluster
+type joinResponse struct {
+	ID          string `json:"id"`
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+}
+
+// handleJoin issues a certificate to an agent with a valid join token
+func (ctl *controllerState) handleJoin(w http.ResponseWriter, r *http.Request) {
+	var body joinRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	secret, _, _ := strings.Cut(body.Token, ".")
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	expires, ok := ctl.state.Tokens[hash]
+	if !ok || time.Now().After(expires) {
+		writeError(w, http.StatusForbidden, ErrInvalidToken.Error())
+		return
+	}
+
+	id := ids.Hex(8)
+
+	cert, serial, err := ctl.ca.sign([]byte(body.Request), id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Tokens are single use so that a leaked token cannot be used to join another node
+	delete(ctl.state.Tokens, hash)
+
+	address, _, _ := net.SplitHostPort(r.RemoteAddr)
+	now := time.Now().UTC()
+
+	ctl.state.Nodes[id] = &Node{
+		ID:       id,
+		Name:     body.Name,
+		Address:  address,
+		Joined:   now,
+		LastSeen: now,
+		Serial:   serial,
+	}
+
+	if err := ctl.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	zap.S().Named("cluster").Infow("node joined the cluster", "node", id, "name", body.Name, "address", address)
+
+	events.Publish(events.Event{
+		Type:     "cluster.node.join",
+		Resource: id,
+		Data:     map[string]interface{}{"name": body.Name, "address": address},
+	})
+
+	writeJSON(w, http.StatusOK, joinResponse{
+		ID:          id,
+		Certificate: string(cert),
+		CA:          string(pemCertificate(ctl.ca.cert)),
+	})
+}
+
+// handleStatus records the status an agent reports
+func (ctl *controllerState) handleStatus(w http.ResponseWriter, r *http.Request, n *Node) {
+	var s Status
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&s); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	ctl.mu.Lock()
+	n.Status = &s
+	err := ctl.save()
+	ctl.mu.Unlock()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctl.detectDrift(n, &s)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCommands sends the commands queued for the node, waiting for some to be queued
+// if there are none
+func (ctl *controllerState) handleCommands(w http.ResponseWriter, r *http.Request, n *Node) {
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+
+	for {
+		ctl.mu.Lock()
+		list := ctl.deliver(n.ID)
+		wake, ok := ctl.wake[n.ID]
+		if !ok {
+			wake = make(chan struct{}, 1)
+			ctl.wake[n.ID] = wake
+		}
+		ctl.mu.Unlock()
+
+		if len(list) > 0 {
+			writeJSON(w, http.StatusOK, list)
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-timeout.C:
+			writeJSON(w, http.StatusOK, []Command{})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// deliver marks the commands queued for the node as sent and returns them. The
+// controller must be locked
+func (ctl *controllerState) deliver(node string) []Command {
+	var list []Command
+
+	for _, cmd := range ctl.state.Commands {
+		if cmd.Node == node && cmd.State == Queued {
+			cmd.State = Sent
+			cmd.Sent = time.Now().UTC()
+			list = append(list, *cmd)
+		}
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	if err := ctl.save(); err != nil {
+		zap.S().Named("cluster").Errorw("failed to save cluster state", zap.Error(err))
+	}
+
+	return list
+}
+
+// commandResult is what an agent sends back once it has carried out a command
+type commandResult struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// handleResult records the outcome of a command
+func (ctl *controllerState) handleResult(w http.ResponseWriter, r *http.Request, n *Node) {
+	var body commandResult
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	cmd, ok := ctl.state.Commands[r.PathValue("id")]
+	if !ok || cmd.Node != n.ID {
+		writeError(w, http.StatusNotFound, ErrCommandNotFound.Error())
+		return
+	}
+
+	ctl.finish(cmd, body.Result, body.Error)
+
+	if err := ctl.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish records the outcome of the command. The controller must be locked
+func (ctl *controllerState) finish(cmd *Command, result json.RawMessage, err string) {
+	cmd.Finished = time.Now().UTC()
+	cmd.Result = result
+	cmd.Error = err
+	cmd.State = Succeeded
+
+	if err != "" {
+		cmd.State = Failed
+
+		zap.S().Named("cluster").Errorw("command failed on node", "node", cmd.Node, "command", cmd.ID, "type", cmd.Type, "error", err)
+
+		events.Publish(events.Event{
+			Type:     "cluster.command.failed",
+			Resource: cmd.ID,
+			Data:     map[string]interface{}{"node": cmd.Node, "type": cmd.Type, "error": err},
+		})
+	}
+}
+
+// expire fails commands nodes have not reported a result for in time and removes old
+// finished ones. The controller must be locked
+func (ctl *controllerState) expire() {
+	now := time.Now()
+
+	for id, cmd := range ctl.state.Commands {
+		switch {
+		case cmd.State == Sent && now.Sub(cmd.Sent) > commandTimeout:
+			ctl.finish(cmd, nil, "the node did not report a result")
+		case !cmd.Finished.IsZero() && now.Sub(cmd.Finished) > commandRetention:
+			delete(ctl.state.Commands, id)
+		}
+	}
+
+	for hash, expires := range ctl.state.Tokens {
+		if now.After(expires) {
+			delete(ctl.state.Tokens, hash)
+		}
+	}
+}
+
+// online returns true if the node has been in touch recently enough to be considered
+// online
+func (ctl *controllerState) online(n *Node) bool {
+	return time.Since(n.LastSeen) < 3*time.Duration(ctl.config.Interval)*time.Second+pollTimeout
+}
+
+// save writes the state of the cluster to disk. The controller must be locked
+func (ctl *controllerState) save() error {
+	ctl.expire()
+
+	b, err := json.MarshalIndent(ctl.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ctl.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ctl.path)
+}
+
+// Nodes returns the nodes that have joined the cluster, sorted by name
+func Nodes() ([]Node, error) {
+	if controller == nil {
+		return nil, ErrNotController
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	list := make([]Node, 0, len(controller.state.Nodes))
+	for _, n := range controller.state.Nodes {
+		node := *n
+		node.Online = controller.online(n)
+		list = append(list, node)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// GetNode returns the node with the ID
+func GetNode(id string) (Node, error) {
+	if controller == nil {
+		return Node{}, ErrNotController
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	n, ok := controller.state.Nodes[id]
+	if !ok {
+		return Node{}, ErrNodeNotFound
+	}
+
+	node := *n
+	node.Online = controller.online(n)
+
+	return node, nil
+}
+
+// RemoveNode removes the node from the cluster. Its certificate is no longer accepted,
+// and it has to join with a new token to be part of the cluster again
+func RemoveNode(id string) error {
+	if controller == nil {
+		return ErrNotController
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if _, ok := controller.state.Nodes[id]; !ok {
+		return ErrNodeNotFound
+	}
+
+	delete(controller.state.Nodes, id)
+
+	for cid, cmd := range controller.state.Commands {
+		if cmd.Node == id {
+			delete(controller.state.Commands, cid)
+		}
+	}
+
+	return controller.save()
+}
+
+// CreateToken returns a single use token an agent can join the cluster with until it
+// expires. The token carries the fingerprint of the certificate authority, which the
+// agent uses to trust the controller
+func CreateToken(ttl time.Duration) (string, time.Time, error) {
+	if controller == nil {
+		return "", time.Time{}, ErrNotController
+	}
+
+	secret := ids.Hex(16)
+	sum := sha256.Sum256([]byte(secret))
+	expires := time.Now().Add(ttl).UTC()
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	controller.state.Tokens[hex.EncodeToString(sum[:])] = expires
+
+	if err := controller.save(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return secret + "." + controller.ca.fingerprint(), expires, nil
+}
+
+// Send queues a command for the node, which receives it the next time it polls the
+// controller
+func Send(node string, typ string, payload json.RawMessage, actor string) (Command, error) {
+	if controller == nil {
+		return Command{}, ErrNotController
+	}
+
+	if typ == "" {
+		return Command{}, errors.New("cluster: command type is required")
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if _, ok := controller.state.Nodes[node]; !ok {
+		return Command{}, ErrNodeNotFound
+	}
+
+	cmd := &Command{
+		ID:      ids.Hex(8),
+		Node:    node,
+		Type:    typ,
+		Payload: payload,
+		State:   Queued,
+		Actor:   actor,
+		Created: time.Now().UTC(),
+	}
+
+	controller.state.Commands[cmd.ID] = cmd
+
+	if err := controller.save(); err != nil {
+		return Command{}, err
+	}
+
+	if wake, ok := controller.wake[node]; ok {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return *cmd, nil
+}
+
+// Commands returns the commands sent to the node, newest first
+func Commands(node string) ([]Command, error) {
+	if controller == nil {
+		return nil, ErrNotController
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if _, ok := controller.state.Nodes[node]; !ok {
+		return nil, ErrNodeNotFound
+	}
+
+	list := []Command{}
+	for _, cmd := range controller.state.Commands {
+		if cmd.Node == node {
+			list = append(list, *cmd)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, nil
+}
+
+// GetCommand returns the command with the ID
+func GetCommand(id string) (Command, error) {
+	if controller == nil {
+		return Command{}, ErrNotController
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	cmd, ok := controller.state.Commands[id]
+	if !ok {
+		return Command{}, ErrCommandNotFound
+	}
+
+	return *cmd, nil
+}
+
+// writeJSON writes the value as the JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response in the same shape as the panel API
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
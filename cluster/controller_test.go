@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func newTestController(t *testing.T) *controllerState {
+	t.Helper()
+
+	ctl, err := newController(t.TempDir(), &config.ClusterConfiguration{Interval: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller = ctl
+	t.Cleanup(func() { controller = nil })
+
+	return ctl
+}
+
+// join sends a join request with the token and returns the response
+func join(t *testing.T, ctl *controllerState, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	_, csr, err := newRequest("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(joinRequest{Token: token, Name: "web1", Request: string(csr)})
+	r := httptest.NewRequest(http.MethodPost, "/cluster/v1/join", bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	ctl.handleJoin(w, r)
+
+	return w
+}
+
+func TestHandleJoin(t *testing.T) {
+	ctl := newTestController(t)
+
+	token, _, err := CreateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(token, "."+ctl.ca.fingerprint()) {
+		t.Errorf("token %q does not carry the fingerprint of the authority", token)
+	}
+
+	expired, _, err := CreateToken(-time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"unknown token", "0123456789abcdef0123456789abcdef." + ctl.ca.fingerprint(), http.StatusForbidden},
+		{"expired token", expired, http.StatusForbidden},
+		{"empty token", "", http.StatusForbidden},
+		{"fingerprint as the secret", ctl.ca.fingerprint(), http.StatusForbidden},
+		{"token", token, http.StatusOK},
+		{"token used twice", token, http.StatusForbidden},
+		{"secret used twice without the fingerprint", secret, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		w := join(t, ctl, tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	nodes, err := Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "web1" || nodes[0].Serial == "" {
+		t.Errorf("nodes %+v, want web1 alone", nodes)
+	}
+
+	// An invalid request does not use up the token
+	retry, _, _ := CreateToken(time.Hour)
+	b, _ := json.Marshal(joinRequest{Token: retry, Name: "web2", Request: "junk"})
+	w := httptest.NewRecorder()
+	ctl.handleJoin(w, httptest.NewRequest(http.MethodPost, "/cluster/v1/join", bytes.NewReader(b)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid request: status %d", w.Code)
+	}
+	if w := join(t, ctl, retry); w.Code != http.StatusOK {
+		t.Errorf("the token was used up by an invalid request: %d", w.Code)
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	ctl := newTestController(t)
+
+	current := issue(t, ctl.ca, "n1")
+	previous := issue(t, ctl.ca, "n1")
+	removed := issue(t, ctl.ca, "n2")
+
+	ctl.state.Nodes["n1"] = &Node{ID: "n1", Name: "web1", Serial: current.SerialNumber.Text(16)}
+
+	tests := []struct {
+		name   string
+		tls    *tls.ConnectionState
+		status int
+	}{
+		{"current certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{current, ctl.ca.cert}}}, http.StatusNoContent},
+		{"certificate issued before the node joined again", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{previous, ctl.ca.cert}}}, http.StatusForbidden},
+		{"removed node", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{removed, ctl.ca.cert}}}, http.StatusForbidden},
+		{"unverified certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{current}}, http.StatusUnauthorized},
+		{"no certificate", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"plain HTTP", nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *Node
+			h := ctl.authenticated(func(w http.ResponseWriter, r *http.Request, n *Node) {
+				got = n
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/cluster/v1/commands", nil)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if (got != nil) != (tt.status == http.StatusNoContent) {
+				t.Errorf("handler called with %+v", got)
+			}
+		})
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	ctl := newTestController(t)
+
+	ctl.state.Nodes["n1"] = &Node{ID: "n1"}
+	ctl.state.Nodes["n2"] = &Node{ID: "n2"}
+
+	cmd, err := Send("n1", "account.create", nil, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		node   string
+		id     string
+		status int
+	}{
+		{"another node", "n2", cmd.ID, http.StatusNotFound},
+		{"unknown command", "n1", "missing", http.StatusNotFound},
+		{"the node of the command", "n1", cmd.ID, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/cluster/v1/commands/"+tt.id+"/result", strings.NewReader(`{"error":"disk full"}`))
+		r.SetPathValue("id", tt.id)
+		w := httptest.NewRecorder()
+		ctl.handleResult(w, r, ctl.state.Nodes[tt.node])
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if got, _ := GetCommand(cmd.ID); tt.status != http.StatusNoContent && got.State != Queued {
+			t.Errorf("%s: the command is %s", tt.name, got.State)
+		}
+	}
+
+	if got, _ := GetCommand(cmd.ID); got.State != Failed || got.Error != "disk full" {
+		t.Errorf("the command is %s with %q", got.State, got.Error)
+	}
+}
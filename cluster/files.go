@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// ErrNotAgent is returned when moving files on a server that is not an agent that has
+// joined a cluster
+var ErrNotAgent = errors.New("cluster: this server is not a cluster agent")
+
+// fileID matches the IDs of files held by the controller, which are random so that only
+// the nodes told about a file can fetch it
+var fileID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// filePath returns where the controller keeps the file
+func (ctl *controllerState) filePath(id string) string {
+	return filepath.Join(filepath.Dir(ctl.path), "files", id)
+}
+
+// handleFileUpload stores a file an agent streams to the controller, such as an account
+// archive on its way to another node
+func (ctl *controllerState) handleFileUpload(w http.ResponseWriter, r *http.Request, n *Node) {
+	id := r.PathValue("id")
+	if !fileID.MatchString(id) {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	path := ctl.filePath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	if err != nil {
+		os.Remove(path + ".tmp")
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFileDownload streams a file held by the controller to an agent
+func (ctl *controllerState) handleFileDownload(w http.ResponseWriter, r *http.Request, n *Node) {
+	id := r.PathValue("id")
+	if !fileID.MatchString(id) {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	f, err := os.Open(ctl.filePath(id))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
+
+// NewFile returns the ID of a file nodes can upload to the controller and fetch from it
+func NewFile() (string, error) {
+	if controller == nil {
+		return "", ErrNotController
+	}
+
+	return ids.Hex(16), nil
+}
+
+// RemoveFile removes a file held by the controller
+func RemoveFile(id string) error {
+	if controller == nil {
+		return ErrNotController
+	}
+
+	if !fileID.MatchString(id) {
+		return nil
+	}
+
+	err := os.Remove(controller.filePath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Upload streams the file to the controller under the ID the controller gave it
+func Upload(ctx context.Context, id string, r io.Reader) error {
+	if agent == nil || agent.client == nil {
+		return ErrNotAgent
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "https://"+agent.address()+"/cluster/v1/files/"+id, r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := agent.stream().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("cluster: the controller returned %s for file %s", resp.Status, id)
+	}
+
+	return nil
+}
+
+// Download streams the file with the ID from the controller into w
+func Download(ctx context.Context, id string, w io.Writer) error {
+	if agent == nil || agent.client == nil {
+		return ErrNotAgent
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+agent.address()+"/cluster/v1/files/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := agent.stream().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("cluster: the controller returned %s for file %s", resp.Status, id)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// stream returns a client for the controller without a timeout, since files can take
+// longer to move than a command is waited for
+func (a *agentState) stream() *http.Client {
+	return &http.Client{Transport: a.client.Transport}
+}
+
+// Wait blocks until the node has carried out the command, returning the command with
+// its result
+func Wait(ctx context.Context, id string) (Command, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		cmd, err := GetCommand(id)
+		if err != nil {
+			return Command{}, err
+		}
+
+		if cmd.State == Succeeded || cmd.State == Failed {
+			return cmd, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return cmd, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Placement policies
+const (
+	// LeastLoaded places accounts on the node with the most room to spare
+	LeastLoaded = "least-loaded"
+
+	// Fill places accounts on the fullest node that still has room, so that nodes are
+	// used up one at a time and empty ones can be kept in reserve or turned off
+	Fill = "fill"
+)
+
+// ErrNoCapacity is returned when no node can take a new account
+var ErrNoCapacity = errors.New("cluster: no node has the capacity for the account")
+
+// NodeSettings are the settings of a node kept by the controller
+type NodeSettings struct {
+	Tags        []string `json:"tags"`
+	MaxAccounts int      `json:"max_accounts"`
+	Draining    bool     `json:"draining"`
+	Standby     bool     `json:"standby"`
+}
+
+// PlacementRequest describes an account that needs a node. Packages translate their
+// limits into the disk and memory the account needs and the tags of the nodes that can
+// serve it
+type PlacementRequest struct {
+	// The policy to place by, the configured one when empty
+	Policy string `json:"policy,omitempty"`
+
+	// Tags the node must have, and tags it should have if any node with them has room
+	Tags   []string `json:"tags,omitempty"`
+	Prefer []string `json:"prefer,omitempty"`
+
+	// Bytes of disk and memory the node must have available for the account
+	Disk   uint64 `json:"disk,omitempty"`
+	Memory uint64 `json:"memory,omitempty"`
+}
+
+// Candidate is a node considered for an account, with why it was rejected or how well
+// it scored. Higher scores are better
+type Candidate struct {
+	Node     string  `json:"node"`
+	Name     string  `json:"name"`
+	Score    float64 `json:"score"`
+	Rejected string  `json:"rejected,omitempty"`
+}
+
+// Placement is the node chosen for an account, along with every node that was
+// considered so that the choice can be explained
+type Placement struct {
+	Node       Node        `json:"node"`
+	Policy     string      `json:"policy"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+// UpdateNode changes the placement settings of the node and whether it is the standby
+// controller
+func UpdateNode(id string, s NodeSettings) (Node, error) {
+	if controller == nil {
+		return Node{}, ErrNotController
+	}
+
+	if s.MaxAccounts < 0 {
+		return Node{}, errors.New("cluster: max accounts must not be negative")
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	n, ok := controller.state.Nodes[id]
+	if !ok {
+		return Node{}, ErrNodeNotFound
+	}
+
+	tags := []string{}
+	for _, t := range s.Tags {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" && !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+
+	n.Tags = tags
+	n.MaxAccounts = s.MaxAccounts
+	n.Draining = s.Draining
+	n.Standby = s.Standby
+
+	if err := controller.save(); err != nil {
+		return Node{}, err
+	}
+
+	node := *n
+	node.Online = controller.online(n)
+
+	return node, nil
+}
+
+// Place picks the node a new account should be created on. Only online nodes that are
+// not draining, have the required tags and have room for the account are considered,
+// and of those the ones with the most preferred tags win before the policy decides
+func Place(r PlacementRequest) (Placement, error) {
+	nodes, err := Nodes()
+	if err != nil {
+		return Placement{}, err
+	}
+
+	if r.Policy == "" {
+		r.Policy = controller.config.Placement
+	}
+
+	switch r.Policy {
+	case "", LeastLoaded:
+		r.Policy = LeastLoaded
+	case Fill:
+	default:
+		return Placement{}, fmt.Errorf("cluster: unknown placement policy %q, must be least-loaded or fill", r.Policy)
+	}
+
+	p := Placement{Policy: r.Policy, Candidates: []Candidate{}}
+	best := -1
+
+	for i, n := range nodes {
+		c := Candidate{Node: n.ID, Name: n.Name}
+
+		if c.Rejected = reject(n, r); c.Rejected == "" {
+			c.Score = score(n, r)
+			if best < 0 || c.Score > p.Candidates[best].Score {
+				best = len(p.Candidates)
+				p.Node = nodes[i]
+			}
+		}
+
+		p.Candidates = append(p.Candidates, c)
+	}
+
+	sort.SliceStable(p.Candidates, func(i, j int) bool {
+		ci, cj := p.Candidates[i], p.Candidates[j]
+		if (ci.Rejected == "") != (cj.Rejected == "") {
+			return ci.Rejected == ""
+		}
+		return ci.Score > cj.Score
+	})
+
+	if best < 0 {
+		return p, ErrNoCapacity
+	}
+
+	return p, nil
+}
+
+// reject returns why the node cannot take the account, or nothing if it can
+func reject(n Node, r PlacementRequest) string {
+	switch {
+	case !n.Online:
+		return "offline"
+	case n.Standby:
+		return "standby controller"
+	case n.Draining:
+		return "draining"
+	case n.Status == nil:
+		return "no status reported"
+	}
+
+	for _, t := range r.Tags {
+		if !slices.Contains(n.Tags, strings.ToLower(t)) {
+			return "missing tag " + t
+		}
+	}
+
+	s := n.Status
+	switch {
+	case n.MaxAccounts > 0 && s.Users >= n.MaxAccounts:
+		return fmt.Sprintf("full with %d of %d accounts", s.Users, n.MaxAccounts)
+	case s.DiskFree < r.Disk:
+		return fmt.Sprintf("%d bytes of disk free, %d needed", s.DiskFree, r.Disk)
+	case s.MemoryAvailable < r.Memory:
+		return fmt.Sprintf("%d bytes of memory available, %d needed", s.MemoryAvailable, r.Memory)
+	}
+
+	return ""
+}
+
+// score rates the node for the account. Every preferred tag the node has is worth more
+// than any difference in load, so the policy only decides between equally preferred
+// nodes. The load of a node is the average of how full its accounts, disk and memory
+// are and how busy its CPUs are
+func score(n Node, r PlacementRequest) float64 {
+	s := n.Status
+
+	affinity := 0
+	for _, t := range r.Prefer {
+		if slices.Contains(n.Tags, strings.ToLower(t)) {
+			affinity++
+		}
+	}
+
+	accounts := 0.0
+	if n.MaxAccounts > 0 {
+		accounts = float64(s.Users) / float64(n.MaxAccounts)
+	}
+
+	load := (accounts + used(s.DiskTotal-s.DiskFree, s.DiskTotal) + used(s.MemoryTotal-s.MemoryAvailable, s.MemoryTotal) + math.Min(s.Load[1]/float64(max(s.CPUs, 1)), 1)) / 4
+
+	if r.Policy == Fill {
+		return float64(affinity) + load
+	}
+
+	return float64(affinity) + 1 - load
+}
+
+// used returns the fraction of the total in use
+func used(n uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return math.Min(float64(n)/float64(total), 1)
+}
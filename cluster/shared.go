@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+)
+
+// The owner of the firewall rules administrators add, which make up the firewall policy
+// of the cluster. Rules opened by modules or added by brute force protection belong to
+// the node they are on
+const policyOwner = "admin"
+
+// policyRule is a firewall rule as it is compared across nodes, without the ID and
+// creation time that differ between them
+type policyRule struct {
+	Type     string `json:"type"`
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// key returns a string identifying the rule
+func (r policyRule) key() string {
+	return fmt.Sprintf("%s|%d|%s|%s|%s|%s", r.Type, r.Port, r.Protocol, r.Source, r.Country, r.Comment)
+}
+
+// sharedAdmin is an administrator as it is shared across nodes, with the credentials
+// needed to log in to every node the same way. Administrators from an identity provider
+// keep their subject so that they stay the same user when they log in to an agent
+type sharedAdmin struct {
+	Username     string             `json:"username"`
+	Email        string             `json:"email"`
+	PasswordHash string             `json:"password_hash"`
+	SSOSubject   string             `json:"sso_subject,omitempty"`
+	TOTPEnabled  bool               `json:"totp_enabled"`
+	TOTPSecret   string             `json:"totp_secret,omitempty"`
+	SecurityKeys []auth.SecurityKey `json:"security_keys"`
+}
+
+// shareBuiltin shares the settings of the parts of the panel every node has
+func shareBuiltin() {
+	Share("firewall", Shared{Export: exportPolicy, Apply: applyPolicy})
+	Share("admins", Shared{Export: exportAdmins, Apply: applyAdmins})
+}
+
+// policy returns the permanent firewall rules added by administrators by key
+func policy() map[string]firewall.Rule {
+	list := make(map[string]firewall.Rule)
+	for _, r := range firewall.Rules() {
+		if r.Owner != policyOwner || r.Expires != nil {
+			continue
+		}
+
+		p := policyRule{Type: r.Type, Port: r.Port, Protocol: r.Protocol, Source: r.Source, Country: r.Country, Comment: r.Comment}
+		list[p.key()] = r
+	}
+
+	return list
+}
+
+// exportPolicy returns the firewall policy sorted so that equal policies hash the same
+func exportPolicy() (interface{}, error) {
+	list := []policyRule{}
+	for _, r := range policy() {
+		list = append(list, policyRule{Type: r.Type, Port: r.Port, Protocol: r.Protocol, Source: r.Source, Country: r.Country, Comment: r.Comment})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+
+	return list, nil
+}
+
+// applyPolicy adds the rules of the policy missing here and removes the rules added by
+// administrators that are not part of it
+func applyPolicy(data json.RawMessage) error {
+	var list []policyRule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	current := policy()
+	wanted := make(map[string]bool)
+
+	for _, p := range list {
+		wanted[p.key()] = true
+		if _, ok := current[p.key()]; ok {
+			continue
+		}
+
+		_, err := firewall.Add(firewall.Rule{Type: p.Type, Port: p.Port, Protocol: p.Protocol, Source: p.Source, Country: p.Country, Comment: p.Comment, Owner: policyOwner})
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, r := range current {
+		if wanted[key] {
+			continue
+		}
+
+		if err := firewall.Remove(r.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportAdmins returns the administrators sorted by username
+func exportAdmins() (interface{}, error) {
+	list := []sharedAdmin{}
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleAdmin {
+			continue
+		}
+
+		list = append(list, sharedAdmin{
+			Username:     u.Username,
+			Email:        u.Email,
+			PasswordHash: u.PasswordHash,
+			SSOSubject:   u.SSOSubject,
+			TOTPEnabled:  u.TOTPEnabled,
+			TOTPSecret:   u.TOTPSecret,
+			SecurityKeys: u.SecurityKeys,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+
+	return list, nil
+}
+
+// applyAdmins makes the administrators here the same as the shared ones. Administrators
+// are matched by username. A reseller or user here with the username of a shared
+// administrator is left as they are and the administrator is not added, since the
+// sessions of the reseller or user would carry on with an administrator's rights
+func applyAdmins(data json.RawMessage) error {
+	var list []sharedAdmin
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	existing := make(map[string]auth.User)
+	for _, u := range auth.Users() {
+		existing[u.Username] = u
+	}
+
+	var errs []error
+	wanted := make([]string, 0, len(list))
+	for _, a := range list {
+		a.Username = strings.ToLower(a.Username)
+		wanted = append(wanted, a.Username)
+
+		u, ok := existing[a.Username]
+		if ok && u.Role != auth.RoleAdmin {
+			errs = append(errs, fmt.Errorf("cluster: %s is a %s on this node and is not made an administrator", u.Username, u.Role))
+			continue
+		}
+
+		if !ok {
+			_, err := auth.ImportUser(auth.User{
+				Username:     a.Username,
+				Email:        a.Email,
+				Role:         auth.RoleAdmin,
+				PasswordHash: a.PasswordHash,
+				SSOSubject:   a.SSOSubject,
+				TOTPEnabled:  a.TOTPEnabled,
+				TOTPSecret:   a.TOTPSecret,
+				SecurityKeys: a.SecurityKeys,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err := auth.UpdateUser(u.ID, func(u *auth.User) error {
+			u.Email = a.Email
+			u.PasswordHash = a.PasswordHash
+			u.SSOSubject = a.SSOSubject
+			u.TOTPEnabled = a.TOTPEnabled
+			u.TOTPSecret = a.TOTPSecret
+			u.TOTPPending = ""
+			u.SecurityKeys = a.SecurityKeys
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, u := range existing {
+		if u.Role == auth.RoleAdmin && !slices.Contains(wanted, u.Username) {
+			if err := auth.DeleteUser(u.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// standbyState is a standby controller. It joins the controller like an agent, and on
+// every interval reports its status and copies the state and certificate authority of
+// the cluster, so that it can take over with the same nodes and certificates
+type standbyState struct {
+	agent   *agentState
+	dataDir string
+	config  *config.ClusterConfiguration
+
+	// When the controller was last reached, and whether the standby has taken over
+	mu          sync.Mutex
+	lastContact time.Time
+	promoted    bool
+}
+
+// replica is the copy of the cluster the controller sends its standby
+type replica struct {
+	State json.RawMessage `json:"state"`
+	CA    string          `json:"ca"`
+	Key   string          `json:"key"`
+}
+
+// roleResponse is the role a controller or standby reports
+type roleResponse struct {
+	Role string `json:"role"`
+}
+
+// newStandby loads the certificate the standby was issued when it joined the controller
+func newStandby(dataDir string, c *config.ClusterConfiguration) (*standbyState, error) {
+	a, err := newAgent(dataDir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &standbyState{agent: a, dataDir: dataDir, config: c}, nil
+}
+
+// markerPath returns the path of the file recording that the standby has taken over
+func (s *standbyState) markerPath() string {
+	return filepath.Join(s.agent.dir, "promoted.json")
+}
+
+// hasTakenOver returns true if the standby took over as controller before it was last
+// restarted
+func (s *standbyState) hasTakenOver() bool {
+	_, err := os.Stat(s.markerPath())
+	return err == nil
+}
+
+// start joins the controller if the standby has not yet, then copies the cluster on the
+// configured interval in the background until it takes over
+func (s *standbyState) start() {
+	crash.Go("cluster", func() {
+		a := s.agent
+		for a.id == "" {
+			if err := a.join(); err != nil {
+				zap.S().Named("cluster").Errorw("failed to join the cluster, retrying in a minute", "controller", s.config.Controller, zap.Error(err))
+				time.Sleep(time.Minute)
+			}
+		}
+
+		s.mu.Lock()
+		s.lastContact = time.Now()
+		s.mu.Unlock()
+
+		for ; ; time.Sleep(time.Duration(s.config.Interval) * time.Second) {
+			if s.isPromoted() {
+				return
+			}
+
+			s.replicate()
+		}
+	})
+}
+
+// replicate reports the status of the standby and copies the cluster from the controller,
+// taking over if the controller has not been reached for longer than configured
+func (s *standbyState) replicate() {
+	a := s.agent
+
+	err := request(a.client, s.config.Controller, http.MethodPost, "/cluster/v1/status", collect(s.dataDir), nil)
+	if err == nil {
+		var r replica
+		if err = request(a.client, s.config.Controller, http.MethodGet, "/cluster/v1/replica", nil, &r); err == nil {
+			err = s.write(r)
+		}
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.lastContact = time.Now()
+	}
+	since := time.Since(s.lastContact)
+	s.mu.Unlock()
+
+	if err == nil {
+		return
+	}
+
+	zap.S().Named("cluster").Warnw("failed to copy the cluster from the controller", zap.Error(err))
+
+	if s.config.FailoverAfter <= 0 || since < time.Duration(s.config.FailoverAfter)*time.Second {
+		return
+	}
+
+	reason := fmt.Sprintf("the controller could not be reached for %s", since.Round(time.Second))
+	if err := s.promote(reason); err != nil {
+		zap.S().Named("cluster").Errorw("failed to take over as controller", zap.Error(err))
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:     "cluster.failover",
+		Resource: s.agent.id,
+		Data:     map[string]interface{}{"reason": reason},
+	})
+}
+
+// write stores the copy of the cluster where a controller keeps it
+func (s *standbyState) write(r replica) error {
+	if len(r.State) == 0 {
+		return errors.New("cluster: the controller sent an invalid replica")
+	}
+
+	for name, data := range map[string]string{"ca.pem": r.CA, "ca.key": r.Key} {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			return errors.New("cluster: the controller sent an invalid certificate authority")
+		}
+
+		if err := writePEM(filepath.Join(s.agent.dir, name), block.Type, block.Bytes); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(s.agent.dir, "controller.json")
+	if err := os.WriteFile(path+".tmp", r.State, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// isPromoted returns true once the standby has taken over
+func (s *standbyState) isPromoted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.promoted
+}
+
+// promote takes over as controller from the last copy of the cluster and starts serving
+// the agents, which switch to the standby when they cannot reach the controller
+func (s *standbyState) promote(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.promoted {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(s.agent.dir, "ca.key")); err != nil {
+		return errors.New("cluster: the standby has not copied the cluster from the controller yet")
+	}
+
+	ctl, err := newController(s.dataDir, s.config)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"promoted": time.Now().UTC(), "reason": reason})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(s.markerPath(), b, 0600); err != nil {
+		return err
+	}
+
+	if err := ctl.listen(); err != nil {
+		os.Remove(s.markerPath())
+		return err
+	}
+
+	s.promoted = true
+	controller = ctl
+	role = Controller
+
+	zap.S().Named("cluster").Warnw("this standby has taken over as controller, set its role to controller", "reason", reason)
+
+	return nil
+}
+
+// Promote has this standby take over as controller, for when the controller is lost and
+// automatic failover is off or has not kicked in yet
+func Promote() error {
+	if standby == nil || standby.isPromoted() {
+		return ErrNotStandby
+	}
+
+	return standby.promote("promoted by hand")
+}
+
+// handleRole reports that this server is the controller. A controller that is starting
+// asks its standby, and refuses to start if the standby answers because it has taken over
+func (ctl *controllerState) handleRole(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, roleResponse{Role: Controller})
+}
+
+// handleReplica sends the standby controller a copy of the cluster
+func (ctl *controllerState) handleReplica(w http.ResponseWriter, r *http.Request, n *Node) {
+	if !n.Standby {
+		writeError(w, http.StatusForbidden, "the node is not the standby controller")
+		return
+	}
+
+	key, err := x509.MarshalECPrivateKey(ctl.ca.key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctl.mu.Lock()
+	state, err := json.Marshal(ctl.state)
+	ctl.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, replica{
+		State: state,
+		CA:    string(pemCertificate(ctl.ca.cert)),
+		Key:   string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})),
+	})
+}
+
+// fence refuses to start the controller when its standby has taken over, so that the
+// cluster never has two controllers. A standby that cannot be reached has not taken over,
+// since it serves agents once it has
+func (ctl *controllerState) fence() error {
+	if ctl.config.Standby == "" {
+		return nil
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			MinVersion:            tls.VersionTLS12,
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verifyController(ctl.ca.cert, ""),
+		}},
+	}
+
+	var resp roleResponse
+	if err := request(client, ctl.config.Standby, http.MethodGet, "/cluster/v1/role", nil, &resp); err != nil {
+		return nil
+	}
+
+	if resp.Role == Controller {
+		return fmt.Errorf("cluster: the standby at %s has taken over as controller, this server must not start as controller too", ctl.config.Standby)
+	}
+
+	return nil
+}
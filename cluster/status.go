@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/boot"
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/diagnostics"
+	"github.com/cosmicpanel/CosmicPanel/platform"
+)
+
+// collect gathers the status of this server. Figures that cannot be read are left zero
+// rather than failing the report
+func collect(dataDir string) Status {
+	hostname, _ := os.Hostname()
+
+	s := Status{
+		Hostname: hostname,
+		Version:  buildinfo.Get().Version,
+		Uptime:   diagnostics.CollectInfo().Uptime,
+		Time:     time.Now().UTC(),
+		CPUs:     runtime.NumCPU(),
+		Users:    len(auth.Users()),
+		Shared:   hashes(),
+	}
+
+	for _, m := range boot.Degraded() {
+		s.Degraded = append(s.Degraded, m.Name)
+	}
+
+	s.Load, _ = platform.Load()
+	s.MemoryTotal, s.MemoryAvailable, _ = platform.Memory()
+	s.DiskTotal, s.DiskFree, _ = platform.Disk(dataDir)
+
+	return s
+}
@@ -0,0 +1,260 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// ErrUnknownSetting is returned when syncing settings nothing has been shared as
+var ErrUnknownSetting = errors.New("cluster: unknown shared setting")
+
+// Shared is a group of settings the controller can keep the same on its agents
+type Shared struct {
+	// Export returns the settings on this server. It must return them in the same order
+	// every time, since drift is found by comparing hashes of the exports
+	Export func() (interface{}, error)
+
+	// Apply replaces the settings on this server with the exported settings of the
+	// controller
+	Apply func(data json.RawMessage) error
+}
+
+var (
+	smu    sync.RWMutex
+	shared = make(map[string]Shared)
+)
+
+// Share makes the settings available to sync under the name. Packages owning settings
+// that should be the same across a cluster, such as packages or zone templates, share
+// them when they are configured
+func Share(name string, s Shared) {
+	smu.Lock()
+	defer smu.Unlock()
+
+	shared[name] = s
+}
+
+// sharedSetting returns the settings shared under the name
+func sharedSetting(name string) (Shared, bool) {
+	smu.RLock()
+	defer smu.RUnlock()
+
+	s, ok := shared[name]
+
+	return s, ok
+}
+
+// export returns the settings shared under the name and a hash of them
+func export(name string) (json.RawMessage, string, error) {
+	s, ok := sharedSetting(name)
+	if !ok {
+		return nil, "", fmt.Errorf("%w %s", ErrUnknownSetting, name)
+	}
+
+	v, err := s.Export()
+	if err != nil {
+		return nil, "", err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return b, hex.EncodeToString(sum[:]), nil
+}
+
+// hashes returns the hash of every shared setting on this server, which agents report
+// so that the controller can find drift
+func hashes() map[string]string {
+	smu.RLock()
+	names := make([]string, 0, len(shared))
+	for name := range shared {
+		names = append(names, name)
+	}
+	smu.RUnlock()
+
+	list := make(map[string]string, len(names))
+	for _, name := range names {
+		_, hash, err := export(name)
+		if err != nil {
+			zap.S().Named("cluster").Warnw("failed to export shared setting", "setting", name, zap.Error(err))
+			continue
+		}
+		list[name] = hash
+	}
+
+	return list
+}
+
+// synced returns the settings kept the same on the node, leaving out its overrides
+func (ctl *controllerState) synced(n *Node) []string {
+	skip := slices.Concat(ctl.config.Overrides[n.ID], ctl.config.Overrides[n.Name])
+
+	var list []string
+	for _, name := range ctl.config.Sync {
+		if !slices.Contains(skip, name) {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
+
+// drift returns the settings of the node that differ from the controller's according to
+// the hashes it reported
+func (ctl *controllerState) drift(n *Node, reported map[string]string) []string {
+	var list []string
+
+	for _, name := range ctl.synced(n) {
+		_, hash, err := export(name)
+		if err != nil {
+			zap.S().Named("cluster").Warnw("failed to export shared setting", "setting", name, zap.Error(err))
+			continue
+		}
+
+		if reported[name] != hash {
+			list = append(list, name)
+		}
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// detectDrift records the drift of the node from the status it reported, and corrects it
+// straight away if the controller is set to
+func (ctl *controllerState) detectDrift(n *Node, s *Status) {
+	// The standby holds a copy of the cluster rather than settings of its own
+	if n.Standby {
+		return
+	}
+
+	drift := ctl.drift(n, s.Shared)
+
+	ctl.mu.Lock()
+	before := n.Drift
+	n.Drift = drift
+	ctl.mu.Unlock()
+
+	if len(drift) > 0 && !slices.Equal(before, drift) {
+		zap.S().Named("cluster").Warnw("node settings have drifted from the controller", "node", n.ID, "name", n.Name, "settings", drift)
+
+		events.Publish(events.Event{
+			Type:     "cluster.node.drift",
+			Resource: n.ID,
+			Data:     map[string]interface{}{"name": n.Name, "settings": drift},
+		})
+	}
+
+	if len(drift) > 0 && ctl.config.AutoSync {
+		if _, err := ctl.sync(n.ID, drift, ""); err != nil {
+			zap.S().Named("cluster").Errorw("failed to correct drift", "node", n.ID, zap.Error(err))
+		}
+	}
+}
+
+// sync sends the settings of the controller to the node, skipping settings a sync is
+// already on its way for
+func (ctl *controllerState) sync(node string, names []string, actor string) ([]Command, error) {
+	ctl.mu.Lock()
+	pending := make(map[string]bool)
+	for _, cmd := range ctl.state.Commands {
+		if cmd.Node == node && cmd.Type == "sync.apply" && (cmd.State == Queued || cmd.State == Sent) {
+			var p syncRequest
+			json.Unmarshal(cmd.Payload, &p)
+			pending[p.Name] = true
+		}
+	}
+	ctl.mu.Unlock()
+
+	list := []Command{}
+	for _, name := range names {
+		if pending[name] {
+			continue
+		}
+
+		data, _, err := export(name)
+		if err != nil {
+			return list, err
+		}
+
+		payload, err := json.Marshal(syncRequest{Name: name, Data: data})
+		if err != nil {
+			return list, err
+		}
+
+		cmd, err := Send(node, "sync.apply", payload, actor)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, cmd)
+	}
+
+	return list, nil
+}
+
+// syncRequest is the payload of the sync.apply command
+type syncRequest struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// applySync replaces shared settings on an agent with those of the controller
+func applySync(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var p syncRequest
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	s, ok := sharedSetting(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownSetting, p.Name)
+	}
+
+	if err := s.Apply(p.Data); err != nil {
+		return nil, err
+	}
+
+	_, hash, err := export(p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{p.Name: hash}, nil
+}
+
+// Sync sends the settings kept the same across the cluster to the node, correcting any
+// drift. It returns the commands sent, which are empty if a sync is already under way
+func Sync(node string, actor string) ([]Command, error) {
+	if controller == nil {
+		return nil, ErrNotController
+	}
+
+	controller.mu.Lock()
+	n, ok := controller.state.Nodes[node]
+	var names []string
+	if ok {
+		names = controller.synced(n)
+	}
+	controller.mu.Unlock()
+
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+
+	return controller.sync(node, names, actor)
+}
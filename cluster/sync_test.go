@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configureNode sets up the users and firewall rules of a node, with a firewall that
+// applies nothing
+func configureNode(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Configure(dir, config.NewConfiguration("").Auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := firewall.Configure(dir, &config.FirewallConfiguration{Backend: "none"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyAdmins(t *testing.T) {
+	type local struct {
+		username string
+		role     string
+	}
+
+	tests := []struct {
+		name   string
+		local  []local
+		shared []string
+		admins []string
+		err    string
+	}{
+		{"adds administrators", nil, []string{"root", "ops"}, []string{"ops", "root"}, ""},
+		{"removes administrators", []local{{"root", auth.RoleAdmin}, {"old", auth.RoleAdmin}}, []string{"root"}, []string{"root"}, ""},
+		{"keeps resellers and users", []local{{"alice", auth.RoleUser}, {"hosting", auth.RoleReseller}}, nil, nil, ""},
+		{"matches usernames in any case", []local{{"root", auth.RoleAdmin}}, []string{"Root"}, []string{"root"}, ""},
+		{"user with the username", []local{{"ops", auth.RoleUser}}, []string{"root", "ops"}, []string{"root"}, "ops is a user"},
+		{"reseller with the username", []local{{"ops", auth.RoleReseller}}, []string{"ops"}, nil, "ops is a reseller"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureNode(t)
+
+			for _, l := range tt.local {
+				if _, err := auth.CreateUser(auth.User{Username: l.username, Role: l.role}, "local password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var shared []sharedAdmin
+			for _, name := range tt.shared {
+				u := auth.User{}
+				if err := u.SetPassword("shared password"); err != nil {
+					t.Fatal(err)
+				}
+				shared = append(shared, sharedAdmin{Username: name, Email: name + "@example.com", PasswordHash: u.PasswordHash})
+			}
+			data, _ := json.Marshal(shared)
+
+			err := applyAdmins(data)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+
+			var admins []string
+			for _, u := range auth.Users() {
+				if u.Role == auth.RoleAdmin {
+					admins = append(admins, u.Username)
+					if !u.CheckPassword("shared password") {
+						t.Errorf("%s does not have the shared password", u.Username)
+					}
+				}
+			}
+			slices.Sort(admins)
+			if !slices.Equal(admins, tt.admins) {
+				t.Errorf("administrators %q, want %q", admins, tt.admins)
+			}
+
+			for _, l := range tt.local {
+				if l.role == auth.RoleAdmin {
+					continue
+				}
+				u, ok := userNamed(l.username)
+				if !ok || u.Role != l.role || !u.CheckPassword("local password") {
+					t.Errorf("the %s %s was changed", l.role, l.username)
+				}
+			}
+		})
+	}
+}
+
+func userNamed(username string) (auth.User, bool) {
+	for _, u := range auth.Users() {
+		if u.Username == username {
+			return u, true
+		}
+	}
+
+	return auth.User{}, false
+}
+
+func TestApplyPolicy(t *testing.T) {
+	configureNode(t)
+
+	expires := time.Now().Add(time.Hour)
+	for _, r := range []firewall.Rule{
+		{Type: firewall.AllowPort, Port: 8443, Owner: policyOwner, Comment: "old"},
+		{Type: firewall.AllowPort, Port: 22, Owner: policyOwner},
+		{Type: firewall.AllowPort, Port: 25, Owner: "mail"},
+		{Type: firewall.BlockIP, Source: "198.51.100.7", Owner: "bruteforce", Expires: &expires},
+		{Type: firewall.BlockIP, Source: "203.0.113.0/24", Owner: policyOwner, Expires: &expires},
+	} {
+		if _, err := firewall.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []policyRule{
+		{Type: firewall.AllowPort, Port: 22, Protocol: "tcp"},
+		{Type: firewall.BlockCountry, Country: "xx", Comment: "test"},
+		{Type: firewall.BlockIP, Source: "192.0.2.0/24"},
+	}
+	data, _ := json.Marshal(want)
+
+	if err := applyPolicy(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := exportPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := json.Marshal(got)
+
+	var again []policyRule
+	json.Unmarshal(exported, &again)
+	if len(again) != len(want) {
+		t.Fatalf("policy %s, want %s", exported, data)
+	}
+
+	// Rules of other owners and temporary rules belong to the node
+	var kept []string
+	for _, r := range firewall.Rules() {
+		if r.Owner != policyOwner || r.Expires != nil {
+			kept = append(kept, r.Owner)
+		}
+	}
+	slices.Sort(kept)
+	if !slices.Equal(kept, []string{policyOwner, "bruteforce", "mail"}) {
+		t.Errorf("kept rules of %q", kept)
+	}
+
+	// Applying the export again replaces no rules
+	before := firewall.Rules()
+	if err := applyPolicy(exported); err != nil {
+		t.Fatal(err)
+	}
+	after := firewall.Rules()
+	if len(before) != len(after) {
+		t.Errorf("applying the export again changed %d rules to %d", len(before), len(after))
+	}
+	for i := range before {
+		if before[i].ID != after[i].ID {
+			t.Errorf("rule %s was replaced", before[i].ID)
+		}
+	}
+}
+
+func TestDrift(t *testing.T) {
+	ctl := newTestController(t)
+	ctl.config.Sync = []string{"admins", "firewall", "packages"}
+	ctl.config.Overrides = map[string][]string{"web2": {"firewall"}, "n3": {"packages", "admins"}}
+
+	exports := map[string]interface{}{"admins": []string{"root"}, "firewall": []int{22}, "packages": "basic"}
+	for name := range exports {
+		Share(name, Shared{Export: func() (interface{}, error) { return exports[name], nil }})
+	}
+	t.Cleanup(func() {
+		smu.Lock()
+		shared = make(map[string]Shared)
+		smu.Unlock()
+	})
+
+	current := hashes()
+
+	tests := []struct {
+		name     string
+		node     Node
+		reported map[string]string
+		drift    []string
+	}{
+		{"in sync", Node{ID: "n1", Name: "web1"}, current, nil},
+		{"nothing reported", Node{ID: "n1", Name: "web1"}, nil, []string{"admins", "firewall", "packages"}},
+		{"one setting", Node{ID: "n1", Name: "web1"}, map[string]string{"admins": current["admins"], "firewall": "x", "packages": current["packages"]}, []string{"firewall"}},
+		{"override by name", Node{ID: "n2", Name: "web2"}, map[string]string{"admins": current["admins"], "packages": current["packages"]}, nil},
+		{"override by ID", Node{ID: "n3", Name: "web3"}, map[string]string{"firewall": current["firewall"]}, nil},
+		{"override leaves the rest", Node{ID: "n3", Name: "web3"}, nil, []string{"firewall"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ctl.drift(&tt.node, tt.reported); !slices.Equal(got, tt.drift) {
+				t.Errorf("drift %q, want %q", got, tt.drift)
+			}
+		})
+	}
+}
+
+func TestSyncSkipsPending(t *testing.T) {
+	ctl := newTestController(t)
+	ctl.config.Sync = []string{"admins", "firewall"}
+	ctl.state.Nodes["n1"] = &Node{ID: "n1", Name: "web1"}
+
+	Share("admins", Shared{Export: func() (interface{}, error) { return []string{"root"}, nil }})
+	Share("firewall", Shared{Export: func() (interface{}, error) { return []int{22}, nil }})
+	t.Cleanup(func() {
+		smu.Lock()
+		shared = make(map[string]Shared)
+		smu.Unlock()
+	})
+
+	first, err := Sync("n1", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("%d commands sent, want 2", len(first))
+	}
+
+	if again, err := Sync("n1", "root"); err != nil || len(again) != 0 {
+		t.Errorf("syncing while the first sync is on its way sent %d commands, %v", len(again), err)
+	}
+
+	// Once the node has reported a result the setting can be synced again
+	ctl.mu.Lock()
+	ctl.finish(ctl.state.Commands[first[0].ID], nil, "")
+	ctl.mu.Unlock()
+
+	again, err := Sync("n1", "root")
+	if err != nil || len(again) != 1 {
+		t.Fatalf("%d commands sent after a result, %v", len(again), err)
+	}
+
+	var was, now syncRequest
+	json.Unmarshal(first[0].Payload, &was)
+	json.Unmarshal(again[0].Payload, &now)
+	if now.Name != was.Name {
+		t.Errorf("synced %s, want %s", now.Name, was.Name)
+	}
+
+	if _, err := Sync("missing", "root"); err != ErrNodeNotFound {
+		t.Errorf("syncing a missing node: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	doctorpkg "github.com/cosmicpanel/CosmicPanel/doctor"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/tlspolicy"
+	"github.com/cosmicpanel/CosmicPanel/vault"
+	"gopkg.in/yaml.v2"
+)
+
+// licenseTypes are the names of the license types
+var licenseTypes = map[int]string{
+	config.FULL:    "full",
+	config.LITE:    "lite",
+	config.DNSONLY: "dnsonly",
+	config.TRIAL:   "trial",
+}
+
+// version prints the version, commit and build date of the binary and the Go toolchain
+// it was built with
+func version(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	o.outputFlag(fs)
+	parse(fs, args)
+
+	info := buildinfo.Get()
+
+	return o.print(info, func() error {
+		fmt.Println(info)
+		return nil
+	})
+}
+
+// configure shows the configuration with its defaults applied, or checks that it can be
+// loaded with its secrets resolved. The configuration is shown as YAML, the format it is
+// written in, unless JSON is asked for
+func configure(args []string) error {
+	var o options
+	fs := o.flags("config", "show|check")
+	args = parse(fs, args)
+
+	switch arg(args, 0) {
+	case "show":
+		c, err := config.ReadConfiguration(o.config)
+		if err != nil {
+			return err
+		}
+
+		// Vault references are shown as they are since they are not secret themselves
+		for _, s := range c.Secrets() {
+			if *s != "" && !strings.HasPrefix(*s, vault.Prefix) {
+				*s = "********"
+			}
+		}
+
+		if o.output == "json" {
+			return o.print(c, nil)
+		}
+
+		b, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		os.Stdout.Write(b)
+	case "check":
+		o.validate = true
+		c, err := bootstrap(&o)
+
+		// Scripts checking the file before a restart get the wrong settings as a list
+		var errs config.ValidationErrors
+		if errors.As(err, &errs) && (o.output == "json" || o.output == "yaml") {
+			if err := o.print(map[string]interface{}{"config": o.config, "valid": false, "errors": errs}, nil); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tlspolicy.Configure(c.TLS, c.Panel); err != nil {
+			return err
+		}
+
+		return o.print(map[string]interface{}{"config": o.config, "valid": true}, func() error {
+			fmt.Printf("%s is valid\n", o.config)
+			return nil
+		})
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+// license checks the license of the server against the license server
+func license(args []string) error {
+	var o options
+	fs := o.flags("license", "check")
+	dnsonly := fs.Bool("dnsonly", false, "Request a DNS only license instead of a trial license if this server has none")
+	args = parse(fs, args)
+
+	if arg(args, 0) != "check" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	c.CheckLicense(*dnsonly)
+	if c.License == nil {
+		return errors.New("license server could not be reached")
+	}
+
+	typ, ok := licenseTypes[c.License.LicenseType]
+	if !ok {
+		typ = "none"
+	}
+
+	v4, v6 := c.PublicIPs()
+	status := licenseStatus{IP: v4, IPv6: v6, Valid: c.License.ValidLicense, Type: typ}
+
+	return o.print(status, func() error {
+		if status.IP != "" {
+			fmt.Printf("IPv4 address: %s\n", status.IP)
+		}
+		if status.IPv6 != "" {
+			fmt.Printf("IPv6 address: %s\n", status.IPv6)
+		}
+		fmt.Printf("Valid: %t\nType: %s\n", status.Valid, status.Type)
+		return nil
+	})
+}
+
+// licenseStatus is the result of checking the license
+type licenseStatus struct {
+	IP    string `json:"ip,omitempty"`
+	IPv6  string `json:"ipv6,omitempty"`
+	Valid bool   `json:"valid"`
+	Type  string `json:"type"`
+}
+
+// doctor checks that the server meets the panel's requirements, printing what to do
+// about each that is not met. The JSON report is meant to be attached to support tickets
+func doctor(args []string) error {
+	var o options
+	fs := o.flags("doctor", "")
+	asJSON := fs.Bool("json", false, "Print the report as JSON, the same as -output json")
+	parse(fs, args)
+
+	if *asJSON {
+		o.output = "json"
+	}
+
+	// A configuration that cannot be read is reported rather than stopping the checks,
+	// which then run against the defaults
+	c, err := config.ReadConfiguration(o.config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s, checking the defaults instead: %v\n\n", o.config, err)
+		c = config.NewConfiguration(o.config)
+	}
+
+	report := doctorpkg.Run(c, o.config)
+	if err != nil {
+		report.Results = append([]doctorpkg.Result{{Check: "config", Status: doctorpkg.Fail, Message: err.Error()}}, report.Results...)
+	} else {
+		var wrong []doctorpkg.Result
+		for _, fe := range c.Validate() {
+			wrong = append(wrong, doctorpkg.Result{Check: "config", Status: doctorpkg.Fail, Message: fe.Error()})
+		}
+		report.Results = append(wrong, report.Results...)
+	}
+
+	err = o.print(report, func() error {
+		for _, res := range report.Results {
+			fmt.Printf("%-5s %-12s %s\n", strings.ToUpper(res.Status), res.Check, res.Message)
+			if res.Hint != "" && res.Status != doctorpkg.Pass {
+				fmt.Printf("%18s %s\n", "->", res.Hint)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if report.Failed() {
+		return errors.New("some requirements are not met")
+	}
+
+	return nil
+}
+
+// diag fetches build and runtime information, a goroutine dump or a CPU profile from the
+// diagnostics server of the running daemon
+func diag(args []string) error {
+	var o options
+	fs := o.flags("diag", "info|goroutines|profile")
+	seconds := fs.Int("seconds", 30, "How long a CPU profile is captured for")
+	file := fs.String("file", "cpu.pprof", "The file a CPU profile is written to")
+	args = parse(fs, args)
+
+	paths := map[string]string{
+		"info":       "/debug/info",
+		"goroutines": "/debug/goroutines",
+		"profile":    "/debug/pprof/profile?seconds=" + strconv.Itoa(*seconds),
+	}
+
+	path, ok := paths[arg(args, 0)]
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+dialAddress(c.Diagnostics.Host, c.Diagnostics.Port)+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.Diagnostics.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Diagnostics.Token)
+	}
+
+	client := &http.Client{Timeout: time.Duration(*seconds)*time.Second + time.Minute}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("diagnostics server is not reachable, it can be started by sending SIGUSR1 to the daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("diagnostics server returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	// The information is JSON, which is printed in the chosen format
+	if arg(args, 0) == "info" && o.output != "table" {
+		var info interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			return err
+		}
+
+		return o.print(info, nil)
+	}
+
+	if arg(args, 0) != "profile" {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+
+	return o.print(map[string]string{"profile": *file}, func() error {
+		fmt.Printf("Wrote CPU profile to %s\n", *file)
+		return nil
+	})
+}
+
+// dialAddress returns the address to reach a listener on this server at, using the
+// loopback interface for listeners bound to every interface
+func dialAddress(host string, port int) string {
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// printPlan prints what an operation run with -dry-run would change
+func printPlan(plan *dryrun.Plan) {
+	if len(plan.Changes) == 0 {
+		fmt.Println("Nothing would be changed")
+	}
+
+	for _, ch := range plan.Changes {
+		fmt.Printf("Would %s %s %s", ch.Action, ch.Kind, ch.Target)
+		if ch.Detail != "" {
+			fmt.Printf(" (%s)", ch.Detail)
+		}
+		fmt.Println()
+	}
+
+	for _, n := range plan.Notes {
+		fmt.Printf("Note: %s\n", n)
+	}
+}
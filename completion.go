@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The completion command is added here rather than in the list of commands since it
+// reads the list itself
+func init() {
+	commands = append(commands, command{Name: "completion", Usage: "bash|zsh|fish", Summary: "Print a shell completion script", Run: completion})
+}
+
+// describing is set while collecting the flags of the commands for completions, which
+// makes parse stop a command with its flag set before it does anything
+var describing bool
+
+// described is the value parse panics with while describing
+type described struct {
+	fs *flag.FlagSet
+}
+
+// describe returns the flag set of the command by running it until it parses its
+// arguments, so that completions always match the flags the commands define
+func describe(cmd command) (fs *flag.FlagSet) {
+	describing = true
+	defer func() {
+		describing = false
+
+		if r := recover(); r != nil {
+			d, ok := r.(described)
+			if !ok {
+				panic(r)
+			}
+			fs = d.fs
+		}
+	}()
+
+	cmd.Run(nil)
+
+	return nil
+}
+
+// spec is what completions know about a command
+type spec struct {
+	command
+	actions []string
+	flags   []*flag.Flag
+}
+
+// specs describes every command other than completion itself
+func specs() []spec {
+	var list []spec
+	for _, cmd := range commands {
+		if cmd.Name == "completion" {
+			continue
+		}
+
+		s := spec{command: cmd}
+
+		// The first word of the usage lists the actions, such as list|create|delete
+		if fields := strings.Fields(cmd.Usage); len(fields) > 0 {
+			s.actions = strings.Split(strings.Trim(fields[0], "[]"), "|")
+		}
+
+		if fs := describe(cmd); fs != nil {
+			fs.VisitAll(func(f *flag.Flag) {
+				s.flags = append(s.flags, f)
+			})
+		}
+
+		list = append(list, s)
+	}
+
+	return list
+}
+
+// completion prints a script completing the commands, their actions and flags for the
+// shell, which is meant to be sourced from the shell's startup files
+func completion(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cosmicpanel completion bash|zsh|fish\n\nAdd the output to the shell's startup files, for example:\n  source <(cosmicpanel completion bash)\n")
+	}
+	args = parse(fs, args)
+
+	shells := map[string]func(io.Writer, []spec){
+		"bash": bashCompletion,
+		"zsh":  zshCompletion,
+		"fish": fishCompletion,
+	}
+
+	write, ok := shells[arg(args, 0)]
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	write(os.Stdout, specs())
+
+	return nil
+}
+
+// fileFlags are the flags whose value is a path, which are completed with file names
+var fileFlags = map[string]bool{
+	"config":      true,
+	"file":        true,
+	"unit":        true,
+	"binary":      true,
+	"certificate": true,
+	"key":         true,
+}
+
+// isBool returns true if the flag takes no value
+func isBool(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagNames returns the flags of the command as they are typed
+func flagNames(s spec) []string {
+	names := make([]string, 0, len(s.flags))
+	for _, f := range s.flags {
+		names = append(names, "-"+f.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// bashCompletion writes the completion script for bash
+func bashCompletion(w io.Writer, list []spec) {
+	names := []string{"help"}
+	for _, s := range list {
+		names = append(names, s.Name)
+	}
+
+	fmt.Fprintf(w, `# bash completion for cosmicpanel
+_cosmicpanel() {
+    local cur prev flags actions
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+        return
+    fi
+
+    case "$prev" in
+        -output|--output)
+            COMPREPLY=($(compgen -W "table json yaml" -- "$cur"))
+            return
+            ;;
+        -config|--config|-file|--file|-unit|--unit|-binary|--binary|-certificate|--certificate|-key|--key)
+            COMPREPLY=($(compgen -f -- "$cur"))
+            return
+            ;;
+    esac
+
+    case "${COMP_WORDS[1]}" in
+`, strings.Join(names, " "))
+
+	for _, s := range list {
+		fmt.Fprintf(w, "        %s)\n            flags=\"%s\"\n            actions=\"%s\"\n            ;;\n", s.Name, strings.Join(flagNames(s), " "), strings.Join(s.actions, " "))
+	}
+
+	fmt.Fprint(w, `    esac
+
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 2 && -n "$actions" ]]; then
+        COMPREPLY=($(compgen -W "$actions" -- "$cur"))
+    fi
+}
+
+complete -o default -F _cosmicpanel cosmicpanel
+`)
+}
+
+// zshCompletion writes the completion script for zsh, which can be sourced or installed
+// as _cosmicpanel in a directory on the fpath
+func zshCompletion(w io.Writer, list []spec) {
+	fmt.Fprint(w, `#compdef cosmicpanel
+
+_cosmicpanel() {
+    local -a commands
+    commands=(
+        'help:Print the commands'
+`)
+
+	for _, s := range list {
+		fmt.Fprintf(w, "        '%s:%s'\n", s.Name, zshEscape(s.Summary))
+	}
+
+	fmt.Fprint(w, `    )
+
+    if (( CURRENT == 2 )); then
+        _describe 'command' commands
+        return
+    fi
+
+    shift words
+    (( CURRENT-- ))
+
+    case $words[1] in
+`)
+
+	for _, s := range list {
+		fmt.Fprintf(w, "        %s)\n            _arguments \\\n", s.Name)
+
+		for _, f := range s.flags {
+			value := ""
+			switch {
+			case isBool(f):
+			case f.Name == "output":
+				value = ":format:(table json yaml)"
+			case fileFlags[f.Name]:
+				value = ":file:_files"
+			default:
+				value = ":" + f.Name + ":"
+			}
+
+			fmt.Fprintf(w, "                '-%s[%s]%s' \\\n", f.Name, zshEscape(f.Usage), value)
+		}
+
+		if len(s.actions) > 0 {
+			fmt.Fprintf(w, "                '1:action:(%s)' \\\n", strings.Join(s.actions, " "))
+		}
+
+		fmt.Fprint(w, "                '*:argument:_files'\n            ;;\n")
+	}
+
+	fmt.Fprint(w, `    esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+    _cosmicpanel "$@"
+else
+    compdef _cosmicpanel cosmicpanel
+fi
+`)
+}
+
+// zshEscape escapes the characters with a meaning in _arguments and _describe specs
+// within a single quoted string
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// fishCompletion writes the completion script for fish
+func fishCompletion(w io.Writer, list []spec) {
+	fmt.Fprint(w, "# fish completion for cosmicpanel\ncomplete -c cosmicpanel -f\n")
+	fmt.Fprint(w, "complete -c cosmicpanel -n __fish_use_subcommand -a help -d 'Print the commands'\n")
+
+	for _, s := range list {
+		fmt.Fprintf(w, "complete -c cosmicpanel -n __fish_use_subcommand -a %s -d %s\n", s.Name, fishQuote(s.Summary))
+	}
+
+	for _, s := range list {
+		cond := fishQuote("__fish_seen_subcommand_from " + s.Name)
+
+		if len(s.actions) > 0 {
+			fmt.Fprintf(w, "complete -c cosmicpanel -n %s -a %s\n", cond, fishQuote(strings.Join(s.actions, " ")))
+		}
+
+		for _, f := range s.flags {
+			args := ""
+			switch {
+			case isBool(f):
+			case f.Name == "output":
+				args = " -x -a 'table json yaml'"
+			case fileFlags[f.Name]:
+				args = " -r -F"
+			default:
+				args = " -x"
+			}
+
+			fmt.Fprintf(w, "complete -c cosmicpanel -n %s -o %s -d %s%s\n", cond, f.Name, fishQuote(f.Usage), args)
+		}
+	}
+}
+
+// fishQuote quotes the string for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
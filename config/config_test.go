@@ -0,0 +1,110 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteToDisk(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		mode     os.FileMode
+		want     os.FileMode
+	}{
+		{"new file", "", 0, 0600},
+		{"replaces the file", "debug: true\n", 0600, 0600},
+		{"keeps the mode", "debug: true\n", 0640, 0640},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.yml")
+
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), tt.mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(path, tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := NewConfiguration(path)
+			c.Auth.SSO.ClientSecret = "resolved secret"
+			c.references = map[*string]string{&c.Auth.SSO.ClientSecret: "vault:sso/secret"}
+
+			if err := c.WriteToDisk(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.want {
+				t.Errorf("mode %v, want %v", info.Mode().Perm(), tt.want)
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "vault:sso/secret") || strings.Contains(string(b), "resolved secret") {
+				t.Errorf("the file does not hold the vault reference in place of the secret")
+			}
+			if c.Auth.SSO.ClientSecret != "resolved secret" {
+				t.Errorf("the secret in memory was left as %q", c.Auth.SSO.ClientSecret)
+			}
+
+			read, err := ReadConfiguration(path)
+			if err != nil {
+				t.Fatalf("the written file does not parse: %v", err)
+			}
+			if read.Auth.SSO.ClientSecret != "vault:sso/secret" {
+				t.Errorf("read back %q", read.Auth.SSO.ClientSecret)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("%d files left in the directory, want only the configuration", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteToDiskFailureKeepsFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only directory")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(path, []byte("debug: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary file cannot be created next to the configuration
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+
+	if err := NewConfiguration(path).WriteToDisk(); err == nil {
+		t.Fatal("writing succeeded")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "debug: true\n" {
+		t.Errorf("the configuration was changed to %q", b)
+	}
+}
@@ -0,0 +1,289 @@
+package config
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// publicIPTTL is how long addresses found with the detection service are used before
+// they are detected again
+const publicIPTTL = time.Hour
+
+// stunCookie is the magic cookie of STUN messages, which mapped addresses are XORed with
+const stunCookie = 0x2112A442
+
+// cgnat is the shared address space carrier-grade NAT hands out, which is not public
+// even though it is not private either
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// detected is the public addresses found with the detection service, keyed by family
+var detected struct {
+	mu      sync.Mutex
+	service string
+	addrs   map[string]string
+	at      time.Time
+}
+
+// GetOutboundIPs returns the IPv4 and IPv6 addresses the server reaches the internet from,
+// each empty when the server has no route for that family
+func GetOutboundIPs() (v4 string, v6 string) {
+	return outboundIP("udp4", "8.8.8.8:80"), outboundIP("udp6", "[2001:4860:4860::8888]:80")
+}
+
+// outboundIP returns the local address of a route to the address. Nothing is sent, as
+// dialing UDP only picks the route
+func outboundIP(network string, address string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	return localAddr.IP.String()
+}
+
+// PublicIP returns the public IPv4 address of the server, or its public IPv6 address on
+// servers without IPv4
+func (c *Configuration) PublicIP() string {
+	v4, v6 := c.PublicIPs()
+	if v4 != "" {
+		return v4
+	}
+
+	return v6
+}
+
+// PublicIPs returns the public IPv4 and IPv6 addresses of the server, each empty when
+// the server has no address of that family. Addresses that are not set are those the
+// server reaches the internet from, or those the detection service sees when the server
+// is behind NAT
+func (c *Configuration) PublicIPs() (v4 string, v6 string) {
+	v4, v6 = c.System.PublicIP, c.System.PublicIPv6
+	if v4 != "" && v6 != "" {
+		return v4, v6
+	}
+
+	local4, local6 := GetOutboundIPs()
+	if v4 == "" {
+		v4 = c.publicIP("4", local4)
+	}
+	if v6 == "" {
+		v6 = c.publicIP("6", local6)
+	}
+
+	return v4, v6
+}
+
+// publicIP returns the local address of the family, or the address the detection
+// service sees if the local one is not public
+func (c *Configuration) publicIP(family string, local string) string {
+	addr, err := netip.ParseAddr(local)
+	if err != nil || public(addr) || c.System.IPDetection == "" {
+		return local
+	}
+
+	detected.mu.Lock()
+	defer detected.mu.Unlock()
+
+	if detected.service != c.System.IPDetection || time.Since(detected.at) > publicIPTTL {
+		detected.service = c.System.IPDetection
+		detected.addrs = make(map[string]string)
+		detected.at = time.Now()
+	}
+
+	if ip, ok := detected.addrs[family]; ok {
+		return ip
+	}
+
+	ip, err := detectIP(c.System.IPDetection, family)
+	if err != nil {
+		zap.S().Named("network").Warnw("failed to detect public address, using the private one", "address", local, "service", c.System.IPDetection, zap.Error(err))
+		return local
+	}
+
+	detected.addrs[family] = ip
+
+	return ip
+}
+
+// public returns true if the address can be reached from the internet
+func public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnat.Contains(addr)
+}
+
+// detectIP asks the detection service for the address connections of the family, 4 or
+// 6, come from
+func detectIP(service string, family string) (string, error) {
+	if server, ok := strings.CutPrefix(service, "stun:"); ok {
+		return stunIP(server, family)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	// The connection must not go through a proxy, which the service would see instead
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp"+family, addr)
+			},
+		},
+	}
+
+	resp, err := client.Get(service)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("config: %s responded with %s", service, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+
+	return familyIP(strings.TrimSpace(string(b)), family)
+}
+
+// stunIP sends a STUN binding request to the server over the family, returning the
+// address the server saw it come from. The request is sent up to three times, as UDP
+// may lose it
+func stunIP(server string, family string) (string, error) {
+	conn, err := net.DialTimeout("udp"+family, server, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001)
+	binary.BigEndian.PutUint32(req[4:], stunCookie)
+	if _, err := rand.Read(req[8:]); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return "", err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			return "", err
+		}
+
+		if ip, ok := stunMapped(buf[:n], req[4:20]); ok {
+			return familyIP(ip, family)
+		}
+	}
+
+	return "", fmt.Errorf("config: no STUN response from %s", server)
+}
+
+// stunMapped returns the address in a STUN binding response to the request with the
+// cookie and transaction ID, preferring the XOR-MAPPED-ADDRESS attribute
+func stunMapped(msg []byte, id []byte) (string, bool) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != 0x0101 || string(msg[4:20]) != string(id) {
+		return "", false
+	}
+
+	attrs := msg[20:min(len(msg), 20+int(binary.BigEndian.Uint16(msg[2:])))]
+
+	var mapped string
+	for len(attrs) >= 4 {
+		typ, size := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+size]
+
+		switch typ {
+		case 0x0020:
+			if ip, ok := stunAddress(value, id); ok {
+				return ip, true
+			}
+		case 0x0001:
+			if ip, ok := stunAddress(value, nil); ok {
+				mapped = ip
+			}
+		}
+
+		// Attributes are padded to a multiple of four bytes
+		attrs = attrs[min(len(attrs), 4+(size+3)&^3):]
+	}
+
+	return mapped, mapped != ""
+}
+
+// stunAddress parses the address of a mapped address attribute, which is XORed with the
+// cookie and transaction ID when they are given
+func stunAddress(value []byte, key []byte) (string, bool) {
+	if len(value) < 4 {
+		return "", false
+	}
+
+	var ip []byte
+	switch value[1] {
+	case 0x01:
+		ip = make([]byte, 4)
+	case 0x02:
+		ip = make([]byte, 16)
+	default:
+		return "", false
+	}
+
+	if len(value) < 4+len(ip) {
+		return "", false
+	}
+	copy(ip, value[4:])
+
+	if key != nil {
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+
+	return addr.String(), true
+}
+
+// familyIP returns the address if it is of the family, 4 or 6
+func familyIP(s string, family string) (string, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("config: invalid address %q", s)
+	}
+
+	if addr = addr.Unmap(); addr.Is4() != (family == "4") {
+		return "", fmt.Errorf("config: expected an IPv%s address, got %s", family, addr)
+	}
+
+	return addr.String(), nil
+}
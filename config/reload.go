@@ -0,0 +1,221 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// reloader is what reloading the configuration from its file needs
+type reloader struct {
+	mu sync.Mutex
+
+	// Guards the settings a reload applies, which requests and writing the file read
+	// while the daemon runs
+	live sync.RWMutex
+
+	// The functions called after every reload
+	callbacks []func(*Configuration)
+
+	// The function vault references were resolved with, which the secrets of the file are
+	// resolved with again
+	resolve func(string) (string, error)
+
+	// Whether debug mode was turned on by the command line, which the file cannot turn off
+	debug bool
+
+	// The hash of the file as it was last read or written, which it is watched for changes
+	// from
+	sum [sha256.Size]byte
+}
+
+// written records the contents the daemon wrote to the file
+func (r *reloader) written(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sum = sha256.Sum256(b)
+}
+
+// ForceDebug turns debug mode on whatever the file says, as the debug flag of the command
+// line does
+func (c *Configuration) ForceDebug() {
+	c.reload.live.Lock()
+	defer c.reload.live.Unlock()
+
+	c.Debug = true
+	c.reload.debug = true
+}
+
+// DebugMode returns whether debug mode is on
+func (c *Configuration) DebugMode() bool {
+	c.reload.live.RLock()
+	defer c.reload.live.RUnlock()
+
+	return c.Debug
+}
+
+// PanelAddress returns the host and port the panel API listens on
+func (c *Configuration) PanelAddress() (string, int) {
+	c.reload.live.RLock()
+	defer c.reload.live.RUnlock()
+
+	return c.Panel.Host, c.Panel.Port
+}
+
+// LogLevels returns the logging level and the levels of modules. The map is replaced
+// rather than changed by a reload, so it can be read without the lock
+func (c *Configuration) LogLevels() (string, map[string]string) {
+	c.reload.live.RLock()
+	defer c.reload.live.RUnlock()
+
+	return c.Logging.Level, c.Logging.Modules
+}
+
+// OnReload registers fn to be called with the configuration after every reload, once the
+// settings that can change while the daemon runs have been applied to it. Functions are
+// called in the order they were registered and must not reload or write the configuration
+func (c *Configuration) OnReload(fn func(*Configuration)) {
+	c.reload.mu.Lock()
+	defer c.reload.mu.Unlock()
+
+	c.reload.callbacks = append(c.reload.callbacks, fn)
+}
+
+// Reload reads the file again and applies debug mode, the address of the panel API and
+// the logging levels from it. The sections of the file with other changes are returned,
+// which take effect once the daemon is restarted. Nothing is applied if the file cannot
+// be read or does not validate. What is applied is read through DebugMode, PanelAddress
+// and LogLevels while the daemon runs
+func (c *Configuration) Reload() ([]string, error) {
+	c.reload.mu.Lock()
+	defer c.reload.mu.Unlock()
+
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := parse(c.path, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.reload.resolve != nil {
+		if err := next.ResolveSecrets(c.reload.resolve); err != nil {
+			return nil, err
+		}
+	}
+
+	// A file the daemon would refuse to boot with is not applied either
+	if errs := next.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	pending := c.pending(next)
+
+	c.reload.live.Lock()
+	if !c.reload.debug {
+		c.Debug = next.Debug
+	}
+	c.Panel.Host, c.Panel.Port = next.Panel.Host, next.Panel.Port
+	c.Logging.Level, c.Logging.Modules = next.Logging.Level, next.Logging.Modules
+	c.reload.live.Unlock()
+
+	c.reload.sum = sha256.Sum256(b)
+
+	for _, fn := range c.reload.callbacks {
+		fn(c)
+	}
+
+	return pending, nil
+}
+
+// pending returns the sections of the next configuration that differ from the running
+// one in more than what a reload applies, by their names in the file
+func (c *Configuration) pending(next *Configuration) []string {
+	applied := *next
+	applied.Debug = c.Debug
+
+	panel := *next.Panel
+	panel.Host, panel.Port = c.Panel.Host, c.Panel.Port
+	applied.Panel = &panel
+
+	logging := *next.Logging
+	logging.Level, logging.Modules = c.Logging.Level, c.Logging.Modules
+	applied.Logging = &logging
+
+	var pending []string
+
+	running, read := reflect.ValueOf(*c), reflect.ValueOf(applied)
+	for i := 0; i < running.NumField(); i++ {
+		// The license is found out when the daemon starts rather than configured
+		f := running.Type().Field(i)
+		if !f.IsExported() || f.Name == "License" {
+			continue
+		}
+
+		a, _ := yaml.Marshal(running.Field(i).Interface())
+		b, _ := yaml.Marshal(read.Field(i).Interface())
+		if !bytes.Equal(a, b) {
+			pending = append(pending, strings.ToLower(f.Name))
+		}
+	}
+
+	return pending
+}
+
+// Watch reloads the configuration whenever its file changes, checking it at the interval
+// until the daemon stops. Changes the daemon made itself are not reloaded, and a file
+// that failed to reload is not tried again until it changes
+func (c *Configuration) Watch(interval time.Duration) {
+	var failed [sha256.Size]byte
+
+	for range time.Tick(interval) {
+		b, err := os.ReadFile(c.path)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(b)
+
+		c.reload.mu.Lock()
+		changed := sum != c.reload.sum
+		c.reload.mu.Unlock()
+
+		if !changed || sum == failed {
+			continue
+		}
+
+		zap.S().Named("config").Infow("configuration file changed, reloading", "path", c.path)
+		if err := c.Apply(); err != nil {
+			failed = sum
+		}
+	}
+}
+
+// Apply reloads the configuration, logging what was applied and which changes need a
+// restart, or why it failed
+func (c *Configuration) Apply() error {
+	pending, err := c.Reload()
+	if err != nil {
+		zap.S().Named("config").Errorw("failed to reload configuration, keeping the running one", "path", c.path, zap.Error(err))
+		return err
+	}
+
+	_, port := c.PanelAddress()
+	level, _ := c.LogLevels()
+	zap.S().Named("config").Infow("reloaded configuration", "debug", c.DebugMode(), "port", port, "level", level)
+
+	if len(pending) > 0 {
+		zap.S().Named("config").Warnw("configuration changes take effect once the daemon is restarted", "sections", pending)
+	}
+
+	return nil
+}
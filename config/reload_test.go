@@ -0,0 +1,161 @@
+package config
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// Changes the file as an admin would
+		change func(c *Configuration)
+
+		// Whether the debug flag of the command line was given
+		forced bool
+
+		debug   bool
+		port    int
+		level   string
+		modules map[string]string
+		pending []string
+		err     bool
+	}{
+		{"unchanged", func(c *Configuration) {}, false, false, 8443, "info", nil, nil, false},
+		{"debug", func(c *Configuration) { c.Debug = true }, false, true, 8443, "info", nil, nil, false},
+		{"port", func(c *Configuration) { c.Panel.Port = 9443 }, false, false, 9443, "info", nil, nil, false},
+		{"levels", func(c *Configuration) {
+			c.Logging.Level, c.Logging.Modules = "warn", map[string]string{"dns": "debug"}
+		}, false, false, 8443, "warn", map[string]string{"dns": "debug"}, nil, false},
+		{"debug off from the command line", func(c *Configuration) { c.Debug = false }, true, true, 8443, "info", nil, nil, false},
+		{"needs a restart", func(c *Configuration) {
+			c.Panel.Port = 9443
+			c.PHP.MemoryLimit++
+			c.SSH.Timeout++
+		}, false, false, 9443, "info", nil, []string{"php", "ssh"}, false},
+
+		{"invalid level", func(c *Configuration) { c.Panel.Port, c.Logging.Level = 9443, "loud" }, false, false, 8443, "info", nil, nil, true},
+		{"invalid module level", func(c *Configuration) { c.Logging.Modules = map[string]string{"dns": "loud"} }, false, false, 8443, "info", nil, nil, true},
+		{"invalid port", func(c *Configuration) { c.Debug, c.Panel.Port = true, 70000 }, false, false, 8443, "info", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+
+			initial := NewConfiguration(path)
+			initial.Panel.Port, initial.Logging.Level = 8443, "info"
+			if err := initial.WriteToDisk(); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := ReadConfiguration(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forced {
+				c.ForceDebug()
+			}
+
+			reloaded := 0
+			c.OnReload(func(*Configuration) { reloaded++ })
+
+			next, err := ReadConfiguration(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(next)
+			if err := next.WriteToDisk(); err != nil {
+				t.Fatal(err)
+			}
+
+			pending, err := c.Reload()
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				var errs ValidationErrors
+				if !errors.As(err, &errs) {
+					t.Errorf("error %T, want the validation errors", err)
+				}
+			}
+			if !slices.Equal(pending, tt.pending) {
+				t.Errorf("pending %q, want %q", pending, tt.pending)
+			}
+			if want := map[bool]int{false: 1}[tt.err]; reloaded != want {
+				t.Errorf("called back %d times, want %d", reloaded, want)
+			}
+
+			_, port := c.PanelAddress()
+			level, modules := c.LogLevels()
+			if c.DebugMode() != tt.debug || port != tt.port || level != tt.level || len(modules) != len(tt.modules) {
+				t.Errorf("debug %v, port %d, level %s and modules %v", c.DebugMode(), port, level, modules)
+			}
+			for m, l := range tt.modules {
+				if modules[m] != l {
+					t.Errorf("module %s at %s, want %s", m, modules[m], l)
+				}
+			}
+
+			// Only what a reload applies changes in the running configuration
+			if c.PHP.MemoryLimit != initial.PHP.MemoryLimit || c.SSH.Timeout != initial.SSH.Timeout {
+				t.Errorf("applied settings that need a restart")
+			}
+		})
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := NewConfiguration(path).WriteToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ReadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file as the daemon read or wrote it last is not a change to reload
+	sum := func() [sha256.Size]byte {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha256.Sum256(b)
+	}
+	if c.reload.sum != sum() {
+		t.Error("the file read is seen as changed")
+	}
+
+	c.Debug = true
+	if err := c.WriteToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if c.reload.sum != sum() {
+		t.Error("the file the daemon wrote is seen as changed")
+	}
+
+	// A file that cannot be read or parsed is not applied
+	if err := os.WriteFile(path, []byte("debug: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reload(); err == nil || !c.DebugMode() {
+		t.Errorf("reloading a malformed file: %v", err)
+	}
+	if c.reload.sum == sum() {
+		t.Error("the malformed file is seen as applied")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reload(); err == nil || !c.DebugMode() {
+		t.Errorf("reloading a missing file: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+)
+
+// FieldError is a setting of the configuration that is wrong, by its path in the file
+type FieldError struct {
+	// The setting, such as panel.port
+	Field string `json:"field"`
+
+	// The line of the file the setting is on, when known
+	Line int `json:"line,omitempty"`
+
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s (line %d): %s", e.Field, e.Line, e.Message)
+	}
+
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors are every setting of the configuration that is wrong
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	var sb strings.Builder
+
+	if len(e) == 1 {
+		sb.WriteString("config: 1 setting is wrong:")
+	} else {
+		fmt.Fprintf(&sb, "config: %d settings are wrong:", len(e))
+	}
+
+	for _, fe := range e {
+		sb.WriteString("\n  " + fe.Error())
+	}
+
+	return sb.String()
+}
+
+// strictError matches the errors of decoding the file strictly, which are the keys it
+// has that no setting is read from
+var strictError = regexp.MustCompile(`^line (\d+): (?:field|key) ("[^"]*"|\S+) (not found|already set) in (?:type (.+)|map)$`)
+
+// strict returns the keys of the file that are not settings or are set more than once,
+// which decoding it otherwise ignores
+func strict(b []byte) ValidationErrors {
+	// Decoding into the defaults would find the keys of their maps set already
+	var te *yaml.TypeError
+	if err := yaml.UnmarshalStrict(b, &Configuration{}); !errors.As(err, &te) {
+		return nil
+	}
+
+	sections := paths()
+
+	var list ValidationErrors
+	for _, msg := range te.Errors {
+		m := strictError.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+
+		field := strings.Trim(m[2], `"`)
+		if section := sections[m[4]]; section != "" {
+			field = section + "." + field
+		}
+
+		if m[3] == "already set" {
+			list = append(list, FieldError{Field: field, Line: line, Message: "is set more than once"})
+		} else {
+			list = append(list, FieldError{Field: field, Line: line, Message: "is not a setting, check its spelling and the section it is in"})
+		}
+	}
+
+	return list
+}
+
+// paths returns the path in the file of each section of the configuration by the name of
+// its type, the first one found where a type is used more than once
+func paths() map[string]string {
+	found := map[string]string{}
+
+	var walk func(t reflect.Type, path string)
+	walk = func(t reflect.Type, path string) {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			if t.Kind() == reflect.Map {
+				path += ".*"
+			}
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return
+		}
+
+		if _, ok := found[t.String()]; ok {
+			return
+		}
+		found[t.String()] = path
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name := strings.ToLower(f.Name)
+			if path != "" {
+				name = path + "." + name
+			}
+			walk(f.Type, name)
+		}
+	}
+	walk(reflect.TypeOf(Configuration{}), "")
+
+	return found
+}
+
+// Validate checks the settings the daemon cannot run with, returning every one that is
+// wrong rather than stopping at the first. The file is checked for keys that are not
+// settings when it is read
+func (c *Configuration) Validate() ValidationErrors {
+	list := append(ValidationErrors{}, c.unknown...)
+
+	add := func(field string, format string, args ...interface{}) {
+		list = append(list, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	port := func(field string, p int, optional bool) {
+		if (p != 0 || !optional) && (p < 1 || p > 65535) {
+			add(field, "%d is not a port, which are from 1 to 65535", p)
+		}
+	}
+
+	if c.System.Data == "" {
+		add("system.data", "is required")
+	} else if err := writable(c.System.Data); err != nil {
+		add("system.data", "%v", err)
+	}
+
+	if c.System.Username == "" {
+		add("system.username", "is required")
+	}
+
+	port("panel.port", c.Panel.Port, false)
+	if (c.Panel.Certificate == "") != (c.Panel.Key == "") {
+		add("panel.certificate", "is set without panel.key or the other way round, both are needed to serve HTTPS")
+	}
+
+	port("diagnostics.port", c.Diagnostics.Port, false)
+	port("cluster.port", c.Cluster.Port, true)
+	port("mail.relay.port", c.Mail.Relay.Port, true)
+
+	for _, p := range c.Advisor.TLSPorts {
+		port("advisor.tlsports", p, false)
+	}
+	for _, p := range c.Advisor.AllowedPorts {
+		port("advisor.allowedports", p, false)
+	}
+	for _, p := range c.Certificates.Ports {
+		port("certificates.ports", p, false)
+	}
+
+	if c.Logging.Level != "" {
+		if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+			add("logging.level", "%q is not a level, use debug, info, warn or error", c.Logging.Level)
+		}
+	}
+
+	modules := make([]string, 0, len(c.Logging.Modules))
+	for module := range c.Logging.Modules {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	for _, module := range modules {
+		if _, err := zapcore.ParseLevel(c.Logging.Modules[module]); err != nil {
+			add("logging.modules."+module, "%q is not a level, use debug, info, warn or error", c.Logging.Modules[module])
+		}
+	}
+
+	if c.Bulk.Threshold < 0 || c.Bulk.Threshold > 100 {
+		add("bulk.threshold", "%d is not a percentage", c.Bulk.Threshold)
+	}
+
+	switch c.Logging.Format {
+	case "", "console", "json":
+	default:
+		add("logging.format", "%q is not a format, use console or json", c.Logging.Format)
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	return list
+}
+
+// writable returns why the daemon cannot write to the directory, which it creates when
+// it does not exist yet as long as the nearest directory above it that does is writable
+func writable(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%s is not an absolute path", dir)
+	}
+
+	parent := dir
+	for {
+		info, err := os.Stat(parent)
+		if os.IsNotExist(err) && filepath.Dir(parent) != parent {
+			parent = filepath.Dir(parent)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", parent)
+		}
+
+		break
+	}
+
+	f, err := os.CreateTemp(parent, ".cosmicpanel-")
+	if err != nil && parent != dir {
+		return fmt.Errorf("%s does not exist and cannot be created in %s: %w", dir, parent, errors.Unwrap(err))
+	}
+	if err != nil {
+		return fmt.Errorf("%s is not writable by the daemon: %w", dir, errors.Unwrap(err))
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
@@ -1,74 +1,266 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+	"github.com/cosmicpanel/CosmicPanel/vault"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 )
 
-// Entrypoint for CosmicPanel daemon. Configures the logger,
-// checks any flags that were passed in the boot arguments,
-// and checks for a valid license
+// command is a subcommand of the cosmicpanel binary
+type command struct {
+	Name    string
+	Usage   string
+	Summary string
+	Run     func(args []string) error
+
+	// Left out of the usage as it is only run by the daemon itself
+	Hidden bool
+}
+
+// commands are listed in the order they appear in the usage
+var commands = []command{
+	{Name: "serve", Summary: "Run the panel daemon", Run: serve},
+	{Name: "setup", Summary: "Prepare this server to run the panel", Run: setup},
+	{Name: "service", Usage: "install|uninstall|unit", Summary: "Install the daemon as a service of the init system", Run: service},
+	{Name: "version", Summary: "Print the version of this binary", Run: version},
+	{Name: "self-update", Usage: "[rollback]", Summary: "Update this binary to the latest signed release", Run: selfUpdate},
+	{Name: "config", Usage: "show|check", Summary: "Show or check the configuration", Run: configure},
+	{Name: "account", Usage: "list|create|delete|unlock|password", Summary: "Manage panel users", Run: account},
+	{Name: "license", Usage: "check", Summary: "Check the license of this server", Run: license},
+	{Name: "maintenance", Usage: "on|off|status", Summary: "Turn maintenance mode on or off", Run: maintenance},
+	{Name: "node", Usage: "list|token|remove|join", Summary: "Manage the nodes of a cluster or join one", Run: node},
+	{Name: "backup", Usage: "create", Summary: "Archive the configuration and data directory", Run: backup},
+	{Name: "state", Usage: "export|import", Summary: "Export or import the panel's state as JSON or YAML", Run: panelState},
+	{Name: "migrate", Summary: "Bring the schema of the state store up to date", Run: migrate},
+	{Name: "lsm", Usage: "status|install|uninstall|relabel", Summary: "Manage the SELinux or AppArmor policy of the panel", Run: securityModule},
+	{Name: "doctor", Summary: "Check that this server meets the panel's requirements", Run: doctor},
+	{Name: "plugin", Usage: "keygen|sign|verify", Summary: "Create signing keys, sign plugins or check their signatures", Run: plugin},
+	{Name: "sdk", Usage: "openapi|go|typescript [file]", Summary: "Generate the API definition or a Go or TypeScript client of it", Run: generateSDK},
+	{Name: "diag", Usage: "info|goroutines|profile", Summary: "Inspect the running daemon through its diagnostics server", Run: diag},
+	{Name: "broker", Summary: "Run privileged commands for a daemon that dropped root", Run: broker, Hidden: true},
+}
+
+// Entrypoint for the CosmicPanel binary. Runs the command named by the first argument,
+// or the daemon if there is none so that existing service definitions passing only
+// flags keep working
 func main() {
-	configPath := *flag.String("config", "config.yml", "Sets the location for the configuration file")
-	debug := *flag.Bool("debug", false, "Pass in debug inorder to run CosmicPanel in debug mode")
-	dnsonly := *flag.Bool("dnsonly", false, "Pass in dnsonly to recieve a dns only license instead of trial license")
+	defer crash.RecoverFatal("main")
+
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
 
-	flag.Parse()
+	for _, cmd := range commands {
+		if cmd.Name != name {
+			continue
+		}
 
-	zap.S().Infof("Using configuration file: %s", configPath)
+		if err := cmd.Run(args); err != nil {
+			fmt.Fprintf(os.Stderr, "cosmicpanel %s: %v\n", name, err)
+			os.Exit(1)
+		}
 
-	c, err := config.ReadConfiguration(configPath)
-	if err != nil {
-		panic(err)
 		return
 	}
 
-	if debug {
-		c.Debug = true
+	fmt.Fprintf(os.Stderr, "cosmicpanel: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// usage prints the commands to stderr
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: cosmicpanel <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		if cmd.Hidden {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, cmd.Summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun cosmicpanel <command> -h for the flags of a command\n")
+}
+
+// options are the flags shared by every command that loads the configuration
+type options struct {
+	config string
+	debug  bool
+
+	// How results are printed, as a table or text for people or as JSON or YAML for
+	// scripts
+	output string
 
-	if err := ConfigureLogging(c.Debug); err != nil {
-		panic(err)
+	// Set by serve. Other commands only log warnings so that their output stays readable
+	daemon bool
+
+	// Set by serve and config check, which refuse a configuration with wrong settings
+	// before anything is configured from it
+	validate bool
+}
+
+// flags returns the flag set for a command with the shared flags registered
+func (o *options) flags(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&o.config, "config", "config.yml", "Sets the location for the configuration file")
+	fs.BoolVar(&o.debug, "debug", false, "Run in debug mode, overriding the configuration file")
+
+	// The daemon has no results to print
+	if !o.daemon {
+		o.outputFlag(fs)
 	}
 
-	if c.Debug {
-		zap.S().Debugw("running in debug mode")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cosmicpanel %s [flags] %s\n\nFlags:\n", name, usage)
+		fs.PrintDefaults()
 	}
 
-	zap.S().Infof("Checking for CosmicPanel system user...")
-	if _, err := c.EnsureUser(); err != nil {
-		zap.S().Panicw("Failed to create CosmicPanel system user", zap.Error(err))
-	} else {
-		zap.S().Infow("Configured system user...")
+	return fs
+}
+
+// outputFlag registers the -output flag, which commands that do not load the
+// configuration register on its own
+func (o *options) outputFlag(fs *flag.FlagSet) {
+	fs.StringVar(&o.output, "output", "table", "How results are printed, one of table, json or yaml")
+}
+
+// print writes the result of a command in the format chosen with -output, calling table
+// to print it for people. JSON and YAML use the same keys so that scripts can switch
+// between them
+func (o *options) print(v interface{}, table func() error) error {
+	switch o.output {
+	case "", "table":
+		return table()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		b, err := marshalYAML(v)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(b)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, use table, json or yaml", o.output)
 	}
+}
 
-	// check for valid license
-	zap.S().Infof("Checking for vaid license...")
-	c.CheckLicense(dnsonly)
-	
+// marshalYAML encodes the value as YAML with the keys it has in JSON
+func marshalYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(generic)
 }
 
-// ConfigureLogging configures the global logger for Zap so that we can call it from any location
-// in the code without having to pass around a logger instance
-func ConfigureLogging(debug bool) error {
-	cfg := zap.NewProductionConfig()
-	if debug {
-		cfg = zap.NewDevelopmentConfig()
+// parse parses the flags of a command, which may come before or after its arguments, and
+// returns the arguments
+func parse(fs *flag.FlagSet, args []string) []string {
+	if describing {
+		panic(described{fs})
+	}
+
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
 	}
+}
 
-	cfg.Encoding = "console"
-	cfg.OutputPaths = []string{
-		"stdout",
+// arg returns the argument at the index, or an empty string if there are fewer
+func arg(args []string, i int) string {
+	if i >= len(args) {
+		return ""
 	}
 
-	logger, err := cfg.Build()
+	return args[i]
+}
+
+// bootstrap reads the configuration, resolves its secrets from the vault and configures
+// logging and crash reporting, which every command touching the panel's state needs
+func bootstrap(o *options) (*config.Configuration, error) {
+	c, err := config.ReadConfiguration(o.config)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if o.debug {
+		c.ForceDebug()
+	}
+
+	// Every wrong setting is reported at once, rather than the modules using them failing
+	// one by one once the daemon is running
+	if o.validate {
+		if errs := c.Validate(); len(errs) > 0 {
+			return nil, errs
+		}
+	}
+
+	// The vault is opened before anything else reads the credentials in the configuration
+	if err := vault.Configure(c.System.Data, c.Vault); err != nil {
+		return nil, err
+	}
+
+	if err := c.ResolveSecrets(vault.Resolve); err != nil {
+		return nil, err
+	}
+
+	err = httpx.Configure(httpx.Options{
+		Proxy:            c.HTTP.Proxy,
+		NoProxy:          c.HTTP.NoProxy,
+		IdleConnsPerHost: c.HTTP.IdleConnsPerHost,
+		ConnsPerHost:     c.HTTP.ConnsPerHost,
+		IdleTimeout:      time.Duration(c.HTTP.IdleTimeout) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := logging.ConfigureLogging(c.Debug, c.Logging); err != nil {
+		return nil, err
+	}
+
+	if !o.daemon && !c.Debug {
+		logging.SetLevel("warn")
+	}
+
+	zap.S().Infof("Using configuration file: %s", o.config)
+
+	if c.Debug {
+		zap.S().Debugw("running in debug mode")
 	}
 
-	zap.ReplaceGlobals(logger)
+	crash.Configure(c.System.Data, c.Crash)
 
-	return nil
+	return c, nil
 }
@@ -0,0 +1,158 @@
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/diagnostics"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+// Report describes a recovered panic. It is written to report.json in the crash bundle
+// and submitted to the crash reporting endpoint if one is configured
+type Report struct {
+	ID        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Component string            `json:"component"`
+	Message   string            `json:"message"`
+	Stack     string            `json:"stack"`
+	Frames    []Frame           `json:"frames"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Runtime   diagnostics.Info  `json:"runtime"`
+}
+
+// Frame is a single function call in the stack of the panicking goroutine
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+var (
+	dir    string
+	report *config.CrashConfiguration
+)
+
+// Configure sets the directory crash bundles are written to and the settings used to
+// submit reports. Panics recovered before Configure is called are only logged
+func Configure(dataDir string, c *config.CrashConfiguration) {
+	dir = filepath.Join(dataDir, "crash")
+	report = c
+}
+
+// Recover recovers a panic in the calling goroutine and records a crash report for it.
+// It must be called directly with defer
+func Recover(component string) {
+	if r := recover(); r != nil {
+		Capture(component, r, nil)
+	}
+}
+
+// RecoverFatal recovers a panic, records a crash report and then exits the process. It
+// is deferred at the top of main so that a panic during boot still leaves a report
+func RecoverFatal(component string) {
+	if r := recover(); r != nil {
+		Capture(component, r, nil)
+		zap.L().Sync()
+		os.Exit(2)
+	}
+}
+
+// Go runs the function in a new goroutine that records a crash report instead of taking
+// down the whole daemon if the function panics
+func Go(component string, fn func()) {
+	go func() {
+		defer Recover(component)
+
+		fn()
+	}()
+}
+
+// Capture builds a report for a recovered value, writes the crash bundle and submits
+// the report if a reporting endpoint is configured
+func Capture(component string, r interface{}, tags map[string]string) *Report {
+	rep := &Report{
+		// Sentry expects event IDs of 32 hex characters
+		ID:        ids.Hex(16),
+		Time:      time.Now().UTC(),
+		Component: component,
+		Message:   fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+		Frames:    callers(),
+		Tags:      tags,
+		Runtime:   diagnostics.CollectInfo(),
+	}
+
+	zap.S().Errorw("recovered from panic", "component", component, "crash_id", rep.ID, "panic", rep.Message, "stack", rep.Stack)
+
+	if dir == "" {
+		fmt.Fprintf(os.Stderr, "panic in %s: %s\n\n%s", component, rep.Message, rep.Stack)
+	} else {
+		if path, err := rep.write(); err != nil {
+			zap.S().Errorw("failed to write crash report", "crash_id", rep.ID, zap.Error(err))
+		} else {
+			zap.S().Infow("wrote crash report", "crash_id", rep.ID, "path", path)
+		}
+	}
+
+	if report != nil && report.Dsn != "" {
+		if err := submit(report, rep); err != nil {
+			zap.S().Warnw("failed to submit crash report", "crash_id", rep.ID, zap.Error(err))
+		}
+	}
+
+	return rep
+}
+
+// write creates the crash bundle directory containing the report and a dump of every
+// running goroutine, returning the path of the bundle
+func (rep *Report) write() (string, error) {
+	path := filepath.Join(dir, rep.Time.Format("20060102-150405")+"-"+rep.ID[:8])
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(path, "report.json"), b, 0600); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(filepath.Join(path, "goroutines.txt"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return path, pprof.Lookup("goroutine").WriteTo(f, 2)
+}
+
+// callers returns the stack frames of the panicking goroutine, skipping the runtime and
+// crash package frames
+func callers() []Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(5, pcs)
+
+	var out []Frame
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		f, more := frames.Next()
+		out = append(out, Frame{Function: f.Function, File: f.File, Line: f.Line})
+		if !more {
+			break
+		}
+	}
+
+	return out
+}
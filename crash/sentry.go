@@ -0,0 +1,108 @@
+package crash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// sentryEvent is the subset of the Sentry event payload used for crash reports. Any
+// service implementing the Sentry store API can receive these reports
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+// submit sends the report to the store endpoint derived from the DSN, which has the
+// format https://<key>@<host>/<project>
+func submit(c *config.CrashConfiguration, rep *Report) error {
+	dsn, err := url.Parse(c.Dsn)
+	if err != nil {
+		return err
+	}
+
+	if dsn.User == nil {
+		return fmt.Errorf("crash: DSN is missing the public key")
+	}
+
+	project := strings.Trim(dsn.Path, "/")
+	endpoint := fmt.Sprintf("%s://%s/api/%s/store/", dsn.Scheme, dsn.Host, project)
+
+	ev := sentryEvent{
+		EventID:     rep.ID,
+		Timestamp:   rep.Time.Format(time.RFC3339),
+		Level:       "fatal",
+		Platform:    "go",
+		Logger:      rep.Component,
+		Release:     rep.Runtime.Version,
+		Environment: c.Environment,
+		ServerName:  c.ServerName,
+		Message:     rep.Message,
+		Tags:        rep.Tags,
+	}
+
+	exc := sentryException{Type: "panic", Value: rep.Message}
+	// Sentry expects frames ordered from the outermost call to the innermost
+	for i := len(rep.Frames) - 1; i >= 0; i-- {
+		f := rep.Frames[i]
+		exc.Stacktrace.Frames = append(exc.Stacktrace.Frames, sentryFrame{Function: f.Function, Filename: f.File, Lineno: f.Line})
+	}
+	ev.Exception.Values = []sentryException{exc}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=cosmicpanel/1.0, sentry_key=%s", dsn.User.Username()))
+
+	client := httpx.Client(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("crash: reporting endpoint returned unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
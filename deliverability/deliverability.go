@@ -0,0 +1,402 @@
+package deliverability
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when checking domains before Configure is called
+	ErrNotConfigured = errors.New("deliverability: not configured")
+
+	// ErrNotFound is returned for a domain that is not hosted here or has not been checked
+	ErrNotFound = errors.New("deliverability: domain not found")
+)
+
+// The status of a check
+const (
+	OK      = "ok"
+	Warning = "warning"
+	Failed  = "failed"
+	Skipped = "skipped"
+)
+
+// minimum is the fewest deliveries or messages in DMARC reports a rate is alerted about
+// with, so that a domain that sent two messages and had one bounce is not
+const minimum = 20
+
+// timeout bounds the DNS lookups of checking one domain
+const timeout = time.Minute
+
+// Check is the result of checking one thing about a domain or an address
+type Check struct {
+	Status string `json:"status"`
+
+	// What was found, such as the SPF record of the domain or the name an address
+	// resolves to
+	Record  string `json:"record,omitempty"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// Address is an address the mail of a domain leaves the server from
+type Address struct {
+	Address string `json:"address"`
+
+	// Whether the address resolves to a name that resolves back to it, which receivers
+	// expect of a mail server
+	ReverseDNS Check `json:"reverse_dns"`
+
+	// Whether the address is on any of the blocklists, and which
+	Blocklists Check    `json:"blocklists"`
+	Listed     []string `json:"listed"`
+}
+
+// Domain is how likely the mail a domain sends is to be delivered, as last checked
+type Domain struct {
+	Name string `json:"name"`
+
+	// The ID of the user the domain belongs to
+	Owner string `json:"owner"`
+
+	Checked time.Time `json:"checked"`
+
+	SPF   Check `json:"spf"`
+	DKIM  Check `json:"dkim"`
+	DMARC Check `json:"dmarc"`
+
+	// The dedicated addresses of the domain, or the addresses of the server when it has
+	// none
+	Addresses []Address `json:"addresses"`
+
+	// The outcomes of the mail the domain sent and what DMARC reports say about the mail
+	// sent as it, over the configured number of days
+	Days       int            `json:"days"`
+	Mail       stats.Outcomes `json:"mail"`
+	BounceRate float64        `json:"bounce_rate"`
+	Reports    Summary        `json:"reports"`
+
+	// The problems found, which are alerted about when they are first found
+	Alerts []string `json:"alerts"`
+}
+
+// domainKind is what the last check of every domain is kept under in the state store,
+// so that only new problems are alerted about
+const domainKind = "deliverability.domain"
+
+type checker struct {
+	mu     sync.Mutex
+	config *config.DeliverabilityConfiguration
+
+	// The public addresses of the server, which mail leaves from unless a domain has a
+	// dedicated address
+	public func() (string, string)
+}
+
+var std *checker
+
+// Configure sets how domains are checked. The public addresses of the server are looked
+// up on every check, since they may change
+func Configure(c *config.DeliverabilityConfiguration, public func() (string, string)) error {
+	switch {
+	case c.Days <= 0:
+		return errors.New("deliverability: days must be more than zero")
+	case c.Retain < c.Days:
+		return errors.New("deliverability: reports must be kept for at least as many days as are looked at")
+	case c.BounceRate < 0 || c.BounceRate > 100 || c.DMARCPass < 0 || c.DMARCPass > 100:
+		return errors.New("deliverability: the bounce and DMARC pass rates must be percentages")
+	}
+
+	std = &checker{config: c, public: public}
+
+	return nil
+}
+
+// Scheduled reads the DMARC reports delivered since the last run, checks every hosted
+// domain and alerts about the problems that are new since it was last checked
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	var errs []error
+	if std.config.Reports != "" {
+		if err := readReports(std.config.Reports); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := expireReports(time.Now().AddDate(0, 0, -std.config.Retain)); err != nil {
+		errs = append(errs, err)
+	}
+
+	domains, err := registrar.List()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	checked := make(map[string]Address)
+	for _, d := range domains {
+		if _, err := std.check(d, checked); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Name, err))
+		}
+	}
+
+	// Domains that are no longer hosted are forgotten
+	err = store.Update(func(tx *store.Tx) error {
+		var gone []string
+		err := tx.Each(domainKind, func(id string, _ []byte) error {
+			if !slices.ContainsFunc(domains, func(d registrar.Domain) bool { return d.Name == id }) {
+				gone = append(gone, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range gone {
+			if err := tx.Delete(domainKind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Recheck checks the domain now rather than waiting for the next run
+func Recheck(name string) (Domain, error) {
+	if std == nil {
+		return Domain{}, ErrNotConfigured
+	}
+
+	d, err := registrar.Get(name)
+	if errors.Is(err, registrar.ErrNotFound) {
+		return Domain{}, ErrNotFound
+	} else if err != nil {
+		return Domain{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.check(d, make(map[string]Address))
+}
+
+// List returns the last check of the domains of the owners, or of every domain when no
+// owners are given, sorted by name
+func List(owners ...string) ([]Domain, error) {
+	list := []Domain{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(domainKind, func(id string, data []byte) error {
+			var d Domain
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("deliverability: malformed domain %s: %w", id, err)
+			}
+
+			if len(owners) == 0 || slices.Contains(owners, d.Owner) {
+				list = append(list, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(list, func(a, b Domain) int { return strings.Compare(a.Name, b.Name) })
+
+	return list, nil
+}
+
+// Get returns the last check of the domain
+func Get(name string) (Domain, error) {
+	var d Domain
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(domainKind, strings.ToLower(name), &d)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Domain{}, ErrNotFound
+	}
+
+	return d, err
+}
+
+// check checks the domain, keeps the result and alerts about new problems. Addresses
+// are only checked once per run, in the map. The checker must be locked
+func (c *checker) check(rd registrar.Domain, checked map[string]Address) (Domain, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	d := Domain{
+		Name:      rd.Name,
+		Owner:     rd.Owner,
+		Checked:   time.Now().UTC(),
+		Addresses: []Address{},
+		Days:      c.config.Days,
+	}
+
+	for _, ip := range c.sendingAddresses(rd.Name) {
+		a, ok := checked[ip.String()]
+		if !ok {
+			a = checkAddress(ctx, ip, c.config.Blocklists)
+			checked[ip.String()] = a
+		}
+		d.Addresses = append(d.Addresses, a)
+	}
+
+	d.SPF = checkSPF(ctx, rd.Name, d.Addresses)
+	d.DKIM = checkDKIM(ctx, rd.Name, c.config.Selectors)
+	d.DMARC = checkDMARC(ctx, rd.Name)
+
+	var err error
+	if d.Mail, err = stats.MailOutcomes(rd.Name, c.config.Days); err != nil && !errors.Is(err, stats.ErrNotConfigured) {
+		return Domain{}, err
+	}
+	d.BounceRate = round(d.Mail.BounceRate())
+
+	if d.Reports, err = summarize(rd.Name, time.Now().AddDate(0, 0, -c.config.Days)); err != nil {
+		return Domain{}, err
+	}
+
+	d.Alerts = c.alerts(d)
+
+	var before Domain
+	err = store.Update(func(tx *store.Tx) error {
+		if err := tx.Get(domainKind, d.Name, &before); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+
+		return tx.Put(domainKind, d.Name, d)
+	})
+	if err != nil {
+		return Domain{}, err
+	}
+
+	var added []string
+	for _, a := range d.Alerts {
+		if !slices.Contains(before.Alerts, a) {
+			added = append(added, a)
+		}
+	}
+
+	if len(added) > 0 {
+		c.alert(d, added)
+	}
+
+	return d, nil
+}
+
+// sendingAddresses returns the addresses the mail of the domain leaves from, which are
+// its dedicated addresses or otherwise the public addresses of the server
+func (c *checker) sendingAddresses(domain string) []netip.Addr {
+	var list []netip.Addr
+	for _, d := range addresses.Pool() {
+		if strings.EqualFold(d.Domain, domain) {
+			list = append(list, d.Address)
+		}
+	}
+
+	if len(list) > 0 {
+		return list
+	}
+
+	v4, v6 := c.public()
+	for _, s := range []string{v4, v6} {
+		if ip, err := netip.ParseAddr(s); err == nil {
+			list = append(list, ip.Unmap())
+		}
+	}
+
+	return list
+}
+
+// alerts returns the problems with the domain that are worth telling its owner about.
+// Warnings are shown but not alerted about
+func (c *checker) alerts(d Domain) []string {
+	alerts := []string{}
+
+	for _, check := range []struct {
+		name string
+		Check
+	}{{"SPF", d.SPF}, {"DKIM", d.DKIM}, {"DMARC", d.DMARC}} {
+		if check.Status == Failed {
+			alerts = append(alerts, check.name+": "+check.Problem)
+		}
+	}
+
+	for _, a := range d.Addresses {
+		if a.ReverseDNS.Status == Failed {
+			alerts = append(alerts, a.Address+": "+a.ReverseDNS.Problem)
+		}
+		if a.Blocklists.Status == Failed {
+			alerts = append(alerts, a.Address+": "+a.Blocklists.Problem)
+		}
+	}
+
+	if d.Mail.Sent+d.Mail.Bounced >= minimum && d.BounceRate > c.config.BounceRate {
+		alerts = append(alerts, fmt.Sprintf("%g%% of the mail sent in the last %d days bounced", d.BounceRate, d.Days))
+	}
+
+	if d.Reports.Messages >= minimum && d.Reports.PassRate < c.config.DMARCPass {
+		alerts = append(alerts, fmt.Sprintf("only %g%% of the messages DMARC reports saw in the last %d days passed", d.Reports.PassRate, d.Days))
+	}
+
+	return alerts
+}
+
+// alert publishes the new problems with the domain, and notifies its owner if the
+// configuration says so
+func (c *checker) alert(d Domain, added []string) {
+	u, err := auth.GetUser(d.Owner)
+	if err != nil {
+		zap.S().Named("deliverability").Warnw("failed to find the owner of a domain", "domain", d.Name, "owner", d.Owner, zap.Error(err))
+	}
+
+	events.Publish(events.Event{
+		Type:     "deliverability.alert",
+		Account:  u.Username,
+		Reseller: u.Reseller(),
+		Resource: d.Name,
+		Data:     map[string]interface{}{"alerts": added},
+	})
+
+	if !c.config.Notify || err != nil {
+		return
+	}
+
+	data := map[string]interface{}{"Username": u.Username, "Domain": d.Name, "Alerts": added}
+	if err := auth.Notify(u, "deliverability_alert", data); err != nil {
+		zap.S().Named("deliverability").Warnw("failed to notify the owner of a domain", "domain", d.Name, "owner", u.Username, zap.Error(err))
+	}
+}
+
+// round rounds a percentage to one decimal
+func round(percent float64) float64 {
+	return float64(int64(percent*10+0.5)) / 10
+}
@@ -0,0 +1,478 @@
+package deliverability
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidReport is returned for an upload without a DMARC aggregate report in it
+var ErrInvalidReport = errors.New("deliverability: not a DMARC aggregate report")
+
+// maxReportSize is the largest a report is read to, once uncompressed, so that a
+// compressed report cannot fill the memory of the panel
+const maxReportSize = 32 << 20
+
+// maxFailing is how many of the sources sending mail that fails DMARC are summarized
+const maxFailing = 10
+
+// reportKind is what DMARC aggregate reports are kept under in the state store
+const reportKind = "deliverability.report"
+
+// Report is a DMARC aggregate report a receiver sent about the mail it got from a domain
+type Report struct {
+	// The organization that sent the report and its ID for it, which are unique together
+	ID  string `json:"id"`
+	Org string `json:"org"`
+
+	Domain string    `json:"domain"`
+	Begin  time.Time `json:"begin"`
+	End    time.Time `json:"end"`
+
+	// The policy the domain published when the receiver checked its mail
+	Policy string `json:"policy"`
+
+	// The messages the report covers and how many passed DMARC, with either an aligned
+	// DKIM signature or an aligned SPF pass
+	Messages int64 `json:"messages"`
+	Passed   int64 `json:"passed"`
+
+	Rows []Row `json:"rows"`
+
+	Received time.Time `json:"received"`
+}
+
+// Row is the messages a receiver got from one address with the same results
+type Row struct {
+	Source   string `json:"source"`
+	Messages int64  `json:"messages"`
+
+	// What the receiver did with them, such as none, quarantine or reject
+	Disposition string `json:"disposition"`
+	DKIM        string `json:"dkim"`
+	SPF         string `json:"spf"`
+}
+
+// Summary is what the DMARC reports about a domain say about its mail over some days
+type Summary struct {
+	Reports  int     `json:"reports"`
+	Messages int64   `json:"messages"`
+	Passed   int64   `json:"passed"`
+	PassRate float64 `json:"pass_rate"`
+
+	// The addresses that sent the most mail as the domain that failed DMARC, most first,
+	// which are either servers missing from its SPF record or someone spoofing it
+	Failing []Source `json:"failing"`
+}
+
+// Source is an address that sent mail as a domain
+type Source struct {
+	Address  string `json:"address"`
+	Messages int64  `json:"messages"`
+}
+
+// feedback is a DMARC aggregate report as receivers send it
+type feedback struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		Org       string `xml:"org_name"`
+		ID        string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		P      string `xml:"p"`
+	} `xml:"policy_published"`
+	Records []struct {
+		Row struct {
+			Source    string `xml:"source_ip"`
+			Count     int64  `xml:"count"`
+			Evaluated struct {
+				Disposition string `xml:"disposition"`
+				DKIM        string `xml:"dkim"`
+				SPF         string `xml:"spf"`
+			} `xml:"policy_evaluated"`
+		} `xml:"row"`
+	} `xml:"record"`
+}
+
+// Ingest reads the DMARC aggregate reports in an upload, which is a report as XML, gzip
+// or zip, or a whole message with reports attached. Reports about domains that are not
+// hosted here are skipped, and a report that was ingested before is replaced
+func Ingest(r io.Reader) ([]Report, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxReportSize {
+		return nil, fmt.Errorf("%w, it is larger than %d MB", ErrInvalidReport, maxReportSize>>20)
+	}
+
+	var found []feedback
+	if err := unpack(data, &found, 0); err != nil {
+		return nil, err
+	} else if len(found) == 0 {
+		return nil, ErrInvalidReport
+	}
+
+	list := []Report{}
+	for _, f := range found {
+		rep := f.report()
+		if _, err := registrar.Get(rep.Domain); errors.Is(err, registrar.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		list = append(list, rep)
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		for _, rep := range list {
+			if err := tx.Put(reportKind, rep.ID, rep); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Reports returns the DMARC reports kept about the domain, newest first
+func Reports(domain string) ([]Report, error) {
+	list := []Report{}
+
+	err := eachReport(func(r Report) {
+		if r.Domain == strings.ToLower(domain) {
+			list = append(list, r)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(list, func(a, b Report) int { return b.End.Compare(a.End) })
+
+	return list, nil
+}
+
+// report returns the report as it is kept
+func (f feedback) report() Report {
+	r := Report{
+		ID:       f.Metadata.Org + "!" + f.Metadata.ID,
+		Org:      f.Metadata.Org,
+		Domain:   strings.ToLower(strings.TrimSpace(f.Policy.Domain)),
+		Begin:    time.Unix(f.Metadata.DateRange.Begin, 0).UTC(),
+		End:      time.Unix(f.Metadata.DateRange.End, 0).UTC(),
+		Policy:   f.Policy.P,
+		Rows:     []Row{},
+		Received: time.Now().UTC(),
+	}
+
+	for _, rec := range f.Records {
+		row := Row{
+			Source:      rec.Row.Source,
+			Messages:    rec.Row.Count,
+			Disposition: rec.Row.Evaluated.Disposition,
+			DKIM:        rec.Row.Evaluated.DKIM,
+			SPF:         rec.Row.Evaluated.SPF,
+		}
+		r.Rows = append(r.Rows, row)
+
+		r.Messages += row.Messages
+		if row.DKIM == "pass" || row.SPF == "pass" {
+			r.Passed += row.Messages
+		}
+	}
+
+	return r
+}
+
+// unpack adds the reports in the data to the list, uncompressing it or taking the
+// attachments out of a message first. Depth bounds how far archives and messages nest
+func unpack(data []byte, found *[]feedback, depth int) error {
+	if depth > 3 {
+		return nil
+	}
+
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidReport, err)
+		}
+
+		b, err := readLimited(zr)
+		if err != nil {
+			return err
+		}
+		return unpack(b, found, depth+1)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidReport, err)
+		}
+
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidReport, err)
+			}
+
+			b, err := readLimited(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+
+			if err := unpack(b, found, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		var f feedback
+		if err := xml.Unmarshal(trimmed, &f); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidReport, err)
+		}
+
+		if f.Metadata.ID == "" || f.Policy.Domain == "" {
+			return fmt.Errorf("%w, it has no report ID or domain", ErrInvalidReport)
+		}
+		*found = append(*found, f)
+		return nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ErrInvalidReport
+	}
+
+	return unpackPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, found, depth+1)
+}
+
+// unpackPart adds the reports in a part of a message to the list, going through every
+// part of one with several
+func unpackPart(contentType string, encoding string, body io.Reader, found *[]feedback, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidReport, err)
+			}
+
+			// A part without a report is skipped, since the others may have one
+			err = unpackPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, found, depth)
+			if err != nil && !errors.Is(err, ErrInvalidReport) {
+				return err
+			}
+		}
+	}
+
+	// Text parts, such as the message saying the report is attached, have no report
+	if strings.HasPrefix(mediaType, "text/") && mediaType != "text/xml" {
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, newlineSkipper{body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	b, err := readLimited(body)
+	if err != nil {
+		return err
+	}
+
+	return unpack(b, found, depth)
+}
+
+// newlineSkipper drops the line breaks base64 in a message is wrapped with
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (s newlineSkipper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	kept := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[kept] = c
+			kept++
+		}
+	}
+
+	return kept, err
+}
+
+// readLimited reads what was uncompressed or decoded, up to the largest report
+func readLimited(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReport, err)
+	} else if len(b) > maxReportSize {
+		return nil, fmt.Errorf("%w, it is larger than %d MB uncompressed", ErrInvalidReport, maxReportSize>>20)
+	}
+
+	return b, nil
+}
+
+// readReports ingests every file in the directory, removing those that were read. Files
+// without a report are renamed with an .invalid suffix and no longer read
+func readReports(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".invalid") {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		list, err := Ingest(f)
+		f.Close()
+
+		switch {
+		case errors.Is(err, ErrInvalidReport):
+			zap.S().Named("deliverability").Warnw("skipping a file without a DMARC report", "path", path, zap.Error(err))
+			if err := os.Rename(path, path+".invalid"); err != nil {
+				errs = append(errs, err)
+			}
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		default:
+			zap.S().Named("deliverability").Debugw("read DMARC reports", "path", path, "reports", len(list))
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// expireReports removes the reports that ended before the time
+func expireReports(before time.Time) error {
+	return store.Update(func(tx *store.Tx) error {
+		var expired []string
+		err := tx.Each(reportKind, func(id string, data []byte) error {
+			var r Report
+			if json.Unmarshal(data, &r) == nil && r.End.Before(before) {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			if err := tx.Delete(reportKind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// summarize adds up the reports about the domain that ended after the time
+func summarize(domain string, since time.Time) (Summary, error) {
+	s := Summary{Failing: []Source{}}
+	failing := make(map[string]int64)
+
+	err := eachReport(func(r Report) {
+		if r.Domain != domain || r.End.Before(since) {
+			return
+		}
+
+		s.Reports++
+		s.Messages += r.Messages
+		s.Passed += r.Passed
+
+		for _, row := range r.Rows {
+			if row.DKIM != "pass" && row.SPF != "pass" {
+				failing[row.Source] += row.Messages
+			}
+		}
+	})
+	if err != nil {
+		return Summary{}, err
+	}
+
+	if s.Messages > 0 {
+		s.PassRate = round(float64(s.Passed) * 100 / float64(s.Messages))
+	}
+
+	for address, messages := range failing {
+		s.Failing = append(s.Failing, Source{Address: address, Messages: messages})
+	}
+	slices.SortFunc(s.Failing, func(a, b Source) int {
+		if a.Messages != b.Messages {
+			return cmp.Compare(b.Messages, a.Messages)
+		}
+		return strings.Compare(a.Address, b.Address)
+	})
+	if len(s.Failing) > maxFailing {
+		s.Failing = s.Failing[:maxFailing]
+	}
+
+	return s, nil
+}
+
+// eachReport calls the function with every report kept
+func eachReport(fn func(Report)) error {
+	return store.View(func(tx *store.Tx) error {
+		return tx.Each(reportKind, func(id string, data []byte) error {
+			var r Report
+			if err := json.Unmarshal(data, &r); err != nil {
+				return fmt.Errorf("deliverability: malformed report %s: %w", id, err)
+			}
+
+			fn(r)
+			return nil
+		})
+	})
+}
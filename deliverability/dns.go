@@ -0,0 +1,384 @@
+package deliverability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxLookups is how many DNS lookups receivers allow evaluating an SPF policy to take
+const maxLookups = 10
+
+// errTooManyLookups is returned for an SPF policy that takes more lookups than receivers
+// allow, which they treat as an error
+var errTooManyLookups = fmt.Errorf("the policy takes more than %d DNS lookups", maxLookups)
+
+// checkAddress checks that the address resolves to a name that resolves back to it and
+// that it is not on any of the blocklists
+func checkAddress(ctx context.Context, ip netip.Addr, blocklists []string) Address {
+	a := Address{Address: ip.String(), Listed: []string{}}
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	switch {
+	case notFound(err) || (err == nil && len(names) == 0):
+		a.ReverseDNS = Check{Status: Failed, Problem: "the address has no reverse DNS"}
+	case err != nil:
+		a.ReverseDNS = Check{Status: Warning, Problem: err.Error()}
+	default:
+		name := strings.TrimSuffix(names[0], ".")
+		a.ReverseDNS = Check{Status: OK, Record: name}
+
+		forward, err := net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+		if err != nil && !notFound(err) {
+			a.ReverseDNS = Check{Status: Warning, Record: name, Problem: err.Error()}
+		} else if !slices.ContainsFunc(forward, func(f netip.Addr) bool { return f.Unmap() == ip }) {
+			a.ReverseDNS = Check{Status: Failed, Record: name, Problem: "the reverse DNS name " + name + " does not resolve back to the address"}
+		}
+	}
+
+	var refused []string
+	for _, zone := range blocklists {
+		answers, err := net.DefaultResolver.LookupHost(ctx, dnsblName(ip)+"."+zone)
+		if err != nil {
+			continue
+		}
+
+		// Spamhaus answers 127.255.255.0/24 when it refuses the query rather than with a
+		// listing, such as for queries through public resolvers
+		if slices.ContainsFunc(answers, func(s string) bool { return strings.HasPrefix(s, "127.255.255.") }) {
+			refused = append(refused, zone)
+		} else if slices.ContainsFunc(answers, func(s string) bool { return strings.HasPrefix(s, "127.") }) {
+			a.Listed = append(a.Listed, zone)
+		}
+	}
+
+	switch {
+	case len(a.Listed) > 0:
+		a.Blocklists = Check{Status: Failed, Problem: "the address is listed on " + strings.Join(a.Listed, ", ")}
+	case len(refused) > 0:
+		a.Blocklists = Check{Status: Warning, Problem: strings.Join(refused, ", ") + " refused the lookup, use a resolver of your own"}
+	case len(blocklists) == 0:
+		a.Blocklists = Check{Status: Skipped}
+	default:
+		a.Blocklists = Check{Status: OK}
+	}
+
+	return a
+}
+
+// dnsblName returns the name the address is looked up under in a blocklist, which is
+// its octets or the nibbles of an IPv6 address in reverse
+func dnsblName(ip netip.Addr) string {
+	b := ip.AsSlice()
+	parts := make([]string, 0, len(b)*2)
+
+	for i := len(b) - 1; i >= 0; i-- {
+		if ip.Is4() {
+			parts = append(parts, strconv.Itoa(int(b[i])))
+		} else {
+			parts = append(parts, strconv.FormatUint(uint64(b[i]&0xf), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// checkSPF checks that the domain has one SPF policy and that it allows the addresses to
+// send its mail
+func checkSPF(ctx context.Context, domain string, addrs []Address) Check {
+	records, err := txtRecords(ctx, domain, "v=spf1")
+	switch {
+	case err != nil:
+		return Check{Status: Warning, Problem: err.Error()}
+	case len(records) == 0:
+		return Check{Status: Failed, Problem: "the domain has no SPF record"}
+	case len(records) > 1:
+		return Check{Status: Failed, Record: strings.Join(records, " | "), Problem: "the domain has more than one SPF record, which receivers treat as an error"}
+	}
+
+	c := Check{Status: OK, Record: records[0]}
+
+	terms := strings.Fields(strings.ToLower(records[0]))
+	if slices.Contains(terms, "+all") || slices.Contains(terms, "all") {
+		c.Status, c.Problem = Failed, "the SPF record allows any server to send as the domain"
+		return c
+	}
+
+	var denied []string
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a.Address)
+		if err != nil {
+			continue
+		}
+
+		e := &spf{ctx: ctx}
+		result, err := e.check(domain, ip)
+		if err != nil {
+			return Check{Status: Warning, Record: records[0], Problem: err.Error()}
+		}
+		if result != "pass" {
+			denied = append(denied, a.Address)
+		}
+	}
+
+	if len(denied) > 0 {
+		c.Status, c.Problem = Failed, "the SPF record does not allow "+strings.Join(denied, ", ")
+	}
+
+	return c
+}
+
+// checkDKIM checks that the domain publishes a signing key under one of the selectors
+func checkDKIM(ctx context.Context, domain string, selectors []string) Check {
+	if len(selectors) == 0 {
+		return Check{Status: Skipped}
+	}
+
+	var revoked []string
+	for _, selector := range selectors {
+		records, err := net.DefaultResolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+		if notFound(err) {
+			continue
+		} else if err != nil {
+			return Check{Status: Warning, Problem: err.Error()}
+		}
+
+		for _, r := range records {
+			tags := parseTags(r)
+			key, ok := tags["p"]
+			if !ok {
+				continue
+			}
+
+			if key == "" {
+				revoked = append(revoked, selector)
+				continue
+			}
+
+			return Check{Status: OK, Record: selector}
+		}
+	}
+
+	if len(revoked) > 0 {
+		return Check{Status: Failed, Problem: "the DKIM key of selector " + strings.Join(revoked, ", ") + " has been revoked"}
+	}
+
+	return Check{Status: Failed, Problem: "the domain has no DKIM key under selector " + strings.Join(selectors, ", ")}
+}
+
+// checkDMARC checks that the domain has a DMARC policy that asks for aggregate reports
+func checkDMARC(ctx context.Context, domain string) Check {
+	records, err := txtRecords(ctx, "_dmarc."+domain, "v=DMARC1")
+	switch {
+	case err != nil:
+		return Check{Status: Warning, Problem: err.Error()}
+	case len(records) == 0:
+		return Check{Status: Failed, Problem: "the domain has no DMARC record"}
+	case len(records) > 1:
+		return Check{Status: Failed, Record: strings.Join(records, " | "), Problem: "the domain has more than one DMARC record, which receivers ignore"}
+	}
+
+	c := Check{Status: OK, Record: records[0]}
+	tags := parseTags(records[0])
+
+	switch {
+	case tags["rua"] == "":
+		c.Status, c.Problem = Warning, "the DMARC record does not ask for aggregate reports"
+	case strings.EqualFold(tags["p"], "none"):
+		c.Status, c.Problem = Warning, "the DMARC policy only monitors, and mail failing it is still delivered"
+	}
+
+	return c
+}
+
+// txtRecords returns the TXT records of the name starting with the version tag
+func txtRecords(ctx context.Context, name string, version string) ([]string, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if notFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for _, r := range records {
+		if strings.EqualFold(r, version) || strings.HasPrefix(strings.ToLower(r), strings.ToLower(version)+" ") ||
+			strings.HasPrefix(strings.ToLower(r), strings.ToLower(version)+";") {
+			list = append(list, r)
+		}
+	}
+
+	return list, nil
+}
+
+// parseTags parses a DKIM or DMARC record of tag=value pairs separated by semicolons,
+// with the tags in lower case
+func parseTags(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(record, ";") {
+		tag, value, ok := strings.Cut(pair, "=")
+		if ok {
+			tags[strings.ToLower(strings.TrimSpace(tag))] = strings.Join(strings.Fields(value), "")
+		}
+	}
+
+	return tags
+}
+
+// notFound returns true if the lookup failed because the name does not exist or has no
+// records of the type
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// spf evaluates an SPF policy for an address, counting the lookups it takes
+type spf struct {
+	ctx     context.Context
+	lookups int
+}
+
+// check returns the result of the SPF policy of the domain for the address, which is
+// pass, fail, softfail, neutral or none
+func (e *spf) check(domain string, ip netip.Addr) (string, error) {
+	records, err := txtRecords(e.ctx, domain, "v=spf1")
+	if err != nil {
+		return "", err
+	} else if len(records) != 1 {
+		return "none", nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(records[0])[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		result := "pass"
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = "fail", term[1:]
+		case '~':
+			result, term = "softfail", term[1:]
+		case '?':
+			result, term = "neutral", term[1:]
+		}
+
+		match, err := e.matches(domain, term, ip)
+		if err != nil {
+			return "", err
+		} else if match {
+			return result, nil
+		}
+	}
+
+	if redirect != "" {
+		if e.lookups++; e.lookups > maxLookups {
+			return "", errTooManyLookups
+		}
+		return e.check(redirect, ip)
+	}
+
+	return "neutral", nil
+}
+
+// matches returns true if the mechanism of the policy of the domain matches the address.
+// Mechanisms with macros are never matched
+func (e *spf) matches(domain string, mechanism string, ip netip.Addr) (bool, error) {
+	name, arg, _ := strings.Cut(mechanism, ":")
+	if strings.Contains(arg, "%") {
+		return false, nil
+	}
+
+	name, cidr, _ := strings.Cut(strings.ToLower(name), "/")
+	if arg == "" {
+		arg = domain
+	}
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			a, err := netip.ParseAddr(arg)
+			return err == nil && a.Unmap() == ip, nil
+		}
+		p, err := netip.ParsePrefix(arg)
+		return err == nil && p.Contains(ip), nil
+	case "include":
+		if e.lookups++; e.lookups > maxLookups {
+			return false, errTooManyLookups
+		}
+		result, err := e.check(arg, ip)
+		return result == "pass", err
+	case "a", "mx":
+		if e.lookups++; e.lookups > maxLookups {
+			return false, errTooManyLookups
+		}
+
+		// The prefix lengths come after the domain, as in a:example.com/24//64
+		if before, after, ok := strings.Cut(arg, "/"); ok {
+			arg, cidr = before, after
+		}
+
+		hosts := []string{arg}
+		if name == "mx" {
+			mx, err := net.DefaultResolver.LookupMX(e.ctx, arg)
+			if err != nil && !notFound(err) {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for _, m := range mx {
+				hosts = append(hosts, m.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := net.DefaultResolver.LookupNetIP(e.ctx, "ip", host)
+			if err != nil && !notFound(err) {
+				return false, err
+			}
+
+			for _, a := range addrs {
+				if prefix(a.Unmap(), cidr).Contains(ip) {
+					return true, nil
+				}
+			}
+		}
+	case "ptr", "exists":
+		if e.lookups++; e.lookups > maxLookups {
+			return false, errTooManyLookups
+		}
+	}
+
+	return false, nil
+}
+
+// prefix returns the network of the address with the prefix length for its family from
+// an SPF dual CIDR length such as 24//64, or the address alone without one
+func prefix(a netip.Addr, cidr string) netip.Prefix {
+	v4, v6, _ := strings.Cut(cidr, "//")
+	length := v4
+	if a.Is6() {
+		length = strings.TrimPrefix(v6, "/")
+	}
+
+	bits, err := strconv.Atoi(length)
+	if err != nil || bits > a.BitLen() {
+		bits = a.BitLen()
+	}
+
+	p, _ := a.Prefix(bits)
+
+	return p
+}
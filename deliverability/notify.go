@@ -0,0 +1,18 @@
+package deliverability
+
+import "github.com/cosmicpanel/CosmicPanel/notify"
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "deliverability_alert",
+		Description: "Sent to the owner of a domain when a check finds a new problem with the mail it sends",
+		Fields:      []string{"Username", "Domain", "Alerts"},
+		Template: notify.Template{
+			Subject: "Mail from {{.Domain}} may not be delivered",
+			SMS:     "{{.Product}}: {{len .Alerts}} new problems with the mail sent from {{.Domain}}. Check the deliverability of the domain in your account.",
+			Body: "A check of the mail sent from {{.Domain}} in your account {{.Username}} found new problems that can send it to spam folders or get it rejected:\n\n" +
+				"{{range .Alerts}}  {{.}}\n{{end}}\n" +
+				"Problems with the SPF, DKIM and DMARC records are fixed in the DNS of the domain. Bounces are most often caused by sending to old or mistyped addresses. Contact your provider if the problem is with the server.\n",
+		},
+	})
+}
@@ -0,0 +1,151 @@
+package diagnostics
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+)
+
+// Server exposes pprof profiles, goroutine dumps and build/runtime information on a
+// listener that is kept separate from the panel so that it can be bound to localhost
+// and enabled or disabled without restarting the daemon
+type Server struct {
+	mu     sync.Mutex
+	config *config.DiagnosticsConfiguration
+	server *http.Server
+}
+
+// New returns a diagnostics server for the given configuration. The server is not
+// listening until Enable is called
+func New(c *config.DiagnosticsConfiguration) *Server {
+	return &Server{config: c}
+}
+
+// Enabled returns true if the diagnostics server is currently listening
+func (s *Server) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.server != nil
+}
+
+// Enable starts listening on the configured address. Calling Enable on a server that
+// is already listening is a no-op
+func (s *Server) Enable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != nil {
+		return nil
+	}
+
+	addr := net.JoinHostPort(s.config.Host, fmt.Sprint(s.config.Port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Handler:     s.handler(),
+		ReadTimeout: 10 * time.Second,
+	}
+
+	go func(srv *http.Server) {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.S().Errorw("diagnostics server stopped unexpectedly", zap.Error(err))
+		}
+	}(s.server)
+
+	zap.S().Infow("diagnostics server listening", "address", addr)
+
+	return nil
+}
+
+// Disable stops the diagnostics server, waiting a short period for any in-flight
+// requests such as CPU profiles to finish
+func (s *Server) Disable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+
+	zap.S().Infow("diagnostics server stopped")
+
+	return err
+}
+
+// Toggle enables the server if it is stopped and disables it if it is running, returning
+// the new state
+func (s *Server) Toggle() (bool, error) {
+	if s.Enabled() {
+		return false, s.Disable()
+	}
+
+	return true, s.Enable()
+}
+
+// handler returns the routes served by the diagnostics server wrapped in the
+// authentication middleware
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	mux.HandleFunc("/debug/info", handleInfo)
+
+	return s.authenticate(mux)
+}
+
+// authenticate only allows requests through if they carry the configured token, or if
+// no token is configured, if they originate from the loopback interface
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+				http.Error(w, "invalid or missing authorization token", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "diagnostics are only available from localhost", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback returns true if the remote address of a request is a loopback address
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
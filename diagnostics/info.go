@@ -0,0 +1,99 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/cache"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// started is the time the daemon process started, used to report the uptime
+var started = time.Now()
+
+// Info contains the build and runtime information for the running daemon
+type Info struct {
+	GoVersion  string            `json:"go_version"`
+	Module     string            `json:"module"`
+	Version    string            `json:"version"`
+	Commit     string            `json:"commit"`
+	BuildDate  string            `json:"build_date"`
+	Settings   map[string]string `json:"build_settings"`
+	Pid        int               `json:"pid"`
+	Uptime     string            `json:"uptime"`
+	Goroutines int               `json:"goroutines"`
+	MaxProcs   int               `json:"max_procs"`
+	Memory     MemoryInfo        `json:"memory"`
+	Caches     []cache.Stats     `json:"caches"`
+	HTTP       []httpx.Stats     `json:"http"`
+}
+
+// MemoryInfo contains a subset of the runtime memory statistics
+type MemoryInfo struct {
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// CollectInfo gathers the build information embedded into the binary along with the
+// current state of the Go runtime
+func CollectInfo() Info {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	build := buildinfo.Get()
+
+	info := Info{
+		Version:    build.Version,
+		Commit:     build.Commit,
+		BuildDate:  build.Date,
+		GoVersion:  runtime.Version(),
+		Settings:   make(map[string]string),
+		Pid:        os.Getpid(),
+		Uptime:     time.Since(started).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		MaxProcs:   runtime.GOMAXPROCS(0),
+		Memory: MemoryInfo{
+			Alloc:      m.Alloc,
+			TotalAlloc: m.TotalAlloc,
+			Sys:        m.Sys,
+			HeapInuse:  m.HeapInuse,
+			NumGC:      m.NumGC,
+		},
+		Caches: cache.All(),
+		HTTP:   httpx.All(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		for _, s := range bi.Settings {
+			info.Settings[s.Key] = s.Value
+		}
+	}
+
+	return info
+}
+
+// handleInfo writes the build and runtime information as JSON
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(CollectInfo())
+}
+
+// handleGoroutines writes a full stack dump of every running goroutine
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
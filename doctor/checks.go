@@ -0,0 +1,284 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+	"github.com/cosmicpanel/CosmicPanel/initsys"
+	"github.com/cosmicpanel/CosmicPanel/lsm"
+	"github.com/cosmicpanel/CosmicPanel/platform"
+)
+
+// licenseHost is the server licenses are verified against
+const licenseHost = "licenses.cosmicpanel.net"
+
+// requirement is a binary the panel runs, any one of whose names will do
+type requirement struct {
+	names  []string
+	needed func(c *config.Configuration) bool
+	hint   string
+}
+
+// always is used for the binaries every server needs
+func always(c *config.Configuration) bool {
+	return true
+}
+
+var requirements = []requirement{
+	{[]string{"useradd", "adduser", "pw"}, always, "Install the passwd package on Debian, shadow-utils on RHEL or busybox on Alpine"},
+	{supervisors, always, supervisorHint},
+	{firewalls, always, firewallHint},
+	{[]string{"nginx", "apache2", "httpd"}, func(c *config.Configuration) bool { return c.Modules.Web }, "Install nginx, or disable the web module"},
+	{[]string{"postfix"}, func(c *config.Configuration) bool { return c.Modules.Mail }, "Install postfix, or disable the mail module"},
+	{[]string{"dovecot"}, func(c *config.Configuration) bool { return c.Modules.Mail }, "Install dovecot, or disable the mail module"},
+	{[]string{"named", "pdns_server"}, func(c *config.Configuration) bool { return c.Modules.DNS }, "Install bind9 or pdns-server, or disable the dns module"},
+	{[]string{"mysql", "mariadb"}, func(c *config.Configuration) bool { return c.Modules.Database }, "Install mariadb-server or mysql-server, or disable the database module"},
+}
+
+// checkBinaries checks that the binaries the enabled modules run are installed
+func checkBinaries(c *config.Configuration, path string) []Result {
+	var results []Result
+	for _, req := range requirements {
+		if !req.needed(c) {
+			continue
+		}
+
+		found := ""
+		for _, name := range req.names {
+			if p := lookPath(name); p != "" {
+				found = p
+				break
+			}
+		}
+
+		if found != "" {
+			results = append(results, Result{Status: Pass, Message: found})
+		} else {
+			results = append(results, Result{Status: Fail, Message: strings.Join(req.names, " or ") + " not found", Hint: req.hint})
+		}
+	}
+
+	return results
+}
+
+// checkQuotas checks that disk quotas are enabled for the filesystem holding the home
+// directories, which account disk limits are enforced with
+func checkQuotas(c *config.Configuration, path string) []Result {
+	m, err := platform.MountOf("/home")
+	if err != nil {
+		return []Result{{Status: Warn, Message: "could not read mounts: " + err.Error()}}
+	}
+
+	// ZFS datasets always support quotas, which are set as properties
+	if m.Type == "zfs" {
+		return []Result{{Status: Pass, Message: "quotas are supported by the ZFS dataset at " + m.Point}}
+	}
+
+	for _, o := range strings.Split(m.Options, ",") {
+		switch {
+		case o == "quota", o == "usrquota", o == "grpquota", o == "prjquota", o == "userquota", o == "groupquota", strings.HasPrefix(o, "usrjquota"), strings.HasPrefix(o, "grpjquota"):
+			return []Result{{Status: Pass, Message: "quotas are enabled on " + m.Point}}
+		}
+	}
+
+	return []Result{{
+		Status:  Warn,
+		Message: "quotas are not enabled on " + m.Point + ", disk limits will not be enforced",
+		Hint:    quotaHint(m.Point),
+	}}
+}
+
+// checkPorts checks that nothing other than the daemon is listening on the ports the
+// panel uses
+func checkPorts(c *config.Configuration, path string) []Result {
+	host, port := c.PanelAddress()
+	results := []Result{checkPort("panel", host, port)}
+
+	if c.Diagnostics.Enabled {
+		results = append(results, checkPort("diagnostics", c.Diagnostics.Host, c.Diagnostics.Port))
+	}
+
+	return results
+}
+
+// checkPort checks that a port is free, or held by the running daemon
+func checkPort(name string, host string, port int) Result {
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+
+	l, err := net.Listen("tcp", addr)
+	if err == nil {
+		l.Close()
+		return Result{Status: Pass, Message: fmt.Sprintf("%s port %d is free", name, port)}
+	}
+
+	if d, err := initsys.Detect(""); err == nil && d.Active(d.Service()) {
+		return Result{Status: Pass, Message: fmt.Sprintf("%s port %d is in use by the running daemon", name, port)}
+	}
+
+	return Result{
+		Status:  Fail,
+		Message: fmt.Sprintf("%s port %d is in use: %v", name, port, err),
+		Hint:    fmt.Sprintf("Find what is listening with ss -ltnp 'sport = :%d', or change the %s port in the configuration", port, name),
+	}
+}
+
+// checkDNS checks that the server can resolve names, including its own
+func checkDNS(c *config.Configuration, path string) []Result {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var results []Result
+	if _, err := net.DefaultResolver.LookupHost(ctx, licenseHost); err != nil {
+		results = append(results, Result{Status: Fail, Message: "failed to resolve " + licenseHost + ": " + err.Error(), Hint: "Check the nameservers in /etc/resolv.conf"})
+	} else {
+		results = append(results, Result{Status: Pass, Message: "resolved " + licenseHost})
+	}
+
+	hostname, _ := os.Hostname()
+	if _, err := net.DefaultResolver.LookupHost(ctx, hostname); err != nil {
+		results = append(results, Result{Status: Warn, Message: "hostname " + hostname + " does not resolve", Hint: "Add it to /etc/hosts or create a DNS record for it"})
+	} else {
+		results = append(results, Result{Status: Pass, Message: "hostname " + hostname + " resolves"})
+	}
+
+	return results
+}
+
+// checkLicense checks that the license server can be reached
+func checkLicense(c *config.Configuration, path string) []Result {
+	ip := c.PublicIP()
+	if ip == "" {
+		return []Result{{Status: Fail, Message: "the server has no outbound route", Hint: "Check the default route and network configuration"}}
+	}
+
+	client := httpx.Client(10 * time.Second)
+
+	resp, err := client.Get(fmt.Sprintf("https://%s/verify?ip=%s", licenseHost, ip))
+	if err != nil {
+		return []Result{{Status: Fail, Message: "license server is unreachable: " + err.Error(), Hint: "Allow outbound HTTPS to " + licenseHost}}
+	}
+	resp.Body.Close()
+
+	return []Result{{Status: Pass, Message: fmt.Sprintf("license server is reachable from %s", ip)}}
+}
+
+// checkLSM checks that the panel's policy is loaded when SELinux or AppArmor is enabled,
+// and reports recent denials of the panel or of the files it manages
+func checkLSM(c *config.Configuration, path string) []Result {
+	st := lsm.Detect()
+	if st.Module == "" {
+		return []Result{{Status: Pass, Message: "neither SELinux nor AppArmor is enabled"}}
+	}
+
+	mode := "permissive"
+	if st.Enforcing {
+		mode = "enforcing"
+	}
+
+	var results []Result
+	switch {
+	case st.Installed:
+		results = append(results, Result{Status: Pass, Message: fmt.Sprintf("%s is %s with the CosmicPanel policy loaded", st.Module, mode)})
+	case st.Enforcing:
+		results = append(results, Result{Status: Fail, Message: st.Module + " is enforcing without the CosmicPanel policy", Hint: "Run cosmicpanel lsm install"})
+	default:
+		results = append(results, Result{Status: Warn, Message: st.Module + " is permissive without the CosmicPanel policy", Hint: "Run cosmicpanel lsm install before switching to enforcing"})
+	}
+
+	denials, err := lsm.Denials([]string{c.System.Data, c.Transfer.Homes}, 5)
+	switch {
+	case err != nil:
+		results = append(results, Result{Status: Warn, Message: "could not read the audit log: " + err.Error()})
+	case len(denials) > 0:
+		results = append(results, Result{
+			Status:  Warn,
+			Message: fmt.Sprintf("%s denied access recently, most recently: %s", st.Module, denials[len(denials)-1]),
+			Hint:    "Run cosmicpanel lsm relabel to restore the labels of the panel's files and home directories, then cosmicpanel lsm status to list the denials that remain",
+		})
+	default:
+		results = append(results, Result{Status: Pass, Message: "no recent " + st.Module + " denials"})
+	}
+
+	return results
+}
+
+// checkPermissions checks that the configuration, the data directory and the keys the
+// panel reads cannot be read by other users
+func checkPermissions(c *config.Configuration, path string) []Result {
+	results := []Result{private("configuration "+path, path, 0)}
+
+	info, err := os.Stat(c.System.Data)
+	switch {
+	case os.IsNotExist(err):
+		results = append(results, Result{Status: Warn, Message: "data directory " + c.System.Data + " does not exist", Hint: "Run cosmicpanel setup"})
+	case err != nil:
+		results = append(results, Result{Status: Fail, Message: err.Error()})
+	default:
+		res := private("data directory "+c.System.Data, c.System.Data, c.System.User.Uid)
+		if !info.IsDir() {
+			res = Result{Status: Fail, Message: c.System.Data + " is not a directory"}
+		}
+		results = append(results, res)
+	}
+
+	if c.Vault.Provider == "local" && c.Vault.Key == "" {
+		if _, err := os.Stat(c.Vault.KeyFile); err == nil {
+			results = append(results, private("vault key "+c.Vault.KeyFile, c.Vault.KeyFile, 0))
+		}
+	}
+
+	if c.Panel.Key != "" {
+		results = append(results, private("panel TLS key "+c.Panel.Key, c.Panel.Key, 0))
+	}
+
+	return results
+}
+
+// private checks that the path is owned by the user and not accessible by anyone else
+func private(name string, path string, uid int) Result {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Result{Status: Fail, Message: name + ": " + err.Error()}
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid && st.Uid != 0 {
+		return Result{Status: Warn, Message: fmt.Sprintf("%s is owned by uid %d", name, st.Uid), Hint: fmt.Sprintf("chown %d %s", uid, path)}
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		mode := "600"
+		if info.IsDir() {
+			mode = "700"
+		}
+
+		return Result{Status: Fail, Message: fmt.Sprintf("%s is accessible by other users (%s)", name, info.Mode().Perm()), Hint: fmt.Sprintf("chmod %s %s", mode, path)}
+	}
+
+	return Result{Status: Pass, Message: name + " is private"}
+}
+
+// lookPath finds a binary in PATH or the sbin directories, which are often missing from
+// PATH for non-root users
+func lookPath(name string) string {
+	if p, err := exec.LookPath(name); err == nil {
+		return p
+	}
+
+	for _, dir := range []string{"/usr/sbin", "/sbin", "/usr/local/sbin"} {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return p
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,85 @@
+package doctor
+
+import (
+	"os"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// Statuses of a result
+const (
+	Pass = "pass"
+	Warn = "warn"
+	Fail = "fail"
+)
+
+// Result is the outcome of checking one requirement of the panel
+type Result struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+
+	// How to fix a requirement that is not met
+	Hint string `json:"hint,omitempty"`
+}
+
+// Report is the result of running every check, meant to be attached to support tickets
+type Report struct {
+	Time     time.Time      `json:"time"`
+	Hostname string         `json:"hostname"`
+	Build    buildinfo.Info `json:"build"`
+	Results  []Result       `json:"results"`
+}
+
+// Failed returns true if any requirement is not met
+func (r Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == Fail {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check inspects one requirement of the panel
+type check struct {
+	name string
+	run  func(c *config.Configuration, path string) []Result
+}
+
+// checks are run in order
+var checks = []check{
+	{"os", checkOS},
+	{"binaries", checkBinaries},
+	{"quotas", checkQuotas},
+	limits,
+	{"lsm", checkLSM},
+	{"ports", checkPorts},
+	{"dns", checkDNS},
+	{"license", checkLicense},
+	{"permissions", checkPermissions},
+}
+
+// Run checks that the server can run the panel with the configuration read from the
+// path. It only reads, so it is safe to run on a server that is already in use
+func Run(c *config.Configuration, path string) Report {
+	hostname, _ := os.Hostname()
+
+	r := Report{
+		Time:     time.Now().UTC(),
+		Hostname: hostname,
+		Build:    buildinfo.Get(),
+	}
+
+	for _, ch := range checks {
+		for _, res := range ch.run(c, path) {
+			res.Check = ch.name
+			r.Results = append(r.Results, res)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,95 @@
+//go:build !freebsd
+
+package doctor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/platform"
+)
+
+// The binaries services are managed with, any one of which will do
+var (
+	supervisors    = []string{"systemctl", "rc-service", "sv"}
+	supervisorHint = "CosmicPanel manages services through systemd, OpenRC or runit"
+)
+
+// The binaries the firewall is managed with, any one of which will do
+var (
+	firewalls    = []string{"nft", "iptables"}
+	firewallHint = "Install nftables"
+)
+
+// limits checks what resource limits are applied through
+var limits = check{"cgroups", checkCgroups}
+
+// distributions are the distribution IDs from os-release the panel is tested on,
+// matched against both ID and ID_LIKE
+var distributions = []string{"debian", "ubuntu", "rhel", "centos", "fedora", "almalinux", "rocky"}
+
+// checkOS checks that the server runs a supported distribution
+func checkOS(c *config.Configuration, path string) []Result {
+	if runtime.GOOS != "linux" {
+		return []Result{{Status: Fail, Message: runtime.GOOS + " is not supported", Hint: "Install CosmicPanel on a Linux or FreeBSD server"}}
+	}
+
+	release, err := platform.Release()
+	if err != nil {
+		return []Result{{Status: Warn, Message: "could not identify the distribution: " + err.Error()}}
+	}
+
+	ids := append([]string{release["ID"]}, strings.Fields(release["ID_LIKE"])...)
+	for _, id := range ids {
+		if slices.Contains(distributions, id) {
+			return []Result{{Status: Pass, Message: release["PRETTY_NAME"]}}
+		}
+	}
+
+	return []Result{{
+		Status:  Warn,
+		Message: release["PRETTY_NAME"] + " is not a tested distribution",
+		Hint:    "CosmicPanel is tested on Debian, Ubuntu and RHEL compatible distributions",
+	}}
+}
+
+// checkCgroups checks that the unified cgroup hierarchy is mounted with the controllers
+// resource limits are applied through
+func checkCgroups(c *config.Configuration, path string) []Result {
+	b, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		return []Result{{
+			Status:  Warn,
+			Message: "cgroups v2 is not mounted, CPU and memory limits will not be enforced",
+			Hint:    "Boot with systemd.unified_cgroup_hierarchy=1 on the kernel command line",
+		}}
+	}
+
+	available := strings.Fields(string(b))
+
+	var missing []string
+	for _, controller := range []string{"cpu", "memory", "io", "pids"} {
+		if !slices.Contains(available, controller) {
+			missing = append(missing, controller)
+		}
+	}
+
+	if len(missing) > 0 {
+		return []Result{{
+			Status:  Warn,
+			Message: "cgroups v2 is missing the " + strings.Join(missing, ", ") + " controllers",
+			Hint:    "Enable the controllers in the kernel, or check that they are not claimed by a cgroups v1 hierarchy",
+		}}
+	}
+
+	return []Result{{Status: Pass, Message: "cgroups v2 with " + strings.Join(available, " ")}}
+}
+
+// quotaHint tells how to enable quotas on the mount
+func quotaHint(mount string) string {
+	return fmt.Sprintf("Add usrquota,grpquota to the options of %s in /etc/fstab, remount it and run quotacheck -cugm %s. XFS root filesystems need rootflags=uquota,gquota on the kernel command line instead", mount, mount)
+}
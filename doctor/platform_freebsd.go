@@ -0,0 +1,54 @@
+package doctor
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// The binaries services are managed with, any one of which will do
+var (
+	supervisors    = []string{"service"}
+	supervisorHint = "CosmicPanel manages services through rc.d"
+)
+
+// The binaries the firewall is managed with, any one of which will do
+var (
+	firewalls    = []string{"pfctl"}
+	firewallHint = "Enable pf with pf_enable=YES in /etc/rc.conf"
+)
+
+// limits checks what resource limits are applied through
+var limits = check{"rctl", checkRctl}
+
+// checkOS checks that the server runs a supported release of FreeBSD
+func checkOS(c *config.Configuration, path string) []Result {
+	out, err := exec.Command("freebsd-version").Output()
+	if err != nil {
+		return []Result{{Status: Warn, Message: "could not identify the release: " + err.Error()}}
+	}
+
+	return []Result{{Status: Pass, Message: "FreeBSD " + strings.TrimSpace(string(out))}}
+}
+
+// checkRctl checks that resource accounting is enabled, which CPU and memory limits are
+// applied through with rctl
+func checkRctl(c *config.Configuration, path string) []Result {
+	out, err := exec.Command("sysctl", "-n", "kern.racct.enable").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "1" {
+		return []Result{{
+			Status:  Warn,
+			Message: "resource accounting is disabled, CPU and memory limits will not be enforced",
+			Hint:    "Add kern.racct.enable=1 to /boot/loader.conf and reboot",
+		}}
+	}
+
+	return []Result{{Status: Pass, Message: "resource accounting is enabled"}}
+}
+
+// quotaHint tells how to enable quotas on the mount
+func quotaHint(mount string) string {
+	return fmt.Sprintf("Add userquota,groupquota to the options of %s in /etc/fstab, set quota_enable=YES in /etc/rc.conf and reboot, or keep home directories on ZFS", mount)
+}
@@ -0,0 +1,55 @@
+package dryrun
+
+// Kinds of resource a change touches
+const (
+	File     = "file"
+	Service  = "service"
+	Package  = "package"
+	User     = "user"
+	Session  = "session"
+	DNS      = "dns"
+	Database = "database"
+)
+
+// Actions a change takes on a resource
+const (
+	Create  = "create"
+	Modify  = "modify"
+	Delete  = "delete"
+	Reload  = "reload"
+	Restart = "restart"
+	Upgrade = "upgrade"
+)
+
+// Change is one thing an operation would do to the server
+type Change struct {
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan is everything an operation would change, reported instead of carrying it out so
+// that operators can preview the blast radius of destructive and bulk actions
+type Plan struct {
+	Operation string   `json:"operation"`
+	Changes   []Change `json:"changes"`
+
+	// Effects that cannot be known without carrying out the operation
+	Notes []string `json:"notes,omitempty"`
+}
+
+// New returns an empty plan for the operation
+func New(operation string) *Plan {
+	return &Plan{Operation: operation, Changes: []Change{}}
+}
+
+// Add records a change
+func (p *Plan) Add(kind string, action string, target string, detail string) {
+	p.Changes = append(p.Changes, Change{Kind: kind, Action: action, Target: target, Detail: detail})
+}
+
+// Note records an effect that cannot be known in advance
+func (p *Plan) Note(note string) {
+	p.Notes = append(p.Notes, note)
+}
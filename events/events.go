@@ -0,0 +1,193 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// Event is something that happened in the panel. Every subsystem publishes events to the
+// bus, and the activity feed, audit log and any other consumer read from it rather than
+// being called directly by the subsystem
+type Event struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// The type of the event, namespaced by subsystem using dots, for example
+	// system.logging.update or account.create
+	Type string `json:"type"`
+
+	// The user or token that caused the event. Events generated by the panel itself,
+	// such as scheduled tasks, have no actor
+	Actor    string `json:"actor,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	// The admin or reseller acting as the actor through an impersonation session
+	Impersonator string `json:"impersonator,omitempty"`
+
+	// The account and reseller the event belongs to, used to scope the activity feed
+	Account  string `json:"account,omitempty"`
+	Reseller string `json:"reseller,omitempty"`
+
+	// The resource that changed and its state before and after the change
+	Resource string          `json:"resource,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+
+	// Any additional information about the event
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Matches returns true if the event type matches the pattern. A pattern ending in .*
+// matches every type within that namespace, and * matches everything
+func (e Event) Matches(pattern string) bool {
+	if pattern == "*" || pattern == e.Type {
+		return true
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(e.Type, prefix)
+	}
+
+	return false
+}
+
+// Subscription receives events matching its patterns on a buffered channel. Events are
+// dropped for a subscriber whose buffer is full so a slow consumer never blocks the
+// subsystem publishing the event
+type Subscription struct {
+	C        <-chan Event
+	c        chan Event
+	patterns []string
+	dropped  atomic.Uint64
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Bus delivers published events to handlers and subscriptions
+type Bus struct {
+	mu            sync.RWMutex
+	handlers      []func(Event)
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewBus returns an empty event bus
+func NewBus() *Bus {
+	return &Bus{subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Handle registers a function called synchronously for every published event. It is
+// used by consumers that must not miss an event, such as the audit log, and must not
+// block for long
+func (b *Bus) Handle(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, fn)
+}
+
+// Subscribe returns a subscription receiving events matching any of the patterns. If no
+// patterns are given every event is received
+func (b *Bus) Subscribe(buffer int, patterns ...string) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, patterns: patterns}
+
+	b.mu.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+// Unsubscribe stops delivering events to the subscription and closes its channel
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscriptions[s]; ok {
+		delete(b.subscriptions, s)
+		close(s.c)
+	}
+}
+
+// Publish assigns the event an ID and time, passes it to every handler and then to the
+// subscriptions whose patterns match it
+func (b *Bus) Publish(e Event) Event {
+	if e.ID == "" {
+		e.ID = ids.Hex(16)
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, h := range b.handlers {
+		h(e)
+	}
+
+	for s := range b.subscriptions {
+		if !s.matches(e) {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			if s.dropped.Add(1) == 1 {
+				zap.S().Named("events").Warnw("subscription buffer full, dropping events", "type", e.Type)
+			}
+		}
+	}
+
+	return e
+}
+
+func (s *Subscription) matches(e Event) bool {
+	if len(s.patterns) == 0 {
+		return true
+	}
+
+	for _, p := range s.patterns {
+		if e.Matches(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// std is the bus used by the package level functions
+var std = NewBus()
+
+// Publish publishes the event on the default bus
+func Publish(e Event) Event {
+	return std.Publish(e)
+}
+
+// Handle registers a synchronous handler on the default bus
+func Handle(fn func(Event)) {
+	std.Handle(fn)
+}
+
+// Subscribe subscribes to events on the default bus
+func Subscribe(buffer int, patterns ...string) *Subscription {
+	return std.Subscribe(buffer, patterns...)
+}
+
+// Unsubscribe removes a subscription from the default bus
+func Unsubscribe(s *Subscription) {
+	std.Unsubscribe(s)
+}
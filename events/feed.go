@@ -0,0 +1,310 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Feed persists every published event as the activity feed. Events are stored as JSON
+// lines in one file per day so that retention can be applied by removing whole files
+type Feed struct {
+	mu        sync.Mutex
+	dir       string
+	retention int
+}
+
+// Filter limits the events returned from the activity feed. Empty fields match every
+// event
+type Filter struct {
+	Account  string
+	Reseller string
+	Actor    string
+
+	// An event type or pattern such as account.* to match
+	Type string
+
+	Since time.Time
+	Until time.Time
+
+	// The maximum number of events to return, keeping the most recent ones
+	Limit int
+}
+
+// Matches returns true if the event satisfies every condition in the filter
+func (f Filter) Matches(e Event) bool {
+	if f.Account != "" && e.Account != f.Account {
+		return false
+	}
+
+	if f.Reseller != "" && e.Reseller != f.Reseller {
+		return false
+	}
+
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+
+	if f.Type != "" && !e.Matches(f.Type) {
+		return false
+	}
+
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+var feed *Feed
+
+// ConfigureFeed persists every event published on the default bus to the activity feed
+// in the directory, removing events older than the retention period in days
+func ConfigureFeed(dir string, retention int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	feed = &Feed{dir: dir, retention: retention}
+	std.Handle(func(e Event) {
+		if err := feed.Append(e); err != nil {
+			zap.S().Named("events").Errorw("failed to write event to activity feed", "type", e.Type, zap.Error(err))
+		}
+	})
+
+	return nil
+}
+
+// Query returns the events in the activity feed matching the filter
+func Query(f Filter) ([]Event, error) {
+	if feed == nil {
+		return []Event{}, nil
+	}
+
+	return feed.Query(f)
+}
+
+// Prune removes activity feed files older than the retention period
+func Prune() error {
+	if feed == nil {
+		return nil
+	}
+
+	return feed.Prune()
+}
+
+// Forget removes the events matching fn from the activity feed, returning how many were
+// removed
+func Forget(fn func(Event) bool) (int, error) {
+	if feed == nil {
+		return 0, nil
+	}
+
+	return feed.Forget(fn)
+}
+
+// Append writes the event to the file for the day it occurred on
+func (f *Feed) Append(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path(e.Time), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(b, '\n'))
+
+	return err
+}
+
+// Query reads the days covered by the filter and returns the matching events, oldest
+// first
+func (f *Feed) Query(filter Filter) ([]Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	days, err := f.days()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	for _, day := range days {
+		if !filter.Since.IsZero() && day.Add(24*time.Hour).Before(filter.Since) {
+			continue
+		}
+
+		if !filter.Until.IsZero() && day.After(filter.Until) {
+			continue
+		}
+
+		if err := f.read(day, filter, &events); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+
+	return events, nil
+}
+
+// Prune removes the files for every day older than the retention period. A retention of
+// zero keeps events forever
+func (f *Feed) Prune() error {
+	if f.retention <= 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	days, err := f.days()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -f.retention)
+	for _, day := range days {
+		if day.Before(cutoff) {
+			if err := os.Remove(f.path(day)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Forget rewrites the files of the days with events matching fn without them
+func (f *Feed) Forget(fn func(Event) bool) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	days, err := f.days()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, day := range days {
+		n, err := f.forget(day, fn)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// forget rewrites a single day's file without the events matching fn. Lines that are not
+// events are kept as they are
+func (f *Feed) forget(day time.Time, fn func(Event) bool) (int, error) {
+	path := f.path(day)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		kept    []byte
+		removed int
+	)
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		var e Event
+		if json.Unmarshal(line, &e) == nil && fn(e) {
+			removed++
+			continue
+		}
+		kept = append(kept, line...)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0600); err != nil {
+		return 0, err
+	}
+
+	return removed, os.Rename(tmp, path)
+}
+
+// read appends the events from a single day's file that match the filter
+func (f *Feed) read(day time.Time, filter Filter, events *[]Event) error {
+	file, err := os.Open(f.path(day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+
+		if filter.Matches(e) {
+			*events = append(*events, e)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// days returns the days that have a feed file, oldest first
+func (f *Feed) days() ([]time.Time, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []time.Time
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+
+		if day, err := time.Parse("2006-01-02", name); err == nil {
+			days = append(days, day)
+		}
+	}
+
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	return days, nil
+}
+
+// path returns the file events from the given day are stored in
+func (f *Feed) path(t time.Time) string {
+	return filepath.Join(f.dir, t.UTC().Format("2006-01-02")+".jsonl")
+}
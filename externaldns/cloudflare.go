@@ -0,0 +1,275 @@
+package externaldns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// cloudflareAPI is the base URL of version 4 of the Cloudflare API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4/"
+
+// cloudflare publishes records through the Cloudflare API with an API token allowed to
+// edit the DNS of the zones
+type cloudflare struct {
+	token  string
+	client *http.Client
+}
+
+func newCloudflare(c config.DNSProviderConfiguration) *cloudflare {
+	return &cloudflare{token: c.Token, client: httpx.Client(timeout)}
+}
+
+func (cf *cloudflare) Name() string {
+	return "cloudflare"
+}
+
+// cfRecord is a DNS record as the API has it
+type cfRecord struct {
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	TTL      int    `json:"ttl"`
+	Priority *int   `json:"priority,omitempty"`
+	Proxied  bool   `json:"proxied"`
+}
+
+// value returns the record's data as the panel has it
+func (r cfRecord) value() string {
+	switch {
+	case r.Type == MX && r.Priority != nil:
+		return strconv.Itoa(*r.Priority) + " " + r.Content
+	case r.Type == TXT && len(r.Content) > 1 && strings.HasPrefix(r.Content, `"`) && strings.HasSuffix(r.Content, `"`):
+		return r.Content[1 : len(r.Content)-1]
+	default:
+		return r.Content
+	}
+}
+
+func (cf *cloudflare) Zone(ctx context.Context, name string) (string, error) {
+	var zones []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := cf.call(ctx, http.MethodGet, "zones?"+url.Values{"name": {name}}.Encode(), nil, &zones); err != nil {
+		return "", err
+	}
+
+	for _, z := range zones {
+		if normalize(z.Name) == name {
+			return z.ID, nil
+		}
+	}
+
+	return "", ErrZoneNotFound
+}
+
+func (cf *cloudflare) Records(ctx context.Context, zone string) ([]RecordSet, error) {
+	records, err := cf.records(ctx, zone, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	var list []RecordSet
+	index := make(map[string]int)
+	for _, r := range records {
+		if !slices.Contains([]string{A, AAAA, CNAME, MX, NS, PTR, TXT}, r.Type) {
+			continue
+		}
+
+		key := normalize(r.Name) + " " + r.Type
+		i, ok := index[key]
+		if !ok {
+			i = len(list)
+			index[key] = i
+			list = append(list, RecordSet{Name: normalize(r.Name), Type: r.Type, TTL: r.TTL})
+		}
+		list[i].Values = append(list[i].Values, r.value())
+	}
+
+	return list, nil
+}
+
+func (cf *cloudflare) Set(ctx context.Context, zone string, rs RecordSet) error {
+	existing, err := cf.records(ctx, zone, url.Values{"name": {rs.Name}, "type": {rs.Type}})
+	if err != nil {
+		return err
+	}
+
+	// Records that are already published with the TTL are kept, and the rest replaced.
+	// Names served through the CDN stay so
+	var keep []string
+	proxied := false
+	for _, r := range existing {
+		proxied = proxied || r.Proxied
+
+		// Proxied records have the automatic TTL of 1
+		if slices.Contains(rs.Values, r.value()) && (r.TTL == rs.TTL || r.Proxied) && !slices.Contains(keep, r.value()) {
+			keep = append(keep, r.value())
+			continue
+		}
+
+		if err := cf.call(ctx, http.MethodDelete, "zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range rs.Values {
+		if slices.Contains(keep, v) {
+			continue
+		}
+
+		r := cfRecord{Type: rs.Type, Name: rs.Name, Content: v, TTL: rs.TTL, Proxied: proxied && proxiable(rs.Type)}
+		if rs.Type == MX {
+			pref, exchange, err := splitMX(v)
+			if err != nil {
+				return err
+			}
+			r.Content, r.Priority = exchange, &pref
+		}
+
+		if err := cf.call(ctx, http.MethodPost, "zones/"+zone+"/dns_records", r, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cf *cloudflare) Delete(ctx context.Context, zone string, name string, typ string) error {
+	existing, err := cf.records(ctx, zone, url.Values{"name": {name}, "type": {typ}})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range existing {
+		if err := cf.call(ctx, http.MethodDelete, "zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cf *cloudflare) SetProxied(ctx context.Context, zone string, name string, proxied bool) error {
+	existing, err := cf.records(ctx, zone, url.Values{"name": {name}})
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, r := range existing {
+		if !proxiable(r.Type) {
+			continue
+		}
+		found = true
+
+		if r.Proxied == proxied {
+			continue
+		}
+
+		if err := cf.call(ctx, http.MethodPatch, "zones/"+zone+"/dns_records/"+r.ID, map[string]bool{"proxied": proxied}, nil); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("there are no A, AAAA or CNAME records at %s", name)
+	}
+
+	return nil
+}
+
+func (cf *cloudflare) Purge(ctx context.Context, zone string, hosts []string) error {
+	return cf.call(ctx, http.MethodPost, "zones/"+zone+"/purge_cache", map[string][]string{"hosts": hosts}, nil)
+}
+
+// proxiable returns true if records of the type can be served through the CDN
+func proxiable(typ string) bool {
+	return typ == A || typ == AAAA || typ == CNAME
+}
+
+// records returns the records of the zone matching the filter, reading every page
+func (cf *cloudflare) records(ctx context.Context, zone string, filter url.Values) ([]cfRecord, error) {
+	var all []cfRecord
+
+	filter.Set("per_page", "100")
+	for page := 1; ; page++ {
+		filter.Set("page", strconv.Itoa(page))
+
+		var records []cfRecord
+		if err := cf.call(ctx, http.MethodGet, "zones/"+zone+"/dns_records?"+filter.Encode(), nil, &records); err != nil {
+			return nil, err
+		}
+
+		all = append(all, records...)
+		if len(records) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// call calls the API with the body as JSON, decoding the result into v when it is not nil
+func (cf *cloudflare) call(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, rd)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+cf.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := cf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare answered %s", resp.Status)
+	}
+
+	if !envelope.Success {
+		var msgs []string
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare answered %s: %s", resp.Status, strings.Join(msgs, ", "))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(envelope.Result, v)
+}
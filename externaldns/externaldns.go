@@ -0,0 +1,504 @@
+package externaldns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/cache"
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// Types of the records the panel publishes
+const (
+	A     = "A"
+	AAAA  = "AAAA"
+	CNAME = "CNAME"
+	MX    = "MX"
+	NS    = "NS"
+	PTR   = "PTR"
+	TXT   = "TXT"
+)
+
+var (
+	// ErrNoProvider is returned for a name in a zone no provider serves
+	ErrNoProvider = errors.New("externaldns: no DNS provider serves the zone")
+
+	// ErrZoneNotFound is returned by a provider for a zone it does not serve
+	ErrZoneNotFound = errors.New("externaldns: zone not found")
+
+	// ErrFailed is returned when a provider refused a change or could not be reached
+	ErrFailed = errors.New("externaldns: the DNS provider failed")
+
+	// ErrUnsupported is returned for a change the provider serving the zone cannot make
+	ErrUnsupported = errors.New("externaldns: the DNS provider cannot do this")
+)
+
+// RecordSet is the records of a type at a name, which are published and removed together
+type RecordSet struct {
+	// The name of the records without a trailing dot, such as www.example.com
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  int    `json:"ttl"`
+
+	// The data of the records as in a zone file, with MX records as their preference and
+	// exchange such as 10 mail.example.com, and TXT records unquoted
+	Values []string `json:"values"`
+}
+
+// Provider publishes records at a DNS provider
+type Provider interface {
+	Name() string
+
+	// Zone returns the ID of the zone with the name at the provider, or ErrZoneNotFound
+	Zone(ctx context.Context, name string) (string, error)
+
+	// Records returns the record sets of the zone with the ID
+	Records(ctx context.Context, zone string) ([]RecordSet, error)
+
+	// Set replaces the records of the type at the name of the set
+	Set(ctx context.Context, zone string, rs RecordSet) error
+
+	// Delete removes the records of the type at the name
+	Delete(ctx context.Context, zone string, name string, typ string) error
+}
+
+// Proxy is a provider that can also serve the names of its zones through its CDN
+type Proxy interface {
+	// SetProxied sets whether the A, AAAA and CNAME records at the name are served
+	// through the CDN
+	SetProxied(ctx context.Context, zone string, name string, proxied bool) error
+
+	// Purge drops what the CDN cached for the hosts
+	Purge(ctx context.Context, zone string, hosts []string) error
+}
+
+// Info is what is reported about a configured provider
+type Info struct {
+	Name   string   `json:"name"`
+	Driver string   `json:"driver"`
+	Zones  []string `json:"zones"`
+}
+
+// Zone is a zone served by a provider
+type Zone struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+
+	// The ID of the zone at the provider
+	ID string `json:"id"`
+}
+
+// provider is a configured provider along with the zones it serves
+type provider struct {
+	Provider
+	config config.DNSProviderConfiguration
+}
+
+// timeout is how long a call to a provider may take
+const timeout = 30 * time.Second
+
+type publisher struct {
+	ttl       int
+	providers []provider
+}
+
+var std *publisher
+
+// zones caches the zones found at the providers by name, and the names that are none,
+// which Lookup asks about for every label of a name until it reaches its zone. Zones
+// added or moved at a provider are found once they expire
+var zones = cache.New("externaldns.zones", 5*time.Minute, 10000)
+
+// Configure sets up the drivers of the providers
+func Configure(c *config.DNSConfiguration) error {
+	p := &publisher{ttl: c.TTL}
+
+	for _, pc := range c.Providers {
+		if pc.Name == "" {
+			return errors.New("externaldns: every provider needs a name")
+		}
+
+		for _, existing := range p.providers {
+			if existing.config.Name == pc.Name {
+				return fmt.Errorf("externaldns: there is more than one provider named %s", pc.Name)
+			}
+		}
+
+		zones := make([]string, 0, len(pc.Zones))
+		for _, zone := range pc.Zones {
+			zones = append(zones, normalize(zone))
+		}
+		pc.Zones = zones
+
+		var d Provider
+		switch pc.Driver {
+		case "cloudflare":
+			if pc.Token == "" {
+				return fmt.Errorf("externaldns: the cloudflare provider %s requires an API token", pc.Name)
+			}
+			d = newCloudflare(pc)
+		case "route53":
+			if pc.Token == "" || pc.Secret == "" {
+				return fmt.Errorf("externaldns: the route53 provider %s requires an access key ID and secret", pc.Name)
+			}
+			d = newRoute53(pc)
+		default:
+			return fmt.Errorf("externaldns: unknown driver %q of provider %s", pc.Driver, pc.Name)
+		}
+
+		p.providers = append(p.providers, provider{Provider: d, config: pc})
+	}
+
+	std = p
+	zones.Purge()
+
+	return nil
+}
+
+// Providers returns the configured providers
+func Providers() []Info {
+	list := []Info{}
+	if std == nil {
+		return list
+	}
+
+	for _, p := range std.providers {
+		list = append(list, Info{Name: p.config.Name, Driver: p.Name(), Zones: append([]string{}, p.config.Zones...)})
+	}
+
+	return list
+}
+
+// Lookup returns the zone the name is in and the provider serving it. The most specific
+// zone wins, and zones configured for a provider are found without asking it
+func Lookup(name string) (Zone, error) {
+	if std == nil || len(std.providers) == 0 {
+		return Zone{}, ErrNoProvider
+	}
+
+	name = normalize(name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	labels := strings.Split(name, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		zone, err := std.zone(ctx, strings.Join(labels[i:], "."))
+		if errors.Is(err, ErrZoneNotFound) {
+			continue
+		}
+
+		return zone, err
+	}
+
+	return Zone{}, fmt.Errorf("%w: %s", ErrNoProvider, name)
+}
+
+// zone returns the zone with the name, asking the providers that do not list their
+// zones
+func (p *publisher) zone(ctx context.Context, name string) (Zone, error) {
+	v, err := zones.Get(name, func() (interface{}, error) {
+		for _, pr := range p.providers {
+			if len(pr.config.Zones) > 0 && !slices.Contains(pr.config.Zones, name) {
+				continue
+			}
+
+			id, err := pr.Zone(ctx, name)
+			if errors.Is(err, ErrZoneNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, failed(pr.config.Name, err)
+			}
+
+			return Zone{Name: name, Provider: pr.config.Name, ID: id}, nil
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return Zone{}, err
+	}
+
+	if v == nil {
+		return Zone{}, ErrZoneNotFound
+	}
+
+	return v.(Zone), nil
+}
+
+// provider returns the provider serving the zone
+func (p *publisher) provider(z Zone) Provider {
+	for _, pr := range p.providers {
+		if pr.config.Name == z.Provider {
+			return pr.Provider
+		}
+	}
+
+	return nil
+}
+
+// Records returns the record sets of the zone, sorted by name and type
+func Records(zone string) ([]RecordSet, error) {
+	z, err := exactZone(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	list, err := std.provider(z).Records(ctx, z.ID)
+	if err != nil {
+		return nil, failed(z.Provider, err)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+
+	return list, nil
+}
+
+// Set publishes the record set at the provider serving its zone, replacing the records of
+// its type at its name
+func Set(rs RecordSet) (RecordSet, error) {
+	if err := validate(&rs); err != nil {
+		return RecordSet{}, err
+	}
+
+	z, err := Lookup(rs.Name)
+	if err != nil {
+		return RecordSet{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := std.provider(z).Set(ctx, z.ID, rs); err != nil {
+		return RecordSet{}, failed(z.Provider, err)
+	}
+
+	return rs, nil
+}
+
+// Delete removes the records of the type at the name from the provider serving its zone
+func Delete(name string, typ string) error {
+	name, typ = normalize(name), strings.ToUpper(typ)
+
+	z, err := Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := std.provider(z).Delete(ctx, z.ID, name, typ); err != nil {
+		return failed(z.Provider, err)
+	}
+
+	return nil
+}
+
+// SetProxied sets whether the name is served through the CDN of the provider serving its
+// zone, which must be a Proxy
+func SetProxied(name string, proxied bool) error {
+	name = normalize(name)
+
+	z, p, err := proxy(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := p.SetProxied(ctx, z.ID, name, proxied); err != nil {
+		return failed(z.Provider, err)
+	}
+
+	return nil
+}
+
+// Purge drops what the CDN of the provider serving its zone cached for the host
+func Purge(host string) error {
+	host = normalize(host)
+
+	z, p, err := proxy(host)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := p.Purge(ctx, z.ID, []string{host}); err != nil {
+		return failed(z.Provider, err)
+	}
+
+	return nil
+}
+
+// proxy returns the zone of the name and its provider, which must be a Proxy
+func proxy(name string) (Zone, Proxy, error) {
+	z, err := Lookup(name)
+	if err != nil {
+		return Zone{}, nil, err
+	}
+
+	p, ok := std.provider(z).(Proxy)
+	if !ok {
+		return Zone{}, nil, fmt.Errorf("%w: %s has no CDN", ErrUnsupported, z.Provider)
+	}
+
+	return z, p, nil
+}
+
+// failed returns the error of the provider with the name as ErrFailed, keeping what it
+// said
+func failed(name string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrFailed, name, err)
+}
+
+// exactZone returns the zone with the name, which must be served by a provider
+func exactZone(name string) (Zone, error) {
+	if std == nil || len(std.providers) == 0 {
+		return Zone{}, ErrNoProvider
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	z, err := std.zone(ctx, normalize(name))
+	if errors.Is(err, ErrZoneNotFound) {
+		return Zone{}, fmt.Errorf("%w: %s", ErrNoProvider, name)
+	}
+
+	return z, err
+}
+
+// validate checks the record set and normalizes its name and type
+func validate(rs *RecordSet) error {
+	rs.Name = normalize(rs.Name)
+	rs.Type = strings.ToUpper(rs.Type)
+
+	if !validName(rs.Name, true) || strings.Count(rs.Name, ".") == 0 {
+		return fmt.Errorf("externaldns: invalid name %q", rs.Name)
+	}
+
+	if rs.TTL == 0 {
+		rs.TTL = std.ttlOrDefault()
+	}
+	if rs.TTL < 60 || rs.TTL > 86400 {
+		return errors.New("externaldns: the TTL must be between 60 and 86400 seconds")
+	}
+
+	if len(rs.Values) == 0 {
+		return errors.New("externaldns: a record set needs at least one value")
+	}
+
+	for i, v := range rs.Values {
+		v = strings.TrimSpace(v)
+		rs.Values[i] = v
+
+		switch rs.Type {
+		case A:
+			if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("externaldns: %q is not an IPv4 address", v)
+			}
+		case AAAA:
+			if ip := net.ParseIP(v); ip == nil || ip.To4() != nil {
+				return fmt.Errorf("externaldns: %q is not an IPv6 address", v)
+			}
+		case MX:
+			pref, exchange, err := splitMX(v)
+			if err != nil {
+				return err
+			}
+			rs.Values[i] = strconv.Itoa(pref) + " " + cmp.Or(exchange, ".")
+		case CNAME, NS, PTR:
+			rs.Values[i] = normalize(v)
+			if !validName(rs.Values[i], false) {
+				return fmt.Errorf("externaldns: %q is not a host name", v)
+			}
+		case TXT:
+			if v == "" {
+				return errors.New("externaldns: TXT records cannot be empty")
+			}
+		default:
+			return fmt.Errorf("externaldns: records of type %q cannot be published", rs.Type)
+		}
+	}
+
+	if rs.Type == CNAME && len(rs.Values) > 1 {
+		return errors.New("externaldns: a name can only have one CNAME record")
+	}
+
+	return nil
+}
+
+// ttlOrDefault returns the configured TTL of records published without one
+func (p *publisher) ttlOrDefault() int {
+	if p == nil || p.ttl == 0 {
+		return 300
+	}
+
+	return p.ttl
+}
+
+// splitMX returns the preference and exchange of an MX record
+func splitMX(v string) (int, string, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("externaldns: MX record %q must be a preference and exchange, such as 10 mail.example.com", v)
+	}
+
+	pref, err := strconv.Atoi(fields[0])
+	exchange := normalize(fields[1])
+	// A null MX of . says the domain accepts no mail
+	if err != nil || pref < 0 || pref > 65535 || (!validName(exchange, false) && fields[1] != ".") {
+		return 0, "", fmt.Errorf("externaldns: MX record %q must be a preference and exchange, such as 10 mail.example.com", v)
+	}
+
+	return pref, exchange, nil
+}
+
+// label matches a label of a name in a zone, which unlike a host name may hold
+// underscores, as in _dmarc.example.com
+var label = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+// validName returns true if the lowercase name is made of labels, the first of which
+// may be the * of a wildcard when allowed. Names are sent to providers within paths and
+// XML, which a valid name cannot break out of
+func validName(name string, wildcard bool) bool {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 {
+		return false
+	}
+
+	for i, l := range labels {
+		if !label.MatchString(l) && !(wildcard && i == 0 && l == "*") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalize returns the name lower case without a trailing dot
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
@@ -0,0 +1,303 @@
+package externaldns
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// fake is a provider serving the zones it holds in memory
+type fake struct {
+	zones map[string][]RecordSet
+	err   error
+
+	// The zones the provider was asked about and the changes it was asked to make
+	calls []string
+}
+
+func (f *fake) Name() string {
+	return "fake"
+}
+
+func (f *fake) Zone(ctx context.Context, name string) (string, error) {
+	f.calls = append(f.calls, "zone "+name)
+	if f.err != nil {
+		return "", f.err
+	}
+
+	if _, ok := f.zones[name]; !ok {
+		return "", ErrZoneNotFound
+	}
+
+	return "id-" + name, nil
+}
+
+func (f *fake) Records(ctx context.Context, zone string) ([]RecordSet, error) {
+	return f.zones[strings.TrimPrefix(zone, "id-")], f.err
+}
+
+func (f *fake) Set(ctx context.Context, zone string, rs RecordSet) error {
+	f.calls = append(f.calls, "set "+zone+" "+rs.Name+" "+rs.Type+" "+strings.Join(rs.Values, ","))
+
+	return f.err
+}
+
+func (f *fake) Delete(ctx context.Context, zone string, name string, typ string) error {
+	f.calls = append(f.calls, "delete "+zone+" "+name+" "+typ)
+
+	return f.err
+}
+
+// fakeCDN is a provider that also serves names through its CDN
+type fakeCDN struct {
+	*fake
+}
+
+func (f fakeCDN) SetProxied(ctx context.Context, zone string, name string, proxied bool) error {
+	f.calls = append(f.calls, "proxy "+zone+" "+name)
+
+	return f.err
+}
+
+func (f fakeCDN) Purge(ctx context.Context, zone string, hosts []string) error {
+	f.calls = append(f.calls, "purge "+zone+" "+strings.Join(hosts, ","))
+
+	return f.err
+}
+
+// configure sets up the publisher with a provider limited to example.com, through whose
+// CDN names can be served, and one asked about its zones
+func configure(t *testing.T) (listed *fake, asked *fake) {
+	t.Helper()
+
+	listed = &fake{zones: map[string][]RecordSet{"example.com": nil}}
+	asked = &fake{zones: map[string][]RecordSet{"example.org": nil, "sub.example.com": nil, "example.com": nil}}
+
+	std = &publisher{providers: []provider{
+		{Provider: fakeCDN{listed}, config: config.DNSProviderConfiguration{Name: "listed", Zones: []string{"example.com"}}},
+		{Provider: asked, config: config.DNSProviderConfiguration{Name: "asked"}},
+	}}
+	zones.Purge()
+
+	t.Cleanup(func() {
+		std = nil
+		zones.Purge()
+	})
+
+	return listed, asked
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []config.DNSProviderConfiguration
+		ok        bool
+	}{
+		{"none", nil, true},
+		{"cloudflare", []config.DNSProviderConfiguration{{Name: "cf", Driver: "cloudflare", Token: "t", Zones: []string{"Example.com."}}}, true},
+		{"route53", []config.DNSProviderConfiguration{{Name: "aws", Driver: "route53", Token: "id", Secret: "s"}}, true},
+		{"both", []config.DNSProviderConfiguration{{Name: "cf", Driver: "cloudflare", Token: "t"}, {Name: "aws", Driver: "route53", Token: "id", Secret: "s"}}, true},
+
+		{"no name", []config.DNSProviderConfiguration{{Driver: "cloudflare", Token: "t"}}, false},
+		{"same name twice", []config.DNSProviderConfiguration{{Name: "cf", Driver: "cloudflare", Token: "t"}, {Name: "cf", Driver: "cloudflare", Token: "u"}}, false},
+		{"cloudflare without a token", []config.DNSProviderConfiguration{{Name: "cf", Driver: "cloudflare"}}, false},
+		{"route53 without a secret", []config.DNSProviderConfiguration{{Name: "aws", Driver: "route53", Token: "id"}}, false},
+		{"unknown driver", []config.DNSProviderConfiguration{{Name: "x", Driver: "bind", Token: "t"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { std = nil })
+
+			err := Configure(&config.DNSConfiguration{Providers: tt.providers})
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v", err)
+			}
+			if !tt.ok {
+				return
+			}
+
+			providers := Providers()
+			if len(providers) != len(tt.providers) {
+				t.Errorf("providers %+v", providers)
+			}
+			if tt.name == "cloudflare" && !slices.Equal(providers[0].Zones, []string{"example.com"}) {
+				t.Errorf("zones %q", providers[0].Zones)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	listed, asked := configure(t)
+
+	tests := []struct {
+		name     string
+		zone     string
+		provider string
+		err      error
+	}{
+		{"www.example.com", "example.com", "listed", nil},
+		{"Example.COM.", "example.com", "listed", nil},
+		{"a.b.sub.example.com", "sub.example.com", "asked", nil},
+		{"www.example.org", "example.org", "asked", nil},
+		{"example.net", "", "", ErrNoProvider},
+		{"com", "", "", ErrNoProvider},
+	}
+
+	for _, tt := range tests {
+		z, err := Lookup(tt.name)
+		if !errors.Is(err, tt.err) || z.Name != tt.zone || z.Provider != tt.provider {
+			t.Errorf("%s is in %+v, %v, want %s at %s", tt.name, z, err, tt.zone, tt.provider)
+		}
+		if err == nil && z.ID != "id-"+tt.zone {
+			t.Errorf("%s is in the zone with ID %s", tt.name, z.ID)
+		}
+	}
+
+	// A provider limited to its zones is not asked about others, and what was found is
+	// remembered
+	if slices.Contains(listed.calls, "zone www.example.org") {
+		t.Errorf("the listed provider was asked %q", listed.calls)
+	}
+	asked.calls = nil
+	if _, err := Lookup("www.example.org"); err != nil || len(asked.calls) > 0 {
+		t.Errorf("looked up again with %v, asking %q", err, asked.calls)
+	}
+
+	// Failing to ask a provider is not taken for the zone being elsewhere
+	zones.Purge()
+	asked.err = errors.New("unreachable")
+	if _, err := Lookup("www.example.org"); !errors.Is(err, ErrFailed) {
+		t.Errorf("looking up with the provider failing: %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	listed, asked := configure(t)
+
+	tests := []struct {
+		name string
+		rs   RecordSet
+		call string
+	}{
+		{"A", RecordSet{Name: "WWW.example.com.", Type: "a", Values: []string{"192.0.2.1", " 192.0.2.2 "}}, "set id-example.com www.example.com A 192.0.2.1,192.0.2.2"},
+		{"in a subzone", RecordSet{Name: "www.sub.example.com", Type: AAAA, Values: []string{"2001:db8::1"}}, "set id-sub.example.com www.sub.example.com AAAA 2001:db8::1"},
+		{"MX", RecordSet{Name: "example.org", Type: MX, Values: []string{"10  Mail.Example.org.", "20 mx2.example.org"}}, "set id-example.org example.org MX 10 mail.example.org,20 mx2.example.org"},
+		{"null MX", RecordSet{Name: "example.org", Type: MX, Values: []string{"0 ."}}, "set id-example.org example.org MX 0 ."},
+		{"CNAME", RecordSet{Name: "s1._domainkey.example.com", Type: CNAME, Values: []string{"s1.domainkey.u1.wl.sendgrid.net."}}, "set id-example.com s1._domainkey.example.com CNAME s1.domainkey.u1.wl.sendgrid.net"},
+		{"TXT", RecordSet{Name: "_dmarc.example.com", Type: TXT, Values: []string{"v=DMARC1; p=none"}}, "set id-example.com _dmarc.example.com TXT v=DMARC1; p=none"},
+		{"wildcard", RecordSet{Name: "*.example.com", Type: A, Values: []string{"192.0.2.1"}}, "set id-example.com *.example.com A 192.0.2.1"},
+		{"PTR", RecordSet{Name: "1.2.0.192.example.org", Type: PTR, Values: []string{"mail.example.com"}}, "set id-example.org 1.2.0.192.example.org PTR mail.example.com"},
+
+		{"no zone", RecordSet{Name: "www.example.net", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"top level domain", RecordSet{Name: "com", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"name with a space", RecordSet{Name: "a b.example.com", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"name with a slash", RecordSet{Name: "../dns_records.example.com", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"wildcard within a name", RecordSet{Name: "www.*.example.com", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"empty label", RecordSet{Name: "www..example.com", Type: A, Values: []string{"192.0.2.1"}}, ""},
+		{"IPv6 as A", RecordSet{Name: "www.example.com", Type: A, Values: []string{"2001:db8::1"}}, ""},
+		{"IPv4 as AAAA", RecordSet{Name: "www.example.com", Type: AAAA, Values: []string{"192.0.2.1"}}, ""},
+		{"MX without a preference", RecordSet{Name: "example.com", Type: MX, Values: []string{"mail.example.com"}}, ""},
+		{"MX with more", RecordSet{Name: "example.com", Type: MX, Values: []string{"10 mail.example.com 20"}}, ""},
+		{"MX preference too large", RecordSet{Name: "example.com", Type: MX, Values: []string{"65536 mail.example.com"}}, ""},
+		{"MX to an address", RecordSet{Name: "example.com", Type: MX, Values: []string{"10 <192.0.2.1>"}}, ""},
+		{"CNAME with spaces", RecordSet{Name: "www.example.com", Type: CNAME, Values: []string{"a b.example.com"}}, ""},
+		{"two CNAMEs", RecordSet{Name: "www.example.com", Type: CNAME, Values: []string{"a.example.com", "b.example.com"}}, ""},
+		{"NS as a wildcard", RecordSet{Name: "sub.example.com", Type: NS, Values: []string{"*.example.com"}}, ""},
+		{"empty TXT", RecordSet{Name: "example.com", Type: TXT, Values: []string{" "}}, ""},
+		{"no values", RecordSet{Name: "example.com", Type: A}, ""},
+		{"TTL too short", RecordSet{Name: "example.com", Type: A, TTL: 30, Values: []string{"192.0.2.1"}}, ""},
+		{"unknown type", RecordSet{Name: "example.com", Type: "SRV", Values: []string{"0 5 5060 sip.example.com"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed.calls, asked.calls = nil, nil
+
+			rs, err := Set(tt.rs)
+			if (err == nil) != (tt.call != "") {
+				t.Fatalf("error %v", err)
+			}
+			if err == nil && rs.TTL != 300 {
+				t.Errorf("TTL %d", rs.TTL)
+			}
+
+			var calls []string
+			for _, c := range append(listed.calls, asked.calls...) {
+				if !strings.HasPrefix(c, "zone ") {
+					calls = append(calls, c)
+				}
+			}
+			if want := []string{tt.call}; (tt.call == "" && len(calls) > 0) || (tt.call != "" && !slices.Equal(calls, want)) {
+				t.Errorf("asked the providers to %q, want %q", calls, want)
+			}
+		})
+	}
+}
+
+func TestDeleteAndProxy(t *testing.T) {
+	listed, asked := configure(t)
+
+	if err := Delete("WWW.example.com.", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProxied("www.example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Purge("www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"delete id-example.com www.example.com A", "proxy id-example.com www.example.com", "purge id-example.com www.example.com"}
+	var calls []string
+	for _, c := range listed.calls {
+		if !strings.HasPrefix(c, "zone ") {
+			calls = append(calls, c)
+		}
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("asked the provider to %q, want %q", calls, want)
+	}
+
+	// The provider serving example.org has no CDN
+	if err := SetProxied("www.example.org", true); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("proxying at a provider without a CDN: %v", err)
+	}
+
+	asked.err = errors.New("refused")
+	if err := Delete("www.example.org", A); !errors.Is(err, ErrFailed) {
+		t.Errorf("deleting with the provider failing: %v", err)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	_, asked := configure(t)
+	asked.zones["example.org"] = []RecordSet{
+		{Name: "www.example.org", Type: A},
+		{Name: "example.org", Type: TXT},
+		{Name: "example.org", Type: MX},
+	}
+
+	list, err := Records("Example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rs := range list {
+		got = append(got, rs.Name+" "+rs.Type)
+	}
+	if want := []string{"example.org MX", "example.org TXT", "www.example.org A"}; !slices.Equal(got, want) {
+		t.Errorf("records %q, want %q", got, want)
+	}
+
+	// Records are read for zones, not for the names within them
+	if _, err := Records("www.example.org"); !errors.Is(err, ErrNoProvider) {
+		t.Errorf("records of a name: %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package externaldns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// route53API is the endpoint of the Route 53 API, which is global and signed for
+// us-east-1
+const route53API = "https://route53.amazonaws.com/2013-04-01/"
+
+// route53 publishes records through the Route 53 API with the access key of an IAM user
+// allowed to list and change the record sets of the hosted zones
+type route53 struct {
+	keyID  string
+	secret string
+	client *http.Client
+}
+
+func newRoute53(c config.DNSProviderConfiguration) *route53 {
+	return &route53{keyID: c.Token, secret: c.Secret, client: httpx.Client(timeout)}
+}
+
+func (r53 *route53) Name() string {
+	return "route53"
+}
+
+// r53Set is a resource record set as the API has it
+type r53Set struct {
+	Name    string `xml:"Name"`
+	Type    string `xml:"Type"`
+	TTL     int    `xml:"TTL,omitempty"`
+	Records []struct {
+		Value string `xml:"Value"`
+	} `xml:"ResourceRecords>ResourceRecord"`
+	AliasTarget *struct{} `xml:"AliasTarget"`
+}
+
+func (r53 *route53) Zone(ctx context.Context, name string) (string, error) {
+	var resp struct {
+		HostedZones []struct {
+			ID   string `xml:"Id"`
+			Name string `xml:"Name"`
+		} `xml:"HostedZones>HostedZone"`
+	}
+	if err := r53.call(ctx, http.MethodGet, "hostedzonesbyname?"+url.Values{"dnsname": {name}, "maxitems": {"1"}}.Encode(), nil, &resp); err != nil {
+		return "", err
+	}
+
+	for _, z := range resp.HostedZones {
+		if normalize(z.Name) == name {
+			return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+		}
+	}
+
+	return "", ErrZoneNotFound
+}
+
+func (r53 *route53) Records(ctx context.Context, zone string) ([]RecordSet, error) {
+	var list []RecordSet
+
+	path := "hostedzone/" + zone + "/rrset"
+	for {
+		var resp struct {
+			Sets           []r53Set `xml:"ResourceRecordSets>ResourceRecordSet"`
+			IsTruncated    bool     `xml:"IsTruncated"`
+			NextRecordName string   `xml:"NextRecordName"`
+			NextRecordType string   `xml:"NextRecordType"`
+		}
+		if err := r53.call(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, s := range resp.Sets {
+			// Aliases point at AWS resources rather than hold records
+			if s.AliasTarget != nil {
+				continue
+			}
+
+			switch s.Type {
+			case A, AAAA, CNAME, MX, NS, PTR, TXT:
+				list = append(list, s.recordSet())
+			}
+		}
+
+		if !resp.IsTruncated {
+			return list, nil
+		}
+
+		path = "hostedzone/" + zone + "/rrset?" + url.Values{"name": {resp.NextRecordName}, "type": {resp.NextRecordType}}.Encode()
+	}
+}
+
+func (r53 *route53) Set(ctx context.Context, zone string, rs RecordSet) error {
+	s := r53Set{Name: rs.Name + ".", Type: rs.Type, TTL: rs.TTL}
+	for _, v := range rs.Values {
+		switch rs.Type {
+		case TXT:
+			v = quoteTXT(v)
+		case MX:
+			pref, exchange, err := splitMX(v)
+			if err != nil {
+				return err
+			}
+			v = strconv.Itoa(pref) + " " + exchange + "."
+		case CNAME, NS, PTR:
+			v += "."
+		}
+
+		s.Records = append(s.Records, struct {
+			Value string `xml:"Value"`
+		}{v})
+	}
+
+	return r53.change(ctx, zone, "UPSERT", s)
+}
+
+func (r53 *route53) Delete(ctx context.Context, zone string, name string, typ string) error {
+	// Deleting a set requires it exactly as it is
+	var resp struct {
+		Sets []r53Set `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	params := url.Values{"name": {name + "."}, "type": {typ}, "maxitems": {"1"}}
+	if err := r53.call(ctx, http.MethodGet, "hostedzone/"+zone+"/rrset?"+params.Encode(), nil, &resp); err != nil {
+		return err
+	}
+
+	for _, s := range resp.Sets {
+		if normalize(unescapeName(s.Name)) != name || s.Type != typ {
+			continue
+		}
+		if s.AliasTarget != nil {
+			return fmt.Errorf("%s %s is an alias, which is managed in AWS", name, typ)
+		}
+
+		return r53.change(ctx, zone, "DELETE", s)
+	}
+
+	return nil
+}
+
+// change applies the action to the set
+func (r53 *route53) change(ctx context.Context, zone string, action string, s r53Set) error {
+	type change struct {
+		Action string `xml:"Action"`
+		Set    r53Set `xml:"ResourceRecordSet"`
+	}
+	req := struct {
+		XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Changes []change `xml:"ChangeBatch>Changes>Change"`
+	}{Changes: []change{{Action: action, Set: s}}}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return r53.call(ctx, http.MethodPost, "hostedzone/"+zone+"/rrset", append([]byte(xml.Header), body...), nil)
+}
+
+// recordSet returns the set as the panel has it
+func (s r53Set) recordSet() RecordSet {
+	rs := RecordSet{Name: normalize(unescapeName(s.Name)), Type: s.Type, TTL: s.TTL}
+	for _, r := range s.Records {
+		v := r.Value
+		switch s.Type {
+		case TXT:
+			v = unquoteTXT(v)
+		case MX, CNAME, NS, PTR:
+			v = strings.TrimSuffix(v, ".")
+		}
+		rs.Values = append(rs.Values, v)
+	}
+
+	return rs
+}
+
+// unescapeName returns the name with the octal escapes Route 53 uses for characters such
+// as the * of wildcards replaced
+func unescapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			if c, err := strconv.ParseUint(name[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+
+	return b.String()
+}
+
+// quoteTXT returns the value as the quoted strings of at most 255 characters a TXT
+// record holds
+func quoteTXT(v string) string {
+	var chunks []string
+	for len(v) > 0 {
+		n := min(len(v), 255)
+		chunk := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v[:n])
+		chunks = append(chunks, `"`+chunk+`"`)
+		v = v[n:]
+	}
+
+	return strings.Join(chunks, " ")
+}
+
+// unquoteTXT returns the value of a TXT record with its quoted strings joined
+func unquoteTXT(v string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(v):
+			i++
+			b.WriteByte(v[i])
+		case quoted:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// call calls the API with the body, decoding the answer into v when it is not nil
+func (r53 *route53) call(ctx context.Context, method string, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	r53.sign(req, body, time.Now().UTC())
+
+	resp, err := r53.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && failure.Message != "" {
+			return fmt.Errorf("route53 answered %s: %s: %s", resp.Status, failure.Code, failure.Message)
+		}
+		return fmt.Errorf("route53 answered %s", resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(data, v)
+}
+
+// sign signs the request with version 4 of the AWS signature
+func (r53 *route53) sign(req *http.Request, body []byte, now time.Time) {
+	const region, service = "us-east-1", "route53"
+
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\nx-amz-date:" + stamp + "\n",
+		"host;x-amz-date",
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + r53.secret)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-date, Signature=%s",
+		r53.keyID, scope, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// canonicalQuery returns the query sorted and escaped as signatures require
+func canonicalQuery(q url.Values) string {
+	// Encode sorts by key, and escapes spaces as + where signatures need %20
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
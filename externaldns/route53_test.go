@@ -0,0 +1,61 @@
+package externaldns
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQuoteTXT(t *testing.T) {
+	long := strings.Repeat("a", 300)
+
+	tests := []struct {
+		value  string
+		quoted string
+	}{
+		{"v=spf1 -all", `"v=spf1 -all"`},
+		{`say "hi" \o/`, `"say \"hi\" \\o/"`},
+		{long, `"` + long[:255] + `" "` + long[255:] + `"`},
+	}
+
+	for _, tt := range tests {
+		quoted := quoteTXT(tt.value)
+		if quoted != tt.quoted {
+			t.Errorf("quoteTXT(%q) = %s, want %s", tt.value, quoted, tt.quoted)
+		}
+		if v := unquoteTXT(quoted); v != tt.value {
+			t.Errorf("unquoteTXT(%s) = %q, want %q", quoted, v, tt.value)
+		}
+	}
+}
+
+func TestRecordSet(t *testing.T) {
+	set := func(name string, typ string, values ...string) r53Set {
+		s := r53Set{Name: name, Type: typ, TTL: 300}
+		for _, v := range values {
+			s.Records = append(s.Records, struct {
+				Value string `xml:"Value"`
+			}{v})
+		}
+		return s
+	}
+
+	tests := []struct {
+		set    r53Set
+		name   string
+		values []string
+	}{
+		{set("www.example.com.", A, "192.0.2.1"), "www.example.com", []string{"192.0.2.1"}},
+		{set("\\052.example.com.", A, "192.0.2.1"), "*.example.com", []string{"192.0.2.1"}},
+		{set("Example.com.", MX, "10 mail.example.com."), "example.com", []string{"10 mail.example.com"}},
+		{set("www.example.com.", CNAME, "example.com."), "www.example.com", []string{"example.com"}},
+		{set("example.com.", TXT, `"v=spf1 " "-all"`), "example.com", []string{"v=spf1 -all"}},
+	}
+
+	for _, tt := range tests {
+		rs := tt.set.recordSet()
+		if rs.Name != tt.name || rs.Type != tt.set.Type || rs.TTL != 300 || !slices.Equal(rs.Values, tt.values) {
+			t.Errorf("%s is %+v, want %s with %q", tt.set.Name, rs, tt.name, tt.values)
+		}
+	}
+}
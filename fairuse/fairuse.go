@@ -0,0 +1,516 @@
+package fairuse
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when sampling usage before Configure is called
+	ErrNotConfigured = errors.New("fairuse: not configured")
+
+	// ErrNotThrottled is returned when lifting the throttle of an account that is not
+	// throttled
+	ErrNotThrottled = errors.New("fairuse: the account is not throttled")
+)
+
+// Placeholders in the throttle and release commands
+const (
+	accountPlaceholder = "{account}"
+	uidPlaceholder     = "{uid}"
+	quotaPlaceholder   = "{quota}"
+)
+
+// defaultWindow is the minutes usage is measured over by policies that do not set a
+// window, and maxWindow the longest window usage is kept for
+const (
+	defaultWindow = 60
+	maxWindow     = 24 * 60
+)
+
+// Usage is the CPU time an account used recently
+type Usage struct {
+	Account string `json:"account"`
+
+	// Minutes of CPU time used in the last hour and in the last day, as far back as the
+	// panel has been sampling
+	Hour float64 `json:"hour"`
+	Day  float64 `json:"day"`
+
+	Throttle *Throttle `json:"throttle,omitempty"`
+}
+
+// Throttle is an account limited by a policy it went over, until the time it is lifted
+type Throttle struct {
+	Account string `json:"account"`
+	Policy  string `json:"policy"`
+
+	// The minutes of CPU time the account used within the window of the policy
+	CPUMinutes float64 `json:"cpu_minutes"`
+	Window     int     `json:"window"`
+
+	// The share of one CPU in percent the account is limited to, zero when it was only
+	// notified
+	Quota int `json:"quota"`
+
+	Started time.Time `json:"started"`
+	Until   time.Time `json:"until"`
+}
+
+// throttleKind is what throttles are kept under in the state store, so that they are
+// lifted after a restart
+const throttleKind = "fairuse.throttle"
+
+// process is a running process and the CPU time it has used
+type process struct {
+	PID int
+	UID uint32
+
+	// When the process started, in whatever unit the platform reports, so that a PID
+	// that was reused is not mistaken for the process before it
+	Start uint64
+	CPU   time.Duration
+}
+
+// sample is the CPU time an account used between two samples
+type sample struct {
+	Time time.Time
+	CPU  time.Duration
+}
+
+type monitor struct {
+	mu     sync.Mutex
+	config *config.FairUseConfiguration
+
+	// The processes at the last sample keyed by PID, nil until the first sample
+	last map[int]process
+
+	// The usage of every account over the longest window, oldest first
+	history map[string][]sample
+}
+
+var std *monitor
+
+// Configure checks the policies. Throttles from before a restart are kept in the state
+// store, which must be configured first, and lifted by the first sample after they expire
+func Configure(c *config.FairUseConfiguration) error {
+	names := make(map[string]bool, len(c.Policies))
+	for _, p := range c.Policies {
+		switch {
+		case p.Name == "":
+			return errors.New("fairuse: every policy needs a name")
+		case names[p.Name]:
+			return fmt.Errorf("fairuse: there is more than one policy named %s", p.Name)
+		case p.CPUMinutes <= 0:
+			return fmt.Errorf("fairuse: policy %s must allow more than zero CPU minutes", p.Name)
+		case p.Window < 0 || p.Window > maxWindow:
+			return fmt.Errorf("fairuse: the window of policy %s must be at most %d minutes", p.Name, maxWindow)
+		case p.Quota < 0:
+			return fmt.Errorf("fairuse: the quota of policy %s must not be negative", p.Name)
+		case p.Duration <= 0:
+			return fmt.Errorf("fairuse: policy %s must last more than zero minutes", p.Name)
+		case p.Quota > 0 && (len(c.Throttle) == 0 || len(c.Release) == 0):
+			return fmt.Errorf("fairuse: policy %s throttles accounts, which needs the throttle and release commands", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	std = &monitor{config: c, history: make(map[string][]sample)}
+
+	return nil
+}
+
+// Enabled returns true if any policy is enforced
+func Enabled() bool {
+	return std != nil && len(std.config.Policies) > 0
+}
+
+// Scheduled samples the CPU time of every account, lifts the throttles that have run
+// their course and applies the policies to the accounts over them. It is run by the
+// scheduler every minute. Throttles still expire once every policy has been removed
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	var accounts map[uint32]account
+	if Enabled() {
+		var err error
+		if accounts, err = listAccounts(); err != nil {
+			return err
+		}
+
+		if err := std.sample(now, accounts); err != nil {
+			return err
+		}
+	}
+
+	throttles, err := List()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	throttled := make(map[string]bool, len(throttles))
+	for _, t := range throttles {
+		if t.Until.After(now) {
+			throttled[t.Account] = true
+			continue
+		}
+
+		if err := std.release(t); err != nil {
+			errs = append(errs, err)
+			throttled[t.Account] = true
+			continue
+		}
+
+		events.Publish(events.Event{
+			Type:     "fairuse.release",
+			Account:  t.Account,
+			Resource: t.Account,
+			Data:     map[string]interface{}{"policy": t.Policy, "started": t.Started},
+		})
+	}
+
+	for _, a := range accounts {
+		if throttled[a.Username] {
+			continue
+		}
+
+		if err := std.enforce(a, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// account is a panel account and the system user its processes run as
+type account struct {
+	auth.User
+	UID string
+}
+
+// listAccounts returns the accounts whose processes are sampled, keyed by the ID of their
+// system user. Accounts without a system user of the same name have no processes
+func listAccounts() (map[uint32]account, error) {
+	list := make(map[uint32]account)
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleUser {
+			continue
+		}
+
+		su, err := user.Lookup(u.Username)
+		if err != nil {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(su.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("fairuse: unexpected ID %s of user %s", su.Uid, u.Username)
+		}
+		list[uint32(uid)] = account{User: u, UID: su.Uid}
+	}
+
+	return list, nil
+}
+
+// sample adds the CPU time each account used since the last sample to its history.
+// Processes started since count whole, and the first sample only records where every
+// process is. The monitor must be locked
+func (m *monitor) sample(now time.Time, accounts map[uint32]account) error {
+	procs, err := processes()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]time.Duration)
+	current := make(map[int]process, len(procs))
+	for _, p := range procs {
+		current[p.PID] = p
+
+		a, ok := accounts[p.UID]
+		if !ok || m.last == nil {
+			continue
+		}
+
+		prev, ok := m.last[p.PID]
+		switch {
+		case !ok || prev.Start != p.Start || prev.UID != p.UID:
+			used[a.Username] += p.CPU
+		case p.CPU > prev.CPU:
+			used[a.Username] += p.CPU - prev.CPU
+		}
+	}
+	m.last = current
+
+	cutoff := now.Add(-maxWindow * time.Minute)
+	for name, history := range m.history {
+		history = slices.DeleteFunc(history, func(s sample) bool { return s.Time.Before(cutoff) })
+		if len(history) == 0 {
+			delete(m.history, name)
+			continue
+		}
+		m.history[name] = history
+	}
+
+	for name, cpu := range used {
+		if cpu > 0 {
+			m.history[name] = append(m.history[name], sample{Time: now, CPU: cpu})
+		}
+	}
+
+	return nil
+}
+
+// used returns the minutes of CPU time the account used within the window ending now.
+// The monitor must be locked
+func (m *monitor) used(username string, now time.Time, window int) float64 {
+	cutoff := now.Add(-time.Duration(window) * time.Minute)
+
+	var cpu time.Duration
+	for _, s := range m.history[username] {
+		if s.Time.After(cutoff) {
+			cpu += s.CPU
+		}
+	}
+
+	return cpu.Minutes()
+}
+
+// round rounds the minutes to hundredths, which is as precise as they are reported
+func round(minutes float64) float64 {
+	return math.Round(minutes*100) / 100
+}
+
+// enforce applies the first policy of the account's package it is over. The monitor must
+// be locked
+func (m *monitor) enforce(a account, now time.Time) error {
+	for _, p := range m.config.Policies {
+		if len(p.Packages) > 0 && !slices.Contains(p.Packages, a.Package) {
+			continue
+		}
+
+		window := p.Window
+		if window == 0 {
+			window = defaultWindow
+		}
+
+		used := m.used(a.Username, now, window)
+		if used <= p.CPUMinutes {
+			continue
+		}
+
+		t := Throttle{
+			Account:    a.Username,
+			Policy:     p.Name,
+			CPUMinutes: round(used),
+			Window:     window,
+			Quota:      p.Quota,
+			Started:    now,
+			Until:      now.Add(time.Duration(p.Duration) * time.Minute),
+		}
+
+		return m.throttle(a, t, p.Notify)
+	}
+
+	return nil
+}
+
+// throttle limits the account and records the throttle, notifying the account if the
+// policy says to. The monitor must be locked
+func (m *monitor) throttle(a account, t Throttle, notify bool) error {
+	if t.Quota > 0 {
+		if err := m.run(m.config.Throttle, a.Username, a.UID, t.Quota); err != nil {
+			return fmt.Errorf("fairuse: failed to throttle %s: %w", a.Username, err)
+		}
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(throttleKind, t.Account, t)
+	})
+	if err != nil {
+		return err
+	}
+
+	zap.S().Named("fairuse").Infow("account went over its CPU policy", "account", t.Account, "policy", t.Policy, "cpu_minutes", t.CPUMinutes, "quota", t.Quota, "until", t.Until)
+
+	events.Publish(events.Event{
+		Type:     "fairuse.throttle",
+		Account:  t.Account,
+		Reseller: a.Reseller(),
+		Resource: t.Account,
+		Data: map[string]interface{}{
+			"policy":      t.Policy,
+			"cpu_minutes": t.CPUMinutes,
+			"window":      t.Window,
+			"quota":       t.Quota,
+			"until":       t.Until,
+		},
+	})
+
+	if notify {
+		data := map[string]interface{}{
+			"Username":   a.Username,
+			"CPUMinutes": t.CPUMinutes,
+			"Window":     t.Window,
+			"Quota":      t.Quota,
+			"Until":      t.Until.Format(time.RFC1123),
+		}
+		if err := auth.Notify(a.User, "fairuse_throttled", data); err != nil {
+			zap.S().Named("fairuse").Warnw("failed to notify throttled account", "account", a.Username, zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// release lifts the throttle. The monitor must be locked
+func (m *monitor) release(t Throttle) error {
+	if t.Quota > 0 {
+		uid := ""
+		if su, err := user.Lookup(t.Account); err == nil {
+			uid = su.Uid
+		}
+
+		if err := m.run(m.config.Release, t.Account, uid, t.Quota); err != nil {
+			return fmt.Errorf("fairuse: failed to lift the throttle of %s: %w", t.Account, err)
+		}
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Delete(throttleKind, t.Account)
+	})
+}
+
+// run runs the throttle or release command for the account
+func (m *monitor) run(command []string, username string, uid string, quota int) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	if uid == "" && slices.ContainsFunc(command, func(arg string) bool { return strings.Contains(arg, uidPlaceholder) }) {
+		return fmt.Errorf("fairuse: %s has no system user", username)
+	}
+
+	r := strings.NewReplacer(accountPlaceholder, username, uidPlaceholder, uid, quotaPlaceholder, strconv.Itoa(quota))
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = r.Replace(arg)
+	}
+
+	out, err := privsep.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// List returns the accounts that are throttled, by username
+func List() ([]Throttle, error) {
+	list := []Throttle{}
+
+	var throttles map[string]Throttle
+	if err := store.Load(throttleKind, &throttles); err != nil {
+		return nil, err
+	}
+
+	for _, t := range throttles {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+
+	return list, nil
+}
+
+// Lift lifts the throttle of the account before it expires
+func Lift(username string) (Throttle, error) {
+	if std == nil {
+		return Throttle{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var t Throttle
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(throttleKind, username, &t)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Throttle{}, ErrNotThrottled
+	} else if err != nil {
+		return Throttle{}, err
+	}
+
+	return t, std.release(t)
+}
+
+// Usages returns the CPU time every account with a system user used recently, busiest
+// first
+func Usages() ([]Usage, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	accounts, err := listAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	throttles, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+
+	list := []Usage{}
+	for _, a := range accounts {
+		u := Usage{
+			Account: a.Username,
+			Hour:    round(std.used(a.Username, now, 60)),
+			Day:     round(std.used(a.Username, now, maxWindow)),
+		}
+
+		for _, t := range throttles {
+			if t.Account == a.Username {
+				u.Throttle = &t
+			}
+		}
+
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hour != list[j].Hour {
+			return list[i].Hour > list[j].Hour
+		}
+		return list[i].Account < list[j].Account
+	})
+
+	return list, nil
+}
@@ -0,0 +1,18 @@
+package fairuse
+
+import "github.com/cosmicpanel/CosmicPanel/notify"
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "fairuse_throttled",
+		Description: "Sent to an account that used more CPU time than a fair use policy allows",
+		Fields:      []string{"Username", "CPUMinutes", "Window", "Quota", "Until"},
+		Template: notify.Template{
+			Subject: "Your {{.Product}} account is using too much CPU",
+			SMS:     "{{.Product}}: your account {{.Username}} used {{.CPUMinutes}} CPU minutes in {{.Window}} minutes{{if .Quota}} and is slowed down until {{.Until}}{{end}}.",
+			Body: "Your account {{.Username}} used {{.CPUMinutes}} minutes of CPU time in the last {{.Window}} minutes, which is more than its fair share of the server.\n\n" +
+				"{{if .Quota}}Its sites are limited to {{.Quota}}% of a CPU until {{.Until}}, after which they run at full speed again.\n\n{{end}}" +
+				"A busy site is most often caused by a slow plugin, a bot crawling it or a scheduled task running too often. Contact your provider if you need more resources.\n",
+		},
+	})
+}
@@ -0,0 +1,65 @@
+//go:build !linux
+
+package fairuse
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processes lists every process with ps. ps does not report when a process started in a
+// form worth comparing, so a reused PID counts as the process before it
+func processes() ([]process, error) {
+	out, err := exec.Command("ps", "-axo", "pid=,uid=,time=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []process
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		pid, err1 := strconv.Atoi(fields[0])
+		uid, err2 := strconv.ParseUint(fields[1], 10, 32)
+		cpu, err3 := parseTime(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+
+		list = append(list, process{PID: pid, UID: uint32(uid), CPU: cpu})
+	}
+
+	return list, scanner.Err()
+}
+
+// parseTime parses the CPU time ps reports, such as 12:34.56 on FreeBSD and macOS or
+// 1-02:03:04 elsewhere
+func parseTime(s string) (time.Duration, error) {
+	var days int
+	if d, rest, ok := strings.Cut(s, "-"); ok {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil {
+			return 0, err
+		}
+		s = rest
+	}
+
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + v
+	}
+
+	return time.Duration(days)*24*time.Hour + time.Duration(seconds*float64(time.Second)), nil
+}
@@ -0,0 +1,83 @@
+package fairuse
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc, which the kernel reports in 1/100ths
+// of a second regardless of its own tick rate
+const clockTicks = 100
+
+// processes reads every process from /proc. Processes that exit while they are read are
+// skipped
+func processes() ([]process, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []process
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		if p, ok := readProcess(pid); ok {
+			list = append(list, p)
+		}
+	}
+
+	return list, nil
+}
+
+// readProcess reads the owner, start time and CPU time of the process
+func readProcess(pid int) (process, bool) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return process{}, false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return process{}, false
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return process{}, false
+	}
+
+	// The name of the command is in parentheses and may contain spaces, so the fields
+	// are counted from after it, starting with the state as the third
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return process{}, false
+	}
+
+	fields := bytes.Fields(b[i+1:])
+	if len(fields) < 20 {
+		return process{}, false
+	}
+
+	utime, err1 := strconv.ParseUint(string(fields[11]), 10, 64)
+	stime, err2 := strconv.ParseUint(string(fields[12]), 10, 64)
+	start, err3 := strconv.ParseUint(string(fields[19]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return process{}, false
+	}
+
+	return process{
+		PID:   pid,
+		UID:   st.Uid,
+		Start: start,
+		CPU:   time.Duration(utime+stime) * time.Second / clockTicks,
+	}, true
+}
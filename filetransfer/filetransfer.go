@@ -0,0 +1,374 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when reading the logs before Configure is called
+	ErrNotConfigured = errors.New("filetransfer: not configured")
+
+	// ErrNotFound is returned for the usage of an account that does not exist
+	ErrNotFound = errors.New("filetransfer: account not found")
+)
+
+// Placeholders in the block and unblock commands
+const (
+	accountPlaceholder = "{account}"
+	uidPlaceholder     = "{uid}"
+)
+
+// The kinds kept in the state store: how far each log has been read, the sessions that
+// have not ended when the logs were last read, and the usage of every account
+const (
+	offsetKind  = "filetransfer.offset"
+	sessionKind = "filetransfer.session"
+	usageKind   = "filetransfer.usage"
+)
+
+// Usage is what an account transferred over FTP and SFTP in the current month
+type Usage struct {
+	Account string `json:"account"`
+	Month   string `json:"month"`
+	Bytes   int64  `json:"bytes"`
+
+	// The bytes the package of the account may transfer in a month, zero when it is not
+	// limited
+	Quota int64 `json:"quota,omitempty"`
+
+	// Whether the account has been stopped from logging in for going over its quota
+	Blocked bool `json:"blocked"`
+}
+
+type auditor struct {
+	mu     sync.Mutex
+	config *config.FileTransferConfiguration
+	ftpLog string
+}
+
+var std *auditor
+
+// Configure checks the quotas. FTP transfers are read from the xferlog, which the
+// statistics meter FTP traffic from too
+func Configure(c *config.FileTransferConfiguration, ftpLog string) error {
+	packages := make(map[string]bool, len(c.Quotas))
+	for _, q := range c.Quotas {
+		switch {
+		case q.Package == "":
+			return errors.New("filetransfer: every quota needs a package")
+		case packages[q.Package]:
+			return fmt.Errorf("filetransfer: package %s has more than one quota", q.Package)
+		case q.Megabytes <= 0:
+			return fmt.Errorf("filetransfer: the quota of package %s must be more than zero megabytes", q.Package)
+		case len(c.Block) == 0 || len(c.Unblock) == 0:
+			return errors.New("filetransfer: quotas need the block and unblock commands")
+		}
+		packages[q.Package] = true
+	}
+
+	if c.Idle <= 0 {
+		return errors.New("filetransfer: the idle minutes must be more than zero")
+	}
+
+	std = &auditor{config: c, ftpLog: ftpLog}
+
+	return nil
+}
+
+// Scheduled runs the filetransfer task. It reads the sessions logged since it last ran
+// into the audit log and blocks the accounts over their quota, or unblocks them once they
+// are under it again, such as in a new month
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	var offsets map[string]*offset
+	if err := store.Load(offsetKind, &offsets); err != nil {
+		return err
+	}
+
+	p := &parser{
+		idle:     time.Duration(std.config.Idle) * time.Minute,
+		maxFiles: std.config.MaxFiles,
+		month:    now.Format("2006-01"),
+		used:     make(map[string]int64),
+	}
+	if err := store.Load(sessionKind, &p.open); err != nil {
+		return err
+	}
+
+	var errs []error
+	read := func(path string, fn func(string)) {
+		if offsets[path] == nil {
+			offsets[path] = &offset{}
+		}
+		if err := follow(path, offsets[path], fn); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+
+	for _, path := range std.config.SFTPLogs {
+		read(path, p.sftp)
+	}
+	if std.ftpLog != "" {
+		read(std.ftpLog, p.ftp)
+	}
+	p.expire(now)
+
+	var usages map[string]Usage
+	err := store.Update(func(tx *store.Tx) error {
+		if err := tx.Load(usageKind, &usages); err != nil {
+			return err
+		}
+
+		for account, bytes := range p.used {
+			u := usages[account]
+			if u.Month != p.month {
+				u = Usage{Account: account, Month: p.month, Blocked: u.Blocked}
+			}
+			u.Bytes += bytes
+			usages[account] = u
+		}
+
+		if err := tx.Save(usageKind, usages); err != nil {
+			return err
+		}
+		if err := tx.Save(sessionKind, p.open); err != nil {
+			return err
+		}
+		return tx.Save(offsetKind, offsets)
+	})
+	if err != nil {
+		return err
+	}
+
+	resellers := make(map[string]string)
+	for _, u := range auth.Users() {
+		resellers[u.Username] = u.Reseller()
+	}
+
+	// Sessions are recorded with the account as the actor, which puts them in the audit
+	// log next to the changes the account made through the panel
+	for _, s := range p.closed {
+		after, _ := json.Marshal(s)
+		events.Publish(events.Event{
+			Type:     "filetransfer.session",
+			Time:     s.Ended,
+			Actor:    s.Account,
+			SourceIP: s.IP,
+			Account:  s.Account,
+			Reseller: resellers[s.Account],
+			Resource: s.ID,
+			After:    after,
+			Data: map[string]interface{}{
+				"protocol":   s.Protocol,
+				"uploaded":   s.Uploaded,
+				"downloaded": s.Downloaded,
+				"files":      len(s.Files) + s.More,
+			},
+		})
+	}
+
+	if err := std.enforce(p.month, usages); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// quota returns the bytes accounts of the package may transfer in a month, zero when they
+// are not limited
+func (a *auditor) quota(pkg string) int64 {
+	for _, q := range a.config.Quotas {
+		if q.Package == pkg {
+			return q.Megabytes << 20
+		}
+	}
+
+	return 0
+}
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "filetransfer_quota",
+		Description: "Sent to an account blocked from FTP and SFTP for going over its monthly transfer quota",
+		Fields:      []string{"Username", "Bytes", "Quota"},
+		Template: notify.Template{
+			Subject: "Your {{.Product}} account has used its file transfer quota",
+			Body: "Your account {{.Username}} transferred {{.Bytes}} bytes over FTP and SFTP this month, more than the {{.Quota}} bytes its package allows.\n\n" +
+				"Logging in over FTP and SFTP is blocked until the start of next month. Your sites are not affected.\n",
+		},
+	})
+}
+
+// enforce blocks the accounts over their quota in the month and unblocks those that are
+// not. The auditor must be locked
+func (a *auditor) enforce(month string, usages map[string]Usage) error {
+	var errs []error
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleUser {
+			continue
+		}
+
+		usage := usages[u.Username]
+		if usage.Month != month {
+			usage = Usage{Account: u.Username, Month: month, Blocked: usage.Blocked}
+		}
+
+		quota := a.quota(u.Package)
+		over := quota > 0 && usage.Bytes > quota
+		if over == usage.Blocked {
+			continue
+		}
+
+		command, typ := a.config.Unblock, "filetransfer.unblock"
+		if over {
+			command, typ = a.config.Block, "filetransfer.block"
+		}
+
+		if err := run(command, u.Username); err != nil {
+			errs = append(errs, fmt.Errorf("filetransfer: failed to %s %s: %w", strings.TrimPrefix(typ, "filetransfer."), u.Username, err))
+			continue
+		}
+
+		usage.Blocked = over
+		err := store.Update(func(tx *store.Tx) error {
+			return tx.Put(usageKind, u.Username, usage)
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		zap.S().Named("filetransfer").Infow("changed file transfer access of account", "account", u.Username, "blocked", over, "bytes", usage.Bytes, "quota", quota)
+
+		events.Publish(events.Event{
+			Type:     typ,
+			Account:  u.Username,
+			Reseller: u.Reseller(),
+			Resource: u.Username,
+			Data:     map[string]interface{}{"month": month, "bytes": usage.Bytes, "quota": quota},
+		})
+
+		if over {
+			data := map[string]interface{}{"Username": u.Username, "Bytes": usage.Bytes, "Quota": quota}
+			if err := auth.Notify(u, "filetransfer_quota", data); err != nil {
+				zap.S().Named("filetransfer").Warnw("failed to notify account over its transfer quota", "account", u.Username, zap.Error(err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Usages returns what every account transferred this month, most first
+func Usages() ([]Usage, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	list := []Usage{}
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleUser {
+			continue
+		}
+
+		usage, err := GetUsage(u.Username)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, usage)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Account < list[j].Account
+	})
+
+	return list, nil
+}
+
+// GetUsage returns what the account transferred this month and the quota of its package
+func GetUsage(account string) (Usage, error) {
+	if std == nil {
+		return Usage{}, ErrNotConfigured
+	}
+
+	month := time.Now().UTC().Format("2006-01")
+
+	var usage Usage
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(usageKind, account, &usage)
+	})
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return Usage{}, err
+	}
+
+	if usage.Month != month {
+		usage = Usage{Account: account, Month: month, Blocked: usage.Blocked}
+	}
+
+	for _, u := range auth.Users() {
+		if u.Username == account {
+			usage.Quota = std.quota(u.Package)
+			return usage, nil
+		}
+	}
+
+	return Usage{}, ErrNotFound
+}
+
+// run runs the block or unblock command for the account
+func run(command []string, username string) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	uid := ""
+	if su, err := user.Lookup(username); err == nil {
+		uid = su.Uid
+	}
+
+	if uid == "" && slices.ContainsFunc(command, func(arg string) bool { return strings.Contains(arg, uidPlaceholder) }) {
+		return fmt.Errorf("filetransfer: %s has no system user", username)
+	}
+
+	r := strings.NewReplacer(accountPlaceholder, username, uidPlaceholder, uid)
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = r.Replace(arg)
+	}
+
+	out, err := privsep.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package filetransfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// headSize is how much of the start of a log is hashed to notice it was rotated
+const headSize = 256
+
+// offset is how far a log has been read
+type offset struct {
+	Offset int64 `json:"offset"`
+
+	// A hash of the start of the log, which changes when the log is rotated even if the
+	// new log has grown past the offset by the time it is read again
+	Head string `json:"head"`
+}
+
+// follow passes every line written to the log since the offset to fn, moving the offset
+// past them
+func follow(path string, o *offset, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if head, err := readHead(f, o.Offset); err != nil {
+		return err
+	} else if o.Offset > info.Size() || head != o.Head {
+		o.Offset = 0
+	}
+
+	defer func() {
+		o.Head, _ = readHead(f, o.Offset)
+	}()
+
+	if _, err := f.Seek(o.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// A line without a newline is still being written, and is read next time
+			return nil
+		} else if err != nil {
+			return err
+		}
+		o.Offset += int64(len(line))
+
+		fn(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// readHead returns the hash of the start of the log, as much of it as has been read
+func readHead(f *os.File, read int64) (string, error) {
+	b := make([]byte, min(read, headSize))
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if len(b) == 0 {
+		return "", nil
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
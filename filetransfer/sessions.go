@@ -0,0 +1,265 @@
+package filetransfer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// The protocols sessions are read for
+const (
+	FTP  = "ftp"
+	SFTP = "sftp"
+)
+
+// What a session did to a file
+const (
+	Upload   = "upload"
+	Download = "download"
+	Delete   = "delete"
+	Rename   = "rename"
+	Mkdir    = "mkdir"
+	Rmdir    = "rmdir"
+)
+
+// sftpIdle is how long an SFTP session that logged nothing is kept open, after which its
+// end was lost, such as when sshd was killed
+const sftpIdle = 24 * time.Hour
+
+var (
+	// sftpLine matches a line the SFTP subsystem of sshd logs, keyed by its process
+	sftpLine = regexp.MustCompile(`(?:sftp-server|internal-sftp)\[(\d+)\]: (.*)$`)
+
+	// The messages of the SFTP subsystem sessions are read from
+	sftpOpened = regexp.MustCompile(`^session opened for local user (\S+) from \[([^\]]+)\]`)
+	sftpClosed = regexp.MustCompile(`^session closed for local user \S+ from \[[^\]]+\]`)
+	sftpClose  = regexp.MustCompile(`^close "(.*)" bytes read (\d+) written (\d+)$`)
+	sftpRemove = regexp.MustCompile(`^remove name "(.*)"$`)
+	sftpRename = regexp.MustCompile(`^rename old "(.*)" new "(.*)"$`)
+	sftpMkdir  = regexp.MustCompile(`^mkdir name "(.*)" mode`)
+	sftpRmdir  = regexp.MustCompile(`^rmdir name "(.*)"$`)
+)
+
+// Session is a login of an account over FTP or SFTP and the files it touched
+type Session struct {
+	ID       string `json:"id"`
+	Account  string `json:"account"`
+	Protocol string `json:"protocol"`
+	IP       string `json:"ip"`
+
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+
+	// Bytes written to and read from the server
+	Uploaded   int64 `json:"uploaded"`
+	Downloaded int64 `json:"downloaded"`
+
+	Files []File `json:"files"`
+
+	// The files touched beyond those listed
+	More int `json:"more,omitempty"`
+}
+
+// File is something a session did to a file
+type File struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+
+	// The path a renamed file had before
+	From  string `json:"from,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+}
+
+// parser assembles sessions from the lines of the logs
+type parser struct {
+	idle     time.Duration
+	maxFiles int
+
+	// The sessions that have not ended yet, keyed by the process of SFTP sessions and by
+	// the account and address of FTP sessions
+	open   map[string]*Session
+	closed []Session
+
+	// Bytes transferred by every account in the month counted
+	month string
+	used  map[string]int64
+}
+
+// touch adds what the session did to a file at the time
+func (p *parser) touch(s *Session, f File) {
+	s.Ended = f.Time
+
+	switch f.Action {
+	case Upload:
+		s.Uploaded += f.Bytes
+	case Download:
+		s.Downloaded += f.Bytes
+	}
+
+	if f.Bytes > 0 && f.Time.Format("2006-01") == p.month {
+		p.used[s.Account] += f.Bytes
+	}
+
+	if len(s.Files) < p.maxFiles {
+		s.Files = append(s.Files, f)
+	} else {
+		s.More++
+	}
+}
+
+// end moves the session to those that have ended
+func (p *parser) end(key string) {
+	if s, ok := p.open[key]; ok {
+		p.closed = append(p.closed, *s)
+		delete(p.open, key)
+	}
+}
+
+// expire ends the sessions that have been quiet for longer than they are kept open
+func (p *parser) expire(now time.Time) {
+	for key, s := range p.open {
+		idle := p.idle
+		if s.Protocol == SFTP {
+			idle = sftpIdle
+		}
+
+		if now.Sub(s.Ended) > idle {
+			p.end(key)
+		}
+	}
+}
+
+// sftp reads a line the SFTP subsystem logged. Files are counted when they are closed,
+// which is when sshd logs the bytes read and written
+func (p *parser) sftp(line string) {
+	m := sftpLine.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	at, ok := syslogTime(line)
+	if !ok {
+		return
+	}
+	at = at.UTC()
+
+	key, msg := SFTP+":"+m[1], m[2]
+
+	if o := sftpOpened.FindStringSubmatch(msg); o != nil {
+		p.end(key)
+		p.open[key] = &Session{ID: ids.New(), Account: o[1], Protocol: SFTP, IP: strings.TrimPrefix(o[2], "::ffff:"), Started: at, Ended: at, Files: []File{}}
+		return
+	}
+
+	s, ok := p.open[key]
+	if !ok {
+		return
+	}
+
+	switch {
+	case sftpClosed.MatchString(msg):
+		s.Ended = at
+		p.end(key)
+	case sftpClose.MatchString(msg):
+		c := sftpClose.FindStringSubmatch(msg)
+		read, _ := strconv.ParseInt(c[2], 10, 64)
+		written, _ := strconv.ParseInt(c[3], 10, 64)
+		if written > 0 {
+			p.touch(s, File{Time: at, Action: Upload, Path: c[1], Bytes: written})
+		}
+		if read > 0 {
+			p.touch(s, File{Time: at, Action: Download, Path: c[1], Bytes: read})
+		}
+	case sftpRemove.MatchString(msg):
+		p.touch(s, File{Time: at, Action: Delete, Path: sftpRemove.FindStringSubmatch(msg)[1]})
+	case sftpRename.MatchString(msg):
+		r := sftpRename.FindStringSubmatch(msg)
+		p.touch(s, File{Time: at, Action: Rename, Path: r[2], From: r[1]})
+	case sftpMkdir.MatchString(msg):
+		p.touch(s, File{Time: at, Action: Mkdir, Path: sftpMkdir.FindStringSubmatch(msg)[1]})
+	case sftpRmdir.MatchString(msg):
+		p.touch(s, File{Time: at, Action: Rmdir, Path: sftpRmdir.FindStringSubmatch(msg)[1]})
+	}
+}
+
+// ftp reads a line of the xferlog, which logs every transfer but not logins. Transfers of
+// an account from the same address belong to the same session until it has been idle
+// for longer than configured
+func (p *parser) ftp(line string) {
+	// The file name may contain spaces, so the fields after it are counted from the end
+	fields := strings.Fields(line)
+	if len(fields) < 18 {
+		return
+	}
+
+	at, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields[:5], " "), time.Local)
+	if err != nil {
+		return
+	}
+	at = at.UTC()
+
+	bytes, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return
+	}
+
+	tail := fields[len(fields)-9:]
+	ip, path, account := strings.TrimPrefix(fields[6], "::ffff:"), strings.Join(fields[8:len(fields)-9], " "), tail[4]
+
+	var action string
+	switch tail[2] {
+	case "i":
+		action = Upload
+	case "o":
+		action = Download
+	case "d":
+		action = Delete
+		bytes = 0
+	default:
+		return
+	}
+
+	key := FTP + ":" + account + "@" + ip
+	if s, ok := p.open[key]; ok && at.Sub(s.Ended) > p.idle {
+		p.end(key)
+	}
+
+	s, ok := p.open[key]
+	if !ok {
+		s = &Session{ID: ids.New(), Account: account, Protocol: FTP, IP: ip, Started: at, Ended: at, Files: []File{}}
+		p.open[key] = s
+	}
+
+	p.touch(s, File{Time: at, Action: action, Path: path, Bytes: bytes})
+}
+
+// syslogTime parses the time a syslog line starts with, either in RFC 3339 or in the
+// traditional format without a year
+func syslogTime(line string) (time.Time, bool) {
+	first, _, _ := strings.Cut(line, " ")
+	if t, err := time.Parse(time.RFC3339Nano, first); err == nil {
+		return t, true
+	}
+
+	if len(line) < 15 {
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation("Jan _2 15:04:05", line[:15], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// Lines from late last year are read early in the new year
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t, true
+}
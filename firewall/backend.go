@@ -0,0 +1,106 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// Port is a port opened by the rule set
+type Port struct {
+	Port     int
+	Protocol string
+}
+
+// RuleSet is the complete set of rules the panel wants applied. Backends replace the
+// panel's previous rules with the rule set as a whole rather than applying changes
+type RuleSet struct {
+	Ports   []Port
+	Blocked []string
+
+	// Determines if traffic not matching an open port is dropped. Established
+	// connections and loopback traffic are always allowed
+	DefaultDrop bool
+}
+
+// split returns the blocked ranges separated into IPv4 and IPv6
+func (s RuleSet) split() (v4 []string, v6 []string) {
+	for _, b := range s.Blocked {
+		ip, _, err := net.ParseCIDR(b)
+		if err != nil {
+			continue
+		}
+
+		if ip.To4() != nil {
+			v4 = append(v4, b)
+		} else {
+			v6 = append(v6, b)
+		}
+	}
+
+	return v4, v6
+}
+
+// Backend applies rule sets to the host firewall
+type Backend interface {
+	Name() string
+	Apply(set RuleSet) error
+}
+
+// Detect returns the configured backend, or when it is auto, the backend matching the
+// firewall in use on the host
+func Detect(c *config.FirewallConfiguration) (Backend, error) {
+	switch c.Backend {
+	case "csf":
+		return newCSF(c), nil
+	case "nftables":
+		return &nftables{}, nil
+	case "iptables":
+		return &iptables{}, nil
+	case "firewalld":
+		return &firewalld{}, nil
+	case "pf":
+		return &pf{}, nil
+	case "none":
+		return &noop{}, nil
+	case "", "auto":
+		return detect(c), nil
+	default:
+		return nil, fmt.Errorf("firewall: unknown backend %q", c.Backend)
+	}
+}
+
+// run executes the command with the input on stdin, returning the command output in the
+// error if it fails
+func run(input string, name string, args ...string) error {
+	cmd := privsep.Command(name, args...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("firewall: %s failed: %s: %s", name, err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
+
+// noop is used when no supported firewall is found on the host. Rules are still stored
+// so they are applied once a firewall is installed
+type noop struct{}
+
+func (b *noop) Name() string {
+	return "none"
+}
+
+func (b *noop) Apply(set RuleSet) error {
+	return nil
+}
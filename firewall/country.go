@@ -0,0 +1,106 @@
+package firewall
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// countryLists downloads and caches the CIDR ranges allocated to each country. Lists are
+// refreshed once they are older than a week
+type countryLists struct {
+	dir     string
+	source4 string
+	source6 string
+}
+
+// load returns every IPv4 and IPv6 range for the country
+func (c *countryLists) load(country string) ([]string, error) {
+	var cidrs []string
+	for _, src := range []struct{ family, url string }{{"4", c.source4}, {"6", c.source6}} {
+		if src.url == "" {
+			continue
+		}
+
+		path := filepath.Join(c.dir, fmt.Sprintf("%s.%s.zone", country, src.family))
+		if st, err := os.Stat(path); err != nil || time.Since(st.ModTime()) > 7*24*time.Hour {
+			if err := c.download(fmt.Sprintf(src.url, country), path); err != nil {
+				// An outdated list is better than no list if the source is unavailable
+				if _, statErr := os.Stat(path); statErr != nil {
+					return nil, err
+				}
+			}
+		}
+
+		list, err := readList(path)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, list...)
+	}
+
+	return cidrs, nil
+}
+
+// download fetches the list from the URL and writes it to the path
+func (c *countryLists) download(url string, path string) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	client := httpx.Client(30 * time.Second)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("firewall: country list %s returned %s", url, resp.Status)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.ReadFrom(resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readList reads a list containing one CIDR range per line, skipping anything that is
+// not a valid range
+func readList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cidrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if _, n, err := net.ParseCIDR(line); err == nil {
+			cidrs = append(cidrs, n.String())
+		}
+	}
+
+	return cidrs, scanner.Err()
+}
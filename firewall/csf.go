@@ -0,0 +1,269 @@
+package firewall
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// csfPorts matches the port lists in csf.conf, such as TCP_IN = "20,21,22"
+var csfPorts = regexp.MustCompile(`^(TCP_IN|TCP6_IN|UDP_IN|UDP6_IN)\s*=\s*"([^"]*)"`)
+
+// csf applies rules through ConfigServer Firewall on hosts already running it, so that
+// the panel and CSF do not overwrite each other's rules. Opened ports are added to the
+// port lists in csf.conf and blocked ranges are written to a file included from
+// csf.deny. CSF always drops traffic to ports that are not open, so the default policy
+// is left to it
+type csf struct {
+	mu      sync.Mutex
+	conf    string
+	deny    string
+	include string
+
+	// Ports the panel added to csf.conf, which are the only ones it ever removes. Ports
+	// the administrator opened are left alone even if the panel opened them too
+	added string
+}
+
+func newCSF(c *config.FirewallConfiguration) *csf {
+	dir := filepath.Dir(c.CSF.Config)
+
+	return &csf{
+		conf:    c.CSF.Config,
+		deny:    c.CSF.Deny,
+		include: filepath.Join(dir, "cosmicpanel.deny"),
+		added:   filepath.Join(dir, "cosmicpanel.ports"),
+	}
+}
+
+// csfEnabled returns true if CSF is installed and has not been disabled with csf -x
+func csfEnabled(c *config.FirewallConfiguration) bool {
+	if _, err := exec.LookPath("csf"); err != nil {
+		return false
+	}
+
+	if _, err := os.Stat(c.CSF.Config); err != nil {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(filepath.Dir(c.CSF.Config), "csf.disable"))
+
+	return os.IsNotExist(err)
+}
+
+func (b *csf) Name() string {
+	return "csf"
+}
+
+func (b *csf) Apply(set RuleSet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	portsChanged, err := b.applyPorts(set.Ports)
+	if err != nil {
+		return err
+	}
+
+	denyChanged, err := b.applyDeny(set.Blocked)
+	if err != nil {
+		return err
+	}
+
+	if !portsChanged && !denyChanged {
+		return nil
+	}
+
+	return run("", "csf", "-r")
+}
+
+// applyPorts updates the port lists in csf.conf, returning true if it changed
+func (b *csf) applyPorts(ports []Port) (bool, error) {
+	conf, err := os.ReadFile(b.conf)
+	if err != nil {
+		return false, err
+	}
+
+	previous, err := readLines(b.added)
+	if err != nil {
+		return false, err
+	}
+
+	var added []string
+	changed := false
+
+	// Ports are tracked per list, such as TCP6_IN/8080, since the administrator may
+	// have opened a port for only one address family
+	lines := strings.Split(string(conf), "\n")
+	for i, line := range lines {
+		loc := csfPorts.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+
+		name, protocol := line[loc[2]:loc[3]], strings.ToLower(line[loc[2]:loc[2]+3])
+		original := strings.Split(line[loc[4]:loc[5]], ",")
+
+		want := make(map[string]bool)
+		for _, p := range ports {
+			if p.Protocol == protocol {
+				want[strconv.Itoa(p.Port)] = true
+			}
+		}
+
+		var list []string
+		for _, entry := range original {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+
+			// Drop ports the panel added that are no longer wanted
+			if slices.Contains(previous, name+"/"+entry) && !want[entry] {
+				changed = true
+				continue
+			}
+
+			list = append(list, entry)
+		}
+
+		for _, p := range ports {
+			if p.Protocol != protocol {
+				continue
+			}
+
+			key := fmt.Sprintf("%s/%d", name, p.Port)
+			if slices.Contains(previous, key) || !covered(original, p.Port) {
+				added = append(added, key)
+			}
+
+			if !covered(list, p.Port) {
+				list = append(list, strconv.Itoa(p.Port))
+				changed = true
+			}
+		}
+
+		lines[i] = line[:loc[4]] + strings.Join(list, ",") + line[loc[5]:]
+	}
+
+	if changed {
+		if err := writeConfig(b.conf, []byte(strings.Join(lines, "\n"))); err != nil {
+			return false, err
+		}
+	}
+
+	if !slices.Equal(added, previous) {
+		if err := writeConfig(b.added, []byte(strings.Join(added, "\n")+"\n")); err != nil {
+			return false, err
+		}
+	}
+
+	return changed, nil
+}
+
+// applyDeny writes the blocked ranges to the include file and makes sure csf.deny
+// includes it, returning true if either changed
+func (b *csf) applyDeny(blocked []string) (bool, error) {
+	var content strings.Builder
+	content.WriteString("# Managed by CosmicPanel, changes are overwritten when the firewall rules change\n")
+	for _, cidr := range blocked {
+		fmt.Fprintf(&content, "%s # CosmicPanel\n", cidr)
+	}
+
+	changed := false
+	if current, err := os.ReadFile(b.include); err != nil || string(current) != content.String() {
+		if err := writeConfig(b.include, []byte(content.String())); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	deny, err := os.ReadFile(b.deny)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	directive := "Include " + b.include
+	if !slices.Contains(strings.Split(string(deny), "\n"), directive) {
+		if len(deny) > 0 && deny[len(deny)-1] != '\n' {
+			deny = append(deny, '\n')
+		}
+
+		if err := writeConfig(b.deny, append(deny, directive+"\n"...)); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// covered returns true if a CSF port list entry, either a port or a range such as
+// 30000:35000, includes the port
+func covered(list []string, port int) bool {
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+
+		low, high, isRange := strings.Cut(entry, ":")
+		if !isRange {
+			high = low
+		}
+
+		from, err := strconv.Atoi(low)
+		if err != nil {
+			continue
+		}
+
+		to, err := strconv.Atoi(high)
+		if err != nil {
+			continue
+		}
+
+		if port >= from && port <= to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readLines returns the non-empty lines of the file, or nothing if it does not exist
+func readLines(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+// writeConfig atomically replaces a CSF configuration file, keeping its permissions
+func writeConfig(path string, b []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,237 @@
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestCovered(t *testing.T) {
+	tests := []struct {
+		list []string
+		port int
+		want bool
+	}{
+		{[]string{"20", "21", "22"}, 22, true},
+		{[]string{"20", "21", "22"}, 23, false},
+		{[]string{" 22 "}, 22, true},
+		{[]string{"30000:35000"}, 30000, true},
+		{[]string{"30000:35000"}, 35000, true},
+		{[]string{"30000:35000"}, 32768, true},
+		{[]string{"30000:35000"}, 35001, false},
+		{[]string{"35000:30000"}, 32768, false},
+		{[]string{"80", "30000:35000", "443"}, 443, true},
+		{[]string{"http"}, 80, false},
+		{[]string{"30000:"}, 30000, false},
+		{[]string{""}, 0, false},
+		{nil, 22, false},
+	}
+
+	for _, tt := range tests {
+		if got := covered(tt.list, tt.port); got != tt.want {
+			t.Errorf("covered(%q, %d) = %v, want %v", tt.list, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestCSFApplyPorts(t *testing.T) {
+	const conf = "# TCP_IN = \"1\"\n" +
+		"TCP_IN = \"20,21,22,80,443,30000:35000\"\n" +
+		"TCP6_IN = \"20,21,22,80,443\"\n" +
+		"TCP_OUT = \"1:65535\"\n" +
+		"UDP_IN = \"53\" # DNS\n" +
+		"UDP6_IN = \"\"\n"
+
+	tests := []struct {
+		name     string
+		conf     string
+		previous string
+		ports    []Port
+		want     string
+		added    string
+		changed  bool
+	}{
+		{
+			"opens ports",
+			conf, "",
+			[]Port{{8443, "tcp"}, {5353, "udp"}},
+			"# TCP_IN = \"1\"\n" +
+				"TCP_IN = \"20,21,22,80,443,30000:35000,8443\"\n" +
+				"TCP6_IN = \"20,21,22,80,443,8443\"\n" +
+				"TCP_OUT = \"1:65535\"\n" +
+				"UDP_IN = \"53,5353\" # DNS\n" +
+				"UDP6_IN = \"5353\"\n",
+			"TCP_IN/8443\nTCP6_IN/8443\nUDP_IN/5353\nUDP6_IN/5353\n",
+			true,
+		},
+		{
+			"ports the administrator opened",
+			conf, "",
+			[]Port{{22, "tcp"}, {31000, "tcp"}},
+			"# TCP_IN = \"1\"\n" +
+				"TCP_IN = \"20,21,22,80,443,30000:35000\"\n" +
+				"TCP6_IN = \"20,21,22,80,443,31000\"\n" +
+				"TCP_OUT = \"1:65535\"\n" +
+				"UDP_IN = \"53\" # DNS\n" +
+				"UDP6_IN = \"\"\n",
+			"TCP6_IN/31000\n",
+			true,
+		},
+		{
+			"nothing to change",
+			conf, "",
+			[]Port{{443, "tcp"}, {22, "tcp"}},
+			conf,
+			"",
+			false,
+		},
+		{
+			"closes ports the panel opened",
+			"TCP_IN = \"22,8443,9000\"\nTCP6_IN = \"22,8443\"\n",
+			"TCP_IN/8443\nTCP_IN/9000\nTCP6_IN/8443\n",
+			[]Port{{9000, "tcp"}},
+			"TCP_IN = \"22,9000\"\nTCP6_IN = \"22,9000\"\n",
+			"TCP_IN/9000\nTCP6_IN/9000\n",
+			true,
+		},
+		{
+			"leaves ports the panel did not open",
+			"TCP_IN = \"22,8443\"\nTCP6_IN = \"22,8443\"\n",
+			"TCP_IN/8443\n",
+			nil,
+			"TCP_IN = \"22\"\nTCP6_IN = \"22,8443\"\n",
+			"",
+			true,
+		},
+		{
+			"reopens a port removed by hand",
+			"TCP_IN = \"22\"\n",
+			"TCP_IN/8443\n",
+			[]Port{{8443, "tcp"}},
+			"TCP_IN = \"22,8443\"\n",
+			"TCP_IN/8443\n",
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestCSF(t)
+			writeFile(t, b.conf, tt.conf)
+			if tt.previous != "" {
+				writeFile(t, b.added, tt.previous)
+			}
+
+			changed, err := b.applyPorts(tt.ports)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed %v, want %v", changed, tt.changed)
+			}
+
+			if got := readFile(t, b.conf); got != tt.want {
+				t.Errorf("csf.conf:\n%s\nwant:\n%s", got, tt.want)
+			}
+			added, err := readLines(b.added)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(added, strings.Fields(tt.added)) {
+				t.Errorf("added ports %q, want %q", added, strings.Fields(tt.added))
+			}
+
+			// Applying the same ports again changes nothing
+			changed, err = b.applyPorts(tt.ports)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed {
+				t.Error("applying the ports again changed csf.conf")
+			}
+		})
+	}
+}
+
+func TestCSFApplyDeny(t *testing.T) {
+	tests := []struct {
+		name    string
+		deny    string
+		blocked []string
+		want    string
+	}{
+		{"no csf.deny", "", []string{"203.0.113.0/24"}, "Include {include}\n"},
+		{"entries of the administrator", "192.0.2.1 # do not delete\n", nil, "192.0.2.1 # do not delete\nInclude {include}\n"},
+		{"no newline at the end", "192.0.2.1", nil, "192.0.2.1\nInclude {include}\n"},
+		{"already included", "Include {include}\n192.0.2.1\n", []string{"2001:db8::/32"}, "Include {include}\n192.0.2.1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestCSF(t)
+			expand := func(s string) string {
+				return strings.ReplaceAll(s, "{include}", b.include)
+			}
+			if tt.deny != "" {
+				writeFile(t, b.deny, expand(tt.deny))
+			}
+
+			changed, err := b.applyDeny(tt.blocked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("the first apply changed nothing")
+			}
+
+			if got := readFile(t, b.deny); got != expand(tt.want) {
+				t.Errorf("csf.deny:\n%s\nwant:\n%s", got, expand(tt.want))
+			}
+
+			want := "# Managed by CosmicPanel, changes are overwritten when the firewall rules change\n"
+			for _, cidr := range tt.blocked {
+				want += cidr + " # CosmicPanel\n"
+			}
+			if got := readFile(t, b.include); got != want {
+				t.Errorf("include:\n%s\nwant:\n%s", got, want)
+			}
+
+			if changed, err := b.applyDeny(tt.blocked); err != nil || changed {
+				t.Errorf("applying again: changed %v, %v", changed, err)
+			}
+			if changed, err := b.applyDeny(append(tt.blocked, "198.51.100.7/32")); err != nil || !changed {
+				t.Errorf("blocking another range: changed %v, %v", changed, err)
+			}
+		})
+	}
+}
+
+func newTestCSF(t *testing.T) *csf {
+	c := &config.FirewallConfiguration{}
+	dir := t.TempDir()
+	c.CSF.Config = filepath.Join(dir, "csf.conf")
+	c.CSF.Deny = filepath.Join(dir, "csf.deny")
+
+	return newCSF(c)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,35 @@
+//go:build !freebsd
+
+package firewall
+
+import (
+	"os/exec"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// detect returns the backend matching the firewall in use on the host. CSF and firewalld
+// are preferred when they are enabled since they would otherwise override rules written
+// directly to nftables or iptables
+func detect(c *config.FirewallConfiguration) Backend {
+	if csfEnabled(c) {
+		return newCSF(c)
+	}
+
+	if _, err := exec.LookPath("firewall-cmd"); err == nil {
+		if err := privsep.Command("firewall-cmd", "--state").Run(); err == nil {
+			return &firewalld{}
+		}
+	}
+
+	if _, err := exec.LookPath("nft"); err == nil {
+		return &nftables{}
+	}
+
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return &iptables{}
+	}
+
+	return &noop{}
+}
@@ -0,0 +1,17 @@
+package firewall
+
+import (
+	"os/exec"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// detect returns the backend matching the firewall in use on the host, which on FreeBSD
+// is pf when pfctl is installed
+func detect(c *config.FirewallConfiguration) Backend {
+	if _, err := exec.LookPath("pfctl"); err == nil {
+		return &pf{}
+	}
+
+	return &noop{}
+}
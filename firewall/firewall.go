@@ -0,0 +1,406 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+// Types of rules managed by the panel
+const (
+	AllowPort    = "allow_port"
+	BlockIP      = "block_ip"
+	BlockCountry = "block_country"
+)
+
+// ErrNotConfigured is returned when changing rules before Configure is called
+var ErrNotConfigured = errors.New("firewall: not configured")
+
+// ErrRuleNotFound is returned when a rule with the given ID does not exist
+var ErrRuleNotFound = errors.New("firewall: rule not found")
+
+// Rule is a single firewall rule owned by the panel. Rules are only ever applied to
+// the panel's own table or chain, rules added by the administrator are left untouched
+type Rule struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+
+	// The port and protocol opened by an allow_port rule
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+
+	// The address or CIDR range blocked by a block_ip rule
+	Source string `json:"source,omitempty"`
+
+	// The ISO 3166 country code blocked by a block_country rule
+	Country string `json:"country,omitempty"`
+
+	// The module that created the rule, such as panel, mail or bruteforce
+	Owner   string `json:"owner"`
+	Comment string `json:"comment,omitempty"`
+
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Validate normalizes the rule and checks that it is complete
+func (r *Rule) Validate() error {
+	switch r.Type {
+	case AllowPort:
+		if r.Port < 1 || r.Port > 65535 {
+			return fmt.Errorf("firewall: port %d is out of range", r.Port)
+		}
+
+		if r.Protocol == "" {
+			r.Protocol = "tcp"
+		}
+
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return fmt.Errorf("firewall: protocol must be tcp or udp")
+		}
+	case BlockIP:
+		source, err := normalizeSource(r.Source)
+		if err != nil {
+			return err
+		}
+		r.Source = source
+	case BlockCountry:
+		r.Country = strings.ToLower(r.Country)
+		if len(r.Country) != 2 || strings.Trim(r.Country, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return fmt.Errorf("firewall: country must be a two letter country code")
+		}
+	default:
+		return fmt.Errorf("firewall: unknown rule type %q", r.Type)
+	}
+
+	return nil
+}
+
+// expired returns true if the rule had a TTL that has passed
+func (r *Rule) expired(now time.Time) bool {
+	return r.Expires != nil && now.After(*r.Expires)
+}
+
+// Manager keeps the panel's firewall rules, persists them to disk and applies them to
+// the host through the detected backend
+type Manager struct {
+	mu        sync.Mutex
+	path      string
+	config    *config.FirewallConfiguration
+	backend   Backend
+	countries *countryLists
+	rules     []Rule
+}
+
+var std *Manager
+
+// Configure detects the firewall backend, loads the persisted rules and applies them
+func Configure(dataDir string, c *config.FirewallConfiguration) error {
+	backend, err := Detect(c)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(dataDir, "firewall")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	m := &Manager{
+		path:      filepath.Join(dir, "rules.json"),
+		config:    c,
+		backend:   backend,
+		countries: &countryLists{dir: filepath.Join(dir, "countries"), source4: c.CountrySource, source6: c.CountrySource6},
+	}
+
+	if b, err := os.ReadFile(m.path); err == nil {
+		if err := json.Unmarshal(b, &m.rules); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	std = m
+
+	zap.S().Named("firewall").Infow("using firewall backend", "backend", backend.Name())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.apply()
+}
+
+// BackendName returns the name of the backend rules are applied with
+func BackendName() string {
+	if std == nil {
+		return ""
+	}
+
+	return std.backend.Name()
+}
+
+// DefaultDrop returns true if traffic not matching an opened port is dropped
+func DefaultDrop() bool {
+	return std != nil && std.config.DefaultPolicy == "drop"
+}
+
+// Rules returns every rule currently managed by the panel
+func Rules() []Rule {
+	if std == nil {
+		return []Rule{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return append([]Rule{}, std.rules...)
+}
+
+// Add validates the rule, assigns it an ID and applies it. Callers publish their own
+// event for the change since only they know why the rule was added
+func Add(r Rule) (Rule, error) {
+	if std == nil {
+		return r, ErrNotConfigured
+	}
+
+	if err := r.Validate(); err != nil {
+		return r, err
+	}
+
+	r.ID = ids.New()
+	r.Created = time.Now().UTC()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.rules = append(std.rules, r)
+	if err := std.commit(); err != nil {
+		std.rules = std.rules[:len(std.rules)-1]
+		return r, err
+	}
+
+	return r, nil
+}
+
+// Remove deletes the rule with the given ID
+func Remove(id string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for i, r := range std.rules {
+		if r.ID != id {
+			continue
+		}
+
+		previous := std.rules
+		std.rules = append(append([]Rule{}, std.rules[:i]...), std.rules[i+1:]...)
+		if err := std.commit(); err != nil {
+			std.rules = previous
+			return err
+		}
+
+		return nil
+	}
+
+	return ErrRuleNotFound
+}
+
+// OpenPort opens a port on behalf of a module. Calling it again for a port the module
+// already opened is a no-op, so modules can call it every time they are enabled
+func OpenPort(owner string, port int, protocol string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	std.mu.Lock()
+	for _, r := range std.rules {
+		if r.Type == AllowPort && r.Owner == owner && r.Port == port && r.Protocol == protocol {
+			std.mu.Unlock()
+			return nil
+		}
+	}
+	std.mu.Unlock()
+
+	_, err := Add(Rule{Type: AllowPort, Port: port, Protocol: protocol, Owner: owner})
+
+	return err
+}
+
+// ClosePorts removes every port opened by the module, used when a module is disabled
+func ClosePorts(owner string) error {
+	for _, r := range Rules() {
+		if r.Type == AllowPort && r.Owner == owner {
+			if err := Remove(r.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Ban blocks an address for the given duration. A zero duration bans it permanently
+func Ban(owner string, source string, ttl time.Duration, reason string) (Rule, error) {
+	r := Rule{Type: BlockIP, Source: source, Owner: owner, Comment: reason}
+	if ttl > 0 {
+		expires := time.Now().UTC().Add(ttl)
+		r.Expires = &expires
+	}
+
+	return Add(r)
+}
+
+// Unban removes every block rule for the address
+func Unban(source string) error {
+	source, err := normalizeSource(source)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range Rules() {
+		if r.Type == BlockIP && r.Source == source {
+			if err := Remove(r.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Expire removes every rule whose TTL has passed. It is called periodically so that
+// temporary bans are lifted on time
+func Expire() error {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	now := time.Now()
+
+	var kept, expired []Rule
+	for _, r := range std.rules {
+		if r.expired(now) {
+			expired = append(expired, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	previous := std.rules
+	std.rules = kept
+	if err := std.commit(); err != nil {
+		std.rules = previous
+		return err
+	}
+
+	for _, r := range expired {
+		events.Publish(events.Event{Type: "firewall.rule.expire", Resource: r.ID, Data: map[string]interface{}{"rule": r}})
+	}
+
+	return nil
+}
+
+// commit applies the rules and then persists them, so that a rule set the backend
+// rejects is never written to disk
+func (m *Manager) commit() error {
+	if err := m.apply(); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(m.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
+
+// apply builds the rule set from every unexpired rule and hands it to the backend
+func (m *Manager) apply() error {
+	set := RuleSet{DefaultDrop: m.config.DefaultPolicy == "drop"}
+
+	// Several modules can open the same port, but each port is only applied once
+	opened := make(map[Port]bool)
+
+	now := time.Now()
+	for _, r := range m.rules {
+		if r.expired(now) {
+			continue
+		}
+
+		switch r.Type {
+		case AllowPort:
+			p := Port{Port: r.Port, Protocol: r.Protocol}
+			if !opened[p] {
+				opened[p] = true
+				set.Ports = append(set.Ports, p)
+			}
+		case BlockIP:
+			set.Blocked = append(set.Blocked, r.Source)
+		case BlockCountry:
+			cidrs, err := m.countries.load(r.Country)
+			if err != nil {
+				return err
+			}
+			set.Blocked = append(set.Blocked, cidrs...)
+		}
+	}
+
+	return m.backend.Apply(set)
+}
+
+// normalizeSource returns the address as a CIDR range, treating a bare address as a
+// range containing only that address
+func normalizeSource(s string) (string, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		// A range of every address would cut off the administrator along with everyone else
+		if ones, _ := n.Mask.Size(); ones == 0 {
+			return "", fmt.Errorf("firewall: %q would block every address", s)
+		}
+
+		return n.String(), nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("firewall: %q is not a valid address or CIDR range", s)
+	}
+
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+
+	return ip.String() + "/128", nil
+}
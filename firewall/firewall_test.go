@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		want Rule
+		ok   bool
+	}{
+		{"port", Rule{Type: AllowPort, Port: 8443}, Rule{Type: AllowPort, Port: 8443, Protocol: "tcp"}, true},
+		{"udp port", Rule{Type: AllowPort, Port: 53, Protocol: "udp"}, Rule{Type: AllowPort, Port: 53, Protocol: "udp"}, true},
+		{"highest port", Rule{Type: AllowPort, Port: 65535}, Rule{Type: AllowPort, Port: 65535, Protocol: "tcp"}, true},
+		{"port zero", Rule{Type: AllowPort, Port: 0}, Rule{}, false},
+		{"port too high", Rule{Type: AllowPort, Port: 65536}, Rule{}, false},
+		{"negative port", Rule{Type: AllowPort, Port: -22}, Rule{}, false},
+		{"other protocol", Rule{Type: AllowPort, Port: 22, Protocol: "sctp"}, Rule{}, false},
+		{"protocol with a script", Rule{Type: AllowPort, Port: 22, Protocol: "tcp dport 1-65535 accept;"}, Rule{}, false},
+
+		{"address", Rule{Type: BlockIP, Source: "203.0.113.7"}, Rule{Type: BlockIP, Source: "203.0.113.7/32"}, true},
+		{"IPv6 address", Rule{Type: BlockIP, Source: "2001:DB8::7"}, Rule{Type: BlockIP, Source: "2001:db8::7/128"}, true},
+		{"IPv4-mapped address", Rule{Type: BlockIP, Source: "::ffff:203.0.113.7"}, Rule{Type: BlockIP, Source: "203.0.113.7/32"}, true},
+		{"range", Rule{Type: BlockIP, Source: "198.51.100.0/24"}, Rule{Type: BlockIP, Source: "198.51.100.0/24"}, true},
+		{"range with host bits", Rule{Type: BlockIP, Source: "198.51.100.77/24"}, Rule{Type: BlockIP, Source: "198.51.100.0/24"}, true},
+		{"IPv6 range", Rule{Type: BlockIP, Source: "2001:db8:1::/48"}, Rule{Type: BlockIP, Source: "2001:db8:1::/48"}, true},
+		{"every IPv4 address", Rule{Type: BlockIP, Source: "0.0.0.0/0"}, Rule{}, false},
+		{"every address by a typo", Rule{Type: BlockIP, Source: "203.0.113.7/0"}, Rule{}, false},
+		{"every IPv6 address", Rule{Type: BlockIP, Source: "::/0"}, Rule{}, false},
+		{"host name", Rule{Type: BlockIP, Source: "attacker.example.com"}, Rule{}, false},
+		{"address with a zone", Rule{Type: BlockIP, Source: "fe80::1%eth0"}, Rule{}, false},
+		{"address with a script", Rule{Type: BlockIP, Source: "203.0.113.7 } ; flush ruleset ; {"}, Rule{}, false},
+		{"no address", Rule{Type: BlockIP}, Rule{}, false},
+		{"prefix too long", Rule{Type: BlockIP, Source: "203.0.113.7/33"}, Rule{}, false},
+
+		{"country", Rule{Type: BlockCountry, Country: "CN"}, Rule{Type: BlockCountry, Country: "cn"}, true},
+		{"three letters", Rule{Type: BlockCountry, Country: "chn"}, Rule{}, false},
+		{"one letter", Rule{Type: BlockCountry, Country: "c"}, Rule{}, false},
+		{"digits", Rule{Type: BlockCountry, Country: "12"}, Rule{}, false},
+		{"dots", Rule{Type: BlockCountry, Country: ".."}, Rule{}, false},
+		{"slash", Rule{Type: BlockCountry, Country: "a/"}, Rule{}, false},
+		{"two bytes of one letter", Rule{Type: BlockCountry, Country: "é"}, Rule{}, false},
+
+		{"unknown type", Rule{Type: "allow_ip", Source: "203.0.113.7"}, Rule{}, false},
+		{"no type", Rule{}, Rule{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.rule
+			err := r.Validate()
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			if tt.ok && r != tt.want {
+				t.Errorf("got %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestNftablesRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     RuleSet
+		want    []string
+		without []string
+	}{
+		{
+			name: "default accept",
+			set:  RuleSet{Ports: []Port{{22, "tcp"}}, Blocked: []string{"203.0.113.0/24"}},
+			want: []string{
+				"table inet cosmicpanel\ndelete table inet cosmicpanel\ntable inet cosmicpanel {",
+				"policy accept;",
+				"elements = { 203.0.113.0/24 }",
+				"ip saddr @blocked4 drop",
+				"tcp dport { 22 } accept",
+			},
+			without: []string{"ct state", "udp dport"},
+		},
+		{
+			name: "default drop",
+			set:  RuleSet{Ports: []Port{{22, "tcp"}, {443, "tcp"}, {53, "udp"}}, DefaultDrop: true},
+			want: []string{
+				"policy drop;",
+				"ct state established,related accept",
+				"iif lo accept",
+				"tcp dport { 22, 443 } accept",
+				"udp dport { 53 } accept",
+			},
+			without: []string{"elements"},
+		},
+		{
+			name: "ranges split by family",
+			set:  RuleSet{Blocked: []string{"203.0.113.7/32", "2001:db8::/32", "not a range"}},
+			want: []string{
+				"type ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 203.0.113.7/32 }",
+				"type ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 2001:db8::/32 }",
+			},
+			without: []string{"not a range"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := (&nftables{}).render(tt.set)
+			for _, s := range tt.want {
+				if !strings.Contains(script, s) {
+					t.Errorf("the script does not contain %q:\n%s", s, script)
+				}
+			}
+			for _, s := range tt.without {
+				if strings.Contains(script, s) {
+					t.Errorf("the script contains %q:\n%s", s, script)
+				}
+			}
+
+			// Blocked ranges are dropped before any port is accepted
+			if drop, accept := strings.Index(script, "@blocked6 drop"), strings.Index(script, "dport"); accept >= 0 && accept < drop {
+				t.Errorf("ports are accepted before blocked ranges are dropped:\n%s", script)
+			}
+		})
+	}
+}
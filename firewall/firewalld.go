@@ -0,0 +1,73 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// firewalld applies rules to the runtime configuration of the default zone using ports
+// and rich rules. The rules added by the panel are tracked so they can be removed when
+// the rule set changes, and are applied again when the daemon boots
+type firewalld struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (b *firewalld) Name() string {
+	return "firewalld"
+}
+
+func (b *firewalld) Apply(set RuleSet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var want []string
+	for _, p := range set.Ports {
+		want = append(want, fmt.Sprintf("--add-port=%d/%s", p.Port, p.Protocol))
+	}
+
+	for _, cidr := range set.Blocked {
+		family := "ipv4"
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+			family = "ipv6"
+		}
+
+		want = append(want, fmt.Sprintf("--add-rich-rule=rule family=%s source address=%s drop", family, cidr))
+	}
+
+	wanted := make(map[string]bool, len(want))
+	for _, w := range want {
+		wanted[w] = true
+	}
+
+	for _, a := range b.applied {
+		if !wanted[a] {
+			if err := run("", "firewall-cmd", removeFlag(a)); err != nil {
+				return err
+			}
+		}
+	}
+
+	current := make(map[string]bool, len(b.applied))
+	for _, a := range b.applied {
+		current[a] = true
+	}
+
+	for _, w := range want {
+		if !current[w] {
+			if err := run("", "firewall-cmd", w); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.applied = want
+
+	return nil
+}
+
+// removeFlag turns an --add flag into the matching --remove flag
+func removeFlag(add string) string {
+	return "--remove" + add[len("--add"):]
+}
@@ -0,0 +1,69 @@
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// iptables applies rules to a COSMICPANEL chain that is jumped to from the top of the
+// INPUT chain. The chain is flushed and rebuilt every time the rules change
+type iptables struct{}
+
+func (b *iptables) Name() string {
+	return "iptables"
+}
+
+func (b *iptables) Apply(set RuleSet) error {
+	v4, v6 := set.split()
+
+	if err := b.apply("iptables", set, v4, "icmp"); err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("ip6tables"); err != nil {
+		return nil
+	}
+
+	return b.apply("ip6tables", set, v6, "ipv6-icmp")
+}
+
+// apply restores the chain for a single address family and makes sure INPUT jumps to it
+func (b *iptables) apply(cmd string, set RuleSet, blocked []string, icmp string) error {
+	var s strings.Builder
+	s.WriteString("*filter\n:COSMICPANEL - [0:0]\n-F COSMICPANEL\n")
+
+	for _, cidr := range blocked {
+		fmt.Fprintf(&s, "-A COSMICPANEL -s %s -j DROP\n", cidr)
+	}
+
+	if set.DefaultDrop {
+		s.WriteString("-A COSMICPANEL -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT\n")
+		s.WriteString("-A COSMICPANEL -i lo -j ACCEPT\n")
+		fmt.Fprintf(&s, "-A COSMICPANEL -p %s -j ACCEPT\n", icmp)
+	}
+
+	for _, p := range set.Ports {
+		fmt.Fprintf(&s, "-A COSMICPANEL -p %s --dport %d -j ACCEPT\n", p.Protocol, p.Port)
+	}
+
+	if set.DefaultDrop {
+		s.WriteString("-A COSMICPANEL -j DROP\n")
+	} else {
+		s.WriteString("-A COSMICPANEL -j RETURN\n")
+	}
+
+	s.WriteString("COMMIT\n")
+
+	if err := run(s.String(), cmd+"-restore", "--noflush"); err != nil {
+		return err
+	}
+
+	if err := privsep.Command(cmd, "-C", "INPUT", "-j", "COSMICPANEL").Run(); err != nil {
+		return run("", cmd, "-I", "INPUT", "1", "-j", "COSMICPANEL")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nftables applies rules to a dedicated inet table, which is replaced atomically every
+// time the rules change
+type nftables struct{}
+
+func (b *nftables) Name() string {
+	return "nftables"
+}
+
+func (b *nftables) Apply(set RuleSet) error {
+	return run(b.render(set), "nft", "-f", "-")
+}
+
+// render builds the nft script replacing the cosmicpanel table. Creating the table before
+// deleting it makes the script work whether or not the table already exists
+func (b *nftables) render(set RuleSet) string {
+	v4, v6 := set.split()
+
+	var s strings.Builder
+	s.WriteString("table inet cosmicpanel\n")
+	s.WriteString("delete table inet cosmicpanel\n")
+	s.WriteString("table inet cosmicpanel {\n")
+
+	s.WriteString("\tset blocked4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n")
+	if len(v4) > 0 {
+		fmt.Fprintf(&s, "\t\telements = { %s }\n", strings.Join(v4, ", "))
+	}
+	s.WriteString("\t}\n")
+
+	s.WriteString("\tset blocked6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n")
+	if len(v6) > 0 {
+		fmt.Fprintf(&s, "\t\telements = { %s }\n", strings.Join(v6, ", "))
+	}
+	s.WriteString("\t}\n")
+
+	policy := "accept"
+	if set.DefaultDrop {
+		policy = "drop"
+	}
+
+	fmt.Fprintf(&s, "\tchain input {\n\t\ttype filter hook input priority -10; policy %s;\n", policy)
+	s.WriteString("\t\tip saddr @blocked4 drop\n")
+	s.WriteString("\t\tip6 saddr @blocked6 drop\n")
+	if set.DefaultDrop {
+		s.WriteString("\t\tct state established,related accept\n")
+		s.WriteString("\t\tiif lo accept\n")
+		s.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	}
+
+	for _, proto := range []string{"tcp", "udp"} {
+		var ports []string
+		for _, p := range set.Ports {
+			if p.Protocol == proto {
+				ports = append(ports, fmt.Sprint(p.Port))
+			}
+		}
+
+		if len(ports) > 0 {
+			fmt.Fprintf(&s, "\t\t%s dport { %s } accept\n", proto, strings.Join(ports, ", "))
+		}
+	}
+
+	s.WriteString("\t}\n}\n")
+
+	return s.String()
+}
@@ -0,0 +1,57 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pf applies rules to the cosmicpanel anchor of the FreeBSD packet filter, which is
+// replaced as a whole every time the rules change. pf.conf must load the anchor with
+// anchor "cosmicpanel" for the rules to take effect
+type pf struct{}
+
+func (b *pf) Name() string {
+	return "pf"
+}
+
+func (b *pf) Apply(set RuleSet) error {
+	return run(b.render(set), "pfctl", "-a", "cosmicpanel", "-f", "-")
+}
+
+// render builds the rules of the anchor. Rules are quick so that the main ruleset cannot
+// override them, and pf keeps state for the connections it passes
+func (b *pf) render(set RuleSet) string {
+	var s strings.Builder
+
+	s.WriteString("table <cosmicpanel_blocked> persist")
+	if len(set.Blocked) > 0 {
+		fmt.Fprintf(&s, " { %s }", strings.Join(set.Blocked, ", "))
+	}
+	s.WriteString("\n")
+
+	s.WriteString("block drop in quick from <cosmicpanel_blocked>\n")
+	if set.DefaultDrop {
+		s.WriteString("pass quick on lo0 all\n")
+		s.WriteString("pass in quick inet proto icmp all keep state\n")
+		s.WriteString("pass in quick inet6 proto ipv6-icmp all keep state\n")
+	}
+
+	for _, proto := range []string{"tcp", "udp"} {
+		var ports []string
+		for _, p := range set.Ports {
+			if p.Protocol == proto {
+				ports = append(ports, fmt.Sprint(p.Port))
+			}
+		}
+
+		if len(ports) > 0 {
+			fmt.Fprintf(&s, "pass in quick proto %s to port { %s } keep state\n", proto, strings.Join(ports, " "))
+		}
+	}
+
+	if set.DefaultDrop {
+		s.WriteString("block drop in quick all\n")
+	}
+
+	return s.String()
+}
@@ -0,0 +1,186 @@
+package httpx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options tune the transport shared by every client
+type Options struct {
+	// The proxy requests are sent through, such as http://proxy.example.com:3128. The
+	// proxy of the environment is used when empty, from HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY
+	Proxy string
+
+	// Hosts, domains and networks reached directly rather than through the proxy, such as
+	// example.com for the domain and its subdomains or 10.0.0.0/8
+	NoProxy []string
+
+	// The connections kept open to each host between requests, and the most opened to
+	// each host at once, without limit when zero
+	IdleConnsPerHost int
+	ConnsPerHost     int
+
+	// How long a connection may sit idle before it is closed
+	IdleTimeout time.Duration
+}
+
+// defaults are the options the transport is tuned with until Configure is called
+var defaults = Options{IdleConnsPerHost: 8, IdleTimeout: 90 * time.Second}
+
+var (
+	mu sync.RWMutex
+
+	// The transport requests are sent with
+	shared, _ = newTransport(defaults)
+)
+
+// Configure replaces the shared transport with one tuned with the options. Clients
+// already handed out use it from their next request on
+func Configure(o Options) error {
+	t, err := newTransport(o)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	old := shared
+	shared = t
+	mu.Unlock()
+
+	old.CloseIdleConnections()
+
+	return nil
+}
+
+// Client returns a client sending requests with the shared transport, which gives up on
+// a request after the timeout. Clients are cheap and may be created per call, as their
+// connections are pooled by the transport
+func Client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Transport, Timeout: timeout}
+}
+
+// Transport sends requests with the shared transport, counting them for Stats. Use it
+// to wrap the shared transport in one of a client's own
+var Transport http.RoundTripper = roundTripper{}
+
+// roundTripper sends requests with the current shared transport
+type roundTripper struct{}
+
+func (roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := counters(req.URL.Hostname())
+	h.inFlight.Add(1)
+	defer h.inFlight.Add(-1)
+
+	mu.RLock()
+	t := shared
+	mu.RUnlock()
+
+	start := time.Now()
+	resp, err := t.RoundTrip(req)
+	h.nanos.Add(uint64(time.Since(start)))
+	h.requests.Add(1)
+
+	switch {
+	case err != nil:
+		h.errors.Add(1)
+	case resp.StatusCode >= 500:
+		h.serverErrors.Add(1)
+	}
+
+	return resp, err
+}
+
+// newTransport returns a transport tuned with the options
+func newTransport(o Options) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	t.MaxIdleConnsPerHost = o.IdleConnsPerHost
+	t.MaxConnsPerHost = o.ConnsPerHost
+	if o.IdleTimeout > 0 {
+		t.IdleConnTimeout = o.IdleTimeout
+	}
+
+	if o.Proxy == "" {
+		t.Proxy = http.ProxyFromEnvironment
+		return t, nil
+	}
+
+	proxy, err := url.Parse(o.Proxy)
+	if err != nil || proxy.Host == "" {
+		return nil, errors.New("httpx: invalid proxy URL")
+	}
+
+	bypass, err := parseNoProxy(o.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if bypass(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+
+	return t, nil
+}
+
+// parseNoProxy returns a function reporting whether a host is reached directly. Loopback
+// addresses and localhost always are
+func parseNoProxy(list []string) (func(host string) bool, error) {
+	var domains []string
+	var networks []*net.IPNet
+
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("httpx: invalid network %q in noproxy", entry)
+			}
+			networks = append(networks, n)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		default:
+			domains = append(domains, strings.TrimPrefix(entry, "."))
+		}
+	}
+
+	return func(host string) bool {
+		host = strings.ToLower(host)
+		if host == "localhost" {
+			return true
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.IsLoopback() {
+				return true
+			}
+			for _, n := range networks {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+
+		for _, d := range domains {
+			if d == "*" || host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
@@ -0,0 +1,83 @@
+package httpx
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxHosts is the number of hosts counted separately. Requests to hosts beyond it, such
+// as the endpoints of many webhooks, are counted under other
+const maxHosts = 100
+
+// Stats are the counters of the requests sent to a host
+type Stats struct {
+	Host     string `json:"host"`
+	Requests uint64 `json:"requests"`
+	InFlight int64  `json:"in_flight"`
+
+	// Requests that failed without a response, and those the server failed with a 5xx
+	Errors       uint64 `json:"errors"`
+	ServerErrors uint64 `json:"server_errors"`
+
+	// The mean time until the response headers were received
+	Latency string `json:"latency"`
+}
+
+// hostCounters counts the requests sent to a host
+type hostCounters struct {
+	requests     atomic.Uint64
+	inFlight     atomic.Int64
+	errors       atomic.Uint64
+	serverErrors atomic.Uint64
+	nanos        atomic.Uint64
+}
+
+var (
+	hmu   sync.Mutex
+	hosts = make(map[string]*hostCounters)
+)
+
+// counters returns the counters of the host
+func counters(host string) *hostCounters {
+	hmu.Lock()
+	defer hmu.Unlock()
+
+	if _, ok := hosts[host]; !ok && len(hosts) >= maxHosts {
+		host = "other"
+	}
+
+	h, ok := hosts[host]
+	if !ok {
+		h = &hostCounters{}
+		hosts[host] = h
+	}
+
+	return h
+}
+
+// All returns the counters of every host requests were sent to, sorted by host
+func All() []Stats {
+	hmu.Lock()
+	defer hmu.Unlock()
+
+	list := make([]Stats, 0, len(hosts))
+	for host, h := range hosts {
+		s := Stats{
+			Host:         host,
+			Requests:     h.requests.Load(),
+			InFlight:     h.inFlight.Load(),
+			Errors:       h.errors.Load(),
+			ServerErrors: h.serverErrors.Load(),
+		}
+		if s.Requests > 0 {
+			s.Latency = time.Duration(h.nanos.Load() / s.Requests).Round(time.Millisecond).String()
+		}
+		list = append(list, s)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	return list
+}
@@ -0,0 +1,34 @@
+//go:build !freebsd
+
+package initsys
+
+import (
+	"os"
+	"os/exec"
+)
+
+// drivers are the init systems the daemon can be installed with
+var drivers = []Driver{systemdDriver{}, openrc{}, runit{}}
+
+// detect returns the driver of the init system running this server, falling back to
+// systemd when it cannot be told
+func detect() Driver {
+	// systemd creates this directory at boot, see sd_booted(3)
+	if info, err := os.Stat("/run/systemd/system"); err == nil && info.IsDir() {
+		return systemdDriver{}
+	}
+
+	if _, err := os.Stat("/run/openrc/softlevel"); err == nil {
+		return openrc{}
+	}
+
+	if runitRunning() {
+		return runit{}
+	}
+
+	if _, err := exec.LookPath("rc-service"); err == nil {
+		return openrc{}
+	}
+
+	return systemdDriver{}
+}
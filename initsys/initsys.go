@@ -0,0 +1,86 @@
+package initsys
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// Daemon is how the panel is run as a service
+type Daemon struct {
+	// The absolute paths of the binary and the configuration file it is started with
+	Binary string
+	Config string
+
+	// How long the init system waits to hear from the daemon before restarting it, for
+	// those that supervise it with a watchdog
+	WatchdogSec int
+}
+
+// Driver controls the services of an init system and installs the daemon as one of them
+type Driver interface {
+	Name() string
+
+	// The name the daemon is installed under and where its service is written by default
+	Service() string
+	Path() string
+
+	// Render returns the service running the daemon, and Install writes it to the path
+	// and enables it, starting or restarting it if now is set
+	Render(d Daemon) ([]byte, error)
+	Install(d Daemon, path string, now bool) error
+	Uninstall(path string) error
+
+	// Active returns true if the service is running, and Restart restarts it
+	Active(name string) bool
+	Restart(name string) error
+}
+
+// Detect returns the driver of the named init system, or when the name is auto or empty,
+// of the init system running this server
+func Detect(name string) (Driver, error) {
+	switch name {
+	case "", "auto":
+		return detect(), nil
+	}
+
+	for _, d := range drivers {
+		if d.Name() == name {
+			return d, nil
+		}
+	}
+
+	names := make([]string, len(drivers))
+	for i, d := range drivers {
+		names[i] = d.Name()
+	}
+
+	return nil, fmt.Errorf("initsys: unknown init system %q, must be one of auto, %s", name, strings.Join(names, ", "))
+}
+
+// command runs the command, including its output in the error
+func command(name string, args ...string) error {
+	out, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// validate returns an error if the paths the daemon is started with cannot be written
+// into a service as they are
+func validate(d Daemon) error {
+	for _, p := range []string{d.Binary, d.Config} {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("initsys: %s must be an absolute path", p)
+		}
+
+		if strings.ContainsAny(p, " \t\n\"'\\$`%") {
+			return fmt.Errorf("initsys: %s contains characters that cannot be used in a service", p)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+//go:build !freebsd
+
+package initsys
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// openrc installs the daemon as an OpenRC service in the default runlevel, supervised by
+// supervise-daemon, as on Alpine and Gentoo
+type openrc struct{}
+
+// openrcTemplate is the init script
+var openrcTemplate = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+# Managed by CosmicPanel, reinstall with cosmicpanel service install
+
+description="CosmicPanel web hosting control panel"
+
+supervisor="supervise-daemon"
+command="{{.Binary}}"
+command_args="serve -config {{.Config}}"
+directory="{{.Dir}}"
+pidfile="/run/${RC_SVCNAME}.pid"
+respawn_delay=5
+respawn_max=0
+rc_ulimit="-n 65536"
+
+depend() {
+	need net
+	after firewall
+}
+`))
+
+func (openrc) Name() string {
+	return "openrc"
+}
+
+func (openrc) Service() string {
+	return "cosmicpanel"
+}
+
+func (openrc) Path() string {
+	return "/etc/init.d/cosmicpanel"
+}
+
+func (openrc) Render(d Daemon) ([]byte, error) {
+	if err := validate(d); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err := openrcTemplate.Execute(&buf, struct {
+		Daemon
+		Dir string
+	}{d, filepath.Dir(d.Config)})
+
+	return buf.Bytes(), err
+}
+
+func (r openrc) Install(d Daemon, path string, now bool) error {
+	b, err := r.Render(d)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(path, b, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	if err := command("rc-update", "add", name, "default"); err != nil {
+		return err
+	}
+
+	if now {
+		return r.Restart(name)
+	}
+
+	return nil
+}
+
+func (r openrc) Uninstall(path string) error {
+	name := filepath.Base(path)
+
+	if r.Active(name) {
+		if err := command("rc-service", name, "stop"); err != nil {
+			return err
+		}
+	}
+
+	if err := command("rc-update", "del", name, "default"); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (openrc) Active(name string) bool {
+	return command("rc-service", name, "status") == nil
+}
+
+func (openrc) Restart(name string) error {
+	return command("rc-service", name, "restart")
+}
+
+// writeFile atomically writes the file with the permissions
+func writeFile(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
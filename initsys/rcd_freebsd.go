@@ -0,0 +1,56 @@
+package initsys
+
+import (
+	"path/filepath"
+
+	"github.com/cosmicpanel/CosmicPanel/rcd"
+)
+
+// drivers are the init systems the daemon can be installed with
+var drivers = []Driver{rcdDriver{}}
+
+// detect returns the driver of the init system running this server
+func detect() Driver {
+	return rcdDriver{}
+}
+
+// rcdDriver installs the daemon as an rc.d service supervised by daemon(8). There is no
+// watchdog, daemon(8) restarts the panel when it exits
+type rcdDriver struct{}
+
+func (rcdDriver) Name() string {
+	return "rcd"
+}
+
+func (rcdDriver) Service() string {
+	return rcd.Service
+}
+
+func (rcdDriver) Path() string {
+	return rcd.DefaultScript
+}
+
+func (rcdDriver) Render(d Daemon) ([]byte, error) {
+	return script(d).Render(rcd.Service)
+}
+
+func (rcdDriver) Install(d Daemon, path string, now bool) error {
+	return rcd.Install(script(d), path, now)
+}
+
+func (rcdDriver) Uninstall(path string) error {
+	return rcd.Uninstall(path)
+}
+
+func (rcdDriver) Active(name string) bool {
+	return rcd.Active(filepath.Base(name))
+}
+
+func (rcdDriver) Restart(name string) error {
+	return rcd.Restart(filepath.Base(name))
+}
+
+// script returns the rc.d script running the daemon
+func script(d Daemon) rcd.Script {
+	return rcd.Script{Binary: d.Binary, Config: d.Config}
+}
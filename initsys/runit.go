@@ -0,0 +1,157 @@
+//go:build !freebsd
+
+package initsys
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// runit installs the daemon as a runit service, as on Void. The service directory is
+// linked into the directory runsvdir watches, which starts supervising it within seconds
+type runit struct{}
+
+// runitTemplate is the run script of the service
+var runitTemplate = template.Must(template.New("runit").Parse(`#!/bin/sh
+# Managed by CosmicPanel, reinstall with cosmicpanel service install
+cd {{.Dir}} || exit 1
+ulimit -n 65536
+exec 2>&1
+exec {{.Binary}} serve -config {{.Config}}
+`))
+
+// runsvdirs are the directories runsvdir watches on the distributions that use runit
+var runsvdirs = []string{"/var/service", "/etc/service", "/service"}
+
+// superviseTimeout is how long runsv is given to start supervising a new service
+const superviseTimeout = 10 * time.Second
+
+func (runit) Name() string {
+	return "runit"
+}
+
+func (runit) Service() string {
+	return "cosmicpanel"
+}
+
+func (runit) Path() string {
+	return "/etc/sv/cosmicpanel"
+}
+
+func (runit) Render(d Daemon) ([]byte, error) {
+	if err := validate(d); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err := runitTemplate.Execute(&buf, struct {
+		Daemon
+		Dir string
+	}{d, filepath.Dir(d.Config)})
+
+	return buf.Bytes(), err
+}
+
+func (r runit) Install(d Daemon, path string, now bool) error {
+	b, err := r.Render(d)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	if err := writeFile(filepath.Join(path, "run"), b, 0755); err != nil {
+		return err
+	}
+
+	link := filepath.Join(runsvdir(), filepath.Base(path))
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		if err := os.Symlink(path, link); err != nil {
+			return err
+		}
+	}
+
+	if !now {
+		return nil
+	}
+
+	// sv cannot control the service until runsv has picked it up
+	deadline := time.Now().Add(superviseTimeout)
+	for {
+		err := r.Restart(filepath.Base(path))
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (r runit) Uninstall(path string) error {
+	name := filepath.Base(path)
+
+	if r.Active(name) {
+		if err := command("sv", "stop", service(name)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(runsvdir(), name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (runit) Active(name string) bool {
+	out, err := privsep.Command("sv", "status", service(name)).Output()
+	return err == nil && strings.HasPrefix(string(out), "run:")
+}
+
+func (runit) Restart(name string) error {
+	return command("sv", "restart", service(name))
+}
+
+// runsvdir returns the directory runsvdir watches
+func runsvdir() string {
+	for _, dir := range runsvdirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+
+	return runsvdirs[0]
+}
+
+// service returns the path sv controls the service through, since sv looks for names in
+// a directory that differs between distributions
+func service(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(runsvdir(), name)
+}
+
+// runitRunning returns true if runit is the init system
+func runitRunning() bool {
+	if _, err := exec.LookPath("runsvdir"); err != nil {
+		return false
+	}
+
+	b, err := os.ReadFile("/proc/1/comm")
+	return err == nil && strings.TrimSpace(string(b)) == "runit"
+}
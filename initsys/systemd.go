@@ -0,0 +1,45 @@
+//go:build !freebsd
+
+package initsys
+
+import "github.com/cosmicpanel/CosmicPanel/systemd"
+
+// systemdDriver installs the daemon as a systemd unit, supervised by its watchdog
+type systemdDriver struct{}
+
+func (systemdDriver) Name() string {
+	return "systemd"
+}
+
+func (systemdDriver) Service() string {
+	return systemd.Service
+}
+
+func (systemdDriver) Path() string {
+	return systemd.DefaultUnit
+}
+
+func (systemdDriver) Render(d Daemon) ([]byte, error) {
+	return unit(d).Render()
+}
+
+func (systemdDriver) Install(d Daemon, path string, now bool) error {
+	return systemd.Install(unit(d), path, now)
+}
+
+func (systemdDriver) Uninstall(path string) error {
+	return systemd.Uninstall(path)
+}
+
+func (systemdDriver) Active(name string) bool {
+	return systemd.Active(name)
+}
+
+func (systemdDriver) Restart(name string) error {
+	return systemd.Restart(name)
+}
+
+// unit returns the unit running the daemon
+func unit(d Daemon) systemd.Unit {
+	return systemd.Unit{Binary: d.Binary, Config: d.Config, WatchdogSec: d.WatchdogSec}
+}
@@ -0,0 +1,30 @@
+package hostname
+
+import (
+	"regexp"
+	"strings"
+)
+
+// label matches a label of a host name in ASCII
+var label = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Valid returns true if the name is a fully qualified host name in lowercase ASCII, with
+// internationalized labels in their xn-- form. Names are written into the configuration
+// of web servers and into paths, which a valid name cannot break out of. The top level
+// domain is never all digits, so an IPv4 address is not a host name
+func Valid(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return false
+	}
+
+	for _, l := range labels {
+		if !label.MatchString(l) {
+			return false
+		}
+	}
+
+	tld := labels[len(labels)-1]
+
+	return len(tld) >= 2 && strings.Trim(tld, "0123456789") != ""
+}
@@ -0,0 +1,55 @@
+package hostname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"www.example.co.uk", true},
+		{"a.io", true},
+		{"my-site.example", true},
+		{"123.example.com", true},
+		{"xn--bcher-kva.example", true},
+		{"example.xn--p1ai", true},
+		{strings.Repeat("a", 63) + ".com", true},
+		{strings.Repeat("a.", 125) + "com", true},
+
+		{"", false},
+		{"localhost", false},
+		{"example.com.", false},
+		{".example.com", false},
+		{"example..com", false},
+		{"Example.com", false},
+		{"exam_ple.com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"example.c", false},
+		{"example.-com", false},
+		{"example.com-", false},
+		{"192.168.1.10", false},
+		{"1.2.3.44", false},
+		{"[::1]", false},
+		{"bücher.example", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a.", 126) + "com", false},
+		{"../etc/passwd", false},
+		{"example.com/../x", false},
+		{"example.com;", false},
+		{"example.com include", false},
+		{"example.com\nlocation", false},
+		{"{domain}.example", false},
+		{"*.example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := Valid(tt.name); got != tt.valid {
+			t.Errorf("Valid(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// New returns a random ID of 16 hex characters, which is what records such as jobs,
+// backups and rules are identified by
+func New() string {
+	return Hex(8)
+}
+
+// Hex returns n random bytes as a hex string of 2n characters. The bytes come from
+// crypto/rand, whose Read does not fail
+func Hex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,38 @@
+package ids
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestHex(t *testing.T) {
+	tests := []struct {
+		name string
+		id   func() string
+		want int
+	}{
+		{"New", New, 16},
+		{"Hex(4)", func() string { return Hex(4) }, 8},
+		{"Hex(16)", func() string { return Hex(16) }, 32},
+		{"Hex(0)", func() string { return Hex(0) }, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[string]bool{}
+			for i := 0; i < 1000; i++ {
+				id := tt.id()
+				if len(id) != tt.want {
+					t.Fatalf("%q has %d characters, want %d", id, len(id), tt.want)
+				}
+				if _, err := hex.DecodeString(id); err != nil {
+					t.Fatalf("%q is not hex: %v", id, err)
+				}
+				if tt.want > 0 && seen[id] {
+					t.Fatalf("%q was returned twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+)
+
+// Group is a group of hosts in an Ansible inventory
+type Group struct {
+	Hosts    []string               `json:"hosts,omitempty"`
+	Children []string               `json:"children,omitempty"`
+	Vars     map[string]interface{} `json:"vars,omitempty"`
+}
+
+// Inventory is the panel's servers, accounts and domains in the format of an Ansible
+// dynamic inventory. The servers are hosts, grouped by role, cluster tag and whether they
+// are online, and the accounts and domains are variables of the all group, so that
+// playbooks can loop over them
+type Inventory struct {
+	Groups map[string]*Group
+
+	// Variables of every host, keyed by host
+	HostVars map[string]map[string]interface{}
+}
+
+// MarshalJSON encodes the inventory with the groups at the top level and the variables
+// of the hosts under _meta, which saves Ansible asking for every host separately
+func (inv Inventory) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(inv.Groups)+1)
+	for name, g := range inv.Groups {
+		m[name] = g
+	}
+	m["_meta"] = map[string]interface{}{"hostvars": inv.HostVars}
+
+	return json.Marshal(m)
+}
+
+// Account is what the inventory holds about an account
+type Account struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Owner     string    `json:"owner,omitempty"`
+	Package   string    `json:"package,omitempty"`
+	Suspended bool      `json:"suspended"`
+	Created   time.Time `json:"created"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	Domains   []string  `json:"domains"`
+}
+
+// Domain is what the inventory holds about a domain
+type Domain struct {
+	Name    string `json:"name"`
+	Account string `json:"account,omitempty"`
+}
+
+// Scope limits what an inventory holds to what the token it is built for may see
+type Scope struct {
+	// Whether to include the servers. Only admins see the infrastructure
+	Servers bool
+
+	// Returns true for the accounts to include
+	Account func(u auth.User) bool
+
+	// Limits the hosts to those in the group when set
+	Group string
+}
+
+// invalid matches the characters Ansible does not allow in group names
+var invalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Build returns the inventory within the scope
+func Build(s Scope) (Inventory, error) {
+	inv := Inventory{
+		Groups:   map[string]*Group{"all": {Vars: make(map[string]interface{})}},
+		HostVars: make(map[string]map[string]interface{}),
+	}
+
+	if s.Servers {
+		if err := inv.addServers(); err != nil {
+			return inv, err
+		}
+	}
+
+	accounts, domains := build(s)
+	inv.Groups["all"].Vars["cosmicpanel_accounts"] = accounts
+	inv.Groups["all"].Vars["cosmicpanel_domains"] = domains
+
+	if s.Group != "" {
+		inv.limit(s.Group)
+	}
+
+	for _, g := range inv.Groups {
+		sort.Strings(g.Hosts)
+		sort.Strings(g.Children)
+	}
+
+	return inv, nil
+}
+
+// addServers adds this server and, on a controller, every node of the cluster as hosts
+func (inv *Inventory) addServers() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	role := cluster.Role()
+	inv.add(hostname, "panel", map[string]interface{}{
+		"ansible_host":     hostname,
+		"cosmicpanel_role": role,
+	})
+	inv.add(hostname, role, nil)
+
+	nodes, err := cluster.Nodes()
+	if errors.Is(err, cluster.ErrNotController) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		vars := map[string]interface{}{
+			"ansible_host":             n.Address,
+			"cosmicpanel_role":         "node",
+			"cosmicpanel_node_id":      n.ID,
+			"cosmicpanel_online":       n.Online,
+			"cosmicpanel_tags":         n.Tags,
+			"cosmicpanel_max_accounts": n.MaxAccounts,
+			"cosmicpanel_draining":     n.Draining,
+			"cosmicpanel_standby":      n.Standby,
+		}
+		if n.Status != nil {
+			vars["cosmicpanel_status"] = n.Status
+		}
+
+		inv.add(n.Name, "nodes", vars)
+
+		if n.Online {
+			inv.add(n.Name, "online", nil)
+		} else {
+			inv.add(n.Name, "offline", nil)
+		}
+
+		if n.Draining {
+			inv.add(n.Name, "draining", nil)
+		}
+
+		for _, tag := range n.Tags {
+			inv.add(n.Name, "tag_"+invalid.ReplaceAllString(tag, "_"), nil)
+		}
+	}
+
+	return nil
+}
+
+// add puts the host in the group, and in the all group through it, merging the variables
+// into those of the host
+func (inv *Inventory) add(host string, group string, vars map[string]interface{}) {
+	g, ok := inv.Groups[group]
+	if !ok {
+		g = &Group{}
+		inv.Groups[group] = g
+		inv.Groups["all"].Children = append(inv.Groups["all"].Children, group)
+	}
+	g.Hosts = append(g.Hosts, host)
+
+	hv, ok := inv.HostVars[host]
+	if !ok {
+		hv = make(map[string]interface{})
+		inv.HostVars[host] = hv
+	}
+	for k, v := range vars {
+		hv[k] = v
+	}
+}
+
+// limit removes the hosts that are not in the group, along with the groups left empty
+func (inv *Inventory) limit(group string) {
+	keep := make(map[string]bool)
+	if g, ok := inv.Groups[group]; ok {
+		for _, h := range g.Hosts {
+			keep[h] = true
+		}
+	}
+
+	for host := range inv.HostVars {
+		if !keep[host] {
+			delete(inv.HostVars, host)
+		}
+	}
+
+	all := inv.Groups["all"]
+	all.Children = nil
+	for name, g := range inv.Groups {
+		if name == "all" {
+			continue
+		}
+
+		hosts := g.Hosts[:0]
+		for _, h := range g.Hosts {
+			if keep[h] {
+				hosts = append(hosts, h)
+			}
+		}
+		g.Hosts = hosts
+
+		if len(g.Hosts) == 0 {
+			delete(inv.Groups, name)
+		} else {
+			all.Children = append(all.Children, name)
+		}
+	}
+}
+
+// build returns the accounts and domains within the scope, ordered by name. Domains are
+// known once their logs have been processed into statistics
+func build(s Scope) ([]Account, []Domain) {
+	users := auth.Users()
+
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	// Without statistics there are no domains to list
+	known, _ := stats.Domains()
+
+	accounts := []Account{}
+	included := make(map[string]bool)
+	for _, u := range users {
+		if s.Account != nil && !s.Account(u) {
+			continue
+		}
+		included[u.Username] = true
+
+		a := Account{
+			ID:        u.ID,
+			Username:  u.Username,
+			Email:     u.Email,
+			Role:      u.Role,
+			Owner:     names[u.Owner],
+			Package:   u.Package,
+			Suspended: u.Suspended,
+			Created:   u.Created,
+			Domains:   []string{},
+		}
+
+		if assignment, err := addresses.IPv6(u.Username); err == nil {
+			a.IPv6 = assignment.Prefix.String()
+		}
+
+		for _, d := range known {
+			if d.Account == u.Username {
+				a.Domains = append(a.Domains, d.Name)
+			}
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	// Domains that cannot be tied to an account are only listed for those who see every
+	// account
+	domains := []Domain{}
+	for _, d := range known {
+		if included[d.Account] || (d.Account == "" && s.Account == nil) {
+			domains = append(domains, Domain{Name: d.Name, Account: d.Account})
+		}
+	}
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+
+	return accounts, domains
+}
@@ -0,0 +1,570 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// States of a job
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+var (
+	// ErrNotConfigured is returned when using the queue before Configure is called
+	ErrNotConfigured = errors.New("jobs: not configured")
+
+	// ErrNotFound is returned when a job does not exist
+	ErrNotFound = errors.New("jobs: job not found")
+
+	// ErrFinished is returned when cancelling a job that has already finished
+	ErrFinished = errors.New("jobs: job has already finished")
+
+	// ErrNotRetryable is returned when retrying a job that has not failed or been
+	// cancelled
+	ErrNotRetryable = errors.New("jobs: only failed or cancelled jobs can be retried")
+
+	// ErrStopping is returned when retrying a cancelled job whose handler has not
+	// returned yet
+	ErrStopping = errors.New("jobs: job is still stopping, retry it once it has stopped")
+)
+
+// Handler runs a job of the type it is registered for. The context is cancelled when the
+// job is cancelled, and a returned error causes the job to be retried until it runs out
+// of attempts
+type Handler func(ctx context.Context, j *Job) error
+
+// Job is a unit of background work such as a backup or a certificate issuance
+type Job struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	State   string          `json:"state"`
+
+	// The user who queued the job, empty for jobs queued by the panel itself
+	Actor string `json:"actor,omitempty"`
+
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	Created     time.Time `json:"created"`
+	RunAt       time.Time `json:"run_at"`
+	Started     time.Time `json:"started,omitempty"`
+	Finished    time.Time `json:"finished,omitempty"`
+
+	// The error returned by the last attempt
+	Error string `json:"error,omitempty"`
+}
+
+// Decode unmarshals the payload of the job
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Options change how a job is queued
+type Options struct {
+	// The job is not run before this time
+	RunAt time.Time
+
+	// Overrides the configured number of attempts
+	MaxAttempts int
+
+	Actor string
+}
+
+var (
+	hmu      sync.RWMutex
+	handlers = make(map[string]Handler)
+)
+
+// Register sets the handler that runs jobs of the type. Packages register their
+// handlers when they are configured, and jobs of types without one fail when run
+func Register(typ string, h Handler) {
+	hmu.Lock()
+	defer hmu.Unlock()
+
+	handlers[typ] = h
+}
+
+// handler returns the handler for the type
+func handler(typ string) (Handler, bool) {
+	hmu.RLock()
+	defer hmu.RUnlock()
+
+	h, ok := handlers[typ]
+
+	return h, ok
+}
+
+// kind is what jobs are kept under in the state store
+const kind = "job"
+
+// Queue persists jobs and runs them on a pool of workers
+type Queue struct {
+	mu      sync.Mutex
+	config  *config.JobsConfiguration
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+	running map[string]int
+	total   int
+	paused  bool
+	wake    chan struct{}
+}
+
+var std *Queue
+
+// Configure loads the queue from the state store, which must be configured first. Jobs
+// that were running when the daemon stopped are queued again
+func Configure(dataDir string, c *config.JobsConfiguration) error {
+	q := &Queue{
+		config:  c,
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}
+
+	// Earlier releases kept the queue in the data directory
+	if err := store.Import(kind, filepath.Join(dataDir, "jobs", "jobs.json")); err != nil {
+		return err
+	}
+
+	if err := store.Load(kind, &q.jobs); err != nil {
+		return fmt.Errorf("jobs: failed to read queue: %w", err)
+	}
+
+	for _, j := range q.jobs {
+		if j.State == Running {
+			j.State = Queued
+			j.Error = "interrupted by a restart"
+		}
+	}
+
+	std = q
+
+	return q.save()
+}
+
+// Start runs queued jobs in the background as workers become free and their scheduled
+// time arrives
+func Start() {
+	if std == nil {
+		return
+	}
+
+	crash.Go("jobs", std.loop)
+}
+
+// Pause stops queued jobs from being started, such as during maintenance. Jobs that are
+// already running are left to finish
+func Pause() {
+	if std == nil {
+		return
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.paused = true
+}
+
+// Resume starts queued jobs again after Pause
+func Resume() {
+	if std == nil {
+		return
+	}
+
+	std.mu.Lock()
+	std.paused = false
+	std.mu.Unlock()
+
+	std.signal()
+}
+
+// Paused returns true if queued jobs are not being started
+func Paused() bool {
+	if std == nil {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.paused
+}
+
+// Enqueue queues a job of the type with the payload, which is marshalled to JSON
+func Enqueue(typ string, payload interface{}, o Options) (Job, error) {
+	if std == nil {
+		return Job{}, ErrNotConfigured
+	}
+
+	if typ == "" {
+		return Job{}, errors.New("jobs: type is required")
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+
+	j := &Job{
+		ID:          ids.New(),
+		Type:        typ,
+		Payload:     raw,
+		State:       Queued,
+		Actor:       o.Actor,
+		MaxAttempts: o.MaxAttempts,
+		Created:     now,
+		RunAt:       o.RunAt.UTC(),
+	}
+
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = max(std.config.Attempts, 1)
+	}
+
+	if j.RunAt.Before(now) {
+		j.RunAt = now
+	}
+
+	std.mu.Lock()
+	std.jobs[j.ID] = j
+	err = std.save()
+	std.mu.Unlock()
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	std.signal()
+
+	return *j, nil
+}
+
+// List returns the jobs, newest first, optionally only those in the state or of the type
+func List(state string, typ string) []Job {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := []Job{}
+	for _, j := range std.jobs {
+		if (state == "" || j.State == state) && (typ == "" || j.Type == typ) {
+			list = append(list, *j)
+		}
+	}
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Created.After(list[b].Created)
+	})
+
+	return list
+}
+
+// Get returns the job with the ID
+func Get(id string) (Job, error) {
+	if std == nil {
+		return Job{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	j, ok := std.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	return *j, nil
+}
+
+// Wait returns the job with the ID once it has succeeded, failed or been cancelled, or
+// as it is when the context is done along with the context's error
+func Wait(ctx context.Context, id string) (Job, error) {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		j, err := Get(id)
+		if err != nil {
+			return j, err
+		}
+
+		switch j.State {
+		case Succeeded, Failed, Cancelled:
+			return j, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return j, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// Retry queues a failed or cancelled job again with all of its attempts
+func Retry(id string) (Job, error) {
+	if std == nil {
+		return Job{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+
+	j, ok := std.jobs[id]
+	if !ok {
+		std.mu.Unlock()
+		return Job{}, ErrNotFound
+	}
+
+	if j.State != Failed && j.State != Cancelled {
+		std.mu.Unlock()
+		return *j, ErrNotRetryable
+	}
+
+	// A second attempt started alongside the cancelled one would share its cancel
+	// function and have its outcome recorded when the first returns
+	if _, ok := std.cancels[id]; ok {
+		std.mu.Unlock()
+		return *j, ErrStopping
+	}
+
+	j.State = Queued
+	j.Attempts = 0
+	j.Error = ""
+	j.RunAt = time.Now().UTC()
+	j.Started = time.Time{}
+	j.Finished = time.Time{}
+
+	err := std.save()
+	retried := *j
+	std.mu.Unlock()
+
+	std.signal()
+
+	return retried, err
+}
+
+// Cancel stops a queued job from running, or cancels the context of a running one
+func Cancel(id string) (Job, error) {
+	if std == nil {
+		return Job{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	j, ok := std.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	switch j.State {
+	case Queued:
+		j.Finished = time.Now().UTC()
+	case Running:
+		// The job is finished once its handler returns
+		std.cancels[id]()
+	default:
+		return *j, ErrFinished
+	}
+
+	j.State = Cancelled
+
+	return *j, std.save()
+}
+
+// signal wakes the dispatcher without blocking
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop dispatches jobs whenever one is queued or finishes, and when the next scheduled
+// job is due
+func (q *Queue) loop() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		timer.Reset(q.dispatch())
+	}
+}
+
+// dispatch starts every due job there is a worker for and removes expired finished
+// jobs, returning how long until the next scheduled job is due
+func (q *Queue) dispatch() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UTC()
+	wait := time.Minute
+	changed := false
+
+	var queued []*Job
+	for id, j := range q.jobs {
+		switch j.State {
+		case Queued:
+			queued = append(queued, j)
+		case Succeeded, Failed, Cancelled:
+			if now.Sub(j.Finished) > time.Duration(q.config.Retention)*time.Hour {
+				delete(q.jobs, id)
+				changed = true
+			}
+		}
+	}
+
+	sort.Slice(queued, func(a, b int) bool {
+		if !queued[a].RunAt.Equal(queued[b].RunAt) {
+			return queued[a].RunAt.Before(queued[b].RunAt)
+		}
+		return queued[a].Created.Before(queued[b].Created)
+	})
+
+	if q.paused {
+		queued = nil
+	}
+
+	for _, j := range queued {
+		if j.RunAt.After(now) {
+			wait = min(wait, j.RunAt.Sub(now))
+			continue
+		}
+
+		if q.total >= max(q.config.Workers, 1) {
+			break
+		}
+
+		if limit := q.config.Concurrency[j.Type]; limit > 0 && q.running[j.Type] >= limit {
+			continue
+		}
+
+		changed = true
+
+		h, ok := handler(j.Type)
+		if !ok {
+			j.State = Failed
+			j.Finished = now
+			j.Error = "no handler is registered for jobs of type " + j.Type
+			continue
+		}
+
+		j.State = Running
+		j.Attempts++
+		j.Started = now
+
+		ctx, cancel := context.WithCancel(context.Background())
+		q.cancels[j.ID] = cancel
+		q.running[j.Type]++
+		q.total++
+
+		job := *j
+		go q.execute(ctx, h, job)
+	}
+
+	if changed {
+		if err := q.save(); err != nil {
+			zap.S().Named("jobs").Errorw("failed to save job queue", zap.Error(err))
+		}
+	}
+
+	return wait
+}
+
+// execute runs an attempt of the job and records its outcome
+func (q *Queue) execute(ctx context.Context, h Handler, j Job) {
+	err := call(ctx, h, &j)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cancels[j.ID]()
+	delete(q.cancels, j.ID)
+	q.running[j.Type]--
+	q.total--
+
+	current, ok := q.jobs[j.ID]
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case current.State == Cancelled:
+		current.Finished = now
+	case err == nil:
+		current.State = Succeeded
+		current.Finished = now
+		current.Error = ""
+	case current.Attempts < current.MaxAttempts:
+		backoff := time.Duration(q.config.Backoff) * time.Second << (current.Attempts - 1)
+		current.State = Queued
+		current.RunAt = now.Add(backoff)
+		current.Error = err.Error()
+
+		zap.S().Named("jobs").Warnw("job failed, retrying", "id", j.ID, "type", j.Type, "attempt", current.Attempts, "retry", current.RunAt, zap.Error(err))
+	default:
+		current.State = Failed
+		current.Finished = now
+		current.Error = err.Error()
+
+		zap.S().Named("jobs").Errorw("job failed", "id", j.ID, "type", j.Type, "attempts", current.Attempts, zap.Error(err))
+
+		events.Publish(events.Event{
+			Type:     "job.failed",
+			Actor:    current.Actor,
+			Resource: current.ID,
+			Data:     map[string]interface{}{"type": current.Type, "attempts": current.Attempts, "error": current.Error},
+		})
+	}
+
+	if err := q.save(); err != nil {
+		zap.S().Named("jobs").Errorw("failed to save job queue", zap.Error(err))
+	}
+
+	q.signal()
+}
+
+// call runs the handler, turning a panic into an error so that it fails the job rather
+// than the daemon
+func call(ctx context.Context, h Handler, j *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rep := crash.Capture("jobs", r, map[string]string{"job": j.ID, "type": j.Type})
+			err = fmt.Errorf("job panicked, see crash report %s: %v", rep.ID, r)
+		}
+	}()
+
+	return h(ctx, j)
+}
+
+// save writes the queue to the state store. The queue must be locked
+func (q *Queue) save() error {
+	return store.Save(kind, q.jobs)
+}
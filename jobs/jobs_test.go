@@ -0,0 +1,422 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up an empty queue on a new state store. The dispatcher is not started,
+// tests call dispatch themselves
+func configure(t *testing.T, c *config.JobsConfiguration) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(dir, c); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		std = nil
+		hmu.Lock()
+		handlers = make(map[string]Handler)
+		hmu.Unlock()
+	})
+}
+
+// settle waits for the attempt of the job that is running to finish
+func settle(t *testing.T, id string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		std.mu.Lock()
+		_, running := std.cancels[id]
+		std.mu.Unlock()
+
+		if !running {
+			j, err := Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return j
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s is still running", id)
+	return Job{}
+}
+
+func TestEnqueue(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Attempts: 3})
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+
+	tests := []struct {
+		name     string
+		o        Options
+		attempts int
+		future   bool
+	}{
+		{"defaults", Options{}, 3, false},
+		{"attempts", Options{MaxAttempts: 5}, 5, false},
+		{"negative attempts", Options{MaxAttempts: -1}, 3, false},
+		{"scheduled", Options{RunAt: tomorrow}, 3, true},
+		{"scheduled in the past", Options{RunAt: time.Now().Add(-time.Hour)}, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().UTC()
+
+			j, err := Enqueue("test", map[string]string{"site": "example.com"}, tt.o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if j.State != Queued || j.MaxAttempts != tt.attempts {
+				t.Errorf("state %s with %d attempts, want queued with %d", j.State, j.MaxAttempts, tt.attempts)
+			}
+			if tt.future && !j.RunAt.Equal(tomorrow.UTC()) {
+				t.Errorf("runs at %s, want %s", j.RunAt, tomorrow.UTC())
+			}
+			if !tt.future && j.RunAt.Before(before) {
+				t.Errorf("runs at %s, before it was queued", j.RunAt)
+			}
+
+			var payload map[string]string
+			if err := j.Decode(&payload); err != nil || payload["site"] != "example.com" {
+				t.Errorf("payload %v, %v", payload, err)
+			}
+		})
+	}
+
+	if _, err := Enqueue("", nil, Options{}); err == nil {
+		t.Error("a job without a type was queued")
+	}
+	if _, err := Enqueue("test", func() {}, Options{}); err == nil {
+		t.Error("a payload that does not marshal was queued")
+	}
+}
+
+func TestDispatchLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		workers     int
+		concurrency map[string]int
+		queued      []string
+		running     map[string]int
+	}{
+		{"workers", 2, nil, []string{"backup", "backup", "backup"}, map[string]int{"backup": 2}},
+		{"no workers configured", 0, nil, []string{"backup", "backup"}, map[string]int{"backup": 1}},
+		{"limit of a type", 4, map[string]int{"backup": 1}, []string{"backup", "backup", "ssl", "ssl"}, map[string]int{"backup": 1, "ssl": 2}},
+		{"limit leaves workers to other types", 2, map[string]int{"backup": 1}, []string{"backup", "backup", "backup", "ssl"}, map[string]int{"backup": 1, "ssl": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, &config.JobsConfiguration{Workers: tt.workers, Concurrency: tt.concurrency, Attempts: 1, Retention: 1})
+
+			release := make(chan struct{})
+			block := func(ctx context.Context, j *Job) error {
+				<-release
+				return nil
+			}
+			Register("backup", block)
+			Register("ssl", block)
+
+			for _, typ := range tt.queued {
+				if _, err := Enqueue(typ, nil, Options{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			std.dispatch()
+
+			running := map[string]int{}
+			for _, j := range List(Running, "") {
+				running[j.Type]++
+			}
+			for typ, n := range tt.running {
+				if running[typ] != n {
+					t.Errorf("%d %s jobs running, want %d", running[typ], typ, n)
+				}
+			}
+			if len(running) != len(tt.running) {
+				t.Errorf("running %v, want %v", running, tt.running)
+			}
+
+			close(release)
+			for _, j := range List(Running, "") {
+				settle(t, j.ID)
+			}
+		})
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Workers: 1, Attempts: 1, Retention: 1})
+
+	started := make(chan string, 3)
+	Register("test", func(ctx context.Context, j *Job) error {
+		started <- j.ID
+		return nil
+	})
+
+	later, _ := Enqueue("test", nil, Options{RunAt: time.Now().Add(time.Hour)})
+	first, _ := Enqueue("test", nil, Options{})
+	second, _ := Enqueue("test", nil, Options{})
+
+	Pause()
+	std.dispatch()
+	if n := len(List(Running, "")); n != 0 {
+		t.Fatalf("%d jobs started while paused", n)
+	}
+	Resume()
+
+	for _, want := range []string{first.ID, second.ID} {
+		std.dispatch()
+		if id := <-started; id != want {
+			t.Errorf("started %s, want %s", id, want)
+		}
+		settle(t, want)
+	}
+
+	if j, _ := Get(later.ID); j.State != Queued {
+		t.Errorf("the scheduled job is %s before its time", j.State)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name     string
+		attempts int
+		fail     int
+		state    string
+		error    string
+	}{
+		{"succeeds", 3, 0, Succeeded, ""},
+		{"succeeds on a retry", 3, 2, Succeeded, ""},
+		{"runs out of attempts", 3, 3, Failed, "failed"},
+		{"single attempt", 1, 1, Failed, "failed"},
+		{"panics", 2, -1, Failed, "job panicked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, &config.JobsConfiguration{Workers: 1, Attempts: tt.attempts, Retention: 1})
+
+			calls := 0
+			Register("test", func(ctx context.Context, j *Job) error {
+				calls++
+				if tt.fail < 0 {
+					panic("handler bug")
+				}
+				if calls <= tt.fail {
+					return errFailed
+				}
+				return nil
+			})
+
+			j, err := Enqueue("test", nil, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.attempts; i++ {
+				std.dispatch()
+				if j = settle(t, j.ID); j.State != Queued {
+					break
+				}
+			}
+
+			if j.State != tt.state {
+				t.Errorf("state %s, want %s", j.State, tt.state)
+			}
+			if !strings.HasPrefix(j.Error, tt.error) || (tt.error == "") != (j.Error == "") {
+				t.Errorf("error %q, want %q", j.Error, tt.error)
+			}
+			if j.Finished.IsZero() {
+				t.Error("the job has no finish time")
+			}
+
+			want := min(tt.fail+1, tt.attempts)
+			if tt.fail < 0 {
+				want = tt.attempts
+			}
+			if j.Attempts != want {
+				t.Errorf("%d attempts, want %d", j.Attempts, want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Workers: 1, Attempts: 3, Backoff: 60, Retention: 1})
+
+	Register("test", func(ctx context.Context, j *Job) error {
+		return errors.New("failed")
+	})
+
+	j, _ := Enqueue("test", nil, Options{})
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute} {
+		std.dispatch()
+		j = settle(t, j.ID)
+
+		if j.State != Queued {
+			t.Fatalf("state %s, want queued for a retry", j.State)
+		}
+		if wait := j.RunAt.Sub(time.Now()); wait > want || wait < want-5*time.Second {
+			t.Errorf("retried in %s, want %s", wait, want)
+		}
+
+		// Make the retry due
+		std.mu.Lock()
+		std.jobs[j.ID].RunAt = time.Now().UTC()
+		std.mu.Unlock()
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Workers: 1, Attempts: 3, Retention: 1})
+
+	j, _ := Enqueue("unknown", nil, Options{})
+	std.dispatch()
+
+	if j, _ = Get(j.ID); j.State != Failed || j.Attempts != 0 {
+		t.Errorf("state %s after %d attempts, want failed without an attempt", j.State, j.Attempts)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Workers: 1, Attempts: 3, Retention: 1})
+
+	release := make(chan struct{})
+	Register("test", func(ctx context.Context, j *Job) error {
+		<-ctx.Done()
+		<-release
+		return ctx.Err()
+	})
+
+	queued, _ := Enqueue("test", nil, Options{RunAt: time.Now().Add(time.Hour)})
+	if j, err := Cancel(queued.ID); err != nil || j.State != Cancelled || j.Finished.IsZero() {
+		t.Errorf("cancelling a queued job: %s, %v", j.State, err)
+	}
+	if _, err := Cancel(queued.ID); !errors.Is(err, ErrFinished) {
+		t.Errorf("cancelling twice: %v", err)
+	}
+
+	running, _ := Enqueue("test", nil, Options{})
+	std.dispatch()
+	if j, err := Cancel(running.ID); err != nil || j.State != Cancelled {
+		t.Errorf("cancelling a running job: %s, %v", j.State, err)
+	}
+
+	// The handler has not returned, and another attempt must not start beside it
+	if _, err := Retry(running.ID); !errors.Is(err, ErrStopping) {
+		t.Errorf("retrying a job that is stopping: %v", err)
+	}
+
+	close(release)
+	j := settle(t, running.ID)
+	if j.State != Cancelled || j.Attempts != 1 || j.Finished.IsZero() {
+		t.Errorf("state %s after %d attempts, want cancelled after 1", j.State, j.Attempts)
+	}
+
+	if j, err := Retry(running.ID); err != nil || j.State != Queued || j.Attempts != 0 {
+		t.Errorf("retrying: %s with %d attempts, %v", j.State, j.Attempts, err)
+	}
+	if _, err := Retry(running.ID); !errors.Is(err, ErrNotRetryable) {
+		t.Errorf("retrying a queued job: %v", err)
+	}
+	if _, err := Cancel("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cancelling a missing job: %v", err)
+	}
+	if _, err := Retry("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("retrying a missing job: %v", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	configure(t, &config.JobsConfiguration{Workers: 1, Attempts: 1, Retention: 24})
+
+	old, _ := Enqueue("test", nil, Options{})
+	recent, _ := Enqueue("test", nil, Options{})
+	waiting, _ := Enqueue("test", nil, Options{RunAt: time.Now().Add(48 * time.Hour)})
+
+	std.mu.Lock()
+	std.jobs[old.ID].State = Succeeded
+	std.jobs[old.ID].Finished = time.Now().Add(-25 * time.Hour)
+	std.jobs[recent.ID].State = Failed
+	std.jobs[recent.ID].Finished = time.Now().Add(-23 * time.Hour)
+	std.mu.Unlock()
+
+	std.dispatch()
+
+	if _, err := Get(old.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("a job finished 25 hours ago was kept: %v", err)
+	}
+	for _, id := range []string{recent.ID, waiting.ID} {
+		if _, err := Get(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+}
+
+func TestConfigureRequeuesRunning(t *testing.T) {
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { std = nil }()
+
+	saved := map[string]*Job{
+		"a": {ID: "a", Type: "test", State: Running, Attempts: 1, MaxAttempts: 3},
+		"b": {ID: "b", Type: "test", State: Succeeded, Attempts: 1, MaxAttempts: 3},
+		"c": {ID: "c", Type: "test", State: Queued, MaxAttempts: 3},
+	}
+	if err := store.Save(kind, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(dir, &config.JobsConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": Queued, "b": Succeeded, "c": Queued}
+	for id, state := range want {
+		j, err := Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.State != state {
+			t.Errorf("%s is %s, want %s", id, j.State, state)
+		}
+	}
+
+	if j, _ := Get("a"); j.Attempts != 1 || j.Error == "" {
+		t.Errorf("the interrupted job has %d attempts and error %q", j.Attempts, j.Error)
+	}
+
+	// The requeued state is what the next start reads
+	var stored map[string]*Job
+	if err := store.Load(kind, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["a"].State != Queued {
+		t.Errorf("the store has the interrupted job as %s", stored["a"].State)
+	}
+}
@@ -0,0 +1,437 @@
+package locale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+)
+
+// English is the language the panel is written in, which needs no bundle
+const English = "en"
+
+var (
+	// ErrUnsupported is returned for a language the panel has no bundle for
+	ErrUnsupported = errors.New("locale: the panel has no translation into the language")
+
+	// ErrNotFound is returned when the bundle of a language has no text for the key
+	ErrNotFound = errors.New("locale: no translation")
+)
+
+// Bundle is the translation of the panel into a language. Messages are keyed by their
+// English text, so that every message the panel has can be translated without giving it
+// an ID
+type Bundle struct {
+	// The tag of the language, such as de or pt-BR, and its name in that language
+	Language string `json:"language"`
+	Name     string `json:"name"`
+
+	// Translations of messages, keyed by their English text. Keys may hold fmt verbs
+	// such as %s or %d, which match any text in a message and are passed to the
+	// translation as strings in order, or reordered with %[2]s
+	Messages map[string]string `json:"messages"`
+
+	// Strings of the UI keyed by ID, which the panel only serves
+	UI map[string]string `json:"ui,omitempty"`
+
+	// Translations of the built in notification templates, keyed by kind
+	Notifications map[string]Notification `json:"notifications,omitempty"`
+}
+
+// Notification is the translation of a notification template
+type Notification struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	SMS     string `json:"sms,omitempty"`
+}
+
+// Language is a language the panel speaks
+type Language struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+}
+
+// pattern is a message with fmt verbs, matched against messages that were formatted
+// before being translated
+type pattern struct {
+	re          *regexp.Regexp
+	translation string
+}
+
+// bundle is a loaded bundle along with the patterns of its messages
+type bundle struct {
+	Bundle
+	patterns []pattern
+}
+
+// translator holds the bundles of every language
+type translator struct {
+	mu       sync.RWMutex
+	config   *config.LocaleConfiguration
+	dir      string
+	bundles  map[string]*bundle
+	fallback string
+}
+
+var std *translator
+
+var (
+	tagPart = regexp.MustCompile(`^[a-zA-Z0-9]{1,8}$`)
+	verb    = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*(\.\d+)?[vsdqxXfgte]`)
+)
+
+// Configure loads the bundles from the directory in the configuration, or locales in
+// the data directory
+func Configure(data string, c *config.LocaleConfiguration) error {
+	dir := c.Dir
+	if dir == "" {
+		dir = filepath.Join(data, "locales")
+	}
+
+	t := &translator{config: c, dir: dir}
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	if Canonical(c.Default) != English && t.bundles[Canonical(c.Default)] == nil {
+		zap.S().Named("locale").Warnw("the default language has no bundle, using English", "language", c.Default, "dir", dir)
+	}
+
+	std = t
+
+	return nil
+}
+
+// load reads every bundle in the directory, which may not exist
+func (t *translator) load() error {
+	bundles := make(map[string]*bundle)
+
+	files, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		b, err := readBundle(path)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := bundles[b.Language]; ok {
+			return fmt.Errorf("locale: %s is the second bundle of %s", path, b.Language)
+		}
+		bundles[b.Language] = b
+	}
+
+	t.mu.Lock()
+	t.bundles = bundles
+	t.fallback = Canonical(t.config.Default)
+	t.mu.Unlock()
+
+	zap.S().Named("locale").Debugw("loaded translations", "dir", t.dir, "languages", len(bundles))
+
+	return nil
+}
+
+// readBundle reads the bundle at the path and compiles the patterns of its messages
+func readBundle(path string) (*bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bundle
+	if err := json.Unmarshal(data, &b.Bundle); err != nil {
+		return nil, fmt.Errorf("locale: malformed bundle %s: %w", path, err)
+	}
+
+	if !valid(b.Language) {
+		return nil, fmt.Errorf("locale: bundle %s has invalid language %q", path, b.Language)
+	}
+	b.Language = Canonical(b.Language)
+	if b.Name == "" {
+		b.Name = b.Language
+	}
+
+	for msg, translation := range b.Messages {
+		if !verb.MatchString(msg) {
+			continue
+		}
+
+		re, err := compile(msg)
+		if err != nil {
+			return nil, fmt.Errorf("locale: message %q of %s: %w", msg, path, err)
+		}
+		b.patterns = append(b.patterns, pattern{re: re, translation: translation})
+	}
+
+	// Longer messages are more specific, so they are tried first
+	sort.Slice(b.patterns, func(i, j int) bool { return len(b.patterns[i].re.String()) > len(b.patterns[j].re.String()) })
+
+	return &b, nil
+}
+
+// compile returns the expression matching the messages the format produces
+func compile(format string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	last := 0
+	for _, loc := range verb.FindAllStringIndex(format, -1) {
+		sb.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		sb.WriteString("(.+?)")
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(format[last:]))
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+// Languages returns every language the panel speaks, English first and then sorted by
+// tag
+func Languages() []Language {
+	list := []Language{{Language: English, Name: "English"}}
+	if std == nil {
+		return list
+	}
+
+	std.mu.RLock()
+	defer std.mu.RUnlock()
+
+	for _, b := range std.bundles {
+		list = append(list, Language{Language: b.Language, Name: b.Name})
+	}
+
+	sort.Slice(list[1:], func(i, j int) bool { return list[i+1].Language < list[j+1].Language })
+
+	return list
+}
+
+// Supported returns true if the panel speaks the language, or the language without its
+// region
+func Supported(language string) bool {
+	for _, tag := range chain(language) {
+		if tag == English || bundleOf(tag) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns the first language the panel speaks among those preferred, trying each
+// without its region too. The configured default is used when it speaks none of them,
+// and English when the default has no bundle either
+func Match(preferred ...string) string {
+	for _, p := range preferred {
+		for _, tag := range chain(p) {
+			if tag == English || bundleOf(tag) != nil {
+				return tag
+			}
+		}
+	}
+
+	if std != nil {
+		std.mu.RLock()
+		fallback := std.fallback
+		std.mu.RUnlock()
+
+		for _, tag := range chain(fallback) {
+			if bundleOf(tag) != nil {
+				return tag
+			}
+		}
+	}
+
+	return English
+}
+
+// Sprintf formats the translation of the format into the language, falling back to the
+// language without its region and then to English
+func Sprintf(language string, format string, args ...interface{}) string {
+	for _, tag := range chain(language) {
+		if b := bundleOf(tag); b != nil {
+			if t, ok := b.Messages[format]; ok {
+				return fmt.Sprintf(t, args...)
+			}
+		}
+	}
+
+	return fmt.Sprintf(format, args...)
+}
+
+// Translate returns the translation of a message that has already been formatted, such
+// as the text of an error, matching it against the messages of the bundles holding fmt
+// verbs. Messages without a translation are returned as they are
+func Translate(language string, msg string) string {
+	for _, tag := range chain(language) {
+		b := bundleOf(tag)
+		if b == nil {
+			continue
+		}
+
+		if t, ok := b.Messages[msg]; ok {
+			return t
+		}
+
+		for _, p := range b.patterns {
+			m := p.re.FindStringSubmatch(msg)
+			if m == nil {
+				continue
+			}
+
+			args := make([]interface{}, len(m)-1)
+			for i, s := range m[1:] {
+				args[i] = s
+			}
+			return fmt.Sprintf(p.translation, args...)
+		}
+	}
+
+	return msg
+}
+
+// UI returns the strings of the UI in the language, filling in those the language lacks
+// from the language without its region. Strings no bundle has are left for the UI to
+// show in English
+func UI(language string) (map[string]string, error) {
+	tags := chain(language)
+	if !Supported(language) {
+		return nil, ErrUnsupported
+	}
+
+	strs := make(map[string]string)
+	for i := len(tags) - 1; i >= 0; i-- {
+		if b := bundleOf(tags[i]); b != nil {
+			for k, v := range b.UI {
+				strs[k] = v
+			}
+		}
+	}
+
+	return strs, nil
+}
+
+// TranslateNotification returns the translation of the built in template of the kind
+// into the language, or the language without its region
+func TranslateNotification(language string, kind string) (Notification, error) {
+	for _, tag := range chain(language) {
+		if b := bundleOf(tag); b != nil {
+			if n, ok := b.Notifications[kind]; ok {
+				return n, nil
+			}
+		}
+	}
+
+	return Notification{}, ErrNotFound
+}
+
+// AcceptLanguage returns the languages of an Accept-Language header, most preferred
+// first
+func AcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var list []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+
+		if valid(tag) && q > 0 {
+			list = append(list, weighted{tag: Canonical(tag), q: q})
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].q > list[j].q })
+
+	tags := make([]string, len(list))
+	for i, w := range list {
+		tags[i] = w.tag
+	}
+
+	return tags
+}
+
+// Canonical returns the language tag written the usual way, such as pt-BR for pt_br
+func Canonical(tag string) string {
+	parts := strings.FieldsFunc(strings.TrimSpace(tag), func(r rune) bool { return r == '-' || r == '_' })
+	for i, p := range parts {
+		switch {
+		case i == 0:
+			parts[i] = strings.ToLower(p)
+		case len(p) == 2:
+			parts[i] = strings.ToUpper(p)
+		case len(p) == 4:
+			parts[i] = strings.ToUpper(p[:1]) + strings.ToLower(p[1:])
+		default:
+			parts[i] = strings.ToLower(p)
+		}
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// valid returns true if the tag is written like a language tag
+func valid(tag string) bool {
+	parts := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' })
+	if len(parts) == 0 || len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return false
+	}
+
+	for _, p := range parts {
+		if !tagPart.MatchString(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// chain returns the language followed by the languages it falls back to, dropping one
+// subtag at a time, such as zh-Hant-TW, zh-Hant and zh
+func chain(language string) []string {
+	if !valid(language) {
+		return nil
+	}
+
+	tag := Canonical(language)
+	tags := []string{tag}
+	for {
+		i := strings.LastIndex(tag, "-")
+		if i < 0 {
+			return tags
+		}
+		tag = tag[:i]
+		tags = append(tags, tag)
+	}
+}
+
+// bundleOf returns the bundle of the language, or nil if there is none
+func bundleOf(tag string) *bundle {
+	if std == nil {
+		return nil
+	}
+
+	std.mu.RLock()
+	defer std.mu.RUnlock()
+
+	return std.bundles[tag]
+}
@@ -0,0 +1,197 @@
+package logging
+
+import (
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// level is shared by every core the global logger writes to, which allows the level to
+// be changed at runtime without rebuilding the logger
+var level = zap.NewAtomicLevel()
+
+// sinks are the queues shipping logs to remote destinations, which are flushed when the
+// daemon shuts down
+var sinks []*queue
+
+// file is the rotating log file, nil if logs are not written to a file
+var file *lumberjack.Logger
+
+// ConfigureLogging configures the global logger for Zap so that we can call it from any location
+// in the code without having to pass around a logger instance. If a log file is configured,
+// logs are also written to it and the file is rotated based on the configured limits
+func ConfigureLogging(debug bool, lc *config.LoggingConfiguration) error {
+	cfg := zap.NewProductionConfig()
+	if debug {
+		cfg = zap.NewDevelopmentConfig()
+	}
+
+	cfg.Encoding = "console"
+	cfg.OutputPaths = []string{
+		"stdout",
+	}
+
+	if lc != nil {
+		if lc.Format != "" {
+			cfg.Encoding = lc.Format
+		}
+
+		if !debug && lc.Level != "" {
+			if err := cfg.Level.UnmarshalText([]byte(lc.Level)); err != nil {
+				return err
+			}
+		}
+
+		cfg.Sampling = nil
+		if lc.Sampling.Initial > 0 {
+			cfg.Sampling = &zap.SamplingConfig{
+				Initial:    lc.Sampling.Initial,
+				Thereafter: lc.Sampling.Thereafter,
+			}
+		}
+	}
+
+	level.SetLevel(cfg.Level.Level())
+
+	// Every core accepts all levels, filtering is done by the module core wrapping them
+	// so that individual modules can log below the global level
+	all := zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	cfg.Level = all
+
+	if lc != nil {
+		if err := SetRedactPatterns(lc.Redact); err != nil {
+			return err
+		}
+
+		for m, l := range lc.Modules {
+			if err := SetModuleLevel(m, l); err != nil {
+				return err
+			}
+		}
+	}
+	updateFloor()
+
+	var cores []zapcore.Core
+	file = nil
+	if lc != nil && lc.File != "" {
+		w := &lumberjack.Logger{
+			Filename:   lc.File,
+			MaxSize:    lc.MaxSize,
+			MaxAge:     lc.MaxAge,
+			MaxBackups: lc.MaxBackups,
+			Compress:   lc.Compress,
+			LocalTime:  true,
+		}
+
+		file = w
+
+		enc := zapcore.NewConsoleEncoder(cfg.EncoderConfig)
+		if cfg.Encoding == "json" {
+			enc = zapcore.NewJSONEncoder(cfg.EncoderConfig)
+		}
+
+		cores = append(cores, zapcore.NewCore(enc, zapcore.AddSync(w), all))
+	}
+
+	if lc != nil {
+		for _, sc := range lc.Sinks {
+			q, err := newQueue(sc)
+			if err != nil {
+				return err
+			}
+
+			sinks = append(sinks, q)
+			cores = append(cores, newSinkCore(q, all))
+		}
+	}
+
+	logger, err := cfg.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		outputs := append([]zapcore.Core{core}, cores...)
+		for i := range outputs {
+			outputs[i] = &redactCore{Core: outputs[i]}
+		}
+
+		return &moduleCore{Core: zapcore.NewTee(outputs...)}
+	}))
+	if err != nil {
+		return err
+	}
+
+	zap.ReplaceGlobals(logger)
+
+	return nil
+}
+
+// Close flushes any logs waiting to be shipped to remote sinks. It should be called
+// once when the daemon is shutting down
+func Close() {
+	zap.L().Sync()
+
+	for _, q := range sinks {
+		q.close()
+	}
+	sinks = nil
+}
+
+// Level returns the level the global logger is currently writing at
+func Level() string {
+	return level.String()
+}
+
+// SetLevel changes the level of the global logger at runtime. The level must be one of
+// debug, info, warn, error, dpanic, panic or fatal
+func SetLevel(l string) error {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(l)); err != nil {
+		return err
+	}
+
+	level.SetLevel(lvl)
+	updateFloor()
+
+	return nil
+}
+
+// Reload applies the levels of a reloaded configuration to the running logger, replacing
+// the module overrides set at runtime. Debug mode logs at debug whatever the level
+func Reload(debug bool, lc *config.LoggingConfiguration) error {
+	lvl := zapcore.InfoLevel
+	if debug {
+		lvl = zapcore.DebugLevel
+	} else if lc.Level != "" {
+		if err := lvl.UnmarshalText([]byte(lc.Level)); err != nil {
+			return err
+		}
+	}
+
+	overrides := make(map[string]zapcore.Level, len(lc.Modules))
+	for m, l := range lc.Modules {
+		var ml zapcore.Level
+		if err := ml.UnmarshalText([]byte(l)); err != nil {
+			return err
+		}
+		overrides[m] = ml
+	}
+
+	level.SetLevel(lvl)
+
+	modulesMu.Lock()
+	modules = overrides
+	modulesMu.Unlock()
+
+	updateFloor()
+
+	return nil
+}
+
+// Rotate starts a new log file, keeping the current one as a backup. The scheduler
+// calls it nightly when RotateDaily is set so that each file covers at most a single
+// day, regardless of how large it has grown
+func Rotate() error {
+	if file == nil {
+		return nil
+	}
+
+	return file.Rotate()
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestReload(t *testing.T) {
+	before := level.Level()
+	t.Cleanup(func() {
+		level.SetLevel(before)
+		modulesMu.Lock()
+		modules = make(map[string]zapcore.Level)
+		modulesMu.Unlock()
+		updateFloor()
+	})
+
+	tests := []struct {
+		name    string
+		debug   bool
+		config  config.LoggingConfiguration
+		level   zapcore.Level
+		modules map[string]string
+		floor   zapcore.Level
+		ok      bool
+	}{
+		{"default", false, config.LoggingConfiguration{}, zapcore.InfoLevel, map[string]string{}, zapcore.InfoLevel, true},
+		{"level", false, config.LoggingConfiguration{Level: "warn"}, zapcore.WarnLevel, map[string]string{}, zapcore.WarnLevel, true},
+		{"debug mode", true, config.LoggingConfiguration{Level: "error"}, zapcore.DebugLevel, map[string]string{}, zapcore.DebugLevel, true},
+		{"modules", false, config.LoggingConfiguration{Level: "warn", Modules: map[string]string{"dns": "debug", "mail": "error"}}, zapcore.WarnLevel, map[string]string{"dns": "debug", "mail": "error"}, zapcore.DebugLevel, true},
+
+		// Overrides set at runtime are replaced, and nothing is applied from an invalid
+		// configuration
+		{"modules removed", false, config.LoggingConfiguration{Level: "error"}, zapcore.ErrorLevel, map[string]string{}, zapcore.ErrorLevel, true},
+		{"invalid level", false, config.LoggingConfiguration{Level: "loud", Modules: map[string]string{"dns": "debug"}}, zapcore.ErrorLevel, map[string]string{"web": "info"}, zapcore.InfoLevel, false},
+		{"invalid module level", false, config.LoggingConfiguration{Level: "debug", Modules: map[string]string{"dns": "loud"}}, zapcore.ErrorLevel, map[string]string{"web": "info"}, zapcore.InfoLevel, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetModuleLevel("web", "info"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Reload(tt.debug, &tt.config); (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+
+			if got := ModuleLevels(); level.Level() != tt.level || !maps.Equal(got, tt.modules) || floor.Level() != tt.floor {
+				t.Errorf("level %s, modules %v and floor %s, want %s, %v and %s", level.Level(), got, floor.Level(), tt.level, tt.modules, tt.floor)
+			}
+		})
+	}
+}
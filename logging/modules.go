@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Subsystems log through a named logger, for example zap.S().Named("dns"), and the
+// first segment of the logger name is used to find a level override for that module.
+// Modules without an override log at the global level
+var (
+	modulesMu sync.RWMutex
+	modules   = make(map[string]zapcore.Level)
+
+	// floor is the lowest level enabled by the global level or any module override. It
+	// lets the logger discard entries cheaply before the logger name is known
+	floor = zap.NewAtomicLevel()
+)
+
+// ModuleLevels returns the level overrides currently set for each module
+func ModuleLevels() map[string]string {
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+
+	levels := make(map[string]string, len(modules))
+	for m, l := range modules {
+		levels[m] = l.String()
+	}
+
+	return levels
+}
+
+// SetModuleLevel overrides the level for a single module at runtime
+func SetModuleLevel(module string, l string) error {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(l)); err != nil {
+		return err
+	}
+
+	modulesMu.Lock()
+	modules[module] = lvl
+	modulesMu.Unlock()
+
+	updateFloor()
+
+	return nil
+}
+
+// ClearModuleLevel removes the override for a module so it logs at the global level
+func ClearModuleLevel(module string) {
+	modulesMu.Lock()
+	delete(modules, module)
+	modulesMu.Unlock()
+
+	updateFloor()
+}
+
+// updateFloor recalculates the lowest level enabled across the global level and every
+// module override
+func updateFloor() {
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+
+	lvl := level.Level()
+	for _, l := range modules {
+		if l < lvl {
+			lvl = l
+		}
+	}
+
+	floor.SetLevel(lvl)
+}
+
+// levelFor returns the level an entry from the named logger is written at
+func levelFor(name string) zapcore.LevelEnabler {
+	if name == "" {
+		return level
+	}
+
+	module, _, _ := strings.Cut(name, ".")
+
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+
+	if l, ok := modules[module]; ok {
+		return l
+	}
+
+	return level
+}
+
+// moduleCore applies the global and per-module levels to entries before passing them
+// on to the wrapped core, which itself accepts every level
+type moduleCore struct {
+	zapcore.Core
+}
+
+func (c *moduleCore) Enabled(l zapcore.Level) bool {
+	return floor.Enabled(l)
+}
+
+func (c *moduleCore) With(fields []zapcore.Field) zapcore.Core {
+	return &moduleCore{Core: c.Core.With(fields)}
+}
+
+func (c *moduleCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !levelFor(e.LoggerName).Enabled(e.Level) {
+		return ce
+	}
+
+	return c.Core.Check(e, ce)
+}
@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"regexp"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKey matches the names of log fields whose value is always redacted
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|authorization|api_?key|license_?key|credential)`)
+
+// replacement is a pattern found in log messages and field values along with the
+// text it is replaced with
+type replacement struct {
+	pattern *regexp.Regexp
+	with    string
+}
+
+// defaultReplacements mask credentials and email addresses wherever they appear in a
+// message. Email addresses keep their first character and domain so they can still be
+// told apart when debugging
+var defaultReplacements = []replacement{
+	{regexp.MustCompile(`(?i)((?:bearer|basic)\s+)[A-Za-z0-9\-._~+/]+=*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|license[_-]?key)["']?\s*[:=]\s*["']?)[^\s"'&,]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(://[^:/\s@]+:)[^@/\s]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`), "${1}***@${2}"},
+}
+
+var (
+	replacementsMu sync.RWMutex
+	replacements   = defaultReplacements
+)
+
+// SetRedactPatterns adds extra regular expressions to the default redaction rules. Any
+// text matching one of the patterns is replaced entirely
+func SetRedactPatterns(patterns []string) error {
+	r := append([]replacement{}, defaultReplacements...)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+
+		r = append(r, replacement{pattern: re, with: redacted})
+	}
+
+	replacementsMu.Lock()
+	replacements = r
+	replacementsMu.Unlock()
+
+	return nil
+}
+
+// Redact masks any credentials, license keys and email addresses found in the string.
+// It is applied to every log entry and should be used on any error message returned to
+// an API client
+func Redact(s string) string {
+	replacementsMu.RLock()
+	defer replacementsMu.RUnlock()
+
+	for _, r := range replacements {
+		s = r.pattern.ReplaceAllString(s, r.with)
+	}
+
+	return s
+}
+
+// redactFields returns a copy of the fields with sensitive values masked. Fields are
+// redacted entirely if their key looks sensitive, otherwise string and error values
+// are passed through Redact
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		out[i] = f
+
+		if sensitiveKey.MatchString(f.Key) && f.Type != zapcore.NamespaceType {
+			out[i] = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: redacted}
+			continue
+		}
+
+		switch f.Type {
+		case zapcore.StringType:
+			out[i].String = Redact(f.String)
+		case zapcore.ByteStringType:
+			out[i] = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: Redact(string(f.Interface.([]byte)))}
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok && err != nil {
+				out[i] = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: Redact(err.Error())}
+			}
+		case zapcore.StringerType:
+			if s, ok := f.Interface.(interface{ String() string }); ok {
+				out[i] = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: Redact(s.String())}
+			}
+		}
+	}
+
+	return out
+}
+
+// redactCore masks sensitive data in the message and fields of every entry before it
+// reaches the output it wraps
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(redactFields(fields))}
+}
+
+// Check asks the wrapped core whether it would write the entry, so that level checks and
+// sampling still apply, and adds itself in its place so the fields pass through Write
+func (c *redactCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Core.Check(e, nil) != nil {
+		return ce.AddCore(e, c)
+	}
+
+	return ce
+}
+
+func (c *redactCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	e.Message = Redact(e.Message)
+
+	return c.Core.Write(e, redactFields(fields))
+}
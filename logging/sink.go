@@ -0,0 +1,218 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// entry is a single encoded log line waiting to be shipped to a remote destination
+type entry struct {
+	Time  time.Time
+	Level zapcore.Level
+	Line  string
+}
+
+// driver ships batches of log entries to a remote destination
+type driver interface {
+	Send(ctx context.Context, entries []entry) error
+	Close() error
+}
+
+// newDriver returns the driver for the sink configuration
+func newDriver(c config.SinkConfiguration) (driver, error) {
+	switch c.Driver {
+	case "syslog":
+		return newSyslogDriver(c)
+	case "loki":
+		return newLokiDriver(c), nil
+	case "elasticsearch":
+		return newElasticsearchDriver(c), nil
+	}
+
+	return nil, fmt.Errorf("logging: unknown sink driver %q", c.Driver)
+}
+
+// queue buffers entries in memory and ships them to the driver in batches from a single
+// goroutine. When the buffer is full new entries are dropped rather than blocking the
+// goroutine that is logging
+type queue struct {
+	name      string
+	driver    driver
+	entries   chan entry
+	dropped   atomic.Uint64
+	batchSize int
+	interval  time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newQueue creates a queue for the sink and starts shipping entries in the background
+func newQueue(c config.SinkConfiguration) (*queue, error) {
+	d, err := newDriver(c)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queue{
+		name:      c.Driver,
+		driver:    d,
+		entries:   make(chan entry, orDefault(c.BufferSize, 10000)),
+		batchSize: orDefault(c.BatchSize, 500),
+		interval:  time.Duration(orDefault(c.FlushInterval, 5)) * time.Second,
+		done:      make(chan struct{}),
+	}
+
+	q.wg.Add(1)
+	crash.Go("logging", q.run)
+
+	return q, nil
+}
+
+// push adds an entry to the queue, dropping it if the buffer is full
+func (q *queue) push(e entry) {
+	select {
+	case q.entries <- e:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// run collects entries into batches and sends them once a batch is full or the flush
+// interval has passed, draining anything left in the buffer when the queue is closed
+func (q *queue) run() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]entry, 0, q.batchSize)
+	for {
+		select {
+		case e := <-q.entries:
+			batch = append(batch, e)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		case <-q.done:
+			for {
+				select {
+				case e := <-q.entries:
+					batch = append(batch, e)
+				default:
+					q.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush sends the batch to the driver, retrying with a backoff. Failures are written to
+// stderr since logging them would feed back into the queue that is failing
+func (q *queue) flush(batch []entry) {
+	if n := q.dropped.Swap(0); n > 0 {
+		fmt.Fprintf(os.Stderr, "logging: %s sink buffer full, dropped %d entries\n", q.name, n)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = q.driver.Send(ctx, batch)
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+
+	fmt.Fprintf(os.Stderr, "logging: failed to ship %d entries to %s sink: %s\n", len(batch), q.name, err)
+}
+
+// close stops accepting entries and waits for the remaining buffer to be shipped
+func (q *queue) close() error {
+	close(q.done)
+	q.wg.Wait()
+
+	return q.driver.Close()
+}
+
+// sinkCore is a zap core that encodes entries as JSON and pushes them onto a queue
+type sinkCore struct {
+	zapcore.LevelEnabler
+	enc   zapcore.Encoder
+	queue *queue
+}
+
+// newSinkCore returns a core writing to the queue at the given level
+func newSinkCore(q *queue, lvl zapcore.LevelEnabler) zapcore.Core {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	return &sinkCore{
+		LevelEnabler: lvl,
+		enc:          zapcore.NewJSONEncoder(cfg),
+		queue:        q,
+	}
+}
+
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	return &sinkCore{LevelEnabler: c.LevelEnabler, enc: enc, queue: c.queue}
+}
+
+func (c *sinkCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+
+	return ce
+}
+
+func (c *sinkCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+
+	c.queue.push(entry{Time: e.Time, Level: e.Level, Line: strings.TrimSuffix(buf.String(), "\n")})
+	buf.Free()
+
+	return nil
+}
+
+func (c *sinkCore) Sync() error {
+	return nil
+}
+
+// orDefault returns the value if it is greater than zero, otherwise the default
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+
+	return def
+}
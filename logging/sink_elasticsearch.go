@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// elasticsearchDriver indexes entries into Elasticsearch using the bulk API
+type elasticsearchDriver struct {
+	config config.SinkConfiguration
+	client *http.Client
+}
+
+func newElasticsearchDriver(c config.SinkConfiguration) *elasticsearchDriver {
+	if c.Index == "" {
+		c.Index = "cosmicpanel"
+	}
+
+	return &elasticsearchDriver{config: c, client: httpx.Client(30 * time.Second)}
+}
+
+// Send indexes the entries into a daily index. Entries are already encoded as JSON so
+// they are written to the bulk request as-is
+func (d *elasticsearchDriver) Send(ctx context.Context, entries []entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		action := map[string]map[string]string{
+			"index": {"_index": d.config.Index + "-" + e.Time.UTC().Format("2006.01.02")},
+		}
+
+		b, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(b)
+		buf.WriteByte('\n')
+		buf.WriteString(e.Line)
+		buf.WriteByte('\n')
+	}
+
+	url := strings.TrimSuffix(d.config.Address, "/") + "/_bulk"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if d.config.Username != "" {
+		req.SetBasicAuth(d.config.Username, d.config.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("elasticsearch returned unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (d *elasticsearchDriver) Close() error {
+	return nil
+}
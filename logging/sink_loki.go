@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// lokiDriver pushes entries to the Grafana Loki push API
+type lokiDriver struct {
+	config config.SinkConfiguration
+	client *http.Client
+}
+
+func newLokiDriver(c config.SinkConfiguration) *lokiDriver {
+	return &lokiDriver{config: c, client: httpx.Client(30 * time.Second)}
+}
+
+// lokiStream is a single stream in a Loki push request
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// Send pushes the entries as one stream per level so that the level can be used as a
+// label when querying
+func (d *lokiDriver) Send(ctx context.Context, entries []entry) error {
+	streams := make(map[string]*lokiStream)
+	for _, e := range entries {
+		lvl := e.Level.String()
+		s, ok := streams[lvl]
+		if !ok {
+			labels := map[string]string{"job": "cosmicpanel", "level": lvl}
+			for k, v := range d.config.Labels {
+				labels[k] = v
+			}
+
+			s = &lokiStream{Stream: labels}
+			streams[lvl] = s
+		}
+
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.Time.UnixNano(), 10), e.Line})
+	}
+
+	body := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, s := range streams {
+		body.Streams = append(body.Streams, s)
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(d.config.Address, "/") + "/loki/api/v1/push"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.config.Username != "" {
+		req.SetBasicAuth(d.config.Username, d.config.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("loki returned unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (d *lokiDriver) Close() error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"log/syslog"
+	"net/url"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogDriver ships entries to a local or remote syslog daemon such as rsyslog
+type syslogDriver struct {
+	w *syslog.Writer
+}
+
+// newSyslogDriver connects to the syslog daemon at the configured address. An empty
+// address connects to the local syslog socket
+func newSyslogDriver(c config.SinkConfiguration) (*syslogDriver, error) {
+	var network, raddr string
+	if c.Address != "" {
+		u, err := url.Parse(c.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		network, raddr = u.Scheme, u.Host
+		if u.Scheme == "unix" || u.Scheme == "unixgram" {
+			raddr = u.Path
+		}
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, "cosmicpanel")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogDriver{w: w}, nil
+}
+
+// Send writes each entry using the syslog severity matching its level
+func (d *syslogDriver) Send(ctx context.Context, entries []entry) error {
+	for _, e := range entries {
+		var err error
+		switch e.Level {
+		case zapcore.DebugLevel:
+			err = d.w.Debug(e.Line)
+		case zapcore.InfoLevel:
+			err = d.w.Info(e.Line)
+		case zapcore.WarnLevel:
+			err = d.w.Warning(e.Line)
+		case zapcore.ErrorLevel:
+			err = d.w.Err(e.Line)
+		case zapcore.FatalLevel:
+			err = d.w.Emerg(e.Line)
+		default:
+			err = d.w.Crit(e.Line)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *syslogDriver) Close() error {
+	return d.w.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/lsm"
+)
+
+// lsmStatus is the security module of the server along with the recent denials
+type lsmStatus struct {
+	lsm.Status
+	Denials []string `json:"denials"`
+}
+
+// securityModule installs the panel's SELinux module or AppArmor profile, so that the
+// panel runs on servers that enforce them, and restores the labels of its files
+func securityModule(args []string) error {
+	var o options
+	fs := o.flags("lsm", "status|install|uninstall|relabel")
+	binary := fs.String("binary", "", "The binary the policy covers, defaults to this one")
+	args = parse(fs, args)
+
+	action := arg(args, 0)
+	if action != "status" && action != "install" && action != "uninstall" && action != "relabel" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	p, err := lsmPolicy(c, *binary)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "install":
+		if err := lsm.Install(p); err != nil {
+			return err
+		}
+	case "uninstall":
+		if err := lsm.Uninstall(p); err != nil {
+			return err
+		}
+	case "relabel":
+		if err := lsm.Relabel(p.Binary, p.Data, p.Log, c.Transfer.Homes); err != nil {
+			return err
+		}
+	}
+
+	status := lsmStatus{Status: lsm.Detect()}
+	if status.Denials, err = lsm.Denials([]string{c.System.Data, c.Transfer.Homes}, 10); err != nil {
+		return err
+	}
+
+	return o.print(status, func() error {
+		switch {
+		case status.Module == "":
+			fmt.Println("Neither SELinux nor AppArmor is enabled")
+			return nil
+		case status.Enforcing:
+			fmt.Printf("%s is enforcing\n", status.Module)
+		default:
+			fmt.Printf("%s is permissive\n", status.Module)
+		}
+
+		if status.Installed {
+			fmt.Println("The CosmicPanel policy is loaded")
+		} else {
+			fmt.Println("The CosmicPanel policy is not loaded, install it with cosmicpanel lsm install")
+		}
+
+		if len(status.Denials) > 0 {
+			fmt.Printf("\nRecent denials:\n")
+			for _, d := range status.Denials {
+				fmt.Println(d)
+			}
+		}
+
+		return nil
+	})
+}
+
+// lsmPolicy returns where the files the policy covers are, for the binary or this one
+func lsmPolicy(c *config.Configuration, binary string) (lsm.Policy, error) {
+	if binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return lsm.Policy{}, err
+		}
+
+		if binary, err = filepath.EvalSymlinks(exe); err != nil {
+			return lsm.Policy{}, err
+		}
+	}
+
+	data, err := filepath.Abs(c.System.Data)
+	if err != nil {
+		return lsm.Policy{}, err
+	}
+
+	p := lsm.Policy{Binary: binary, Data: data}
+	if c.Logging != nil {
+		p.Log = c.Logging.File
+	}
+
+	return p, nil
+}
@@ -0,0 +1,116 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// apparmorDir is where profiles are loaded from on boot
+const apparmorDir = "/etc/apparmor.d"
+
+// apparmorProfile attaches to the panel's binary. The panel manages users, services and
+// the firewall of the whole server, so it may use any capability and access any file.
+// The commands it runs switch to their own profiles when they have one
+var apparmorProfile = template.Must(template.New("apparmor").Parse(`# Managed by CosmicPanel, reinstall with cosmicpanel lsm install
+#include <tunables/global>
+
+profile cosmicpanel {{.Binary}} flags=(attach_disconnected) {
+  #include <abstractions/base>
+  #include <abstractions/nameservice>
+  #include <abstractions/openssl>
+  #include <abstractions/ssl_certs>
+
+  capability,
+  network,
+  signal,
+  ptrace,
+  unix,
+  dbus,
+  mount,
+  umount,
+
+  {{.Binary}} mr,
+  {{.Data}}/ rw,
+  {{.Data}}/** rwlk,
+{{- if .Log}}
+  {{.Log}}* rw,
+{{- end}}
+
+  / r,
+  /** rwlk,
+  /** pix,
+}
+`))
+
+// RenderAppArmor returns the profile of the panel
+func RenderAppArmor(p Policy) ([]byte, error) {
+	for _, path := range []string{p.Binary, p.Data, p.Log} {
+		if path != "" && (!filepath.IsAbs(path) || strings.ContainsAny(path, " \"\n{}[]*?,")) {
+			return nil, fmt.Errorf("lsm: %q must be an absolute path without spaces or globs", path)
+		}
+	}
+
+	if p.Binary == "" || p.Data == "" {
+		return nil, fmt.Errorf("lsm: the binary and data directory must be set")
+	}
+
+	p.Data = strings.TrimSuffix(p.Data, "/")
+
+	var buf bytes.Buffer
+	err := apparmorProfile.Execute(&buf, p)
+
+	return buf.Bytes(), err
+}
+
+// apparmorPath returns the file of the profile, named after the binary as is the
+// convention, such as usr.local.bin.cosmicpanel
+func apparmorPath(p Policy) string {
+	return filepath.Join(apparmorDir, strings.ReplaceAll(strings.TrimPrefix(p.Binary, "/"), "/", "."))
+}
+
+// installAppArmor writes the profile and loads it in place of any loaded before
+func installAppArmor(p Policy) error {
+	b, err := RenderAppArmor(p)
+	if err != nil {
+		return err
+	}
+
+	path := apparmorPath(p)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	return command("apparmor_parser", "--replace", "--write-cache", path)
+}
+
+// uninstallAppArmor unloads the profile and removes it
+func uninstallAppArmor(p Policy) error {
+	path := apparmorPath(p)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := command("apparmor_parser", "--remove", path); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// apparmorInstalled returns true if the panel's profile is loaded
+func apparmorInstalled() bool {
+	b, err := os.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return false
+	}
+
+	return bytes.Contains(b, []byte("\n"+name+" (")) || bytes.HasPrefix(b, []byte(name+" ("))
+}
@@ -0,0 +1,208 @@
+package lsm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// The security modules the panel installs a policy for
+const (
+	SELinux  = "selinux"
+	AppArmor = "apparmor"
+)
+
+// name is the name of the SELinux module and AppArmor profile the panel installs
+const name = "cosmicpanel"
+
+// tailSize is how many bytes at the end of a log are searched for denials
+const tailSize = 4 << 20
+
+// ErrNoModule is returned when installing a policy on a server without SELinux or
+// AppArmor enabled
+var ErrNoModule = errors.New("lsm: neither SELinux nor AppArmor is enabled")
+
+// auditLogs are searched for denials, which auditd writes to its own log and the kernel
+// writes to syslog when auditd is not running
+var auditLogs = []string{"/var/log/audit/audit.log", "/var/log/kern.log", "/var/log/syslog", "/var/log/messages"}
+
+// Status is the security module enabled on the server and whether it confines the panel
+type Status struct {
+	// The enabled module, selinux or apparmor, or empty if neither is
+	Module string `json:"module"`
+
+	// Denials are enforced rather than only logged. AppArmor is enforcing whenever it is
+	// enabled, as complain mode is per profile
+	Enforcing bool `json:"enforcing"`
+
+	// The panel's policy is loaded
+	Installed bool `json:"installed"`
+}
+
+// Policy is where the files the panel's policy labels are
+type Policy struct {
+	Binary string
+	Data   string
+
+	// The log file of the daemon, whose rotated copies are labeled along with it
+	Log string
+}
+
+// Detect returns the security module enabled on the server
+func Detect() Status {
+	if b, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil {
+		return Status{Module: SELinux, Enforcing: strings.TrimSpace(string(b)) == "1", Installed: selinuxInstalled()}
+	}
+
+	if b, err := os.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(b)) == "Y" {
+		return Status{Module: AppArmor, Enforcing: true, Installed: apparmorInstalled()}
+	}
+
+	return Status{}
+}
+
+// Install loads the panel's policy into the enabled security module and labels its files
+func Install(p Policy) error {
+	switch Detect().Module {
+	case SELinux:
+		return installSELinux(p)
+	case AppArmor:
+		return installAppArmor(p)
+	}
+
+	return ErrNoModule
+}
+
+// Uninstall unloads the panel's policy from the enabled security module
+func Uninstall(p Policy) error {
+	switch Detect().Module {
+	case SELinux:
+		return command("semodule", "-r", name)
+	case AppArmor:
+		return uninstallAppArmor(p)
+	}
+
+	return ErrNoModule
+}
+
+// Relabel restores the SELinux contexts the policy defines for the paths and everything
+// in them, such as a home directory that was just created. It does nothing without
+// SELinux, as AppArmor confines by path rather than by label
+func Relabel(paths ...string) error {
+	if Detect().Module != SELinux {
+		return nil
+	}
+
+	var existing []string
+	for _, p := range paths {
+		if _, err := os.Lstat(p); err == nil {
+			existing = append(existing, p)
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil
+	}
+
+	return command("restorecon", append([]string{"-R", "-F"}, existing...)...)
+}
+
+// Denials returns the most recent access denials in the audit logs that involve the
+// panel or any of the paths, oldest first
+func Denials(paths []string, limit int) ([]string, error) {
+	var denials []string
+	var errs []error
+
+	for _, path := range auditLogs {
+		lines, err := tail(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, line := range lines {
+			if denied(line) && involves(line, paths) {
+				denials = append(denials, line)
+			}
+		}
+	}
+
+	if len(denials) > limit {
+		denials = denials[len(denials)-limit:]
+	}
+
+	return denials, errors.Join(errs...)
+}
+
+// denied returns true if the log line is a SELinux or AppArmor denial
+func denied(line string) bool {
+	return strings.Contains(line, "avc:  denied") || strings.Contains(line, `apparmor="DENIED"`)
+}
+
+// involves returns true if the denial names the panel or one of the paths
+func involves(line string, paths []string) bool {
+	if strings.Contains(line, name) {
+		return true
+	}
+
+	for _, p := range paths {
+		if p != "" && strings.Contains(line, `"`+strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tail returns the lines at the end of the log
+func tail(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	partial := info.Size() > tailSize
+	if partial {
+		if _, err := f.Seek(-tailSize, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	var lines []string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	// The first line is cut off when reading from the middle of the log
+	if partial && len(lines) > 0 {
+		lines = lines[1:]
+	}
+
+	return lines, scanner.Err()
+}
+
+// command runs the command, returning its output in the error if it fails
+func command(cmd string, args ...string) error {
+	out, err := privsep.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lsm: %s %s failed: %w: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
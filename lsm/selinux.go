@@ -0,0 +1,113 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// develMakefile builds policy modules with the interfaces of the installed policy. It is
+// part of selinux-policy-devel
+const develMakefile = "/usr/share/selinux/devel/Makefile"
+
+// selinuxModule is the type enforcement of the panel's module. The panel manages users,
+// services and the firewall of the whole server, so its domain is unconfined. It still
+// runs in a domain of its own, entered from init, so that its files are labeled and the
+// confined services it manages cannot read them
+const selinuxModule = `policy_module(cosmicpanel, 1.0.0)
+
+type cosmicpanel_t;
+type cosmicpanel_exec_t;
+init_daemon_domain(cosmicpanel_t, cosmicpanel_exec_t)
+
+type cosmicpanel_var_lib_t;
+files_type(cosmicpanel_var_lib_t)
+
+type cosmicpanel_log_t;
+logging_log_file(cosmicpanel_log_t)
+
+optional_policy(` + "`" + `
+	unconfined_domain(cosmicpanel_t)
+')
+`
+
+// selinuxContexts labels the binary, the data directory and the log of the daemon
+var selinuxContexts = template.Must(template.New("fc").Parse(`{{.Binary}}	--	gen_context(system_u:object_r:cosmicpanel_exec_t,s0)
+{{.Data}}(/.*)?		gen_context(system_u:object_r:cosmicpanel_var_lib_t,s0)
+{{- if .Log}}
+{{.Log}}.*	--	gen_context(system_u:object_r:cosmicpanel_log_t,s0)
+{{- end}}
+`))
+
+// RenderSELinux returns the type enforcement and file contexts of the panel's module
+func RenderSELinux(p Policy) (te []byte, fc []byte, err error) {
+	if !filepath.IsAbs(p.Binary) || !filepath.IsAbs(p.Data) || (p.Log != "" && !filepath.IsAbs(p.Log)) {
+		return nil, nil, fmt.Errorf("lsm: the binary, data directory and log must be absolute paths")
+	}
+
+	var buf bytes.Buffer
+	err = selinuxContexts.Execute(&buf, Policy{
+		Binary: regexp.QuoteMeta(p.Binary),
+		Data:   regexp.QuoteMeta(strings.TrimSuffix(p.Data, "/")),
+		Log:    regexp.QuoteMeta(p.Log),
+	})
+
+	return []byte(selinuxModule), buf.Bytes(), err
+}
+
+// installSELinux builds the module against the installed policy, loads it and labels
+// the files it covers
+func installSELinux(p Policy) error {
+	te, fc, err := RenderSELinux(p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(develMakefile); err != nil {
+		return fmt.Errorf("lsm: %s is missing, install selinux-policy-devel to build the policy", develMakefile)
+	}
+
+	dir, err := os.MkdirTemp("", "cosmicpanel-selinux")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{name + ".te": te, name + ".fc": fc, name + ".if": nil}
+	for file, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), b, 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := command("make", "-C", dir, "-f", develMakefile, name+".pp"); err != nil {
+		return err
+	}
+
+	if err := command("semodule", "-i", filepath.Join(dir, name+".pp")); err != nil {
+		return err
+	}
+
+	return Relabel(p.Binary, p.Data, p.Log)
+}
+
+// selinuxInstalled returns true if the panel's module is loaded
+func selinuxInstalled() bool {
+	out, err := exec.Command("semodule", "-l").Output()
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,240 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+)
+
+// Transports a message can leave the server through
+const (
+	Relay    = "relay"
+	Sendmail = "sendmail"
+)
+
+// TLS modes of the relay
+const (
+	StartTLS = "starttls"
+	TLS      = "tls"
+	None     = "none"
+)
+
+var (
+	// ErrNotConfigured is returned when sending mail before Configure is called
+	ErrNotConfigured = errors.New("mailer: not configured")
+
+	// ErrInvalidAddress is returned for a sender or recipient that is not an email
+	// address
+	ErrInvalidAddress = errors.New("mailer: invalid address")
+)
+
+// Delivery is how a message left the server
+type Delivery struct {
+	Transport string `json:"transport"`
+
+	// The relay the message went through or was tried with, as host:port
+	Relay string `json:"relay,omitempty"`
+
+	// Why the relay was not used when the message fell back to sendmail
+	RelayError string `json:"relay_error,omitempty"`
+}
+
+// mailer sends the mail the panel sends itself
+type mailer struct {
+	config   *config.MailConfiguration
+	sendmail string
+}
+
+var std *mailer
+
+// Configure sets the relay mail is sent through, and the sendmail binary it falls back
+// to or is sent with when there is no relay
+func Configure(c *config.MailConfiguration, sendmail string) error {
+	switch c.Relay.TLS {
+	case "", StartTLS, TLS, None:
+	default:
+		return fmt.Errorf("mailer: unknown TLS mode %q, must be starttls, tls or none", c.Relay.TLS)
+	}
+
+	std = &mailer{config: c, sendmail: sendmail}
+
+	return nil
+}
+
+// Send delivers the message, with its headers and CRLF line endings, from the sender to
+// the recipient. It goes through the relay if one is set, falling back to sendmail when
+// that fails and the fallback is on
+func Send(from string, to string, msg []byte) (Delivery, error) {
+	if std == nil {
+		return Delivery{}, ErrNotConfigured
+	}
+
+	sender, err := address(from)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	rcpt, err := address(to)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	if std.config.Relay.Host == "" {
+		return Delivery{Transport: Sendmail}, std.viaSendmail(msg)
+	}
+
+	d := Delivery{Transport: Relay, Relay: std.relay()}
+
+	err = std.viaRelay(sender, rcpt, msg)
+	if err == nil || !std.config.Fallback {
+		return d, err
+	}
+
+	zap.S().Named("mailer").Warnw("failed to send mail through relay, falling back to sendmail", "relay", d.Relay, zap.Error(err))
+
+	d.Transport, d.RelayError = Sendmail, err.Error()
+
+	if serr := std.viaSendmail(msg); serr != nil {
+		return d, errors.Join(fmt.Errorf("relay: %w", err), fmt.Errorf("sendmail: %w", serr))
+	}
+
+	return d, nil
+}
+
+// address returns the bare address of a sender or recipient such as
+// "Panel <panel@example.com>"
+func address(s string) (string, error) {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		// Local addresses such as cosmicpanel@localhost have no domain to parse
+		if s = strings.TrimSpace(s); s != "" && !strings.ContainsAny(s, " <>\r\n") {
+			return s, nil
+		}
+
+		return "", fmt.Errorf("%w %q", ErrInvalidAddress, s)
+	}
+
+	return a.Address, nil
+}
+
+// relay returns the address of the relay, defaulting the port by the TLS mode
+func (m *mailer) relay() string {
+	port := m.config.Relay.Port
+	if port == 0 {
+		port = 587
+		if m.config.Relay.TLS == TLS {
+			port = 465
+		}
+	}
+
+	return net.JoinHostPort(m.config.Relay.Host, strconv.Itoa(port))
+}
+
+// viaRelay sends the message through the relay over SMTP
+func (m *mailer) viaRelay(from string, to string, msg []byte) error {
+	r := m.config.Relay
+	timeout := time.Duration(max(r.Timeout, 1)) * time.Second
+	tlsConfig := &tls.Config{ServerName: r.Host, MinVersion: tls.VersionTLS12}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if r.TLS == TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.relay(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", m.relay())
+	}
+	if err != nil {
+		return err
+	}
+
+	// The whole conversation has to finish in time, so a relay that stops answering
+	// half way does not hold up the notification
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, r.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	helo := r.HELO
+	if helo == "" {
+		helo, _ = os.Hostname()
+	}
+	if helo != "" {
+		if err := c.Hello(helo); err != nil {
+			return err
+		}
+	}
+
+	if r.TLS == "" || r.TLS == StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", r.Host)
+		}
+
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if r.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", r.Username, r.Password, r.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// The relay has accepted the message, so failing to say goodbye does not fail it
+	c.Quit()
+
+	return nil
+}
+
+// viaSendmail hands the message to the sendmail binary, which reads the recipients from
+// its headers
+func (m *mailer) viaSendmail(msg []byte) error {
+	cmd := exec.Command(m.sendmail, "-t", "-i")
+	cmd.Stdin = bytes.NewReader(msg)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// maintenance turns maintenance mode on or off. While the daemon is running the change
+// is made through its API so that it takes effect immediately, otherwise it is written
+// to the data directory and applies when the daemon starts
+func maintenance(args []string) error {
+	var o options
+	fs := o.flags("maintenance", "on|off|status")
+	reason := fs.String("reason", "", "The message shown to users while the panel is down")
+	eta := fs.Duration("eta", 0, "How long the maintenance is expected to take, such as 45m")
+	args = parse(fs, args)
+
+	action := arg(args, 0)
+	if action != "on" && action != "off" && action != "status" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	var until time.Time
+	if *eta > 0 {
+		until = time.Now().Add(*eta)
+	}
+
+	var m *access.Mode
+
+	if daemonRunning(c) {
+		if c.Panel.Token == "" {
+			return errors.New("the daemon is running and no panel token is configured to reach its API")
+		}
+
+		switch action {
+		case "on":
+			m = &access.Mode{}
+			err = panelRequest(c, http.MethodPut, "/api/v1/access/maintenance/mode", map[string]interface{}{"reason": *reason, "eta": until}, m)
+		case "off":
+			err = panelRequest(c, http.MethodDelete, "/api/v1/access/maintenance/mode", nil, nil)
+		default:
+			var state struct {
+				Mode *access.Mode `json:"mode"`
+			}
+			err = panelRequest(c, http.MethodGet, "/api/v1/access", nil, &state)
+			m = state.Mode
+		}
+	} else {
+		if err := access.Configure(c.System.Data, c.Access); err != nil {
+			return err
+		}
+
+		switch action {
+		case "on":
+			var mode access.Mode
+			mode, err = access.EnableMaintenance(*reason, until, "cli")
+			m = &mode
+		case "off":
+			err = access.DisableMaintenance()
+		default:
+			m = access.Maintenance()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	status := maintenanceStatus{Enabled: m != nil, Mode: m}
+
+	return o.print(status, func() error {
+		if m == nil {
+			fmt.Println("Maintenance mode is off")
+			return nil
+		}
+
+		fmt.Printf("Maintenance mode is on since %s", m.Started.Local().Format(time.RFC1123))
+		if !m.ETA.IsZero() {
+			fmt.Printf(", expected to end %s", m.ETA.Local().Format(time.RFC1123))
+		}
+		fmt.Println()
+
+		if m.Reason != "" {
+			fmt.Printf("Reason: %s\n", m.Reason)
+		}
+
+		return nil
+	})
+}
+
+// maintenanceStatus is whether maintenance mode is on
+type maintenanceStatus struct {
+	Enabled bool         `json:"enabled"`
+	Mode    *access.Mode `json:"mode,omitempty"`
+}
+
+// panelRequest calls the API of the running daemon with the panel token, decoding the
+// response into out if it is not nil. The daemon is reached over the loopback address,
+// so its certificate is not verified
+func panelRequest(c *config.Configuration, method string, path string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	scheme := "https"
+	if c.Panel.Certificate == "" {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequest(method, scheme+"://"+dialAddress(c.Panel.Host, c.Panel.Port)+path, r)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.Panel.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+
+		return fmt.Errorf("the daemon returned %s: %s", resp.Status, e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,246 @@
+package malware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+)
+
+// hit is a file an engine matched against a signature or rule
+type hit struct {
+	Path      string
+	Signature string
+	Engine    string
+}
+
+// engine scans a list of files for malware
+type engine interface {
+	Name() string
+	Scan(ctx context.Context, paths []string) ([]hit, error)
+}
+
+// engines returns every engine available on the host. clamd is preferred over clamscan
+// since it keeps its signatures loaded between scans
+func engines(c *config.MalwareConfiguration) []engine {
+	var list []engine
+
+	if conn, err := net.DialTimeout("unix", c.ClamdSocket, time.Second); err == nil {
+		conn.Close()
+		list = append(list, &clamd{socket: c.ClamdSocket})
+	} else if _, err := os.Stat(c.ClamScan); err == nil {
+		list = append(list, &clamscan{binary: c.ClamScan})
+	}
+
+	if len(c.YaraRules) > 0 {
+		if _, err := os.Stat(c.Yara); err == nil {
+			list = append(list, &yara{binary: c.Yara, rules: c.YaraRules})
+		}
+	}
+
+	return list
+}
+
+// clamd streams each file to the ClamAV daemon, which avoids clamd needing permission
+// to read account files
+type clamd struct {
+	socket string
+}
+
+func (e *clamd) Name() string {
+	return "clamav"
+}
+
+func (e *clamd) Scan(ctx context.Context, paths []string) ([]hit, error) {
+	var hits []hit
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return hits, err
+		}
+
+		sig, err := e.scanFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return hits, err
+		}
+
+		if sig != "" {
+			hits = append(hits, hit{Path: path, Signature: sig, Engine: e.Name()})
+		}
+	}
+
+	return hits, nil
+}
+
+// scanFile sends the file with the INSTREAM command, returning the signature it matched
+// or an empty string if it is clean
+func (e *clamd) scanFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	conn, err := net.DialTimeout("unix", e.socket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 64*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+				return "", err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	// Replies are "stream: OK" or "stream: <signature> FOUND", terminated by a null byte
+	res := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	res = strings.TrimPrefix(res, "stream: ")
+
+	switch {
+	case res == "OK":
+		return "", nil
+	case strings.HasSuffix(res, " FOUND"):
+		return strings.TrimSuffix(res, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("malware: unexpected reply from clamd: %s", res)
+	}
+}
+
+// clamscan runs the ClamAV command line scanner, used when clamd is not running
+type clamscan struct {
+	binary string
+}
+
+func (e *clamscan) Name() string {
+	return "clamav"
+}
+
+func (e *clamscan) Scan(ctx context.Context, paths []string) ([]hit, error) {
+	list, err := writeList(paths)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(list)
+
+	out, err := throttle.Command(ctx, e.binary, "--no-summary", "--infected", "--file-list="+list).Output()
+
+	// clamscan exits with 1 when it finds malware and 2 on errors
+	var exit interface{ ExitCode() int }
+	if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 1) {
+		return nil, fmt.Errorf("malware: clamscan failed: %w", err)
+	}
+
+	var hits []hit
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasSuffix(line, " FOUND") {
+			continue
+		}
+
+		i := strings.LastIndex(line, ": ")
+		if i < 0 {
+			continue
+		}
+
+		hits = append(hits, hit{Path: line[:i], Signature: strings.TrimSuffix(line[i+2:], " FOUND"), Engine: e.Name()})
+	}
+
+	return hits, nil
+}
+
+// yara matches files against the configured YARA rules
+type yara struct {
+	binary string
+	rules  []string
+}
+
+func (e *yara) Name() string {
+	return "yara"
+}
+
+func (e *yara) Scan(ctx context.Context, paths []string) ([]hit, error) {
+	list, err := writeList(paths)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(list)
+
+	args := append([]string{"--no-warnings", "--scan-list"}, e.rules...)
+	out, err := throttle.Command(ctx, e.binary, append(args, list)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("malware: yara failed: %w", err)
+	}
+
+	// Every match is printed as the rule name followed by the path
+	var hits []hit
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		rule, path, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		hits = append(hits, hit{Path: path, Signature: "YARA." + rule, Engine: e.Name()})
+	}
+
+	return hits, nil
+}
+
+// writeList writes the paths to a temporary file, one per line, for the scanners that
+// read the files to scan from a list
+func writeList(paths []string) (string, error) {
+	f, err := os.CreateTemp("", "cosmicpanel-scan-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(paths, "\n") + "\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,369 @@
+package malware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"go.uber.org/zap"
+)
+
+// batchSize is the number of files handed to the engines at once during a full scan
+const batchSize = 1000
+
+// maxScans is the number of scan summaries kept
+const maxScans = 50
+
+var (
+	// ErrNotConfigured is returned when scanning before Configure is called
+	ErrNotConfigured = errors.New("malware: not configured")
+
+	// ErrNoEngine is returned when neither ClamAV nor YARA is installed
+	ErrNoEngine = errors.New("malware: no scanner is installed, install clamav or configure yara rules")
+
+	// ErrScanRunning is returned when starting a full scan while another is in progress
+	ErrScanRunning = errors.New("malware: a scan is already running")
+)
+
+// Scan summarizes a full or upload scan
+type Scan struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Files      int       `json:"files"`
+	Detections int       `json:"detections"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// state is persisted so that the review queue survives a restart. Allowed holds the
+// hashes of files an administrator restored as false positives
+type state struct {
+	Detections []*Detection `json:"detections"`
+	Allowed    []string     `json:"allowed"`
+	Scans      []Scan       `json:"scans"`
+}
+
+// Scanner scans account files with every available engine and quarantines what they
+// find
+type Scanner struct {
+	mu         sync.Mutex
+	dir        string
+	config     *config.MalwareConfiguration
+	engines    []engine
+	state      state
+	running    bool
+	lastUpload time.Time
+}
+
+var std *Scanner
+
+// Configure detects the available engines and loads the review queue from the data
+// directory
+func Configure(dataDir string, c *config.MalwareConfiguration) error {
+	dir := filepath.Join(dataDir, "malware")
+	if err := os.MkdirAll(filepath.Join(dir, "quarantine"), 0700); err != nil {
+		return err
+	}
+
+	s := &Scanner{
+		dir:        dir,
+		config:     c,
+		engines:    engines(c),
+		lastUpload: time.Now(),
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "state.json")); err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	std = s
+
+	names := make([]string, len(s.engines))
+	for i, e := range s.engines {
+		names[i] = e.Name()
+	}
+
+	if len(names) == 0 {
+		zap.S().Named("malware").Warnw("no malware scanner is installed, scanning is disabled")
+	} else {
+		zap.S().Named("malware").Infow("using malware scanners", "engines", names)
+	}
+
+	return nil
+}
+
+// Due returns true if the scheduled interval has passed since the last full scan
+func Due() bool {
+	if std == nil || !std.config.Enabled || std.config.Interval <= 0 || len(std.engines) == 0 {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for i := len(std.state.Scans) - 1; i >= 0; i-- {
+		if std.state.Scans[i].Type == "full" {
+			return time.Since(std.state.Scans[i].Finished) >= time.Duration(std.config.Interval)*time.Hour
+		}
+	}
+
+	return true
+}
+
+// ScanHomes scans every file in the configured home directories
+func ScanHomes() (Scan, error) {
+	if std == nil {
+		return Scan{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	if std.running {
+		std.mu.Unlock()
+		return Scan{}, ErrScanRunning
+	}
+	std.running = true
+	std.mu.Unlock()
+
+	defer func() {
+		std.mu.Lock()
+		std.running = false
+		std.mu.Unlock()
+	}()
+
+	return std.scan("full", std.config.Homes, time.Time{})
+}
+
+// ScanUploads scans files in the upload directories that have changed since the last
+// time it was called
+func ScanUploads() (Scan, error) {
+	if std == nil {
+		return Scan{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	since := std.lastUpload
+	std.lastUpload = time.Now()
+	std.mu.Unlock()
+
+	return std.scan("uploads", std.config.Uploads, since)
+}
+
+// ScanFiles scans the files immediately, used for files uploaded through the panel
+func ScanFiles(paths []string) ([]Detection, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	return std.process(context.Background(), paths)
+}
+
+// Running returns true while a full scan is in progress
+func Running() bool {
+	if std == nil {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.running
+}
+
+// Scans returns the summaries of recent scans, newest last
+func Scans() []Scan {
+	if std == nil {
+		return []Scan{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return append([]Scan{}, std.state.Scans...)
+}
+
+// scan walks the directories matching the patterns with the limits of the malware class
+func (s *Scanner) scan(typ string, patterns []string, since time.Time) (Scan, error) {
+	var summary Scan
+	err := throttle.Run(context.Background(), throttle.Malware, func(ctx context.Context) error {
+		var err error
+		summary, err = s.walk(ctx, typ, patterns, since)
+		return err
+	})
+
+	return summary, err
+}
+
+// walk walks the directories matching the patterns, scanning every regular file modified
+// after since in batches. Walking stops once the context is done
+func (s *Scanner) walk(ctx context.Context, typ string, patterns []string, since time.Time) (Scan, error) {
+	summary := Scan{ID: ids.New(), Type: typ, Started: time.Now().UTC()}
+
+	if len(s.engines) == 0 {
+		return summary, ErrNoEngine
+	}
+
+	maxSize := int64(s.config.MaxFileSize) * 1024 * 1024
+	quarantine := filepath.Join(s.dir, "quarantine")
+
+	var batch []string
+	var scanErr error
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		found, err := s.process(ctx, batch)
+		summary.Files += len(batch)
+		summary.Detections += len(found)
+		if err != nil && scanErr == nil {
+			scanErr = err
+		}
+		batch = batch[:0]
+	}
+
+	for _, pattern := range patterns {
+		roots, err := filepath.Glob(pattern)
+		if err != nil {
+			return summary, err
+		}
+
+		for _, root := range roots {
+			filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if ctx.Err() != nil {
+					return filepath.SkipAll
+				}
+				if err != nil {
+					return nil
+				}
+
+				if d.IsDir() {
+					if path == quarantine {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				// Paths are passed to the scanners one per line
+				if !d.Type().IsRegular() || strings.ContainsAny(path, "\r\n") {
+					return nil
+				}
+
+				info, err := d.Info()
+				if err != nil || info.Size() == 0 || (maxSize > 0 && info.Size() > maxSize) || info.ModTime().Before(since) {
+					return nil
+				}
+
+				batch = append(batch, path)
+				if len(batch) >= batchSize {
+					flush()
+				}
+
+				return nil
+			})
+		}
+	}
+	flush()
+
+	if err := ctx.Err(); err != nil && scanErr == nil {
+		scanErr = err
+	}
+
+	summary.Finished = time.Now().UTC()
+	if scanErr != nil {
+		summary.Error = scanErr.Error()
+	}
+
+	// Upload scans run every few minutes, so only those that scanned something are kept
+	if typ == "full" || summary.Files > 0 {
+		s.mu.Lock()
+		s.state.Scans = append(s.state.Scans, summary)
+		if len(s.state.Scans) > maxScans {
+			s.state.Scans = s.state.Scans[len(s.state.Scans)-maxScans:]
+		}
+		if err := s.save(); err != nil {
+			zap.S().Named("malware").Errorw("failed to save malware scanner state", zap.Error(err))
+		}
+		s.mu.Unlock()
+	}
+
+	if typ == "full" {
+		zap.S().Named("malware").Infow("malware scan finished", "files", summary.Files, "detections", summary.Detections)
+	}
+
+	return summary, scanErr
+}
+
+// process runs every engine over the files and handles each file they match
+func (s *Scanner) process(ctx context.Context, paths []string) ([]Detection, error) {
+	if len(s.engines) == 0 {
+		return nil, ErrNoEngine
+	}
+
+	// A file matched by several engines is only handled once, with the first match
+	hits := make(map[string]hit)
+	var order []string
+	var scanErr error
+	for _, e := range s.engines {
+		found, err := e.Scan(ctx, paths)
+		if err != nil {
+			zap.S().Named("malware").Warnw("malware scanner failed", "engine", e.Name(), zap.Error(err))
+			scanErr = err
+		}
+
+		for _, h := range found {
+			if _, ok := hits[h.Path]; !ok {
+				hits[h.Path] = h
+				order = append(order, h.Path)
+			}
+		}
+	}
+
+	var detections []Detection
+	for _, path := range order {
+		d, err := s.detected(hits[path])
+		if err != nil {
+			zap.S().Named("malware").Errorw("failed to handle infected file", "path", path, zap.Error(err))
+			continue
+		}
+
+		if d != nil {
+			detections = append(detections, *d)
+		}
+	}
+
+	if len(detections) > 0 && s.config.Notify {
+		notifyOwners(s.config, detections)
+	}
+
+	return detections, scanErr
+}
+
+// save writes the review queue, allowlist and scan summaries to disk. The scanner must
+// be locked
+func (s *Scanner) save() error {
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, "state.json")
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
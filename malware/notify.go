@@ -0,0 +1,65 @@
+package malware
+
+import (
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"go.uber.org/zap"
+)
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "malware_found",
+		Description: "Sent to the owner of infected files found by a scan",
+		Fields:      []string{"Username", "Detections", "Quarantine"},
+		Template: notify.Template{
+			Subject: "Malware found in your {{.Product}} account",
+			Body: "A scan of your account {{.Username}} found {{len .Detections}} infected files:\n\n" +
+				"{{range .Detections}}  {{.Path}} ({{.Signature}})\n{{end}}" +
+				"{{if .Quarantine}}\nThe files have been moved into quarantine and will be reviewed by your administrator.\n{{end}}" +
+				"Files are most often infected through outdated plugins or themes, or a leaked password. Update your software and change your passwords.\n",
+		},
+	})
+}
+
+// notifyOwners notifies each owner of the infected files found in their account. Owners
+// are matched to panel users by username, and owners without a panel user with an email
+// address or phone number are skipped
+func notifyOwners(c *config.MalwareConfiguration, detections []Detection) {
+	byOwner := make(map[string][]Detection)
+	for _, d := range detections {
+		if d.Owner != "" {
+			byOwner[d.Owner] = append(byOwner[d.Owner], d)
+		}
+	}
+
+	users := make(map[string]auth.User)
+	for _, u := range auth.Users() {
+		users[u.Username] = u
+	}
+
+	for owner, list := range byOwner {
+		u, ok := users[owner]
+		if !ok || (u.Email == "" && u.Phone == "") {
+			continue
+		}
+
+		err := notify.Send(notify.Notification{
+			Kind:     "malware_found",
+			Username: u.Username,
+			Email:    u.Email,
+			Phone:    u.Phone,
+			Reseller: u.Reseller(),
+			Language: u.Language,
+			From:     c.NotifyFrom,
+			Data: map[string]interface{}{
+				"Username":   owner,
+				"Detections": list,
+				"Quarantine": c.Quarantine,
+			},
+		})
+		if err != nil {
+			zap.S().Named("malware").Warnw("failed to notify owner of infected files", "owner", owner, zap.Error(err))
+		}
+	}
+}
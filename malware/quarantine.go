@@ -0,0 +1,279 @@
+package malware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+// Statuses of a detection in the review queue
+const (
+	StatusQuarantined = "quarantined"
+	StatusReported    = "reported"
+	StatusRestored    = "restored"
+	StatusDeleted     = "deleted"
+)
+
+// ErrDetectionNotFound is returned when a detection with the ID does not exist
+var ErrDetectionNotFound = errors.New("malware: detection not found")
+
+// Detection is an infected file waiting for an administrator to review it. Quarantined
+// files are moved out of the account and stored without any permissions until they are
+// restored or deleted
+type Detection struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Owner     string    `json:"owner"`
+	Signature string    `json:"signature"`
+	Engine    string    `json:"engine"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Status    string    `json:"status"`
+	Detected  time.Time `json:"detected"`
+	Reviewed  time.Time `json:"reviewed,omitempty"`
+
+	// The original ownership and permissions, restored along with the file
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// detected records the hit and moves the file into quarantine if enabled. Files whose
+// hash an administrator allowed are ignored, and nil is returned for them
+func (s *Scanner) detected(h hit) (*Detection, error) {
+	info, err := os.Lstat(h.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := hashFile(h.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Contains(s.state.Allowed, sum) {
+		return nil, nil
+	}
+
+	// Files left in place because quarantine is disabled are only reported once
+	for _, existing := range s.state.Detections {
+		if existing.Path == h.Path && existing.SHA256 == sum && existing.Status == StatusReported {
+			return nil, nil
+		}
+	}
+
+	d := &Detection{
+		ID:        ids.New(),
+		Path:      h.Path,
+		Signature: h.Signature,
+		Engine:    h.Engine,
+		SHA256:    sum,
+		Size:      info.Size(),
+		Status:    StatusReported,
+		Detected:  time.Now().UTC(),
+		Mode:      info.Mode().Perm(),
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		d.UID, d.GID = int(st.Uid), int(st.Gid)
+		if u, err := user.LookupId(strconv.Itoa(d.UID)); err == nil {
+			d.Owner = u.Username
+		}
+	}
+
+	if s.config.Quarantine {
+		if err := moveFile(h.Path, s.quarantinePath(d.ID)); err != nil {
+			return nil, err
+		}
+		os.Chmod(s.quarantinePath(d.ID), 0)
+		d.Status = StatusQuarantined
+	}
+
+	s.state.Detections = append(s.state.Detections, d)
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	zap.S().Named("malware").Warnw("malware detected", "path", d.Path, "signature", d.Signature, "owner", d.Owner, "status", d.Status)
+
+	events.Publish(events.Event{
+		Type:     "malware.detected",
+		Account:  d.Owner,
+		Resource: d.ID,
+		Data:     map[string]interface{}{"path": d.Path, "signature": d.Signature, "engine": d.Engine, "status": d.Status},
+	})
+
+	return d, nil
+}
+
+// Detections returns the detections with the status, or every detection if the status is
+// empty
+func Detections(status string) []Detection {
+	list := []Detection{}
+	if std == nil {
+		return list
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, d := range std.state.Detections {
+		if status == "" || d.Status == status {
+			list = append(list, *d)
+		}
+	}
+
+	return list
+}
+
+// Restore marks the detection as a false positive. A quarantined file is moved back with
+// its original ownership and permissions, and files with the same hash are no longer
+// reported
+func Restore(id string) (Detection, error) {
+	if std == nil {
+		return Detection{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d := std.detection(id)
+	if d == nil {
+		return Detection{}, ErrDetectionNotFound
+	}
+
+	if d.Status == StatusQuarantined {
+		if _, err := os.Lstat(d.Path); err == nil {
+			return *d, errors.New("malware: a file now exists at the original path, move it before restoring")
+		}
+
+		src := std.quarantinePath(d.ID)
+		if err := moveFile(src, d.Path); err != nil {
+			return *d, err
+		}
+		os.Chown(d.Path, d.UID, d.GID)
+		os.Chmod(d.Path, d.Mode)
+	}
+
+	if !slices.Contains(std.state.Allowed, d.SHA256) {
+		std.state.Allowed = append(std.state.Allowed, d.SHA256)
+	}
+
+	d.Status = StatusRestored
+	d.Reviewed = time.Now().UTC()
+
+	return *d, std.save()
+}
+
+// Delete permanently removes the infected file, whether it is in quarantine or still in
+// place because quarantine is disabled
+func Delete(id string) (Detection, error) {
+	if std == nil {
+		return Detection{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d := std.detection(id)
+	if d == nil {
+		return Detection{}, ErrDetectionNotFound
+	}
+
+	var err error
+	switch d.Status {
+	case StatusQuarantined:
+		err = os.Remove(std.quarantinePath(d.ID))
+	case StatusReported:
+		// Only remove the file if it has not been replaced since it was detected
+		if sum, herr := hashFile(d.Path); herr == nil && sum == d.SHA256 {
+			err = os.Remove(d.Path)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return *d, err
+	}
+
+	d.Status = StatusDeleted
+	d.Reviewed = time.Now().UTC()
+
+	return *d, std.save()
+}
+
+// detection returns the detection with the ID. The scanner must be locked
+func (s *Scanner) detection(id string) *Detection {
+	for _, d := range s.state.Detections {
+		if d.ID == id {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// quarantinePath returns where a quarantined file is stored
+func (s *Scanner) quarantinePath(id string) string {
+	return filepath.Join(s.dir, "quarantine", id)
+}
+
+// moveFile renames the file, copying it when the destination is on another filesystem
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// hashFile returns the hex SHA-256 of the file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// migrations are the migrations of the state store that are pending or were applied
+type migrations struct {
+	Version    int               `json:"version"`
+	Migrations []store.Migration `json:"migrations"`
+}
+
+// migrate brings the schema of the state store up to date, which the daemon otherwise
+// does when it starts, or checks whether it is before upgrading
+func migrate(args []string) error {
+	var o options
+	fs := o.flags("migrate", "")
+	check := fs.Bool("check", false, "Only list the migrations the store is missing, failing if there are any")
+	parse(fs, args)
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	s, err := store.New(c.System.Data, c.Store)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	result := migrations{Migrations: []store.Migration{}}
+	if *check {
+		if result.Migrations, err = s.Pending(); err != nil {
+			return err
+		}
+	} else if result.Migrations, err = s.Migrate(store.Snapshots(c.System.Data)); err != nil {
+		return err
+	}
+
+	if result.Version, err = s.Version(); err != nil {
+		return err
+	}
+
+	err = o.print(result, func() error {
+		switch {
+		case len(result.Migrations) == 0:
+			fmt.Printf("The store is up to date at version %d\n", result.Version)
+			return nil
+		case *check:
+			fmt.Printf("The store is at version %d and is missing:\n", result.Version)
+		default:
+			fmt.Printf("Applied, the store is now at version %d:\n", result.Version)
+		}
+
+		for _, m := range result.Migrations {
+			fmt.Printf("  %04d %s\n", m.Version, m.Name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *check && len(result.Migrations) > 0 {
+		return fmt.Errorf("%d migrations are pending", len(result.Migrations))
+	}
+
+	return nil
+}
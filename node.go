@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+)
+
+// node manages the nodes of a cluster from its controller, joins this server to a
+// controller as an agent or standby, or has a standby take over as controller
+func node(args []string) error {
+	var o options
+	fs := o.flags("node", "list|token|place|remove|sync|promote|join [id|controller token]")
+	ttl := fs.Duration("ttl", 24*time.Hour, "How long a join token can be used for")
+	policy := fs.String("policy", "", "The placement policy, least-loaded or fill")
+	tags := fs.String("tags", "", "Comma separated tags the placed node must have")
+	prefer := fs.String("prefer", "", "Comma separated tags the placed node should have")
+	disk := fs.Uint64("disk", 0, "Megabytes of disk the placed node must have free")
+	standby := fs.Bool("standby", false, "Join as the standby controller rather than an agent")
+	args = parse(fs, args)
+
+	action := arg(args, 0)
+	switch {
+	case action == "list" || action == "token" || action == "place" || action == "promote":
+	case (action == "remove" || action == "sync") && arg(args, 1) != "":
+	case action == "join" && arg(args, 2) != "":
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	// Joining only changes the configuration, the daemon joins the controller once it is
+	// restarted
+	if action == "join" {
+		c.Cluster.Role = cluster.Agent
+		if *standby {
+			c.Cluster.Role = cluster.Standby
+		}
+		c.Cluster.Controller = arg(args, 1)
+		c.Cluster.JoinToken = arg(args, 2)
+
+		if err := c.WriteToDisk(); err != nil {
+			return err
+		}
+
+		return o.print(c.Cluster, func() error {
+			fmt.Printf("Configured this server as the %s of %s, restart the daemon to join the cluster\n", c.Cluster.Role, c.Cluster.Controller)
+			return nil
+		})
+	}
+
+	// Nodes are kept by the daemon, so they can only be managed through its API
+	if !daemonRunning(c) {
+		return errors.New("the daemon is not running")
+	}
+
+	if c.Panel.Token == "" {
+		return errors.New("no panel token is configured to reach the daemon's API")
+	}
+
+	switch action {
+	case "token":
+		var t struct {
+			Token   string    `json:"token"`
+			Expires time.Time `json:"expires"`
+		}
+
+		hours := max(int(ttl.Hours()), 1)
+		if err := panelRequest(c, http.MethodPost, "/api/v1/cluster/tokens", map[string]int{"ttl": hours}, &t); err != nil {
+			return err
+		}
+
+		return o.print(t, func() error {
+			fmt.Printf("Join token, valid until %s:\n\n  %s\n\nRun this on the server joining the cluster:\n\n  cosmicpanel node join <controller address:%d> %s\n", t.Expires.Local().Format(time.RFC1123), t.Token, c.Cluster.Port, t.Token)
+			return nil
+		})
+	case "remove":
+		id := arg(args, 1)
+		if err := panelRequest(c, http.MethodDelete, "/api/v1/cluster/nodes/"+id, nil, nil); err != nil {
+			return err
+		}
+
+		return o.print(map[string]string{"removed": id}, func() error {
+			fmt.Printf("Removed node %s from the cluster\n", id)
+			return nil
+		})
+	case "place":
+		req := cluster.PlacementRequest{Policy: *policy, Tags: splitList(*tags), Prefer: splitList(*prefer), Disk: *disk << 20}
+
+		var p cluster.Placement
+		if err := panelRequest(c, http.MethodPost, "/api/v1/cluster/placement", req, &p); err != nil {
+			return err
+		}
+
+		return o.print(p, func() error {
+			fmt.Printf("Place the account on %s (%s) by %s\n\n", p.Node.Name, p.Node.ID, p.Policy)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tSCORE\tREJECTED")
+			for _, cand := range p.Candidates {
+				fmt.Fprintf(w, "%s\t%s\t%.3f\t%s\n", cand.Node, cand.Name, cand.Score, cand.Rejected)
+			}
+			return w.Flush()
+		})
+	case "promote":
+		if err := panelRequest(c, http.MethodPost, "/api/v1/cluster/promote", nil, nil); err != nil {
+			return err
+		}
+
+		return o.print(map[string]string{"role": cluster.Controller}, func() error {
+			fmt.Println("This standby has taken over as controller, set its role to controller in the configuration")
+			return nil
+		})
+	case "sync":
+		id := arg(args, 1)
+
+		var list []cluster.Command
+		if err := panelRequest(c, http.MethodPost, "/api/v1/cluster/nodes/"+id+"/sync", nil, &list); err != nil {
+			return err
+		}
+
+		return o.print(list, func() error {
+			if len(list) == 0 {
+				fmt.Printf("Node %s is already being synced\n", id)
+				return nil
+			}
+
+			for _, cmd := range list {
+				fmt.Printf("Queued command %s to sync node %s\n", cmd.ID, id)
+			}
+			return nil
+		})
+	}
+
+	var state struct {
+		Role  string         `json:"role"`
+		Nodes []cluster.Node `json:"nodes"`
+	}
+	if err := panelRequest(c, http.MethodGet, "/api/v1/cluster", nil, &state); err != nil {
+		return err
+	}
+
+	if state.Role != cluster.Controller {
+		return fmt.Errorf("this server is not a cluster controller, its role is %s", state.Role)
+	}
+
+	if o.output != "table" {
+		return o.print(state.Nodes, nil)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tADDRESS\tONLINE\tVERSION\tLOAD\tDRIFT\tLAST SEEN")
+
+	for _, n := range state.Nodes {
+		version, load := "", ""
+		if n.Status != nil {
+			version = n.Status.Version
+			load = fmt.Sprintf("%.2f", n.Status.Load[0])
+		}
+
+		drift := strings.Join(n.Drift, ",")
+		if drift == "" {
+			drift = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\t%s\n", n.ID, n.Name, n.Address, n.Online, version, load, drift, n.LastSeen.Local().Format(time.RFC1123))
+	}
+
+	return w.Flush()
+}
+
+// splitList splits a comma separated flag into its trimmed, non-empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/mailer"
+)
+
+// client sends text messages and calls webhooks
+var client = httpx.Client(10 * time.Second)
+
+// webhookPayload is what a notification is POSTed to webhooks as. The data it was
+// rendered with is left out, as it can hold credentials
+type webhookPayload struct {
+	Kind     string    `json:"kind"`
+	Username string    `json:"username,omitempty"`
+	Reseller string    `json:"reseller,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Phone    string    `json:"phone,omitempty"`
+	Language string    `json:"language"`
+	Subject  string    `json:"subject"`
+	Time     time.Time `json:"time"`
+}
+
+// email sends the email through the relay or sendmail, with CRLF line endings
+func (s *notifier) email(from string, to string, subject string, body string) error {
+	_, err := mailer.Send(from, to, message(from, to, subject, body))
+	return err
+}
+
+// message returns the email with its headers. Relays do not add a date or message ID the
+// way sendmail does, so they are always set
+func message(from string, to string, subject string, body string) []byte {
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = strings.TrimRight(from[i+1:], ">")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", ids.Hex(16), domain)
+	fmt.Fprintf(&msg, "Subject: %s\r\n\r\n", subject)
+	msg.WriteString(body)
+
+	return msg.Bytes()
+}
+
+// sms sends the text message through the configured gateway
+func (s *notifier) sms(to string, message string) error {
+	b, err := json.Marshal(map[string]string{"to": to, "from": s.config.SMS.From, "message": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.SMS.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.SMS.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.SMS.Token)
+	}
+
+	return do(req)
+}
+
+// webhook POSTs the notification to the URL, signing the body with an HMAC-SHA256 of
+// the configured secret
+func (s *notifier) webhook(url string, n Notification, msg Template) error {
+	b, err := json.Marshal(webhookPayload{
+		Kind:     n.Kind,
+		Username: n.Username,
+		Reseller: n.Reseller,
+		Email:    n.Email,
+		Phone:    n.Phone,
+		Language: n.Language,
+		Subject:  msg.Subject,
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if s.config.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.config.WebhookSecret))
+		mac.Write(b)
+		req.Header.Set("X-CosmicPanel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return do(req)
+}
+
+// do sends the request, returning an error for any response but a success
+func do(req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return nil
+}
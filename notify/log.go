@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// Statuses of a delivery
+const (
+	Sent   = "sent"
+	Failed = "failed"
+)
+
+// Delivery is an attempt to deliver a notification through one channel
+type Delivery struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Channel   string    `json:"channel"`
+	Recipient string    `json:"recipient"`
+	Username  string    `json:"username,omitempty"`
+	Reseller  string    `json:"reseller,omitempty"`
+	Subject   string    `json:"subject"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Filter selects deliveries from the log. Fields left empty match every delivery
+type Filter struct {
+	Kind      string
+	Username  string
+	Reseller  string
+	Status    string
+	Recipient string
+
+	// The most deliveries returned, every one when zero
+	Limit int
+}
+
+// deliveryKind is what the delivery log is kept under in the state store, keyed by IDs
+// that sort by time
+const deliveryKind = "notify.delivery"
+
+// deliver runs the delivery through the channel and records it in the log
+func (s *notifier) deliver(n Notification, channel string, recipient string, subject string, fn func() error) error {
+	d := Delivery{
+		ID:        newID(),
+		Time:      time.Now().UTC(),
+		Kind:      n.Kind,
+		Channel:   channel,
+		Recipient: recipient,
+		Username:  n.Username,
+		Reseller:  n.Reseller,
+		Subject:   subject,
+		Status:    Sent,
+	}
+
+	err := fn()
+	if err != nil {
+		d.Status = Failed
+		d.Error = err.Error()
+		zap.S().Named("notify").Warnw("failed to deliver notification", "kind", n.Kind, "channel", channel, "username", n.Username, zap.Error(err))
+	}
+
+	if serr := store.Update(func(tx *store.Tx) error { return tx.Put(deliveryKind, d.ID, d) }); serr != nil {
+		zap.S().Named("notify").Errorw("failed to record delivery", "kind", n.Kind, "channel", channel, zap.Error(serr))
+	}
+
+	return err
+}
+
+// Deliveries returns the deliveries in the log matching the filter, newest first
+func Deliveries(f Filter) ([]Delivery, error) {
+	list := []Delivery{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(deliveryKind, func(id string, data []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(data, &d); err != nil {
+				return nil
+			}
+
+			if f.matches(d) {
+				list = append(list, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(list)
+	if f.Limit > 0 && len(list) > f.Limit {
+		list = list[:f.Limit]
+	}
+
+	return list, nil
+}
+
+// DeleteDeliveries removes the deliveries matching the filter from the log, returning
+// how many were removed. The limit of the filter is ignored
+func DeleteDeliveries(f Filter) (int, error) {
+	var n int
+
+	err := store.Update(func(tx *store.Tx) error {
+		var ids []string
+		err := tx.Each(deliveryKind, func(id string, data []byte) error {
+			var d Delivery
+			if json.Unmarshal(data, &d) == nil && f.matches(d) {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := tx.Delete(deliveryKind, id); err != nil {
+				return err
+			}
+		}
+		n = len(ids)
+
+		return nil
+	})
+
+	return n, err
+}
+
+// matches returns true if the delivery satisfies every field of the filter
+func (f Filter) matches(d Delivery) bool {
+	return (f.Kind == "" || d.Kind == f.Kind) && (f.Username == "" || d.Username == f.Username) &&
+		(f.Reseller == "" || d.Reseller == f.Reseller) && (f.Status == "" || d.Status == f.Status) &&
+		(f.Recipient == "" || d.Recipient == f.Recipient)
+}
+
+// prune removes deliveries older than the retention from the log, at most once an hour
+func (s *notifier) prune() {
+	s.mu.Lock()
+	if time.Since(s.pruned) < time.Hour {
+		s.mu.Unlock()
+		return
+	}
+	s.pruned = time.Now()
+	s.mu.Unlock()
+
+	// IDs start with the time of the delivery, so the expired ones sort first
+	cutoff := time.Now().UTC().AddDate(0, 0, -s.config.Retention).Format(idTime)
+
+	err := store.Update(func(tx *store.Tx) error {
+		var expired []string
+		err := tx.Each(deliveryKind, func(id string, _ []byte) error {
+			if id < cutoff {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			if err := tx.Delete(deliveryKind, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		zap.S().Named("notify").Warnw("failed to prune delivery log", zap.Error(err))
+	}
+}
+
+// idTime is the layout of the time delivery IDs start with
+const idTime = "20060102T150405.000000000"
+
+// newID returns an ID for a delivery that sorts by the time it was made
+func newID() string {
+	return time.Now().UTC().Format(idTime) + "-" + ids.Hex(4)
+}
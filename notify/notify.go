@@ -0,0 +1,444 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"github.com/cosmicpanel/CosmicPanel/mailer"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("notify: not configured")
+
+	// ErrUnknownKind is returned for a kind of notification that is not registered
+	ErrUnknownKind = errors.New("notify: unknown kind of notification")
+
+	// ErrNotFound is returned for a template that has not been overridden
+	ErrNotFound = errors.New("notify: the template is not overridden")
+)
+
+// Template is a notification written as Go text templates, executed with the data of
+// the notification along with .Product, .Hostname and .URL of the recipient's brand
+type Template struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+
+	// The text sent by SMS. Notifications without one are not sent by SMS
+	SMS string `json:"sms,omitempty"`
+}
+
+// Kind is a notification the panel sends, along with its built in template
+type Kind struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Template    Template `json:"template"`
+
+	// The fields the templates are executed with, besides those of the brand
+	Fields []string `json:"fields"`
+}
+
+// Notification is a notification to one of the panel's users
+type Notification struct {
+	Kind string
+
+	// The recipient, and the reseller they belong to, which is empty for those who
+	// belong to the administrators
+	Username string
+	Email    string
+	Phone    string
+	Reseller string
+
+	// The language the recipient chose, which falls back to that of their brand and then
+	// to the panel's
+	Language string
+
+	// The address the notification is emailed from unless the brand sets one, the
+	// configured address when empty
+	From string
+
+	Data map[string]interface{}
+}
+
+// templateKind is what templates overriding the built in ones are kept under in the
+// state store, keyed by kind for the panel's own and by reseller and kind for a
+// reseller's
+const templateKind = "notify.template"
+
+var (
+	kindsMu sync.Mutex
+	kinds   = make(map[string]Kind)
+)
+
+// notifier sends notifications and records their deliveries
+type notifier struct {
+	mu        sync.Mutex
+	config    *config.NotifyConfiguration
+	templates map[string]Template
+	pruned    time.Time
+}
+
+var std *notifier
+
+// Configure loads the templates overriding the built in ones from the state store, which
+// must be configured first
+func Configure(c *config.NotifyConfiguration) error {
+	n := &notifier{config: c, templates: make(map[string]Template)}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(templateKind, func(id string, data []byte) error {
+			var t Template
+			if err := json.Unmarshal(data, &t); err != nil {
+				return fmt.Errorf("notify: malformed template %s: %w", id, err)
+			}
+			n.templates[id] = t
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	std = n
+
+	return nil
+}
+
+// Register adds a kind of notification. The packages sending notifications register
+// their kinds when they are loaded
+func Register(k Kind) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+
+	kinds[k.Name] = k
+}
+
+// Kinds returns every kind of notification, sorted by name
+func Kinds() []Kind {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+
+	list := make([]Kind, 0, len(kinds))
+	for _, k := range kinds {
+		list = append(list, k)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// kind returns the registered kind with the name
+func kind(name string) (Kind, bool) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+
+	k, ok := kinds[name]
+
+	return k, ok
+}
+
+// Send renders the notification in the brand of the recipient and delivers it by email,
+// by SMS and to the webhooks, recording every delivery. It returns once every delivery
+// has been attempted, so callers that cannot wait send it from a goroutine
+func Send(n Notification) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	k, ok := kind(n.Kind)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKind, n.Kind)
+	}
+
+	if slices.Contains(std.config.Disabled, n.Kind) {
+		return nil
+	}
+
+	b := branding.Resolve(n.Reseller)
+
+	data := make(map[string]interface{}, len(n.Data)+3)
+	for key, v := range n.Data {
+		data[key] = v
+	}
+	data["Product"] = b.ProductName
+	data["Hostname"] = b.Hostname
+	data["URL"] = std.url(b.Hostname)
+
+	from := n.From
+	if b.From != "" {
+		from = b.From
+	}
+	if from == "" {
+		from = std.config.From
+	}
+
+	n.Language = locale.Match(n.Language, b.Language)
+	msg := std.render(k, n.Reseller, n.Language, data)
+
+	var errs []error
+	if n.Email != "" {
+		errs = append(errs, std.deliver(n, "email", n.Email, msg.Subject, func() error {
+			return std.email(from, n.Email, msg.Subject, msg.Body)
+		}))
+	}
+
+	if n.Phone != "" && msg.SMS != "" && std.config.SMS.URL != "" {
+		errs = append(errs, std.deliver(n, "sms", n.Phone, msg.Subject, func() error {
+			return std.sms(n.Phone, msg.SMS)
+		}))
+	}
+
+	for _, hook := range std.config.Webhooks {
+		errs = append(errs, std.deliver(n, "webhook", hook, msg.Subject, func() error {
+			return std.webhook(hook, n, msg)
+		}))
+	}
+
+	std.prune()
+
+	return errors.Join(errs...)
+}
+
+// Test emails a test message from the configured address, to check that the panel's
+// mail reaches its recipients, returning how it left the server
+func Test(to string) (mailer.Delivery, error) {
+	if std == nil {
+		return mailer.Delivery{}, ErrNotConfigured
+	}
+
+	b := branding.Resolve("")
+	subject := "Test email from " + b.ProductName
+	body := "This message was sent from " + b.ProductName + " to check that the email it sends reaches you.\n"
+
+	return mailer.Send(std.config.From, to, message(std.config.From, to, subject, body))
+}
+
+// url returns the address of the panel for a brand with the hostname
+func (s *notifier) url(hostname string) string {
+	if s.config.URL == "" || hostname == "" {
+		return s.config.URL
+	}
+
+	u, err := url.Parse(s.config.URL)
+	if err != nil {
+		return s.config.URL
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = hostname + ":" + port
+	} else {
+		u.Host = hostname
+	}
+
+	return u.String()
+}
+
+// render executes the template of the kind the reseller has, falling back to the
+// panel's own, then to the translation of the built in one into the language and then
+// to the built in one when there is none or it fails, so that the notification still
+// goes out
+func (s *notifier) render(k Kind, reseller string, language string, data map[string]interface{}) Template {
+	s.mu.Lock()
+	var candidates []Template
+	if t, ok := s.templates[templateID(reseller, k.Name)]; ok && reseller != "" {
+		candidates = append(candidates, t)
+	}
+	if t, ok := s.templates[templateID("", k.Name)]; ok {
+		candidates = append(candidates, t)
+	}
+	s.mu.Unlock()
+
+	if t, err := locale.TranslateNotification(language, k.Name); err == nil {
+		candidates = append(candidates, Template{Subject: t.Subject, Body: t.Body, SMS: t.SMS})
+	}
+
+	for _, t := range candidates {
+		msg, err := execute(k.Name, t, data)
+		if err == nil {
+			return msg
+		}
+
+		zap.S().Named("notify").Warnw("failed to render template, falling back", "kind", k.Name, "reseller", reseller, "language", language, zap.Error(err))
+	}
+
+	msg, err := execute(k.Name, k.Template, data)
+	if err != nil {
+		zap.S().Named("notify").Errorw("failed to render built in template", "kind", k.Name, zap.Error(err))
+	}
+
+	return msg
+}
+
+// execute renders every part of the template. Line breaks in the subject are removed so
+// that a template cannot add headers to the email
+func execute(name string, t Template, data map[string]interface{}) (Template, error) {
+	var out Template
+
+	for _, part := range []struct {
+		text string
+		dst  *string
+	}{{t.Subject, &out.Subject}, {t.Body, &out.Body}, {t.SMS, &out.SMS}} {
+		tmpl, err := template.New(name).Parse(part.text)
+		if err != nil {
+			return out, err
+		}
+
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			return out, err
+		}
+		*part.dst = sb.String()
+	}
+
+	out.Subject = strings.Join(strings.Fields(out.Subject), " ")
+
+	return out, nil
+}
+
+// GetTemplate returns the template overriding the built in one of the kind, the panel's
+// own for an empty reseller
+func GetTemplate(reseller string, name string) (Template, error) {
+	if std == nil {
+		return Template{}, ErrNotConfigured
+	}
+
+	if _, ok := kind(name); !ok {
+		return Template{}, ErrUnknownKind
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	t, ok := std.templates[templateID(reseller, name)]
+	if !ok {
+		return Template{}, ErrNotFound
+	}
+
+	return t, nil
+}
+
+// SetTemplate checks and saves the template overriding the built in one of the kind for
+// the reseller, or for the panel for an empty reseller
+func SetTemplate(reseller string, name string, t Template) (Template, error) {
+	if std == nil {
+		return Template{}, ErrNotConfigured
+	}
+
+	if _, ok := kind(name); !ok {
+		return Template{}, ErrUnknownKind
+	}
+
+	if strings.TrimSpace(t.Subject) == "" || strings.TrimSpace(t.Body) == "" {
+		return Template{}, errors.New("notify: a template needs a subject and a body")
+	}
+
+	for part, text := range map[string]string{"subject": t.Subject, "body": t.Body, "sms": t.SMS} {
+		if _, err := template.New(name).Parse(text); err != nil {
+			return Template{}, fmt.Errorf("notify: %s of %s: %w", part, name, err)
+		}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	id := templateID(reseller, name)
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(templateKind, id, t)
+	})
+	if err != nil {
+		return Template{}, err
+	}
+
+	std.templates[id] = t
+
+	return t, nil
+}
+
+// DeleteTemplate removes the template overriding the built in one of the kind for the
+// reseller, or for the panel for an empty reseller
+func DeleteTemplate(reseller string, name string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	id := templateID(reseller, name)
+	if _, ok := std.templates[id]; !ok {
+		return ErrNotFound
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Delete(templateKind, id)
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(std.templates, id)
+
+	return nil
+}
+
+// DeleteTemplates removes every template of the reseller, such as once they are deleted
+func DeleteTemplates(reseller string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	if reseller == "" {
+		return nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var ids []string
+	for id := range std.templates {
+		if strings.HasPrefix(id, reseller+"/") {
+			ids = append(ids, id)
+		}
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		for _, id := range ids {
+			if err := tx.Delete(templateKind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		delete(std.templates, id)
+	}
+
+	return nil
+}
+
+// templateID returns the ID the template of the kind is kept under for the reseller
+func templateID(reseller string, name string) string {
+	if reseller == "" {
+		return name
+	}
+
+	return reseller + "/" + name
+}
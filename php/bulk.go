@@ -0,0 +1,125 @@
+package php
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// The mass operation changing the php.ini settings of many domains at once, such as
+// raising memory_limit on every site
+const bulkType = "php.settings"
+
+// Change is what a mass operation changes in the settings of each domain
+type Change struct {
+	// The settings set, and those removed when their value is empty. Other settings of
+	// the domain are kept
+	INI map[string]string `json:"ini"`
+}
+
+// registerBulk registers the mass operation changing the settings of domains, which is
+// checked by requesting the sites once they were changed
+func registerBulk() {
+	bulk.Register(bulk.Type{
+		Name:    bulkType,
+		Run:     changeItem,
+		All:     domains,
+		Check:   bulk.SiteCheck(std.config.Check),
+		Account: func(it bulk.Item) string { return account(it.Key) },
+	})
+}
+
+// changeItem changes the settings of the domain the item is keyed by
+func changeItem(ctx context.Context, actor string, it bulk.Item) error {
+	var c Change
+	if err := it.Decode(&c); err != nil {
+		return err
+	}
+
+	if len(c.INI) == 0 {
+		return errors.New("php: the operation changes no settings")
+	}
+
+	before, err := Get(it.Key)
+	if errors.Is(err, ErrNotFound) {
+		before = Settings{Domain: it.Key, Account: account(it.Key), Env: map[string]string{}}
+	} else if err != nil {
+		return err
+	}
+
+	s := before
+	s.INI = maps.Clone(before.INI)
+	if s.INI == nil {
+		s.INI = map[string]string{}
+	}
+
+	for name, value := range c.INI {
+		if strings.TrimSpace(value) == "" {
+			delete(s.INI, name)
+		} else {
+			s.INI[name] = value
+		}
+	}
+
+	if s, err = Set(s); err != nil {
+		return err
+	}
+
+	e := events.Event{Type: "php.settings", Actor: actor, Resource: s.Domain}
+	if !before.Updated.IsZero() {
+		e.Before, _ = json.Marshal(before.Redacted())
+	}
+	e.After, _ = json.Marshal(s.Redacted())
+	events.Publish(e)
+
+	return nil
+}
+
+// domains returns an item for every domain registered through the panel or with
+// settings, which is what operations without items change
+func domains() ([]bulk.Item, error) {
+	seen := map[string]bool{}
+	items := []bulk.Item{}
+
+	registered, err := registrar.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range registered {
+		if name := normalize(d.Name); !seen[name] {
+			seen[name] = true
+			items = append(items, bulk.Item{Key: name})
+		}
+	}
+
+	list, err := List()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if !seen[s.Domain] {
+			seen[s.Domain] = true
+			items = append(items, bulk.Item{Key: s.Domain})
+		}
+	}
+
+	return items, nil
+}
+
+// account returns the username of the account the domain belongs to, from its settings
+// or from who registered it, or an empty string when neither is known
+func account(domain string) string {
+	domain = normalize(domain)
+
+	if s, err := Get(domain); err == nil && s.Account != "" {
+		return s.Account
+	}
+
+	return registrar.Account(domain)
+}
@@ -0,0 +1,239 @@
+package php
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"go.uber.org/zap"
+)
+
+// Placeholders in the paths of the files of a domain and the name of its pool
+const (
+	domainPlaceholder  = "{domain}"
+	accountPlaceholder = "{account}"
+)
+
+// Headers starting every pool and environment file
+const (
+	poolHeader = "; Managed by CosmicPanel, changes are overwritten when the PHP settings of the domain change\n"
+	envHeader  = "# Managed by CosmicPanel, changes are overwritten when the PHP settings of the domain change\n"
+)
+
+// Names the files are reconciled under
+const (
+	poolSource = "php.fpm"
+	envSource  = "php.env"
+)
+
+// registerSources registers the pools and environment files of every domain with the
+// reconciler, so that edits to them are reported and repaired
+func registerSources() {
+	reconcile.Register(poolSource, std.poolSource())
+	reconcile.Register(envSource, std.envSource())
+}
+
+// poolSource generates the additions to the pools of domains, which PHP-FPM tests
+// before it is reloaded
+func (m *manager) poolSource() reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			return m.desired(m.pool)
+		},
+		Test: func() error {
+			return privsep.Run(m.config.FPM, "-t")
+		},
+		Reload: func() error {
+			if len(m.config.Reload) == 0 {
+				return nil
+			}
+			return privsep.Run(m.config.Reload[0], m.config.Reload[1:]...)
+		},
+	}
+}
+
+// envSource generates the environment files of domains running in containers, which
+// pick them up when they are restarted
+func (m *manager) envSource() reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			return m.desired(m.env)
+		},
+	}
+}
+
+// desired returns the file fn generates for every domain whose directory exists
+func (m *manager) desired(fn func(s Settings) (string, *reconcile.Artifact)) ([]reconcile.Artifact, error) {
+	list, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []reconcile.Artifact
+	for _, s := range list {
+		if path, a := fn(s); a != nil && reconcile.Installed(path) {
+			artifacts = append(artifacts, *a)
+		}
+	}
+
+	return artifacts, nil
+}
+
+// render writes the files of the domain, or removes them when it sets nothing. The pool
+// is put back as it was if PHP-FPM rejects it
+func (m *manager) render(s Settings) error {
+	if path, a := m.pool(s); path != "" {
+		if !reconcile.Installed(path) {
+			return ErrNoPool
+		}
+
+		var err error
+		if a != nil {
+			_, err = reconcile.Write(poolSource, m.poolSource(), *a)
+		} else {
+			_, err = reconcile.Remove(poolSource, m.poolSource(), path)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+
+	if path, a := m.env(s); path != "" && reconcile.Installed(path) {
+		var err error
+		if a != nil {
+			_, err = reconcile.Write(envSource, m.envSource(), *a)
+		} else {
+			_, err = reconcile.Remove(envSource, m.envSource(), path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes the files of the domain other than those to keep
+func (m *manager) remove(s Settings, keep ...string) error {
+	if path, _ := m.pool(s); path != "" && !slices.Contains(keep, path) {
+		if _, err := reconcile.Remove(poolSource, m.poolSource(), path); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+
+	if path, _ := m.env(s); path != "" && !slices.Contains(keep, path) {
+		if _, err := reconcile.Remove(envSource, m.envSource(), path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// paths returns the files of the domain
+func (m *manager) paths(s Settings) []string {
+	pool, _ := m.pool(s)
+	env, _ := m.env(s)
+
+	return []string{pool, env}
+}
+
+// pool returns the path of the addition to the pool of the domain, and the addition
+// unless it sets nothing. The path is empty when pools are not rendered
+func (m *manager) pool(s Settings) (string, *reconcile.Artifact) {
+	if m.config.File == "" {
+		return "", nil
+	}
+
+	r := placeholders(s)
+	path := r.Replace(m.config.File)
+
+	ini := m.effective(s)
+	if len(ini) == 0 && len(s.Env) == 0 {
+		return path, nil
+	}
+
+	var b strings.Builder
+	b.WriteString(poolHeader)
+	fmt.Fprintf(&b, "[%s]\n", r.Replace(m.config.Pool))
+
+	for _, name := range sorted(ini) {
+		directive := "php_value"
+		if settings[name].admin {
+			directive = "php_admin_value"
+		}
+
+		value := ini[name]
+		switch settings[name].typ {
+		case Flag:
+			directive = strings.Replace(directive, "value", "flag", 1)
+		case Timezone:
+			value = `"` + value + `"`
+		}
+
+		fmt.Fprintf(&b, "%s[%s] = %s\n", directive, name, value)
+	}
+
+	for _, name := range sorted(s.Env) {
+		fmt.Fprintf(&b, "env[%s] = \"%s\"\n", name, s.Env[name])
+	}
+
+	return path, &reconcile.Artifact{Path: path, Content: b.String()}
+}
+
+// env returns the path of the environment file of the domain, and the file unless the
+// domain sets no variables. The path is empty when environment files are off
+func (m *manager) env(s Settings) (string, *reconcile.Artifact) {
+	if m.config.EnvFile == "" {
+		return "", nil
+	}
+
+	path := placeholders(s).Replace(m.config.EnvFile)
+	if len(s.Env) == 0 {
+		return path, nil
+	}
+
+	var b strings.Builder
+	b.WriteString(envHeader)
+	for _, name := range sorted(s.Env) {
+		fmt.Fprintf(&b, "%s=%s\n", name, s.Env[name])
+	}
+
+	// The variables often hold credentials
+	return path, &reconcile.Artifact{Path: path, Content: b.String(), Mode: 0600}
+}
+
+// effective returns the php.ini settings of the domain within the ceilings. Settings
+// above a ceiling that was lowered since they were set are left out
+func (m *manager) effective(s Settings) map[string]string {
+	ini := make(map[string]string, len(s.INI))
+	for name, value := range s.INI {
+		v, err := m.check(name, value)
+		if err != nil {
+			zap.S().Named("php").Warnw("leaving out PHP setting beyond its ceiling", "domain", s.Domain, zap.Error(err))
+			continue
+		}
+		ini[name] = v
+	}
+
+	return ini
+}
+
+// placeholders returns the replacer of the placeholders in the paths of the domain
+func placeholders(s Settings) *strings.Replacer {
+	return strings.NewReplacer(domainPlaceholder, s.Domain, accountPlaceholder, s.Account)
+}
+
+// sorted returns the keys of the map in order
+func sorted(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,61 @@
+package php
+
+import "testing"
+
+func TestPool(t *testing.T) {
+	configure(t, "true")
+
+	tests := []struct {
+		name     string
+		settings Settings
+		pool     string
+		env      string
+	}{
+		{
+			"settings",
+			Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "256M", "display_errors": "on", "date.timezone": "Europe/Berlin", "error_reporting": "E_ALL"}, Env: map[string]string{"B": "2", "A": "1 $x"}},
+			poolHeader + "[alice]\nphp_value[date.timezone] = \"Europe/Berlin\"\nphp_flag[display_errors] = on\nphp_value[error_reporting] = E_ALL\nphp_admin_value[memory_limit] = 256M\nenv[A] = \"1 $x\"\nenv[B] = \"2\"\n",
+			envHeader + "A=1 $x\nB=2\n",
+		},
+		{
+			"no variables",
+			Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"max_input_vars": "1000"}},
+			poolHeader + "[alice]\nphp_admin_value[max_input_vars] = 1000\n",
+			"",
+		},
+		{"nothing", Settings{Domain: "example.com", Account: "alice"}, "", ""},
+
+		// Settings stored before a ceiling was lowered are left out
+		{
+			"over a lowered ceiling",
+			Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "1G", "log_errors": "on"}},
+			poolHeader + "[alice]\nphp_flag[log_errors] = on\n",
+			"",
+		},
+		{"only over a lowered ceiling", Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "1G"}}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, a := std.pool(tt.settings)
+			if path == "" || (a == nil) != (tt.pool == "") || (a != nil && (a.Content != tt.pool || a.Path != path)) {
+				t.Errorf("pool %s: %+v, want\n%s", path, a, tt.pool)
+			}
+
+			path, a = std.env(tt.settings)
+			if path == "" || (a == nil) != (tt.env == "") || (a != nil && (a.Content != tt.env || a.Mode != 0600)) {
+				t.Errorf("environment file %s: %+v, want\n%s", path, a, tt.env)
+			}
+		})
+	}
+
+	std.config.File = ""
+	std.config.EnvFile = ""
+	s := Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "256M"}, Env: map[string]string{"A": "1"}}
+	if path, a := std.pool(s); path != "" || a != nil {
+		t.Errorf("pool %s rendered when pools are off", path)
+	}
+	if path, a := std.env(s); path != "" || a != nil {
+		t.Errorf("environment file %s rendered when they are off", path)
+	}
+}
@@ -0,0 +1,450 @@
+package php
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// Types of the php.ini settings accounts can override
+const (
+	Size           = "size"
+	Seconds        = "seconds"
+	Count          = "count"
+	Flag           = "flag"
+	ErrorReporting = "error_reporting"
+	Timezone       = "timezone"
+)
+
+var (
+	// ErrNotConfigured is returned when changing settings before Configure is called
+	ErrNotConfigured = errors.New("php: not configured")
+
+	// ErrNotFound is returned for a domain without settings
+	ErrNotFound = errors.New("php: the domain has no PHP settings")
+
+	// ErrNoPool is returned when the directory the pool of a domain is extended in does
+	// not exist, as PHP-FPM is not installed or the account has no pools
+	ErrNoPool = errors.New("php: the directory the PHP-FPM pool of the domain is extended in does not exist")
+
+	// ErrRejected is returned when PHP-FPM rejected the settings or failed to reload with
+	// them, which are then rolled back
+	ErrRejected = errors.New("php: PHP-FPM rejected the settings")
+)
+
+// Settings are the php.ini overrides and environment variables of a domain
+type Settings struct {
+	Domain string `json:"domain"`
+
+	// The username of the account the domain belongs to
+	Account string `json:"account,omitempty"`
+
+	INI map[string]string `json:"ini"`
+	Env map[string]string `json:"env"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// Redacted returns the settings without the values of the environment variables, which
+// often hold credentials, for the activity log
+func (s Settings) Redacted() Settings {
+	env := make(map[string]string, len(s.Env))
+	for name := range s.Env {
+		env[name] = "..."
+	}
+	s.Env = env
+
+	return s
+}
+
+// Limit is a php.ini setting accounts can override and the highest value they can set
+type Limit struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Max  string `json:"max,omitempty"`
+}
+
+// setting is how a php.ini setting is validated and rendered
+type setting struct {
+	typ string
+
+	// Rendered with php_admin_value so that scripts cannot raise the limit past the
+	// ceiling with ini_set, while the rest can still be changed by the site
+	admin bool
+
+	// The ceiling in the configuration
+	max func(c *config.PHPConfiguration) int
+}
+
+// settings are the php.ini settings accounts can override
+var settings = map[string]setting{
+	"memory_limit":           {typ: Size, admin: true, max: func(c *config.PHPConfiguration) int { return c.MemoryLimit }},
+	"upload_max_filesize":    {typ: Size, admin: true, max: func(c *config.PHPConfiguration) int { return c.UploadSize }},
+	"post_max_size":          {typ: Size, admin: true, max: func(c *config.PHPConfiguration) int { return c.UploadSize }},
+	"max_execution_time":     {typ: Seconds, admin: true, max: func(c *config.PHPConfiguration) int { return c.ExecutionTime }},
+	"max_input_time":         {typ: Seconds, admin: true, max: func(c *config.PHPConfiguration) int { return c.ExecutionTime }},
+	"max_input_vars":         {typ: Count, admin: true, max: func(c *config.PHPConfiguration) int { return c.InputVars }},
+	"display_errors":         {typ: Flag},
+	"display_startup_errors": {typ: Flag},
+	"log_errors":             {typ: Flag},
+	"short_open_tag":         {typ: Flag},
+	"error_reporting":        {typ: ErrorReporting},
+	"date.timezone":          {typ: Timezone},
+}
+
+// maxEnv is the most environment variables a domain can set
+const maxEnv = 64
+
+// maxValue is the longest value of an environment variable
+const maxValue = 4096
+
+// settingsKind is what the settings of domains are kept under in the state store
+const settingsKind = "php.settings"
+
+type manager struct {
+	// Serializes changes, which each render the pool of the domain before they are kept
+	mu     sync.Mutex
+	config *config.PHPConfiguration
+}
+
+var std *manager
+
+// Configure registers the pools and environment files of domains with the reconciler,
+// and the mass operation changing the settings of many domains
+func Configure(c *config.PHPConfiguration) error {
+	if c.File != "" && !strings.Contains(c.File, domainPlaceholder) {
+		return fmt.Errorf("php: the file %q does not contain %s", c.File, domainPlaceholder)
+	}
+
+	if c.EnvFile != "" && !strings.Contains(c.EnvFile, domainPlaceholder) {
+		return fmt.Errorf("php: the environment file %q does not contain %s", c.EnvFile, domainPlaceholder)
+	}
+
+	if c.File != "" && c.Pool == "" {
+		return errors.New("php: the name of the pool of domains is required")
+	}
+
+	std = &manager{config: c}
+
+	registerSources()
+	registerBulk()
+
+	return nil
+}
+
+// Limits returns the php.ini settings accounts can override with the ceilings of those
+// that have one, sorted by name
+func Limits() []Limit {
+	list := make([]Limit, 0, len(settings))
+	for name, s := range settings {
+		l := Limit{Name: name, Type: s.typ}
+
+		if std != nil && s.max != nil {
+			switch s.typ {
+			case Size:
+				l.Max = strconv.Itoa(s.max(std.config)) + "M"
+			default:
+				l.Max = strconv.Itoa(s.max(std.config))
+			}
+		}
+
+		list = append(list, l)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// List returns the settings of the domains, or of every domain when none are given,
+// sorted by domain
+func List(domains ...string) ([]Settings, error) {
+	wanted := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		wanted[normalize(d)] = true
+	}
+
+	list := []Settings{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(settingsKind, func(id string, data []byte) error {
+			var s Settings
+			if err := json.Unmarshal(data, &s); err != nil {
+				return fmt.Errorf("php: malformed settings of %s: %w", id, err)
+			}
+
+			if len(domains) == 0 || wanted[s.Domain] {
+				list = append(list, s)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+
+	return list, nil
+}
+
+// Get returns the settings of the domain
+func Get(domain string) (Settings, error) {
+	var s Settings
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(settingsKind, normalize(domain), &s)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Settings{}, ErrNotFound
+	}
+
+	return s, err
+}
+
+// Set replaces the settings of the domain once they are validated against the ceilings,
+// rendering them into its pool. Settings PHP-FPM rejects are rolled back and not kept
+func Set(s Settings) (Settings, error) {
+	if std == nil {
+		return Settings{}, ErrNotConfigured
+	}
+
+	if err := std.validate(&s); err != nil {
+		return Settings{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	before, err := Get(s.Domain)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Settings{}, err
+	}
+
+	s.Updated = time.Now().UTC()
+
+	if err := std.render(s); err != nil {
+		return Settings{}, err
+	}
+
+	if before.Domain != "" && before.Account != s.Account {
+		// The files of the account the domain belonged to are in other places
+		if err := std.remove(before, std.paths(s)...); err != nil {
+			return Settings{}, err
+		}
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(settingsKind, s.Domain, s)
+	})
+
+	return s, err
+}
+
+// Reset removes the settings of the domain, leaving its pool as the server defines it
+func Reset(domain string) (Settings, error) {
+	if std == nil {
+		return Settings{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	s, err := Get(domain)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	if err := std.remove(s); err != nil {
+		return Settings{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(settingsKind, s.Domain)
+	})
+
+	return s, err
+}
+
+// accountPattern matches the username of an account
+var accountPattern = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// envPattern matches the name of an environment variable
+var envPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+
+// reservedEnv are the environment variables that change how PHP or the dynamic linker
+// run, which accounts cannot set
+var reservedEnv = []string{"PATH", "HOME", "USER", "SHELL", "TMPDIR", "PHPRC", "PHP_INI_SCAN_DIR"}
+
+// validate checks the settings against the ceilings and normalizes them
+func (m *manager) validate(s *Settings) error {
+	s.Domain = normalize(s.Domain)
+	if !hostname.Valid(s.Domain) {
+		return fmt.Errorf("php: invalid domain %q", s.Domain)
+	}
+
+	if s.Account != "" && !accountPattern.MatchString(s.Account) {
+		return fmt.Errorf("php: invalid account %q", s.Account)
+	}
+
+	if s.Account == "" && strings.Contains(m.config.File+m.config.Pool+m.config.EnvFile, accountPlaceholder) {
+		return fmt.Errorf("php: the account %s belongs to is needed to find its pool", s.Domain)
+	}
+
+	ini := make(map[string]string, len(s.INI))
+	for name, value := range s.INI {
+		v, err := m.check(name, strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		ini[name] = v
+	}
+	s.INI = ini
+
+	if len(s.Env) > maxEnv {
+		return fmt.Errorf("php: a domain can set at most %d environment variables", maxEnv)
+	}
+
+	if s.Env == nil {
+		s.Env = map[string]string{}
+	}
+	for name, value := range s.Env {
+		if !envPattern.MatchString(name) {
+			return fmt.Errorf("php: invalid environment variable name %q", name)
+		}
+
+		if strings.HasPrefix(name, "LD_") || slices.Contains(reservedEnv, name) {
+			return fmt.Errorf("php: the environment variable %s cannot be set", name)
+		}
+
+		// The pool is parsed like php.ini, where double quotes end the value,
+		// backslashes escape and ${...} is expanded
+		if len(value) > maxValue || strings.ContainsAny(value, "\"\\") || strings.Contains(value, "${") || strings.ContainsFunc(value, unicode.IsControl) {
+			return fmt.Errorf("php: the value of %s must be at most %d characters without quotes, backslashes, ${ or control characters", name, maxValue)
+		}
+	}
+
+	return nil
+}
+
+// check validates the value of the php.ini setting, returning it as it is rendered
+func (m *manager) check(name string, value string) (string, error) {
+	s, ok := settings[name]
+	if !ok {
+		return "", fmt.Errorf("php: %s cannot be overridden", name)
+	}
+
+	switch s.typ {
+	case Size:
+		n, err := size(value)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("php: %s must be a size such as 128M", name)
+		}
+
+		if max := s.max(m.config); n > int64(max)<<20 {
+			return "", fmt.Errorf("php: %s can be at most %dM", name, max)
+		}
+
+		return strings.ToUpper(value), nil
+	case Seconds, Count:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("php: %s must be a positive number", name)
+		}
+
+		if max := s.max(m.config); n > max {
+			return "", fmt.Errorf("php: %s can be at most %d", name, max)
+		}
+
+		return strconv.Itoa(n), nil
+	case Flag:
+		switch strings.ToLower(value) {
+		case "on", "true", "yes", "1":
+			return "on", nil
+		case "off", "false", "no", "0":
+			return "off", nil
+		}
+
+		return "", fmt.Errorf("php: %s must be on or off", name)
+	case ErrorReporting:
+		if !reportingPattern.MatchString(value) {
+			return "", fmt.Errorf("php: %s must be a number or an expression of E_ constants", name)
+		}
+
+		for _, c := range constantPattern.FindAllString(value, -1) {
+			if !slices.Contains(errorConstants, c) {
+				return "", fmt.Errorf("php: unknown constant %s in %s", c, name)
+			}
+		}
+
+		return value, nil
+	case Timezone:
+		if value == "" || value == "Local" {
+			return "", fmt.Errorf("php: %s must be a time zone such as Europe/Berlin", name)
+		}
+
+		if _, err := time.LoadLocation(value); err != nil {
+			return "", fmt.Errorf("php: unknown time zone %q", value)
+		}
+
+		return value, nil
+	}
+
+	return "", fmt.Errorf("php: %s cannot be overridden", name)
+}
+
+// sizePattern matches a php.ini size, in bytes or with a K, M or G suffix
+var sizePattern = regexp.MustCompile(`^(\d{1,12})([KkMmGg]?)$`)
+
+// size returns the bytes of a php.ini size
+func size(value string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	shift := map[string]int{"": 0, "K": 10, "M": 20, "G": 30}[strings.ToUpper(m[2])]
+
+	// Wrapping around would let a huge size pass as a small one
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+
+	return n << shift, nil
+}
+
+// reportingPattern matches an error_reporting expression, which PHP-FPM evaluates
+var reportingPattern = regexp.MustCompile(`^[A-Z0-9_&|~^() ]+$`)
+
+// constantPattern matches the constants in an error_reporting expression
+var constantPattern = regexp.MustCompile(`[A-Z_][A-Z0-9_]*`)
+
+// errorConstants are the constants error_reporting can be set with
+var errorConstants = []string{
+	"E_ALL", "E_ERROR", "E_WARNING", "E_PARSE", "E_NOTICE", "E_STRICT", "E_DEPRECATED",
+	"E_CORE_ERROR", "E_CORE_WARNING", "E_COMPILE_ERROR", "E_COMPILE_WARNING",
+	"E_USER_ERROR", "E_USER_WARNING", "E_USER_NOTICE", "E_USER_DEPRECATED", "E_RECOVERABLE_ERROR",
+}
+
+// normalize returns the domain lower case without a trailing dot
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
@@ -0,0 +1,272 @@
+package php
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the settings with a state store of their own and the pools and
+// environment files in a temporary directory, tested with the command given
+func configure(t *testing.T, fpm string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcile.Configure(&config.ReconcileConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{"pool.d", "env"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &config.PHPConfiguration{
+		File:          filepath.Join(dir, "pool.d", "zz-{account}-{domain}.conf"),
+		Pool:          "{account}",
+		FPM:           fpm,
+		EnvFile:       filepath.Join(dir, "env", "{domain}.env"),
+		MemoryLimit:   512,
+		UploadSize:    64,
+		ExecutionTime: 120,
+		InputVars:     5000,
+	}
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { std = nil })
+
+	return dir
+}
+
+func TestSize(t *testing.T) {
+	tests := []struct {
+		value string
+		bytes int64
+		ok    bool
+	}{
+		{"1024", 1024, true},
+		{"128k", 128 << 10, true},
+		{"128M", 128 << 20, true},
+		{"2G", 2 << 30, true},
+		{"999999999999K", 999999999999 << 10, true},
+
+		{"", 0, false},
+		{"-1", 0, false},
+		{"128MB", 0, false},
+		{"1.5G", 0, false},
+		{"1T", 0, false},
+		{"1234567890123", 0, false},
+
+		// Shifted, these wrap around to 1G and to nothing
+		{"17179869185G", 0, false},
+		{"17179869184G", 0, false},
+	}
+
+	for _, tt := range tests {
+		n, err := size(tt.value)
+		if (err == nil) != tt.ok || n != tt.bytes {
+			t.Errorf("size(%q) = %d, %v", tt.value, n, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	configure(t, "true")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"memory_limit", "256m", "256M"},
+		{"memory_limit", "512M", "512M"},
+		{"memory_limit", "536870912", "536870912"},
+		{"upload_max_filesize", "64M", "64M"},
+		{"post_max_size", "65536K", "65536K"},
+		{"max_execution_time", "120", "120"},
+		{"max_input_time", "+30", "30"},
+		{"max_input_vars", "5000", "5000"},
+		{"display_errors", "Yes", "on"},
+		{"log_errors", "0", "off"},
+		{"error_reporting", "E_ALL & ~E_DEPRECATED & ~E_STRICT", "E_ALL & ~E_DEPRECATED & ~E_STRICT"},
+		{"error_reporting", "32767", "32767"},
+		{"date.timezone", "Europe/Berlin", "Europe/Berlin"},
+		{"date.timezone", "UTC", "UTC"},
+
+		{"open_basedir", "/", ""},
+		{"disable_functions", "", ""},
+		{"memory_limit", "513M", ""},
+		{"memory_limit", "1G", ""},
+		{"memory_limit", "17179869185G", ""},
+		{"memory_limit", "0", ""},
+		{"memory_limit", "-1", ""},
+		{"upload_max_filesize", "65M", ""},
+		{"max_execution_time", "0", ""},
+		{"max_execution_time", "121", ""},
+		{"max_input_vars", "5k", ""},
+		{"display_errors", "stderr", ""},
+		{"error_reporting", "E_ALL & ~E_NOTICE; auto_prepend_file", ""},
+		{"error_reporting", "E_ALL | PHP_INT_MAX", ""},
+		{"error_reporting", "e_all", ""},
+		{"date.timezone", "Local", ""},
+		{"date.timezone", "Mars/Olympus", ""},
+		{"date.timezone", "../../../etc/passwd", ""},
+		{"date.timezone", `Europe/Berlin"`, ""},
+	}
+
+	for _, tt := range tests {
+		v, err := std.check(tt.name, tt.value)
+		if (err == nil) != (tt.want != "") || v != tt.want {
+			t.Errorf("%s = %q checked as %q, %v, want %q", tt.name, tt.value, v, err, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	configure(t, "true")
+
+	tests := []struct {
+		name     string
+		settings Settings
+		ok       bool
+	}{
+		{"settings", Settings{Domain: "Example.com.", Account: "alice", INI: map[string]string{"memory_limit": " 256M "}, Env: map[string]string{"APP_ENV": "production", "DB_PASSWORD": "s3cret!$ ok"}}, true},
+		{"nothing", Settings{Domain: "example.com", Account: "alice"}, true},
+
+		{"invalid domain", Settings{Domain: "../example.com", Account: "alice"}, false},
+		{"invalid account", Settings{Domain: "example.com", Account: "../root"}, false},
+		{"no account", Settings{Domain: "example.com"}, false},
+		{"setting not allowed", Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"open_basedir": "/"}}, false},
+		{"over the ceiling", Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "2G"}}, false},
+		{"invalid name", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"APP ENV": "x"}}, false},
+		{"name with a bracket", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A]": "x"}}, false},
+		{"dynamic linker", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"LD_PRELOAD": "/tmp/x.so"}}, false},
+		{"reserved", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"PHPRC": "/tmp"}}, false},
+		{"quote", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A": `x"` + "\nphp_admin_value[open_basedir] = /"}}, false},
+		{"backslash", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A": `x\`}}, false},
+		{"expansion", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A": "${HOME}"}}, false},
+		{"newline", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A": "x\nLD_PRELOAD=/tmp/x.so"}}, false},
+		{"too long", Settings{Domain: "example.com", Account: "alice", Env: map[string]string{"A": strings.Repeat("x", maxValue+1)}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.settings
+			if err := std.validate(&s); (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	many := Settings{Domain: "example.com", Account: "alice", Env: map[string]string{}}
+	for i := range maxEnv + 1 {
+		many.Env["VAR_"+strings.Repeat("X", i)] = "x"
+	}
+	if err := std.validate(&many); err == nil {
+		t.Errorf("%d environment variables were accepted", len(many.Env))
+	}
+
+	s := Settings{Domain: "Example.com.", Account: "alice", INI: map[string]string{"memory_limit": " 256m "}}
+	if err := std.validate(&s); err != nil || s.Domain != "example.com" || s.INI["memory_limit"] != "256M" || s.Env == nil {
+		t.Errorf("normalized %+v, %v", s, err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	dir := configure(t, "true")
+	pool := filepath.Join(dir, "pool.d", "zz-alice-example.com.conf")
+	env := filepath.Join(dir, "env", "example.com.env")
+
+	s, err := Set(Settings{Domain: "example.com", Account: "alice", INI: map[string]string{"memory_limit": "256M"}, Env: map[string]string{"APP_ENV": "production"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := Get("EXAMPLE.com"); err != nil || stored.INI["memory_limit"] != "256M" || !stored.Updated.Equal(s.Updated) {
+		t.Errorf("stored %+v, %v", stored, err)
+	}
+	if b, err := os.ReadFile(pool); err != nil || !strings.Contains(string(b), "php_admin_value[memory_limit] = 256M\n") {
+		t.Errorf("pool %s, %v", b, err)
+	}
+	if info, err := os.Stat(env); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("environment file %v, %v", info, err)
+	}
+
+	// Moved to another account, the files of the previous one are removed
+	if _, err := Set(Settings{Domain: "example.com", Account: "bob", INI: map[string]string{"memory_limit": "128M"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pool); !os.IsNotExist(err) {
+		t.Errorf("the pool of the previous account was kept: %v", err)
+	}
+	if _, err := os.Stat(env); !os.IsNotExist(err) {
+		t.Errorf("the environment file without variables was kept: %v", err)
+	}
+	pool = filepath.Join(dir, "pool.d", "zz-bob-example.com.conf")
+
+	// Settings PHP-FPM rejects are put back and not kept
+	std.config.FPM = "false"
+	if _, err := Set(Settings{Domain: "example.com", Account: "bob", INI: map[string]string{"memory_limit": "64M"}}); !errors.Is(err, ErrRejected) {
+		t.Errorf("rejected settings: %v", err)
+	}
+	if b, _ := os.ReadFile(pool); !strings.Contains(string(b), "= 128M\n") {
+		t.Errorf("the rejected pool was kept:\n%s", b)
+	}
+	if stored, _ := Get("example.com"); stored.INI["memory_limit"] != "128M" {
+		t.Errorf("the rejected settings were kept: %+v", stored)
+	}
+	std.config.FPM = "true"
+
+	if _, err := Set(Settings{Domain: "example.com", Account: "bob", INI: map[string]string{"memory_limit": "1G"}}); err == nil {
+		t.Error("settings over the ceiling were set")
+	}
+
+	// A domain whose pool is extended in a directory that does not exist is refused
+	std.config.File = filepath.Join(dir, "missing", "{domain}.conf")
+	if _, err := Set(Settings{Domain: "other.example.com", Account: "bob", INI: map[string]string{"memory_limit": "64M"}}); !errors.Is(err, ErrNoPool) {
+		t.Errorf("setting without a pool: %v", err)
+	}
+	std.config.File = filepath.Join(dir, "pool.d", "zz-{account}-{domain}.conf")
+
+	if _, err := Reset("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pool); !os.IsNotExist(err) {
+		t.Errorf("the pool was kept: %v", err)
+	}
+	if _, err := Get("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reset settings: %v", err)
+	}
+	if _, err := Reset("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resetting again: %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	s := Settings{Domain: "example.com", Env: map[string]string{"DB_PASSWORD": "secret"}}
+	if r := s.Redacted(); r.Env["DB_PASSWORD"] != "..." || s.Env["DB_PASSWORD"] != "secret" {
+		t.Errorf("redacted %+v from %+v", r, s)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	configure(t, "true")
+
+	want := map[string]string{"memory_limit": "512M", "post_max_size": "64M", "max_input_time": "120", "max_input_vars": "5000", "display_errors": ""}
+	for _, l := range Limits() {
+		if max, ok := want[l.Name]; ok && l.Max != max {
+			t.Errorf("%s can be at most %q, want %q", l.Name, l.Max, max)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+//go:build !freebsd
+
+package platform
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Load returns the load averages over the last 1, 5 and 15 minutes
+func Load() ([3]float64, error) {
+	var load [3]float64
+
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return load, err
+	}
+
+	for i, f := range strings.Fields(string(b)) {
+		if i == len(load) {
+			break
+		}
+		load[i], _ = strconv.ParseFloat(f, 64)
+	}
+
+	return load, nil
+}
+
+// Memory returns the total and available bytes of memory from /proc/meminfo
+func Memory() (uint64, uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var total, available uint64
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+
+	return total, available, scanner.Err()
+}
+
+// Disk returns the total and free bytes of the filesystem holding the path
+func Disk(path string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+
+	return fs.Blocks * uint64(fs.Bsize), fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// mounts returns the mounted filesystems in the fstab format
+func mounts() ([]byte, error) {
+	return os.ReadFile("/proc/mounts")
+}
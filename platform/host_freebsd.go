@@ -0,0 +1,82 @@
+package platform
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Load returns the load averages over the last 1, 5 and 15 minutes
+func Load() ([3]float64, error) {
+	var load [3]float64
+
+	out, err := sysctl("vm.loadavg")
+	if err != nil {
+		return load, err
+	}
+
+	// The averages are printed in braces, such as { 0.10 0.20 0.15 }
+	for i, f := range strings.Fields(strings.Trim(out[0], "{} ")) {
+		if i == len(load) {
+			break
+		}
+		load[i], _ = strconv.ParseFloat(f, 64)
+	}
+
+	return load, nil
+}
+
+// Memory returns the total bytes of memory and the bytes in free and inactive pages,
+// which the kernel hands out before swapping
+func Memory() (uint64, uint64, error) {
+	out, err := sysctl("hw.physmem", "hw.pagesize", "vm.stats.vm.v_free_count", "vm.stats.vm.v_inactive_count")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var v [4]uint64
+	for i := range v {
+		if v[i], err = strconv.ParseUint(out[i], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return v[0], (v[2] + v[3]) * v[1], nil
+}
+
+// Disk returns the total and free bytes of the filesystem holding the path
+func Disk(path string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+
+	free := uint64(0)
+	if fs.Bavail > 0 {
+		free = uint64(fs.Bavail) * fs.Bsize
+	}
+
+	return fs.Blocks * fs.Bsize, free, nil
+}
+
+// mounts returns the mounted filesystems in the fstab format
+func mounts() ([]byte, error) {
+	return exec.Command("mount", "-p").Output()
+}
+
+// sysctl returns the values of the kernel variables, one per name
+func sysctl(names ...string) ([]string, error) {
+	out, err := exec.Command("sysctl", append([]string{"-n"}, names...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("platform: sysctl %s failed: %w", strings.Join(names, " "), err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != len(names) {
+		return nil, fmt.Errorf("platform: sysctl returned %d values for %d names", len(lines), len(names))
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,62 @@
+package platform
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Release reads the fields of /etc/os-release
+func Release() (map[string]string, error) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok {
+			fields[k] = strings.Trim(v, `"'`)
+		}
+	}
+
+	return fields, scanner.Err()
+}
+
+// Mount is a mounted filesystem
+type Mount struct {
+	Point   string
+	Type    string
+	Options string
+}
+
+// MountOf returns the filesystem holding the path
+func MountOf(path string) (Mount, error) {
+	b, err := mounts()
+	if err != nil {
+		return Mount{}, err
+	}
+
+	var m Mount
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		point := fields[1]
+		if (path == point || strings.HasPrefix(path, strings.TrimSuffix(point, "/")+"/")) && len(point) > len(m.Point) {
+			m = Mount{Point: point, Type: fields[2], Options: fields[3]}
+		}
+	}
+
+	if m.Point == "" {
+		return Mount{}, fmt.Errorf("platform: no filesystem is mounted at %s", path)
+	}
+
+	return m, nil
+}
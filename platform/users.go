@@ -0,0 +1,106 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// ErrNoUserTool is returned when none of the tools system users are created with is
+// installed
+var ErrNoUserTool = errors.New("platform: found none of useradd, adduser or pw to create users with")
+
+// SystemUser is a user without a password that services run as
+type SystemUser struct {
+	Name string
+
+	// The home directory, which is not created, and the login shell. They default to no
+	// home directory and a shell that refuses logins
+	Home  string
+	Shell string
+
+	// Supplementary groups the user is a member of, such as docker
+	Groups []string
+}
+
+// userTool is the command line tool a platform manages users with
+type userTool struct {
+	binary string
+
+	// create returns the commands that create the user, run in order
+	create func(u SystemUser) [][]string
+
+	// join returns the command that adds the user to a supplementary group
+	join func(name string, group string) []string
+}
+
+// CreateUser creates the system user with the tool of this platform
+func CreateUser(u SystemUser) error {
+	t, err := tool()
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range t.create(u) {
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// JoinGroups adds the user to the supplementary groups it is not a member of yet
+func JoinGroups(u *user.User, groups []string) error {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+
+	var t userTool
+	for _, name := range groups {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return err
+		}
+
+		if slices.Contains(ids, g.Gid) {
+			continue
+		}
+
+		if t.binary == "" {
+			if t, err = tool(); err != nil {
+				return err
+			}
+		}
+
+		if err := run(t.join(u.Username, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run runs the command, returning its output in the error if it fails
+func run(cmd []string) error {
+	out, err := privsep.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("platform: %s failed: %w: %s", strings.Join(cmd, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// or returns the value, or the fallback if the value is empty
+func or(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
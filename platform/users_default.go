@@ -0,0 +1,61 @@
+//go:build !freebsd
+
+package platform
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// shadow is useradd from shadow-utils, found on Debian, RHEL and their derivatives
+var shadow = userTool{
+	binary: "useradd",
+	create: func(u SystemUser) [][]string {
+		cmd := []string{"useradd", "--system", "--no-create-home", "--shell", or(u.Shell, "/bin/false")}
+		if u.Home != "" {
+			cmd = append(cmd, "--home-dir", u.Home)
+		}
+		if len(u.Groups) > 0 {
+			cmd = append(cmd, "--groups", strings.Join(u.Groups, ","))
+		}
+
+		return [][]string{append(cmd, u.Name)}
+	},
+	join: func(name string, group string) []string {
+		return []string{"usermod", "--append", "--groups", group, name}
+	},
+}
+
+// busybox is the adduser applet of BusyBox, found on Alpine. It only takes a primary
+// group, so supplementary groups are joined one by one
+var busybox = userTool{
+	binary: "adduser",
+	create: func(u SystemUser) [][]string {
+		cmd := []string{"adduser", "-S", "-D", "-H", "-s", or(u.Shell, "/sbin/nologin")}
+		if u.Home != "" {
+			cmd = append(cmd, "-h", u.Home)
+		}
+
+		cmds := [][]string{append(cmd, u.Name)}
+		for _, g := range u.Groups {
+			cmds = append(cmds, []string{"addgroup", u.Name, g})
+		}
+
+		return cmds
+	},
+	join: func(name string, group string) []string {
+		return []string{"addgroup", name, group}
+	},
+}
+
+// tool returns the user tool of this platform. useradd is preferred since Debian also
+// ships an adduser, which takes different arguments than BusyBox's
+func tool() (userTool, error) {
+	for _, t := range []userTool{shadow, busybox} {
+		if _, err := exec.LookPath(t.binary); err == nil {
+			return t, nil
+		}
+	}
+
+	return userTool{}, ErrNoUserTool
+}
@@ -0,0 +1,24 @@
+package platform
+
+import "strings"
+
+// pw is the user tool of FreeBSD
+var pw = userTool{
+	binary: "pw",
+	create: func(u SystemUser) [][]string {
+		cmd := []string{"pw", "useradd", "-n", u.Name, "-d", or(u.Home, "/nonexistent"), "-s", or(u.Shell, "/usr/sbin/nologin")}
+		if len(u.Groups) > 0 {
+			cmd = append(cmd, "-G", strings.Join(u.Groups, ","))
+		}
+
+		return [][]string{cmd}
+	},
+	join: func(name string, group string) []string {
+		return []string{"pw", "groupmod", group, "-m", name}
+	},
+}
+
+// tool returns the user tool of this platform
+func tool() (userTool, error) {
+	return pw, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/plugins"
+)
+
+// plugin creates signing keys, signs plugins and checks their signatures. The private
+// key stays with whoever publishes plugins, and its public key is added to plugins.keys
+// on the servers that trust them
+func plugin(args []string) error {
+	var o options
+	fs := o.flags("plugin", "keygen|sign|verify [directory]")
+	keyFile := fs.String("key", "plugin.key", "The file holding the private key to create or sign with")
+	args = parse(fs, args)
+
+	action, dir := arg(args, 0), arg(args, 1)
+	switch {
+	case action == "keygen":
+	case (action == "sign" || action == "verify") && dir != "":
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch action {
+	case "keygen":
+		if _, err := os.Stat(*keyFile); err == nil {
+			return fmt.Errorf("%s already exists, remove it first to replace the key", *keyFile)
+		}
+
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(*keyFile, []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"), 0600); err != nil {
+			return err
+		}
+
+		key := base64.StdEncoding.EncodeToString(public)
+		return o.print(map[string]string{"key": key, "fingerprint": plugins.Fingerprint(public)}, func() error {
+			fmt.Printf("Wrote the private key to %s\nPublic key, to add to plugins.keys: %s\n", *keyFile, key)
+			return nil
+		})
+	case "sign":
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("%s is not a key created by cosmicpanel plugin keygen", *keyFile)
+		}
+
+		private := ed25519.NewKeyFromSeed(seed)
+		if err := plugins.Sign(dir, private); err != nil {
+			return err
+		}
+
+		fingerprint := plugins.Fingerprint(private.Public().(ed25519.PublicKey))
+		return o.print(map[string]string{"plugin": dir, "signer": fingerprint}, func() error {
+			fmt.Printf("Signed %s with key %s\n", dir, fingerprint)
+			return nil
+		})
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	m, signer, err := plugins.Verify(dir, c.Plugins.Keys)
+	if errors.Is(err, plugins.ErrUnsigned) && c.Plugins.AllowUnsigned {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return o.print(map[string]string{"plugin": m.Name, "version": m.Version, "signer": signer}, func() error {
+		if signer == "" {
+			fmt.Printf("%s %s is unsigned, which plugins.allowunsigned permits\n", m.Name, m.Version)
+		} else {
+			fmt.Printf("%s %s is signed by trusted key %s\n", m.Name, m.Version, signer)
+		}
+		return nil
+	})
+}
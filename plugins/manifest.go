@@ -0,0 +1,260 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The files of a plugin's directory the panel reads
+const (
+	manifestFile  = "plugin.yml"
+	signatureFile = "plugin.sig"
+)
+
+// Manifest describes a plugin. It is read from plugin.yml in the plugin's directory,
+// which is named after the plugin
+type Manifest struct {
+	Name        string `yaml:"name" json:"name"`
+	Version     string `yaml:"version" json:"version"`
+	Description string `yaml:"description" json:"description,omitempty"`
+
+	// The executable serving the plugin over HTTP, relative to the plugin's directory.
+	// Plugins that only have hooks do not need one
+	Command string `yaml:"command" json:"command,omitempty"`
+
+	// Event patterns, such as user.*, whose events are sent to the plugin
+	Events []string `yaml:"events" json:"events,omitempty"`
+
+	// Job types the plugin runs, queued as plugin.<name>.<type>
+	Jobs []string `yaml:"jobs" json:"jobs,omitempty"`
+
+	// Panels the plugin contributes to the UI
+	Panels []Panel `yaml:"panels" json:"panels,omitempty"`
+
+	// Executables relative to the plugin's directory keyed by the event pattern they run
+	// on, for plugins too simple to serve HTTP
+	Hooks map[string]string `yaml:"hooks" json:"hooks,omitempty"`
+}
+
+// Panel is a page a plugin adds to the UI. Its content is served by the plugin at the
+// path, through the plugin's API route
+type Panel struct {
+	ID    string `yaml:"id" json:"id"`
+	Title string `yaml:"title" json:"title"`
+	Path  string `yaml:"path" json:"path"`
+
+	// The roles the panel is shown to, every role when empty
+	Roles []string `yaml:"roles" json:"roles,omitempty"`
+}
+
+// validName matches the names plugins can have, which are used in paths and job types
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// readManifest reads and checks the manifest of the plugin in the directory
+func readManifest(dir string) (Manifest, error) {
+	var m Manifest
+
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return m, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return m, fmt.Errorf("plugins: malformed %s: %w", manifestFile, err)
+	}
+
+	if m.Name != filepath.Base(dir) || !validName.MatchString(m.Name) {
+		return m, fmt.Errorf("plugins: the plugin in %s must be named after its directory with lowercase letters, digits and dashes", dir)
+	}
+
+	if m.Command == "" && len(m.Events)+len(m.Jobs)+len(m.Panels) > 0 {
+		return m, fmt.Errorf("plugins: %s needs a command to receive events, run jobs or serve panels", m.Name)
+	}
+
+	for _, typ := range m.Jobs {
+		if !validName.MatchString(typ) {
+			return m, fmt.Errorf("plugins: job type %q of %s must be lowercase letters, digits and dashes", typ, m.Name)
+		}
+	}
+
+	// Panels are fetched with the session of whoever views them, so they must not reach
+	// past the plugin's own API
+	for _, p := range m.Panels {
+		if !validName.MatchString(p.ID) {
+			return m, fmt.Errorf("plugins: panel %q of %s must be named with lowercase letters, digits and dashes", p.ID, m.Name)
+		}
+
+		if rel := strings.TrimPrefix(p.Path, "/"); (rel != "" && !filepath.IsLocal(rel)) || strings.ContainsAny(rel, `?#\`) {
+			return m, fmt.Errorf("plugins: panel %s of %s is outside the plugin's API", p.ID, m.Name)
+		}
+	}
+
+	for _, path := range m.Hooks {
+		if !filepath.IsLocal(path) {
+			return m, fmt.Errorf("plugins: hook %s of %s is outside the plugin's directory", path, m.Name)
+		}
+	}
+
+	if m.Command != "" && !filepath.IsLocal(m.Command) {
+		return m, fmt.Errorf("plugins: command %s of %s is outside the plugin's directory", m.Command, m.Name)
+	}
+
+	return m, nil
+}
+
+// message returns what the signature of the plugin in the directory covers, which is
+// its name and version followed by the checksum of every file in it. Any change to the
+// plugin's files, including adding one, invalidates the signature
+func message(dir string, m Manifest) ([]byte, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case d.IsDir() || rel == signatureFile:
+			return nil
+		case !d.Type().IsRegular():
+			return fmt.Errorf("plugins: %s in %s is not a regular file", rel, m.Name)
+		}
+
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "cosmicpanel-plugin\n%s\n%s\n", m.Name, m.Version)
+
+	for _, rel := range files {
+		sum, err := checksum(filepath.Join(dir, rel))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, filepath.ToSlash(rel))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// checksum returns the hex encoded SHA-256 of the file
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify checks the signature of the plugin in the directory against the keys, returning
+// the fingerprint of the key that signed it. An unsigned plugin returns ErrUnsigned
+func verify(dir string, m Manifest, keys []ed25519.PublicKey) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, signatureFile))
+	if os.IsNotExist(err) {
+		return "", ErrUnsigned
+	} else if err != nil {
+		return "", err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return "", ErrBadSignature
+	}
+
+	msg, err := message(dir, m)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return Fingerprint(key), nil
+		}
+	}
+
+	return "", ErrBadSignature
+}
+
+// Sign signs the plugin in the directory with the key, writing the signature to
+// plugin.sig. Sign a plugin again after changing any of its files
+func Sign(dir string, key ed25519.PrivateKey) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	msg, err := message(dir, m)
+	if err != nil {
+		return err
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+
+	return os.WriteFile(filepath.Join(dir, signatureFile), []byte(sig+"\n"), 0644)
+}
+
+// Verify checks the plugin in the directory is signed by one of the base64 encoded keys,
+// returning its manifest and the fingerprint of the key that signed it
+func Verify(dir string, keys []string) (Manifest, string, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return m, "", err
+	}
+
+	parsed, err := parseKeys(keys)
+	if err != nil {
+		return m, "", err
+	}
+
+	signer, err := verify(dir, m, parsed)
+
+	return m, signer, err
+}
+
+// Fingerprint returns a short identifier of a public key, which plugins list as their
+// signer
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseKeys decodes base64 encoded Ed25519 public keys
+func parseKeys(keys []string) ([]ed25519.PublicKey, error) {
+	parsed := make([]ed25519.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("plugins: keys must be base64 encoded Ed25519 public keys")
+		}
+		parsed = append(parsed, key)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,200 @@
+package plugins
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePlugin writes the files of a plugin named hello into a new directory and returns
+// the directory
+func writePlugin(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "hello")
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return public, private
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		ok       bool
+	}{
+		{"hooks alone", "name: hello\nversion: 1.0.0\nhooks:\n  user.create: hooks/on-user.sh\n", true},
+		{"everything", "name: hello\nversion: 1.0.0\ncommand: bin/server\nevents: [user.*]\njobs: [greet, send-mail]\npanels:\n  - id: main\n    title: Hello\n    path: /panel/index.html\n    roles: [admin]\n", true},
+		{"panel path without a slash", "name: hello\ncommand: server\npanels:\n  - id: main\n    path: panel\n", true},
+		{"panel at the root of the API", "name: hello\ncommand: server\npanels:\n  - id: main\n    path: /\n", true},
+
+		{"named after another directory", "name: other\nversion: 1.0.0\n", false},
+		{"uppercase name", "name: Hello\n", false},
+		{"unknown field", "name: hello\nexec: server\n", false},
+		{"malformed", "name: [hello\n", false},
+		{"events without a command", "name: hello\nevents: [user.*]\n", false},
+		{"jobs without a command", "name: hello\njobs: [greet]\n", false},
+		{"panels without a command", "name: hello\npanels:\n  - id: main\n    path: /panel\n", false},
+		{"command outside", "name: hello\ncommand: ../server\n", false},
+		{"absolute command", "name: hello\ncommand: /bin/sh\n", false},
+		{"hook outside", "name: hello\nhooks:\n  user.create: ../../bin/sh\n", false},
+		{"absolute hook", "name: hello\nhooks:\n  user.create: /bin/sh\n", false},
+		{"job type with a slash", "name: hello\ncommand: server\njobs: [greet/../../events]\n", false},
+		{"job type with a dot", "name: hello\ncommand: server\njobs: [greet.now]\n", false},
+		{"panel ID with spaces", "name: hello\ncommand: server\npanels:\n  - id: my panel\n    path: /panel\n", false},
+		{"panel outside the API", "name: hello\ncommand: server\npanels:\n  - id: main\n    path: /../../users\n", false},
+		{"panel with a query", "name: hello\ncommand: server\npanels:\n  - id: main\n    path: /panel?next=/api/v1/users\n", false},
+		{"panel with a backslash", "name: hello\ncommand: server\npanels:\n  - id: main\n    path: /..\\..\\users\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writePlugin(t, map[string]string{manifestFile: tt.manifest})
+
+			_, err := readManifest(dir)
+			if (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	if _, err := readManifest(t.TempDir()); !os.IsNotExist(err) {
+		t.Errorf("reading a directory without a manifest: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	public, private := newKey(t)
+	other, otherPrivate := newKey(t)
+
+	files := map[string]string{
+		manifestFile:         "name: hello\nversion: 1.0.0\ncommand: server\n",
+		"server":             "#!/bin/sh\n",
+		"static/index.html":  "<p>Hello</p>\n",
+		"static/sub/app.css": "p {}\n",
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+		keys   []ed25519.PublicKey
+		signer string
+		err    error
+	}{
+		{"signed", func(t *testing.T, dir string) {}, []ed25519.PublicKey{public}, Fingerprint(public), nil},
+		{"signed by the second key", func(t *testing.T, dir string) {}, []ed25519.PublicKey{other, public}, Fingerprint(public), nil},
+		{"untrusted key", func(t *testing.T, dir string) {}, []ed25519.PublicKey{other}, "", ErrBadSignature},
+		{"no trusted keys", func(t *testing.T, dir string) {}, nil, "", ErrBadSignature},
+		{"file changed", func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, "server"), []byte("#!/bin/sh\nrm -rf /\n"), 0755)
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"file added", func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, "static", "extra.js"), nil, 0644)
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"file removed", func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "static", "sub", "app.css"))
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"file moved", func(t *testing.T, dir string) {
+			os.Rename(filepath.Join(dir, "static", "sub", "app.css"), filepath.Join(dir, "static", "app.css"))
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"version changed", func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, manifestFile), []byte("name: hello\nversion: 1.0.1\ncommand: server\n"), 0644)
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"signed by another key", func(t *testing.T, dir string) {
+			if err := Sign(dir, otherPrivate); err != nil {
+				t.Fatal(err)
+			}
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"garbage signature", func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, signatureFile), []byte("not base64!\n"), 0644)
+		}, []ed25519.PublicKey{public}, "", ErrBadSignature},
+		{"unsigned", func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, signatureFile))
+		}, []ed25519.PublicKey{public}, "", ErrUnsigned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writePlugin(t, files)
+			if err := Sign(dir, private); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, dir)
+
+			m, err := readManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := verify(dir, m, tt.keys)
+			if !errors.Is(err, tt.err) || signer != tt.signer {
+				t.Errorf("signed by %q with %v, want %q with %v", signer, err, tt.signer, tt.err)
+			}
+		})
+	}
+
+	// A symbolic link could point the signed name at any file
+	dir := writePlugin(t, files)
+	if err := os.Symlink("/bin/sh", filepath.Join(dir, "static", "sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sign(dir, private); err == nil {
+		t.Error("a plugin with a symbolic link was signed")
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	public, private := newKey(t)
+
+	dir := writePlugin(t, map[string]string{manifestFile: "name: hello\nversion: 1.0.0\n"})
+	if err := Sign(dir, private); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(public)
+
+	tests := []struct {
+		name string
+		keys []string
+		ok   bool
+	}{
+		{"trusted key", []string{encoded}, true},
+		{"not base64", []string{"not a key"}, false},
+		{"too short", []string{base64.StdEncoding.EncodeToString(public[:16])}, false},
+		{"a private key", []string{base64.StdEncoding.EncodeToString(private)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, signer, err := Verify(dir, tt.keys)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (m.Name != "hello" || signer != Fingerprint(public)) {
+				t.Errorf("verified %s signed by %s", m.Name, signer)
+			}
+		})
+	}
+}
@@ -0,0 +1,721 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when managing plugins before Configure is called
+	ErrNotConfigured = errors.New("plugins: not configured")
+
+	// ErrNotFound is returned for a plugin that is not installed
+	ErrNotFound = errors.New("plugins: plugin not found")
+
+	// ErrNotRunning is returned when calling a plugin that is disabled or has not come up
+	ErrNotRunning = errors.New("plugins: plugin is not running")
+
+	// ErrBadSignature is returned for a plugin whose signature does not verify against
+	// any trusted key
+	ErrBadSignature = errors.New("plugins: plugin signature is invalid")
+
+	// ErrUnsigned is returned when enabling an unsigned plugin while unsigned plugins are
+	// not allowed
+	ErrUnsigned = errors.New("plugins: plugin is not signed")
+)
+
+// Plugin is an installed plugin and its state
+type Plugin struct {
+	Manifest
+
+	Enabled bool `json:"enabled"`
+	Running bool `json:"running"`
+
+	// The fingerprint of the key the plugin is signed with, empty if it is unsigned
+	Signer string `json:"signer,omitempty"`
+
+	// Why the plugin cannot be enabled or last stopped
+	Error string `json:"error,omitempty"`
+}
+
+// Contribution is a UI panel of a running plugin along with the API path serving it
+type Contribution struct {
+	Plugin string `json:"plugin"`
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+}
+
+// enabledKind is what the names of the enabled plugins are kept under in the state store
+const enabledKind = "plugins.enabled"
+
+// How long a plugin has to answer on its socket after starting, to stop after being
+// asked to and for a hook to run
+const (
+	handshakeTimeout = 10 * time.Second
+	stopTimeout      = 10 * time.Second
+	hookTimeout      = 30 * time.Second
+)
+
+// safePath is the PATH plugins run with
+const safePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// manager runs the enabled plugins
+type manager struct {
+	mu      sync.Mutex
+	config  *config.PluginsConfiguration
+	dir     string
+	run     string
+	keys    []ed25519.PublicKey
+	attr    *syscall.SysProcAttr
+	enabled map[string]bool
+	running map[string]*instance
+	errors  map[string]string
+}
+
+var std *manager
+
+// Configure finds plugins in the configured directory and loads which are enabled from
+// the state store, which must be configured first. When the daemon runs as root without
+// dropping its privileges, plugins run as the panel's user, uid and gid
+func Configure(dataDir string, uid int, gid int, c *config.PluginsConfiguration) error {
+	keys, err := parseKeys(c.Keys)
+	if err != nil {
+		return err
+	}
+
+	m := &manager{
+		config:  c,
+		dir:     c.Dir,
+		run:     filepath.Join(dataDir, "plugin-sockets"),
+		keys:    keys,
+		enabled: make(map[string]bool),
+		running: make(map[string]*instance),
+		errors:  make(map[string]string),
+	}
+
+	if m.dir == "" {
+		m.dir = filepath.Join(dataDir, "plugins")
+	}
+
+	if err := os.MkdirAll(m.run, 0700); err != nil {
+		return err
+	}
+
+	// Plugins create their sockets themselves, so the directory belongs to their user
+	if os.Geteuid() == 0 && uid != 0 {
+		m.attr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+
+		if err := os.Chown(m.run, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if err := store.Load(enabledKind, &m.enabled); err != nil {
+		return err
+	}
+
+	std = m
+
+	return nil
+}
+
+// Start runs every enabled plugin. It is called once the daemon has dropped its
+// privileges, so that plugins never inherit them. A plugin that fails to start is
+// reported in its state rather than stopping the others
+func Start() {
+	if std == nil {
+		return
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for name, enabled := range std.enabled {
+		if !enabled {
+			continue
+		}
+
+		if err := std.start(name); err != nil {
+			std.errors[name] = err.Error()
+			zap.S().Named("plugins").Errorw("failed to start plugin", "plugin", name, zap.Error(err))
+		}
+	}
+}
+
+// Stop stops every running plugin, such as when the daemon shuts down
+func Stop() {
+	if std == nil {
+		return
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for name := range std.running {
+		std.stop(name)
+	}
+}
+
+// List returns every installed plugin, sorted by name
+func List() ([]Plugin, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	entries, err := os.ReadDir(std.dir)
+	if os.IsNotExist(err) {
+		return []Plugin{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := []Plugin{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(std.dir, e.Name(), manifestFile)); err != nil {
+			continue
+		}
+
+		list = append(list, std.plugin(e.Name()))
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// Get returns the installed plugin with the name
+func Get(name string) (Plugin, error) {
+	if std == nil {
+		return Plugin{}, ErrNotConfigured
+	}
+
+	if !validName.MatchString(name) {
+		return Plugin{}, ErrNotFound
+	}
+
+	if _, err := os.Stat(filepath.Join(std.dir, name, manifestFile)); err != nil {
+		return Plugin{}, ErrNotFound
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.plugin(name), nil
+}
+
+// Enable verifies the plugin's signature, records it as enabled and starts it
+func Enable(name string) (Plugin, error) {
+	if _, err := Get(name); err != nil {
+		return Plugin{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if _, ok := std.running[name]; !ok {
+		if err := std.start(name); err != nil {
+			return std.plugin(name), err
+		}
+	}
+
+	std.enabled[name] = true
+	delete(std.errors, name)
+	if err := store.Save(enabledKind, std.enabled); err != nil {
+		return std.plugin(name), err
+	}
+
+	return std.plugin(name), nil
+}
+
+// Disable stops the plugin and records it as disabled. Its jobs fail until it is enabled
+// again
+func Disable(name string) (Plugin, error) {
+	if _, err := Get(name); err != nil {
+		return Plugin{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.stop(name)
+
+	delete(std.enabled, name)
+	delete(std.errors, name)
+	if err := store.Save(enabledKind, std.enabled); err != nil {
+		return std.plugin(name), err
+	}
+
+	return std.plugin(name), nil
+}
+
+// Proxy returns the handler forwarding requests to the API of the running plugin
+func Proxy(name string) (http.Handler, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	i, ok := std.running[name]
+	if !ok || i.proxy == nil || !i.ready.Load() {
+		return nil, ErrNotRunning
+	}
+
+	return i.proxy, nil
+}
+
+// Panels returns the UI panels of the running plugins shown to the role, ordered by
+// plugin
+func Panels(role string) []Contribution {
+	if std == nil {
+		return []Contribution{}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := []Contribution{}
+	for name, i := range std.running {
+		if !i.ready.Load() {
+			continue
+		}
+
+		for _, p := range i.manifest.Panels {
+			if len(p.Roles) > 0 && !slices.Contains(p.Roles, role) {
+				continue
+			}
+
+			list = append(list, Contribution{
+				Plugin: name,
+				ID:     p.ID,
+				Title:  p.Title,
+				URL:    "/api/v1/plugins/" + name + "/api/" + strings.TrimPrefix(p.Path, "/"),
+			})
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Plugin < list[j].Plugin })
+
+	return list
+}
+
+// JobType returns the type jobs of the plugin's type are queued as, or an error if the
+// plugin does not declare the type
+func JobType(name string, typ string) (string, error) {
+	p, err := Get(name)
+	if err != nil {
+		return "", err
+	}
+
+	if !slices.Contains(p.Jobs, typ) {
+		return "", fmt.Errorf("plugins: %s does not run jobs of type %s", name, typ)
+	}
+
+	return "plugin." + name + "." + typ, nil
+}
+
+// plugin returns the state of the installed plugin. The manager must be locked
+func (m *manager) plugin(name string) Plugin {
+	dir := filepath.Join(m.dir, name)
+
+	p := Plugin{Manifest: Manifest{Name: name}, Enabled: m.enabled[name], Error: m.errors[name]}
+
+	manifest, signer, err := m.check(dir)
+	if manifest.Name != "" {
+		p.Manifest = manifest
+	}
+	p.Signer = signer
+	if err != nil && p.Error == "" {
+		p.Error = err.Error()
+	}
+
+	if i, ok := m.running[name]; ok {
+		p.Running = i.ready.Load() || i.proxy == nil
+		if msg := i.failure(); msg != "" {
+			p.Error = msg
+		}
+	}
+
+	return p
+}
+
+// check reads the manifest of the plugin in the directory and verifies its signature,
+// returning the fingerprint of the key that signed it
+func (m *manager) check(dir string) (Manifest, string, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return manifest, "", err
+	}
+
+	signer, err := verify(dir, manifest, m.keys)
+	if errors.Is(err, ErrUnsigned) && m.config.AllowUnsigned {
+		err = nil
+	}
+
+	return manifest, signer, err
+}
+
+// start runs the plugin, subscribes it to its events and registers its jobs. The manager
+// must be locked
+func (m *manager) start(name string) error {
+	if os.Geteuid() == 0 && m.attr == nil {
+		return errors.New("plugins: plugins are not run as root, set system.username to an unprivileged user")
+	}
+
+	dir := filepath.Join(m.dir, name)
+	manifest, _, err := m.check(dir)
+	if err != nil {
+		return err
+	}
+
+	i := &instance{
+		name:     name,
+		dir:      dir,
+		manifest: manifest,
+		attr:     m.attr,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if manifest.Command != "" {
+		i.connect(filepath.Join(m.run, name+".sock"))
+		crash.Go("plugins", i.supervise)
+
+		if len(manifest.Events) > 0 {
+			sub := events.Subscribe(64, manifest.Events...)
+			i.subs = append(i.subs, sub)
+			crash.Go("plugins", func() {
+				for e := range sub.C {
+					if err := i.post(context.Background(), "/events", e); err != nil {
+						zap.S().Named("plugins").Warnw("failed to deliver event to plugin", "plugin", name, "event", e.Type, zap.Error(err))
+					}
+				}
+			})
+		}
+	} else {
+		close(i.done)
+	}
+
+	for pattern, hook := range manifest.Hooks {
+		sub := events.Subscribe(64, pattern)
+		i.subs = append(i.subs, sub)
+		crash.Go("plugins", func() {
+			for e := range sub.C {
+				i.hook(hook, e)
+			}
+		})
+	}
+
+	// Jobs look the plugin up when they run, since handlers cannot be unregistered
+	for _, typ := range manifest.Jobs {
+		jobs.Register("plugin."+name+"."+typ, func(ctx context.Context, j *jobs.Job) error {
+			return m.runJob(ctx, name, typ, j)
+		})
+	}
+
+	m.running[name] = i
+
+	return nil
+}
+
+// stop stops the plugin if it is running. The manager must be locked
+func (m *manager) stop(name string) {
+	i, ok := m.running[name]
+	if !ok {
+		return
+	}
+
+	for _, sub := range i.subs {
+		events.Unsubscribe(sub)
+	}
+
+	close(i.stopping)
+	<-i.done
+
+	delete(m.running, name)
+}
+
+// runJob runs a job of the plugin's type by sending it to the plugin
+func (m *manager) runJob(ctx context.Context, name string, typ string, j *jobs.Job) error {
+	m.mu.Lock()
+	i, ok := m.running[name]
+	m.mu.Unlock()
+
+	if !ok || !i.ready.Load() {
+		return fmt.Errorf("%w: %s", ErrNotRunning, name)
+	}
+
+	return i.post(ctx, "/jobs/"+typ, j)
+}
+
+// instance is a running plugin
+type instance struct {
+	name     string
+	dir      string
+	manifest Manifest
+	attr     *syscall.SysProcAttr
+
+	client *http.Client
+	proxy  *httputil.ReverseProxy
+	socket string
+	subs   []*events.Subscription
+
+	// Whether the plugin has answered on its socket since it last started
+	ready atomic.Bool
+
+	mu  sync.Mutex
+	err string
+
+	// Closed to ask the plugin to stop, and once it has
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+// connect sets up the client and proxy that reach the plugin on its socket
+func (i *instance) connect(socket string) {
+	i.socket = socket
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	i.client = &http.Client{Transport: transport, Timeout: time.Minute}
+	i.proxy = &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = i.name
+		},
+	}
+}
+
+// supervise runs the plugin's command until it is asked to stop, restarting it with a
+// growing delay whenever it exits
+func (i *instance) supervise() {
+	defer close(i.done)
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		if err := i.runOnce(); err != nil {
+			i.fail(err)
+			zap.S().Named("plugins").Errorw("plugin stopped", "plugin", i.name, zap.Error(err))
+		}
+
+		select {
+		case <-i.stopping:
+			return
+		default:
+		}
+
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+
+		select {
+		case <-i.stopping:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// runOnce starts the plugin's command and waits for it to exit, or stops it when asked
+// to. It returns nil only when the plugin was asked to stop
+func (i *instance) runOnce() error {
+	os.Remove(i.socket)
+
+	cmd := exec.Command(filepath.Join(i.dir, i.manifest.Command))
+	cmd.Dir = i.dir
+	cmd.Env = i.env("COSMICPANEL_PLUGIN_SOCKET=" + i.socket)
+	cmd.Stdout = &logWriter{plugin: i.name}
+	cmd.Stderr = cmd.Stdout
+	cmd.SysProcAttr = i.attr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	crash.Go("plugins", i.handshake)
+
+	select {
+	case err := <-exited:
+		i.ready.Store(false)
+		return fmt.Errorf("plugins: %s exited: %v", i.name, err)
+	case <-i.stopping:
+		i.ready.Store(false)
+		cmd.Process.Signal(syscall.SIGTERM)
+
+		select {
+		case <-exited:
+		case <-time.After(stopTimeout):
+			cmd.Process.Kill()
+			<-exited
+		}
+
+		os.Remove(i.socket)
+		return nil
+	}
+}
+
+// handshake waits for the plugin to answer GET /health on its socket, after which it is
+// sent events, jobs and requests
+func (i *instance) handshake() {
+	deadline := time.Now().Add(handshakeTimeout)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+i.name+"/health", nil)
+
+		resp, err := i.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+
+		if err == nil && resp.StatusCode == http.StatusOK {
+			i.ready.Store(true)
+			i.fail(nil)
+			return
+		}
+
+		select {
+		case <-i.stopping:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	i.fail(fmt.Errorf("plugins: %s did not answer on its socket within %s", i.name, handshakeTimeout))
+}
+
+// post sends the value to the plugin as JSON, returning the body of an error response
+// as the error
+func (i *instance) post(ctx context.Context, path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+i.name+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("plugins: %s answered %s: %s", i.name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// hook runs the executable hook with the event as JSON on its standard input
+func (i *instance) hook(path string, e events.Event) {
+	b, _ := json.Marshal(e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, filepath.Join(i.dir, path))
+	cmd.Dir = i.dir
+	cmd.Env = i.env("COSMICPANEL_EVENT=" + e.Type)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.SysProcAttr = i.attr
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		zap.S().Named("plugins").Warnw("plugin hook failed", "plugin", i.name, "hook", path, "event", e.Type, "output", string(out), zap.Error(err))
+	}
+}
+
+// env returns the environment the plugin's processes run with
+func (i *instance) env(extra ...string) []string {
+	return append([]string{"PATH=" + safePath, "COSMICPANEL_PLUGIN=" + i.name}, extra...)
+}
+
+// fail records why the plugin last failed, or clears it
+func (i *instance) fail(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.err = ""
+	if err != nil {
+		i.err = err.Error()
+	}
+}
+
+// failure returns why the plugin last failed
+func (i *instance) failure() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.err
+}
+
+// logWriter logs what a plugin writes to its standard output and error, a line at a time
+type logWriter struct {
+	plugin string
+	buf    []byte
+}
+
+// Write logs every complete line written so far
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		line, rest, ok := bytes.Cut(w.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		zap.S().Named("plugins").Infow(string(line), "plugin", w.plugin)
+		w.buf = rest
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,220 @@
+package plugins
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the manager with the plugins in its own directory and a state store,
+// running plugins as nobody when the tests run as root
+func configure(t *testing.T, c *config.PluginsConfiguration) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Dir = filepath.Join(dir, "plugins")
+	if err := Configure(dir, 65534, 65534, c); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		Stop()
+		std = nil
+	})
+}
+
+// install writes a plugin with hooks alone into the plugins directory
+func install(t *testing.T, name string, sign func(dir string)) {
+	t.Helper()
+
+	dir := filepath.Join(std.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := "name: " + name + "\nversion: 1.0.0\nhooks:\n  user.create: on-user.sh\n"
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "on-user.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if sign != nil {
+		sign(dir)
+	}
+}
+
+func TestEnable(t *testing.T) {
+	public, private := newKey(t)
+	_, untrusted := newKey(t)
+	keys := []string{base64.StdEncoding.EncodeToString(public)}
+
+	signed := func(dir string) { Sign(dir, private) }
+	tampered := func(dir string) {
+		Sign(dir, private)
+		os.WriteFile(filepath.Join(dir, "on-user.sh"), []byte("#!/bin/sh\nid\n"), 0755)
+	}
+
+	tests := []struct {
+		name          string
+		sign          func(dir string)
+		allowUnsigned bool
+		err           error
+	}{
+		{"signed", signed, false, nil},
+		{"unsigned", nil, false, ErrUnsigned},
+		{"unsigned while allowed", nil, true, nil},
+		{"untrusted key", func(dir string) { Sign(dir, untrusted) }, false, ErrBadSignature},
+		{"untrusted key while unsigned are allowed", func(dir string) { Sign(dir, untrusted) }, true, ErrBadSignature},
+		{"changed after signing", tampered, true, ErrBadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, &config.PluginsConfiguration{Keys: keys, AllowUnsigned: tt.allowUnsigned})
+			install(t, "hello", tt.sign)
+
+			p, err := Enable("hello")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+
+			if p.Enabled != (tt.err == nil) || p.Running != (tt.err == nil) {
+				t.Errorf("enabled %v and running %v", p.Enabled, p.Running)
+			}
+			if tt.err == nil && p.Signer != map[bool]string{true: Fingerprint(public)}[tt.sign != nil] {
+				t.Errorf("signer %q", p.Signer)
+			}
+			if tt.err != nil && p.Error == "" {
+				t.Error("the plugin does not say why it cannot be enabled")
+			}
+
+			// Only enabled plugins are started with the daemon
+			var enabled map[string]bool
+			if err := store.Load(enabledKind, &enabled); err != nil {
+				t.Fatal(err)
+			}
+			if enabled["hello"] != (tt.err == nil) {
+				t.Errorf("stored as enabled %v", enabled["hello"])
+			}
+
+			if tt.err != nil {
+				return
+			}
+
+			p, err = Disable("hello")
+			if err != nil || p.Enabled || p.Running {
+				t.Errorf("disabled %+v, %v", p, err)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	configure(t, &config.PluginsConfiguration{AllowUnsigned: true})
+	install(t, "hello", nil)
+	install(t, "world", nil)
+
+	// A directory without a manifest is not a plugin
+	os.MkdirAll(filepath.Join(std.dir, "empty"), 0755)
+
+	for _, name := range []string{"hello", "world"} {
+		if p, err := Get(name); err != nil || p.Name != name || p.Error != "" {
+			t.Errorf("%s is %+v, %v", name, p, err)
+		}
+	}
+
+	for _, name := range []string{"empty", "missing", "../hello", "hello/..", "", "Hello"} {
+		if _, err := Get(name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("getting %q: %v", name, err)
+		}
+		if _, err := Enable(name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("enabling %q: %v", name, err)
+		}
+	}
+
+	list, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range list {
+		names = append(names, p.Name)
+	}
+	if !slices.Equal(names, []string{"hello", "world"}) {
+		t.Errorf("listed %q", names)
+	}
+}
+
+func TestJobType(t *testing.T) {
+	configure(t, &config.PluginsConfiguration{AllowUnsigned: true})
+
+	dir := filepath.Join(std.dir, "hello")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, manifestFile), []byte("name: hello\ncommand: server\njobs: [greet]\n"), 0644)
+
+	tests := []struct {
+		plugin string
+		typ    string
+		want   string
+	}{
+		{"hello", "greet", "plugin.hello.greet"},
+		{"hello", "other", ""},
+		{"missing", "greet", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := JobType(tt.plugin, tt.typ)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("job type of %s %s is %q, %v, want %q", tt.plugin, tt.typ, got, err, tt.want)
+		}
+	}
+}
+
+func TestPanels(t *testing.T) {
+	configure(t, &config.PluginsConfiguration{})
+
+	ready := &instance{manifest: Manifest{Panels: []Panel{
+		{ID: "main", Title: "Main", Path: "/panel"},
+		{ID: "admin", Title: "Admin", Path: "admin", Roles: []string{"admin"}},
+	}}}
+	ready.ready.Store(true)
+	starting := &instance{manifest: Manifest{Panels: []Panel{{ID: "main", Path: "/panel"}}}}
+
+	std.running["hello"] = ready
+	std.running["starting"] = starting
+	t.Cleanup(func() { std.running = make(map[string]*instance) })
+
+	tests := []struct {
+		role string
+		want []string
+	}{
+		{"admin", []string{"/api/v1/plugins/hello/api/panel", "/api/v1/plugins/hello/api/admin"}},
+		{"user", []string{"/api/v1/plugins/hello/api/panel"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, c := range Panels(tt.role) {
+			got = append(got, c.URL)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("panels for %s %q, want %q", tt.role, got, tt.want)
+		}
+	}
+
+	if _, err := Proxy("starting"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("proxy of a plugin that has not answered: %v", err)
+	}
+}
@@ -0,0 +1,481 @@
+package privacy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/archives"
+	"github.com/cosmicpanel/CosmicPanel/backups"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/php"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/support"
+)
+
+var (
+	// ErrNotConfigured is returned when erasing an account before Configure is called
+	ErrNotConfigured = errors.New("privacy: not configured")
+
+	// ErrNotFound is returned for an erasure that does not exist
+	ErrNotFound = errors.New("privacy: erasure not found")
+
+	// ErrActive is returned when erasing an account that has not been terminated
+	ErrActive = errors.New("privacy: the account must be terminated before it is erased")
+
+	// ErrUnconfirmed is returned when the username an erasure is confirmed with does not
+	// match the account
+	ErrUnconfirmed = errors.New("privacy: confirm the erasure by repeating the username of the account")
+
+	// ErrNothingToErase is returned when erasing an account the panel holds nothing about
+	// other than what is retained
+	ErrNothingToErase = errors.New("privacy: nothing is left to erase of the account")
+)
+
+// States of an erasure
+const (
+	Pending = "pending"
+	Erased  = "erased"
+)
+
+// Categories of personal data an erasure counts
+const (
+	CategoryArchives = "archives"
+	CategoryBackups  = "backups"
+	CategoryPHP      = "php"
+	CategoryTickets  = "tickets"
+	CategoryMail     = "mail"
+	CategoryActivity = "activity"
+	CategoryHome     = "home"
+	CategoryAudit    = "audit"
+	CategoryDomains  = "domains"
+)
+
+// Erasure is the erasure of the personal data of a terminated account. Once the data is
+// gone and the panel has checked nothing is left, the erasure is its certificate of
+// deletion. The certificate is recorded in the audit log, whose hash chain shows it has
+// not been changed since
+type Erasure struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	UserID   string `json:"user_id,omitempty"`
+
+	// Kept until the notifications sent to it are erased
+	Email string `json:"email,omitempty"`
+
+	// Why the account is erased, such as the request of the data subject it was made
+	// under, and who erased it
+	Reason string `json:"reason,omitempty"`
+	Actor  string `json:"actor"`
+	Job    string `json:"job,omitempty"`
+
+	State     string    `json:"state"`
+	Requested time.Time `json:"requested"`
+	Completed time.Time `json:"completed,omitempty"`
+
+	// The number of records of each category that were erased, and of those that are
+	// kept. The audit log cannot be changed without breaking its chain, and domains are
+	// released through the registrar
+	Erased   map[string]int `json:"erased,omitempty"`
+	Retained map[string]int `json:"retained,omitempty"`
+
+	// The SHA-256 of the certificate without this field, set once it is erased
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Digest returns the SHA-256 of the certificate, which matches its SHA256 field unless
+// it has been changed
+func (e Erasure) Digest() string {
+	e.SHA256 = ""
+
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Public returns a copy of the erasure without the email address it still has to erase,
+// which is safe to return from the API and record in the audit log
+func (e Erasure) Public() Erasure {
+	e.Email = ""
+
+	return e
+}
+
+// erasureKind is what erasures are kept under in the state store
+const erasureKind = "privacy.erasure"
+
+// eraseJob is the job erasures run as
+const eraseJob = "privacy.erase"
+
+type eraser struct {
+	homes string
+}
+
+var std *eraser
+
+// Configure registers the job accounts are erased with. The home directories of
+// accounts are in homes
+func Configure(homes string) {
+	std = &eraser{homes: homes}
+
+	jobs.Register(eraseJob, func(ctx context.Context, j *jobs.Job) error {
+		var id string
+		if err := j.Decode(&id); err != nil {
+			return err
+		}
+
+		return erase(ctx, id)
+	})
+}
+
+// Request queues the erasure of the terminated account, which is confirmed by repeating
+// its username. An erasure already pending for the account is returned instead of
+// queueing another
+func Request(username string, confirm string, reason string, actor string) (Erasure, error) {
+	if std == nil {
+		return Erasure{}, ErrNotConfigured
+	}
+
+	if username == "" || confirm != username {
+		return Erasure{}, ErrUnconfirmed
+	}
+
+	s, err := resolve(username)
+	if err != nil {
+		return Erasure{}, err
+	}
+
+	if s.user != nil {
+		return Erasure{}, ErrActive
+	}
+
+	list, err := List()
+	if err != nil {
+		return Erasure{}, err
+	}
+
+	for _, e := range list {
+		if e.Username == username && e.State == Pending {
+			return e, nil
+		}
+	}
+
+	x, err := collect(s)
+	if err != nil {
+		return Erasure{}, err
+	}
+
+	if !x.erasable() && !std.hasHome(username) {
+		return Erasure{}, ErrNothingToErase
+	}
+
+	e := Erasure{
+		ID:        ids.New(),
+		Username:  username,
+		UserID:    s.ID,
+		Email:     s.Email,
+		Reason:    strings.TrimSpace(reason),
+		Actor:     actor,
+		State:     Pending,
+		Requested: time.Now().UTC(),
+	}
+
+	if err := save(e); err != nil {
+		return Erasure{}, err
+	}
+
+	j, err := jobs.Enqueue(eraseJob, e.ID, jobs.Options{Actor: actor})
+	if err != nil {
+		return Erasure{}, err
+	}
+
+	e.Job = j.ID
+
+	return e, save(e)
+}
+
+// List returns every erasure, newest first
+func List() ([]Erasure, error) {
+	list := []Erasure{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(erasureKind, func(id string, data []byte) error {
+			var e Erasure
+			if err := json.Unmarshal(data, &e); err != nil {
+				return fmt.Errorf("privacy: malformed erasure %s: %w", id, err)
+			}
+
+			list = append(list, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.After(list[j].Requested) })
+
+	return list, nil
+}
+
+// Get returns the erasure with the ID
+func Get(id string) (Erasure, error) {
+	var e Erasure
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(erasureKind, id, &e)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Erasure{}, ErrNotFound
+	}
+
+	return e, err
+}
+
+// erase removes everything held about the account of the erasure, then collects it
+// again to check nothing is left before completing the certificate. Each step skips
+// what an earlier attempt removed, so that a failed erasure is retried by its job
+func erase(ctx context.Context, id string) error {
+	e, err := Get(id)
+	if err != nil || e.State == Erased {
+		return err
+	}
+
+	s, err := resolve(e.Username)
+	if err != nil {
+		return err
+	}
+
+	if s.user != nil {
+		return ErrActive
+	}
+	s.ID, s.Email = e.UserID, e.Email
+
+	if e.Erased == nil {
+		e.Erased = make(map[string]int)
+	}
+
+	steps := []struct {
+		category string
+		fn       func(s subject) (int, error)
+	}{
+		{CategoryArchives, eraseArchives},
+		{CategoryBackups, eraseBackups},
+		{CategoryPHP, erasePHP},
+		{CategoryTickets, eraseTickets},
+		{CategoryMail, eraseMail},
+		{CategoryHome, std.eraseHome},
+		{CategoryActivity, eraseActivity},
+	}
+
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := step.fn(s)
+		e.Erased[step.category] += n
+		if err != nil {
+			if serr := save(e); serr != nil {
+				err = errors.Join(err, serr)
+			}
+			return fmt.Errorf("privacy: failed to erase the %s of %s: %w", step.category, e.Username, err)
+		}
+	}
+
+	x, err := collect(s)
+	if err != nil {
+		return err
+	}
+
+	var left []string
+	for category, n := range map[string]int{
+		CategoryArchives: len(x.Archives),
+		CategoryBackups:  len(x.Backups),
+		CategoryPHP:      len(x.PHP),
+		CategoryTickets:  len(x.Tickets),
+		CategoryMail:     len(x.Mail),
+		CategoryActivity: len(x.Activity),
+	} {
+		if n > 0 {
+			left = append(left, fmt.Sprintf("%d %s", n, category))
+		}
+	}
+	if std.hasHome(e.Username) {
+		left = append(left, "the home directory")
+	}
+	if len(left) > 0 {
+		sort.Strings(left)
+		return fmt.Errorf("privacy: %s still holds %s after erasing it", e.Username, strings.Join(left, ", "))
+	}
+
+	e.Email = ""
+	e.State = Erased
+	e.Completed = time.Now().UTC()
+	e.Retained = map[string]int{CategoryAudit: len(x.Audit), CategoryDomains: len(x.Domains)}
+	e.SHA256 = e.Digest()
+
+	if err := save(e); err != nil {
+		return err
+	}
+
+	// The certificate is recorded in the audit log like every change made by an actor
+	after, _ := json.Marshal(e)
+	events.Publish(events.Event{
+		Type:     "privacy.erase",
+		Actor:    e.Actor,
+		Resource: e.ID,
+		After:    after,
+	})
+
+	return nil
+}
+
+// eraseArchives purges the archives of the account
+func eraseArchives(s subject) (int, error) {
+	list, err := archives.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, a := range list {
+		if a.Username != s.Username {
+			continue
+		}
+
+		if _, err := archives.Purge(a.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// eraseBackups removes the backups of the account made by this server
+func eraseBackups(s subject) (int, error) {
+	removed, err := backups.Delete(s.Username)
+	if errors.Is(err, backups.ErrNotConfigured) {
+		return 0, nil
+	}
+
+	return len(removed), err
+}
+
+// erasePHP removes the PHP settings of the domains of the account and the files they
+// were rendered into
+func erasePHP(s subject) (int, error) {
+	list, err := php.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, p := range list {
+		if p.Account != s.Username {
+			continue
+		}
+
+		if _, err := php.Reset(p.Domain); err != nil && !errors.Is(err, php.ErrNotFound) {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// eraseTickets removes the tickets the account opened from the panel
+func eraseTickets(s subject) (int, error) {
+	list, err := support.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, t := range list {
+		if !s.owns(t) {
+			continue
+		}
+
+		if err := support.Delete(t.ID); err != nil && !errors.Is(err, support.ErrNotFound) {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// eraseMail removes the record of the notifications sent to the account
+func eraseMail(s subject) (int, error) {
+	n, err := notify.DeleteDeliveries(notify.Filter{Username: s.Username})
+	if err != nil || s.Email == "" {
+		return n, err
+	}
+
+	sent, err := notify.DeleteDeliveries(notify.Filter{Recipient: s.Email})
+
+	return n + sent, err
+}
+
+// eraseActivity removes the events referencing the account from the activity feed
+func eraseActivity(s subject) (int, error) {
+	return events.Forget(s.references)
+}
+
+// eraseHome removes the home directory the account left behind when it was terminated
+// without being archived
+func (r *eraser) eraseHome(s subject) (int, error) {
+	if !r.hasHome(s.Username) {
+		return 0, nil
+	}
+
+	if err := os.RemoveAll(r.home(s.Username)); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// hasHome returns true if the home directory of the account exists
+func (r *eraser) hasHome(username string) bool {
+	path := r.home(username)
+	if path == "" {
+		return false
+	}
+
+	_, err := os.Lstat(path)
+
+	return err == nil
+}
+
+// home returns the path of the home directory of the account, which is empty for a
+// username that is not a single path element
+func (r *eraser) home(username string) string {
+	if r.homes == "" || username == "" || username != filepath.Base(username) || strings.HasPrefix(username, ".") {
+		return ""
+	}
+
+	return filepath.Join(r.homes, username)
+}
+
+// save writes the erasure to the state store
+func save(e Erasure) error {
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(erasureKind, e.ID, e)
+	})
+}
@@ -0,0 +1,266 @@
+package privacy
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/archives"
+	"github.com/cosmicpanel/CosmicPanel/audit"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/backups"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/php"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/support"
+)
+
+// ErrUnknownAccount is returned for an account the panel holds nothing about
+var ErrUnknownAccount = errors.New("privacy: the panel holds no personal data of the account")
+
+// Export is the personal data the panel holds about an account
+type Export struct {
+	Generated time.Time `json:"generated"`
+	Username  string    `json:"username"`
+	UserID    string    `json:"user_id,omitempty"`
+
+	// The account without its credentials, which is empty once it has been terminated
+	Account *auth.User `json:"account,omitempty"`
+
+	Domains []registrar.Domain `json:"domains"`
+	PHP     []php.Settings     `json:"php"`
+	Tickets []support.Ticket   `json:"tickets"`
+
+	// The notifications sent to the account, which is the mail the panel keeps a record
+	// of. Only who it went to, when and its subject are kept, never the message
+	Mail []notify.Delivery `json:"mail"`
+
+	// The events in the activity feed and the entries in the audit log that reference the
+	// account, either as the one who made a change or as what was changed
+	Activity []events.Event `json:"activity"`
+	Audit    []audit.Entry  `json:"audit"`
+
+	// The archive of the terminated account and the backups of this server, without
+	// their contents
+	Archives []archives.Archive `json:"archives"`
+	Backups  []backups.Backup   `json:"backups"`
+}
+
+// empty returns true if the export holds nothing about the account
+func (x Export) empty() bool {
+	return x.Account == nil && len(x.Domains) == 0 && len(x.PHP) == 0 && len(x.Tickets) == 0 &&
+		len(x.Mail) == 0 && len(x.Activity) == 0 && len(x.Audit) == 0 && len(x.Archives) == 0 &&
+		len(x.Backups) == 0
+}
+
+// erasable returns true if the export holds anything an erasure removes
+func (x Export) erasable() bool {
+	return len(x.PHP) > 0 || len(x.Tickets) > 0 || len(x.Mail) > 0 || len(x.Activity) > 0 ||
+		len(x.Archives) > 0 || len(x.Backups) > 0
+}
+
+// subject identifies the account personal data is held about. The ID and email address
+// of a terminated account are found in the event of its deletion
+type subject struct {
+	Username string
+	ID       string
+	Email    string
+
+	user *auth.User
+}
+
+// Collect gathers the personal data the panel holds about the account, which may have
+// been terminated
+func Collect(username string) (Export, error) {
+	s, err := resolve(username)
+	if err != nil {
+		return Export{}, err
+	}
+
+	x, err := collect(s)
+	if err != nil {
+		return Export{}, err
+	}
+
+	if x.empty() {
+		return Export{}, ErrUnknownAccount
+	}
+
+	return x, nil
+}
+
+// resolve finds the account with the username, falling back to the activity feed for
+// one that has been terminated
+func resolve(username string) (subject, error) {
+	for _, u := range auth.Users() {
+		if u.Username == username {
+			public := u.Public()
+			return subject{Username: u.Username, ID: u.ID, Email: u.Email, user: &public}, nil
+		}
+	}
+
+	s := subject{Username: username}
+
+	deleted, err := events.Query(events.Filter{Type: "user.delete"})
+	if err != nil {
+		return subject{}, err
+	}
+
+	for _, e := range slices.Backward(deleted) {
+		var u auth.User
+		if json.Unmarshal(e.Before, &u) == nil && u.Username == username {
+			s.ID, s.Email = u.ID, u.Email
+			return s, nil
+		}
+	}
+
+	// The deletion is erased from the feed along with the account, and the erasure keeps
+	// its ID so that the audit log entries retained about it are still found
+	erasures, err := List()
+	if err != nil {
+		return subject{}, err
+	}
+
+	for _, e := range erasures {
+		if e.Username == username && e.UserID != "" {
+			s.ID = e.UserID
+			break
+		}
+	}
+
+	return s, nil
+}
+
+// collect gathers everything held about the subject
+func collect(s subject) (Export, error) {
+	x := Export{
+		Generated: time.Now().UTC(),
+		Username:  s.Username,
+		UserID:    s.ID,
+		Account:   s.user,
+		Domains:   []registrar.Domain{},
+		PHP:       []php.Settings{},
+		Tickets:   []support.Ticket{},
+		Mail:      []notify.Delivery{},
+		Archives:  []archives.Archive{},
+		Backups:   backups.List(s.Username),
+	}
+
+	var err error
+
+	if s.ID != "" {
+		if x.Domains, err = registrar.List(s.ID); err != nil {
+			return Export{}, err
+		}
+	}
+
+	settings, err := php.List()
+	if err != nil {
+		return Export{}, err
+	}
+	for _, p := range settings {
+		if p.Account == s.Username {
+			x.PHP = append(x.PHP, p.Redacted())
+		}
+	}
+
+	tickets, err := support.List()
+	if err != nil {
+		return Export{}, err
+	}
+	for _, t := range tickets {
+		if s.owns(t) {
+			x.Tickets = append(x.Tickets, t)
+		}
+	}
+
+	if x.Mail, err = deliveries(s); err != nil {
+		return Export{}, err
+	}
+
+	if x.Activity, err = events.Query(events.Filter{}); err != nil {
+		return Export{}, err
+	}
+	x.Activity = slices.DeleteFunc(x.Activity, func(e events.Event) bool { return !s.references(e) })
+
+	if x.Audit, err = auditEntries(s); err != nil {
+		return Export{}, err
+	}
+
+	list, err := archives.List()
+	if err != nil {
+		return Export{}, err
+	}
+	for _, a := range list {
+		if a.Username == s.Username {
+			x.Archives = append(x.Archives, a)
+		}
+	}
+
+	return x, nil
+}
+
+// deliveries returns the notifications sent to the account or to its email address
+func deliveries(s subject) ([]notify.Delivery, error) {
+	list, err := notify.Deliveries(notify.Filter{Username: s.Username})
+	if err != nil || s.Email == "" {
+		return list, err
+	}
+
+	sent, err := notify.Deliveries(notify.Filter{Recipient: s.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range sent {
+		if !slices.ContainsFunc(list, func(o notify.Delivery) bool { return o.ID == d.ID }) {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+
+	return list, nil
+}
+
+// auditEntries returns the entries of the audit log made by the account or changing it,
+// in the order they were recorded
+func auditEntries(s subject) ([]audit.Entry, error) {
+	list, err := audit.Query(audit.Filter{Actor: s.Username})
+	if errors.Is(err, audit.ErrNotConfigured) {
+		return []audit.Entry{}, nil
+	} else if err != nil || s.ID == "" {
+		return list, err
+	}
+
+	changed, err := audit.Query(audit.Filter{Resource: s.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range changed {
+		if e.Actor != s.Username {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Sequence < list[j].Sequence })
+
+	return list, nil
+}
+
+// references returns true if the event was caused by the account, belongs to it or
+// changed it
+func (s subject) references(e events.Event) bool {
+	if e.Actor == s.Username || e.Account == s.Username {
+		return true
+	}
+
+	return s.ID != "" && (e.Account == s.ID || e.Resource == s.ID)
+}
+
+// owns returns true if the account opened the ticket
+func (s subject) owns(t support.Ticket) bool {
+	return (s.ID != "" && t.User == s.ID) || t.Context.Account.Username == s.Username
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"go.uber.org/zap"
+)
+
+// dropPrivileges switches the daemon from root to the panel's user once its listeners
+// are bound, leaving a broker running as root for the commands on the allowlist. The
+// data directory and log are handed to the user first so that the daemon can still
+// write them
+func dropPrivileges(c *config.Configuration) error {
+	if os.Geteuid() != 0 {
+		zap.S().Warnw("not dropping privileges as the daemon is not running as root")
+		return nil
+	}
+
+	uid, gid := c.System.User.Uid, c.System.User.Gid
+	if uid == 0 {
+		return errors.New("the panel's user is root, set system.username to an unprivileged user")
+	}
+
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return err
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+
+	groups := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if g, err := strconv.Atoi(id); err == nil {
+			groups = append(groups, g)
+		}
+	}
+
+	err = filepath.WalkDir(c.System.Data, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The log and its rotated copies are handed over but not its directory, which is
+	// often shared. Rotation only works if the user can write to the directory
+	if c.Logging != nil && c.Logging.File != "" {
+		matches, _ := filepath.Glob(strings.TrimSuffix(c.Logging.File, filepath.Ext(c.Logging.File)) + "*")
+		for _, path := range append(matches, c.Logging.File) {
+			if err := os.Lchown(path, uid, gid); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	allow := privsep.DefaultAllow
+	if len(c.System.Broker) > 0 {
+		allow = slices.DeleteFunc(slices.Clone(c.System.Broker), func(name string) bool {
+			return !slices.Contains(privsep.DefaultAllow, name)
+		})
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if err := privsep.Start(exe, allow); err != nil {
+		return err
+	}
+
+	if err := privsep.Drop(uid, gid, groups); err != nil {
+		return err
+	}
+
+	zap.S().Infow("dropped privileges", "uid", uid, "gid", gid, "broker", allow)
+
+	return nil
+}
+
+// broker runs the commands the daemon sends it as root, after the daemon has dropped its
+// privileges. The daemon starts it with its end of the connection as the fourth file
+func broker(args []string) error {
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	allow := fs.String("allow", "", "The commands the daemon may run, separated by commas")
+	fs.Parse(args)
+
+	if err := logging.ConfigureLogging(false, nil); err != nil {
+		return err
+	}
+
+	conn := os.NewFile(3, "daemon")
+	if conn == nil {
+		return fmt.Errorf("the broker is started by the daemon")
+	}
+	defer conn.Close()
+
+	return privsep.Serve(conn, strings.Split(*allow, ","))
+}
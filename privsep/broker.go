@@ -0,0 +1,280 @@
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// safePath is the only place the broker looks for commands, so the daemon cannot point
+// it at a binary of its own
+const safePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// safeEnv are the variables the daemon may add to the environment of a command. Others,
+// such as LD_PRELOAD, would let it run code as root
+var safeEnv = []string{"DEBIAN_FRONTEND", "LANG", "LC_ALL"}
+
+// Start runs the broker as a child of this process with the commands it may run, and
+// sends privileged commands to it from then on. It must be called while still root,
+// before Drop
+func Start(binary string, allow []string) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+
+	local, remote := os.NewFile(uintptr(fds[0]), "broker"), os.NewFile(uintptr(fds[1]), "daemon")
+	defer local.Close()
+	defer remote.Close()
+
+	// The broker finds the daemon's end of the connection as its fourth file
+	cmd := exec.Command(binary, "broker", "-allow", strings.Join(allow, ","))
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = []string{"PATH=" + safePath}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("privsep: failed to start the broker: %w", err)
+	}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	go func() {
+		err := cmd.Wait()
+		zap.S().Named("privsep").Errorw("the broker stopped, privileged commands will fail", zap.Error(err))
+		conn.Close()
+	}()
+
+	std = newClient(conn)
+
+	return nil
+}
+
+// Drop switches the process to the user and group for good, with the supplementary
+// groups. Every capability is lost along with root
+func Drop(uid int, gid int, groups []int) error {
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("privsep: failed to set groups: %w", err)
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("privsep: failed to set group: %w", err)
+	}
+
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("privsep: failed to set user: %w", err)
+	}
+
+	if syscall.Setuid(0) == nil {
+		return errors.New("privsep: root could be regained after dropping it")
+	}
+
+	return nil
+}
+
+// Serve runs the commands the daemon sends over the connection until the daemon goes
+// away. Only commands on the allowlist are run, with the arguments their rule allows,
+// found in safePath and with the environment limited to safeEnv. WP-CLI is the one
+// command run as an account rather than as root
+func Serve(conn io.ReadWriter, allow []string) error {
+	allowed := make(map[string]bool)
+	for _, name := range allow {
+		if slices.Contains(DefaultAllow, name) {
+			allowed[name] = true
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	// Cancels the commands still running, keyed by the ID of their request
+	var rmu sync.Mutex
+	running := make(map[uint64]context.CancelFunc)
+
+	defer wg.Wait()
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if req.Cancel != 0 {
+			rmu.Lock()
+			if cancel, ok := running[req.Cancel]; ok {
+				cancel()
+			}
+			rmu.Unlock()
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		rmu.Lock()
+		running[req.ID] = cancel
+		rmu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp := execute(ctx, req, allowed)
+
+			rmu.Lock()
+			delete(running, req.ID)
+			rmu.Unlock()
+			cancel()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err := enc.Encode(resp); err != nil {
+				zap.S().Named("privsep").Errorw("failed to respond to the daemon", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// execute runs the command of the request if it is allowed, killing it once the context
+// is done
+func execute(ctx context.Context, req request, allowed map[string]bool) response {
+	resp := response{ID: req.ID}
+	log := zap.S().Named("privsep")
+
+	if len(req.Args) == 0 {
+		resp.Denied, resp.Error = true, "privsep: no command"
+		return resp
+	}
+
+	// WP-CLI is only run as the user of an account, and nothing else is
+	var cred *syscall.Credential
+	var home string
+	var path string
+	var err error
+	if req.User != "" || filepath.Base(req.Args[0]) == wpCLI {
+		path, cred, home, err = asAccount(req)
+	} else {
+		path, err = resolve(req.Args[0], allowed)
+		if err == nil {
+			err = check(path, req.Args[1:])
+		}
+	}
+	if err != nil {
+		log.Warnw("refused command", "command", req.Args[0], "user", req.User, zap.Error(err))
+		resp.Denied, resp.Error = true, err.Error()
+		return resp
+	}
+
+	env := []string{"PATH=" + safePath}
+	if cred != nil {
+		env = append(env, "HOME="+home, "USER="+req.User)
+	}
+	for _, v := range req.Env {
+		if name, _, _ := strings.Cut(v, "="); !slices.Contains(safeEnv, name) {
+			log.Warnw("refused command", "command", req.Args[0], "variable", name)
+			resp.Denied, resp.Error = true, fmt.Sprintf("privsep: the variable %s is not allowed", name)
+			return resp
+		}
+		env = append(env, v)
+	}
+
+	if req.Limits != nil {
+		if err := req.Limits.Validate(); err != nil {
+			log.Warnw("refused command", "command", req.Args[0], zap.Error(err))
+			resp.Denied, resp.Error = true, err.Error()
+			return resp
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, req.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(req.Stdin)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+
+	err = cmd.Start()
+	if err == nil {
+		if lerr := limit(cmd.Process.Pid, req.Limits); lerr != nil {
+			log.Warnw("failed to limit command", "command", req.Args[0], zap.Error(lerr))
+		}
+		err = cmd.Wait()
+	}
+	resp.Stdout, resp.Stderr = stdout.Bytes(), stderr.Bytes()
+
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit) && exit.ExitCode() >= 0:
+		resp.Code = exit.ExitCode()
+	case err != nil:
+		resp.Error = err.Error()
+	}
+
+	log.Infow("ran command", "args", req.Args, "user", req.User, "code", resp.Code)
+
+	return resp
+}
+
+// asAccount returns the path of WP-CLI and the credentials of the account the request
+// runs it as, which must be the user of an account rather than root or a system user
+func asAccount(req request) (string, *syscall.Credential, string, error) {
+	if req.User == "" || filepath.Base(req.Args[0]) != wpCLI {
+		return "", nil, "", fmt.Errorf("%w: %s as %q", ErrNotAllowed, req.Args[0], req.User)
+	}
+
+	cred, home, err := credential(req.User)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	path, err := resolve(req.Args[0], map[string]bool{wpCLI: true})
+
+	return path, cred, home, err
+}
+
+// resolve returns the path of the allowed command in safePath. An absolute path is only
+// accepted if it is where the command is found
+func resolve(name string, allowed map[string]bool) (string, error) {
+	base := filepath.Base(name)
+	if !allowed[base] || (name != base && !filepath.IsAbs(name)) {
+		return "", fmt.Errorf("%w: %s", ErrNotAllowed, name)
+	}
+
+	for _, dir := range filepath.SplitList(safePath) {
+		path := filepath.Join(dir, base)
+		if info, err := os.Stat(path); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+
+		if name != base && filepath.Clean(name) != path {
+			return "", fmt.Errorf("%w: %s is not %s", ErrNotAllowed, name, path)
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("privsep: %s is not installed", base)
+}
@@ -0,0 +1,68 @@
+package privsep
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// I/O scheduling classes a command can be limited to
+const (
+	BestEffort = "best-effort"
+	Idle       = "idle"
+)
+
+// groupName matches the cgroups the broker creates, which are a single path element
+var groupName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Limits lower the priority of a command so that it does not slow down the sites on the
+// server. They are applied as soon as the command has started
+type Limits struct {
+	// The nice value, from 0 to 19
+	Nice int `json:"nice,omitempty"`
+
+	// The I/O scheduling class and the priority within best-effort, from 0 to 7
+	IOClass    string `json:"io_class,omitempty"`
+	IOPriority int    `json:"io_priority,omitempty"`
+
+	// The cgroup the command is moved into, below cosmicpanel in the cgroup v2 hierarchy,
+	// and its CPU and I/O weights. The command stays where it is without a group
+	Group     string `json:"group,omitempty"`
+	CPUWeight int    `json:"cpu_weight,omitempty"`
+	IOWeight  int    `json:"io_weight,omitempty"`
+}
+
+// Validate returns an error if a limit is out of range. Limits only ever lower the
+// priority of a command, never raise it
+func (l Limits) Validate() error {
+	switch {
+	case l.Nice < 0 || l.Nice > 19:
+		return fmt.Errorf("privsep: nice value %d is not between 0 and 19", l.Nice)
+	case l.IOClass != "" && l.IOClass != BestEffort && l.IOClass != Idle:
+		return fmt.Errorf("privsep: unknown I/O class %q", l.IOClass)
+	case l.IOPriority < 0 || l.IOPriority > 7:
+		return fmt.Errorf("privsep: I/O priority %d is not between 0 and 7", l.IOPriority)
+	case l.Group != "" && !groupName.MatchString(l.Group):
+		return fmt.Errorf("privsep: invalid cgroup %q", l.Group)
+	case l.CPUWeight < 0 || l.CPUWeight > 10000 || l.IOWeight < 0 || l.IOWeight > 10000:
+		return fmt.Errorf("privsep: cgroup weights must be between 1 and 10000")
+	}
+
+	return nil
+}
+
+// limit applies the limits to the process that has just started
+func limit(pid int, l *Limits) error {
+	if l == nil {
+		return nil
+	}
+
+	if err := SetPriority(pid, *l); err != nil {
+		return err
+	}
+
+	if l.Group == "" {
+		return nil
+	}
+
+	return join(pid, *l)
+}
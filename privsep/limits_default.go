@@ -0,0 +1,27 @@
+//go:build !linux
+
+package privsep
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SetPriority sets the nice value of the process. Only Linux has I/O priorities, and
+// elsewhere nice values apply to the whole process rather than a thread
+func SetPriority(id int, l Limits) error {
+	if l.Nice == 0 {
+		return nil
+	}
+
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, id, l.Nice); err != nil {
+		return fmt.Errorf("privsep: failed to set the nice value: %w", err)
+	}
+
+	return nil
+}
+
+// join does nothing, as only Linux has cgroups
+func join(pid int, l Limits) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package privsep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// ioprio_set takes the class in the top bits and the priority within it in the rest
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{BestEffort: 2, Idle: 3}
+
+// SetPriority sets the nice value and I/O priority of the process, or of the thread when
+// given a thread ID, which the processes it starts from then on inherit
+func SetPriority(id int, l Limits) error {
+	if l.Nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, id, l.Nice); err != nil {
+			return fmt.Errorf("privsep: failed to set the nice value: %w", err)
+		}
+	}
+
+	if class, ok := ioprioClasses[l.IOClass]; ok {
+		prio := class<<ioprioClassShift | l.IOPriority
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(id), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("privsep: failed to set the I/O priority: %w", errno)
+		}
+	}
+
+	return nil
+}
+
+// join moves the process into its cgroup below cosmicpanel, creating it with the weights
+// of the limits. The cpu and io controllers are enabled along the way
+func join(pid int, l Limits) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("privsep: cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+
+	parent := filepath.Join(cgroupRoot, "cosmicpanel")
+	group := filepath.Join(parent, l.Group)
+	if err := os.MkdirAll(group, 0755); err != nil {
+		return fmt.Errorf("privsep: failed to create cgroup: %w", err)
+	}
+
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := writeCgroup(dir, "cgroup.subtree_control", "+cpu +io"); err != nil {
+			return err
+		}
+	}
+
+	if l.CPUWeight > 0 {
+		if err := writeCgroup(group, "cpu.weight", strconv.Itoa(l.CPUWeight)); err != nil {
+			return err
+		}
+	}
+	if l.IOWeight > 0 {
+		if err := writeCgroup(group, "io.weight", "default "+strconv.Itoa(l.IOWeight)); err != nil {
+			return err
+		}
+	}
+
+	return writeCgroup(group, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// writeCgroup writes the value to a control file of the cgroup
+func writeCgroup(dir string, file string, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("privsep: failed to write %s: %w", file, err)
+	}
+
+	return nil
+}
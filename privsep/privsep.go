@@ -0,0 +1,337 @@
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// DefaultAllow is every command the broker runs for the daemon, which the configuration
+// can only narrow. Each is only run with the arguments its rule allows
+var DefaultAllow = []string{
+	// System users
+	"useradd", "usermod", "adduser", "addgroup", "pw",
+
+	// Firewalls
+	"nft", "iptables", "iptables-restore", "ip6tables", "ip6tables-restore", "firewall-cmd", "csf", "pfctl",
+
+	// Services
+	"systemctl", "rc-service", "rc-update", "sv", "service", "sysrc",
+
+	// Security updates
+	"apt-get", "needrestart", "dnf",
+
+	// TLS policy, SELinux labels and malware scans
+	"nginx", "postfix", "postconf", "doveadm", "doveconf", "restorecon", "clamscan", "clamdscan", "yara",
+
+	// PHP-FPM, which Debian and Ubuntu install by version
+	"php-fpm", "php-fpm7.4", "php-fpm8.0", "php-fpm8.1", "php-fpm8.2", "php-fpm8.3", "php-fpm8.4",
+
+	// Throttling accounts over their fair use of the CPU on FreeBSD
+	"rctl",
+}
+
+// ErrNotAllowed is returned for a command the broker does not run
+var ErrNotAllowed = errors.New("privsep: the broker does not run the command")
+
+// std is the connection to the broker once the daemon has dropped its privileges
+var std *client
+
+// Cmd is a command that needs root, which is run by the broker once the daemon has
+// dropped its privileges and directly before that. It mirrors the parts of exec.Cmd the
+// panel uses
+type Cmd struct {
+	Args []string
+
+	// Variables added to the environment, such as DEBIAN_FRONTEND=noninteractive. The
+	// broker only accepts those in safeEnv
+	Env []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Limits lowering the priority of the command, which runs like the daemon without
+	Limits *Limits
+
+	// Kills the command once done, set by CommandContext
+	ctx context.Context
+
+	// The account the command is run as rather than root, set by WP
+	user string
+}
+
+// ExitError is returned when a command run by the broker exits with a status other than
+// zero
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
+
+// ExitCode returns the exit status of the command, like exec.ExitError
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Command returns the command to run the program with the arguments
+func Command(name string, arg ...string) *Cmd {
+	return &Cmd{Args: append([]string{name}, arg...)}
+}
+
+// CommandContext is like Command, but the command is killed once the context is done
+func CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	c := Command(name, arg...)
+	c.ctx = ctx
+
+	return c
+}
+
+// Run runs the program with the arguments, including its output in the error if it
+// fails, which is how services are tested and reloaded after their files change
+func Run(name string, arg ...string) error {
+	out, err := Command(name, arg...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(arg, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Brokered returns true if privileged commands are run by the broker
+func Brokered() bool {
+	return std != nil
+}
+
+// Run runs the command and waits for it to finish. A command that exits with a status
+// other than zero returns an error with an ExitCode method, and one killed because its
+// context is done returns the error of the context
+func (c *Cmd) Run() error {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if c.Limits != nil {
+		if err := c.Limits.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if std == nil {
+		cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+		if len(c.Env) > 0 {
+			cmd.Env = append(os.Environ(), c.Env...)
+		}
+		if c.user != "" {
+			cred, home, err := credential(c.user)
+			if err != nil {
+				return err
+			}
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+			cmd.Env = append(os.Environ(), append(c.Env, "HOME="+home, "USER="+c.user)...)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = c.Stdin, c.Stdout, c.Stderr
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if err := limit(cmd.Process.Pid, c.Limits); err != nil {
+			zap.S().Named("privsep").Warnw("failed to limit command", "command", c.Args[0], zap.Error(err))
+		}
+
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	req := request{Args: c.Args, Env: c.Env, User: c.user, Limits: c.Limits}
+	if c.Stdin != nil {
+		var err error
+		if req.Stdin, err = io.ReadAll(c.Stdin); err != nil {
+			return err
+		}
+	}
+
+	resp, err := std.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if c.Stdout != nil {
+		c.Stdout.Write(resp.Stdout)
+	}
+	if c.Stderr != nil {
+		c.Stderr.Write(resp.Stderr)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case resp.Denied:
+		return fmt.Errorf("%w: %s", ErrNotAllowed, c.Args[0])
+	case resp.Error != "":
+		return errors.New(resp.Error)
+	case resp.Code != 0:
+		return &ExitError{Code: resp.Code}
+	}
+
+	return nil
+}
+
+// Output runs the command and returns what it wrote to stdout
+func (c *Cmd) Output() ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+
+	err := c.Run()
+
+	return out.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns what it wrote to stdout and stderr. Output
+// from the broker has stdout before stderr rather than interleaved
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+
+	err := c.Run()
+
+	return out.Bytes(), err
+}
+
+// request is a command sent to the broker
+type request struct {
+	ID    uint64   `json:"id"`
+	Args  []string `json:"args"`
+	Env   []string `json:"env,omitempty"`
+	Stdin []byte   `json:"stdin,omitempty"`
+
+	// The account to run WP-CLI as, the only command not run as root
+	User string `json:"user,omitempty"`
+
+	Limits *Limits `json:"limits,omitempty"`
+
+	// The ID of a running command to kill, rather than a command to run
+	Cancel uint64 `json:"cancel,omitempty"`
+}
+
+// response is the outcome of a command run by the broker
+type response struct {
+	ID     uint64 `json:"id"`
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+	Code   int    `json:"code"`
+
+	// The command is not allowed, or could not be started
+	Denied bool   `json:"denied,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// client sends commands to the broker, which may run several at once
+type client struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	next    uint64
+	pending map[uint64]chan response
+
+	// Set once the connection to the broker is lost
+	err error
+}
+
+// newClient starts reading the responses of the broker from the connection
+func newClient(conn net.Conn) *client {
+	c := &client{enc: json.NewEncoder(conn), pending: make(map[uint64]chan response)}
+
+	go c.read(json.NewDecoder(conn))
+
+	return c
+}
+
+// read passes every response to the call waiting for it
+func (c *client) read(dec *json.Decoder) {
+	for {
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("privsep: lost the connection to the broker: %w", err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// call sends the request to the broker and waits for its response. The broker is asked
+// to kill the command once the context is done, and still responds once it has exited
+func (c *client) call(ctx context.Context, req request) (response, error) {
+	ch := make(chan response, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return response{}, c.err
+	}
+
+	c.next++
+	req.ID = c.next
+	c.pending[req.ID] = ch
+
+	if err := c.enc.Encode(req); err != nil {
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return response{}, fmt.Errorf("privsep: failed to reach the broker: %w", err)
+	}
+	c.mu.Unlock()
+
+	var resp response
+	var ok bool
+	select {
+	case resp, ok = <-ch:
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.err == nil {
+			c.enc.Encode(request{Cancel: req.ID})
+		}
+		c.mu.Unlock()
+
+		resp, ok = <-ch
+	}
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return response{}, c.err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,721 @@
+package privsep
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// rule checks the arguments of a command the broker runs, returning why they are
+// refused. Most of the commands take options that run another program or load a file
+// of the caller's choosing as root, so only the arguments the panel uses are allowed
+type rule func(args []string) error
+
+// rules are the arguments allowed for every command in DefaultAllow. A command without a
+// rule is not run
+var rules = map[string]rule{
+	"useradd":  useradd,
+	"usermod":  usermod,
+	"adduser":  adduser,
+	"addgroup": addgroup,
+	"pw":       pw,
+
+	"nft":               exactly([]string{"-f", "-"}),
+	"iptables":          iptables,
+	"ip6tables":         iptables,
+	"iptables-restore":  exactly(nil, []string{"--noflush"}),
+	"ip6tables-restore": exactly(nil, []string{"--noflush"}),
+	"firewall-cmd":      firewallCmd,
+	"csf":               exactly([]string{"-r"}),
+	"pfctl":             pfctl,
+
+	"systemctl":  systemctl,
+	"rc-service": rcService,
+	"rc-update":  rcUpdate,
+	"sv":         sv,
+	"service":    service,
+	"sysrc":      sysrc,
+
+	"apt-get":     aptGet,
+	"needrestart": exactly([]string{"-b", "-r", "l"}),
+	"dnf":         dnf,
+
+	"nginx":      exactly([]string{"-t"}, []string{"-T"}, []string{"-s", "reload"}),
+	"postfix":    exactly([]string{"check"}, []string{"reload"}),
+	"postconf":   postconf,
+	"doveadm":    exactly([]string{"reload"}),
+	"doveconf":   doveconf,
+	"restorecon": restorecon,
+	"clamscan":   clamscan,
+	"clamdscan":  clamscan,
+	"yara":       yara,
+
+	"php-fpm":    phpFPM,
+	"php-fpm7.4": phpFPM,
+	"php-fpm8.0": phpFPM,
+	"php-fpm8.1": phpFPM,
+	"php-fpm8.2": phpFPM,
+	"php-fpm8.3": phpFPM,
+	"php-fpm8.4": phpFPM,
+
+	"rctl": rctl,
+}
+
+// ErrArguments is returned for an allowed command the broker does not run with the
+// arguments it was given
+var ErrArguments = errors.New("privsep: the broker does not run the command with these arguments")
+
+var (
+	// word matches the users, groups and services the broker is given, which can then
+	// never be taken for an option or a path
+	word = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@:-]*\$?$`)
+
+	// pkg matches a package, optionally with its version, which unlike a path to a
+	// package file cannot install something of the caller's own
+	pkg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._:~-]*(=[A-Za-z0-9+._:~-]+)?$`)
+
+	// setting matches the name of a setting of Postfix or Dovecot
+	setting = regexp.MustCompile(`^[a-z0-9_/]+$`)
+)
+
+// privilegedGroups are the groups whose members can become root or read what only root
+// can, which users are never added to
+var privilegedGroups = []string{"root", "wheel", "sudo", "admin", "adm", "shadow", "disk", "kmem", "docker", "lxd", "operator"}
+
+// refuse returns the error for arguments the broker does not run
+func refuse(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrArguments, fmt.Sprintf(format, args...))
+}
+
+// check returns an error unless the rule of the command allows the arguments
+func check(path string, args []string) error {
+	r, ok := rules[filepath.Base(path)]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotAllowed, path)
+	}
+
+	return r(args)
+}
+
+// exactly allows nothing but the lists of arguments
+func exactly(allowed ...[]string) rule {
+	return func(args []string) error {
+		for _, a := range allowed {
+			if slices.Equal(args, a) {
+				return nil
+			}
+		}
+
+		return refuse("%s", strings.Join(args, " "))
+	}
+}
+
+// options splits the arguments into the options in flags, by whether they take a value,
+// and the arguments left. Options take their value as the next argument or after an =.
+// Any other option is refused
+func options(args []string, flags map[string]bool) (map[string][]string, []string, error) {
+	set := map[string][]string{}
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rest = append(rest, arg)
+			continue
+		}
+
+		flag, value, inline := strings.Cut(arg, "=")
+		takes, ok := flags[flag]
+		if !ok || (inline && !takes) {
+			return nil, nil, refuse("the option %s", arg)
+		}
+
+		if takes && !inline {
+			if i+1 == len(args) {
+				return nil, nil, refuse("the option %s without a value", arg)
+			}
+			i++
+			value = args[i]
+		}
+		set[flag] = append(set[flag], value)
+	}
+
+	return set, rest, nil
+}
+
+// unprivileged returns an error if the user is root or anyone else with its UID
+func unprivileged(username string) error {
+	if !word.MatchString(username) || username == "root" {
+		return refuse("the user %q", username)
+	}
+
+	if u, err := user.Lookup(username); err == nil && u.Uid == "0" {
+		return refuse("the user %s, which has the UID of root", username)
+	}
+
+	return nil
+}
+
+// ordinary returns an error unless every group in the comma separated list is one that
+// does not grant privileges
+func ordinary(list string) error {
+	for _, g := range strings.Split(list, ",") {
+		if !word.MatchString(g) || slices.Contains(privilegedGroups, g) {
+			return refuse("the group %q", g)
+		}
+
+		if group, err := user.LookupGroup(g); err == nil && group.Gid == "0" {
+			return refuse("the group %s, which has the GID of root", g)
+		}
+	}
+
+	return nil
+}
+
+// absolute returns an error unless the path is absolute and clean, so that it cannot
+// be taken for an option or walk out of where it is checked to be
+func absolute(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return refuse("the path %q", path)
+	}
+
+	return nil
+}
+
+// each runs fn for every value given to any of the options
+func each(set map[string][]string, fn func(string) error, flags ...string) error {
+	for _, flag := range flags {
+		for _, v := range set[flag] {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// useradd only creates system users of shadow-utils, which cannot be given a UID such
+// as that of root or be put in a group granting privileges
+func useradd(args []string) error {
+	set, rest, err := options(args, map[string]bool{
+		"--system": false, "-r": false, "--no-create-home": false, "-M": false,
+		"--shell": true, "-s": true, "--home-dir": true, "-d": true, "--groups": true, "-G": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 1 {
+		return refuse("useradd creates one user")
+	}
+	if err := each(set, absolute, "--shell", "-s", "--home-dir", "-d"); err != nil {
+		return err
+	}
+	if err := each(set, ordinary, "--groups", "-G"); err != nil {
+		return err
+	}
+
+	return unprivileged(rest[0])
+}
+
+// usermod only adds a user to groups and removes it from them
+func usermod(args []string) error {
+	set, rest, err := options(args, map[string]bool{
+		"--append": false, "-a": false, "--remove": false, "-r": false, "--groups": true, "-G": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 1 || len(set["--groups"])+len(set["-G"]) != 1 {
+		return refuse("usermod only changes the groups of one user")
+	}
+	if len(set["--append"])+len(set["-a"])+len(set["--remove"])+len(set["-r"]) != 1 {
+		return refuse("usermod either adds to the groups or removes from them, keeping the others")
+	}
+	if err := each(set, ordinary, "--groups", "-G"); err != nil {
+		return err
+	}
+
+	return unprivileged(rest[0])
+}
+
+// adduser only creates system users of BusyBox
+func adduser(args []string) error {
+	set, rest, err := options(args, map[string]bool{
+		"-S": false, "-D": false, "-H": false, "-s": true, "-h": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 1 {
+		return refuse("adduser creates one user")
+	}
+	if err := each(set, absolute, "-s", "-h"); err != nil {
+		return err
+	}
+
+	return unprivileged(rest[0])
+}
+
+// addgroup only adds a user to a group, as BusyBox does given both
+func addgroup(args []string) error {
+	if len(args) != 2 {
+		return refuse("addgroup only adds a user to a group")
+	}
+
+	if err := unprivileged(args[0]); err != nil {
+		return err
+	}
+
+	return ordinary(args[1])
+}
+
+// pw only creates users and changes the members of groups on FreeBSD
+func pw(args []string) error {
+	if len(args) == 0 {
+		return refuse("pw without a command")
+	}
+
+	switch args[0] {
+	case "useradd":
+		set, rest, err := options(args[1:], map[string]bool{"-n": true, "-d": true, "-s": true, "-G": true})
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 || len(set["-n"]) != 1 {
+			return refuse("pw useradd creates one user given with -n")
+		}
+		if err := each(set, absolute, "-d", "-s"); err != nil {
+			return err
+		}
+		if err := each(set, ordinary, "-G"); err != nil {
+			return err
+		}
+
+		return unprivileged(set["-n"][0])
+	case "groupmod":
+		set, rest, err := options(args[1:], map[string]bool{"-m": true, "-d": true})
+		if err != nil {
+			return err
+		}
+		members := append(set["-m"], set["-d"]...)
+		if len(rest) != 1 || len(members) != 1 {
+			return refuse("pw groupmod only adds users to one group or removes them from it")
+		}
+		if err := ordinary(rest[0]); err != nil {
+			return err
+		}
+
+		for _, u := range strings.Split(members[0], ",") {
+			if err := unprivileged(u); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return refuse("pw %s", args[0])
+}
+
+// iptables only checks for and inserts the jump to the chain of the panel. Options such
+// as --modprobe run a program of the caller's choosing
+func iptables(args []string) error {
+	return exactly(
+		[]string{"-C", "INPUT", "-j", "COSMICPANEL"},
+		[]string{"-I", "INPUT", "1", "-j", "COSMICPANEL"},
+	)(args)
+}
+
+// firewallCmd only opens ports and blocks addresses at runtime
+func firewallCmd(args []string) error {
+	if len(args) != 1 {
+		return refuse("firewall-cmd changes one rule at a time")
+	}
+
+	if args[0] == "--state" || args[0] == "--reload" {
+		return nil
+	}
+
+	for _, prefix := range []string{"--add-port=", "--remove-port=", "--add-rich-rule=", "--remove-rich-rule="} {
+		if strings.HasPrefix(args[0], prefix) {
+			return nil
+		}
+	}
+
+	return refuse("firewall-cmd %s", args[0])
+}
+
+// pfctl only loads the rules of the anchor of the panel from stdin
+func pfctl(args []string) error {
+	if len(args) == 4 && args[0] == "-a" && (args[1] == "cosmicpanel" || strings.HasPrefix(args[1], "cosmicpanel/")) && args[2] == "-f" && args[3] == "-" {
+		return nil
+	}
+
+	return refuse("pfctl %s", strings.Join(args, " "))
+}
+
+// unit returns an error unless the unit or service is named rather than given as a path,
+// which systemctl enable and link would install
+func unit(s string) error {
+	if !word.MatchString(s) {
+		return refuse("the service %q", s)
+	}
+
+	return nil
+}
+
+// properties are the resource controls systemctl set-property may change, which is what
+// throttling and reserving resources for accounts sets on their slices
+var properties = []string{
+	"CPUQuota", "CPUWeight", "StartupCPUWeight", "IOWeight", "StartupIOWeight",
+	"MemoryMin", "MemoryLow", "MemoryHigh", "MemoryMax", "MemorySwapMax", "TasksMax",
+}
+
+// systemctl only manages services and the resources of slices. link, edit and the
+// environment of the manager are refused, as is a unit given as a path
+func systemctl(args []string) error {
+	set, rest, err := options(args, map[string]bool{"--quiet": false, "-q": false, "--now": false, "--runtime": false, "--no-block": false})
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return refuse("systemctl without a command")
+	}
+
+	verb, units := rest[0], rest[1:]
+	switch verb {
+	case "daemon-reload":
+		if len(units) != 0 {
+			return refuse("systemctl daemon-reload takes no units")
+		}
+		return nil
+	case "start", "stop", "restart", "reload", "try-restart", "reload-or-restart", "enable", "disable", "is-active", "is-enabled", "status":
+		if len(units) == 0 {
+			return refuse("systemctl %s without a unit", verb)
+		}
+		for _, u := range units {
+			if err := unit(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "set-property":
+		if len(units) < 2 || len(set["--runtime"]) == 0 {
+			return refuse("systemctl set-property only changes a unit at runtime")
+		}
+		if err := unit(units[0]); err != nil {
+			return err
+		}
+		for _, p := range units[1:] {
+			if property, _, _ := strings.Cut(p, "="); !slices.Contains(properties, property) {
+				return refuse("the property %q", p)
+			}
+		}
+		return nil
+	}
+
+	return refuse("systemctl %s", verb)
+}
+
+// rcService only controls OpenRC services
+func rcService(args []string) error {
+	if len(args) != 2 || !slices.Contains([]string{"start", "stop", "restart", "reload", "status"}, args[1]) {
+		return refuse("rc-service %s", strings.Join(args, " "))
+	}
+
+	return unit(args[0])
+}
+
+// rcUpdate only adds services to runlevels and removes them
+func rcUpdate(args []string) error {
+	if len(args) < 2 || len(args) > 3 || (args[0] != "add" && args[0] != "del") {
+		return refuse("rc-update %s", strings.Join(args, " "))
+	}
+
+	for _, a := range args[1:] {
+		if err := unit(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sv only controls runit services, by name or by their directory. -v is refused, as it
+// runs the check script of the directory
+func sv(args []string) error {
+	if len(args) != 2 || !slices.Contains([]string{"start", "stop", "restart", "reload", "status", "up", "down"}, args[0]) {
+		return refuse("sv %s", strings.Join(args, " "))
+	}
+
+	if filepath.IsAbs(args[1]) {
+		return absolute(args[1])
+	}
+
+	return unit(args[1])
+}
+
+// service only controls services of rc.d and the init scripts of Linux
+func service(args []string) error {
+	verbs := []string{"start", "stop", "restart", "reload", "status", "onestart", "onestop", "onerestart", "onestatus"}
+	if len(args) != 2 || !slices.Contains(verbs, args[1]) {
+		return refuse("service %s", strings.Join(args, " "))
+	}
+
+	return unit(args[0])
+}
+
+// enableVar matches the rc.conf variable enabling a service, the only one sysrc sets
+var enableVar = regexp.MustCompile(`^[A-Za-z0-9_]+_enable$`)
+
+// sysrc only enables services in rc.conf and removes that again. Other variables, such
+// as the flags of a service, are refused
+func sysrc(args []string) error {
+	if len(args) == 2 && args[0] == "-x" && enableVar.MatchString(args[1]) {
+		return nil
+	}
+
+	if len(args) == 1 {
+		if variable, value, _ := strings.Cut(args[0], "="); enableVar.MatchString(variable) && (value == "YES" || value == "NO") {
+			return nil
+		}
+	}
+
+	return refuse("sysrc %s", strings.Join(args, " "))
+}
+
+// dpkgOptions are the only options apt-get is given with -o, keeping changed
+// configuration files. Others, such as APT::Update::Pre-Invoke, run commands
+var dpkgOptions = []string{"Dpkg::Options::=--force-confdef", "Dpkg::Options::=--force-confold"}
+
+// aptGet only refreshes the package lists, simulates an upgrade and upgrades installed
+// packages from the repositories
+func aptGet(args []string) error {
+	set, rest, err := options(args, map[string]bool{
+		"-q": false, "-qq": false, "-y": false, "-s": false, "--only-upgrade": false, "-o": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, o := range set["-o"] {
+		if !slices.Contains(dpkgOptions, o) {
+			return refuse("the option -o %s", o)
+		}
+	}
+
+	if len(rest) == 0 {
+		return refuse("apt-get without a command")
+	}
+
+	switch rest[0] {
+	case "update", "dist-upgrade":
+		if len(rest) != 1 {
+			return refuse("apt-get %s takes no packages", rest[0])
+		}
+		if rest[0] == "dist-upgrade" && len(set["-s"]) == 0 {
+			return refuse("apt-get dist-upgrade is only simulated")
+		}
+		return nil
+	case "install":
+		if len(set["--only-upgrade"]) == 0 {
+			return refuse("apt-get install only upgrades installed packages")
+		}
+		for _, p := range rest[1:] {
+			if !pkg.MatchString(p) {
+				return refuse("the package %q", p)
+			}
+		}
+		return nil
+	}
+
+	return refuse("apt-get %s", rest[0])
+}
+
+// dnf only lists security advisories, applies them and checks what needs restarting.
+// Options such as --setopt and --installroot are refused
+func dnf(args []string) error {
+	set, rest, err := options(args, map[string]bool{
+		"-q": false, "-y": false, "--refresh": false, "--security": false, "-r": false, "-s": false,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return refuse("dnf without a command")
+	}
+
+	switch {
+	case slices.Equal(rest, []string{"updateinfo", "list"}) && len(set["--security"]) > 0:
+		return nil
+	case rest[0] == "needs-restarting" && len(rest) == 1:
+		return nil
+	case rest[0] == "upgrade" && len(set["--security"]) > 0:
+		for _, p := range rest[1:] {
+			if !pkg.MatchString(p) {
+				return refuse("the package %q", p)
+			}
+		}
+		return nil
+	}
+
+	return refuse("dnf %s", strings.Join(rest, " "))
+}
+
+// tlsSetting matches the settings of Postfix the TLS policy changes
+var tlsSetting = regexp.MustCompile(`^(smtpd_tls|smtp_tls|tls)_[a-z0-9_]+$`)
+
+// postconf reads any setting but only changes those of TLS. Others, such as
+// mailbox_command, run commands
+func postconf(args []string) error {
+	if len(args) == 2 && args[0] == "-h" && setting.MatchString(args[1]) {
+		return nil
+	}
+
+	if len(args) < 2 || args[0] != "-e" {
+		return refuse("postconf %s", strings.Join(args, " "))
+	}
+
+	for _, s := range args[1:] {
+		if name, _, ok := strings.Cut(s, "="); !ok || !tlsSetting.MatchString(name) {
+			return refuse("the setting %q", s)
+		}
+	}
+
+	return nil
+}
+
+// doveconf only prints the configuration and single settings of Dovecot
+func doveconf(args []string) error {
+	if slices.Equal(args, []string{"-n"}) {
+		return nil
+	}
+
+	if len(args) == 2 && args[0] == "-h" && setting.MatchString(args[1]) {
+		return nil
+	}
+
+	return refuse("doveconf %s", strings.Join(args, " "))
+}
+
+// restorecon only relabels the paths it is given
+func restorecon(args []string) error {
+	_, rest, err := options(args, map[string]bool{"-R": false, "-F": false})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range rest {
+		if err := absolute(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clamscan only reports the files of a list that are infected. Options such as --move
+// and --remove would change files as root, and --database load signatures of the caller
+func clamscan(args []string) error {
+	set, rest, err := options(args, map[string]bool{"--no-summary": false, "--infected": false, "--file-list": true})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 0 || len(set["--file-list"]) != 1 {
+		return refuse("clamscan only scans a list of files")
+	}
+
+	return absolute(set["--file-list"][0])
+}
+
+// yara only matches the files of a list against rule files
+func yara(args []string) error {
+	_, rest, err := options(args, map[string]bool{"--no-warnings": false, "--scan-list": false})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) < 2 {
+		return refuse("yara without rules or a list of files")
+	}
+
+	for _, p := range rest {
+		if err := absolute(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fpmConfigs are the directories the configuration PHP-FPM tests may be in
+var fpmConfigs = []string{"/etc/", "/usr/local/etc/"}
+
+// phpFPM only tests the configuration, optionally of the file given with -y. Options
+// such as -d would set auto_prepend_file and run a script as root
+func phpFPM(args []string) error {
+	set, rest, err := options(args, map[string]bool{"-t": false, "-tt": false, "-y": true, "--fpm-config": true})
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 0 || len(set["-t"])+len(set["-tt"]) == 0 {
+		return refuse("php-fpm only tests its configuration")
+	}
+
+	return each(set, func(path string) error {
+		if err := absolute(path); err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(fpmConfigs, func(dir string) bool { return strings.HasPrefix(path, dir) }) {
+			return refuse("the configuration %s, which is not in %s", path, strings.Join(fpmConfigs, ", "))
+		}
+		return nil
+	}, "-y", "--fpm-config")
+}
+
+// MinUID is the lowest UID of the users of accounts. Users below it, and root, belong to
+// the system and are never limited or run as
+const MinUID = 1000
+
+// nobody is the UID of the unprivileged user of Linux and FreeBSD, which is a system user
+// despite being above MinUID
+const nobody = 65534
+
+// rctl only adds and removes rules limiting the users of accounts, never root or a
+// system user
+func rctl(args []string) error {
+	if len(args) != 2 || (args[0] != "-a" && args[0] != "-r") {
+		return refuse("rctl only adds and removes rules")
+	}
+
+	parts := strings.Split(args[1], ":")
+	if parts[0] != "user" || len(parts) < 2 || (args[0] == "-a" && len(parts) != 4) {
+		return refuse("the rule %q, which does not limit a user", args[1])
+	}
+
+	uid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		u, lerr := user.Lookup(parts[1])
+		if lerr != nil {
+			return refuse("the user %q", parts[1])
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if uid < MinUID || uid >= nobody {
+		return refuse("the rule %q, which limits root or a system user", args[1])
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package privsep
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		command string
+		args    string
+		allowed bool
+	}{
+		// System users
+		{"useradd", "--system --no-create-home --shell /usr/sbin/nologin cp_alice", true},
+		{"useradd", "-r -M -s /sbin/nologin -d /home/cp_alice -G www-data,sftp cp_alice", true},
+		{"useradd", "--groups=www-data cp_alice", true},
+		{"useradd", "-o -u 0 cp_alice", false},
+		{"useradd", "-u 0 cp_alice", false},
+		{"useradd", "--non-unique cp_alice", false},
+		{"useradd", "-G wheel cp_alice", false},
+		{"useradd", "-G www-data,sudo cp_alice", false},
+		{"useradd", "--groups=docker cp_alice", false},
+		{"useradd", "-s bin/sh cp_alice", false},
+		{"useradd", "-d /home/../root cp_alice", false},
+		{"useradd", "root", false},
+		{"useradd", "cp_alice cp_bob", false},
+		{"useradd", "-s", false},
+		{"useradd", "--system=yes cp_alice", false},
+		{"usermod", "-a -G sftp cp_alice", true},
+		{"usermod", "--remove --groups sftp cp_alice", true},
+		{"usermod", "-a -G sudo cp_alice", false},
+		{"usermod", "-a -G shadow,sftp cp_alice", false},
+		{"usermod", "-G sftp cp_alice", false},
+		{"usermod", "-a -r -G sftp cp_alice", false},
+		{"usermod", "-o -u 0 cp_alice", false},
+		{"usermod", "-a -G sftp root", false},
+		{"usermod", "-a -G sftp -- cp_alice", false},
+		{"adduser", "-S -D -H -s /sbin/nologin cp_alice", true},
+		{"adduser", "-S -G wheel cp_alice", false},
+		{"adduser", "-S -u 0 cp_alice", false},
+		{"addgroup", "cp_alice sftp", true},
+		{"addgroup", "cp_alice wheel", false},
+		{"addgroup", "root sftp", false},
+		{"addgroup", "-S cp_alice", false},
+		{"pw", "useradd -n cp_alice -d /home/cp_alice -s /usr/sbin/nologin -G sftp", true},
+		{"pw", "useradd -n cp_alice -u 0 -o", false},
+		{"pw", "useradd -n cp_alice -G wheel", false},
+		{"pw", "useradd -n root", false},
+		{"pw", "groupmod sftp -m cp_alice", true},
+		{"pw", "groupmod sftp -d cp_alice,cp_bob", true},
+		{"pw", "groupmod wheel -m cp_alice", false},
+		{"pw", "groupmod sftp -m cp_alice,root", false},
+		{"pw", "usermod root -u 0", false},
+		{"pw", "", false},
+
+		// Firewalls
+		{"nft", "-f -", true},
+		{"nft", "-f /tmp/rules", false},
+		{"iptables", "-C INPUT -j COSMICPANEL", true},
+		{"ip6tables", "-I INPUT 1 -j COSMICPANEL", true},
+		{"iptables", "--modprobe=/tmp/x -C INPUT -j COSMICPANEL", false},
+		{"iptables", "-F", false},
+		{"iptables-restore", "", true},
+		{"iptables-restore", "--noflush", true},
+		{"iptables-restore", "--modprobe=/tmp/x", false},
+		{"firewall-cmd", "--add-port=443/tcp", true},
+		{"firewall-cmd", "--reload", true},
+		{"firewall-cmd", "--permanent --add-port=443/tcp", false},
+		{"firewall-cmd", "--direct --passthrough ipv4 -F", false},
+		{"csf", "-r", true},
+		{"csf", "-x", false},
+		{"pfctl", "-a cosmicpanel/blocks -f -", true},
+		{"pfctl", "-a other -f -", false},
+		{"pfctl", "-d", false},
+
+		// Services
+		{"systemctl", "restart nginx.service", true},
+		{"systemctl", "--quiet is-active php8.2-fpm", true},
+		{"systemctl", "daemon-reload", true},
+		{"systemctl", "set-property --runtime user-1001.slice CPUQuota=50%", true},
+		{"systemctl", "set-property --runtime user-1001.slice MemoryMax=1G TasksMax=512", true},
+		{"systemctl", "set-property user-1001.slice CPUQuota=50%", false},
+		{"systemctl", "set-property --runtime user-1001.slice ExecStart=/tmp/x", false},
+		{"systemctl", "set-property --runtime user-1001.slice Delegate=yes", false},
+		{"systemctl", "set-property --runtime user-1001.slice", false},
+		{"systemctl", "set-property --runtime /tmp/x.service CPUQuota=50%", false},
+		{"systemctl", "link /tmp/evil.service", false},
+		{"systemctl", "enable /tmp/evil.service", false},
+		{"systemctl", "set-environment LD_PRELOAD=/tmp/x.so", false},
+		{"systemctl", "daemon-reload nginx", false},
+		{"systemctl", "restart", false},
+		{"systemctl", "", false},
+		{"rc-service", "nginx reload", true},
+		{"rc-service", "nginx zap", false},
+		{"rc-update", "add nginx default", true},
+		{"rc-update", "add /tmp/x", false},
+		{"sv", "restart nginx", true},
+		{"sv", "restart /etc/service/nginx", true},
+		{"sv", "restart /etc/service/../../tmp/x", false},
+		{"sv", "-v restart nginx", false},
+		{"service", "nginx onerestart", true},
+		{"service", "nginx rcvar", false},
+		{"sysrc", "nginx_enable=YES", true},
+		{"sysrc", "-x nginx_enable", true},
+		{"sysrc", "nginx_flags=-c /tmp/x", false},
+		{"sysrc", "nginx_enable=MAYBE", false},
+
+		// Security updates
+		{"apt-get", "-qq update", true},
+		{"apt-get", "-s -q dist-upgrade", true},
+		{"apt-get", "-y -o Dpkg::Options::=--force-confold install --only-upgrade openssl libssl3=3.0.2-0ubuntu1.15", true},
+		{"apt-get", "-y dist-upgrade", false},
+		{"apt-get", "-y install openssl", false},
+		{"apt-get", "-y install --only-upgrade ./evil.deb", false},
+		{"apt-get", "-o APT::Update::Pre-Invoke::=/tmp/x update", false},
+		{"apt-get", "remove openssl", false},
+		{"needrestart", "-b -r l", true},
+		{"needrestart", "-r a", false},
+		{"dnf", "-q updateinfo list --security", true},
+		{"dnf", "-y upgrade --security openssl", true},
+		{"dnf", "needs-restarting -r", true},
+		{"dnf", "updateinfo list", false},
+		{"dnf", "-y upgrade openssl", false},
+		{"dnf", "--setopt=installonly_limit=0 upgrade --security", false},
+		{"dnf", "-y upgrade --security /tmp/evil.rpm", false},
+
+		// TLS policy, SELinux labels and malware scans
+		{"nginx", "-t", true},
+		{"nginx", "-s reload", true},
+		{"nginx", "-c /tmp/nginx.conf", false},
+		{"nginx", "-g daemon off;", false},
+		{"postfix", "reload", true},
+		{"postfix", "stop", false},
+		{"postconf", "-h smtpd_tls_protocols", true},
+		{"postconf", "-e smtpd_tls_protocols=>=TLSv1.2 smtpd_tls_ciphers=high", true},
+		{"postconf", "-e mailbox_command=/tmp/x", false},
+		{"postconf", "-e smtpd_tls_protocols", false},
+		{"postconf", "-n", false},
+		{"doveadm", "reload", true},
+		{"doveadm", "exec /bin/sh", false},
+		{"doveconf", "-n", true},
+		{"doveconf", "-h ssl_min_protocol", true},
+		{"doveconf", "-c /tmp/x", false},
+		{"restorecon", "-R -F /home/cp_alice", true},
+		{"restorecon", "-R home/cp_alice", false},
+		{"clamscan", "--no-summary --infected --file-list /var/lib/cosmicpanel/scan.list", true},
+		{"clamdscan", "--infected --file-list=/var/lib/cosmicpanel/scan.list", true},
+		{"clamscan", "--infected --remove --file-list /tmp/list", false},
+		{"clamscan", "--database /tmp/db --file-list /tmp/list", false},
+		{"clamscan", "/home", false},
+		{"yara", "--no-warnings --scan-list /etc/cosmicpanel/rules.yar /tmp/list", true},
+		{"yara", "/etc/cosmicpanel/rules.yar", false},
+		{"yara", "-x module=/tmp/x /etc/cosmicpanel/rules.yar /tmp/list", false},
+
+		// PHP-FPM
+		{"php-fpm", "-t", true},
+		{"php-fpm8.2", "-t -y /etc/php/8.2/fpm/php-fpm.conf", true},
+		{"php-fpm", "-tt --fpm-config=/usr/local/etc/php-fpm.conf", true},
+		{"php-fpm", "-t -y /tmp/php-fpm.conf", false},
+		{"php-fpm", "-t -y /home/cp_alice/php-fpm.conf", false},
+		{"php-fpm", "-t -y /etc/../tmp/php-fpm.conf", false},
+		{"php-fpm", "-t -y etc/php-fpm.conf", false},
+		{"php-fpm", "-t -d auto_prepend_file=/tmp/x.php", false},
+		{"php-fpm", "-y /etc/php-fpm.conf", false},
+		{"php-fpm", "--daemonize", false},
+
+		// Throttling accounts on FreeBSD
+		{"rctl", "-a user:1000:pcpu:deny=50", true},
+		{"rctl", "-a user:65533:pcpu:deny=50", true},
+		{"rctl", "-r user:1001", true},
+		{"rctl", "-r user:1001:pcpu", true},
+		{"rctl", "-a user:999:pcpu:deny=50", false},
+		{"rctl", "-a user:0:pcpu:deny=1", false},
+		{"rctl", "-a user:root:pcpu:deny=1", false},
+		{"rctl", "-a user:65534:pcpu:deny=50", false},
+		{"rctl", "-a user:-1:pcpu:deny=50", false},
+		{"rctl", "-a user:1001", false},
+		{"rctl", "-a process:1001:pcpu:deny=50", false},
+		{"rctl", "-a loginclass:default:pcpu:deny=50", false},
+		{"rctl", "-r user:cp-no-such-user", false},
+		{"rctl", "-l user:1001", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command+" "+tt.args, func(t *testing.T) {
+			err := check("/usr/sbin/"+tt.command, strings.Fields(tt.args))
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed {
+				if err == nil {
+					t.Errorf("allowed")
+				} else if !errors.Is(err, ErrArguments) {
+					t.Errorf("refused with %v, not ErrArguments", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRulesCoverDefaultAllow(t *testing.T) {
+	for _, name := range DefaultAllow {
+		if _, ok := rules[name]; !ok {
+			t.Errorf("%s has no rule", name)
+		}
+	}
+
+	if err := check("/bin/sh", []string{"-c", "id"}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("sh: got %v, want ErrNotAllowed", err)
+	}
+}
@@ -0,0 +1,65 @@
+package privsep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// wpCLI is the only command the broker runs as an account, found in safePath
+const wpCLI = "wp"
+
+// ErrSystemUser is returned when running WP-CLI as root or a system user
+var ErrSystemUser = errors.New("privsep: WP-CLI is only run as the user of an account")
+
+// WP returns WP-CLI with the arguments, run as the user of the account. It is run by
+// switching to the user directly rather than through runuser, which the broker does not
+// run since it can become any user
+func WP(ctx context.Context, account string, arg ...string) *Cmd {
+	c := CommandContext(ctx, wpCLI, arg...)
+	c.user = account
+
+	return c
+}
+
+// credential returns the user, groups and home directory to run a command as the
+// account, refusing root and system users
+func credential(account string) (*syscall.Credential, string, error) {
+	u, err := user.Lookup(account)
+	if err != nil {
+		return nil, "", fmt.Errorf("privsep: %w", err)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, "", err
+	}
+	if uid < MinUID || uid >= nobody {
+		return nil, "", fmt.Errorf("%w: %s has the UID %d", ErrSystemUser, account, uid)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, "", err
+	}
+	if gid == 0 {
+		return nil, "", fmt.Errorf("%w: %s is in the group of root", ErrSystemUser, account)
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, "", err
+	}
+
+	groups := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if g, err := strconv.Atoi(id); err == nil && g != 0 {
+			groups = append(groups, uint32(g))
+		}
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, u.HomeDir, nil
+}
@@ -0,0 +1,250 @@
+package propagation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// target is a server the change is checked at
+type target struct {
+	address    string
+	nameserver string
+}
+
+// check asks the resolvers and the nameservers the zone is delegated to for the records
+// of the change, and when those still answering with something else should stop
+func (c *checker) check(ctx context.Context, change Change, now time.Time) Change {
+	targets, err := nameservers(ctx, change.Zone)
+
+	servers := make([]Server, len(targets)+len(c.config.Resolvers))
+	if err != nil {
+		// Without the nameservers the resolvers are still checked, but the change is not
+		// known to be served everywhere
+		servers = append(servers, Server{Nameserver: change.Zone, Status: Unreachable, Values: []string{}, Error: err.Error()})
+	}
+
+	for _, r := range c.config.Resolvers {
+		targets = append(targets, target{address: r})
+	}
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers[i] = c.ask(ctx, change, t, now)
+		}()
+	}
+
+	// The negative caching TTL is read from the zone as its nameservers serve it
+	for _, t := range targets {
+		if t.nameserver == "" {
+			break
+		}
+
+		if ttl, err := negativeTTL(ctx, t.address, change.Zone); err == nil {
+			change.NegativeTTL = ttl
+			break
+		}
+	}
+
+	wg.Wait()
+
+	change.Servers = servers
+	change.Checks++
+	change.Checked = now
+	change.Expected = expected(servers)
+
+	return change
+}
+
+// ask asks the server for the records of the change
+func (c *checker) ask(ctx context.Context, change Change, t target, now time.Time) Server {
+	s := Server{Address: t.address, Nameserver: t.nameserver, Values: []string{}}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	r, err := exchange(ctx, t.address, change.Name, types[change.Type], t.nameserver == "")
+	if err == nil && r.RCode != rcodeSuccess && r.RCode != rcodeNXDomain {
+		err = fmt.Errorf("the server answered with response code %d", r.RCode)
+	}
+	if err != nil {
+		s.Status, s.Error = Unreachable, err.Error()
+		return s
+	}
+
+	// A CNAME at the name is answered for any type, which is an answer other than the
+	// change all the same
+	var ttl uint32
+	var found bool
+	for _, rr := range r.Answer {
+		if rr.Name != change.Name {
+			continue
+		}
+
+		if rr.Type == types[change.Type] {
+			s.Values = append(s.Values, rr.Value)
+		} else {
+			s.Values = append(s.Values, rr.Value+" ("+typeName(rr.Type)+")")
+		}
+
+		if !found || rr.TTL < ttl {
+			ttl, found = rr.TTL, true
+		}
+	}
+	s.Values = canonical(change.Type, s.Values)
+
+	switch {
+	case slices.Equal(s.Values, change.Values):
+		s.Status = Current
+	case t.nameserver != "":
+		s.Status = Pending
+	case found:
+		// Resolvers count down the TTL of what they cached, which is how long they keep
+		// answering with it
+		s.Status = Stale
+		expires := now.Add(time.Duration(ttl) * time.Second)
+		s.Expires = &expires
+	default:
+		// A negative answer carries the SOA record of the zone, whose TTL counts down how
+		// long the resolver keeps answering that nothing exists, up to the minimum of the
+		// record
+		s.Status = Negative
+		if soa, ok := r.soa(); ok {
+			expires := now.Add(time.Duration(soa.Negative) * time.Second)
+			s.Expires = &expires
+		}
+	}
+
+	return s
+}
+
+// nameservers returns an address of each nameserver the zone is delegated to, preferring
+// IPv4 as the server may not reach IPv6 addresses
+func nameservers(ctx context.Context, zone string) ([]target, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	records, err := net.DefaultResolver.LookupNS(ctx, zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the nameservers of %s: %w", zone, err)
+	}
+
+	var targets []target
+	for _, ns := range records {
+		host := normalize(ns.Host)
+
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return addrs[i].Unmap().Is4() && !addrs[j].Unmap().Is4()
+		})
+
+		targets = append(targets, target{address: addrs[0].Unmap().String(), nameserver: host})
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("none of the nameservers of %s resolve", zone)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].nameserver < targets[j].nameserver
+	})
+
+	return targets, nil
+}
+
+// negativeTTL returns how long resolvers may cache that a name in the zone does not exist,
+// which is the lower of the TTL and the minimum of its SOA record
+func negativeTTL(ctx context.Context, server string, zone string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	r, err := exchange(ctx, server, zone, types["SOA"], false)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, rr := range r.Answer {
+		if rr.Type == types["SOA"] {
+			return int(rr.Negative), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s has no SOA record", zone)
+}
+
+// expected returns when every resolver should answer with the change, which is unknown
+// while a server has not been updated, did not answer or did not say how long it caches
+func expected(servers []Server) *time.Time {
+	var latest time.Time
+
+	for _, s := range servers {
+		switch {
+		case s.Status == Current:
+			continue
+		case s.Expires == nil:
+			return nil
+		case s.Expires.After(latest):
+			latest = *s.Expires
+		}
+	}
+
+	if latest.IsZero() {
+		return nil
+	}
+
+	return &latest
+}
+
+// canonical returns the values as servers are compared by, sorted with names lower case
+// without a trailing dot
+func canonical(typ string, values []string) []string {
+	list := make([]string, 0, len(values))
+
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+
+		switch typ {
+		case "CNAME", "NS", "PTR":
+			v = normalize(v)
+		case "MX":
+			var pref int
+			var exchange string
+			if _, err := fmt.Sscanf(v, "%d %s", &pref, &exchange); err == nil {
+				v = fmt.Sprintf("%d %s", pref, normalize(exchange))
+			}
+		case "A", "AAAA":
+			if ip := net.ParseIP(v); ip != nil {
+				v = ip.String()
+			}
+		}
+
+		list = append(list, v)
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// typeName returns the name of the record type
+func typeName(typ uint16) string {
+	for name, t := range types {
+		if t == typ {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("TYPE%d", typ)
+}
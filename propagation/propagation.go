@@ -0,0 +1,434 @@
+package propagation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// States of a change
+const (
+	// Checking is a change that has not reached every server yet
+	Checking = "checking"
+
+	// Propagated is a change every server answers with
+	Propagated = "propagated"
+
+	// Incomplete is a change that had not reached every server when checking it stopped
+	Incomplete = "incomplete"
+)
+
+// What a server answers for a changed record
+const (
+	// Current is the answer of the change
+	Current = "current"
+
+	// Pending is a nameserver that has not been updated by the provider yet
+	Pending = "pending"
+
+	// Stale is a resolver answering from what it cached before the change, until its
+	// TTL runs out
+	Stale = "stale"
+
+	// Negative is a resolver that cached that the record did not exist, which it answers
+	// with until the negative caching TTL of the zone runs out
+	Negative = "negative"
+
+	// Unreachable is a server that did not answer
+	Unreachable = "unreachable"
+)
+
+var (
+	// ErrNotConfigured is returned when checking changes before Configure is called
+	ErrNotConfigured = errors.New("propagation: not configured")
+
+	// ErrNotFound is returned for a record whose changes are not checked
+	ErrNotFound = errors.New("propagation: no change of the record was checked")
+
+	// ErrUnsupported is returned for records of a type that cannot be checked
+	ErrUnsupported = errors.New("propagation: records of the type cannot be checked")
+)
+
+// Change is a change of the records of a type at a name and how far it reached
+type Change struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Zone string `json:"zone"`
+
+	// The values servers should answer with, empty when the records were removed
+	Values []string `json:"values"`
+
+	Changed time.Time `json:"changed"`
+	State   string    `json:"state"`
+	Checks  int       `json:"checks"`
+	Checked time.Time `json:"checked,omitempty"`
+
+	// How long resolvers may cache that a name or record does not exist, from the SOA
+	// record of the zone. A record added where resolvers were asked for it before is
+	// answered as missing for up to this long
+	NegativeTTL int `json:"negative_ttl"`
+
+	// When every resolver should answer with the change, from how long they may keep what
+	// they cached. Unknown while a nameserver has not been updated or did not answer
+	Expected *time.Time `json:"expected,omitempty"`
+
+	Servers []Server `json:"servers"`
+}
+
+// Server is what a resolver or nameserver answered for the record
+type Server struct {
+	Address string `json:"address"`
+
+	// The nameserver the address belongs to, empty for resolvers
+	Nameserver string `json:"nameserver,omitempty"`
+
+	Status string   `json:"status"`
+	Values []string `json:"values"`
+
+	// When a resolver drops the stale or negative answer it has cached
+	Expires *time.Time `json:"expires,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	changeKind = "propagation.change"
+	checkJob   = "dns.propagation"
+)
+
+// timeout is how long asking a server may take
+const timeout = 5 * time.Second
+
+// payload is the payload of the job checking a change
+type payload struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Changed time.Time `json:"changed"`
+}
+
+type checker struct {
+	config *config.DNSConfiguration
+}
+
+var std *checker
+
+// Configure checks the resolvers and registers the job checking changes
+func Configure(c *config.DNSConfiguration) error {
+	for _, r := range c.Resolvers {
+		host := r
+		if h, _, err := net.SplitHostPort(r); err == nil {
+			host = h
+		}
+
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("propagation: resolver %q is not an address", r)
+		}
+	}
+
+	if c.Interval < 10 {
+		return errors.New("propagation: the interval must be at least 10 seconds")
+	}
+
+	if c.Hours < 1 {
+		return errors.New("propagation: changes must be checked for at least an hour")
+	}
+
+	std = &checker{config: c}
+
+	jobs.Register(checkJob, func(ctx context.Context, j *jobs.Job) error {
+		var p payload
+		if err := j.Decode(&p); err != nil {
+			return err
+		}
+
+		return std.run(ctx, p, j.Actor)
+	})
+
+	return nil
+}
+
+// Watch checks the changes of records made through the panel
+func Watch() {
+	if std == nil {
+		return
+	}
+
+	sub := events.Subscribe(64, "dns.record.set", "dns.record.delete")
+	crash.Go("propagation", func() {
+		for e := range sub.C {
+			var rs externaldns.RecordSet
+			data := e.After
+			if e.Type == "dns.record.delete" {
+				data = e.Before
+			}
+
+			if err := json.Unmarshal(data, &rs); err != nil {
+				continue
+			}
+
+			if e.Type == "dns.record.delete" {
+				rs.Values = nil
+			}
+
+			if _, err := Track(rs.Name, rs.Type, rs.Values, e.Actor); err != nil {
+				zap.S().Named("propagation").Errorw("failed to check the propagation of a change", "name", rs.Name, "type", rs.Type, zap.Error(err))
+			}
+		}
+	})
+}
+
+// Track starts checking that the servers answer for the records of the type at the name
+// with the values, or that they no longer exist when there are none. A change of the
+// record that is still being checked is replaced
+func Track(name string, typ string, values []string, actor string) (Change, error) {
+	if std == nil {
+		return Change{}, ErrNotConfigured
+	}
+
+	name, typ = normalize(name), strings.ToUpper(typ)
+	if _, ok := types[typ]; !ok || typ == "SOA" {
+		return Change{}, fmt.Errorf("%w: %s", ErrUnsupported, typ)
+	}
+
+	z, err := externaldns.Lookup(name)
+	if err != nil {
+		return Change{}, err
+	}
+
+	c := Change{
+		Name:    name,
+		Type:    typ,
+		Zone:    z.Name,
+		Values:  canonical(typ, values),
+		Changed: time.Now().UTC(),
+		State:   Checking,
+		Servers: []Server{},
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(changeKind, id(name, typ), c)
+	})
+	if err != nil {
+		return Change{}, err
+	}
+
+	// Providers take a moment to update their nameservers, so the first check waits a
+	// little rather than finding every one of them pending
+	p := payload{Name: name, Type: typ, Changed: c.Changed}
+	if _, err := jobs.Enqueue(checkJob, p, jobs.Options{RunAt: c.Changed.Add(10 * time.Second), MaxAttempts: 1, Actor: actor}); err != nil {
+		return Change{}, err
+	}
+
+	return c, nil
+}
+
+// Recheck starts checking the records of the type at the name again against what the
+// provider serving its zone has, such as after changing them at the provider directly
+func Recheck(name string, typ string, actor string) (Change, error) {
+	if std == nil {
+		return Change{}, ErrNotConfigured
+	}
+
+	name, typ = normalize(name), strings.ToUpper(typ)
+
+	z, err := externaldns.Lookup(name)
+	if err != nil {
+		return Change{}, err
+	}
+
+	sets, err := externaldns.Records(z.Name)
+	if err != nil {
+		return Change{}, err
+	}
+
+	var values []string
+	for _, rs := range sets {
+		if normalize(rs.Name) == name && strings.EqualFold(rs.Type, typ) {
+			values = rs.Values
+		}
+	}
+
+	return Track(name, typ, values, actor)
+}
+
+// Get returns the last change of the records of the type at the name
+func Get(name string, typ string) (Change, error) {
+	var c Change
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(changeKind, id(normalize(name), strings.ToUpper(typ)), &c)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Change{}, ErrNotFound
+	}
+
+	return c, err
+}
+
+// List returns the last changes of the records of the zone, the latest first
+func List(zone string) ([]Change, error) {
+	zone = normalize(zone)
+	list := []Change{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(changeKind, func(id string, data []byte) error {
+			var c Change
+			if err := json.Unmarshal(data, &c); err != nil {
+				return fmt.Errorf("propagation: malformed change %s: %w", id, err)
+			}
+
+			if c.Zone == zone {
+				list = append(list, c)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Changed.After(list[j].Changed)
+	})
+
+	return list, nil
+}
+
+// run checks the change and queues the next check until it has propagated or is given
+// up on. A change replaced by a later one is no longer checked
+func (c *checker) run(ctx context.Context, p payload, actor string) error {
+	change, err := Get(p.Name, p.Type)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !change.Changed.Equal(p.Changed) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	change = c.check(ctx, change, now)
+
+	var next time.Time
+	switch {
+	case complete(change.Servers):
+		change.State = Propagated
+	case now.Sub(change.Changed) >= time.Duration(c.config.Hours)*time.Hour:
+		change.State = Incomplete
+	default:
+		next = c.next(change, now)
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		var stored Change
+		if err := tx.Get(changeKind, id(p.Name, p.Type), &stored); err != nil {
+			return err
+		}
+
+		// The record was changed again while it was being checked
+		if !stored.Changed.Equal(p.Changed) {
+			next = time.Time{}
+			return nil
+		}
+
+		return tx.Put(changeKind, id(p.Name, p.Type), change)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !next.IsZero() {
+		_, err := jobs.Enqueue(checkJob, p, jobs.Options{RunAt: next, MaxAttempts: 1, Actor: actor})
+		return err
+	}
+
+	if change.State != Checking {
+		events.Publish(events.Event{
+			Type:     "dns.propagation." + change.State,
+			Resource: change.Name,
+			Data: map[string]interface{}{
+				"type":   change.Type,
+				"zone":   change.Zone,
+				"checks": change.Checks,
+			},
+		})
+	}
+
+	return nil
+}
+
+// next returns when the change is checked again, backing off from the interval up to an
+// hour between checks. Resolvers answering from their cache are only checked again once
+// it has run out, unless a nameserver needs checking sooner
+func (c *checker) next(change Change, now time.Time) time.Time {
+	delay := time.Duration(c.config.Interval) * time.Second
+	for i := 1; i < change.Checks && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	interval := now.Add(min(delay, time.Hour))
+
+	var earliest time.Time
+	for _, s := range change.Servers {
+		switch {
+		case s.Status == Current:
+			continue
+		case s.Expires == nil:
+			return interval
+		case earliest.IsZero() || s.Expires.Before(earliest):
+			earliest = *s.Expires
+		}
+	}
+
+	// Resolvers are asked a moment after their cache ran out, so that they do not answer
+	// from it one last time
+	earliest = earliest.Add(2 * time.Second)
+	if earliest.Before(interval) {
+		return interval
+	}
+
+	return earliest
+}
+
+// complete returns true if every server answered with the change
+func complete(servers []Server) bool {
+	if len(servers) == 0 {
+		return false
+	}
+
+	for _, s := range servers {
+		if s.Status != Current {
+			return false
+		}
+	}
+
+	return true
+}
+
+// id returns what the change of the records is kept under
+func id(name string, typ string) string {
+	return name + "/" + typ
+}
+
+// normalize returns the name lower case without a trailing dot
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
@@ -0,0 +1,349 @@
+package propagation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Types of the records that can be checked, as numbered on the wire
+var types = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+}
+
+// Response codes
+const (
+	rcodeSuccess  = 0
+	rcodeNXDomain = 3
+)
+
+// errMalformed is returned for a response that cannot be parsed
+var errMalformed = errors.New("malformed DNS response")
+
+// record is a resource record of a response
+type record struct {
+	Name  string
+	Type  uint16
+	TTL   uint32
+	Value string
+
+	// The negative caching TTL of an SOA record, the lowest of its TTL and its minimum
+	Negative uint32
+}
+
+// response is what a server answered a query with
+type response struct {
+	RCode int
+
+	// Whether the server is authoritative for the name
+	Authoritative bool
+
+	Answer    []record
+	Authority []record
+}
+
+// soa returns the SOA record of the authority section, which a negative answer carries
+// to tell how long it may be cached
+func (r response) soa() (record, bool) {
+	for _, rr := range r.Authority {
+		if rr.Type == types["SOA"] {
+			return rr, true
+		}
+	}
+
+	return record{}, false
+}
+
+// exchange asks the server for the records of the type at the name, over UDP and again
+// over TCP when the answer did not fit. Recursion is asked for from resolvers and not from
+// nameservers, which answer from their zones
+func exchange(ctx context.Context, server string, name string, typ uint16, recurse bool) (response, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	q, id := message(name, typ, recurse)
+
+	b, err := roundTrip(ctx, "udp", server, q)
+	if err != nil {
+		return response{}, err
+	}
+
+	r, truncated, err := parse(b, id)
+	if err != nil || !truncated {
+		return r, err
+	}
+
+	if b, err = roundTrip(ctx, "tcp", server, q); err != nil {
+		return response{}, err
+	}
+
+	r, _, err = parse(b, id)
+
+	return r, err
+}
+
+// roundTrip sends the query and reads the response, which over TCP are each prefixed by
+// their length
+func roundTrip(ctx context.Context, network string, server string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(q); err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, 65535)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		return b[:n], nil
+	}
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+	if _, err := conn.Write(append(framed, q...)); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// message returns a query for the records of the type at the name and its ID. An EDNS
+// record lets the answer be larger than 512 bytes before it is truncated
+func message(name string, typ uint16, recurse bool) ([]byte, uint16) {
+	var rnd [2]byte
+	rand.Read(rnd[:])
+	id := binary.BigEndian.Uint16(rnd[:])
+
+	var flags uint16
+	if recurse {
+		flags |= 1 << 8
+	}
+
+	b := make([]byte, 0, 64)
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1) // questions
+	b = binary.BigEndian.AppendUint16(b, 0) // answers
+	b = binary.BigEndian.AppendUint16(b, 0) // authority
+	b = binary.BigEndian.AppendUint16(b, 1) // additional
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, 1) // IN
+
+	// OPT with the root as its name and the UDP payload size as its class
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 41)
+	b = binary.BigEndian.AppendUint16(b, 1232)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	return b, id
+}
+
+// parse reads the answer and authority sections of the response to the query with the
+// ID, and whether it was truncated
+func parse(b []byte, id uint16) (response, bool, error) {
+	if len(b) < 12 {
+		return response{}, false, errMalformed
+	}
+
+	if binary.BigEndian.Uint16(b) != id {
+		return response{}, false, errors.New("DNS response to another query")
+	}
+
+	flags := binary.BigEndian.Uint16(b[2:])
+	r := response{
+		RCode:         int(flags & 0xf),
+		Authoritative: flags&(1<<10) != 0,
+	}
+	truncated := flags&(1<<9) != 0
+
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	answers := int(binary.BigEndian.Uint16(b[6:]))
+	authority := int(binary.BigEndian.Uint16(b[8:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return response{}, false, errMalformed
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < answers+authority; i++ {
+		rr, next, err := readRecord(b, off)
+		if err != nil {
+			// What did not fit is read again over TCP
+			if truncated {
+				return r, true, nil
+			}
+			return response{}, false, err
+		}
+		off = next
+
+		if i < answers {
+			r.Answer = append(r.Answer, rr)
+		} else {
+			r.Authority = append(r.Authority, rr)
+		}
+	}
+
+	return r, truncated, nil
+}
+
+// readRecord reads the resource record at the offset, returning the offset after it
+func readRecord(b []byte, off int) (record, int, error) {
+	name, off, err := readName(b, off)
+	if err != nil || off+10 > len(b) {
+		return record{}, 0, errMalformed
+	}
+
+	rr := record{
+		Name: name,
+		Type: binary.BigEndian.Uint16(b[off:]),
+		TTL:  binary.BigEndian.Uint32(b[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+
+	end := off + length
+	if end > len(b) {
+		return record{}, 0, errMalformed
+	}
+	data := b[off:end]
+
+	switch rr.Type {
+	case types["A"], types["AAAA"]:
+		ip, ok := netip.AddrFromSlice(data)
+		if !ok {
+			return record{}, 0, errMalformed
+		}
+		rr.Value = ip.Unmap().String()
+	case types["NS"], types["CNAME"], types["PTR"]:
+		rr.Value, _, err = readName(b, off)
+	case types["MX"]:
+		if length < 3 {
+			return record{}, 0, errMalformed
+		}
+		var exchange string
+		exchange, _, err = readName(b, off+2)
+		rr.Value = strconv.Itoa(int(binary.BigEndian.Uint16(data))) + " " + exchange
+	case types["TXT"]:
+		// A record longer than 255 bytes is split into strings, which make up its value
+		// again when joined
+		var sb strings.Builder
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				return record{}, 0, errMalformed
+			}
+			sb.Write(data[i+1 : i+1+n])
+			i += 1 + n
+		}
+		rr.Value = sb.String()
+	case types["SOA"]:
+		var next int
+		if _, next, err = readName(b, off); err == nil {
+			_, next, err = readName(b, next)
+		}
+		if err == nil && next+20 > end {
+			err = errMalformed
+		}
+		if err == nil {
+			minimum := binary.BigEndian.Uint32(b[next+16:])
+			rr.Negative = min(rr.TTL, minimum)
+			rr.Value = fmt.Sprintf("serial %d", binary.BigEndian.Uint32(b[next:]))
+		}
+	}
+	if err != nil {
+		return record{}, 0, errMalformed
+	}
+
+	return rr, end, nil
+}
+
+// readName reads the name at the offset, following compression pointers, and returns it
+// lower case without a trailing dot with the offset after it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	// Every pointer must point backwards, so following them ends
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) || jumps > 64 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			target := int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			if target >= off {
+				return "", 0, errMalformed
+			}
+			off = target
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package provisioning
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/archives"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/filetransfer"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+	"go.uber.org/zap"
+)
+
+// Operations a billing system can request
+const (
+	Create        = "create"
+	Suspend       = "suspend"
+	Unsuspend     = "unsuspend"
+	Terminate     = "terminate"
+	ChangePackage = "change_package"
+)
+
+var (
+	// ErrNotConfigured is returned when provisioning before Configure is called
+	ErrNotConfigured = errors.New("provisioning: not configured")
+
+	// ErrAccountNotFound is returned when requesting an operation on an account that
+	// does not exist
+	ErrAccountNotFound = errors.New("provisioning: account not found")
+
+	// ErrKeyReused is returned when an idempotency key is sent again with a different
+	// request
+	ErrKeyReused = errors.New("provisioning: the idempotency key was already used for a different request")
+)
+
+// Request is an operation on a hosting account. Operations are run as jobs, so that a
+// billing system can follow them and retry them safely
+type Request struct {
+	Operation string `json:"operation"`
+	Username  string `json:"username"`
+
+	// Creating an account. The password is hashed before the job is queued, and the
+	// owner is the username of the reseller the account belongs to
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Language string `json:"language,omitempty"`
+	Password string `json:"password,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+
+	// Creating an account or changing its package
+	Package string `json:"package,omitempty"`
+
+	// Creating an account from a template, which it gets its files from and the package,
+	// language and reseller of unless the request has its own
+	Template string `json:"template,omitempty"`
+
+	// Suspending an account
+	Reason string `json:"reason,omitempty"`
+}
+
+// payload is what a job of an operation is queued with
+type payload struct {
+	Request
+	PasswordHash string `json:"password_hash,omitempty"`
+	OwnerID      string `json:"owner_id,omitempty"`
+}
+
+// Usage is what an account uses, which billing systems record for overage charges
+type Usage struct {
+	Username  string `json:"username"`
+	Package   string `json:"package"`
+	Suspended bool   `json:"suspended"`
+
+	// Bytes used by the home directory, and transferred by the account this month
+	Disk    int64 `json:"disk"`
+	Traffic int64 `json:"traffic"`
+
+	// Bytes uploaded and downloaded over FTP and SFTP this month, of which Traffic only
+	// counts FTP, and the quota of its package the account is blocked from both over
+	FileTransfers        int64 `json:"file_transfers"`
+	FileTransferQuota    int64 `json:"file_transfer_quota,omitempty"`
+	FileTransfersBlocked bool  `json:"file_transfers_blocked,omitempty"`
+}
+
+// requestKind is what the requests made with an idempotency key are kept under in the
+// state store, keyed by the key
+const requestKind = "provisioning.request"
+
+// keyLifetime is how long an idempotency key is remembered, which covers the retries of
+// a billing system's cron
+const keyLifetime = 24 * time.Hour
+
+// keyed is the request made with an idempotency key and the job it queued
+type keyed struct {
+	Fingerprint string    `json:"fingerprint"`
+	Job         string    `json:"job"`
+	Created     time.Time `json:"created"`
+}
+
+// provisioner queues the operations of billing systems
+type provisioner struct {
+	mu     sync.Mutex
+	config *config.ProvisioningConfiguration
+	homes  string
+	pruned time.Time
+}
+
+var std *provisioner
+
+// Configure registers the jobs that carry out operations. Accounts' home directories are
+// in homes, which their disk usage is measured from
+func Configure(homes string, c *config.ProvisioningConfiguration) {
+	std = &provisioner{config: c, homes: homes}
+
+	jobs.Register("provisioning."+Create, run(create))
+	jobs.Register("provisioning."+Suspend, run(suspend))
+	jobs.Register("provisioning."+Unsuspend, run(unsuspend))
+	jobs.Register("provisioning."+Terminate, run(terminate))
+	jobs.Register("provisioning."+ChangePackage, run(changePackage))
+}
+
+// Submit validates the request and queues the job carrying it out. A request sent again
+// with the same idempotency key returns the job it queued the first time rather than
+// queueing another, along with true
+func Submit(key string, req Request, actor string) (jobs.Job, bool, error) {
+	if std == nil {
+		return jobs.Job{}, false, ErrNotConfigured
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	fingerprint := fingerprint(req)
+	if key != "" {
+		var k keyed
+		err := store.View(func(tx *store.Tx) error {
+			return tx.Get(requestKind, key, &k)
+		})
+
+		switch {
+		case err == nil && time.Since(k.Created) < keyLifetime:
+			if k.Fingerprint != fingerprint {
+				return jobs.Job{}, false, ErrKeyReused
+			}
+
+			j, err := jobs.Get(k.Job)
+			return j, true, err
+		case err != nil && !errors.Is(err, store.ErrNotFound):
+			return jobs.Job{}, false, err
+		}
+	}
+
+	p, err := std.validate(req)
+	if err != nil {
+		return jobs.Job{}, false, err
+	}
+
+	j, err := jobs.Enqueue("provisioning."+req.Operation, p, jobs.Options{Actor: actor})
+	if err != nil {
+		return jobs.Job{}, false, err
+	}
+
+	if key != "" {
+		err := store.Update(func(tx *store.Tx) error {
+			return tx.Put(requestKind, key, keyed{Fingerprint: fingerprint, Job: j.ID, Created: time.Now().UTC()})
+		})
+		if err != nil {
+			zap.S().Named("provisioning").Errorw("failed to remember idempotency key", "job", j.ID, zap.Error(err))
+		}
+	}
+
+	std.prune()
+
+	return j, false, nil
+}
+
+// validate checks the request can be carried out and returns the payload of its job
+func (p *provisioner) validate(req Request) (payload, error) {
+	pl := payload{Request: req}
+	pl.Password = ""
+
+	if req.Username == "" {
+		return pl, errors.New("provisioning: username is required")
+	}
+
+	u, exists := account(req.Username)
+	if !exists && req.Operation != Create {
+		return pl, ErrAccountNotFound
+	}
+
+	if exists && u.Role != auth.RoleUser {
+		return pl, fmt.Errorf("provisioning: %s is a %s rather than a hosting account", req.Username, u.Role)
+	}
+
+	if req.Operation == Create || req.Operation == ChangePackage {
+		if err := p.checkPackage(req.Package); err != nil {
+			return pl, err
+		}
+	}
+
+	switch req.Operation {
+	case Create:
+		if exists {
+			return pl, auth.ErrUserExists
+		}
+
+		if !auth.ValidPhone(req.Phone) {
+			return pl, errors.New("provisioning: phone must be in international format, such as +447700900123")
+		}
+
+		pl.Language = locale.Canonical(req.Language)
+		if pl.Language != "" && !locale.Supported(pl.Language) {
+			return pl, fmt.Errorf("provisioning: the panel has no translation into %s", pl.Language)
+		}
+
+		if len(req.Password) < 8 {
+			return pl, errors.New("provisioning: password must be at least 8 characters")
+		}
+
+		var hashed auth.User
+		if err := hashed.SetPassword(req.Password); err != nil {
+			return pl, err
+		}
+		pl.PasswordHash = hashed.PasswordHash
+
+		if req.Template != "" {
+			if _, err := transfer.GetTemplate(req.Template); err != nil {
+				return pl, err
+			}
+		}
+
+		if req.Owner != "" {
+			owner, ok := account(req.Owner)
+			if !ok || owner.Role != auth.RoleReseller {
+				return pl, fmt.Errorf("provisioning: owner %s is not a reseller", req.Owner)
+			}
+			pl.OwnerID = owner.ID
+		}
+	case Suspend, Unsuspend, Terminate, ChangePackage:
+	default:
+		return pl, fmt.Errorf("provisioning: unknown operation %q", req.Operation)
+	}
+
+	return pl, nil
+}
+
+// checkPackage returns an error unless the package is one accounts can be on
+func (p *provisioner) checkPackage(name string) error {
+	if len(p.config.Packages) == 0 || slices.Contains(p.config.Packages, name) {
+		return nil
+	}
+
+	return fmt.Errorf("provisioning: unknown package %q, must be one of %s", name, strings.Join(p.config.Packages, ", "))
+}
+
+// prune forgets idempotency keys older than their lifetime, at most once an hour. The
+// provisioner must be locked
+func (p *provisioner) prune() {
+	if time.Since(p.pruned) < time.Hour {
+		return
+	}
+	p.pruned = time.Now()
+
+	err := store.Update(func(tx *store.Tx) error {
+		var expired []string
+		err := tx.Each(requestKind, func(id string, data []byte) error {
+			var k keyed
+			if err := json.Unmarshal(data, &k); err != nil || time.Since(k.Created) >= keyLifetime {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			if err := tx.Delete(requestKind, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		zap.S().Named("provisioning").Warnw("failed to prune idempotency keys", zap.Error(err))
+	}
+}
+
+// fingerprint identifies the request, leaving out the password so that it is not kept
+func fingerprint(req Request) string {
+	req.Password = ""
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// account returns the panel user with the username
+func account(username string) (auth.User, bool) {
+	for _, u := range auth.Users() {
+		if u.Username == strings.ToLower(username) {
+			return u, true
+		}
+	}
+
+	return auth.User{}, false
+}
+
+// Account returns the hosting account with the username
+func Account(username string) (auth.User, error) {
+	u, ok := account(username)
+	if !ok || u.Role != auth.RoleUser {
+		return auth.User{}, ErrAccountNotFound
+	}
+
+	return u.Public(), nil
+}
+
+// GetUsage returns the disk and traffic the account uses. The home directory is measured
+// with the limits of the disk class
+func GetUsage(username string) (Usage, error) {
+	if std == nil {
+		return Usage{}, ErrNotConfigured
+	}
+
+	u, err := Account(username)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{Username: u.Username, Package: u.Package, Suspended: u.Suspended}
+
+	now := time.Now().UTC()
+	points, err := stats.AccountTraffic(u.Username, stats.Range{
+		Interval: stats.Month,
+		From:     time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		To:       now,
+	})
+	if err != nil && !errors.Is(err, stats.ErrNotConfigured) {
+		return usage, err
+	}
+	for _, p := range points {
+		usage.Traffic += p.Total
+	}
+
+	ft, err := filetransfer.GetUsage(u.Username)
+	if err != nil && !errors.Is(err, filetransfer.ErrNotConfigured) {
+		return usage, err
+	}
+	usage.FileTransfers, usage.FileTransferQuota, usage.FileTransfersBlocked = ft.Bytes, ft.Quota, ft.Blocked
+
+	// Files that vanish or cannot be read while walking are left out
+	err = throttle.Run(context.Background(), throttle.Disk, func(ctx context.Context) error {
+		return filepath.WalkDir(filepath.Join(std.homes, u.Username), func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+
+			if info, err := d.Info(); err == nil {
+				usage.Disk += info.Size()
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return usage, err
+	}
+
+	return usage, nil
+}
+
+// run returns the handler of jobs of the operation, which decodes their payload
+func run(fn func(ctx context.Context, j *jobs.Job, p payload) error) jobs.Handler {
+	return func(ctx context.Context, j *jobs.Job) error {
+		var p payload
+		if err := j.Decode(&p); err != nil {
+			return err
+		}
+
+		return fn(ctx, j, p)
+	}
+}
+
+// create adds the account, from its template if it has one, assigning it an IPv6 address
+// when accounts are given one
+func create(ctx context.Context, j *jobs.Job, p payload) error {
+	u := auth.User{
+		Username:     p.Username,
+		Email:        p.Email,
+		Phone:        p.Phone,
+		Language:     p.Language,
+		Role:         auth.RoleUser,
+		Owner:        p.OwnerID,
+		PasswordHash: p.PasswordHash,
+		Package:      p.Package,
+		Created:      time.Now().UTC(),
+	}
+
+	var err error
+	if p.Template != "" {
+		u, err = transfer.FromTemplate(p.Template, u)
+	} else {
+		u, err = auth.ImportUser(u)
+	}
+	if err != nil {
+		return err
+	}
+
+	publish(j, "user.create", u.ID, nil, u.Public())
+
+	if addresses.AutoAssign() {
+		if a, err := addresses.AssignIPv6(u.Username); err != nil {
+			zap.S().Named("addresses").Warnw("failed to assign IPv6 prefix", "account", u.Username, zap.Error(err))
+		} else {
+			publish(j, "user.ipv6.assign", u.ID, nil, a)
+		}
+	}
+
+	// The password is not kept in the job, so the account is welcomed without it
+	notifyUser(u, "welcome", map[string]interface{}{"Username": u.Username})
+
+	return nil
+}
+
+// suspend stops the account logging in
+func suspend(ctx context.Context, j *jobs.Job, p payload) error {
+	u, err := Account(p.Username)
+	if err != nil {
+		return err
+	}
+
+	updated, err := auth.Suspend(u.ID, p.Reason)
+	if err != nil {
+		return err
+	}
+
+	publish(j, "user.suspend", u.ID, u, updated.Public())
+
+	notifyUser(updated, "account_suspended", map[string]interface{}{"Username": u.Username, "Reason": p.Reason})
+
+	return nil
+}
+
+// unsuspend lets the account log in again
+func unsuspend(ctx context.Context, j *jobs.Job, p payload) error {
+	u, err := Account(p.Username)
+	if err != nil {
+		return err
+	}
+
+	updated, err := auth.Unsuspend(u.ID)
+	if err != nil {
+		return err
+	}
+
+	publish(j, "user.unsuspend", u.ID, u, updated.Public())
+
+	return nil
+}
+
+// terminate removes the account and releases its IPv6 address. When terminated accounts
+// are archived, the account is archived first and its home directory removed once it is
+// gone. An account that is already gone, such as when the job is retried, has been
+// terminated
+func terminate(ctx context.Context, j *jobs.Job, p payload) error {
+	u, err := Account(p.Username)
+	if errors.Is(err, ErrAccountNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	archived := archives.Enabled()
+	if archived {
+		if _, err := archives.Create(ctx, u, j.ID, j.Actor); err != nil {
+			return fmt.Errorf("provisioning: failed to archive %s, which is kept: %w", u.Username, err)
+		}
+	}
+
+	if err := auth.DeleteUser(u.ID); err != nil {
+		return err
+	}
+
+	publish(j, "user.delete", u.ID, u, nil)
+
+	// The archive restores the home directory, which must not exist by then
+	if archived {
+		if err := os.RemoveAll(filepath.Join(std.homes, u.Username)); err != nil {
+			zap.S().Named("provisioning").Warnw("failed to remove home directory of terminated account", "account", u.Username, zap.Error(err))
+		}
+	}
+
+	if a, err := addresses.IPv6(u.Username); err == nil {
+		if err := addresses.ReleaseIPv6(u.Username); err != nil {
+			zap.S().Named("addresses").Warnw("failed to release IPv6 prefix", "account", u.Username, zap.Error(err))
+		} else {
+			publish(j, "user.ipv6.release", u.ID, a, nil)
+		}
+	}
+
+	released, err := addresses.ReleaseAccount(u.Username)
+	if err != nil {
+		zap.S().Named("addresses").Warnw("failed to release dedicated addresses", "account", u.Username, zap.Error(err))
+	}
+	for _, d := range released {
+		publish(j, "user.ip.release", d.Address.String(), d, nil)
+	}
+
+	return nil
+}
+
+// changePackage moves the account to another package
+func changePackage(ctx context.Context, j *jobs.Job, p payload) error {
+	u, err := Account(p.Username)
+	if err != nil {
+		return err
+	}
+
+	updated, err := auth.UpdateUser(u.ID, func(u *auth.User) error {
+		u.Package = p.Package
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	publish(j, "user.package", u.ID, u, updated.Public())
+
+	return nil
+}
+
+// publish publishes the change made by the job on behalf of the billing system that
+// queued it
+func publish(j *jobs.Job, typ string, resource string, before interface{}, after interface{}) {
+	e := events.Event{
+		Type:     typ,
+		Actor:    j.Actor,
+		Resource: resource,
+		Data:     map[string]interface{}{"job": j.ID},
+	}
+
+	if before != nil {
+		e.Before, _ = json.Marshal(before)
+	}
+
+	if after != nil {
+		e.After, _ = json.Marshal(after)
+	}
+
+	events.Publish(e)
+}
+
+// notifyUser sends the account a notification, logging rather than failing the job when
+// it cannot be delivered
+func notifyUser(u auth.User, kind string, data map[string]interface{}) {
+	if err := auth.Notify(u, kind, data); err != nil {
+		zap.S().Named("provisioning").Warnw("failed to notify account", "account", u.Username, "kind", kind, zap.Error(err))
+	}
+}
@@ -0,0 +1,145 @@
+package rcd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// Service is the name of the service the daemon is installed as
+const Service = "cosmicpanel"
+
+// DefaultScript is where the script is installed unless told otherwise
+const DefaultScript = "/usr/local/etc/rc.d/" + Service
+
+// Script describes the rc.d service the daemon is installed as on FreeBSD
+type Script struct {
+	// The absolute paths of the binary and the configuration file it is started with
+	Binary string
+	Config string
+}
+
+// scriptTemplate is the rc.d script. daemon(8) supervises the panel, restarting it when
+// it exits and sending its output to syslog, and the pidfile holds the supervisor's pid
+var scriptTemplate = template.Must(template.New("script").Parse(`#!/bin/sh
+# Managed by CosmicPanel, reinstall with cosmicpanel service install
+
+# PROVIDE: {{.Name}}
+# REQUIRE: LOGIN NETWORKING
+# KEYWORD: shutdown
+
+. /etc/rc.subr
+
+name="{{.Name}}"
+rcvar="{{.Name}}_enable"
+
+load_rc_config $name
+
+: ${ {{- .Name}}_enable:="NO"}
+: ${ {{- .Name}}_chdir:="{{.Dir}}"}
+
+pidfile="/var/run/${name}.pid"
+procname="/usr/sbin/daemon"
+command="/usr/sbin/daemon"
+command_args="-r -R 5 -S -T ${name} -P ${pidfile} {{.Binary}} serve -config {{.Config}}"
+
+run_rc_command "$1"
+`))
+
+// Render returns the contents of the script
+func (s Script) Render(name string) ([]byte, error) {
+	for _, p := range []string{s.Binary, s.Config} {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("rcd: %s must be an absolute path", p)
+		}
+
+		if strings.ContainsAny(p, " \t\n\"'\\$`") {
+			return nil, fmt.Errorf("rcd: %s contains characters that cannot be used in a script", p)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := scriptTemplate.Execute(&buf, struct {
+		Script
+		Name string
+		Dir  string
+	}{s, name, filepath.Dir(s.Config)})
+
+	return buf.Bytes(), err
+}
+
+// Install writes the script to the path and enables the service in rc.conf so that it
+// starts on boot. The service is started or restarted if now is set
+func Install(s Script, path string, now bool) error {
+	name := filepath.Base(path)
+
+	b, err := s.Render(name)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if err := command("sysrc", name+"_enable=YES"); err != nil {
+		return err
+	}
+
+	if now {
+		return Restart(name)
+	}
+
+	return nil
+}
+
+// Uninstall stops and disables the service and removes the script
+func Uninstall(path string) error {
+	name := filepath.Base(path)
+
+	if Active(name) {
+		if err := command("service", name, "stop"); err != nil {
+			return err
+		}
+	}
+
+	if err := command("sysrc", "-x", name+"_enable"); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Active returns true if the service is running
+func Active(name string) bool {
+	return privsep.Command("service", name, "onestatus").Run() == nil
+}
+
+// Restart restarts the service, starting it if it is not running
+func Restart(name string) error {
+	return command("service", name, "restart")
+}
+
+// command runs the command, including its output in the error
+func command(name string, args ...string) error {
+	out, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
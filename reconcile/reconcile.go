@@ -0,0 +1,519 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when reconciling before Configure is called
+	ErrNotConfigured = errors.New("reconcile: not configured")
+
+	// ErrUnknownSource is returned when reconciling a source nothing has registered as
+	ErrUnknownSource = errors.New("reconcile: unknown source")
+)
+
+// Artifact is a file the panel generates, such as the configuration of a service
+type Artifact struct {
+	Path    string
+	Content string
+
+	// Defaults to 0644 so that the service can read it
+	Mode os.FileMode
+}
+
+// Source generates artifacts from the panel's state. The reconciler compares them with
+// what is on disk, writes those that are missing or have been edited and removes those
+// the source no longer generates
+type Source struct {
+	// Desired returns every artifact the source generates, in any order
+	Desired func() ([]Artifact, error)
+
+	// Test checks the service accepts the artifacts once they are written. The previous
+	// files are restored if it fails. Optional
+	Test func() error
+
+	// Reload makes the service pick up changed artifacts. Optional
+	Reload func() error
+
+	// Events that change the artifacts, such as account.create, after which the source
+	// is reconciled
+	Events []string
+}
+
+// States of an artifact that has drifted
+const (
+	Missing  = "missing"
+	Modified = "modified"
+	Stale    = "stale"
+)
+
+// Drift is an artifact that does not match what its source generates. Stale artifacts
+// were generated before but no longer are
+type Drift struct {
+	Path  string `json:"path"`
+	State string `json:"state"`
+}
+
+// Result is the drift of a source and whether it was converged
+type Result struct {
+	Source    string  `json:"source"`
+	Drift     []Drift `json:"drift"`
+	Converged bool    `json:"converged"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the result of reconciling every source
+type Report struct {
+	Generated time.Time `json:"generated"`
+	Results   []Result  `json:"results"`
+}
+
+var (
+	smu     sync.RWMutex
+	sources = make(map[string]Source)
+)
+
+// Register makes the source available to reconcile under the name. Packages generating
+// files register them when they are configured
+func Register(name string, s Source) {
+	smu.Lock()
+	defer smu.Unlock()
+
+	sources[name] = s
+}
+
+// source returns the source registered under the name
+func source(name string) (Source, bool) {
+	smu.RLock()
+	defer smu.RUnlock()
+
+	s, ok := sources[name]
+
+	return s, ok
+}
+
+// names returns the names of every registered source in order
+func names() []string {
+	smu.RLock()
+	defer smu.RUnlock()
+
+	list := make([]string, 0, len(sources))
+	for name := range sources {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// ownedKind is the kind the paths each source generated are kept under in the state
+// store, so that artifacts it stops generating are found after a restart
+const ownedKind = "reconcile.owned"
+
+// reconciler runs one reconciliation at a time
+type reconciler struct {
+	mu       sync.Mutex
+	converge bool
+	owned    map[string][]string
+}
+
+var std *reconciler
+
+// Configure loads the paths every source generated from the state store, which must be
+// configured first
+func Configure(c *config.ReconcileConfiguration) error {
+	r := &reconciler{converge: c.Converge, owned: make(map[string][]string)}
+	if err := store.Load(ownedKind, &r.owned); err != nil {
+		return err
+	}
+
+	if c.Snapshots > 0 {
+		keep = c.Snapshots
+	}
+
+	std = r
+
+	return nil
+}
+
+// Start reconciles a source whenever one of its events is published, converging it if
+// drift is to be repaired
+func Start() {
+	for _, name := range names() {
+		s, _ := source(name)
+		if len(s.Events) == 0 {
+			continue
+		}
+
+		sub := events.Subscribe(16, s.Events...)
+		crash.Go("reconcile", func() {
+			for range sub.C {
+				if _, err := run(std.converge, name); err != nil {
+					zap.S().Named("reconcile").Errorw("failed to reconcile after an event", "source", name, zap.Error(err))
+				}
+			}
+		})
+	}
+}
+
+// Check reports the drift of the sources, or of every source if none are named, without
+// changing anything
+func Check(names ...string) (Report, error) {
+	return run(false, names...)
+}
+
+// Converge writes the artifacts of the sources that have drifted, or of every source if
+// none are named, and removes those no longer generated
+func Converge(names ...string) (Report, error) {
+	return run(true, names...)
+}
+
+// Scheduled reconciles every source, only reporting drift unless it is to be repaired
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	report, err := run(std.converge)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, res := range report.Results {
+		if res.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", res.Source, res.Error))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// run reconciles the named sources, or every source if none are named
+func run(converge bool, list ...string) (Report, error) {
+	if std == nil {
+		return Report{}, ErrNotConfigured
+	}
+
+	if len(list) == 0 {
+		list = names()
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	report := Report{Generated: time.Now().UTC(), Results: []Result{}}
+	for _, name := range list {
+		s, ok := source(name)
+		if !ok {
+			return report, fmt.Errorf("%w %s", ErrUnknownSource, name)
+		}
+
+		res := std.reconcile(name, s, converge)
+		report.Results = append(report.Results, res)
+
+		if len(res.Drift) > 0 {
+			zap.S().Named("reconcile").Warnw("generated files have drifted", "source", name, "drift", res.Drift, "converged", res.Converged)
+
+			events.Publish(events.Event{
+				Type:     "reconcile.drift",
+				Resource: name,
+				Data:     map[string]interface{}{"drift": res.Drift, "converged": res.Converged},
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// reconcile finds the drift of the source and converges it if asked to. The reconciler
+// must be locked
+func (r *reconciler) reconcile(name string, s Source, converge bool) Result {
+	res := Result{Source: name, Drift: []Drift{}}
+
+	desired, err := s.Desired()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	paths := make([]string, 0, len(desired))
+	wanted := make(map[string]bool, len(desired))
+	for _, a := range desired {
+		paths = append(paths, a.Path)
+		wanted[a.Path] = true
+
+		if state := drifted(a); state != "" {
+			res.Drift = append(res.Drift, Drift{Path: a.Path, State: state})
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range r.owned[name] {
+		if _, err := os.Lstat(path); !wanted[path] && err == nil {
+			res.Drift = append(res.Drift, Drift{Path: path, State: Stale})
+		}
+	}
+
+	if !converge {
+		return res
+	}
+
+	if len(res.Drift) > 0 {
+		if err := apply(name, s, desired, res.Drift); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Converged = true
+	}
+
+	if !slices.Equal(r.owned[name], paths) {
+		r.owned[name] = paths
+		if err := store.Save(ownedKind, r.owned); err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	return res
+}
+
+// drifted returns the state of the artifact on disk, or an empty string if it matches
+func drifted(a Artifact) string {
+	info, err := os.Stat(a.Path)
+	if os.IsNotExist(err) {
+		return Missing
+	} else if err != nil {
+		return Modified
+	}
+
+	b, err := os.ReadFile(a.Path)
+	if err != nil || string(b) != a.Content || info.Mode().Perm() != mode(a) {
+		return Modified
+	}
+
+	return ""
+}
+
+// Installed returns true if the directory the file belongs in exists, which is how
+// sources tell whether the service they render a file for is installed
+func Installed(path string) bool {
+	if path == "" {
+		return false
+	}
+
+	info, err := os.Stat(filepath.Dir(path))
+
+	return err == nil && info.IsDir()
+}
+
+// FirstInstalled returns the first path whose directory exists, or an empty string if
+// none do
+func FirstInstalled(paths []string) string {
+	for _, path := range paths {
+		if Installed(path) {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// Write writes the artifacts of the source that differ from the files on disk, then tests
+// and reloads the service like converging does. The files are snapshotted first and put
+// back if the service rejects them. It returns false if every file was up to date
+func Write(name string, s Source, artifacts ...Artifact) (bool, error) {
+	var drift []Drift
+	for _, a := range artifacts {
+		if state := drifted(a); state != "" {
+			drift = append(drift, Drift{Path: a.Path, State: state})
+		}
+	}
+
+	if len(drift) == 0 {
+		return false, nil
+	}
+
+	if err := apply(name, s, artifacts, drift); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove removes the files of the source that exist, then tests and reloads the service
+// like Write does. It returns false if none of the files existed
+func Remove(name string, s Source, paths ...string) (bool, error) {
+	var drift []Drift
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			drift = append(drift, Drift{Path: path, State: Stale})
+		}
+	}
+
+	if len(drift) == 0 {
+		return false, nil
+	}
+
+	if err := apply(name, s, nil, drift); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// apply writes the artifacts that drifted and removes the stale ones, then tests and
+// reloads the service, rolling back if any of it fails
+func apply(name string, s Source, desired []Artifact, drift []Drift) error {
+	artifacts := make(map[string]Artifact, len(desired))
+	for _, a := range desired {
+		artifacts[a.Path] = a
+	}
+
+	paths := make([]string, 0, len(drift))
+	for _, d := range drift {
+		paths = append(paths, d.Path)
+	}
+
+	return Change(name, s, paths, func() error {
+		for _, d := range drift {
+			if d.State == Stale {
+				if err := os.Remove(d.Path); err != nil {
+					return err
+				}
+				continue
+			}
+
+			a := artifacts[d.Path]
+			if err := writeFile(a.Path, []byte(a.Content), mode(a)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Change snapshots the files, runs fn to change them and then tests and reloads the
+// service of the source. The files are put back if fn, the test or the reload fails,
+// reloading the service again when it was the reload. Services changed through their
+// own tools, such as postconf, use it directly
+func Change(name string, s Source, paths []string, fn func() error) error {
+	wmu.Lock()
+	defer wmu.Unlock()
+
+	snap := newSnapshot(name)
+	defer snap.record()
+
+	rollback := func(stage string, err error) error {
+		for i := len(snap.Files) - 1; i >= 0; i-- {
+			restore(snap.Files[i])
+		}
+
+		if stage == StageReload {
+			if rerr := s.Reload(); rerr != nil {
+				err = fmt.Errorf("%w, and reloading the previous files failed: %v", err, rerr)
+			}
+		}
+
+		snap.rolledBack(stage, err)
+
+		return err
+	}
+
+	for _, path := range paths {
+		f, err := save(path)
+		if err != nil {
+			return rollback(StageWrite, err)
+		}
+		snap.Files = append(snap.Files, f)
+	}
+
+	if err := fn(); err != nil {
+		return rollback(StageWrite, err)
+	}
+
+	if s.Test != nil {
+		if err := s.Test(); err != nil {
+			return rollback(StageTest, err)
+		}
+	}
+
+	if s.Reload != nil {
+		if err := s.Reload(); err != nil {
+			return rollback(StageReload, err)
+		}
+	}
+
+	return nil
+}
+
+// save returns the file as it is before a change
+func save(path string) (File, error) {
+	f := File{Path: path}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	f.Content, f.Mode, f.Existed = string(b), info.Mode().Perm(), true
+
+	return f, nil
+}
+
+// restore puts the file back as it was
+func restore(f File) {
+	if !f.Existed {
+		os.Remove(f.Path)
+		return
+	}
+
+	writeFile(f.Path, []byte(f.Content), f.Mode)
+}
+
+// writeFile atomically writes the file with the mode
+func writeFile(path string, b []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, mode); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// mode returns the mode of the artifact
+func mode(a Artifact) os.FileMode {
+	if a.Mode == 0 {
+		return 0644
+	}
+
+	return a.Mode
+}
@@ -0,0 +1,302 @@
+package reconcile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the reconciler with a state store of its own
+func configure(t *testing.T) {
+	t.Helper()
+
+	if err := store.Configure(t.TempDir(), &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(&config.ReconcileConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		std = nil
+		smu.Lock()
+		sources = make(map[string]Source)
+		smu.Unlock()
+	})
+}
+
+func writeFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) (string, bool) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b), true
+}
+
+func TestReconcile(t *testing.T) {
+	configure(t)
+	dir := t.TempDir()
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	desired := []Artifact{
+		{Path: path("a.conf"), Content: "a\n"},
+		{Path: path("b.conf"), Content: "b\n"},
+		{Path: path("secret.conf"), Content: "secret\n", Mode: 0600},
+	}
+	reloads := 0
+	Register("web", Source{
+		Desired: func() ([]Artifact, error) { return desired, nil },
+		Reload:  func() error { reloads++; return nil },
+	})
+
+	tests := []struct {
+		name     string
+		change   func()
+		converge bool
+		drift    []Drift
+		reloads  int
+	}{
+		{"nothing written", func() {}, false, []Drift{{path("a.conf"), Missing}, {path("b.conf"), Missing}, {path("secret.conf"), Missing}}, 0},
+		{"converged", func() {}, true, []Drift{{path("a.conf"), Missing}, {path("b.conf"), Missing}, {path("secret.conf"), Missing}}, 1},
+		{"in sync", func() {}, true, []Drift{}, 0},
+		{"edited", func() { writeFiles(t, map[string]string{path("a.conf"): "edited\n"}) }, false, []Drift{{path("a.conf"), Modified}}, 0},
+		{"mode changed", func() { os.Chmod(path("secret.conf"), 0644) }, false, []Drift{{path("a.conf"), Modified}, {path("secret.conf"), Modified}}, 0},
+		{"repaired", func() {}, true, []Drift{{path("a.conf"), Modified}, {path("secret.conf"), Modified}}, 1},
+		{"no longer generated", func() { desired = desired[1:] }, true, []Drift{{path("a.conf"), Stale}}, 1},
+		{"stale file gone", func() {}, false, []Drift{}, 0},
+
+		// A file the source never generated is not its to remove
+		{"unknown file", func() { writeFiles(t, map[string]string{path("a.conf"): "admin\n"}) }, true, []Drift{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			reloads = 0
+
+			report, err := run(tt.converge, "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := report.Results[0]
+
+			if res.Error != "" || !slices.Equal(res.Drift, tt.drift) {
+				t.Errorf("drift %+v with %q, want %+v", res.Drift, res.Error, tt.drift)
+			}
+			if res.Converged != (tt.converge && len(tt.drift) > 0) {
+				t.Errorf("converged %v", res.Converged)
+			}
+			if reloads != tt.reloads {
+				t.Errorf("reloaded %d times, want %d", reloads, tt.reloads)
+			}
+
+			if !tt.converge {
+				return
+			}
+
+			for _, a := range desired {
+				if content, _ := readFile(t, a.Path); content != a.Content {
+					t.Errorf("%s is %q, want %q", a.Path, content, a.Content)
+				}
+				if info, err := os.Stat(a.Path); err != nil || info.Mode().Perm() != mode(a) {
+					t.Errorf("%s has mode %v, want %v", a.Path, info.Mode().Perm(), mode(a))
+				}
+			}
+		})
+	}
+
+	// The files a source generated are remembered across restarts
+	if err := Configure(&config.ReconcileConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := std.owned["web"]; !slices.Equal(got, []string{path("b.conf"), path("secret.conf")}) {
+		t.Errorf("owned %q", got)
+	}
+
+	if _, err := run(false, "missing"); !errors.Is(err, ErrUnknownSource) {
+		t.Errorf("reconciling an unknown source: %v", err)
+	}
+}
+
+func TestChange(t *testing.T) {
+	configure(t)
+	dir := t.TempDir()
+
+	existing := filepath.Join(dir, "existing.conf")
+	created := filepath.Join(dir, "created.conf")
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		write   error
+		test    error
+		reload  error
+		stage   string
+		reloads int
+	}{
+		{"applied", nil, nil, nil, "", 1},
+		{"write fails", failed, nil, nil, StageWrite, 0},
+		{"test fails", nil, failed, nil, StageTest, 0},
+		{"reload fails", nil, nil, failed, StageReload, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFiles(t, map[string]string{existing: "before\n"})
+			os.Remove(created)
+
+			reloads := 0
+			s := Source{
+				Test: func() error { return tt.test },
+				Reload: func() error {
+					reloads++
+					if reloads == 1 {
+						return tt.reload
+					}
+					return nil
+				},
+			}
+
+			err := Change("mail", s, []string{existing, created}, func() error {
+				writeFiles(t, map[string]string{existing: "after\n", created: "new\n"})
+				return tt.write
+			})
+			if (err == nil) != (tt.stage == "") {
+				t.Errorf("error %v", err)
+			}
+			if reloads != tt.reloads {
+				t.Errorf("reloaded %d times, want %d", reloads, tt.reloads)
+			}
+
+			content, _ := readFile(t, existing)
+			_, exists := readFile(t, created)
+			if tt.stage == "" && (content != "after\n" || !exists) {
+				t.Errorf("the change was not kept: %q, %v", content, exists)
+			}
+			if tt.stage != "" && (content != "before\n" || exists) {
+				t.Errorf("the change was not rolled back: %q, %v", content, exists)
+			}
+
+			list, err := Snapshots("mail")
+			if err != nil || len(list) == 0 {
+				t.Fatal(list, err)
+			}
+			snap := list[0]
+			if snap.RolledBack != (tt.stage != "") || snap.Stage != tt.stage {
+				t.Errorf("snapshot rolled back %v at %q, want %q", snap.RolledBack, snap.Stage, tt.stage)
+			}
+			want := []File{{Path: existing, Content: "before\n", Mode: 0644, Existed: true}, {Path: created}}
+			if !slices.Equal(snap.Files, want) {
+				t.Errorf("snapshot files %+v, want %+v", snap.Files, want)
+			}
+		})
+	}
+}
+
+func TestWriteRemove(t *testing.T) {
+	configure(t)
+	dir := t.TempDir()
+
+	a := Artifact{Path: filepath.Join(dir, "sub", "a.conf"), Content: "a\n"}
+	reloads := 0
+	s := Source{Reload: func() error { reloads++; return nil }}
+
+	steps := []struct {
+		name    string
+		write   bool
+		changed bool
+	}{
+		{"write", true, true},
+		{"write again", true, false},
+		{"remove", false, true},
+		{"remove again", false, false},
+	}
+
+	for _, step := range steps {
+		reloads = 0
+
+		var changed bool
+		var err error
+		if step.write {
+			changed, err = Write("web", s, a)
+		} else {
+			changed, err = Remove("web", s, a.Path)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if changed != step.changed || reloads != map[bool]int{true: 1}[step.changed] {
+			t.Errorf("%s: changed %v and reloaded %d times", step.name, changed, reloads)
+		}
+		if _, exists := readFile(t, a.Path); exists != step.write {
+			t.Errorf("%s: the file exists %v", step.name, exists)
+		}
+	}
+}
+
+func TestSnapshotsKept(t *testing.T) {
+	configure(t)
+
+	keep = 3
+	t.Cleanup(func() { keep = 10 })
+
+	path := filepath.Join(t.TempDir(), "a.conf")
+	for i := 0; i < 5; i++ {
+		for _, name := range []string{"web", "mail"} {
+			if err := Change(name, Source{}, []string{path}, func() error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		source string
+		want   int
+	}{
+		{"web", 3},
+		{"mail", 3},
+		{"", 6},
+	}
+
+	for _, tt := range tests {
+		list, err := Snapshots(tt.source)
+		if err != nil || len(list) != tt.want {
+			t.Errorf("%q: %d snapshots, %v, want %d", tt.source, len(list), err, tt.want)
+		}
+		for i := 1; i < len(list); i++ {
+			if list[i].Created.After(list[i-1].Created) {
+				t.Errorf("%q: snapshots are not newest first", tt.source)
+			}
+		}
+	}
+
+	list, _ := Snapshots("web")
+	if s, err := GetSnapshot(list[0].ID); err != nil || s.ID != list[0].ID {
+		t.Errorf("snapshot %+v, %v", s, err)
+	}
+	if _, err := GetSnapshot("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing snapshot: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package reconcile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// snapshotKind is the kind snapshots are kept under in the state store
+const snapshotKind = "reconcile.snapshot"
+
+// Stages a change is rolled back at
+const (
+	StageWrite  = "write"
+	StageTest   = "test"
+	StageReload = "reload"
+)
+
+// ErrNotFound is returned for a snapshot that does not exist
+var ErrNotFound = errors.New("reconcile: snapshot not found")
+
+// File is a generated file as it was before a change, with Existed false if the change
+// created it
+type File struct {
+	Path    string      `json:"path"`
+	Content string      `json:"content,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Existed bool        `json:"existed"`
+}
+
+// Snapshot is the files of a source as they were before they were written. A change the
+// service rejected or failed to reload with is rolled back to its snapshot
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+	Files   []File    `json:"files"`
+
+	// Set when the change was rolled back, with the stage that failed
+	RolledBack bool   `json:"rolled_back"`
+	Stage      string `json:"stage,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	// wmu lets one change write generated files at a time
+	wmu sync.Mutex
+
+	// The number of snapshots kept per source
+	keep = 10
+)
+
+// Snapshots returns the snapshots of the source, or of every source if the name is
+// empty, newest first
+func Snapshots(name string) ([]Snapshot, error) {
+	list := []Snapshot{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(snapshotKind, func(id string, data []byte) error {
+			var s Snapshot
+			if err := json.Unmarshal(data, &s); err != nil {
+				return err
+			}
+
+			if name == "" || s.Source == name {
+				list = append(list, s)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, err
+}
+
+// GetSnapshot returns the snapshot with the ID
+func GetSnapshot(id string) (Snapshot, error) {
+	var s Snapshot
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(snapshotKind, id, &s)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return s, ErrNotFound
+	}
+
+	return s, err
+}
+
+// newSnapshot returns an empty snapshot of the source
+func newSnapshot(name string) *Snapshot {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	now := time.Now().UTC()
+
+	return &Snapshot{
+		ID:      now.Format("20060102150405.000000") + "-" + hex.EncodeToString(b),
+		Source:  name,
+		Created: now,
+		Files:   []File{},
+	}
+}
+
+// record keeps the snapshot, removing the oldest of its source beyond those kept. A
+// snapshot that cannot be kept is only logged, as the change itself went through
+func (s *Snapshot) record() {
+	err := store.Update(func(tx *store.Tx) error {
+		if err := tx.Put(snapshotKind, s.ID, s); err != nil {
+			return err
+		}
+
+		var ids []string
+		err := tx.Each(snapshotKind, func(id string, data []byte) error {
+			var other Snapshot
+			if err := json.Unmarshal(data, &other); err == nil && other.Source == s.Source {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// IDs start with the time the snapshot was taken, so the oldest come first
+		for len(ids) > keep {
+			if err := tx.Delete(snapshotKind, ids[0]); err != nil {
+				return err
+			}
+			ids = ids[1:]
+		}
+
+		return nil
+	})
+	if err != nil {
+		zap.S().Named("reconcile").Warnw("failed to keep snapshot of generated files", "source", s.Source, zap.Error(err))
+	}
+}
+
+// rolledBack records that the change was rolled back at the stage, which is an incident
+// admins are told about through the events
+func (s *Snapshot) rolledBack(stage string, err error) {
+	s.RolledBack, s.Stage, s.Error = true, stage, err.Error()
+
+	paths := make([]string, 0, len(s.Files))
+	for _, f := range s.Files {
+		paths = append(paths, f.Path)
+	}
+
+	zap.S().Named("reconcile").Errorw("rolled back generated files", "source", s.Source, "stage", stage, "paths", paths, zap.Error(err))
+
+	events.Publish(events.Event{
+		Type:     "reconcile.rollback",
+		Resource: s.Source,
+		Data:     map[string]interface{}{"snapshot": s.ID, "stage": stage, "paths": paths, "error": err.Error()},
+	})
+}
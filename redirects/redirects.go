@@ -0,0 +1,465 @@
+package redirects
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+var (
+	// ErrNotConfigured is returned when changing redirects before Configure is called
+	ErrNotConfigured = errors.New("redirects: not configured")
+
+	// ErrNotFound is returned for a redirect that does not exist
+	ErrNotFound = errors.New("redirects: redirect not found")
+
+	// ErrInvalid is returned for a redirect without a valid path, target or status code
+	ErrInvalid = errors.New("redirects: invalid redirect")
+
+	// ErrExists is returned when the domain already redirects the path
+	ErrExists = errors.New("redirects: the domain already redirects the path")
+
+	// ErrLimit is returned when the domain has as many redirects as it may have
+	ErrLimit = errors.New("redirects: the domain has as many redirects as it may have")
+
+	// ErrRejected is returned when a web server rejected the redirects or failed to
+	// reload with them, which are then rolled back
+	ErrRejected = errors.New("redirects: the web server rejected the redirects")
+)
+
+// Redirect sends the visitors of a path of a domain elsewhere. A short link is a redirect
+// whose path the panel picked
+type Redirect struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+
+	// The username of the account the domain belongs to
+	Account string `json:"account,omitempty"`
+
+	// The path redirected, such as /old-page. A prefix redirect also redirects every path
+	// starting with it, appending the rest of the path to the target
+	Path   string `json:"path"`
+	Prefix bool   `json:"prefix,omitempty"`
+
+	// A URL or a path on the same domain
+	Target string `json:"target"`
+
+	// One of 301, 302, 307 or 308
+	Code int `json:"code"`
+
+	// The times the redirect was followed, counted from the access log of the domain
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"last_hit"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// redirectKind is what redirects are kept under in the state store
+const redirectKind = "redirects.redirect"
+
+// slugLength is the length of the paths picked for short links, and slugChars the
+// characters they are picked from, which leave out those easily mistaken for another
+const (
+	slugLength = 6
+	slugChars  = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// validPath matches the paths that can be redirected, which leave out the characters
+// the configuration of web servers gives a meaning to
+var validPath = regexp.MustCompile(`^/[A-Za-z0-9._~!*'()+,=:@%/-]*$`)
+
+// maxLength is the longest path and target of a redirect
+const maxLength = 2048
+
+type manager struct {
+	// Serializes changes, which each render the files of the domain before they are kept
+	mu     sync.Mutex
+	config *config.RedirectsConfiguration
+
+	// The redirects of every domain, which the access logs are matched against
+	imu   sync.RWMutex
+	index map[string][]Redirect
+}
+
+var std *manager
+
+// Configure registers the redirects of domains with the reconciler and has the access
+// logs count their hits. The state store must be configured first
+func Configure(c *config.RedirectsConfiguration) error {
+	if c.Nginx != "" && !strings.Contains(c.Nginx, domainPlaceholder) {
+		return fmt.Errorf("redirects: the nginx file %q does not contain %s", c.Nginx, domainPlaceholder)
+	}
+
+	for _, path := range c.Apache {
+		if !strings.Contains(path, domainPlaceholder) {
+			return fmt.Errorf("redirects: the apache file %q does not contain %s", path, domainPlaceholder)
+		}
+	}
+
+	if c.Limit <= 0 {
+		return errors.New("redirects: the limit must be more than zero")
+	}
+
+	m := &manager{config: c}
+	if err := m.reindex(); err != nil {
+		return err
+	}
+
+	std = m
+
+	registerSources()
+	stats.CountRedirects(m)
+
+	return nil
+}
+
+// List returns the redirects of the domains, or of every domain when none are given,
+// sorted by domain and path
+func List(domains ...string) ([]Redirect, error) {
+	wanted := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		wanted[normalize(d)] = true
+	}
+
+	list := []Redirect{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(redirectKind, func(id string, data []byte) error {
+			var r Redirect
+			if err := json.Unmarshal(data, &r); err != nil {
+				return fmt.Errorf("redirects: malformed redirect %s: %w", id, err)
+			}
+
+			if len(domains) == 0 || wanted[r.Domain] {
+				list = append(list, r)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Domain != list[j].Domain {
+			return list[i].Domain < list[j].Domain
+		}
+		return list[i].Path < list[j].Path
+	})
+
+	return list, nil
+}
+
+// Get returns the redirect
+func Get(id string) (Redirect, error) {
+	var r Redirect
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(redirectKind, id, &r)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Redirect{}, ErrNotFound
+	}
+
+	return r, err
+}
+
+// Create adds the redirect to its domain, picking a path for a short link when it has
+// none. Short links redirect with 302 unless they say otherwise, so that their target can
+// be changed later, and other redirects with 301
+func Create(r Redirect) (Redirect, error) {
+	if std == nil {
+		return Redirect{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	r.Domain = normalize(r.Domain)
+	list, err := List(r.Domain)
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	if len(list) >= std.config.Limit {
+		return Redirect{}, fmt.Errorf("%w, which is %d", ErrLimit, std.config.Limit)
+	}
+
+	if r.Path == "" {
+		if r.Path, err = slug(list); err != nil {
+			return Redirect{}, err
+		}
+		if r.Code == 0 {
+			r.Code = 302
+		}
+	}
+
+	r.ID = ids.New()
+	r.Hits, r.LastHit = 0, time.Time{}
+	r.Created = time.Now().UTC()
+	r.Updated = r.Created
+
+	return std.save(r, list)
+}
+
+// Update replaces the path, target and status code of the redirect, keeping its hits. A
+// path or code left empty is kept too
+func Update(r Redirect) (Redirect, error) {
+	if std == nil {
+		return Redirect{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	before, err := Get(r.ID)
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	list, err := List(before.Domain)
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	r.Domain, r.Account = before.Domain, before.Account
+	r.Created, r.Updated = before.Created, time.Now().UTC()
+	if r.Path == "" {
+		r.Path = before.Path
+	}
+	if r.Code == 0 {
+		r.Code = before.Code
+	}
+
+	return std.save(r, list)
+}
+
+// Delete removes the redirect
+func Delete(id string) (Redirect, error) {
+	if std == nil {
+		return Redirect{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	r, err := Get(id)
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	list, err := List(r.Domain)
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	kept := make([]Redirect, 0, len(list))
+	for _, o := range list {
+		if o.ID != id {
+			kept = append(kept, o)
+		}
+	}
+
+	if err := std.render(r.Domain, r.Account, kept); err != nil {
+		return Redirect{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(redirectKind, id)
+	})
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	return r, std.reindex()
+}
+
+// save validates the redirect and renders it into the files of its domain along with the
+// others in the list, keeping it once the web servers accept them. The manager must be
+// locked
+func (m *manager) save(r Redirect, list []Redirect) (Redirect, error) {
+	if err := validate(&r); err != nil {
+		return Redirect{}, err
+	}
+
+	kept := make([]Redirect, 0, len(list)+1)
+	for _, o := range list {
+		switch {
+		case o.ID == r.ID:
+			continue
+		case o.Path == r.Path && o.Prefix == r.Prefix:
+			return Redirect{}, fmt.Errorf("%w %s", ErrExists, r.Path)
+		}
+		kept = append(kept, o)
+	}
+	kept = append(kept, r)
+
+	if err := m.render(r.Domain, r.Account, kept); err != nil {
+		return Redirect{}, err
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		// Hits counted since the redirect was read are kept
+		var stored Redirect
+		if err := tx.Get(redirectKind, r.ID, &stored); err == nil {
+			r.Hits, r.LastHit = stored.Hits, stored.LastHit
+		} else if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+
+		return tx.Put(redirectKind, r.ID, r)
+	})
+	if err != nil {
+		return Redirect{}, err
+	}
+
+	return r, m.reindex()
+}
+
+// validate checks the redirect and fills in the status code it defaults to
+func validate(r *Redirect) error {
+	if r.Code == 0 {
+		r.Code = 301
+	}
+
+	switch {
+	case !hostname.Valid(r.Domain):
+		return fmt.Errorf("%w, %q is not a domain", ErrInvalid, r.Domain)
+	case !validPath.MatchString(r.Path):
+		return fmt.Errorf("%w, the path must start with / and may not contain spaces, quotes, $, ;, ?, # or braces", ErrInvalid)
+	case r.Code != 301 && r.Code != 302 && r.Code != 307 && r.Code != 308:
+		return fmt.Errorf("%w, the code must be 301, 302, 307 or 308", ErrInvalid)
+	}
+
+	if len(r.Path) > maxLength || len(r.Target) > maxLength {
+		return fmt.Errorf("%w, the path and target may be at most %d characters", ErrInvalid, maxLength)
+	}
+
+	if strings.ContainsAny(r.Target, " \t\r\n\"'\\$;{}<>`") {
+		return fmt.Errorf("%w, the target may not contain spaces, quotes, $, ;, <, > or braces", ErrInvalid)
+	}
+
+	// A path on the same domain redirecting to itself, or a prefix redirecting under
+	// itself, sends visitors round in circles
+	if strings.HasPrefix(r.Target, "/") && !strings.HasPrefix(r.Target, "//") {
+		target, _, _ := strings.Cut(r.Target, "?")
+		if target == r.Path || (r.Prefix && strings.HasPrefix(target, r.Path)) {
+			return fmt.Errorf("%w, it redirects to itself", ErrInvalid)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(r.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w, the target must be a path or an http or https URL", ErrInvalid)
+	}
+
+	return nil
+}
+
+// Match returns the ID of the redirect the domain serves at the path. Exact paths win
+// over prefixes, and longer prefixes over shorter ones, as the web servers match them
+func (m *manager) Match(domain string, path string) (string, bool) {
+	m.imu.RLock()
+	defer m.imu.RUnlock()
+
+	id, length := "", -1
+	for _, r := range m.index[domain] {
+		switch {
+		case !r.Prefix && r.Path == path:
+			return r.ID, true
+		case r.Prefix && strings.HasPrefix(path, r.Path) && len(r.Path) > length:
+			id, length = r.ID, len(r.Path)
+		}
+	}
+
+	return id, id != ""
+}
+
+// Count adds the hits counted from the access logs to the redirects
+func (m *manager) Count(hits map[string]stats.Hits) error {
+	return store.Update(func(tx *store.Tx) error {
+		for id, h := range hits {
+			var r Redirect
+			if err := tx.Get(redirectKind, id, &r); errors.Is(err, store.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			r.Hits += h.Hits
+			if h.Last.After(r.LastHit) {
+				r.LastHit = h.Last
+			}
+
+			if err := tx.Put(redirectKind, id, r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// reindex loads the redirects the access logs are matched against
+func (m *manager) reindex() error {
+	list, err := List()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string][]Redirect)
+	for _, r := range list {
+		index[r.Domain] = append(index[r.Domain], r)
+	}
+
+	m.imu.Lock()
+	m.index = index
+	m.imu.Unlock()
+
+	return nil
+}
+
+// slug picks a path for a short link that none of the redirects in the list has
+func slug(list []Redirect) (string, error) {
+	for range 10 {
+		b := make([]byte, slugLength)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+
+		for i := range b {
+			b[i] = slugChars[int(b[i])%len(slugChars)]
+		}
+
+		path := "/" + string(b)
+		taken := false
+		for _, r := range list {
+			taken = taken || r.Path == path || (r.Prefix && strings.HasPrefix(path, r.Path))
+		}
+		if !taken {
+			return path, nil
+		}
+	}
+
+	return "", errors.New("redirects: failed to pick a path for the short link")
+}
+
+// normalize returns the domain lower case without a trailing dot
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
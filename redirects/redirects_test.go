@@ -0,0 +1,309 @@
+package redirects
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up the redirects with a state store of their own, rendered for an nginx
+// whose files are in a temporary directory. The nginx on the path rejects its files
+// while the file returned exists
+func configure(t *testing.T, limit int) (dir string, reject string) {
+	t.Helper()
+
+	dir = t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcile.Configure(&config.ReconcileConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "bin")
+	reject = filepath.Join(dir, "reject")
+	script := "#!/bin/sh\ntest ! -e " + reject + "\n"
+	if err := os.MkdirAll(filepath.Join(dir, "nginx"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "nginx"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	c := &config.RedirectsConfiguration{
+		Nginx:  filepath.Join(dir, "nginx", "{account}-{domain}.conf"),
+		Apache: []string{filepath.Join(dir, "apache", "{domain}.conf")},
+		Limit:  limit,
+	}
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { std = nil })
+
+	return dir, reject
+}
+
+func TestConfigure(t *testing.T) {
+	if err := store.Configure(t.TempDir(), &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config config.RedirectsConfiguration
+		ok     bool
+	}{
+		{"both servers", config.RedirectsConfiguration{Nginx: "/etc/nginx/redirects/{domain}.conf", Apache: []string{"/etc/apache2/redirects/{domain}.conf"}, Limit: 10}, true},
+		{"no servers", config.RedirectsConfiguration{Limit: 10}, true},
+
+		{"nginx file for every domain", config.RedirectsConfiguration{Nginx: "/etc/nginx/redirects.conf", Limit: 10}, false},
+		{"apache file for every domain", config.RedirectsConfiguration{Apache: []string{"/etc/apache2/redirects/{domain}.conf", "/etc/httpd/redirects.conf"}, Limit: 10}, false},
+		{"no limit", config.RedirectsConfiguration{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { std = nil })
+
+			if err := Configure(&tt.config); (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect Redirect
+		code     int
+	}{
+		{"URL", Redirect{Domain: "example.com", Path: "/old-page", Target: "https://example.net/new?a=1"}, 301},
+		{"path", Redirect{Domain: "example.com", Path: "/old", Target: "/new", Code: 308}, 308},
+		{"prefix", Redirect{Domain: "example.com", Path: "/blog/", Prefix: true, Target: "https://blog.example.com/"}, 301},
+		{"prefix elsewhere", Redirect{Domain: "example.com", Path: "/docs", Prefix: true, Target: "/manual/"}, 301},
+		{"same path with a query", Redirect{Domain: "example.com", Path: "/a", Target: "/b?from=a", Code: 302}, 302},
+		{"encoded path", Redirect{Domain: "example.com", Path: "/caf%C3%A9", Target: "/cafe"}, 301},
+
+		{"invalid domain", Redirect{Domain: "example com", Path: "/a", Target: "/b"}, 0},
+		{"no path", Redirect{Domain: "example.com", Target: "/b"}, 0},
+		{"relative path", Redirect{Domain: "example.com", Path: "a", Target: "/b"}, 0},
+		{"path with a space", Redirect{Domain: "example.com", Path: "/a b", Target: "/b"}, 0},
+		{"path with a quote", Redirect{Domain: "example.com", Path: `/a"; return 200 "x`, Target: "/b"}, 0},
+		{"path with a brace", Redirect{Domain: "example.com", Path: "/a{", Target: "/b"}, 0},
+		{"path with a variable", Redirect{Domain: "example.com", Path: "/$host", Target: "/b"}, 0},
+		{"path with a query", Redirect{Domain: "example.com", Path: "/a?b", Target: "/b"}, 0},
+		{"path too long", Redirect{Domain: "example.com", Path: "/" + strings.Repeat("a", maxLength), Target: "/b"}, 0},
+		{"target too long", Redirect{Domain: "example.com", Path: "/a", Target: "/" + strings.Repeat("b", maxLength)}, 0},
+		{"code", Redirect{Domain: "example.com", Path: "/a", Target: "/b", Code: 303}, 0},
+		{"target with a quote", Redirect{Domain: "example.com", Path: "/a", Target: `https://example.net/" always; return 200 "x`}, 0},
+		{"target with a variable", Redirect{Domain: "example.com", Path: "/a", Target: "https://$host/"}, 0},
+		{"target with a newline", Redirect{Domain: "example.com", Path: "/a", Target: "https://example.net/\nRedirect / https://evil.example"}, 0},
+		{"target with a backslash", Redirect{Domain: "example.com", Path: "/a", Target: `/\evil.example`}, 0},
+		{"target with a scheme", Redirect{Domain: "example.com", Path: "/a", Target: "javascript:alert(1)"}, 0},
+		{"target without a scheme", Redirect{Domain: "example.com", Path: "/a", Target: "//evil.example/"}, 0},
+		{"target without a host", Redirect{Domain: "example.com", Path: "/a", Target: "https:///b"}, 0},
+		{"target without a slash", Redirect{Domain: "example.com", Path: "/a", Target: "example.net"}, 0},
+		{"to itself", Redirect{Domain: "example.com", Path: "/a", Target: "/a?x=1"}, 0},
+		{"prefix under itself", Redirect{Domain: "example.com", Path: "/a", Prefix: true, Target: "/ab"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.redirect
+			err := validate(&r)
+			if (err == nil) != (tt.code != 0) {
+				t.Fatalf("error %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalid) {
+				t.Errorf("error %v, want %v", err, ErrInvalid)
+			}
+			if err == nil && r.Code != tt.code {
+				t.Errorf("code %d, want %d", r.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, reject := configure(t, 3)
+	file := filepath.Join(dir, "nginx", "alice-example.com.conf")
+
+	first, err := Create(Redirect{Domain: "Example.com.", Account: "alice", Path: "/old", Target: "/new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Domain != "example.com" || first.Code != 301 || first.ID == "" || first.Created.IsZero() {
+		t.Errorf("created %+v", first)
+	}
+	if b, err := os.ReadFile(file); err != nil || !strings.Contains(string(b), `location = "/old" { return 301 "/new$is_args$args"; }`) {
+		t.Errorf("rendered %s, %v", b, err)
+	}
+
+	short, err := Create(Redirect{Domain: "example.com", Account: "alice", Target: "https://example.net/campaign", Hits: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(short.Path) != slugLength+1 || short.Code != 302 || short.Hits != 0 {
+		t.Errorf("short link %+v", short)
+	}
+
+	tests := []struct {
+		name     string
+		redirect Redirect
+		err      error
+	}{
+		{"same path", Redirect{Domain: "example.com", Account: "alice", Path: "/old", Target: "/other"}, ErrExists},
+		{"invalid", Redirect{Domain: "example.com", Account: "alice", Path: "/a", Target: "/a"}, ErrInvalid},
+		{"rejected", Redirect{Domain: "example.com", Account: "alice", Path: "/a", Target: "/b"}, ErrRejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := os.ReadFile(file)
+			if tt.err == ErrRejected {
+				os.WriteFile(reject, nil, 0644)
+				defer os.Remove(reject)
+			}
+
+			if _, err := Create(tt.redirect); !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+
+			if after, _ := os.ReadFile(file); string(after) != string(before) {
+				t.Errorf("the file was changed to\n%s", after)
+			}
+			if list, _ := List("example.com"); len(list) != 2 {
+				t.Errorf("kept %+v", list)
+			}
+		})
+	}
+
+	// The same path can be both an exact and a prefix redirect
+	if _, err := Create(Redirect{Domain: "example.com", Account: "alice", Path: "/old", Prefix: true, Target: "/archive/"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(Redirect{Domain: "example.com", Account: "alice", Path: "/more", Target: "/"}); !errors.Is(err, ErrLimit) {
+		t.Errorf("creating over the limit: %v", err)
+	}
+	if _, err := Create(Redirect{Domain: "example.org", Account: "alice", Path: "/more", Target: "/"}); err != nil {
+		t.Errorf("the limit of another domain was applied: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir, _ := configure(t, 10)
+	file := filepath.Join(dir, "nginx", "alice-example.com.conf")
+
+	r, err := Create(Redirect{Domain: "example.com", Account: "alice", Path: "/old", Target: "/new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Create(Redirect{Domain: "example.com", Account: "alice", Path: "/other", Target: "/new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hits counted while the redirect is changed are kept
+	if err := std.Count(map[string]stats.Hits{r.ID: {Hits: 5, Last: time.Now().UTC()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := Update(Redirect{ID: r.ID, Domain: "example.org", Account: "bob", Target: "https://example.net/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Domain != "example.com" || updated.Account != "alice" || updated.Path != "/old" || updated.Code != 301 || updated.Hits != 5 || !updated.Created.Equal(r.Created) {
+		t.Errorf("updated %+v", updated)
+	}
+	if b, _ := os.ReadFile(file); !strings.Contains(string(b), `"https://example.net/$is_args$args"`) {
+		t.Errorf("rendered\n%s", b)
+	}
+
+	if _, err := Update(Redirect{ID: r.ID, Path: other.Path, Target: "/x"}); !errors.Is(err, ErrExists) {
+		t.Errorf("moving onto another redirect: %v", err)
+	}
+	if _, err := Update(Redirect{ID: "missing", Target: "/x"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("updating a missing redirect: %v", err)
+	}
+
+	// The file is removed along with the last redirect of the domain
+	for _, id := range []string{r.ID, other.ID} {
+		if _, err := Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the file of a domain without redirects was kept: %v", err)
+	}
+	if _, err := Delete(r.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting again: %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	configure(t, 10)
+
+	ids := make(map[string]string)
+	for _, r := range []Redirect{
+		{Path: "/blog", Target: "/news"},
+		{Path: "/blog", Prefix: true, Target: "/news/"},
+		{Path: "/blog/2020/", Prefix: true, Target: "/archive/"},
+		{Path: "/shop/", Prefix: true, Target: "https://shop.example.net/"},
+	} {
+		r.Domain, r.Account = "example.com", "alice"
+		created, err := Create(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[created.Path+map[bool]string{true: "*"}[created.Prefix]] = created.ID
+	}
+
+	tests := []struct {
+		domain string
+		path   string
+		want   string
+	}{
+		{"example.com", "/blog", "/blog"},
+		{"example.com", "/blog/", "/blog*"},
+		{"example.com", "/blogs", "/blog*"},
+		{"example.com", "/blog/2020/01", "/blog/2020/*"},
+		{"example.com", "/shop/cart", "/shop/*"},
+
+		{"example.com", "/", ""},
+		{"example.com", "/shop", ""},
+		{"example.org", "/blog", ""},
+	}
+
+	for _, tt := range tests {
+		id, ok := std.Match(tt.domain, tt.path)
+		if id != ids[tt.want] || ok != (tt.want != "") {
+			t.Errorf("Match(%s, %s) = %s, want %s", tt.domain, tt.path, id, ids[tt.want])
+		}
+	}
+}
+
+func TestSlug(t *testing.T) {
+	taken := []Redirect{{Path: "/", Prefix: true}}
+	if path, err := slug(taken); err == nil {
+		t.Errorf("picked %s under a prefix of every path", path)
+	}
+
+	path, err := slug([]Redirect{{Path: "/abc"}})
+	if err != nil || len(path) != slugLength+1 || strings.Trim(path[1:], slugChars) != "" {
+		t.Errorf("picked %q, %v", path, err)
+	}
+}
@@ -0,0 +1,215 @@
+package redirects
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// Placeholders in the paths of the files of a domain
+const (
+	domainPlaceholder  = "{domain}"
+	accountPlaceholder = "{account}"
+)
+
+// header starts every file redirects are rendered into
+const header = "# Managed by CosmicPanel, changes are overwritten when the redirects of the domain change\n"
+
+// server is a web server the redirects of domains are rendered into
+type server interface {
+	name() string
+
+	// file returns the path of the file of the domain, or an empty string when the
+	// server is not installed
+	file(domain string, account string) string
+	render(list []Redirect) string
+	test() error
+	reload() error
+}
+
+// servers returns the web servers redirects are rendered for
+func (m *manager) servers() []server {
+	return []server{&nginx{path: m.config.Nginx}, &apache{paths: m.config.Apache}}
+}
+
+// registerSources registers the files of every domain with the reconciler, so that edits
+// to them are reported and repaired
+func registerSources() {
+	for _, s := range std.servers() {
+		reconcile.Register(s.name(), source(s))
+	}
+}
+
+// source generates the file of every domain with redirects for the server
+func source(s server) reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			list, err := List()
+			if err != nil {
+				return nil, err
+			}
+
+			domains := make(map[string][]Redirect)
+			for _, r := range list {
+				domains[r.Domain] = append(domains[r.Domain], r)
+			}
+
+			var artifacts []reconcile.Artifact
+			for domain, redirects := range domains {
+				if path := s.file(domain, redirects[0].Account); path != "" {
+					artifacts = append(artifacts, reconcile.Artifact{Path: path, Content: s.render(redirects)})
+				}
+			}
+
+			return artifacts, nil
+		},
+		Test:   s.test,
+		Reload: s.reload,
+	}
+}
+
+// render writes the files of the domain for every installed server, or removes them when
+// the domain has no redirects left. The files are put back if a server rejects them
+func (m *manager) render(domain string, account string, list []Redirect) error {
+	for _, s := range m.servers() {
+		path := s.file(domain, account)
+		if path == "" {
+			continue
+		}
+
+		var err error
+		if len(list) > 0 {
+			_, err = reconcile.Write(s.name(), source(s), reconcile.Artifact{Path: path, Content: s.render(list)})
+		} else {
+			_, err = reconcile.Remove(s.name(), source(s), path)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+
+	return nil
+}
+
+// ordered returns the redirects in the order the servers are to try them, exact paths
+// first and then the longest prefixes, so that the most specific redirect wins
+func ordered(list []Redirect) []Redirect {
+	sorted := append([]Redirect(nil), list...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		switch {
+		case a.Prefix != b.Prefix:
+			return !a.Prefix
+		case len(a.Path) != len(b.Path):
+			return len(a.Path) > len(b.Path)
+		default:
+			return a.Path < b.Path
+		}
+	})
+
+	return sorted
+}
+
+// nginx renders the redirects into a file included in the server block of the domain
+type nginx struct {
+	path string
+}
+
+func (t *nginx) name() string {
+	return "redirects.nginx"
+}
+
+func (t *nginx) file(domain string, account string) string {
+	return installed(placeholders(domain, account).Replace(t.path))
+}
+
+func (t *nginx) render(list []Redirect) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, r := range ordered(list) {
+		// The query of the request is passed on unless the target has its own
+		args := "$is_args$args"
+		if strings.Contains(r.Target, "?") {
+			args = ""
+		}
+
+		if r.Prefix {
+			fmt.Fprintf(&b, "location ~ \"^%s(.*)$\" { return %d \"%s$1%s\"; }\n", regexp.QuoteMeta(r.Path), r.Code, r.Target, args)
+		} else {
+			fmt.Fprintf(&b, "location = \"%s\" { return %d \"%s%s\"; }\n", r.Path, r.Code, r.Target, args)
+		}
+	}
+
+	return b.String()
+}
+
+func (t *nginx) test() error {
+	return privsep.Run("nginx", "-t")
+}
+
+func (t *nginx) reload() error {
+	return privsep.Run("nginx", "-s", "reload")
+}
+
+// apache renders the redirects into a file included in the virtual host of the domain,
+// which mod_alias serves
+type apache struct {
+	paths []string
+}
+
+func (t *apache) name() string {
+	return "redirects.apache"
+}
+
+func (t *apache) file(domain string, account string) string {
+	r := placeholders(domain, account)
+	for _, pattern := range t.paths {
+		if path := installed(r.Replace(pattern)); path != "" {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func (t *apache) render(list []Redirect) string {
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteString("<IfModule mod_alias.c>\n")
+	for _, r := range ordered(list) {
+		if r.Prefix {
+			fmt.Fprintf(&b, "    RedirectMatch %d \"^%s(.*)$\" \"%s$1\"\n", r.Code, regexp.QuoteMeta(r.Path), r.Target)
+		} else {
+			fmt.Fprintf(&b, "    RedirectMatch %d \"^%s$\" \"%s\"\n", r.Code, regexp.QuoteMeta(r.Path), r.Target)
+		}
+	}
+	b.WriteString("</IfModule>\n")
+
+	return b.String()
+}
+
+func (t *apache) test() error {
+	return privsep.Run("apachectl", "configtest")
+}
+
+func (t *apache) reload() error {
+	return privsep.Run("apachectl", "graceful")
+}
+
+// placeholders returns the replacer of the placeholders in the paths of the domain
+func placeholders(domain string, account string) *strings.Replacer {
+	return strings.NewReplacer(domainPlaceholder, domain, accountPlaceholder, account)
+}
+
+// installed returns the path if the directory it belongs in exists, or an empty string
+func installed(path string) string {
+	if !reconcile.Installed(path) {
+		return ""
+	}
+
+	return path
+}
@@ -0,0 +1,69 @@
+package redirects
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrdered(t *testing.T) {
+	list := []Redirect{
+		{Path: "/a", Prefix: true},
+		{Path: "/b"},
+		{Path: "/a/b/", Prefix: true},
+		{Path: "/aa"},
+		{Path: "/c", Prefix: true},
+	}
+
+	want := []string{"/aa", "/b", "/a/b/*", "/a*", "/c*"}
+
+	var got []string
+	for _, r := range ordered(list) {
+		got = append(got, r.Path+map[bool]string{true: "*"}[r.Prefix])
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ordered %q, want %q", got, want)
+	}
+
+	if list[0].Path != "/a" {
+		t.Error("the list was sorted in place")
+	}
+}
+
+func TestRender(t *testing.T) {
+	list := []Redirect{
+		{Path: "/docs.old/", Prefix: true, Target: "https://docs.example.net/", Code: 301},
+		{Path: "/old", Target: "/new", Code: 308},
+		{Path: "/go", Target: "https://example.net/?utm_source=go", Code: 302},
+	}
+
+	tests := []struct {
+		name   string
+		server server
+		want   string
+	}{
+		{
+			"nginx",
+			&nginx{},
+			header +
+				"location = \"/old\" { return 308 \"/new$is_args$args\"; }\n" +
+				"location = \"/go\" { return 302 \"https://example.net/?utm_source=go\"; }\n" +
+				"location ~ \"^/docs\\.old/(.*)$\" { return 301 \"https://docs.example.net/$1$is_args$args\"; }\n",
+		},
+		{
+			"apache",
+			&apache{},
+			header +
+				"<IfModule mod_alias.c>\n" +
+				"    RedirectMatch 308 \"^/old$\" \"/new\"\n" +
+				"    RedirectMatch 302 \"^/go$\" \"https://example.net/?utm_source=go\"\n" +
+				"    RedirectMatch 301 \"^/docs\\.old/(.*)$\" \"https://docs.example.net/$1\"\n" +
+				"</IfModule>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.server.render(list); got != tt.want {
+			t.Errorf("%s rendered\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
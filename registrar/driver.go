@@ -0,0 +1,76 @@
+package registrar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// Driver carries out orders at a registrar
+type Driver interface {
+	Name() string
+
+	// Available returns true if the domain can be registered
+	Available(ctx context.Context, name string) (bool, error)
+
+	// Register registers the domain, returning when it expires
+	Register(ctx context.Context, o Order) (time.Time, error)
+
+	// Renew extends the registration of the domain expiring at the time by the years,
+	// returning when it now expires
+	Renew(ctx context.Context, name string, expires time.Time, years int) (time.Time, error)
+
+	// Transfer requests the transfer of the domain from its current registrar
+	Transfer(ctx context.Context, o Order) error
+
+	// TransferStatus returns where the transfer of the domain stands
+	TransferStatus(ctx context.Context, name string) (TransferStatus, error)
+
+	// SetNameservers replaces the nameservers the domain is delegated to
+	SetNameservers(ctx context.Context, name string, nameservers []string) error
+
+	// SetDS replaces the DS records of the domain
+	SetDS(ctx context.Context, name string, records []DS) error
+}
+
+// TransferStatus is where a transfer stands
+type TransferStatus struct {
+	// TransferPending, TransferFailed or Active once the domain was transferred
+	State string
+
+	// Why the transfer failed
+	Reason string
+
+	// When the domain expires once it was transferred
+	Expires time.Time
+}
+
+// newDriver returns the driver for the configuration, or nil when registration is off
+func newDriver(c *config.RegistrarConfiguration) (Driver, error) {
+	switch c.Driver {
+	case "none", "":
+		return nil, nil
+	}
+
+	if c.Username == "" || c.Password == "" || c.Contact == "" {
+		return nil, fmt.Errorf("registrar: the %s driver requires a username, password and contact", c.Driver)
+	}
+
+	switch c.Driver {
+	case "epp":
+		if c.Address == "" {
+			return nil, errors.New("registrar: the epp driver requires the address of the EPP server")
+		}
+		return newEPP(c), nil
+	case "resellerclub":
+		if c.Customer == "" {
+			return nil, errors.New("registrar: the resellerclub driver requires the customer domains are ordered for")
+		}
+		return newResellerClub(c), nil
+	default:
+		return nil, fmt.Errorf("registrar: unknown driver %q", c.Driver)
+	}
+}
@@ -0,0 +1,449 @@
+package registrar
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+)
+
+// EPP namespaces of the objects and extensions the driver uses
+const (
+	eppNS     = "urn:ietf:params:xml:ns:epp-1.0"
+	domainNS  = "urn:ietf:params:xml:ns:domain-1.0"
+	hostNS    = "urn:ietf:params:xml:ns:host-1.0"
+	secDNSNS  = "urn:ietf:params:xml:ns:secDNS-1.1"
+	eppMaxLen = 1 << 20
+)
+
+// epp talks to a registry or registrar over the Extensible Provisioning Protocol,
+// opening a session for every order
+type epp struct {
+	address  string
+	username string
+	password string
+	contact  string
+
+	// Registries limit the sessions a registrar may hold, so orders are sent one at a time
+	mu sync.Mutex
+}
+
+func newEPP(c *config.RegistrarConfiguration) *epp {
+	return &epp{address: c.Address, username: c.Username, password: c.Password, contact: c.Contact}
+}
+
+func (e *epp) Name() string {
+	return "epp"
+}
+
+func (e *epp) Available(ctx context.Context, name string) (bool, error) {
+	var available bool
+
+	err := e.session(ctx, func(s *eppSession) error {
+		resp, err := s.command(`<check><domain:check xmlns:domain="%s"><domain:name>%s</domain:name></domain:check></check>`, domainNS, esc(name))
+		if err != nil {
+			return err
+		}
+
+		available = len(resp.Checked) == 1 && resp.Checked[0].available()
+		return nil
+	})
+
+	return available, err
+}
+
+func (e *epp) Register(ctx context.Context, o Order) (time.Time, error) {
+	var expires time.Time
+
+	err := e.session(ctx, func(s *eppSession) error {
+		if err := s.ensureHosts(o.Nameservers); err != nil {
+			return err
+		}
+
+		resp, err := s.command(`<create><domain:create xmlns:domain="%s"><domain:name>%s</domain:name><domain:period unit="y">%d</domain:period>%s`+
+			`<domain:registrant>%s</domain:registrant><domain:contact type="admin">%s</domain:contact><domain:contact type="tech">%s</domain:contact><domain:contact type="billing">%s</domain:contact>`+
+			`<domain:authInfo><domain:pw>%s</domain:pw></domain:authInfo></domain:create></create>`,
+			domainNS, esc(o.Name), o.Years, hostObjs(o.Nameservers), esc(e.contact), esc(e.contact), esc(e.contact), esc(e.contact), authInfo())
+		if err != nil {
+			return err
+		}
+
+		expires, err = parseTime(resp.Created)
+		return err
+	})
+
+	return expires, err
+}
+
+func (e *epp) Renew(ctx context.Context, name string, _ time.Time, years int) (time.Time, error) {
+	var expires time.Time
+
+	err := e.session(ctx, func(s *eppSession) error {
+		// The registry only renews from the expiry it holds, which is read rather than
+		// trusted from the panel's copy
+		info, err := s.info(name)
+		if err != nil {
+			return err
+		}
+
+		current, err := parseTime(info.Expires)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.command(`<renew><domain:renew xmlns:domain="%s"><domain:name>%s</domain:name><domain:curExpDate>%s</domain:curExpDate><domain:period unit="y">%d</domain:period></domain:renew></renew>`,
+			domainNS, esc(name), current.Format(time.DateOnly), years)
+		if err != nil {
+			return err
+		}
+
+		expires, err = parseTime(resp.Renewed)
+		return err
+	})
+
+	return expires, err
+}
+
+func (e *epp) Transfer(ctx context.Context, o Order) error {
+	return e.session(ctx, func(s *eppSession) error {
+		_, err := s.command(`<transfer op="request"><domain:transfer xmlns:domain="%s"><domain:name>%s</domain:name><domain:period unit="y">%d</domain:period><domain:authInfo><domain:pw>%s</domain:pw></domain:authInfo></domain:transfer></transfer>`,
+			domainNS, esc(o.Name), o.Years, esc(o.AuthCode))
+		return err
+	})
+}
+
+func (e *epp) TransferStatus(ctx context.Context, name string) (TransferStatus, error) {
+	var status TransferStatus
+
+	err := e.session(ctx, func(s *eppSession) error {
+		resp, err := s.command(`<transfer op="query"><domain:transfer xmlns:domain="%s"><domain:name>%s</domain:name></domain:transfer></transfer>`, domainNS, esc(name))
+		if err != nil {
+			return err
+		}
+
+		switch resp.TransferStatus {
+		case "pending":
+			status.State = TransferPending
+			return nil
+		case "clientApproved", "serverApproved":
+		default:
+			status.State = TransferFailed
+			status.Reason = "the transfer was " + resp.TransferStatus
+			return nil
+		}
+
+		// Once approved the domain is sponsored by the registrar, which can read it
+		info, err := s.info(name)
+		if err != nil {
+			return err
+		}
+
+		status.State = Active
+		status.Expires, err = parseTime(info.Expires)
+		return err
+	})
+
+	return status, err
+}
+
+func (e *epp) SetNameservers(ctx context.Context, name string, nameservers []string) error {
+	return e.session(ctx, func(s *eppSession) error {
+		info, err := s.info(name)
+		if err != nil {
+			return err
+		}
+
+		add, rem := nsChanges(info.Nameservers, nameservers)
+		if len(add) == 0 && len(rem) == 0 {
+			return nil
+		}
+
+		if err := s.ensureHosts(add); err != nil {
+			return err
+		}
+
+		var change strings.Builder
+		if len(add) > 0 {
+			change.WriteString("<domain:add>" + hostObjs(add) + "</domain:add>")
+		}
+		if len(rem) > 0 {
+			change.WriteString("<domain:rem>" + hostObjs(rem) + "</domain:rem>")
+		}
+
+		_, err = s.command(`<update><domain:update xmlns:domain="%s"><domain:name>%s</domain:name>%s</domain:update></update>`, domainNS, esc(name), change.String())
+		return err
+	})
+}
+
+func (e *epp) SetDS(ctx context.Context, name string, records []DS) error {
+	var add strings.Builder
+	for _, ds := range records {
+		fmt.Fprintf(&add, "<secDNS:dsData><secDNS:keyTag>%d</secDNS:keyTag><secDNS:alg>%d</secDNS:alg><secDNS:digestType>%d</secDNS:digestType><secDNS:digest>%s</secDNS:digest></secDNS:dsData>",
+			ds.KeyTag, ds.Algorithm, ds.DigestType, esc(ds.Digest))
+	}
+
+	ext := "<secDNS:rem><secDNS:all>true</secDNS:all></secDNS:rem>"
+	if add.Len() > 0 {
+		ext += "<secDNS:add>" + add.String() + "</secDNS:add>"
+	}
+
+	return e.session(ctx, func(s *eppSession) error {
+		_, err := s.command(`<update><domain:update xmlns:domain="%s"><domain:name>%s</domain:name></domain:update></update><extension><secDNS:update xmlns:secDNS="%s">%s</secDNS:update></extension>`,
+			domainNS, esc(name), secDNSNS, ext)
+		return err
+	})
+}
+
+// session connects and logs in to the server, runs the commands and logs out
+func (e *epp) session(ctx context.Context, fn func(s *eppSession) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	host, _, err := net.SplitHostPort(e.address)
+	if err != nil {
+		return fmt.Errorf("registrar: invalid EPP address %q: %w", e.address, err)
+	}
+
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+	conn, err := dialer.DialContext(ctx, "tcp", e.address)
+	if err != nil {
+		return fmt.Errorf("registrar: connecting to %s: %w", e.address, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	s := &eppSession{conn: conn}
+
+	// The server greets every connection before it accepts commands
+	if _, err := s.read(); err != nil {
+		return fmt.Errorf("registrar: reading the EPP greeting: %w", err)
+	}
+
+	_, err = s.command(`<login><clID>%s</clID><pw>%s</pw><options><version>1.0</version><lang>en</lang></options>`+
+		`<svcs><objURI>%s</objURI><objURI>%s</objURI><svcExtension><extURI>%s</extURI></svcExtension></svcs></login>`,
+		esc(e.username), esc(e.password), domainNS, hostNS, secDNSNS)
+	if err != nil {
+		return err
+	}
+
+	err = fn(s)
+
+	s.command("<logout/>")
+
+	return err
+}
+
+// eppSession is a connection to an EPP server a registrar is logged in on
+type eppSession struct {
+	conn net.Conn
+}
+
+// eppResponse holds what the driver reads from the responses of the server
+type eppResponse struct {
+	Results []struct {
+		Code    int    `xml:"code,attr"`
+		Message string `xml:"msg"`
+		Reason  string `xml:"extValue>reason"`
+	} `xml:"response>result"`
+
+	Checked        []eppChecked `xml:"response>resData>chkData>cd>name"`
+	Created        string       `xml:"response>resData>creData>exDate"`
+	Renewed        string       `xml:"response>resData>renData>exDate"`
+	TransferStatus string       `xml:"response>resData>trnData>trStatus"`
+	Nameservers    []string     `xml:"response>resData>infData>ns>hostObj"`
+	Expires        string       `xml:"response>resData>infData>exDate"`
+}
+
+// eppChecked is whether a domain or host of a check is available
+type eppChecked struct {
+	Name  string `xml:",chardata"`
+	Avail string `xml:"avail,attr"`
+}
+
+func (c eppChecked) available() bool {
+	return c.Avail == "1" || c.Avail == "true"
+}
+
+// command sends the command formatted with the arguments and returns the response,
+// which is an error unless its result code is in the 1000s
+func (s *eppSession) command(format string, args ...interface{}) (eppResponse, error) {
+	// Extensions such as secDNS follow the command within the command element
+	msg := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="no"?><epp xmlns="%s"><command>%s<clTRID>cosmicpanel-%s</clTRID></command></epp>`,
+		eppNS, fmt.Sprintf(format, args...), ids.New())
+
+	if err := s.write([]byte(msg)); err != nil {
+		return eppResponse{}, err
+	}
+
+	data, err := s.read()
+	if err != nil {
+		return eppResponse{}, err
+	}
+
+	var resp eppResponse
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return eppResponse{}, fmt.Errorf("registrar: malformed EPP response: %w", err)
+	}
+
+	if len(resp.Results) == 0 {
+		return eppResponse{}, errors.New("registrar: the EPP response has no result")
+	}
+
+	if r := resp.Results[0]; r.Code < 1000 || r.Code >= 2000 {
+		msg := strings.TrimSpace(r.Message)
+		if reason := strings.TrimSpace(r.Reason); reason != "" {
+			msg += ": " + reason
+		}
+		return eppResponse{}, fmt.Errorf("registrar: %d %s", r.Code, msg)
+	}
+
+	return resp, nil
+}
+
+// info returns the domain as the registry holds it
+func (s *eppSession) info(name string) (eppResponse, error) {
+	return s.command(`<info><domain:info xmlns:domain="%s"><domain:name hosts="all">%s</domain:name></domain:info></info>`, domainNS, esc(name))
+}
+
+// ensureHosts creates the nameservers the registry does not know yet, which domains can
+// only be delegated to once they exist. Nameservers within a zone of the registry also
+// need glue addresses, which are registered with the registrar by hand
+func (s *eppSession) ensureHosts(nameservers []string) error {
+	if len(nameservers) == 0 {
+		return nil
+	}
+
+	var names strings.Builder
+	for _, ns := range nameservers {
+		names.WriteString("<host:name>" + esc(ns) + "</host:name>")
+	}
+
+	resp, err := s.command(`<check><host:check xmlns:host="%s">%s</host:check></check>`, hostNS, names.String())
+	if err != nil {
+		return err
+	}
+
+	for _, c := range resp.Checked {
+		if !c.available() {
+			continue
+		}
+
+		if _, err := s.command(`<create><host:create xmlns:host="%s"><host:name>%s</host:name></host:create></create>`, hostNS, esc(c.Name)); err != nil {
+			return fmt.Errorf("%w (creating nameserver %s)", err, c.Name)
+		}
+	}
+
+	return nil
+}
+
+// write sends a message with the length header of the EPP TCP transport
+func (s *eppSession) write(msg []byte) error {
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(4+len(msg)))
+
+	_, err := s.conn.Write(append(frame, msg...))
+	return err
+}
+
+// read receives a message sent with its length header
+func (s *eppSession) read() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:])
+	if n < 4 || n > eppMaxLen {
+		return nil, fmt.Errorf("registrar: EPP message of %d bytes", n)
+	}
+
+	msg := make([]byte, n-4)
+	if _, err := io.ReadFull(s.conn, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// nsChanges returns the nameservers to add to and remove from the current ones of a
+// domain to delegate it to the lowercase nameservers. Registries may answer with host
+// names in any case
+func nsChanges(current []string, nameservers []string) (add []string, rem []string) {
+	lower := make([]string, len(current))
+	for i, ns := range current {
+		lower[i] = strings.ToLower(strings.TrimSuffix(ns, "."))
+	}
+
+	for _, ns := range nameservers {
+		if !slices.Contains(lower, ns) {
+			add = append(add, ns)
+		}
+	}
+	for i, ns := range current {
+		if !slices.Contains(nameservers, lower[i]) {
+			rem = append(rem, ns)
+		}
+	}
+
+	return add, rem
+}
+
+// hostObjs returns the nameservers as the ns element of a domain
+func hostObjs(nameservers []string) string {
+	if len(nameservers) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<domain:ns>")
+	for _, ns := range nameservers {
+		sb.WriteString("<domain:hostObj>" + esc(ns) + "</domain:hostObj>")
+	}
+	sb.WriteString("</domain:ns>")
+
+	return sb.String()
+}
+
+// authInfo returns a random transfer password for a new domain, which registries require
+// to mix letters, digits and symbols
+func authInfo() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	return "Cp" + hex.EncodeToString(b) + "#7"
+}
+
+// esc escapes the text for an XML element or attribute
+func esc(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+
+	return buf.String()
+}
+
+// parseTime parses a date of an EPP response
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("registrar: the EPP server answered without a valid expiry date: %q", s)
+	}
+
+	return t.UTC(), nil
+}
@@ -0,0 +1,123 @@
+package registrar
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serve answers the next message sent over the session with the raw frame
+func serve(t *testing.T, frame []byte) *eppSession {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	go func() {
+		s := &eppSession{conn: server}
+		if _, err := s.read(); err != nil {
+			return
+		}
+		server.Write(frame)
+	}()
+
+	return &eppSession{conn: client}
+}
+
+// framed returns the message with the length header of the EPP TCP transport
+func framed(msg string) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(4+len(msg)))
+
+	return append(frame, msg...)
+}
+
+// result returns a response with the result code and message
+func result(code string, msg string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><epp xmlns="urn:ietf:params:xml:ns:epp-1.0"><response><result code="` + code + `"><msg>` + msg + `</msg></result>` +
+		`<resData><domain:chkData xmlns:domain="urn:ietf:params:xml:ns:domain-1.0"><domain:cd><domain:name avail="1">example.com</domain:name></domain:cd></domain:chkData></resData></response></epp>`
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{"completed", framed(result("1000", "Command completed successfully")), ""},
+		{"pending", framed(result("1001", "Command completed successfully; action pending")), ""},
+
+		{"object exists", framed(result("2302", "Object exists")), "2302 Object exists"},
+		{"with a reason", framed(strings.Replace(result("2306", "Parameter value policy error"), "</msg>", "</msg><extValue><reason>Too many nameservers</reason></extValue>", 1)), "2306 Parameter value policy error: Too many nameservers"},
+		{"no result", framed(`<epp><response></response></epp>`), "no result"},
+		{"malformed", framed(`<epp><response>`), "malformed"},
+		{"length below the header", binary.BigEndian.AppendUint32(nil, 3), "EPP message of 3 bytes"},
+		{"too long", binary.BigEndian.AppendUint32(nil, eppMaxLen+1), "bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := serve(t, tt.frame)
+
+			resp, err := s.command(`<check><domain:check xmlns:domain="%s"><domain:name>%s</domain:name></domain:check></check>`, domainNS, "example.com")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(resp.Checked) != 1 || !resp.Checked[0].available() {
+					t.Errorf("checked %+v", resp.Checked)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNSChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     []string
+		nameservers []string
+		add         []string
+		rem         []string
+	}{
+		{"unchanged", []string{"ns1.example.net", "ns2.example.net"}, []string{"ns1.example.net", "ns2.example.net"}, nil, nil},
+		{"in another case", []string{"NS1.EXAMPLE.NET", "ns2.example.net."}, []string{"ns1.example.net", "ns2.example.net"}, nil, nil},
+		{"replaced", []string{"NS1.example.org", "ns2.example.net"}, []string{"ns1.example.net", "ns2.example.net"}, []string{"ns1.example.net"}, []string{"NS1.example.org"}},
+		{"none before", nil, []string{"ns1.example.net", "ns2.example.net"}, []string{"ns1.example.net", "ns2.example.net"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, rem := nsChanges(tt.current, tt.nameservers)
+			if !slices.Equal(add, tt.add) || !slices.Equal(rem, tt.rem) {
+				t.Errorf("adds %q and removes %q, want %q and %q", add, rem, tt.add, tt.rem)
+			}
+		})
+	}
+}
+
+func TestEsc(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"a<b>&\"c'", "a&lt;b&gt;&amp;&#34;c&#39;"},
+		{"</domain:pw></domain:authInfo><domain:ns>", "&lt;/domain:pw&gt;&lt;/domain:authInfo&gt;&lt;domain:ns&gt;"},
+	}
+
+	for _, tt := range tests {
+		if got := esc(tt.text); got != tt.want {
+			t.Errorf("esc(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,679 @@
+package registrar
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/cache"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// States of a domain at the registrar
+const (
+	Active          = "active"
+	TransferPending = "transfer_pending"
+	TransferFailed  = "transfer_failed"
+)
+
+var (
+	// ErrNotConfigured is returned when registration is turned off
+	ErrNotConfigured = errors.New("registrar: domain registration is not configured")
+
+	// ErrNotFound is returned for a domain the panel does not manage
+	ErrNotFound = errors.New("registrar: domain not found")
+
+	// ErrExists is returned when registering or transferring a domain the panel already
+	// manages
+	ErrExists = errors.New("registrar: the domain is already managed by the panel")
+
+	// ErrUnavailable is returned when registering a domain that is taken
+	ErrUnavailable = errors.New("registrar: the domain is not available")
+
+	// ErrFailed is returned when the registrar refused an order or could not be reached
+	ErrFailed = errors.New("registrar: the registrar failed the order")
+)
+
+// Domain is a domain registered or transferred through the panel
+type Domain struct {
+	Name string `json:"name"`
+
+	// The ID of the user the domain belongs to
+	Owner string `json:"owner"`
+
+	State string `json:"state"`
+
+	Expires   time.Time `json:"expires,omitempty"`
+	AutoRenew bool      `json:"auto_renew"`
+
+	Nameservers []string `json:"nameservers"`
+	DS          []DS     `json:"ds"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// Why the last transfer or automatic renewal failed
+	Error string `json:"error,omitempty"`
+}
+
+// DS is a delegation signer record published at the parent zone for DNSSEC
+type DS struct {
+	KeyTag     int    `json:"key_tag"`
+	Algorithm  int    `json:"algorithm"`
+	DigestType int    `json:"digest_type"`
+	Digest     string `json:"digest"`
+}
+
+// Order is a registration or transfer of a domain
+type Order struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+
+	// The years the domain is registered for, or added to it on transfer
+	Years int `json:"years,omitempty"`
+
+	// The nameservers the domain is delegated to, the configured ones when empty
+	Nameservers []string `json:"nameservers,omitempty"`
+
+	// The code the current registrar gave out to authorize a transfer
+	AuthCode string `json:"auth_code,omitempty"`
+
+	AutoRenew bool `json:"auto_renew"`
+}
+
+// domainKind is what domains are kept under in the state store, keyed by name
+const domainKind = "domain"
+
+// timeout is how long a call to the registrar may take
+const timeout = time.Minute
+
+type registrar struct {
+	// Serializes the changes to domains, which each call the registrar before they are
+	// stored
+	mu     sync.Mutex
+	config *config.RegistrarConfiguration
+	driver Driver
+}
+
+var std *registrar
+
+// Configure sets up the driver of the registrar. Registration stays off with the none
+// driver
+func Configure(c *config.RegistrarConfiguration) error {
+	d, err := newDriver(c)
+	if err != nil {
+		return err
+	}
+
+	std = &registrar{config: c, driver: d}
+
+	return nil
+}
+
+// Enabled returns true if domains can be registered
+func Enabled() bool {
+	return std != nil && std.driver != nil
+}
+
+// Available returns true if the domain can be registered
+func Available(name string) (bool, error) {
+	if !Enabled() {
+		return false, ErrNotConfigured
+	}
+
+	name, err := normalize(name)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	available, err := std.driver.Available(ctx, name)
+
+	return available, failed(err)
+}
+
+// domains caches the domains of owners, which every request to the DNS and CDN API
+// looks up to find the domains the caller manages. Changes to domains purge it
+var domains = cache.New("registrar.domains", 30*time.Second, 10000)
+
+func init() {
+	domains.PurgeOn("domain.*")
+}
+
+// List returns the domains of the owners, or every domain when no owners are given,
+// sorted by name
+func List(owners ...string) ([]Domain, error) {
+	v, err := domains.Get(strings.Join(owners, ","), func() (interface{}, error) {
+		return load(owners)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(v.([]Domain)), nil
+}
+
+// load reads the domains of the owners from the state store
+func load(owners []string) ([]Domain, error) {
+	list := []Domain{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(domainKind, func(id string, data []byte) error {
+			var d Domain
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("registrar: malformed domain %s: %w", id, err)
+			}
+
+			if len(owners) == 0 || slices.Contains(owners, d.Owner) {
+				list = append(list, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// Get returns the domain
+func Get(name string) (Domain, error) {
+	var d Domain
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(domainKind, strings.ToLower(name), &d)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Domain{}, ErrNotFound
+	}
+
+	return d, err
+}
+
+// Account returns the username of the account the domain belongs to, or an empty string
+// when the panel does not manage the domain
+func Account(name string) string {
+	d, err := Get(name)
+	if err != nil {
+		return ""
+	}
+
+	u, err := auth.GetUser(d.Owner)
+	if err != nil {
+		return ""
+	}
+
+	return u.Username
+}
+
+// Register registers the domain at the registrar for its owner
+func Register(o Order) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	if err := std.prepare(&o); err != nil {
+		return Domain{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if _, err := Get(o.Name); err == nil {
+		return Domain{}, ErrExists
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	available, err := std.driver.Available(ctx, o.Name)
+	if err != nil {
+		return Domain{}, failed(err)
+	}
+	if !available {
+		return Domain{}, ErrUnavailable
+	}
+
+	expires, err := std.driver.Register(ctx, o)
+	if err != nil {
+		return Domain{}, failed(err)
+	}
+
+	now := time.Now().UTC()
+	d := Domain{
+		Name:        o.Name,
+		Owner:       o.Owner,
+		State:       Active,
+		Expires:     expires,
+		AutoRenew:   o.AutoRenew,
+		Nameservers: o.Nameservers,
+		DS:          []DS{},
+		Created:     now,
+		Updated:     now,
+	}
+
+	// The domain is registered and paid for by now, so failing to store it is logged
+	// loudly rather than hidden behind an error the caller would retry
+	if err := put(d); err != nil {
+		zap.S().Named("registrar").Errorw("registered a domain but failed to store it", "domain", d.Name, zap.Error(err))
+		return d, err
+	}
+
+	return d, nil
+}
+
+// Transfer requests the transfer of the domain to the registrar for its owner. The
+// transfer completes once the current registrar approves it or lets it time out, which
+// the domains task checks for
+func Transfer(o Order) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	if err := std.prepare(&o); err != nil {
+		return Domain{}, err
+	}
+
+	if o.AuthCode == "" {
+		return Domain{}, errors.New("registrar: a transfer requires the auth code of the current registrar")
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	// A failed transfer is retried by its owner alone, who the domain would otherwise be
+	// taken from
+	if d, err := Get(o.Name); err == nil && (d.State != TransferFailed || d.Owner != o.Owner) {
+		return Domain{}, ErrExists
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := std.driver.Transfer(ctx, o); err != nil {
+		return Domain{}, failed(err)
+	}
+
+	now := time.Now().UTC()
+	d := Domain{
+		Name:        o.Name,
+		Owner:       o.Owner,
+		State:       TransferPending,
+		AutoRenew:   o.AutoRenew,
+		Nameservers: o.Nameservers,
+		DS:          []DS{},
+		Created:     now,
+		Updated:     now,
+	}
+
+	return d, put(d)
+}
+
+// Renew extends the registration of the domain by the years, or the configured period
+// when zero
+func Renew(name string, years int) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.renew(name, years)
+}
+
+// renew extends the registration of the domain, with the lock held
+func (r *registrar) renew(name string, years int) (Domain, error) {
+	if years == 0 {
+		years = r.config.Period
+	}
+	if years < 1 || years > 10 {
+		return Domain{}, errors.New("registrar: domains are renewed for 1 to 10 years")
+	}
+
+	d, err := Get(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	if d.State != Active {
+		return Domain{}, fmt.Errorf("registrar: %s cannot be renewed while it is %s", d.Name, d.State)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	expires, err := r.driver.Renew(ctx, d.Name, d.Expires, years)
+	if err != nil {
+		return Domain{}, failed(err)
+	}
+
+	d.Expires = expires
+	d.Error = ""
+	d.Updated = time.Now().UTC()
+
+	return d, put(d)
+}
+
+// Update changes whether the domain renews automatically
+func Update(name string, autoRenew bool) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, err := Get(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	d.AutoRenew = autoRenew
+	d.Updated = time.Now().UTC()
+
+	return d, put(d)
+}
+
+// SetNameservers delegates the domain to the nameservers, the configured ones when none
+// are given
+func SetNameservers(name string, nameservers []string) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	nameservers, err := std.nameservers(nameservers)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, err := active(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := std.driver.SetNameservers(ctx, d.Name, nameservers); err != nil {
+		return Domain{}, failed(err)
+	}
+
+	d.Nameservers = nameservers
+	d.Updated = time.Now().UTC()
+
+	return d, put(d)
+}
+
+// SetDS replaces the DS records published for the domain, which turns DNSSEC off when
+// there are none
+func SetDS(name string, records []DS) (Domain, error) {
+	if !Enabled() {
+		return Domain{}, ErrNotConfigured
+	}
+
+	for i := range records {
+		if err := records[i].validate(); err != nil {
+			return Domain{}, err
+		}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, err := active(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := std.driver.SetDS(ctx, d.Name, records); err != nil {
+		return Domain{}, failed(err)
+	}
+
+	d.DS = append([]DS{}, records...)
+	d.Updated = time.Now().UTC()
+
+	return d, put(d)
+}
+
+// Forget stops managing the domain in the panel. It stays registered at the registrar.
+// Domains are kept when their owner is deleted, so that admins can still renew or move
+// them
+func Forget(name string) error {
+	err := store.Update(func(tx *store.Tx) error {
+		if err := tx.Get(domainKind, strings.ToLower(name), &Domain{}); err != nil {
+			return err
+		}
+		return tx.Delete(domainKind, strings.ToLower(name))
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+	domains.Purge()
+
+	return err
+}
+
+// Sync completes the transfers the current registrar has approved and renews the
+// domains set to renew automatically that expire within the configured days. It is run
+// by the scheduler
+func Sync() error {
+	if !Enabled() {
+		return nil
+	}
+
+	list, err := List()
+	if err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var errs []error
+	for _, d := range list {
+		switch {
+		case d.State == TransferPending:
+			errs = append(errs, std.completeTransfer(d))
+		case d.State == Active && d.AutoRenew && time.Until(d.Expires) < time.Duration(std.config.RenewDays)*24*time.Hour:
+			if _, err := std.renew(d.Name, 0); err != nil {
+				d.Error = err.Error()
+				d.Updated = time.Now().UTC()
+				errs = append(errs, err, put(d))
+
+				publish("domain.renew_failed", d)
+				continue
+			}
+
+			zap.S().Named("registrar").Infow("renewed domain", "domain", d.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// completeTransfer checks a pending transfer, and once it completed, delegates the
+// domain to its nameservers
+func (r *registrar) completeTransfer(d Domain) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status, err := r.driver.TransferStatus(ctx, d.Name)
+	if err != nil {
+		return failed(err)
+	}
+
+	switch status.State {
+	case TransferPending:
+		return nil
+	case TransferFailed:
+		d.State = TransferFailed
+		d.Error = status.Reason
+		d.Updated = time.Now().UTC()
+
+		publish("domain.transfer_failed", d)
+		return put(d)
+	}
+
+	d.State = Active
+	d.Expires = status.Expires
+	d.Error = ""
+	d.Updated = time.Now().UTC()
+
+	if err := r.driver.SetNameservers(ctx, d.Name, d.Nameservers); err != nil {
+		d.Error = "the domain was transferred but could not be delegated to its nameservers: " + err.Error()
+	}
+
+	publish("domain.transfer", d)
+
+	return put(d)
+}
+
+// prepare checks the order and fills in its defaults
+func (r *registrar) prepare(o *Order) error {
+	name, err := normalize(o.Name)
+	if err != nil {
+		return err
+	}
+	o.Name = name
+
+	if o.Owner == "" {
+		return errors.New("registrar: the domain needs an owner")
+	}
+
+	if o.Years == 0 {
+		o.Years = r.config.Period
+	}
+	if o.Years < 1 || o.Years > 10 {
+		return errors.New("registrar: domains are registered for 1 to 10 years")
+	}
+
+	o.Nameservers, err = r.nameservers(o.Nameservers)
+
+	return err
+}
+
+// nameservers checks the nameservers, returning the configured ones when there are none
+func (r *registrar) nameservers(list []string) ([]string, error) {
+	if len(list) == 0 {
+		list = r.config.Nameservers
+	}
+
+	if len(list) < 2 || len(list) > 13 {
+		return nil, errors.New("registrar: a domain needs between 2 and 13 nameservers")
+	}
+
+	normalized := make([]string, 0, len(list))
+	for _, ns := range list {
+		n, err := normalize(ns)
+		if err != nil {
+			return nil, fmt.Errorf("registrar: invalid nameserver %q", ns)
+		}
+		if !slices.Contains(normalized, n) {
+			normalized = append(normalized, n)
+		}
+	}
+
+	return normalized, nil
+}
+
+// digestSizes holds the length in bytes of the digests of the known digest types, which
+// a mistyped digest published at the parent zone would break resolution of the domain for
+var digestSizes = map[int]int{1: 20, 2: 32, 3: 32, 4: 48}
+
+// validate checks the record and normalizes its digest
+func (ds *DS) validate() error {
+	ds.Digest = strings.ToUpper(strings.ReplaceAll(ds.Digest, " ", ""))
+
+	if ds.KeyTag < 0 || ds.KeyTag > 65535 || ds.Algorithm < 1 || ds.Algorithm > 255 || ds.DigestType < 1 || ds.DigestType > 255 {
+		return errors.New("registrar: a DS record needs a key tag, algorithm and digest type")
+	}
+
+	b, err := hex.DecodeString(ds.Digest)
+	if err != nil || len(b) == 0 {
+		return errors.New("registrar: the digest of a DS record must be hexadecimal")
+	}
+
+	if n, ok := digestSizes[ds.DigestType]; ok && len(b) != n {
+		return fmt.Errorf("registrar: a digest of type %d is %d bytes, not %d", ds.DigestType, n, len(b))
+	}
+
+	return nil
+}
+
+// normalize returns the domain name lower case, checking that it has a name below a top
+// level domain. Internationalized names are given in their xn-- form
+func normalize(name string) (string, error) {
+	ascii := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+
+	if !hostname.Valid(ascii) {
+		return "", fmt.Errorf("registrar: invalid domain %q, internationalized domains are given in their xn-- form", name)
+	}
+
+	return ascii, nil
+}
+
+// active returns the domain, which must be active at the registrar to be changed
+func active(name string) (Domain, error) {
+	d, err := Get(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	if d.State != Active {
+		return Domain{}, fmt.Errorf("registrar: %s cannot be changed while it is %s", d.Name, d.State)
+	}
+
+	return d, nil
+}
+
+// failed returns the error of a driver as ErrFailed, keeping what the registrar said
+func failed(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrFailed, strings.TrimPrefix(err.Error(), "registrar: "))
+}
+
+// put stores the domain
+func put(d Domain) error {
+	defer domains.Purge()
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(domainKind, d.Name, d)
+	})
+}
+
+// publish publishes what happened to a domain from a scheduled task, which has no actor
+func publish(typ string, d Domain) {
+	events.Publish(events.Event{
+		Type:     typ,
+		Resource: d.Name,
+		Account:  d.Owner,
+		Data:     map[string]interface{}{"state": d.State, "expires": d.Expires, "error": d.Error},
+	})
+}
@@ -0,0 +1,450 @@
+package registrar
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// fake is a registrar holding the domains it registered in memory
+type fake struct {
+	taken    map[string]bool
+	expires  map[string]time.Time
+	transfer map[string]TransferStatus
+	err      error
+
+	// The orders the registrar was asked to carry out
+	calls []string
+}
+
+func (f *fake) Name() string {
+	return "fake"
+}
+
+func (f *fake) Available(ctx context.Context, name string) (bool, error) {
+	return !f.taken[name], nil
+}
+
+func (f *fake) Register(ctx context.Context, o Order) (time.Time, error) {
+	f.calls = append(f.calls, "register "+o.Name)
+	if f.err != nil {
+		return time.Time{}, f.err
+	}
+
+	f.taken[o.Name] = true
+	f.expires[o.Name] = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(o.Years, 0, 0)
+
+	return f.expires[o.Name], nil
+}
+
+func (f *fake) Renew(ctx context.Context, name string, expires time.Time, years int) (time.Time, error) {
+	f.calls = append(f.calls, "renew "+name)
+	if f.err != nil {
+		return time.Time{}, f.err
+	}
+
+	f.expires[name] = expires.AddDate(years, 0, 0)
+
+	return f.expires[name], nil
+}
+
+func (f *fake) Transfer(ctx context.Context, o Order) error {
+	f.calls = append(f.calls, "transfer "+o.Name)
+
+	return f.err
+}
+
+func (f *fake) TransferStatus(ctx context.Context, name string) (TransferStatus, error) {
+	return f.transfer[name], f.err
+}
+
+func (f *fake) SetNameservers(ctx context.Context, name string, nameservers []string) error {
+	f.calls = append(f.calls, "nameservers "+name+" "+strings.Join(nameservers, " "))
+
+	return nil
+}
+
+func (f *fake) SetDS(ctx context.Context, name string, records []DS) error {
+	f.calls = append(f.calls, "ds "+name)
+
+	return f.err
+}
+
+// configure sets up the registrar with a fake driver and a state store of its own
+func configure(t *testing.T) *fake {
+	t.Helper()
+
+	if err := store.Configure(t.TempDir(), &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	domains.Purge()
+
+	f := &fake{taken: map[string]bool{}, expires: map[string]time.Time{}, transfer: map[string]TransferStatus{}}
+	std = &registrar{
+		config: &config.RegistrarConfiguration{Nameservers: []string{"ns1.example.net", "ns2.example.net"}, Period: 1, RenewDays: 30},
+		driver: f,
+	}
+
+	t.Cleanup(func() {
+		std = nil
+		domains.Purge()
+	})
+
+	return f
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{" Example.COM. ", "example.com"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+
+		{"", ""},
+		{"com", ""},
+		{"bücher.example", ""},
+		{"example..com", ""},
+		{"../example.com", ""},
+		{"192.0.2.1", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := normalize(tt.name)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("normalize(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestNameservers(t *testing.T) {
+	r := &registrar{config: &config.RegistrarConfiguration{Nameservers: []string{"ns1.example.net", "ns2.example.net"}}}
+
+	many := make([]string, 14)
+	for i := range many {
+		many[i] = "ns" + strings.Repeat("x", i+1) + ".example.net"
+	}
+
+	tests := []struct {
+		name string
+		list []string
+		want []string
+	}{
+		{"configured", nil, []string{"ns1.example.net", "ns2.example.net"}},
+		{"given", []string{"NS1.example.org.", "ns2.example.org"}, []string{"ns1.example.org", "ns2.example.org"}},
+		{"duplicates", []string{"ns1.example.org", "NS1.example.org", "ns2.example.org"}, []string{"ns1.example.org", "ns2.example.org"}},
+		{"thirteen", many[:13], many[:13]},
+
+		{"one", []string{"ns1.example.org"}, nil},
+		{"fourteen", many, nil},
+		{"invalid", []string{"ns1.example.org", "ns2 example.org"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.nameservers(tt.list)
+			if !slices.Equal(got, tt.want) || (err == nil) != (tt.want != nil) {
+				t.Errorf("nameservers %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDS(t *testing.T) {
+	sha1 := strings.Repeat("ab", 20)
+	sha256 := strings.Repeat("AB", 32)
+
+	tests := []struct {
+		name   string
+		ds     DS
+		digest string
+	}{
+		{"SHA-256", DS{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: sha256}, sha256},
+		{"SHA-1 in lowercase", DS{KeyTag: 1, Algorithm: 8, DigestType: 1, Digest: sha1}, strings.ToUpper(sha1)},
+		{"spaced digest", DS{KeyTag: 0, Algorithm: 13, DigestType: 2, Digest: sha256[:32] + " " + sha256[32:]}, sha256},
+		{"unknown digest type", DS{KeyTag: 65535, Algorithm: 13, DigestType: 200, Digest: "ABCD"}, "ABCD"},
+
+		{"key tag too large", DS{KeyTag: 65536, Algorithm: 13, DigestType: 2, Digest: sha256}, ""},
+		{"negative key tag", DS{KeyTag: -1, Algorithm: 13, DigestType: 2, Digest: sha256}, ""},
+		{"no algorithm", DS{KeyTag: 1, DigestType: 2, Digest: sha256}, ""},
+		{"no digest type", DS{KeyTag: 1, Algorithm: 13, Digest: sha256}, ""},
+		{"no digest", DS{KeyTag: 1, Algorithm: 13, DigestType: 2}, ""},
+		{"not hexadecimal", DS{KeyTag: 1, Algorithm: 13, DigestType: 2, Digest: "XYZ"}, ""},
+		{"SHA-256 digest cut short", DS{KeyTag: 1, Algorithm: 13, DigestType: 2, Digest: sha256[:62]}, ""},
+		{"SHA-1 digest as SHA-256", DS{KeyTag: 1, Algorithm: 13, DigestType: 2, Digest: sha1}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ds.validate()
+			if (err == nil) != (tt.digest != "") {
+				t.Fatalf("error %v", err)
+			}
+			if err == nil && tt.ds.Digest != tt.digest {
+				t.Errorf("digest %s, want %s", tt.ds.Digest, tt.digest)
+			}
+		})
+	}
+}
+
+func TestNewDriver(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.RegistrarConfiguration
+		driver string
+		ok     bool
+	}{
+		{"off", config.RegistrarConfiguration{}, "", true},
+		{"none", config.RegistrarConfiguration{Driver: "none"}, "", true},
+		{"epp", config.RegistrarConfiguration{Driver: "epp", Address: "epp.example.net:700", Username: "u", Password: "p", Contact: "c"}, "epp", true},
+		{"resellerclub", config.RegistrarConfiguration{Driver: "resellerclub", Username: "u", Password: "p", Contact: "c", Customer: "1"}, "resellerclub", true},
+
+		{"no password", config.RegistrarConfiguration{Driver: "epp", Address: "epp.example.net:700", Username: "u", Contact: "c"}, "", false},
+		{"no contact", config.RegistrarConfiguration{Driver: "resellerclub", Username: "u", Password: "p", Customer: "1"}, "", false},
+		{"epp without an address", config.RegistrarConfiguration{Driver: "epp", Username: "u", Password: "p", Contact: "c"}, "", false},
+		{"resellerclub without a customer", config.RegistrarConfiguration{Driver: "resellerclub", Username: "u", Password: "p", Contact: "c"}, "", false},
+		{"unknown", config.RegistrarConfiguration{Driver: "other", Username: "u", Password: "p", Contact: "c"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDriver(&tt.config)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v", err)
+			}
+
+			name := ""
+			if d != nil {
+				name = d.Name()
+			}
+			if name != tt.driver {
+				t.Errorf("driver %q, want %q", name, tt.driver)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	f := configure(t)
+	f.taken["taken.com"] = true
+
+	refused := errors.New("registrar: insufficient funds")
+
+	tests := []struct {
+		name   string
+		order  Order
+		refuse error
+		err    error
+		calls  []string
+	}{
+		{"registered", Order{Name: "Example.com.", Owner: "alice", AutoRenew: true}, nil, nil, []string{"register example.com"}},
+		{"again", Order{Name: "example.com", Owner: "bob"}, nil, ErrExists, nil},
+		{"taken elsewhere", Order{Name: "taken.com", Owner: "alice"}, nil, ErrUnavailable, nil},
+		{"refused", Order{Name: "refused.com", Owner: "alice"}, refused, ErrFailed, []string{"register refused.com"}},
+		{"no owner", Order{Name: "other.com"}, nil, nil, nil},
+		{"too many years", Order{Name: "other.com", Owner: "alice", Years: 11}, nil, nil, nil},
+		{"invalid name", Order{Name: "other com", Owner: "alice"}, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.calls = nil
+			f.err = tt.refuse
+
+			d, err := Register(tt.order)
+			switch {
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("error %v, want %v", err, tt.err)
+			case tt.err == nil && tt.calls == nil && err == nil:
+				t.Error("an invalid order was placed")
+			}
+			if !slices.Equal(f.calls, tt.calls) {
+				t.Errorf("asked the registrar to %q, want %q", f.calls, tt.calls)
+			}
+
+			if err != nil {
+				return
+			}
+
+			stored, err := Get("EXAMPLE.com")
+			if err != nil || stored.Owner != "alice" || stored.State != Active || !stored.AutoRenew || stored.Expires.Year() != 2031 {
+				t.Errorf("stored %+v, %v", stored, err)
+			}
+			if !slices.Equal(d.Nameservers, std.config.Nameservers) {
+				t.Errorf("delegated to %q", d.Nameservers)
+			}
+		})
+	}
+
+	if list, err := List("bob"); err != nil || len(list) != 0 {
+		t.Errorf("bob has %+v, %v", list, err)
+	}
+	if list, err := List(); err != nil || len(list) != 1 {
+		t.Errorf("listed %+v, %v", list, err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	f := configure(t)
+
+	for _, d := range []Domain{
+		{Name: "active.com", Owner: "alice", State: Active},
+		{Name: "pending.com", Owner: "alice", State: TransferPending},
+		{Name: "failed.com", Owner: "alice", State: TransferFailed, Error: "refused"},
+	} {
+		if err := put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		order  Order
+		placed bool
+		err    error
+		owner  string
+	}{
+		{"requested", Order{Name: "new.com", Owner: "bob", AuthCode: "secret"}, true, nil, "bob"},
+		{"no auth code", Order{Name: "other.com", Owner: "bob"}, false, nil, ""},
+		{"already managed", Order{Name: "active.com", Owner: "alice", AuthCode: "secret"}, false, ErrExists, "alice"},
+		{"already pending", Order{Name: "pending.com", Owner: "alice", AuthCode: "secret"}, false, ErrExists, "alice"},
+		{"failed transfer of another owner", Order{Name: "failed.com", Owner: "bob", AuthCode: "secret"}, false, ErrExists, "alice"},
+		{"failed transfer retried", Order{Name: "failed.com", Owner: "alice", AuthCode: "secret"}, true, nil, "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.calls = nil
+
+			_, err := Transfer(tt.order)
+			if (err == nil) != tt.placed || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if (len(f.calls) > 0) != tt.placed {
+				t.Errorf("asked the registrar to %q", f.calls)
+			}
+
+			d, _ := Get(tt.order.Name)
+			if d.Owner != tt.owner {
+				t.Errorf("owned by %q, want %q", d.Owner, tt.owner)
+			}
+			if tt.placed && (d.State != TransferPending || d.Error != "") {
+				t.Errorf("stored %+v", d)
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	f := configure(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, d := range []Domain{
+		{Name: "approved.com", Owner: "alice", State: TransferPending, Nameservers: []string{"ns1.example.org", "ns2.example.org"}},
+		{Name: "waiting.com", Owner: "alice", State: TransferPending},
+		{Name: "rejected.com", Owner: "alice", State: TransferPending},
+		{Name: "expiring.com", Owner: "alice", State: Active, AutoRenew: true, Expires: now.AddDate(0, 0, 10)},
+		{Name: "manual.com", Owner: "alice", State: Active, Expires: now.AddDate(0, 0, 10)},
+		{Name: "later.com", Owner: "alice", State: Active, AutoRenew: true, Expires: now.AddDate(0, 0, 60)},
+	} {
+		if err := put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.transfer["approved.com"] = TransferStatus{State: Active, Expires: now.AddDate(1, 0, 0)}
+	f.transfer["waiting.com"] = TransferStatus{State: TransferPending}
+	f.transfer["rejected.com"] = TransferStatus{State: TransferFailed, Reason: "rejected by the current registrar"}
+
+	if err := Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"nameservers approved.com ns1.example.org ns2.example.org", "renew expiring.com"}
+	if !slices.Equal(f.calls, want) {
+		t.Errorf("asked the registrar to %q, want %q", f.calls, want)
+	}
+
+	tests := []struct {
+		name    string
+		state   string
+		expires time.Time
+		error   string
+	}{
+		{"approved.com", Active, now.AddDate(1, 0, 0), ""},
+		{"waiting.com", TransferPending, time.Time{}, ""},
+		{"rejected.com", TransferFailed, time.Time{}, "rejected by the current registrar"},
+		{"expiring.com", Active, now.AddDate(1, 0, 10), ""},
+		{"manual.com", Active, now.AddDate(0, 0, 10), ""},
+		{"later.com", Active, now.AddDate(0, 0, 60), ""},
+	}
+
+	for _, tt := range tests {
+		d, err := Get(tt.name)
+		if err != nil || d.State != tt.state || !d.Expires.Equal(tt.expires) || d.Error != tt.error {
+			t.Errorf("%s is %s until %v with %q, %v, want %s until %v with %q", tt.name, d.State, d.Expires, d.Error, err, tt.state, tt.expires, tt.error)
+		}
+	}
+
+	// A renewal that fails is kept on the domain and tried again on the next run
+	f.calls = nil
+	f.err = errors.New("registrar: insufficient funds")
+	if err := put(Domain{Name: "expiring.com", Owner: "alice", State: Active, AutoRenew: true, Expires: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Sync(); !errors.Is(err, ErrFailed) {
+		t.Errorf("sync with the registrar failing: %v", err)
+	}
+	if d, _ := Get("expiring.com"); !strings.Contains(d.Error, "insufficient funds") || !d.Expires.Equal(now) {
+		t.Errorf("expiring.com is %+v", d)
+	}
+
+	f.err = nil
+	if err := Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := Get("expiring.com"); d.Error != "" || !d.Expires.Equal(now.AddDate(1, 0, 0)) {
+		t.Errorf("expiring.com is %+v after renewing", d)
+	}
+}
+
+func TestChangeInactive(t *testing.T) {
+	f := configure(t)
+
+	if err := put(Domain{Name: "pending.com", Owner: "alice", State: TransferPending}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []struct {
+		name   string
+		change func() error
+	}{
+		{"renew", func() error { _, err := Renew("pending.com", 1); return err }},
+		{"nameservers", func() error { _, err := SetNameservers("pending.com", nil); return err }},
+		{"ds", func() error { _, err := SetDS("pending.com", nil); return err }},
+	}
+
+	for _, c := range changes {
+		if err := c.change(); err == nil {
+			t.Errorf("%s of a domain being transferred", c.name)
+		}
+	}
+	if len(f.calls) > 0 {
+		t.Errorf("asked the registrar to %q", f.calls)
+	}
+
+	if err := Forget("PENDING.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Forget("pending.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("forgetting a forgotten domain: %v", err)
+	}
+}
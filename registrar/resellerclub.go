@@ -0,0 +1,281 @@
+package registrar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// resellerClub orders domains through the LogicBoxes HTTP API of ResellerClub and the
+// registrars running on it
+type resellerClub struct {
+	base     string
+	userID   string
+	apiKey   string
+	customer string
+	contact  string
+	client   *http.Client
+}
+
+func newResellerClub(c *config.RegistrarConfiguration) *resellerClub {
+	base := c.Address
+	if base == "" {
+		base = "https://httpapi.com"
+	}
+
+	return &resellerClub{
+		base:     strings.TrimSuffix(base, "/") + "/api/",
+		userID:   c.Username,
+		apiKey:   c.Password,
+		customer: c.Customer,
+		contact:  c.Contact,
+		client:   httpx.Client(timeout),
+	}
+}
+
+func (rc *resellerClub) Name() string {
+	return "resellerclub"
+}
+
+func (rc *resellerClub) Available(ctx context.Context, name string) (bool, error) {
+	sld, tld, _ := strings.Cut(name, ".")
+
+	var resp map[string]struct {
+		Status string `json:"status"`
+	}
+	if err := rc.call(ctx, http.MethodGet, "domains/available.json", url.Values{"domain-name": {sld}, "tlds": {tld}}, &resp); err != nil {
+		return false, err
+	}
+
+	return resp[name].Status == "available", nil
+}
+
+func (rc *resellerClub) Register(ctx context.Context, o Order) (time.Time, error) {
+	params := rc.contacts(url.Values{
+		"domain-name": {o.Name},
+		"years":       {strconv.Itoa(o.Years)},
+		"ns":          o.Nameservers,
+	})
+
+	if err := rc.call(ctx, http.MethodPost, "domains/register.json", params, nil); err != nil {
+		return time.Time{}, err
+	}
+
+	d, err := rc.details(ctx, o.Name, "OrderDetails")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return d.expires()
+}
+
+func (rc *resellerClub) Renew(ctx context.Context, name string, _ time.Time, years int) (time.Time, error) {
+	d, err := rc.details(ctx, name, "OrderDetails")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	params := url.Values{
+		"order-id":       {d.OrderID.String()},
+		"years":          {strconv.Itoa(years)},
+		"exp-date":       {d.EndTime.String()},
+		"invoice-option": {"NoInvoice"},
+	}
+	if err := rc.call(ctx, http.MethodPost, "domains/renew.json", params, nil); err != nil {
+		return time.Time{}, err
+	}
+
+	if d, err = rc.details(ctx, name, "OrderDetails"); err != nil {
+		return time.Time{}, err
+	}
+
+	return d.expires()
+}
+
+func (rc *resellerClub) Transfer(ctx context.Context, o Order) error {
+	params := rc.contacts(url.Values{
+		"domain-name": {o.Name},
+		"auth-code":   {o.AuthCode},
+		"ns":          o.Nameservers,
+	})
+
+	return rc.call(ctx, http.MethodPost, "domains/transfer.json", params, nil)
+}
+
+func (rc *resellerClub) TransferStatus(ctx context.Context, name string) (TransferStatus, error) {
+	d, err := rc.details(ctx, name, "OrderDetails")
+	if err != nil {
+		return TransferStatus{}, err
+	}
+
+	switch d.CurrentStatus {
+	case "Active":
+		expires, err := d.expires()
+		return TransferStatus{State: Active, Expires: expires}, err
+	case "Deleted", "Archived":
+		return TransferStatus{State: TransferFailed, Reason: "the transfer order was " + strings.ToLower(d.CurrentStatus)}, nil
+	default:
+		return TransferStatus{State: TransferPending}, nil
+	}
+}
+
+func (rc *resellerClub) SetNameservers(ctx context.Context, name string, nameservers []string) error {
+	d, err := rc.details(ctx, name, "OrderDetails")
+	if err != nil {
+		return err
+	}
+
+	return rc.call(ctx, http.MethodPost, "domains/modify-ns.json", url.Values{"order-id": {d.OrderID.String()}, "ns": nameservers}, nil)
+}
+
+func (rc *resellerClub) SetDS(ctx context.Context, name string, records []DS) error {
+	d, err := rc.details(ctx, name, "DNSSECDetails")
+	if err != nil {
+		return err
+	}
+
+	if len(d.DNSSEC) > 0 {
+		params := url.Values{"order-id": {d.OrderID.String()}}
+		for i, ds := range d.DNSSEC {
+			dsParams(params, i, ds.KeyTag.String(), ds.Algorithm.String(), ds.DigestType.String(), ds.Digest)
+		}
+
+		if err := rc.call(ctx, http.MethodPost, "domains/del-dnssec.json", params, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	params := url.Values{"order-id": {d.OrderID.String()}}
+	for i, ds := range records {
+		dsParams(params, i, strconv.Itoa(ds.KeyTag), strconv.Itoa(ds.Algorithm), strconv.Itoa(ds.DigestType), ds.Digest)
+	}
+
+	return rc.call(ctx, http.MethodPost, "domains/add-dnssec.json", params, nil)
+}
+
+// rcDetails is what the driver reads from the details of a domain order
+type rcDetails struct {
+	OrderID       json.Number `json:"orderid"`
+	EndTime       json.Number `json:"endtime"`
+	CurrentStatus string      `json:"currentstatus"`
+	DNSSEC        []struct {
+		KeyTag     json.Number `json:"keytag"`
+		Algorithm  json.Number `json:"algorithm"`
+		DigestType json.Number `json:"digesttype"`
+		Digest     string      `json:"digest"`
+	} `json:"dnssec"`
+}
+
+// expires returns when the domain expires, which the API gives in seconds since 1970
+func (d rcDetails) expires() (time.Time, error) {
+	secs, err := d.EndTime.Int64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("registrar: the order of the domain has no valid expiry: %q", d.EndTime)
+	}
+
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// details returns the details of the order of the domain
+func (rc *resellerClub) details(ctx context.Context, name string, options string) (rcDetails, error) {
+	var d rcDetails
+	err := rc.call(ctx, http.MethodGet, "domains/details-by-name.json", url.Values{"domain-name": {name}, "options": {options}}, &d)
+
+	return d, err
+}
+
+// contacts adds the customer and contact an order is placed for
+func (rc *resellerClub) contacts(params url.Values) url.Values {
+	params.Set("customer-id", rc.customer)
+	for _, role := range []string{"reg", "admin", "tech", "billing"} {
+		params.Set(role+"-contact-id", rc.contact)
+	}
+	params.Set("invoice-option", "NoInvoice")
+
+	return params
+}
+
+// call calls the API and decodes its answer into v when it is not nil
+func (rc *resellerClub) call(ctx context.Context, method string, path string, params url.Values, v interface{}) error {
+	params.Set("auth-userid", rc.userID)
+	params.Set("api-key", rc.apiKey)
+
+	var body io.Reader
+	target := rc.base + path
+	if method == http.MethodGet {
+		target += "?" + params.Encode()
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		// The error holds the URL, which carries the API key of GET requests
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("registrar: calling %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	// Failures are answered as a status of ERROR, along with an HTTP error status
+	var failure struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(data, &failure) == nil && strings.EqualFold(failure.Status, "error") {
+		return fmt.Errorf("registrar: %s", failure.Message+failure.Error)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registrar: %s answered %s", path, resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("registrar: malformed answer from %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// dsParams adds the fields of the ith DS record in the numbered attributes the API takes
+func dsParams(params url.Values, i int, keyTag string, algorithm string, digestType string, digest string) {
+	for j, attr := range [][2]string{{"keytag", keyTag}, {"algorithm", algorithm}, {"digesttype", digestType}, {"digest", digest}} {
+		n := strconv.Itoa(i*4 + j + 1)
+		params.Set("attr-name"+n, attr[0])
+		params.Set("attr-value"+n, attr[1])
+	}
+}
@@ -0,0 +1,87 @@
+package registrar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{"answered", http.StatusOK, `{"orderid": 42, "endtime": "1893456000", "currentstatus": "Active"}`, ""},
+		{"refused", http.StatusInternalServerError, `{"status": "ERROR", "message": "Insufficient funds"}`, "registrar: Insufficient funds"},
+		{"refused with an error", http.StatusOK, `{"status": "error", "error": "Invalid order"}`, "registrar: Invalid order"},
+		{"failed", http.StatusBadGateway, `<html>Bad gateway</html>`, "502 Bad Gateway"},
+		{"malformed", http.StatusOK, `{"orderid": `, "malformed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/domains/details-by-name.json" || r.FormValue("auth-userid") != "reseller" || r.FormValue("api-key") != "key" {
+					t.Errorf("called %s", r.URL)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			rc := newResellerClub(&config.RegistrarConfiguration{Address: srv.URL + "/", Username: "reseller", Password: "key"})
+
+			d, err := rc.details(context.Background(), "example.com", "OrderDetails")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+
+			expires, err := d.expires()
+			if err != nil || d.OrderID.String() != "42" || d.CurrentStatus != "Active" || expires.Year() != 2030 {
+				t.Errorf("details %+v expiring %v, %v", d, expires, err)
+			}
+		})
+	}
+
+	// The API key is in the URL of a GET request, which errors reaching the API would
+	// otherwise carry into the logs and answers of the panel
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	rc := newResellerClub(&config.RegistrarConfiguration{Address: srv.URL, Username: "reseller", Password: "secret-key"})
+	if _, err := rc.details(context.Background(), "example.com", "OrderDetails"); err == nil || strings.Contains(err.Error(), "secret-key") {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestDSParams(t *testing.T) {
+	params := make(map[string][]string)
+	dsParams(params, 0, "1", "13", "2", "AB")
+	dsParams(params, 1, "2", "8", "1", "CD")
+
+	want := map[string]string{
+		"attr-name1": "keytag", "attr-value1": "1",
+		"attr-name2": "algorithm", "attr-value2": "13",
+		"attr-name3": "digesttype", "attr-value3": "2",
+		"attr-name4": "digest", "attr-value4": "AB",
+		"attr-name5": "keytag", "attr-value5": "2",
+		"attr-name8": "digest", "attr-value8": "CD",
+	}
+	for k, v := range want {
+		if got := params[k]; len(got) != 1 || got[0] != v {
+			t.Errorf("%s is %q, want %q", k, got, v)
+		}
+	}
+	if len(params) != 16 {
+		t.Errorf("%d parameters", len(params))
+	}
+}
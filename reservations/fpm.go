@@ -0,0 +1,135 @@
+package reservations
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// domainPlaceholder stands for the domain in the file reserving workers and the name of
+// the pool it reopens, which also take {account} like those of the php module
+const domainPlaceholder = "{domain}"
+
+// poolHeader starts every file reserving workers
+const poolHeader = "; Managed by CosmicPanel, changes are overwritten when the package of the account changes\n"
+
+// poolSource is the name the files reserving workers are reconciled under
+const poolSource = "reservations.fpm"
+
+// registerSource registers the files reserving workers with the reconciler
+func registerSource() {
+	reconcile.Register(poolSource, std.source())
+}
+
+// source generates the files reserving the workers of every account reserved for,
+// which PHP-FPM tests before it is reloaded
+func (r *reserver) source() reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			list, err := List()
+			if err != nil {
+				return nil, err
+			}
+
+			ids := make(map[string]string)
+			for _, u := range auth.Users() {
+				ids[u.Username] = u.ID
+			}
+
+			var artifacts []reconcile.Artifact
+			for _, res := range list {
+				if res.Workers == 0 || ids[res.Account] == "" {
+					continue
+				}
+
+				pools, err := r.pools(res, ids[res.Account])
+				if err != nil {
+					return nil, err
+				}
+				artifacts = append(artifacts, pools...)
+			}
+
+			return artifacts, nil
+		},
+		Test: func() error {
+			if r.php.FPM == "" {
+				return nil
+			}
+			return privsep.Run(r.php.FPM, "-t")
+		},
+		Reload: func() error {
+			if len(r.php.Reload) == 0 {
+				return nil
+			}
+			return privsep.Run(r.php.Reload[0], r.php.Reload[1:]...)
+		},
+	}
+}
+
+// pools returns the files reserving the workers of the account in the pool of each of its
+// domains, skipping domains whose file belongs in a directory that does not exist
+func (r *reserver) pools(res Reserved, owner string) ([]reconcile.Artifact, error) {
+	domains, err := registrar.List(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []reconcile.Artifact
+	for _, d := range domains {
+		rp := strings.NewReplacer(domainPlaceholder, d.Name, accountPlaceholder, res.Account)
+
+		path := rp.Replace(r.config.File)
+		if !reconcile.Installed(path) {
+			continue
+		}
+
+		// The spare workers are pinned to the reservation, which keeps that many idle
+		// and ready even in pools that otherwise start them on demand
+		var b strings.Builder
+		b.WriteString(poolHeader)
+		fmt.Fprintf(&b, "[%s]\n", rp.Replace(r.php.Pool))
+		b.WriteString("pm = dynamic\n")
+		fmt.Fprintf(&b, "pm.start_servers = %d\n", res.Workers)
+		fmt.Fprintf(&b, "pm.min_spare_servers = %d\n", res.Workers)
+		fmt.Fprintf(&b, "pm.max_spare_servers = %d\n", res.Workers)
+
+		artifacts = append(artifacts, reconcile.Artifact{Path: path, Content: b.String()})
+	}
+
+	return artifacts, nil
+}
+
+// writePools writes the files reserving workers and removes those of before that are no
+// longer wanted. The files are put back if PHP-FPM rejects them
+func (r *reserver) writePools(artifacts []reconcile.Artifact, before []string) error {
+	if len(artifacts) > 0 {
+		if _, err := reconcile.Write(poolSource, r.source(), artifacts...); err != nil {
+			return err
+		}
+	}
+
+	var stale []string
+	for _, path := range before {
+		if !slices.ContainsFunc(artifacts, func(a reconcile.Artifact) bool { return a.Path == path }) {
+			stale = append(stale, path)
+		}
+	}
+
+	return r.removePools(stale)
+}
+
+// removePools removes the files reserving workers
+func (r *reserver) removePools(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	_, err := reconcile.Remove(poolSource, r.source(), paths...)
+
+	return err
+}
@@ -0,0 +1,419 @@
+package reservations
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when reserving resources before Configure is called
+	ErrNotConfigured = errors.New("reservations: not configured")
+
+	// ErrNotFound is returned for an account without a reservation
+	ErrNotFound = errors.New("reservations: nothing is reserved for the account")
+
+	// errNoSystemUser is returned when running a command for the units of an account
+	// without a system user, which has no processes to reserve anything for
+	errNoSystemUser = errors.New("reservations: the account has no system user")
+)
+
+// Placeholders in the reserve, release and parent commands
+const (
+	accountPlaceholder   = "{account}"
+	uidPlaceholder       = "{uid}"
+	cpuWeightPlaceholder = "{cpuweight}"
+	ioWeightPlaceholder  = "{ioweight}"
+	memoryPlaceholder    = "{memory}"
+)
+
+// maxWeight is the highest CPU and IO weight, which systemd and the kernel accept up to
+const maxWeight = 10000
+
+// Reserved is what is reserved for an account
+type Reserved struct {
+	Account string `json:"account"`
+	Package string `json:"package"`
+
+	CPUWeight int `json:"cpu_weight,omitempty"`
+	IOWeight  int `json:"io_weight,omitempty"`
+
+	// Megabytes of memory protected from being reclaimed
+	Memory int `json:"memory,omitempty"`
+
+	// PHP-FPM workers kept running in the pool of every domain, and the files they are
+	// written to
+	Workers int      `json:"workers,omitempty"`
+	Pools   []string `json:"pools,omitempty"`
+
+	Reserved time.Time `json:"reserved"`
+}
+
+// cgroup returns true if the reservation has a weight or a memory floor, which the
+// reserve command applies
+func (r Reserved) cgroup() bool {
+	return r.CPUWeight > 0 || r.IOWeight > 0 || r.Memory > 0
+}
+
+// same returns true if the reservations guarantee the same
+func (r Reserved) same(o Reserved) bool {
+	return r.Package == o.Package && r.CPUWeight == o.CPUWeight && r.IOWeight == o.IOWeight &&
+		r.Memory == o.Memory && r.Workers == o.Workers && slices.Equal(r.Pools, o.Pools)
+}
+
+// reservedKind is what reservations are kept under in the state store, so that those of
+// accounts that changed package while the daemon was stopped are still released
+const reservedKind = "reservations.account"
+
+type reserver struct {
+	mu     sync.Mutex
+	config *config.ReservationsConfiguration
+	php    *config.PHPConfiguration
+
+	// The accounts reserved for since the daemon started. Reservations are applied at
+	// runtime, so they are applied again after a restart in case the server rebooted
+	current map[string]bool
+
+	// The megabytes the parent command last protected, -1 until it has run
+	parent int
+}
+
+var std *reserver
+
+// Configure checks the reservations. The pools of domains are reopened under the names
+// and tested with the PHP-FPM binary of the PHP configuration
+func Configure(c *config.ReservationsConfiguration, php *config.PHPConfiguration) error {
+	packages := make(map[string]bool, len(c.Packages))
+	for _, r := range c.Packages {
+		switch {
+		case r.Package == "":
+			return errors.New("reservations: every reservation needs a package")
+		case packages[r.Package]:
+			return fmt.Errorf("reservations: package %s has more than one reservation", r.Package)
+		case r.CPUWeight < 0 || r.CPUWeight > maxWeight || r.IOWeight < 0 || r.IOWeight > maxWeight:
+			return fmt.Errorf("reservations: the weights of package %s must be from 1 to %d", r.Package, maxWeight)
+		case r.Memory < 0 || r.Workers < 0:
+			return fmt.Errorf("reservations: package %s must not reserve less than nothing", r.Package)
+		case (r.CPUWeight > 0 || r.IOWeight > 0 || r.Memory > 0) && (len(c.Reserve) == 0 || len(c.Release) == 0):
+			return fmt.Errorf("reservations: package %s reserves weights or memory, which needs the reserve and release commands", r.Package)
+		case r.Workers > 0 && (c.File == "" || php.Pool == ""):
+			return fmt.Errorf("reservations: package %s reserves PHP-FPM workers, which needs the file and php.pool", r.Package)
+		}
+		packages[r.Package] = true
+	}
+
+	if c.File != "" && !strings.Contains(c.File, domainPlaceholder) {
+		return fmt.Errorf("reservations: the file %q does not contain %s", c.File, domainPlaceholder)
+	}
+
+	std = &reserver{config: c, php: php, current: make(map[string]bool), parent: -1}
+
+	registerSource()
+
+	return nil
+}
+
+// List returns what is reserved for every account, by username
+func List() ([]Reserved, error) {
+	var reserved map[string]Reserved
+	if err := store.Load(reservedKind, &reserved); err != nil {
+		return nil, err
+	}
+
+	list := make([]Reserved, 0, len(reserved))
+	for _, r := range reserved {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+
+	return list, nil
+}
+
+// Get returns what is reserved for the account
+func Get(username string) (Reserved, error) {
+	var r Reserved
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(reservedKind, username, &r)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Reserved{}, ErrNotFound
+	}
+
+	return r, err
+}
+
+// Scheduled reserves what the package of every account guarantees, releasing what is no
+// longer reserved for accounts that changed package or were removed. It is run by the
+// scheduler every 15 minutes, which is how long a change of package takes to apply
+func Scheduled() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var stored map[string]Reserved
+	if err := store.Load(reservedKind, &stored); err != nil {
+		return err
+	}
+
+	wanted, err := std.wanted()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	memory := 0
+	for _, w := range wanted {
+		memory += w.Reserved.Memory
+
+		prev, ok := stored[w.User.Username]
+		if ok && prev.same(w.Reserved) && std.current[w.User.Username] {
+			continue
+		}
+
+		if err := std.reserve(w, prev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for name, r := range stored {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+
+		if err := std.release(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if memory != std.parent && len(std.config.Parent) > 0 {
+		if err := std.run(std.config.Parent, "", "", Reserved{Memory: memory}); err != nil {
+			errs = append(errs, fmt.Errorf("reservations: failed to protect the memory floors in their parent: %w", err))
+		} else {
+			std.parent = memory
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply reserves what the package of every account guarantees now, such as after
+// packages were changed, rather than on the next run of the task
+func Apply() ([]Reserved, error) {
+	if err := Scheduled(); err != nil {
+		return nil, err
+	}
+
+	return List()
+}
+
+// account is a panel account with a reservation and the system user its processes run as
+type account struct {
+	User     auth.User
+	UID      string
+	Reserved Reserved
+
+	// The files reserving its workers
+	pools []reconcile.Artifact
+}
+
+// wanted returns what the package of every account reserves, by username. Workers are
+// reserved in the pools of the domains of the account that exist
+func (r *reserver) wanted() (map[string]account, error) {
+	list := make(map[string]account)
+	for _, u := range auth.Users() {
+		if u.Role != auth.RoleUser || u.Package == "" {
+			continue
+		}
+
+		i := slices.IndexFunc(r.config.Packages, func(p config.Reservation) bool { return p.Package == u.Package })
+		if i < 0 {
+			continue
+		}
+		p := r.config.Packages[i]
+
+		a := account{
+			User: u,
+			Reserved: Reserved{
+				Account:   u.Username,
+				Package:   p.Package,
+				CPUWeight: p.CPUWeight,
+				IOWeight:  p.IOWeight,
+				Memory:    p.Memory,
+				Workers:   p.Workers,
+			},
+		}
+
+		if su, err := user.Lookup(u.Username); err == nil {
+			a.UID = su.Uid
+		}
+
+		if p.Workers > 0 {
+			var err error
+			if a.pools, err = r.pools(a.Reserved, u.ID); err != nil {
+				return nil, err
+			}
+			for _, art := range a.pools {
+				a.Reserved.Pools = append(a.Reserved.Pools, art.Path)
+			}
+		}
+
+		list[u.Username] = a
+	}
+
+	return list, nil
+}
+
+// reserve applies the reservation of the account, which had prev reserved before. The
+// reserver must be locked
+func (r *reserver) reserve(a account, prev Reserved) error {
+	res, name := a.Reserved, a.User.Username
+
+	switch {
+	case res.cgroup():
+		if err := r.run(r.config.Reserve, name, a.UID, res); err != nil && !errors.Is(err, errNoSystemUser) {
+			return fmt.Errorf("reservations: failed to reserve resources for %s: %w", name, err)
+		}
+	case prev.cgroup():
+		if err := r.run(r.config.Release, name, a.UID, prev); err != nil && !errors.Is(err, errNoSystemUser) {
+			return fmt.Errorf("reservations: failed to release the resources of %s: %w", name, err)
+		}
+	}
+
+	if err := r.writePools(a.pools, prev.Pools); err != nil {
+		return fmt.Errorf("reservations: failed to reserve PHP-FPM workers for %s: %w", name, err)
+	}
+
+	res.Reserved = time.Now().UTC()
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(reservedKind, name, res)
+	})
+	if err != nil {
+		return err
+	}
+	r.current[name] = true
+
+	if prev.same(res) {
+		return nil
+	}
+
+	zap.S().Named("reservations").Infow("reserved resources for account", "account", name, "package", res.Package, "cpu_weight", res.CPUWeight, "io_weight", res.IOWeight, "memory", res.Memory, "workers", res.Workers)
+
+	events.Publish(events.Event{
+		Type:     "reservations.reserve",
+		Account:  name,
+		Reseller: a.User.Reseller(),
+		Resource: name,
+		Data: map[string]interface{}{
+			"package":    res.Package,
+			"cpu_weight": res.CPUWeight,
+			"io_weight":  res.IOWeight,
+			"memory":     res.Memory,
+			"workers":    res.Workers,
+		},
+	})
+
+	return nil
+}
+
+// release releases what was reserved for an account that no longer has a reservation.
+// The reserver must be locked
+func (r *reserver) release(res Reserved) error {
+	if res.cgroup() {
+		uid := ""
+		if su, err := user.Lookup(res.Account); err == nil {
+			uid = su.Uid
+		}
+
+		// Accounts that were removed have no units left to release
+		if err := r.run(r.config.Release, res.Account, uid, res); err != nil && uid != "" {
+			return fmt.Errorf("reservations: failed to release the resources of %s: %w", res.Account, err)
+		}
+	}
+
+	if err := r.removePools(res.Pools); err != nil {
+		return fmt.Errorf("reservations: failed to release the PHP-FPM workers of %s: %w", res.Account, err)
+	}
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Delete(reservedKind, res.Account)
+	})
+	if err != nil {
+		return err
+	}
+	delete(r.current, res.Account)
+
+	zap.S().Named("reservations").Infow("released resources of account", "account", res.Account, "package", res.Package)
+
+	events.Publish(events.Event{
+		Type:     "reservations.release",
+		Account:  res.Account,
+		Resource: res.Account,
+		Data:     map[string]interface{}{"package": res.Package},
+	})
+
+	return nil
+}
+
+// run runs the reserve, release or parent command with the values of the reservation
+func (r *reserver) run(command []string, username string, uid string, res Reserved) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	if uid == "" && slices.ContainsFunc(command, func(arg string) bool { return strings.Contains(arg, uidPlaceholder) }) {
+		return errNoSystemUser
+	}
+
+	memory := ""
+	if res.Memory > 0 {
+		memory = strconv.Itoa(res.Memory) + "M"
+	}
+
+	rp := strings.NewReplacer(
+		accountPlaceholder, username,
+		uidPlaceholder, uid,
+		cpuWeightPlaceholder, weight(res.CPUWeight),
+		ioWeightPlaceholder, weight(res.IOWeight),
+		memoryPlaceholder, memory,
+	)
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = rp.Replace(arg)
+	}
+
+	out, err := privsep.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// weight returns the weight for the commands, which is empty when none is reserved
+func weight(w int) string {
+	if w == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(w)
+}
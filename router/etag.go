@@ -0,0 +1,60 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// etag returns the entity tag of a resource, a hash of the JSON encoding of what the API
+// can change about it. Fields that change on their own, such as when a user last logged
+// in, are left out so that they do not fail conditional requests
+func etag(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setETag sets the entity tag of the resource in the response
+func setETag(w http.ResponseWriter, tag string) {
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+}
+
+// preconditions checks the If-Match and If-None-Match headers of a request changing a
+// resource against its entity tag, which is empty if the resource does not exist. It
+// writes 412 Precondition Failed and returns false unless both hold, so that a client
+// does not overwrite a change it has not seen or create something twice. Requests
+// without either header are let through
+func preconditions(w http.ResponseWriter, r *http.Request, tag string) bool {
+	if h := r.Header.Get("If-Match"); h != "" && !matchesTag(h, tag) {
+		writeError(w, http.StatusPreconditionFailed, "the resource has changed since it was read, read it again and retry")
+		return false
+	}
+
+	if h := r.Header.Get("If-None-Match"); h != "" && matchesTag(h, tag) {
+		writeError(w, http.StatusPreconditionFailed, "the resource already exists in the state If-None-Match excludes")
+		return false
+	}
+
+	return true
+}
+
+// matchesTag returns true if the header lists the tag, or is * and the resource exists
+func matchesTag(header string, tag string) bool {
+	if tag == "" {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/audit"
+	"github.com/cosmicpanel/CosmicPanel/events"
+)
+
+// publish publishes an event for a state-changing operation made by the request. The
+// identity, source address and token fingerprint are taken from the request so that the
+// event can be recorded in the audit log
+func publish(r *http.Request, typ string, resource string, before interface{}, after interface{}) {
+	token, _ := r.Context().Value(tokenKey).(string)
+
+	e := events.Event{
+		Type:         typ,
+		Actor:        actor(r),
+		SourceIP:     remoteIP(r),
+		Token:        audit.Fingerprint(token),
+		Impersonator: requestIdentity(r).Impersonator,
+		Resource:     resource,
+	}
+
+	if before != nil {
+		e.Before, _ = json.Marshal(before)
+	}
+
+	if after != nil {
+		e.After, _ = json.Marshal(after)
+	}
+
+	events.Publish(e)
+}
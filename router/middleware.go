@@ -0,0 +1,283 @@
+package router
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/bruteforce"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+	"github.com/cosmicpanel/CosmicPanel/sdk"
+	"github.com/cosmicpanel/CosmicPanel/tlspolicy"
+	"go.uber.org/zap"
+)
+
+// contextKey is the type used for values the middleware stores on the request context
+type contextKey string
+
+const (
+	identityKey contextKey = "identity"
+	tokenKey    contextKey = "token"
+)
+
+// identity is whoever authenticated a request, either the holder of the admin token
+// from the configuration or a logged in panel user
+type identity struct {
+	Actor  string
+	Role   string
+	UserID string
+
+	// Set for sessions that may only be used to enroll a second factor
+	Enrollment bool
+
+	// The admin or reseller acting as the user through an impersonation session
+	Impersonator string
+
+	// The language responses to the identity are written in
+	Language string
+}
+
+// Recover records a crash report for any panic in a handler and responds with an error
+// including the report ID so that it can be found when the issue is reported
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				rep := crash.Capture("api", rec, map[string]string{"method": r.Method, "path": r.URL.Path})
+				writeError(w, http.StatusInternalServerError, "an unexpected error occurred, crash report "+rep.ID)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StrictTransport sends the Strict-Transport-Security header from the TLS policy on
+// responses served over HTTPS
+func StrictTransport(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts := tlspolicy.HSTS(); r.TLS != nil && hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Restrict refuses requests from addresses outside the panel's global allowlist. The
+// break glass route is exempt since it exists for administrators who are locked out
+func Restrict(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != breakGlassPath {
+			if err := access.Check(remoteIP(r), ""); err != nil {
+				writeAccessError(w, r, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAccessError writes the response for a request refused by access control
+func writeAccessError(w http.ResponseWriter, r *http.Request, err error) {
+	var m *access.MaintenanceError
+	if errors.As(err, &m) {
+		if !m.Until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(time.Until(m.Until).Seconds())+1, 1)))
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			writeMaintenancePage(w, r, m)
+			return
+		}
+
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	writeError(w, http.StatusForbidden, err.Error())
+}
+
+// authenticate resolves the bearer token on the request to an identity. The token is
+// either the admin token from the panel configuration or a session token
+func authenticate(c *config.Configuration, r *http.Request) (identity, string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return identity{}, "", false
+	}
+
+	if c.Panel.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Panel.Token)) == 1 {
+		return identity{Actor: "admin", Role: auth.RoleAdmin, Language: requestLanguage(r, "", branding.ForHost(r.Host))}, token, true
+	}
+
+	u, sess, err := auth.Authenticate(token)
+	if err != nil {
+		return identity{}, token, false
+	}
+
+	id := identity{
+		Actor:      u.Username,
+		Role:       u.Role,
+		UserID:     u.ID,
+		Enrollment: sess.Enrollment,
+		Language:   requestLanguage(r, u.Language, branding.Resolve(u.Reseller())),
+	}
+	if sess.Impersonator != nil {
+		id.Impersonator = sess.Impersonator.Username
+	}
+
+	return id, token, true
+}
+
+// RequireUser only allows a request through if it carries a valid bearer token, storing
+// the identity it belongs to on the request context
+func RequireUser(c *config.Configuration, next http.Handler) http.Handler {
+	return requireRole(c, next, false)
+}
+
+// AllowEnrollment is RequireUser for the routes a user needs to enroll a second factor,
+// which also accept sessions that may only be used for enrollment
+func AllowEnrollment(c *config.Configuration, next http.Handler) http.Handler {
+	return requireRole(c, next, true)
+}
+
+// DenyImpersonation refuses requests made through an impersonation session. It wraps
+// the routes that manage how a user logs in, which stay in the user's own hands
+func DenyImpersonation(next http.Handler) http.Handler {
+	return guard{next: next, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestIdentity(r).Impersonator != "" {
+			writeError(w, http.StatusForbidden, "this action is not available while acting as another user")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})}
+}
+
+// RequireAdmin only allows a request through if it carries the admin token from the
+// panel configuration or the session token of an admin user as a bearer token
+func RequireAdmin(c *config.Configuration, next http.Handler) http.Handler {
+	return requireRole(c, next, false, auth.RoleAdmin)
+}
+
+// requireRole authenticates the request and checks that the identity has one of the
+// roles. If no roles are given any authenticated identity is allowed. Enrollment sessions
+// are rejected unless allowEnrollment is set
+func requireRole(c *config.Configuration, next http.Handler, allowEnrollment bool, roles ...string) http.Handler {
+	level := sdk.User
+	if slices.Contains(roles, auth.RoleAdmin) {
+		level = sdk.Admin
+	}
+
+	return guard{access: level, next: next, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, token, ok := authenticate(c, r)
+		if !ok {
+			if token != "" {
+				bruteforce.Failure("panel", remoteIP(r))
+			}
+
+			writeError(w, http.StatusUnauthorized, "invalid or missing authorization token")
+			return
+		}
+
+		setResponseLanguage(w, id.Language)
+
+		if id.Enrollment && !allowEnrollment {
+			writeError(w, http.StatusForbidden, "your role requires a second factor, enroll one before using the panel")
+			return
+		}
+
+		if len(roles) > 0 && !slices.Contains(roles, id.Role) {
+			writeError(w, http.StatusForbidden, "you do not have permission to perform this action")
+			return
+		}
+
+		if err := access.Check(remoteIP(r), id.Role); err != nil {
+			writeAccessError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), identityKey, id)
+		ctx = context.WithValue(ctx, tokenKey, token)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})}
+}
+
+// writeJSON writes the value as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.S().Named("api").Debugw("failed to write response", zap.Error(err))
+	}
+}
+
+// writeError writes an error response in the format used by every API route, translated
+// into the language of the response. The message is redacted since errors often include
+// the values that caused them
+func writeError(w http.ResponseWriter, status int, message string) {
+	language := responseLanguage(w)
+	w.Header().Set("Content-Language", language)
+
+	writeJSON(w, status, map[string]string{"error": logging.Redact(locale.Translate(language, message))})
+}
+
+// dryRun returns true if the dry_run query parameter asks for a report of what the
+// request would change instead of changing it
+func dryRun(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return v
+}
+
+// readJSON decodes the request body into the value, writing an error response and
+// returning false if the body is not valid JSON
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "request body is not valid JSON")
+		return false
+	}
+
+	return true
+}
+
+// requestIdentity returns the identity that authenticated the request
+func requestIdentity(r *http.Request) identity {
+	id, _ := r.Context().Value(identityKey).(identity)
+
+	return id
+}
+
+// actor returns the name of the identity that authenticated the request
+func actor(r *http.Request) string {
+	return requestIdentity(r).Actor
+}
+
+// remoteIP returns the IP address the request was made from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,290 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// Configure returns the handler serving the panel API. Every route registered here is
+// served beneath /api/v1 and requires the admin token unless stated otherwise
+func Configure(c *config.Configuration) http.Handler {
+	mux := &routeMux{ServeMux: http.NewServeMux()}
+
+	loadMaintenancePage(c.Access.MaintenancePage)
+
+	mux.HandleFunc("POST /api/v1/auth/login", postLogin)
+	mux.HandleFunc("POST /api/v1/auth/login/totp", postLoginTOTP)
+	mux.HandleFunc("POST /api/v1/auth/login/recovery", postLoginRecovery)
+	mux.HandleFunc("POST /api/v1/auth/login/webauthn/begin", postLoginKeyBegin)
+	mux.HandleFunc("POST /api/v1/auth/login/webauthn/finish", postLoginKeyFinish)
+	mux.HandleFunc("POST /api/v1/auth/login/passkey", postLoginPasskey)
+	mux.HandleFunc("POST /api/v1/auth/login/sso", postLoginSSO)
+	mux.HandleFunc("GET /api/v1/auth/login/sso/callback", getLoginSSOCallback)
+	mux.Handle("POST /api/v1/auth/logout", AllowEnrollment(c, http.HandlerFunc(postLogout)))
+	mux.Handle("GET /api/v1/auth/me", AllowEnrollment(c, http.HandlerFunc(getMe)))
+	mux.Handle("PUT /api/v1/auth/me/language", AllowEnrollment(c, http.HandlerFunc(putMyLanguage)))
+	mux.Handle("GET /api/v1/auth/me/announcements", RequireUser(c, http.HandlerFunc(getMyAnnouncements)))
+	mux.Handle("POST /api/v1/auth/me/announcements/{id}/dismiss", RequireUser(c, http.HandlerFunc(postDismissAnnouncement)))
+	mux.Handle("DELETE /api/v1/auth/devices/{id}", RequireUser(c, DenyImpersonation(http.HandlerFunc(deleteDevice))))
+
+	mux.Handle("POST /api/v1/auth/totp", AllowEnrollment(c, DenyImpersonation(http.HandlerFunc(postTOTP))))
+	mux.Handle("POST /api/v1/auth/totp/confirm", AllowEnrollment(c, DenyImpersonation(http.HandlerFunc(postTOTPConfirm))))
+	mux.Handle("DELETE /api/v1/auth/totp", RequireUser(c, DenyImpersonation(http.HandlerFunc(deleteTOTP))))
+	mux.Handle("POST /api/v1/auth/keys/begin", AllowEnrollment(c, DenyImpersonation(http.HandlerFunc(postKeyBegin))))
+	mux.Handle("POST /api/v1/auth/keys/finish", AllowEnrollment(c, DenyImpersonation(http.HandlerFunc(postKeyFinish))))
+	mux.Handle("DELETE /api/v1/auth/keys/{id}", RequireUser(c, DenyImpersonation(http.HandlerFunc(deleteKey))))
+	mux.Handle("POST /api/v1/auth/recovery-codes", RequireUser(c, DenyImpersonation(http.HandlerFunc(postRecoveryCodes))))
+
+	mux.Handle("GET /api/v1/users", RequireAdmin(c, http.HandlerFunc(getUsers)))
+	mux.Handle("POST /api/v1/users", RequireAdmin(c, http.HandlerFunc(postUser)))
+	mux.Handle("GET /api/v1/users/{id}", RequireAdmin(c, http.HandlerFunc(getUser)))
+	mux.Handle("DELETE /api/v1/users/{id}", RequireAdmin(c, http.HandlerFunc(deleteUser)))
+	mux.Handle("POST /api/v1/users/{id}/unlock", RequireAdmin(c, http.HandlerFunc(postUserUnlock)))
+	mux.Handle("DELETE /api/v1/users/{id}/second-factors", RequireAdmin(c, http.HandlerFunc(deleteUserSecondFactors)))
+	mux.Handle("POST /api/v1/users/{id}/clone", RequireAdmin(c, http.HandlerFunc(postUserClone)))
+	mux.Handle("GET /api/v1/users/{id}/ipv6", RequireAdmin(c, http.HandlerFunc(getUserIPv6)))
+	mux.Handle("PUT /api/v1/users/{id}/ipv6", RequireAdmin(c, http.HandlerFunc(putUserIPv6)))
+	mux.Handle("DELETE /api/v1/users/{id}/ipv6", RequireAdmin(c, http.HandlerFunc(deleteUserIPv6)))
+	mux.Handle("GET /api/v1/network/ipv6", RequireAdmin(c, http.HandlerFunc(getIPv6Assignments)))
+	mux.Handle("GET /api/v1/users/{id}/ips", RequireAdmin(c, http.HandlerFunc(getUserDedicated)))
+	mux.Handle("POST /api/v1/users/{id}/ips", RequireAdmin(c, http.HandlerFunc(postUserDedicated)))
+	mux.Handle("GET /api/v1/network/dedicated", RequireAdmin(c, http.HandlerFunc(getDedicatedPool)))
+	mux.Handle("GET /api/v1/network/dedicated/{address}", RequireAdmin(c, http.HandlerFunc(getDedicated)))
+	mux.Handle("PUT /api/v1/network/dedicated/{address}", RequireAdmin(c, http.HandlerFunc(putDedicated)))
+	mux.Handle("DELETE /api/v1/network/dedicated/{address}", RequireAdmin(c, http.HandlerFunc(deleteDedicated)))
+	mux.Handle("POST /api/v1/users/{id}/impersonate", RequireUser(c, DenyImpersonation(http.HandlerFunc(postImpersonate))))
+
+	mux.Handle("POST /api/v1/provisioning/accounts", RequireAdmin(c, http.HandlerFunc(postProvisioningAccount)))
+	mux.Handle("GET /api/v1/provisioning/accounts/{username}", RequireAdmin(c, http.HandlerFunc(getProvisioningAccount)))
+	mux.Handle("DELETE /api/v1/provisioning/accounts/{username}", RequireAdmin(c, http.HandlerFunc(deleteProvisioningAccount)))
+	mux.Handle("POST /api/v1/provisioning/accounts/{username}/suspend", RequireAdmin(c, http.HandlerFunc(postProvisioningSuspend)))
+	mux.Handle("POST /api/v1/provisioning/accounts/{username}/unsuspend", RequireAdmin(c, http.HandlerFunc(postProvisioningUnsuspend)))
+	mux.Handle("PUT /api/v1/provisioning/accounts/{username}/package", RequireAdmin(c, http.HandlerFunc(putProvisioningPackage)))
+	mux.Handle("GET /api/v1/provisioning/accounts/{username}/usage", RequireAdmin(c, http.HandlerFunc(getProvisioningUsage)))
+	mux.Handle("GET /json-api/{function}", whmAuthorization(RequireAdmin(c, http.HandlerFunc(whmAPI))))
+	mux.Handle("POST /json-api/{function}", whmAuthorization(RequireAdmin(c, http.HandlerFunc(whmAPI))))
+
+	mux.HandleFunc("GET /api/v1/health", getHealth)
+	mux.HandleFunc("GET /api/v1/branding", getBranding)
+	mux.HandleFunc("GET /api/v1/locales", getLocales)
+	mux.HandleFunc("GET /api/v1/locales/{language}", getLocale)
+
+	mux.Handle("GET /api/v1/system/info", RequireAdmin(c, http.HandlerFunc(getSystemInfo)))
+	mux.Handle("GET /api/v1/system/modules", RequireAdmin(c, http.HandlerFunc(getModules)))
+	mux.Handle("GET /api/v1/system/logging", RequireAdmin(c, http.HandlerFunc(getLogging)))
+	mux.Handle("PUT /api/v1/system/logging", RequireAdmin(c, http.HandlerFunc(putLogging)))
+	mux.Handle("PUT /api/v1/system/logging/{module}", RequireAdmin(c, http.HandlerFunc(putModuleLogging)))
+	mux.Handle("DELETE /api/v1/system/logging/{module}", RequireAdmin(c, http.HandlerFunc(deleteModuleLogging)))
+	mux.Handle("POST /api/v1/system/mail/test", RequireAdmin(c, http.HandlerFunc(postMailTest)))
+	mux.Handle("GET /api/v1/system/tasks", RequireAdmin(c, http.HandlerFunc(getTasks)))
+	mux.Handle("GET /api/v1/system/tasks/{name}/runs", RequireAdmin(c, http.HandlerFunc(getTaskRuns)))
+	mux.Handle("POST /api/v1/system/tasks/{name}/run", RequireAdmin(c, http.HandlerFunc(postTaskRun)))
+	mux.Handle("GET /api/v1/system/updates", RequireAdmin(c, http.HandlerFunc(getUpdates)))
+	mux.Handle("POST /api/v1/system/updates/check", RequireAdmin(c, http.HandlerFunc(postUpdatesCheck)))
+	mux.Handle("POST /api/v1/system/updates/apply", RequireAdmin(c, http.HandlerFunc(postUpdatesApply)))
+	mux.Handle("GET /api/v1/system/reconcile", RequireAdmin(c, http.HandlerFunc(getReconcile)))
+	mux.Handle("POST /api/v1/system/reconcile", RequireAdmin(c, http.HandlerFunc(postReconcile)))
+	mux.Handle("GET /api/v1/system/reconcile/snapshots", RequireAdmin(c, http.HandlerFunc(getReconcileSnapshots)))
+	mux.Handle("GET /api/v1/system/reconcile/snapshots/{id}", RequireAdmin(c, http.HandlerFunc(getReconcileSnapshot)))
+
+	mux.Handle("GET /api/v1/jobs", RequireAdmin(c, http.HandlerFunc(getJobs)))
+	mux.Handle("GET /api/v1/jobs/{id}", RequireAdmin(c, http.HandlerFunc(getJob)))
+	mux.Handle("POST /api/v1/jobs/{id}/retry", RequireAdmin(c, http.HandlerFunc(postJobRetry)))
+	mux.Handle("POST /api/v1/jobs/{id}/cancel", RequireAdmin(c, http.HandlerFunc(postJobCancel)))
+	mux.Handle("GET /api/v1/bulk", RequireAdmin(c, http.HandlerFunc(getBulkOperations)))
+	mux.Handle("POST /api/v1/bulk", RequireAdmin(c, http.HandlerFunc(postBulkOperation)))
+	mux.Handle("GET /api/v1/bulk/{id}", RequireAdmin(c, http.HandlerFunc(getBulkOperation)))
+	mux.Handle("POST /api/v1/bulk/{id}/retry", RequireAdmin(c, http.HandlerFunc(postBulkRetry)))
+	mux.Handle("POST /api/v1/bulk/{id}/cancel", RequireAdmin(c, http.HandlerFunc(postBulkCancel)))
+	mux.Handle("POST /api/v1/support/tickets", RequireUser(c, http.HandlerFunc(postSupportTicket)))
+	mux.Handle("GET /api/v1/support/tickets", RequireUser(c, http.HandlerFunc(getSupportTickets)))
+	mux.Handle("GET /api/v1/support/tickets/{id}", RequireUser(c, http.HandlerFunc(getSupportTicket)))
+	mux.Handle("GET /api/v1/support/context", RequireUser(c, http.HandlerFunc(getSupportContext)))
+
+	mux.Handle("GET /api/v1/stats", RequireAdmin(c, http.HandlerFunc(getStats)))
+	mux.Handle("GET /api/v1/stats/{domain}", RequireAdmin(c, http.HandlerFunc(getDomainStats)))
+	mux.Handle("GET /api/v1/stats/{domain}/errors", RequireAdmin(c, http.HandlerFunc(getDomainErrors)))
+	mux.Handle("GET /api/v1/stats/{domain}/archive", RequireAdmin(c, http.HandlerFunc(getDomainArchive)))
+	mux.Handle("PUT /api/v1/stats/{domain}/archive", RequireAdmin(c, http.HandlerFunc(putDomainArchive)))
+	mux.Handle("GET /api/v1/stats/{domain}/archive/{date}", RequireAdmin(c, http.HandlerFunc(getDomainArchiveLog)))
+	mux.Handle("GET /api/v1/traffic/domains/{domain}", RequireAdmin(c, http.HandlerFunc(getDomainTraffic)))
+	mux.Handle("GET /api/v1/traffic/accounts/{username}", RequireAdmin(c, http.HandlerFunc(getAccountTraffic)))
+
+	mux.Handle("GET /api/v1/backups", RequireAdmin(c, http.HandlerFunc(getBackups)))
+	mux.Handle("POST /api/v1/backups", RequireAdmin(c, http.HandlerFunc(postBackup)))
+	mux.Handle("POST /api/v1/backups/{id}/restore", RequireAdmin(c, http.HandlerFunc(postBackupRestore)))
+
+	mux.Handle("GET /api/v1/account-templates", RequireAdmin(c, http.HandlerFunc(getAccountTemplates)))
+	mux.Handle("POST /api/v1/account-templates", RequireAdmin(c, http.HandlerFunc(postAccountTemplate)))
+	mux.Handle("GET /api/v1/account-templates/{name}", RequireAdmin(c, http.HandlerFunc(getAccountTemplate)))
+	mux.Handle("DELETE /api/v1/account-templates/{name}", RequireAdmin(c, http.HandlerFunc(deleteAccountTemplate)))
+	mux.Handle("POST /api/v1/account-templates/{name}/accounts", RequireAdmin(c, http.HandlerFunc(postAccountTemplateAccount)))
+
+	mux.Handle("GET /api/v1/archives", RequireAdmin(c, http.HandlerFunc(getArchives)))
+	mux.Handle("GET /api/v1/archives/{id}", RequireAdmin(c, http.HandlerFunc(getArchive)))
+	mux.Handle("PUT /api/v1/archives/{id}", RequireAdmin(c, http.HandlerFunc(putArchive)))
+	mux.Handle("DELETE /api/v1/archives/{id}", RequireAdmin(c, http.HandlerFunc(deleteArchive)))
+	mux.Handle("POST /api/v1/archives/{id}/restore", RequireAdmin(c, http.HandlerFunc(postArchiveRestore)))
+	mux.Handle("GET /api/v1/privacy/export", RequireUser(c, http.HandlerFunc(getPrivacyExport)))
+	mux.Handle("GET /api/v1/privacy/erasures", RequireAdmin(c, http.HandlerFunc(getErasures)))
+	mux.Handle("GET /api/v1/privacy/erasures/{id}", RequireAdmin(c, http.HandlerFunc(getErasure)))
+	mux.Handle("POST /api/v1/privacy/erasures", RequireAdmin(c, http.HandlerFunc(postErasure)))
+	mux.Handle("GET /api/v1/fairuse", RequireAdmin(c, http.HandlerFunc(getFairUse)))
+	mux.Handle("GET /api/v1/fairuse/throttles", RequireAdmin(c, http.HandlerFunc(getThrottles)))
+	mux.Handle("DELETE /api/v1/fairuse/throttles/{account}", RequireAdmin(c, http.HandlerFunc(deleteThrottle)))
+	mux.Handle("GET /api/v1/filetransfers", RequireAdmin(c, http.HandlerFunc(getFileTransfers)))
+	mux.Handle("GET /api/v1/filetransfers/{account}", RequireAdmin(c, http.HandlerFunc(getFileTransfer)))
+	mux.Handle("GET /api/v1/reservations", RequireAdmin(c, http.HandlerFunc(getReservations)))
+	mux.Handle("POST /api/v1/reservations/apply", RequireAdmin(c, http.HandlerFunc(postReservationsApply)))
+	mux.Handle("GET /api/v1/reservations/{account}", RequireAdmin(c, http.HandlerFunc(getReservation)))
+	mux.Handle("GET /api/v1/deliverability", RequireUser(c, http.HandlerFunc(getDeliverability)))
+	mux.Handle("POST /api/v1/deliverability/reports", RequireAdmin(c, http.HandlerFunc(postDMARCReports)))
+	mux.Handle("GET /api/v1/deliverability/{name}", RequireUser(c, http.HandlerFunc(getDomainDeliverability)))
+	mux.Handle("POST /api/v1/deliverability/{name}/check", RequireUser(c, http.HandlerFunc(postDeliverabilityCheck)))
+	mux.Handle("GET /api/v1/deliverability/{name}/reports", RequireUser(c, http.HandlerFunc(getDMARCReports)))
+	mux.Handle("GET /api/v1/certificates", RequireUser(c, http.HandlerFunc(getCertificates)))
+	mux.Handle("POST /api/v1/certificates/scan", RequireAdmin(c, http.HandlerFunc(postCertificatesScan)))
+	mux.Handle("GET /api/v1/certificates/calendar", RequireUser(c, http.HandlerFunc(getCertificatesCalendar)))
+	mux.Handle("GET /api/v1/ssh/key", RequireAdmin(c, http.HandlerFunc(getSSHKey)))
+	mux.Handle("POST /api/v1/ssh/key", RequireAdmin(c, http.HandlerFunc(postSSHKey)))
+	mux.Handle("POST /api/v1/ssh/scan", RequireAdmin(c, http.HandlerFunc(postSSHScan)))
+	mux.Handle("GET /api/v1/ssh/hosts", RequireAdmin(c, http.HandlerFunc(getKnownHosts)))
+	mux.Handle("POST /api/v1/ssh/hosts", RequireAdmin(c, http.HandlerFunc(postKnownHost)))
+	mux.Handle("DELETE /api/v1/ssh/hosts/{address}", RequireAdmin(c, http.HandlerFunc(deleteKnownHost)))
+	mux.Handle("GET /api/v1/ssh/destinations", RequireAdmin(c, http.HandlerFunc(getSSHDestinations)))
+	mux.Handle("GET /api/v1/ssh/destinations/{name}", RequireAdmin(c, http.HandlerFunc(getSSHDestination)))
+	mux.Handle("PUT /api/v1/ssh/destinations/{name}", RequireAdmin(c, http.HandlerFunc(putSSHDestination)))
+	mux.Handle("DELETE /api/v1/ssh/destinations/{name}", RequireAdmin(c, http.HandlerFunc(deleteSSHDestination)))
+	mux.Handle("POST /api/v1/ssh/destinations/{name}/test", RequireAdmin(c, http.HandlerFunc(postSSHDestinationTest)))
+
+	mux.Handle("GET /api/v1/cluster", RequireAdmin(c, http.HandlerFunc(getCluster)))
+	mux.Handle("POST /api/v1/cluster/tokens", RequireAdmin(c, http.HandlerFunc(postJoinToken)))
+	mux.Handle("POST /api/v1/cluster/promote", RequireAdmin(c, http.HandlerFunc(postPromote)))
+	mux.Handle("GET /api/v1/cluster/nodes/{id}", RequireAdmin(c, http.HandlerFunc(getNode)))
+	mux.Handle("PUT /api/v1/cluster/nodes/{id}", RequireAdmin(c, http.HandlerFunc(putNode)))
+	mux.Handle("DELETE /api/v1/cluster/nodes/{id}", RequireAdmin(c, http.HandlerFunc(deleteNode)))
+	mux.Handle("GET /api/v1/cluster/nodes/{id}/commands", RequireAdmin(c, http.HandlerFunc(getNodeCommands)))
+	mux.Handle("POST /api/v1/cluster/nodes/{id}/commands", RequireAdmin(c, http.HandlerFunc(postNodeCommand)))
+	mux.Handle("POST /api/v1/cluster/nodes/{id}/sync", RequireAdmin(c, http.HandlerFunc(postNodeSync)))
+	mux.Handle("GET /api/v1/cluster/commands/{id}", RequireAdmin(c, http.HandlerFunc(getCommand)))
+	mux.Handle("POST /api/v1/cluster/placement", RequireAdmin(c, http.HandlerFunc(postPlacement)))
+	mux.Handle("GET /api/v1/cluster/backups", RequireAdmin(c, http.HandlerFunc(getClusterBackups)))
+	mux.Handle("POST /api/v1/cluster/backups/refresh", RequireAdmin(c, http.HandlerFunc(postClusterBackupsRefresh)))
+	mux.Handle("POST /api/v1/cluster/backups/restore", RequireAdmin(c, http.HandlerFunc(postClusterBackupRestore)))
+	mux.Handle("POST /api/v1/cluster/transfers", RequireAdmin(c, http.HandlerFunc(postTransfer)))
+
+	mux.Handle("GET /api/v1/access", RequireAdmin(c, http.HandlerFunc(getAccess)))
+	mux.HandleFunc("POST "+breakGlassPath, postBreakGlass)
+	mux.Handle("DELETE /api/v1/access/grants/{ip}", RequireAdmin(c, http.HandlerFunc(deleteGrant)))
+	mux.Handle("POST /api/v1/access/maintenance", RequireAdmin(c, http.HandlerFunc(postMaintenance)))
+	mux.Handle("DELETE /api/v1/access/maintenance/{id}", RequireAdmin(c, http.HandlerFunc(deleteMaintenance)))
+	mux.Handle("PUT /api/v1/access/maintenance/mode", RequireAdmin(c, http.HandlerFunc(putMaintenanceMode)))
+	mux.Handle("DELETE /api/v1/access/maintenance/mode", RequireAdmin(c, http.HandlerFunc(deleteMaintenanceMode)))
+
+	mux.Handle("GET /api/v1/activity", RequireAdmin(c, http.HandlerFunc(getActivity)))
+	mux.Handle("GET /api/v1/inventory", RequireUser(c, http.HandlerFunc(getInventory)))
+
+	mux.Handle("GET /api/v1/resellers/{id}/branding", RequireUser(c, http.HandlerFunc(getResellerBranding)))
+	mux.Handle("PUT /api/v1/resellers/{id}/branding", RequireUser(c, http.HandlerFunc(putResellerBranding)))
+	mux.Handle("DELETE /api/v1/resellers/{id}/branding", RequireUser(c, http.HandlerFunc(deleteResellerBranding)))
+
+	mux.Handle("GET /api/v1/notifications/kinds", RequireUser(c, http.HandlerFunc(getNotificationKinds)))
+	mux.Handle("GET /api/v1/notifications/deliveries", RequireUser(c, http.HandlerFunc(getNotificationDeliveries)))
+	mux.Handle("GET /api/v1/notifications/templates/{kind}", RequireAdmin(c, http.HandlerFunc(getNotificationTemplate)))
+	mux.Handle("PUT /api/v1/notifications/templates/{kind}", RequireAdmin(c, http.HandlerFunc(putNotificationTemplate)))
+	mux.Handle("DELETE /api/v1/notifications/templates/{kind}", RequireAdmin(c, http.HandlerFunc(deleteNotificationTemplate)))
+	mux.Handle("GET /api/v1/resellers/{id}/notifications/{kind}", RequireUser(c, http.HandlerFunc(getResellerNotificationTemplate)))
+	mux.Handle("PUT /api/v1/resellers/{id}/notifications/{kind}", RequireUser(c, http.HandlerFunc(putResellerNotificationTemplate)))
+	mux.Handle("DELETE /api/v1/resellers/{id}/notifications/{kind}", RequireUser(c, http.HandlerFunc(deleteResellerNotificationTemplate)))
+
+	mux.Handle("GET /api/v1/announcements", RequireUser(c, http.HandlerFunc(getAnnouncements)))
+	mux.Handle("POST /api/v1/announcements", RequireUser(c, http.HandlerFunc(postAnnouncement)))
+	mux.Handle("GET /api/v1/announcements/{id}", RequireUser(c, http.HandlerFunc(getAnnouncement)))
+	mux.Handle("PUT /api/v1/announcements/{id}", RequireUser(c, http.HandlerFunc(putAnnouncement)))
+	mux.Handle("DELETE /api/v1/announcements/{id}", RequireUser(c, http.HandlerFunc(deleteAnnouncement)))
+
+	mux.Handle("GET /api/v1/plugins", RequireAdmin(c, http.HandlerFunc(getPlugins)))
+	mux.Handle("GET /api/v1/plugins/panels", RequireUser(c, http.HandlerFunc(getPluginPanels)))
+	mux.Handle("POST /api/v1/plugins/{name}/enable", RequireAdmin(c, http.HandlerFunc(postPluginEnable)))
+	mux.Handle("POST /api/v1/plugins/{name}/disable", RequireAdmin(c, http.HandlerFunc(postPluginDisable)))
+	mux.Handle("POST /api/v1/plugins/{name}/jobs/{type}", RequireAdmin(c, http.HandlerFunc(postPluginJob)))
+	mux.Handle("/api/v1/plugins/{name}/api/{path...}", RequireUser(c, http.HandlerFunc(pluginAPI)))
+
+	mux.Handle("GET /api/v1/firewall", RequireAdmin(c, http.HandlerFunc(getFirewall)))
+	mux.Handle("POST /api/v1/firewall/rules", RequireAdmin(c, http.HandlerFunc(postFirewallRule)))
+	mux.Handle("DELETE /api/v1/firewall/rules/{id}", RequireAdmin(c, http.HandlerFunc(deleteFirewallRule)))
+
+	mux.Handle("GET /api/v1/security/bans", RequireAdmin(c, http.HandlerFunc(getBans)))
+	mux.Handle("DELETE /api/v1/security/bans/{ip}", RequireAdmin(c, http.HandlerFunc(deleteBan)))
+	mux.Handle("GET /api/v1/security/whitelist", RequireAdmin(c, http.HandlerFunc(getWhitelist)))
+	mux.Handle("POST /api/v1/security/whitelist", RequireAdmin(c, http.HandlerFunc(postWhitelist)))
+	mux.Handle("DELETE /api/v1/security/whitelist/{entry...}", RequireAdmin(c, http.HandlerFunc(deleteWhitelist)))
+	mux.Handle("GET /api/v1/security/advisor", RequireAdmin(c, http.HandlerFunc(getAdvisor)))
+	mux.Handle("POST /api/v1/security/advisor/scan", RequireAdmin(c, http.HandlerFunc(postAdvisorScan)))
+	mux.Handle("GET /api/v1/security/tls", RequireAdmin(c, http.HandlerFunc(getTLSPolicy)))
+	mux.Handle("POST /api/v1/security/tls/apply", RequireAdmin(c, http.HandlerFunc(postTLSPolicyApply)))
+
+	mux.Handle("GET /api/v1/malware", RequireAdmin(c, http.HandlerFunc(getMalware)))
+	mux.Handle("POST /api/v1/malware/scan", RequireAdmin(c, http.HandlerFunc(postMalwareScan)))
+	mux.Handle("POST /api/v1/malware/detections/{id}/restore", RequireAdmin(c, http.HandlerFunc(postMalwareRestore)))
+	mux.Handle("DELETE /api/v1/malware/detections/{id}", RequireAdmin(c, http.HandlerFunc(deleteMalware)))
+
+	mux.Handle("GET /api/v1/vault", RequireAdmin(c, http.HandlerFunc(getVault)))
+	mux.Handle("POST /api/v1/vault/rotate", RequireAdmin(c, http.HandlerFunc(postVaultRotate)))
+	mux.Handle("PUT /api/v1/vault/{name...}", RequireAdmin(c, http.HandlerFunc(putVaultSecret)))
+	mux.Handle("DELETE /api/v1/vault/{name...}", RequireAdmin(c, http.HandlerFunc(deleteVaultSecret)))
+
+	mux.Handle("GET /api/v1/audit", RequireAdmin(c, http.HandlerFunc(getAudit)))
+	mux.Handle("GET /api/v1/audit/export", RequireAdmin(c, http.HandlerFunc(getAuditExport)))
+	mux.Handle("GET /api/v1/audit/verify", RequireAdmin(c, http.HandlerFunc(getAuditVerify)))
+
+	mux.Handle("GET /api/v1/domains", RequireUser(c, http.HandlerFunc(getDomains)))
+	mux.Handle("POST /api/v1/domains", RequireUser(c, http.HandlerFunc(postDomain)))
+	mux.Handle("GET /api/v1/domains/availability", RequireUser(c, http.HandlerFunc(getDomainAvailability)))
+	mux.Handle("POST /api/v1/domains/transfers", RequireUser(c, http.HandlerFunc(postDomainTransfer)))
+	mux.Handle("GET /api/v1/domains/{name}", RequireUser(c, http.HandlerFunc(getDomain)))
+	mux.Handle("DELETE /api/v1/domains/{name}", RequireAdmin(c, http.HandlerFunc(deleteDomain)))
+	mux.Handle("POST /api/v1/domains/{name}/renew", RequireUser(c, http.HandlerFunc(postDomainRenew)))
+	mux.Handle("PUT /api/v1/domains/{name}/auto-renew", RequireUser(c, http.HandlerFunc(putDomainAutoRenew)))
+	mux.Handle("PUT /api/v1/domains/{name}/nameservers", RequireUser(c, http.HandlerFunc(putDomainNameservers)))
+	mux.Handle("PUT /api/v1/domains/{name}/ds", RequireUser(c, http.HandlerFunc(putDomainDS)))
+
+	mux.Handle("GET /api/v1/dns/providers", RequireAdmin(c, http.HandlerFunc(getDNSProviders)))
+	mux.Handle("GET /api/v1/dns/zones/{zone}/records", RequireUser(c, http.HandlerFunc(getDNSRecords)))
+	mux.Handle("PUT /api/v1/dns/zones/{zone}/records/{name}/{type}", RequireUser(c, http.HandlerFunc(putDNSRecords)))
+	mux.Handle("DELETE /api/v1/dns/zones/{zone}/records/{name}/{type}", RequireUser(c, http.HandlerFunc(deleteDNSRecords)))
+	mux.Handle("GET /api/v1/dns/zones/{zone}/propagation", RequireUser(c, http.HandlerFunc(getDNSPropagation)))
+	mux.Handle("GET /api/v1/dns/zones/{zone}/records/{name}/{type}/propagation", RequireUser(c, http.HandlerFunc(getDNSRecordPropagation)))
+	mux.Handle("POST /api/v1/dns/zones/{zone}/records/{name}/{type}/propagation", RequireUser(c, http.HandlerFunc(postDNSRecordPropagation)))
+
+	mux.Handle("GET /api/v1/cdn", RequireUser(c, http.HandlerFunc(getCDNSites)))
+	mux.Handle("GET /api/v1/cdn/{host}", RequireUser(c, http.HandlerFunc(getCDNSite)))
+	mux.Handle("PUT /api/v1/cdn/{host}", RequireUser(c, http.HandlerFunc(putCDNSite)))
+	mux.Handle("DELETE /api/v1/cdn/{host}", RequireUser(c, http.HandlerFunc(deleteCDNSite)))
+	mux.Handle("POST /api/v1/cdn/{host}/purge", RequireUser(c, http.HandlerFunc(postCDNPurge)))
+	mux.Handle("GET /api/v1/php/limits", RequireUser(c, http.HandlerFunc(getPHPLimits)))
+	mux.Handle("GET /api/v1/php", RequireUser(c, http.HandlerFunc(getPHPSettings)))
+	mux.Handle("GET /api/v1/php/{domain}", RequireUser(c, http.HandlerFunc(getPHPSetting)))
+	mux.Handle("PUT /api/v1/php/{domain}", RequireUser(c, http.HandlerFunc(putPHPSetting)))
+	mux.Handle("DELETE /api/v1/php/{domain}", RequireUser(c, http.HandlerFunc(deletePHPSetting)))
+	mux.Handle("GET /api/v1/redirects", RequireUser(c, http.HandlerFunc(getRedirects)))
+	mux.Handle("GET /api/v1/redirects/{domain}", RequireUser(c, http.HandlerFunc(getDomainRedirects)))
+	mux.Handle("POST /api/v1/redirects/{domain}", RequireUser(c, http.HandlerFunc(postRedirect)))
+	mux.Handle("GET /api/v1/redirects/{domain}/{id}", RequireUser(c, http.HandlerFunc(getRedirect)))
+	mux.Handle("PUT /api/v1/redirects/{domain}/{id}", RequireUser(c, http.HandlerFunc(putRedirect)))
+	mux.Handle("DELETE /api/v1/redirects/{domain}/{id}", RequireUser(c, http.HandlerFunc(deleteRedirect)))
+	mux.Handle("GET /api/v1/wordpress", RequireUser(c, http.HandlerFunc(getWordPressSites)))
+	mux.Handle("POST /api/v1/wordpress/scan", RequireAdmin(c, http.HandlerFunc(postWordPressScan)))
+	mux.Handle("GET /api/v1/wordpress/{id}", RequireUser(c, http.HandlerFunc(getWordPressSite)))
+	mux.Handle("PUT /api/v1/wordpress/{id}/hardening", RequireUser(c, http.HandlerFunc(putWordPressHardening)))
+	mux.Handle("POST /api/v1/wordpress/{id}/update", RequireUser(c, http.HandlerFunc(postWordPressUpdate)))
+
+	mux.Handle("GET /api/v1/sdk/openapi.json", RequireUser(c, http.HandlerFunc(getOpenAPI)))
+	mux.Handle("GET /api/v1/sdk/go", RequireUser(c, http.HandlerFunc(getGoClient)))
+	mux.Handle("GET /api/v1/sdk/typescript", RequireUser(c, http.HandlerFunc(getTypeScriptClient)))
+
+	routes = mux.routes
+
+	return Recover(Localize(StrictTransport(Restrict(mux))))
+}
@@ -0,0 +1,226 @@
+package router
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/bruteforce"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"go.uber.org/zap"
+)
+
+// breakGlassPath is exempt from the global allowlist so that a locked out administrator
+// can still reach it
+const breakGlassPath = "/api/v1/access/break-glass"
+
+// defaultMaintenancePage is shown to browsers during maintenance unless the access
+// configuration sets a page of its own
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html lang="{{.Language}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.T "%s is down for maintenance" .Brand.ProductName}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: {{or .Brand.PrimaryColor "#0f172a"}}; color: #e2e8f0; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+main { max-width: 32rem; padding: 2rem; text-align: center; }
+h1 { font-size: 1.5rem; }
+</style>
+</head>
+<body>
+<main>
+{{if .Brand.Logo}}<img src="{{.Brand.Logo}}" alt="{{.Brand.ProductName}}" style="max-height: 4rem">{{end}}
+<h1>{{.T "We'll be right back"}}</h1>
+<p>{{if .Message}}{{.Message}}{{else}}{{.T "%s is down for maintenance." .Brand.ProductName}}{{end}}</p>
+{{if not .Until.IsZero}}<p>{{.T "Expected back by %s." (.Until.Format "Mon, 02 Jan 2006 15:04 MST")}}</p>{{end}}
+</main>
+</body>
+</html>
+`
+
+// maintenancePage is the page written by writeMaintenancePage
+var maintenancePage = template.Must(template.New("maintenance").Parse(defaultMaintenancePage))
+
+// loadMaintenancePage replaces the built in maintenance page with the template at the
+// path, keeping the built in one if it cannot be parsed
+func loadMaintenancePage(path string) {
+	if path == "" {
+		return
+	}
+
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		zap.S().Named("api").Errorw("failed to load maintenance page, using the built in one", "path", path, zap.Error(err))
+		return
+	}
+
+	maintenancePage = t
+}
+
+// maintenancePageData is what the maintenance page is executed with. The brand is that of
+// the hostname the panel was reached at
+type maintenancePageData struct {
+	*access.MaintenanceError
+	Brand    branding.Brand
+	Language string
+}
+
+// T translates the text of the page into the language of the request
+func (d maintenancePageData) T(format string, args ...interface{}) string {
+	return locale.Sprintf(d.Language, format, args...)
+}
+
+// writeMaintenancePage writes the maintenance page with a 503 status for requests from
+// a browser
+func writeMaintenancePage(w http.ResponseWriter, r *http.Request, m *access.MaintenanceError) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	data := maintenancePageData{MaintenanceError: m, Brand: branding.ForHost(r.Host).Public(), Language: responseLanguage(w)}
+	if err := maintenancePage.Execute(w, data); err != nil {
+		zap.S().Named("api").Debugw("failed to write maintenance page", zap.Error(err))
+	}
+}
+
+// getAccess returns the active break glass grants, upcoming maintenance windows and
+// maintenance mode
+func getAccess(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"grants":      access.Grants(),
+		"maintenance": access.Windows(),
+		"active":      access.Active(),
+		"mode":        access.Maintenance(),
+	})
+}
+
+// postBreakGlass exchanges the break glass token for temporary access from the address
+// the request was made from
+func postBreakGlass(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	until, err := access.BreakGlass(body.Token, remoteIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, access.ErrInvalidToken):
+			bruteforce.Failure("panel", remoteIP(r))
+			writeError(w, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, access.ErrBreakGlassDisabled):
+			writeError(w, http.StatusNotFound, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ip": remoteIP(r), "until": until})
+}
+
+// deleteGrant ends a break glass grant early
+func deleteGrant(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+
+	if err := access.RevokeGrant(ip); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "security.access.revoke", ip, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maintenanceRequest is the request body for scheduling a maintenance window. A window
+// without a start begins immediately
+type maintenanceRequest struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Message string    `json:"message"`
+}
+
+// postMaintenance schedules a maintenance window during which only administrators can
+// use the panel
+func postMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body maintenanceRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	window, err := access.Schedule(access.Window{Start: body.Start, End: body.End, Message: body.Message})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "maintenance.create", window.ID, nil, window)
+
+	writeJSON(w, http.StatusCreated, window)
+}
+
+// deleteMaintenance cancels a maintenance window, ending it early if it has started
+func deleteMaintenance(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if err := access.Cancel(id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	publish(r, "maintenance.delete", id, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maintenanceModeRequest is the request body for turning maintenance mode on
+type maintenanceModeRequest struct {
+	Reason string    `json:"reason"`
+	ETA    time.Time `json:"eta"`
+}
+
+// putMaintenanceMode turns maintenance mode on and pauses the job queue, so that an
+// upgrade or migration is not raced by customers or background work
+func putMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	var body maintenanceModeRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before := access.Maintenance()
+
+	m, err := access.EnableMaintenance(body.Reason, body.ETA, actor(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jobs.Pause()
+
+	publish(r, "maintenance.mode.enable", "", before, m)
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+// deleteMaintenanceMode turns maintenance mode off and resumes the job queue
+func deleteMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	before := access.Maintenance()
+
+	if err := access.DisableMaintenance(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jobs.Resume()
+
+	publish(r, "maintenance.mode.disable", "", before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
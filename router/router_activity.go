@@ -0,0 +1,53 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+)
+
+// getActivity returns the activity feed filtered by account, reseller, actor, event
+// type and time range
+func getActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	f := events.Filter{
+		Account:  q.Get("account"),
+		Reseller: q.Get("reseller"),
+		Actor:    q.Get("actor"),
+		Type:     q.Get("type"),
+		Limit:    100,
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	activity, err := events.Query(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, activity)
+}
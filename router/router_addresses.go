@@ -0,0 +1,235 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+)
+
+// getIPv6Assignments returns the IPv6 prefix assigned to every account
+func getIPv6Assignments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, addresses.IPv6Assignments())
+}
+
+// getUserIPv6 returns the IPv6 prefix assigned to a user
+func getUserIPv6(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	a, err := addresses.IPv6(u.Username)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	setETag(w, etag(a))
+	writeJSON(w, http.StatusOK, a)
+}
+
+// putUserIPv6 assigns a user an IPv6 prefix, returning the one they already have if any
+func putUserIPv6(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var tag string
+	existing, err := addresses.IPv6(u.Username)
+	assigned := err == nil
+	if assigned {
+		tag = etag(existing)
+	}
+
+	if !preconditions(w, r, tag) {
+		return
+	}
+
+	a, err := addresses.AssignIPv6(u.Username)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	if !assigned {
+		publish(r, "user.ipv6.assign", u.ID, nil, a)
+	}
+
+	setETag(w, etag(a))
+	writeJSON(w, http.StatusOK, a)
+}
+
+// deleteUserIPv6 releases the IPv6 prefix of a user so it can be assigned to another
+func deleteUserIPv6(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	a, err := addresses.IPv6(u.Username)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(a)) {
+		return
+	}
+
+	if err := addresses.ReleaseIPv6(u.Username); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	publish(r, "user.ipv6.release", u.ID, a, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDedicatedPool returns every dedicated address and the account it is assigned to
+func getDedicatedPool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, addresses.Pool())
+}
+
+// getUserDedicated returns the dedicated addresses assigned to a user
+func getUserDedicated(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, addresses.DedicatedOf(u.Username))
+}
+
+// postUserDedicated assigns a user the dedicated address in the body, or the first free
+// one, serving the domain in the body on it
+func postUserDedicated(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var body struct {
+		Address string `json:"address"`
+		Domain  string `json:"domain"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	// Assigning moves an address the account already has, which is done through its
+	// own resource
+	if body.Address != "" {
+		if d, err := addresses.GetDedicated(body.Address); err == nil && d.Account != "" {
+			writeAddressError(w, addresses.ErrInUse)
+			return
+		}
+	}
+
+	d, err := addresses.AssignDedicated(u.Username, body.Address, body.Domain)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	publish(r, "user.ip.assign", d.Address.String(), nil, d)
+
+	w.Header().Set("Location", "/api/v1/network/dedicated/"+d.Address.String())
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// getDedicated returns a dedicated address and the account it is assigned to
+func getDedicated(w http.ResponseWriter, r *http.Request) {
+	d, err := addresses.GetDedicated(r.PathValue("address"))
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusOK, d)
+}
+
+// putDedicated serves the domain in the body on an assigned dedicated address, pointing
+// the previous one back at the shared address of the server
+func putDedicated(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Domain string `json:"domain"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, err := addresses.GetDedicated(r.PathValue("address"))
+	if err == nil && before.Account == "" {
+		err = addresses.ErrNotAssigned
+	}
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	d, err := addresses.AssignDedicated(before.Account, before.Address.String(), body.Domain)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	publish(r, "user.ip.update", d.Address.String(), before, d)
+
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusOK, d)
+}
+
+// deleteDedicated returns a dedicated address to the pool
+func deleteDedicated(w http.ResponseWriter, r *http.Request) {
+	before, err := addresses.GetDedicated(r.PathValue("address"))
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	d, err := addresses.ReleaseDedicated(before.Address.String())
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	publish(r, "user.ip.release", d.Address.String(), d, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAddressError writes an error from the addresses package with a matching status
+func writeAddressError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, addresses.ErrNotFound), errors.Is(err, addresses.ErrNotAssigned), errors.Is(err, addresses.ErrNotInPool):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, addresses.ErrNoPrefixes), errors.Is(err, addresses.ErrExhausted),
+		errors.Is(err, addresses.ErrPoolExhausted), errors.Is(err, addresses.ErrInUse), errors.Is(err, addresses.ErrDomainInUse):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, addresses.ErrInvalid):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, addresses.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
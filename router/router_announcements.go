@@ -0,0 +1,200 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/announcements"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+)
+
+// getMyAnnouncements returns the active announcements for the logged in user that they
+// have not dismissed, for the UI to show as banners
+func getMyAnnouncements(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	list, err := announcements.For(u)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postDismissAnnouncement hides an announcement from the logged in user
+func postDismissAnnouncement(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err := announcements.Dismiss(u, r.PathValue("id")); err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAnnouncements returns every announcement to admins, and those a reseller published
+// to the reseller
+func getAnnouncements(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := announcer(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := announcements.List(reseller)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getAnnouncement returns an announcement along with who has dismissed it
+func getAnnouncement(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := announcer(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := announcements.Get(reseller, r.PathValue("id"))
+	if err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	setETag(w, announcementTag(a))
+	writeJSON(w, http.StatusOK, a)
+}
+
+// postAnnouncement publishes an announcement, by a reseller only to their accounts
+func postAnnouncement(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := announcer(w, r)
+	if !ok {
+		return
+	}
+
+	var body announcements.Announcement
+	if !readJSON(w, r, &body) {
+		return
+	}
+	body.Reseller = reseller
+
+	a, err := announcements.Create(body, actor(r))
+	if err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	publish(r, "announcement.create", a.ID, nil, a)
+
+	w.Header().Set("Location", "/api/v1/announcements/"+a.ID)
+	setETag(w, announcementTag(a))
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// putAnnouncement replaces an announcement. One that has already been emailed is not
+// emailed again
+func putAnnouncement(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := announcer(w, r)
+	if !ok {
+		return
+	}
+
+	var body announcements.Announcement
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, err := announcements.Get(reseller, r.PathValue("id"))
+	if err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, announcementTag(before)) {
+		return
+	}
+
+	a, err := announcements.Update(reseller, before.ID, body)
+	if err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	publish(r, "announcement.update", a.ID, before, a)
+
+	setETag(w, announcementTag(a))
+	writeJSON(w, http.StatusOK, a)
+}
+
+// deleteAnnouncement removes an announcement
+func deleteAnnouncement(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := announcer(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := announcements.Get(reseller, r.PathValue("id"))
+	if err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, announcementTag(before)) {
+		return
+	}
+
+	if err := announcements.Delete(reseller, before.ID); err != nil {
+		writeAnnouncementError(w, err)
+		return
+	}
+
+	publish(r, "announcement.delete", before.ID, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// announcer returns the reseller whose announcements the caller manages, which is empty
+// for admins, writing an error for users who cannot publish announcements
+func announcer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	caller := requestIdentity(r)
+
+	switch caller.Role {
+	case auth.RoleAdmin:
+		return "", true
+	case auth.RoleReseller:
+		return caller.UserID, true
+	default:
+		writeError(w, http.StatusForbidden, "only admins and resellers can publish announcements")
+		return "", false
+	}
+}
+
+// announcementTag returns the entity tag of an announcement, which covers what the API
+// changes about it but not who has dismissed it
+func announcementTag(a announcements.Announcement) string {
+	a.Dismissed = nil
+
+	return etag(a)
+}
+
+// writeAnnouncementError writes the response for an announcement that could not be read
+// or changed
+func writeAnnouncementError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, announcements.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
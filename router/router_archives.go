@@ -0,0 +1,107 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/archives"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+)
+
+// getArchives returns the archives of terminated accounts, newest first
+func getArchives(w http.ResponseWriter, r *http.Request) {
+	list, err := archives.List()
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getArchive returns the archive of a terminated account
+func getArchive(w http.ResponseWriter, r *http.Request) {
+	a, err := archives.Get(r.PathValue("id"))
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+// archiveRequest is the request body for keeping an archive longer or shorter
+type archiveRequest struct {
+	Expires time.Time `json:"expires"`
+}
+
+// putArchive changes when an archive is purged, such as to keep it while the
+// termination is disputed
+func putArchive(w http.ResponseWriter, r *http.Request) {
+	var body archiveRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	id := r.PathValue("id")
+
+	before, err := archives.Get(id)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	a, err := archives.Extend(id, body.Expires)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	publish(r, "archive.extend", id, map[string]interface{}{"expires": before.Expires}, map[string]interface{}{"expires": a.Expires})
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+// postArchiveRestore recreates a terminated account from its archive, undoing the
+// termination
+func postArchiveRestore(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	u, err := archives.Restore(id)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	publish(r, "archive.restore", u.ID, nil, map[string]string{"archive": id, "username": u.Username})
+
+	writeJSON(w, http.StatusCreated, u.Public())
+}
+
+// deleteArchive purges the archive of a terminated account before it expires
+func deleteArchive(w http.ResponseWriter, r *http.Request) {
+	a, err := archives.Purge(r.PathValue("id"))
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	publish(r, "archive.purge", a.ID, a, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeArchiveError writes the response for an error managing archives
+func writeArchiveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, archives.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, archives.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
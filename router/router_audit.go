@@ -0,0 +1,97 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/audit"
+)
+
+// auditFilter builds an audit log filter from the query string of the request
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+
+	f := audit.Filter{
+		Actor:    q.Get("actor"),
+		Action:   q.Get("action"),
+		Resource: q.Get("resource"),
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// getAudit returns the audit log entries matching the query string filters
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := audit.Query(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getAuditExport downloads the audit log entries matching the query string filters as
+// either JSON lines or CSV
+func getAuditExport(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := audit.Query(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		audit.ExportCSV(w, entries)
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		audit.ExportJSONLines(w, entries)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be one of jsonl or csv")
+	}
+}
+
+// getAuditVerify checks the hash chain of the entire audit log
+func getAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if err := audit.Verify(); err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"valid": false, "error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"valid": true})
+}
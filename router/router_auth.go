@@ -0,0 +1,247 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/bruteforce"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// loginRequest is the request body for logging in
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// The device ID returned from a previous login on this device
+	DeviceID string `json:"device_id"`
+}
+
+// postLogin exchanges a username and password for a session token
+func postLogin(w http.ResponseWriter, r *http.Request) {
+	var body loginRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	res, err := auth.Login(body.Username, body.Password, remoteIP(r), r.UserAgent(), body.DeviceID)
+	writeLogin(w, r, res, err)
+}
+
+// challengeRequest is the request body for completing a login challenge with a code
+type challengeRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+
+	// The assertion returned from navigator.credentials.get when using a security key
+	Credential json.RawMessage `json:"credential"`
+}
+
+// postLoginTOTP completes a login challenge with a code from an authenticator app
+func postLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var body challengeRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	res, err := auth.VerifyTOTP(body.Challenge, body.Code)
+	writeLogin(w, r, res, err)
+}
+
+// postLoginRecovery completes a login challenge with a recovery code
+func postLoginRecovery(w http.ResponseWriter, r *http.Request) {
+	var body challengeRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	res, err := auth.VerifyRecoveryCode(body.Challenge, body.Code)
+	writeLogin(w, r, res, err)
+}
+
+// postLoginKeyBegin returns the options for completing a login challenge with a security
+// key
+func postLoginKeyBegin(w http.ResponseWriter, r *http.Request) {
+	var body challengeRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	assertion, err := auth.BeginKeyLogin(body.Challenge)
+	if err != nil {
+		writeLogin(w, r, auth.LoginResult{}, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+// postLoginKeyFinish completes a login challenge with the assertion from a security key,
+// for both second factor and passkey logins
+func postLoginKeyFinish(w http.ResponseWriter, r *http.Request) {
+	var body challengeRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	res, err := auth.FinishKeyLogin(body.Challenge, body.Credential)
+	writeLogin(w, r, res, err)
+}
+
+// postLoginPasskey starts a login without a username or password. The response holds a
+// challenge and the options for navigator.credentials.get, and the login is completed
+// through postLoginKeyFinish
+func postLoginPasskey(w http.ResponseWriter, r *http.Request) {
+	var body loginRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	token, assertion, err := auth.BeginPasskeyLogin(remoteIP(r), r.UserAgent(), body.DeviceID)
+	if err != nil {
+		writeLogin(w, r, auth.LoginResult{}, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"challenge": token, "options": assertion})
+}
+
+// ssoRequest is the request body for starting a login at the identity provider
+type ssoRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// postLoginSSO starts a login at the identity provider. The client sends the user to the
+// returned URL, and the provider sends them back to the callback route
+func postLoginSSO(w http.ResponseWriter, r *http.Request) {
+	var body ssoRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	u, err := auth.BeginSSO(remoteIP(r), r.UserAgent(), body.DeviceID)
+	if err != nil {
+		writeLogin(w, r, auth.LoginResult{}, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"url": u})
+}
+
+// getLoginSSOCallback completes a login when the identity provider sends the user back
+func getLoginSSOCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		writeError(w, http.StatusUnauthorized, "the identity provider refused the login: "+e+" "+q.Get("error_description"))
+		return
+	}
+
+	res, err := auth.FinishSSO(q.Get("state"), q.Get("code"))
+	writeLogin(w, r, res, err)
+}
+
+// writeLogin writes the result of a login step, counting failures towards brute force
+// protection
+func writeLogin(w http.ResponseWriter, r *http.Request, res auth.LoginResult, err error) {
+	// The role is only known once the login completes, so the role's allowlist and any
+	// maintenance window are checked here and the new session ended if either applies
+	if err == nil && res.Token != "" {
+		if aerr := access.Check(remoteIP(r), res.User.Role); aerr != nil {
+			auth.Logout(res.Token)
+			writeAccessError(w, r, aerr)
+			return
+		}
+	}
+
+	if err == nil {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrInvalidCode):
+		bruteforce.Failure("panel", remoteIP(r))
+		writeError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, auth.ErrLocked):
+		bruteforce.Failure("panel", remoteIP(r))
+		writeError(w, http.StatusLocked, err.Error())
+	case errors.Is(err, auth.ErrInvalidChallenge), errors.Is(err, auth.ErrKeyNotFound), errors.Is(err, auth.ErrInvalidToken):
+		writeError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, auth.ErrSSORequired), errors.Is(err, auth.ErrSSONoRole), errors.Is(err, auth.ErrSuspended):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, auth.ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, auth.ErrWebAuthnDisabled), errors.Is(err, auth.ErrSSODisabled):
+		writeError(w, http.StatusNotImplemented, err.Error())
+	case errors.As(err, new(*protocol.Error)):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// postLogout ends the session used to make the request
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err := auth.Logout(token); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// meResponse is the logged in user, along with who is acting as them so that clients can
+// show a banner for the whole of an impersonation session
+type meResponse struct {
+	auth.User
+	Impersonator string `json:"impersonator,omitempty"`
+
+	// The brand the UI is shown in for the user, and the language
+	Brand  branding.Brand `json:"brand"`
+	Locale string         `json:"locale"`
+}
+
+// getMe returns the logged in user along with the devices they have logged in from
+func getMe(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+
+	u, err := auth.GetUser(id.UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meResponse{
+		User:         u.Public(),
+		Impersonator: id.Impersonator,
+		Brand:        branding.Resolve(u.Reseller()).Public(),
+		Locale:       id.Language,
+	})
+}
+
+// deleteDevice forgets one of the logged in user's devices, so that the next login from
+// it triggers a new device alert
+func deleteDevice(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	_, err := auth.UpdateUser(requestIdentity(r).UserID, func(u *auth.User) error {
+		if !u.ForgetDevice(id) {
+			return errors.New("device not found")
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	publish(r, "auth.device.delete", id, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/backups"
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+)
+
+// getBackups returns the backups made by this server, newest first, optionally only
+// those of the account in the username query parameter
+func getBackups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, backups.List(r.URL.Query().Get("username")))
+}
+
+// backupRequest is the request body for backing up accounts
+type backupRequest struct {
+	// The account to back up, every account when empty
+	Username string `json:"username"`
+}
+
+// postBackup backs up an account, or every account, in the background
+func postBackup(w http.ResponseWriter, r *http.Request) {
+	var body backupRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	j, err := backups.Queue(body.Username, actor(r))
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+
+	publish(r, "backup.queue", body.Username, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// postBackupRestore recreates an account from one of the backups of this server
+func postBackupRestore(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	u, err := backups.Restore(id)
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+
+	publish(r, "backup.restore", u.ID, nil, map[string]string{"backup": id, "username": u.Username})
+
+	writeJSON(w, http.StatusCreated, u.Public())
+}
+
+// getClusterBackups returns the backups of every node of the cluster, newest first,
+// optionally only those of accounts matching the username query parameter or of the
+// node in the node query parameter
+func getClusterBackups(w http.ResponseWriter, r *http.Request) {
+	list, err := backups.Catalog(r.URL.Query().Get("username"), r.URL.Query().Get("node"))
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postClusterBackupsRefresh asks every node for its catalog, returning the nodes that
+// did not answer
+func postClusterBackupsRefresh(w http.ResponseWriter, r *http.Request) {
+	failed, err := backups.Refresh(r.Context(), actor(r))
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"failed": failed})
+}
+
+// postClusterBackupRestore restores a backup of one node onto any node of the cluster.
+// The restore runs as a background job, which is returned so that it can be followed
+func postClusterBackupRestore(w http.ResponseWriter, r *http.Request) {
+	var body backups.RestoreRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	j, err := backups.StartRestore(body, actor(r))
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+
+	publish(r, "backup.restore.start", body.Backup, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// writeBackupError writes the response for an error managing backups
+func writeBackupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, backups.ErrNotFound), errors.Is(err, cluster.ErrNodeNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, cluster.ErrNotController), errors.Is(err, auth.ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, backups.ErrNotConfigured), errors.Is(err, jobs.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,137 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+)
+
+// getBranding returns the brand of the hostname the panel was reached at, so that the
+// UI can show it on the login page. It does not require authentication
+func getBranding(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, branding.ForHost(r.Host).Public())
+}
+
+// getResellerBranding returns the brand a reseller has set
+func getResellerBranding(w http.ResponseWriter, r *http.Request) {
+	id, ok := managedReseller(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := branding.Get(id)
+	if err != nil {
+		writeBrandingError(w, err)
+		return
+	}
+
+	setETag(w, etag(b))
+	writeJSON(w, http.StatusOK, b)
+}
+
+// putResellerBranding sets the brand of a reseller's accounts, replacing the one they had
+func putResellerBranding(w http.ResponseWriter, r *http.Request) {
+	id, ok := managedReseller(w, r)
+	if !ok {
+		return
+	}
+
+	var body branding.Brand
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, err := branding.Get(id)
+	var tag string
+	if err == nil {
+		tag = etag(before)
+	}
+
+	if !preconditions(w, r, tag) {
+		return
+	}
+
+	b, err := branding.Set(id, body)
+	if err != nil {
+		writeBrandingError(w, err)
+		return
+	}
+
+	if tag == "" {
+		publish(r, "branding.set", id, nil, b)
+	} else {
+		publish(r, "branding.set", id, before, b)
+	}
+
+	setETag(w, etag(b))
+	writeJSON(w, http.StatusOK, b)
+}
+
+// deleteResellerBranding removes the brand of a reseller, whose accounts then see the
+// panel's own
+func deleteResellerBranding(w http.ResponseWriter, r *http.Request) {
+	id, ok := managedReseller(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := branding.Get(id)
+	if err != nil {
+		writeBrandingError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	if err := branding.Delete(id); err != nil {
+		writeBrandingError(w, err)
+		return
+	}
+
+	publish(r, "branding.delete", id, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// managedReseller returns the reseller whose brand or notifications the request is for,
+// writing an error unless it names a reseller that the caller is, or is an admin
+func managedReseller(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	caller := requestIdentity(r)
+
+	if caller.Role != auth.RoleAdmin && (caller.Role != auth.RoleReseller || caller.UserID != id) {
+		writeError(w, http.StatusForbidden, "only admins and the reseller can manage a reseller's brand and notifications")
+		return "", false
+	}
+
+	u, err := auth.GetUser(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return "", false
+	}
+
+	if u.Role != auth.RoleReseller {
+		writeError(w, http.StatusUnprocessableEntity, u.Username+" is not a reseller")
+		return "", false
+	}
+
+	return id, true
+}
+
+// writeBrandingError writes the response for a brand that could not be read or changed
+func writeBrandingError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, branding.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, branding.ErrHostnameTaken):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, branding.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
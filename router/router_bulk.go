@@ -0,0 +1,111 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+)
+
+// bulkRequest is the request body for starting a mass operation
+type bulkRequest struct {
+	Type  string      `json:"type"`
+	Items []bulk.Item `json:"items"`
+
+	// The number of items processed at the same time, the configured default when zero
+	Concurrency int `json:"concurrency"`
+
+	// The payload of the items without their own
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Rolls the operation out to canary accounts first and then in waves
+	Rollout *bulk.Rollout `json:"rollout,omitempty"`
+}
+
+// getBulkOperations returns the mass operations, newest first, without their items
+func getBulkOperations(w http.ResponseWriter, r *http.Request) {
+	list, err := bulk.List()
+	if err != nil {
+		writeBulkError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postBulkOperation starts a mass operation on the items in the body, or on everything
+// the type can be run on without them
+func postBulkOperation(w http.ResponseWriter, r *http.Request) {
+	var body bulkRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	op, err := bulk.Start(body.Type, body.Items, bulk.Options{Concurrency: body.Concurrency, Rollout: body.Rollout, Payload: body.Payload, Actor: actor(r)})
+	if err != nil {
+		writeBulkError(w, err)
+		return
+	}
+
+	publish(r, "bulk.start", op.ID, nil, map[string]interface{}{"type": op.Type, "total": op.Total, "concurrency": op.Concurrency, "rollout": op.Rollout})
+
+	writeJSON(w, http.StatusAccepted, op)
+}
+
+// getBulkOperation returns the progress of a mass operation and the state of each item
+func getBulkOperation(w http.ResponseWriter, r *http.Request) {
+	op, err := bulk.Get(r.PathValue("id"))
+	if err != nil {
+		writeBulkError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, op)
+}
+
+// postBulkRetry processes the items of a finished mass operation that failed or were not
+// processed again
+func postBulkRetry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	op, err := bulk.Retry(id, actor(r))
+	if err != nil {
+		writeBulkError(w, err)
+		return
+	}
+
+	publish(r, "bulk.retry", id, nil, map[string]interface{}{"type": op.Type, "pending": op.Pending})
+
+	writeJSON(w, http.StatusAccepted, op)
+}
+
+// postBulkCancel stops a mass operation, leaving the items it has not finished pending
+func postBulkCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	op, err := bulk.Cancel(id)
+	if err != nil {
+		writeBulkError(w, err)
+		return
+	}
+
+	publish(r, "bulk.cancel", id, nil, map[string]interface{}{"type": op.Type, "pending": op.Pending})
+
+	writeJSON(w, http.StatusOK, op)
+}
+
+// writeBulkError writes the response for an error managing a mass operation
+func writeBulkError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, bulk.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, bulk.ErrRunning), errors.Is(err, bulk.ErrFinished):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, bulk.ErrNotConfigured), errors.Is(err, jobs.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,200 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/cdn"
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// getCDNSites returns the hosts fronted by a CDN within the domains the caller manages
+func getCDNSites(w http.ResponseWriter, r *http.Request) {
+	domains, err := managedDomainNames(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var list []cdn.Site
+	if domains == nil || len(domains) > 0 {
+		list, err = cdn.List(domains...)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sites := []cdn.Site{}
+	for _, s := range list {
+		sites = append(sites, s.Redacted())
+	}
+
+	writeJSON(w, http.StatusOK, sites)
+}
+
+// getCDNSite returns the CDN a host is fronted by
+func getCDNSite(w http.ResponseWriter, r *http.Request) {
+	host, ok := managedHost(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := cdn.Get(host)
+	if err != nil {
+		writeCDNError(w, err)
+		return
+	}
+
+	setETag(w, etag(s.Redacted()))
+	writeJSON(w, http.StatusOK, s.Redacted())
+}
+
+// putCDNSite fronts a host by the CDN in the body, or moves it to another
+func putCDNSite(w http.ResponseWriter, r *http.Request) {
+	var body cdn.Site
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	host, ok := managedHost(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := cdn.Get(host)
+	if err != nil && !errors.Is(err, cdn.ErrNotFound) {
+		writeCDNError(w, err)
+		return
+	}
+
+	var previous interface{}
+	if err == nil {
+		if !preconditions(w, r, etag(before.Redacted())) {
+			return
+		}
+		previous = before.Redacted()
+	}
+
+	body.Host = host
+	s, err := cdn.Enable(body)
+	if err != nil {
+		writeCDNError(w, err)
+		return
+	}
+
+	publish(r, "cdn.enable", s.Host, previous, s.Redacted())
+
+	setETag(w, etag(s.Redacted()))
+	writeJSON(w, http.StatusOK, s.Redacted())
+}
+
+// deleteCDNSite stops fronting a host by its CDN
+func deleteCDNSite(w http.ResponseWriter, r *http.Request) {
+	host, ok := managedHost(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := cdn.Get(host)
+	if err != nil {
+		writeCDNError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before.Redacted())) {
+		return
+	}
+
+	if _, err := cdn.Disable(host); err != nil {
+		writeCDNError(w, err)
+		return
+	}
+
+	publish(r, "cdn.disable", before.Host, before.Redacted(), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postCDNPurge drops what the CDN cached for a host, which deployments call once they
+// change the site
+func postCDNPurge(w http.ResponseWriter, r *http.Request) {
+	host, ok := managedHost(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := cdn.Purge(host)
+	if err != nil {
+		writeCDNError(w, err)
+		return
+	}
+
+	publish(r, "cdn.purge", s.Host, nil, nil)
+
+	writeJSON(w, http.StatusOK, s.Redacted())
+}
+
+// managedDomainNames returns the names of the domains the caller manages, or nil for
+// admins who manage every domain
+func managedDomainNames(r *http.Request) ([]string, error) {
+	owners := domainOwners(r)
+	if owners == nil {
+		return nil, nil
+	}
+
+	list, err := registrar.List(owners...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, d := range list {
+		names = append(names, d.Name)
+	}
+
+	return names, nil
+}
+
+// managedHost returns the host of the request, writing an error unless it is within a
+// domain the caller manages. Hosts of others are reported as not found
+func managedHost(w http.ResponseWriter, r *http.Request) (string, bool) {
+	host := r.PathValue("host")
+
+	domains, err := managedDomainNames(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+
+	if domains == nil {
+		return host, true
+	}
+
+	for _, d := range domains {
+		if cdn.Within(host, d) {
+			return host, true
+		}
+	}
+
+	writeCDNError(w, cdn.ErrNotFound)
+	return "", false
+}
+
+// writeCDNError writes the response for a host that could not be fronted by a CDN or
+// purged
+func writeCDNError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cdn.ErrNotFound), errors.Is(err, externaldns.ErrNoProvider):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, cdn.ErrNoPurge), errors.Is(err, externaldns.ErrUnsupported):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, cdn.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, cdn.ErrFailed), errors.Is(err, externaldns.ErrFailed):
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
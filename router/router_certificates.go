@@ -0,0 +1,76 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cosmicpanel/CosmicPanel/certificates"
+)
+
+// getCertificates returns the certificates the server presents for the domains the
+// caller manages, or every certificate found for admins, soonest to expire first
+func getCertificates(w http.ResponseWriter, r *http.Request) {
+	list, err := certificates.List(domainOwners(r)...)
+	if err != nil {
+		writeCertificatesError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postCertificatesScan reads the certificates without waiting for the scheduler, such
+// as after installing a renewed one
+func postCertificatesScan(w http.ResponseWriter, r *http.Request) {
+	list, err := certificates.Scan()
+	if err != nil {
+		writeCertificatesError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getCertificatesCalendar returns the certificates of getCertificates grouped by the day
+// they expire on, those expiring within ?days= days when given, as JSON or with
+// ?format=ics as iCalendar
+func getCertificatesCalendar(w http.ResponseWriter, r *http.Request) {
+	days := 0
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		if days, err = strconv.Atoi(v); err != nil || days < 0 {
+			writeError(w, http.StatusBadRequest, "days must be a number of days")
+			return
+		}
+	}
+
+	calendar, err := certificates.Calendar(days, domainOwners(r)...)
+	if err != nil {
+		writeCertificatesError(w, err)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, calendar)
+	case "ics":
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="certificates.ics"`)
+		certificates.ExportICS(w, calendar)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be one of json or ics")
+	}
+}
+
+// writeCertificatesError writes the response for certificates that could not be read
+func writeCertificatesError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, certificates.ErrScanning):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, certificates.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
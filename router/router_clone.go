@@ -0,0 +1,127 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+)
+
+// postUserClone copies the hosting account as a new account, with its files if asked.
+// The copy runs as a background job, which is returned so that it can be followed
+func postUserClone(w http.ResponseWriter, r *http.Request) {
+	var body transfer.CloneRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	body.Source, body.Template = u.Username, ""
+
+	j, err := transfer.Clone(body, actor(r))
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	body.Password = ""
+	publish(r, "account.clone.start", u.ID, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// getAccountTemplates returns the templates accounts can be created from, sorted by name
+func getAccountTemplates(w http.ResponseWriter, r *http.Request) {
+	list, err := transfer.ListTemplates()
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getAccountTemplate returns a template
+func getAccountTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := transfer.GetTemplate(r.PathValue("name"))
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+// postAccountTemplate saves a hosting account as a template in the background
+func postAccountTemplate(w http.ResponseWriter, r *http.Request) {
+	var body transfer.TemplateRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	j, err := transfer.SaveTemplate(body, actor(r))
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	publish(r, "account.template.start", body.Name, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// deleteAccountTemplate removes a template
+func deleteAccountTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := transfer.DeleteTemplate(r.PathValue("name"))
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	publish(r, "account.template.delete", t.Name, t, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postAccountTemplateAccount creates an account from a template in the background
+func postAccountTemplateAccount(w http.ResponseWriter, r *http.Request) {
+	var body transfer.CloneRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	body.Source, body.Template = "", r.PathValue("name")
+
+	j, err := transfer.Clone(body, actor(r))
+	if err != nil {
+		writeCloneError(w, err)
+		return
+	}
+
+	body.Password = ""
+	publish(r, "account.clone.start", body.Template, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// writeCloneError writes the response for an error cloning accounts or managing
+// templates
+func writeCloneError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, transfer.ErrTemplateNotFound), errors.Is(err, auth.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, transfer.ErrTemplateExists), errors.Is(err, auth.ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, transfer.ErrNotConfigured), errors.Is(err, jobs.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,270 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+)
+
+// clusterState is the response body for the cluster route
+type clusterState struct {
+	Role  string         `json:"role"`
+	Nodes []cluster.Node `json:"nodes,omitempty"`
+}
+
+// getCluster returns the role of this server in the cluster, and the nodes that have
+// joined it on a controller
+func getCluster(w http.ResponseWriter, r *http.Request) {
+	state := clusterState{Role: cluster.Role()}
+
+	if state.Role == cluster.Controller {
+		nodes, err := cluster.Nodes()
+		if err != nil {
+			writeClusterError(w, err)
+			return
+		}
+		state.Nodes = nodes
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
+
+// getNode returns a node with its last status report
+func getNode(w http.ResponseWriter, r *http.Request) {
+	n, err := cluster.GetNode(r.PathValue("id"))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	setETag(w, etag(nodeSettings(n)))
+	writeJSON(w, http.StatusOK, n)
+}
+
+// putNode changes the tags and capacity new accounts are placed on a node by, and whether
+// the node is the standby controller
+func putNode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	before, err := cluster.GetNode(id)
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(nodeSettings(before))) {
+		return
+	}
+
+	var body cluster.NodeSettings
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	n, err := cluster.UpdateNode(id, body)
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "cluster.node.update", id, nodeSettings(before), nodeSettings(n))
+
+	setETag(w, etag(nodeSettings(n)))
+	writeJSON(w, http.StatusOK, n)
+}
+
+// nodeSettings returns the settings of the node, which are also what its entity tag
+// covers rather than its heartbeat and status
+func nodeSettings(n cluster.Node) cluster.NodeSettings {
+	return cluster.NodeSettings{Tags: n.Tags, MaxAccounts: n.MaxAccounts, Draining: n.Draining, Standby: n.Standby}
+}
+
+// postPlacement picks the node a new account should be created on, listing every node
+// considered along with why it was or was not chosen
+func postPlacement(w http.ResponseWriter, r *http.Request) {
+	var body cluster.PlacementRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	p, err := cluster.Place(body)
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// postPromote has this standby take over as the controller of the cluster
+func postPromote(w http.ResponseWriter, r *http.Request) {
+	if err := cluster.Promote(); err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "cluster.promote", cluster.Identity(), cluster.Standby, cluster.Controller)
+
+	writeJSON(w, http.StatusOK, clusterState{Role: cluster.Role()})
+}
+
+// deleteNode removes a node from the cluster, revoking its certificate
+func deleteNode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	n, err := cluster.GetNode(id)
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(nodeSettings(n))) {
+		return
+	}
+
+	if err := cluster.RemoveNode(id); err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "cluster.node.remove", id, n, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// joinToken is the request and response body for the join token route
+type joinToken struct {
+	// Hours the token can be used for, a day by default
+	TTL int `json:"ttl,omitempty"`
+
+	Token   string    `json:"token,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// postJoinToken creates a single use token an agent can join the cluster with
+func postJoinToken(w http.ResponseWriter, r *http.Request) {
+	body := joinToken{TTL: 24}
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	if body.TTL <= 0 {
+		writeError(w, http.StatusUnprocessableEntity, "ttl must be a positive number of hours")
+		return
+	}
+
+	token, expires, err := cluster.CreateToken(time.Duration(body.TTL) * time.Hour)
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "cluster.token.create", "", nil, map[string]interface{}{"expires": expires})
+
+	writeJSON(w, http.StatusCreated, joinToken{Token: token, Expires: expires})
+}
+
+// nodeCommand is the request body for sending a command to a node
+type nodeCommand struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// postNodeCommand queues a provisioning command for a node. The node carries it out the
+// next time it polls the controller, so the command is returned before it has run
+func postNodeCommand(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var body nodeCommand
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	cmd, err := cluster.Send(id, body.Type, body.Payload, actor(r))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	// The payload may hold credentials such as the password of a user to create
+	publish(r, "cluster.command.send", cmd.ID, nil, map[string]interface{}{"node": id, "type": cmd.Type})
+
+	writeJSON(w, http.StatusAccepted, cmd)
+}
+
+// getNodeCommands returns the commands sent to a node, newest first
+func getNodeCommands(w http.ResponseWriter, r *http.Request) {
+	list, err := cluster.Commands(r.PathValue("id"))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getCommand returns a command along with its result once the node has carried it out
+func getCommand(w http.ResponseWriter, r *http.Request) {
+	cmd, err := cluster.GetCommand(r.PathValue("id"))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// postNodeSync sends the shared settings of the controller to a node, correcting any
+// drift from them
+func postNodeSync(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	list, err := cluster.Sync(id, actor(r))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "cluster.node.sync", id, nil, map[string]interface{}{"commands": len(list)})
+
+	writeJSON(w, http.StatusAccepted, list)
+}
+
+// postTransfer starts moving an account from one node to another. The transfer runs as
+// a background job, which is returned so that it can be followed
+func postTransfer(w http.ResponseWriter, r *http.Request) {
+	var body transfer.Request
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	j, err := transfer.Start(body, actor(r))
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	publish(r, "account.transfer.start", body.Username, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// writeClusterError writes the response for an error managing the cluster
+func writeClusterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cluster.ErrNodeNotFound), errors.Is(err, cluster.ErrCommandNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, cluster.ErrNotController), errors.Is(err, cluster.ErrNoCapacity),
+		errors.Is(err, cluster.ErrNotStandby):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, transfer.ErrNotConfigured), errors.Is(err, jobs.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
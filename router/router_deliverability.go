@@ -0,0 +1,102 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/deliverability"
+)
+
+// getDeliverability returns the last check of every domain the caller manages
+func getDeliverability(w http.ResponseWriter, r *http.Request) {
+	list, err := deliverability.List(domainOwners(r)...)
+	if err != nil {
+		writeDeliverabilityError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getDomainDeliverability returns the last check of a domain the caller manages
+func getDomainDeliverability(w http.ResponseWriter, r *http.Request) {
+	d, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := deliverability.Get(d.Name)
+	if err != nil {
+		writeDeliverabilityError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// postDeliverabilityCheck checks a domain the caller manages now, such as after fixing
+// its DNS records
+func postDeliverabilityCheck(w http.ResponseWriter, r *http.Request) {
+	d, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := deliverability.Recheck(d.Name)
+	if err != nil {
+		writeDeliverabilityError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// getDMARCReports returns the DMARC aggregate reports kept about a domain the caller
+// manages, newest first
+func getDMARCReports(w http.ResponseWriter, r *http.Request) {
+	d, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := deliverability.Reports(d.Name)
+	if err != nil {
+		writeDeliverabilityError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postDMARCReports ingests the DMARC aggregate reports in the request body, which is a
+// report as XML, gzip or zip or a message with reports attached
+func postDMARCReports(w http.ResponseWriter, r *http.Request) {
+	list, err := deliverability.Ingest(r.Body)
+	if err != nil {
+		writeDeliverabilityError(w, err)
+		return
+	}
+
+	ids := []string{}
+	for _, rep := range list {
+		ids = append(ids, rep.ID)
+	}
+	publish(r, "deliverability.reports", "", nil, map[string]interface{}{"reports": ids})
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// writeDeliverabilityError writes the response for a deliverability check or report that
+// failed
+func writeDeliverabilityError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, deliverability.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, deliverability.ErrInvalidReport):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, deliverability.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,224 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/propagation"
+)
+
+// getDNSProviders returns the configured DNS providers and the zones they are limited to
+func getDNSProviders(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, externaldns.Providers())
+}
+
+// getDNSRecords returns the record sets of a zone at the provider serving it
+func getDNSRecords(w http.ResponseWriter, r *http.Request) {
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := externaldns.Records(zone)
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// putDNSRecords replaces the records of a type at a name of a zone with the values in
+// the body. The name is relative to the zone, with @ for the zone itself
+func putDNSRecords(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TTL    int      `json:"ttl"`
+		Values []string `json:"values"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := recordName(r, zone)
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	rs, err := externaldns.Set(externaldns.RecordSet{
+		Name:   name,
+		Type:   r.PathValue("type"),
+		TTL:    body.TTL,
+		Values: body.Values,
+	})
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	publish(r, "dns.record.set", rs.Name, nil, rs)
+
+	writeJSON(w, http.StatusOK, rs)
+}
+
+// deleteDNSRecords removes the records of a type at a name of a zone
+func deleteDNSRecords(w http.ResponseWriter, r *http.Request) {
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := recordName(r, zone)
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	typ := strings.ToUpper(r.PathValue("type"))
+	if err := externaldns.Delete(name, typ); err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	publish(r, "dns.record.delete", name, map[string]string{"name": name, "type": typ}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDNSPropagation returns the last changes of the records of a zone and how far each
+// has propagated, the latest first
+func getDNSPropagation(w http.ResponseWriter, r *http.Request) {
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := propagation.List(zone)
+	if err != nil {
+		writePropagationError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getDNSRecordPropagation returns how far the last change of the records of a type at a
+// name has propagated, with what every resolver and nameserver answered
+func getDNSRecordPropagation(w http.ResponseWriter, r *http.Request) {
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := recordName(r, zone)
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	c, err := propagation.Get(name, r.PathValue("type"))
+	if err != nil {
+		writePropagationError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+// postDNSRecordPropagation starts checking the records of a type at a name again against
+// what the provider serving the zone has
+func postDNSRecordPropagation(w http.ResponseWriter, r *http.Request) {
+	zone, ok := managedZone(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := recordName(r, zone)
+	if err != nil {
+		writeDNSError(w, err)
+		return
+	}
+
+	c, err := propagation.Recheck(name, r.PathValue("type"), actor(r))
+	if err != nil {
+		writePropagationError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, c)
+}
+
+// managedZone returns the zone of the request, writing an error unless the caller may
+// manage it. Admins manage every zone, and others the zones of the domains they manage
+func managedZone(w http.ResponseWriter, r *http.Request) (string, bool) {
+	zone := strings.ToLower(strings.TrimSuffix(r.PathValue("zone"), "."))
+
+	domains, err := managedDomainNames(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+
+	if domains == nil || slices.Contains(domains, zone) {
+		return zone, true
+	}
+
+	writeDNSError(w, externaldns.ErrNoProvider)
+	return "", false
+}
+
+// recordName returns the name of the request in the zone, which is given relative to it.
+// A name within a zone of its own below the zone, which may be another customer's, is
+// not found
+func recordName(r *http.Request, zone string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(r.PathValue("name"), "."))
+	if name == "@" || name == zone {
+		return zone, nil
+	}
+
+	name = strings.TrimSuffix(name, "."+zone) + "." + zone
+
+	if z, err := externaldns.Lookup(name); err == nil && z.Name != zone {
+		return "", fmt.Errorf("%w: %s", externaldns.ErrNoProvider, name)
+	}
+
+	return name, nil
+}
+
+// writeDNSError writes the response for records that could not be read or published
+func writeDNSError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, externaldns.ErrNoProvider):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, externaldns.ErrFailed):
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
+
+// writePropagationError writes the response for changes whose propagation could not be
+// checked
+func writePropagationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, propagation.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, propagation.ErrUnsupported):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, propagation.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, externaldns.ErrNoProvider), errors.Is(err, externaldns.ErrFailed):
+		writeDNSError(w, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
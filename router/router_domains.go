@@ -0,0 +1,288 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// getDomainAvailability returns whether the domain in ?name= can be registered
+func getDomainAvailability(w http.ResponseWriter, r *http.Request) {
+	if !orderer(w, r) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+
+	available, err := registrar.Available(name)
+	if err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "available": available})
+}
+
+// getDomains returns the domains registered through the panel the caller manages: every
+// domain for admins, their own and their accounts' for resellers, and their own for
+// users
+func getDomains(w http.ResponseWriter, r *http.Request) {
+	list, err := registrar.List(domainOwners(r)...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getDomain returns a domain registered through the panel
+func getDomain(w http.ResponseWriter, r *http.Request) {
+	d, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusOK, d)
+}
+
+// postDomain registers a domain for its owner, the caller unless another is named
+func postDomain(w http.ResponseWriter, r *http.Request) {
+	order(w, r, "domain.register", registrar.Register)
+}
+
+// postDomainTransfer requests the transfer of a domain from its current registrar for
+// its owner, which completes once the current registrar lets it go
+func postDomainTransfer(w http.ResponseWriter, r *http.Request) {
+	order(w, r, "domain.transfer_request", registrar.Transfer)
+}
+
+// order places the order in the body for its owner with the function, publishing the
+// event type
+func order(w http.ResponseWriter, r *http.Request, typ string, place func(registrar.Order) (registrar.Domain, error)) {
+	if !orderer(w, r) {
+		return
+	}
+
+	var body registrar.Order
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if body.Owner == "" {
+		body.Owner = requestIdentity(r).UserID
+	}
+
+	if _, err := auth.GetUser(body.Owner); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "the domain needs an existing owner")
+		return
+	}
+
+	if owners := domainOwners(r); owners != nil && !slices.Contains(owners, body.Owner) {
+		writeError(w, http.StatusForbidden, "you can only order domains for yourself and your accounts")
+		return
+	}
+
+	d, err := place(body)
+	if err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	publish(r, typ, d.Name, nil, d)
+
+	w.Header().Set("Location", "/api/v1/domains/"+d.Name)
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// postDomainRenew extends the registration of a domain by the years in the body, or the
+// configured period
+func postDomainRenew(w http.ResponseWriter, r *http.Request) {
+	if !orderer(w, r) {
+		return
+	}
+
+	var body struct {
+		Years int `json:"years"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := registrar.Renew(before.Name, body.Years)
+	if err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	publish(r, "domain.renew", d.Name, before, d)
+
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusOK, d)
+}
+
+// putDomainAutoRenew sets whether a domain is renewed before it expires
+func putDomainAutoRenew(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		AutoRenew bool `json:"auto_renew"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	changeDomain(w, r, "domain.auto_renew", func(name string) (registrar.Domain, error) {
+		return registrar.Update(name, body.AutoRenew)
+	})
+}
+
+// putDomainNameservers delegates a domain to the nameservers in the body, or to the
+// configured ones when there are none
+func putDomainNameservers(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Nameservers []string `json:"nameservers"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	changeDomain(w, r, "domain.nameservers", func(name string) (registrar.Domain, error) {
+		return registrar.SetNameservers(name, body.Nameservers)
+	})
+}
+
+// putDomainDS replaces the DS records a domain publishes for DNSSEC, turning it off when
+// there are none
+func putDomainDS(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Records []registrar.DS `json:"records"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	changeDomain(w, r, "domain.ds", func(name string) (registrar.Domain, error) {
+		return registrar.SetDS(name, body.Records)
+	})
+}
+
+// changeDomain changes the domain of the request with the function if its preconditions
+// hold, publishing the event type
+func changeDomain(w http.ResponseWriter, r *http.Request, typ string, change func(name string) (registrar.Domain, error)) {
+	before, ok := managedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	d, err := change(before.Name)
+	if err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	publish(r, typ, d.Name, before, d)
+
+	setETag(w, etag(d))
+	writeJSON(w, http.StatusOK, d)
+}
+
+// deleteDomain stops managing a domain in the panel. It stays registered at the
+// registrar until it expires
+func deleteDomain(w http.ResponseWriter, r *http.Request) {
+	before, err := registrar.Get(r.PathValue("name"))
+	if err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	if err := registrar.Forget(before.Name); err != nil {
+		writeRegistrarError(w, err)
+		return
+	}
+
+	publish(r, "domain.delete", before.Name, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// domainOwners returns the users whose domains the caller manages, or nil for admins who
+// manage every domain
+func domainOwners(r *http.Request) []string {
+	caller := requestIdentity(r)
+
+	switch caller.Role {
+	case auth.RoleAdmin:
+		return nil
+	case auth.RoleReseller:
+		owners := []string{caller.UserID}
+		for _, u := range auth.Users() {
+			if u.Owner == caller.UserID {
+				owners = append(owners, u.ID)
+			}
+		}
+		return owners
+	default:
+		return []string{caller.UserID}
+	}
+}
+
+// managedDomain returns the domain of the request, writing an error if the caller does
+// not manage it. Domains of others are reported as not found
+func managedDomain(w http.ResponseWriter, r *http.Request) (registrar.Domain, bool) {
+	d, err := registrar.Get(r.PathValue("name"))
+	if owners := domainOwners(r); err == nil && owners != nil && !slices.Contains(owners, d.Owner) {
+		err = registrar.ErrNotFound
+	}
+	if err != nil {
+		writeRegistrarError(w, err)
+		return registrar.Domain{}, false
+	}
+
+	return d, true
+}
+
+// orderer writes an error unless the caller may place orders that are charged to the
+// panel's account at the registrar, which only admins and resellers may
+func orderer(w http.ResponseWriter, r *http.Request) bool {
+	switch requestIdentity(r).Role {
+	case auth.RoleAdmin, auth.RoleReseller:
+		return true
+	default:
+		writeError(w, http.StatusForbidden, "only admins and resellers can register, transfer and renew domains")
+		return false
+	}
+}
+
+// writeRegistrarError writes the response for a domain that could not be ordered or
+// changed
+func writeRegistrarError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, registrar.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, registrar.ErrExists), errors.Is(err, registrar.ErrUnavailable):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, registrar.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, registrar.ErrFailed):
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/fairuse"
+)
+
+// getFairUse returns the CPU time every account used recently and whether it is
+// throttled, busiest first
+func getFairUse(w http.ResponseWriter, r *http.Request) {
+	list, err := fairuse.Usages()
+	if err != nil {
+		writeFairUseError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getThrottles returns the accounts throttled by fair use policies
+func getThrottles(w http.ResponseWriter, r *http.Request) {
+	list, err := fairuse.List()
+	if err != nil {
+		writeFairUseError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// deleteThrottle lifts the throttle of an account before it expires
+func deleteThrottle(w http.ResponseWriter, r *http.Request) {
+	t, err := fairuse.Lift(r.PathValue("account"))
+	if err != nil {
+		writeFairUseError(w, err)
+		return
+	}
+
+	publish(r, "fairuse.release", t.Account, t, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeFairUseError writes the response for fair use enforcement that failed
+func writeFairUseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fairuse.ErrNotThrottled):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, fairuse.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/filetransfer"
+)
+
+// getFileTransfers returns what every account transferred over FTP and SFTP this month
+func getFileTransfers(w http.ResponseWriter, r *http.Request) {
+	list, err := filetransfer.Usages()
+	if err != nil {
+		writeFileTransferError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getFileTransfer returns what an account transferred over FTP and SFTP this month, its
+// quota and whether it is blocked
+func getFileTransfer(w http.ResponseWriter, r *http.Request) {
+	usage, err := filetransfer.GetUsage(r.PathValue("account"))
+	if err != nil {
+		writeFileTransferError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// writeFileTransferError writes the response for file transfer usage that could not be
+// read
+func writeFileTransferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filetransfer.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, filetransfer.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+)
+
+// getFirewall returns the firewall backend in use and every rule managed by the panel
+func getFirewall(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"backend": firewall.BackendName(),
+		"rules":   firewall.Rules(),
+	})
+}
+
+// postFirewallRule adds a rule. Temporary rules are created by setting expires
+func postFirewallRule(w http.ResponseWriter, r *http.Request) {
+	var rule firewall.Rule
+	if !readJSON(w, r, &rule) {
+		return
+	}
+
+	rule.Owner = "admin"
+
+	rule, err := firewall.Add(rule)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "firewall.rule.create", rule.ID, nil, rule)
+
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// deleteFirewallRule removes a rule
+func deleteFirewallRule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if err := firewall.Remove(id); err != nil {
+		if errors.Is(err, firewall.ErrRuleNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+		} else {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	publish(r, "firewall.rule.delete", id, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
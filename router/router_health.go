@@ -0,0 +1,34 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/boot"
+)
+
+// health is the response body for the health route
+type health struct {
+	Status   string   `json:"status"`
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// getHealth reports whether every module of the daemon started. It does not require a
+// token so that monitoring can poll it, and only names the degraded modules since why
+// they failed is for admins. A degraded daemon still serves the API, so this is not an
+// error status
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	h := health{Status: "ok"}
+
+	for _, s := range boot.Degraded() {
+		h.Status = "degraded"
+		h.Degraded = append(h.Degraded, s.Name)
+	}
+
+	writeJSON(w, http.StatusOK, h)
+}
+
+// getModules returns how starting every module of the daemon went, including why the
+// degraded ones did not start
+func getModules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, boot.Modules())
+}
@@ -0,0 +1,33 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/inventory"
+)
+
+// getInventory returns the servers, accounts and domains as an Ansible dynamic inventory,
+// limited to what the caller may see. Admins get every server and account, resellers the
+// accounts they own and users their own account. Hosts are limited with ?group=
+func getInventory(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+
+	scope := inventory.Scope{Group: r.URL.Query().Get("group")}
+	switch id.Role {
+	case auth.RoleAdmin:
+		scope.Servers = true
+	case auth.RoleReseller:
+		scope.Account = func(u auth.User) bool { return u.ID == id.UserID || u.Owner == id.UserID }
+	default:
+		scope.Account = func(u auth.User) bool { return u.ID == id.UserID }
+	}
+
+	inv, err := inventory.Build(scope)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, inv)
+}
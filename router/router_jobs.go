@@ -0,0 +1,66 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+)
+
+// getJobs returns the background jobs, filtered by the state and type query parameters
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jobs.List(r.URL.Query().Get("state"), r.URL.Query().Get("type")))
+}
+
+// getJob returns a single background job
+func getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := jobs.Get(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, j)
+}
+
+// postJobRetry queues a failed or cancelled job again
+func postJobRetry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	j, err := jobs.Retry(id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	publish(r, "job.retry", id, nil, j)
+
+	writeJSON(w, http.StatusOK, j)
+}
+
+// postJobCancel cancels a queued or running job
+func postJobCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	j, err := jobs.Cancel(id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	publish(r, "job.cancel", id, nil, j)
+
+	writeJSON(w, http.StatusOK, j)
+}
+
+// writeJobError writes the response for an error managing a job
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, jobs.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusConflict, err.Error())
+	}
+}
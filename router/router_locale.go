@@ -0,0 +1,102 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+)
+
+// localizedWriter carries the language the messages of a response are written in
+type localizedWriter struct {
+	http.ResponseWriter
+	language string
+}
+
+// Unwrap returns the writer being localized, for http.ResponseController
+func (w *localizedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Localize picks the language of the response from the browser's Accept-Language and
+// then the brand of the hostname the panel was reached at. Once a request is
+// authenticated the language the user chose comes first
+func Localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &localizedWriter{ResponseWriter: w, language: requestLanguage(r, "", branding.ForHost(r.Host))}
+
+		next.ServeHTTP(lw, r)
+	})
+}
+
+// requestLanguage returns the language of the request for a user who chose the language
+// and sees the brand: theirs, their browser's, their brand's, and then the panel's
+func requestLanguage(r *http.Request, chosen string, b branding.Brand) string {
+	preferred := append([]string{chosen}, locale.AcceptLanguage(r.Header.Get("Accept-Language"))...)
+
+	return locale.Match(append(preferred, b.Language)...)
+}
+
+// responseLanguage returns the language the response is written in
+func responseLanguage(w http.ResponseWriter) string {
+	if lw, ok := w.(*localizedWriter); ok {
+		return lw.language
+	}
+
+	return locale.English
+}
+
+// setResponseLanguage changes the language the response is written in
+func setResponseLanguage(w http.ResponseWriter, language string) {
+	if lw, ok := w.(*localizedWriter); ok {
+		lw.language = language
+	}
+}
+
+// getLocales returns the languages the panel speaks. It does not require authentication
+func getLocales(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, locale.Languages())
+}
+
+// getLocale returns the strings of the UI in a language, so that the UI can show the
+// login page in it. It does not require authentication
+func getLocale(w http.ResponseWriter, r *http.Request) {
+	strs, err := locale.UI(r.PathValue("language"))
+	if errors.Is(err, locale.ErrUnsupported) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, strs)
+}
+
+// putMyLanguage sets the language the logged in user reads the panel and their
+// notifications in, or clears it so that their browser's is used
+func putMyLanguage(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Language string `json:"language"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	id := requestIdentity(r)
+
+	before, err := auth.GetUser(id.UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	u, err := auth.SetLanguage(id.UserID, body.Language)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "user.language", u.ID, before.Public(), u.Public())
+
+	writeJSON(w, http.StatusOK, u.Public())
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/malware"
+	"go.uber.org/zap"
+)
+
+// getMalware returns the review queue of detections, filtered by the status query
+// parameter, along with recent scans
+func getMalware(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"running":    malware.Running(),
+		"detections": malware.Detections(r.URL.Query().Get("status")),
+		"scans":      malware.Scans(),
+	})
+}
+
+// postMalwareScan starts a full scan of the home directories in the background
+func postMalwareScan(w http.ResponseWriter, r *http.Request) {
+	if malware.Running() {
+		writeError(w, http.StatusConflict, malware.ErrScanRunning.Error())
+		return
+	}
+
+	crash.Go("malware", func() {
+		if _, err := malware.ScanHomes(); err != nil {
+			zap.S().Named("malware").Errorw("malware scan failed", zap.Error(err))
+		}
+	})
+
+	publish(r, "malware.scan.start", "", nil, nil)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// postMalwareRestore restores a detection as a false positive
+func postMalwareRestore(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	d, err := malware.Restore(id)
+	if err != nil {
+		writeMalwareError(w, err)
+		return
+	}
+
+	publish(r, "malware.restore", id, nil, d)
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// deleteMalware permanently deletes the infected file for a detection
+func deleteMalware(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	d, err := malware.Delete(id)
+	if err != nil {
+		writeMalwareError(w, err)
+		return
+	}
+
+	publish(r, "malware.delete", id, nil, d)
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// writeMalwareError writes the response for an error reviewing a detection
+func writeMalwareError(w http.ResponseWriter, err error) {
+	if errors.Is(err, malware.ErrDetectionNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeError(w, http.StatusConflict, err.Error())
+}
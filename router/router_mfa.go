@@ -0,0 +1,145 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+)
+
+// postTOTP starts enrolling an authenticator app for the logged in user
+func postTOTP(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := auth.BeginTOTP(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, enrollment)
+}
+
+// postTOTPConfirm enables the authenticator app being enrolled once the user enters a
+// code from it. Recovery codes are returned if this is the user's first second factor
+func postTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	codes, err := auth.ConfirmTOTP(requestIdentity(r).UserID, body.Code)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	publish(r, "auth.totp.enable", requestIdentity(r).UserID, nil, nil)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// deleteTOTP removes the logged in user's authenticator app
+func deleteTOTP(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.DisableTOTP(requestIdentity(r).UserID); err != nil {
+		writeSecondFactorError(w, err)
+		return
+	}
+
+	publish(r, "auth.totp.disable", requestIdentity(r).UserID, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postKeyBegin starts registering a security key for the logged in user, returning the
+// options for navigator.credentials.create
+func postKeyBegin(w http.ResponseWriter, r *http.Request) {
+	creation, err := auth.BeginKeyRegistration(requestIdentity(r).UserID)
+	if err != nil {
+		writeSecondFactorError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, creation)
+}
+
+// postKeyFinish registers the security key from the response to
+// navigator.credentials.create. Recovery codes are returned if this is the user's first
+// second factor
+func postKeyFinish(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	key, codes, err := auth.FinishKeyRegistration(requestIdentity(r).UserID, body.Name, body.Credential)
+	if err != nil {
+		writeSecondFactorError(w, err)
+		return
+	}
+
+	publish(r, "auth.key.create", key.ID, nil, key.Public())
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"key": key.Public(), "recovery_codes": codes})
+}
+
+// deleteKey removes one of the logged in user's security keys
+func deleteKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if _, err := auth.RemoveSecurityKey(requestIdentity(r).UserID, id); err != nil {
+		writeSecondFactorError(w, err)
+		return
+	}
+
+	publish(r, "auth.key.delete", id, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postRecoveryCodes replaces the logged in user's recovery codes with a new set
+func postRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := auth.GenerateRecoveryCodes(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	publish(r, "auth.recovery_codes.create", requestIdentity(r).UserID, nil, nil)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// deleteUserSecondFactors removes every second factor from a user who has lost access to
+// them, so they can enroll new ones on their next login
+func deleteUserSecondFactors(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	u, err := auth.ResetSecondFactors(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	publish(r, "user.second_factors.reset", id, nil, nil)
+
+	writeJSON(w, http.StatusOK, u.Public())
+}
+
+// writeSecondFactorError writes the response for an error from managing second factors
+func writeSecondFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound), errors.Is(err, auth.ErrKeyNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrSecondFactorRequired):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, auth.ErrWebAuthnDisabled):
+		writeError(w, http.StatusNotImplemented, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
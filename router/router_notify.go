@@ -0,0 +1,232 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/mailer"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+)
+
+// getNotificationKinds returns the notifications the panel sends, with their built in
+// templates and the fields they are executed with
+func getNotificationKinds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, notify.Kinds())
+}
+
+// getNotificationDeliveries returns the delivery log filtered by kind, status and
+// username. Admins see every delivery, resellers those to themselves and their accounts,
+// and users their own
+func getNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	f := notify.Filter{
+		Kind:     q.Get("kind"),
+		Username: q.Get("username"),
+		Status:   q.Get("status"),
+		Limit:    100,
+	}
+
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	caller := requestIdentity(r)
+	switch caller.Role {
+	case auth.RoleAdmin:
+	case auth.RoleReseller:
+		f.Reseller = caller.UserID
+	default:
+		u, err := auth.GetUser(caller.UserID)
+		if err != nil {
+			writeError(w, http.StatusForbidden, "only users can read their notifications")
+			return
+		}
+		f.Username = u.Username
+	}
+
+	list, err := notify.Deliveries(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getNotificationTemplate returns the panel's template overriding the built in one of
+// the kind
+func getNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	getTemplate(w, r, "")
+}
+
+// putNotificationTemplate overrides the built in template of the kind for every account
+// whose reseller has not overridden it
+func putNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	putTemplate(w, r, "")
+}
+
+// deleteNotificationTemplate removes the panel's template of the kind, restoring the
+// built in one
+func deleteNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	deleteTemplate(w, r, "")
+}
+
+// getResellerNotificationTemplate returns the template of the kind a reseller has set
+func getResellerNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	if id, ok := managedReseller(w, r); ok {
+		getTemplate(w, r, id)
+	}
+}
+
+// putResellerNotificationTemplate overrides the template of the kind for a reseller's
+// accounts
+func putResellerNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	if id, ok := managedReseller(w, r); ok {
+		putTemplate(w, r, id)
+	}
+}
+
+// deleteResellerNotificationTemplate removes the template of the kind a reseller has
+// set, so that their accounts get the panel's
+func deleteResellerNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	if id, ok := managedReseller(w, r); ok {
+		deleteTemplate(w, r, id)
+	}
+}
+
+// getTemplate writes the template of the kind in the path for the reseller, the
+// panel's own for an empty reseller
+func getTemplate(w http.ResponseWriter, r *http.Request, reseller string) {
+	t, err := notify.GetTemplate(reseller, r.PathValue("kind"))
+	if err != nil {
+		writeNotifyError(w, err)
+		return
+	}
+
+	setETag(w, etag(t))
+	writeJSON(w, http.StatusOK, t)
+}
+
+// putTemplate sets the template of the kind in the path for the reseller, the panel's
+// own for an empty reseller
+func putTemplate(w http.ResponseWriter, r *http.Request, reseller string) {
+	name := r.PathValue("kind")
+
+	var body notify.Template
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, err := notify.GetTemplate(reseller, name)
+	var tag string
+	if err == nil {
+		tag = etag(before)
+	} else if !errors.Is(err, notify.ErrNotFound) {
+		writeNotifyError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, tag) {
+		return
+	}
+
+	t, err := notify.SetTemplate(reseller, name, body)
+	if err != nil {
+		writeNotifyError(w, err)
+		return
+	}
+
+	if tag == "" {
+		publish(r, "notify.template.set", templateResource(reseller, name), nil, t)
+	} else {
+		publish(r, "notify.template.set", templateResource(reseller, name), before, t)
+	}
+
+	setETag(w, etag(t))
+	writeJSON(w, http.StatusOK, t)
+}
+
+// deleteTemplate removes the template of the kind in the path for the reseller, the
+// panel's own for an empty reseller
+func deleteTemplate(w http.ResponseWriter, r *http.Request, reseller string) {
+	name := r.PathValue("kind")
+
+	before, err := notify.GetTemplate(reseller, name)
+	if err != nil {
+		writeNotifyError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	if err := notify.DeleteTemplate(reseller, name); err != nil {
+		writeNotifyError(w, err)
+		return
+	}
+
+	publish(r, "notify.template.delete", templateResource(reseller, name), before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// templateResource returns the resource events about the template of the kind for the
+// reseller are published with
+func templateResource(reseller string, name string) string {
+	if reseller == "" {
+		return name
+	}
+
+	return reseller + "/" + name
+}
+
+// mailTest is the request body for sending a test email
+type mailTest struct {
+	To string `json:"to"`
+}
+
+// postMailTest emails a test message to check the relay, answering with how it left the
+// server, or why it did not
+func postMailTest(w http.ResponseWriter, r *http.Request) {
+	var body mailTest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	d, err := notify.Test(body.To)
+	switch {
+	case errors.Is(err, mailer.ErrInvalidAddress):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case errors.Is(err, notify.ErrNotConfigured), errors.Is(err, mailer.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	publish(r, "system.mail.test", body.To, nil, d)
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// writeNotifyError writes the response for a template that could not be read or changed
+func writeNotifyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, notify.ErrUnknownKind), errors.Is(err, notify.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, notify.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
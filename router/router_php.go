@@ -0,0 +1,188 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/cdn"
+	"github.com/cosmicpanel/CosmicPanel/php"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+)
+
+// getPHPLimits returns the php.ini settings accounts can override and the highest value
+// of each
+func getPHPLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, php.Limits())
+}
+
+// getPHPSettings returns the PHP settings of the domains the caller manages
+func getPHPSettings(w http.ResponseWriter, r *http.Request) {
+	domains, err := managedDomainNames(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list, err := php.List()
+	if err != nil {
+		writePHPError(w, err)
+		return
+	}
+
+	settings := []php.Settings{}
+	for _, s := range list {
+		if domains == nil || slices.ContainsFunc(domains, func(d string) bool { return cdn.Within(s.Domain, d) }) {
+			settings = append(settings, s)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// getPHPSetting returns the php.ini overrides and environment variables of a domain
+func getPHPSetting(w http.ResponseWriter, r *http.Request) {
+	domain, _, ok := phpDomain(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := php.Get(domain)
+	if err != nil {
+		writePHPError(w, err)
+		return
+	}
+
+	setETag(w, etag(s))
+	writeJSON(w, http.StatusOK, s)
+}
+
+// putPHPSetting replaces the PHP settings of a domain and renders them into its pool.
+// Admins name the account of domains not registered through the panel
+func putPHPSetting(w http.ResponseWriter, r *http.Request) {
+	var body php.Settings
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	domain, account, ok := phpDomain(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := php.Get(domain)
+	if err != nil && !errors.Is(err, php.ErrNotFound) {
+		writePHPError(w, err)
+		return
+	}
+
+	var previous interface{}
+	if err == nil {
+		if !preconditions(w, r, etag(before)) {
+			return
+		}
+		previous = before.Redacted()
+	}
+
+	body.Domain = domain
+	if account != "" {
+		body.Account = account
+	}
+
+	s, err := php.Set(body)
+	if err != nil {
+		writePHPError(w, err)
+		return
+	}
+
+	publish(r, "php.settings", s.Domain, previous, s.Redacted())
+
+	setETag(w, etag(s))
+	writeJSON(w, http.StatusOK, s)
+}
+
+// deletePHPSetting removes the PHP settings of a domain, leaving its pool as the server
+// defines it
+func deletePHPSetting(w http.ResponseWriter, r *http.Request) {
+	domain, _, ok := phpDomain(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := php.Get(domain)
+	if err != nil {
+		writePHPError(w, err)
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	if _, err := php.Reset(domain); err != nil {
+		writePHPError(w, err)
+		return
+	}
+
+	publish(r, "php.reset", before.Domain, before.Redacted(), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// phpDomain returns the domain of the request and the username of the account it belongs
+// to, writing an error unless it is within a domain the caller manages. The account is
+// empty for domains not registered through the panel, which only admins manage
+func phpDomain(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	host := r.PathValue("domain")
+
+	account, ok, err := hostAccount(r, host)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", "", false
+	} else if !ok {
+		writePHPError(w, php.ErrNotFound)
+		return "", "", false
+	}
+
+	return host, account, true
+}
+
+// hostAccount returns the username of the account the host belongs to, and false unless
+// it is within a domain the caller manages. Admins manage hosts not registered through
+// the panel too, which belong to no account
+func hostAccount(r *http.Request, host string) (string, bool, error) {
+	list, err := registrar.List(domainOwners(r)...)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, d := range list {
+		if !cdn.Within(host, d.Name) {
+			continue
+		}
+
+		u, err := auth.GetUser(d.Owner)
+		if err != nil {
+			return "", false, err
+		}
+
+		return u.Username, true, nil
+	}
+
+	return "", requestIdentity(r).Role == auth.RoleAdmin, nil
+}
+
+// writePHPError writes the response for PHP settings that could not be read or changed
+func writePHPError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, php.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, php.ErrNoPool):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, php.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
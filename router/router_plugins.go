@@ -0,0 +1,116 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/plugins"
+)
+
+// getPlugins returns the installed plugins, whether they are enabled and running and who
+// signed them
+func getPlugins(w http.ResponseWriter, r *http.Request) {
+	list, err := plugins.List()
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postPluginEnable verifies and starts a plugin, and starts it whenever the daemon does
+func postPluginEnable(w http.ResponseWriter, r *http.Request) {
+	p, err := plugins.Enable(r.PathValue("name"))
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+
+	publish(r, "plugin.enable", p.Name, nil, p)
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// postPluginDisable stops a plugin and keeps it from starting with the daemon
+func postPluginDisable(w http.ResponseWriter, r *http.Request) {
+	p, err := plugins.Disable(r.PathValue("name"))
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+
+	publish(r, "plugin.disable", p.Name, nil, p)
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// getPluginPanels returns the UI panels the running plugins show to the role of the
+// request
+func getPluginPanels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, plugins.Panels(requestIdentity(r).Role))
+}
+
+// pluginAPI forwards a request to the API of a running plugin. The panel authenticates
+// the request and passes who made it along in headers, so that the plugin never sees
+// the credentials
+func pluginAPI(w http.ResponseWriter, r *http.Request) {
+	proxy, err := plugins.Proxy(r.PathValue("name"))
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+
+	id := requestIdentity(r)
+
+	out := r.Clone(r.Context())
+	out.URL.Path = "/api/" + r.PathValue("path")
+	out.URL.RawPath = ""
+	out.Header.Del("Authorization")
+	out.Header.Del("Cookie")
+	out.Header.Set("X-CosmicPanel-Actor", id.Actor)
+	out.Header.Set("X-CosmicPanel-Role", id.Role)
+	out.Header.Set("X-CosmicPanel-User", id.UserID)
+	out.Header.Set("X-CosmicPanel-Impersonator", id.Impersonator)
+
+	proxy.ServeHTTP(w, out)
+}
+
+// postPluginJob queues a job of a type the plugin runs, with the request body as its
+// payload
+func postPluginJob(w http.ResponseWriter, r *http.Request) {
+	typ, err := plugins.JobType(r.PathValue("name"), r.PathValue("type"))
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+
+	var payload json.RawMessage
+	if r.ContentLength != 0 && !readJSON(w, r, &payload) {
+		return
+	}
+
+	j, err := jobs.Enqueue(typ, payload, jobs.Options{Actor: actor(r)})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/jobs/"+j.ID)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// writePluginError writes the response for a plugin that could not be managed or reached
+func writePluginError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, plugins.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, plugins.ErrNotConfigured), errors.Is(err, plugins.ErrNotRunning):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/privacy"
+)
+
+// getPrivacyExport returns the personal data the panel holds about the caller as a
+// download. Admins export any account, including terminated ones, and resellers their
+// own accounts
+func getPrivacyExport(w http.ResponseWriter, r *http.Request) {
+	caller := requestIdentity(r)
+
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		username = caller.Actor
+	}
+
+	if caller.Role != auth.RoleAdmin && username != caller.Actor {
+		owners := domainOwners(r)
+		if !slices.ContainsFunc(auth.Users(), func(u auth.User) bool {
+			return u.Username == username && slices.Contains(owners, u.ID)
+		}) {
+			writePrivacyError(w, privacy.ErrUnknownAccount)
+			return
+		}
+	}
+
+	x, err := privacy.Collect(username)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	publish(r, "privacy.export", x.UserID, nil, map[string]string{"username": x.Username})
+
+	w.Header().Set("Content-Disposition", `attachment; filename="personal-data-`+x.Username+`.json"`)
+	writeJSON(w, http.StatusOK, x)
+}
+
+// getErasures returns the erasures of terminated accounts and their certificates,
+// newest first
+func getErasures(w http.ResponseWriter, r *http.Request) {
+	list, err := privacy.List()
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	for i, e := range list {
+		list[i] = e.Public()
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getErasure returns an erasure, which is the certificate of deletion once the account
+// is erased
+func getErasure(w http.ResponseWriter, r *http.Request) {
+	e, err := privacy.Get(r.PathValue("id"))
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, e.Public())
+}
+
+// erasureRequest is the request body for erasing a terminated account
+type erasureRequest struct {
+	Username string `json:"username"`
+
+	// The username again, so that an account is not erased by mistake
+	Confirm string `json:"confirm"`
+	Reason  string `json:"reason"`
+}
+
+// postErasure queues the erasure of the personal data of a terminated account
+func postErasure(w http.ResponseWriter, r *http.Request) {
+	var body erasureRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	e, err := privacy.Request(body.Username, body.Confirm, body.Reason, actor(r))
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	publish(r, "privacy.erasure", e.ID, nil, e.Public())
+
+	writeJSON(w, http.StatusAccepted, e.Public())
+}
+
+// writePrivacyError writes the response for personal data that could not be exported or
+// erased
+func writePrivacyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, privacy.ErrNotFound), errors.Is(err, privacy.ErrUnknownAccount):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, privacy.ErrActive), errors.Is(err, privacy.ErrNothingToErase):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, privacy.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, privacy.ErrUnconfirmed):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/provisioning"
+)
+
+// packageRequest is the request body for moving an account to another package
+type packageRequest struct {
+	Package string `json:"package"`
+}
+
+// suspendRequest is the request body for suspending an account
+type suspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+// postProvisioningAccount queues the creation of a hosting account
+func postProvisioningAccount(w http.ResponseWriter, r *http.Request) {
+	var body provisioning.Request
+	if !readJSON(w, r, &body) {
+		return
+	}
+	body.Operation = provisioning.Create
+
+	submitProvisioning(w, r, body)
+}
+
+// getProvisioningAccount returns a hosting account, including whether it is suspended
+// and its package
+func getProvisioningAccount(w http.ResponseWriter, r *http.Request) {
+	u, err := provisioning.Account(r.PathValue("username"))
+	if err != nil {
+		writeProvisioningError(w, err)
+		return
+	}
+
+	setETag(w, userTag(u))
+	writeJSON(w, http.StatusOK, u)
+}
+
+// postProvisioningSuspend queues the suspension of a hosting account
+func postProvisioningSuspend(w http.ResponseWriter, r *http.Request) {
+	var body suspendRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	submitProvisioning(w, r, provisioning.Request{Operation: provisioning.Suspend, Username: r.PathValue("username"), Reason: body.Reason})
+}
+
+// postProvisioningUnsuspend queues lifting the suspension of a hosting account
+func postProvisioningUnsuspend(w http.ResponseWriter, r *http.Request) {
+	submitProvisioning(w, r, provisioning.Request{Operation: provisioning.Unsuspend, Username: r.PathValue("username")})
+}
+
+// putProvisioningPackage queues moving a hosting account to another package
+func putProvisioningPackage(w http.ResponseWriter, r *http.Request) {
+	var body packageRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	submitProvisioning(w, r, provisioning.Request{Operation: provisioning.ChangePackage, Username: r.PathValue("username"), Package: body.Package})
+}
+
+// deleteProvisioningAccount queues the termination of a hosting account
+func deleteProvisioningAccount(w http.ResponseWriter, r *http.Request) {
+	submitProvisioning(w, r, provisioning.Request{Operation: provisioning.Terminate, Username: r.PathValue("username")})
+}
+
+// getProvisioningUsage returns the disk and traffic a hosting account uses
+func getProvisioningUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := provisioning.GetUsage(r.PathValue("username"))
+	if err != nil {
+		writeProvisioningError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// submitProvisioning queues the operation and responds with its job, which the billing
+// system follows at the job's location. A request repeating the Idempotency-Key of an
+// earlier one gets the job of that request back
+func submitProvisioning(w http.ResponseWriter, r *http.Request, req provisioning.Request) {
+	var tag string
+	if u, err := provisioning.Account(req.Username); err == nil {
+		tag = userTag(u)
+	}
+
+	if !preconditions(w, r, tag) {
+		return
+	}
+
+	j, replayed, err := provisioning.Submit(r.Header.Get("Idempotency-Key"), req, actor(r))
+	if err != nil {
+		writeProvisioningError(w, err)
+		return
+	}
+
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+j.ID)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// writeProvisioningError writes the response for an operation that was not queued
+func writeProvisioningError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, provisioning.ErrAccountNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrUserExists), errors.Is(err, provisioning.ErrKeyReused):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, provisioning.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
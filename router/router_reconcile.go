@@ -0,0 +1,74 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// getReconcile reports the generated files that are missing, were edited by hand or are
+// no longer generated, without changing anything. Sources are limited with ?source=
+func getReconcile(w http.ResponseWriter, r *http.Request) {
+	report, err := reconcile.Check(r.URL.Query()["source"]...)
+	if err != nil {
+		writeReconcileError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// postReconcile converges the generated files that have drifted and responds with what
+// was found, even when drift is only reported on schedule. With dry_run it only reports
+// the drift
+func postReconcile(w http.ResponseWriter, r *http.Request) {
+	if dryRun(r) {
+		getReconcile(w, r)
+		return
+	}
+
+	report, err := reconcile.Converge(r.URL.Query()["source"]...)
+	if err != nil {
+		writeReconcileError(w, err)
+		return
+	}
+
+	publish(r, "system.reconcile", "", nil, report.Results)
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// getReconcileSnapshots returns the snapshots taken of generated files before they were
+// changed, newest first, which show the changes that were rolled back. The source is
+// limited with ?source=
+func getReconcileSnapshots(w http.ResponseWriter, r *http.Request) {
+	list, err := reconcile.Snapshots(r.URL.Query().Get("source"))
+	if err != nil {
+		writeReconcileError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getReconcileSnapshot returns a snapshot with the content the files had
+func getReconcileSnapshot(w http.ResponseWriter, r *http.Request) {
+	s, err := reconcile.GetSnapshot(r.PathValue("id"))
+	if err != nil {
+		writeReconcileError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
+
+// writeReconcileError writes the response for a reconciliation that could not run
+func writeReconcileError(w http.ResponseWriter, err error) {
+	if errors.Is(err, reconcile.ErrUnknownSource) || errors.Is(err, reconcile.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeError(w, http.StatusServiceUnavailable, err.Error())
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/cdn"
+	"github.com/cosmicpanel/CosmicPanel/redirects"
+)
+
+// getRedirects returns the redirects and short links of the domains the caller manages
+func getRedirects(w http.ResponseWriter, r *http.Request) {
+	domains, err := managedDomainNames(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list, err := redirects.List()
+	if err != nil {
+		writeRedirectError(w, err)
+		return
+	}
+
+	managed := []redirects.Redirect{}
+	for _, rd := range list {
+		if domains == nil || slices.ContainsFunc(domains, func(d string) bool { return cdn.Within(rd.Domain, d) }) {
+			managed = append(managed, rd)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, managed)
+}
+
+// getDomainRedirects returns the redirects and short links of a domain
+func getDomainRedirects(w http.ResponseWriter, r *http.Request) {
+	domain, _, ok := redirectDomain(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := redirects.List(domain)
+	if err != nil {
+		writeRedirectError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postRedirect adds a redirect to a domain, or a short link when it has no path
+func postRedirect(w http.ResponseWriter, r *http.Request) {
+	var body redirects.Redirect
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	domain, account, ok := redirectDomain(w, r)
+	if !ok {
+		return
+	}
+
+	body.Domain, body.Account = domain, account
+
+	rd, err := redirects.Create(body)
+	if err != nil {
+		writeRedirectError(w, err)
+		return
+	}
+
+	publish(r, "redirect.create", rd.Domain+rd.Path, nil, rd)
+
+	writeJSON(w, http.StatusCreated, rd)
+}
+
+// getRedirect returns a redirect of a domain with its hits
+func getRedirect(w http.ResponseWriter, r *http.Request) {
+	rd, ok := managedRedirect(w, r)
+	if !ok {
+		return
+	}
+
+	setETag(w, etag(rd))
+	writeJSON(w, http.StatusOK, rd)
+}
+
+// putRedirect changes the path, target or status code of a redirect
+func putRedirect(w http.ResponseWriter, r *http.Request) {
+	var body redirects.Redirect
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, ok := managedRedirect(w, r)
+	if !ok {
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	body.ID = before.ID
+
+	rd, err := redirects.Update(body)
+	if err != nil {
+		writeRedirectError(w, err)
+		return
+	}
+
+	publish(r, "redirect.update", rd.Domain+rd.Path, before, rd)
+
+	setETag(w, etag(rd))
+	writeJSON(w, http.StatusOK, rd)
+}
+
+// deleteRedirect removes a redirect from its domain
+func deleteRedirect(w http.ResponseWriter, r *http.Request) {
+	before, ok := managedRedirect(w, r)
+	if !ok {
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	if _, err := redirects.Delete(before.ID); err != nil {
+		writeRedirectError(w, err)
+		return
+	}
+
+	publish(r, "redirect.delete", before.Domain+before.Path, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirectDomain returns the domain of the request and the username of the account it
+// belongs to, writing an error unless it is within a domain the caller manages
+func redirectDomain(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	domain := r.PathValue("domain")
+
+	account, ok, err := hostAccount(r, domain)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", "", false
+	} else if !ok {
+		writeRedirectError(w, redirects.ErrNotFound)
+		return "", "", false
+	}
+
+	return domain, account, true
+}
+
+// managedRedirect returns the redirect of the request, writing an error unless it belongs
+// to the domain of the request and the caller manages it
+func managedRedirect(w http.ResponseWriter, r *http.Request) (redirects.Redirect, bool) {
+	domain, _, ok := redirectDomain(w, r)
+	if !ok {
+		return redirects.Redirect{}, false
+	}
+
+	rd, err := redirects.Get(r.PathValue("id"))
+	if err == nil && !strings.EqualFold(rd.Domain, strings.TrimSuffix(domain, ".")) {
+		err = redirects.ErrNotFound
+	}
+	if err != nil {
+		writeRedirectError(w, err)
+		return redirects.Redirect{}, false
+	}
+
+	return rd, true
+}
+
+// writeRedirectError writes the response for redirects that could not be read or changed
+func writeRedirectError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, redirects.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, redirects.ErrExists), errors.Is(err, redirects.ErrLimit), errors.Is(err, redirects.ErrRejected):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, redirects.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, redirects.ErrInvalid):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
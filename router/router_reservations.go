@@ -0,0 +1,54 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/reservations"
+)
+
+// getReservations returns what is reserved for every account with a reservation
+func getReservations(w http.ResponseWriter, r *http.Request) {
+	list, err := reservations.List()
+	if err != nil {
+		writeReservationsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getReservation returns what is reserved for an account
+func getReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := reservations.Get(r.PathValue("account"))
+	if err != nil {
+		writeReservationsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// postReservationsApply reserves what the packages of accounts guarantee without waiting
+// for the scheduler, such as after changing packages
+func postReservationsApply(w http.ResponseWriter, r *http.Request) {
+	list, err := reservations.Apply()
+	if err != nil {
+		writeReservationsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// writeReservationsError writes the response for reserving resources that failed
+func writeReservationsError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, reservations.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, reservations.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
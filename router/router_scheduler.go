@@ -0,0 +1,51 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/scheduler"
+)
+
+// getTasks returns the recurring maintenance tasks with when they last and next run
+func getTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, scheduler.Tasks())
+}
+
+// getTaskRuns returns the recent runs of a task with their exit codes and output, newest
+// first
+func getTaskRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := scheduler.History(r.PathValue("name"))
+	switch {
+	case errors.Is(err, scheduler.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// postTaskRun runs a maintenance task now in the background, regardless of its schedule
+func postTaskRun(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	t, err := scheduler.Trigger(name, actor(r))
+	switch {
+	case errors.Is(err, scheduler.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, scheduler.ErrRunning):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	publish(r, "scheduler.task.run", name, nil, nil)
+
+	writeJSON(w, http.StatusAccepted, t)
+}
@@ -0,0 +1,41 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/sdk"
+)
+
+// getOpenAPI returns the OpenAPI definition of the API of this version of the panel
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeClient(w, sdk.OpenAPI, "application/json", "openapi.json")
+}
+
+// getGoClient returns the source of a Go client of the API of this version of the panel
+func getGoClient(w http.ResponseWriter, r *http.Request) {
+	writeClient(w, sdk.Go, "text/x-go; charset=utf-8", "cosmicpanel.go")
+}
+
+// getTypeScriptClient returns the source of a TypeScript client of the API of this
+// version of the panel
+func getTypeScriptClient(w http.ResponseWriter, r *http.Request) {
+	writeClient(w, sdk.TypeScript, "text/plain; charset=utf-8", "cosmicpanel.ts")
+}
+
+// writeClient writes what the generator makes of the routes as a file to download
+func writeClient(w http.ResponseWriter, generate func([]sdk.Route, string) ([]byte, error), contentType string, filename string) {
+	version := buildinfo.Get().Version
+
+	data, err := generate(Routes(), version)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("X-Cosmicpanel-Version", version)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/advisor"
+	"github.com/cosmicpanel/CosmicPanel/bruteforce"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/tlspolicy"
+	"go.uber.org/zap"
+)
+
+// getBans returns every address currently banned by brute force protection
+func getBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, bruteforce.Bans())
+}
+
+// deleteBan lifts the ban on an address and resets its ban history
+func deleteBan(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+
+	if err := bruteforce.Unban(ip); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "security.bruteforce.unban", ip, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// whitelistEntry is the request body for adding to the whitelist
+type whitelistEntry struct {
+	Entry string `json:"entry"`
+}
+
+// getWhitelist returns the addresses that are never banned
+func getWhitelist(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, bruteforce.Whitelist())
+}
+
+// postWhitelist adds an address or CIDR range to the whitelist
+func postWhitelist(w http.ResponseWriter, r *http.Request) {
+	var body whitelistEntry
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if err := bruteforce.AddWhitelist(body.Entry); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "security.whitelist.create", body.Entry, nil, body)
+
+	writeJSON(w, http.StatusCreated, bruteforce.Whitelist())
+}
+
+// deleteWhitelist removes an address or CIDR range from the whitelist. CIDR ranges
+// contain a slash so the entry is matched against the rest of the path
+func deleteWhitelist(w http.ResponseWriter, r *http.Request) {
+	entry := r.PathValue("entry")
+
+	if err := bruteforce.RemoveWhitelist(entry); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "security.whitelist.delete", entry, whitelistEntry{Entry: entry}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAdvisor returns the report from the latest security advisor scan
+func getAdvisor(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"running": advisor.Running(),
+		"report":  advisor.Latest(),
+	})
+}
+
+// postAdvisorScan starts a security advisor scan in the background. Probing TLS ports
+// and walking document roots can take a while, so the report is fetched afterwards
+func postAdvisorScan(w http.ResponseWriter, r *http.Request) {
+	if advisor.Running() {
+		writeError(w, http.StatusConflict, advisor.ErrScanRunning.Error())
+		return
+	}
+
+	crash.Go("advisor", func() {
+		if _, err := advisor.Scan(); err != nil {
+			zap.S().Named("advisor").Errorw("security scan failed", zap.Error(err))
+		}
+	})
+
+	publish(r, "security.advisor.start", "", nil, nil)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getTLSPolicy returns the TLS policy and whether each service complies with it
+func getTLSPolicy(w http.ResponseWriter, r *http.Request) {
+	report, err := tlspolicy.Check()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// postTLSPolicyApply renders the TLS policy into every installed service and responds
+// with the compliance report afterwards, which shows any service that failed. With
+// dry_run it reports the files that would be written and services reloaded instead
+func postTLSPolicyApply(w http.ResponseWriter, r *http.Request) {
+	if dryRun(r) {
+		plan, err := tlspolicy.PlanApply()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+
+	before, _ := tlspolicy.Check()
+
+	if err := tlspolicy.Apply(); err != nil {
+		zap.S().Named("tlspolicy").Errorw("failed to apply tls policy", zap.Error(err))
+	}
+
+	after, err := tlspolicy.Check()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "security.tls.apply", "", before.Targets, after.Targets)
+
+	writeJSON(w, http.StatusOK, after)
+}
@@ -0,0 +1,214 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/sshx"
+)
+
+// getSSHKey returns the public key the panel logs in to servers with
+func getSSHKey(w http.ResponseWriter, r *http.Request) {
+	k, err := sshx.Key()
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, k)
+}
+
+// postSSHKey replaces the key of the panel with a new one
+func postSSHKey(w http.ResponseWriter, r *http.Request) {
+	before, err := sshx.Key()
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	k, err := sshx.RotateKey()
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	publish(r, "ssh.key.rotate", "", before, k)
+
+	writeJSON(w, http.StatusOK, k)
+}
+
+// getKnownHosts returns the servers with a pinned host key
+func getKnownHosts(w http.ResponseWriter, r *http.Request) {
+	list, err := sshx.Hosts()
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// hostRequest is the request body for scanning the host key of a server or pinning one
+type hostRequest struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// The key to pin in authorized_keys format, or the SHA256 fingerprint the key the
+	// server presents must have
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// postSSHScan returns the host key a server presents without trusting it
+func postSSHScan(w http.ResponseWriter, r *http.Request) {
+	var body hostRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if body.Port == 0 {
+		body.Port = 22
+	}
+
+	h, err := sshx.Scan(r.Context(), body.Host, body.Port)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h)
+}
+
+// postKnownHost pins the host key of a server
+func postKnownHost(w http.ResponseWriter, r *http.Request) {
+	var body hostRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if body.Port == 0 {
+		body.Port = 22
+	}
+
+	h, err := sshx.Pin(r.Context(), body.Host, body.Port, body.Key, body.Fingerprint, actor(r))
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	publish(r, "ssh.host.pin", h.Address, nil, h)
+
+	writeJSON(w, http.StatusOK, h)
+}
+
+// deleteKnownHost forgets the host key pinned for a server
+func deleteKnownHost(w http.ResponseWriter, r *http.Request) {
+	h, err := sshx.Forget(r.PathValue("address"))
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	publish(r, "ssh.host.forget", h.Address, h, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSSHDestinations returns the servers the panel connects to over SSH
+func getSSHDestinations(w http.ResponseWriter, r *http.Request) {
+	list, err := sshx.Destinations()
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getSSHDestination returns a destination without its credentials
+func getSSHDestination(w http.ResponseWriter, r *http.Request) {
+	d, err := sshx.Get(r.PathValue("name"))
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// destinationRequest is the request body for creating or changing a destination
+type destinationRequest struct {
+	sshx.Destination
+	sshx.Credentials
+}
+
+// putSSHDestination creates or replaces a destination
+func putSSHDestination(w http.ResponseWriter, r *http.Request) {
+	var body destinationRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	body.Name = r.PathValue("name")
+
+	before, err := sshx.Get(body.Name)
+	if err != nil && !errors.Is(err, sshx.ErrNotFound) {
+		writeSSHError(w, err)
+		return
+	}
+
+	d, err := sshx.Save(body.Destination, body.Credentials)
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	if before.Name == "" {
+		publish(r, "ssh.destination.create", d.Name, nil, d)
+	} else {
+		publish(r, "ssh.destination.update", d.Name, before, d)
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// deleteSSHDestination removes a destination and its credentials
+func deleteSSHDestination(w http.ResponseWriter, r *http.Request) {
+	d, err := sshx.Delete(r.PathValue("name"))
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	publish(r, "ssh.destination.delete", d.Name, d, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postSSHDestinationTest connects and logs in to a destination. A connection that fails
+// is reported in the result rather than as an error
+func postSSHDestinationTest(w http.ResponseWriter, r *http.Request) {
+	t, err := sshx.TestDestination(r.Context(), r.PathValue("name"))
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+// writeSSHError writes the response for an SSH key, known host or destination that could
+// not be used or changed
+func writeSSHError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sshx.ErrNotFound), errors.Is(err, sshx.ErrHostNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, sshx.ErrInvalidDestination), errors.Is(err, sshx.ErrInvalidHostKey):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, sshx.ErrFingerprintMismatch):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, sshx.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/stats"
+)
+
+// getStats returns every domain with web statistics and the months they cover
+func getStats(w http.ResponseWriter, r *http.Request) {
+	list, err := stats.Domains()
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getDomainStats returns the web statistics of a domain for the month in the month query
+// parameter, formatted as YYYY-MM, or for the current month
+func getDomainStats(w http.ResponseWriter, r *http.Request) {
+	report, err := stats.Get(r.PathValue("domain"), r.URL.Query().Get("month"))
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// getDomainErrors returns the digest of the errors of a domain on the date in the date
+// query parameter, formatted as YYYY-MM-DD, or today
+func getDomainErrors(w http.ResponseWriter, r *http.Request) {
+	d, err := stats.Errors(r.PathValue("domain"), r.URL.Query().Get("date"))
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// archiveResponse is how the raw access log of a domain is archived and the days that are
+type archiveResponse struct {
+	stats.ArchiveSettings
+	Archives []stats.Archive `json:"archives"`
+}
+
+// getDomainArchive returns the archive settings of a domain and the days of its raw
+// access log that are archived
+func getDomainArchive(w http.ResponseWriter, r *http.Request) {
+	domain := r.PathValue("domain")
+
+	s, err := stats.GetArchiveSettings(domain)
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	list, err := stats.Archives(domain)
+	if errors.Is(err, stats.ErrNotFound) {
+		list = []stats.Archive{}
+	} else if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, archiveResponse{ArchiveSettings: s, Archives: list})
+}
+
+// putDomainArchive changes how long the raw access log of a domain is archived for and
+// whether client addresses are anonymized
+func putDomainArchive(w http.ResponseWriter, r *http.Request) {
+	domain := r.PathValue("domain")
+
+	var body stats.ArchiveSettings
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, err := stats.GetArchiveSettings(domain)
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	if err := stats.SetArchiveSettings(domain, body); err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	publish(r, "stats.archive", domain, before, body)
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+// getDomainArchiveLog downloads the raw access log of a domain archived on the date,
+// formatted as YYYY-MM-DD, compressed with gzip. Every download is recorded, since access
+// to logs often has to be accounted for
+func getDomainArchiveLog(w http.ResponseWriter, r *http.Request) {
+	domain, date := r.PathValue("domain"), r.PathValue("date")
+
+	f, err := stats.OpenArchive(domain, date)
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	publish(r, "stats.archive.download", domain, nil, map[string]interface{}{"date": date, "size": info.Size()})
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+domain+"-"+date+`.log.gz"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// getDomainTraffic returns the HTTP and mail traffic of a domain
+func getDomainTraffic(w http.ResponseWriter, r *http.Request) {
+	writeTraffic(w, r, r.PathValue("domain"), stats.DomainTraffic)
+}
+
+// getAccountTraffic returns the HTTP, mail and FTP traffic of an account
+func getAccountTraffic(w http.ResponseWriter, r *http.Request) {
+	writeTraffic(w, r, r.PathValue("username"), stats.AccountTraffic)
+}
+
+// writeTraffic writes the traffic of the domain or account as JSON, or as CSV when the
+// format query parameter is csv. The interval query parameter is one of hour, day or
+// month, and the from and to query parameters limit the period in RFC 3339 or as dates
+func writeTraffic(w http.ResponseWriter, r *http.Request, name string, fn func(string, stats.Range) ([]stats.Point, error)) {
+	q := r.URL.Query()
+	rng := stats.Range{Interval: q.Get("interval")}
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &rng.From}, {"to", &rng.To}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				writeError(w, http.StatusBadRequest, p.name+" must be a date or a time in RFC 3339")
+				return
+			}
+		}
+		*p.t = t
+	}
+
+	points, err := fn(name, rng)
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	switch q.Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="traffic.csv"`)
+		stats.ExportCSV(w, points)
+	case "", "json":
+		writeJSON(w, http.StatusOK, points)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be one of json or csv")
+	}
+}
+
+// writeStatsError writes the response for an error reading web statistics
+func writeStatsError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, stats.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, stats.ErrInvalidMonth), errors.Is(err, stats.ErrInvalidDate), errors.Is(err, stats.ErrInvalidRange), errors.Is(err, stats.ErrInvalidRetention):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, stats.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,94 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/support"
+)
+
+// postSupportTicket forwards a ticket from the caller to the helpdesk with the context of
+// their account. A ticket the helpdesk did not take is returned with the error
+func postSupportTicket(w http.ResponseWriter, r *http.Request) {
+	var body support.Request
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	u, err := auth.GetUser(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusForbidden, "only users can open tickets")
+		return
+	}
+
+	t, err := support.Open(u, body)
+	if errors.Is(err, support.ErrFailed) {
+		writeJSON(w, http.StatusBadGateway, t)
+		return
+	}
+	if err != nil {
+		writeSupportError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// getSupportTickets returns the tickets opened by the caller, or every ticket for admins,
+// newest first
+func getSupportTickets(w http.ResponseWriter, r *http.Request) {
+	var users []string
+	if caller := requestIdentity(r); caller.Role != auth.RoleAdmin {
+		users = append(users, caller.UserID)
+	}
+
+	list, err := support.List(users...)
+	if err != nil {
+		writeSupportError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getSupportTicket returns a ticket with the context that was attached to it. Users can
+// only read their own tickets
+func getSupportTicket(w http.ResponseWriter, r *http.Request) {
+	t, err := support.Get(r.PathValue("id"))
+	if err != nil {
+		writeSupportError(w, err)
+		return
+	}
+
+	if caller := requestIdentity(r); caller.Role != auth.RoleAdmin && caller.UserID != t.User {
+		writeSupportError(w, support.ErrNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+// getSupportContext returns the context a ticket opened by the caller would carry, so the
+// UI can show it before the ticket is sent
+func getSupportContext(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(requestIdentity(r).UserID)
+	if err != nil {
+		writeError(w, http.StatusForbidden, "only users can open tickets")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": support.Enabled(), "context": support.Gather(u)})
+}
+
+// writeSupportError writes the response for an error opening or reading a ticket
+func writeSupportError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, support.ErrNotConfigured):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/cosmicpanel/CosmicPanel/boot"
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/diagnostics"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+)
+
+// systemInfo is the response body for the system info route
+type systemInfo struct {
+	buildinfo.Info
+	Hostname string `json:"hostname"`
+	Uptime   string `json:"uptime"`
+
+	// How long the daemon took to boot, module by module
+	Boot boot.Profile `json:"boot"`
+}
+
+// getSystemInfo returns exactly which build of the panel is running, for how long and how
+// long it took to start, which is the first thing support needs to know
+func getSystemInfo(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+
+	writeJSON(w, http.StatusOK, systemInfo{Info: buildinfo.Get(), Hostname: hostname, Uptime: diagnostics.CollectInfo().Uptime, Boot: boot.Report()})
+}
+
+// loggingLevel is the request and response body for the logging routes
+type loggingLevel struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// getLogging returns the level the daemon is currently logging at along with any
+// module level overrides
+func getLogging(w http.ResponseWriter, r *http.Request) {
+	writeLogging(w)
+}
+
+// putLogging changes the level the daemon logs at without restarting it. The change is
+// not persisted and the configured level is used again after a restart
+func putLogging(w http.ResponseWriter, r *http.Request) {
+	var body loggingLevel
+	if !readJSON(w, r, &body) || !preconditions(w, r, loggingTag()) {
+		return
+	}
+
+	before := loggingLevel{Level: logging.Level()}
+	if err := logging.SetLevel(body.Level); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "system.logging.update", "", before, loggingLevel{Level: logging.Level()})
+
+	writeLogging(w)
+}
+
+// putModuleLogging overrides the level for a single module such as dns or license
+func putModuleLogging(w http.ResponseWriter, r *http.Request) {
+	module := r.PathValue("module")
+
+	var body loggingLevel
+	if !readJSON(w, r, &body) || !preconditions(w, r, loggingTag()) {
+		return
+	}
+
+	before := logging.ModuleLevels()
+	if err := logging.SetModuleLevel(module, body.Level); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	publish(r, "system.logging.module.update", module, before, logging.ModuleLevels())
+
+	writeLogging(w)
+}
+
+// deleteModuleLogging removes the level override for a module so that it logs at the
+// global level again
+func deleteModuleLogging(w http.ResponseWriter, r *http.Request) {
+	module := r.PathValue("module")
+
+	if !preconditions(w, r, loggingTag()) {
+		return
+	}
+
+	before := logging.ModuleLevels()
+	logging.ClearModuleLevel(module)
+
+	publish(r, "system.logging.module.delete", module, before, logging.ModuleLevels())
+
+	writeLogging(w)
+}
+
+// writeLogging writes the level the daemon logs at and the module overrides, along with
+// their entity tag
+func writeLogging(w http.ResponseWriter) {
+	setETag(w, loggingTag())
+	writeJSON(w, http.StatusOK, loggingLevel{Level: logging.Level(), Modules: logging.ModuleLevels()})
+}
+
+// loggingTag returns the entity tag of the logging levels, which every logging route
+// changes
+func loggingTag() string {
+	return etag(loggingLevel{Level: logging.Level(), Modules: logging.ModuleLevels()})
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/updates"
+	"go.uber.org/zap"
+)
+
+// getUpdates returns the pending security updates and the history of update runs
+func getUpdates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, updates.Get())
+}
+
+// postUpdatesCheck refreshes the package metadata and returns the pending security
+// updates
+func postUpdatesCheck(w http.ResponseWriter, r *http.Request) {
+	if _, err := updates.Check(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updates.Get())
+}
+
+// postUpdatesApply starts applying the pending security updates in the background.
+// Package installs and service restarts can take minutes, so the run is fetched
+// afterwards. With dry_run it reports the packages that would be upgraded instead
+func postUpdatesApply(w http.ResponseWriter, r *http.Request) {
+	if dryRun(r) {
+		plan, err := updates.PlanApply()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+
+	if updates.Running() {
+		writeError(w, http.StatusConflict, updates.ErrRunning.Error())
+		return
+	}
+
+	crash.Go("updates", func() {
+		if _, err := updates.Apply("manual"); err != nil {
+			zap.S().Named("updates").Errorw("failed to apply security updates", zap.Error(err))
+		}
+	})
+
+	publish(r, "system.updates.apply", "", nil, nil)
+
+	w.WriteHeader(http.StatusAccepted)
+}
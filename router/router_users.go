@@ -0,0 +1,234 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/announcements"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"go.uber.org/zap"
+)
+
+// createUserRequest is the request body for creating a panel user
+type createUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Owner    string `json:"owner"`
+	Phone    string `json:"phone"`
+	Language string `json:"language"`
+	Password string `json:"password"`
+}
+
+// impersonateRequest is the request body for acting as a user
+type impersonateRequest struct {
+	Reason string `json:"reason"`
+}
+
+// getUsers returns every panel user
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	users := auth.Users()
+	for i := range users {
+		users[i] = users[i].Public()
+	}
+
+	writeJSON(w, http.StatusOK, users)
+}
+
+// getUser returns a panel user
+func getUser(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.GetUser(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	setETag(w, userTag(u))
+	writeJSON(w, http.StatusOK, u.Public())
+}
+
+// postUser creates a panel user and sends them the welcome notification with their
+// credentials. When the username is taken the response locates the user who has it, so
+// that a client retrying a create can adopt that user
+func postUser(w http.ResponseWriter, r *http.Request) {
+	var body createUserRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	u, err := auth.CreateUser(auth.User{Username: body.Username, Email: body.Email, Role: body.Role, Owner: body.Owner, Phone: body.Phone, Language: body.Language}, body.Password)
+	if err != nil {
+		if errors.Is(err, auth.ErrUserExists) {
+			for _, existing := range auth.Users() {
+				if existing.Username == strings.ToLower(strings.TrimSpace(body.Username)) {
+					w.Header().Set("Location", "/api/v1/users/"+existing.ID)
+				}
+			}
+			writeError(w, http.StatusConflict, err.Error())
+		} else {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+
+	publish(r, "user.create", u.ID, nil, u.Public())
+
+	// An account without an address can still be assigned one later
+	if addresses.AutoAssign() {
+		if a, err := addresses.AssignIPv6(u.Username); err != nil {
+			zap.S().Named("addresses").Warnw("failed to assign IPv6 prefix", "account", u.Username, zap.Error(err))
+		} else {
+			publish(r, "user.ipv6.assign", u.ID, nil, a)
+		}
+	}
+
+	crash.Go("notify", func() {
+		if err := auth.Notify(u, "welcome", map[string]interface{}{"Username": u.Username, "Password": body.Password}); err != nil {
+			zap.S().Named("notify").Warnw("failed to send welcome notification", "user", u.Username, zap.Error(err))
+		}
+	})
+
+	w.Header().Set("Location", "/api/v1/users/"+u.ID)
+	setETag(w, userTag(u))
+	writeJSON(w, http.StatusCreated, u.Public())
+}
+
+// deleteUser removes a panel user and ends their sessions. With dry_run it reports the
+// sessions that would be ended instead
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	u, err := auth.GetUser(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if !preconditions(w, r, userTag(u)) {
+		return
+	}
+
+	if dryRun(r) {
+		plan, err := auth.PlanDelete(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+
+	if err := auth.DeleteUser(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "user.delete", id, u.Public(), nil)
+
+	if u.Role == auth.RoleReseller {
+		if err := branding.Delete(id); err != nil && !errors.Is(err, branding.ErrNotFound) {
+			zap.S().Named("branding").Warnw("failed to remove brand of deleted reseller", "reseller", u.Username, zap.Error(err))
+		}
+
+		if err := notify.DeleteTemplates(id); err != nil {
+			zap.S().Named("notify").Warnw("failed to remove notification templates of deleted reseller", "reseller", u.Username, zap.Error(err))
+		}
+
+		if err := announcements.DeleteReseller(id); err != nil {
+			zap.S().Named("announcements").Warnw("failed to remove announcements of deleted reseller", "reseller", u.Username, zap.Error(err))
+		}
+	}
+
+	if a, err := addresses.IPv6(u.Username); err == nil {
+		if err := addresses.ReleaseIPv6(u.Username); err != nil {
+			zap.S().Named("addresses").Warnw("failed to release IPv6 prefix", "account", u.Username, zap.Error(err))
+		} else {
+			publish(r, "user.ipv6.release", id, a, nil)
+		}
+	}
+
+	released, err := addresses.ReleaseAccount(u.Username)
+	if err != nil {
+		zap.S().Named("addresses").Warnw("failed to release dedicated addresses", "account", u.Username, zap.Error(err))
+	}
+	for _, d := range released {
+		publish(r, "user.ip.release", d.Address.String(), d, nil)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postUserUnlock clears a lockout caused by too many failed logins
+func postUserUnlock(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	u, err := auth.Unlock(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	publish(r, "user.unlock", id, nil, nil)
+
+	writeJSON(w, http.StatusOK, u.Public())
+}
+
+// postImpersonate starts a time-boxed session as a user for an admin, or for the reseller
+// who owns the user, so that support can see what the customer sees without resetting
+// their password. The caller's own session is left untouched
+func postImpersonate(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+
+	var body impersonateRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	by := auth.Impersonator{UserID: id.UserID, Username: id.Actor, Role: id.Role, Reason: body.Reason}
+
+	res, err := auth.Impersonate(r.PathValue("id"), by, remoteIP(r), r.UserAgent())
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, auth.ErrImpersonationDenied):
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The session is refused if the user's role may not use the panel from this address
+	if aerr := access.Check(remoteIP(r), res.User.Role); aerr != nil {
+		auth.Logout(res.Token)
+		writeAccessError(w, r, aerr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// userTag returns the entity tag of a user, which covers what the API changes about them
+// but not their logins, lockouts or second factors
+func userTag(u auth.User) string {
+	return etag(struct {
+		ID            string
+		Username      string
+		Email         string
+		Phone         string
+		Language      string
+		Role          string
+		Owner         string
+		Package       string
+		Suspended     bool
+		SuspendReason string
+	}{u.ID, u.Username, u.Email, u.Phone, u.Language, u.Role, u.Owner, u.Package, u.Suspended, u.SuspendReason})
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cosmicpanel/CosmicPanel/vault"
+)
+
+// secretValue is the request body for storing a secret
+type secretValue struct {
+	Value string `json:"value"`
+}
+
+// getVault lists the secrets in the vault. Values are never returned by the API, they
+// are only read by the modules that use them
+func getVault(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, vault.List())
+}
+
+// putVaultSecret creates or replaces a secret. Names may contain slashes so the name is
+// matched against the rest of the path
+func putVaultSecret(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var body secretValue
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if err := vault.Set(name, body.Value); err != nil {
+		if errors.Is(err, vault.ErrInvalidName) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "vault.secret.update", name, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteVaultSecret removes a secret from the vault
+func deleteVaultSecret(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	if err := vault.Delete(name); err != nil {
+		if errors.Is(err, vault.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "vault.secret.delete", name, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postVaultRotate re-encrypts every secret with a new data key
+func postVaultRotate(w http.ResponseWriter, r *http.Request) {
+	if err := vault.Rotate(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publish(r, "vault.rotate", "", nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,285 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+	"github.com/cosmicpanel/CosmicPanel/provisioning"
+)
+
+// whmTimeout is how long a WHM call waits for the job carrying it out, since WHM answers
+// once the change is made
+const whmTimeout = time.Minute
+
+// whmMetadata is the metadata of a WHM API 1 response. Result is 1 when the call
+// succeeded and 0 when it failed, with the reason
+type whmMetadata struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+	Result  int    `json:"result"`
+	Reason  string `json:"reason"`
+}
+
+// whmResponse is a WHM API 1 response
+type whmResponse struct {
+	Metadata whmMetadata `json:"metadata"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// whmAccount is an account as listaccts and accountsummary describe it
+type whmAccount struct {
+	User          string `json:"user"`
+	Email         string `json:"email"`
+	Plan          string `json:"plan"`
+	Owner         string `json:"owner"`
+	Suspended     int    `json:"suspended"`
+	SuspendReason string `json:"suspendreason"`
+	StartDate     string `json:"startdate"`
+	UnixStartDate int64  `json:"unix_startdate"`
+}
+
+// whmFunction carries out a WHM API 1 function with the parameters of the request
+type whmFunction func(r *http.Request) (interface{}, error)
+
+// whmFunctions are the WHM API 1 functions translated onto the panel
+var whmFunctions = map[string]whmFunction{
+	"createacct":       whmCreateAccount,
+	"suspendacct":      whmSuspendAccount,
+	"unsuspendacct":    whmUnsuspendAccount,
+	"removeacct":       whmRemoveAccount,
+	"changepackage":    whmChangePackage,
+	"listaccts":        whmListAccounts,
+	"accountsummary":   whmAccountSummary,
+	"version":          whmVersion,
+	"dumpzone":         whmDumpZone,
+	"addzonerecord":    whmAddZoneRecord,
+	"editzonerecord":   whmEditZoneRecord,
+	"removezonerecord": whmRemoveZoneRecord,
+}
+
+// whmZoneFunctions are the WHM API 1 functions creating, removing and rewriting whole
+// zones. The panel publishes records to the DNS providers already serving zones, so they
+// fail with a reason saying so rather than as unknown functions
+var whmZoneFunctions = map[string]bool{
+	"adddns":             true,
+	"killdns":            true,
+	"listzones":          true,
+	"mass_edit_dns_zone": true,
+	"parse_dns_zone":     true,
+	"resetzone":          true,
+}
+
+// whmAPI answers a WHM API 1 call at /json-api/{function}, so that scripts written for
+// WHM keep working while accounts are migrated. Calls fail with a result of 0 and a
+// reason, as they do on WHM
+func whmAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("function")
+	res := whmResponse{Metadata: whmMetadata{Version: 1, Command: name, Result: 1, Reason: "OK"}}
+
+	fn, ok := whmFunctions[name]
+	var err error
+	switch {
+	case r.FormValue("api.version") != "1":
+		err = errors.New("only WHM API 1 is supported, call it with api.version=1")
+	case whmZoneFunctions[name]:
+		err = fmt.Errorf("CosmicPanel manages the records of zones at their DNS providers rather than the zones themselves, so %s is not available", name)
+	case !ok:
+		err = fmt.Errorf("unknown app (%q) requested for this version (1) of the API", name)
+	default:
+		res.Data, err = fn(r)
+	}
+
+	if err != nil {
+		res.Metadata.Result = 0
+		res.Metadata.Reason = logging.Redact(err.Error())
+		res.Data = nil
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// whmAuthorization accepts the whm user:token scheme of WHM API tokens as a bearer
+// token, so that scripts authenticate with the panel token or an admin session token
+// without changing how they send it
+func whmAuthorization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "whm") {
+			_, token, _ := strings.Cut(credentials, ":")
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// whmCreateAccount creates an account. The domain WHM requires is accepted and ignored
+func whmCreateAccount(r *http.Request) (interface{}, error) {
+	return whmSubmit(r, provisioning.Request{
+		Operation: provisioning.Create,
+		Username:  r.FormValue("username"),
+		Email:     r.FormValue("contactemail"),
+		Password:  r.FormValue("password"),
+		Owner:     r.FormValue("owner"),
+		Package:   r.FormValue("plan"),
+	})
+}
+
+// whmSuspendAccount suspends an account
+func whmSuspendAccount(r *http.Request) (interface{}, error) {
+	return whmSubmit(r, provisioning.Request{Operation: provisioning.Suspend, Username: r.FormValue("user"), Reason: r.FormValue("reason")})
+}
+
+// whmUnsuspendAccount lifts the suspension of an account
+func whmUnsuspendAccount(r *http.Request) (interface{}, error) {
+	return whmSubmit(r, provisioning.Request{Operation: provisioning.Unsuspend, Username: r.FormValue("user")})
+}
+
+// whmRemoveAccount terminates an account, which WHM names username or, in older
+// scripts, user
+func whmRemoveAccount(r *http.Request) (interface{}, error) {
+	username := r.FormValue("username")
+	if username == "" {
+		username = r.FormValue("user")
+	}
+
+	return whmSubmit(r, provisioning.Request{Operation: provisioning.Terminate, Username: username})
+}
+
+// whmChangePackage moves an account to another package
+func whmChangePackage(r *http.Request) (interface{}, error) {
+	return whmSubmit(r, provisioning.Request{Operation: provisioning.ChangePackage, Username: r.FormValue("user"), Package: r.FormValue("pkg")})
+}
+
+// whmSubmit queues the operation and waits for its job to finish
+func whmSubmit(r *http.Request, req provisioning.Request) (interface{}, error) {
+	j, _, err := provisioning.Submit(r.Header.Get("Idempotency-Key"), req, actor(r))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), whmTimeout)
+	defer cancel()
+
+	j, err = jobs.Wait(ctx, j.ID)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, fmt.Errorf("the operation has not finished yet, follow it at /api/v1/jobs/%s", j.ID)
+	case err != nil:
+		return nil, err
+	case j.State != jobs.Succeeded:
+		return nil, fmt.Errorf("job %s %s: %s", j.ID, j.State, j.Error)
+	}
+
+	return map[string]string{"job": j.ID}, nil
+}
+
+// whmListAccounts lists accounts, optionally searching by user, owner or package with
+// searchtype and search. Searches are regular expressions unless searchmethod is exact
+func whmListAccounts(r *http.Request) (interface{}, error) {
+	field := r.FormValue("searchtype")
+	search := r.FormValue("search")
+
+	match := func(string) bool { return true }
+	if search != "" {
+		if r.FormValue("searchmethod") == "exact" {
+			match = func(v string) bool { return v == search }
+		} else {
+			re, err := regexp.Compile(search)
+			if err != nil {
+				return nil, fmt.Errorf("invalid search: %w", err)
+			}
+			match = re.MatchString
+		}
+	}
+
+	accounts := []whmAccount{}
+	for _, a := range whmAccounts() {
+		var v string
+		switch field {
+		case "", "user":
+			v = a.User
+		case "owner":
+			v = a.Owner
+		case "package":
+			v = a.Plan
+		default:
+			return nil, fmt.Errorf("searching accounts by %s is not supported", field)
+		}
+
+		if match(v) {
+			accounts = append(accounts, a)
+		}
+	}
+
+	return map[string]interface{}{"acct": accounts}, nil
+}
+
+// whmAccountSummary describes the account named by user
+func whmAccountSummary(r *http.Request) (interface{}, error) {
+	for _, a := range whmAccounts() {
+		if a.User == strings.ToLower(r.FormValue("user")) {
+			return map[string]interface{}{"acct": []whmAccount{a}}, nil
+		}
+	}
+
+	return nil, provisioning.ErrAccountNotFound
+}
+
+// whmVersion returns the version of the panel
+func whmVersion(r *http.Request) (interface{}, error) {
+	return map[string]string{"version": buildinfo.Get().Version}, nil
+}
+
+// whmAccounts returns every hosting account as WHM describes it, ordered by username.
+// Accounts without a reseller are owned by root, as on WHM
+func whmAccounts() []whmAccount {
+	users := auth.Users()
+
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	var accounts []whmAccount
+	for _, u := range users {
+		if u.Role != auth.RoleUser {
+			continue
+		}
+
+		a := whmAccount{
+			User:          u.Username,
+			Email:         u.Email,
+			Plan:          u.Package,
+			Owner:         "root",
+			SuspendReason: "not suspended",
+			StartDate:     u.Created.Format("06 Jan 02 15:04"),
+			UnixStartDate: u.Created.Unix(),
+		}
+
+		if owner, ok := names[u.Owner]; ok {
+			a.Owner = owner
+		}
+
+		if u.Suspended {
+			a.Suspended = 1
+			a.SuspendReason = u.SuspendReason
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].User < accounts[j].User })
+
+	return accounts
+}
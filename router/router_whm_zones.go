@@ -0,0 +1,352 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+)
+
+// whmRecord is a record of a zone as dumpzone describes it. Line is its position in the
+// zone, which editzonerecord and removezonerecord name it by
+type whmRecord struct {
+	Line  int    `json:"Line"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   int    `json:"ttl"`
+
+	Address    string `json:"address,omitempty"`
+	CName      string `json:"cname,omitempty"`
+	Exchange   string `json:"exchange,omitempty"`
+	Preference *int   `json:"preference,omitempty"`
+	NSDName    string `json:"nsdname,omitempty"`
+	PTRDName   string `json:"ptrdname,omitempty"`
+	TXTData    string `json:"txtdata,omitempty"`
+
+	// The value as the DNS API has it, and the set it belongs to
+	value string
+	set   externaldns.RecordSet
+}
+
+// whmDumpZone lists the records of the zone named by domain, one for every value of the
+// record sets at the provider serving it
+func whmDumpZone(r *http.Request) (interface{}, error) {
+	_, records, err := whmZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"zone": []map[string]interface{}{{"record": records, "status": 1, "statusmsg": "Zone Serialized"}}}, nil
+}
+
+// whmAddZoneRecord adds a record to the zone named by domain, keeping the other records
+// of its name and type
+func whmAddZoneRecord(r *http.Request) (interface{}, error) {
+	zone, records, err := whmZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := whmRecordName(r.FormValue("name"), zone)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := strings.ToUpper(r.FormValue("type"))
+	value, err := whmRecordValue(r, typ, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := externaldns.RecordSet{Name: name, Type: typ}
+	for _, rec := range records {
+		if rec.set.Name == name && rec.set.Type == typ {
+			rs = rec.set
+			break
+		}
+	}
+
+	if slices.Contains(rs.Values, value) {
+		return nil, fmt.Errorf("%s already has the %s record %s", name, typ, value)
+	}
+	rs.Values = append(slices.Clone(rs.Values), value)
+
+	if rs.TTL, err = whmTTL(r, rs.TTL); err != nil {
+		return nil, err
+	}
+
+	return nil, whmSetRecords(r, rs)
+}
+
+// whmEditZoneRecord changes the record at line of the zone named by domain. Fields left
+// out keep the values of the record, and a changed name or type moves it to that set
+func whmEditZoneRecord(r *http.Request) (interface{}, error) {
+	zone, records, err := whmZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := whmLine(r, records)
+	if err != nil {
+		return nil, err
+	}
+
+	name := rec.set.Name
+	if r.FormValue("name") != "" {
+		if name, err = whmRecordName(r.FormValue("name"), zone); err != nil {
+			return nil, err
+		}
+	}
+
+	typ := rec.set.Type
+	if r.FormValue("type") != "" {
+		typ = strings.ToUpper(r.FormValue("type"))
+	}
+
+	previous := rec
+	if typ != rec.set.Type {
+		previous = nil
+	}
+	value, err := whmRecordValue(r, typ, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := whmTTL(r, rec.set.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The record is taken out of its set, which it is put back into with its new value
+	// unless its name or type changed
+	old := rec.set
+	old.Values = slices.DeleteFunc(slices.Clone(old.Values), func(v string) bool { return v == rec.value })
+
+	rs := externaldns.RecordSet{Name: name, Type: typ, TTL: ttl}
+	moved := name != old.Name || typ != old.Type
+	if !moved {
+		rs.Values = old.Values
+	} else {
+		for _, other := range records {
+			if other.set.Name == name && other.set.Type == typ {
+				rs.Values = slices.Clone(other.set.Values)
+				break
+			}
+		}
+	}
+
+	if slices.Contains(rs.Values, value) {
+		return nil, fmt.Errorf("%s already has the %s record %s", name, typ, value)
+	}
+	rs.Values = append(rs.Values, value)
+
+	if err := whmSetRecords(r, rs); err != nil {
+		return nil, err
+	}
+
+	// The record is only taken out of the set it moved from once it is in the other
+	if moved {
+		return nil, whmReplaceRecords(r, old)
+	}
+
+	return nil, nil
+}
+
+// whmRemoveZoneRecord removes the record at line of the zone named by domain, keeping the
+// other records of its name and type
+func whmRemoveZoneRecord(r *http.Request) (interface{}, error) {
+	_, records, err := whmZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := whmLine(r, records)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := rec.set
+	rs.Values = slices.DeleteFunc(slices.Clone(rs.Values), func(v string) bool { return v == rec.value })
+
+	return nil, whmReplaceRecords(r, rs)
+}
+
+// whmZone returns the zone named by domain with its records, numbered in the order they
+// are listed
+func whmZone(r *http.Request) (string, []*whmRecord, error) {
+	zone := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.FormValue("domain")), "."))
+	if zone == "" {
+		return "", nil, errors.New("the domain of the zone is required")
+	}
+
+	sets, err := externaldns.Records(zone)
+	if err != nil {
+		return "", nil, err
+	}
+
+	records := []*whmRecord{}
+	for _, rs := range sets {
+		for _, v := range rs.Values {
+			rec := &whmRecord{Line: len(records) + 1, Name: rs.Name + ".", Type: rs.Type, Class: "IN", TTL: rs.TTL, value: v, set: rs}
+
+			switch rs.Type {
+			case externaldns.A, externaldns.AAAA:
+				rec.Address = v
+			case externaldns.CNAME:
+				rec.CName = v
+			case externaldns.MX:
+				pref, exchange, _ := strings.Cut(v, " ")
+				p, _ := strconv.Atoi(pref)
+				rec.Preference, rec.Exchange = &p, strings.TrimSpace(exchange)
+			case externaldns.NS:
+				rec.NSDName = v
+			case externaldns.PTR:
+				rec.PTRDName = v
+			case externaldns.TXT:
+				rec.TXTData = v
+			}
+
+			records = append(records, rec)
+		}
+	}
+
+	return zone, records, nil
+}
+
+// whmLine returns the record at the line of the request
+func whmLine(r *http.Request, records []*whmRecord) (*whmRecord, error) {
+	line, err := strconv.Atoi(r.FormValue("line"))
+	if err != nil || line < 1 || line > len(records) {
+		return nil, fmt.Errorf("the zone has no record at line %q, dump the zone for the lines of its records", r.FormValue("line"))
+	}
+
+	return records[line-1], nil
+}
+
+// whmRecordName returns the name of a record in the zone. Names ending in a dot are
+// fully qualified, and other names are relative to the zone as in a zone file
+func whmRecordName(name string, zone string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	switch {
+	case name == "" || name == "@":
+		return zone, nil
+	case strings.HasSuffix(name, "."):
+		name = strings.TrimSuffix(name, ".")
+	default:
+		name += "." + zone
+	}
+
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return "", fmt.Errorf("%s is not in the zone %s", name, zone)
+	}
+
+	return name, nil
+}
+
+// whmRecordValue returns the value of a record of the type from the fields WHM names
+// them by, such as address for A records. Fields left out are taken from the previous
+// record when there is one
+func whmRecordValue(r *http.Request, typ string, previous *whmRecord) (string, error) {
+	current := previous.fields()
+	field := func(name string) string {
+		if v := strings.TrimSpace(r.FormValue(name)); v != "" {
+			return v
+		}
+		return current[name]
+	}
+
+	var value string
+	switch typ {
+	case externaldns.A, externaldns.AAAA:
+		value = field("address")
+	case externaldns.CNAME:
+		value = field("cname")
+	case externaldns.NS:
+		value = field("nsdname")
+	case externaldns.PTR:
+		value = field("ptrdname")
+	case externaldns.TXT:
+		value = field("txtdata")
+	case externaldns.MX:
+		if pref, exchange := field("preference"), field("exchange"); pref != "" && exchange != "" {
+			value = pref + " " + exchange
+		}
+	default:
+		return "", fmt.Errorf("records of type %q cannot be published", typ)
+	}
+
+	if value == "" {
+		return "", fmt.Errorf("the value of the %s record is required", typ)
+	}
+
+	return value, nil
+}
+
+// fields returns the fields of the record by their names in WHM, or none without a record
+func (rec *whmRecord) fields() map[string]string {
+	if rec == nil {
+		return nil
+	}
+
+	fields := map[string]string{
+		"address":  rec.Address,
+		"cname":    rec.CName,
+		"exchange": rec.Exchange,
+		"nsdname":  rec.NSDName,
+		"ptrdname": rec.PTRDName,
+		"txtdata":  rec.TXTData,
+	}
+	if rec.Preference != nil {
+		fields["preference"] = strconv.Itoa(*rec.Preference)
+	}
+
+	return fields
+}
+
+// whmTTL returns the TTL of the request, or the current one when it has none
+func whmTTL(r *http.Request, current int) (int, error) {
+	if r.FormValue("ttl") == "" {
+		return current, nil
+	}
+
+	ttl, err := strconv.Atoi(r.FormValue("ttl"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q", r.FormValue("ttl"))
+	}
+
+	return ttl, nil
+}
+
+// whmSetRecords publishes the record set, as PUT /api/v1/dns/zones/{zone}/records does
+func whmSetRecords(r *http.Request, rs externaldns.RecordSet) error {
+	rs, err := externaldns.Set(rs)
+	if err != nil {
+		return err
+	}
+
+	publish(r, "dns.record.set", rs.Name, nil, rs)
+
+	return nil
+}
+
+// whmReplaceRecords publishes what is left of a record set a record was taken out of,
+// removing the set once it has no records left
+func whmReplaceRecords(r *http.Request, rs externaldns.RecordSet) error {
+	if len(rs.Values) > 0 {
+		return whmSetRecords(r, rs)
+	}
+
+	if err := externaldns.Delete(rs.Name, rs.Type); err != nil {
+		return err
+	}
+
+	publish(r, "dns.record.delete", rs.Name, map[string]string{"name": rs.Name, "type": rs.Type}, nil)
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"slices"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/wordpress"
+)
+
+// getWordPressSites returns the WordPress sites of the accounts the caller manages
+func getWordPressSites(w http.ResponseWriter, r *http.Request) {
+	list, err := wordpress.List(managedAccounts(r)...)
+	if err != nil {
+		writeWordPressError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postWordPressScan looks for sites in the document roots without waiting for the
+// scheduler, such as after an account installed one
+func postWordPressScan(w http.ResponseWriter, r *http.Request) {
+	list, err := wordpress.Scan()
+	if err != nil {
+		writeWordPressError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getWordPressSite returns a site with the versions of WordPress and its plugins
+func getWordPressSite(w http.ResponseWriter, r *http.Request) {
+	i, ok := managedWordPressSite(w, r)
+	if !ok {
+		return
+	}
+
+	setETag(w, etag(i))
+	writeJSON(w, http.StatusOK, i)
+}
+
+// putWordPressHardening turns the hardening of a site on or off
+func putWordPressHardening(w http.ResponseWriter, r *http.Request) {
+	var body wordpress.Hardening
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	before, ok := managedWordPressSite(w, r)
+	if !ok {
+		return
+	}
+
+	if !preconditions(w, r, etag(before)) {
+		return
+	}
+
+	i, err := wordpress.Harden(before.ID, body)
+	if err != nil {
+		writeWordPressError(w, err)
+		return
+	}
+
+	publish(r, "wordpress.harden", i.ID, before.Hardening, i.Hardening)
+
+	setETag(w, etag(i))
+	writeJSON(w, http.StatusOK, i)
+}
+
+// postWordPressUpdate updates WordPress or plugins of a site in the background, after
+// backing up its account
+func postWordPressUpdate(w http.ResponseWriter, r *http.Request) {
+	var body wordpress.UpdateRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	i, ok := managedWordPressSite(w, r)
+	if !ok {
+		return
+	}
+
+	j, err := wordpress.Queue(i.ID, body, actor(r))
+	if err != nil {
+		writeWordPressError(w, err)
+		return
+	}
+
+	publish(r, "wordpress.queue", i.ID, nil, body)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// managedAccounts returns the usernames of the accounts the caller manages, or nil for
+// admins who manage every account
+func managedAccounts(r *http.Request) []string {
+	owners := domainOwners(r)
+	if owners == nil {
+		return nil
+	}
+
+	accounts := []string{}
+	for _, u := range auth.Users() {
+		if slices.Contains(owners, u.ID) {
+			accounts = append(accounts, u.Username)
+		}
+	}
+
+	return accounts
+}
+
+// managedWordPressSite returns the site of the request, writing an error if the caller
+// does not manage its account. Sites of others are reported as not found
+func managedWordPressSite(w http.ResponseWriter, r *http.Request) (wordpress.Install, bool) {
+	i, err := wordpress.Get(r.PathValue("id"))
+	if accounts := managedAccounts(r); err == nil && accounts != nil && !slices.Contains(accounts, i.Account) {
+		err = wordpress.ErrNotFound
+	}
+	if err != nil {
+		writeWordPressError(w, err)
+		return wordpress.Install{}, false
+	}
+
+	return i, true
+}
+
+// writeWordPressError writes the response for WordPress sites that could not be read,
+// scanned or changed
+func writeWordPressError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, wordpress.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, wordpress.ErrScanning), errors.Is(err, wordpress.ErrUpToDate):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, wordpress.ErrUnknownPlugin), errors.Is(err, wordpress.ErrNoOwner):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, wordpress.ErrNotConfigured), errors.Is(err, wordpress.ErrNoCLI), errors.Is(err, fs.ErrPermission):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
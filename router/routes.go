@@ -0,0 +1,104 @@
+package router
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/sdk"
+)
+
+// routes are the routes of the API as registered by Configure, which the API definition
+// and the client SDKs are generated from
+var routes []sdk.Route
+
+// Routes returns the routes of the API in the order they were registered
+func Routes() []sdk.Route {
+	return slices.Clone(routes)
+}
+
+// guard is a handler that checks a request before passing it on to the next handler,
+// which the routes are recorded with
+type guard struct {
+	http.Handler
+
+	// The access the guard requires, or empty if it does not authenticate
+	access string
+	next   http.Handler
+}
+
+// routeMux is a ServeMux that records the routes of the API as they are registered
+type routeMux struct {
+	*http.ServeMux
+	routes []sdk.Route
+	names  map[string]int
+}
+
+// Handle registers the handler for the pattern
+func (m *routeMux) Handle(pattern string, handler http.Handler) {
+	m.ServeMux.Handle(pattern, handler)
+	m.record(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the pattern, which does not require
+// authentication
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.ServeMux.HandleFunc(pattern, handler)
+	m.record(pattern, http.HandlerFunc(handler))
+}
+
+// record adds the route of the pattern if it is part of the API. Routes that are not
+// versioned, such as the WHM compatible API and plugins, are left out
+func (m *routeMux) record(pattern string, handler http.Handler) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok || !strings.HasPrefix(path, "/api/v1/") {
+		return
+	}
+
+	access := sdk.Public
+	for {
+		g, ok := handler.(guard)
+		if !ok {
+			break
+		}
+		if access == sdk.Public && g.access != "" {
+			access = g.access
+		}
+		handler = g.next
+	}
+
+	name := handlerName(handler)
+	if name == "" {
+		name = sdk.Operation(method, path)
+	}
+
+	if m.names == nil {
+		m.names = make(map[string]int)
+	}
+	m.names[name]++
+	if n := m.names[name]; n > 1 {
+		name += strconv.Itoa(n)
+	}
+
+	m.routes = append(m.routes, sdk.Route{Method: method, Path: path, Operation: name, Access: access})
+}
+
+// handlerName returns the name of the function handling a route, such as getUsers, or
+// nothing for closures
+func handlerName(handler http.Handler) string {
+	fn, ok := handler.(http.HandlerFunc)
+	if !ok {
+		return ""
+	}
+
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	if strings.HasPrefix(name, "func") {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,221 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month and day of week fields start with a *. Unless one of them
+	// does, a day matches if either field does, as in cron
+	anyDOM, anyDOW bool
+}
+
+// field is the range of values of a cron field
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression of five fields, minute, hour, day of month, month and
+// day of week, or one of the shorthands such as @daily. Fields are a *, a value, a range
+// such as 1-5, any of those followed by a step such as */15, or a list of them
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if s, ok := shorthands[expr]; ok {
+		expr = s
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return Schedule{}, fmt.Errorf("scheduler: %q must have 5 fields", expr)
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseField(parts[i], f)
+		if err != nil {
+			return Schedule{}, err
+		}
+		bits[i] = b
+	}
+
+	// Sunday can be written as 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDOM: strings.HasPrefix(parts[2], "*"),
+		anyDOW: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseField returns the values of the field as a bit set
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("scheduler: invalid step in %s field %q", f.name, s)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil || lo > hi {
+				return 0, fmt.Errorf("scheduler: invalid range in %s field %q", f.name, s)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("scheduler: invalid value in %s field %q", f.name, s)
+			}
+
+			// A single value with a step runs from the value to the end of the range
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+
+		if lo < f.min || hi > f.max {
+			return 0, fmt.Errorf("scheduler: %s field %q is out of range %d-%d", f.name, s, f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+// everyHour is the hour field of a schedule running every hour
+const everyHour = 1<<24 - 1
+
+// Next returns the first time after t that the schedule matches, or the zero time if it
+// never does, such as on the 31st of February. As in cron, a schedule at given hours
+// runs what the clocks skipped going forward right after they did, and runs once in an
+// hour repeated when they go back. Schedules running every hour carry on as the clocks do
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Every combination of month and day recurs within a few years
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.day(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour != everyHour {
+			if s.skipped(t) {
+				return t
+			}
+			if repeated(t) {
+				t = t.Add(time.Minute)
+				continue
+			}
+		}
+
+		if s.hour&(1<<t.Hour()) == 0 {
+			// The next hour is stepped to in elapsed time rather than by the clock, which
+			// is ambiguous in an hour the clocks go back over
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+
+		if s.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// skipped returns true if the schedule matches a time of the day of t that the clocks
+// skipped going forward right before t
+func (s Schedule) skipped(t time.Time) bool {
+	prev := t.Add(-time.Minute)
+	if prev.Day() != t.Day() {
+		return false
+	}
+
+	for m := prev.Hour()*60 + prev.Minute() + 1; m < t.Hour()*60+t.Minute(); m++ {
+		if s.hour&(1<<(m/60)) != 0 && s.minute&(1<<(m%60)) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// repeated returns true if the clocks already showed the time of t an hour earlier, as
+// they do when they go back
+func repeated(t time.Time) bool {
+	earlier := t.Add(-time.Hour)
+
+	return earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+// day returns true if the day of t matches the schedule
+func (s Schedule) day(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+
+	if s.anyDOM || s.anyDOW {
+		return dom && dow
+	}
+
+	return dom || dow
+}
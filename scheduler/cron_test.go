@@ -0,0 +1,235 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseShorthands(t *testing.T) {
+	tests := map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+
+	for shorthand, expr := range tests {
+		got, err := Parse(" " + shorthand + " ")
+		if err != nil {
+			t.Errorf("%s: %v", shorthand, err)
+			continue
+		}
+
+		want, err := Parse(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", shorthand, got, want)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		field string
+		f     field
+		want  []int
+	}{
+		{"*", fields[1], seq(0, 23, 1)},
+		{"*/15", fields[0], []int{0, 15, 30, 45}},
+		{"5/20", fields[0], []int{5, 25, 45}},
+		{"1-5", fields[4], []int{1, 2, 3, 4, 5}},
+		{"10-20/5", fields[0], []int{10, 15, 20}},
+		{"1,3,5-7", fields[3], []int{1, 3, 5, 6, 7}},
+		{"*/10,7", fields[2], []int{1, 7, 11, 21, 31}},
+		{"0-59/30", fields[0], []int{0, 30}},
+		{"7", fields[4], []int{7}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseField(tt.field, tt.f)
+		if err != nil {
+			t.Errorf("%s field %q: %v", tt.f.name, tt.field, err)
+			continue
+		}
+
+		var want uint64
+		for _, v := range tt.want {
+			want |= 1 << v
+		}
+
+		if got != want {
+			t.Errorf("%s field %q: got %b, want %b", tt.f.name, tt.field, got, want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"1-60 * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/-5 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1- * * * *",
+		"1,,2 * * * *",
+		"* * * JAN *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q was accepted", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Times are in UTC, and Next is given them in the location of the test when it has one
+	tests := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from time.Time
+		want time.Time
+	}{
+		{"next minute", "* * * * *", nil, utc(2026, 10, 15, 10, 0, 30), utc(2026, 10, 15, 10, 1, 0)},
+		{"strictly after", "0 * * * *", nil, utc(2026, 10, 15, 10, 0, 0), utc(2026, 10, 15, 11, 0, 0)},
+		{"step", "*/15 * * * *", nil, utc(2026, 10, 15, 10, 16, 0), utc(2026, 10, 15, 10, 30, 0)},
+		{"range of hours", "0 9-17 * * *", nil, utc(2026, 10, 15, 17, 30, 0), utc(2026, 10, 16, 9, 0, 0)},
+		{"weekdays", "0 6 * * 1-5", nil, utc(2026, 10, 16, 7, 0, 0), utc(2026, 10, 19, 6, 0, 0)},
+
+		// Sunday is 0 and 7, and 2026-10-17 is a Saturday
+		{"Sunday as 0", "0 0 * * 0", nil, utc(2026, 10, 17, 12, 0, 0), utc(2026, 10, 18, 0, 0, 0)},
+		{"Sunday as 7", "0 0 * * 7", nil, utc(2026, 10, 17, 12, 0, 0), utc(2026, 10, 18, 0, 0, 0)},
+		{"range ending on Sunday", "0 0 * * 6-7", nil, utc(2026, 10, 17, 12, 0, 0), utc(2026, 10, 18, 0, 0, 0)},
+
+		// Restricting both days matches either, and a * in one leaves the other
+		{"day of month or Friday", "0 0 13 * 5", nil, utc(2026, 10, 1, 0, 0, 0), utc(2026, 10, 2, 0, 0, 0)},
+		{"day of month or Friday, the day", "0 0 13 * 5", nil, utc(2026, 10, 10, 0, 0, 0), utc(2026, 10, 13, 0, 0, 0)},
+		{"any day of month and Friday", "0 0 * * 5", nil, utc(2026, 10, 10, 0, 0, 0), utc(2026, 10, 16, 0, 0, 0)},
+		{"day of month and any day of week", "0 0 13 * *", nil, utc(2026, 10, 1, 0, 0, 0), utc(2026, 10, 13, 0, 0, 0)},
+		{"stepped day of month and Monday", "0 0 */10 * 1", nil, utc(2026, 10, 1, 12, 0, 0), utc(2026, 12, 21, 0, 0, 0)},
+
+		// Month ends
+		{"31st skips shorter months", "0 0 31 * *", nil, utc(2026, 4, 15, 0, 0, 0), utc(2026, 5, 31, 0, 0, 0)},
+		{"first of the month", "0 0 1 * *", nil, utc(2026, 1, 31, 12, 0, 0), utc(2026, 2, 1, 0, 0, 0)},
+		{"end of the year", "59 23 31 12 *", nil, utc(2026, 12, 31, 23, 59, 0), utc(2027, 12, 31, 23, 59, 0)},
+		{"new year", "0 0 * * *", nil, utc(2026, 12, 31, 23, 59, 0), utc(2027, 1, 1, 0, 0, 0)},
+		{"leap day", "0 0 29 2 *", nil, utc(2026, 3, 1, 0, 0, 0), utc(2028, 2, 29, 0, 0, 0)},
+		{"never", "0 0 30 2 *", nil, utc(2026, 1, 1, 0, 0, 0), time.Time{}},
+
+		// Clocks in Berlin went forward from 02:00 to 03:00 on 2026-03-29
+		{"skipped time runs after the change", "30 2 * * *", berlin, time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)},
+		{"skipped time runs once", "30 2 * * *", berlin, time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), time.Date(2026, 3, 30, 0, 30, 0, 0, time.UTC)},
+		{"hour after the skipped one", "0 3 * * *", berlin, time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)},
+		{"every hour across the change", "0 * * * *", berlin, time.Date(2026, 3, 29, 0, 59, 0, 0, time.UTC), time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)},
+
+		// Clocks in Berlin went back from 03:00 to 02:00 on 2026-10-25
+		{"repeated time runs in the first pass", "30 2 * * *", berlin, time.Date(2026, 10, 24, 22, 0, 0, 0, time.UTC), time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC)},
+		{"repeated time runs once", "30 2 * * *", berlin, time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC)},
+		{"every hour in the second pass", "30 * * * *", berlin, time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC)},
+
+		// Clocks in New York went back from 02:00 to 01:00 on 2026-11-01
+		{"repeated time in New York", "30 1 * * *", newYork, time.Date(2026, 11, 1, 4, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC)},
+		{"repeated time in New York runs once", "30 1 * * *", newYork, time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), time.Date(2026, 11, 2, 6, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from := tt.from
+			if tt.loc != nil {
+				from = from.In(tt.loc)
+			}
+
+			got := s.Next(from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", from, got, tt.want.In(from.Location()))
+			}
+		})
+	}
+}
+
+// TestRunsAcrossDST counts the runs of the loop of the scheduler, which starts a task
+// in the minute Next returns for the minute before, over days the clocks change on
+func TestRunsAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		day  time.Time
+		want int
+	}{
+		{"30 2 * * *", time.Date(2026, 3, 29, 0, 0, 0, 0, berlin), 1},
+		{"30 2 * * *", time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), 1},
+		{"0 0 * * *", time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), 1},
+		{"0 * * * *", time.Date(2026, 3, 29, 0, 0, 0, 0, berlin), 23},
+		{"0 * * * *", time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), 25},
+		{"*/30 1-3 * * *", time.Date(2026, 3, 29, 0, 0, 0, 0, berlin), 4},
+		{"*/30 1-3 * * *", time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), 6},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		runs := 0
+		end := time.Date(tt.day.Year(), tt.day.Month(), tt.day.Day()+1, 0, 0, 0, 0, berlin)
+		for minute := tt.day; minute.Before(end); minute = minute.Add(time.Minute) {
+			if s.Next(minute.Add(-time.Minute)).Equal(minute) {
+				runs++
+			}
+		}
+
+		if runs != tt.want {
+			t.Errorf("%q on %s: %d runs, want %d", tt.expr, tt.day.Format(time.DateOnly), runs, tt.want)
+		}
+	}
+}
+
+func utc(year int, month time.Month, day, hour, min, sec int) time.Time {
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+}
+
+func seq(lo, hi, step int) []int {
+	var s []int
+	for v := lo; v <= hi; v += step {
+		s = append(s, v)
+	}
+	return s
+}
@@ -0,0 +1,142 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+)
+
+// What started a run of a task
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+// Run is the record of a single run of a task
+type Run struct {
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+
+	// Whether the run was scheduled or triggered, and who triggered it
+	Trigger string `json:"trigger"`
+	Actor   string `json:"actor,omitempty"`
+
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+
+	// What the task wrote, cut off at the configured limit
+	Output    string `json:"output,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// history keeps the recent runs of every task, newest first
+type history struct {
+	mu   sync.Mutex
+	path string
+	runs map[string][]Run
+}
+
+// load reads the history from disk
+func (h *history) load() error {
+	b, err := os.ReadFile(h.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &h.runs); err != nil {
+			return fmt.Errorf("scheduler: failed to read task history: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// add records the run of the task, keeping only the most recent runs
+func (h *history) add(name string, r Run, keep int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	runs := append([]Run{r}, h.runs[name]...)
+	if keep > 0 && len(runs) > keep {
+		runs = runs[:keep]
+	}
+	h.runs[name] = runs
+
+	b, err := json.MarshalIndent(h.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.path)
+}
+
+// History returns the recent runs of the task, newest first
+func History(name string) ([]Run, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.history.mu.Lock()
+	runs, ok := std.history.runs[name]
+	std.history.mu.Unlock()
+
+	if _, registered := registered(name); !ok && !registered {
+		return nil, ErrNotFound
+	}
+
+	return append([]Run{}, runs...), nil
+}
+
+// registerCommand registers a task running the shell command with the limits of the
+// scheduler class
+func registerCommand(name string, command string) {
+	fmu.Lock()
+	defer fmu.Unlock()
+
+	funcs[name] = func(w io.Writer) error {
+		return throttle.Run(context.Background(), throttle.Scheduler, func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+			cmd.Stdout = w
+			cmd.Stderr = w
+
+			return cmd.Run()
+		})
+	}
+}
+
+// output keeps what a task writes up to a limit, discarding the rest
+type output struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write keeps as much of p as fits within the limit. It never fails, so that a task
+// writing more than is kept is not interrupted
+func (o *output) Write(p []byte) (int, error) {
+	room := o.limit - o.buf.Len()
+	if o.limit > 0 && len(p) > room {
+		o.buf.Write(p[:max(room, 0)])
+		o.truncated = true
+
+		return len(p), nil
+	}
+
+	o.buf.Write(p)
+
+	return len(p), nil
+}
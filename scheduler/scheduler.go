@@ -0,0 +1,366 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// Off disables the schedule of a task, which then only runs when it is triggered
+const Off = "off"
+
+var (
+	// ErrNotConfigured is returned when using the scheduler before Configure is called
+	ErrNotConfigured = errors.New("scheduler: not configured")
+
+	// ErrNotFound is returned when a task has not been registered
+	ErrNotFound = errors.New("scheduler: task not found")
+
+	// ErrRunning is returned when triggering a task that is already running
+	ErrRunning = errors.New("scheduler: task is already running")
+)
+
+// Func runs a task
+type Func func() error
+
+// runner runs a task, writing its output to w
+type runner func(w io.Writer) error
+
+var (
+	fmu   sync.Mutex
+	funcs = make(map[string]runner)
+)
+
+// Register sets the function run for the task. Tasks are run on the schedule configured
+// for their name, and only once at a time
+func Register(name string, fn Func) {
+	fmu.Lock()
+	defer fmu.Unlock()
+
+	funcs[name] = func(io.Writer) error { return fn() }
+}
+
+// registered returns the function registered for the task
+func registered(name string) (runner, bool) {
+	fmu.Lock()
+	defer fmu.Unlock()
+
+	fn, ok := funcs[name]
+
+	return fn, ok
+}
+
+// Task is the status of a recurring task
+type Task struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Running  bool   `json:"running"`
+
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastExitCode int       `json:"last_exit_code"`
+	LastError    string    `json:"last_error,omitempty"`
+
+	// When the task next runs on its schedule, zero if it is off
+	NextRun time.Time `json:"next_run,omitempty"`
+}
+
+// Scheduler runs the registered tasks on their schedules and keeps the outcome of their
+// last run, along with the history of their recent runs
+type Scheduler struct {
+	mu        sync.Mutex
+	path      string
+	config    *config.SchedulerConfiguration
+	location  *time.Location
+	schedules map[string]Schedule
+	tasks     map[string]*Task
+	history   *history
+}
+
+var std *Scheduler
+
+// Configure parses the schedules and loads the outcome of the last run of every task
+// from the data directory
+func Configure(dataDir string, c *config.SchedulerConfiguration) error {
+	s := &Scheduler{
+		path:      filepath.Join(dataDir, "scheduler", "tasks.json"),
+		config:    c,
+		location:  time.Local,
+		schedules: make(map[string]Schedule),
+		tasks:     make(map[string]*Task),
+		history:   &history{path: filepath.Join(dataDir, "scheduler", "history.json"), runs: make(map[string][]Run)},
+	}
+
+	if c.TimeZone != "" {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return fmt.Errorf("scheduler: invalid time zone %q: %w", c.TimeZone, err)
+		}
+		s.location = loc
+	}
+
+	for name, expr := range c.Tasks {
+		if expr == "" || expr == Off {
+			continue
+		}
+
+		sched, err := Parse(expr)
+		if err != nil {
+			return fmt.Errorf("%w for task %s", err, name)
+		}
+		s.schedules[name] = sched
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &s.tasks); err != nil {
+			return fmt.Errorf("scheduler: failed to read task status: %w", err)
+		}
+	}
+
+	for _, t := range s.tasks {
+		t.Running = false
+	}
+
+	if err := s.history.load(); err != nil {
+		return err
+	}
+
+	for name, cmd := range c.Commands {
+		registerCommand(name, cmd)
+	}
+
+	std = s
+
+	return nil
+}
+
+// Start runs the tasks on their schedules in the background. Runs missed while the
+// daemon was stopped are not caught up on
+func Start() {
+	if std == nil {
+		return
+	}
+
+	crash.Go("scheduler", std.loop)
+}
+
+// Tasks returns the status of every registered task, sorted by name
+func Tasks() []Task {
+	if std == nil {
+		return nil
+	}
+
+	fmu.Lock()
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	fmu.Unlock()
+
+	sort.Strings(names)
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	list := make([]Task, 0, len(names))
+	for _, name := range names {
+		list = append(list, std.status(name))
+	}
+
+	return list
+}
+
+// Trigger runs the task now in the background on behalf of the actor, regardless of its
+// schedule
+func Trigger(name string, actor string) (Task, error) {
+	if std == nil {
+		return Task{}, ErrNotConfigured
+	}
+
+	if err := std.start(name, TriggerManual, actor); err != nil {
+		return Task{}, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.status(name), nil
+}
+
+// status returns the status of the task. The scheduler must be locked
+func (s *Scheduler) status(name string) Task {
+	t := Task{Name: name}
+	if last, ok := s.tasks[name]; ok {
+		t = *last
+	}
+
+	t.Schedule = Off
+	t.NextRun = time.Time{}
+
+	if sched, ok := s.schedules[name]; ok {
+		t.Schedule = s.config.Tasks[name]
+		t.NextRun = sched.Next(time.Now().In(s.location))
+	}
+
+	return t
+}
+
+// loop wakes at the start of every minute and starts the tasks scheduled for it
+func (s *Scheduler) loop() {
+	for {
+		now := time.Now().In(s.location)
+		minute := now.Truncate(time.Minute).Add(time.Minute)
+
+		time.Sleep(minute.Sub(now))
+
+		s.mu.Lock()
+		var due []string
+		for name, sched := range s.schedules {
+			if sched.Next(minute.Add(-time.Minute)).Equal(minute) {
+				due = append(due, name)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, name := range due {
+			if err := s.start(name, TriggerSchedule, ""); err != nil && !errors.Is(err, ErrNotFound) {
+				zap.S().Named("scheduler").Warnw("skipped scheduled task", "task", name, zap.Error(err))
+			}
+		}
+	}
+}
+
+// start runs the task in the background unless it is already running
+func (s *Scheduler) start(name string, trigger string, actor string) error {
+	fn, ok := registered(name)
+	if !ok {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[name]
+	if !ok {
+		t = &Task{Name: name}
+		s.tasks[name] = t
+	}
+
+	if t.Running {
+		return ErrRunning
+	}
+	t.Running = true
+
+	go s.run(name, fn, trigger, actor)
+
+	return nil
+}
+
+// run runs the task and records the outcome
+func (s *Scheduler) run(name string, fn runner, trigger string, actor string) {
+	started := time.Now()
+	out := &output{limit: s.config.OutputLimit}
+	code, err := call(name, fn, out)
+	duration := time.Since(started)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tasks[name]
+	t.Running = false
+	t.LastRun = started.UTC()
+	t.LastDuration = duration.Round(time.Millisecond).String()
+	t.LastExitCode = code
+	t.LastError = ""
+
+	run := Run{
+		Started:   started.UTC(),
+		Duration:  t.LastDuration,
+		Trigger:   trigger,
+		Actor:     actor,
+		ExitCode:  code,
+		Output:    out.buf.String(),
+		Truncated: out.truncated,
+	}
+
+	if err != nil {
+		run.Error = err.Error()
+
+		t.LastError = err.Error()
+
+		zap.S().Named("scheduler").Errorw("task failed", "task", name, zap.Error(err))
+
+		events.Publish(events.Event{
+			Type:     "scheduler.task.failed",
+			Resource: name,
+			Data:     map[string]interface{}{"error": t.LastError, "exit_code": code},
+		})
+	}
+
+	if err := s.save(); err != nil {
+		zap.S().Named("scheduler").Errorw("failed to save task status", zap.Error(err))
+	}
+
+	if err := s.history.add(name, run, s.config.History); err != nil {
+		zap.S().Named("scheduler").Errorw("failed to save task history", zap.Error(err))
+	}
+}
+
+// call runs the task, returning its exit code. Commands exit with their own code, and
+// functions with 0 on success, 1 on failure and 2 on a panic, which is turned into an
+// error so that the task can run again
+func call(name string, fn runner, w io.Writer) (code int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rep := crash.Capture("scheduler", r, map[string]string{"task": name})
+			code, err = 2, fmt.Errorf("task panicked, see crash report %s: %v", rep.ID, r)
+		}
+	}()
+
+	if err = fn(w); err == nil {
+		return 0, nil
+	}
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() > 0 {
+		return exit.ExitCode(), err
+	}
+
+	return 1, err
+}
+
+// save writes the status of the tasks to disk. The scheduler must be locked
+func (s *Scheduler) save() error {
+	b, err := json.MarshalIndent(s.tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
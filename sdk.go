@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/router"
+	"github.com/cosmicpanel/CosmicPanel/sdk"
+)
+
+// generateSDK writes the OpenAPI definition of the API of this binary or a client of it
+// to the file, or to stdout without one. The routes are the same whatever the
+// configuration, so none is read and the clients can be built without a panel
+func generateSDK(args []string) error {
+	fs := flag.NewFlagSet("sdk", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cosmicpanel sdk openapi|go|typescript [file]\n\nFor example, to build the Go client:\n  cosmicpanel sdk go cosmicpanel.go\n")
+	}
+	args = parse(fs, args)
+
+	var generate func([]sdk.Route, string) ([]byte, error)
+	switch arg(args, 0) {
+	case "openapi":
+		generate = sdk.OpenAPI
+	case "go":
+		generate = sdk.Go
+	case "typescript":
+		generate = sdk.TypeScript
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	router.Configure(config.NewConfiguration(""))
+
+	data, err := generate(router.Routes(), buildinfo.Get().Version)
+	if err != nil {
+		return err
+	}
+
+	if file := arg(args, 1); file != "" {
+		return os.WriteFile(file, data, 0644)
+	}
+
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,92 @@
+package sdk
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// OpenAPI returns the OpenAPI 3 definition of the routes as JSON. Request and response
+// bodies are described as JSON objects, as the routes do not declare their types
+func OpenAPI(routes []Route, version string) ([]byte, error) {
+	paths := make(map[string]map[string]interface{})
+
+	for _, r := range routes {
+		path := strings.ReplaceAll(r.Path, "...}", "}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		op := map[string]interface{}{
+			"operationId":          r.Operation,
+			"tags":                 []string{r.tag()},
+			"x-cosmicpanel-access": r.Access,
+			"responses":            map[string]interface{}{"2XX": map[string]interface{}{"description": "Success", "content": jsonObject}, "default": errorResponse},
+		}
+
+		if r.Access == Public {
+			op["security"] = []interface{}{}
+		}
+
+		var params []interface{}
+		for _, p := range r.params() {
+			param := map[string]interface{}{
+				"name":     p.Name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			}
+			if p.Rest {
+				param["description"] = "The rest of the path, which may hold slashes"
+				param["allowReserved"] = true
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if r.body() {
+			op["requestBody"] = map[string]interface{}{"content": jsonObject}
+		}
+
+		paths[path][strings.ToLower(r.Method)] = op
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "CosmicPanel API",
+			"version": version,
+		},
+		"paths":    paths,
+		"security": []interface{}{map[string][]string{"bearer": {}}},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"error": map[string]string{"type": "string"}},
+				},
+			},
+		},
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+var (
+	// jsonObject is the content of a request or response body
+	jsonObject = map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": map[string]string{"type": "object"}},
+	}
+
+	// errorResponse is what every route answers when it fails
+	errorResponse = map[string]interface{}{
+		"description": "The request failed",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]string{"$ref": "#/components/schemas/Error"}},
+		},
+	}
+)
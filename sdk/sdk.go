@@ -0,0 +1,102 @@
+package sdk
+
+import (
+	"go/token"
+	"strings"
+	"unicode"
+)
+
+// Access a route needs
+const (
+	Public = "public"
+	User   = "user"
+	Admin  = "admin"
+)
+
+// Route is a route of the API, which the definition and clients are generated from
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// The name of the operation, such as getUsers
+	Operation string `json:"operation"`
+
+	// Who may call the route, public, any logged in user or admins
+	Access string `json:"access"`
+}
+
+// param is a wildcard in the path of a route
+type param struct {
+	Name string
+
+	// Set for wildcards ending in ..., which match the rest of the path, slashes included
+	Rest bool
+}
+
+// params returns the wildcards in the path in order
+func (r Route) params() []param {
+	var list []param
+	for _, seg := range strings.Split(r.Path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			name := strings.Trim(seg, "{}")
+			rest := strings.HasSuffix(name, "...")
+			list = append(list, param{Name: strings.TrimSuffix(name, "..."), Rest: rest})
+		}
+	}
+
+	return list
+}
+
+// body returns true if requests to the route send a body
+func (r Route) body() bool {
+	return r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH"
+}
+
+// Operation returns the name of the operation of a route whose handler has none, from
+// its method and path, such as postAuthRecoveryCodes or getUsersByID
+func Operation(method string, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+
+	for _, seg := range strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/") {
+		if strings.HasPrefix(seg, "{") {
+			sb.WriteString("By")
+			seg = strings.TrimSuffix(strings.Trim(seg, "{}"), "...")
+			if seg == "id" {
+				seg = "ID"
+			}
+		}
+
+		for _, word := range strings.FieldsFunc(seg, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			sb.WriteString(exported(word))
+		}
+	}
+
+	return sb.String()
+}
+
+// exported returns the name with its first letter upper case
+func exported(name string) string {
+	if name == "" {
+		return name
+	}
+
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// goIdent returns the name of a path parameter as a Go identifier, which must not be a
+// keyword
+func goIdent(name string) string {
+	if token.IsKeyword(name) {
+		return name + "Name"
+	}
+
+	return name
+}
+
+// tag returns the group a route is listed under, the first segment of its path
+func (r Route) tag() string {
+	seg, _, _ := strings.Cut(strings.TrimPrefix(r.Path, "/api/v1/"), "/")
+
+	return seg
+}
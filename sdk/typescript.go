@@ -0,0 +1,154 @@
+package sdk
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// TypeScript returns the source of a TypeScript client of the routes, a single module
+// exporting the class CosmicPanel with a method per route. It uses fetch, so it runs in
+// browsers and in Node.js 18 and later
+func TypeScript(routes []Route, version string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tsTemplate.Execute(&buf, clientData(routes, version)); err != nil {
+		return nil, fmt.Errorf("sdk: generating the TypeScript client: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// tsPath returns a template literal building the path of a route from its parameters
+func tsPath(r Route) string {
+	var sb strings.Builder
+	sb.WriteString("`")
+
+	for _, seg := range strings.Split(strings.TrimPrefix(r.Path, "/"), "/") {
+		sb.WriteString("/")
+
+		if !strings.HasPrefix(seg, "{") {
+			sb.WriteString(seg)
+			continue
+		}
+
+		name := strings.Trim(seg, "{}")
+		if strings.HasSuffix(name, "...") {
+			sb.WriteString("${escapePath(" + tsIdent(strings.TrimSuffix(name, "...")) + ")}")
+		} else {
+			sb.WriteString("${encodeURIComponent(" + tsIdent(name) + ")}")
+		}
+	}
+
+	sb.WriteString("`")
+
+	return sb.String()
+}
+
+// tsReserved are the words of JavaScript that cannot name a parameter
+var tsReserved = strings.Fields(`break case catch class const continue debugger default delete do else
+	enum export extends false finally for function if import in instanceof new null return
+	super switch this throw true try typeof var void while with`)
+
+// tsIdent returns the name of a path parameter as a TypeScript identifier
+func tsIdent(name string) string {
+	if slices.Contains(tsReserved, name) {
+		return name + "Name"
+	}
+
+	return name
+}
+
+var tsTemplate = template.Must(template.New("typescript").Funcs(template.FuncMap{
+	"ident": tsIdent,
+	"path":  tsPath,
+}).Parse(`// Code generated by cosmicpanel sdk. DO NOT EDIT.
+
+// A client of the API of CosmicPanel {{.Version}}. Responses are returned as JSON,
+// which callers give types of their own.
+
+export const VERSION = "{{.Version}}";
+
+// The answer to a request that succeeded.
+export interface Response<T = unknown> {
+  status: number;
+  headers: Headers;
+  body: T;
+}
+
+// The answer to a request that failed.
+export class CosmicPanelError extends Error {
+  constructor(public status: number, message: string) {
+    super(message);
+    this.name = "CosmicPanelError";
+  }
+}
+
+// What changes a request before it is sent, such as headers like If-Match.
+export interface RequestOptions {
+  query?: Record<string, string | string[]>;
+  headers?: Record<string, string>;
+  signal?: AbortSignal;
+}
+
+function escapePath(p: string): string {
+  return p.split("/").map(encodeURIComponent).join("/");
+}
+
+// Calls the API of a panel, such as https://panel.example.com:2087, with the admin
+// token or the token of a user's session.
+export class CosmicPanel {
+  constructor(
+    private baseURL: string,
+    private token: string = "",
+    private fetcher: typeof fetch = globalThis.fetch.bind(globalThis),
+  ) {
+    this.baseURL = baseURL.replace(/\/+$/, "");
+  }
+
+  async request<T = unknown>(method: string, path: string, body?: unknown, options: RequestOptions = {}): Promise<Response<T>> {
+    const url = new URL(this.baseURL + path);
+    for (const [key, value] of Object.entries(options.query ?? {})) {
+      for (const v of Array.isArray(value) ? value : [value]) {
+        url.searchParams.append(key, v);
+      }
+    }
+
+    const headers: Record<string, string> = { Accept: "application/json" };
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    if (this.token) {
+      headers["Authorization"] = "Bearer " + this.token;
+    }
+
+    const resp = await this.fetcher(url, {
+      method,
+      headers: { ...headers, ...options.headers },
+      body: body === undefined ? undefined : JSON.stringify(body),
+      signal: options.signal,
+    });
+
+    const text = await resp.text();
+    let data: unknown = undefined;
+    try {
+      data = text ? JSON.parse(text) : undefined;
+    } catch {
+      data = text;
+    }
+
+    if (!resp.ok) {
+      const message = (data as { error?: string } | undefined)?.error || resp.statusText;
+      throw new CosmicPanelError(resp.status, message);
+    }
+
+    return { status: resp.status, headers: resp.headers, body: data as T };
+  }
+{{range .Operations}}
+  // {{.Method}} {{.Path}}, which is {{if eq .Access "public"}}public{{else if eq .Access "admin"}}for admins{{else}}for logged in users{{end}}.
+  {{.Operation}}<T = unknown>({{range .Params}}{{ident .Name}}: string, {{end}}{{if .Body}}body?: unknown, {{end}}options?: RequestOptions): Promise<Response<T>> {
+    return this.request<T>("{{.Method}}", {{path .Route}}, {{if .Body}}body{{else}}undefined{{end}}, options);
+  }
+{{end}}}
+`))
@@ -0,0 +1,223 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// client is used for every request to the release server
+var client = httpx.Client(10 * time.Minute)
+
+// Release is the manifest of a published build of the panel
+type Release struct {
+	Version   string    `json:"version"`
+	Channel   string    `json:"channel"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	URL       string    `json:"url"`
+	SHA256    string    `json:"sha256"`
+	Published time.Time `json:"published"`
+
+	// The base64 encoded Ed25519 signature of the message
+	Signature string `json:"signature"`
+}
+
+// message returns what the signature covers. The version, channel and platform are
+// signed along with the checksum so that a signature cannot be reused for a different
+// build
+func (r Release) message() []byte {
+	return []byte(fmt.Sprintf("cosmicpanel\n%s\n%s\n%s/%s\n%s\n", r.Version, r.Channel, r.OS, r.Arch, strings.ToLower(r.SHA256)))
+}
+
+// verify checks that the release is signed by the key and built for this server
+func (r Release) verify(key ed25519.PublicKey, channel string) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(key, r.message(), sig) {
+		return ErrBadSignature
+	}
+
+	if r.Channel != channel || r.OS != runtime.GOOS || r.Arch != runtime.GOARCH {
+		return fmt.Errorf("selfupdate: release is for %s on %s/%s, not %s on %s/%s", r.Channel, r.OS, r.Arch, channel, runtime.GOOS, runtime.GOARCH)
+	}
+
+	if u, err := url.Parse(r.URL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("selfupdate: release must be downloaded over https, not from %q", r.URL)
+	}
+
+	return nil
+}
+
+// fetchRelease returns the manifest of the latest release on the channel
+func fetchRelease(base string, channel string) (Release, error) {
+	var r Release
+
+	resp, err := client.Get(fmt.Sprintf("%s/%s/%s-%s.json", strings.TrimSuffix(base, "/"), url.PathEscape(channel), runtime.GOOS, runtime.GOARCH))
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return r, fmt.Errorf("selfupdate: release server returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&r)
+
+	return r, err
+}
+
+// download writes the release's binary to the path, returning an error if it does not
+// match the signed checksum
+func download(r Release, path string) error {
+	resp, err := client.Get(r.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("selfupdate: downloading %s returned %s", r.URL, resp.Status)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), r.SHA256) {
+		err = ErrChecksum
+	}
+
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+// Newer returns true if version a is newer than version b. Versions are compared as
+// dotted numbers with an optional leading v, and a pre-release such as 1.4.0-beta.2 is
+// older than the release it precedes. Anything else, such as a development build, is
+// older than every release
+func Newer(a string, b string) bool {
+	return compare(a, b) > 0
+}
+
+// compare returns -1, 0 or 1 when version a is older, the same or newer than b
+func compare(a string, b string) int {
+	na, pa, oka := parseVersion(a)
+	nb, pb, okb := parseVersion(b)
+
+	switch {
+	case !oka && !okb:
+		return 0
+	case !oka:
+		return -1
+	case !okb:
+		return 1
+	}
+
+	for i := 0; i < len(na) || i < len(nb); i++ {
+		var x, y int
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+
+	return comparePre(strings.Split(pa, "."), strings.Split(pb, "."))
+}
+
+// comparePre compares the identifiers of two pre-releases as semantic versioning does.
+// Numeric identifiers are compared as numbers and sort before the others, which are
+// compared as text, and a pre-release with fewer identifiers sorts first when the ones
+// it has are the same, so beta.10 is newer than beta.9 and beta newer than alpha.1
+func comparePre(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, errx := strconv.ParseUint(a[i], 10, 64)
+		y, erry := strconv.ParseUint(b[i], 10, 64)
+
+		switch {
+		case errx == nil && erry == nil:
+			if x != y {
+				if x > y {
+					return 1
+				}
+				return -1
+			}
+		case errx == nil:
+			return -1
+		case erry == nil:
+			return 1
+		case a[i] != b[i]:
+			if a[i] > b[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+
+	switch {
+	case len(a) > len(b):
+		return 1
+	case len(a) < len(b):
+		return -1
+	}
+
+	return 0
+}
+
+// parseVersion splits a version into its numbers and pre-release
+func parseVersion(v string) ([]int, string, bool) {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+	v, pre, _ := strings.Cut(v, "-")
+
+	var numbers []int
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, "", false
+		}
+		numbers = append(numbers, n)
+	}
+
+	return numbers, pre, true
+}
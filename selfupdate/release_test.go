@@ -0,0 +1,221 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.4.0", "1.4.0", 0},
+		{"v1.4.0", "1.4.0", 0},
+		{"1.4", "1.4.0", 0},
+		{"1.4.0+build.7", "1.4.0", 0},
+		{"1.4.1", "1.4.0", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.4.0.1", "1.4.0", 1},
+		{"1.3.9", "1.4.0", -1},
+
+		// Pre-releases precede their release
+		{"1.4.0-beta.1", "1.4.0", -1},
+		{"1.4.0", "1.4.0-rc.1", 1},
+		{"1.4.0-rc.1", "1.3.9", 1},
+		{"1.4.0-beta.10", "1.4.0-beta.9", 1},
+		{"1.4.0-beta", "1.4.0-alpha.1", 1},
+		{"1.4.0-beta.2", "1.4.0-beta", 1},
+		{"1.4.0-alpha.beta", "1.4.0-alpha.1", 1},
+		{"1.4.0-rc.1", "1.4.0-rc.1", 0},
+
+		// Versions that cannot be parsed are older than every release
+		{"dev", "0.0.1", -1},
+		{"1.4.0", "", 1},
+		{"dev", "unknown", 0},
+		{"1.x.0", "1.0.0", -1},
+		{"1..0", "1.0.0", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := compare(tt.a, tt.b); got != tt.want {
+				t.Errorf("compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := compare(tt.b, tt.a); got != -tt.want {
+				t.Errorf("compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+			if got := Newer(tt.a, tt.b); got != (tt.want > 0) {
+				t.Errorf("Newer(%q, %q) = %v", tt.a, tt.b, got)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(r Release, key ed25519.PrivateKey) Release {
+		r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.message()))
+		return r
+	}
+
+	release := Release{
+		Version: "1.4.0",
+		Channel: "stable",
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		URL:     "https://releases.example.com/cosmicpanel-1.4.0",
+		SHA256:  strings.Repeat("ab", 32),
+	}
+
+	tests := []struct {
+		name    string
+		release func() Release
+		key     ed25519.PublicKey
+		channel string
+		ok      bool
+		badSig  bool
+	}{
+		{"signed", func() Release { return signed(release, priv) }, pub, "stable", true, false},
+		{"checksum in upper case", func() Release {
+			r := signed(release, priv)
+			r.SHA256 = strings.ToUpper(r.SHA256)
+			return r
+		}, pub, "stable", true, false},
+
+		{"signed by another key", func() Release { return signed(release, otherPriv) }, pub, "stable", false, true},
+		{"verified with another key", func() Release { return signed(release, priv) }, otherPub, "stable", false, true},
+		{"no signature", func() Release { return release }, pub, "stable", false, true},
+		{"signature not base64", func() Release {
+			r := release
+			r.Signature = "not base64!"
+			return r
+		}, pub, "stable", false, true},
+		{"version changed", func() Release {
+			r := signed(release, priv)
+			r.Version = "9.9.9"
+			return r
+		}, pub, "stable", false, true},
+		{"checksum changed", func() Release {
+			r := signed(release, priv)
+			r.SHA256 = strings.Repeat("cd", 32)
+			return r
+		}, pub, "stable", false, true},
+		{"channel changed", func() Release {
+			r := signed(release, priv)
+			r.Channel = "beta"
+			return r
+		}, pub, "beta", false, true},
+		{"platform changed", func() Release {
+			r := signed(release, priv)
+			r.Arch = "other"
+			return r
+		}, pub, "stable", false, true},
+
+		{"signed for another channel", func() Release {
+			r := release
+			r.Channel = "beta"
+			return signed(r, priv)
+		}, pub, "stable", false, false},
+		{"signed for another platform", func() Release {
+			r := release
+			r.OS = "plan9"
+			return signed(r, priv)
+		}, pub, "stable", false, false},
+		{"plain http", func() Release {
+			r := release
+			r.URL = "http://releases.example.com/cosmicpanel-1.4.0"
+			return signed(r, priv)
+		}, pub, "stable", false, false},
+		{"no URL", func() Release {
+			r := release
+			r.URL = ""
+			return signed(r, priv)
+		}, pub, "stable", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.release().verify(tt.key, tt.channel)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			if errors.Is(err, ErrBadSignature) != tt.badSig {
+				t.Errorf("got %v, want a bad signature: %v", err, tt.badSig)
+			}
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho cosmicpanel\n")
+	sum := sha256.Sum256(binary)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cosmicpanel" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(binary)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		sha256 string
+		err    error
+	}{
+		{"matching checksum", "/cosmicpanel", hex.EncodeToString(sum[:]), nil},
+		{"checksum in upper case", "/cosmicpanel", strings.ToUpper(hex.EncodeToString(sum[:])), nil},
+		{"other checksum", "/cosmicpanel", strings.Repeat("00", 32), ErrChecksum},
+		{"no checksum", "/cosmicpanel", "", ErrChecksum},
+		{"not found", "/missing", hex.EncodeToString(sum[:]), errors.New("not found")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cosmicpanel.new")
+
+			err := download(Release{URL: srv.URL + tt.path, SHA256: tt.sha256}, path)
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatal(err)
+			case tt.err != nil && err == nil:
+				t.Fatal("the download was accepted")
+			case errors.Is(tt.err, ErrChecksum) && !errors.Is(err, ErrChecksum):
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			b, statErr := os.ReadFile(path)
+			if tt.err != nil {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("a rejected download was left at the path")
+				}
+				return
+			}
+			if string(b) != string(binary) {
+				t.Errorf("got %q", b)
+			}
+		})
+	}
+}
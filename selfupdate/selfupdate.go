@@ -0,0 +1,250 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("selfupdate: not configured")
+
+	// ErrNoKey is returned when updating without a release signing key configured
+	ErrNoKey = errors.New("selfupdate: no release signing key is configured")
+
+	// ErrBadSignature is returned when a release is not signed by the configured key
+	ErrBadSignature = errors.New("selfupdate: release signature is invalid")
+
+	// ErrChecksum is returned when a downloaded binary does not match its release
+	ErrChecksum = errors.New("selfupdate: downloaded binary does not match the release checksum")
+
+	// ErrNoPrevious is returned when rolling back without a previous binary to restore
+	ErrNoPrevious = errors.New("selfupdate: there is no previous version to roll back to")
+
+	// ErrUnhealthy is returned when a new version does not report itself healthy in time
+	ErrUnhealthy = errors.New("selfupdate: new version did not report itself healthy")
+)
+
+// Pending is an installed update that has not yet been confirmed by the new version
+// starting successfully
+type Pending struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Binary    string    `json:"binary"`
+	Installed time.Time `json:"installed"`
+	Confirmed time.Time `json:"confirmed,omitempty"`
+}
+
+// Updater replaces the panel binary with signed releases
+type Updater struct {
+	path   string
+	config *config.ReleaseConfiguration
+	key    ed25519.PublicKey
+}
+
+var std *Updater
+
+// Configure loads the release signing key
+func Configure(dataDir string, c *config.ReleaseConfiguration) error {
+	dir := filepath.Join(dataDir, "selfupdate")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	u := &Updater{path: filepath.Join(dir, "pending.json"), config: c}
+
+	if c.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("selfupdate: release public key must be a base64 encoded Ed25519 key")
+		}
+		u.key = key
+	}
+
+	std = u
+
+	return nil
+}
+
+// Latest returns the latest release on the channel, or the configured channel if it is
+// empty, once its signature has been verified
+func Latest(channel string) (Release, error) {
+	if std == nil {
+		return Release{}, ErrNotConfigured
+	}
+
+	if std.key == nil {
+		return Release{}, ErrNoKey
+	}
+
+	if channel == "" {
+		channel = std.config.Channel
+	}
+
+	r, err := fetchRelease(std.config.URL, channel)
+	if err != nil {
+		return r, err
+	}
+
+	return r, r.verify(std.key, channel)
+}
+
+// Install downloads the release and atomically replaces the binary with it, keeping the
+// binary it replaced so that it can be rolled back. The update stays pending until the
+// new version calls Confirm
+func Install(r Release, binary string, current string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	// The download is written next to the binary so that it can be renamed over it
+	next := binary + ".new"
+	if err := download(r, next); err != nil {
+		return err
+	}
+
+	previous := binary + ".previous"
+	if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Link(binary, previous); err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	if err := std.save(&Pending{From: current, To: r.Version, Binary: binary, Installed: time.Now().UTC()}); err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	if err := os.Rename(next, binary); err != nil {
+		os.Remove(next)
+		os.Remove(std.path)
+		return err
+	}
+
+	zap.S().Named("selfupdate").Infow("installed update", "from", current, "to", r.Version, "binary", binary)
+
+	return nil
+}
+
+// Confirm is called by the daemon once it has started, confirming a pending update to
+// its version. An update is never confirmed by the version it replaced, which is what
+// starts after a rollback
+func Confirm(version string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	p, err := std.load()
+	if err != nil || p == nil || p.To != version || !p.Confirmed.IsZero() {
+		return err
+	}
+
+	p.Confirmed = time.Now().UTC()
+	if err := std.save(p); err != nil {
+		return err
+	}
+
+	zap.S().Named("selfupdate").Infow("confirmed update", "from", p.From, "to", p.To)
+
+	events.Publish(events.Event{
+		Type:     "system.updated",
+		Resource: p.To,
+		Data:     map[string]interface{}{"from": p.From, "to": p.To},
+	})
+
+	return nil
+}
+
+// Wait blocks until the new version confirms the pending update, or returns
+// ErrUnhealthy once the health timeout passes
+func Wait() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	deadline := time.Now().Add(time.Duration(std.config.HealthTimeout) * time.Second)
+	for time.Now().Before(deadline) {
+		p, err := std.load()
+		if err != nil {
+			return err
+		}
+
+		if p != nil && !p.Confirmed.IsZero() {
+			return nil
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return ErrUnhealthy
+}
+
+// Rollback restores the binary the last update replaced
+func Rollback(binary string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	previous := binary + ".previous"
+	if _, err := os.Stat(previous); os.IsNotExist(err) {
+		return ErrNoPrevious
+	}
+
+	if err := os.Rename(previous, binary); err != nil {
+		return err
+	}
+
+	if err := os.Remove(std.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	zap.S().Named("selfupdate").Warnw("rolled back update", "binary", binary)
+
+	return nil
+}
+
+// load returns the pending update, or nil if there is none
+func (u *Updater) load() (*Pending, error) {
+	b, err := os.ReadFile(u.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Pending
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("selfupdate: failed to read pending update: %w", err)
+	}
+
+	return &p, nil
+}
+
+// save writes the pending update
+func (u *Updater) save(p *Pending) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, u.path)
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/access"
+	"github.com/cosmicpanel/CosmicPanel/addresses"
+	"github.com/cosmicpanel/CosmicPanel/advisor"
+	"github.com/cosmicpanel/CosmicPanel/announcements"
+	"github.com/cosmicpanel/CosmicPanel/archives"
+	"github.com/cosmicpanel/CosmicPanel/audit"
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/backups"
+	"github.com/cosmicpanel/CosmicPanel/boot"
+	"github.com/cosmicpanel/CosmicPanel/branding"
+	"github.com/cosmicpanel/CosmicPanel/bruteforce"
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/cdn"
+	"github.com/cosmicpanel/CosmicPanel/certificates"
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/crash"
+	"github.com/cosmicpanel/CosmicPanel/deliverability"
+	"github.com/cosmicpanel/CosmicPanel/diagnostics"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/externaldns"
+	"github.com/cosmicpanel/CosmicPanel/fairuse"
+	"github.com/cosmicpanel/CosmicPanel/filetransfer"
+	"github.com/cosmicpanel/CosmicPanel/firewall"
+	"github.com/cosmicpanel/CosmicPanel/initsys"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/locale"
+	"github.com/cosmicpanel/CosmicPanel/logging"
+	"github.com/cosmicpanel/CosmicPanel/mailer"
+	"github.com/cosmicpanel/CosmicPanel/malware"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/php"
+	"github.com/cosmicpanel/CosmicPanel/plugins"
+	"github.com/cosmicpanel/CosmicPanel/privacy"
+	"github.com/cosmicpanel/CosmicPanel/propagation"
+	"github.com/cosmicpanel/CosmicPanel/provisioning"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/redirects"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/reservations"
+	"github.com/cosmicpanel/CosmicPanel/router"
+	"github.com/cosmicpanel/CosmicPanel/scheduler"
+	"github.com/cosmicpanel/CosmicPanel/selfupdate"
+	"github.com/cosmicpanel/CosmicPanel/sshx"
+	"github.com/cosmicpanel/CosmicPanel/stats"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/support"
+	"github.com/cosmicpanel/CosmicPanel/systemd"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"github.com/cosmicpanel/CosmicPanel/tlspolicy"
+	"github.com/cosmicpanel/CosmicPanel/transfer"
+	"github.com/cosmicpanel/CosmicPanel/updates"
+	"github.com/cosmicpanel/CosmicPanel/vhosts"
+	"github.com/cosmicpanel/CosmicPanel/wordpress"
+	"go.uber.org/zap"
+)
+
+// serve runs the panel daemon until it is asked to stop. This is what running the binary
+// without a command does
+func serve(args []string) error {
+	o := options{daemon: true, validate: true}
+	fs := o.flags("serve", "")
+	dnsonly := fs.Bool("dnsonly", false, "Request a DNS only license instead of a trial license if this server has none")
+	parse(fs, args)
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	driver, err := initsys.Detect("")
+	if err != nil {
+		return err
+	}
+
+	build := buildinfo.Get()
+	zap.S().Infow("starting CosmicPanel", "version", build.Version, "commit", build.Commit, "built", build.Date, "go", build.GoVersion, "platform", build.Platform, "init", driver.Name())
+
+	// Every part of the daemon is started as a module so that one failing leaves the rest
+	// of the panel running. Only the modules the API cannot safely run without are
+	// critical
+	boot.Register(boot.Module{Name: "user", Start: func() error {
+		_, err := c.EnsureUser()
+		return err
+	}})
+
+	// The license server may be slow or down, which must not keep admins out of the API
+	boot.Register(boot.Module{Name: "license", Background: true, Start: func() error {
+		c.CheckLicense(*dnsonly)
+		return nil
+	}})
+
+	// Users, jobs, backups and the audit log are kept in the state store, so the API cannot
+	// run without it
+	boot.Register(boot.Module{Name: "store", Critical: true, Start: func() error {
+		return store.Configure(c.System.Data, c.Store)
+	}})
+
+	boot.Register(boot.Module{Name: "audit", Requires: []string{"store"}, Start: func() error {
+		if err := audit.Configure(filepath.Join(c.System.Data, "audit")); err != nil {
+			return err
+		}
+
+		if err := audit.Verify(); err != nil {
+			zap.S().Errorw("audit log failed verification, it may have been tampered with", zap.Error(err))
+		}
+		audit.Attach()
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "events", Start: func() error {
+		return events.ConfigureFeed(filepath.Join(c.System.Data, "events"), c.Events.Retention)
+	}})
+
+	// Background maintenance is limited so that it does not slow down the hosted sites
+	boot.Register(boot.Module{Name: "throttle", Start: func() error {
+		return throttle.Configure(c.Throttle)
+	}})
+
+	boot.Register(boot.Module{Name: "firewall", Start: func() error {
+		if err := firewall.Configure(c.System.Data, c.Firewall); err != nil {
+			return err
+		}
+
+		crash.Go("firewall", func() {
+			for range time.Tick(time.Minute) {
+				if err := firewall.Expire(); err != nil {
+					zap.S().Named("firewall").Errorw("failed to remove expired firewall rules", zap.Error(err))
+				}
+			}
+		})
+
+		if err := firewall.OpenPort("panel", c.Panel.Port, "tcp"); err != nil {
+			return fmt.Errorf("failed to open panel port: %w", err)
+		}
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "bruteforce", Requires: []string{"firewall"}, Start: func() error {
+		if err := bruteforce.Configure(c.System.Data, c.BruteForce); err != nil {
+			return err
+		}
+
+		if firewall.BackendName() == "csf" {
+			if err := bruteforce.WatchLFD(c.Firewall.CSF.LFDLog); err != nil {
+				zap.S().Warnw("failed to watch lfd log", "path", c.Firewall.CSF.LFDLog, zap.Error(err))
+			}
+		}
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "auth", Requires: []string{"store"}, Start: func() error {
+		return auth.Configure(c.System.Data, c.Auth)
+	}})
+
+	// Domains of dedicated addresses are published through the DNS providers
+	boot.Register(boot.Module{Name: "addresses", Requires: []string{"store", "externaldns"}, Start: func() error {
+		return addresses.Configure(c.System.Data, c.Network, c.PublicIPs)
+	}})
+
+	// Access control allows every request until it is configured, so the API must not
+	// come up without it
+	boot.Register(boot.Module{Name: "access", Critical: true, Start: func() error {
+		return access.Configure(c.System.Data, c.Access)
+	}})
+
+	boot.Register(boot.Module{Name: "advisor", Start: func() error {
+		if err := advisor.Configure(c.System.Data, c.Advisor); err != nil {
+			return err
+		}
+
+		crash.Go("advisor", func() {
+			for ; ; time.Sleep(time.Hour) {
+				if !advisor.Due() {
+					continue
+				}
+
+				if _, err := advisor.Scan(); err != nil {
+					zap.S().Named("advisor").Errorw("security scan failed", zap.Error(err))
+				}
+			}
+		})
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "malware", Start: func() error {
+		if err := malware.Configure(c.System.Data, c.Malware); err != nil {
+			return err
+		}
+
+		if c.Malware.Enabled {
+			crash.Go("malware", func() {
+				for ; ; time.Sleep(time.Hour) {
+					if !malware.Due() {
+						continue
+					}
+
+					if _, err := malware.ScanHomes(); err != nil {
+						zap.S().Named("malware").Errorw("malware scan failed", zap.Error(err))
+					}
+				}
+			})
+		}
+
+		if c.Malware.Enabled && c.Malware.UploadInterval > 0 {
+			crash.Go("malware", func() {
+				for range time.Tick(time.Duration(c.Malware.UploadInterval) * time.Minute) {
+					if _, err := malware.ScanUploads(); err != nil && !errors.Is(err, malware.ErrNoEngine) {
+						zap.S().Named("malware").Errorw("upload scan failed", zap.Error(err))
+					}
+				}
+			})
+		}
+
+		return nil
+	}})
+
+	// Jobs are held while maintenance mode is on, which access control knows about
+	boot.Register(boot.Module{Name: "jobs", Requires: []string{"store", "access"}, Start: func() error {
+		if err := jobs.Configure(c.System.Data, c.Jobs); err != nil {
+			return err
+		}
+
+		if access.Maintenance() != nil {
+			jobs.Pause()
+		}
+
+		jobs.Start()
+
+		return nil
+	}})
+
+	// Mass operations run their items through a job, which resumes them after a restart
+	boot.Register(boot.Module{Name: "bulk", Requires: []string{"store", "jobs"}, Start: func() error {
+		bulk.Configure(c.Bulk)
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "scheduler", Start: func() error {
+		if err := scheduler.Configure(c.System.Data, c.Scheduler); err != nil {
+			return err
+		}
+
+		if err := stats.Configure(c.System.Data, c.Stats); err != nil {
+			return err
+		}
+
+		scheduler.Register("license", func() error {
+			c.CheckLicense(*dnsonly)
+			if c.License == nil || !c.License.ValidLicense {
+				return errors.New("no valid license for this server")
+			}
+			return nil
+		})
+		scheduler.Register("activity", events.Prune)
+		scheduler.Register("stats", stats.Process)
+		scheduler.Register("digests", stats.Digests)
+		scheduler.Register("sessions", auth.ExpireSessions)
+
+		if c.Logging != nil && c.Logging.RotateDaily {
+			scheduler.Register("logs", logging.Rotate)
+		}
+
+		scheduler.Start()
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "updates", Start: func() error {
+		if err := updates.Configure(c.System.Data, c.Updates); err != nil {
+			return err
+		}
+
+		crash.Go("updates", func() {
+			for ; ; time.Sleep(time.Hour) {
+				if updates.Due() {
+					if _, err := updates.Check(); err != nil {
+						zap.S().Named("updates").Errorw("failed to check for security updates", zap.Error(err))
+					}
+				}
+
+				if updates.AutoDue() {
+					if _, err := updates.Apply("scheduled"); err != nil {
+						zap.S().Named("updates").Errorw("failed to apply security updates", zap.Error(err))
+					}
+				}
+			}
+		})
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "cluster", Requires: []string{"store"}, Start: func() error {
+		if err := cluster.Configure(c.System.Data, c.Cluster); err != nil {
+			return err
+		}
+
+		transfer.Configure(c.System.Data, c.Transfer)
+
+		// Backups register their commands before the agent starts taking commands
+		if err := backups.Configure(c.System.Data, c.Backups); err != nil {
+			return err
+		}
+		scheduler.Register("backups", backups.Scheduled)
+
+		if cluster.Role() == cluster.Controller {
+			if err := firewall.OpenPort("cluster", c.Cluster.Port, "tcp"); err != nil {
+				zap.S().Warnw("failed to open cluster port in firewall", zap.Error(err))
+			}
+		}
+
+		return cluster.Start()
+	}})
+
+	// Without a valid policy the API falls back to the defaults of the tls package
+	boot.Register(boot.Module{Name: "tls", Requires: []string{"store"}, Start: func() error {
+		if err := tlspolicy.Configure(c.TLS, c.Panel); err != nil {
+			return err
+		}
+
+		return tlspolicy.Apply()
+	}})
+
+	// Generated files are reconciled once the packages generating them have registered
+	boot.Register(boot.Module{Name: "reconcile", Requires: []string{"store", "tls", "cdn", "php", "reservations", "redirects", "vhosts"}, Start: func() error {
+		if err := reconcile.Configure(c.Reconcile); err != nil {
+			return err
+		}
+		scheduler.Register("reconcile", reconcile.Scheduled)
+
+		reconcile.Start()
+
+		return nil
+	}})
+
+	// Translations, which brands and users may only pick a language among
+	boot.Register(boot.Module{Name: "locale", Start: func() error {
+		return locale.Configure(c.System.Data, c.Locale)
+	}})
+
+	// Resellers' brands, which notifications sent before they are loaded go out without
+	boot.Register(boot.Module{Name: "branding", Requires: []string{"store", "locale"}, Start: func() error {
+		return branding.Configure(c.Branding)
+	}})
+
+	// Notifications are rendered in the recipient's brand, so their templates are loaded
+	// after the brands
+	boot.Register(boot.Module{Name: "notify", Requires: []string{"store", "branding"}, Start: func() error {
+		if err := mailer.Configure(c.Mail, c.Notify.Sendmail); err != nil {
+			return err
+		}
+
+		return notify.Configure(c.Notify)
+	}})
+
+	// Tickets opened from the panel are forwarded to the helpdesk with the account's
+	// recent failed notifications and jobs attached
+	boot.Register(boot.Module{Name: "support", Requires: []string{"store", "notify", "jobs"}, Start: func() error {
+		return support.Configure(c.Support)
+	}})
+
+	// Announcements are emailed by the scheduler once they start
+	boot.Register(boot.Module{Name: "announcements", Requires: []string{"store", "notify"}, Start: func() error {
+		scheduler.Register("announcements", announcements.Deliver)
+		return nil
+	}})
+
+	// Domains are registered at the registrar, and the scheduler completes transfers and
+	// renews domains before they expire
+	boot.Register(boot.Module{Name: "registrar", Requires: []string{"store"}, Start: func() error {
+		if err := registrar.Configure(c.Registrar); err != nil {
+			return err
+		}
+
+		scheduler.Register("domains", registrar.Sync)
+		return nil
+	}})
+
+	// Records are published at the DNS providers serving their zones
+	boot.Register(boot.Module{Name: "externaldns", Start: func() error {
+		return externaldns.Configure(c.DNS)
+	}})
+
+	// Hosts are fronted by CDNs through the DNS providers, and the web servers trust the
+	// edges of the CDNs in use
+	// Changes of records are checked to have reached the nameservers of their zone and
+	// public resolvers, through the job queue
+	boot.Register(boot.Module{Name: "propagation", Requires: []string{"store", "jobs", "externaldns"}, Start: func() error {
+		if err := propagation.Configure(c.DNS); err != nil {
+			return err
+		}
+
+		propagation.Watch()
+
+		return nil
+	}})
+
+	boot.Register(boot.Module{Name: "cdn", Requires: []string{"store", "externaldns"}, Start: func() error {
+		if err := cdn.Configure(c.CDN); err != nil {
+			return err
+		}
+		scheduler.Register("cdn", cdn.Refresh)
+
+		cdn.Watch()
+
+		return nil
+	}})
+
+	// Accounts override php.ini settings within the ceilings and set environment
+	// variables for their domains, which are rendered into their PHP-FPM pools
+	boot.Register(boot.Module{Name: "php", Requires: []string{"store"}, Start: func() error {
+		return php.Configure(c.PHP)
+	}})
+
+	// Accounts redirect paths of their domains and create short links, which the web
+	// servers serve and the statistics count the hits of
+	boot.Register(boot.Module{Name: "redirects", Requires: []string{"store"}, Start: func() error {
+		return redirects.Configure(c.Redirects)
+	}})
+
+	// Templates rolled out to the server blocks and virtual hosts of domains, which the
+	// reconciler keeps as rendered
+	boot.Register(boot.Module{Name: "vhosts", Requires: []string{"store"}, Start: func() error {
+		return vhosts.Configure(c.VHosts)
+	}})
+
+	// Terminated accounts are archived in the format of transfers, which are configured
+	// with the cluster, and purged by the scheduler once they expire
+	boot.Register(boot.Module{Name: "archives", Requires: []string{"store", "cluster"}, Start: func() error {
+		if err := archives.Configure(c.Archives); err != nil {
+			return err
+		}
+		scheduler.Register("archives", archives.Expire)
+
+		return nil
+	}})
+
+	// Accounts using more than their share of the CPU are throttled by the policies
+	boot.Register(boot.Module{Name: "fairuse", Requires: []string{"store", "auth"}, Start: func() error {
+		if err := fairuse.Configure(c.FairUse); err != nil {
+			return err
+		}
+		scheduler.Register("fairuse", fairuse.Scheduled)
+
+		return nil
+	}})
+
+	// FTP and SFTP sessions are read into the audit log, which the audit module records
+	// events into, and accounts over the transfer quota of their package are blocked
+	boot.Register(boot.Module{Name: "filetransfer", Requires: []string{"store", "auth", "audit"}, Start: func() error {
+		if err := filetransfer.Configure(c.FileTransfer, c.Stats.FTPLog); err != nil {
+			return err
+		}
+		scheduler.Register("filetransfer", filetransfer.Scheduled)
+
+		return nil
+	}})
+
+	// Packages guarantee their accounts CPU and IO weights, a memory floor and PHP-FPM
+	// workers, which the reconciler keeps in the pools of their domains
+	boot.Register(boot.Module{Name: "reservations", Requires: []string{"store", "auth"}, Start: func() error {
+		if err := reservations.Configure(c.Reservations, c.PHP); err != nil {
+			return err
+		}
+		scheduler.Register("reservations", reservations.Scheduled)
+
+		return nil
+	}})
+
+	// WordPress sites in the document roots of accounts, which are backed up with the
+	// backups the cluster module configures before they are updated in jobs
+	boot.Register(boot.Module{Name: "wordpress", Requires: []string{"store", "auth", "jobs", "cluster"}, Start: func() error {
+		if err := wordpress.Configure(c.WordPress); err != nil {
+			return err
+		}
+		scheduler.Register("wordpress", wordpress.Scheduled)
+
+		return nil
+	}})
+
+	// The mail hosted domains send is checked for what keeps it out of inboxes, with the
+	// bounces counted by the statistics the scheduler module configures
+	boot.Register(boot.Module{Name: "deliverability", Requires: []string{"store", "auth", "scheduler", "addresses"}, Start: func() error {
+		if err := deliverability.Configure(c.Deliverability, c.PublicIPs); err != nil {
+			return err
+		}
+		scheduler.Register("deliverability", deliverability.Scheduled)
+
+		return nil
+	}})
+
+	// Certificates the server presents are checked for expiry whoever issued them, since
+	// the panel issues none of its own
+	boot.Register(boot.Module{Name: "certificates", Requires: []string{"store", "auth", "scheduler", "addresses"}, Start: func() error {
+		if err := certificates.Configure(c.Certificates); err != nil {
+			return err
+		}
+		scheduler.Register("certificates", certificates.Scheduled)
+
+		return nil
+	}})
+
+	// Connections to other servers over SSH log in with the key of the panel or the
+	// credentials of a destination, both kept in the vault
+	boot.Register(boot.Module{Name: "ssh", Requires: []string{"store"}, Start: func() error {
+		return sshx.Configure(c.SSH)
+	}})
+
+	// Personal data of accounts is exported on request, and erased once they are
+	// terminated
+	boot.Register(boot.Module{Name: "privacy", Requires: []string{"store", "jobs", "archives"}, Start: func() error {
+		privacy.Configure(c.Transfer.Homes)
+		return nil
+	}})
+
+	// Billing systems provision accounts through jobs, so that they can follow and retry them
+	boot.Register(boot.Module{Name: "provisioning", Requires: []string{"store", "auth", "jobs", "archives"}, Start: func() error {
+		provisioning.Configure(c.Transfer.Homes, c.Provisioning)
+		return nil
+	}})
+
+	// Plugins are only found here. They are started once the daemon has dropped its
+	// privileges
+	boot.Register(boot.Module{Name: "plugins", Requires: []string{"store", "jobs"}, Start: func() error {
+		return plugins.Configure(c.System.Data, c.System.User.Uid, c.System.User.Gid, c.Plugins)
+	}})
+
+	srv := &http.Server{
+		Addr: config.ListenAddress(c.Panel.Host, c.Panel.Port),
+	}
+
+	// The listener the API accepts connections on, which is replaced when the address
+	// changes on reload
+	var listener net.Listener
+
+	listen := func(l net.Listener) {
+		secure := c.Panel.Certificate != "" && c.Panel.Key != ""
+
+		crash.Go("api", func() {
+			zap.S().Infow("panel API listening", "address", l.Addr().String(), "tls", secure)
+
+			var err error
+			if secure {
+				err = srv.ServeTLS(l, c.Panel.Certificate, c.Panel.Key)
+			} else {
+				err = srv.Serve(l)
+			}
+
+			// A listener is closed once the API has moved to another address
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				zap.S().Fatalw("panel API stopped unexpectedly", zap.Error(err))
+			}
+		})
+	}
+
+	boot.Register(boot.Module{Name: "api", Requires: []string{"access"}, Critical: true, Start: func() error {
+		srv.Handler = router.Configure(c)
+		srv.TLSConfig = tlspolicy.Config()
+
+		// The listener is opened here so that systemd is only told the daemon is ready once
+		// the API accepts connections
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+		listener = l
+
+		listen(l)
+
+		return nil
+	}})
+
+	// Debug mode, the logging levels and the address of the API are applied when the
+	// configuration is reloaded, on SIGHUP or when its file changes
+	c.OnReload(func(c *config.Configuration) {
+		if err := logging.Reload(c.DebugMode(), c.Logging); err != nil {
+			zap.S().Errorw("failed to apply reloaded logging levels", zap.Error(err))
+		}
+	})
+
+	c.OnReload(func(c *config.Configuration) {
+		host, port := c.PanelAddress()
+		addr := config.ListenAddress(host, port)
+		if listener == nil || addr == srv.Addr {
+			return
+		}
+
+		// Ports below 1024 cannot be bound once privileges were dropped, in which case the
+		// API stays where it is
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			zap.S().Errorw("failed to move panel API, it keeps listening on its current address", "address", srv.Addr, zap.Error(err))
+			return
+		}
+
+		if err := firewall.ClosePorts("panel"); err != nil {
+			zap.S().Warnw("failed to close the previous panel port", zap.Error(err))
+		}
+		if err := firewall.OpenPort("panel", port, "tcp"); err != nil {
+			zap.S().Warnw("failed to open panel port", "port", port, zap.Error(err))
+		}
+
+		previous := listener
+		listener, srv.Addr = l, addr
+		listen(l)
+
+		// Connections already accepted on the previous address are served until they close
+		previous.Close()
+	})
+
+	diag := diagnostics.New(c.Diagnostics)
+
+	boot.Register(boot.Module{Name: "diagnostics", Start: func() error {
+		if c.Diagnostics.Enabled {
+			return diag.Enable()
+		}
+		return nil
+	}})
+
+	// Reaching this point is the health check for an update installed by self-update
+	boot.Register(boot.Module{Name: "selfupdate", Requires: []string{"api"}, Start: func() error {
+		if err := selfupdate.Configure(c.System.Data, c.Release); err != nil {
+			return err
+		}
+
+		return selfupdate.Confirm(buildinfo.Get().Version)
+	}})
+
+	if err := boot.Run(); err != nil {
+		return err
+	}
+
+	// Everything that needs root to start, such as binding the listeners, is done by now
+	if c.System.DropPrivileges {
+		if err := dropPrivileges(c); err != nil {
+			return fmt.Errorf("failed to drop privileges: %w", err)
+		}
+	}
+
+	plugins.Start()
+
+	if err := systemd.Ready(); err != nil {
+		zap.S().Warnw("failed to notify systemd the daemon is ready", zap.Error(err))
+	}
+
+	crash.Go("systemd", func() {
+		systemd.Watchdog(func() error {
+			conn, err := net.DialTimeout("tcp", dialAddress(c.PanelAddress()), 5*time.Second)
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		})
+	})
+
+	crash.Go("config", func() {
+		c.Watch(5 * time.Second)
+	})
+
+	// Block until the daemon is asked to stop. SIGUSR1 toggles the diagnostics server so
+	// that profiles can be captured from a running daemon without restarting it, and
+	// SIGHUP reloads the configuration
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			c.Apply()
+			continue
+		}
+
+		if sig != syscall.SIGUSR1 {
+			break
+		}
+
+		if enabled, err := diag.Toggle(); err != nil {
+			zap.S().Errorw("failed to toggle diagnostics server", zap.Error(err))
+		} else {
+			zap.S().Infow("toggled diagnostics server", "enabled", enabled)
+		}
+	}
+
+	zap.S().Infow("shutting down")
+	systemd.Stopping()
+	diag.Disable()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		zap.S().Errorw("failed to gracefully stop panel API", zap.Error(err))
+	}
+
+	plugins.Stop()
+
+	logging.Close()
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cosmicpanel/CosmicPanel/initsys"
+)
+
+// service installs the daemon as a service of the init system, so that it is started on
+// boot, restarted when it fails and, under systemd, supervised by the watchdog
+func service(args []string) error {
+	var o options
+	fs := o.flags("service", "install|uninstall|unit")
+	initSystem := fs.String("init", "auto", "The init system, one of auto, systemd, openrc, runit or rcd")
+	binary := fs.String("binary", "", "The binary the service runs, defaults to this one")
+	unit := fs.String("unit", "", "Where the service is written, defaults to where the init system keeps services")
+	watchdog := fs.Int("watchdog", 60, "How many seconds systemd waits to hear from the daemon before restarting it")
+	now := fs.Bool("now", false, "Start the service, or restart it if it is running, once installed")
+	args = parse(fs, args)
+
+	driver, err := initsys.Detect(*initSystem)
+	if err != nil {
+		return err
+	}
+
+	if *unit == "" {
+		*unit = driver.Path()
+	}
+
+	action := arg(args, 0)
+	if action == "uninstall" {
+		if err := driver.Uninstall(*unit); err != nil {
+			return err
+		}
+
+		return o.print(map[string]string{"removed": *unit}, func() error {
+			fmt.Printf("Removed %s\n", *unit)
+			return nil
+		})
+	}
+
+	if action != "install" && action != "unit" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		if *binary, err = filepath.EvalSymlinks(exe); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := filepath.Abs(o.config)
+	if err != nil {
+		return err
+	}
+
+	d := initsys.Daemon{Binary: *binary, Config: cfg, WatchdogSec: *watchdog}
+
+	if action == "unit" {
+		b, err := driver.Render(d)
+		if err != nil {
+			return err
+		}
+
+		return o.print(map[string]string{"unit": string(b)}, func() error {
+			_, err := os.Stdout.Write(b)
+			return err
+		})
+	}
+
+	// The configuration is checked first since a unit for a daemon that cannot start
+	// would only restart it in a loop
+	if _, err := bootstrap(&o); err != nil {
+		return err
+	}
+
+	if err := driver.Install(d, *unit, *now); err != nil {
+		return err
+	}
+
+	return o.print(map[string]interface{}{"installed": *unit, "init": driver.Name(), "started": *now}, func() error {
+		fmt.Printf("Installed and enabled %s with %s\n", *unit, driver.Name())
+		return nil
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/lsm"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// setup walks through the first boot of a server: its hostname, the data directory, how
+// the panel is served, which services it manages, the first admin and the license. The
+// answers are written to the configuration and the state they need is created, so that
+// the daemon can be started straight afterwards. Every question can be answered with a
+// flag, and -yes accepts the flags and defaults without asking
+func setup(args []string) error {
+	var o options
+	fs := o.flags("setup", "")
+	yes := fs.Bool("yes", false, "Accept the flags and defaults without asking")
+	hostname := fs.String("hostname", "", "The hostname of this server, defaults to the current one")
+	data := fs.String("data", "", "The data directory, defaults to the configured one")
+	port := fs.Int("port", 0, "The port the panel listens on, defaults to the configured one")
+	certificate := fs.String("certificate", "", "The certificate the panel serves, self-signed to generate one or none to serve plain HTTP")
+	key := fs.String("key", "", "The key of the certificate")
+	modules := fs.String("modules", "", "The services the panel manages, a comma separated list of web, mail, dns and database")
+	admin := fs.String("admin", "admin", "The username of the first admin")
+	email := fs.String("email", "", "The email address of the first admin")
+	password := fs.String("password", "", "The password of the first admin")
+	dnsonly := fs.Bool("dnsonly", false, "Request a DNS only license instead of a trial license")
+	parse(fs, args)
+
+	// Questions and progress go to stderr when the result is printed for scripts, so that
+	// stdout only holds the result
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout, yes: *yes}
+	if o.output != "table" {
+		p.out = os.Stderr
+	}
+
+	c, err := config.ReadConfiguration(o.config)
+	if os.IsNotExist(err) {
+		c, err = config.NewConfiguration(o.config), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "Setting up CosmicPanel, the configuration is written to %s\n\n", o.config)
+
+	// Hostname
+	current, _ := os.Hostname()
+	host := p.ask("Hostname", first(*hostname, current))
+	if host != current {
+		if err := setHostname(host); err != nil {
+			return err
+		}
+	}
+
+	// Data directory and panel listener
+	c.System.Data = p.ask("Data directory", first(*data, c.System.Data))
+
+	if *port != 0 {
+		c.Panel.Port = *port
+	}
+	if c.Panel.Port, err = p.askInt("Panel port", c.Panel.Port); err != nil {
+		return err
+	}
+
+	defaultCertificate := "self-signed"
+	if c.Panel.Certificate != "" {
+		defaultCertificate = c.Panel.Certificate
+	}
+
+	cert := p.ask("TLS certificate file, self-signed to generate one or none to serve plain HTTP", first(*certificate, defaultCertificate))
+	switch cert {
+	case "none":
+		c.Panel.Certificate, c.Panel.Key = "", ""
+	case "self-signed":
+	default:
+		c.Panel.Certificate = cert
+		c.Panel.Key = p.ask("TLS key file", first(*key, c.Panel.Key))
+	}
+
+	// Modules
+	if *modules != "" {
+		enabled := make(map[string]bool)
+		for _, m := range strings.Split(*modules, ",") {
+			enabled[strings.TrimSpace(m)] = true
+		}
+
+		c.Modules.Web, c.Modules.Mail, c.Modules.DNS, c.Modules.Database = enabled["web"], enabled["mail"], enabled["dns"], enabled["database"]
+	}
+
+	c.Modules.Web = p.confirm("Manage web servers", c.Modules.Web)
+	c.Modules.Mail = p.confirm("Manage mail servers", c.Modules.Mail)
+	c.Modules.DNS = p.confirm("Manage DNS zones", c.Modules.DNS)
+	c.Modules.Database = p.confirm("Manage databases", c.Modules.Database)
+
+	if err := c.WriteToDisk(); err != nil {
+		return err
+	}
+
+	// Everything from here on needs the configuration in place
+	if c, err = bootstrap(&o); err != nil {
+		return err
+	}
+
+	u, err := c.EnsureUser()
+	if err != nil {
+		return fmt.Errorf("failed to create the system user: %w", err)
+	}
+
+	if err := os.MkdirAll(c.System.Data, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Chown(c.System.Data, c.System.User.Uid, c.System.User.Gid); err != nil {
+		return err
+	}
+
+	// The daemon would be denied its own files on servers enforcing SELinux or AppArmor
+	if st := lsm.Detect(); st.Module != "" && !st.Installed {
+		policy, err := lsmPolicy(c, "")
+		if err == nil {
+			err = lsm.Install(policy)
+		}
+
+		if err != nil {
+			fmt.Fprintf(p.out, "Failed to install the %s policy, retry with cosmicpanel lsm install: %v\n", st.Module, err)
+		} else {
+			fmt.Fprintf(p.out, "Installed the %s policy\n", st.Module)
+		}
+	}
+
+	if cert == "self-signed" {
+		if c.Panel.Certificate, c.Panel.Key, err = selfSigned(c, host); err != nil {
+			return err
+		}
+
+		if err := c.WriteToDisk(); err != nil {
+			return err
+		}
+	}
+
+	// First admin
+	if err := store.Configure(c.System.Data, c.Store); err != nil {
+		return err
+	}
+
+	if err := auth.Configure(c.System.Data, c.Auth); err != nil {
+		return err
+	}
+
+	if existing := firstAdmin(); existing != "" {
+		fmt.Fprintf(p.out, "\nAn admin already exists (%s), skipping admin creation\n", existing)
+	} else {
+		fmt.Fprintln(p.out)
+		username := p.ask("Admin username", *admin)
+		address := p.ask("Admin email", *email)
+
+		pw := *password
+		if pw == "" {
+			if pw, err = p.password("Admin password"); err != nil {
+				return err
+			}
+		}
+
+		if _, err := auth.CreateUser(auth.User{Username: username, Email: address, Role: auth.RoleAdmin}, pw); err != nil {
+			return err
+		}
+	}
+
+	// License
+	if p.confirm("Activate the license now", true) {
+		c.CheckLicense(p.confirm("Request a DNS only license if this server has none", *dnsonly))
+
+		if c.License != nil && c.License.ValidLicense {
+			fmt.Fprintf(p.out, "License is valid (%s)\n", licenseTypes[c.License.LicenseType])
+		} else {
+			fmt.Fprintln(p.out, "No valid license yet, one has been requested for this server's IP address")
+		}
+	}
+
+	scheme := "https"
+	if c.Panel.Certificate == "" {
+		scheme = "http"
+	}
+
+	res := setupResult{
+		User:   u.Username,
+		UID:    u.Uid,
+		Data:   c.System.Data,
+		Panel:  scheme + "://" + net.JoinHostPort(host, strconv.Itoa(c.Panel.Port)),
+		Config: o.config,
+	}
+
+	return o.print(res, func() error {
+		fmt.Printf("\nSystem user: %s (uid %s)\nData directory: %s\nPanel: %s\n", res.User, res.UID, res.Data, res.Panel)
+		fmt.Printf("\nStart the panel with: cosmicpanel service install -config %s -now\n", o.config)
+		return nil
+	})
+}
+
+// setupResult is what the setup wizard configured
+type setupResult struct {
+	User   string `json:"user"`
+	UID    string `json:"uid"`
+	Data   string `json:"data"`
+	Panel  string `json:"panel"`
+	Config string `json:"config"`
+}
+
+// prompter asks the questions of the setup wizard
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	yes bool
+}
+
+// ask returns the answer to the question, or the default if the answer is empty
+func (p *prompter) ask(question string, def string) string {
+	if p.yes {
+		return def
+	}
+
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	line, _ := p.in.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+
+	return def
+}
+
+// askInt asks a question with a numeric answer
+func (p *prompter) askInt(question string, def int) (int, error) {
+	answer := p.ask(question, strconv.Itoa(def))
+
+	n, err := strconv.Atoi(answer)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, not %q", strings.ToLower(question), answer)
+	}
+
+	return n, nil
+}
+
+// confirm asks a yes or no question
+func (p *prompter) confirm(question string, def bool) bool {
+	d := "n"
+	if def {
+		d = "y"
+	}
+
+	switch strings.ToLower(p.ask(question+" (y/n)", d)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	default:
+		return def
+	}
+}
+
+// password asks for a password twice without echoing it when stdin is a terminal
+func (p *prompter) password(question string) (string, error) {
+	if p.yes {
+		return "", errors.New("a password is required, pass it with -password")
+	}
+
+	if terminal() {
+		echo(false)
+		defer echo(true)
+	}
+
+	fmt.Fprintf(p.out, "%s: ", question)
+	entered, _ := p.in.ReadString('\n')
+	fmt.Fprintf(p.out, "\nRepeat %s: ", strings.ToLower(question))
+	repeated, _ := p.in.ReadString('\n')
+	fmt.Fprintln(p.out)
+
+	if entered != repeated {
+		return "", errors.New("passwords do not match")
+	}
+
+	return strings.TrimRight(entered, "\r\n"), nil
+}
+
+// terminal returns true if stdin is a terminal
+func terminal() bool {
+	info, err := os.Stdin.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// echo turns echoing of typed characters on or off
+func echo(on bool) {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// first returns the first value that is not empty
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// firstAdmin returns the username of an admin, or an empty string if there is none
+func firstAdmin() string {
+	for _, u := range auth.Users() {
+		if u.Role == auth.RoleAdmin {
+			return u.Username
+		}
+	}
+
+	return ""
+}
+
+// setHostname changes the hostname of the server
+func setHostname(hostname string) error {
+	if _, err := exec.LookPath("hostnamectl"); err == nil {
+		if out, err := exec.Command("hostnamectl", "set-hostname", hostname).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set hostname: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+
+		return nil
+	}
+
+	if err := os.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("hostname", hostname).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set hostname: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// selfSigned generates a self-signed certificate for the panel in the data directory,
+// returning the paths of the certificate and key. It lets the panel be reached over
+// HTTPS straight away, until it is replaced with a trusted certificate. It is valid for
+// both the public addresses of the server and the private ones behind NAT
+func selfSigned(c *config.Configuration, hostname string) (string, string, error) {
+	dir := filepath.Join(c.System.Data, "tls")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"CosmicPanel"}},
+		DNSNames:              []string{hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	local4, local6 := config.GetOutboundIPs()
+	public4, public6 := c.PublicIPs()
+	for _, addr := range []string{public4, public6, local4, local6} {
+		if ip := net.ParseIP(addr); ip != nil && !slices.ContainsFunc(tmpl.IPAddresses, ip.Equal) {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certPath, keyPath := filepath.Join(dir, "panel.crt"), filepath.Join(dir, "panel.key")
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", err
+	}
+
+	return certPath, keyPath, nil
+}
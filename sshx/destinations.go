@@ -0,0 +1,317 @@
+package sshx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotFound is returned for a destination that does not exist
+	ErrNotFound = errors.New("sshx: destination not found")
+
+	// ErrInvalidDestination is returned for a destination without a valid name, host,
+	// port, user or way of logging in
+	ErrInvalidDestination = errors.New("sshx: invalid destination")
+)
+
+// How the panel logs in to a destination
+const (
+	// The key of the panel, which is added to the authorized_keys of the user
+	AuthPanelKey = "panel-key"
+
+	// A password or a private key of the destination's own, kept in the vault
+	AuthPassword = "password"
+	AuthKey      = "key"
+)
+
+// validName matches the names of destinations, which are part of the name of the
+// vault secret their credentials are kept in
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// destinationKind is what destinations are kept under in the state store
+const destinationKind = "ssh.destination"
+
+// Destination is a server the panel connects to over SSH, such as to store backups on
+// or to migrate accounts from
+type Destination struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	User string `json:"user"`
+
+	// How the panel logs in, one of panel-key, password or key
+	Auth string `json:"auth"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Credentials are the password or private key a destination is logged in to with. They
+// are kept in the vault and never returned
+type Credentials struct {
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// Test is the result of connecting and logging in to a destination
+type Test struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+
+	// The software the server runs and its host key, when it got that far
+	Version     string `json:"version,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Milliseconds connecting and logging in took
+	Latency int64 `json:"latency"`
+}
+
+// Destinations returns every destination, sorted by name
+func Destinations() ([]Destination, error) {
+	list := []Destination{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(destinationKind, func(id string, data []byte) error {
+			var d Destination
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("sshx: malformed destination %s: %w", id, err)
+			}
+
+			list = append(list, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(list, func(a, b Destination) int { return strings.Compare(a.Name, b.Name) })
+
+	return list, nil
+}
+
+// Get returns the destination
+func Get(name string) (Destination, error) {
+	var d Destination
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(destinationKind, name, &d)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Destination{}, ErrNotFound
+	}
+
+	return d, err
+}
+
+// Save creates or replaces the destination. Credentials that are left empty keep those
+// stored before, so that a destination is changed without sending them again
+func Save(d Destination, c Credentials) (Destination, error) {
+	if d.Port == 0 {
+		d.Port = 22
+	}
+
+	switch {
+	case !validName.MatchString(d.Name):
+		return Destination{}, fmt.Errorf("%w, names may only contain a-z, 0-9, '.', '-' and '_'", ErrInvalidDestination)
+	case d.Host == "" || strings.ContainsAny(d.Host, " /@"):
+		return Destination{}, fmt.Errorf("%w, it needs a host name or address", ErrInvalidDestination)
+	case d.Port < 1 || d.Port > 65535:
+		return Destination{}, fmt.Errorf("%w, the port must be from 1 to 65535", ErrInvalidDestination)
+	case d.User == "":
+		return Destination{}, fmt.Errorf("%w, it needs a user to log in as", ErrInvalidDestination)
+	case d.Auth != AuthPanelKey && d.Auth != AuthPassword && d.Auth != AuthKey:
+		return Destination{}, fmt.Errorf("%w, auth must be panel-key, password or key", ErrInvalidDestination)
+	}
+
+	before, err := Get(d.Name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Destination{}, err
+	}
+
+	stored, err := credentials(d.Name)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	if c == (Credentials{}) && before.Auth == d.Auth {
+		c = stored
+	}
+
+	switch d.Auth {
+	case AuthPassword:
+		if c.Password == "" {
+			return Destination{}, fmt.Errorf("%w, password auth needs a password", ErrInvalidDestination)
+		}
+		c = Credentials{Password: c.Password}
+	case AuthKey:
+		if _, err := signer(c); err != nil {
+			return Destination{}, fmt.Errorf("%w, key auth needs a private key that can be read: %w", ErrInvalidDestination, err)
+		}
+		c.Password = ""
+	default:
+		c = Credentials{}
+	}
+
+	now := time.Now().UTC()
+	d.Created, d.Updated = before.Created, now
+	if d.Created.IsZero() {
+		d.Created = now
+	}
+
+	if err := setCredentials(d.Name, c); err != nil {
+		return Destination{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Put(destinationKind, d.Name, d)
+	})
+	if err != nil {
+		return Destination{}, err
+	}
+
+	return d, nil
+}
+
+// Delete removes the destination and its credentials. The host key pinned for its
+// server is kept, since other destinations may use the same server
+func Delete(name string) (Destination, error) {
+	d, err := Get(name)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	if err := setCredentials(name, Credentials{}); err != nil {
+		return Destination{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(destinationKind, name)
+	})
+	if err != nil {
+		return Destination{}, err
+	}
+
+	return d, nil
+}
+
+// TestDestination connects and logs in to the destination, reporting how far it got
+func TestDestination(ctx context.Context, name string) (Test, error) {
+	d, err := Get(name)
+	if err != nil {
+		return Test{}, err
+	}
+
+	start := time.Now()
+	client, err := Dial(ctx, name)
+	if errors.Is(err, ErrNotConfigured) {
+		return Test{}, err
+	}
+
+	t := Test{Connected: err == nil, Latency: time.Since(start).Milliseconds()}
+	if err != nil {
+		t.Error = err.Error()
+		return t, nil
+	}
+	defer client.Close()
+
+	t.Version = string(client.ServerVersion())
+	if h, err := GetHost(net.JoinHostPort(d.Host, strconv.Itoa(d.Port))); err == nil {
+		t.Fingerprint = h.Fingerprint
+	}
+
+	return t, nil
+}
+
+// auth returns the ways of logging in to the destination
+func (c *connector) auth(d Destination) ([]ssh.AuthMethod, error) {
+	if d.Auth == AuthPanelKey {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return []ssh.AuthMethod{ssh.PublicKeys(c.signer)}, nil
+	}
+
+	cred, err := credentials(d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Auth == AuthPassword {
+		return []ssh.AuthMethod{ssh.Password(cred.Password)}, nil
+	}
+
+	s, err := signer(cred)
+	if err != nil {
+		return nil, fmt.Errorf("sshx: failed to read the key of destination %s: %w", d.Name, err)
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(s)}, nil
+}
+
+// signer parses the private key of the credentials
+func signer(c Credentials) (ssh.Signer, error) {
+	if c.PrivateKey == "" {
+		return nil, errors.New("no private key")
+	}
+
+	if c.Passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase([]byte(c.PrivateKey), []byte(c.Passphrase))
+	}
+
+	return ssh.ParsePrivateKey([]byte(c.PrivateKey))
+}
+
+// secretName returns the vault secret the credentials of the destination are kept in
+func secretName(name string) string {
+	return "ssh/destinations/" + name
+}
+
+// credentials returns the credentials kept for the destination, which are empty for one
+// without any
+func credentials(name string) (Credentials, error) {
+	s, err := vault.Get(secretName(name))
+	if errors.Is(err, vault.ErrNotFound) {
+		return Credentials{}, nil
+	} else if err != nil {
+		return Credentials{}, err
+	}
+
+	var c Credentials
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		return Credentials{}, fmt.Errorf("sshx: malformed credentials of destination %s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// setCredentials keeps the credentials of the destination in the vault, removing them
+// when they are empty
+func setCredentials(name string, c Credentials) error {
+	if c == (Credentials{}) {
+		if err := vault.Delete(secretName(name)); err != nil && !errors.Is(err, vault.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return vault.Set(secretName(name), string(b))
+}
@@ -0,0 +1,235 @@
+package sshx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrHostNotFound is returned for a server without a pinned host key
+	ErrHostNotFound = errors.New("sshx: no host key is pinned for the server")
+
+	// ErrFingerprintMismatch is returned when pinning the key of a server that presents
+	// a key with a different fingerprint than the one given
+	ErrFingerprintMismatch = errors.New("sshx: the server presented a host key with a different fingerprint")
+
+	// ErrInvalidHostKey is returned when pinning a key that cannot be parsed, or without
+	// either a key or a fingerprint
+	ErrInvalidHostKey = errors.New("sshx: invalid host key, give the key in authorized_keys format or its SHA256 fingerprint")
+)
+
+// PinnedOnFirstUse is who pinned a host key that was trusted the first time the panel
+// connected to the server
+const PinnedOnFirstUse = "first use"
+
+// errScanned aborts a connection once the host key of the server is known
+var errScanned = errors.New("sshx: host key scanned")
+
+// KnownHost is a server and the host key pinned for it
+type KnownHost struct {
+	// The host and port of the server, as host:port
+	Address string `json:"address"`
+
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+
+	// The admin who pinned the key, or first use
+	PinnedBy string    `json:"pinned_by"`
+	Pinned   time.Time `json:"pinned"`
+}
+
+// hostKind is what the pinned host keys are kept under in the state store
+const hostKind = "ssh.host"
+
+// Hosts returns the servers with a pinned host key, sorted by address
+func Hosts() ([]KnownHost, error) {
+	list := []KnownHost{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(hostKind, func(id string, data []byte) error {
+			var h KnownHost
+			if err := json.Unmarshal(data, &h); err != nil {
+				return fmt.Errorf("sshx: malformed known host %s: %w", id, err)
+			}
+
+			list = append(list, h)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(list, func(a, b KnownHost) int { return strings.Compare(a.Address, b.Address) })
+
+	return list, nil
+}
+
+// GetHost returns the host key pinned for the server at the address
+func GetHost(address string) (KnownHost, error) {
+	var h KnownHost
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(hostKind, strings.ToLower(address), &h)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return KnownHost{}, ErrHostNotFound
+	}
+
+	return h, err
+}
+
+// Scan connects to the server and returns the host key it presents, without logging in
+// or pinning it, so that an admin can compare its fingerprint with the one the server
+// reports
+func Scan(ctx context.Context, host string, port int) (KnownHost, error) {
+	if std == nil {
+		return KnownHost{}, ErrNotConfigured
+	}
+
+	var scanned KnownHost
+	cc := &ssh.ClientConfig{
+		User: "cosmicpanel",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			scanned = knownHost(net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port)), key)
+			return errScanned
+		},
+	}
+
+	_, err := std.dial(ctx, host, port, cc)
+	if !errors.Is(err, errScanned) {
+		if err == nil {
+			err = errors.New("sshx: the server did not present a host key")
+		}
+		return KnownHost{}, err
+	}
+
+	return scanned, nil
+}
+
+// Pin trusts the host key for the server, replacing any key pinned before. A key is
+// pinned as given, while a fingerprint is checked against the key the server presents
+func Pin(ctx context.Context, host string, port int, key string, fingerprint string, actor string) (KnownHost, error) {
+	var h KnownHost
+
+	switch {
+	case key != "":
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return KnownHost{}, fmt.Errorf("%w: %w", ErrInvalidHostKey, err)
+		}
+		h = knownHost(net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port)), parsed)
+
+		if fingerprint != "" && fingerprint != h.Fingerprint {
+			return KnownHost{}, fmt.Errorf("%w, the key is %s", ErrFingerprintMismatch, h.Fingerprint)
+		}
+	case fingerprint != "":
+		var err error
+		if h, err = Scan(ctx, host, port); err != nil {
+			return KnownHost{}, err
+		}
+
+		if fingerprint != h.Fingerprint {
+			return KnownHost{}, fmt.Errorf("%w, it presented %s", ErrFingerprintMismatch, h.Fingerprint)
+		}
+	default:
+		return KnownHost{}, ErrInvalidHostKey
+	}
+
+	h.PinnedBy = actor
+
+	err := store.Update(func(tx *store.Tx) error {
+		return tx.Put(hostKind, h.Address, h)
+	})
+	if err != nil {
+		return KnownHost{}, err
+	}
+
+	return h, nil
+}
+
+// Forget removes the host key pinned for the server, such as after it was reinstalled.
+// Under the tofu policy the key it presents next is pinned again
+func Forget(address string) (KnownHost, error) {
+	var h KnownHost
+
+	err := store.Update(func(tx *store.Tx) error {
+		if err := tx.Get(hostKind, strings.ToLower(address), &h); err != nil {
+			return err
+		}
+
+		return tx.Delete(hostKind, h.Address)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return KnownHost{}, ErrHostNotFound
+	}
+
+	return h, err
+}
+
+// verify returns the callback checking the host key of the server at the address
+// against the one pinned for it, pinning it on first use if the policy allows
+func (c *connector) verify(address string) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		presented := knownHost(address, key)
+
+		pinned, err := GetHost(address)
+		switch {
+		case err == nil && pinned.Key == presented.Key:
+			return nil
+		case err == nil:
+			events.Publish(events.Event{
+				Type:     "ssh.host.mismatch",
+				Resource: address,
+				Data:     map[string]interface{}{"pinned": pinned.Fingerprint, "presented": presented.Fingerprint},
+			})
+			return fmt.Errorf("%w, %s presented %s but %s is pinned", ErrHostKeyChanged, address, presented.Fingerprint, pinned.Fingerprint)
+		case !errors.Is(err, ErrHostNotFound):
+			return err
+		case c.config.HostKeys == Strict:
+			return fmt.Errorf("%w, %s presented %s", ErrUnknownHost, address, presented.Fingerprint)
+		}
+
+		presented.PinnedBy = PinnedOnFirstUse
+
+		err = store.Update(func(tx *store.Tx) error {
+			return tx.Put(hostKind, address, presented)
+		})
+		if err != nil {
+			return err
+		}
+
+		zap.S().Named("ssh").Infow("pinned host key on first use", "address", address, "fingerprint", presented.Fingerprint)
+		events.Publish(events.Event{
+			Type:     "ssh.host.pin",
+			Resource: address,
+			Data:     map[string]interface{}{"fingerprint": presented.Fingerprint, "pinned_by": presented.PinnedBy},
+		})
+
+		return nil
+	}
+}
+
+// knownHost returns the key of the server at the address as it is pinned
+func knownHost(address string, key ssh.PublicKey) KnownHost {
+	return KnownHost{
+		Address:     address,
+		Type:        key.Type(),
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Pinned:      time.Now().UTC(),
+	}
+}
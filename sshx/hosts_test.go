@@ -0,0 +1,100 @@
+package sshx
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestScan(t *testing.T) {
+	configure(t, Strict)
+	srv := serve(t)
+
+	h, err := Scan(context.Background(), srv.host, srv.port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Address != srv.address() || h.Type != ssh.KeyAlgoED25519 || h.Fingerprint != ssh.FingerprintSHA256(srv.hostKey.PublicKey()) {
+		t.Errorf("scanned %+v", h)
+	}
+
+	// Scanning neither logs in nor pins the key
+	if _, err := GetHost(srv.address()); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("the scanned key was pinned: %v", err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	configure(t, Strict)
+	srv := serve(t)
+
+	own := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(srv.hostKey.PublicKey())))
+	fingerprint := ssh.FingerprintSHA256(srv.hostKey.PublicKey())
+	other := newSigner(t).PublicKey()
+
+	tests := []struct {
+		name        string
+		key         string
+		fingerprint string
+		pinned      string
+		err         error
+	}{
+		{"key", own + " root@backup", "", fingerprint, nil},
+		{"key and fingerprint", own, fingerprint, fingerprint, nil},
+		{"fingerprint of the key presented", "", fingerprint, fingerprint, nil},
+		{"another key", string(ssh.MarshalAuthorizedKey(other)), "", ssh.FingerprintSHA256(other), nil},
+
+		{"fingerprint of another key", "", ssh.FingerprintSHA256(other), "", ErrFingerprintMismatch},
+		{"key with another fingerprint", own, ssh.FingerprintSHA256(other), "", ErrFingerprintMismatch},
+		{"invalid key", "ssh-ed25519 AAAA", "", "", ErrInvalidHostKey},
+		{"nothing", "", "", "", ErrInvalidHostKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Forget(srv.address()); err != nil && !errors.Is(err, ErrHostNotFound) {
+				t.Fatal(err)
+			}
+
+			h, err := Pin(context.Background(), srv.host, srv.port, tt.key, tt.fingerprint, "admin")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+
+			stored, serr := GetHost(srv.address())
+			if tt.err != nil {
+				if !errors.Is(serr, ErrHostNotFound) {
+					t.Errorf("pinned %+v, %v", stored, serr)
+				}
+				return
+			}
+			if h.Fingerprint != tt.pinned || stored.Fingerprint != tt.pinned || stored.PinnedBy != "admin" {
+				t.Errorf("pinned %+v, stored %+v", h, stored)
+			}
+		})
+	}
+
+	if _, err := Pin(context.Background(), "BACKUP.example.com", 2222, own, "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetHost("backup.example.com:2222"); err != nil {
+		t.Errorf("pinned host: %v", err)
+	}
+	if h, err := Forget("Backup.example.com:2222"); err != nil || h.Address != "backup.example.com:2222" {
+		t.Errorf("forgot %+v, %v", h, err)
+	}
+	if _, err := Forget("backup.example.com:2222"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("forgetting again: %v", err)
+	}
+
+	if _, err := Pin(context.Background(), srv.host, srv.port, own, "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Hosts()
+	if err != nil || len(list) != 1 || list[0].Address != srv.address() {
+		t.Errorf("hosts %+v, %v", list, err)
+	}
+}
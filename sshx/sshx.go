@@ -0,0 +1,225 @@
+package sshx
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotConfigured is returned when connecting before Configure is called
+	ErrNotConfigured = errors.New("sshx: not configured")
+
+	// ErrUnknownHost is returned when connecting to a server without a pinned host key
+	// while only keys pinned by an admin are trusted
+	ErrUnknownHost = errors.New("sshx: the server is not a known host, and only host keys pinned by an admin are trusted")
+
+	// ErrHostKeyChanged is returned when a server presents a different host key than
+	// the one pinned for it, which is either a reinstalled server or someone in between
+	ErrHostKeyChanged = errors.New("sshx: the host key of the server changed")
+)
+
+// The policies for trusting the host key of a server the panel has not connected to
+const (
+	TOFU   = "tofu"
+	Strict = "strict"
+)
+
+// keySecret is the vault secret the private key of the panel is kept in
+const keySecret = "ssh/key"
+
+// PublicKey is the key the panel logs in to servers with, which is added to the
+// authorized_keys of the user it logs in as
+type PublicKey struct {
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type connector struct {
+	mu     sync.Mutex
+	config *config.SSHConfiguration
+	signer ssh.Signer
+}
+
+var std *connector
+
+// Configure loads the key of the panel from the vault, which must be configured first,
+// generating one the first time
+func Configure(c *config.SSHConfiguration) error {
+	switch {
+	case c.HostKeys != TOFU && c.HostKeys != Strict:
+		return fmt.Errorf("sshx: unknown host key policy %q, must be tofu or strict", c.HostKeys)
+	case c.Timeout <= 0:
+		return errors.New("sshx: the timeout must be more than zero seconds")
+	}
+
+	signer, err := loadKey()
+	if errors.Is(err, vault.ErrNotFound) {
+		signer, err = generateKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	std = &connector{config: c, signer: signer}
+
+	return nil
+}
+
+// Key returns the public key of the panel
+func Key() (PublicKey, error) {
+	if std == nil {
+		return PublicKey{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return publicKey(std.signer), nil
+}
+
+// RotateKey replaces the key of the panel with a new one. Servers logged in to with the
+// old key refuse the panel until the new one is added to them
+func RotateKey() (PublicKey, error) {
+	if std == nil {
+		return PublicKey{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	signer, err := generateKey()
+	if err != nil {
+		return PublicKey{}, err
+	}
+	std.signer = signer
+
+	return publicKey(signer), nil
+}
+
+// Dial connects and logs in to the destination, refusing a server whose host key does
+// not match the one pinned for it. The context only bounds connecting and logging in
+func Dial(ctx context.Context, name string) (*ssh.Client, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	d, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := std.auth(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return std.dial(ctx, d.Host, d.Port, &ssh.ClientConfig{User: d.User, Auth: auth})
+}
+
+// dial connects to the server with the configuration, checking its host key against the
+// one pinned for it unless the configuration has a callback of its own
+func (c *connector) dial(ctx context.Context, host string, port int, cc *ssh.ClientConfig) (*ssh.Client, error) {
+	address := net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port))
+
+	if cc.HostKeyCallback == nil {
+		pinned, err := GetHost(address)
+		if err != nil && !errors.Is(err, ErrHostNotFound) {
+			return nil, err
+		}
+
+		// Only the algorithm of the pinned key is negotiated, so that a server with
+		// several host keys presents the one that was pinned
+		if err == nil {
+			cc.HostKeyAlgorithms = algorithms(pinned.Type)
+		}
+		cc.HostKeyCallback = c.verify(address)
+	}
+	cc.Timeout = time.Duration(c.config.Timeout) * time.Second
+
+	ctx, cancel := context.WithTimeout(ctx, cc.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake has no context of its own, so the deadline bounds it instead
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sc, chans, reqs, err := ssh.NewClientConn(conn, address, cc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// algorithms returns the host key algorithms a key of the type is presented with
+func algorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{keyType}
+}
+
+// publicKey returns the public half of the key
+func publicKey(signer ssh.Signer) PublicKey {
+	return PublicKey{
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " cosmicpanel",
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+}
+
+// loadKey reads the private key of the panel from the vault
+func loadKey() (ssh.Signer, error) {
+	s, err := vault.Get(keySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("sshx: failed to read the key of the panel: %w", err)
+	}
+
+	return signer, nil
+}
+
+// generateKey creates a new Ed25519 key for the panel and keeps it in the vault
+func generateKey() (ssh.Signer, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, "cosmicpanel")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vault.Set(keySecret, string(pem.EncodeToMemory(block))); err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(private)
+}
@@ -0,0 +1,264 @@
+package sshx
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+// configure sets up the client with a state store and vault of its own, trusting new
+// servers by the policy
+func configure(t *testing.T, policy string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := vault.Configure(dir, &config.VaultConfiguration{Provider: "local", Key: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(&config.SSHConfiguration{HostKeys: policy, Timeout: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { std = nil })
+}
+
+// newSigner returns a new Ed25519 key
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// server is an SSH server on the loopback that lets in the user with the password or
+// the authorized key, and whose host key can be replaced
+type server struct {
+	host string
+	port int
+
+	hostKey    ssh.Signer
+	password   string
+	authorized ssh.PublicKey
+}
+
+// serve starts a server with a new host key until the test ends
+func serve(t *testing.T) *server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &server{hostKey: newSigner(t), password: "secret"}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	s.host = host
+	s.port, _ = strconv.Atoi(port)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	sc := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.password != "" && string(password) == s.password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.authorized != nil && bytes.Equal(key.Marshal(), s.authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	sc.AddHostKey(s.hostKey)
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, sc)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		ch.Reject(ssh.Prohibited, "nothing is served")
+	}
+}
+
+// address returns the host and port of the server as host keys are pinned for it
+func (s *server) address() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+func TestConfigure(t *testing.T) {
+	configure(t, TOFU)
+
+	first, err := Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config config.SSHConfiguration
+		ok     bool
+	}{
+		{"tofu", config.SSHConfiguration{HostKeys: TOFU, Timeout: 10}, true},
+		{"strict", config.SSHConfiguration{HostKeys: Strict, Timeout: 10}, true},
+
+		{"unknown policy", config.SSHConfiguration{HostKeys: "any", Timeout: 10}, false},
+		{"no policy", config.SSHConfiguration{Timeout: 10}, false},
+		{"no timeout", config.SSHConfiguration{HostKeys: TOFU}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Configure(&tt.config); (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+
+			// The key of the panel is kept in the vault and loaded again
+			if key, err := Key(); err != nil || key != first {
+				t.Errorf("key %+v, %v, want %+v", key, err, first)
+			}
+		})
+	}
+
+	rotated, err := RotateKey()
+	if err != nil || rotated.Fingerprint == first.Fingerprint {
+		t.Fatalf("rotated %+v, %v", rotated, err)
+	}
+	if err := Configure(&config.SSHConfiguration{HostKeys: TOFU, Timeout: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := Key(); key != rotated {
+		t.Errorf("loaded %+v after rotating to %+v", key, rotated)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	tests := []struct {
+		keyType string
+		want    []string
+	}{
+		{ssh.KeyAlgoED25519, []string{ssh.KeyAlgoED25519}},
+		{ssh.KeyAlgoECDSA256, []string{ssh.KeyAlgoECDSA256}},
+		{ssh.KeyAlgoRSA, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+	}
+
+	for _, tt := range tests {
+		if got := algorithms(tt.keyType); !slices.Equal(got, tt.want) {
+			t.Errorf("algorithms(%s) = %q, want %q", tt.keyType, got, tt.want)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+
+		// The host key pinned before connecting, the server's own or another
+		pinned string
+
+		err error
+	}{
+		{"first use", TOFU, "", nil},
+		{"pinned", TOFU, "own", nil},
+		{"pinned under strict", Strict, "own", nil},
+
+		{"unknown under strict", Strict, "", ErrUnknownHost},
+		{"changed", TOFU, "other", ErrHostKeyChanged},
+		{"changed under strict", Strict, "other", ErrHostKeyChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, tt.policy)
+			srv := serve(t)
+
+			key, err := Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.authorized, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(key.Key))
+
+			if _, err := Save(Destination{Name: "backup", Host: srv.host, Port: srv.port, User: "cosmicpanel", Auth: AuthPanelKey}, Credentials{}); err != nil {
+				t.Fatal(err)
+			}
+
+			pinned := map[string]ssh.PublicKey{"own": srv.hostKey.PublicKey(), "other": newSigner(t).PublicKey()}[tt.pinned]
+			if pinned != nil {
+				authorized := string(ssh.MarshalAuthorizedKey(pinned))
+				if _, err := Pin(context.Background(), srv.host, srv.port, authorized, "", "admin"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client, err := Dial(context.Background(), "backup")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if client != nil {
+				client.Close()
+			}
+
+			// A key is only pinned on first use, and a changed one is never replaced
+			h, err := GetHost(srv.address())
+			switch {
+			case tt.pinned == "" && tt.policy == Strict:
+				if !errors.Is(err, ErrHostNotFound) {
+					t.Errorf("pinned %+v, %v under strict", h, err)
+				}
+			case tt.pinned == "":
+				if err != nil || h.Fingerprint != ssh.FingerprintSHA256(srv.hostKey.PublicKey()) || h.PinnedBy != PinnedOnFirstUse {
+					t.Errorf("pinned %+v, %v on first use", h, err)
+				}
+			default:
+				if err != nil || h.Fingerprint != ssh.FingerprintSHA256(pinned) || h.PinnedBy != "admin" {
+					t.Errorf("pinned %+v, %v, want the key pinned by the admin", h, err)
+				}
+			}
+		})
+	}
+}
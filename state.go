@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"gopkg.in/yaml.v2"
+)
+
+// stateSummary is how many records of every kind and entries of every log a state holds
+type stateSummary struct {
+	Records map[string]int `json:"records"`
+	Logs    map[string]int `json:"logs"`
+}
+
+// panelState exports the panel's state as a document that does not depend on the
+// database it is kept in, for disaster recovery, copying it to another panel or
+// reviewing it in version control, and imports such a document
+func panelState(args []string) error {
+	var o options
+	fs := o.flags("state", "export|import [file]")
+	kinds := fs.String("kinds", "", "Comma separated kinds of records to export, such as user,backup")
+	logs := fs.String("logs", "", "Comma separated logs to export, such as audit")
+	force := fs.Bool("force", false, "Import even though the daemon appears to be running")
+	args = parse(fs, args)
+
+	action, file := arg(args, 0), arg(args, 1)
+	if (action != "export" && action != "import") || (action == "import" && file == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Configure(c.System.Data, c.Store); err != nil {
+		return err
+	}
+
+	if action == "export" {
+		s, err := store.Export(splitList(*kinds), splitList(*logs))
+		if err != nil {
+			return err
+		}
+
+		return writeState(s, file, o.output)
+	}
+
+	s, err := readState(file)
+	if err != nil {
+		return err
+	}
+
+	// The daemon keeps the state in memory and would write what it has over the import
+	if !*force && daemonRunning(c) {
+		return errors.New("the daemon is running, stop it first or pass -force")
+	}
+
+	if err := store.Restore(s); err != nil {
+		return err
+	}
+
+	summary := stateSummary{Records: make(map[string]int), Logs: make(map[string]int)}
+	for kind, records := range s.Records {
+		summary.Records[kind] = len(records)
+	}
+	for log, entries := range s.Logs {
+		summary.Logs[log] = len(entries)
+	}
+
+	return o.print(summary, func() error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMPORTED\tCOUNT")
+
+		for _, kind := range sortedCounts(summary.Records) {
+			fmt.Fprintf(w, "%s\t%d\n", kind, summary.Records[kind])
+		}
+		for _, log := range sortedCounts(summary.Logs) {
+			fmt.Fprintf(w, "%s log\t%d\n", log, summary.Logs[log])
+		}
+
+		return w.Flush()
+	})
+}
+
+// writeState writes the state to the file, or to stdout if there is none, as JSON or
+// otherwise as YAML. The state holds password hashes and sessions, so the file is only
+// readable by its owner
+func writeState(s *store.State, file string, format string) error {
+	var b []byte
+	var err error
+
+	switch format {
+	case "json":
+		b, err = json.MarshalIndent(s, "", "  ")
+		b = append(b, '\n')
+	case "", "table", "yaml":
+		b, err = marshalYAML(s)
+	default:
+		return fmt.Errorf("unknown output format %q, use json or yaml", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if file == "" || file == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	return os.WriteFile(file, b, 0600)
+}
+
+// readState reads a state from the file, or from stdin if it is -, in JSON or YAML
+func readState(file string) (*store.State, error) {
+	var b []byte
+	var err error
+
+	if file == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is also YAML, so both are read the same way
+	var s store.State
+	if err := yaml.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to read the state in %s: %w", file, err)
+	}
+
+	return &s, nil
+}
+
+// sortedCounts returns the names of the counts in order
+func sortedCounts(counts map[string]int) []string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
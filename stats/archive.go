@@ -0,0 +1,406 @@
+package stats
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/lsm"
+)
+
+// archiveSuffix is the extension of a day of archived access log
+const archiveSuffix = ".log.gz"
+
+// ArchiveSettings are how the raw access log of a domain is archived
+type ArchiveSettings struct {
+	// Days archives are kept for, or zero for the configured number of days
+	Retention int `json:"retention"`
+
+	// Client addresses are anonymized before they are archived, keeping the first three
+	// bytes of IPv4 addresses and the first six of IPv6 addresses. Lines without a client
+	// address where the log format has it are left out of the archive
+	Anonymize bool `json:"anonymize"`
+}
+
+// Archive is a day of the raw access log of a domain, compressed with gzip
+type Archive struct {
+	Date string `json:"date"`
+	Size int64  `json:"size"`
+}
+
+// archiveDomain is the settings of a domain along with the directory its log is archived
+// in, which is known once the log has been read
+type archiveDomain struct {
+	ArchiveSettings
+	Dir string `json:"dir,omitempty"`
+}
+
+// archiver appends the lines of an access log to the archive of the day they were logged
+// on. Every run appends a gzip member to the file, which readers see as one stream
+type archiver struct {
+	dir       string
+	anonymize bool
+	format    *regexp.Regexp
+	uid, gid  int
+	files     map[string]*archiveFile
+}
+
+// archiveFile is a day of archive open for appending
+type archiveFile struct {
+	f *os.File
+	w *gzip.Writer
+}
+
+// loadArchives reads the archive settings of every domain. The manager must be locked
+func (m *manager) loadArchives() error {
+	b, err := os.ReadFile(filepath.Join(m.dir, "archives.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &m.archives); err != nil {
+			return fmt.Errorf("stats: failed to read archive settings: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// archiver returns an archiver for the log of the domain, or nil if logs are not archived
+// or the archive directory needs an account the domain is not known to belong to. The
+// manager must be locked
+func (m *manager) archiver(l domainLog) (*archiver, error) {
+	pattern := m.config.Archives
+	if pattern == "" || (strings.Contains(pattern, accountPlaceholder) && l.account == "") {
+		return nil, nil
+	}
+
+	if !strings.Contains(pattern, domainPlaceholder) {
+		return nil, fmt.Errorf("stats: the archive path %q does not contain %s", pattern, domainPlaceholder)
+	}
+
+	dir := strings.NewReplacer(domainPlaceholder, l.domain, accountPlaceholder, l.account).Replace(pattern)
+
+	// The directory may be in a home directory, where the account could have planted a
+	// symlink to have the panel write elsewhere
+	root := filepath.Clean(pattern[:strings.Index(pattern, "{")])
+	if err := noSymlinks(root, dir); err != nil {
+		return nil, err
+	}
+
+	a := &archiver{dir: dir, format: m.format, uid: -1, gid: -1, files: make(map[string]*archiveFile)}
+	if l.account != "" {
+		if su, err := user.Lookup(l.account); err == nil {
+			a.uid, _ = strconv.Atoi(su.Uid)
+			a.gid, _ = strconv.Atoi(su.Gid)
+		}
+	}
+
+	d, ok := m.archives[l.domain]
+	if !ok {
+		d = &archiveDomain{}
+		m.archives[l.domain] = d
+	}
+	d.Dir = dir
+	a.anonymize = d.Anonymize
+
+	return a, nil
+}
+
+// write appends the line to the archive of the day it was logged on
+func (a *archiver) write(line string, at time.Time) error {
+	if a.anonymize {
+		var ok bool
+		if line, ok = anonymize(a.format, line); !ok {
+			return nil
+		}
+	}
+
+	date := at.Format(time.DateOnly)
+
+	file, ok := a.files[date]
+	if !ok {
+		var err error
+		if file, err = a.open(date); err != nil {
+			return err
+		}
+		a.files[date] = file
+	}
+
+	_, err := file.w.Write([]byte(line + "\n"))
+
+	return err
+}
+
+// open opens the archive of the day for appending, creating it and its directory owned by
+// the account if need be
+func (a *archiver) open(date string) (*archiveFile, error) {
+	if _, err := os.Stat(a.dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(a.dir, 0700); err != nil {
+			return nil, err
+		}
+
+		if a.uid >= 0 {
+			if err := os.Chown(a.dir, a.uid, a.gid); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := lsm.Relabel(a.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(a.dir, date+archiveSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.uid >= 0 {
+		if err := f.Chown(a.uid, a.gid); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &archiveFile{f: f, w: gzip.NewWriter(f)}, nil
+}
+
+// close finishes the gzip member written to every archive
+func (a *archiver) close() error {
+	var first error
+	for _, file := range a.files {
+		if err := file.w.Close(); err != nil && first == nil {
+			first = err
+		}
+
+		if err := file.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// expireArchives removes the archives of every domain older than they are kept for. The
+// manager must be locked
+func (m *manager) expireArchives() {
+	for _, d := range m.archives {
+		days := d.Retention
+		if days <= 0 {
+			days = m.config.ArchiveDays
+		}
+
+		if d.Dir == "" || days <= 0 {
+			continue
+		}
+
+		oldest := time.Now().AddDate(0, 0, -days+1).Format(time.DateOnly)
+
+		list, err := archives(d.Dir)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range list {
+			if a.Date < oldest {
+				os.Remove(filepath.Join(d.Dir, a.Date+archiveSuffix))
+			}
+		}
+	}
+}
+
+// archives returns the days of access log archived in the directory, newest first
+func archives(dir string) ([]Archive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Archive{}
+	for _, e := range entries {
+		date, ok := strings.CutSuffix(e.Name(), archiveSuffix)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		list = append(list, Archive{Date: date, Size: info.Size()})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Date > list[j].Date })
+
+	return list, nil
+}
+
+// Archives returns the days of raw access log archived for the domain, newest first
+func Archives(domain string) ([]Archive, error) {
+	dir, err := archiveDir(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := archives(dir)
+	if os.IsNotExist(err) {
+		return []Archive{}, nil
+	}
+
+	return list, err
+}
+
+// OpenArchive opens the raw access log of the domain archived on the date, formatted as
+// YYYY-MM-DD
+func OpenArchive(domain string, date string) (*os.File, error) {
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		return nil, ErrInvalidDate
+	}
+
+	dir, err := archiveDir(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, date+archiveSuffix), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+// archiveDir returns the directory the log of the domain is archived in
+func archiveDir(domain string) (string, error) {
+	if std == nil {
+		return "", ErrNotConfigured
+	}
+
+	if !validDomain(domain) {
+		return "", ErrNotFound
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, ok := std.archives[domain]
+	if !ok || d.Dir == "" {
+		return "", ErrNotFound
+	}
+
+	return d.Dir, nil
+}
+
+// GetArchiveSettings returns how the raw access log of the domain is archived
+func GetArchiveSettings(domain string) (ArchiveSettings, error) {
+	if std == nil {
+		return ArchiveSettings{}, ErrNotConfigured
+	}
+
+	if !validDomain(domain) {
+		return ArchiveSettings{}, ErrNotFound
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if d, ok := std.archives[domain]; ok {
+		return d.ArchiveSettings, nil
+	}
+
+	return ArchiveSettings{}, nil
+}
+
+// SetArchiveSettings changes how the raw access log of the domain is archived, which
+// applies to the lines archived from then on
+func SetArchiveSettings(domain string, s ArchiveSettings) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	if !validDomain(domain) {
+		return ErrNotFound
+	}
+
+	if s.Retention < 0 {
+		return ErrInvalidRetention
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	d, ok := std.archives[domain]
+	if !ok {
+		d = &archiveDomain{}
+		std.archives[domain] = d
+	}
+	d.ArchiveSettings = s
+
+	return writeJSON(filepath.Join(std.dir, "archives.json"), std.archives)
+}
+
+// anonymize replaces the client address of the access log line in the format by the
+// network it is in. It returns false for a line without an address where the format has
+// it, such as one in another format or with a host name, which is left out rather than
+// archived as it was
+func anonymize(format *regexp.Regexp, line string) (string, bool) {
+	match := format.FindStringSubmatchIndex(line)
+	if match == nil {
+		return "", false
+	}
+
+	addr, err := netip.ParseAddr(line[match[2]:match[3]])
+	if err != nil {
+		return "", false
+	}
+
+	bits := 48
+	if addr = addr.Unmap(); addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", false
+	}
+
+	return line[:match[2]] + prefix.Addr().String() + line[match[3]:], true
+}
+
+// noSymlinks returns an error if the directory or any directory between it and the root
+// is a symlink
+func noSymlinks(root string, dir string) error {
+	for ; dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("stats: the archive directory %s is a symlink", dir)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package stats
+
+import "testing"
+
+func TestAnonymize(t *testing.T) {
+	const request = ` - - [15/Oct/2026:08:06:08 +0000] "GET / HTTP/1.1" 200 512 "-" "curl/8.5.0"`
+
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   string
+		ok     bool
+	}{
+		{"IPv4", "combined", "203.0.113.77" + request, "203.0.113.0" + request, true},
+		{"IPv6", "combined", "2001:db8:1234:5678:9abc::1" + request, "2001:db8:1234::" + request, true},
+		{"IPv4-mapped IPv6", "combined", "::ffff:198.51.100.23" + request, "198.51.100.0" + request, true},
+		{"IPv6 with a zone", "combined", "fe80::1%eth0" + request, "fe80::" + request, true},
+		{"common log format", "combined", `192.0.2.10 - - [15/Oct/2026:08:06:08 +0000] "GET / HTTP/1.1" 404 -`, `192.0.2.0 - - [15/Oct/2026:08:06:08 +0000] "GET / HTTP/1.1" 404 -`, true},
+		{"virtual host first", "vhost_combined", "example.com:443 203.0.113.77" + request, "example.com:443 203.0.113.0" + request, true},
+		{"virtual host and IPv6", "vhost_combined", "example.com 2001:db8::42" + request, "example.com 2001:db8::" + request, true},
+		{"address in the request is kept", "combined", `203.0.113.77 - - [15/Oct/2026:08:06:08 +0000] "GET /?ip=203.0.113.77 HTTP/1.1" 200 1`, `203.0.113.0 - - [15/Oct/2026:08:06:08 +0000] "GET /?ip=203.0.113.77 HTTP/1.1" 200 1`, true},
+
+		{"host name instead of an address", "combined", "client.example.net" + request, "", false},
+		{"virtual host in a combined log", "combined", "example.com:443 203.0.113.77" + request, "", false},
+		{"combined line in a vhost_combined log", "vhost_combined", "203.0.113.77" + request, "", false},
+		{"no space", "combined", "203.0.113.77", "", false},
+		{"not an access log line", "combined", "upstream timed out (110: Connection timed out) while reading from 203.0.113.77", "", false},
+		{"empty", "combined", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := anonymize(formats[tt.format], tt.line)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+		client string
+		path   string
+		size   int64
+	}{
+		{"combined", `203.0.113.77 - - [15/Oct/2026:08:06:08 +0000] "GET /shop?page=2 HTTP/1.1" 200 512 "https://example.com/" "curl/8.5.0"`, "203.0.113.77", "/shop", 512},
+		{"combined", `2001:db8::1 - alice [15/Oct/2026:08:06:08 +0000] "POST /login HTTP/2.0" 302 -`, "2001:db8::1", "/login", 0},
+		{"vhost_combined", `example.com:443 203.0.113.77 - - [15/Oct/2026:08:06:08 +0000] "GET / HTTP/1.1" 200 10 "-" "-"`, "203.0.113.77", "/", 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.client, func(t *testing.T) {
+			req, ok := parse(formats[tt.format], tt.line)
+			if !ok {
+				t.Fatal("not parsed")
+			}
+			if req.client != tt.client || req.path != tt.path || req.size != tt.size {
+				t.Errorf("got client %q, path %q, size %d", req.client, req.path, req.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package stats
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"go.uber.org/zap"
+)
+
+// maxMessage is the longest PHP error message kept, longer ones are cut off
+const maxMessage = 300
+
+// phpError matches a PHP error in an Apache, nginx or PHP error log, capturing its level
+// and message
+var phpError = regexp.MustCompile(`PHP (Fatal error|Parse error|Warning):\s+(.+?)(?:"? while |"?$)`)
+
+// errorTimes are the layouts of the times error logs start their lines with, along with
+// how the time is marked off from the rest of the line
+var errorTimes = []struct {
+	open, close string
+	layout      string
+}{
+	{"[", "]", "Mon Jan 02 15:04:05.000000 2006"},
+	{"[", "]", "Mon Jan 02 15:04:05 2006"},
+	{"[", "]", "02-Jan-2006 15:04:05 MST"},
+	{"", " [", "2006/01/02 15:04:05"},
+}
+
+// ErrorHour is the requests to a domain in an hour and how many failed with a server error
+type ErrorHour struct {
+	Requests     int64 `json:"requests"`
+	ServerErrors int64 `json:"server_errors"`
+}
+
+// dayErrors is the errors of a domain in a day as they are kept
+type dayErrors struct {
+	ServerErrors  int64            `json:"server_errors"`
+	NotFound      int64            `json:"not_found"`
+	Warnings      int64            `json:"warnings"`
+	Hours         [24]ErrorHour    `json:"hours"`
+	NotFoundPaths map[string]int64 `json:"not_found_paths"`
+	Fatals        map[string]int64 `json:"fatals"`
+
+	// The hour an anomaly was last reported for, so that it is reported once
+	Anomaly int `json:"anomaly"`
+}
+
+// Digest summarizes the errors of a domain in a day
+type Digest struct {
+	Domain string `json:"domain"`
+	Date   string `json:"date"`
+
+	// Requests that failed with a server error or were not found, and PHP warnings
+	ServerErrors int64 `json:"server_errors"`
+	NotFound     int64 `json:"not_found"`
+	Warnings     int64 `json:"warnings"`
+
+	// Requests and server errors by hour of the day
+	Hours [24]ErrorHour `json:"hours"`
+
+	// The most frequent PHP fatal and parse errors, and the paths most often not found
+	Fatals        []Entry `json:"fatals"`
+	NotFoundPaths []Entry `json:"not_found_paths"`
+}
+
+// errors returns the errors of the day, starting them if there are none yet
+func (mon *month) errors(day string) *dayErrors {
+	e, ok := mon.Errors[day]
+	if !ok {
+		e = &dayErrors{NotFoundPaths: make(map[string]int64), Fatals: make(map[string]int64), Anomaly: -1}
+		mon.Errors[day] = e
+	}
+
+	return e
+}
+
+// countError adds a line of the error log of the domain to its errors. The manager must
+// be locked
+func (m *manager) countError(domain string, line string, months map[string]*month) error {
+	match := phpError.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+
+	at, ok := errorTime(line)
+	if !ok {
+		return nil
+	}
+
+	mon, err := m.month(domain, at, months)
+	if err != nil {
+		return err
+	}
+
+	e := mon.errors(at.Format("02"))
+	if match[1] == "Warning" {
+		e.Warnings++
+		return nil
+	}
+
+	message := strings.Join(strings.Fields(match[2]), " ")
+	if len(message) > maxMessage {
+		message = message[:maxMessage]
+	}
+	e.Fatals[match[1]+": "+message]++
+
+	return nil
+}
+
+// errorTime parses the time an error log line starts with
+func errorTime(line string) (time.Time, bool) {
+	for _, f := range errorTimes {
+		rest, ok := strings.CutPrefix(line, f.open)
+		if !ok {
+			continue
+		}
+
+		value, _, ok := strings.Cut(rest, f.close)
+		if !ok {
+			continue
+		}
+
+		if t, err := time.ParseInLocation(f.layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// detect reports an anomaly when the rate of server errors of the domain in the hour of
+// the time jumped past the configured factor of its rate over the day before. The
+// manager must be locked
+func (m *manager) detect(domain string, at time.Time, months map[string]*month) error {
+	if m.config.AnomalyFactor <= 0 {
+		return nil
+	}
+
+	mon, err := m.month(domain, at, months)
+	if err != nil {
+		return err
+	}
+
+	e := mon.errors(at.Format("02"))
+	now := e.Hours[at.Hour()]
+	if now.ServerErrors == 0 || now.ServerErrors < int64(m.config.AnomalyMinimum) || e.Anomaly == at.Hour() {
+		return nil
+	}
+
+	var before ErrorHour
+	for i := 1; i <= 24; i++ {
+		t := at.Add(-time.Duration(i) * time.Hour)
+
+		prev, err := m.month(domain, t, months)
+		if err != nil {
+			return err
+		}
+
+		if pe, ok := prev.Errors[t.Format("02")]; ok {
+			h := pe.Hours[t.Hour()]
+			before.Requests += h.Requests
+			before.ServerErrors += h.ServerErrors
+		}
+	}
+
+	rate := float64(now.ServerErrors) / float64(now.Requests)
+	baseline := 0.0
+	if before.Requests > 0 {
+		baseline = float64(before.ServerErrors) / float64(before.Requests)
+	}
+
+	if baseline > 0 && rate < baseline*m.config.AnomalyFactor {
+		return nil
+	}
+
+	e.Anomaly = at.Hour()
+
+	zap.S().Named("stats").Warnw("server error rate jumped", "domain", domain, "rate", rate, "baseline", baseline)
+
+	events.Publish(events.Event{
+		Type:     "stats.anomaly",
+		Resource: domain,
+		Data: map[string]interface{}{
+			"hour":          at.Truncate(time.Hour).Format(time.RFC3339),
+			"requests":      now.Requests,
+			"server_errors": now.ServerErrors,
+			"rate":          rate,
+			"baseline":      baseline,
+		},
+	})
+
+	return nil
+}
+
+// Errors returns the digest of the errors of the domain on the date, formatted as
+// YYYY-MM-DD, or today when empty
+func Errors(domain string, date string) (Digest, error) {
+	if std == nil {
+		return Digest{}, ErrNotConfigured
+	}
+
+	day := time.Now()
+	if date != "" {
+		var err error
+		if day, err = time.ParseInLocation(time.DateOnly, date, time.Local); err != nil {
+			return Digest{}, ErrInvalidDate
+		}
+	}
+
+	if !validDomain(domain) {
+		return Digest{}, ErrNotFound
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	mon, err := std.load(domain, day.Format("2006-01"))
+	if err != nil {
+		return Digest{}, err
+	}
+
+	if mon.Updated.IsZero() {
+		return Digest{}, ErrNotFound
+	}
+
+	d := Digest{Domain: domain, Date: day.Format(time.DateOnly), Fatals: []Entry{}, NotFoundPaths: []Entry{}}
+	if e, ok := mon.Errors[day.Format("02")]; ok {
+		d.ServerErrors = e.ServerErrors
+		d.NotFound = e.NotFound
+		d.Warnings = e.Warnings
+		d.Hours = e.Hours
+		d.Fatals = entries(e.Fatals, std.config.Top)
+		d.NotFoundPaths = entries(e.NotFoundPaths, std.config.Top)
+	}
+
+	return d, nil
+}
+
+// Digests publishes the digest of yesterday's errors of every domain that had any, for
+// those who would rather not read error logs
+func Digests() error {
+	domains, err := Domains()
+	if err != nil {
+		return err
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+
+	for _, domain := range domains {
+		d, err := Errors(domain.Name, yesterday)
+		if err != nil {
+			continue
+		}
+
+		if d.ServerErrors == 0 && d.NotFound == 0 && len(d.Fatals) == 0 {
+			continue
+		}
+
+		events.Publish(events.Event{
+			Type:     "stats.digest",
+			Resource: domain.Name,
+			Data: map[string]interface{}{
+				"date":            d.Date,
+				"server_errors":   d.ServerErrors,
+				"not_found":       d.NotFound,
+				"warnings":        d.Warnings,
+				"fatals":          d.Fatals[:min(len(d.Fatals), 5)],
+				"not_found_paths": d.NotFoundPaths[:min(len(d.NotFoundPaths), 5)],
+			},
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package stats
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tracked is how many times more pages and referrers are tracked than are listed, so
+// that the counts near the top of the lists stay accurate
+const tracked = 10
+
+// headSize is the number of bytes at the start of a log that identify it, so that a log
+// that was rotated is read from the start
+const headSize = 256
+
+// formats match a line of each access log format, whose groups are the client, time,
+// request, status, size, referrer and user agent. combined also matches the common log
+// format, which lacks the referrer and user agent
+var formats = map[string]*regexp.Regexp{
+	"combined":       regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`),
+	"vhost_combined": regexp.MustCompile(`^\S+ (\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`),
+}
+
+// assets are the extensions of files that are requested along with pages rather than
+// viewed, so they count as hits but not page views
+var assets = map[string]bool{
+	".css": true, ".js": true, ".map": true, ".json": true, ".xml": true, ".txt": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true, ".avif": true, ".ico": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".ogg": true,
+}
+
+// offset is how far an access log has been read
+type offset struct {
+	Offset int64 `json:"offset"`
+
+	// A hash of the start of the log, which changes when the log is rotated
+	Head string `json:"head"`
+}
+
+// request is a request parsed from an access log
+type request struct {
+	client   string
+	time     time.Time
+	path     string
+	status   string
+	size     int64
+	referrer string
+}
+
+// month is the statistics of a domain in a month as they are kept, with what is needed
+// to add to them
+type month struct {
+	Report
+
+	// The days of the month each visitor was seen on as a bit mask, keyed by a hash of
+	// their address
+	Seen map[string]uint32 `json:"seen"`
+
+	// Every page and referrer tracked, which are cut down to the top ones when reported
+	AllPages     map[string]int64 `json:"all_pages"`
+	AllReferrers map[string]int64 `json:"all_referrers"`
+
+	// The errors of every day of the month
+	Errors map[string]*dayErrors `json:"errors"`
+}
+
+// follow passes every line written to the log since it was last read to fn. The manager
+// must be locked
+func (m *manager) follow(logPath string, fn func(line string) error) error {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	o, ok := m.offsets[logPath]
+	if !ok {
+		o = &offset{}
+		m.offsets[logPath] = o
+	}
+
+	// A log that shrank or starts differently than it did has been rotated
+	if head, err := readHead(f, o.Offset); err != nil {
+		return err
+	} else if o.Offset > info.Size() || head != o.Head {
+		o.Offset = 0
+	}
+
+	defer func() {
+		o.Head, _ = readHead(f, o.Offset)
+	}()
+
+	if _, err := f.Seek(o.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// A line without a newline is still being written, and is read next time
+			return nil
+		} else if err != nil {
+			return err
+		}
+		o.Offset += int64(len(line))
+
+		if err := fn(strings.TrimRight(line, "\r\n")); err != nil {
+			return err
+		}
+	}
+}
+
+// count adds the request to the statistics of the domain for the month it was made in.
+// The manager must be locked
+func (m *manager) count(domain string, req request, months map[string]*month) error {
+	mon, err := m.month(domain, req.time, months)
+	if err != nil {
+		return err
+	}
+
+	mon.add(req)
+
+	return nil
+}
+
+// month returns the statistics of the domain for the month of the time, loading them
+// into months if they are not there yet. The manager must be locked
+func (m *manager) month(domain string, at time.Time, months map[string]*month) (*month, error) {
+	name := at.Format("2006-01")
+
+	mon, ok := months[domain+"/"+name]
+	if !ok {
+		var err error
+		if mon, err = m.load(domain, name); err != nil {
+			return nil, err
+		}
+		months[domain+"/"+name] = mon
+	}
+
+	return mon, nil
+}
+
+// readHead returns a hash of the start of the log, up to the offset it has been read to
+func readHead(f *os.File, read int64) (string, error) {
+	b := make([]byte, min(read, headSize))
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if len(b) == 0 {
+		return "", nil
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// parse parses a line of an access log in the format
+func parse(format *regexp.Regexp, line string) (request, bool) {
+	match := format.FindStringSubmatch(line)
+	if match == nil {
+		return request{}, false
+	}
+
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[2])
+	if err != nil {
+		return request{}, false
+	}
+
+	req := request{client: match[1], time: t, status: match[4], referrer: match[6]}
+
+	if fields := strings.Fields(match[3]); len(fields) >= 2 {
+		req.path, _, _ = strings.Cut(fields[1], "?")
+	}
+
+	if match[5] != "-" {
+		req.size, _ = strconv.ParseInt(match[5], 10, 64)
+	}
+
+	return req, true
+}
+
+// add counts the request
+func (mon *month) add(req request) {
+	day := req.time.Format("02")
+	d := mon.Days[day]
+	h := &mon.Hours[req.time.Hour()]
+
+	mon.Hits++
+	d.Hits++
+	h.Hits++
+
+	mon.Bandwidth += req.size
+	d.Bandwidth += req.size
+	h.Bandwidth += req.size
+
+	mon.Status[req.status]++
+
+	e := mon.errors(day)
+	e.Hours[req.time.Hour()].Requests++
+
+	switch {
+	case req.status == "404" && req.path != "":
+		e.NotFound++
+		e.NotFoundPaths[req.path]++
+	case strings.HasPrefix(req.status, "5"):
+		e.ServerErrors++
+		e.Hours[req.time.Hour()].ServerErrors++
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(req.client))
+	visitor := strconv.FormatUint(hash.Sum64(), 36)
+
+	bit := uint32(1) << (req.time.Day() - 1)
+	seen, ok := mon.Seen[visitor]
+	if !ok {
+		mon.Visitors++
+	}
+	if seen&bit == 0 {
+		d.Visitors++
+		mon.Seen[visitor] = seen | bit
+	}
+
+	if view(req) {
+		mon.PageViews++
+		d.PageViews++
+		h.PageViews++
+
+		mon.AllPages[req.path]++
+
+		if u, err := url.Parse(req.referrer); err == nil && u.Host != "" && !strings.EqualFold(strings.TrimPrefix(u.Hostname(), "www."), strings.TrimPrefix(mon.Domain, "www.")) {
+			mon.AllReferrers[strings.ToLower(u.Hostname())]++
+		}
+	}
+
+	mon.Days[day] = d
+}
+
+// view returns true if the request was a page being viewed successfully
+func view(req request) bool {
+	if req.path == "" || !(strings.HasPrefix(req.status, "2") || req.status == "304") {
+		return false
+	}
+
+	return !assets[strings.ToLower(path.Ext(req.path))]
+}
+
+// load reads the statistics of the domain in the month, or starts them if there are
+// none yet
+func (m *manager) load(domain string, name string) (*month, error) {
+	mon := &month{
+		Report: Report{
+			Domain: domain,
+			Month:  name,
+			Days:   make(map[string]Totals),
+			Status: make(map[string]int64),
+		},
+		Seen:         make(map[string]uint32),
+		AllPages:     make(map[string]int64),
+		AllReferrers: make(map[string]int64),
+		Errors:       make(map[string]*dayErrors),
+	}
+
+	b, err := os.ReadFile(filepath.Join(m.dir, domain, name+".json"))
+	if os.IsNotExist(err) {
+		return mon, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, mon); err != nil {
+		return nil, fmt.Errorf("stats: failed to read statistics of %s for %s: %w", domain, name, err)
+	}
+
+	return mon, nil
+}
+
+// save writes the statistics of the month, dropping the pages, referrers and errors too
+// far down to be listed. The manager must be locked
+func (m *manager) save(mon *month) error {
+	limit := m.config.Top * tracked
+	mon.AllPages = top(mon.AllPages, limit)
+	mon.AllReferrers = top(mon.AllReferrers, limit)
+	for _, e := range mon.Errors {
+		e.NotFoundPaths = top(e.NotFoundPaths, limit)
+		e.Fatals = top(e.Fatals, limit)
+	}
+	mon.Updated = time.Now().UTC()
+
+	dir := filepath.Join(m.dir, mon.Domain)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(dir, mon.Month+".json"), mon)
+}
+
+// report returns the statistics with the top pages and referrers listed
+func (mon *month) report(n int) Report {
+	r := mon.Report
+	r.Pages = entries(mon.AllPages, n)
+	r.Referrers = entries(mon.AllReferrers, n)
+
+	return r
+}
+
+// top returns the counts with only the n highest kept
+func top(counts map[string]int64, n int) map[string]int64 {
+	if n <= 0 || len(counts) <= n {
+		return counts
+	}
+
+	kept := make(map[string]int64, n)
+	for _, e := range entries(counts, n) {
+		kept[e.Name] = e.Count
+	}
+
+	return kept
+}
+
+// entries returns the n highest counts, highest first
+func entries(counts map[string]int64, n int) []Entry {
+	list := make([]Entry, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, Entry{Name: name, Count: count})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+
+	return list
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// RedirectCounter counts the hits of the redirects domains serve as their access logs are
+// read, since the web server that serves them counts nothing
+type RedirectCounter interface {
+	// Match returns the ID of the redirect the domain serves at the path, or false if it
+	// serves none there
+	Match(domain string, path string) (string, bool)
+
+	// Count adds the hits of every redirect matched while reading the logs, keyed by ID
+	Count(hits map[string]Hits) error
+}
+
+// Hits are the times a redirect was followed and when it last was
+type Hits struct {
+	Hits int64     `json:"hits"`
+	Last time.Time `json:"last"`
+}
+
+var (
+	cmu     sync.Mutex
+	counter RedirectCounter
+)
+
+// CountRedirects makes reading the access logs report the hits of redirects to the
+// counter
+func CountRedirects(c RedirectCounter) {
+	cmu.Lock()
+	defer cmu.Unlock()
+
+	counter = c
+}
+
+// redirectCounter returns the counter redirects are reported to, nil if there is none
+func redirectCounter() RedirectCounter {
+	cmu.Lock()
+	defer cmu.Unlock()
+
+	return counter
+}
+
+// redirected adds the request to the hits of the redirect it was answered by, if any
+func redirected(c RedirectCounter, domain string, req request, hits map[string]Hits) {
+	switch req.status {
+	case "301", "302", "303", "307", "308":
+	default:
+		return
+	}
+
+	id, ok := c.Match(domain, req.path)
+	if !ok {
+		return
+	}
+
+	h := hits[id]
+	h.Hits++
+	if req.time.After(h.Last) {
+		h.Last = req.time.UTC()
+	}
+	hits[id] = h
+}
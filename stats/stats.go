@@ -0,0 +1,500 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+	"go.uber.org/zap"
+)
+
+// The placeholders in the configured log path, standing for the name of the domain and
+// the account it belongs to
+const (
+	domainPlaceholder  = "{domain}"
+	accountPlaceholder = "{account}"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("stats: not configured")
+
+	// ErrNotFound is returned when there are no statistics for a domain or month
+	ErrNotFound = errors.New("stats: no statistics for the domain")
+
+	// ErrInvalidMonth is returned for a month not in the YYYY-MM format
+	ErrInvalidMonth = errors.New("stats: invalid month, must be YYYY-MM")
+
+	// ErrInvalidDate is returned for a date not in the YYYY-MM-DD format
+	ErrInvalidDate = errors.New("stats: invalid date, must be YYYY-MM-DD")
+
+	// ErrInvalidRetention is returned for archive settings with a negative retention
+	ErrInvalidRetention = errors.New("stats: invalid retention, must be zero or more days")
+)
+
+// Entry is a page or referrer with the number of times it was requested or linked from
+type Entry struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Totals are the traffic of a domain over a month, day or hour
+type Totals struct {
+	Hits      int64 `json:"hits"`
+	PageViews int64 `json:"page_views"`
+	Visitors  int64 `json:"visitors"`
+	Bandwidth int64 `json:"bandwidth"`
+}
+
+// Report is the traffic of a domain in a month
+type Report struct {
+	Domain  string    `json:"domain"`
+	Month   string    `json:"month"`
+	Updated time.Time `json:"updated"`
+	Totals
+
+	// Totals by day of the month and by hour of the day. Visitors are counted once per
+	// day, and hours do not count visitors
+	Days  map[string]Totals `json:"days"`
+	Hours [24]Totals        `json:"hours"`
+
+	// Requests by status code, such as 200 or 404
+	Status map[string]int64 `json:"status"`
+
+	// The most viewed pages and the sites linking to the domain most, most first
+	Pages     []Entry `json:"pages"`
+	Referrers []Entry `json:"referrers"`
+}
+
+// Domain is a domain with the months it has statistics for, newest first. The account it
+// belongs to is known when the log path has an account placeholder
+type Domain struct {
+	Name    string   `json:"name"`
+	Account string   `json:"account,omitempty"`
+	Months  []string `json:"months"`
+}
+
+// domainLog is the access or error log of a domain
+type domainLog struct {
+	domain  string
+	account string
+	path    string
+}
+
+// manager builds the statistics of every domain from their access logs
+type manager struct {
+	mu      sync.Mutex
+	dir     string
+	config  *config.StatsConfiguration
+	offsets map[string]*offset
+
+	// The format of the access logs
+	format *regexp.Regexp
+
+	// The archive settings of domains, keyed by name
+	archives map[string]*archiveDomain
+}
+
+var std *manager
+
+// Configure loads how far every access log has been read and how they are archived from
+// the data directory
+func Configure(dataDir string, c *config.StatsConfiguration) error {
+	m := &manager{
+		dir:      filepath.Join(dataDir, "stats"),
+		config:   c,
+		offsets:  make(map[string]*offset),
+		archives: make(map[string]*archiveDomain),
+	}
+
+	format := c.LogFormat
+	if format == "" {
+		format = "combined"
+	}
+	if m.format = formats[format]; m.format == nil {
+		return fmt.Errorf("stats: unknown log format %q", c.LogFormat)
+	}
+
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(filepath.Join(m.dir, "offsets.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &m.offsets); err != nil {
+			return fmt.Errorf("stats: failed to read log offsets: %w", err)
+		}
+	}
+
+	if err := m.loadArchives(); err != nil {
+		return err
+	}
+
+	std = m
+
+	return nil
+}
+
+// Process reads what was written to the access log of every domain since it was last
+// processed, adding it to the statistics of the month each request was made in and to
+// the archive of the day, and meters the traffic in the access, mail and FTP logs
+func Process() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	if !std.config.Enabled {
+		return nil
+	}
+
+	return throttle.Run(context.Background(), throttle.Stats, process)
+}
+
+// process reads the logs for Process. Once the context is done the logs not yet read are
+// left for the next run, and what was read from the others is saved
+func process(ctx context.Context) error {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	access, err := logs(std.config.Logs)
+	if err != nil {
+		return err
+	}
+
+	var errorLogs []domainLog
+	if std.config.ErrorLogs != "" {
+		if errorLogs, err = logs(std.config.ErrorLogs); err != nil {
+			return err
+		}
+	}
+
+	// Logs that are gone are forgotten, so that a domain that comes back is read in full
+	read := map[string]bool{std.config.MailLog: true, std.config.FTPLog: true}
+	for _, l := range slices.Concat(access, errorLogs) {
+		read[l.path] = true
+	}
+	for path := range std.offsets {
+		if !read[path] {
+			delete(std.offsets, path)
+		}
+	}
+
+	months := make(map[string]*month)
+	t := newTraffic(access)
+	rc := redirectCounter()
+	hits := make(map[string]Hits)
+	last := make(map[string]time.Time)
+	var errs []error
+
+	for _, l := range access {
+		if ctx.Err() != nil {
+			break
+		}
+
+		a, err := std.archiver(l)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.domain, err))
+		}
+
+		err = std.follow(l.path, func(line string) error {
+			req, ok := parse(std.format, line)
+			if a != nil {
+				at := req.time
+				if !ok {
+					at = time.Now()
+				}
+
+				if err := a.write(line, at); err != nil {
+					return err
+				}
+			}
+
+			if !ok {
+				return nil
+			}
+
+			t.add(HTTP, l.domain, l.account, req.time, req.size)
+			last[l.domain] = req.time
+
+			if rc != nil {
+				redirected(rc, l.domain, req, hits)
+			}
+
+			return std.count(l.domain, req, months)
+		})
+		if a != nil {
+			err = errors.Join(err, a.close())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.domain, err))
+		}
+	}
+
+	for _, l := range errorLogs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := std.follow(l.path, func(line string) error {
+			return std.countError(l.domain, line, months)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.domain, err))
+		}
+	}
+
+	for domain, at := range last {
+		if err := std.detect(domain, at, months); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if std.config.MailLog != "" && ctx.Err() == nil {
+		if err := std.follow(std.config.MailLog, t.mail); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("mail log: %w", err))
+		}
+	}
+
+	if std.config.FTPLog != "" && ctx.Err() == nil {
+		if err := std.follow(std.config.FTPLog, t.ftp); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("ftp log: %w", err))
+		}
+	}
+
+	for _, m := range months {
+		// Months only looked at for the error rate before an hour are not started
+		if m.Updated.IsZero() && m.Hits == 0 && len(m.Errors) == 0 {
+			continue
+		}
+
+		if err := std.save(m); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.Domain, err))
+		}
+	}
+
+	if err := std.saveTraffic(t); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(hits) > 0 {
+		if err := rc.Count(hits); err != nil {
+			errs = append(errs, fmt.Errorf("redirects: %w", err))
+		}
+	}
+
+	if err := writeJSON(filepath.Join(std.dir, "offsets.json"), std.offsets); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := writeJSON(filepath.Join(std.dir, "archives.json"), std.archives); err != nil {
+		errs = append(errs, err)
+	}
+
+	std.expire()
+	std.expireArchives()
+
+	zap.S().Named("stats").Debugw("processed logs", "domains", len(access), "months", len(months))
+
+	return errors.Join(errs...)
+}
+
+// logs returns the log of every domain matching the pattern, along with the account the
+// domain belongs to when the pattern has an account placeholder
+func logs(pattern string) ([]domainLog, error) {
+	if !strings.Contains(pattern, domainPlaceholder) {
+		return nil, fmt.Errorf("stats: the log path %q does not contain %s", pattern, domainPlaceholder)
+	}
+
+	expr := "^" + regexp.QuoteMeta(pattern) + "$"
+	expr = strings.Replace(expr, regexp.QuoteMeta(domainPlaceholder), `(?P<domain>[^/]+)`, 1)
+	expr = strings.Replace(expr, regexp.QuoteMeta(accountPlaceholder), `(?P<account>[^/]+)`, 1)
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(strings.NewReplacer(domainPlaceholder, "*", accountPlaceholder, "*").Replace(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]domainLog, 0, len(matches))
+	for _, path := range matches {
+		match := re.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+
+		l := domainLog{path: path, domain: match[re.SubexpIndex("domain")]}
+		if i := re.SubexpIndex("account"); i >= 0 {
+			l.account = match[i]
+		}
+
+		if validDomain(l.domain) {
+			list = append(list, l)
+		}
+	}
+
+	return list, nil
+}
+
+// Domains returns every domain with statistics, sorted by name
+func Domains() ([]Domain, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	entries, err := os.ReadDir(std.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logs that cannot be listed only leave out the accounts
+	accounts := make(map[string]string)
+	if access, err := logs(std.config.Logs); err == nil {
+		for _, l := range access {
+			accounts[l.domain] = l.account
+		}
+	}
+
+	list := []Domain{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		months, err := std.months(e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if len(months) > 0 {
+			list = append(list, Domain{Name: e.Name(), Account: accounts[e.Name()], Months: months})
+		}
+	}
+
+	return list, nil
+}
+
+// Get returns the statistics of the domain in the month, the current month when empty
+func Get(domain string, monthName string) (Report, error) {
+	if std == nil {
+		return Report{}, ErrNotConfigured
+	}
+
+	if monthName == "" {
+		monthName = time.Now().Format("2006-01")
+	}
+
+	if _, err := time.Parse("2006-01", monthName); err != nil {
+		return Report{}, ErrInvalidMonth
+	}
+
+	if !validDomain(domain) {
+		return Report{}, ErrNotFound
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	m, err := std.load(domain, monthName)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if m.Updated.IsZero() {
+		return Report{}, ErrNotFound
+	}
+
+	return m.report(std.config.Top), nil
+}
+
+// months returns the months the domain has statistics for, newest first
+func (m *manager) months(domain string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(m.dir, domain))
+	if err != nil {
+		return nil, err
+	}
+
+	list := []string{}
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			list = append(list, name)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+
+	return list, nil
+}
+
+// expire removes the statistics and traffic of months older than those retained. The
+// manager must be locked
+func (m *manager) expire() {
+	if m.config.Months <= 0 {
+		return
+	}
+
+	oldest := time.Now().AddDate(0, -m.config.Months+1, 0).Format("2006-01")
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if name, ok := strings.CutPrefix(strings.TrimSuffix(e.Name(), ".json"), "traffic-"); ok && !e.IsDir() && name < oldest {
+			os.Remove(filepath.Join(m.dir, e.Name()))
+		}
+
+		if !e.IsDir() {
+			continue
+		}
+
+		months, _ := m.months(e.Name())
+		for _, name := range months {
+			if name < oldest {
+				os.Remove(filepath.Join(m.dir, e.Name(), name+".json"))
+			}
+		}
+	}
+}
+
+// validDomain returns true if the name can be a domain, which keeps it from escaping the
+// directory statistics are kept in
+func validDomain(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
+
+// writeJSON atomically writes the value as JSON to the file
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,553 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The services traffic is metered for
+const (
+	HTTP = "http"
+	Mail = "mail"
+	FTP  = "ftp"
+)
+
+// The intervals traffic is reported in
+const (
+	Hour  = "hour"
+	Day   = "day"
+	Month = "month"
+)
+
+// maxPoints is the most intervals a single traffic report covers
+const maxPoints = 10000
+
+// ErrInvalidRange is returned for a traffic report with an unknown interval or one that
+// covers too many intervals
+var ErrInvalidRange = errors.New("stats: invalid traffic range")
+
+// postfix matches a line postfix logs about a message in its queue
+var postfix = regexp.MustCompile(`postfix(?:/[\w-]+)*/(\w+)\[\d+\]: ([0-9A-Za-z]+): (?:(from|to)=<([^>]*)>(.*)|(removed))`)
+
+// size matches the size of a message in the line postfix logs when queueing it
+var size = regexp.MustCompile(`\bsize=(\d+)`)
+
+// status matches the outcome of an attempt to deliver a message to a recipient. Postfix
+// logs a message that stayed in the queue for too long as expired, which bounces it
+var status = regexp.MustCompile(`\bstatus=(sent|bounced|deferred|expired)\b`)
+
+// Point is the traffic in an interval, in bytes
+type Point struct {
+	Time  time.Time `json:"time"`
+	HTTP  int64     `json:"http"`
+	Mail  int64     `json:"mail"`
+	FTP   int64     `json:"ftp"`
+	Total int64     `json:"total"`
+}
+
+// Range is the period and interval a traffic report covers. The period defaults to the
+// last two days by hour, 30 days by day or 12 months by month
+type Range struct {
+	Interval string
+	From     time.Time
+	To       time.Time
+}
+
+// Outcomes are how many attempts to deliver the mail a domain sent succeeded, bounced or
+// were deferred. A message is deferred again every time a retry fails
+type Outcomes struct {
+	Sent     int64 `json:"sent"`
+	Bounced  int64 `json:"bounced"`
+	Deferred int64 `json:"deferred"`
+}
+
+// BounceRate returns the share of the messages that bounced out of those that were either
+// delivered or bounced, in percent
+func (o Outcomes) BounceRate() float64 {
+	if o.Sent+o.Bounced == 0 {
+		return 0
+	}
+
+	return float64(o.Bounced) * 100 / float64(o.Sent+o.Bounced)
+}
+
+// add adds the outcomes to these
+func (o *Outcomes) add(other Outcomes) {
+	o.Sent += other.Sent
+	o.Bounced += other.Bounced
+	o.Deferred += other.Deferred
+}
+
+// series is bytes transferred by hour, keyed by service and then by hour in UTC
+type series map[string]map[string]int64
+
+// trafficMonth is the traffic of every domain and account in a month
+type trafficMonth struct {
+	Domains  map[string]series `json:"domains"`
+	Accounts map[string]series `json:"accounts"`
+
+	// The outcomes of the mail hosted domains sent, keyed by domain and then by day
+	Outcomes map[string]map[string]*Outcomes `json:"outcomes,omitempty"`
+}
+
+// queued is a message in the mail queue, with the hosted domain that sent it and the
+// domains it has been counted for
+type queued struct {
+	size    int64
+	sender  string
+	counted map[string]bool
+}
+
+// traffic is what a run of Process metered, which is added to what is kept
+type traffic struct {
+	// The account every hosted domain belongs to, empty when the access logs do not say
+	owners map[string]string
+
+	queue  map[string]*queued
+	months map[string]*trafficMonth
+}
+
+// newTraffic starts metering for the domains with access logs
+func newTraffic(logs []domainLog) *traffic {
+	t := &traffic{
+		owners: make(map[string]string, len(logs)),
+		queue:  make(map[string]*queued),
+		months: make(map[string]*trafficMonth),
+	}
+
+	for _, l := range logs {
+		t.owners[strings.ToLower(l.domain)] = l.account
+	}
+
+	return t
+}
+
+// add counts bytes transferred for the service at the time, for the domain and the
+// account when they are known
+func (t *traffic) add(service string, domain string, account string, at time.Time, bytes int64) {
+	at = at.UTC()
+
+	mon, ok := t.months[at.Format("2006-01")]
+	if !ok {
+		mon = newTrafficMonth()
+		t.months[at.Format("2006-01")] = mon
+	}
+
+	hour := at.Format("2006-01-02T15")
+	domain = strings.ToLower(domain)
+
+	if domain != "" {
+		mon.Domains[domain] = mon.Domains[domain].add(service, hour, bytes)
+	}
+
+	if account != "" {
+		mon.Accounts[account] = mon.Accounts[account].add(service, hour, bytes)
+	}
+}
+
+// add adds the bytes to the hour, returning the series in case it had to be created
+func (s series) add(service string, hour string, bytes int64) series {
+	if s == nil {
+		s = make(series)
+	}
+
+	if s[service] == nil {
+		s[service] = make(map[string]int64)
+	}
+	s[service][hour] += bytes
+
+	return s
+}
+
+// mail meters a line of the postfix log. Messages count towards the hosted domain that
+// sent them and every hosted domain they were delivered to
+func (t *traffic) mail(line string) error {
+	match := postfix.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+
+	id := match[2]
+	if match[6] != "" {
+		delete(t.queue, id)
+		return nil
+	}
+
+	at, ok := syslogTime(line)
+	if !ok {
+		return nil
+	}
+
+	_, domain, _ := strings.Cut(strings.ToLower(match[4]), "@")
+
+	switch match[3] {
+	case "from":
+		m := size.FindStringSubmatch(match[5])
+		if m == nil {
+			return nil
+		}
+
+		q := &queued{counted: make(map[string]bool)}
+		q.size, _ = strconv.ParseInt(m[1], 10, 64)
+		if _, hosted := t.owners[domain]; hosted {
+			q.sender = domain
+		}
+		t.queue[id] = q
+
+		t.deliver(q, domain, at)
+	case "to":
+		q, ok := t.queue[id]
+		m := status.FindStringSubmatch(match[5])
+		if !ok || m == nil {
+			return nil
+		}
+
+		if q.sender != "" {
+			t.outcome(q.sender, m[1], at)
+		}
+
+		if m[1] == "sent" {
+			t.deliver(q, domain, at)
+		}
+	}
+
+	return nil
+}
+
+// outcome counts an attempt to deliver mail the domain sent
+func (t *traffic) outcome(domain string, result string, at time.Time) {
+	at = at.UTC()
+
+	mon, ok := t.months[at.Format("2006-01")]
+	if !ok {
+		mon = newTrafficMonth()
+		t.months[at.Format("2006-01")] = mon
+	}
+
+	o := mon.outcomes(domain, at.Format("2006-01-02"))
+	switch result {
+	case "sent":
+		o.Sent++
+	case "bounced", "expired":
+		o.Bounced++
+	case "deferred":
+		o.Deferred++
+	}
+}
+
+// deliver counts the message towards the domain once if it is hosted here
+func (t *traffic) deliver(q *queued, domain string, at time.Time) {
+	account, hosted := t.owners[domain]
+	if !hosted || q.counted[domain] {
+		return
+	}
+
+	q.counted[domain] = true
+	t.add(Mail, domain, account, at, q.size)
+}
+
+// ftp meters a line of an xferlog, which names the account that transferred the file
+// but not a domain
+func (t *traffic) ftp(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 14 {
+		return nil
+	}
+
+	at, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields[:5], " "), time.Local)
+	if err != nil {
+		return nil
+	}
+
+	bytes, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	t.add(FTP, "", fields[13], at, bytes)
+
+	return nil
+}
+
+// syslogTime parses the time a syslog line starts with, either in RFC 3339 or in the
+// traditional format without a year
+func syslogTime(line string) (time.Time, bool) {
+	first, _, _ := strings.Cut(line, " ")
+	if t, err := time.Parse(time.RFC3339Nano, first); err == nil {
+		return t, true
+	}
+
+	if len(line) < 15 {
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation("Jan _2 15:04:05", line[:15], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// Lines from late last year are read early in the new year
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t, true
+}
+
+// newTrafficMonth returns a month without traffic
+func newTrafficMonth() *trafficMonth {
+	return &trafficMonth{
+		Domains:  make(map[string]series),
+		Accounts: make(map[string]series),
+		Outcomes: make(map[string]map[string]*Outcomes),
+	}
+}
+
+// outcomes returns the outcomes of the mail the domain sent on the day, creating them
+func (mon *trafficMonth) outcomes(domain string, day string) *Outcomes {
+	if mon.Outcomes == nil {
+		mon.Outcomes = make(map[string]map[string]*Outcomes)
+	}
+
+	if mon.Outcomes[domain] == nil {
+		mon.Outcomes[domain] = make(map[string]*Outcomes)
+	}
+
+	o, ok := mon.Outcomes[domain][day]
+	if !ok {
+		o = &Outcomes{}
+		mon.Outcomes[domain][day] = o
+	}
+
+	return o
+}
+
+// trafficPath returns the file the traffic of the month is kept in
+func (m *manager) trafficPath(name string) string {
+	return filepath.Join(m.dir, "traffic-"+name+".json")
+}
+
+// loadTraffic reads the traffic of the month
+func (m *manager) loadTraffic(name string) (*trafficMonth, error) {
+	mon := newTrafficMonth()
+
+	b, err := os.ReadFile(m.trafficPath(name))
+	if os.IsNotExist(err) {
+		return mon, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, mon); err != nil {
+		return nil, fmt.Errorf("stats: failed to read traffic for %s: %w", name, err)
+	}
+
+	return mon, nil
+}
+
+// saveTraffic adds what was metered to the traffic kept. The manager must be locked
+func (m *manager) saveTraffic(t *traffic) error {
+	for name, metered := range t.months {
+		mon, err := m.loadTraffic(name)
+		if err != nil {
+			return err
+		}
+
+		for _, pair := range [][2]map[string]series{{mon.Domains, metered.Domains}, {mon.Accounts, metered.Accounts}} {
+			kept, added := pair[0], pair[1]
+			for subject, s := range added {
+				for service, hours := range s {
+					for hour, bytes := range hours {
+						kept[subject] = kept[subject].add(service, hour, bytes)
+					}
+				}
+			}
+		}
+
+		for domain, days := range metered.Outcomes {
+			for day, o := range days {
+				mon.outcomes(domain, day).add(*o)
+			}
+		}
+
+		if err := writeJSON(m.trafficPath(name), mon); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DomainTraffic returns the traffic of the domain over the range
+func DomainTraffic(domain string, r Range) ([]Point, error) {
+	return report(r, func(mon *trafficMonth) series { return mon.Domains[strings.ToLower(domain)] })
+}
+
+// AccountTraffic returns the traffic of the account over the range, which includes its
+// domains and its FTP transfers
+func AccountTraffic(account string, r Range) ([]Point, error) {
+	return report(r, func(mon *trafficMonth) series { return mon.Accounts[account] })
+}
+
+// MailOutcomes returns the outcomes of the mail the domain sent over the number of days
+// up to and including today
+func MailOutcomes(domain string, days int) (Outcomes, error) {
+	if std == nil {
+		return Outcomes{}, ErrNotConfigured
+	}
+
+	to := truncate(time.Now().UTC(), Day)
+	from := to.AddDate(0, 0, 1-days)
+	domain = strings.ToLower(domain)
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var total Outcomes
+	for t := truncate(from, Month); !t.After(to); t = t.AddDate(0, 1, 0) {
+		mon, err := std.loadTraffic(t.Format("2006-01"))
+		if err != nil {
+			return Outcomes{}, err
+		}
+
+		for day, o := range mon.Outcomes[domain] {
+			at, err := time.Parse("2006-01-02", day)
+			if err != nil || at.Before(from) || at.After(to) {
+				continue
+			}
+
+			total.add(*o)
+		}
+	}
+
+	return total, nil
+}
+
+// report adds up the series picked from every month in the range into its intervals
+func report(r Range, pick func(*trafficMonth) series) ([]Point, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	if r.Interval == "" {
+		r.Interval = Day
+	}
+
+	if r.To.IsZero() {
+		r.To = time.Now()
+	}
+
+	if r.From.IsZero() {
+		switch r.Interval {
+		case Hour:
+			r.From = r.To.Add(-48 * time.Hour)
+		case Day:
+			r.From = r.To.AddDate(0, 0, -30)
+		case Month:
+			r.From = r.To.AddDate(0, -12, 0)
+		}
+	}
+
+	var next func(time.Time) time.Time
+	switch r.Interval {
+	case Hour:
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case Day:
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case Month:
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, fmt.Errorf("%w, the interval must be hour, day or month", ErrInvalidRange)
+	}
+
+	from, to := truncate(r.From.UTC(), r.Interval), r.To.UTC()
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w, it must start before it ends", ErrInvalidRange)
+	}
+
+	points := []Point{}
+	index := make(map[time.Time]int)
+	for t := from; t.Before(to); t = next(t) {
+		if len(points) == maxPoints {
+			return nil, fmt.Errorf("%w, it covers more than %d intervals", ErrInvalidRange, maxPoints)
+		}
+
+		index[t] = len(points)
+		points = append(points, Point{Time: t})
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for t := truncate(from, Month); t.Before(to); t = t.AddDate(0, 1, 0) {
+		mon, err := std.loadTraffic(t.Format("2006-01"))
+		if err != nil {
+			return nil, err
+		}
+
+		for service, hours := range pick(mon) {
+			for hour, bytes := range hours {
+				at, err := time.Parse("2006-01-02T15", hour)
+				if err != nil || at.Before(from) || !at.Before(to) {
+					continue
+				}
+
+				p := &points[index[truncate(at, r.Interval)]]
+				switch service {
+				case HTTP:
+					p.HTTP += bytes
+				case Mail:
+					p.Mail += bytes
+				case FTP:
+					p.FTP += bytes
+				}
+				p.Total += bytes
+			}
+		}
+	}
+
+	return points, nil
+}
+
+// truncate returns the start of the interval the time is in
+func truncate(t time.Time, interval string) time.Time {
+	switch interval {
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case Day:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return t.Truncate(time.Hour)
+}
+
+// ExportCSV writes the traffic as CSV with a header row
+func ExportCSV(w io.Writer, points []Point) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"time", "http", "mail", "ftp", "total"})
+	for _, p := range points {
+		cw.Write([]string{
+			p.Time.Format(time.RFC3339),
+			strconv.FormatInt(p.HTTP, 10),
+			strconv.FormatInt(p.Mail, 10),
+			strconv.FormatInt(p.FTP, 10),
+			strconv.FormatInt(p.Total, 10),
+		})
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// The databases the store can be kept in
+const (
+	SQLite   = "sqlite"
+	MySQL    = "mysql"
+	Postgres = "postgres"
+)
+
+// dialect is how a database differs in the SQL the store uses
+type dialect struct {
+	// The database/sql driver of the database
+	driver string
+
+	// The column types of keys, which MySQL can only index with a length, and of the
+	// JSON documents
+	key  string
+	text string
+
+	// Placeholders are numbered, such as $1, rather than ?
+	numbered bool
+
+	// Writes a record, leaving an unchanged record as it is
+	upsert string
+
+	// Counts the tables with a name, and lists every table of the store
+	exists string
+	tables string
+}
+
+var dialects = map[string]dialect{
+	SQLite: {
+		driver: "sqlite",
+		key:    "TEXT",
+		text:   "TEXT",
+		upsert: `INSERT INTO records (kind, id, data, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT (kind, id) DO UPDATE SET data = excluded.data, updated = excluded.updated WHERE records.data <> excluded.data`,
+		exists: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+		tables: `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`,
+	},
+	Postgres: {
+		driver:   "pgx",
+		key:      "TEXT",
+		text:     "TEXT",
+		numbered: true,
+		upsert: `INSERT INTO records (kind, id, data, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT (kind, id) DO UPDATE SET data = excluded.data, updated = excluded.updated WHERE records.data <> excluded.data`,
+		exists: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`,
+		tables: `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name`,
+	},
+
+	// MySQL assigns in order, so updated is compared against the data before it changes
+	MySQL: {
+		driver: "mysql",
+		key:    "VARCHAR(191)",
+		text:   "LONGTEXT",
+		upsert: `INSERT INTO records (kind, id, data, updated) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE updated = IF(data = VALUES(data), updated, VALUES(updated)), data = VALUES(data)`,
+		exists: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`,
+		tables: `SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY table_name`,
+	},
+}
+
+// rebind rewrites the placeholders of the query for the database
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// schema returns the statements of a migration with the column types of the database.
+// Lines starting with -- are comments and are left out
+func (d dialect) schema(sql string) []string {
+	var lines []string
+	for _, line := range strings.Split(sql, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	sql = strings.NewReplacer("{key}", d.key, "{text}", d.text).Replace(strings.Join(lines, "\n"))
+
+	var statements []string
+	for _, s := range strings.Split(sql, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			statements = append(statements, s)
+		}
+	}
+
+	return statements
+}
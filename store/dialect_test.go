@@ -0,0 +1,108 @@
+package store
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{SQLite, "SELECT data FROM records WHERE kind = ? AND id = ?", "SELECT data FROM records WHERE kind = ? AND id = ?"},
+		{MySQL, "SELECT data FROM records WHERE kind = ? AND id = ?", "SELECT data FROM records WHERE kind = ? AND id = ?"},
+		{Postgres, "SELECT data FROM records WHERE kind = ? AND id = ?", "SELECT data FROM records WHERE kind = $1 AND id = $2"},
+		{Postgres, "SELECT 1", "SELECT 1"},
+	}
+
+	for _, tt := range tests {
+		if got := dialects[tt.driver].rebind(tt.query); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.driver, got, tt.want)
+		}
+	}
+
+	// Every placeholder of the upsert is numbered
+	upsert := dialects[Postgres].rebind(dialects[Postgres].upsert)
+	if strings.Contains(upsert, "?") || !strings.Contains(upsert, "$4") || strings.Contains(upsert, "$5") {
+		t.Errorf("upsert %q", upsert)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	const sql = `-- A comment; with a semicolon
+CREATE TABLE a (
+	id {key} NOT NULL, -- the ID
+	data {text} NOT NULL
+);
+
+  -- An indented comment
+CREATE INDEX a_id ON a (id);
+`
+
+	tests := []struct {
+		driver string
+		want   []string
+	}{
+		{SQLite, []string{"CREATE TABLE a (\n\tid TEXT NOT NULL, -- the ID\n\tdata TEXT NOT NULL\n)", "CREATE INDEX a_id ON a (id)"}},
+		{Postgres, []string{"CREATE TABLE a (\n\tid TEXT NOT NULL, -- the ID\n\tdata TEXT NOT NULL\n)", "CREATE INDEX a_id ON a (id)"}},
+		{MySQL, []string{"CREATE TABLE a (\n\tid VARCHAR(191) NOT NULL, -- the ID\n\tdata LONGTEXT NOT NULL\n)", "CREATE INDEX a_id ON a (id)"}},
+	}
+
+	for _, tt := range tests {
+		if got := dialects[tt.driver].schema(sql); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.driver, got, tt.want)
+		}
+	}
+
+	// The released migrations are written for every database
+	for _, m := range migrations {
+		for driver, d := range dialects {
+			for _, statement := range d.schema(m.sql) {
+				if strings.ContainsAny(statement, "{}") {
+					t.Errorf("migration %d for %s: %q", m.Version, driver, statement)
+				}
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.StoreConfiguration
+		ok     bool
+	}{
+		{"default", config.StoreConfiguration{}, true},
+		{"sqlite", config.StoreConfiguration{Driver: SQLite}, true},
+		{"unknown driver", config.StoreConfiguration{Driver: "oracle"}, false},
+		{"driver name", config.StoreConfiguration{Driver: "pgx", DSN: "postgres://localhost/panel"}, false},
+		{"mysql without a data source", config.StoreConfiguration{Driver: MySQL}, false},
+		{"postgres without a data source", config.StoreConfiguration{Driver: Postgres}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(t.TempDir(), &tt.config)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer s.Close()
+
+			if !s.Embedded() {
+				t.Error("the SQLite store is not embedded")
+			}
+		})
+	}
+
+	if _, err := Connect(SQLite, "file:panel.db", 0); err == nil {
+		t.Error("connected to SQLite as a database server")
+	}
+}
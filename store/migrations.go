@@ -0,0 +1,274 @@
+package store
+
+import (
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Migration changes the schema of the store from the version before it
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+
+	sql string
+}
+
+// files holds the migrations, named after their version and what they do such as
+// 0001_records_and_logs.sql. Column types that differ between databases are written as
+// {key} and {text}. A migration is never changed once released, a new one is added
+// instead
+//
+//go:embed migrations/*.sql
+var files embed.FS
+
+// migrations are every migration in the order they are applied
+var migrations = load()
+
+// load reads the embedded migrations, which must be numbered from 1 without gaps
+func load() []Migration {
+	entries, err := files.ReadDir("migrations")
+	if err != nil {
+		panic(err)
+	}
+
+	var list []Migration
+	for _, e := range entries {
+		number, name, _ := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			panic("store: migration " + e.Name() + " is not numbered")
+		}
+
+		b, err := files.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+
+		list = append(list, Migration{Version: version, Name: strings.ReplaceAll(name, "_", " "), sql: string(b)})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i, m := range list {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("store: expected migration %d but found %d", i+1, m.Version))
+		}
+	}
+
+	return list
+}
+
+// Version returns the version of the schema of the store, which is zero for a new store
+func (s *Store) Version() (int, error) {
+	var tables int
+	if err := s.db.QueryRow(s.dialect.rebind(s.dialect.exists), "migrations").Scan(&tables); err != nil {
+		return 0, err
+	}
+
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM migrations").Scan(&version)
+
+	return version, err
+}
+
+// Pending returns the migrations the store is missing. A store written by a newer
+// release is an error, as this release does not know its schema
+func (s *Store) Pending() ([]Migration, error) {
+	current, err := s.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := len(migrations); current > latest {
+		return nil, fmt.Errorf("store: the store is at version %d but this release only knows version %d, it was written by a newer release", current, latest)
+	}
+
+	return migrations[current:], nil
+}
+
+// Migrate applies every migration the store is missing, each in a transaction of its own
+// along with the record that it was applied. A store that already has a schema is first
+// snapshotted into the directory, so that a failed upgrade can be rolled back by
+// restoring it. MySQL commits schema changes as they are made, so a migration that fails
+// there is rolled back with the snapshot rather than the transaction
+func (s *Store) Migrate(snapshots string) ([]Migration, error) {
+	pending, err := s.Pending()
+	if err != nil || len(pending) == 0 {
+		return pending, err
+	}
+
+	if current := pending[0].Version - 1; current > 0 {
+		path, err := s.snapshot(snapshots, current)
+		if err != nil {
+			return nil, fmt.Errorf("store: failed to snapshot the store before migrating: %w", err)
+		}
+
+		zap.S().Named("store").Infow("snapshotted the store before migrating", "path", path, "from", current, "to", pending[len(pending)-1].Version)
+	}
+
+	_, err = s.db.Exec(s.dialect.schema(`CREATE TABLE IF NOT EXISTS migrations (
+	version INTEGER PRIMARY KEY,
+	name    {key} NOT NULL,
+	applied {key} NOT NULL
+)`)[0])
+	if err != nil {
+		return nil, fmt.Errorf("store: failed to create the migrations table: %w", err)
+	}
+
+	for i, m := range pending {
+		if err := s.apply(m); err != nil {
+			return pending[:i], err
+		}
+
+		zap.S().Named("store").Infow("applied migration", "version", m.Version, "name", m.Name)
+	}
+
+	return pending, nil
+}
+
+// apply runs the statements of the migration and records it in one transaction
+func (s *Store) apply(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range s.dialect.schema(m.sql) {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("store: migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+
+	_, err = tx.Exec(s.dialect.rebind("INSERT INTO migrations (version, name, applied) VALUES (?, ?, ?)"), m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// snapshot copies the store at the version into the directory. An SQLite store is
+// copied as a database that can replace it, and a store on a server is dumped as JSON
+// with every row of every table
+func (s *Store) snapshot(dir string, version int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	stamp := time.Now().UTC().Format("20060102-150405")
+	if s.Embedded() {
+		path := filepath.Join(dir, fmt.Sprintf("panel-v%d-%s.db", version, stamp))
+		return path, s.Snapshot(path)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("panel-v%d-%s.json.gz", version, stamp))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	if err := s.dump(gz, version); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	if err := gz.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, f.Sync()
+}
+
+// dump writes every row of every table in the store as JSON
+func (s *Store) dump(w *gzip.Writer, version int) error {
+	rows, err := s.db.Query(s.dialect.tables)
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	out := struct {
+		Version int                                 `json:"version"`
+		Tables  map[string][]map[string]interface{} `json:"tables"`
+	}{Version: version, Tables: make(map[string][]map[string]interface{})}
+
+	for _, table := range tables {
+		if out.Tables[table], err = s.rows(table); err != nil {
+			return err
+		}
+	}
+
+	return json.NewEncoder(w).Encode(out)
+}
+
+// rows returns every row of the table keyed by column
+func (s *Store) rows(table string) ([]map[string]interface{}, error) {
+	rows, err := s.db.Query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		list = append(list, row)
+	}
+
+	return list, rows.Err()
+}
@@ -0,0 +1,17 @@
+-- Records are JSON documents grouped by kind, and entries are append-only logs such as
+-- the audit log
+
+CREATE TABLE records (
+	kind    {key}  NOT NULL,
+	id      {key}  NOT NULL,
+	data    {text} NOT NULL,
+	updated {key}  NOT NULL,
+	PRIMARY KEY (kind, id)
+);
+
+CREATE TABLE entries (
+	log      {key}  NOT NULL,
+	sequence BIGINT NOT NULL,
+	data     {text} NOT NULL,
+	PRIMARY KEY (log, sequence)
+);
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("no migrations are embedded")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Name == "" || strings.Contains(m.Name, "_") || m.sql == "" {
+			t.Errorf("migration %d is %+v", i+1, m)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	released := migrations
+	t.Cleanup(func() { migrations = released })
+
+	dir := t.TempDir()
+	snapshots := filepath.Join(dir, "snapshots")
+
+	s, err := Open(filepath.Join(dir, "panel.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	next := Migration{Version: len(released) + 1, Name: "extra", sql: "CREATE TABLE extra (id {key} NOT NULL);\nCREATE INDEX extra_id ON extra (id);"}
+	broken := Migration{Version: len(released) + 2, Name: "broken", sql: "CREATE TABLE broken (id {key});\nCREATE TABLE broken (id {key});"}
+
+	tests := []struct {
+		name       string
+		migrations []Migration
+		applied    int
+		version    int
+		snapshots  int
+		ok         bool
+	}{
+		{"new store", released, len(released), len(released), 0, true},
+		{"up to date", released, 0, len(released), 0, true},
+		{"new migration", append(released[:len(released):len(released)], next), 1, len(released) + 1, 1, true},
+		{"failed migration", append(released[:len(released):len(released)], next, broken), 0, len(released) + 1, 2, false},
+		{"newer store", released, 0, len(released) + 1, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations = tt.migrations
+
+			applied, err := s.Migrate(snapshots)
+			if (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+			if len(applied) != tt.applied {
+				t.Errorf("applied %+v, want %d", applied, tt.applied)
+			}
+
+			if version, err := s.Version(); err != nil || version != tt.version {
+				t.Errorf("version %d, %v, want %d", version, err, tt.version)
+			}
+
+			entries, _ := os.ReadDir(snapshots)
+			if len(entries) != tt.snapshots {
+				t.Errorf("%d snapshots, want %d", len(entries), tt.snapshots)
+			}
+		})
+	}
+
+	// A failed migration leaves none of its statements behind
+	var tables int
+	if err := s.db.QueryRow(s.dialect.exists, "broken").Scan(&tables); err != nil || tables != 0 {
+		t.Errorf("the failed migration created %d tables, %v", tables, err)
+	}
+
+	// The snapshot taken before a migration is the store before it
+	matches, err := filepath.Glob(filepath.Join(snapshots, fmt.Sprintf("panel-v%d-*.db", len(released))))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("snapshots %q, %v", matches, err)
+	}
+
+	snapshot, err := Open(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+
+	if version, err := snapshot.Version(); err != nil || version != len(released) {
+		t.Errorf("the snapshot is at version %d, %v", version, err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	s := newStore(t)
+
+	err := s.Update(func(tx *Tx) error {
+		if err := tx.Put("user", "alice", record{Name: "alice", Size: 1 << 53}); err != nil {
+			return err
+		}
+		return tx.Append("audit", 1, record{Name: "login"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := s.dump(gz, 1); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		Version int                                 `json:"version"`
+		Tables  map[string][]map[string]interface{} `json:"tables"`
+	}
+	if err := json.NewDecoder(r).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Version != 1 || len(out.Tables["migrations"]) != len(migrations) {
+		t.Errorf("dump at version %d with migrations %v", out.Version, out.Tables["migrations"])
+	}
+
+	records := out.Tables["records"]
+	if len(records) != 1 || records[0]["id"] != "alice" || records[0]["data"] != `{"name":"alice","size":9007199254740992}` {
+		t.Errorf("records %v", records)
+	}
+	if entries := out.Tables["entries"]; len(entries) != 1 || entries[0]["log"] != "audit" {
+		t.Errorf("entries %v", entries)
+	}
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Format is the version of the format states are exported in. It only changes when the
+// layout of a state does, not when the records in it gain fields
+const Format = 1
+
+// State is the records and logs of the store in a form that is independent of the
+// database it is kept in, for recovering a panel, copying its state to another one or
+// reviewing changes to it
+type State struct {
+	Format   int       `json:"format"`
+	Exported time.Time `json:"exported"`
+
+	// The records of every kind keyed by ID, each a JSON document such as a user
+	Records map[string]map[string]interface{} `json:"records"`
+
+	// The entries of every log, oldest first
+	Logs map[string][]LogEntry `json:"logs"`
+}
+
+// UnmarshalJSON decodes the state with numbers kept as they are written, as decode does
+// for the records in the store
+func (s *State) UnmarshalJSON(b []byte) error {
+	type plain State
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	return dec.Decode((*plain)(s))
+}
+
+// LogEntry is an entry of a log along with its sequence number
+type LogEntry struct {
+	Sequence uint64      `json:"sequence"`
+	Data     interface{} `json:"data"`
+}
+
+// Export returns the records of the kinds and the entries of the logs, or of everything
+// in the store if neither is given
+func (s *Store) Export(kinds []string, logs []string) (*State, error) {
+	state := &State{
+		Format:   Format,
+		Exported: time.Now().UTC(),
+		Records:  make(map[string]map[string]interface{}),
+		Logs:     make(map[string][]LogEntry),
+	}
+
+	err := s.View(func(tx *Tx) error {
+		if len(kinds) == 0 && len(logs) == 0 {
+			var err error
+			if kinds, err = tx.distinct("SELECT DISTINCT kind FROM records ORDER BY kind"); err != nil {
+				return err
+			}
+
+			if logs, err = tx.distinct("SELECT DISTINCT log FROM entries ORDER BY log"); err != nil {
+				return err
+			}
+		}
+
+		for _, kind := range kinds {
+			records := make(map[string]interface{})
+			err := tx.Each(kind, func(id string, data []byte) error {
+				v, err := decode(data)
+				if err != nil {
+					return fmt.Errorf("store: malformed %s %s: %w", kind, id, err)
+				}
+
+				records[id] = v
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			state.Records[kind] = records
+		}
+
+		for _, log := range logs {
+			entries := []LogEntry{}
+			rows, err := tx.query("SELECT sequence, data FROM entries WHERE log = ? ORDER BY sequence", log)
+			if err != nil {
+				return err
+			}
+
+			for rows.Next() {
+				var e LogEntry
+				var data []byte
+				if err := rows.Scan(&e.Sequence, &data); err != nil {
+					rows.Close()
+					return err
+				}
+
+				if e.Data, err = decode(data); err != nil {
+					rows.Close()
+					return fmt.Errorf("store: malformed entry %d of %s: %w", e.Sequence, log, err)
+				}
+				entries = append(entries, e)
+			}
+			rows.Close()
+
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			state.Logs[log] = entries
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Restore replaces the records of every kind and the entries of every log in the state
+// with those in it, in one transaction. Kinds and logs the state does not hold are left
+// as they are, so a state exported with only some kinds restores only those
+func (s *Store) Restore(state *State) error {
+	if state.Format != Format {
+		return fmt.Errorf("store: the state is in format %d but this release only reads format %d", state.Format, Format)
+	}
+
+	return s.Update(func(tx *Tx) error {
+		for kind, records := range state.Records {
+			if _, err := tx.exec("DELETE FROM records WHERE kind = ?", kind); err != nil {
+				return err
+			}
+
+			for id, v := range records {
+				data, err := encode(v)
+				if err != nil {
+					return fmt.Errorf("store: malformed %s %s: %w", kind, id, err)
+				}
+
+				if err := tx.put(kind, id, data); err != nil {
+					return err
+				}
+			}
+
+			// The records were replaced underneath what this process loaded
+			tx.seen[kind] = nil
+		}
+
+		for log, entries := range state.Logs {
+			if _, err := tx.exec("DELETE FROM entries WHERE log = ?", log); err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				data, err := encode(e.Data)
+				if err != nil {
+					return fmt.Errorf("store: malformed entry %d of %s: %w", e.Sequence, log, err)
+				}
+
+				if err := tx.Append(log, e.Sequence, json.RawMessage(data)); err != nil {
+					return fmt.Errorf("store: failed to restore entry %d of %s: %w", e.Sequence, log, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// distinct returns the values of the single column the query selects
+func (t *Tx) distinct(query string) ([]string, error) {
+	rows, err := t.query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, rows.Err()
+}
+
+// decode decodes a JSON document, keeping numbers as they are written so that large
+// integers such as sizes in bytes are not rounded
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+
+	return v, err
+}
+
+// encode encodes a document read from a state as compact JSON. States read from YAML
+// hold maps with keys of any type, which are converted to strings
+func encode(v interface{}) ([]byte, error) {
+	return json.Marshal(stringKeys(v))
+}
+
+// stringKeys converts maps keyed by any type within the value to maps keyed by string
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = stringKeys(e)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// Export returns the records of the kinds and the entries of the logs in the configured
+// store, or everything in it if neither is given
+func Export(kinds []string, logs []string) (*State, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	return std.Export(kinds, logs)
+}
+
+// Restore replaces the kinds and logs in the state in the configured store
+func Restore(state *State) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.Restore(state)
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// fill writes users, a backup and an audit log to the store
+func fill(t *testing.T, s *Store) {
+	t.Helper()
+
+	err := s.Update(func(tx *Tx) error {
+		for _, r := range []record{{Name: "alice", Size: 1<<62 + 1}, {Name: "bob"}} {
+			if err := tx.Put("user", r.Name, r); err != nil {
+				return err
+			}
+		}
+		if err := tx.Put("backup", "b1", map[string]interface{}{"paths": []string{"/home"}, "options": map[string]bool{"yes": true}, "when": "2026-01-02T03:04:05Z"}); err != nil {
+			return err
+		}
+
+		for i, name := range []string{"login", "logout"} {
+			if err := tx.Append("audit", uint64(i+7), record{Name: name}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns every record and entry of the store as it is stored
+func contents(t *testing.T, s *Store) []string {
+	t.Helper()
+
+	var list []string
+	err := s.View(func(tx *Tx) error {
+		for _, kind := range []string{"backup", "user"} {
+			err := tx.Each(kind, func(id string, data []byte) error {
+				list = append(list, kind+" "+id+" "+string(data))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		rows, err := tx.query("SELECT sequence, data FROM entries ORDER BY log, sequence")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sequence, data string
+			if err := rows.Scan(&sequence, &data); err != nil {
+				return err
+			}
+			list = append(list, "entry "+sequence+" "+data)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func TestExportRestore(t *testing.T) {
+	source := newStore(t)
+	fill(t, source)
+	want := contents(t, source)
+
+	tests := []struct {
+		name   string
+		decode func(t *testing.T, s *State) *State
+	}{
+		{"as it is", func(t *testing.T, s *State) *State { return s }},
+		{"JSON", func(t *testing.T, s *State) *State {
+			b, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out State
+			if err := json.Unmarshal(b, &out); err != nil {
+				t.Fatal(err)
+			}
+			return &out
+		}},
+
+		// As the command line writes and reads it
+		{"YAML", func(t *testing.T, s *State) *State {
+			b, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var generic interface{}
+			if err := yaml.Unmarshal(b, &generic); err != nil {
+				t.Fatal(err)
+			}
+			if b, err = yaml.Marshal(generic); err != nil {
+				t.Fatal(err)
+			}
+
+			var out State
+			if err := yaml.Unmarshal(b, &out); err != nil {
+				t.Fatal(err)
+			}
+			return &out
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := source.Export(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.Format != Format || len(state.Records) != 2 || len(state.Logs["audit"]) != 2 {
+				t.Fatalf("exported %+v", state)
+			}
+
+			target := newStore(t)
+			err = target.Update(func(tx *Tx) error {
+				if err := tx.Put("user", "carol", record{Name: "carol"}); err != nil {
+					return err
+				}
+				return tx.Append("audit", 1, record{Name: "old"})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := target.Restore(tt.decode(t, state)); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := contents(t, target); !slices.Equal(got, want) {
+				t.Errorf("restored\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestExportSome(t *testing.T) {
+	s := newStore(t)
+	fill(t, s)
+
+	tests := []struct {
+		name  string
+		kinds []string
+		logs  []string
+		want  []string
+	}{
+		{"everything", nil, nil, []string{"backup", "user", "audit log"}},
+		{"kinds", []string{"user"}, nil, []string{"user"}},
+		{"logs", nil, []string{"audit"}, []string{"audit log"}},
+		{"missing kind", []string{"job"}, nil, []string{"job"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := s.Export(tt.kinds, tt.logs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for kind := range state.Records {
+				got = append(got, kind)
+			}
+			slices.Sort(got)
+			for log := range state.Logs {
+				got = append(got, log+" log")
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("exported %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Restoring the users leaves the backups and the audit log as they are
+	before := contents(t, s)
+
+	state, err := s.Export([]string{"user"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(state.Records["user"], "bob")
+
+	if err := s.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, c := range before {
+		if !strings.HasPrefix(c, "user bob ") {
+			want = append(want, c)
+		}
+	}
+	if got := contents(t, s); !slices.Equal(got, want) {
+		t.Errorf("restored\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+	}{
+		{"newer format", State{Format: Format + 1, Records: map[string]map[string]interface{}{"user": {}}}},
+		{"no format", State{Records: map[string]map[string]interface{}{"user": {}}}},
+		{"entry twice", State{Format: Format, Logs: map[string][]LogEntry{"audit": {{Sequence: 1, Data: "a"}, {Sequence: 1, Data: "b"}}}}},
+		{"unencodable record", State{Format: Format, Records: map[string]map[string]interface{}{"user": {"alice": func() {}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			fill(t, s)
+			before := contents(t, s)
+
+			if err := s.Restore(&tt.state); err == nil {
+				t.Fatal("restored")
+			}
+
+			if got := contents(t, s); !slices.Equal(got, before) {
+				t.Errorf("a failed restore changed the store to\n%s", strings.Join(got, "\n"))
+			}
+		})
+	}
+}
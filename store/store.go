@@ -0,0 +1,534 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("store: not configured")
+
+	// ErrNotFound is returned when getting a record that does not exist
+	ErrNotFound = errors.New("store: record not found")
+
+	// ErrExternal is returned when taking a snapshot of a store kept on a database server,
+	// which is backed up with the server's own tools
+	ErrExternal = errors.New("store: snapshots can only be taken of an SQLite store")
+)
+
+// Store is the database holding the panel's state. Records are JSON documents grouped by
+// kind, such as user or job, and logs are append-only sequences of JSON entries, such as
+// the audit log
+type Store struct {
+	db      *sql.DB
+	dialect dialect
+	path    string
+
+	// The records of every kind as this process last loaded or saved them. Saving a kind
+	// only writes the records this process changed, so that controllers sharing a
+	// database do not undo each other's changes
+	mu   sync.Mutex
+	seen map[string]map[string]string
+}
+
+// Tx is a transaction on the store. Every change made within it is applied at once or
+// not at all
+type Tx struct {
+	tx    *sql.Tx
+	store *Store
+
+	// The records loaded and saved within the transaction, which are only seen once it
+	// is committed
+	seen map[string]map[string]string
+}
+
+var std *Store
+
+// Path returns where the SQLite store is kept in the data directory
+func Path(dataDir string) string {
+	return filepath.Join(dataDir, "store", "panel.db")
+}
+
+// Snapshots returns where the store is snapshotted before it is migrated
+func Snapshots(dataDir string) string {
+	return filepath.Join(dataDir, "store", "snapshots")
+}
+
+// Configure opens the store configured, brings its schema up to date and makes it the
+// store used by the package level functions. A store that already has a schema is
+// snapshotted before it is migrated
+func Configure(dataDir string, c *config.StoreConfiguration) error {
+	s, err := New(dataDir, c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.Migrate(Snapshots(dataDir)); err != nil {
+		s.Close()
+		return err
+	}
+
+	if std != nil {
+		std.Close()
+	}
+	std = s
+
+	return nil
+}
+
+// New opens the store configured without migrating it, which is an SQLite database in
+// the data directory unless a database server is configured
+func New(dataDir string, c *config.StoreConfiguration) (*Store, error) {
+	switch c.Driver {
+	case "", SQLite:
+		return Open(Path(dataDir))
+	case MySQL, Postgres:
+		return Connect(c.Driver, c.DSN, c.MaxConnections)
+	default:
+		return nil, fmt.Errorf("store: unknown driver %q, must be one of sqlite, mysql or postgres", c.Driver)
+	}
+}
+
+// Open opens the SQLite database at the path, creating it if needed
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Writes are synced before they return, and another process such as the command line
+	// waits for the daemon's writes rather than failing
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)"
+
+	db, err := sql.Open(dialects[SQLite].driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, so a single connection keeps the transactions of
+	// this process from failing on each other
+	db.SetMaxOpenConns(1)
+
+	// Connecting creates the database, which is then only readable by the panel
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := open(db, SQLite)
+	s.path = path
+
+	return s, nil
+}
+
+// Connect opens the store on a MySQL or PostgreSQL server
+func Connect(driver string, dsn string, maxConnections int) (*Store, error) {
+	d, ok := dialects[driver]
+	if !ok || driver == SQLite {
+		return nil, fmt.Errorf("store: unknown database server %q", driver)
+	}
+
+	if dsn == "" {
+		return nil, fmt.Errorf("store: the %s data source name must be set", driver)
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxConnections > 0 {
+		db.SetMaxOpenConns(maxConnections)
+	}
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store: failed to connect to %s: %w", driver, err)
+	}
+
+	return open(db, driver), nil
+}
+
+// open returns the store kept in the database
+func open(db *sql.DB, driver string) *Store {
+	return &Store{db: db, dialect: dialects[driver], seen: make(map[string]map[string]string)}
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Snapshot writes a consistent copy of the store to the path, which must not exist, while
+// the store stays in use. Copying the database file itself could miss changes that are
+// only in its write-ahead log
+func (s *Store) Snapshot(path string) error {
+	if s.path == "" {
+		return ErrExternal
+	}
+
+	_, err := s.db.Exec("VACUUM INTO ?", path)
+
+	return err
+}
+
+// Update runs the function in a transaction, which is committed if it returns nil and
+// rolled back otherwise. Transactions must not be nested
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	return s.transaction(false, fn)
+}
+
+// View runs the function in a transaction that only reads
+func (s *Store) View(fn func(tx *Tx) error) error {
+	return s.transaction(true, fn)
+}
+
+// transaction runs the function in a transaction
+func (s *Store) transaction(readOnly bool, fn func(tx *Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("store: failed to begin transaction: %w", err)
+	}
+
+	t := &Tx{tx: tx, store: s, seen: make(map[string]map[string]string)}
+	if err := fn(t); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for kind, records := range t.seen {
+		s.seen[kind] = records
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Embedded returns true if the store is an SQLite database in the data directory rather
+// than on a database server
+func (s *Store) Embedded() bool {
+	return s.path != ""
+}
+
+// exec runs the statement with the placeholders of the database
+func (t *Tx) exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.store.dialect.rebind(query), args...)
+}
+
+// query runs the query with the placeholders of the database
+func (t *Tx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.Query(t.store.dialect.rebind(query), args...)
+}
+
+// queryRow runs the query with the placeholders of the database
+func (t *Tx) queryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(t.store.dialect.rebind(query), args...)
+}
+
+// known returns the records of the kind as this process last loaded or saved them
+func (t *Tx) known(kind string) map[string]string {
+	if records, ok := t.seen[kind]; ok {
+		return records
+	}
+
+	t.store.mu.Lock()
+	defer t.store.mu.Unlock()
+
+	return t.store.seen[kind]
+}
+
+// Get reads the record of the kind with the ID into the value
+func (t *Tx) Get(kind string, id string, v interface{}) error {
+	var data []byte
+	err := t.queryRow("SELECT data FROM records WHERE kind = ? AND id = ?", kind, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Put writes the value as the record of the kind with the ID, replacing any record
+// already there
+func (t *Tx) Put(kind string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return t.put(kind, id, data)
+}
+
+// put writes the record unless it is unchanged
+func (t *Tx) put(kind string, id string, data []byte) error {
+	_, err := t.exec(t.store.dialect.upsert, kind, id, string(data), time.Now().UTC().Format(time.RFC3339Nano))
+
+	return err
+}
+
+// Delete removes the record of the kind with the ID if there is one
+func (t *Tx) Delete(kind string, id string) error {
+	_, err := t.exec("DELETE FROM records WHERE kind = ? AND id = ?", kind, id)
+
+	return err
+}
+
+// Each calls the function with every record of the kind, in the order of their IDs
+func (t *Tx) Each(kind string, fn func(id string, data []byte) error) error {
+	rows, err := t.query("SELECT id, data FROM records WHERE kind = ? ORDER BY id", kind)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Load reads every record of the kind into the map the value points to, which is keyed
+// by ID. Records are decoded into new elements of the map, and what the map held is
+// dropped so that saving it does not bring back records deleted since
+func (t *Tx) Load(kind string, v interface{}) error {
+	m := reflect.ValueOf(v)
+	if m.Kind() != reflect.Pointer || m.Elem().Kind() != reflect.Map || m.Elem().Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("store: can only load into a pointer to a map keyed by string, not %T", v)
+	}
+
+	m = m.Elem()
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	} else {
+		m.Clear()
+	}
+
+	seen := make(map[string]string)
+	err := t.Each(kind, func(id string, data []byte) error {
+		elem := reflect.New(m.Type().Elem())
+		if err := json.Unmarshal(data, elem.Interface()); err != nil {
+			return fmt.Errorf("store: malformed %s %s: %w", kind, id, err)
+		}
+
+		m.SetMapIndex(reflect.ValueOf(id).Convert(m.Type().Key()), elem.Elem())
+		seen[id] = string(data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.seen[kind] = seen
+
+	return nil
+}
+
+// Save writes the changes made to the map since the kind was last loaded or saved, which
+// is keyed by ID. Records removed from the map are deleted, and records this process
+// has not changed are left as they are in the database
+func (t *Tx) Save(kind string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var records map[string]json.RawMessage
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("store: can only save a map keyed by string, not %T", v)
+	}
+
+	known := t.known(kind)
+	seen := make(map[string]string, len(records))
+
+	for id := range known {
+		if _, ok := records[id]; !ok {
+			if err := t.Delete(kind, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for id, data := range records {
+		seen[id] = string(data)
+		if known[id] == string(data) {
+			continue
+		}
+
+		if err := t.put(kind, id, data); err != nil {
+			return err
+		}
+	}
+
+	t.seen[kind] = seen
+
+	return nil
+}
+
+// Append adds the entry with the sequence number to the end of the log. Sequence numbers
+// are unique within a log, so an entry is never overwritten
+func (t *Tx) Append(log string, sequence uint64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.exec("INSERT INTO entries (log, sequence, data) VALUES (?, ?, ?)", log, sequence, string(data))
+
+	return err
+}
+
+// Entries calls the function with every entry of the log from the sequence number on,
+// oldest first
+func (t *Tx) Entries(log string, from uint64, fn func(data []byte) error) error {
+	rows, err := t.query("SELECT data FROM entries WHERE log = ? AND sequence >= ? ORDER BY sequence", log, from)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Last reads the entry with the highest sequence number in the log into the value,
+// returning ErrNotFound if the log is empty
+func (t *Tx) Last(log string, v interface{}) error {
+	var data []byte
+	err := t.queryRow("SELECT data FROM entries WHERE log = ? ORDER BY sequence DESC LIMIT 1", log).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Update runs the function in a transaction on the configured store
+func Update(fn func(tx *Tx) error) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.Update(fn)
+}
+
+// View runs the function in a read only transaction on the configured store
+func View(fn func(tx *Tx) error) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.View(fn)
+}
+
+// Snapshot writes a consistent copy of the configured store to the path
+func Snapshot(path string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return std.Snapshot(path)
+}
+
+// Embedded returns true if the configured store is an SQLite database in the data
+// directory
+func Embedded() bool {
+	return std != nil && std.Embedded()
+}
+
+// Load reads every record of the kind in the configured store into the map the value
+// points to
+func Load(kind string, v interface{}) error {
+	return View(func(tx *Tx) error {
+		return tx.Load(kind, v)
+	})
+}
+
+// Save makes the records of the kind in the configured store match the map
+func Save(kind string, v interface{}) error {
+	return Update(func(tx *Tx) error {
+		return tx.Save(kind, v)
+	})
+}
+
+// Import moves the records of the kind from a JSON file written before the store existed
+// into the store, holding a map keyed by ID. The file is renamed once its records are in
+// the store, so it is only imported once and kept for reference
+func Import(kind string, path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var records map[string]json.RawMessage
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &records); err != nil {
+			return fmt.Errorf("store: failed to import %s: %w", path, err)
+		}
+	}
+
+	err = Update(func(tx *Tx) error {
+		for id, data := range records {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, data); err != nil {
+				return err
+			}
+
+			if err := tx.put(kind, id, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, path+".imported")
+}
@@ -0,0 +1,320 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+type record struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// newStore opens a migrated SQLite store in a directory of its own
+func newStore(t *testing.T) *Store {
+	t.Helper()
+
+	s, err := Open(filepath.Join(t.TempDir(), "panel.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if _, err := s.Migrate(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// ids returns the IDs of every record of the kind in the store
+func ids(t *testing.T, s *Store, kind string) []string {
+	t.Helper()
+
+	var list []string
+	err := s.View(func(tx *Tx) error {
+		return tx.Each(kind, func(id string, data []byte) error {
+			list = append(list, id)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func TestRecords(t *testing.T) {
+	s := newStore(t)
+
+	err := s.Update(func(tx *Tx) error {
+		for _, id := range []string{"b", "a", "c"} {
+			if err := tx.Put("user", id, record{Name: id}); err != nil {
+				return err
+			}
+		}
+		return tx.Put("job", "a", record{Name: "job"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ids(t, s, "user"); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("users %q, want them in order", got)
+	}
+
+	var r record
+	if err := s.View(func(tx *Tx) error { return tx.Get("job", "a", &r) }); err != nil || r.Name != "job" {
+		t.Errorf("job a is %+v, %v", r, err)
+	}
+	if err := s.View(func(tx *Tx) error { return tx.Get("job", "b", &r) }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting a missing record: %v", err)
+	}
+
+	// A transaction that fails changes nothing
+	failed := errors.New("failed")
+	err = s.Update(func(tx *Tx) error {
+		if err := tx.Delete("user", "a"); err != nil {
+			return err
+		}
+		if err := tx.Put("user", "d", record{Name: "d"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("error %v, want the function's", err)
+	}
+	if got := ids(t, s, "user"); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("users %q after a failed transaction", got)
+	}
+}
+
+func TestLoadSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "panel.db")
+
+	// Two controllers sharing the database
+	var stores [2]*Store
+	for i := range stores {
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stores[i] = s
+	}
+	if _, err := stores[0].Migrate(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	first, second := stores[0], stores[1]
+
+	load := func(s *Store) map[string]record {
+		m := map[string]record{"stale": {Name: "stale"}}
+		if err := s.View(func(tx *Tx) error { return tx.Load("user", &m) }); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	save := func(s *Store, m map[string]record) {
+		if err := s.Update(func(tx *Tx) error { return tx.Save("user", m) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save(first, map[string]record{"alice": {Name: "alice"}, "bob": {Name: "bob"}})
+
+	a, b := load(first), load(second)
+	if _, ok := a["stale"]; ok || len(a) != 2 {
+		t.Fatalf("loaded %+v, want the stored records alone", a)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		want   map[string]string
+	}{
+		{
+			"each changes a record",
+			func() {
+				a["alice"] = record{Name: "alice", Size: 1}
+				b["bob"] = record{Name: "bob", Size: 2}
+				save(first, a)
+				save(second, b)
+			},
+			map[string]string{"alice": `{"name":"alice","size":1}`, "bob": `{"name":"bob","size":2}`},
+		},
+		{
+			"one deletes and the other adds",
+			func() {
+				delete(a, "alice")
+				b["carol"] = record{Name: "carol"}
+				save(first, a)
+				save(second, b)
+			},
+			map[string]string{"bob": `{"name":"bob","size":2}`, "carol": `{"name":"carol","size":0}`},
+		},
+		{
+			"loading again drops what was deleted",
+			func() {
+				b = load(second)
+				save(second, b)
+			},
+			map[string]string{"bob": `{"name":"bob","size":2}`, "carol": `{"name":"carol","size":0}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+
+			got := make(map[string]string)
+			err := first.View(func(tx *Tx) error {
+				return tx.Each("user", func(id string, data []byte) error {
+					got[id] = string(data)
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Errorf("records %q, want %q", got, tt.want)
+			}
+			for id, data := range tt.want {
+				if got[id] != data {
+					t.Errorf("%s is %s, want %s", id, got[id], data)
+				}
+			}
+		})
+	}
+
+	if err := first.View(func(tx *Tx) error { return tx.Load("user", &[]record{}) }); err == nil {
+		t.Error("loaded into a slice")
+	}
+	if err := first.Update(func(tx *Tx) error { return tx.Save("user", []record{}) }); err == nil {
+		t.Error("saved a slice")
+	}
+}
+
+func TestLogs(t *testing.T) {
+	s := newStore(t)
+
+	var last record
+	if err := s.View(func(tx *Tx) error { return tx.Last("audit", &last) }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("last entry of an empty log: %v", err)
+	}
+
+	err := s.Update(func(tx *Tx) error {
+		for i, name := range []string{"first", "second", "third"} {
+			if err := tx.Append("audit", uint64(i+1), record{Name: name}); err != nil {
+				return err
+			}
+		}
+		return tx.Append("other", 9, record{Name: "other"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Update(func(tx *Tx) error { return tx.Append("audit", 2, record{Name: "again"}) }); err == nil {
+		t.Error("an entry was overwritten")
+	}
+
+	tests := []struct {
+		from uint64
+		want []string
+	}{
+		{0, []string{`{"name":"first","size":0}`, `{"name":"second","size":0}`, `{"name":"third","size":0}`}},
+		{2, []string{`{"name":"second","size":0}`, `{"name":"third","size":0}`}},
+		{4, nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		err := s.View(func(tx *Tx) error {
+			return tx.Entries("audit", tt.from, func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("entries from %d are %q, want %q", tt.from, got, tt.want)
+		}
+	}
+
+	if err := s.View(func(tx *Tx) error { return tx.Last("audit", &last) }); err != nil || last.Name != "third" {
+		t.Errorf("last entry %+v, %v", last, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	if err := Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		std.Close()
+		std = nil
+	})
+
+	tests := []struct {
+		name    string
+		content string
+		ids     []string
+		ok      bool
+	}{
+		{"missing file", "", nil, true},
+		{"empty file", "-", nil, true},
+		{"records", `{"alice": {"name": "alice"}, "bob": {"name": "bob"}}`, []string{"alice", "bob"}, true},
+		{"malformed", `{"alice": `, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind := "import." + tt.name
+			path := filepath.Join(dir, tt.name+".json")
+
+			switch tt.content {
+			case "":
+			case "-":
+				if err := os.WriteFile(path, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := Import(kind, path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+
+			if got := ids(t, std, kind); !slices.Equal(got, tt.ids) {
+				t.Errorf("imported %q, want %q", got, tt.ids)
+			}
+
+			// A file is imported once, and one that failed is kept to be fixed
+			_, err = os.Stat(path + ".imported")
+			if imported := err == nil; imported != (tt.ok && tt.content != "") {
+				t.Errorf("renamed %v", imported)
+			}
+		})
+	}
+
+	var r record
+	if err := View(func(tx *Tx) error { return tx.Get("import.records", "alice", &r) }); err != nil || r.Name != "alice" {
+		t.Errorf("alice is %+v, %v", r, err)
+	}
+}
@@ -0,0 +1,125 @@
+package support
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// Driver forwards tickets to a helpdesk
+type Driver interface {
+	Name() string
+
+	// Open creates the ticket at the helpdesk, returning its ID there and a link to it
+	// if the helpdesk has one
+	Open(ctx context.Context, t Ticket) (string, string, error)
+}
+
+// newDriver returns the driver for the configuration, or nil when tickets are off
+func newDriver(c *config.SupportConfiguration) (Driver, error) {
+	switch c.Driver {
+	case "none", "":
+		return nil, nil
+	}
+
+	if c.URL == "" {
+		return nil, fmt.Errorf("support: the %s driver requires a URL", c.Driver)
+	}
+
+	switch c.Driver {
+	case "webhook":
+		return newWebhook(c), nil
+	case "zendesk":
+		if c.Username == "" || c.Token == "" {
+			return nil, errors.New("support: the zendesk driver requires the email address of an agent and their API token")
+		}
+		return newZendesk(c), nil
+	case "freshdesk":
+		if c.Token == "" {
+			return nil, errors.New("support: the freshdesk driver requires an API key")
+		}
+		return newFreshdesk(c), nil
+	case "osticket":
+		if c.Token == "" {
+			return nil, errors.New("support: the osticket driver requires an API key")
+		}
+		return newOSTicket(c), nil
+	default:
+		return nil, fmt.Errorf("support: unknown driver %q", c.Driver)
+	}
+}
+
+// client opens tickets at helpdesks
+var client = httpx.Client(timeout)
+
+// do sends the request, returning the body of a successful response
+func do(req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if len(b) > 1024 {
+			b = b[:1024]
+		}
+		return nil, fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return b, nil
+}
+
+// describe returns the message of the ticket followed by the context of the account, as
+// plain text for helpdesks that only take text
+func describe(t Ticket) string {
+	var b strings.Builder
+	c := t.Context
+
+	b.WriteString(t.Message)
+	b.WriteString("\n\n---\nOpened from the panel on " + c.Server + " (" + c.Version + ")\n\n")
+
+	fmt.Fprintf(&b, "Account: %s (%s)\n", c.Account.Username, c.Account.Role)
+	fmt.Fprintf(&b, "Email: %s\n", c.Account.Email)
+	if c.Account.Reseller != "" {
+		fmt.Fprintf(&b, "Reseller: %s\n", c.Account.Reseller)
+	}
+	if c.Account.Package != "" {
+		fmt.Fprintf(&b, "Package: %s\n", c.Account.Package)
+	}
+	if c.Account.Suspended {
+		fmt.Fprintf(&b, "Suspended: %s\n", c.Account.SuspendReason)
+	}
+	fmt.Fprintf(&b, "Created: %s\n", c.Account.Created.Format("2006-01-02"))
+	if !c.Account.LastLogin.IsZero() {
+		fmt.Fprintf(&b, "Last login: %s\n", c.Account.LastLogin.Format("2006-01-02 15:04 MST"))
+	}
+
+	if c.Usage != nil {
+		fmt.Fprintf(&b, "Disk: %d MB\n", c.Usage.Disk>>20)
+		fmt.Fprintf(&b, "Traffic this month: %d MB\n", c.Usage.Traffic>>20)
+	}
+
+	if len(c.Errors) == 0 {
+		b.WriteString("\nNo recent errors\n")
+		return b.String()
+	}
+
+	b.WriteString("\nRecent errors:\n")
+	for _, e := range c.Errors {
+		fmt.Fprintf(&b, "- %s %s: %s\n", e.Time.Format("2006-01-02 15:04 MST"), e.Source, e.Message)
+	}
+
+	return b.String()
+}
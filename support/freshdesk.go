@@ -0,0 +1,71 @@
+package support
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// freshdesk opens tickets through version 2 of the Freshdesk API with an API key
+type freshdesk struct {
+	url string
+	key string
+}
+
+func newFreshdesk(c *config.SupportConfiguration) *freshdesk {
+	return &freshdesk{url: strings.TrimRight(c.URL, "/"), key: c.Token}
+}
+
+func (f *freshdesk) Name() string {
+	return "freshdesk"
+}
+
+// freshdeskPriorities are the priorities of Freshdesk tickets by name
+var freshdeskPriorities = map[string]int{Low: 1, Normal: 2, High: 3, Urgent: 4}
+
+func (f *freshdesk) Open(ctx context.Context, t Ticket) (string, string, error) {
+	// The description is HTML
+	description := strings.ReplaceAll(html.EscapeString(describe(t)), "\n", "<br>")
+
+	b, err := json.Marshal(map[string]interface{}{
+		"subject":     t.Subject,
+		"description": description,
+		"name":        t.Context.Account.Username,
+		"email":       t.Context.Account.Email,
+		"priority":    freshdeskPriorities[t.Priority],
+		"status":      2,
+		"tags":        []string{"cosmicpanel"},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url+"/api/v2/tickets", bytes.NewReader(b))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(f.key, "X")
+
+	resp, err := do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(resp, &created); err != nil {
+		return "", "", err
+	}
+
+	id := strconv.FormatInt(created.ID, 10)
+
+	return id, f.url + "/a/tickets/" + id, nil
+}
@@ -0,0 +1,60 @@
+package support
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// osticket opens tickets through the API of osTicket with a key, which osTicket only
+// accepts from the address the key was created for
+type osticket struct {
+	url string
+	key string
+}
+
+func newOSTicket(c *config.SupportConfiguration) *osticket {
+	return &osticket{url: strings.TrimRight(c.URL, "/"), key: c.Token}
+}
+
+func (o *osticket) Name() string {
+	return "osticket"
+}
+
+// osticketPriorities are the IDs of the priorities osTicket is installed with
+var osticketPriorities = map[string]int{Low: 1, Normal: 2, High: 3, Urgent: 4}
+
+// Open creates the ticket, which osTicket answers with its number
+func (o *osticket) Open(ctx context.Context, t Ticket) (string, string, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"name":     t.Context.Account.Username,
+		"email":    t.Context.Account.Email,
+		"subject":  t.Subject,
+		"message":  "data:text/plain;charset=utf-8," + describe(t),
+		"priority": osticketPriorities[t.Priority],
+		"source":   "API",
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url+"/api/tickets.json", bytes.NewReader(b))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", o.key)
+
+	resp, err := do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	number := strings.TrimSpace(string(resp))
+
+	return number, o.url + "/scp/tickets.php?number=" + number, nil
+}
@@ -0,0 +1,334 @@
+package support
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/provisioning"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+// Priorities of a ticket
+const (
+	Low    = "low"
+	Normal = "normal"
+	High   = "high"
+	Urgent = "urgent"
+)
+
+// States of a ticket
+const (
+	Sent   = "sent"
+	Failed = "failed"
+)
+
+var (
+	// ErrNotConfigured is returned when opening a ticket without a helpdesk
+	ErrNotConfigured = errors.New("support: no helpdesk is configured")
+
+	// ErrNotFound is returned for a ticket that does not exist
+	ErrNotFound = errors.New("support: ticket not found")
+
+	// ErrFailed is returned when the helpdesk refused a ticket or could not be reached
+	ErrFailed = errors.New("support: the helpdesk failed to open the ticket")
+)
+
+// Request is a ticket as a customer writes it
+type Request struct {
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+	Priority string `json:"priority,omitempty"`
+}
+
+// Account is the account a ticket is opened from as the helpdesk sees it
+type Account struct {
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	Phone         string    `json:"phone,omitempty"`
+	Role          string    `json:"role"`
+	Reseller      string    `json:"reseller,omitempty"`
+	Package       string    `json:"package,omitempty"`
+	Suspended     bool      `json:"suspended,omitempty"`
+	SuspendReason string    `json:"suspend_reason,omitempty"`
+	Created       time.Time `json:"created"`
+	LastLogin     time.Time `json:"last_login,omitempty"`
+}
+
+// Error is something that recently failed for the account
+type Error struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// Context is what the panel knows about the account that support would otherwise have
+// to ask for
+type Context struct {
+	Account Account             `json:"account"`
+	Usage   *provisioning.Usage `json:"usage,omitempty"`
+	Errors  []Error             `json:"errors"`
+
+	// The server and build the account is on
+	Server  string `json:"server"`
+	Version string `json:"version"`
+
+	Gathered time.Time `json:"gathered"`
+}
+
+// Ticket is a ticket opened from the panel and where it was forwarded to
+type Ticket struct {
+	ID       string  `json:"id"`
+	User     string  `json:"user"`
+	Subject  string  `json:"subject"`
+	Message  string  `json:"message"`
+	Priority string  `json:"priority"`
+	Context  Context `json:"context"`
+
+	// The helpdesk the ticket was forwarded to, the ticket's ID there and a link to it
+	// when the helpdesk has one
+	Driver string `json:"driver"`
+	Ref    string `json:"ref,omitempty"`
+	URL    string `json:"url,omitempty"`
+
+	State   string    `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// ticketKind is what tickets are kept under in the state store
+const ticketKind = "support.ticket"
+
+// timeout is how long the helpdesk may take to open a ticket
+const timeout = 30 * time.Second
+
+// maxErrors is the most recent errors attached to a ticket
+const maxErrors = 20
+
+type support struct {
+	config *config.SupportConfiguration
+	driver Driver
+}
+
+var std *support
+
+// Configure sets up the driver of the helpdesk. Tickets cannot be opened with the none
+// driver
+func Configure(c *config.SupportConfiguration) error {
+	d, err := newDriver(c)
+	if err != nil {
+		return err
+	}
+
+	std = &support{config: c, driver: d}
+
+	return nil
+}
+
+// Enabled returns true if tickets can be opened
+func Enabled() bool {
+	return std != nil && std.driver != nil
+}
+
+// Gather returns the context attached to a ticket the user opens
+func Gather(u auth.User) Context {
+	c := Context{
+		Account: Account{
+			Username:      u.Username,
+			Email:         u.Email,
+			Phone:         u.Phone,
+			Role:          u.Role,
+			Package:       u.Package,
+			Suspended:     u.Suspended,
+			SuspendReason: u.SuspendReason,
+			Created:       u.Created,
+			LastLogin:     u.LastLogin,
+		},
+		Errors:   []Error{},
+		Version:  buildinfo.Get().Version,
+		Gathered: time.Now().UTC(),
+	}
+	c.Server, _ = os.Hostname()
+
+	if u.Owner != "" {
+		if owner, err := auth.GetUser(u.Owner); err == nil {
+			c.Account.Reseller = owner.Username
+		}
+	}
+
+	log := zap.S().Named("support")
+
+	if u.Role != auth.RoleAdmin {
+		if usage, err := provisioning.GetUsage(u.Username); err == nil {
+			c.Usage = &usage
+		} else {
+			log.Warnw("failed to measure usage for ticket", "username", u.Username, zap.Error(err))
+		}
+	}
+
+	days := 7
+	if std != nil && std.config.Days > 0 {
+		days = std.config.Days
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	for _, j := range jobs.List(jobs.Failed, "") {
+		if j.Actor == u.Username && j.Finished.After(since) {
+			c.Errors = append(c.Errors, Error{Time: j.Finished, Source: "job " + j.Type, Message: j.Error})
+		}
+	}
+
+	deliveries, err := notify.Deliveries(notify.Filter{Username: u.Username, Status: notify.Failed, Limit: maxErrors})
+	if err != nil {
+		log.Warnw("failed to read failed notifications for ticket", "username", u.Username, zap.Error(err))
+	}
+	for _, d := range deliveries {
+		if d.Time.After(since) {
+			c.Errors = append(c.Errors, Error{Time: d.Time, Source: "notification " + d.Kind + " by " + d.Channel, Message: d.Error})
+		}
+	}
+
+	activity, err := events.Query(events.Filter{Actor: u.Username, Since: since})
+	if err != nil {
+		log.Warnw("failed to read activity for ticket", "username", u.Username, zap.Error(err))
+	}
+	for _, e := range activity {
+		if msg, ok := e.Data["error"].(string); ok && msg != "" {
+			c.Errors = append(c.Errors, Error{Time: e.Time, Source: e.Type, Message: msg})
+		}
+	}
+
+	sort.Slice(c.Errors, func(i, j int) bool { return c.Errors[i].Time.After(c.Errors[j].Time) })
+	if len(c.Errors) > maxErrors {
+		c.Errors = c.Errors[:maxErrors]
+	}
+
+	return c
+}
+
+// Open forwards a ticket from the user to the helpdesk with the context of their
+// account. The ticket is kept whether or not the helpdesk took it, so that admins can
+// see the tickets that did not reach it
+func Open(u auth.User, r Request) (Ticket, error) {
+	if !Enabled() {
+		return Ticket{}, ErrNotConfigured
+	}
+
+	r.Subject = strings.TrimSpace(r.Subject)
+	r.Message = strings.TrimSpace(r.Message)
+
+	if r.Subject == "" || r.Message == "" {
+		return Ticket{}, errors.New("support: a ticket needs a subject and a message")
+	}
+
+	switch r.Priority {
+	case "":
+		r.Priority = Normal
+	case Low, Normal, High, Urgent:
+	default:
+		return Ticket{}, errors.New("support: priority must be one of low, normal, high or urgent")
+	}
+
+	t := Ticket{
+		ID:       ids.New(),
+		User:     u.ID,
+		Subject:  r.Subject,
+		Message:  r.Message,
+		Priority: r.Priority,
+		Context:  Gather(u),
+		Driver:   std.driver.Name(),
+		State:    Sent,
+		Created:  time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	t.Ref, t.URL, err = std.driver.Open(ctx, t)
+	if err != nil {
+		t.State, t.Error = Failed, err.Error()
+		zap.S().Named("support").Errorw("failed to forward ticket to helpdesk", "driver", t.Driver, "username", u.Username, zap.Error(err))
+		err = fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+
+	if serr := store.Update(func(tx *store.Tx) error { return tx.Put(ticketKind, t.ID, t) }); serr != nil {
+		return t, serr
+	}
+
+	events.Publish(events.Event{
+		Type:     "support.ticket",
+		Actor:    u.Username,
+		Resource: t.ID,
+		Data:     map[string]interface{}{"driver": t.Driver, "ref": t.Ref, "state": t.State, "priority": t.Priority},
+	})
+
+	return t, err
+}
+
+// List returns the tickets opened by the users, or every ticket when none are given,
+// newest first
+func List(users ...string) ([]Ticket, error) {
+	list := []Ticket{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(ticketKind, func(id string, data []byte) error {
+			var t Ticket
+			if err := json.Unmarshal(data, &t); err != nil {
+				return err
+			}
+
+			if len(users) == 0 || slices.Contains(users, t.User) {
+				list = append(list, t)
+			}
+			return nil
+		})
+	})
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	return list, err
+}
+
+// Get returns the ticket with the ID
+func Get(id string) (Ticket, error) {
+	var t Ticket
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(ticketKind, id, &t)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return t, ErrNotFound
+	}
+
+	return t, err
+}
+
+// Delete removes the ticket from the panel. The ticket stays open at the helpdesk
+func Delete(id string) error {
+	err := store.Update(func(tx *store.Tx) error {
+		if err := tx.Get(ticketKind, id, &Ticket{}); err != nil {
+			return err
+		}
+		return tx.Delete(ticketKind, id)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrNotFound
+	}
+
+	return err
+}
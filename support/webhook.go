@@ -0,0 +1,66 @@
+package support
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// webhook POSTs tickets as JSON to a URL, for helpdesks the panel has no driver for and
+// for automation. The body is signed with an HMAC-SHA256 of the secret in the
+// X-CosmicPanel-Signature header when one is set
+type webhook struct {
+	url    string
+	secret string
+}
+
+func newWebhook(c *config.SupportConfiguration) *webhook {
+	return &webhook{url: c.URL, secret: c.Token}
+}
+
+func (h *webhook) Name() string {
+	return "webhook"
+}
+
+// Open POSTs the ticket with its context. The receiver may answer with the id of the
+// ticket it opened and a url to it
+func (h *webhook) Open(ctx context.Context, t Ticket) (string, string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(b))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(b)
+		req.Header.Set("X-CosmicPanel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	body, err := do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	var opened struct {
+		ID  json.RawMessage `json:"id"`
+		URL string          `json:"url"`
+	}
+	if json.Unmarshal(body, &opened) != nil {
+		return "", "", nil
+	}
+
+	return strings.Trim(string(opened.ID), `"`), opened.URL, nil
+}
@@ -0,0 +1,82 @@
+package support
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+// zendesk opens tickets through the Zendesk Support API, as the customer with the API
+// token of an agent
+type zendesk struct {
+	url   string
+	email string
+	token string
+}
+
+func newZendesk(c *config.SupportConfiguration) *zendesk {
+	return &zendesk{url: strings.TrimRight(c.URL, "/"), email: c.Username, token: c.Token}
+}
+
+func (z *zendesk) Name() string {
+	return "zendesk"
+}
+
+func (z *zendesk) Open(ctx context.Context, t Ticket) (string, string, error) {
+	var body struct {
+		Ticket struct {
+			Subject  string `json:"subject"`
+			Priority string `json:"priority"`
+			Comment  struct {
+				Body string `json:"body"`
+			} `json:"comment"`
+			Requester struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			} `json:"requester"`
+			Tags []string `json:"tags"`
+		} `json:"ticket"`
+	}
+
+	body.Ticket.Subject = t.Subject
+	body.Ticket.Priority = t.Priority
+	body.Ticket.Comment.Body = describe(t)
+	body.Ticket.Requester.Name = t.Context.Account.Username
+	body.Ticket.Requester.Email = t.Context.Account.Email
+	body.Ticket.Tags = []string{"cosmicpanel"}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, z.url+"/api/v2/tickets.json", bytes.NewReader(b))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(z.email+"/token", z.token)
+
+	resp, err := do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	var created struct {
+		Ticket struct {
+			ID int64 `json:"id"`
+		} `json:"ticket"`
+	}
+	if err := json.Unmarshal(resp, &created); err != nil {
+		return "", "", err
+	}
+
+	id := strconv.FormatInt(created.Ticket.ID, 10)
+
+	return id, z.url + "/agent/tickets/" + id, nil
+}
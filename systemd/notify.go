@@ -0,0 +1,86 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Notify sends a state such as READY=1 to systemd over the socket it passes to services
+// with Type=notify. It does nothing if the daemon was not started by systemd
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract sockets are passed with a leading @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// Ready tells systemd the daemon has finished starting
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Stopping tells systemd the daemon is shutting down
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Status sets the status shown by systemctl status
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns how often systemd expects to hear from the daemon, or zero if
+// the watchdog is not enabled for it
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog may be meant for another process, such as a wrapper script
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the systemd watchdog at half the interval it expects for as long as
+// healthy returns nil, so that systemd restarts the daemon if it stops responding. It
+// blocks, and returns immediately if the watchdog is not enabled
+func Watchdog(healthy func() error) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	for range time.Tick(interval / 2) {
+		if err := healthy(); err != nil {
+			zap.S().Named("systemd").Warnw("skipping watchdog ping, the daemon is unhealthy", zap.Error(err))
+			continue
+		}
+
+		if err := Notify("WATCHDOG=1"); err != nil {
+			zap.S().Named("systemd").Errorw("failed to ping watchdog", zap.Error(err))
+		}
+	}
+}
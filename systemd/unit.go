@@ -0,0 +1,160 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// Service is the name of the service the daemon is installed as
+const Service = "cosmicpanel.service"
+
+// DefaultUnit is where the unit is installed unless told otherwise
+const DefaultUnit = "/etc/systemd/system/" + Service
+
+// Unit describes the service the daemon is installed as
+type Unit struct {
+	// The absolute paths of the binary and the configuration file it is started with
+	Binary string
+	Config string
+
+	// How long systemd waits to hear from the daemon before restarting it. The daemon
+	// pings at half this interval
+	WatchdogSec int
+}
+
+// unitTemplate is the unit file. The daemon runs as root since it manages users, the
+// firewall and system services, so only what none of those ever need is locked down.
+// Temporary directories and cgroups are left shared since scans and containers use them.
+// The panel's own system user owns its data directory, see config.EnsureUser
+var unitTemplate = template.Must(template.New("unit").Parse(`# Managed by CosmicPanel, reinstall with cosmicpanel service install
+[Unit]
+Description=CosmicPanel web hosting control panel
+Documentation=https://github.com/cosmicpanel/CosmicPanel
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+User=root
+Group=root
+WorkingDirectory={{.Dir}}
+ExecStart={{.Binary}} serve -config {{.Config}}
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+WatchdogSec={{.WatchdogSec}}
+TimeoutStartSec=300
+TimeoutStopSec=30
+KillMode=mixed
+LimitNOFILE=65536
+
+ProtectClock=yes
+ProtectKernelLogs=yes
+RestrictRealtime=yes
+LockPersonality=yes
+SystemCallArchitectures=native
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// Render returns the contents of the unit file
+func (u Unit) Render() ([]byte, error) {
+	for _, p := range []string{u.Binary, u.Config} {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("systemd: %s must be an absolute path", p)
+		}
+
+		if strings.ContainsAny(p, " \t\n\"'\\%") {
+			return nil, fmt.Errorf("systemd: %s contains characters that cannot be used in a unit", p)
+		}
+	}
+
+	if u.WatchdogSec <= 0 {
+		return nil, fmt.Errorf("systemd: watchdog interval must be positive")
+	}
+
+	var buf bytes.Buffer
+	err := unitTemplate.Execute(&buf, struct {
+		Unit
+		Dir string
+	}{u, filepath.Dir(u.Config)})
+
+	return buf.Bytes(), err
+}
+
+// Install writes the unit to the path, reloads systemd and enables the service so that
+// it starts on boot. The service is started or restarted if now is set
+func Install(u Unit, path string, now bool) error {
+	b, err := u.Render()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+
+	if err := systemctl("enable", name); err != nil {
+		return err
+	}
+
+	if now {
+		return systemctl("restart", name)
+	}
+
+	return nil
+}
+
+// Uninstall stops and disables the service and removes the unit
+func Uninstall(path string) error {
+	name := filepath.Base(path)
+
+	if err := systemctl("disable", "--now", name); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return systemctl("daemon-reload")
+}
+
+// Active returns true if the service is running
+func Active(name string) bool {
+	return privsep.Command("systemctl", "is-active", "--quiet", name).Run() == nil
+}
+
+// Restart restarts the service
+func Restart(name string) error {
+	return systemctl("restart", name)
+}
+
+// systemctl runs systemctl, including its output in the error
+func systemctl(args ...string) error {
+	out, err := privsep.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package throttle
+
+import "github.com/cosmicpanel/CosmicPanel/privsep"
+
+// lower does nothing, as nice values outside Linux apply to the whole daemon rather than
+// a thread. Only the privileged commands of a task are limited
+func lower(l privsep.Limits) error {
+	return nil
+}
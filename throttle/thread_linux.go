@@ -0,0 +1,14 @@
+package throttle
+
+import (
+	"syscall"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// lower sets the nice value and I/O priority of the current thread, which the processes
+// it starts inherit. Cgroup weights are left to privileged commands, as moving a single
+// thread would need the cgroup of the whole daemon to be threaded
+func lower(l privsep.Limits) error {
+	return privsep.SetPriority(syscall.Gettid(), l)
+}
@@ -0,0 +1,138 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"go.uber.org/zap"
+)
+
+// Classes of maintenance tasks, which are limited alike
+const (
+	Backups   = "backups"
+	Stats     = "stats"
+	Malware   = "malware"
+	Disk      = "disk"
+	Scheduler = "scheduler"
+)
+
+// Classes is every class of maintenance task
+var Classes = []string{Backups, Stats, Malware, Disk, Scheduler}
+
+// class is the limits and timeout of a class of tasks
+type class struct {
+	limits  privsep.Limits
+	timeout time.Duration
+}
+
+var std map[string]class
+
+// classKey is the key of the class a context was given by Run
+type classKey struct{}
+
+// Configure checks the limits of every class. Tasks run unconstrained until it is called
+func Configure(c *config.ThrottleConfiguration) error {
+	classes := make(map[string]class)
+
+	for name, cl := range c.Classes {
+		if !slices.Contains(Classes, name) {
+			return fmt.Errorf("throttle: unknown class %q", name)
+		}
+
+		l := privsep.Limits{
+			Nice:       cl.Nice,
+			IOClass:    cl.IOClass,
+			IOPriority: cl.IOPriority,
+			CPUWeight:  cl.CPUWeight,
+			IOWeight:   cl.IOWeight,
+		}
+		if l.CPUWeight > 0 || l.IOWeight > 0 {
+			l.Group = name
+		}
+
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("%w for class %s", err, name)
+		}
+		if cl.Timeout < 0 {
+			return fmt.Errorf("throttle: negative timeout for class %s", name)
+		}
+
+		classes[name] = class{limits: l, timeout: time.Duration(cl.Timeout) * time.Minute}
+	}
+
+	std = classes
+
+	return nil
+}
+
+// Run runs fn with the limits of the class, cancelling its context once the class times
+// out. The nice value and I/O priority apply to the work fn does itself and the processes
+// it starts, and Command applies every limit to the privileged commands it runs. fn runs
+// on an OS thread of its own, which is thrown away once it returns as its priority cannot
+// be raised again
+func Run(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	cl := std[name]
+
+	if cl.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cl.timeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, classKey{}, name)
+
+	type result struct {
+		err      error
+		panicked bool
+		value    interface{}
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		// Exiting without unlocking the thread ends it
+		runtime.LockOSThread()
+
+		defer func() {
+			if v := recover(); v != nil {
+				done <- result{panicked: true, value: v}
+			}
+		}()
+
+		if err := lower(cl.limits); err != nil {
+			zap.S().Named("throttle").Warnw("failed to lower the priority of task", "class", name, zap.Error(err))
+		}
+
+		done <- result{err: fn(ctx)}
+	}()
+
+	r := <-done
+	if r.panicked {
+		panic(r.value)
+	}
+
+	return r.err
+}
+
+// Command returns the privileged command, limited like the class the context was given
+// by Run and killed once the context is done
+func Command(ctx context.Context, name string, arg ...string) *privsep.Cmd {
+	cmd := privsep.CommandContext(ctx, name, arg...)
+
+	if cl, ok := std[Of(ctx)]; ok {
+		l := cl.limits
+		cmd.Limits = &l
+	}
+
+	return cmd
+}
+
+// Of returns the class the context was given by Run, or an empty string outside of Run
+func Of(ctx context.Context) string {
+	name, _ := ctx.Value(classKey{}).(string)
+
+	return name
+}
@@ -0,0 +1,382 @@
+package tlspolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// The mass operation changing the policy of many domains at once, which rolls a stricter
+// policy out to a few sites before it reaches every one
+const bulkType = "tls.policy"
+
+// domainKind is what the policies of domains are kept under in the state store
+const domainKind = "tlspolicy.domain"
+
+// domainPlaceholder stands for the name of the domain in the paths of its files
+const domainPlaceholder = "{domain}"
+
+// domainHeader starts every file the policy of a domain is rendered into
+const domainHeader = "# Managed by CosmicPanel, changes are overwritten when the TLS policy of the domain changes\n"
+
+// ErrNoDomainPolicy is returned for a domain that has the server wide policy
+var ErrNoDomainPolicy = errors.New("tlspolicy: the domain has no policy of its own")
+
+// HSTSHeader is the Strict-Transport-Security header of the policy of a domain. No header
+// is sent when MaxAge is 0
+type HSTSHeader struct {
+	MaxAge            int  `json:"maxAge"`
+	IncludeSubdomains bool `json:"includeSubdomains"`
+	Preload           bool `json:"preload"`
+}
+
+// Domain is the policy of a domain set by a mass operation, which takes precedence over
+// the server wide policy in its server block or virtual host
+type Domain struct {
+	Domain       string     `json:"domain"`
+	MinVersion   string     `json:"minVersion"`
+	Ciphers      []string   `json:"ciphers"`
+	HSTS         HSTSHeader `json:"hsts"`
+	OCSPStapling bool       `json:"ocspStapling"`
+	Updated      time.Time  `json:"updated"`
+}
+
+// Change is what a mass operation changes in the policy of each domain. Settings left
+// out are kept from the domain's policy, or taken from the server wide one when it has
+// none. Reset removes the policy of the domain instead, so that the server wide one
+// applies again
+type Change struct {
+	MinVersion   string      `json:"minVersion"`
+	Ciphers      []string    `json:"ciphers"`
+	HSTS         *HSTSHeader `json:"hsts"`
+	OCSPStapling *bool       `json:"ocspStapling"`
+	Reset        bool        `json:"reset"`
+}
+
+// policy validates the policy of the domain
+func (d Domain) policy() (*Policy, error) {
+	c := &config.TLSConfiguration{MinVersion: d.MinVersion, Ciphers: d.Ciphers, OCSPStapling: d.OCSPStapling}
+	c.HSTS.MaxAge = d.HSTS.MaxAge
+	c.HSTS.IncludeSubdomains = d.HSTS.IncludeSubdomains
+	c.HSTS.Preload = d.HSTS.Preload
+
+	return newPolicy(c)
+}
+
+// domainServer is a web server the policies of domains are rendered into, in a file
+// included by the server block or virtual host of each domain
+type domainServer struct {
+	name   string
+	paths  []string
+	render func(p *Policy) string
+	test   func() error
+	reload func() error
+}
+
+// domainServers returns the web servers the policies of domains are rendered for
+func (m *Manager) domainServers() []domainServer {
+	n, a := &nginx{}, &apache{}
+
+	return []domainServer{
+		{
+			name:   "tls.domains.nginx",
+			paths:  []string{m.config.Domains.Nginx},
+			render: func(p *Policy) string { return domainHeader + nginxDirectives(p) },
+			test:   n.test,
+			reload: n.reload,
+		},
+		{
+			name:   "tls.domains.apache",
+			paths:  m.config.Domains.Apache,
+			render: func(p *Policy) string { return domainHeader + apacheDirectives(p, false) },
+			test:   a.test,
+			reload: a.reload,
+		},
+	}
+}
+
+// file returns the path of the file of the domain, or an empty string when the server is
+// not installed
+func (s domainServer) file(domain string) string {
+	for _, path := range s.paths {
+		if path = strings.ReplaceAll(path, domainPlaceholder, domain); reconcile.Installed(path) {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// domainSource generates the file of every domain with a policy of its own for the server
+func domainSource(s domainServer) reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			list, err := Domains()
+			if err != nil {
+				return nil, err
+			}
+
+			var artifacts []reconcile.Artifact
+			for _, d := range list {
+				path := s.file(d.Domain)
+				if path == "" {
+					continue
+				}
+
+				p, err := d.policy()
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", d.Domain, err)
+				}
+
+				artifacts = append(artifacts, reconcile.Artifact{Path: path, Content: s.render(p)})
+			}
+
+			return artifacts, nil
+		},
+		Test:   s.test,
+		Reload: s.reload,
+	}
+}
+
+// configureDomains checks the paths of the files of domains, and registers them with the
+// reconciler and the mass operation changing them
+func (m *Manager) configureDomains() error {
+	c := m.config.Domains
+	if c.Nginx != "" && !strings.Contains(c.Nginx, domainPlaceholder) {
+		return fmt.Errorf("tlspolicy: the nginx file %q of domains does not contain %s", c.Nginx, domainPlaceholder)
+	}
+
+	for _, path := range c.Apache {
+		if !strings.Contains(path, domainPlaceholder) {
+			return fmt.Errorf("tlspolicy: the apache file %q of domains does not contain %s", path, domainPlaceholder)
+		}
+	}
+
+	for _, s := range m.domainServers() {
+		reconcile.Register(s.name, domainSource(s))
+	}
+
+	bulk.Register(bulk.Type{
+		Name:    bulkType,
+		Run:     changeItem,
+		All:     domainItems,
+		Check:   bulk.SiteCheck(m.config.Check),
+		Account: func(it bulk.Item) string { return registrar.Account(normalize(it.Key)) },
+	})
+
+	return nil
+}
+
+// Domains returns the domains with a policy of their own, sorted by name
+func Domains() ([]Domain, error) {
+	list := []Domain{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(domainKind, func(id string, data []byte) error {
+			var d Domain
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("tlspolicy: malformed policy of %s: %w", id, err)
+			}
+
+			list = append(list, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+
+	return list, nil
+}
+
+// GetDomain returns the policy of the domain
+func GetDomain(domain string) (Domain, error) {
+	var d Domain
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(domainKind, normalize(domain), &d)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Domain{}, ErrNoDomainPolicy
+	}
+
+	return d, err
+}
+
+// setDomain renders the policy of the domain for every installed web server and keeps
+// it. The files are put back if a server rejects them
+func setDomain(d Domain) error {
+	p, err := d.policy()
+	if err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, s := range std.domainServers() {
+		if path := s.file(d.Domain); path != "" {
+			if _, err := reconcile.Write(s.name, domainSource(s), reconcile.Artifact{Path: path, Content: s.render(p)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(domainKind, d.Domain, d)
+	})
+}
+
+// resetDomain removes the files of the domain, so that the server wide policy applies to
+// it again
+func resetDomain(domain string) error {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, s := range std.domainServers() {
+		if path := s.file(domain); path != "" {
+			if _, err := reconcile.Remove(s.name, domainSource(s), path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Delete(domainKind, domain)
+	})
+}
+
+// changeItem changes the policy of the domain the item is keyed by
+func changeItem(ctx context.Context, actor string, it bulk.Item) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	var c Change
+	if err := it.Decode(&c); err != nil {
+		return err
+	}
+
+	domain := normalize(it.Key)
+	if !hostname.Valid(domain) {
+		return fmt.Errorf("tlspolicy: invalid domain %q", domain)
+	}
+
+	before, err := GetDomain(domain)
+	if err != nil && !errors.Is(err, ErrNoDomainPolicy) {
+		return err
+	}
+
+	e := events.Event{Type: "tls.domain", Actor: actor, Resource: domain}
+	if before.Domain != "" {
+		e.Before, _ = json.Marshal(before)
+	}
+
+	if c.Reset {
+		if before.Domain == "" {
+			return nil
+		}
+		if err := resetDomain(domain); err != nil {
+			return err
+		}
+
+		events.Publish(e)
+		return nil
+	}
+
+	if c.MinVersion == "" && c.Ciphers == nil && c.HSTS == nil && c.OCSPStapling == nil {
+		return errors.New("tlspolicy: the operation changes no settings")
+	}
+
+	d := before
+	if d.Domain == "" {
+		d = serverDomain()
+	}
+	d.Domain = domain
+
+	if c.MinVersion != "" {
+		d.MinVersion = c.MinVersion
+	}
+	if c.Ciphers != nil {
+		d.Ciphers = c.Ciphers
+	}
+	if c.HSTS != nil {
+		d.HSTS = *c.HSTS
+	}
+	if c.OCSPStapling != nil {
+		d.OCSPStapling = *c.OCSPStapling
+	}
+	d.Updated = time.Now().UTC()
+
+	if err := setDomain(d); err != nil {
+		return err
+	}
+
+	e.After, _ = json.Marshal(d)
+	events.Publish(e)
+
+	return nil
+}
+
+// serverDomain returns the server wide policy as the policy of a domain, which changes
+// to domains without a policy of their own start from
+func serverDomain() Domain {
+	c := std.config
+
+	return Domain{
+		MinVersion:   c.MinVersion,
+		Ciphers:      c.Ciphers,
+		HSTS:         HSTSHeader{MaxAge: c.HSTS.MaxAge, IncludeSubdomains: c.HSTS.IncludeSubdomains, Preload: c.HSTS.Preload},
+		OCSPStapling: c.OCSPStapling,
+	}
+}
+
+// domainItems returns an item for every domain registered through the panel or with a
+// policy of its own, which is what operations without items change
+func domainItems() ([]bulk.Item, error) {
+	seen := map[string]bool{}
+	items := []bulk.Item{}
+
+	registered, err := registrar.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range registered {
+		if name := normalize(d.Name); !seen[name] {
+			seen[name] = true
+			items = append(items, bulk.Item{Key: name})
+		}
+	}
+
+	list, err := Domains()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		if !seen[d.Domain] {
+			seen[d.Domain] = true
+			items = append(items, bulk.Item{Key: d.Domain})
+		}
+	}
+
+	return items, nil
+}
+
+// normalize returns the domain in lowercase without a trailing dot
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
@@ -0,0 +1,207 @@
+package tlspolicy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// postfix applies the policy to the SMTP server with postconf. Outgoing connections are
+// left alone so that mail can still be delivered to servers with older TLS stacks
+type postfix struct {
+	postconf string
+}
+
+func (t *postfix) Name() string {
+	return "postfix"
+}
+
+func (t *postfix) Installed() bool {
+	_, err := os.Stat(t.postconf)
+	return err == nil
+}
+
+// settings returns the main.cf parameters for the policy. Protocols are excluded rather
+// than listed as a minimum since Postfix only understands >=TLSv1.2 from 3.6
+func (t *postfix) settings(p *Policy) [][2]string {
+	excluded := "!SSLv2, !SSLv3, !TLSv1, !TLSv1.1"
+	if p.MinVersion == "1.3" {
+		excluded += ", !TLSv1.2"
+	}
+
+	settings := [][2]string{
+		{"smtpd_tls_protocols", excluded},
+		{"smtpd_tls_mandatory_protocols", excluded},
+	}
+
+	if list := p.cipherList(); list != "" {
+		settings = append(settings,
+			[2]string{"smtpd_tls_ciphers", "high"},
+			[2]string{"smtpd_tls_mandatory_ciphers", "high"},
+			[2]string{"tls_high_cipherlist", list},
+			[2]string{"tls_preempt_cipherlist", "yes"},
+		)
+	}
+
+	return settings
+}
+
+func (t *postfix) Apply(p *Policy) (bool, error) {
+	var changed []string
+	for _, s := range t.settings(p) {
+		if value, err := t.get(s[0]); err == nil && value == s[1] {
+			continue
+		}
+		changed = append(changed, s[0]+"="+s[1])
+	}
+
+	if len(changed) == 0 {
+		return false, nil
+	}
+
+	dir, err := t.get("config_directory")
+	if err != nil {
+		return false, err
+	}
+
+	// main.cf is put back if postfix rejects the settings or fails to reload
+	err = reconcile.Change("tls.postfix", reconcile.Source{Test: t.test, Reload: t.reload}, []string{filepath.Join(dir, "main.cf")}, func() error {
+		return privsep.Run(t.postconf, append([]string{"-e"}, changed...)...)
+	})
+
+	return err == nil, err
+}
+
+func (t *postfix) test() error {
+	return privsep.Run("postfix", "check")
+}
+
+func (t *postfix) reload() error {
+	return privsep.Run("postfix", "reload")
+}
+
+func (t *postfix) Plan(p *Policy, plan *dryrun.Plan) error {
+	changed := false
+	for _, s := range t.settings(p) {
+		if value, err := t.get(s[0]); err == nil && value == s[1] {
+			continue
+		}
+
+		plan.Add(dryrun.File, dryrun.Modify, "main.cf", s[0]+" = "+s[1])
+		changed = true
+	}
+
+	if changed {
+		plan.Add(dryrun.Service, dryrun.Reload, "postfix", "")
+	}
+
+	return nil
+}
+
+func (t *postfix) Drift(p *Policy) ([]string, error) {
+	var drift []string
+	for _, s := range t.settings(p) {
+		value, err := t.get(s[0])
+		if err != nil {
+			return drift, err
+		}
+
+		if value != s[1] {
+			drift = append(drift, fmt.Sprintf("main.cf sets %s = %s", s[0], value))
+		}
+	}
+
+	return drift, nil
+}
+
+// get returns the value Postfix is using for the parameter
+func (t *postfix) get(name string) (string, error) {
+	out, err := privsep.Command(t.postconf, "-h", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read postfix parameter %s: %w", name, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// dovecot renders the policy into a file in conf.d, which is loaded after the
+// distribution's own ssl settings
+type dovecot struct {
+	path string
+}
+
+func (t *dovecot) Name() string {
+	return "dovecot"
+}
+
+func (t *dovecot) Installed() bool {
+	return reconcile.Installed(t.path)
+}
+
+// settings returns the dovecot settings for the policy
+func (t *dovecot) settings(p *Policy) [][2]string {
+	settings := [][2]string{{"ssl_min_protocol", "TLSv" + p.MinVersion}}
+
+	if list := p.cipherList(); list != "" {
+		settings = append(settings,
+			[2]string{"ssl_cipher_list", list},
+			[2]string{"ssl_prefer_server_ciphers", "yes"},
+		)
+	}
+
+	return settings
+}
+
+func (t *dovecot) render(p *Policy) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, s := range t.settings(p) {
+		fmt.Fprintf(&b, "%s = %s\n", s[0], s[1])
+	}
+
+	return b.String()
+}
+
+func (t *dovecot) file() string {
+	return t.path
+}
+
+func (t *dovecot) test() error {
+	return privsep.Run("doveconf", "-n")
+}
+
+func (t *dovecot) reload() error {
+	return privsep.Run("doveadm", "reload")
+}
+
+func (t *dovecot) Apply(p *Policy) (bool, error) {
+	return writeManaged(t, t.render(p))
+}
+
+func (t *dovecot) Plan(p *Policy, plan *dryrun.Plan) error {
+	return planManaged(plan, t.path, t.render(p), "dovecot")
+}
+
+func (t *dovecot) Drift(p *Policy) ([]string, error) {
+	drift := fileDrift(t.path, t.render(p))
+
+	// Settings in files loaded later override the managed file, so the values dovecot
+	// is actually using are compared
+	for _, s := range t.settings(p) {
+		out, err := privsep.Command("doveconf", "-h", s[0]).Output()
+		if err != nil {
+			return drift, fmt.Errorf("failed to read dovecot setting %s: %w", s[0], err)
+		}
+
+		if value := strings.TrimSpace(string(out)); value != s[1] {
+			drift = append(drift, fmt.Sprintf("dovecot is using %s = %s", s[0], value))
+		}
+	}
+
+	return drift, nil
+}
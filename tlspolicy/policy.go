@@ -0,0 +1,330 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"go.uber.org/zap"
+)
+
+// ErrNotConfigured is returned when using the policy before Configure is called
+var ErrNotConfigured = errors.New("tlspolicy: not configured")
+
+// openssl maps the IANA names of the supported TLS 1.2 cipher suites to the names used
+// by OpenSSL, which every service rendered into is built against
+var openssl = map[string]string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       "ECDHE-ECDSA-AES128-GCM-SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         "ECDHE-RSA-AES128-GCM-SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       "ECDHE-ECDSA-AES256-GCM-SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         "ECDHE-RSA-AES256-GCM-SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": "ECDHE-ECDSA-CHACHA20-POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   "ECDHE-RSA-CHACHA20-POLY1305",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          "ECDHE-ECDSA-AES128-SHA",
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            "ECDHE-RSA-AES128-SHA",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          "ECDHE-ECDSA-AES256-SHA",
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            "ECDHE-RSA-AES256-SHA",
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               "AES128-GCM-SHA256",
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               "AES256-GCM-SHA384",
+}
+
+// Policy is the validated TLS policy
+type Policy struct {
+	MinVersion   string   `json:"minVersion"`
+	Ciphers      []string `json:"ciphers"`
+	HSTS         string   `json:"hsts"`
+	OCSPStapling bool     `json:"ocspStapling"`
+
+	version uint16
+	suites  []uint16
+}
+
+// Target is a service the policy is applied to and checked against
+type Target struct {
+	Name      string   `json:"name"`
+	Installed bool     `json:"installed"`
+	Compliant bool     `json:"compliant"`
+	Drift     []string `json:"drift"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Report shows whether every service matches the policy
+type Report struct {
+	Generated time.Time `json:"generated"`
+	Policy    Policy    `json:"policy"`
+	Compliant bool      `json:"compliant"`
+	Targets   []Target  `json:"targets"`
+}
+
+// target renders the policy into a service and reads back what the service is using
+type target interface {
+	Name() string
+	Installed() bool
+
+	// Apply writes the policy, reloading the service if anything changed
+	Apply(p *Policy) (bool, error)
+
+	// Plan records what Apply would change without changing anything
+	Plan(p *Policy, plan *dryrun.Plan) error
+
+	// Drift returns a description of every setting that does not match the policy
+	Drift(p *Policy) ([]string, error)
+}
+
+// managed is a target the policy is rendered into a file of its own for, which the
+// reconciler keeps as rendered
+type managed interface {
+	target
+
+	file() string
+	render(p *Policy) string
+	test() error
+	reload() error
+}
+
+// Manager applies the policy to every installed service
+type Manager struct {
+	mu      sync.Mutex
+	config  *config.TLSConfiguration
+	policy  *Policy
+	targets []target
+}
+
+var std *Manager
+
+// Configure validates the policy in the configuration, and registers the mass operation
+// rolling a policy out to domains. The panel's own listener is included in reports, with
+// panel being the panel's configuration
+func Configure(c *config.TLSConfiguration, panel *config.PanelConfiguration) error {
+	p, err := newPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	m := &Manager{
+		config: c,
+		policy: p,
+		targets: []target{
+			&panelTarget{config: panel},
+			&nginx{path: c.Nginx},
+			&apache{path: reconcile.FirstInstalled(c.Apache)},
+			&postfix{postconf: c.Postconf},
+			&dovecot{path: c.Dovecot},
+		},
+	}
+
+	if err := m.configureDomains(); err != nil {
+		return err
+	}
+
+	std = m
+	for _, t := range std.targets {
+		if m, ok := t.(managed); ok {
+			reconcile.Register("tls."+t.Name(), source(m))
+		}
+	}
+
+	return nil
+}
+
+// source generates the file of the target while its service is installed
+func source(t managed) reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			if std == nil || !t.Installed() {
+				return nil, nil
+			}
+
+			std.mu.Lock()
+			content := t.render(std.policy)
+			std.mu.Unlock()
+
+			return []reconcile.Artifact{{Path: t.file(), Content: content}}, nil
+		},
+		Test:   t.test,
+		Reload: t.reload,
+	}
+}
+
+// newPolicy validates the configuration and converts the cipher names for crypto/tls
+func newPolicy(c *config.TLSConfiguration) (*Policy, error) {
+	p := &Policy{
+		MinVersion:   c.MinVersion,
+		Ciphers:      c.Ciphers,
+		OCSPStapling: c.OCSPStapling,
+	}
+
+	switch c.MinVersion {
+	case "1.2":
+		p.version = tls.VersionTLS12
+	case "1.3":
+		p.version = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("tlspolicy: unsupported minimum version %q, use 1.2 or 1.3", c.MinVersion)
+	}
+
+	ids := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[s.Name] = s.ID
+	}
+
+	for _, name := range c.Ciphers {
+		if _, ok := openssl[name]; !ok {
+			return nil, fmt.Errorf("tlspolicy: unsupported cipher suite %s", name)
+		}
+		p.suites = append(p.suites, ids[name])
+	}
+
+	if p.version == tls.VersionTLS12 && len(p.suites) == 0 {
+		return nil, errors.New("tlspolicy: at least one cipher suite is required when allowing TLS 1.2")
+	}
+
+	if c.HSTS.MaxAge > 0 {
+		p.HSTS = fmt.Sprintf("max-age=%d", c.HSTS.MaxAge)
+		if c.HSTS.IncludeSubdomains {
+			p.HSTS += "; includeSubDomains"
+		}
+		if c.HSTS.Preload {
+			p.HSTS += "; preload"
+		}
+	}
+
+	return p, nil
+}
+
+// Config returns the TLS configuration for the panel's own listener
+func Config() *tls.Config {
+	if std == nil {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	return &tls.Config{
+		MinVersion:   std.policy.version,
+		CipherSuites: std.policy.suites,
+	}
+}
+
+// HSTS returns the Strict-Transport-Security header value, or an empty string if the
+// header should not be sent
+func HSTS() string {
+	if std == nil {
+		return ""
+	}
+
+	return std.policy.HSTS
+}
+
+// Apply renders the policy into every installed service, reloading those whose
+// configuration changed. Every service is attempted even if one fails
+func Apply() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	var errs []error
+	for _, t := range std.targets {
+		if !t.Installed() {
+			continue
+		}
+
+		changed, err := t.Apply(std.policy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name(), err))
+			continue
+		}
+
+		if changed {
+			zap.S().Named("tlspolicy").Infow("applied tls policy", "service", t.Name())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// PlanApply reports the files Apply would write and the services it would reload
+func PlanApply() (*dryrun.Plan, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	plan := dryrun.New("tlspolicy.apply")
+
+	var errs []error
+	for _, t := range std.targets {
+		if !t.Installed() {
+			continue
+		}
+
+		if err := t.Plan(std.policy, plan); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name(), err))
+		}
+	}
+
+	plan.Note("each service's configuration is tested after writing and the file restored if the test fails")
+
+	return plan, errors.Join(errs...)
+}
+
+// Check reports the settings of every installed service that differ from the policy
+func Check() (Report, error) {
+	if std == nil {
+		return Report{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	report := Report{Generated: time.Now().UTC(), Policy: *std.policy, Compliant: true, Targets: []Target{}}
+	for _, t := range std.targets {
+		res := Target{Name: t.Name(), Installed: t.Installed(), Compliant: true, Drift: []string{}}
+
+		if res.Installed {
+			drift, err := t.Drift(std.policy)
+			if err != nil {
+				res.Error = err.Error()
+				res.Compliant = false
+			}
+			if len(drift) > 0 {
+				res.Drift = drift
+				res.Compliant = false
+			}
+		}
+
+		report.Compliant = report.Compliant && res.Compliant
+		report.Targets = append(report.Targets, res)
+	}
+
+	return report, nil
+}
+
+// protocols returns the protocol versions the policy accepts in the form used by nginx
+// and Apache
+func (p *Policy) protocols() []string {
+	if p.version == tls.VersionTLS13 {
+		return []string{"TLSv1.3"}
+	}
+
+	return []string{"TLSv1.2", "TLSv1.3"}
+}
+
+// cipherList returns the cipher suites as an OpenSSL cipher list
+func (p *Policy) cipherList() string {
+	names := make([]string, len(p.Ciphers))
+	for i, c := range p.Ciphers {
+		names[i] = openssl[c]
+	}
+
+	return strings.Join(names, ":")
+}
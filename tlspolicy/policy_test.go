@@ -0,0 +1,229 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestNewPolicy(t *testing.T) {
+	modern := []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}
+
+	tests := []struct {
+		name    string
+		version string
+		ciphers []string
+		maxAge  int
+		sub     bool
+		preload bool
+		want    string
+		ok      bool
+	}{
+		{"TLS 1.2", "1.2", modern, 0, false, false, "", true},
+		{"TLS 1.3 without ciphers", "1.3", nil, 0, false, false, "", true},
+		{"TLS 1.3 with ciphers", "1.3", modern, 0, false, false, "", true},
+		{"HSTS", "1.3", nil, 31536000, false, false, "max-age=31536000", true},
+		{"HSTS with subdomains", "1.3", nil, 31536000, true, false, "max-age=31536000; includeSubDomains", true},
+		{"HSTS with preload", "1.3", nil, 63072000, true, true, "max-age=63072000; includeSubDomains; preload", true},
+		{"no HSTS without a max age", "1.3", nil, 0, true, true, "", true},
+
+		{"TLS 1.2 without ciphers", "1.2", nil, 0, false, false, "", false},
+		{"TLS 1.2 with an empty list", "1.2", []string{}, 0, false, false, "", false},
+		{"TLS 1.1", "1.1", modern, 0, false, false, "", false},
+		{"TLS 1.0", "1.0", modern, 0, false, false, "", false},
+		{"no version", "", modern, 0, false, false, "", false},
+		{"version with a prefix", "TLSv1.2", modern, 0, false, false, "", false},
+		{"unknown cipher", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA512"}, 0, false, false, "", false},
+		{"OpenSSL name", "1.2", []string{"ECDHE-RSA-AES128-GCM-SHA256"}, 0, false, false, "", false},
+		{"lower case name", "1.2", []string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256"}, 0, false, false, "", false},
+		{"RC4", "1.2", []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"}, 0, false, false, "", false},
+		{"3DES", "1.2", []string{"TLS_RSA_WITH_3DES_EDE_CBC_SHA"}, 0, false, false, "", false},
+		{"TLS 1.3 suite", "1.2", []string{"TLS_AES_128_GCM_SHA256"}, 0, false, false, "", false},
+		{"unknown cipher after a valid one", "1.2", append(slices.Clone(modern), "TLS_NULL"), 0, false, false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.TLSConfiguration{MinVersion: tt.version, Ciphers: tt.ciphers}
+			c.HSTS.MaxAge = tt.maxAge
+			c.HSTS.IncludeSubdomains = tt.sub
+			c.HSTS.Preload = tt.preload
+
+			p, err := newPolicy(c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+
+			if p.HSTS != tt.want {
+				t.Errorf("HSTS %q, want %q", p.HSTS, tt.want)
+			}
+			if len(p.suites) != len(tt.ciphers) {
+				t.Errorf("%d suites for %d ciphers", len(p.suites), len(tt.ciphers))
+			}
+		})
+	}
+}
+
+// TestCipherSuiteIDs checks that every supported name is one crypto/tls knows, as a name
+// it does not know would leave the panel's listener with a suite of ID 0
+func TestCipherSuiteIDs(t *testing.T) {
+	for name := range openssl {
+		p, err := newPolicy(&config.TLSConfiguration{MinVersion: "1.2", Ciphers: []string{name}})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if s := tls.CipherSuiteName(p.suites[0]); s != name {
+			t.Errorf("%s has ID %#04x, which is %s", name, p.suites[0], s)
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	p, err := newPolicy(config.NewConfiguration("").TLS)
+	if err != nil {
+		t.Fatalf("the default policy is invalid: %v", err)
+	}
+
+	if p.version != tls.VersionTLS12 {
+		t.Errorf("version %#04x, want TLS 1.2", p.version)
+	}
+	for _, id := range p.suites {
+		for _, s := range tls.InsecureCipherSuites() {
+			if s.ID == id {
+				t.Errorf("the default policy allows %s", s.Name)
+			}
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	tls12 := &config.TLSConfiguration{
+		MinVersion:   "1.2",
+		Ciphers:      []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		OCSPStapling: true,
+	}
+	tls12.HSTS.MaxAge = 300
+
+	tls13 := &config.TLSConfiguration{MinVersion: "1.3"}
+
+	tests := []struct {
+		name   string
+		c      *config.TLSConfiguration
+		nginx  string
+		apache [2]string
+	}{
+		{
+			"TLS 1.2 with HSTS and stapling",
+			tls12,
+			"ssl_protocols TLSv1.2 TLSv1.3;\n" +
+				"ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384;\n" +
+				"ssl_prefer_server_ciphers on;\n" +
+				"ssl_stapling on;\n" +
+				"add_header Strict-Transport-Security \"max-age=300\" always;\n",
+			[2]string{
+				"<IfModule mod_ssl.c>\n" +
+					"    SSLProtocol -all +TLSv1.2 +TLSv1.3\n" +
+					"    SSLCipherSuite ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384\n" +
+					"    SSLHonorCipherOrder on\n" +
+					"    SSLUseStapling on\n" +
+					"    SSLStaplingCache \"shmcb:/var/run/ocsp(128000)\"\n" +
+					"</IfModule>\n" +
+					"<IfModule mod_headers.c>\n" +
+					"    Header always set Strict-Transport-Security \"max-age=300\" \"expr=%{HTTPS} == 'on'\"\n" +
+					"</IfModule>\n",
+				"<IfModule mod_ssl.c>\n" +
+					"    SSLProtocol -all +TLSv1.2 +TLSv1.3\n" +
+					"    SSLCipherSuite ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384\n" +
+					"    SSLHonorCipherOrder on\n" +
+					"    SSLUseStapling on\n" +
+					"</IfModule>\n" +
+					"<IfModule mod_headers.c>\n" +
+					"    Header always set Strict-Transport-Security \"max-age=300\" \"expr=%{HTTPS} == 'on'\"\n" +
+					"</IfModule>\n",
+			},
+		},
+		{
+			"TLS 1.3 only",
+			tls13,
+			"ssl_protocols TLSv1.3;\n" +
+				"ssl_stapling off;\n",
+			[2]string{
+				"<IfModule mod_ssl.c>\n" +
+					"    SSLProtocol -all +TLSv1.3\n" +
+					"    SSLUseStapling off\n" +
+					"</IfModule>\n",
+				"<IfModule mod_ssl.c>\n" +
+					"    SSLProtocol -all +TLSv1.3\n" +
+					"    SSLUseStapling off\n" +
+					"</IfModule>\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPolicy(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := nginxDirectives(p); got != tt.nginx {
+				t.Errorf("nginx:\n%s\nwant:\n%s", got, tt.nginx)
+			}
+			if got := apacheDirectives(p, true); got != tt.apache[0] {
+				t.Errorf("apache server:\n%s\nwant:\n%s", got, tt.apache[0])
+			}
+			if got := apacheDirectives(p, false); got != tt.apache[1] {
+				t.Errorf("apache virtual host:\n%s\nwant:\n%s", got, tt.apache[1])
+			}
+		})
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	const managed = "/etc/nginx/conf.d/cosmicpanel-tls.conf"
+
+	expected := map[string]string{
+		"ssl_protocols": "TLSv1.2 TLSv1.3",
+		"ssl_stapling":  "on",
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"matching", "ssl_protocols TLSv1.2 TLSv1.3;\nssl_stapling on;\n", nil},
+		{"other directives", "listen 443 ssl;\nserver_name example.com;\n", nil},
+		{"different value", "ssl_protocols TLSv1 TLSv1.1 TLSv1.2;\n", []string{"/etc/nginx/nginx.conf sets ssl_protocols TLSv1 TLSv1.1 TLSv1.2"}},
+		{"quoted value", "ssl_stapling \"on\";\n", nil},
+		{"indented", "    server {\n        ssl_stapling off;\n    }\n", []string{"/etc/nginx/nginx.conf sets ssl_stapling off"}},
+		{"upper case name", "SSL_Stapling off;\n", []string{"/etc/nginx/nginx.conf sets SSL_Stapling off"}},
+		{"commented out", "# ssl_stapling off;\n", nil},
+		{"the managed file", "# configuration file " + managed + ":\nssl_stapling off;\n", nil},
+		{
+			"included files",
+			"# configuration file /etc/nginx/sites-enabled/example.com:\nssl_stapling off;\n" +
+				"# configuration file " + managed + ":\nssl_stapling on;\n" +
+				"# configuration file /etc/nginx/sites-enabled/example.org:\nssl_protocols TLSv1.2;\n",
+			[]string{"/etc/nginx/sites-enabled/example.com sets ssl_stapling off", "/etc/nginx/sites-enabled/example.org sets ssl_protocols TLSv1.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := overrides("/etc/nginx/nginx.conf", []byte(tt.config), managed, expected)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package tlspolicy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// header starts every file the policy is rendered into
+const header = "# Managed by CosmicPanel, changes are overwritten when the TLS policy is applied\n"
+
+// panelTarget is the panel's own listener, which reads the policy through Config when
+// the daemon boots
+type panelTarget struct {
+	config *config.PanelConfiguration
+}
+
+func (t *panelTarget) Name() string {
+	return "panel"
+}
+
+func (t *panelTarget) Installed() bool {
+	return true
+}
+
+func (t *panelTarget) Apply(p *Policy) (bool, error) {
+	return false, nil
+}
+
+func (t *panelTarget) Plan(p *Policy, plan *dryrun.Plan) error {
+	return nil
+}
+
+func (t *panelTarget) Drift(p *Policy) ([]string, error) {
+	if t.config.Certificate == "" || t.config.Key == "" {
+		return []string{"the panel serves plain HTTP, set panel.certificate and panel.key to serve HTTPS"}, nil
+	}
+
+	return nil, nil
+}
+
+// writeManaged writes the content to the managed file of the target and reloads its
+// service, like reconciling the file does. The previous file is put back if the service
+// rejects the content or fails to reload
+func writeManaged(t managed, content string) (bool, error) {
+	return reconcile.Write("tls."+t.Name(), reconcile.Source{Test: t.test, Reload: t.reload}, reconcile.Artifact{Path: t.file(), Content: content})
+}
+
+// planManaged records the change writeManaged would make to the file and the reload of
+// the service that follows it
+func planManaged(plan *dryrun.Plan, path string, content string, service string) error {
+	previous, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	switch {
+	case err != nil:
+		plan.Add(dryrun.File, dryrun.Create, path, "")
+	case string(previous) != content:
+		plan.Add(dryrun.File, dryrun.Modify, path, "")
+	default:
+		return nil
+	}
+
+	plan.Add(dryrun.Service, dryrun.Reload, service, "")
+
+	return nil
+}
+
+// fileDrift returns drift if the managed file is missing or has been edited
+func fileDrift(path string, content string) []string {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{fmt.Sprintf("%s does not exist, apply the policy to create it", path)}
+	}
+
+	if err != nil || string(b) != content {
+		return []string{fmt.Sprintf("%s has been modified since the policy was applied", path)}
+	}
+
+	return nil
+}
+
+// overrides scans configuration for directives that set a different value to the one
+// expected, ignoring the managed file. Directive names are matched case insensitively
+// and values have surrounding quotes and a trailing semicolon removed. Lines of the form
+// "# configuration file <path>:", as printed by nginx -T, switch the file being scanned
+func overrides(file string, b []byte, managed string, expected map[string]string) []string {
+	var drift []string
+
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		text := strings.TrimSpace(string(line))
+
+		if path, ok := strings.CutPrefix(text, "# configuration file "); ok {
+			file = strings.TrimSuffix(path, ":")
+			continue
+		}
+
+		if file == managed || text == "" || text[0] == '#' {
+			continue
+		}
+
+		name, value, _ := strings.Cut(text, " ")
+		want, ok := expected[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), ";"))
+		value = strings.Trim(value, `"'`)
+		if value != want {
+			drift = append(drift, fmt.Sprintf("%s sets %s %s", file, name, value))
+		}
+	}
+
+	return drift
+}
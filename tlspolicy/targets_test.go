@@ -0,0 +1,72 @@
+package tlspolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+)
+
+func TestPlanManaged(t *testing.T) {
+	const content = "ssl_protocols TLSv1.3;\n"
+
+	tests := []struct {
+		name     string
+		existing string
+		changes  []dryrun.Change
+	}{
+		{"missing file", "", []dryrun.Change{
+			{Kind: dryrun.File, Action: dryrun.Create, Target: "{path}"},
+			{Kind: dryrun.Service, Action: dryrun.Reload, Target: "nginx"},
+		}},
+		{"edited file", "ssl_protocols TLSv1.2 TLSv1.3;\n", []dryrun.Change{
+			{Kind: dryrun.File, Action: dryrun.Modify, Target: "{path}"},
+			{Kind: dryrun.Service, Action: dryrun.Reload, Target: "nginx"},
+		}},
+		{"current file", content, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cosmicpanel-tls.conf")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			plan := dryrun.New("tls.apply")
+			if err := planManaged(plan, path, content, "nginx"); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(plan.Changes) != len(tt.changes) {
+				t.Fatalf("changes %+v, want %+v", plan.Changes, tt.changes)
+			}
+			for i, c := range plan.Changes {
+				want := tt.changes[i]
+				if want.Target == "{path}" {
+					want.Target = path
+				}
+				if c != want {
+					t.Errorf("change %+v, want %+v", c, want)
+				}
+			}
+
+			// The plan leaves the file as it was
+			b, err := os.ReadFile(path)
+			if tt.existing == "" && !os.IsNotExist(err) {
+				t.Errorf("the file was created: %v", err)
+			}
+			if tt.existing != "" && string(b) != tt.existing {
+				t.Errorf("the file was changed to %q", b)
+			}
+
+			drift := fileDrift(path, content)
+			if (len(drift) == 0) != (len(tt.changes) == 0) {
+				t.Errorf("drift %q disagrees with the plan", drift)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package tlspolicy
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+)
+
+// nginx renders the policy into a file included in the http block, which every server
+// block inherits unless it sets the directives itself
+type nginx struct {
+	path string
+}
+
+func (t *nginx) Name() string {
+	return "nginx"
+}
+
+func (t *nginx) Installed() bool {
+	return reconcile.Installed(t.path)
+}
+
+func (t *nginx) render(p *Policy) string {
+	return header + nginxDirectives(p)
+}
+
+// nginxDirectives returns the directives of the policy, which are valid both in the
+// http block and in a server block
+func nginxDirectives(p *Policy) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ssl_protocols %s;\n", strings.Join(p.protocols(), " "))
+	if list := p.cipherList(); list != "" {
+		fmt.Fprintf(&b, "ssl_ciphers %s;\n", list)
+		b.WriteString("ssl_prefer_server_ciphers on;\n")
+	}
+	fmt.Fprintf(&b, "ssl_stapling %s;\n", onOff(p.OCSPStapling))
+	if p.HSTS != "" {
+		fmt.Fprintf(&b, "add_header Strict-Transport-Security \"%s\" always;\n", p.HSTS)
+	}
+
+	return b.String()
+}
+
+func (t *nginx) file() string {
+	return t.path
+}
+
+func (t *nginx) test() error {
+	return privsep.Run("nginx", "-t")
+}
+
+func (t *nginx) reload() error {
+	return privsep.Run("nginx", "-s", "reload")
+}
+
+func (t *nginx) Apply(p *Policy) (bool, error) {
+	return writeManaged(t, t.render(p))
+}
+
+func (t *nginx) Plan(p *Policy, plan *dryrun.Plan) error {
+	return planManaged(plan, t.path, t.render(p), "nginx")
+}
+
+func (t *nginx) Drift(p *Policy) ([]string, error) {
+	drift := fileDrift(t.path, t.render(p))
+
+	// nginx -T prints the full configuration with every included file
+	out, err := privsep.Command("nginx", "-T").Output()
+	if err != nil {
+		return drift, fmt.Errorf("failed to read nginx configuration: %w", err)
+	}
+
+	expected := map[string]string{
+		"ssl_protocols": strings.Join(p.protocols(), " "),
+		"ssl_stapling":  onOff(p.OCSPStapling),
+	}
+	if list := p.cipherList(); list != "" {
+		expected["ssl_ciphers"] = list
+	}
+
+	return append(drift, overrides("", out, t.path, expected)...), nil
+}
+
+// apache renders the policy into a server wide configuration file, which virtual hosts
+// inherit unless they set the directives themselves
+type apache struct {
+	path string
+}
+
+func (t *apache) Name() string {
+	return "apache"
+}
+
+func (t *apache) Installed() bool {
+	return reconcile.Installed(t.path)
+}
+
+func (t *apache) render(p *Policy) string {
+	return header + apacheDirectives(p, true)
+}
+
+// apacheDirectives returns the directives of the policy. The cache of stapled responses
+// is shared by the whole server and can only be set outside virtual hosts
+func apacheDirectives(p *Policy, server bool) string {
+	var b strings.Builder
+	b.WriteString("<IfModule mod_ssl.c>\n")
+	fmt.Fprintf(&b, "    SSLProtocol %s\n", apacheProtocols(p))
+	if list := p.cipherList(); list != "" {
+		fmt.Fprintf(&b, "    SSLCipherSuite %s\n", list)
+		b.WriteString("    SSLHonorCipherOrder on\n")
+	}
+	fmt.Fprintf(&b, "    SSLUseStapling %s\n", onOff(p.OCSPStapling))
+	if p.OCSPStapling && server {
+		b.WriteString("    SSLStaplingCache \"shmcb:/var/run/ocsp(128000)\"\n")
+	}
+	b.WriteString("</IfModule>\n")
+	if p.HSTS != "" {
+		b.WriteString("<IfModule mod_headers.c>\n")
+		fmt.Fprintf(&b, "    Header always set Strict-Transport-Security \"%s\" \"expr=%%{HTTPS} == 'on'\"\n", p.HSTS)
+		b.WriteString("</IfModule>\n")
+	}
+
+	return b.String()
+}
+
+func (t *apache) file() string {
+	return t.path
+}
+
+func (t *apache) test() error {
+	return privsep.Run("apachectl", "configtest")
+}
+
+func (t *apache) reload() error {
+	return privsep.Run("apachectl", "graceful")
+}
+
+func (t *apache) Apply(p *Policy) (bool, error) {
+	return writeManaged(t, t.render(p))
+}
+
+func (t *apache) Plan(p *Policy, plan *dryrun.Plan) error {
+	return planManaged(plan, t.path, t.render(p), "apache")
+}
+
+func (t *apache) Drift(p *Policy) ([]string, error) {
+	drift := fileDrift(t.path, t.render(p))
+
+	expected := map[string]string{
+		"sslprotocol":    apacheProtocols(p),
+		"sslusestapling": onOff(p.OCSPStapling),
+	}
+	if list := p.cipherList(); list != "" {
+		expected["sslciphersuite"] = list
+	}
+
+	// Apache has no equivalent of nginx -T, so every enabled file under the server root
+	// is scanned. The *-available directories on Debian only hold disabled files
+	root := filepath.Dir(filepath.Dir(t.path))
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			if strings.HasSuffix(d.Name(), "-available") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		drift = append(drift, overrides(path, b, t.path, expected)...)
+
+		return nil
+	})
+
+	return drift, err
+}
+
+// apacheProtocols returns the value of the SSLProtocol directive for the policy
+func apacheProtocols(p *Policy) string {
+	protocols := "-all"
+	for _, v := range p.protocols() {
+		protocols += " +" + v
+	}
+
+	return protocols
+}
+
+// onOff formats a boolean as a configuration flag
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+
+	return "off"
+}
@@ -0,0 +1,309 @@
+package transfer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/lsm"
+)
+
+// accountFile is the name of the entry holding the panel user in an archive. It is
+// always the first entry so that an import can be refused before any file is written
+const accountFile = "account.json"
+
+// export writes an archive of the user and their home directory
+func export(username string, homes string, w io.Writer) error {
+	u, err := findUser(username)
+	if err != nil {
+		return err
+	}
+
+	return write(w, u, filepath.Join(homes, u.Username))
+}
+
+// write writes an archive of the user and the home directory, which is left out when
+// empty
+func write(w io.Writer, u auth.User, home string) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    accountFile,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(home); err == nil {
+		err = filepath.WalkDir(home, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(home, p)
+			if err != nil {
+				return err
+			}
+
+			return archiveEntry(tw, p, path.Join("home", filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// archiveEntry adds the file, directory or symlink to the archive under the name
+func archiveEntry(tw *tar.Writer, p string, name string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	// Owners are set from the account on the destination rather than the IDs here
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+
+	return err
+}
+
+// restore recreates the user and their home directory from an archive. Nothing is
+// overwritten, the import fails if the user or their home directory already exists
+func restore(r io.Reader, homes string) (auth.User, error) {
+	return restoreAs(r, homes, nil)
+}
+
+// restoreAs restores the archive as the user the function makes of the one it holds,
+// such as a copy of an account under another name
+func restoreAs(r io.Reader, homes string, as func(auth.User) auth.User) (auth.User, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	if hdr.Name != accountFile {
+		return auth.User{}, errors.New("transfer: archive does not start with the account")
+	}
+
+	var u auth.User
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&u); err != nil {
+		return auth.User{}, fmt.Errorf("transfer: invalid account in archive: %w", err)
+	}
+
+	if as != nil {
+		u = as(u)
+	}
+
+	if err := checkUsername(u.Username); err != nil {
+		return auth.User{}, err
+	}
+
+	if _, err := findUser(u.Username); err == nil {
+		return auth.User{}, fmt.Errorf("%w: %s", auth.ErrUserExists, u.Username)
+	}
+
+	home := filepath.Join(homes, u.Username)
+	if _, err := os.Lstat(home); err == nil {
+		return auth.User{}, fmt.Errorf("transfer: home directory %s already exists", home)
+	}
+
+	if err := extract(tr, home, u.Username); err != nil {
+		os.RemoveAll(home)
+		return auth.User{}, err
+	}
+
+	// Extracted files inherit the label of /home, which confined services are denied
+	if err := lsm.Relabel(home); err != nil {
+		os.RemoveAll(home)
+		return auth.User{}, err
+	}
+
+	imported, err := auth.ImportUser(u)
+	if err != nil {
+		os.RemoveAll(home)
+		return auth.User{}, err
+	}
+
+	return imported, nil
+}
+
+// extract writes the home directory entries of the archive into the directory, owned
+// by the system user with the username if there is one on this server
+func extract(tr *tar.Reader, home string, username string) error {
+	uid, gid := -1, -1
+	if su, err := user.Lookup(username); err == nil {
+		uid, _ = strconv.Atoi(su.Uid)
+		gid, _ = strconv.Atoi(su.Gid)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		if name != "home" && !strings.HasPrefix(name, "home/") {
+			return fmt.Errorf("transfer: unexpected entry %s in archive", hdr.Name)
+		}
+
+		target := filepath.Join(home, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(name, "home"), "/")))
+		if target != home && !strings.HasPrefix(target, home+string(filepath.Separator)) {
+			return fmt.Errorf("transfer: entry %s is outside the home directory", hdr.Name)
+		}
+
+		// A symlink extracted earlier must not lead later entries out of the home directory
+		if err := noSymlinks(home, filepath.Dir(target)); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeReg:
+			err = writeFile(target, tr, mode)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if uid >= 0 {
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// noSymlinks returns an error if the directory or any directory between it and the home
+// directory is a symlink
+func noSymlinks(home string, dir string) error {
+	for ; strings.HasPrefix(dir, home+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("transfer: %s is a symlink", dir)
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes the contents of the reader to a new file
+func writeFile(p string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// checkUsername returns an error unless the username can name a home directory
+func checkUsername(username string) error {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return fmt.Errorf("transfer: invalid username %q", username)
+	}
+
+	return nil
+}
+
+// findUser returns the user with the username
+func findUser(username string) (auth.User, error) {
+	username = strings.ToLower(username)
+
+	for _, u := range auth.Users() {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+
+	return auth.User{}, fmt.Errorf("%w: %s", auth.ErrUserNotFound, username)
+}
@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+)
+
+// The job cloning accounts and creating them from templates
+const cloneJob = "account.clone"
+
+// CloneRequest is a new account copied from an existing one or made from a template. It
+// gets the package, language and reseller of what it is made from
+type CloneRequest struct {
+	// The account copied or the template the account is made from, one of which is
+	// required
+	Source   string `json:"source,omitempty"`
+	Template string `json:"template,omitempty"`
+
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Whether the home directory of the account copied is copied along with it. A
+	// template brings whatever files it was saved with
+	Files bool `json:"files,omitempty"`
+}
+
+// clonePayload is what the job of a clone is queued with, which keeps the password
+// hashed
+type clonePayload struct {
+	CloneRequest
+	PasswordHash string `json:"password_hash"`
+}
+
+// Clone queues the creation of the account as a copy of another or from a template
+func Clone(req CloneRequest, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	p, err := validateClone(req)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+
+	// Copying files into a home directory that a failed attempt left behind is refused,
+	// so clones are only attempted once
+	return jobs.Enqueue(cloneJob, p, jobs.Options{Actor: actor, MaxAttempts: 1})
+}
+
+// validateClone checks the clone can be made and returns the payload of its job
+func validateClone(req CloneRequest) (clonePayload, error) {
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	p := clonePayload{CloneRequest: req}
+	p.Password = ""
+
+	switch {
+	case (req.Source == "") == (req.Template == ""):
+		return p, errors.New("transfer: either the account to copy or a template is required")
+	case req.Template != "" && req.Files:
+		return p, errors.New("transfer: files are only copied from accounts, a template brings its own")
+	}
+
+	if req.Source != "" {
+		u, err := findUser(req.Source)
+		if err != nil {
+			return p, err
+		}
+		if u.Role != auth.RoleUser {
+			return p, errors.New("transfer: only hosting accounts can be copied")
+		}
+	} else if _, err := GetTemplate(req.Template); err != nil {
+		return p, err
+	}
+
+	if err := checkUsername(req.Username); err != nil {
+		return p, err
+	}
+	if _, err := findUser(req.Username); err == nil {
+		return p, auth.ErrUserExists
+	}
+
+	if req.Email == "" {
+		return p, errors.New("transfer: email is required")
+	}
+
+	if !auth.ValidPhone(req.Phone) {
+		return p, errors.New("transfer: phone must be in international format, such as +447700900123")
+	}
+
+	if len(req.Password) < 8 {
+		return p, errors.New("transfer: password must be at least 8 characters")
+	}
+
+	var hashed auth.User
+	if err := hashed.SetPassword(req.Password); err != nil {
+		return p, err
+	}
+	p.PasswordHash = hashed.PasswordHash
+
+	return p, nil
+}
+
+// runClone runs the job of a clone
+func runClone(ctx context.Context, j *jobs.Job) error {
+	var p clonePayload
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	// Copying the files is limited like backups, which read and write as much
+	var u auth.User
+	err := throttle.Run(ctx, throttle.Backups, func(ctx context.Context) error {
+		var err error
+		u, err = clone(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{"job": j.ID, "username": u.Username, "files": p.Files}
+	if p.Template != "" {
+		data["template"] = p.Template
+	} else {
+		data["source"] = p.Source
+	}
+
+	after, _ := json.Marshal(u.Public())
+	events.Publish(events.Event{
+		Type:     "account.clone",
+		Actor:    j.Actor,
+		Resource: u.ID,
+		After:    after,
+		Data:     data,
+	})
+
+	return nil
+}
+
+// clone creates the account of the payload, restoring the home directory from the
+// template or from an archive of the account copied streamed straight into it
+func clone(p clonePayload) (auth.User, error) {
+	u := auth.User{
+		Username:     p.Username,
+		Email:        p.Email,
+		Phone:        p.Phone,
+		Role:         auth.RoleUser,
+		PasswordHash: p.PasswordHash,
+		Created:      time.Now().UTC(),
+	}
+
+	if p.Template != "" {
+		return FromTemplate(p.Template, u)
+	}
+
+	source, err := findUser(p.Source)
+	if err != nil {
+		return auth.User{}, err
+	}
+	u.Language, u.Owner, u.Package = source.Language, source.Owner, source.Package
+
+	if !p.Files {
+		return auth.ImportUser(u)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(export(p.Source, std.Homes, pw))
+	}()
+
+	imported, err := restoreAs(pr, std.Homes, func(auth.User) auth.User { return u })
+	if err == nil {
+		// Reading to the end lets the export finish and report its own errors
+		_, err = io.Copy(io.Discard, pr)
+	}
+	pr.CloseWithError(err)
+
+	if err != nil && imported.ID != "" {
+		auth.DeleteUser(imported.ID)
+		os.RemoveAll(filepath.Join(std.Homes, imported.Username))
+	}
+
+	return imported, err
+}
@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+)
+
+func TestValidateClone(t *testing.T) {
+	homes := configure(t)
+
+	addUser(t, homes, auth.User{Username: "cpsource", Role: auth.RoleUser}, nil)
+	addUser(t, homes, auth.User{Username: "cpreseller", Role: auth.RoleReseller}, nil)
+	if _, err := saveTemplate(TemplateRequest{Name: "stack", Source: "cpsource"}); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := CloneRequest{Source: "cpsource", Username: " CPAlice ", Email: "alice@example.com", Phone: "+447700900123", Password: "correct horse", Files: true}
+	with := func(fn func(r *CloneRequest)) CloneRequest {
+		r := valid
+		fn(&r)
+		return r
+	}
+
+	tests := []struct {
+		name string
+		req  CloneRequest
+		err  error
+	}{
+		{"account", valid, nil},
+		{"template", with(func(r *CloneRequest) { r.Source, r.Template, r.Files = "", "stack", false }), nil},
+
+		{"both", with(func(r *CloneRequest) { r.Template = "stack" }), errors.New("")},
+		{"neither", with(func(r *CloneRequest) { r.Source = "" }), errors.New("")},
+		{"files of a template", with(func(r *CloneRequest) { r.Source, r.Template = "", "stack" }), errors.New("")},
+		{"unknown account", with(func(r *CloneRequest) { r.Source = "cpmissing" }), auth.ErrUserNotFound},
+		{"reseller", with(func(r *CloneRequest) { r.Source = "cpreseller" }), errors.New("")},
+		{"missing template", with(func(r *CloneRequest) { r.Source, r.Template, r.Files = "", "missing", false }), ErrTemplateNotFound},
+		{"existing username", with(func(r *CloneRequest) { r.Username = "CPSource" }), auth.ErrUserExists},
+		{"no username", with(func(r *CloneRequest) { r.Username = " " }), errors.New("")},
+		{"path as the username", with(func(r *CloneRequest) { r.Username = "../cpsource" }), errors.New("")},
+		{"parent as the username", with(func(r *CloneRequest) { r.Username = ".." }), errors.New("")},
+		{"no email", with(func(r *CloneRequest) { r.Email = "" }), errors.New("")},
+		{"phone", with(func(r *CloneRequest) { r.Phone = "07700 900123" }), errors.New("")},
+		{"short password", with(func(r *CloneRequest) { r.Password = "hunter2" }), errors.New("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := validateClone(tt.req)
+			if (err == nil) != (tt.err == nil) || (tt.err != nil && tt.err.Error() != "" && !errors.Is(err, tt.err)) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			// The job keeps the password hashed only
+			b, _ := json.Marshal(p)
+			if p.Username != "cpalice" || p.Password != "" || strings.Contains(string(b), tt.req.Password) {
+				t.Errorf("payload %s", b)
+			}
+			if u := (auth.User{PasswordHash: p.PasswordHash}); !u.CheckPassword(tt.req.Password) {
+				t.Error("the hash does not match the password")
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	homes := configure(t)
+
+	reseller := addUser(t, homes, auth.User{Username: "cpreseller", Role: auth.RoleReseller}, nil)
+	source := addUser(t, homes, auth.User{Username: "cpsource", Role: auth.RoleUser, Email: "source@example.com", Package: "gold", Language: "de", Owner: reseller.ID}, map[string]string{
+		"public_html/index.php": "<?php echo 'hello';",
+	})
+	if err := os.Symlink("public_html/index.php", filepath.Join(homes, "cpsource", "index.php")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A home directory a failed clone left behind
+	if err := os.MkdirAll(filepath.Join(homes, "cpstale"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		files    bool
+		ok       bool
+	}{
+		{"with files", "cpalice", true, true},
+		{"without files", "cpbob", false, true},
+
+		{"home directory exists", "cpstale", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := validateClone(CloneRequest{Source: "cpsource", Username: tt.username, Email: tt.username + "@example.com", Password: "correct horse", Files: tt.files})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := clone(p)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if _, err := findUser(tt.username); !errors.Is(err, auth.ErrUserNotFound) {
+					t.Errorf("the account of a failed clone was kept: %v", err)
+				}
+				return
+			}
+
+			if u.ID == source.ID || u.Email != tt.username+"@example.com" || u.Package != "gold" || u.Language != "de" || u.Owner != reseller.ID || !u.CheckPassword("correct horse") {
+				t.Errorf("cloned %+v", u)
+			}
+
+			b, err := os.ReadFile(filepath.Join(homes, tt.username, "index.php"))
+			if (err == nil) != tt.files || (tt.files && string(b) != "<?php echo 'hello';") {
+				t.Errorf("copied index.php %q, %v", b, err)
+			}
+			if link, err := os.Readlink(filepath.Join(homes, tt.username, "index.php")); tt.files && (err != nil || link != "public_html/index.php") {
+				t.Errorf("copied symlink %q, %v", link, err)
+			}
+		})
+	}
+
+	if b, err := os.ReadFile(filepath.Join(homes, "cpsource", "public_html", "index.php")); err != nil || string(b) != "<?php echo 'hello';" {
+		t.Errorf("the files of the account copied were changed: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,294 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"github.com/cosmicpanel/CosmicPanel/throttle"
+)
+
+// The job saving accounts as templates
+const templateJob = "account.template"
+
+// templateKind is what templates are kept under in the state store, keyed by name
+const templateKind = "transfer.template"
+
+var (
+	// ErrTemplateNotFound is returned for a template that does not exist
+	ErrTemplateNotFound = errors.New("transfer: template not found")
+
+	// ErrTemplateExists is returned when saving a template under a name already taken
+	ErrTemplateExists = errors.New("transfer: a template with the name already exists")
+)
+
+// templateName matches the names templates can be saved under, which name their archive
+var templateName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Template is an account saved to create accounts like it from, such as the stack an
+// agency deploys for every client
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// The account the template was saved from, and the settings of it that accounts made
+	// from the template get
+	Source   string `json:"source"`
+	Package  string `json:"package,omitempty"`
+	Language string `json:"language,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+
+	// Whether the template holds the files of the home directory, and the size of its
+	// archive
+	Files bool  `json:"files"`
+	Size  int64 `json:"size"`
+
+	Created time.Time `json:"created"`
+}
+
+// TemplateRequest is an account saved as a template
+type TemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source"`
+
+	// Whether the files of the home directory are saved with the template
+	Files bool `json:"files,omitempty"`
+}
+
+// SaveTemplate queues saving the account as a template
+func SaveTemplate(req TemplateRequest, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	if !templateName.MatchString(req.Name) {
+		return jobs.Job{}, errors.New("transfer: template names are lower case letters, digits, - and _")
+	}
+
+	if _, err := GetTemplate(req.Name); err == nil {
+		return jobs.Job{}, ErrTemplateExists
+	} else if !errors.Is(err, ErrTemplateNotFound) {
+		return jobs.Job{}, err
+	}
+
+	u, err := findUser(req.Source)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	if u.Role != auth.RoleUser {
+		return jobs.Job{}, errors.New("transfer: only hosting accounts can be saved as templates")
+	}
+
+	return jobs.Enqueue(templateJob, req, jobs.Options{Actor: actor, MaxAttempts: 1})
+}
+
+// runTemplate runs the job saving a template, writing its archive with the limits of the
+// backups class
+func runTemplate(ctx context.Context, j *jobs.Job) error {
+	var req TemplateRequest
+	if err := j.Decode(&req); err != nil {
+		return err
+	}
+
+	var t Template
+	err := throttle.Run(ctx, throttle.Backups, func(ctx context.Context) error {
+		var err error
+		t, err = saveTemplate(req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	after, _ := json.Marshal(t)
+	events.Publish(events.Event{
+		Type:     "account.template.create",
+		Actor:    j.Actor,
+		Resource: t.Name,
+		After:    after,
+		Data:     map[string]interface{}{"job": j.ID},
+	})
+
+	return nil
+}
+
+// saveTemplate writes the archive of the template and keeps it. The archive holds none of
+// the identity of the account, which accounts made from it get their own of
+func saveTemplate(req TemplateRequest) (Template, error) {
+	u, err := findUser(req.Source)
+	if err != nil {
+		return Template{}, err
+	}
+
+	t := Template{
+		Name:        req.Name,
+		Description: req.Description,
+		Source:      u.Username,
+		Package:     u.Package,
+		Language:    u.Language,
+		Owner:       u.Owner,
+		Files:       req.Files,
+		Created:     time.Now().UTC(),
+	}
+
+	home := ""
+	if req.Files {
+		home = filepath.Join(std.Homes, u.Username)
+	}
+
+	path := templateFile(t.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return Template{}, err
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Template{}, err
+	}
+
+	err = write(f, auth.User{Username: t.Name, Role: auth.RoleUser, Package: t.Package, Language: t.Language, Owner: t.Owner}, home)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			t.Size = info.Size()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	// Another template may have been saved under the name while this one was written
+	if err == nil {
+		err = store.Update(func(tx *store.Tx) error {
+			var existing Template
+			if err := tx.Get(templateKind, t.Name, &existing); err == nil {
+				return ErrTemplateExists
+			} else if !errors.Is(err, store.ErrNotFound) {
+				return err
+			}
+
+			if err := os.Rename(path+".tmp", path); err != nil {
+				return err
+			}
+
+			return tx.Put(templateKind, t.Name, t)
+		})
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return Template{}, err
+	}
+
+	return t, nil
+}
+
+// FromTemplate creates the account from the template, with the files it was saved with.
+// The account gets the package, language and reseller of the template unless it has its
+// own
+func FromTemplate(name string, u auth.User) (auth.User, error) {
+	if std == nil {
+		return auth.User{}, ErrNotConfigured
+	}
+
+	if _, err := GetTemplate(name); err != nil {
+		return auth.User{}, err
+	}
+
+	f, err := os.Open(templateFile(name))
+	if err != nil {
+		return auth.User{}, err
+	}
+	defer f.Close()
+
+	return restoreAs(f, std.Homes, func(from auth.User) auth.User {
+		if u.Package == "" {
+			u.Package = from.Package
+		}
+		if u.Language == "" {
+			u.Language = from.Language
+		}
+		if u.Owner == "" {
+			u.Owner = from.Owner
+		}
+
+		return u
+	})
+}
+
+// ListTemplates returns the templates sorted by name
+func ListTemplates() ([]Template, error) {
+	list := []Template{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(templateKind, func(id string, data []byte) error {
+			var t Template
+			if err := json.Unmarshal(data, &t); err != nil {
+				return fmt.Errorf("transfer: malformed template %s: %w", id, err)
+			}
+
+			list = append(list, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+// GetTemplate returns the template with the name
+func GetTemplate(name string) (Template, error) {
+	var t Template
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(templateKind, name, &t)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Template{}, ErrTemplateNotFound
+	}
+
+	return t, err
+}
+
+// DeleteTemplate removes the template and its archive. Accounts made from it are not
+// affected
+func DeleteTemplate(name string) (Template, error) {
+	t, err := GetTemplate(name)
+	if err != nil {
+		return Template{}, err
+	}
+
+	err = store.Update(func(tx *store.Tx) error {
+		return tx.Delete(templateKind, name)
+	})
+	if err != nil {
+		return Template{}, err
+	}
+
+	if err := os.Remove(templateFile(name)); err != nil && !os.IsNotExist(err) {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// templateFile returns the path of the archive of the template
+func templateFile(name string) string {
+	return filepath.Join(templates, name+".tar.gz")
+}
@@ -0,0 +1,226 @@
+package transfer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// configure sets up transfers with a state store, users and job queue of their own and
+// the home directories in a temporary directory, which is returned
+func configure(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := store.Configure(dir, &config.StoreConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Configure(dir, config.NewConfiguration("").Auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Configure(dir, &config.JobsConfiguration{}); err != nil {
+		t.Fatal(err)
+	}
+
+	homes := filepath.Join(dir, "home")
+	if err := os.MkdirAll(homes, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	Configure(dir, &config.TransferConfiguration{Homes: homes})
+	t.Cleanup(func() { std, templates = nil, "" })
+
+	return homes
+}
+
+// addUser adds the user with a password, and a home directory holding the files
+func addUser(t *testing.T, homes string, u auth.User, files map[string]string) auth.User {
+	t.Helper()
+
+	if err := u.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := auth.ImportUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		p := filepath.Join(homes, u.Username, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return u
+}
+
+func TestSaveTemplate(t *testing.T) {
+	homes := configure(t)
+
+	addUser(t, homes, auth.User{Username: "cpsource", Role: auth.RoleUser}, nil)
+	addUser(t, homes, auth.User{Username: "cpreseller", Role: auth.RoleReseller}, nil)
+	if _, err := saveTemplate(TemplateRequest{Name: "taken", Source: "cpsource"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  TemplateRequest
+		err  error
+	}{
+		{"account", TemplateRequest{Name: "agency-stack", Source: "CPSource", Files: true}, nil},
+
+		{"name taken", TemplateRequest{Name: "taken", Source: "cpsource"}, ErrTemplateExists},
+		{"unknown account", TemplateRequest{Name: "other", Source: "cpmissing"}, auth.ErrUserNotFound},
+		{"reseller", TemplateRequest{Name: "other", Source: "cpreseller"}, errors.New("")},
+		{"path in the name", TemplateRequest{Name: "../../etc/cron.d/x", Source: "cpsource"}, errors.New("")},
+		{"upper case name", TemplateRequest{Name: "Stack", Source: "cpsource"}, errors.New("")},
+		{"no name", TemplateRequest{Source: "cpsource"}, errors.New("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := SaveTemplate(tt.req, "admin")
+			if (err == nil) != (tt.err == nil) || (tt.err != nil && tt.err.Error() != "" && !errors.Is(err, tt.err)) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err == nil && (j.Type != templateJob || j.Actor != "admin") {
+				t.Errorf("queued %+v", j)
+			}
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	homes := configure(t)
+
+	reseller := addUser(t, homes, auth.User{Username: "cpreseller", Role: auth.RoleReseller}, nil)
+	addUser(t, homes, auth.User{Username: "cpsource", Role: auth.RoleUser, Email: "source@example.com", Package: "gold", Language: "de", Owner: reseller.ID}, map[string]string{
+		"public_html/index.php": "<?php echo 'hello';",
+		".env":                  "DB_PASSWORD=secret",
+	})
+
+	tpl, err := saveTemplate(TemplateRequest{Name: "stack", Description: "Agency stack", Source: "cpsource", Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := GetTemplate("stack"); err != nil || stored.Source != "cpsource" || stored.Package != "gold" || stored.Owner != reseller.ID || !stored.Files || stored.Size == 0 {
+		t.Errorf("saved %+v, %v", stored, err)
+	}
+	if _, err := os.Stat(templateFile("stack") + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the archive being written was left behind: %v", err)
+	}
+
+	// The archive holds none of the identity of the account
+	u := archived(t, templateFile("stack"))
+	if u.Username != "stack" || u.Email != "" || u.PasswordHash != "" || u.ID != "" {
+		t.Errorf("archived %+v", u)
+	}
+
+	if _, err := saveTemplate(TemplateRequest{Name: "stack", Source: "cpsource"}); !errors.Is(err, ErrTemplateExists) {
+		t.Errorf("saving over a template: %v", err)
+	}
+	if _, err := saveTemplate(TemplateRequest{Name: "empty", Source: "cpsource"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := ListTemplates(); err != nil || len(list) != 2 || list[0].Name != "empty" || list[1].Name != tpl.Name {
+		t.Errorf("listed %+v, %v", list, err)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		user     auth.User
+		want     auth.User
+		files    bool
+		err      error
+	}{
+		{"settings of the template", "stack", auth.User{Username: "cpalice", Email: "alice@example.com", Role: auth.RoleUser, PasswordHash: "hash"}, auth.User{Username: "cpalice", Email: "alice@example.com", Package: "gold", Language: "de", Owner: reseller.ID}, true, nil},
+		{"own settings", "stack", auth.User{Username: "cpbob", Role: auth.RoleUser, PasswordHash: "hash", Package: "silver", Language: "fr"}, auth.User{Username: "cpbob", Package: "silver", Language: "fr", Owner: reseller.ID}, true, nil},
+		{"without files", "empty", auth.User{Username: "cpcarol", Role: auth.RoleUser, PasswordHash: "hash"}, auth.User{Username: "cpcarol", Package: "gold", Language: "de", Owner: reseller.ID}, false, nil},
+
+		{"existing account", "stack", auth.User{Username: "cpsource", Role: auth.RoleUser, PasswordHash: "hash"}, auth.User{}, false, auth.ErrUserExists},
+		{"path as the username", "stack", auth.User{Username: "../cpsource", Role: auth.RoleUser, PasswordHash: "hash"}, auth.User{}, false, errors.New("")},
+		{"missing template", "missing", auth.User{Username: "cpdave", Role: auth.RoleUser, PasswordHash: "hash"}, auth.User{}, false, ErrTemplateNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := FromTemplate(tt.template, tt.user)
+			if (err == nil) != (tt.err == nil) || (tt.err != nil && tt.err.Error() != "" && !errors.Is(err, tt.err)) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if u.ID == "" || u.Username != tt.want.Username || u.Email != tt.want.Email || u.Package != tt.want.Package || u.Language != tt.want.Language || u.Owner != tt.want.Owner || u.PasswordHash != "hash" {
+				t.Errorf("created %+v", u)
+			}
+
+			b, err := os.ReadFile(filepath.Join(homes, u.Username, "public_html", "index.php"))
+			if (err == nil) != tt.files || (tt.files && string(b) != "<?php echo 'hello';") {
+				t.Errorf("files of the template %q, %v", b, err)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(homes, "cpsource", ".env")); err != nil {
+		t.Errorf("the files of the account the template was saved from: %v", err)
+	}
+
+	if _, err := DeleteTemplate("stack"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(templateFile("stack")); !os.IsNotExist(err) {
+		t.Errorf("the archive of a deleted template was kept: %v", err)
+	}
+	if _, err := FromTemplate("stack", auth.User{Username: "cperin", Role: auth.RoleUser, PasswordHash: "hash"}); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("creating from a deleted template: %v", err)
+	}
+	if _, err := DeleteTemplate("stack"); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("deleting again: %v", err)
+	}
+}
+
+// archived returns the account an archive holds
+func archived(t *testing.T, path string) auth.User {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	if hdr, err := tr.Next(); err != nil || hdr.Name != accountFile {
+		t.Fatalf("first entry %+v, %v", hdr, err)
+	}
+
+	var u auth.User
+	if err := json.NewDecoder(tr).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
@@ -0,0 +1,372 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/cluster"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+)
+
+// The job transfers run as on the controller
+const jobType = "account.transfer"
+
+// What happens to an account on the source node once it has been transferred
+const (
+	Keep   = "keep"
+	Lock   = "lock"
+	Delete = "delete"
+)
+
+// ErrNotConfigured is returned when transferring an account before Configure is called
+var ErrNotConfigured = errors.New("transfer: not configured")
+
+// Request is a transfer of an account from one node of the cluster to another
+type Request struct {
+	Username    string `json:"username"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// What happens to the account on the source once it exists on the destination. It is
+	// locked by default so that it cannot change on both nodes
+	SourceAction string `json:"source_action,omitempty"`
+}
+
+// exportRequest is the payload of the account.export command
+type exportRequest struct {
+	Username string `json:"username"`
+	File     string `json:"file"`
+}
+
+// exportResult is what the source reports once it has uploaded the archive
+type exportResult struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// importRequest is the payload of the account.import command
+type importRequest struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// releaseRequest is the payload of the account.release command
+type releaseRequest struct {
+	Username string `json:"username"`
+	Action   string `json:"action"`
+}
+
+var std *config.TransferConfiguration
+
+// templates is the directory the archives of templates are kept in
+var templates string
+
+// Configure registers the commands nodes export and import accounts with, and on a
+// controller the job and the bulk operation transfers run as. Templates are kept in the
+// data directory
+func Configure(dataDir string, c *config.TransferConfiguration) {
+	std = c
+	templates = filepath.Join(dataDir, "templates")
+
+	cluster.Register("account.export", exportAccount)
+	cluster.Register("account.import", importAccount)
+	cluster.Register("account.release", releaseAccount)
+
+	jobs.Register(jobType, run)
+	jobs.Register(cloneJob, runClone)
+	jobs.Register(templateJob, runTemplate)
+
+	// Moving many accounts, such as to empty a node, is one operation of many transfers
+	bulk.Register(bulk.Type{Name: jobType, Run: func(ctx context.Context, actor string, it bulk.Item) error {
+		var r Request
+		if err := it.Decode(&r); err != nil {
+			return err
+		}
+		r.Username = it.Key
+
+		if err := validate(&r); err != nil {
+			return err
+		}
+
+		return move(ctx, r, actor)
+	}})
+}
+
+// Start queues the transfer of an account. Transfers run in the background since
+// moving the home directory can take a long time, and are followed through the job
+func Start(r Request, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	if err := validate(&r); err != nil {
+		return jobs.Job{}, err
+	}
+
+	// A transfer that failed half way is not safe to repeat, so it is only attempted once
+	return jobs.Enqueue(jobType, r, jobs.Options{Actor: actor, MaxAttempts: 1})
+}
+
+// validate returns an error unless the transfer is between two nodes of the cluster,
+// locking the account on the source unless it says otherwise
+func validate(r *Request) error {
+	if r.SourceAction == "" {
+		r.SourceAction = Lock
+	}
+
+	switch r.SourceAction {
+	case Keep, Lock, Delete:
+	default:
+		return errors.New("transfer: source action must be one of keep, lock or delete")
+	}
+
+	if r.Username == "" {
+		return errors.New("transfer: username is required")
+	}
+
+	if r.Source == r.Destination {
+		return errors.New("transfer: source and destination must be different nodes")
+	}
+
+	for _, id := range []string{r.Source, r.Destination} {
+		if _, err := cluster.GetNode(id); err != nil {
+			return fmt.Errorf("%w: %s", err, id)
+		}
+	}
+
+	return nil
+}
+
+// Export writes an archive of the account and its home directory. Backups are written in
+// the same format, so that they can be restored on any node the way transfers are
+func Export(username string, w io.Writer) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	return export(username, std.Homes, w)
+}
+
+// Restore recreates the account from an archive written by Export
+func Restore(r io.Reader) (auth.User, error) {
+	if std == nil {
+		return auth.User{}, ErrNotConfigured
+	}
+
+	return restore(r, std.Homes)
+}
+
+// run runs the job transferring an account
+func run(ctx context.Context, j *jobs.Job) error {
+	var r Request
+	if err := j.Decode(&r); err != nil {
+		return err
+	}
+
+	return move(ctx, r, j.Actor)
+}
+
+// move transfers the account by having the source upload its archive to the controller
+// and the destination fetch it from there, so that both only ever talk to the
+// controller over their authenticated connection
+func move(ctx context.Context, r Request, actor string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(std.Timeout)*time.Minute)
+	defer cancel()
+
+	file, err := cluster.NewFile()
+	if err != nil {
+		return err
+	}
+	defer cluster.RemoveFile(file)
+
+	var exported exportResult
+	if err := command(ctx, r.Source, "account.export", exportRequest{Username: r.Username, File: file}, actor, &exported); err != nil {
+		return fmt.Errorf("failed to export %s from %s: %w", r.Username, r.Source, err)
+	}
+
+	var imported auth.User
+	if err := command(ctx, r.Destination, "account.import", importRequest{File: file, SHA256: exported.SHA256}, actor, &imported); err != nil {
+		return fmt.Errorf("failed to import %s on %s: %w", r.Username, r.Destination, err)
+	}
+
+	if r.SourceAction != Keep {
+		if err := command(ctx, r.Source, "account.release", releaseRequest{Username: r.Username, Action: r.SourceAction}, actor, nil); err != nil {
+			return fmt.Errorf("transferred %s but failed to %s it on %s: %w", r.Username, r.SourceAction, r.Source, err)
+		}
+	}
+
+	events.Publish(events.Event{
+		Type:     "account.transfer",
+		Actor:    actor,
+		Resource: imported.ID,
+		Data: map[string]interface{}{
+			"username":      r.Username,
+			"source":        r.Source,
+			"destination":   r.Destination,
+			"source_action": r.SourceAction,
+			"size":          exported.Size,
+		},
+	})
+
+	return nil
+}
+
+// Import has the node fetch the archive of an account from the controller and recreate
+// the account from it, returning the account once it exists on the node
+func Import(ctx context.Context, node string, file string, sha256 string, actor string) (auth.User, error) {
+	var imported auth.User
+	err := command(ctx, node, "account.import", importRequest{File: file, SHA256: sha256}, actor, &imported)
+
+	return imported, err
+}
+
+// command sends the command to the node and waits for it to be carried out, decoding
+// the result into out if it is not nil
+func command(ctx context.Context, node string, typ string, payload interface{}, actor string, out interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := cluster.Send(node, typ, b, actor)
+	if err != nil {
+		return err
+	}
+
+	cmd, err = cluster.Wait(ctx, cmd.ID)
+	if err != nil {
+		return err
+	}
+
+	if cmd.State == cluster.Failed {
+		return errors.New(cmd.Error)
+	}
+
+	if out == nil || len(cmd.Result) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(cmd.Result, out)
+}
+
+// exportAccount streams the archive of an account to the controller
+func exportAccount(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var p exportRequest
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(export(p.Username, std.Homes, pw))
+	}()
+
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(pr, h)}
+
+	if err := cluster.Upload(ctx, p.File, counter); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+
+	return exportResult{Size: counter.n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// importAccount fetches the archive of an account from the controller and recreates the
+// account from it once it has been checked to have arrived intact
+func importAccount(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var p importRequest
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	done := make(chan error, 1)
+
+	go func() {
+		err := cluster.Download(ctx, p.File, io.MultiWriter(pw, h))
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	u, err := restore(pr, std.Homes)
+	if err == nil {
+		// Reading the rest of the archive makes sure the checksum covers all of it
+		_, err = io.Copy(io.Discard, pr)
+	}
+
+	// Stops the download if the archive was refused before it was read to the end
+	pr.CloseWithError(err)
+	if derr := <-done; err == nil {
+		err = derr
+	}
+
+	if err == nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != p.SHA256 {
+			err = fmt.Errorf("transfer: archive checksum %s does not match %s", sum, p.SHA256)
+		}
+	}
+
+	if err != nil {
+		if u.ID != "" {
+			auth.DeleteUser(u.ID)
+			os.RemoveAll(filepath.Join(std.Homes, u.Username))
+		}
+		return nil, err
+	}
+
+	return u.Public(), nil
+}
+
+// releaseAccount locks or deletes an account on the source once it has been transferred
+func releaseAccount(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var p releaseRequest
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	u, err := findUser(p.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Action {
+	case Delete:
+		return nil, auth.DeleteUser(u.ID)
+	case Lock:
+		_, err := auth.UpdateUser(u.ID, func(u *auth.User) error {
+			u.LockedUntil = time.Now().AddDate(100, 0, 0).UTC()
+			return nil
+		})
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("transfer: unknown source action %q", p.Action)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader, counting the bytes read
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cosmicpanel/CosmicPanel/buildinfo"
+	"github.com/cosmicpanel/CosmicPanel/initsys"
+	"github.com/cosmicpanel/CosmicPanel/selfupdate"
+)
+
+// selfUpdate replaces this binary with the latest signed release on the channel. When
+// the daemon runs as a service it is restarted, and the previous binary is restored if
+// the new version does not report itself healthy in time
+func selfUpdate(args []string) error {
+	var o options
+	fs := o.flags("self-update", "[rollback]")
+	channel := fs.String("channel", "", "The release channel, stable or beta, defaults to the configured one")
+	check := fs.Bool("check", false, "Only check whether a newer release is available")
+	force := fs.Bool("force", false, "Install the latest release even if it is not newer than this one")
+	service := fs.String("service", "", "The service the daemon runs as, defaults to the name it is installed under")
+	args = parse(fs, args)
+
+	driver, err := initsys.Detect("")
+	if err != nil {
+		return err
+	}
+
+	if *service == "" {
+		*service = driver.Service()
+	}
+
+	if a := arg(args, 0); a != "" && a != "rollback" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := bootstrap(&o)
+	if err != nil {
+		return err
+	}
+
+	if err := selfupdate.Configure(c.System.Data, c.Release); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	if arg(args, 0) == "rollback" {
+		if err := selfupdate.Rollback(exe); err != nil {
+			return err
+		}
+
+		if err := restartService(driver, *service); err != nil {
+			return err
+		}
+
+		return o.print(map[string]bool{"rolledBack": true}, func() error {
+			fmt.Println("Restored the previous version")
+			return nil
+		})
+	}
+
+	current := buildinfo.Get().Version
+
+	r, err := selfupdate.Latest(*channel)
+	if err != nil {
+		return err
+	}
+
+	res := updateResult{Current: current, Latest: r.Version, Channel: r.Channel, Available: selfupdate.Newer(r.Version, current)}
+
+	if !*force && !res.Available {
+		return o.print(res, func() error {
+			fmt.Printf("Already running the latest %s release (%s)\n", r.Channel, current)
+			return nil
+		})
+	}
+
+	if *check {
+		return o.print(res, func() error {
+			fmt.Printf("Version %s is available on the %s channel, running %s\n", r.Version, r.Channel, current)
+			return nil
+		})
+	}
+
+	if err := selfupdate.Install(r, exe, current); err != nil {
+		return err
+	}
+	res.Installed = true
+
+	// Waiting for the restarted daemon can take a while, so people are told straight away
+	if o.output == "table" {
+		fmt.Printf("Installed %s\n", r.Version)
+	}
+
+	if !driver.Active(*service) {
+		return o.print(res, func() error {
+			fmt.Println("The daemon is not running as a service, restart it to run the new version")
+			return nil
+		})
+	}
+
+	if err := driver.Restart(*service); err != nil {
+		return err
+	}
+
+	if err := selfupdate.Wait(); err != nil {
+		if rerr := selfupdate.Rollback(exe); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+
+		if rerr := driver.Restart(*service); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+
+		return fmt.Errorf("%w, rolled back to %s", err, current)
+	}
+
+	res.Running = true
+
+	return o.print(res, func() error {
+		fmt.Printf("Version %s is running\n", r.Version)
+		return nil
+	})
+}
+
+// updateResult is the outcome of checking for or installing a release
+type updateResult struct {
+	Current   string `json:"current"`
+	Latest    string `json:"latest"`
+	Channel   string `json:"channel"`
+	Available bool   `json:"available"`
+	Installed bool   `json:"installed"`
+
+	// Whether the daemon was restarted and reported the new version healthy
+	Running bool `json:"running"`
+}
+
+// restartService restarts the daemon if it is running as a service
+func restartService(driver initsys.Driver, name string) error {
+	if !driver.Active(name) {
+		return nil
+	}
+
+	return driver.Restart(name)
+}
@@ -0,0 +1,240 @@
+package updates
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// Update is a pending package update that fixes a security issue
+type Update struct {
+	Package   string `json:"package"`
+	Current   string `json:"current,omitempty"`
+	Available string `json:"available"`
+	Advisory  string `json:"advisory,omitempty"`
+	Severity  string `json:"severity,omitempty"`
+}
+
+// backend lists and installs security updates with the host's package manager
+type backend interface {
+	Name() string
+
+	// Pending refreshes the package metadata and returns the security updates
+	Pending() ([]Update, error)
+
+	// Apply installs the updates, returning the package manager's output
+	Apply(updates []Update) ([]byte, error)
+
+	// Restarts returns the services still running code replaced by an update and
+	// whether the host must be rebooted to load a new kernel or core library
+	Restarts() ([]string, bool, error)
+}
+
+// newBackend returns the backend for the configured package manager, detecting the one
+// installed when set to auto
+func newBackend(name string) (backend, error) {
+	switch name {
+	case "apt":
+		return &apt{}, nil
+	case "dnf":
+		return &dnf{}, nil
+	case "auto", "":
+		if _, err := exec.LookPath("apt-get"); err == nil {
+			return &apt{}, nil
+		}
+		if _, err := exec.LookPath("dnf"); err == nil {
+			return &dnf{}, nil
+		}
+		return nil, errors.New("updates: no supported package manager found, install apt or dnf")
+	default:
+		return nil, fmt.Errorf("updates: unknown package manager %q", name)
+	}
+}
+
+// apt manages updates on Debian and Ubuntu, where security updates come from the
+// distribution's -security suite
+type apt struct{}
+
+func (b *apt) Name() string {
+	return "apt"
+}
+
+func (b *apt) Pending() ([]Update, error) {
+	if out, err := b.command("update", "-qq").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("updates: apt-get update failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	out, err := b.command("-s", "-q", "dist-upgrade").Output()
+	if err != nil {
+		return nil, fmt.Errorf("updates: apt-get failed to simulate an upgrade: %w", err)
+	}
+
+	// Simulated installs are printed as
+	// Inst openssl [3.0.2-0ubuntu1.10] (3.0.2-0ubuntu1.12 Ubuntu:22.04/jammy-security [amd64])
+	updates := []Update{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Inst ") || !strings.Contains(line, "-security") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		u := Update{Package: fields[1]}
+		for i := 2; i < len(fields); i++ {
+			switch {
+			case strings.HasPrefix(fields[i], "["):
+				u.Current = strings.Trim(fields[i], "[]")
+			case strings.HasPrefix(fields[i], "("):
+				u.Available = strings.TrimPrefix(fields[i], "(")
+				if i+1 < len(fields) {
+					u.Advisory = fields[i+1]
+				}
+				i = len(fields)
+			}
+		}
+
+		updates = append(updates, u)
+	}
+
+	return updates, nil
+}
+
+func (b *apt) Apply(updates []Update) ([]byte, error) {
+	args := []string{"install", "--only-upgrade", "-y", "-q",
+		"-o", "Dpkg::Options::=--force-confdef",
+		"-o", "Dpkg::Options::=--force-confold",
+	}
+	for _, u := range updates {
+		args = append(args, u.Package)
+	}
+
+	return b.command(args...).CombinedOutput()
+}
+
+func (b *apt) Restarts() ([]string, bool, error) {
+	_, err := os.Stat("/var/run/reboot-required")
+	reboot := err == nil
+
+	if _, err := exec.LookPath("needrestart"); err != nil {
+		return nil, reboot, nil
+	}
+
+	// needrestart lists services in batch mode as NEEDRESTART-SVC: nginx.service
+	out, err := privsep.Command("needrestart", "-b", "-r", "l").Output()
+	if err != nil {
+		return nil, reboot, fmt.Errorf("updates: needrestart failed: %w", err)
+	}
+
+	var services []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if svc, ok := strings.CutPrefix(s.Text(), "NEEDRESTART-SVC: "); ok {
+			services = append(services, strings.TrimSpace(svc))
+		}
+		if strings.HasPrefix(s.Text(), "NEEDRESTART-KSTA: ") && strings.TrimSpace(strings.TrimPrefix(s.Text(), "NEEDRESTART-KSTA: ")) != "1" {
+			reboot = true
+		}
+	}
+
+	return services, reboot, nil
+}
+
+// command returns an apt-get command that never prompts
+func (b *apt) command(args ...string) *privsep.Cmd {
+	cmd := privsep.Command("apt-get", args...)
+	cmd.Env = []string{"DEBIAN_FRONTEND=noninteractive"}
+
+	return cmd
+}
+
+// dnf manages updates on RHEL and its rebuilds, which publish security advisories in
+// their update metadata
+type dnf struct{}
+
+func (b *dnf) Name() string {
+	return "dnf"
+}
+
+func (b *dnf) Pending() ([]Update, error) {
+	out, err := privsep.Command("dnf", "-q", "--refresh", "updateinfo", "list", "--security").Output()
+	if err != nil {
+		return nil, fmt.Errorf("updates: dnf updateinfo failed: %w", err)
+	}
+
+	// Advisories are printed as ALSA-2024:1234 Important/Sec. openssl-1:3.0.7-25.el9.x86_64
+	updates := []Update{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		name, version := splitNEVRA(fields[2])
+		updates = append(updates, Update{
+			Package:   name,
+			Available: version,
+			Advisory:  fields[0],
+			Severity:  strings.TrimSuffix(fields[1], "/Sec."),
+		})
+	}
+
+	return updates, nil
+}
+
+func (b *dnf) Apply(updates []Update) ([]byte, error) {
+	args := []string{"-y", "upgrade", "--security"}
+	for _, u := range updates {
+		args = append(args, u.Package)
+	}
+
+	return privsep.Command("dnf", args...).CombinedOutput()
+}
+
+func (b *dnf) Restarts() ([]string, bool, error) {
+	// needs-restarting -r exits with 1 when a reboot is required
+	var exit interface{ ExitCode() int }
+	err := privsep.Command("dnf", "needs-restarting", "-r").Run()
+	reboot := errors.As(err, &exit) && exit.ExitCode() == 1
+
+	out, err := privsep.Command("dnf", "-q", "needs-restarting", "-s").Output()
+	if err != nil {
+		return nil, reboot, fmt.Errorf("updates: dnf needs-restarting failed: %w", err)
+	}
+
+	var services []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); strings.HasSuffix(line, ".service") {
+			services = append(services, line)
+		}
+	}
+
+	return services, reboot, nil
+}
+
+// splitNEVRA splits a package in name-epoch:version-release.arch form into its name and
+// the rest
+func splitNEVRA(nevra string) (string, string) {
+	if i := strings.LastIndex(nevra, "."); i > 0 {
+		nevra = nevra[:i]
+	}
+
+	release := strings.LastIndex(nevra, "-")
+	if release <= 0 {
+		return nevra, ""
+	}
+
+	version := strings.LastIndex(nevra[:release], "-")
+	if version <= 0 {
+		return nevra, ""
+	}
+
+	return nevra[:version], nevra[version+1:]
+}
@@ -0,0 +1,96 @@
+package updates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// snapshot copies every file matching the patterns under dir, keeping their absolute
+// paths, and returns the hash of each file copied
+func snapshot(dir string, patterns []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	for _, pattern := range patterns {
+		roots, err := filepath.Glob(pattern)
+		if err != nil {
+			return hashes, err
+		}
+
+		for _, root := range roots {
+			err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() {
+					return nil
+				}
+
+				sum, err := copyFile(path, filepath.Join(dir, path))
+				if err != nil {
+					return err
+				}
+				hashes[path] = sum
+
+				return nil
+			})
+			if err != nil {
+				return hashes, err
+			}
+		}
+	}
+
+	return hashes, nil
+}
+
+// changed returns the files added, removed or modified between two snapshots
+func changed(before map[string]string, after map[string]string) []string {
+	var files []string
+	for path, sum := range after {
+		if before[path] != sum {
+			files = append(files, path)
+		}
+	}
+
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			files = append(files, path)
+		}
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+// copyFile copies the file, preserving its permissions, and returns its hex SHA-256
+func copyFile(src string, dst string) (string, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
+}
@@ -0,0 +1,450 @@
+package updates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/initsys"
+	"github.com/cosmicpanel/CosmicPanel/internal/ids"
+	"go.uber.org/zap"
+)
+
+// maxRuns is the number of update runs kept in the history
+const maxRuns = 50
+
+// maxOutput is the number of bytes of package manager output kept for each run
+const maxOutput = 64 * 1024
+
+var (
+	// ErrNotConfigured is returned when checking for updates before Configure is called
+	ErrNotConfigured = errors.New("updates: not configured")
+
+	// ErrRunning is returned when applying updates while another run is in progress
+	ErrRunning = errors.New("updates: updates are already being applied")
+)
+
+// Services that are never restarted automatically, either because restarting them
+// would end the run itself or because it would log out every user on the host
+var protected = []string{"cosmicpanel", "dbus", "systemd-", "user@", "getty@", "serial-getty@"}
+
+// Run is a single application of security updates
+type Run struct {
+	ID       string    `json:"id"`
+	Trigger  string    `json:"trigger"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Updates  []Update  `json:"updates"`
+
+	// Panel managed configuration files the update added, removed or modified, found by
+	// comparing the snapshots taken before and after
+	Changed []string `json:"changed"`
+
+	Restarted      []string `json:"restarted"`
+	Failed         []string `json:"failed"`
+	RebootRequired bool     `json:"rebootRequired"`
+
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Status describes the pending updates and recent runs
+type Status struct {
+	Backend        string    `json:"backend"`
+	Checked        time.Time `json:"checked"`
+	Pending        []Update  `json:"pending"`
+	RebootRequired bool      `json:"rebootRequired"`
+	Running        bool      `json:"running"`
+	AutoApply      bool      `json:"autoApply"`
+	NextWindow     time.Time `json:"nextWindow,omitempty"`
+	Runs           []Run     `json:"runs"`
+}
+
+// state is persisted so that pending updates and the run history survive a restart
+type state struct {
+	Checked        time.Time `json:"checked"`
+	Pending        []Update  `json:"pending"`
+	RebootRequired bool      `json:"rebootRequired"`
+	Runs           []Run     `json:"runs"`
+}
+
+// Manager checks for and applies security updates with the host's package manager
+type Manager struct {
+	mu      sync.Mutex
+	dir     string
+	config  *config.UpdatesConfiguration
+	backend backend
+	state   state
+	running bool
+}
+
+var std *Manager
+
+// Configure detects the package manager and loads the update history from the data
+// directory
+func Configure(dataDir string, c *config.UpdatesConfiguration) error {
+	dir := filepath.Join(dataDir, "updates")
+	if err := os.MkdirAll(filepath.Join(dir, "snapshots"), 0700); err != nil {
+		return err
+	}
+
+	if _, err := time.Parse("15:04", c.Window.Start); err != nil {
+		return fmt.Errorf("updates: invalid window start %q, use HH:MM", c.Window.Start)
+	}
+
+	for _, day := range c.Window.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("updates: invalid window day %q", day)
+		}
+	}
+
+	b, err := newBackend(c.Backend)
+	if err != nil {
+		return err
+	}
+
+	m := &Manager{dir: dir, config: c, backend: b}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "state.json")); err == nil {
+		if err := json.Unmarshal(b, &m.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	std = m
+
+	return nil
+}
+
+// Get returns the pending updates and recent runs
+func Get() Status {
+	if std == nil {
+		return Status{Pending: []Update{}, Runs: []Run{}}
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	status := Status{
+		Backend:        std.backend.Name(),
+		Checked:        std.state.Checked,
+		Pending:        append([]Update{}, std.state.Pending...),
+		RebootRequired: std.state.RebootRequired,
+		Running:        std.running,
+		AutoApply:      std.config.AutoApply,
+		Runs:           append([]Run{}, std.state.Runs...),
+	}
+
+	if std.config.AutoApply {
+		status.NextWindow = std.nextWindow(time.Now())
+	}
+
+	return status
+}
+
+// Due returns true if the check interval has passed since updates were last checked for
+func Due() bool {
+	if std == nil || std.config.Interval <= 0 {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return time.Since(std.state.Checked) >= time.Duration(std.config.Interval)*time.Hour
+}
+
+// Check refreshes the package metadata and records the pending security updates
+func Check() ([]Update, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	pending, err := std.backend.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	_, reboot, err := std.backend.Restarts()
+	if err != nil {
+		zap.S().Named("updates").Warnw("failed to check for required restarts", zap.Error(err))
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.state.Checked = time.Now().UTC()
+	std.state.Pending = pending
+	std.state.RebootRequired = reboot
+
+	if len(pending) > 0 {
+		zap.S().Named("updates").Warnw("security updates are pending", "count", len(pending))
+	}
+
+	return pending, std.save()
+}
+
+// AutoDue returns true if automatic updates are enabled, updates are pending and the
+// current window has not already had a run
+func AutoDue() bool {
+	if std == nil || !std.config.AutoApply {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	start, ok := std.window(time.Now())
+	if !ok || len(std.state.Pending) == 0 || std.running {
+		return false
+	}
+
+	for _, r := range std.state.Runs {
+		if !r.Started.Before(start) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Running returns true while updates are being applied
+func Running() bool {
+	if std == nil {
+		return false
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.running
+}
+
+// Apply installs the pending security updates, snapshotting panel managed
+// configuration before and after and restarting the services that need it. The
+// trigger records whether the run was started manually or by the schedule
+func Apply(trigger string) (Run, error) {
+	if std == nil {
+		return Run{}, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	if std.running {
+		std.mu.Unlock()
+		return Run{}, ErrRunning
+	}
+	std.running = true
+	pending := append([]Update{}, std.state.Pending...)
+	std.mu.Unlock()
+
+	defer func() {
+		std.mu.Lock()
+		std.running = false
+		std.mu.Unlock()
+	}()
+
+	run := std.apply(trigger, pending)
+
+	std.mu.Lock()
+	std.state.Runs = append(std.state.Runs, run)
+	if len(std.state.Runs) > maxRuns {
+		std.state.Runs = std.state.Runs[len(std.state.Runs)-maxRuns:]
+	}
+	if run.Error == "" {
+		std.state.Pending = nil
+	}
+	std.state.RebootRequired = run.RebootRequired
+	if err := std.save(); err != nil {
+		zap.S().Named("updates").Errorw("failed to save update history", zap.Error(err))
+	}
+	std.mu.Unlock()
+
+	std.prune()
+
+	events.Publish(events.Event{
+		Type:     "updates.applied",
+		Resource: run.ID,
+		Data: map[string]interface{}{
+			"trigger":        run.Trigger,
+			"updates":        len(run.Updates),
+			"changed":        run.Changed,
+			"restarted":      run.Restarted,
+			"failed":         run.Failed,
+			"rebootRequired": run.RebootRequired,
+			"error":          run.Error,
+		},
+	})
+
+	if run.Error != "" {
+		return run, errors.New(run.Error)
+	}
+
+	return run, nil
+}
+
+// PlanApply reports the packages Apply would upgrade without installing anything
+func PlanApply() (*dryrun.Plan, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	plan := dryrun.New("updates.apply")
+	for _, u := range std.state.Pending {
+		detail := u.Available
+		if u.Current != "" {
+			detail = u.Current + " -> " + u.Available
+		}
+		if u.Advisory != "" {
+			detail += " (" + u.Advisory + ")"
+		}
+
+		plan.Add(dryrun.Package, dryrun.Upgrade, u.Package, detail)
+	}
+
+	if len(std.config.Snapshots) > 0 {
+		plan.Note("files matching " + strings.Join(std.config.Snapshots, ", ") + " are snapshotted before and after updating")
+	}
+
+	if std.config.Restart {
+		plan.Note("services still running replaced code are restarted, which are only known once the packages are installed")
+	}
+
+	return plan, nil
+}
+
+// apply performs a run without holding the lock
+func (m *Manager) apply(trigger string, pending []Update) Run {
+	run := Run{
+		ID:        ids.New(),
+		Trigger:   trigger,
+		Started:   time.Now().UTC(),
+		Updates:   pending,
+		Changed:   []string{},
+		Restarted: []string{},
+		Failed:    []string{},
+	}
+
+	log := zap.S().Named("updates")
+	log.Infow("applying security updates", "count", len(pending), "trigger", trigger)
+
+	dir := filepath.Join(m.dir, "snapshots", run.ID)
+	before, err := snapshot(filepath.Join(dir, "pre"), m.config.Snapshots)
+	if err != nil {
+		run.Error = fmt.Sprintf("failed to snapshot configuration before updating: %s", err)
+		run.Finished = time.Now().UTC()
+		return run
+	}
+
+	if len(pending) > 0 {
+		out, err := m.backend.Apply(pending)
+		if len(out) > maxOutput {
+			out = out[len(out)-maxOutput:]
+		}
+		run.Output = string(out)
+
+		if err != nil {
+			run.Error = fmt.Sprintf("%s failed: %s", m.backend.Name(), err)
+		}
+	}
+
+	after, err := snapshot(filepath.Join(dir, "post"), m.config.Snapshots)
+	if err != nil {
+		log.Errorw("failed to snapshot configuration after updating", zap.Error(err))
+	}
+	run.Changed = append(run.Changed, changed(before, after)...)
+
+	services, reboot, err := m.backend.Restarts()
+	if err != nil {
+		log.Warnw("failed to check for required restarts", zap.Error(err))
+	}
+	run.RebootRequired = reboot
+
+	driver, err := initsys.Detect("")
+	if err != nil {
+		log.Warnw("failed to detect the init system to restart services with", zap.Error(err))
+		services = nil
+	}
+
+	for _, svc := range services {
+		if !m.config.Restart || isProtected(svc) {
+			continue
+		}
+
+		if !driver.Active(svc) {
+			continue
+		}
+
+		if err := driver.Restart(svc); err != nil {
+			log.Errorw("failed to restart service after updating", "service", svc, zap.Error(err))
+			run.Failed = append(run.Failed, svc)
+			continue
+		}
+
+		run.Restarted = append(run.Restarted, svc)
+	}
+
+	run.Finished = time.Now().UTC()
+	log.Infow("applied security updates", "count", len(pending), "changed", len(run.Changed), "restarted", run.Restarted, "rebootRequired", run.RebootRequired)
+
+	return run
+}
+
+// prune removes the snapshots of all but the most recent runs
+func (m *Manager) prune() {
+	m.mu.Lock()
+	keep := make(map[string]bool)
+	for i := len(m.state.Runs) - 1; i >= 0 && len(keep) < m.config.Keep; i-- {
+		keep[m.state.Runs[i].ID] = true
+	}
+	m.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(m.dir, "snapshots"))
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			os.RemoveAll(filepath.Join(m.dir, "snapshots", e.Name()))
+		}
+	}
+}
+
+// save writes the pending updates and history to disk. The manager must be locked
+func (m *Manager) save() error {
+	b, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(m.dir, "state.json")
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// isProtected returns true if the service must not be restarted automatically
+func isProtected(svc string) bool {
+	for _, p := range protected {
+		if strings.HasPrefix(svc, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package updates
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/dryrun"
+)
+
+func TestPlanApply(t *testing.T) {
+	if _, err := PlanApply(); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("planning before Configure: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		pending []Update
+		config  config.UpdatesConfiguration
+		changes []dryrun.Change
+		notes   int
+	}{
+		{"nothing pending", nil, config.UpdatesConfiguration{}, []dryrun.Change{}, 0},
+		{
+			"upgrades",
+			[]Update{
+				{Package: "openssl", Current: "3.0.13-1", Available: "3.0.13-2", Advisory: "DSA-5678-1"},
+				{Package: "libssl3", Available: "3.0.13-2"},
+			},
+			config.UpdatesConfiguration{},
+			[]dryrun.Change{
+				{Kind: dryrun.Package, Action: dryrun.Upgrade, Target: "openssl", Detail: "3.0.13-1 -> 3.0.13-2 (DSA-5678-1)"},
+				{Kind: dryrun.Package, Action: dryrun.Upgrade, Target: "libssl3", Detail: "3.0.13-2"},
+			},
+			0,
+		},
+		{"snapshots and restarts", nil, config.UpdatesConfiguration{Snapshots: []string{"/etc/nginx"}, Restart: true}, []dryrun.Change{}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			std = &Manager{config: &tt.config, state: state{Pending: tt.pending}}
+			defer func() { std = nil }()
+
+			plan, err := PlanApply()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(plan.Changes) != len(tt.changes) {
+				t.Fatalf("changes %+v, want %+v", plan.Changes, tt.changes)
+			}
+			for i, c := range plan.Changes {
+				if c != tt.changes[i] {
+					t.Errorf("change %+v, want %+v", c, tt.changes[i])
+				}
+			}
+			if len(plan.Notes) != tt.notes {
+				t.Errorf("notes %q, want %d", plan.Notes, tt.notes)
+			}
+
+			// Planning changes nothing Apply would read
+			if len(std.state.Pending) != len(tt.pending) || len(std.state.Runs) != 0 {
+				t.Error("planning changed the state")
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package updates
+
+import (
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window returns the start of the update window covering the time. Windows may run past
+// midnight, so one starting the previous day is also considered
+func (m *Manager) window(now time.Time) (time.Time, bool) {
+	for _, offset := range []int{0, -1} {
+		start, ok := m.windowStart(now.AddDate(0, 0, offset))
+		if !ok {
+			continue
+		}
+
+		end := start.Add(time.Duration(m.config.Window.Duration) * time.Minute)
+		if !now.Before(start) && now.Before(end) {
+			return start, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// nextWindow returns the start of the next update window after the time, or the start
+// of the current window if one is in progress
+func (m *Manager) nextWindow(now time.Time) time.Time {
+	if start, ok := m.window(now); ok {
+		return start
+	}
+
+	for offset := 0; offset <= 7; offset++ {
+		start, ok := m.windowStart(now.AddDate(0, 0, offset))
+		if ok && start.After(now) {
+			return start
+		}
+	}
+
+	return time.Time{}
+}
+
+// windowStart returns when the window starts on the day, if the day is one of the
+// window's days
+func (m *Manager) windowStart(day time.Time) (time.Time, bool) {
+	at, err := time.Parse("15:04", m.config.Window.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, d := range m.config.Window.Days {
+		if weekdays[strings.ToLower(d)] == day.Weekday() {
+			return time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, day.Location()), true
+		}
+	}
+
+	return time.Time{}, false
+}
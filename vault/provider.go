@@ -0,0 +1,254 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+)
+
+// provider protects the data key secrets are encrypted with
+type provider interface {
+	Name() string
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// newProvider returns the provider for the configuration
+func newProvider(c *config.VaultConfiguration) (provider, error) {
+	switch c.Provider {
+	case "local", "":
+		key, err := masterKey(c)
+		if err != nil {
+			return nil, err
+		}
+		return &local{key: key}, nil
+	case "command":
+		if c.Command == "" {
+			return nil, errors.New("vault: the command provider requires a command")
+		}
+		return &command{cmd: c.Command}, nil
+	case "transit":
+		if c.Address == "" || c.KeyName == "" {
+			return nil, errors.New("vault: the transit provider requires an address and key name")
+		}
+		return &transit{address: strings.TrimRight(c.Address, "/"), token: c.Token, key: c.KeyName}, nil
+	default:
+		return nil, fmt.Errorf("vault: unknown key provider %q", c.Provider)
+	}
+}
+
+// local wraps the data key with a master key held in the configuration or a key file
+type local struct {
+	key []byte
+}
+
+func (p *local) Name() string {
+	return "local"
+}
+
+func (p *local) Wrap(key []byte) ([]byte, error) {
+	return seal(p.key, key, nil)
+}
+
+func (p *local) Unwrap(wrapped []byte) ([]byte, error) {
+	return open(p.key, wrapped, nil)
+}
+
+// masterKey returns the master key from the configuration, reading it from the key file
+// or creating the file with a random key if it is not set directly
+func masterKey(c *config.VaultConfiguration) ([]byte, error) {
+	encoded := c.Key
+	if encoded == "" {
+		b, err := os.ReadFile(c.KeyFile)
+		if os.IsNotExist(err) {
+			return createKeyFile(c.KeyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("vault: the master key must be 32 bytes encoded as base64")
+	}
+
+	return key, nil
+}
+
+// createKeyFile writes a random master key to the path, readable only by root
+func createKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0400); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// command wraps the data key by running an external program, which lets any KMS with a
+// command line client protect the key
+type command struct {
+	cmd string
+}
+
+func (p *command) Name() string {
+	return "command"
+}
+
+func (p *command) Wrap(key []byte) ([]byte, error) {
+	return p.run("wrap", key)
+}
+
+func (p *command) Unwrap(wrapped []byte) ([]byte, error) {
+	return p.run("unwrap", wrapped)
+}
+
+func (p *command) run(op string, in []byte) ([]byte, error) {
+	cmd := exec.Command(p.cmd, op)
+	cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(in))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("vault: key command failed to %s: %w: %s", op, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+// transit wraps the data key with the transit secrets engine of a HashiCorp Vault server
+type transit struct {
+	address string
+	token   string
+	key     string
+}
+
+func (p *transit) Name() string {
+	return "transit"
+}
+
+func (p *transit) Wrap(key []byte) ([]byte, error) {
+	var res struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := p.call("encrypt", body, &res); err != nil {
+		return nil, err
+	}
+
+	return []byte(res.Data.Ciphertext), nil
+}
+
+func (p *transit) Unwrap(wrapped []byte) ([]byte, error) {
+	var res struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+
+	body := map[string]string{"ciphertext": string(wrapped)}
+	if err := p.call("decrypt", body, &res); err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(res.Data.Plaintext)
+}
+
+func (p *transit) call(op string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/transit/%s/%s", p.address, op, p.key), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpx.Client(30 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: transit %s failed with status %s", op, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// seal encrypts the plaintext with AES-256-GCM, prefixing the nonce to the result. The
+// additional data must be passed to open unchanged, which binds a secret to its name
+func seal(key []byte, plaintext []byte, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// open decrypts a value encrypted by seal
+func open(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("vault: ciphertext is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+	if err != nil {
+		return nil, errors.New("vault: failed to decrypt, the key is wrong or the data has been modified")
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,116 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+
+	sealed, err := seal(key, []byte("hunter2"), []byte("mysql/root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        []byte
+		sealed     []byte
+		additional string
+		ok         bool
+	}{
+		{"same key and name", key, sealed, "mysql/root", true},
+		{"another key", other, sealed, "mysql/root", false},
+		{"another name", key, sealed, "dns/cloudflare", false},
+		{"no name", key, sealed, "", false},
+		{"modified", key, flipped, "mysql/root", false},
+		{"truncated", key, sealed[:len(sealed)-1], "mysql/root", false},
+		{"shorter than the nonce", key, sealed[:5], "mysql/root", false},
+		{"empty", key, nil, "mysql/root", false},
+		{"key of the wrong size", key[:16], sealed, "mysql/root", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := open(tt.key, tt.sealed, []byte(tt.additional))
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			if tt.ok && string(b) != "hunter2" {
+				t.Errorf("got %q", b)
+			}
+		})
+	}
+
+	// Sealing the same value twice uses a new nonce each time
+	again, err := seal(key, []byte("hunter2"), []byte("mysql/root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("the same value sealed twice gave the same ciphertext")
+	}
+}
+
+func TestMasterKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	tests := []struct {
+		name string
+		c    config.VaultConfiguration
+		file string
+		ok   bool
+	}{
+		{"in the configuration", config.VaultConfiguration{Key: key}, "", true},
+		{"with surrounding space", config.VaultConfiguration{Key: " " + key + "\n"}, "", true},
+		{"in a file", config.VaultConfiguration{}, key + "\n", true},
+		{"file created", config.VaultConfiguration{}, "", true},
+		{"too short", config.VaultConfiguration{Key: base64.StdEncoding.EncodeToString(make([]byte, 16))}, "", false},
+		{"not base64", config.VaultConfiguration{Key: "not base64!"}, "", false},
+		{"file too short", config.VaultConfiguration{}, base64.StdEncoding.EncodeToString(make([]byte, 31)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.c
+			c.KeyFile = filepath.Join(t.TempDir(), "keys", "vault.key")
+			if tt.file != "" {
+				os.MkdirAll(filepath.Dir(c.KeyFile), 0700)
+				if err := os.WriteFile(c.KeyFile, []byte(tt.file), 0400); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := masterKey(&c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			if !tt.ok {
+				return
+			}
+			if len(got) != 32 {
+				t.Errorf("%d byte key", len(got))
+			}
+
+			// A key file that did not exist is created readable only by its owner, and
+			// holds the key returned
+			again, err := masterKey(&c)
+			if err != nil || !bytes.Equal(got, again) {
+				t.Errorf("the key changed when read again: %v", err)
+			}
+			if info, err := os.Stat(c.KeyFile); err == nil && c.Key == "" && info.Mode().Perm()&0077 != 0 {
+				t.Errorf("key file mode %v", info.Mode().Perm())
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"go.uber.org/zap"
+)
+
+// Prefix marks a configuration value as a reference to a secret in the vault
+const Prefix = "vault:"
+
+var (
+	// ErrNotConfigured is returned when using the vault before Configure is called
+	ErrNotConfigured = errors.New("vault: not configured")
+
+	// ErrNotFound is returned when a secret does not exist
+	ErrNotFound = errors.New("vault: secret not found")
+
+	// ErrInvalidName is returned when a secret name contains characters other than
+	// lowercase letters, digits, dots, dashes, underscores and slashes
+	ErrInvalidName = errors.New("vault: secret names may only contain a-z, 0-9, '.', '-', '_' and '/'")
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9._/-]*$`)
+
+// secret is a single encrypted value
+type secret struct {
+	Value   []byte    `json:"value"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// file is the format the vault is stored in. The data key is stored wrapped by the
+// provider so that the file alone cannot be decrypted
+type file struct {
+	Provider string             `json:"provider"`
+	Key      []byte             `json:"key"`
+	Secrets  map[string]*secret `json:"secrets"`
+}
+
+// Info describes a secret without revealing its value
+type Info struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Vault holds the secrets used by other modules, such as database root passwords, DNS
+// provider tokens and credentials for backup destinations, encrypted at rest
+type Vault struct {
+	mu       sync.Mutex
+	path     string
+	provider provider
+	key      []byte
+	data     file
+}
+
+var std *Vault
+
+// Configure opens the vault in the data directory, creating it with a new data key if
+// it does not exist yet
+func Configure(dataDir string, c *config.VaultConfiguration) error {
+	dir := filepath.Join(dataDir, "vault")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	p, err := newProvider(c)
+	if err != nil {
+		return err
+	}
+
+	v := &Vault{
+		path:     filepath.Join(dir, "vault.json"),
+		provider: p,
+		data:     file{Secrets: make(map[string]*secret)},
+	}
+
+	b, err := os.ReadFile(v.path)
+	switch {
+	case os.IsNotExist(err):
+		if err := v.newKey(); err != nil {
+			return err
+		}
+		if err := v.save(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &v.data); err != nil {
+			return err
+		}
+
+		if v.data.Provider != p.Name() {
+			return fmt.Errorf("vault: the vault was created with the %s provider but %s is configured", v.data.Provider, p.Name())
+		}
+
+		if v.key, err = p.Unwrap(v.data.Key); err != nil {
+			return fmt.Errorf("vault: failed to unwrap the data key: %w", err)
+		}
+
+		if v.data.Secrets == nil {
+			v.data.Secrets = make(map[string]*secret)
+		}
+	}
+
+	std = v
+
+	return nil
+}
+
+// Get returns the value of the secret
+func Get(name string) (string, error) {
+	if std == nil {
+		return "", ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	s, ok := std.data.Secrets[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	b, err := open(std.key, s.Value, []byte(name))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Set stores the value of the secret, replacing any previous value
+func Set(name string, value string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	if !validName.MatchString(name) {
+		return ErrInvalidName
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	sealed, err := seal(std.key, []byte(value), []byte(name))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	s, ok := std.data.Secrets[name]
+	if !ok {
+		s = &secret{Created: now}
+		std.data.Secrets[name] = s
+	}
+
+	previous := *s
+	s.Value = sealed
+	s.Updated = now
+
+	if err := std.save(); err != nil {
+		if ok {
+			*s = previous
+		} else {
+			delete(std.data.Secrets, name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the secret
+func Delete(name string) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if _, ok := std.data.Secrets[name]; !ok {
+		return ErrNotFound
+	}
+
+	delete(std.data.Secrets, name)
+
+	return std.save()
+}
+
+// List returns every secret in the vault without its value, sorted by name
+func List() []Info {
+	list := []Info{}
+	if std == nil {
+		return list
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for name, s := range std.data.Secrets {
+		list = append(list, Info{Name: name, Created: s.Created, Updated: s.Updated})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Resolve returns the secret a value references if it starts with the vault: prefix,
+// or the value unchanged if it does not
+func Resolve(value string) (string, error) {
+	name, ok := strings.CutPrefix(value, Prefix)
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := Get(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, name)
+	}
+
+	return secret, nil
+}
+
+// Rotate re-encrypts every secret with a new data key
+func Rotate() error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return std.rekey(std.provider)
+}
+
+// rekey decrypts every secret and encrypts it again with a new data key wrapped by the
+// provider. Nothing changes if any step fails. The vault must be locked
+func (v *Vault) rekey(p provider) error {
+	previous := v.data
+	previousKey := v.key
+	previousProvider := v.provider
+
+	plain := make(map[string][]byte, len(v.data.Secrets))
+	for name, s := range v.data.Secrets {
+		b, err := open(v.key, s.Value, []byte(name))
+		if err != nil {
+			return fmt.Errorf("vault: failed to decrypt %s: %w", name, err)
+		}
+		plain[name] = b
+	}
+
+	v.provider = p
+	v.data = file{Secrets: make(map[string]*secret, len(plain))}
+	restore := func() {
+		v.data, v.key, v.provider = previous, previousKey, previousProvider
+	}
+
+	if err := v.newKey(); err != nil {
+		restore()
+		return err
+	}
+
+	for name, b := range plain {
+		sealed, err := seal(v.key, b, []byte(name))
+		if err != nil {
+			restore()
+			return err
+		}
+
+		old := previous.Secrets[name]
+		v.data.Secrets[name] = &secret{Value: sealed, Created: old.Created, Updated: old.Updated}
+	}
+
+	if err := v.save(); err != nil {
+		restore()
+		return err
+	}
+
+	zap.S().Named("vault").Infow("rotated vault data key", "provider", p.Name(), "secrets", len(plain))
+
+	return nil
+}
+
+// newKey generates a data key and wraps it with the provider. The vault must be locked
+func (v *Vault) newKey() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	wrapped, err := v.provider.Wrap(key)
+	if err != nil {
+		return fmt.Errorf("vault: failed to wrap the data key: %w", err)
+	}
+
+	v.key = key
+	v.data.Provider = v.provider.Name()
+	v.data.Key = wrapped
+
+	return nil
+}
+
+// save atomically writes the vault to disk. The vault must be locked
+func (v *Vault) save() error {
+	b, err := json.MarshalIndent(v.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := v.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, v.path)
+}
@@ -0,0 +1,170 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+)
+
+func localConfig(b byte) *config.VaultConfiguration {
+	return &config.VaultConfiguration{Provider: "local", Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))}
+}
+
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	if err := Configure(dir, localConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { std = nil }()
+
+	secrets := map[string]string{
+		"mysql/root":           "hunter2",
+		"dns/cloudflare.token": "cf-abc123",
+		"backup/s3-secret_key": "",
+	}
+	for name, value := range secrets {
+		if err := Set(name, value); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		set  string
+		err  error
+	}{
+		{"upper case", "MySQL", ErrInvalidName},
+		{"leading dot", ".hidden", ErrInvalidName},
+		{"leading slash", "/etc/shadow", ErrInvalidName},
+		{"space", "my secret", ErrInvalidName},
+		{"empty", "", ErrInvalidName},
+		{"colon", "vault:x", ErrInvalidName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Set(tt.set, "x"); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// Values do not appear in the file
+	b, err := os.ReadFile(filepath.Join(dir, "vault", "vault.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range secrets {
+		if value != "" && bytes.Contains(b, []byte(value)) {
+			t.Errorf("%q is stored in the clear", value)
+		}
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for name, want := range secrets {
+			if got, err := Get(name); err != nil || got != want {
+				t.Errorf("%s: %s is %q, %v", stage, name, got, err)
+			}
+		}
+	}
+
+	check("after setting")
+
+	if err := Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	check("after rotating")
+
+	// The vault opens again with the same master key
+	if err := Configure(dir, localConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	check("after reopening")
+
+	if err := Configure(dir, localConfig(2)); err == nil {
+		t.Error("the vault opened with another master key")
+	}
+	if err := Configure(dir, &config.VaultConfiguration{Provider: "command", Command: "/bin/false"}); err == nil {
+		t.Error("the vault opened with another provider")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	if err := Configure(t.TempDir(), localConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { std = nil }()
+
+	if err := Set("mysql/root", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		want  string
+		err   error
+	}{
+		{"vault:mysql/root", "hunter2", nil},
+		{"plain value", "plain value", nil},
+		{"", "", nil},
+		{"VAULT:mysql/root", "VAULT:mysql/root", nil},
+		{"vault:missing", "", ErrNotFound},
+		{"vault:", "", ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		got, err := Resolve(tt.value)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Resolve(%q) = %q, %v, want %q, %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSwappedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := Configure(dir, localConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { std = nil }()
+
+	Set("mysql/root", "root password")
+	Set("mail/relay", "relay password")
+
+	// Someone able to write the file moves the value of one secret to another, hoping the
+	// panel sends the root password to the relay
+	path := filepath.Join(dir, "vault", "vault.json")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	f.Secrets["mail/relay"].Value = f.Secrets["mysql/root"].Value
+
+	if b, err = json.Marshal(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(dir, localConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := Get("mail/relay"); err == nil {
+		t.Errorf("the swapped secret decrypted to %q", got)
+	}
+	if got, err := Get("mysql/root"); err != nil || got != "root password" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,383 @@
+package vhosts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/bulk"
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/internal/hostname"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"github.com/cosmicpanel/CosmicPanel/reconcile"
+	"github.com/cosmicpanel/CosmicPanel/registrar"
+	"github.com/cosmicpanel/CosmicPanel/store"
+)
+
+// The mass operation changing the template of many domains at once, such as adding a
+// header to every site, which is rolled out to a few sites before it reaches every one
+const bulkType = "vhost.template"
+
+// templateKind is what the templates of domains are kept under in the state store
+const templateKind = "vhosts.template"
+
+// Placeholders in the paths of the files of a domain and in its templates
+const (
+	domainPlaceholder  = "{domain}"
+	accountPlaceholder = "{account}"
+)
+
+// header starts every file templates are rendered into
+const header = "# Managed by CosmicPanel, changes are overwritten when the template of the domain changes\n"
+
+var (
+	// ErrNotConfigured is returned when changing templates before Configure is called
+	ErrNotConfigured = errors.New("vhosts: not configured")
+
+	// ErrNotFound is returned for a domain without a template
+	ErrNotFound = errors.New("vhosts: the domain has no template")
+)
+
+// Template is what is rendered into the server block and virtual host of a domain, with
+// {domain} and {account} standing for the domain and its account
+type Template struct {
+	Domain string `json:"domain"`
+
+	// The username of the account the domain belongs to
+	Account string `json:"account,omitempty"`
+
+	Nginx  string `json:"nginx,omitempty"`
+	Apache string `json:"apache,omitempty"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// Change is what a mass operation changes in the template of each domain. A server left
+// out keeps its template, and an empty template removes the file of the server
+type Change struct {
+	Nginx  *string `json:"nginx"`
+	Apache *string `json:"apache"`
+}
+
+type manager struct {
+	// Serializes changes, which each render the files of the domain before they are kept
+	mu     sync.Mutex
+	config *config.VHostsConfiguration
+}
+
+var std *manager
+
+// Configure registers the templates of domains with the reconciler, and the mass
+// operation changing them. The state store must be configured first
+func Configure(c *config.VHostsConfiguration) error {
+	if c.Nginx != "" && !strings.Contains(c.Nginx, domainPlaceholder) {
+		return fmt.Errorf("vhosts: the nginx file %q does not contain %s", c.Nginx, domainPlaceholder)
+	}
+
+	for _, path := range c.Apache {
+		if !strings.Contains(path, domainPlaceholder) {
+			return fmt.Errorf("vhosts: the apache file %q does not contain %s", path, domainPlaceholder)
+		}
+	}
+
+	std = &manager{config: c}
+
+	for _, s := range std.servers() {
+		reconcile.Register(s.name(), source(s))
+	}
+
+	bulk.Register(bulk.Type{
+		Name:    bulkType,
+		Run:     changeItem,
+		All:     domains,
+		Check:   bulk.SiteCheck(c.Check),
+		Account: func(it bulk.Item) string { return registrar.Account(normalize(it.Key)) },
+	})
+
+	return nil
+}
+
+// List returns the templates of every domain that has one, sorted by domain
+func List() ([]Template, error) {
+	list := []Template{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(templateKind, func(id string, data []byte) error {
+			var t Template
+			if err := json.Unmarshal(data, &t); err != nil {
+				return fmt.Errorf("vhosts: malformed template %s: %w", id, err)
+			}
+
+			list = append(list, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+
+	return list, nil
+}
+
+// Get returns the template of the domain
+func Get(domain string) (Template, error) {
+	var t Template
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(templateKind, normalize(domain), &t)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Template{}, ErrNotFound
+	}
+
+	return t, err
+}
+
+// set renders the template of the domain for every installed server and keeps it, or
+// forgets it when it is empty for every server. The files are put back if a server
+// rejects them
+func set(t Template) error {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	for _, s := range std.servers() {
+		path := s.file(t.Domain, t.Account)
+		if path == "" {
+			continue
+		}
+
+		var err error
+		if text := s.template(t); text != "" {
+			_, err = reconcile.Write(s.name(), source(s), reconcile.Artifact{Path: path, Content: render(t, text)})
+		} else {
+			_, err = reconcile.Remove(s.name(), source(s), path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.Update(func(tx *store.Tx) error {
+		if t.Nginx == "" && t.Apache == "" {
+			return tx.Delete(templateKind, t.Domain)
+		}
+
+		return tx.Put(templateKind, t.Domain, t)
+	})
+}
+
+// changeItem changes the template of the domain the item is keyed by
+func changeItem(ctx context.Context, actor string, it bulk.Item) error {
+	if std == nil {
+		return ErrNotConfigured
+	}
+
+	var c Change
+	if err := it.Decode(&c); err != nil {
+		return err
+	}
+
+	if c.Nginx == nil && c.Apache == nil {
+		return errors.New("vhosts: the operation changes no template")
+	}
+
+	domain := normalize(it.Key)
+	if !hostname.Valid(domain) {
+		return fmt.Errorf("vhosts: invalid domain %q", domain)
+	}
+
+	before, err := Get(domain)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	t := before
+	t.Domain = domain
+	t.Account = registrar.Account(domain)
+	if c.Nginx != nil {
+		t.Nginx = *c.Nginx
+	}
+	if c.Apache != nil {
+		t.Apache = *c.Apache
+	}
+	t.Updated = time.Now().UTC()
+
+	if t.Account == "" && strings.Contains(t.Nginx+t.Apache+std.config.Nginx+strings.Join(std.config.Apache, ""), accountPlaceholder) {
+		return fmt.Errorf("vhosts: the account %s belongs to is needed to render its template", domain)
+	}
+
+	if err := set(t); err != nil {
+		return err
+	}
+
+	e := events.Event{Type: "vhost.template", Actor: actor, Resource: domain}
+	if !before.Updated.IsZero() {
+		e.Before, _ = json.Marshal(before)
+	}
+	e.After, _ = json.Marshal(t)
+	events.Publish(e)
+
+	return nil
+}
+
+// domains returns an item for every domain registered through the panel or with a
+// template, which is what operations without items change
+func domains() ([]bulk.Item, error) {
+	seen := map[string]bool{}
+	items := []bulk.Item{}
+
+	registered, err := registrar.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range registered {
+		if name := normalize(d.Name); !seen[name] {
+			seen[name] = true
+			items = append(items, bulk.Item{Key: name})
+		}
+	}
+
+	list, err := List()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if !seen[t.Domain] {
+			seen[t.Domain] = true
+			items = append(items, bulk.Item{Key: t.Domain})
+		}
+	}
+
+	return items, nil
+}
+
+// render returns the file of the template of a server for the domain
+func render(t Template, text string) string {
+	return header + placeholders(t.Domain, t.Account).Replace(strings.TrimRight(text, "\n")) + "\n"
+}
+
+// server is a web server templates are rendered into
+type server interface {
+	name() string
+
+	// file returns the path of the file of the domain, or an empty string when the
+	// server is not installed
+	file(domain string, account string) string
+
+	// template returns the template of the domain for the server
+	template(t Template) string
+	test() error
+	reload() error
+}
+
+// servers returns the web servers templates are rendered for
+func (m *manager) servers() []server {
+	return []server{&nginx{path: m.config.Nginx}, &apache{paths: m.config.Apache}}
+}
+
+// source generates the file of every domain with a template for the server
+func source(s server) reconcile.Source {
+	return reconcile.Source{
+		Desired: func() ([]reconcile.Artifact, error) {
+			list, err := List()
+			if err != nil {
+				return nil, err
+			}
+
+			var artifacts []reconcile.Artifact
+			for _, t := range list {
+				text := s.template(t)
+				if text == "" {
+					continue
+				}
+
+				if path := s.file(t.Domain, t.Account); path != "" {
+					artifacts = append(artifacts, reconcile.Artifact{Path: path, Content: render(t, text)})
+				}
+			}
+
+			return artifacts, nil
+		},
+		Test:   s.test,
+		Reload: s.reload,
+	}
+}
+
+// nginx renders the template into a file included in the server block of the domain
+type nginx struct {
+	path string
+}
+
+func (t *nginx) name() string {
+	return "vhosts.nginx"
+}
+
+func (t *nginx) file(domain string, account string) string {
+	if path := placeholders(domain, account).Replace(t.path); reconcile.Installed(path) {
+		return path
+	}
+
+	return ""
+}
+
+func (t *nginx) template(tmpl Template) string {
+	return tmpl.Nginx
+}
+
+func (t *nginx) test() error {
+	return privsep.Run("nginx", "-t")
+}
+
+func (t *nginx) reload() error {
+	return privsep.Run("nginx", "-s", "reload")
+}
+
+// apache renders the template into a file included in the virtual host of the domain
+type apache struct {
+	paths []string
+}
+
+func (t *apache) name() string {
+	return "vhosts.apache"
+}
+
+func (t *apache) file(domain string, account string) string {
+	r := placeholders(domain, account)
+	for _, pattern := range t.paths {
+		if path := r.Replace(pattern); reconcile.Installed(path) {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func (t *apache) template(tmpl Template) string {
+	return tmpl.Apache
+}
+
+func (t *apache) test() error {
+	return privsep.Run("apachectl", "configtest")
+}
+
+func (t *apache) reload() error {
+	return privsep.Run("apachectl", "graceful")
+}
+
+// placeholders returns the replacer of the placeholders of the domain
+func placeholders(domain string, account string) *strings.Replacer {
+	return strings.NewReplacer(domainPlaceholder, domain, accountPlaceholder, account)
+}
+
+// normalize returns the domain in lowercase without a trailing dot
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
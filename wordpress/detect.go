@@ -0,0 +1,195 @@
+package wordpress
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+)
+
+// headerSize is how much of a plugin file is read for its header, which WordPress also
+// only looks for in the first 8 KiB
+const headerSize = 8 << 10
+
+var (
+	// errNotWordPress is returned when detecting a site in a directory without one
+	errNotWordPress = errors.New("wordpress: the directory has no WordPress site")
+
+	// coreVersion matches the version of WordPress in wp-includes/version.php
+	coreVersion = regexp.MustCompile(`\$wp_version\s*=\s*['"]([^'"]+)['"]`)
+
+	// pluginName and pluginVersion match the header of the main file of a plugin
+	pluginName    = regexp.MustCompile(`(?mi)^[ \t/*#@]*Plugin Name:(.*)$`)
+	pluginVersion = regexp.MustCompile(`(?mi)^[ \t/*#@]*Version:(.*)$`)
+)
+
+// detectAll finds the sites in the document roots, no deeper than the configured depth.
+// Symbolic links are not followed, so that an account cannot point the scan at the sites
+// of another
+func (t *toolkit) detectAll() ([]Install, error) {
+	var roots []string
+	for _, pattern := range t.config.Docroots {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, matches...)
+	}
+
+	found := []Install{}
+	for _, root := range roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+
+			i, err := detect(path)
+			if err == nil {
+				found = append(found, i)
+				return fs.SkipDir
+			}
+
+			if rel, _ := filepath.Rel(root, path); rel != "." && strings.Count(rel, string(filepath.Separator)) >= t.config.Depth {
+				return fs.SkipDir
+			}
+			return nil
+		})
+	}
+
+	return found, nil
+}
+
+// detect returns the site installed in the directory with its plugins and hardening
+func detect(path string) (Install, error) {
+	if _, err := os.Lstat(filepath.Join(path, "wp-load.php")); err != nil {
+		return Install{}, errNotWordPress
+	}
+
+	data, err := os.ReadFile(filepath.Join(path, "wp-includes", "version.php"))
+	if err != nil {
+		return Install{}, errNotWordPress
+	}
+
+	m := coreVersion.FindSubmatch(data)
+	if m == nil {
+		return Install{}, errNotWordPress
+	}
+
+	i := Install{
+		ID:        siteID(path),
+		Path:      path,
+		Version:   string(m[1]),
+		Plugins:   plugins(filepath.Join(path, "wp-content", "plugins")),
+		Hardening: hardened(path),
+	}
+
+	i.Account = owner(path)
+
+	return i, nil
+}
+
+// owner returns the account of the panel whose user owns the directory, or an empty
+// string when root, a system user or a user without an account owns it. The CLI runs
+// the site's wp-config.php, so it must not run as anyone the account could not act as
+func owner(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Uid < privsep.MinUID {
+		return ""
+	}
+
+	u, err := user.LookupId(strconv.Itoa(int(st.Uid)))
+	if err != nil {
+		return ""
+	}
+
+	if !slices.ContainsFunc(auth.Users(), func(a auth.User) bool { return a.Username == u.Username }) {
+		return ""
+	}
+
+	return u.Username
+}
+
+// plugins returns the plugins in the directory, both those in a directory of their own
+// and those of a single file. Files without a plugin header are skipped like WordPress
+// skips them
+func plugins(dir string) []Plugin {
+	list := []Plugin{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return list
+	}
+
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			files, err := os.ReadDir(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if f.Type().IsRegular() && strings.HasSuffix(f.Name(), ".php") {
+					if p, ok := plugin(filepath.Join(dir, e.Name(), f.Name()), e.Name()); ok {
+						list = append(list, p)
+						break
+					}
+				}
+			}
+		case e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".php"):
+			if p, ok := plugin(filepath.Join(dir, e.Name()), strings.TrimSuffix(e.Name(), ".php")); ok {
+				list = append(list, p)
+			}
+		}
+	}
+
+	return list
+}
+
+// plugin reads the header of a plugin file, returning false if it has none
+func plugin(path string, slug string) (Plugin, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Plugin{}, false
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	name := pluginName.FindSubmatch(header)
+	if name == nil {
+		return Plugin{}, false
+	}
+
+	p := Plugin{Slug: slug, Name: cleanHeader(name[1])}
+	if v := pluginVersion.FindSubmatch(header); v != nil {
+		p.Version = cleanHeader(v[1])
+	}
+
+	return p, true
+}
+
+// cleanHeader trims a value of a plugin header, which may end the comment it is in
+func cleanHeader(b []byte) string {
+	s := strings.TrimSpace(string(b))
+	s = strings.TrimSuffix(s, "*/")
+	s = strings.TrimSuffix(s, "?>")
+
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,132 @@
+package wordpress
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Hardening is what is turned off in a site to shrink what an attacker can reach
+type Hardening struct {
+	// XML-RPC, which is abused to guess passwords many at a time and to amplify pingbacks
+	XMLRPC bool `json:"disable_xmlrpc"`
+
+	// The theme and plugin editors of the dashboard, so that a stolen administrator login
+	// cannot write PHP to the site
+	FileEdit bool `json:"disable_file_edit"`
+}
+
+// hardeningFile is the must-use plugin hardening is written to, which WordPress loads
+// before every other plugin and which cannot be deactivated from the dashboard
+var hardeningFile = filepath.Join("wp-content", "mu-plugins", "cosmicpanel-hardening.php")
+
+// The parts of the hardening plugin, which are also how the hardening of a site is read
+// back from it
+const (
+	hardeningHeader = "<?php\n" +
+		"/*\n" +
+		" * Plugin Name: CosmicPanel hardening\n" +
+		" * Description: Managed by CosmicPanel, changes are overwritten when the hardening of the site changes\n" +
+		" */\n\n" +
+		"defined('ABSPATH') || exit;\n"
+
+	xmlrpcOff = "\nadd_filter('xmlrpc_enabled', '__return_false');\n" +
+		"add_filter('xmlrpc_methods', '__return_empty_array');\n"
+
+	fileEditOff = "\nif (!defined('DISALLOW_FILE_EDIT')) {\n" +
+		"\tdefine('DISALLOW_FILE_EDIT', true);\n" +
+		"}\n"
+)
+
+// hardened reads the hardening of the site in the directory from its hardening plugin
+func hardened(path string) Hardening {
+	data, err := os.ReadFile(filepath.Join(path, hardeningFile))
+	if err != nil {
+		return Hardening{}
+	}
+
+	return Hardening{
+		XMLRPC:   strings.Contains(string(data), xmlrpcOff),
+		FileEdit: strings.Contains(string(data), fileEditOff),
+	}
+}
+
+// Harden writes the hardening plugin of the site, owned by the owner of the site, or
+// removes it when nothing is to be turned off. The site is opened as a root the plugin
+// cannot be written outside of, so that links placed by the account do not redirect it
+func Harden(id string, h Hardening) (Install, error) {
+	if std == nil {
+		return Install{}, ErrNotConfigured
+	}
+
+	i, err := Get(id)
+	if err != nil {
+		return Install{}, err
+	}
+
+	root, err := os.OpenRoot(i.Path)
+	if err != nil {
+		return Install{}, err
+	}
+	defer root.Close()
+
+	if h == (Hardening{}) {
+		if err := root.Remove(hardeningFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return Install{}, err
+		}
+		return rescan(i)
+	}
+
+	info, err := root.Stat(".")
+	if err != nil {
+		return Install{}, err
+	}
+
+	uid, gid := -1, -1
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+
+	dir := filepath.Dir(hardeningFile)
+	if err := root.Mkdir(dir, 0755); err == nil {
+		if err := root.Lchown(dir, uid, gid); err != nil {
+			return Install{}, err
+		}
+	} else if !errors.Is(err, fs.ErrExist) {
+		return Install{}, err
+	}
+
+	content := hardeningHeader
+	if h.XMLRPC {
+		content += xmlrpcOff
+	}
+	if h.FileEdit {
+		content += fileEditOff
+	}
+
+	tmp := hardeningFile + ".tmp"
+	f, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return Install{}, err
+	}
+
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Chown(uid, gid)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = root.Rename(tmp, hardeningFile)
+	}
+	if err != nil {
+		root.Remove(tmp)
+		return Install{}, err
+	}
+
+	return rescan(i)
+}
@@ -0,0 +1,94 @@
+package wordpress
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/httpx"
+	"go.uber.org/zap"
+)
+
+// releases looks up the latest releases of WordPress and its plugins for one scan, so
+// that each is only requested once however many sites have it
+type releases struct {
+	api    string
+	client *http.Client
+
+	core    string
+	plugins map[string]string
+
+	// Whether WordPress.org failed to answer, after which the scan stops asking
+	failed bool
+}
+
+func newReleases(api string) *releases {
+	return &releases{
+		api:     strings.TrimSuffix(api, "/"),
+		client:  httpx.Client(30 * time.Second),
+		plugins: make(map[string]string),
+	}
+}
+
+// resolve sets the latest releases of WordPress and the plugins of the site. They are
+// left empty when WordPress.org cannot be reached or does not list a plugin
+func (r *releases) resolve(i *Install) {
+	if r.api == "" {
+		return
+	}
+
+	if r.core == "" && !r.failed {
+		var body struct {
+			Offers []struct {
+				Current string `json:"current"`
+			} `json:"offers"`
+		}
+		if r.get("/core/version-check/1.7/", &body) && len(body.Offers) > 0 {
+			r.core = body.Offers[0].Current
+		}
+	}
+	i.Latest = r.core
+
+	for n, p := range i.Plugins {
+		latest, ok := r.plugins[p.Slug]
+		if !ok && !r.failed {
+			var body struct {
+				Version string `json:"version"`
+			}
+			q := url.Values{"action": {"plugin_information"}, "request[slug]": {p.Slug}, "request[fields][sections]": {"0"}}
+			if r.get("/plugins/info/1.2/?"+q.Encode(), &body) {
+				latest = body.Version
+			}
+			r.plugins[p.Slug] = latest
+		}
+		i.Plugins[n].Latest = latest
+	}
+}
+
+// get decodes the answer of the API to the path, returning false if there is none. Plugins
+// WordPress.org does not list are answered with 404, which is not a failure
+func (r *releases) get(path string, v interface{}) bool {
+	resp, err := r.client.Get(r.api + path)
+	if err == nil {
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(v)
+		case http.StatusNotFound:
+			return false
+		default:
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		zap.S().Named("wordpress").Warnw("failed to look up the latest releases", "api", r.api, zap.Error(err))
+		r.failed = true
+		return false
+	}
+
+	return true
+}
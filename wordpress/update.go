@@ -0,0 +1,218 @@
+package wordpress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/auth"
+	"github.com/cosmicpanel/CosmicPanel/backups"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/jobs"
+	"github.com/cosmicpanel/CosmicPanel/notify"
+	"github.com/cosmicpanel/CosmicPanel/privsep"
+	"go.uber.org/zap"
+)
+
+// The placeholder in the CLI command standing for the directory of the site
+const pathPlaceholder = "{path}"
+
+// The job sites are updated in
+const updateJob = "wordpress.update"
+
+var (
+	// ErrNoCLI is returned when updating a site without a CLI command configured
+	ErrNoCLI = errors.New("wordpress: updating is turned off as no CLI command is configured")
+
+	// ErrNoOwner is returned when updating a site whose files are not owned by the user
+	// of an account of the panel, which is the only user the CLI runs as
+	ErrNoOwner = errors.New("wordpress: the site is not owned by an account of the panel")
+)
+
+// UpdateRequest is what to update in a site. Nothing at all updates WordPress and every
+// plugin that has a newer release
+type UpdateRequest struct {
+	Core    bool     `json:"core"`
+	Plugins []string `json:"plugins"`
+}
+
+// updatePayload is the payload of the job updating a site
+type updatePayload struct {
+	ID string `json:"id"`
+	UpdateRequest
+}
+
+func init() {
+	notify.Register(notify.Kind{
+		Name:        "wordpress_update_failed",
+		Description: "Sent to an account when updating one of its WordPress sites fails",
+		Fields:      []string{"Path", "Error", "Backup"},
+		Template: notify.Template{
+			Subject: "Updating your WordPress site failed",
+			Body: "Updating the WordPress site in {{.Path}} failed:\n\n  {{.Error}}\n\n" +
+				"{{if .Backup}}Your account was backed up as {{.Backup}} before the update, which your administrator can restore if the site no longer works.\n{{end}}",
+		},
+	})
+}
+
+// registerJobs registers the job updating sites
+func registerJobs() {
+	jobs.Register(updateJob, func(ctx context.Context, j *jobs.Job) error {
+		var p updatePayload
+		if err := j.Decode(&p); err != nil {
+			return err
+		}
+
+		_, err := update(ctx, p)
+		return err
+	})
+}
+
+// Queue updates the site in the background. Updates are not retried, as a site that
+// failed halfway is better looked at than updated again
+func Queue(id string, req UpdateRequest, actor string) (jobs.Job, error) {
+	if std == nil {
+		return jobs.Job{}, ErrNotConfigured
+	}
+
+	if len(std.config.CLI) == 0 {
+		return jobs.Job{}, ErrNoCLI
+	}
+
+	i, err := Get(id)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+
+	// The owner may have changed since the site was scanned
+	if i.Account == "" || owner(i.Path) != i.Account {
+		return jobs.Job{}, ErrNoOwner
+	}
+
+	if !req.Core && len(req.Plugins) == 0 {
+		req.Core = newer(i.Latest, i.Version)
+		for _, p := range i.Plugins {
+			if p.Outdated() {
+				req.Plugins = append(req.Plugins, p.Slug)
+			}
+		}
+
+		if !req.Core && len(req.Plugins) == 0 {
+			return jobs.Job{}, ErrUpToDate
+		}
+	}
+
+	for _, slug := range req.Plugins {
+		if !slices.ContainsFunc(i.Plugins, func(p Plugin) bool { return p.Slug == slug }) {
+			return jobs.Job{}, fmt.Errorf("%w: %s", ErrUnknownPlugin, slug)
+		}
+	}
+
+	return jobs.Enqueue(updateJob, updatePayload{ID: id, UpdateRequest: req}, jobs.Options{Actor: actor, MaxAttempts: 1})
+}
+
+// update backs up the account of the site if configured to and updates the site with the
+// CLI. The site is not touched when the backup fails, and its owner is notified when the
+// update fails
+func update(ctx context.Context, p updatePayload) (Install, error) {
+	before, err := Get(p.ID)
+	if err != nil {
+		return Install{}, err
+	}
+
+	i := before
+	if i.Account == "" || owner(i.Path) != i.Account {
+		return Install{}, ErrNoOwner
+	}
+
+	if std.config.Backup {
+		b, err := backups.Create(ctx, i.Account)
+		if err != nil {
+			return Install{}, fmt.Errorf("wordpress: not updating %s as backing up the account failed: %w", i.Path, err)
+		}
+		i.Backup = b.ID
+	}
+
+	var steps [][]string
+	if p.Core {
+		steps = append(steps, []string{"core", "update"}, []string{"core", "update-db"})
+	}
+	if len(p.Plugins) > 0 {
+		steps = append(steps, append([]string{"plugin", "update"}, p.Plugins...))
+	}
+
+	var failed error
+	for _, args := range steps {
+		if failed = std.cli(ctx, i, args...); failed != nil {
+			break
+		}
+	}
+
+	i.Updated = time.Now().UTC()
+	after, err := rescan(i)
+	if err != nil {
+		return Install{}, errors.Join(failed, err)
+	}
+
+	data := map[string]interface{}{
+		"path":    after.Path,
+		"from":    before.Version,
+		"to":      after.Version,
+		"plugins": p.Plugins,
+		"backup":  after.Backup,
+	}
+	if failed != nil {
+		data["error"] = failed.Error()
+	}
+
+	events.Publish(events.Event{
+		Type:     "wordpress.update",
+		Account:  after.Account,
+		Resource: after.ID,
+		Data:     data,
+	})
+
+	if failed != nil {
+		zap.S().Named("wordpress").Warnw("failed to update WordPress site", "path", after.Path, "account", after.Account, zap.Error(failed))
+		notifyFailed(after, failed)
+		return after, failed
+	}
+
+	zap.S().Named("wordpress").Infow("updated WordPress site", "path", after.Path, "account", after.Account, "version", after.Version)
+
+	return after, nil
+}
+
+// cli runs the CLI command in the site with the arguments as the account owning it,
+// including its output in the error if it fails
+func (t *toolkit) cli(ctx context.Context, i Install, args ...string) error {
+	cmd := make([]string, 0, len(t.config.CLI)+len(args))
+	for _, arg := range t.config.CLI[1:] {
+		cmd = append(cmd, strings.ReplaceAll(arg, pathPlaceholder, i.Path))
+	}
+	cmd = append(cmd, args...)
+
+	out, err := privsep.WP(ctx, i.Account, cmd...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("wp %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// notifyFailed sends the account of the site the notification that updating it failed
+func notifyFailed(i Install, failed error) {
+	for _, u := range auth.Users() {
+		if u.Username != i.Account {
+			continue
+		}
+
+		err := auth.Notify(u, "wordpress_update_failed", map[string]interface{}{"Path": i.Path, "Error": failed.Error(), "Backup": i.Backup})
+		if err != nil {
+			zap.S().Named("wordpress").Warnw("failed to notify account of failed update", "account", i.Account, zap.Error(err))
+		}
+	}
+}
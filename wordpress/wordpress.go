@@ -0,0 +1,340 @@
+package wordpress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmicpanel/CosmicPanel/config"
+	"github.com/cosmicpanel/CosmicPanel/events"
+	"github.com/cosmicpanel/CosmicPanel/store"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotConfigured is returned when using the package before Configure is called
+	ErrNotConfigured = errors.New("wordpress: not configured")
+
+	// ErrNotFound is returned for a site that has not been detected
+	ErrNotFound = errors.New("wordpress: site not found")
+
+	// ErrScanning is returned when scanning while a scan is already running
+	ErrScanning = errors.New("wordpress: a scan is already running")
+
+	// ErrUnknownPlugin is returned when updating a plugin the site does not have
+	ErrUnknownPlugin = errors.New("wordpress: the site does not have the plugin")
+
+	// ErrUpToDate is returned when updating a site that has nothing to update
+	ErrUpToDate = errors.New("wordpress: the site is up to date")
+)
+
+// Install is a WordPress site found in a document root
+type Install struct {
+	ID string `json:"id"`
+
+	// The system user owning the files of the site, which is the username of its account
+	Account string `json:"account"`
+	Path    string `json:"path"`
+
+	// The version of WordPress installed and the latest release, empty when it could not
+	// be looked up
+	Version string `json:"version"`
+	Latest  string `json:"latest,omitempty"`
+
+	Plugins   []Plugin  `json:"plugins"`
+	Hardening Hardening `json:"hardening"`
+
+	Detected time.Time `json:"detected"`
+	Scanned  time.Time `json:"scanned"`
+	Updated  time.Time `json:"updated,omitempty"`
+
+	// The backup of the account taken before the site was last updated
+	Backup string `json:"backup,omitempty"`
+}
+
+// Outdated returns true if WordPress or one of the plugins of the site has a newer release
+func (i Install) Outdated() bool {
+	return newer(i.Latest, i.Version) || slices.ContainsFunc(i.Plugins, Plugin.Outdated)
+}
+
+// Plugin is a plugin installed in a site, whether or not it is activated
+type Plugin struct {
+	// The directory of the plugin, or the name of its file for plugins of a single file,
+	// which is also its slug in the WordPress.org directory
+	Slug    string `json:"slug"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+
+	// The latest release in the WordPress.org directory, empty for plugins that are not
+	// listed there such as commercial ones
+	Latest string `json:"latest,omitempty"`
+}
+
+// Outdated returns true if the plugin has a newer release
+func (p Plugin) Outdated() bool {
+	return newer(p.Latest, p.Version)
+}
+
+// installKind is what detected sites are kept under in the state store
+const installKind = "wordpress.install"
+
+type toolkit struct {
+	config *config.WordPressConfiguration
+
+	// Whether a scan is running, so that scans do not overlap
+	mu       sync.Mutex
+	scanning bool
+}
+
+var std *toolkit
+
+// Configure checks the configuration and registers the job updating sites. The state
+// store must be configured first
+func Configure(c *config.WordPressConfiguration) error {
+	if c.Depth < 0 {
+		return errors.New("wordpress: the depth must not be negative")
+	}
+
+	if len(c.CLI) > 0 && !slices.ContainsFunc(c.CLI, func(arg string) bool { return strings.Contains(arg, pathPlaceholder) }) {
+		return fmt.Errorf("wordpress: the CLI command does not contain %s", pathPlaceholder)
+	}
+
+	// The CLI is run as the owner of the site by the broker, never through runuser or sudo
+	if len(c.CLI) > 0 && filepath.Base(c.CLI[0]) != "wp" {
+		return fmt.Errorf("wordpress: the CLI command must start with wp rather than %s, it is run as the account owning the site", c.CLI[0])
+	}
+
+	std = &toolkit{config: c}
+
+	registerJobs()
+
+	return nil
+}
+
+// Scheduled runs the wordpress task, which scans the document roots for sites
+func Scheduled() error {
+	_, err := Scan()
+
+	return err
+}
+
+// List returns the sites detected in the document roots of the accounts, or of every
+// account if none are given, sorted by path
+func List(accounts ...string) ([]Install, error) {
+	list := []Install{}
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Each(installKind, func(id string, data []byte) error {
+			var i Install
+			if err := json.Unmarshal(data, &i); err != nil {
+				return fmt.Errorf("wordpress: malformed site %s: %w", id, err)
+			}
+
+			if len(accounts) == 0 || slices.Contains(accounts, i.Account) {
+				list = append(list, i)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+
+	return list, nil
+}
+
+// Get returns the site
+func Get(id string) (Install, error) {
+	var i Install
+
+	err := store.View(func(tx *store.Tx) error {
+		return tx.Get(installKind, id, &i)
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Install{}, ErrNotFound
+	}
+
+	return i, err
+}
+
+// Scan finds the sites in the document roots and looks up the latest releases of
+// WordPress and their plugins. Sites that are gone are forgotten
+func Scan() ([]Install, error) {
+	if std == nil {
+		return nil, ErrNotConfigured
+	}
+
+	std.mu.Lock()
+	if std.scanning {
+		std.mu.Unlock()
+		return nil, ErrScanning
+	}
+	std.scanning = true
+	std.mu.Unlock()
+
+	defer func() {
+		std.mu.Lock()
+		std.scanning = false
+		std.mu.Unlock()
+	}()
+
+	found, err := std.detectAll()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := newReleases(std.config.API)
+	for i := range found {
+		latest.resolve(&found[i])
+	}
+
+	before, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]Install, len(before))
+	for _, i := range before {
+		known[i.ID] = i
+	}
+
+	now := time.Now().UTC()
+	err = store.Update(func(tx *store.Tx) error {
+		for i := range found {
+			found[i].Scanned = now
+			if k, ok := known[found[i].ID]; ok {
+				// Releases that could not be looked up this time are kept from the last scan
+				if latest.failed {
+					carryLatest(&found[i], k)
+				}
+				found[i].Detected, found[i].Updated, found[i].Backup = k.Detected, k.Updated, k.Backup
+				delete(known, found[i].ID)
+			} else {
+				found[i].Detected = now
+			}
+
+			if err := tx.Put(installKind, found[i].ID, found[i]); err != nil {
+				return err
+			}
+		}
+
+		for id := range known {
+			if err := tx.Delete(installKind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range found {
+		if i.Detected.Equal(now) {
+			zap.S().Named("wordpress").Infow("WordPress site detected", "path", i.Path, "account", i.Account, "version", i.Version)
+
+			events.Publish(events.Event{
+				Type:     "wordpress.detected",
+				Account:  i.Account,
+				Resource: i.ID,
+				Data:     map[string]interface{}{"path": i.Path, "version": i.Version},
+			})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+
+	return found, nil
+}
+
+// rescan detects the site again after it changed, keeping the latest releases looked up by
+// the last scan and the state the scan does not find on disk
+func rescan(stored Install) (Install, error) {
+	i, err := detect(stored.Path)
+	if err != nil {
+		return Install{}, err
+	}
+
+	carryLatest(&i, stored)
+	i.Detected, i.Updated, i.Backup = stored.Detected, stored.Updated, stored.Backup
+	i.Scanned = time.Now().UTC()
+
+	return i, save(i)
+}
+
+// carryLatest sets the latest releases the site has none for to those of before
+func carryLatest(i *Install, before Install) {
+	if i.Latest == "" {
+		i.Latest = before.Latest
+	}
+
+	latest := make(map[string]string, len(before.Plugins))
+	for _, p := range before.Plugins {
+		latest[p.Slug] = p.Latest
+	}
+	for n := range i.Plugins {
+		if i.Plugins[n].Latest == "" {
+			i.Plugins[n].Latest = latest[i.Plugins[n].Slug]
+		}
+	}
+}
+
+// save stores the site
+func save(i Install) error {
+	return store.Update(func(tx *store.Tx) error {
+		return tx.Put(installKind, i.ID, i)
+	})
+}
+
+// siteID returns the ID of the site in the directory, which stays the same across scans
+func siteID(path string) string {
+	sum := sha256.Sum256([]byte(path))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// newer returns true if version a is a later release than b. Missing parts count as zero,
+// so 6.5 and 6.5.0 are the same release
+func newer(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for n := 0; n < max(len(pa), len(pb)); n++ {
+		var x, y int
+		if n < len(pa) {
+			x, _ = strconv.Atoi(leadingDigits(pa[n]))
+		}
+		if n < len(pb) {
+			y, _ = strconv.Atoi(leadingDigits(pb[n]))
+		}
+		if x != y {
+			return x > y
+		}
+	}
+
+	return false
+}
+
+// leadingDigits returns the number a part of a version starts with, dropping suffixes such
+// as -beta1
+func leadingDigits(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+
+	return s[:end]
+}